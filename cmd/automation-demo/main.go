@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -39,6 +40,10 @@ func main() {
 	deviceService := services.NewDeviceService(mqttClient, kafkaClient)
 	automationService := services.NewAutomationService(motionService, lightService, deviceService, mqttClient, logger)
 
+	// The demo runs until it is killed, so the sensor services are never stopped
+	motionService.Start(context.Background())
+	lightService.Start(context.Background())
+
 	// Add light devices for the demo
 	rooms := []string{"living-room", "kitchen", "bedroom"}
 	for _, roomID := range rooms {
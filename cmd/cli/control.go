@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/plugins"
+	"github.com/johnpr01/home-automation/internal/script"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// apiTimeout bounds a single request to the server's API
+const apiTimeout = 10 * time.Second
+
+// callAPI sends body as JSON to an API endpoint with the admin token, when set, and decodes the
+// JSON response into response unless it is nil
+func callAPI(method, endpoint, adminToken string, body, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	client := &http.Client{Timeout: apiTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// printOutput prints data as indented JSON, or rows as a table under header. An empty table
+// prints the empty message instead.
+func printOutput(format string, data interface{}, empty string, header []string, rows [][]string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+
+	if len(rows) == 0 {
+		fmt.Println(empty)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// validOutput checks the -output flag
+func validOutput(format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown output %q, use table or json", format)
+	}
+	return nil
+}
+
+// runDeviceCommand turns Tasmota and ESPHome devices on or off through the unified gateway.
+// It needs the admin token (HA_ADMIN_TOKEN) or an API session token.
+func runDeviceCommand(server, adminToken, command string, deviceIDs []string, format string) error {
+	if len(deviceIDs) == 0 {
+		return fmt.Errorf("-device is required")
+	}
+
+	action := "turn_on"
+	if command == "device-off" {
+		action = "turn_off"
+	}
+
+	type result struct {
+		DeviceID string `json:"device_id"`
+		Action   string `json:"action"`
+		Error    string `json:"error,omitempty"`
+	}
+	results := make([]result, 0, len(deviceIDs))
+	rows := make([][]string, 0, len(deviceIDs))
+	failed := 0
+	for _, deviceID := range deviceIDs {
+		outcome := "ok"
+		cmd := models.DeviceCommand{DeviceID: deviceID, Action: action}
+		err := callAPI(http.MethodPost, strings.TrimSuffix(server, "/")+"/api/mqtt-devices/command", adminToken, cmd, nil)
+		r := result{DeviceID: deviceID, Action: action}
+		if err != nil {
+			r.Error = err.Error()
+			outcome = err.Error()
+			failed++
+		}
+		results = append(results, r)
+		rows = append(rows, []string{deviceID, action, outcome})
+	}
+
+	if err := printOutput(format, results, "", []string{"DEVICE", "ACTION", "RESULT"}, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("'%s' failed on %d of %d devices", action, failed, len(deviceIDs))
+	}
+	return nil
+}
+
+// runThermostat shows the thermostats, or one with -thermostat, or holds a thermostat at a
+// setpoint. Holds need the admin token (HA_ADMIN_TOKEN) or an API session token.
+func runThermostat(server, adminToken, command, thermostatID string, temp float64, hold, format string) error {
+	base := strings.TrimSuffix(server, "/") + "/api/thermostats"
+
+	if command == "thermostat-set" {
+		if thermostatID == "" || temp == 0 {
+			return fmt.Errorf("-thermostat and -temp are required")
+		}
+		var held models.ThermostatHold
+		endpoint := base + "/hold?thermostat=" + url.QueryEscape(thermostatID)
+		request := models.ThermostatHold{Mode: models.HoldMode(hold), TargetTemp: temp}
+		if err := callAPI(http.MethodPost, endpoint, adminToken, request, &held); err != nil {
+			return err
+		}
+		if format == "json" {
+			return printOutput(format, held, "", nil, nil)
+		}
+		fmt.Printf("Holding %s at %.1f°F (%s)\n", thermostatID, held.TargetTemp, held.Mode)
+		return nil
+	}
+
+	var response struct {
+		Thermostats []models.Thermostat `json:"thermostats"`
+	}
+	if err := callAPI(http.MethodGet, base, adminToken, nil, &response); err != nil {
+		return err
+	}
+
+	thermostats := response.Thermostats
+	if thermostatID != "" {
+		thermostats = nil
+		for _, thermostat := range response.Thermostats {
+			if thermostat.ID == thermostatID {
+				thermostats = append(thermostats, thermostat)
+			}
+		}
+		if len(thermostats) == 0 {
+			return fmt.Errorf("unknown thermostat %s", thermostatID)
+		}
+	}
+
+	rows := make([][]string, 0, len(thermostats))
+	for _, t := range thermostats {
+		online := "online"
+		if !t.IsOnline {
+			online = "offline"
+		}
+		rows = append(rows, []string{t.ID, t.Name, t.RoomID, fmt.Sprintf("%.1f°F", t.CurrentTemp),
+			fmt.Sprintf("%.1f°F", t.TargetTemp), fmt.Sprintf("%.0f%%", t.CurrentHumidity), string(t.Mode), string(t.Status), online})
+	}
+	return printOutput(format, thermostats, "No thermostats",
+		[]string{"ID", "NAME", "ROOM", "CURRENT", "TARGET", "HUMIDITY", "MODE", "STATUS", "ONLINE"}, rows)
+}
+
+// runThermostatFan sets when a thermostat runs its blower. It needs the admin token
+// (HA_ADMIN_TOKEN) or an API session token.
+func runThermostatFan(server, adminToken, thermostatID string, settings models.FanSettings, format string) error {
+	if thermostatID == "" || (settings.Mode == "" && settings.CirculateMinutes == 0) {
+		return fmt.Errorf("-thermostat and -fan or -circulate are required")
+	}
+
+	var response struct {
+		ThermostatID string             `json:"thermostat_id"`
+		Fan          models.FanSettings `json:"fan"`
+	}
+	endpoint := strings.TrimSuffix(server, "/") + "/api/thermostats/fan?thermostat=" + url.QueryEscape(thermostatID)
+	if err := callAPI(http.MethodPost, endpoint, adminToken, settings, &response); err != nil {
+		return err
+	}
+	if format == "json" {
+		return printOutput(format, response, "", nil, nil)
+	}
+	switch response.Fan.Mode {
+	case models.FanCirculate:
+		minutes := response.Fan.CirculateMinutes
+		if minutes == 0 {
+			minutes = models.DefaultCirculateMinutes
+		}
+		fmt.Printf("Fan of %s circulating %d minutes an hour\n", thermostatID, minutes)
+	case "":
+		fmt.Printf("Fan of %s set to %s\n", thermostatID, models.FanAuto)
+	default:
+		fmt.Printf("Fan of %s set to %s\n", thermostatID, response.Fan.Mode)
+	}
+	return nil
+}
+
+// runRules lists the alert rules of the unified gateway with their firing alerts, or turns a
+// rule on or off until the gateway restarts. Changes need the admin token (HA_ADMIN_TOKEN) or
+// an API session token.
+func runRules(server, adminToken, command, ruleID, format string) error {
+	base := strings.TrimSuffix(server, "/") + "/api/alerts"
+
+	if command == "rule-enable" || command == "rule-disable" {
+		if ruleID == "" {
+			return fmt.Errorf("-rule is required")
+		}
+		enabled := command == "rule-enable"
+		query := url.Values{"rule": {ruleID}, "enabled": {fmt.Sprint(enabled)}}
+		if err := callAPI(http.MethodPost, base+"/rules/enable?"+query.Encode(), adminToken, nil, nil); err != nil {
+			return err
+		}
+		if enabled {
+			fmt.Printf("Enabled rule %s\n", ruleID)
+		} else {
+			fmt.Printf("Disabled rule %s\n", ruleID)
+		}
+		return nil
+	}
+
+	var response struct {
+		Rules  []services.AlertRule `json:"rules"`
+		Active []services.Alert     `json:"active"`
+	}
+	if err := callAPI(http.MethodGet, base, adminToken, nil, &response); err != nil {
+		return err
+	}
+
+	firing := make(map[string]int)
+	for _, alert := range response.Active {
+		firing[alert.RuleID]++
+	}
+	rows := make([][]string, 0, len(response.Rules))
+	for _, rule := range response.Rules {
+		state := "enabled"
+		if rule.Disabled {
+			state = "disabled"
+		}
+		subjects := strings.Join(rule.Subjects, ",")
+		if subjects == "" {
+			subjects = "all"
+		}
+		rows = append(rows, []string{rule.ID, rule.Name, rule.Metric, rule.Severity, subjects, state, fmt.Sprint(firing[rule.ID])})
+	}
+	return printOutput(format, response.Rules, "No alert rules",
+		[]string{"ID", "NAME", "METRIC", "SEVERITY", "SUBJECTS", "STATE", "FIRING"}, rows)
+}
+
+// runScripts lists the scripted automations of the unified gateway with where their conditions
+// stand, evaluates an expression against the home, or turns a rule on or off until the gateway
+// restarts. Changes need the admin token (HA_ADMIN_TOKEN) or an API session token.
+func runScripts(server, adminToken, command, ruleID, expression, format string) error {
+	base := strings.TrimSuffix(server, "/") + "/api/scripts"
+
+	switch command {
+	case "script-enable", "script-disable":
+		if ruleID == "" {
+			return fmt.Errorf("-rule is required")
+		}
+		enabled := command == "script-enable"
+		query := url.Values{"rule": {ruleID}, "enabled": {fmt.Sprint(enabled)}}
+		if err := callAPI(http.MethodPost, base+"/enable?"+query.Encode(), adminToken, nil, nil); err != nil {
+			return err
+		}
+		if enabled {
+			fmt.Printf("Enabled script rule %s\n", ruleID)
+		} else {
+			fmt.Printf("Disabled script rule %s\n", ruleID)
+		}
+		return nil
+	case "script-eval":
+		if expression == "" {
+			return fmt.Errorf("-expr is required")
+		}
+		var response struct {
+			Value interface{} `json:"value"`
+		}
+		if err := callAPI(http.MethodPost, base+"/eval", adminToken, services.ScriptEvalRequest{Expression: expression}, &response); err != nil {
+			return err
+		}
+		fmt.Println(script.Format(response.Value))
+		return nil
+	}
+
+	var status services.ScriptStatus
+	if err := callAPI(http.MethodGet, base, adminToken, nil, &status); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(status.Rules))
+	for _, rule := range status.Rules {
+		state := "waiting"
+		switch {
+		case rule.Disabled:
+			state = "disabled"
+		case rule.Error != "":
+			state = "failing"
+		case rule.Active:
+			state = "active"
+		case rule.Pending != nil:
+			state = "pending"
+		}
+		lastRun := "-"
+		if rule.LastRun != nil {
+			lastRun = rule.LastRun.Local().Format("2006-01-02 15:04")
+		}
+		rows = append(rows, []string{rule.ID, rule.Name, rule.When, state, fmt.Sprint(rule.Runs), lastRun})
+	}
+	return printOutput(format, status.Rules, "No script rules",
+		[]string{"ID", "NAME", "WHEN", "STATE", "RUNS", "LAST RUN"}, rows)
+}
+
+// runHistory prints a room's or device's downsampled history of a metric, with a sparkline
+func runHistory(server, adminToken, metric, room, device, from, resolution, format string) error {
+	query := url.Values{"from": {from}}
+	switch {
+	case room != "" && device != "":
+		return fmt.Errorf("use either -room or -device")
+	case room != "":
+		query.Set("room", room)
+	case device != "":
+		query.Set("device", device)
+	default:
+		return fmt.Errorf("-room or -device is required")
+	}
+	if resolution != "" {
+		query.Set("resolution", resolution)
+	}
+
+	var series services.HistorySeries
+	endpoint := strings.TrimSuffix(server, "/") + services.HistoryPath + url.PathEscape(metric) + "?" + query.Encode()
+	if err := callAPI(http.MethodGet, endpoint, adminToken, nil, &series); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(series.Points))
+	values := make([]float64, 0, len(series.Points))
+	for _, point := range series.Points {
+		rows = append(rows, []string{point.Time.Local().Format("2006-01-02 15:04"), fmt.Sprintf("%.1f %s", point.Value, series.Unit)})
+		values = append(values, point.Value)
+	}
+	if format != "json" && len(values) > 0 {
+		fmt.Printf("%s of %s%s, %s %s: %s\n\n", metric, room, device, series.Resolution, series.Aggregate, sparkline(values))
+	}
+	return printOutput(format, series, "No history in this range", []string{"TIME", strings.ToUpper(metric)}, rows)
+}
+
+// sparkline draws values as a line of block characters scaled between their minimum and maximum
+func sparkline(values []float64) string {
+	blocks := []rune("▁▂▃▄▅▆▇█")
+	low, high := values[0], values[0]
+	for _, value := range values {
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	line := make([]rune, len(values))
+	for i, value := range values {
+		level := 0
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(blocks)-1))
+		}
+		line[i] = blocks[level]
+	}
+	return string(line)
+}
+
+// listAssets prints the network asset inventory of the unified gateway, filtered by room
+func listAssets(server, room, format string) error {
+	query := url.Values{}
+	if room != "" {
+		query.Set("room", room)
+	}
+
+	var assets []discovery.InventoryEntry
+	if err := callAPI(http.MethodGet, strings.TrimSuffix(server, "/")+"/api/assets?"+query.Encode(), "", nil, &assets); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(assets))
+	for _, asset := range assets {
+		rows = append(rows, []string{asset.ID, asset.Name, string(asset.Type), asset.Room, asset.IPAddress,
+			asset.Status, asset.LastSeen.Format("2006-01-02 15:04")})
+	}
+	return printOutput(format, assets, "No assets found",
+		[]string{"ID", "NAME", "TYPE", "ROOM", "IP", "STATUS", "LAST SEEN"}, rows)
+}
+
+// watchSensors prints the room sensor readings published on the broker as they arrive, until
+// interrupted. JSON output is one object per line.
+func watchSensors(cfg *config.Config, room, format string) error {
+	broker := mqtt.NewClient(&cfg.MQTT, &mqtt.ClientOptions{ReadOnly: true})
+	if err := broker.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+	}
+	defer broker.Disconnect()
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(os.Stdout)
+	show := func(topic string, payload []byte) error {
+		kind, roomID, _ := strings.Cut(topic, "/")
+		now := time.Now()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if format == "json" {
+			reading := json.RawMessage(payload)
+			if !json.Valid(payload) {
+				reading, _ = json.Marshal(string(payload))
+			}
+			return encoder.Encode(map[string]interface{}{
+				"time":    now,
+				"topic":   topic,
+				"room":    roomID,
+				"reading": reading,
+			})
+		}
+		fmt.Printf("%s  %-14s %-14s %s\n", now.Format("15:04:05"), roomID, strings.TrimPrefix(kind, "room-"), formatReading(payload))
+		return nil
+	}
+
+	for _, filter := range mqtt.SensorTopics {
+		if room != "" {
+			root, _, _ := strings.Cut(filter, "/")
+			filter = mqtt.RoomTopic(root, room)
+		}
+		if err := broker.Subscribe(filter, show); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Watching sensor readings, press Ctrl-C to stop")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	return nil
+}
+
+// formatReading shows a sensor payload as its fields, e.g. "temperature=68.5 temp_unit=F",
+// leaving out the device and timestamp fields every reading carries
+func formatReading(payload []byte) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return string(payload)
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "device_id" && key != "timestamp" && key != "room" && fields[key] != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", key, fields[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// runOTA lists the Pico firmware releases and versions, or rolls an update out to Picos or back.
+// Updates need the admin token (HA_ADMIN_TOKEN).
+func runOTA(server, adminToken, command, version string, deviceIDs []string, format string) error {
+	base := strings.TrimSuffix(server, "/") + "/api/ota"
+
+	if command == "ota-rollout" || command == "ota-rollback" {
+		request := map[string]interface{}{"devices": deviceIDs}
+		endpoint := base + "/rollback"
+		if command == "ota-rollout" {
+			if version == "" {
+				return fmt.Errorf("-firmware is required")
+			}
+			request["version"] = version
+			endpoint = base + "/rollout"
+		} else if len(deviceIDs) == 0 {
+			return fmt.Errorf("-device is required")
+		}
+
+		var response struct {
+			Devices []string `json:"devices"`
+		}
+		if err := callAPI(http.MethodPost, endpoint, adminToken, request, &response); err != nil {
+			return err
+		}
+		if len(response.Devices) == 0 {
+			fmt.Println("Every Pico already runs that firmware")
+			return nil
+		}
+		fmt.Printf("Sent the update to %s, follow it with -cmd ota\n", strings.Join(response.Devices, ", "))
+		return nil
+	}
+
+	var response struct {
+		Releases []services.FirmwareRelease `json:"releases"`
+		Devices  []services.PicoFirmware    `json:"devices"`
+	}
+	if err := callAPI(http.MethodGet, base, adminToken, nil, &response); err != nil {
+		return err
+	}
+	if format == "json" {
+		return printOutput(format, response, "", nil, nil)
+	}
+
+	releases := make([]string, 0, len(response.Releases))
+	for _, release := range response.Releases {
+		releases = append(releases, release.Version)
+	}
+	if len(releases) > 0 {
+		fmt.Printf("Releases: %s\n\n", strings.Join(releases, ", "))
+	}
+	rows := make([][]string, 0, len(response.Devices))
+	for _, device := range response.Devices {
+		update := device.State
+		if device.Target != "" && device.State != "" {
+			update = fmt.Sprintf("%s %s", device.State, device.Target)
+		}
+		if device.Error != "" {
+			update += ": " + device.Error
+		}
+		rows = append(rows, []string{device.DeviceID, device.RoomID, device.Version, device.PreviousVersion, update,
+			device.LastSeen.Format("2006-01-02 15:04")})
+	}
+	return printOutput(format, response.Devices, "No Pico has reported its firmware version",
+		[]string{"DEVICE", "ROOM", "VERSION", "PREVIOUS", "UPDATE", "LAST SEEN"}, rows)
+}
+
+// runPlugins lists the plugins, or restarts, enables or disables one. Changes need the admin
+// token (HA_ADMIN_TOKEN).
+func runPlugins(server, adminToken, command, name, format string) error {
+	base := strings.TrimSuffix(server, "/") + "/api/plugins"
+
+	if command != "plugins" {
+		if name == "" {
+			return fmt.Errorf("-name is required")
+		}
+		query := url.Values{"name": {name}}
+		endpoint := base + "/restart"
+		if command != "plugin-restart" {
+			query.Set("enabled", strconv.FormatBool(command == "plugin-enable"))
+			endpoint = base + "/enable"
+		}
+		if err := callAPI(http.MethodPost, endpoint+"?"+query.Encode(), adminToken, nil, nil); err != nil {
+			return err
+		}
+		progress := map[string]string{"plugin-restart": "restarting", "plugin-enable": "starting", "plugin-disable": "stopping"}
+		fmt.Printf("Plugin %s is %s, follow it with -cmd plugins\n", name, progress[command])
+		return nil
+	}
+
+	var response struct {
+		Plugins []plugins.Status `json:"plugins"`
+	}
+	if err := callAPI(http.MethodGet, base, adminToken, nil, &response); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(response.Plugins))
+	for _, plugin := range response.Plugins {
+		state := plugin.State
+		if plugin.State == plugins.StateRunning && !plugin.Online {
+			state += " (not online)"
+		}
+		detail := plugin.Error
+		if detail == "" && plugin.LastExit != "" {
+			detail = "last " + plugin.LastExit
+		}
+		rows = append(rows, []string{plugin.Name, plugin.Version, state, strconv.Itoa(plugin.Restarts),
+			strconv.Itoa(plugin.Devices), strings.Join(plugin.Actions, ","), detail})
+	}
+	return printOutput(format, response.Plugins, "No plugins are installed",
+		[]string{"PLUGIN", "VERSION", "STATE", "RESTARTS", "DEVICES", "ACTIONS", "DETAIL"}, rows)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Terminal control sequences of the dashboard
+const (
+	clearScreen = "\033[H\033[2J"
+	hideCursor  = "\033[?25l"
+	showCursor  = "\033[?25h"
+)
+
+// dashboardStale is how long a room or plug can be silent before the dashboard marks it stale
+const dashboardStale = 10 * time.Minute
+
+// roomPanel is what the dashboard knows of a room from its sensor readings
+type roomPanel struct {
+	Temperature *float64
+	Humidity    *float64
+	Motion      *bool
+	MotionSince time.Time
+	LightLevel  *float64
+	LightState  string
+	Updated     time.Time
+}
+
+// plugPanel is the last energy reading of a Tapo plug
+type plugPanel struct {
+	Name    string
+	RoomID  string
+	PowerW  float64
+	IsOn    bool
+	Updated time.Time
+}
+
+// dashboard holds the live state of the home shown by the dashboard command. Room and plug
+// readings arrive over MQTT; thermostats are polled from the unified gateway.
+type dashboard struct {
+	mu          sync.Mutex
+	room        string
+	rooms       map[string]*roomPanel
+	plugs       map[string]*plugPanel
+	thermostats []models.Thermostat
+	pollErr     error
+	polled      time.Time
+}
+
+func newDashboard(room string) *dashboard {
+	return &dashboard{
+		room:  room,
+		rooms: make(map[string]*roomPanel),
+		plugs: make(map[string]*plugPanel),
+	}
+}
+
+// handleRoom records a room sensor reading
+func (d *dashboard) handleRoom(topic string, payload []byte) error {
+	var reading services.UnifiedSensorMessage
+	if err := json.Unmarshal(payload, &reading); err != nil {
+		return nil
+	}
+	kind, roomID, _ := strings.Cut(topic, "/")
+	if roomID == "" {
+		roomID = reading.Room
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	room, ok := d.rooms[roomID]
+	if !ok {
+		room = &roomPanel{}
+		d.rooms[roomID] = room
+	}
+	switch kind {
+	case mqtt.TopicRoomTemperature:
+		temp := reading.Temperature
+		room.Temperature = &temp
+	case mqtt.TopicRoomHumidity:
+		humidity := reading.Humidity
+		room.Humidity = &humidity
+	case mqtt.TopicRoomMotion:
+		if reading.Motion == nil {
+			return nil
+		}
+		if room.Motion == nil || *room.Motion != *reading.Motion {
+			room.MotionSince = now
+		}
+		room.Motion = reading.Motion
+	case mqtt.TopicRoomLight:
+		if reading.LightPercent != nil {
+			room.LightLevel = reading.LightPercent
+		}
+		room.LightState = reading.LightState
+	default:
+		return nil
+	}
+	room.Updated = now
+	return nil
+}
+
+// handlePlug records a Tapo energy reading
+func (d *dashboard) handlePlug(topic string, payload []byte) error {
+	var reading struct {
+		DeviceID   string  `json:"device_id"`
+		DeviceName string  `json:"device_name"`
+		RoomID     string  `json:"room_id"`
+		PowerW     float64 `json:"power_w"`
+		IsOn       bool    `json:"is_on"`
+	}
+	if err := json.Unmarshal(payload, &reading); err != nil || reading.DeviceID == "" {
+		return nil
+	}
+	if d.room != "" && reading.RoomID != d.room {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.plugs[reading.DeviceID] = &plugPanel{
+		Name:    reading.DeviceName,
+		RoomID:  reading.RoomID,
+		PowerW:  reading.PowerW,
+		IsOn:    reading.IsOn,
+		Updated: time.Now(),
+	}
+	return nil
+}
+
+// poll fetches the thermostats from the unified gateway. A failed poll is shown on the
+// dashboard rather than ending it.
+func (d *dashboard) poll(server, adminToken string) {
+	var response struct {
+		Thermostats []models.Thermostat `json:"thermostats"`
+	}
+	err := callAPI(http.MethodGet, strings.TrimSuffix(server, "/")+"/api/thermostats", adminToken, nil, &response)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pollErr = err
+	if err != nil {
+		return
+	}
+	d.thermostats = d.thermostats[:0]
+	for _, thermostat := range response.Thermostats {
+		if d.room == "" || thermostat.RoomID == d.room {
+			d.thermostats = append(d.thermostats, thermostat)
+		}
+	}
+	d.polled = time.Now()
+}
+
+// render draws the dashboard as of now
+func (d *dashboard) render(out io.Writer, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fmt.Fprintf(out, "Home automation  %s", now.Format("2006-01-02 15:04:05"))
+	if d.room != "" {
+		fmt.Fprintf(out, "  room %s", d.room)
+	}
+	fmt.Fprint(out, "\n\n")
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOM\tTEMP\tHUMIDITY\tOCCUPANCY\tLIGHT\tUPDATED")
+	if len(d.rooms) == 0 {
+		fmt.Fprintln(w, "waiting for sensor readings\t\t\t\t\t")
+	}
+	for _, roomID := range sortedKeys(d.rooms) {
+		room := d.rooms[roomID]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", roomID,
+			optional(room.Temperature, "%.1f°F"), optional(room.Humidity, "%.0f%%"),
+			occupancy(room, now), light(room), age(room.Updated, now))
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "THERMOSTAT\tROOM\tCURRENT\tTARGET\tMODE\tSTATUS")
+	switch {
+	case d.polled.IsZero() && d.pollErr == nil:
+		fmt.Fprintln(w, "loading\t\t\t\t\t")
+	case !d.polled.IsZero() && len(d.thermostats) == 0:
+		fmt.Fprintln(w, "none\t\t\t\t\t")
+	}
+	for _, t := range d.thermostats {
+		status := string(t.Status)
+		if !t.IsOnline {
+			status = "offline"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f°F\t%.1f°F\t%s\t%s\n", displayName(t.Name, t.ID), t.RoomID, t.CurrentTemp, t.TargetTemp, t.Mode, status)
+	}
+	w.Flush()
+	if d.pollErr != nil {
+		fmt.Fprintf(out, "Thermostats unavailable: %v\n", d.pollErr)
+	}
+	fmt.Fprintln(out)
+
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLUG\tROOM\tPOWER\tSTATE\tUPDATED")
+	total := 0.0
+	for _, deviceID := range sortedKeys(d.plugs) {
+		plug := d.plugs[deviceID]
+		state := "off"
+		if plug.IsOn {
+			state = "on"
+		}
+		if now.Sub(plug.Updated) < dashboardStale {
+			total += plug.PowerW
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f W\t%s\t%s\n", displayName(plug.Name, deviceID), plug.RoomID, plug.PowerW, state, age(plug.Updated, now))
+	}
+	if len(d.plugs) == 0 {
+		fmt.Fprintln(w, "waiting for energy readings\t\t\t\t")
+	} else {
+		fmt.Fprintf(w, "total\t\t%.1f W\t\t\n", total)
+	}
+	w.Flush()
+
+	fmt.Fprint(out, "\nPress Ctrl-C to quit\n")
+}
+
+// runDashboard shows live room readings, thermostats and Tapo power draw in the terminal until
+// interrupted, redrawing every refresh
+func runDashboard(cfg *config.Config, server, adminToken, room string, refresh time.Duration) error {
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("the dashboard needs a terminal, use sensors-watch to log readings")
+	}
+	if refresh <= 0 {
+		refresh = 2 * time.Second
+	}
+
+	broker := mqtt.NewClient(&cfg.MQTT, &mqtt.ClientOptions{ReadOnly: true})
+	if err := broker.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+	}
+	defer broker.Disconnect()
+
+	board := newDashboard(room)
+	filters := []string{mqtt.TopicRoomTemperature, mqtt.TopicRoomHumidity, mqtt.TopicRoomMotion, mqtt.TopicRoomLight}
+	for _, root := range filters {
+		filter := mqtt.RoomTopic(root, "+")
+		if room != "" {
+			filter = mqtt.RoomTopic(root, room)
+		}
+		if err := broker.Subscribe(filter, board.handleRoom); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+		}
+	}
+	if err := broker.Subscribe(mqtt.TapoEnergyTopic("+"), board.handlePlug); err != nil {
+		return fmt.Errorf("failed to subscribe to Tapo energy readings: %w", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	fmt.Print(hideCursor)
+	defer fmt.Print(showCursor)
+
+	// Thermostats change slowly, so they're polled at most every 10 seconds
+	pollEvery := 10 * time.Second
+	if refresh > pollEvery {
+		pollEvery = refresh
+	}
+	var lastPoll time.Time
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		if time.Since(lastPoll) >= pollEvery {
+			board.poll(server, adminToken)
+			lastPoll = time.Now()
+		}
+
+		var screen strings.Builder
+		board.render(&screen, time.Now())
+		fmt.Print(clearScreen + screen.String())
+
+		select {
+		case <-signals:
+			fmt.Print(clearScreen)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sortedKeys returns the keys of a dashboard panel map in order
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// optional formats a reading the room has reported, or a dash
+func optional(value *float64, format string) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *value)
+}
+
+// occupancy shows whether a room's motion sensor sees anyone, and for how long
+func occupancy(room *roomPanel, now time.Time) string {
+	if room.Motion == nil {
+		return "-"
+	}
+	state := "vacant"
+	if *room.Motion {
+		state = "occupied"
+	}
+	return fmt.Sprintf("%s %s", state, now.Sub(room.MotionSince).Round(time.Second))
+}
+
+// light shows a room's light level and state
+func light(room *roomPanel) string {
+	switch {
+	case room.LightLevel == nil && room.LightState == "":
+		return "-"
+	case room.LightLevel == nil:
+		return room.LightState
+	}
+	return strings.TrimSpace(fmt.Sprintf("%.0f%% %s", *room.LightLevel, room.LightState))
+}
+
+// age shows how long ago a reading arrived, marking readings older than dashboardStale
+func age(updated, now time.Time) string {
+	since := now.Sub(updated).Round(time.Second)
+	if since >= dashboardStale {
+		return fmt.Sprintf("%s ago, stale", since)
+	}
+	return fmt.Sprintf("%s ago", since)
+}
+
+// displayName prefers a device's name over its ID
+func displayName(name, id string) string {
+	if name == "" {
+		return id
+	}
+	return name
+}
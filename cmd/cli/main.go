@@ -1,28 +1,853 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/access"
+	"github.com/johnpr01/home-automation/internal/buildinfo"
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/migrate"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/influxdb"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 func main() {
+	cfg := config.Load()
+
 	var (
-		command = flag.String("cmd", "", "Command to execute (status, devices, sensors)")
-		//device  = flag.String("device", "", "Device ID")
+		command  = flag.String("cmd", "", "Command to execute (status, version, dashboard, devices, device-on, device-off, sensors, sensors-watch, thermostat, thermostat-set, thermostat-fan, rules, rule-enable, rule-disable, assets, identities, claim, device-set, device-merge, device-delete, asset, inventory, warranties, mqtt-keys, mqtt-key-rotate, dry-run, safe-mode, safe-mode-enter, safe-mode-exit, safe-mode-enable, safe-mode-disable, scenes, scene-capture, scene-recall, scene-delete, room-rename, log-levels, log-level, logs, sessions, session-create, session-revoke, access-log, ota, ota-rollout, ota-rollback, plugins, plugin-restart, plugin-enable, plugin-disable, scripts, script-enable, script-disable, script-eval, history)")
+		target   = flag.String("target", "", "Safe mode target to enable or disable (e.g. thermostat, automation:motion-light-kitchen)")
+		stateDir = flag.String("state-dir", cfg.StateDir, "Directory holding the shared service state")
+		limit    = flag.Int("limit", 20, "Number of dry-run traces to show")
+		name     = flag.String("name", "", "Device name to claim or set, scene name or plugin name")
+		tag      = flag.String("tag", "", "Only list devices or sensors carrying this tag (e.g. holiday-lights), or the comma-separated tags device-set gives")
+		room     = flag.String("room", "", "Only list devices or sensors in this room, the room to rename, or the room device-set moves a device to")
+		icon     = flag.String("icon", "", "Dashboard icon device-set gives a device (e.g. 💡)")
+		newRoom  = flag.String("to", "", "New ID of the room to rename")
+		preview  = flag.Bool("preview", false, "Show what room-rename would change without changing anything")
+		server   = flag.String("server", "http://localhost:"+cfg.Port, "Home automation server URL (for scenes, the unified debug address or Tapo scraper)")
+		aliases  = flag.String("alias", "", "Comma-separated kind=value aliases to claim (e.g. mac=aa:bb:cc:dd:ee:ff,mqtt_device_id=pico-kitchen); device-merge merges the second device into the first")
+		topic    = flag.String("topic", "", "MQTT topic filter to generate a payload key for (e.g. home-automation/#)")
+		keyFile  = flag.String("key-file", cfg.MQTT.KeyFile, "MQTT payload key file")
+		devices  = flag.String("device", "", "Comma-separated device IDs to switch, to capture in a scene or to update")
+		logComp  = flag.String("component", "", "Log component to change or show (e.g. mqtt, tapo, discovery, automation)")
+		logLevel = flag.String("level", "", "Log level to set (debug, info, warn, error, default), or the minimum level of logs to show")
+		days     = flag.Int("days", cfg.WarrantyReminderDays, "Days ahead to list warranties ending")
+		session  = flag.String("session", "", "API session ID to revoke, or whose access to show")
+		expires  = flag.Int("expires-days", 0, "Days until a created API session expires (0 never expires)")
+		role     = flag.String("role", access.DefaultRole, "Role of a created API session: read_only, resident or admin")
+		output   = flag.String("output", "table", "Output of devices, sensors, thermostats, rules and assets: table or json")
+		thermo   = flag.String("thermostat", "", "Thermostat ID to show or set")
+		temp     = flag.Float64("temp", 0, "Setpoint in °F to hold the thermostat at")
+		hold     = flag.String("hold", string(models.HoldNextBlock), "How long thermostat-set holds: next_block or permanent")
+		fan      = flag.String("fan", "", "Fan mode thermostat-fan sets: auto, on or circulate")
+		circ     = flag.Int("circulate", 0, "Minutes an hour the circulate fan mode runs the blower (default 15)")
+		rule     = flag.String("rule", "", "Alert or script rule ID to enable or disable")
+		expr     = flag.String("expr", "", "Expression script-eval evaluates (e.g. 'temp(\"bedroom\") > 78')")
+		metric   = flag.String("metric", "temperature", "Metric history shows: temperature, humidity or power")
+		from     = flag.String("from", "24h", "Start of the history shown: an RFC 3339 time or how long ago (e.g. 6h, 7d)")
+		resolut  = flag.String("resolution", "", "Step history is downsampled to (e.g. 5m); picked to suit the range when empty")
+		firmware = flag.String("firmware", "", "Pico firmware version ota-rollout installs (e.g. 1.2.0)")
+		refresh  = flag.Duration("refresh", 2*time.Second, "How often the dashboard redraws")
+		asset    identity.Asset
 		//action  = flag.String("action", "", "Action to perform")
 	)
+	flag.StringVar(&asset.Manufacturer, "manufacturer", "", "Asset manufacturer")
+	flag.StringVar(&asset.Model, "model", "", "Asset model")
+	flag.StringVar(&asset.SerialNumber, "serial", "", "Asset serial number")
+	flag.StringVar(&asset.PurchaseDate, "purchased", "", "Asset purchase date (YYYY-MM-DD)")
+	flag.Float64Var(&asset.PurchasePrice, "price", 0, "Asset purchase price")
+	flag.IntVar(&asset.WarrantyMonths, "warranty-months", 0, "Asset warranty length in months")
+	flag.StringVar(&asset.ManualURL, "manual", "", "Asset manual URL or path")
+	flag.StringVar(&asset.Notes, "notes", "", "Asset notes, e.g. where it is fitted")
 	flag.Parse()
 
+	if err := validOutput(*output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	switch *command {
 	case "status":
 		fmt.Println("Home automation system status: OK")
-	case "devices":
-		fmt.Println("Listing devices...")
-	case "sensors":
-		fmt.Println("Listing sensors...")
+	case "version":
+		fmt.Println(buildinfo.Get("cli", nil))
+	case "devices", "sensors":
+		if err := listItems(*server, *command, *tag, *room, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "device-on", "device-off":
+		if err := runDeviceCommand(*server, cfg.AdminToken, *command, models.ParseTags(*devices), *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "dashboard":
+		if err := runDashboard(cfg, *server, cfg.AdminToken, *room, *refresh); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "sensors-watch":
+		if err := watchSensors(cfg, *room, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "thermostat", "thermostat-set":
+		if err := runThermostat(*server, cfg.AdminToken, *command, *thermo, *temp, *hold, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "thermostat-fan":
+		settings := models.FanSettings{Mode: models.FanMode(*fan), CirculateMinutes: *circ}
+		if err := runThermostatFan(*server, cfg.AdminToken, *thermo, settings, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "rules", "rule-enable", "rule-disable":
+		if err := runRules(*server, cfg.AdminToken, *command, *rule, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "scripts", "script-enable", "script-disable", "script-eval":
+		if err := runScripts(*server, cfg.AdminToken, *command, *rule, *expr, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "history":
+		if err := runHistory(*server, cfg.AdminToken, *metric, *room, *devices, *from, *resolut, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "assets":
+		if err := listAssets(*server, *room, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "identities", "claim", "device-set", "device-merge", "device-delete":
+		if err := runIdentities(*command, *name, *aliases, *room, *icon, *tag, *stateDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "asset", "inventory", "warranties":
+		if err := runAssets(*command, *aliases, asset, *days, *stateDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "mqtt-keys", "mqtt-key-rotate":
+		if err := runMQTTKeys(*command, *topic, *keyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "dry-run":
+		if err := showDryRunTraces(*stateDir, *limit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "safe-mode", "safe-mode-enter", "safe-mode-exit", "safe-mode-enable", "safe-mode-disable":
+		if err := runSafeMode(*command, *target, *stateDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "scenes", "scene-capture", "scene-recall", "scene-delete":
+		selection := models.SceneSelection{DeviceIDs: models.ParseTags(*devices), Tag: *tag, RoomID: *room}
+		if err := runScenes(*server, cfg.AdminToken, *command, *name, selection); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "room-rename":
+		if err := runRoomRename(cfg, *room, *newRoom, *stateDir, *preview); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "log-levels", "log-level", "logs":
+		if err := runLogs(*server, cfg.AdminToken, *command, *logComp, *logLevel, *limit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "sessions", "session-create", "session-revoke", "access-log":
+		if err := runSessions(*server, cfg.AdminToken, *command, *name, *role, *session, *expires, *limit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "ota", "ota-rollout", "ota-rollback":
+		if err := runOTA(*server, cfg.AdminToken, *command, *firmware, models.ParseTags(*devices), *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "plugins", "plugin-restart", "plugin-enable", "plugin-disable":
+		if err := runPlugins(*server, cfg.AdminToken, *command, *name, *output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	default:
-		fmt.Println("Usage: home-automation-cli -cmd [status|devices|sensors]")
+		fmt.Println("Usage: home-automation-cli -cmd [status|version|dashboard|devices|device-on|device-off|sensors|sensors-watch|thermostat|thermostat-set|rules|rule-enable|rule-disable|assets|identities|claim|device-set|device-merge|device-delete|asset|inventory|warranties|mqtt-keys|mqtt-key-rotate|dry-run|safe-mode|safe-mode-enter|safe-mode-exit|safe-mode-enable|safe-mode-disable|scenes|scene-capture|scene-recall|scene-delete|room-rename|log-levels|log-level|logs|sessions|session-create|session-revoke|access-log|ota|ota-rollout|ota-rollback|plugins|plugin-restart|plugin-enable|plugin-disable|scripts|script-enable|script-disable|script-eval|history] [-target name] [-tag tag] [-room room] [-device id,...] [-name name -alias kind=value,...] [-alias kind=value -name name -room room -icon icon -tag a,b] [-alias kind=value -purchased date -warranty-months n ...] [-days n] [-topic filter] [-room old -to new [-preview]] [-component name -level level] [-name name -role role -expires-days n] [-session id] [-thermostat id -temp f -hold mode] [-rule id] [-expr expression] [-metric name -room room|-device id -from 24h -resolution 5m] [-firmware version] [-name plugin] [-output table|json] [-refresh 2s]")
 		os.Exit(1)
 	}
 }
+
+// listItems prints the devices or sensors known to the server, filtered by tag and room
+func listItems(server, kind, tag, room, format string) error {
+	query := url.Values{}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	if room != "" {
+		query.Set("room", room)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/%s?%s", strings.TrimSuffix(server, "/"), kind, query.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	var items []struct {
+		ID     string   `json:"id"`
+		Name   string   `json:"name"`
+		Type   string   `json:"type"`
+		RoomID string   `json:"room_id"`
+		Tags   []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+
+	rows := make([][]string, 0, len(items))
+	for _, item := range items {
+		rows = append(rows, []string{item.ID, item.Name, item.Type, item.RoomID, strings.Join(item.Tags, ",")})
+	}
+	return printOutput(format, items, fmt.Sprintf("No %s found", kind), []string{"ID", "NAME", "TYPE", "ROOM", "TAGS"}, rows)
+}
+
+// runSafeMode inspects or changes the safe mode state shared with the running services
+func runSafeMode(command, target, stateDir string) error {
+	controller := safemode.NewController(safemode.StatePath(stateDir), nil)
+	if err := controller.Reload(); err != nil {
+		return err
+	}
+
+	switch command {
+	case "safe-mode-enter":
+		if err := controller.Enter("entered from CLI"); err != nil {
+			return err
+		}
+	case "safe-mode-exit":
+		if err := controller.Exit(); err != nil {
+			return err
+		}
+	case "safe-mode-enable":
+		if target == "" {
+			return fmt.Errorf("-target is required")
+		}
+		if err := controller.Enable(target); err != nil {
+			return err
+		}
+	case "safe-mode-disable":
+		if target == "" {
+			return fmt.Errorf("-target is required")
+		}
+		if err := controller.Disable(target); err != nil {
+			return err
+		}
+	}
+
+	printSafeModeState(controller.GetState())
+	return nil
+}
+
+// printSafeModeState prints the safe mode state in a human readable form
+func printSafeModeState(state safemode.State) {
+	if !state.Active {
+		fmt.Println("Safe mode: inactive")
+		return
+	}
+
+	fmt.Println("Safe mode: ACTIVE")
+	fmt.Printf("  Reason:  %s\n", state.Reason)
+	fmt.Printf("  Since:   %s\n", state.Since.Format("2006-01-02 15:04:05"))
+
+	if len(state.Enabled) == 0 {
+		fmt.Println("  Enabled: none (all automations and actuators held back)")
+	} else {
+		fmt.Printf("  Enabled: %s\n", strings.Join(state.Enabled, ", "))
+	}
+
+	fmt.Printf("  Components: %s, %s, %s, %s\n",
+		safemode.ComponentAutomation, safemode.ComponentThermostat, safemode.ComponentTapo, safemode.ComponentDevice)
+}
+
+// showDryRunTraces prints the commands withheld while running in observe-only mode
+func showDryRunTraces(stateDir string, limit int) error {
+	traces, err := dryrun.ReadTraces(dryrun.TracePath(stateDir), limit)
+	if err != nil {
+		return err
+	}
+
+	if len(traces) == 0 {
+		fmt.Println("No dry-run traces recorded")
+		return nil
+	}
+
+	for _, trace := range traces {
+		fmt.Printf("%s  %-10s %-16s %-24s %s\n",
+			trace.Timestamp.Format("2006-01-02 15:04:05"), trace.Service, trace.Action, trace.Target, trace.Reason)
+	}
+
+	return nil
+}
+
+// runIdentities lists the claimed devices, claims a device by its aliases, or sets the name,
+// room, icon and tags of, merges or deletes the devices the aliases pick
+func runIdentities(command, name, aliasList, room, icon, tags, stateDir string) error {
+	registry, err := identity.NewRegistry(identity.RegistryPath(stateDir))
+	if err != nil {
+		return err
+	}
+
+	var aliases []identity.Alias
+	if command != "identities" {
+		for _, pair := range strings.Split(aliasList, ",") {
+			kind, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found || value == "" {
+				return fmt.Errorf("invalid alias %q, expected kind=value", pair)
+			}
+			aliases = append(aliases, identity.NewAlias(identity.AliasKind(kind), value))
+		}
+	}
+
+	// The other commands pick existing devices, one per alias
+	var uuids []string
+	if command != "identities" && command != "claim" {
+		for _, alias := range aliases {
+			uuid, exists := registry.Resolve(alias)
+			if !exists {
+				return fmt.Errorf("no claimed device is known as %s=%s", alias.Kind, alias.Value)
+			}
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	switch command {
+	case "claim":
+		claimed, err := registry.Claim(name, aliases...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Claimed %s as %s\n", claimed.Name, claimed.UUID)
+		return nil
+
+	case "device-set":
+		var update identity.DeviceUpdate
+		for field, value := range map[**string]string{&update.Name: name, &update.RoomID: room, &update.Icon: icon} {
+			if value != "" {
+				value := value
+				*field = &value
+			}
+		}
+		if tags != "" {
+			parsed := models.ParseTags(tags)
+			update.Tags = &parsed
+		}
+		device, err := registry.Update(uuids[0], update)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s in %s\n", device.Name, device.RoomID)
+		return nil
+
+	case "device-merge":
+		if len(uuids) != 2 {
+			return fmt.Errorf("-alias needs the device to keep and the device to merge into it")
+		}
+		merged, err := registry.Merge(uuids[0], uuids[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Merged %s into %s (%s)\n", uuids[1], merged.Name, merged.UUID)
+		return nil
+
+	case "device-delete":
+		device, _ := registry.Get(uuids[0])
+		if err := registry.Delete(uuids[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s (%s)\n", device.Name, device.UUID)
+		return nil
+	}
+
+	identities := registry.List()
+	if len(identities) == 0 {
+		fmt.Println("No devices claimed")
+		return nil
+	}
+
+	for _, claimed := range identities {
+		aliases := make([]string, 0, len(claimed.Aliases))
+		for _, alias := range claimed.Aliases {
+			aliases = append(aliases, fmt.Sprintf("%s=%s", alias.Kind, alias.Value))
+		}
+		fmt.Printf("%s  %-24s %-16s %s\n", claimed.UUID, claimed.Name, claimed.RoomID, strings.Join(aliases, ", "))
+	}
+
+	return nil
+}
+
+// runAssets sets the asset record of a claimed device, exports the inventory as CSV, or lists
+// the warranties ending within the given days. Fields not given keep their recorded value.
+func runAssets(command, alias string, asset identity.Asset, days int, stateDir string) error {
+	registry, err := identity.NewRegistry(identity.RegistryPath(stateDir))
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "inventory":
+		return identity.WriteInventoryCSV(os.Stdout, registry.List())
+
+	case "warranties":
+		expiring := registry.ExpiringWarranties(time.Now(), time.Duration(days)*24*time.Hour)
+		if len(expiring) == 0 {
+			fmt.Printf("No warranties end in the next %d days\n", days)
+			return nil
+		}
+		for _, device := range expiring {
+			expires, _ := device.Asset.WarrantyExpires()
+			fmt.Printf("%s  %-24s %s\n", expires.Format(identity.AssetDateFormat), device.Name, device.Asset.ManualURL)
+		}
+		return nil
+	}
+
+	kind, value, found := strings.Cut(alias, "=")
+	if !found || value == "" {
+		return fmt.Errorf("-alias kind=value is required to pick the device")
+	}
+	uuid, exists := registry.Resolve(identity.NewAlias(identity.AliasKind(kind), value))
+	if !exists {
+		return fmt.Errorf("no claimed device is known as %s", alias)
+	}
+
+	device, _ := registry.Get(uuid)
+	merged := identity.Asset{}
+	if device.Asset != nil {
+		merged = *device.Asset
+	}
+	for field, set := range map[*string]string{
+		&merged.Manufacturer: asset.Manufacturer,
+		&merged.Model:        asset.Model,
+		&merged.SerialNumber: asset.SerialNumber,
+		&merged.PurchaseDate: asset.PurchaseDate,
+		&merged.ManualURL:    asset.ManualURL,
+		&merged.Notes:        asset.Notes,
+	} {
+		if set != "" {
+			*field = set
+		}
+	}
+	if asset.PurchasePrice > 0 {
+		merged.PurchasePrice = asset.PurchasePrice
+	}
+	if asset.WarrantyMonths > 0 {
+		merged.WarrantyMonths = asset.WarrantyMonths
+	}
+
+	if err := registry.SetAsset(uuid, merged); err != nil {
+		return err
+	}
+	if expires, ok := merged.WarrantyExpires(); ok {
+		fmt.Printf("Updated %s, warranty ends %s\n", device.Name, expires.Format(identity.AssetDateFormat))
+	} else {
+		fmt.Printf("Updated %s\n", device.Name)
+	}
+	return nil
+}
+
+// runRoomRename renames a room across the state directory, the configuration files, the retained
+// topics and the InfluxDB history. The services must be stopped first.
+func runRoomRename(cfg *config.Config, from, to, stateDir string, preview bool) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("-room and -to are required")
+	}
+
+	rename := &migrate.RoomRename{
+		From:        from,
+		To:          to,
+		StateDir:    stateDir,
+		ConfigFiles: []string{cfg.MQTTDevicesFile, cfg.FollowMeFile, cfg.ExteriorLightingFile},
+	}
+	if cfg.TimeSeries.Backend == "influxdb" {
+		history, err := influxdb.NewClient(cfg.TimeSeries.InfluxURL, cfg.TimeSeries.InfluxToken, cfg.TimeSeries.InfluxOrg, cfg.TimeSeries.InfluxBucket)
+		if err != nil {
+			return err
+		}
+		defer history.Disconnect()
+		rename.History = history
+	}
+	if !preview {
+		broker := mqtt.NewClient(&cfg.MQTT, nil)
+		if err := broker.Connect(); err != nil {
+			return fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+		}
+		defer broker.Disconnect()
+		rename.Broker = broker
+	}
+
+	ctx := context.Background()
+	plan, err := rename.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Print(plan)
+	if preview || len(plan.Changes) == 0 {
+		return nil
+	}
+
+	if err := plan.Apply(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Renamed room %s to %s\n", from, to)
+	return nil
+}
+
+// runMQTTKeys lists the payload keys or adds a key for a topic filter. A new key takes over
+// publishing on its topics; older keys are kept so in-flight messages still decrypt.
+func runMQTTKeys(command, topic, keyFile string) error {
+	if keyFile == "" {
+		return fmt.Errorf("no key file: set MQTT_KEY_FILE or -key-file")
+	}
+
+	keys, err := mqtt.NewKeyRing(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if command == "mqtt-key-rotate" {
+		key, err := keys.GenerateKey(topic)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Generated key %s for %s; restart services and copy %s to other subscribers\n", key.ID, key.Topic, keyFile)
+		return nil
+	}
+
+	list := keys.Keys()
+	if len(list) == 0 {
+		fmt.Println("No MQTT payload keys, payloads are sent in the clear")
+		return nil
+	}
+
+	for _, key := range list {
+		fmt.Printf("%s  %-40s %s\n", key.ID, key.Topic, key.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// runScenes lists, captures, recalls or deletes scenes on a service holding them. Changes need
+// the admin token (HA_ADMIN_TOKEN).
+func runScenes(server, adminToken, command, name string, selection models.SceneSelection) error {
+	base := strings.TrimSuffix(server, "/") + "/api/scenes"
+	if command != "scenes" && name == "" {
+		return fmt.Errorf("-name is required")
+	}
+
+	var req *http.Request
+	var err error
+	switch command {
+	case "scenes":
+		req, err = http.NewRequest(http.MethodGet, base, nil)
+	case "scene-capture":
+		body, marshalErr := json.Marshal(struct {
+			Name string `json:"name"`
+			models.SceneSelection
+		}{name, selection})
+		if marshalErr != nil {
+			return marshalErr
+		}
+		req, err = http.NewRequest(http.MethodPost, base+"/capture", bytes.NewReader(body))
+	case "scene-recall":
+		req, err = http.NewRequest(http.MethodPost, base+"/recall?name="+url.QueryEscape(name), nil)
+	case "scene-delete":
+		req, err = http.NewRequest(http.MethodPost, base+"/delete?name="+url.QueryEscape(name), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	switch command {
+	case "scene-capture":
+		var scene models.Scene
+		if err := json.NewDecoder(resp.Body).Decode(&scene); err != nil {
+			return fmt.Errorf("failed to decode scene: %w", err)
+		}
+		fmt.Printf("Captured scene %q with %d devices\n", scene.Name, len(scene.Devices))
+		printScene(&scene)
+	case "scene-recall":
+		fmt.Printf("Recalled scene %q\n", name)
+	case "scene-delete":
+		fmt.Printf("Deleted scene %q\n", name)
+	default:
+		var response struct {
+			Scenes []*models.Scene `json:"scenes"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode scenes: %w", err)
+		}
+		if len(response.Scenes) == 0 {
+			fmt.Println("No scenes captured")
+		}
+		for _, scene := range response.Scenes {
+			fmt.Printf("%s (%s)\n", scene.Name, scene.CreatedAt.Format("2006-01-02 15:04"))
+			printScene(scene)
+		}
+	}
+	return nil
+}
+
+// runLogs shows or changes the log levels of a service's debug server, or shows its recent logs
+// including debug entries not written out. All need the admin token (HA_ADMIN_TOKEN).
+func runLogs(server, adminToken, command, component, level string, limit int) error {
+	base := strings.TrimSuffix(server, "/") + "/debug/log"
+
+	var req *http.Request
+	var err error
+	switch command {
+	case "log-levels":
+		req, err = http.NewRequest(http.MethodGet, base+"/levels", nil)
+	case "log-level":
+		if level == "" {
+			return fmt.Errorf("-level is required")
+		}
+		body, marshalErr := json.Marshal(map[string]string{"component": component, "level": level})
+		if marshalErr != nil {
+			return marshalErr
+		}
+		req, err = http.NewRequest(http.MethodPost, base+"/levels", bytes.NewReader(body))
+	case "logs":
+		query := url.Values{"limit": {fmt.Sprint(limit)}}
+		if component != "" {
+			query.Set("component", component)
+		}
+		if level != "" {
+			query.Set("level", level)
+		}
+		req, err = http.NewRequest(http.MethodGet, base+"/recent?"+query.Encode(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if command == "logs" {
+		var response struct {
+			Entries []logger.LogEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode logs: %w", err)
+		}
+		if len(response.Entries) == 0 {
+			fmt.Println("No recent logs")
+		}
+		for _, entry := range response.Entries {
+			line := fmt.Sprintf("%s %-5s [%s] %s", entry.Timestamp.Format("15:04:05.000"), entry.Level, entry.Service, entry.Message)
+			if entry.Error != "" {
+				line += ": " + entry.Error
+			}
+			if len(entry.Context) > 0 {
+				context, _ := json.Marshal(entry.Context)
+				line += " " + string(context)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	}
+
+	var levels logger.LevelStatus
+	if err := json.NewDecoder(resp.Body).Decode(&levels); err != nil {
+		return fmt.Errorf("failed to decode log levels: %w", err)
+	}
+	fmt.Printf("default       %s\n", levels.Default)
+	for _, name := range sortedComponents(levels.Components) {
+		fmt.Printf("%-13s %s\n", name, levels.Components[name])
+	}
+	return nil
+}
+
+// runSessions lists, creates and revokes API session tokens and shows the API access log of the
+// unified debug server. All need the admin token (HA_ADMIN_TOKEN).
+func runSessions(server, adminToken, command, name, role, session string, expiresDays, limit int) error {
+	base := strings.TrimSuffix(server, "/") + "/api"
+
+	var req *http.Request
+	var err error
+	switch command {
+	case "sessions":
+		req, err = http.NewRequest(http.MethodGet, base+"/sessions", nil)
+	case "session-create":
+		if name == "" {
+			return fmt.Errorf("-name is required, e.g. the device the token is for")
+		}
+		body, marshalErr := json.Marshal(map[string]interface{}{"name": name, "role": role, "expires_days": expiresDays})
+		if marshalErr != nil {
+			return marshalErr
+		}
+		req, err = http.NewRequest(http.MethodPost, base+"/sessions", bytes.NewReader(body))
+	case "session-revoke":
+		if session == "" {
+			return fmt.Errorf("-session is required")
+		}
+		req, err = http.NewRequest(http.MethodPost, base+"/sessions/revoke?id="+url.QueryEscape(session), nil)
+	case "access-log":
+		query := url.Values{"limit": {fmt.Sprint(limit)}}
+		if session != "" {
+			query.Set("session", session)
+		}
+		req, err = http.NewRequest(http.MethodGet, base+"/access-log?"+query.Encode(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	switch command {
+	case "session-create":
+		var response struct {
+			Session access.SessionInfo `json:"session"`
+			Token   string             `json:"token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode session: %w", err)
+		}
+		fmt.Printf("Created %s session %s for %q\n", response.Session.Role, response.Session.ID, response.Session.Name)
+		fmt.Printf("Token (shown once): %s\n", response.Token)
+	case "session-revoke":
+		fmt.Printf("Revoked session %s\n", session)
+	case "access-log":
+		var response struct {
+			Entries []access.Entry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode access log: %w", err)
+		}
+		if len(response.Entries) == 0 {
+			fmt.Println("No API access recorded")
+		}
+		for _, entry := range response.Entries {
+			fmt.Printf("%s %-16s %-6s %-40s %d %dms %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.Caller,
+				entry.Method, entry.Path, entry.Status, entry.DurationMs, entry.RemoteAddr)
+		}
+	default:
+		var response struct {
+			Sessions []access.SessionInfo `json:"sessions"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode sessions: %w", err)
+		}
+		if len(response.Sessions) == 0 {
+			fmt.Println("No API sessions")
+		}
+		for _, s := range response.Sessions {
+			state := "active"
+			if !s.RevokedAt.IsZero() {
+				state = "revoked " + s.RevokedAt.Format("2006-01-02")
+			} else if !s.Active {
+				state = "expired"
+			}
+			lastUsed := "never used"
+			if !s.LastUsedAt.IsZero() {
+				lastUsed = "last used " + s.LastUsedAt.Format("2006-01-02 15:04") + " from " + s.LastAddr
+			}
+			fmt.Printf("%s  %-20s %-9s created %s, %s, %s\n", s.ID, s.Name, s.Role, s.CreatedAt.Format("2006-01-02"), lastUsed, state)
+		}
+	}
+	return nil
+}
+
+func sortedComponents(components map[string]logger.LogLevel) []string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printScene prints the captured state of each device of a scene
+func printScene(scene *models.Scene) {
+	for _, device := range scene.Devices {
+		var state []string
+		if device.Power != nil && *device.Power {
+			state = append(state, "on")
+		} else if device.Power != nil {
+			state = append(state, "off")
+		}
+		if device.Brightness != nil {
+			state = append(state, fmt.Sprintf("brightness %.0f%%", *device.Brightness))
+		}
+		if device.Mode != "" {
+			state = append(state, string(device.Mode))
+		}
+		if device.TargetTemp != nil {
+			state = append(state, fmt.Sprintf("target %.1f°F", *device.TargetTemp))
+		}
+		fmt.Printf("  %-24s %-11s %s\n", device.DeviceID, device.Kind, strings.Join(state, ", "))
+	}
+}
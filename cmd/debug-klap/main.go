@@ -1,27 +1,26 @@
 package main
 
 import (
-	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/diagnostics"
 	"github.com/johnpr01/home-automation/internal/logger"
-	"github.com/johnpr01/home-automation/pkg/tapo"
 )
 
 func main() {
 	var (
-		host     = flag.String("host", "", "IP address of the Tapo device (required)")
-		username = flag.String("username", "", "TP-Link account username (required)")
-		password = flag.String("password", "", "TP-Link account password (required)")
-		timeout  = flag.Duration("timeout", 30*time.Second, "Connection timeout")
-		debug    = flag.Bool("debug", false, "Enable debug output for hash verification")
-		help     = flag.Bool("help", false, "Show help message")
+		host       = flag.String("host", "", "IP address of the Tapo device (required)")
+		username   = flag.String("username", "", "TP-Link account username (required)")
+		password   = flag.String("password", "", "TP-Link account password (required)")
+		timeout    = flag.Duration("timeout", 30*time.Second, "Connection timeout")
+		debug      = flag.Bool("debug", false, "Enable debug output for hash verification")
+		jsonOutput = flag.Bool("json", false, "Print the results as JSON")
+		help       = flag.Bool("help", false, "Show help message")
 	)
 
 	flag.Usage = func() {
@@ -31,115 +30,72 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  %s -host 192.168.1.100 -username your@email.com -password yourpassword -debug\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nExit codes: 0 connected, 1 a check failed, 2 invalid options\n")
 	}
 
 	flag.Parse()
 
 	if *help {
 		flag.Usage()
-		os.Exit(0)
+		os.Exit(diagnostics.ExitOK)
 	}
 
 	// Validate required flags
-	if *host == "" {
-		fmt.Fprintf(os.Stderr, "Error: -host is required\n\n")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	if *username == "" {
-		fmt.Fprintf(os.Stderr, "Error: -username is required\n\n")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	if *password == "" {
-		fmt.Fprintf(os.Stderr, "Error: -password is required\n\n")
-		flag.Usage()
-		os.Exit(1)
+	for _, required := range []struct{ name, value string }{{"host", *host}, {"username", *username}, {"password", *password}} {
+		if required.value == "" {
+			fmt.Fprintf(os.Stderr, "Error: -%s is required\n\n", required.name)
+			flag.Usage()
+			os.Exit(diagnostics.ExitUsage)
+		}
 	}
 
 	// Create a simple logger for testing
 	testLogger := logger.NewLogger("tapo-klap-debug", nil)
+	if *jsonOutput {
+		testLogger.SetOutput(os.Stderr) // Keep stdout for the JSON results
+	} else {
+		fmt.Printf("🔍 Debugging KLAP client connection to %s\n\n", *host)
+	}
 
-	fmt.Printf("🔍 Debugging KLAP client connection to %s\n", *host)
+	report := diagnostics.NewReport("debug-klap", *host)
 
 	if *debug {
-		fmt.Printf("\n📊 Debug Information:\n")
-		fmt.Printf("  Username: %s\n", *username)
-		fmt.Printf("  Password: %s (length: %d)\n", maskPassword(*password), len(*password))
-
-		// Show hash calculations
+		// The hashes are the device credentials, so only a fingerprint is shown. Runs with the
+		// same fingerprint use the same credentials.
 		usernameSha1 := sha1Hash([]byte(*username))
 		passwordSha1 := sha1Hash([]byte(*password))
 		authHash := sha256Hash(concat(usernameSha1, passwordSha1))
-
-		fmt.Printf("\n🔐 Hash Calculations:\n")
-		fmt.Printf("  Username SHA1: %x\n", usernameSha1)
-		fmt.Printf("  Password SHA1: %x\n", passwordSha1)
-		fmt.Printf("  Auth Hash: %x\n", authHash)
-		fmt.Printf("\n")
-	}
-
-	klapClient := tapo.NewKlapClient(*host, *username, *password, *timeout, *testLogger)
-
-	// Test connection
-	ctx := context.Background()
-	fmt.Println("🔌 Attempting KLAP connection...")
-
-	if err := klapClient.Connect(ctx); err != nil {
-		if *debug {
-			fmt.Printf("\n❌ Connection failed with detailed error:\n")
-			fmt.Printf("Error: %v\n", err)
-
-			// Check if it's a hash verification error
-			if fmt.Sprintf("%v", err) == "server hash verification failed" {
-				fmt.Printf("\n💡 Hash Verification Troubleshooting:\n")
-				fmt.Printf("1. Verify your TP-Link account credentials are correct\n")
-				fmt.Printf("2. Try using your email address (not username) if you're using username\n")
-				fmt.Printf("3. Check if your device firmware supports KLAP (1.1.0+)\n")
-				fmt.Printf("4. Ensure your account has access to this device\n")
-				fmt.Printf("5. Try the legacy protocol if KLAP continues to fail\n")
-			}
+		fingerprint := fmt.Sprintf("%x", sha256Hash(authHash)[:4])
+
+		report.Add(&diagnostics.Check{
+			Name:    "Hash calculations",
+			Status:  diagnostics.StatusPass,
+			Message: fmt.Sprintf("username %s, credentials fingerprint %s", *username, fingerprint),
+			Data: map[string]interface{}{
+				"username_sha1": fmt.Sprintf("%x", usernameSha1),
+				"fingerprint":   fingerprint,
+			},
+		})
+		if !*jsonOutput {
+			fmt.Printf("🔐 Hash Calculations:\n")
+			fmt.Printf("  Username SHA1: %x\n", usernameSha1)
+			fmt.Printf("  Credentials fingerprint: %s\n\n", fingerprint)
 		}
-		log.Fatalf("Failed to connect to device: %v", err)
-	}
-
-	fmt.Println("✅ Successfully connected using KLAP protocol!")
-
-	// Get device information
-	deviceInfo, err := klapClient.GetDeviceInfo(ctx)
-	if err != nil {
-		log.Fatalf("Failed to get device info: %v", err)
 	}
 
-	fmt.Printf("\n📱 Device Info:\n")
-	fmt.Printf("  Device ID: %s\n", deviceInfo.DeviceID)
-	fmt.Printf("  Model: %s\n", deviceInfo.Model)
-	fmt.Printf("  Firmware: %s\n", deviceInfo.FwVersion)
-	fmt.Printf("  Device On: %t\n", deviceInfo.DeviceOn)
-	fmt.Printf("  RSSI: %d\n", deviceInfo.RSSI)
-
-	// Get energy usage
-	energyUsage, err := klapClient.GetEnergyUsage(ctx)
-	if err != nil {
-		log.Fatalf("Failed to get energy usage: %v", err)
-	}
-
-	fmt.Printf("\n⚡ Energy Usage:\n")
-	fmt.Printf("  Current Power: %d mW\n", energyUsage.CurrentPower)
-	fmt.Printf("  Today Energy: %d Wh\n", energyUsage.TodayEnergy)
-	fmt.Printf("  Month Energy: %d Wh\n", energyUsage.MonthEnergy)
-	fmt.Printf("  Today Runtime: %d minutes\n", energyUsage.TodayRuntime)
-
-	fmt.Println("\n🎉 KLAP client debug test completed successfully!")
-}
-
-func maskPassword(password string) string {
-	if len(password) <= 4 {
-		return "****"
+	diagnostics.CheckKLAP(report, diagnostics.TapoTarget{
+		Host:     *host,
+		Username: *username,
+		Password: *password,
+		Timeout:  *timeout,
+		Logger:   testLogger,
+	}, false)
+
+	if err := report.Write(os.Stdout, *jsonOutput); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+		os.Exit(diagnostics.ExitFailed)
 	}
-	return password[:2] + "****" + password[len(password)-2:]
+	os.Exit(report.ExitCode())
 }
 
 // Helper functions for debug calculations
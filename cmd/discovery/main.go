@@ -11,22 +11,33 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/buildinfo"
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/models"
 	"github.com/johnpr01/home-automation/pkg/discovery"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 func main() {
 	var (
-		mode         = flag.String("mode", "discover", "Mode: discover, announce, query")
+		mode         = flag.String("mode", "discover", "Mode: discover, announce, query, relay, assets")
 		assetType    = flag.String("type", "gateway", "Asset type for announce mode")
-		assetName    = flag.String("name", "", "Asset name for announce mode")
-		room         = flag.String("room", "", "Room for announce mode or query filter")
+		assetName    = flag.String("name", "", "Asset name for announce mode, or to give the -id asset in assets mode")
+		room         = flag.String("room", "", "Room for announce mode or query filter, or to give the -id asset in assets mode")
 		ip           = flag.String("ip", "", "IP address for announce mode")
 		capabilities = flag.String("capabilities", "", "Comma-separated capabilities for announce mode")
 		queryTypes   = flag.String("query-types", "", "Comma-separated asset types to query for")
 		queryCaps    = flag.String("query-caps", "", "Comma-separated capabilities to query for")
+		tags         = flag.String("tags", "", "Comma-separated tags for announce mode or query filter (e.g. holiday-lights)")
 		duration     = flag.Duration("duration", 60*time.Second, "Duration to run discovery")
 		verbose      = flag.Bool("verbose", false, "Verbose output")
 		jsonOutput   = flag.Bool("json", false, "JSON output format")
+		mdns         = flag.Bool("mdns", false, "Also advertise and browse over mDNS/DNS-SD (_homeauto._tcp)")
+		ssdp         = flag.Bool("ssdp", false, "Also find UPnP devices such as TVs, media players and routers over SSDP")
+		peers        = flag.String("peers", "", "Comma-separated hosts to also query directly, e.g. a relay or assets on another VLAN")
+		relayIfaces  = flag.String("relay-interfaces", "", "Comma-separated interfaces to relay discovery between in relay mode, as name[:both|in|out]")
+		registry     = flag.String("registry", "", "File remembering the assets discovered, with their history and the names and rooms given to them")
+		assetID      = flag.String("id", "", "Asset to name or put in a room in assets mode")
 	)
 	flag.Parse()
 
@@ -34,11 +45,15 @@ func main() {
 
 	switch *mode {
 	case "discover":
-		runDiscovery(*duration, *verbose, *jsonOutput, logger)
+		runDiscovery(*duration, *verbose, *jsonOutput, *mdns, *ssdp, *peers, *registry, logger)
 	case "announce":
-		runAnnounce(*assetType, *assetName, *room, *ip, *capabilities, *duration, *verbose, logger)
+		runAnnounce(*assetType, *assetName, *room, *ip, *capabilities, *tags, *duration, *verbose, *mdns, logger)
 	case "query":
-		runQuery(*queryTypes, *queryCaps, *room, *duration, *verbose, *jsonOutput, logger)
+		runQuery(*queryTypes, *queryCaps, *room, *tags, *duration, *verbose, *jsonOutput, *mdns, *ssdp, *peers, *registry, logger)
+	case "relay":
+		runRelay(*relayIfaces, *duration, *verbose)
+	case "assets":
+		runAssets(*registry, *assetID, *assetName, *room, *jsonOutput)
 	default:
 		fmt.Printf("Unknown mode: %s\n", *mode)
 		flag.Usage()
@@ -47,14 +62,19 @@ func main() {
 }
 
 // runDiscovery runs asset discovery and displays found assets
-func runDiscovery(duration time.Duration, verbose, jsonOutput bool, logger *log.Logger) {
+func runDiscovery(duration time.Duration, verbose, jsonOutput, mdns, ssdp bool, peers, registry string, logger *log.Logger) {
 	fmt.Printf("🔍 Starting asset discovery for %v...\n\n", duration)
+	mqttConfig := config.Load().MQTT
 
 	// Create discovery manager
 	config := discovery.DiscoveryConfig{
 		AutoQuery:     true,
 		QueryInterval: 30 * time.Second,
 		Logger:        logger,
+		MDNS:          mdns,
+		SSDP:          ssdp,
+		UnicastPeers:  splitList(peers),
+		RegistryPath:  registry,
 	}
 
 	manager, err := discovery.NewDiscoveryManager(config)
@@ -70,6 +90,29 @@ func runDiscovery(duration time.Duration, verbose, jsonOutput bool, logger *log.
 	}
 	defer manager.Stop()
 
+	// Mark services offline as soon as the broker publishes their last will
+	mqttClient := mqtt.NewClient(&mqttConfig, nil)
+	if err := mqttClient.Connect(); err != nil {
+		logger.Printf("MQTT unavailable, service availability is not tracked: %v", err)
+	} else {
+		defer mqttClient.Disconnect()
+
+		tracker := mqtt.NewAvailabilityTracker()
+		tracker.AddCallback(manager.SetServiceAvailability)
+		tracker.AddCallback(func(service string, online bool) {
+			if jsonOutput {
+				fmt.Printf("AVAILABILITY: {\"service\": \"%s\", \"online\": %t}\n", service, online)
+			} else if online {
+				fmt.Printf("⬆️  SERVICE ONLINE: %s\n", service)
+			} else {
+				fmt.Printf("⬇️  SERVICE OFFLINE: %s\n", service)
+			}
+		})
+		if err := tracker.Subscribe(mqttClient); err != nil {
+			logger.Printf("Failed to subscribe to service availability: %v", err)
+		}
+	}
+
 	// Create channels for graceful shutdown
 	done := make(chan bool)
 	interrupt := make(chan os.Signal, 1)
@@ -164,7 +207,7 @@ func runDiscovery(duration time.Duration, verbose, jsonOutput bool, logger *log.
 }
 
 // runAnnounce announces a local asset
-func runAnnounce(assetType, assetName, room, ip, capabilities string, duration time.Duration, verbose bool, logger *log.Logger) {
+func runAnnounce(assetType, assetName, room, ip, capabilities, tags string, duration time.Duration, verbose, mdns bool, logger *log.Logger) {
 	if assetName == "" {
 		fmt.Println("Asset name is required for announce mode")
 		os.Exit(1)
@@ -184,7 +227,8 @@ func runAnnounce(assetType, assetName, room, ip, capabilities string, duration t
 		WithType(parsedType).
 		WithName(assetName).
 		AutoDetectNetwork().
-		AutoDetectSystem()
+		AutoDetectSystem().
+		WithBuildInfo(buildinfo.Get("discovery", nil))
 
 	// Set room if provided
 	if room != "" {
@@ -196,6 +240,11 @@ func runAnnounce(assetType, assetName, room, ip, capabilities string, duration t
 		builder.WithIPAddress(ip)
 	}
 
+	// Tag the asset so services can target it as a group
+	if tags != "" {
+		builder.WithTags(models.ParseTags(tags))
+	}
+
 	// Parse and add capabilities
 	if capabilities != "" {
 		caps := strings.Split(capabilities, ",")
@@ -249,6 +298,7 @@ func runAnnounce(assetType, assetName, room, ip, capabilities string, duration t
 	config := discovery.DiscoveryConfig{
 		LocalAsset: asset,
 		Logger:     logger,
+		MDNS:       mdns,
 	}
 
 	manager, err := discovery.NewDiscoveryManager(config)
@@ -305,12 +355,16 @@ func runAnnounce(assetType, assetName, room, ip, capabilities string, duration t
 }
 
 // runQuery sends discovery queries
-func runQuery(queryTypes, queryCaps, room string, duration time.Duration, verbose, jsonOutput bool, logger *log.Logger) {
+func runQuery(queryTypes, queryCaps, room, tags string, duration time.Duration, verbose, jsonOutput, mdns, ssdp bool, peers, registry string, logger *log.Logger) {
 	fmt.Printf("❓ Sending discovery queries for %v...\n\n", duration)
 
 	// Create discovery manager
 	config := discovery.DiscoveryConfig{
-		Logger: logger,
+		Logger:       logger,
+		MDNS:         mdns,
+		SSDP:         ssdp,
+		UnicastPeers: splitList(peers),
+		RegistryPath: registry,
 	}
 
 	manager, err := discovery.NewDiscoveryManager(config)
@@ -362,6 +416,11 @@ func runQuery(queryTypes, queryCaps, room string, duration time.Duration, verbos
 		query.Room = room
 	}
 
+	// Set tag filter; assets must carry every tag
+	if tags != "" {
+		query.Tags = models.ParseTags(tags)
+	}
+
 	if verbose {
 		fmt.Printf("Query Configuration:\n")
 		if len(query.AssetTypes) > 0 {
@@ -443,6 +502,125 @@ func runQuery(queryTypes, queryCaps, room string, duration time.Duration, verbos
 }
 
 // printAssetDetails prints detailed asset information
+// runRelay forwards discovery between the interfaces' network segments
+func runRelay(interfaces string, duration time.Duration, verbose bool) {
+	relay, err := discovery.NewRelay(discovery.RelayConfig{Interfaces: discovery.ParseRelayInterfaces(interfaces)})
+	if err != nil {
+		fmt.Printf("Error creating relay: %v\n", err)
+		os.Exit(1)
+	}
+	if err := relay.Start(); err != nil {
+		fmt.Printf("Error starting relay: %v\n", err)
+		os.Exit(1)
+	}
+	defer relay.Stop()
+
+	fmt.Printf("🔁 Relaying discovery between %s for %v...\n\n", interfaces, duration)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	timer := time.NewTimer(duration)
+	statsTicker := time.NewTicker(30 * time.Second)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			fmt.Printf("\n⏰ Relay time elapsed\n")
+			printRelayStats(relay.Stats())
+			return
+
+		case <-interrupt:
+			fmt.Printf("\n🛑 Relay interrupted\n")
+			printRelayStats(relay.Stats())
+			return
+
+		case <-statsTicker.C:
+			if verbose {
+				printRelayStats(relay.Stats())
+			}
+		}
+	}
+}
+
+func printRelayStats(stats discovery.RelayStats) {
+	fmt.Printf("📊 Relayed: %d announce, %d query, %d response, %d goodbye; dropped %d past the hop limit\n",
+		stats.Relayed[discovery.MessageTypeAnnounce], stats.Relayed[discovery.MessageTypeQuery],
+		stats.Relayed[discovery.MessageTypeResponse], stats.Relayed[discovery.MessageTypeGoodbye], stats.Dropped)
+}
+
+// runAssets lists the assets in the registry, or names an asset or puts it in a room. An empty
+// -name or -room restores what the asset announces.
+func runAssets(path, id, name, room string, jsonOutput bool) {
+	if path == "" {
+		fmt.Println("assets mode needs -registry")
+		os.Exit(1)
+	}
+	registry, err := discovery.NewAssetRegistry(path)
+	if err != nil {
+		fmt.Printf("Error loading registry: %v\n", err)
+		os.Exit(1)
+	}
+
+	if id != "" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				err = registry.SetName(id, name)
+			case "room":
+				err = registry.SetRoom(id, room)
+			}
+			if err != nil {
+				fmt.Printf("Error updating %s: %v\n", id, err)
+				os.Exit(1)
+			}
+		})
+	}
+
+	records := registry.List()
+	if id != "" {
+		record, ok := registry.Get(id)
+		if !ok {
+			fmt.Printf("Unknown asset: %s\n", id)
+			os.Exit(1)
+		}
+		records = []discovery.AssetRecord{record}
+	}
+	if jsonOutput {
+		data, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf("📚 %d known assets\n\n", len(records))
+	for _, record := range records {
+		asset := record.Merged()
+		status := "online"
+		if !record.Online {
+			status = "offline"
+		}
+		fmt.Printf("%s (%s)\n", asset.Name, status)
+		printAssetDetails(asset)
+		fmt.Printf("  First seen: %s\n", record.FirstSeen.Format(time.RFC3339))
+		fmt.Printf("  Last seen: %s\n", record.LastSeen.Format(time.RFC3339))
+		for _, change := range record.History {
+			fmt.Printf("  %s: %s changed from %s to %s\n", change.At.Format(time.RFC3339), change.Field, change.From, change.To)
+		}
+		fmt.Println()
+	}
+}
+
+// splitList splits a comma-separated flag, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func printAssetDetails(asset *discovery.AssetInfo) {
 	fmt.Printf("  ID: %s\n", asset.ID)
 	fmt.Printf("  Type: %s\n", asset.Type)
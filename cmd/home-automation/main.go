@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/diagnostics"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/secrets"
+)
+
+const usage = `Usage: home-automation <command> [options]
+
+Commands:
+  diag net        Check a device's network connectivity (-ip), or scan a subnet for Tapo devices (-subnet)
+  diag tapo       Connect to a Tapo device with KLAP and the legacy protocol
+  diag mqtt       Check the MQTT brokers, payload keys and service availability
+  diag discovery  List the assets that answer a discovery query
+  diag sensors    Check the age of the last reading of each sensor
+  diag bundle     Run every check and write a support bundle (reports, config without secrets, state, logs)
+  secrets keygen  Generate the key of an encrypted secrets file (-o to write it to a file)
+  secrets set     Store a secret (-name) read from stdin in the file of HA_SECRETS_FILE
+  secrets get     Print a secret (-name)
+  secrets list    List the names of the stored secrets
+  secrets delete  Remove a secret (-name)
+
+Run "home-automation diag <subcommand> -h" for the options of a subcommand.
+Exit codes: 0 every check passed, 1 a check failed, 2 invalid options
+`
+
+func main() {
+	if len(os.Args) >= 3 && os.Args[1] == "secrets" {
+		os.Exit(runSecrets(os.Args[2], os.Args[3:]))
+	}
+	if len(os.Args) < 3 || os.Args[1] != "diag" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(diagnostics.ExitUsage)
+	}
+
+	subcommand, args := os.Args[2], os.Args[3:]
+	flags := flag.NewFlagSet("diag "+subcommand, flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the results as JSON")
+	cfg := config.Load()
+
+	var run func() *diagnostics.Report
+	switch subcommand {
+	case "net":
+		ip := flags.String("ip", "", "Device IP address to test")
+		subnet := flags.String("subnet", "", "Subnet to scan for Tapo devices (e.g. 192.168.68)")
+		run = func() *diagnostics.Report {
+			switch {
+			case *ip != "":
+				report := diagnostics.NewReport("diag-net", *ip)
+				diagnostics.CheckNetwork(report, *ip)
+				return report
+			case *subnet != "":
+				report := diagnostics.NewReport("diag-net", *subnet+".0/24")
+				diagnostics.ScanSubnet(report, *subnet)
+				return report
+			}
+			usageError(flags, "-ip or -subnet is required")
+			return nil
+		}
+
+	case "tapo":
+		ip := flags.String("ip", "", "Device IP address")
+		username := flags.String("username", os.Getenv("TPLINK_USERNAME"), "TP-Link account username")
+		password := flags.String("password", os.Getenv("TPLINK_PASSWORD"), "TP-Link account password")
+		protocol := flags.String("protocol", "auto", "Protocol to try: auto, klap or legacy")
+		timeout := flags.Duration("timeout", 30*time.Second, "Connection timeout")
+		run = func() *diagnostics.Report {
+			if *ip == "" || *username == "" || *password == "" {
+				usageError(flags, "-ip, -username and -password are required (or TPLINK_USERNAME and TPLINK_PASSWORD)")
+			}
+
+			resolved, err := secrets.Resolve(*password)
+			if err != nil {
+				usageError(flags, err.Error())
+			}
+
+			tapoLogger := logger.NewLogger("diag", nil)
+			tapoLogger.SetOutput(os.Stderr) // Keep stdout for the results
+			target := diagnostics.TapoTarget{Host: *ip, Username: *username, Password: resolved, Timeout: *timeout, Logger: tapoLogger}
+
+			report := diagnostics.NewReport("diag-tapo", *ip)
+			switch *protocol {
+			case "auto":
+				diagnostics.CheckTapo(report, target)
+			case "klap":
+				diagnostics.CheckKLAP(report, target, false)
+			case "legacy":
+				diagnostics.CheckLegacy(report, target, false)
+			default:
+				usageError(flags, fmt.Sprintf("unknown protocol %q", *protocol))
+			}
+			return report
+		}
+
+	case "mqtt":
+		run = func() *diagnostics.Report {
+			return mqttReport(cfg)
+		}
+
+	case "discovery":
+		duration := flags.Duration("duration", 5*time.Second, "How long to wait for answers")
+		run = func() *diagnostics.Report {
+			return discoveryReport(*duration)
+		}
+
+	case "sensors":
+		maxAge := flags.Duration("max-age", 10*time.Minute, "Warn about sensors without a reading for this long")
+		run = func() *diagnostics.Report {
+			return sensorsReport(cfg, *maxAge)
+		}
+
+	case "bundle":
+		output := flags.String("o", "", "Bundle file (default home-automation-diag-<time>.tar.gz)")
+		logDir := flags.String("log-dir", "", "Directory of log files to include, e.g. /var/log/home-automation")
+		duration := flags.Duration("duration", 5*time.Second, "How long to wait for discovery answers")
+		flags.Parse(args)
+		os.Exit(writeBundle(cfg, *output, *logDir, *duration))
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown diag subcommand %q\n\n", subcommand)
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(diagnostics.ExitUsage)
+	}
+
+	flags.Parse(args)
+	report := run()
+	if err := report.Write(os.Stdout, *jsonOutput); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+		os.Exit(diagnostics.ExitFailed)
+	}
+	os.Exit(report.ExitCode())
+}
+
+// mqttReport checks the brokers and the last availability of each service
+func mqttReport(cfg *config.Config) *diagnostics.Report {
+	report := diagnostics.NewReport("diag-mqtt", "")
+	diagnostics.CheckMQTT(report, &cfg.MQTT)
+	diagnostics.CheckServices(report, cfg.StateDir)
+	return report
+}
+
+// discoveryReport lists the assets that answer a discovery query
+func discoveryReport(duration time.Duration) *diagnostics.Report {
+	report := diagnostics.NewReport("diag-discovery", "")
+	diagnostics.CheckDiscovery(report, duration)
+	return report
+}
+
+// sensorsReport checks the last reading of each sensor
+func sensorsReport(cfg *config.Config, maxAge time.Duration) *diagnostics.Report {
+	report := diagnostics.NewReport("diag-sensors", "")
+	diagnostics.CheckSensors(report, cfg.StateDir, maxAge)
+	return report
+}
+
+// writeBundle runs the checks that need no device credentials and writes them to a support bundle
+// with the config, state and logs. It returns the exit code.
+func writeBundle(cfg *config.Config, output, logDir string, duration time.Duration) int {
+	if output == "" {
+		output = fmt.Sprintf("home-automation-diag-%s.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	reports := []*diagnostics.Report{
+		mqttReport(cfg),
+		discoveryReport(duration),
+		sensorsReport(cfg, 10*time.Minute),
+	}
+
+	file, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600) // The state may hold personal data
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", output, err)
+		return diagnostics.ExitFailed
+	}
+	err = diagnostics.WriteBundle(file, diagnostics.BundleOptions{Reports: reports, Config: cfg, LogDir: logDir})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", output, err)
+		return diagnostics.ExitFailed
+	}
+
+	exitCode := diagnostics.ExitOK
+	for _, report := range reports {
+		fmt.Printf("%s: %s\n", report.Tool, report.Status)
+		if report.ExitCode() != diagnostics.ExitOK {
+			exitCode = report.ExitCode()
+		}
+	}
+	fmt.Printf("\nSupport bundle written to %s\n", output)
+	fmt.Println("Passwords, tokens and precise locations are redacted and the MQTT key file is left out; review it before sharing.")
+	return exitCode
+}
+
+// usageError reports invalid options and exits with the usage exit code
+func usageError(flags *flag.FlagSet, message string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n\n", message)
+	flags.Usage()
+	os.Exit(diagnostics.ExitUsage)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/diagnostics"
+	"github.com/johnpr01/home-automation/internal/secrets"
+)
+
+// runSecrets manages the encrypted secrets file and returns the exit code
+func runSecrets(subcommand string, args []string) int {
+	flags := flag.NewFlagSet("secrets "+subcommand, flag.ExitOnError)
+	opts := secrets.OptionsFromEnv()
+	flags.StringVar(&opts.File, "file", opts.File, "Encrypted secrets file (default HA_SECRETS_FILE)")
+	flags.StringVar(&opts.KeyFile, "key-file", opts.KeyFile, "File holding the base64 key (default HA_SECRETS_KEY_FILE)")
+	name := flags.String("name", "", "Secret name, referenced as secret:<name>")
+	output := flags.String("o", "", "keygen: write the key to this file instead of stdout")
+	flags.Parse(args)
+
+	if subcommand == "keygen" {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return failed(err)
+		}
+		if *output == "" {
+			fmt.Println(key)
+			return 0
+		}
+		if err := os.WriteFile(*output, []byte(key+"\n"), 0600); err != nil {
+			return failed(err)
+		}
+		fmt.Printf("Key written to %s\n", *output)
+		return 0
+	}
+
+	store, err := secrets.OpenFile(opts)
+	if err != nil {
+		return failed(err)
+	}
+
+	switch subcommand {
+	case "list":
+		names, err := store.Names()
+		if err != nil {
+			return failed(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "set":
+		if *name == "" {
+			usageError(flags, "-name is required")
+		}
+		// The value is read from stdin so it stays out of the shell history and process list
+		value, err := readValue(os.Stdin)
+		if err != nil {
+			return failed(err)
+		}
+		if err := store.Set(*name, value); err != nil {
+			return failed(err)
+		}
+		fmt.Fprintf(os.Stderr, "Stored %s; reference it as %s%s\n", *name, secrets.Prefix, *name)
+	case "get":
+		if *name == "" {
+			usageError(flags, "-name is required")
+		}
+		value, err := store.Get(*name)
+		if err != nil {
+			return failed(err)
+		}
+		fmt.Println(value)
+	case "delete":
+		if *name == "" {
+			usageError(flags, "-name is required")
+		}
+		if err := store.Delete(*name); err != nil {
+			return failed(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown secrets subcommand %q\n\n", subcommand)
+		fmt.Fprint(os.Stderr, usage)
+		return diagnostics.ExitUsage
+	}
+	return 0
+}
+
+// readValue reads a secret from the first line of r
+func readValue(r io.Reader) (string, error) {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Value: ")
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	value := strings.TrimRight(line, "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("no value given on stdin")
+	}
+	return value, nil
+}
+
+func failed(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return diagnostics.ExitFailed
+}
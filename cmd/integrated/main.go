@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/internal/models"
 	"github.com/johnpr01/home-automation/internal/services"
@@ -53,6 +55,7 @@ func main() {
 	lightService := services.NewLightService(mqttClient, lightLogger)
 	thermostatService := services.NewThermostatService(mqttClient, thermostatLogger)
 	deviceService := services.NewDeviceService(mqttClient, deviceLogger)
+	deviceService.SetCapabilityFallback(config.Load().CapabilityFallback)
 
 	// Create automation service logger
 	automationLogger := logger.NewLogger("AutomationService", kafkaClient)
@@ -60,6 +63,34 @@ func main() {
 	// Create automation service that coordinates between sensors and devices
 	automationService := services.NewAutomationService(motionService, lightService, deviceService, mqttClient, automationLogger)
 
+	// Adapt per-room cooldowns and dark thresholds from activations marked unwanted
+	tuner, err := services.NewMotionTuner(services.MotionTuningPath(config.Load().StateDir), 5*time.Minute, 20.0, automationLogger)
+	if err != nil {
+		customLogger.Error("Failed to load motion tuning, starting from the defaults", err)
+	}
+	automationService.SetMotionTuner(tuner)
+	if err := automationService.SubscribeFeedback(); err != nil {
+		customLogger.Error("Failed to subscribe to automation feedback", err)
+	}
+
+	// Switch motion-lit lights off once their room is empty, leaving lights turned on by hand
+	if err := automationService.ConfigureAutoOff(config.Load().LightAutoOff); err != nil {
+		customLogger.Error("Invalid HA_LIGHT_AUTO_OFF, using the default delay", err)
+	}
+	if err := automationService.SubscribeLightStates(); err != nil {
+		customLogger.Error("Failed to subscribe to light states", err)
+	}
+
+	// Dim and warm motion-activated lights at night
+	if file := config.Load().AdaptiveLightingFile; file != "" {
+		adaptiveConfig, err := services.LoadAdaptiveLightingConfig(file)
+		if err != nil {
+			customLogger.Error("Failed to load adaptive lighting, lights come on as they are", err)
+		} else {
+			automationService.SetAdaptiveLighting(services.NewAdaptiveLighting(adaptiveConfig))
+		}
+	}
+
 	customLogger.Info("🏠 Automation Service: Motion-activated lighting enabled!")
 	customLogger.Info("📋 Rules: When motion detected + dark conditions → Turn on lights")
 
@@ -138,12 +169,26 @@ func main() {
 		stdLogger.Printf("Integration Monitor: Room %s light level: %s (%.1f%%)", roomID, lightState, lightLevel)
 	})
 
+	// Services stop in the reverse of the order they start in: the status reports, then the
+	// thermostat control loop and the sensor checks
+	ctx := context.Background()
+	running := lifecycle.NewGroup(lifecycle.DefaultStopTimeout)
+	running.Start(ctx, "motion", motionService)
+	running.Start(ctx, "light", lightService)
+	running.Start(ctx, "thermostat", thermostatService)
+
 	// Start periodic status reporting
-	go func() {
+	running.Go(ctx, "status_reports", func(ctx context.Context) {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
 			// Motion service status
 			motionSummary := motionService.GetMotionSummary()
 			stdLogger.Printf("Motion Summary: %d rooms total, %d occupied, %d sensors online",
@@ -159,7 +204,7 @@ func main() {
 			thermostats := thermostatService.GetAllThermostats()
 			stdLogger.Printf("Thermostat Summary: %d thermostats registered", len(thermostats))
 		}
-	}()
+	})
 
 	stdLogger.Println("Integrated home automation service started successfully")
 	stdLogger.Println("Running independent Motion Detection, Light Sensor, and Thermostat services")
@@ -170,4 +215,10 @@ func main() {
 	<-sigChan
 
 	stdLogger.Println("Shutting down integrated home automation service...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
+	defer cancel()
+	if err := running.Stop(shutdownCtx); err != nil {
+		stdLogger.Printf("Shutdown incomplete: %v", err)
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -56,6 +57,10 @@ func main() {
 		}
 	})
 
+	if err := lightService.Start(context.Background()); err != nil {
+		logger.Fatalf("Failed to start light service: %v", err)
+	}
+
 	// Start periodic status reporting
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
@@ -78,5 +83,12 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
+	// Let a check in progress finish, within the shutdown timeout
+	ctx, cancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
+	defer cancel()
+	if err := lightService.Stop(ctx); err != nil {
+		logger.Printf("Failed to stop light service: %v", err)
+	}
+
 	logger.Println("Shutting down light sensor service...")
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -47,6 +48,10 @@ func main() {
 		logger.Printf("Room %s is now %s", roomID, status)
 	})
 
+	if err := motionService.Start(context.Background()); err != nil {
+		logger.Fatalf("Failed to start motion service: %v", err)
+	}
+
 	// Start periodic status reporting
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
@@ -67,5 +72,12 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
+	// Let a check in progress finish, within the shutdown timeout
+	ctx, cancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
+	defer cancel()
+	if err := motionService.Stop(ctx); err != nil {
+		logger.Printf("Failed to stop motion service: %v", err)
+	}
+
 	logger.Println("Shutting down motion detection service...")
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/replay"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const usage = `Usage: replay <command> [options]
+
+Commands:
+  record  Record MQTT sensor topics to a file (-o) until interrupted or for -duration
+  play    Publish a recording (-i) with its original timing, -speed times faster, or -speed 0 as fast as possible
+  list    Print the messages of a recording (-i) with their offsets
+
+The broker is taken from the MQTT_* settings, as for the other services.
+Run "replay <command> -h" for the options of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	topics := flags.String("topic", "", "Comma-separated topic filters (default every room sensor for record, everything for play and list)")
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "record":
+		output := flags.String("o", "", "Recording file to write")
+		duration := flags.Duration("duration", 0, "How long to record (default until interrupted)")
+		flags.Parse(args)
+		if *output == "" {
+			usageError(flags, "-o is required")
+		}
+		filters := splitList(*topics)
+		if len(filters) == 0 {
+			filters = mqtt.SensorTopics
+		}
+		if *duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *duration)
+			defer cancel()
+		}
+		err = record(ctx, *output, filters)
+
+	case "play":
+		input := flags.String("i", "", "Recording file to play")
+		speed := flags.Float64("speed", 1, "Playback speed: 1 original timing, 10 ten times faster, 0 as fast as possible")
+		from := flags.Duration("from", 0, "Skip the messages before this offset into the recording")
+		to := flags.Duration("to", 0, "Stop at this offset into the recording (default the end)")
+		loop := flags.Bool("loop", false, "Play the recording again and again until interrupted")
+		flags.Parse(args)
+		if *input == "" {
+			usageError(flags, "-i is required")
+		}
+		if *speed < 0 {
+			usageError(flags, "-speed can't be negative")
+		}
+		err = play(ctx, *input, splitList(*topics), *from, *to, *speed, *loop)
+
+	case "list":
+		input := flags.String("i", "", "Recording file to list")
+		flags.Parse(args)
+		if *input == "" {
+			usageError(flags, "-i is required")
+		}
+		err = list(*input, splitList(*topics))
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// record writes the messages on the filters to output until ctx is done
+func record(ctx context.Context, output string, filters []string) error {
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recorder := replay.NewRecorder(file)
+	broker := mqtt.NewClient(&config.Load().MQTT, &mqtt.ClientOptions{ReadOnly: true, Logger: stderrLogger()})
+	if err := broker.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+	}
+	defer broker.Disconnect()
+	for _, filter := range filters {
+		if err := broker.Subscribe(filter, recorder.Record); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Recording %s to %s, Ctrl-C to stop\n", strings.Join(filters, ", "), output)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := recorder.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Recorded %d messages\n", recorder.Count())
+			return nil
+		case <-ticker.C:
+			// A recording cut short by a crash keeps what was flushed
+			if err := recorder.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// play publishes a recording, once or until ctx is done with loop
+func play(ctx context.Context, input string, filters []string, from, to time.Duration, speed float64, loop bool) error {
+	messages, err := load(input)
+	if err != nil {
+		return err
+	}
+	messages = replay.Filter(messages, filters, from, to)
+	if len(messages) == 0 {
+		return fmt.Errorf("no messages to play in %s", input)
+	}
+
+	broker := mqtt.NewClient(&config.Load().MQTT, &mqtt.ClientOptions{Logger: stderrLogger()})
+	if err := broker.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+	}
+	defer broker.Disconnect()
+
+	player := replay.NewPlayer(speed, func(topic string, payload []byte) error {
+		return broker.Publish(&mqtt.Message{Topic: topic, Payload: payload, QoS: 1})
+	})
+	length := messages[len(messages)-1].Offset() - messages[0].Offset()
+	for {
+		fmt.Fprintf(os.Stderr, "Playing %d messages over %s\n", len(messages), scaled(length, speed))
+		count, err := player.Play(ctx, messages)
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Stopped after %d messages\n", count)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !loop {
+			fmt.Fprintf(os.Stderr, "Played %d messages\n", count)
+			return nil
+		}
+	}
+}
+
+// list prints the messages of a recording, one per line
+func list(input string, filters []string) error {
+	messages, err := load(input)
+	if err != nil {
+		return err
+	}
+	for _, msg := range replay.Filter(messages, filters, 0, 0) {
+		fmt.Printf("%10s  %-28s %s\n", msg.Offset().Truncate(time.Millisecond), msg.Topic, msg.Bytes())
+	}
+	return nil
+}
+
+func load(input string) ([]replay.Message, error) {
+	var reader io.Reader = os.Stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	return replay.Load(reader)
+}
+
+// scaled describes how long a recording plays at speed
+func scaled(length time.Duration, speed float64) string {
+	if speed == 0 {
+		return "no time, as fast as possible"
+	}
+	return (time.Duration(float64(length) / speed)).Round(time.Second).String()
+}
+
+// stderrLogger keeps the client's log off stdout, which list prints to
+func stderrLogger() *logger.Logger {
+	clientLogger := logger.NewLogger("replay", nil)
+	clientLogger.SetOutput(os.Stderr)
+	return clientLogger
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func usageError(flags *flag.FlagSet, message string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n\n", message)
+	flags.Usage()
+	os.Exit(2)
+}
@@ -1,20 +1,133 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/johnpr01/home-automation/internal/access"
+	"github.com/johnpr01/home-automation/internal/buildinfo"
+	"github.com/johnpr01/home-automation/internal/certs"
 	"github.com/johnpr01/home-automation/internal/config"
 	"github.com/johnpr01/home-automation/internal/handlers"
+	"github.com/johnpr01/home-automation/internal/health"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/profiling"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	cfg := config.Load()
 
+	// The dashboard labels follow the configured locale unless the browser asks for another
+	if cfg.MessagesFile != "" {
+		if err := i18n.LoadMessages(cfg.MessagesFile); err != nil {
+			log.Printf("Failed to load messages file: %v", err)
+		}
+	}
+	if err := i18n.SetLocale(cfg.Locale); err != nil {
+		log.Printf("Invalid HA_LOCALE: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	handlers.RegisterRoutes(mux)
+	profiling.RegisterPprof(mux, cfg.AdminToken)
+
+	buildInfo := buildinfo.Get("server", buildinfo.Features(map[string]bool{
+		"pprof": cfg.AdminToken != "",
+	}))
+	mux.Handle("/api/build-info", buildinfo.Handler(buildInfo))
+
+	// Stable device UUIDs claimed by the services, resolvable by any alias
+	identities, err := identity.NewRegistry(identity.RegistryPath(cfg.StateDir))
+	if err != nil {
+		log.Printf("Failed to load device registry: %v", err)
+	}
+	mux.Handle("/api/device-identities", identity.Handler(identities))
+	mux.Handle("/api/inventory", identity.InventoryHandler(identities))
+	mux.Handle("/api/devices/registry", identity.DevicesHandler(identities))
+
+	// Occupancy heatmaps recorded by the unified service
+	presence := services.NewPresenceService(services.PresencePath(cfg.StateDir), nil)
+	mux.Handle("/api/presence/heatmap", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := presence.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		presence.Handler().ServeHTTP(w, r)
+	}))
+	mux.Handle("/api/presence/analytics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := presence.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		presence.AnalyticsHandler().ServeHTTP(w, r)
+	}))
+
+	if err := profiling.RegisterRuntimeGauges(prometheus.DefaultRegisterer, "server"); err != nil {
+		log.Printf("Failed to register runtime gauges: %v", err)
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Liveness and readiness for container probes; the dashboard reads the state the services write
+	healthChecker := health.NewRegistry("server")
+	healthChecker.RegisterReadiness("prometheus", health.Prometheus(prometheus.DefaultGatherer))
+	healthChecker.RegisterOptional("occupancy_history", presence.Reload)
+	mux.Handle("/healthz", healthChecker.LivenessHandler())
+	mux.Handle("/readyz", healthChecker.ReadinessHandler())
+
+	// The dashboard; its rooms, thermostats, energy and automations sections need the unified gateway
+	mux.Handle("/", web.Handler())
+
+	// With HA_API_AUTH the API needs the admin token or a session token issued by the unified
+	// service; the dashboard page, probes and metrics stay open
+	sessions := access.NewManager(cfg.AdminToken, access.SessionsPath(cfg.StateDir), "", logger.NewLogger("Access", nil))
+	sessions.FollowSessions()
+	sessions.SetAuthenticateReads(cfg.APIAuth)
+
+	// Devices are edited with a resident's token and deleted or merged with an admin's, as on
+	// the unified gateway
+	mux.Handle("/api/devices/registry/create", sessions.Require(identity.CreateHandler(identities)))
+	mux.Handle("/api/devices/registry/update", sessions.Require(identity.UpdateHandler(identities)))
+	mux.Handle("/api/devices/registry/delete", sessions.RequireRole(access.RoleAdmin, identity.DeleteHandler(identities)))
+	mux.Handle("/api/devices/registry/merge", sessions.RequireRole(access.RoleAdmin, identity.MergeHandler(identities)))
+	root := http.NewServeMux()
+	root.Handle("/api/", sessions.Authenticate(mux))
+	root.Handle("/", mux)
+
+	if !cfg.TLS.Enabled() {
+		fmt.Printf("Starting home automation server %s on port %s\n", buildInfo, cfg.Port)
+		log.Fatal(http.ListenAndServe(":"+cfg.Port, root))
+	}
+
+	// HTTPS with certificate files, a Let's Encrypt certificate or a self-signed one, renewed
+	// while the server runs
+	certificates, err := certs.NewManager(cfg.TLS, cfg.StateDir, logger.NewLogger("TLS", nil))
+	if err != nil {
+		log.Fatalf("Failed to set up HTTPS: %v", err)
+	}
+	if err := certificates.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start certificate renewal: %v", err)
+	}
+
+	// Let's Encrypt checks the HTTP-01 challenges on port 80, which also redirects to HTTPS
+	httpAddr := cfg.TLS.HTTPAddr
+	if httpAddr == "" && len(cfg.TLS.Domains) > 0 {
+		httpAddr = ":80"
+	}
+	if httpAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(httpAddr, certificates.HTTPHandler(cfg.Port)))
+		}()
+	}
 
-	fmt.Printf("Starting home automation server on port %s\n", cfg.Port)
-	log.Fatal(http.ListenAndServe(":"+cfg.Port, mux))
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: root, TLSConfig: certificates.TLSConfig()}
+	fmt.Printf("Starting home automation server %s on port %s with HTTPS\n", buildInfo, cfg.Port)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
@@ -38,16 +38,9 @@ func main() {
 	serviceLogger := logger.NewLogger("tapo-service", nil)
 	serviceLogger.Info("Starting Tapo Smart Plug Monitoring Service")
 
-	// Initialize MQTT client
-	mqttConfig := &config.MQTTConfig{
-		Broker:   "localhost",
-		Port:     "1883",
-		Username: "",
-		Password: "",
-	}
-
-	mqttClient := mqtt.NewClient(mqttConfig, nil)
-	if err := mqttClient.Connect(); err != nil {
+	// Initialize MQTT client, with its own brokers when MQTT_BROKERS_TAPO is set
+	mqttClient, err := mqtt.ConnectIntegration(config.Load().MQTT, "tapo", []string{"tapo/#"}, nil)
+	if err != nil {
 		serviceLogger.Error("Failed to connect to MQTT broker", err)
 		return
 	}
@@ -58,6 +51,10 @@ func main() {
 	// Create Tapo service
 	tapoService := services.NewTapoService(mqttClient, prometheusClient, serviceLogger)
 
+	// Publish per-room energy totals to home-automation/energy/<room>
+	energyService := services.NewEnergyService(mqttClient, "", serviceLogger)
+	tapoService.AddReadingCallback(energyService.Record)
+
 	// Get password from environment variable (GitHub Actions secret)
 	tplinkPassword := os.Getenv("TPLINK_PASSWORD")
 	if tplinkPassword == "" {
@@ -109,11 +106,20 @@ func main() {
 	}
 
 	// Start monitoring
-	if err := tapoService.Start(); err != nil {
+	if err := tapoService.Start(ctx); err != nil {
 		serviceLogger.Error("Failed to start Tapo service", err)
 		return
 	}
 
+	// Stopping waits for polls in progress, within the shutdown timeout
+	stop := func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
+		defer stopCancel()
+		if err := tapoService.Stop(stopCtx); err != nil {
+			serviceLogger.Error("Failed to stop Tapo service", err)
+		}
+	}
+
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -131,7 +137,7 @@ func main() {
 		select {
 		case <-sigChan:
 			serviceLogger.Info("Received shutdown signal, stopping service...")
-			tapoService.Stop()
+			stop()
 			return
 
 		case <-ticker.C:
@@ -141,7 +147,7 @@ func main() {
 
 		case <-ctx.Done():
 			serviceLogger.Info("Context cancelled, stopping service...")
-			tapoService.Stop()
+			stop()
 			return
 		}
 	}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -11,13 +14,27 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/calendar"
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/health"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/profiling"
 	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/internal/tariff"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
 	"github.com/johnpr01/home-automation/pkg/prometheus"
+	"github.com/johnpr01/home-automation/pkg/tapo"
+	prometheusclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	once := flag.Bool("once", false, "Poll every device once, print the readings as JSON and exit")
+	flag.Parse()
+
 	log.Println("🔌 Starting Tapo Metrics Scraper")
 
 	// Get configuration from environment variables
@@ -38,8 +55,19 @@ func main() {
 		log.Fatal("TPLINK_PASSWORD environment variable is required")
 	}
 
-	// Initialize logger
+	// Initialize logger; the levels can be changed at /debug/log/levels
 	serviceLogger := logger.NewLogger("tapo-metrics", nil)
+	logFile, err := logger.ConfigureOutput(config.Load().Log, "tapo-metrics")
+	if err != nil {
+		serviceLogger.Error("Invalid log output, logging to stdout", err)
+	}
+	defer logFile.Close()
+	if err := logger.ApplyLevels(logLevel); err != nil {
+		serviceLogger.Error("Invalid LOG_LEVEL", err)
+	}
+	if *once {
+		serviceLogger.SetOutput(os.Stderr) // Keep stdout for the JSON results
+	}
 	serviceLogger.Info("Tapo Metrics Scraper starting", map[string]interface{}{
 		"metrics_port":  metricsPort,
 		"poll_interval": pollInterval,
@@ -51,8 +79,247 @@ func main() {
 	// Create Prometheus client
 	prometheusClient := prometheus.NewClient("http://prometheus:9090")
 
+	// Store readings in InfluxDB instead when HA_TIMESERIES_BACKEND=influxdb
+	timeSeriesConfig := config.Load().TimeSeries
+	tsClient, err := services.SelectTimeSeriesClient(timeSeriesConfig, prometheusClient)
+	if err != nil {
+		log.Fatalf("Invalid time series configuration: %v", err)
+	}
+	if timeSeriesConfig.Backend == "influxdb" {
+		if err := tsClient.Connect(); err != nil {
+			serviceLogger.Error("InfluxDB is not reachable yet, writes will be retried every poll", err)
+		}
+		defer tsClient.Disconnect()
+	}
+
 	// Create Tapo service
-	tapoService := services.NewTapoService(nil, prometheusClient, serviceLogger)
+	tapoService := services.NewTapoService(nil, tsClient, serviceLogger)
+
+	// Remember detected KLAP/legacy protocols across restarts
+	protocolCache, err := tapo.NewProtocolCache(tapo.ProtocolCachePath(config.Load().StateDir))
+	if err != nil {
+		serviceLogger.Error("Failed to load Tapo protocol cache, devices will be re-probed", err)
+	}
+	tapoService.SetProtocolCache(protocolCache)
+
+	// Key metrics by stable device UUIDs instead of configured IDs
+	identities, err := identity.NewRegistry(identity.RegistryPath(config.Load().StateDir))
+	if err != nil {
+		serviceLogger.Error("Failed to load device registry", err)
+	}
+	tapoService.SetIdentityRegistry(identities)
+
+	// Washer and dryer cycles have no MQTT client here, so report them in the log
+	tapoService.AddCycleCallback(func(event services.CycleEvent) {
+		serviceLogger.Info("Appliance finished", map[string]interface{}{
+			"device_name": event.DeviceName,
+			"duration":    event.Duration.String(),
+		})
+	})
+
+	// Convert energy readings to cost when a tariff is configured
+	var costService *services.EnergyCostService
+	if tariffFile := config.Load().TariffFile; tariffFile != "" {
+		energyTariff, err := tariff.Load(tariffFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load tariff, cost tracking disabled", err)
+		} else {
+			costService = services.NewEnergyCostService(energyTariff, services.EnergyCostPath(config.Load().StateDir), serviceLogger)
+			if err := costService.RegisterMetrics(prometheusclient.DefaultRegisterer); err != nil {
+				serviceLogger.Error("Failed to register energy cost metrics", err)
+			}
+			tapoService.AddReadingCallback(costService.Record)
+			http.Handle("/api/energy/cost", costService.Handler())
+		}
+	}
+
+	// Aggregate readings per room for Grafana and the API
+	energyService := services.NewEnergyService(nil, services.RoomEnergyPath(config.Load().StateDir), serviceLogger)
+	if err := energyService.RegisterMetrics(prometheusclient.DefaultRegisterer); err != nil {
+		serviceLogger.Error("Failed to register room energy metrics", err)
+	}
+	tapoService.AddReadingCallback(energyService.Record)
+	http.Handle("/api/energy/rooms", energyService.Handler())
+	http.Handle("/api/energy/rooms/daily", energyService.DailyHandler())
+
+	// Plug states can be saved as scenes and recalled
+	sceneService := services.NewSceneService(services.ScenesPath(config.Load().StateDir, "tapo"), serviceLogger)
+	sceneService.SetTapoService(tapoService)
+	tapoService.AddReadingCallback(sceneService.RecordPlugReading)
+	adminToken := config.Load().AdminToken
+	http.Handle("/api/scenes", sceneService.Handler())
+	http.Handle("/api/scenes/capture", profiling.RequireAdmin(adminToken, sceneService.CaptureHandler()))
+	http.Handle("/api/scenes/recall", profiling.RequireAdmin(adminToken, sceneService.RecallHandler()))
+	http.Handle("/api/scenes/delete", profiling.RequireAdmin(adminToken, sceneService.DeleteHandler()))
+
+	// Switch plugs tagged for exterior lighting from sunset when configured
+	var exteriorLighting *services.ExteriorLightingService
+	if exteriorFile := config.Load().ExteriorLightingFile; exteriorFile != "" {
+		exteriorConfig, err := services.LoadExteriorLightingConfig(exteriorFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load exterior lighting, controller disabled", err)
+		} else {
+			exteriorLighting = services.NewExteriorLightingService(exteriorConfig, serviceLogger)
+			exteriorLighting.SetTapoService(tapoService)
+			tapoService.AddReadingCallback(exteriorLighting.RecordPlugReading)
+			http.Handle("/api/lighting/exterior", exteriorLighting.Handler())
+
+			// Holiday lights can follow the periods and holidays of the calendar
+			if calendarFile := config.Load().CalendarFile; calendarFile != "" {
+				holidays, err := calendar.Load(calendarFile)
+				if err != nil {
+					serviceLogger.Error("Failed to load holiday calendar", err)
+				} else {
+					exteriorLighting.SetCalendar(holidays)
+					http.Handle("/api/calendar", holidays.Handler())
+				}
+			}
+
+			// The dark override needs the light sensor, which only MQTT carries
+			if exteriorConfig.LuxRoom != "" {
+				mqttClient := mqtt.NewClient(&config.Load().MQTT, nil)
+				if err := mqttClient.Connect(); err != nil {
+					serviceLogger.Error("MQTT unavailable, exterior lights follow the schedule only", err)
+				} else {
+					defer mqttClient.Disconnect()
+					if err := exteriorLighting.Subscribe(mqttClient); err != nil {
+						serviceLogger.Error("Failed to subscribe to the exterior light sensor", err)
+					}
+				}
+			}
+		}
+	}
+
+	// Switch dehumidifiers and humidifiers on plugs to keep rooms within their humidity setpoints
+	var humidityControl *services.HumidityControlService
+	if humidityFile := config.Load().HumidityFile; humidityFile != "" {
+		controls, err := services.LoadHumidityControl(humidityFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load humidity control, controller disabled", err)
+		} else {
+			// Room humidity only arrives over MQTT, so the controller needs it
+			mqttClient := mqtt.NewClient(&config.Load().MQTT, nil)
+			if err := mqttClient.Connect(); err != nil {
+				serviceLogger.Error("MQTT unavailable, humidity control disabled", err)
+			} else {
+				defer mqttClient.Disconnect()
+				humidityControl = services.NewHumidityControlService(controls, serviceLogger)
+				humidityControl.SetTapoService(tapoService)
+				if err := humidityControl.Subscribe(mqttClient); err != nil {
+					serviceLogger.Error("Failed to subscribe to room humidity", err)
+				}
+				http.Handle("/api/humidity", humidityControl.Handler())
+			}
+		}
+	}
+
+	// Switch off plugs such as the washing machine when a leak or smoke detector triggers. The
+	// unified service sends the alerts, so this controller only acts.
+	if hazardFile := config.Load().HazardFile; hazardFile != "" {
+		hazardConfig, err := services.LoadHazardConfig(hazardFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load hazard responses, plugs are left alone", err)
+		} else {
+			mqttClient := mqtt.NewClient(&config.Load().MQTT, nil)
+			if err := mqttClient.Connect(); err != nil {
+				serviceLogger.Error("MQTT unavailable, hazard responses disabled", err)
+			} else {
+				defer mqttClient.Disconnect()
+				hazards := services.NewHazardService(hazardConfig, serviceLogger)
+				hazards.SetTapoService(tapoService)
+				if err := hazards.Subscribe(mqttClient); err != nil {
+					serviceLogger.Error("Failed to subscribe to leak and smoke detectors", err)
+				}
+				http.Handle("/api/hazards", hazards.Handler())
+			}
+		}
+	}
+
+	// EV chargers connect over OCPP; their charging counts like a plug's and can be paused
+	var chargers *services.ChargerService
+	if chargerFile := config.Load().EVChargerFile; chargerFile != "" {
+		chargerConfig, err := services.LoadChargerConfig(chargerFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load EV chargers, they are not monitored", err)
+		} else {
+			chargers = services.NewChargerService(chargerConfig, services.EVChargerPath(config.Load().StateDir), serviceLogger)
+			if err := chargers.RegisterMetrics(prometheusclient.DefaultRegisterer); err != nil {
+				serviceLogger.Error("Failed to register EV charger metrics", err)
+			}
+			chargers.AddReadingCallback(energyService.Record)
+			if costService != nil {
+				chargers.AddReadingCallback(costService.Record)
+			}
+			http.Handle("/ocpp/", chargers.OCPPHandler())
+			http.Handle("/api/ev/chargers", chargers.Handler())
+			http.Handle("/api/ev/chargers/charging", profiling.RequireAdmin(adminToken, chargers.ControlHandler()))
+		}
+	}
+
+	// Keep the home within its power budget by switching off low-priority plugs during peaks
+	var peakShaving *services.PeakShavingService
+	if peakFile := config.Load().PeakShavingFile; peakFile != "" {
+		peakConfig, err := services.LoadPeakShavingConfig(peakFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load peak shaving, loads are left alone", err)
+		} else {
+			peakShaving = services.NewPeakShavingService(peakConfig, services.PeakShavingPath(config.Load().StateDir), serviceLogger)
+			peakShaving.SetTapoService(tapoService)
+			tapoService.AddReadingCallback(peakShaving.RecordPlugReading)
+			if chargers != nil {
+				peakShaving.SetChargerService(chargers)
+				chargers.AddReadingCallback(peakShaving.RecordPlugReading)
+			}
+			if err := peakShaving.RegisterMetrics(prometheusclient.DefaultRegisterer); err != nil {
+				serviceLogger.Error("Failed to register peak shaving metrics", err)
+			}
+			http.Handle("/api/energy/peak", peakShaving.Handler())
+
+			// The CT-clamp meter only arrives over MQTT; without it the plugs are the home's power
+			if peakConfig.Meter != nil {
+				mqttClient := mqtt.NewClient(&config.Load().MQTT, nil)
+				if err := mqttClient.Connect(); err != nil {
+					serviceLogger.Error("MQTT unavailable, the power budget counts the plugs only", err)
+				} else {
+					defer mqttClient.Disconnect()
+					if err := peakShaving.Subscribe(mqttClient); err != nil {
+						serviceLogger.Error("Failed to subscribe to the power meter", err)
+					}
+				}
+			}
+		}
+	}
+
+	// Solar production, grid power and electricity prices switch plugs by rule
+	var grid *services.GridService
+	if gridFile := config.Load().GridFile; gridFile != "" {
+		gridConfig, err := services.LoadGridConfig(gridFile)
+		if err != nil {
+			serviceLogger.Error("Failed to load grid sources, grid rules are off", err)
+		} else {
+			grid = services.NewGridService(gridConfig, serviceLogger)
+			grid.SetTapoService(tapoService)
+			if chargers != nil {
+				grid.SetChargerService(chargers)
+			}
+			if err := grid.RegisterMetrics(prometheusclient.DefaultRegisterer); err != nil {
+				serviceLogger.Error("Failed to register grid metrics", err)
+			}
+			http.Handle("/api/energy/grid", grid.Handler())
+
+			// Signals are published on MQTT, where topic sources also arrive
+			mqttClient := mqtt.NewClient(&config.Load().MQTT, nil)
+			if err := mqttClient.Connect(); err != nil {
+				serviceLogger.Error("MQTT unavailable, grid signals come from SunSpec and prices only", err)
+			} else {
+				defer mqttClient.Disconnect()
+				grid.SetMQTTClient(mqttClient)
+				if err := grid.Subscribe(mqttClient); err != nil {
+					serviceLogger.Error("Failed to subscribe to the solar and grid topics", err)
+				}
+			}
+		}
+	}
 
 	// Configure devices from environment or config file
 	err = configureDevices(tapoService, tplinkUsername, tplinkPassword, pollInterval, serviceLogger)
@@ -61,15 +328,85 @@ func main() {
 		log.Fatalf("Device configuration failed: %v", err)
 	}
 
+	// One-shot mode: a single poll cycle for cron-based deployments and debugging
+	if *once {
+		os.Exit(pollOnce(tapoService, energyService, costService, serviceLogger))
+	}
+
+	// Services are stopped in the reverse of the order they start in: the lights and humidity
+	// control before the plugs they switch, and the plugs before the energy totals are saved
+	ctx := context.Background()
+	running := lifecycle.NewGroup(lifecycle.DefaultStopTimeout)
+	running.Start(ctx, "energy_totals", lifecycle.Hooks{OnStop: func(context.Context) error {
+		if err := energyService.Save(); err != nil {
+			serviceLogger.Error("Failed to save room energy totals", err)
+		}
+		if costService != nil {
+			if err := costService.Save(); err != nil {
+				serviceLogger.Error("Failed to save energy cost totals", err)
+			}
+		}
+		return nil
+	}})
+
+	// Plugs switched while unreachable are switched when they reconnect
+	var commands *services.CommandQueue
+	if queueConfig := config.Load().Commands; queueConfig.Enabled {
+		commands = tapoService.EnableCommandQueue(queueConfig)
+		http.Handle("/api/tapo/commands", commands.Handler())
+	}
+
 	// Start Tapo service
-	if err := tapoService.Start(); err != nil {
+	if err := running.Start(ctx, "tapo", tapoService); err != nil {
 		serviceLogger.Error("Failed to start Tapo service", err)
 		log.Fatalf("Service start failed: %v", err)
 	}
+	if commands != nil {
+		running.Start(ctx, "tapo_commands", commands)
+	}
+
+	if exteriorLighting != nil {
+		running.Go(ctx, "exterior_lighting", exteriorLighting.Run)
+	}
+	if humidityControl != nil {
+		running.Go(ctx, "humidity_control", humidityControl.Run)
+	}
+	if peakShaving != nil {
+		running.Go(ctx, "peak_shaving", peakShaving.Run)
+	}
+	if grid != nil {
+		running.Go(ctx, "grid", grid.Run)
+	}
+
+	// Tapo plugs found on the network are monitored by the provisioning rules
+	var assets *discovery.DiscoveryManager
+	if provisioningFile := config.Load().ProvisioningFile; provisioningFile != "" {
+		var provisioning *services.ProvisioningService
+		assets, provisioning, err = startProvisioning(provisioningFile, tapoService, tplinkUsername, tplinkPassword)
+		if err != nil {
+			serviceLogger.Error("Failed to start provisioning", err)
+		} else {
+			running.Start(ctx, "asset_discovery", lifecycle.OnStop(assets.Stop))
+			running.Go(ctx, "provisioning", func(ctx context.Context) {
+				provisioning.Run(ctx, assets.GetDiscoveredChannel(), assets.GetUpdatedChannel())
+			})
+			http.Handle("/api/provisioning", provisioning.Handler())
+		}
+	}
 
 	// Setup metrics HTTP server
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/health", healthHandler)
+
+	// Liveness and readiness with the detail of each check; plugs offline only degrade readiness
+	healthChecker := health.NewRegistry("tapo-metrics")
+	healthChecker.RegisterLiveness("tapo_service", health.Responds(func() { tapoService.GetDeviceStatus() }))
+	healthChecker.RegisterReadiness("tapo_polling", tapoService.HealthCheck)
+	healthChecker.RegisterReadiness("prometheus", health.Prometheus(prometheusclient.DefaultGatherer))
+	healthChecker.RegisterOptional("tapo_devices", tapoService.DeviceHealthCheck)
+	http.Handle("/healthz", healthChecker.LivenessHandler())
+	http.Handle("/readyz", healthChecker.ReadinessHandler())
+	profiling.RegisterLogEndpoints(http.DefaultServeMux, config.Load().AdminToken)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprintf(w, `
@@ -77,7 +414,7 @@ func main() {
 <head><title>Tapo Metrics Scraper</title></head>
 <body>
 <h1>Tapo Smart Plug Metrics</h1>
-<p><a href="/metrics">Metrics</a> | <a href="/health">Health</a></p>
+<p><a href="/metrics">Metrics</a> | <a href="/health">Health</a> | <a href="/readyz">Readiness</a></p>
 <p>Scraping %d devices every %v</p>
 </body>
 </html>`, len(getConfiguredDevices()), pollInterval)
@@ -113,15 +450,14 @@ func main() {
 	<-sigChan
 	serviceLogger.Info("Shutdown signal received, stopping gracefully...")
 
-	// Stop Tapo service
-	if err := tapoService.Stop(); err != nil {
-		serviceLogger.Error("Error stopping Tapo service", err)
-	}
-
-	// Shutdown HTTP server
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Stop the services in order, then the HTTP server so health probes answer until the end
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
 	defer shutdownCancel()
 
+	if err := running.Stop(shutdownCtx); err != nil {
+		serviceLogger.Error("Error stopping services", err)
+	}
+
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		serviceLogger.Error("Error shutting down HTTP server", err)
 	}
@@ -129,6 +465,72 @@ func main() {
 	serviceLogger.Info("Tapo metrics scraper stopped")
 }
 
+// pollOnce polls every device once and prints the results as JSON. It returns the exit code:
+// 0 when every device answered, 1 when a device failed or none are configured.
+func pollOnce(tapoService *services.TapoService, energyService *services.EnergyService, costService *services.EnergyCostService, logger *logger.Logger) int {
+	results := tapoService.PollOnce()
+
+	if err := energyService.Save(); err != nil {
+		logger.Error("Failed to save room energy totals", err)
+	}
+	if costService != nil {
+		if err := costService.Save(); err != nil {
+			logger.Error("Failed to save energy cost totals", err)
+		}
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{
+		"service":   "tapo-metrics",
+		"polled_at": time.Now(),
+		"devices":   results,
+		"failed":    failed,
+	}); err != nil {
+		logger.Error("Failed to write results", err)
+		return 1
+	}
+
+	if failed > 0 || len(results) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// startProvisioning loads the provisioning rules and starts discovering assets for them. The
+// unified gateway keeps the asset registry, so the assets found here are only kept in memory.
+func startProvisioning(path string, tapoService *services.TapoService, username, password string) (*discovery.DiscoveryManager, *services.ProvisioningService, error) {
+	provisioningConfig, err := services.LoadProvisioningConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	provisioning := services.NewProvisioningService(provisioningConfig, logger.NewLogger("Provisioning", nil))
+	provisioning.SetTapo(tapoService, username, password)
+
+	assets, err := discovery.NewDiscoveryManager(discovery.DiscoveryConfig{
+		AutoQuery: true,
+		Logger:    log.New(io.Discard, "", 0),
+		MDNS:      true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := assets.Start(); err != nil {
+		return nil, nil, err
+	}
+	if err := assets.QueryByType(discovery.AssetTypeSmartPlug); err != nil {
+		log.Printf("Failed to query for smart plugs: %v", err)
+	}
+	return assets, provisioning, nil
+}
+
 func configureDevices(tapoService *services.TapoService, username, password string, pollInterval time.Duration, logger *logger.Logger) error {
 	// Default configuration - can be overridden by config file or environment variables
 	defaultDevices := []*services.TapoConfig{
@@ -141,6 +543,7 @@ func configureDevices(tapoService *services.TapoService, username, password stri
 			Password:     password,
 			PollInterval: pollInterval,
 			UseKlap:      getBoolEnvWithDefault("TAPO_DEVICE_1_USE_KLAP", false),
+			Cycle:        services.DefaultCycleConfig(),
 		},
 		{
 			DeviceID:     "tapo_device_2",
@@ -151,6 +554,7 @@ func configureDevices(tapoService *services.TapoService, username, password stri
 			Password:     password,
 			PollInterval: pollInterval,
 			UseKlap:      getBoolEnvWithDefault("TAPO_DEVICE_2_USE_KLAP", false),
+			Cycle:        services.DefaultCycleConfig(),
 		},
 		{
 			DeviceID:     "tapo_device_3",
@@ -2,21 +2,39 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/buildinfo"
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/health"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/profiling"
+	"github.com/johnpr01/home-automation/internal/safemode"
 	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/internal/tracing"
 	"github.com/johnpr01/home-automation/internal/utils"
 	"github.com/johnpr01/home-automation/pkg/kafka"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 func main() {
+	safeModeFlag := flag.Bool("safe-mode", false, "Start with all automations disabled and actuators untouched")
+	observeOnlyFlag := flag.Bool("observe-only", false, "Ingest and display data but never publish commands (dry-run)")
+	debugAddr := flag.String("debug-addr", "", "Address for the /metrics and admin-gated pprof debug server (default $HA_DEBUG_ADDR, disabled if empty)")
+	once := flag.Bool("once", false, "Run one control cycle on the last-known sensor state, print the thermostats as JSON and exit")
+	flag.Parse()
+
 	// Initialize error handling context
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -35,27 +53,95 @@ func main() {
 		}()
 	}
 
-	// Initialize logger
+	// Initialize logger; the levels can be changed on the debug server
 	serviceLogger := logger.NewLogger("thermostat-service", kafkaClient)
+	logFile, err := logger.ConfigureOutput(config.Load().Log, "thermostat-service")
+	if err != nil {
+		serviceLogger.Error("Invalid log output, logging to stdout", err)
+	}
+	defer logFile.Close()
+	if err := logger.ApplyLevels(config.Load().LogLevel); err != nil {
+		serviceLogger.Error("Invalid HA_LOG_LEVEL", err)
+	}
+	tracer, err := tracing.Configure(config.Load().Tracing, "thermostat-service")
+	if err != nil {
+		serviceLogger.Error("Invalid tracing settings, tracing is off", err)
+	}
+	if *once {
+		serviceLogger.SetOutput(os.Stderr) // Keep stdout for the JSON results
+	}
 	serviceLogger.Info("Starting Home Automation Thermostat Service")
 
-	// Load MQTT configuration
-	mqttConfig := &config.MQTTConfig{
-		Broker:   "localhost",
-		Port:     "1883",
-		Username: "",
-		Password: "",
+	// Resolve safe mode before the control loop can act
+	cfg := config.Load()
+	safeModeController, crashDetector, err := safemode.Startup(cfg.StateDir, "thermostat-service", *safeModeFlag, serviceLogger)
+	if err != nil {
+		serviceLogger.Error("Safe mode state unavailable", err)
+	}
+	go safeModeController.Watch(ctx, 5*time.Second)
+
+	// Observe-only mode traces HVAC commands instead of publishing them
+	observeOnly := *observeOnlyFlag || cfg.ObserveOnly
+	dryRunRecorder := dryrun.NewRecorder(observeOnly, dryrun.TracePath(cfg.StateDir), serviceLogger)
+	if observeOnly {
+		serviceLogger.Warn("Observe-only mode: no thermostat commands will be published")
+	}
+
+	// Expose runtime gauges and profiling for this service
+	if *debugAddr == "" {
+		*debugAddr = cfg.DebugAddr
+	}
+	buildInfo := buildinfo.Get("thermostat-service", buildinfo.Features(map[string]bool{
+		"safe_mode":    safeModeController.Active(),
+		"observe_only": observeOnly,
+		"debug_server": *debugAddr != "",
+		"pprof":        *debugAddr != "" && cfg.AdminToken != "",
+	}))
+	serviceLogger.Info("Build info", map[string]interface{}{
+		"version":    buildInfo.Version,
+		"commit":     buildInfo.Commit,
+		"build_date": buildInfo.BuildDate,
+		"features":   buildInfo.Features,
+	})
+	// Checks are registered as the connections and services come up
+	healthChecker := health.NewRegistry("thermostat-service")
+	if *debugAddr != "" {
+		if err := services.RegisterSensorMetrics(prometheus.DefaultRegisterer); err != nil {
+			serviceLogger.Error("Failed to register thermostat metrics", err)
+		}
+		healthChecker.RegisterReadiness("prometheus", health.Prometheus(prometheus.DefaultGatherer))
+		go func() {
+			routes := map[string]http.Handler{
+				"/build-info": buildinfo.Handler(buildInfo),
+				"/healthz":    healthChecker.LivenessHandler(),
+				"/readyz":     healthChecker.ReadinessHandler(),
+			}
+			if err := profiling.Serve(ctx, *debugAddr, "thermostat-service", cfg.AdminToken, routes, serviceLogger); err != nil {
+				serviceLogger.Error("Debug server stopped", err)
+			}
+		}()
 	}
 
+	// Load MQTT configuration, with its own brokers when MQTT_BROKERS_THERMOSTAT is set
+	mqttConfig := config.Load().MQTT.ForIntegration("thermostat")
+
 	// Create MQTT client with enhanced error handling
 	retryConfig := utils.DefaultRetryConfig()
 	retryConfig.MaxAttempts = 5
 	circuitBreaker := utils.NewCircuitBreaker(3, 30*time.Second)
 
+	// Keep the last sensor readings so a restart doesn't leave the thermostats blind
+	stateCache, err := mqtt.NewStateCache(mqtt.StateCachePath(cfg.StateDir), mqttConfig.StateMaxAge)
+	if err != nil {
+		serviceLogger.Error("Failed to load MQTT state cache, starting without last-known state", err)
+	}
+
 	mqttOptions := &mqtt.ClientOptions{
 		RetryConfig:    retryConfig,
 		CircuitBreaker: circuitBreaker,
 		Logger:         serviceLogger,
+		StateCache:     stateCache,
+		Service:        buildInfo.Service,
 	}
 
 	mqttClient := mqtt.NewClient(mqttConfig, mqttOptions)
@@ -75,8 +161,15 @@ func main() {
 		}
 	}()
 
+	// Announce the running build so multi-binary deployments can verify matching versions
+	if err := buildinfo.Announce(mqttClient, buildInfo); err != nil {
+		serviceLogger.Error("Failed to announce build info", err)
+	}
+
 	// Create thermostat service with enhanced error handling
 	thermostatService := services.NewThermostatService(mqttClient, serviceLogger)
+	thermostatService.SetSafeMode(safeModeController)
+	thermostatService.SetDryRunRecorder(dryRunRecorder)
 
 	// Register a sample thermostat for room 1 (using Fahrenheit)
 	sampleThermostat := &models.Thermostat{
@@ -108,28 +201,62 @@ func main() {
 		"name":          sampleThermostat.Name,
 	})
 
-	// Initialize health checker
-	healthChecker := utils.NewHealthChecker()
-	healthChecker.RegisterCheck("mqtt_connection", func() error {
-		return mqttClient.GetHealthStatus(ctx)["mqtt_connection"]
-	})
-	healthChecker.RegisterCheck("thermostat_service", func() error {
+	// Replay last-known sensor state now that the thermostats are registered
+	mqttClient.ReplayState()
+
+	// One-shot mode: a single control cycle for cron-based deployments and debugging
+	if *once {
+		code := controlOnce(thermostatService, serviceLogger)
+		if err := mqttClient.Disconnect(); err != nil {
+			serviceLogger.Error("Error disconnecting from MQTT broker", err)
+		}
+		traceCtx, traceCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracer.Shutdown(traceCtx); err != nil {
+			serviceLogger.Error("Failed to export the last trace spans", err)
+		}
+		traceCancel()
+		if err := crashDetector.RecordCleanShutdown(); err != nil {
+			serviceLogger.Error("Failed to record clean shutdown", err)
+		}
+		os.Exit(code)
+	}
+
+	// Services stop in the reverse of the order they start in: the control loop first, then the
+	// MQTT connection its last commands went out on, and the spans of it all are exported last
+	running := lifecycle.NewGroup(lifecycle.DefaultStopTimeout)
+	running.Start(ctx, "tracing", lifecycle.Hooks{OnStop: tracer.Shutdown})
+	running.Start(ctx, "mqtt", lifecycle.OnStop(mqttClient.Disconnect))
+	if err := running.Start(ctx, "thermostat", thermostatService); err != nil {
+		serviceLogger.Error("Failed to start the thermostat control loop", err)
+	}
+
+	// Register the health checks
+	healthChecker.RegisterReadiness("mqtt_connection", mqttClient.HealthCheck)
+	if kafkaClient != nil {
+		healthChecker.RegisterOptional("kafka_connection", kafkaClient.HealthCheck)
+	}
+	// Follow the availability of the other services
+	availability := mqtt.NewAvailabilityTracker()
+	if err := availability.Subscribe(mqttClient); err != nil {
+		serviceLogger.Error("Failed to subscribe to service availability", err)
+	}
+	healthChecker.RegisterOptional("service_availability", availability.HealthCheck)
+	healthChecker.RegisterLiveness("thermostat_service", health.Responds(func() {
 		// Check if thermostat is responsive
-		_, err := thermostatService.GetThermostat("thermostat-001")
-		return err
-	})
+		thermostatService.GetAllThermostats()
+	}))
 
 	// Set up graceful shutdown with enhanced error handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	serviceLogger.Info("Thermostat service is running", map[string]interface{}{
-		"topics":      []string{"room-temp/+", "room-hum/+"},
+		"topics":      []string{mqtt.RoomTopic(mqtt.TopicRoomTemperature, "+"), mqtt.RoomTopic(mqtt.TopicRoomHumidity, "+")},
 		"thermostats": 1,
 	})
 
 	// Health check routine
-	go func() {
+	running.Go(ctx, "health_monitor", func(ctx context.Context) {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 
@@ -153,17 +280,14 @@ func main() {
 				}
 			}
 		}
-	}()
+	})
 
 	// Wait for shutdown signal
 	<-sigChan
 	serviceLogger.Info("Received shutdown signal, shutting down gracefully")
 
-	// Cancel context to stop all background operations
-	cancel()
-
 	// Give services time to clean up
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer shutdownCancel()
 
 	// Perform health check before shutdown
@@ -177,5 +301,46 @@ func main() {
 		}
 	}
 
+	if err := running.Stop(shutdownCtx); err != nil {
+		serviceLogger.Error("Services did not stop cleanly", err)
+	}
+
+	// Cancel context to stop the remaining background operations
+	cancel()
+
+	if err := crashDetector.RecordCleanShutdown(); err != nil {
+		serviceLogger.Error("Failed to record clean shutdown", err)
+	}
+
 	serviceLogger.Info("Thermostat service shutdown complete")
 }
+
+// controlOnce runs one control cycle and prints the thermostats as JSON. It returns the exit
+// code: 0 when every thermostat has recent sensor data, 1 when one is offline.
+func controlOnce(thermostatService *services.ThermostatService, serviceLogger *logger.Logger) int {
+	thermostats := thermostatService.RunOnce()
+
+	offline := 0
+	for _, thermostat := range thermostats {
+		if !thermostat.IsOnline {
+			offline++
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{
+		"service":     "thermostat-service",
+		"ran_at":      time.Now(),
+		"thermostats": thermostats,
+		"offline":     offline,
+	}); err != nil {
+		serviceLogger.Error("Failed to write results", err)
+		return 1
+	}
+
+	if offline > 0 {
+		return 1
+	}
+	return 0
+}
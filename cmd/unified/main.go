@@ -2,48 +2,181 @@ package main
 
 import (
 	"context"
+	"flag"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/access"
+	"github.com/johnpr01/home-automation/internal/backup"
+	"github.com/johnpr01/home-automation/internal/buildinfo"
+	"github.com/johnpr01/home-automation/internal/calendar"
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/demo"
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/failover"
+	"github.com/johnpr01/home-automation/internal/grpcapi"
+	"github.com/johnpr01/home-automation/internal/health"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/plugins"
+	"github.com/johnpr01/home-automation/internal/profiling"
+	"github.com/johnpr01/home-automation/internal/safemode"
 	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/internal/tracing"
+	"github.com/johnpr01/home-automation/internal/voice"
+	"github.com/johnpr01/home-automation/pkg/discovery"
 	"github.com/johnpr01/home-automation/pkg/kafka"
+	"github.com/johnpr01/home-automation/pkg/matter"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/nut"
+	"github.com/johnpr01/home-automation/web"
 )
 
 // HomeAutomationSystem coordinates all home automation services
 type HomeAutomationSystem struct {
 	unifiedSensorService *services.UnifiedSensorService
 	thermostatService    *services.ThermostatService
+	presenceService      *services.PresenceService
+	scheduleService      *services.ScheduleService
+	sceneService         *services.SceneService
+	holidays             *calendar.Calendar
+	identities           *identity.Registry
+	mqttDeviceService    *services.MQTTDeviceService
+	roomEnergy           *services.EnergyService
+	weather              *services.WeatherService
+	condensation         *services.CondensationGuardService
+	zones                *services.ZoneController
+	followMe             *services.FollowMeService
+	matterDevices        *services.DeviceService
+	tapoBulbs            *services.DeviceService
+	matterCommands       *services.CommandQueue
+	matterService        *services.MatterService
+	powerRestore         *services.PowerRestoreService
+	ups                  *services.UPSService
+	voiceConfig          *voice.Config
+	topicMigration       *services.TopicMigrationService
+	alerts               *services.AlertService
+	webhooks             *services.WebhookService
+	scripts              *services.ScriptService
+	history              *services.HistoryService
+	hazards              *services.HazardService
+	residents            *services.ResidentPresenceService
+	arrival              *services.ArrivalWarmUpService
+	homeMode             *services.HomeModeService
+	departure            *services.DepartureService
+	digest               *services.DigestService
+	roomClosures         *services.RoomClosureService
+	access               *access.Manager
+	gatewaySensors       *services.GatewaySensorService
+	bleSensors           *services.BLESensorService
+	ota                  *services.OTAService
+	plugins              *plugins.Manager
+	backup               *backup.Service
+	failover             *failover.Controller
+	failoverConfig       *failover.Config
+	discovery            *discovery.DiscoveryProtocol
+	mdns                 *discovery.MDNSService
+	assets               *discovery.DiscoveryManager
+	provisioning         *services.ProvisioningService
+	health               *health.Registry
+	running              *lifecycle.Group
+	readReplica          bool
 	mqttClient           *mqtt.Client
+	availability         *mqtt.AvailabilityTracker
+	safeMode             *safemode.Controller
+	crashDetector        *safemode.CrashLoopDetector
+	buildInfo            buildinfo.Info
+	dryRun               *dryrun.Recorder
+	demo                 *demo.Simulator
 	logger               *log.Logger
 	ctx                  context.Context
 	cancel               context.CancelFunc
 }
 
 func main() {
+	safeModeFlag := flag.Bool("safe-mode", false, "Start with all automations disabled and actuators untouched")
+	observeOnlyFlag := flag.Bool("observe-only", false, "Ingest and display data but never publish commands (dry-run)")
+	readReplicaFlag := flag.Bool("read-replica", false, "Serve the dashboard and API from the MQTT stream without controlling anything")
+	debugAddr := flag.String("debug-addr", "", "Address for the /metrics and admin-gated pprof debug server (default $HA_DEBUG_ADDR, disabled if empty)")
+	demoFlag := flag.Bool("demo", false, "Run the bundled demo house: simulated rooms, devices and rules, without hardware or a broker")
+	flag.Parse()
+
+	// The demo house runs from a scratch state directory with its own configuration files
+	if *demoFlag {
+		stateDir, err := demo.Setup("")
+		if err != nil {
+			log.Fatalf("Failed to set up the demo house: %v", err)
+		}
+		if *debugAddr == "" {
+			*debugAddr = config.Load().DebugAddr
+		}
+		log.Printf("Demo house: state in %s, API on http://%s with admin token %q",
+			stateDir, *debugAddr, config.Load().AdminToken)
+	}
+
+	// Apply the log format, file and levels before any service logs; the levels can be changed
+	// on the debug server
+	logFile, err := logger.ConfigureOutput(config.Load().Log, "unified")
+	if err != nil {
+		log.Printf("Invalid log output, logging to stdout: %v", err)
+	}
+	defer logFile.Close()
+	if err := logger.ApplyLevels(config.Load().LogLevel); err != nil {
+		log.Printf("Invalid HA_LOG_LEVEL: %v", err)
+	}
+
+	// Trace sensor messages through the services to the commands they cause, when a collector is set
+	tracer, err := tracing.Configure(config.Load().Tracing, "unified")
+	if err != nil {
+		log.Printf("Invalid tracing settings, tracing is off: %v", err)
+	}
+
+	// Translations are loaded before the residents, whose locales must be in the catalog
+	if messagesFile := config.Load().MessagesFile; messagesFile != "" {
+		if err := i18n.LoadMessages(messagesFile); err != nil {
+			log.Printf("Failed to load messages file: %v", err)
+		}
+	}
+	if err := i18n.SetLocale(config.Load().Locale); err != nil {
+		log.Printf("Invalid HA_LOCALE, using %s: %v", i18n.Locale(), err)
+	}
+
 	// Create logger
-	logger := log.New(os.Stdout, "[HOME-AUTO] ", log.LstdFlags|log.Lshortfile)
+	logger := logger.NewStdLogger("HOME-AUTO")
 	logger.Println("Starting Home Automation System...")
 
-	// Initialize MQTT client
-	mqttConfig := &config.MQTTConfig{
-		Broker:   "localhost",
-		Port:     "1883",
-		Username: "",
-		Password: "",
+	// Keep the last sensor readings so a restart doesn't leave the services blind
+	stateCache, err := mqtt.NewStateCache(mqtt.StateCachePath(config.Load().StateDir), config.Load().MQTT.StateMaxAge)
+	if err != nil {
+		logger.Printf("Failed to load MQTT state cache, starting without last-known state: %v", err)
 	}
-	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	// Connect to MQTT broker
-	if err := mqttClient.Connect(); err != nil {
+	// A read replica takes UI traffic off the control node; its client never publishes
+	readReplica := *readReplicaFlag || config.Load().ReadReplica
+
+	// Connect to the sensor brokers, failing over to MQTT_BROKERS in order
+	mqttClient, err := mqtt.ConnectIntegration(config.Load().MQTT, "sensors", mqtt.SensorTopics, &mqtt.ClientOptions{
+		StateCache: stateCache,
+		Service:    "unified",
+		ReadOnly:   readReplica,
+		Loopback:   *demoFlag,
+	})
+	if err != nil {
 		logger.Fatalf("Failed to connect to MQTT broker: %v", err)
 	}
-	defer mqttClient.Disconnect()
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -51,22 +184,78 @@ func main() {
 
 	// Initialize home automation system
 	homeSystem := &HomeAutomationSystem{
-		mqttClient: mqttClient,
-		logger:     logger,
-		ctx:        ctx,
-		cancel:     cancel,
+		mqttClient:  mqttClient,
+		readReplica: readReplica,
+		logger:      logger,
+		running:     lifecycle.NewGroup(lifecycle.DefaultStopTimeout),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 
+	// Services stop in the reverse of the order they start in, so these go last: the failover
+	// goodbye once nothing acts anymore, then the broker connection and the spans of it all
+	homeSystem.running.Start(ctx, "tracing", lifecycle.Hooks{OnStop: tracer.Shutdown})
+	homeSystem.running.Start(ctx, "mqtt", lifecycle.OnStop(mqttClient.Disconnect))
+	homeSystem.running.Start(ctx, "failover_goodbye", lifecycle.OnStop(homeSystem.sayGoodbye))
+
+	// Resolve safe mode before any service can act
+	if err := homeSystem.initializeSafeMode(*safeModeFlag); err != nil {
+		logger.Printf("Safe mode state unavailable: %v", err)
+	}
+
+	homeSystem.initializeObserveOnly(*observeOnlyFlag || readReplica)
+
+	// A failover pair starts in standby so two gateways never act at once
+	homeSystem.initializeFailover()
+
 	// Start all services
 	if err := homeSystem.initializeServices(); err != nil {
 		logger.Fatalf("Failed to initialize services: %v", err)
 	}
 
+	// Follow the availability of the other services
+	homeSystem.availability = mqtt.NewAvailabilityTracker()
+	homeSystem.availability.AddCallback(func(service string, online bool) {
+		logger.Printf("Service %s is %s", service, map[bool]string{true: "online", false: "offline"}[online])
+	})
+	if err := homeSystem.availability.Subscribe(mqttClient); err != nil {
+		logger.Printf("Failed to subscribe to service availability: %v", err)
+	}
+
+	// Thermostat schedules and holds can also be edited over MQTT
+	if err := homeSystem.scheduleService.Subscribe(mqttClient); err != nil {
+		logger.Printf("Failed to subscribe to thermostat schedule edits: %v", err)
+	}
+
+	// Mirror state from the active gateway and start the election heartbeat
+	homeSystem.startFailover()
+	homeSystem.startReadReplica()
+
+	// The demo house's sensors and devices talk to the services over the loopback client
+	if *demoFlag {
+		homeSystem.startDemo()
+	}
+
+	// Replay last-known sensor state now that every callback is wired up
+	logger.Printf("Replayed %d last-known sensor messages", mqttClient.ReplayState())
+
+	if *debugAddr == "" {
+		*debugAddr = config.Load().DebugAddr
+	}
+	homeSystem.announceBuildInfo(*debugAddr != "")
+	homeSystem.startAssetDiscovery()
+	homeSystem.startDebugServer(*debugAddr)
+	homeSystem.startGRPCServer(config.Load().GRPCAddr)
+	homeSystem.startMDNS(*debugAddr)
+
 	// Start system monitoring
-	go homeSystem.startSystemMonitoring()
+	homeSystem.running.Go(ctx, "system_monitor", homeSystem.startSystemMonitoring)
 
 	// Start sensor data analysis
-	go homeSystem.startSensorAnalysis()
+	homeSystem.running.Go(ctx, "sensor_analysis", homeSystem.startSensorAnalysis)
+
+	// Follow applied thermostat schedules
+	homeSystem.running.Go(ctx, "schedules", homeSystem.scheduleService.Run)
 
 	// Setup graceful shutdown
 	homeSystem.setupGracefulShutdown()
@@ -77,12 +266,245 @@ func main() {
 	// Wait for shutdown signal
 	<-homeSystem.ctx.Done()
 	logger.Println("Home Automation System shutting down...")
+
+	// Stop the services in the reverse of the order they started in: automations first, then
+	// the services they drive, saving state as each goes, within HA_SHUTDOWN_TIMEOUT
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.Load().ShutdownTimeout)
+	if err := homeSystem.running.Stop(shutdownCtx); err != nil {
+		logger.Printf("Shutdown incomplete: %v", err)
+	}
+	shutdownCancel()
+
+	if err := homeSystem.crashDetector.RecordCleanShutdown(); err != nil {
+		logger.Printf("Failed to record clean shutdown: %v", err)
+	}
+}
+
+// initializeSafeMode resolves safe mode from the --safe-mode flag, crash history and persisted state
+func (has *HomeAutomationSystem) initializeSafeMode(forced bool) error {
+	cfg := config.Load()
+
+	controller, detector, err := safemode.Startup(cfg.StateDir, "unified", forced, logger.NewLogger("SafeMode", nil))
+	has.safeMode = controller
+	has.crashDetector = detector
+
+	if controller.Active() {
+		has.logger.Println("SAFE MODE: automations disabled, actuators untouched")
+		has.logger.Println("Use 'home-automation-cli -cmd safe-mode' to inspect and re-enable components")
+	}
+
+	// Pick up changes made through the CLI
+	go controller.Watch(has.ctx, 5*time.Second)
+
+	return err
+}
+
+// initializeObserveOnly sets up the dry-run recorder used when commands must never be published
+func (has *HomeAutomationSystem) initializeObserveOnly(forced bool) {
+	cfg := config.Load()
+	observeOnly := forced || cfg.ObserveOnly
+
+	has.dryRun = dryrun.NewRecorder(observeOnly, dryrun.TracePath(cfg.StateDir), logger.NewLogger("DryRun", nil))
+
+	if has.readReplica {
+		has.logger.Println("READ REPLICA: serving the dashboard and API only, the control node does the controlling")
+	} else if observeOnly {
+		has.logger.Println("OBSERVE-ONLY: data is ingested but no commands will be published")
+		has.logger.Println("Use 'home-automation-cli -cmd dry-run' to review what would have been sent")
+	}
+}
+
+// initializeFailover withholds commands until this gateway wins the failover election
+func (has *HomeAutomationSystem) initializeFailover() {
+	cfg := config.Load()
+	if cfg.FailoverFile == "" {
+		return
+	}
+	if has.readReplica {
+		has.logger.Println("READ REPLICA: ignoring HA_FAILOVER_FILE, a read replica never takes over")
+		return
+	}
+
+	failoverConfig, err := failover.LoadConfig(cfg.FailoverFile)
+	if err != nil {
+		has.logger.Printf("Failed to load failover config, running alone: %v", err)
+		return
+	}
+
+	has.failoverConfig = failoverConfig
+	has.failover = failover.NewController(failoverConfig, failover.StatePath(cfg.StateDir), logger.NewLogger("Failover", nil))
+	has.dryRun.SetStandby(true)
+	has.failover.OnRoleChange(func(role failover.Role, epoch uint64) {
+		has.dryRun.SetStandby(role != failover.RoleActive)
+		has.logger.Printf("FAILOVER: gateway %s is now %s (epoch %d)", failoverConfig.NodeID, role, epoch)
+	})
+	has.logger.Printf("FAILOVER: gateway %s starts in standby, no commands until it is elected", failoverConfig.NodeID)
+}
+
+// startFailover mirrors state from the active gateway and announces this gateway's heartbeat
+func (has *HomeAutomationSystem) startFailover() {
+	if has.failover == nil {
+		return
+	}
+	cfg := config.Load()
+	failoverConfig := has.failoverConfig
+
+	files := failoverConfig.StateFiles
+	if len(files) == 0 {
+		files = mirroredStateFiles(cfg.StateDir)
+	}
+	replicator := failover.NewReplicator(has.failover, cfg.StateDir, files, logger.NewLogger("Failover", nil))
+	replicator.OnTakeover(has.scheduleService.Reload)
+	replicator.OnTakeover(has.presenceService.Reload)
+	if has.alerts != nil {
+		replicator.OnTakeover(has.alerts.Start)
+	}
+	if err := replicator.Subscribe(has.mqttClient); err != nil {
+		has.logger.Printf("Failed to subscribe to failover state: %v", err)
+	}
+	has.running.Go(has.ctx, "failover_replicator", replicator.Run)
+
+	protocol, err := discovery.NewDiscoveryProtocol(failover.GatewayAsset(failoverConfig, "Home Automation Gateway "+failoverConfig.NodeID))
+	if err != nil {
+		has.logger.Printf("Failed to start failover heartbeat, staying in standby: %v", err)
+		return
+	}
+	heartbeat := failover.NewHeartbeat(has.failover, protocol)
+	protocol.AddListener(heartbeat)
+	if err := protocol.Start(); err != nil {
+		has.logger.Printf("Failed to announce failover heartbeat: %v", err)
+	}
+	has.discovery = protocol
+	has.running.Go(has.ctx, "failover_heartbeat", heartbeat.Run)
+}
+
+// sayGoodbye stops the failover heartbeat so the standby takes over without waiting for it to
+// time out. It runs once the services have stopped, so the two gateways never act at once.
+func (has *HomeAutomationSystem) sayGoodbye() error {
+	if has.discovery == nil {
+		return nil
+	}
+	return has.discovery.Stop()
+}
+
+// mirroredStateFiles lists the state files mirrored by default: only those that are reloaded
+// when they change underneath their service
+func mirroredStateFiles(stateDir string) []string {
+	return []string{
+		filepath.Base(services.ThermostatSchedulePath(stateDir)),
+		filepath.Base(services.PresencePath(stateDir)),
+		filepath.Base(services.AlertsPath(stateDir)),
+	}
+}
+
+// startReadReplica follows the state files the active gateway mirrors, so the replica's API
+// shows the control node's schedules, occupancy history and alerts
+func (has *HomeAutomationSystem) startReadReplica() {
+	if !has.readReplica {
+		return
+	}
+	cfg := config.Load()
+
+	files := mirroredStateFiles(cfg.StateDir)
+	follower := failover.NewFollower(cfg.StateDir, files, logger.NewLogger("ReadReplica", nil))
+	follower.OnUpdate(files[0], has.scheduleService.Reload)
+	follower.OnUpdate(files[1], has.presenceService.Reload)
+	if has.alerts != nil {
+		follower.OnUpdate(files[2], has.alerts.Start)
+	}
+	if err := follower.Subscribe(has.mqttClient); err != nil {
+		has.logger.Printf("Failed to subscribe to the control node's state: %v", err)
+	}
 }
 
 // initializeServices sets up all home automation services
 func (has *HomeAutomationSystem) initializeServices() error {
 	// Initialize unified sensor service
 	has.unifiedSensorService = services.NewUnifiedSensorService(has.mqttClient, has.logger)
+	has.unifiedSensorService.SetMaxRooms(config.Load().Limits.MaxRooms)
+	if err := has.running.Start(has.ctx, "sensors", has.unifiedSensorService); err != nil {
+		return err
+	}
+
+	// Resolve sensor device IDs to the stable UUIDs claimed with the CLI
+	identities, err := identity.NewRegistry(identity.RegistryPath(config.Load().StateDir))
+	if err != nil {
+		has.logger.Printf("Failed to load device registry: %v", err)
+	}
+	has.unifiedSensorService.SetIdentityRegistry(identities)
+	has.identities = identities
+
+	// Remind of warranties about to end, from the asset records set with the CLI
+	if days := config.Load().WarrantyReminderDays; days > 0 {
+		reminders := services.NewWarrantyReminderService(identities, days,
+			services.WarrantyRemindersPath(config.Load().StateDir), logger.NewLogger("WarrantyReminders", nil))
+		reminders.SetMQTTClient(has.mqttClient)
+		has.running.Go(has.ctx, "warranty_reminders", reminders.Run)
+	}
+
+	// Keep temperature and humidity history in InfluxDB when it is the configured backend
+	var tsClient services.TimeSeriesClient
+	if timeSeriesConfig := config.Load().TimeSeries; timeSeriesConfig.Backend == "influxdb" {
+		tsClient, err = services.SelectTimeSeriesClient(timeSeriesConfig, nil)
+		if err != nil {
+			return err
+		}
+		if err := tsClient.Connect(); err != nil {
+			has.logger.Printf("InfluxDB is not reachable yet, sensor writes will be retried: %v", err)
+		}
+		has.unifiedSensorService.SetTimeSeriesClient(tsClient)
+
+		// Serve that history downsampled, so dashboards needn't query InfluxDB themselves
+		if querier, ok := tsClient.(services.HistoryQuerier); ok {
+			has.history = services.NewHistoryService(querier, logger.NewLogger("HistoryService", nil))
+		}
+	}
+
+	// Devices on old firmware still publish on legacy topics; republish them on the current ones
+	var topicMigrations []mqtt.TopicMigration
+	if migrationsFile := config.Load().TopicMigrationsFile; migrationsFile != "" {
+		topicMigrations, err = services.LoadTopicMigrations(migrationsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load topic migrations, only the built-in ones apply: %v", err)
+		}
+	}
+	has.topicMigration = services.NewTopicMigrationService(has.mqttClient, topicMigrations, logger.NewLogger("TopicMigrationService", nil))
+	if err := has.topicMigration.Start(); err != nil {
+		has.logger.Printf("Failed to subscribe to legacy topics: %v", err)
+	}
+
+	// Tasmota and ESPHome devices report on their own topics; their climate sensors are
+	// republished as room sensor readings
+	has.mqttDeviceService = services.NewMQTTDeviceService(has.mqttClient, tsClient, logger.NewLogger("MQTTDeviceService", nil))
+	has.mqttDeviceService.SetSafeMode(has.safeMode)
+	has.mqttDeviceService.SetDryRunRecorder(has.dryRun)
+	if devicesFile := config.Load().MQTTDevicesFile; devicesFile != "" {
+		devices, err := services.LoadMQTTDevices(devicesFile)
+		if err != nil {
+			has.logger.Printf("Failed to load Tasmota/ESPHome devices: %v", err)
+		}
+		for _, device := range devices {
+			if err := has.mqttDeviceService.AddDevice(device); err != nil {
+				has.logger.Printf("Failed to add device %s: %v", device.DeviceID, err)
+			}
+		}
+	}
+
+	// Room energy of the metered DIY plugs, plus lighting estimated from bulb wattage × on-time.
+	// Summaries aren't published: the Tapo scraper owns the room energy topics.
+	has.roomEnergy = services.NewEnergyService(nil, services.GatewayRoomEnergyPath(config.Load().StateDir), logger.NewLogger("EnergyService", nil))
+	has.mqttDeviceService.AddReadingCallback(has.roomEnergy.Record)
+	has.running.Start(has.ctx, "room_energy_totals", lifecycle.OnStop(has.roomEnergy.Save))
+	if lightingFile := config.Load().LightingLoadsFile; lightingFile != "" {
+		lightingConfig, err := services.LoadLightingConfig(lightingFile)
+		if err != nil {
+			has.logger.Printf("Failed to load lighting loads: %v", err)
+		} else {
+			estimator := services.NewLightingEnergyEstimator(lightingConfig, has.mqttDeviceService, logger.NewLogger("LightingEnergy", nil))
+			estimator.AddReadingCallback(has.roomEnergy.Record)
+			has.running.Go(has.ctx, "lighting_energy", estimator.Run)
+		}
+	}
 
 	// Create custom logger for thermostat service
 	kafkaClient := kafka.NewClient([]string{"localhost:9092"}, "thermostat-logs", nil)
@@ -90,16 +512,966 @@ func (has *HomeAutomationSystem) initializeServices() error {
 
 	// Initialize thermostat service
 	has.thermostatService = services.NewThermostatService(has.mqttClient, customLogger)
+	has.thermostatService.SetSafeMode(has.safeMode)
+	has.thermostatService.SetDryRunRecorder(has.dryRun)
+	if err := has.running.Start(has.ctx, "thermostats", has.thermostatService); err != nil {
+		return err
+	}
+
+	// Stages, heat pumps and compressor protection; single-stage furnace and AC otherwise
+	if equipmentFile := config.Load().HVACEquipmentFile; equipmentFile != "" {
+		equipment, err := services.LoadHVACEquipment(equipmentFile)
+		if err != nil {
+			has.logger.Printf("Failed to load HVAC equipment: %v", err)
+		}
+		for id, entry := range equipment {
+			if err := has.thermostatService.SetEquipment(id, entry); err != nil {
+				has.logger.Printf("Failed to set HVAC equipment of %s: %v", id, err)
+			}
+		}
+	}
+
+	// Thermostats sharing a furnace or heat pump take turns, and their zone dampers follow
+	if zonesFile := config.Load().HVACZonesFile; zonesFile != "" {
+		zoneConfig, err := services.LoadZoneConfig(zonesFile)
+		if err != nil {
+			has.logger.Printf("Failed to load HVAC zones: %v", err)
+		} else {
+			has.zones = services.NewZoneController(zoneConfig, logger.NewLogger("ZoneController", nil))
+			has.zones.SetMQTTClient(has.mqttClient)
+			has.zones.SetSafeMode(has.safeMode)
+			has.zones.SetDryRunRecorder(has.dryRun)
+			has.thermostatService.SetZoning(has.zones)
+		}
+	}
+
+	// PID control of heat calls for rooms that overshoot, e.g. with slow radiators
+	if controlFile := config.Load().ThermostatControlFile; controlFile != "" {
+		if err := has.thermostatService.SetControlStatePath(services.ThermostatControlPath(config.Load().StateDir)); err != nil {
+			has.logger.Printf("Failed to load learned room responses: %v", err)
+		}
+		controls, err := services.LoadThermostatControl(controlFile)
+		if err != nil {
+			has.logger.Printf("Failed to load thermostat control: %v", err)
+		}
+		for id, settings := range controls {
+			if err := has.thermostatService.SetControl(id, settings); err != nil {
+				has.logger.Printf("Failed to set PID control of %s: %v", id, err)
+			}
+		}
+	}
+
+	// Humidity setpoints show on the thermostats; the Tapo scraper switches the devices keeping them
+	if humidityFile := config.Load().HumidityFile; humidityFile != "" {
+		controls, err := services.LoadHumidityControl(humidityFile)
+		if err != nil {
+			has.logger.Printf("Failed to load humidity control: %v", err)
+		}
+		for id, control := range controls {
+			if err := has.thermostatService.SetHumiditySetpoint(id, control.Setpoint); err != nil {
+				has.logger.Printf("Failed to set humidity setpoint of %s: %v", id, err)
+			}
+		}
+	}
+
+	// Humid rooms cool with a slower fan, and cooling holds back before surfaces sweat
+	if condensationFile := config.Load().CondensationFile; condensationFile != "" {
+		condensationConfig, err := services.LoadCondensationGuardConfig(condensationFile)
+		if err != nil {
+			has.logger.Printf("Failed to load the condensation guard: %v", err)
+		} else {
+			has.condensation = services.NewCondensationGuardService(condensationConfig, logger.NewLogger("CondensationGuardService", nil))
+			has.condensation.SetMQTTClient(has.mqttClient)
+			has.thermostatService.SetCondensationGuard(has.condensation)
+		}
+	}
+
+	// The forecast pre-heats before cold nights and skips cooling ahead of cool evenings; the
+	// outdoor conditions are published as the sensors of a virtual outdoor room
+	if weatherFile := config.Load().WeatherFile; weatherFile != "" {
+		weatherConfig, err := services.LoadWeatherConfig(weatherFile)
+		if err != nil {
+			has.logger.Printf("Failed to load weather configuration: %v", err)
+		} else {
+			has.weather = services.NewWeatherService(weatherConfig, logger.NewLogger("WeatherService", nil))
+			has.weather.SetMQTTClient(has.mqttClient)
+			has.thermostatService.SetWeather(has.weather)
+			has.running.Go(has.ctx, "weather", has.weather.Run)
+		}
+	}
 
 	// Connect sensor service to thermostat service
-	has.unifiedSensorService.AddTemperatureCallback(has.thermostatService.HandleTemperatureUpdate)
+	has.unifiedSensorService.AddTemperatureCallbackContext(has.thermostatService.HandleTemperatureUpdateContext)
 	has.unifiedSensorService.AddMotionCallback(has.handleMotionUpdate)
 	has.unifiedSensorService.AddLightCallback(has.handleLightUpdate)
 
+	// Aggregate occupancy into heatmaps for schedule tuning
+	has.presenceService = services.NewPresenceService(services.PresencePath(config.Load().StateDir), logger.NewLogger("PresenceService", nil))
+	has.unifiedSensorService.AddMotionCallback(has.presenceService.HandleOccupancy)
+	has.running.Start(has.ctx, "occupancy_history", lifecycle.OnStop(has.presenceService.Save))
+
+	// Suggest weekly schedules from occupancy and HVAC runtime, and follow the applied ones
+	has.scheduleService = services.NewScheduleService(has.thermostatService, has.presenceService,
+		services.ThermostatSchedulePath(config.Load().StateDir), logger.NewLogger("ScheduleService", nil))
+	has.thermostatService.AddStatusCallback(has.scheduleService.RecordStatus)
+	has.running.Start(has.ctx, "thermostat_schedules", lifecycle.OnStop(has.scheduleService.Save))
+
+	// Holidays can follow a weekend schedule
+	if calendarFile := config.Load().CalendarFile; calendarFile != "" {
+		holidays, err := calendar.Load(calendarFile)
+		if err != nil {
+			has.logger.Printf("Failed to load holiday calendar, schedules follow the weekday: %v", err)
+		} else {
+			has.holidays = holidays
+			has.scheduleService.SetCalendar(holidays)
+		}
+	}
+
+	// Closed-off rooms leave the averages and automations, and their thermostats hold a deep setback
+	if !has.readReplica {
+		var closureConfig *services.RoomClosureConfig
+		if closuresFile := config.Load().RoomClosuresFile; closuresFile != "" {
+			loaded, err := services.LoadRoomClosureConfig(closuresFile)
+			if err != nil {
+				has.logger.Printf("Failed to load room closure schedules, closing through the API only: %v", err)
+			} else {
+				closureConfig = loaded
+			}
+		}
+		has.roomClosures = services.NewRoomClosureService(closureConfig,
+			services.RoomClosuresPath(config.Load().StateDir), logger.NewLogger("RoomClosure", nil))
+		has.roomClosures.AddClosureCallback(func(roomID string, closed bool) {
+			has.scheduleService.SetClosed(roomID, closed, has.roomClosures.Setback(roomID), time.Now())
+		})
+		has.unifiedSensorService.SetClosedRooms(has.roomClosures.Closed)
+		has.running.Go(has.ctx, "room_closures", has.roomClosures.Run)
+	}
+
+	// Thermostat targets and modes can be saved as scenes and recalled
+	has.sceneService = services.NewSceneService(services.ScenesPath(config.Load().StateDir, "unified"), logger.NewLogger("SceneService", nil))
+	has.sceneService.SetThermostatService(has.thermostatService)
+
+	// Follow-me lighting lights rooms ahead of someone walking through the house
+	if followMeFile := config.Load().FollowMeFile; followMeFile != "" {
+		followMeConfig, err := services.LoadFollowMeConfig(followMeFile)
+		if err != nil {
+			has.logger.Printf("Failed to load follow-me lighting: %v", err)
+		} else {
+			has.followMe = services.NewFollowMeService(followMeConfig, logger.NewLogger("FollowMeService", nil))
+			has.followMe.SetCommandExecutor(has.mqttDeviceService)
+			has.followMe.SetSafeMode(has.safeMode)
+			has.followMe.SetDryRunRecorder(has.dryRun)
+			has.unifiedSensorService.AddMotionCallback(has.followMe.HandleOccupancy)
+			has.unifiedSensorService.AddLightCallback(has.followMe.HandleLightLevel)
+			has.running.Go(has.ctx, "follow_me", has.followMe.Run)
+		}
+	}
+
+	// Power losses are told apart from ordinary restarts; critical plugs are switched back on
+	if powerRestoreFile := config.Load().PowerRestoreFile; powerRestoreFile != "" && !has.readReplica {
+		powerRestoreConfig, err := services.LoadPowerRestoreConfig(powerRestoreFile)
+		if err != nil {
+			has.logger.Printf("Failed to load power restoration routine: %v", err)
+		} else {
+			has.powerRestore = services.NewPowerRestoreService(powerRestoreConfig,
+				services.PowerStatePath(config.Load().StateDir), logger.NewLogger("PowerRestoreService", nil))
+			has.powerRestore.SetCommandExecutor(has.mqttDeviceService)
+			has.powerRestore.SetPowerStateReader(has.mqttDeviceService)
+			has.powerRestore.SetMQTTClient(has.mqttClient)
+			has.powerRestore.SetSafeMode(has.safeMode)
+			has.powerRestore.SetDryRunRecorder(has.dryRun)
+			has.mqttDeviceService.AddBootCallback(has.powerRestore.HandleDeviceBoot)
+			if err := has.powerRestore.Start(time.Now()); err != nil {
+				has.logger.Printf("Failed to read power state: %v", err)
+			}
+			// Recorded as a clean stop once the restoration routine can't run anymore
+			has.running.Start(has.ctx, "power_state", lifecycle.OnStop(has.powerRestore.Stop))
+			has.running.Go(has.ctx, "power_restore", has.powerRestore.Run)
+		}
+	}
+
+	// On a UPS, the gateway sheds loads on battery and shuts down in order before it runs out
+	if upsFile := config.Load().UPSFile; upsFile != "" && !has.readReplica {
+		upsConfig, err := services.LoadUPSConfig(upsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load UPS configuration: %v", err)
+		} else {
+			has.initializeUPS(upsConfig)
+		}
+	}
+
+	// Voice assistants control the thermostats and plugs through webhooks on the debug server
+	if voiceFile := config.Load().VoiceFile; voiceFile != "" && !has.readReplica {
+		voiceConfig, err := voice.LoadConfig(voiceFile)
+		if err != nil {
+			has.logger.Printf("Failed to load voice assistant configuration: %v", err)
+		} else {
+			has.voiceConfig = voiceConfig
+		}
+	}
+
+	// Inbound webhooks run device commands and scenes; outbound webhooks are called by them and
+	// by alert rules
+	if webhooksFile := config.Load().WebhooksFile; webhooksFile != "" && !has.readReplica {
+		webhookConfig, err := services.LoadWebhookConfig(webhooksFile)
+		if err == nil {
+			has.webhooks, err = services.NewWebhookService(webhookConfig, logger.NewLogger("WebhookService", nil))
+		}
+		if err != nil {
+			has.logger.Printf("Failed to load webhooks: %v", err)
+		} else {
+			has.webhooks.SetCommandExecutor(has.mqttDeviceService)
+			has.webhooks.SetSceneRecaller(has.sceneService)
+			has.webhooks.SetSafeMode(has.safeMode)
+			has.webhooks.SetDryRunRecorder(has.dryRun)
+		}
+	}
+
+	// Alert rules watch the room sensors and devices and notify when they fire and resolve
+	if alertsFile := config.Load().AlertsFile; alertsFile != "" {
+		alertConfig, err := services.LoadAlertConfig(alertsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load alert rules: %v", err)
+		} else {
+			has.alerts = services.NewAlertService(alertConfig,
+				services.AlertsPath(config.Load().StateDir), logger.NewLogger("AlertService", nil))
+			has.alerts.SetRoomSensors(has.unifiedSensorService)
+			has.alerts.SetDevices(has.mqttDeviceService)
+			has.alerts.SetMQTTClient(has.mqttClient)
+			if has.webhooks != nil {
+				has.alerts.SetWebhookCaller(has.webhooks)
+			}
+			if err := has.alerts.Start(); err != nil {
+				has.logger.Printf("Failed to restore active alerts: %v", err)
+			}
+			has.running.Go(has.ctx, "alerts", has.alerts.Run)
+		}
+	}
+
+	// Leak and smoke detectors alert at once and send the configured MQTT device commands;
+	// the Tapo plugs of the same rules are switched off by the Tapo metrics scraper
+	if !has.readReplica {
+		var hazardConfig *services.HazardConfig
+		if hazardFile := config.Load().HazardFile; hazardFile != "" {
+			loaded, err := services.LoadHazardConfig(hazardFile)
+			if err != nil {
+				has.logger.Printf("Failed to load hazard responses, alerting only: %v", err)
+			} else {
+				hazardConfig = loaded
+			}
+		}
+		has.hazards = services.NewHazardService(hazardConfig, logger.NewLogger("HazardService", nil))
+		has.hazards.SetCommandExecutor(has.mqttDeviceService)
+		has.hazards.SetMQTTClient(has.mqttClient)
+		has.unifiedSensorService.AddHazardCallback(has.hazards.HandleHazard)
+		has.running.Go(has.ctx, "hazards", has.hazards.Run)
+	}
+
+	// Residents' phones tell who is home; an empty home holds the thermostats at the away setback
+	var awaySetback *services.AwaySetback
+	if residentsFile := config.Load().ResidentsFile; residentsFile != "" {
+		residentConfig, err := services.LoadResidentPresenceConfig(residentsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load residents: %v", err)
+		} else {
+			for _, resident := range residentConfig.Residents {
+				i18n.SetUserLocale(resident.Name, resident.Locale)
+			}
+			has.residents = services.NewResidentPresenceService(residentConfig, logger.NewLogger("ResidentPresence", nil))
+			has.residents.SetMQTTClient(has.mqttClient)
+			if err := has.residents.Subscribe(has.mqttClient); err != nil {
+				has.logger.Printf("Failed to subscribe to OwnTracks: %v", err)
+			}
+			awaySetback = residentConfig.AwaySetback
+
+			// Residents heading home end the away setback ahead of them and light the porch
+			if residentConfig.ArrivalWarmUp != nil && !has.readReplica {
+				has.arrival = services.NewArrivalWarmUpService(residentConfig,
+					services.ArrivalWarmUpPath(config.Load().StateDir), logger.NewLogger("ArrivalWarmUp", nil))
+				has.arrival.SetThermostats(has.scheduleService, has.thermostatService)
+				has.arrival.SetCommandExecutor(has.mqttDeviceService)
+				has.residents.AddApproachCallback(has.arrival.HandleApproach)
+				has.residents.AddResidentCallback(has.arrival.HandleResident)
+				has.running.Go(has.ctx, "arrival_warm_up", has.arrival.Run)
+			}
+			has.running.Go(has.ctx, "residents", has.residents.Run)
+		}
+	}
+
+	// The home mode follows vacations, presence and the night; thermostats hold their setbacks
+	// while away and on vacation, and lights are simulated on vacation evenings
+	if !has.readReplica {
+		var modeConfig *services.HomeModeConfig
+		if homeModeFile := config.Load().HomeModeFile; homeModeFile != "" {
+			loaded, err := services.LoadHomeModeConfig(homeModeFile)
+			if err != nil {
+				has.logger.Printf("Failed to load home modes, following presence only: %v", err)
+			} else {
+				modeConfig = loaded
+			}
+		}
+		has.homeMode = services.NewHomeModeService(modeConfig,
+			services.HomeModePath(config.Load().StateDir), logger.NewLogger("HomeMode", nil))
+		has.homeMode.SetMQTTClient(has.mqttClient)
+		has.homeMode.SetCommandExecutor(has.mqttDeviceService)
+		if has.residents != nil {
+			has.residents.AddHomeCallback(has.homeMode.SetOccupied)
+		}
+		has.homeMode.AddModeCallback(func(mode string) {
+			setback := awaySetback
+			if mode == services.HomeModeVacation {
+				setback = has.homeMode.VacationSetback(awaySetback)
+			}
+			// Without a setback for the mode, any away holds are released
+			away := (mode == services.HomeModeAway || mode == services.HomeModeVacation) && setback != nil
+			if setback == nil {
+				setback = &services.AwaySetback{}
+			}
+			has.scheduleService.SetAway(away, *setback, time.Now())
+		})
+
+		// Leaving runs a checklist of doors and windows open and devices left on
+		var departureConfig *services.DepartureConfig
+		if departureFile := config.Load().DepartureFile; departureFile != "" {
+			loaded, err := services.LoadDepartureConfig(departureFile)
+			if err != nil {
+				has.logger.Printf("Failed to load departure check settings, reporting every device: %v", err)
+			} else {
+				departureConfig = loaded
+			}
+		}
+		has.departure = services.NewDepartureService(departureConfig, logger.NewLogger("Departure", nil))
+		has.departure.SetRoomSensors(has.unifiedSensorService)
+		has.departure.SetDevices(has.mqttDeviceService)
+		has.departure.SetMQTTClient(has.mqttClient)
+		has.homeMode.AddModeCallback(has.departure.HandleMode)
+		has.running.Go(has.ctx, "home_mode", has.homeMode.Run)
+	}
+
+	// Scripted automations run their scripts when their conditions on the home change
+	if scriptsFile := config.Load().ScriptsFile; scriptsFile != "" && !has.readReplica {
+		scriptConfig, err := services.LoadScriptConfig(scriptsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load scripted automations: %v", err)
+		} else {
+			has.scripts = services.NewScriptService(scriptConfig, logger.NewLogger("ScriptService", nil))
+			has.scripts.SetRoomSensors(has.unifiedSensorService)
+			has.scripts.SetDevices(has.mqttDeviceService)
+			has.scripts.SetCommandExecutor(has.mqttDeviceService)
+			has.scripts.SetSceneRecaller(has.sceneService)
+			has.scripts.SetMQTTClient(has.mqttClient)
+			has.scripts.SetSafeMode(has.safeMode)
+			has.scripts.SetDryRunRecorder(has.dryRun)
+			if has.webhooks != nil {
+				has.scripts.SetWebhookCaller(has.webhooks)
+			}
+			if has.homeMode != nil {
+				has.scripts.SetHomeMode(has.homeMode)
+			}
+			if has.residents != nil {
+				has.scripts.SetResidents(has.residents)
+			}
+			has.running.Go(has.ctx, "scripts", has.scripts.Run)
+		}
+	}
+
+	// A daily or weekly digest in plain sentences, for residents who don't use the dashboard
+	if digestFile := config.Load().DigestFile; digestFile != "" && !has.readReplica {
+		digestConfig, err := services.LoadDigestConfig(digestFile)
+		if err != nil {
+			has.logger.Printf("Failed to load digest configuration: %v", err)
+		} else {
+			has.digest = services.NewDigestService(digestConfig, services.DigestPath(config.Load().StateDir),
+				logger.NewLogger("Digest", nil))
+			has.digest.SetRoomSensors(has.unifiedSensorService)
+			has.digest.SetEnergy(has.roomEnergy)
+			has.digest.SetWarranties(has.identities)
+			if has.alerts != nil {
+				has.digest.SetAlerts(has.alerts)
+			}
+			if has.weather != nil {
+				has.digest.SetWeather(has.weather)
+			}
+			has.running.Go(has.ctx, "digest", has.digest.Run)
+		}
+	}
+
+	// Sensors wired to the gateway report for the room it lives in, like a Pico would
+	if gatewaySensorsFile := config.Load().GatewaySensorsFile; gatewaySensorsFile != "" && !has.readReplica {
+		gatewaySensorConfig, err := services.LoadGatewaySensorConfig(gatewaySensorsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load gateway sensors: %v", err)
+		} else {
+			has.gatewaySensors = services.NewGatewaySensorService(gatewaySensorConfig, logger.NewLogger("GatewaySensorService", nil))
+			has.gatewaySensors.SetMQTTClient(has.mqttClient)
+			has.running.Go(has.ctx, "gateway_sensors", has.gatewaySensors.Run)
+		}
+	}
+
+	// Bluetooth LE thermometers stand in for a Pico in rooms without one
+	if bleSensorsFile := config.Load().BLESensorsFile; bleSensorsFile != "" && !has.readReplica {
+		bleSensorConfig, err := services.LoadBLESensorConfig(bleSensorsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load BLE sensors: %v", err)
+		} else {
+			has.bleSensors = services.NewBLESensorService(bleSensorConfig, logger.NewLogger("BLESensorService", nil))
+			has.bleSensors.SetMQTTClient(has.mqttClient)
+			has.running.Go(has.ctx, "ble_sensors", has.bleSensors.Run)
+		}
+	}
+
+	// Firmware updates of the Picos, which report their version with their readings
+	if otaFile := config.Load().OTAFile; otaFile != "" && !has.readReplica {
+		otaConfig, err := services.LoadOTAConfig(otaFile)
+		if err != nil {
+			has.logger.Printf("Failed to load OTA settings: %v", err)
+		} else {
+			has.ota = services.NewOTAService(otaConfig, services.OTAPath(config.Load().StateDir), logger.NewLogger("OTAService", nil))
+			has.ota.SetSafeMode(has.safeMode)
+			has.ota.SetDryRunRecorder(has.dryRun)
+			if err := has.ota.Subscribe(has.mqttClient); err != nil {
+				has.logger.Printf("Failed to subscribe to OTA progress: %v", err)
+			}
+			has.unifiedSensorService.AddFirmwareCallback(has.ota.HandleFirmwareVersion)
+			has.running.Go(has.ctx, "ota", has.ota.Run)
+		}
+	}
+
+	// Third-party integrations, run as their own processes and reached over MQTT; their devices
+	// and actions take commands like any other device
+	if pluginDir := config.Load().PluginDir; pluginDir != "" && !has.readReplica {
+		manager, err := plugins.NewManager(pluginDir, logger.NewLogger("Plugins", nil))
+		if err != nil {
+			has.logger.Printf("Failed to load plugins: %v", err)
+		} else {
+			has.plugins = manager
+			if err := has.plugins.Subscribe(has.mqttClient); err != nil {
+				has.logger.Printf("Failed to subscribe to plugin topics: %v", err)
+			}
+			has.mqttDeviceService.AddDeviceProvider(has.plugins)
+			has.running.Go(has.ctx, "plugins", has.plugins.Run)
+		}
+	}
+
+	// Nightly backups of the state and configuration files; a read replica's state is a mirror
+	if backupFile := config.Load().BackupFile; backupFile != "" && !has.readReplica {
+		backupConfig, err := backup.LoadConfig(backupFile)
+		if err != nil {
+			has.logger.Printf("Failed to load backup configuration: %v", err)
+		} else {
+			sources := append([]string{config.Load().StateDir}, config.Load().Files()...)
+			has.backup = backup.NewService(backupConfig, sources, backup.StatePath(config.Load().StateDir), logger.NewLogger("Backup", nil))
+			if err := has.backup.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+				has.logger.Printf("Failed to register backup metrics: %v", err)
+			}
+			has.running.Go(has.ctx, "backup", has.backup.Run)
+		}
+	}
+
+	// Tapo bulbs are controlled directly over the LAN; they can't be from a read replica
+	if bulbsFile := config.Load().TapoBulbsFile; bulbsFile != "" && !has.readReplica {
+		bulbs, err := services.LoadTapoBulbs(bulbsFile)
+		if err != nil {
+			has.logger.Printf("Failed to load Tapo bulbs: %v", err)
+		} else {
+			has.initializeTapoBulbs(bulbs)
+		}
+	}
+
+	// Matter devices are commissioned and controlled through a Matter controller
+	if matterURL := config.Load().MatterURL; matterURL != "" && !has.readReplica {
+		has.initializeMatter(matterURL)
+	}
+
 	has.logger.Println("All services initialized successfully")
 	return nil
 }
 
+// initializeUPS coordinates the shutdown of the gateway as the UPS battery depletes
+func (has *HomeAutomationSystem) initializeUPS(cfg *services.UPSConfig) {
+	has.ups = services.NewUPSService(cfg, nut.NewClient(cfg.Address), logger.NewLogger("UPSService", nil))
+	has.ups.SetCommandExecutor(has.mqttDeviceService)
+	has.ups.SetMQTTClient(has.mqttClient)
+	has.ups.SetSafeMode(has.safeMode)
+	has.ups.SetDryRunRecorder(has.dryRun)
+	has.ups.AddShutdownHook("occupancy history", has.presenceService.Save)
+	has.ups.AddShutdownHook("thermostat schedules", has.scheduleService.Save)
+	if has.powerRestore != nil {
+		has.ups.SetShutdownRecorder(has.powerRestore)
+	}
+	has.ups.SetShutdownFunc(has.cancel)
+	has.running.Go(has.ctx, "ups", has.ups.Run)
+}
+
+// initializeTapoBulbs adds the configured Tapo bulbs to the devices commanded through the device
+// API, retrying the bulbs that can't be reached until each connects
+func (has *HomeAutomationSystem) initializeTapoBulbs(bulbs []services.TapoBulbConfig) {
+	has.tapoBulbs = services.NewDeviceService(has.mqttClient, nil)
+	has.tapoBulbs.SetSafeMode(has.safeMode)
+	has.tapoBulbs.SetDryRunRecorder(has.dryRun)
+	has.tapoBulbs.SetIdentityRegistry(has.identities)
+	has.tapoBulbs.SetCapabilityFallback(config.Load().CapabilityFallback)
+	if queueConfig := config.Load().Commands; queueConfig.Enabled {
+		has.running.Start(has.ctx, "tapo_bulb_commands", has.tapoBulbs.EnableCommandQueue(queueConfig))
+	}
+	has.mqttDeviceService.AddDeviceProvider(has.tapoBulbs.TapoBulbs())
+
+	has.running.Go(has.ctx, "tapo_bulbs", func(ctx context.Context) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		pending := bulbs
+		for {
+			var unreachable []services.TapoBulbConfig
+			for _, bulb := range pending {
+				connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				err := has.tapoBulbs.AddConfiguredTapoBulb(connectCtx, bulb)
+				cancel()
+				if err == nil {
+					continue
+				}
+				if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeDevice {
+					has.logger.Printf("Tapo bulb %s not reachable, retrying: %v", bulb.DeviceID, err)
+					unreachable = append(unreachable, bulb)
+				} else {
+					has.logger.Printf("Failed to add Tapo bulb %s: %v", bulb.DeviceID, err)
+				}
+			}
+			if pending = unreachable; len(pending) == 0 {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// initializeMatter exposes the endpoints of commissioned Matter nodes as devices and keeps the
+// controller connection up, re-syncing the nodes after each reconnect
+func (has *HomeAutomationSystem) initializeMatter(url string) {
+	has.matterDevices = services.NewDeviceService(has.mqttClient, nil)
+	has.matterDevices.SetSafeMode(has.safeMode)
+	has.matterDevices.SetDryRunRecorder(has.dryRun)
+	has.matterDevices.SetIdentityRegistry(has.identities)
+	has.matterDevices.SetCapabilityFallback(config.Load().CapabilityFallback)
+
+	// Commands for nodes that can't be reached are retried until they arrive or expire
+	if queueConfig := config.Load().Commands; queueConfig.Enabled {
+		has.matterCommands = has.matterDevices.EnableCommandQueue(queueConfig)
+		has.running.Start(has.ctx, "matter_commands", has.matterCommands)
+	}
+
+	client := matter.NewClient(url)
+	has.matterService = services.NewMatterService(client, has.matterDevices,
+		services.MatterRoomsPath(config.Load().StateDir), logger.NewLogger("MatterService", nil))
+	has.matterService.SetMQTTClient(has.mqttClient)
+	client.AddAttributeCallback(has.matterService.HandleAttribute)
+	client.AddNodeCallback(func(node matter.Node) { has.matterService.HandleNode(node) })
+
+	has.running.Go(has.ctx, "matter", func(ctx context.Context) {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		defer client.Close()
+
+		for {
+			if !client.Connected() {
+				connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				if err := client.Connect(connectCtx); err != nil {
+					has.logger.Printf("Matter controller not reachable, retrying: %v", err)
+				} else if err := has.matterService.Sync(connectCtx); err != nil {
+					has.logger.Printf("Failed to sync Matter nodes: %v", err)
+				}
+				cancel()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// startDebugServer exposes runtime gauges, build info and admin-gated pprof when a debug address is configured
+func (has *HomeAutomationSystem) startDebugServer(addr string) {
+	if addr == "" {
+		return
+	}
+
+	cfg := config.Load()
+
+	if cfg.AdminToken == "" {
+		has.logger.Println("Debug server: HA_ADMIN_TOKEN not set, pprof endpoints are closed")
+	}
+
+	// Export room sensor and thermostat metrics alongside the runtime gauges
+	if err := services.RegisterSensorMetrics(prometheus.DefaultRegisterer); err != nil {
+		has.logger.Printf("Failed to register sensor metrics: %v", err)
+	}
+	if err := has.topicMigration.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		has.logger.Printf("Failed to register legacy topic metrics: %v", err)
+	}
+	if err := has.roomEnergy.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		has.logger.Printf("Failed to register room energy metrics: %v", err)
+	}
+	if err := has.presenceService.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		has.logger.Printf("Failed to register occupancy metrics: %v", err)
+	}
+
+	// API calls are logged with their caller; clients such as a phone get their own revocable
+	// session token instead of the admin token
+	has.access = access.NewManager(cfg.AdminToken, access.SessionsPath(cfg.StateDir), access.LogPath(cfg.StateDir),
+		logger.NewLogger("Access", nil))
+	has.access.SetAuthenticateReads(cfg.APIAuth)
+	has.running.Start(has.ctx, "access_log", lifecycle.OnStop(has.access.Close))
+
+	// Liveness and readiness for container and orchestrator probes
+	has.registerHealthChecks()
+
+	has.running.Go(has.ctx, "debug_server", func(ctx context.Context) {
+		routes := map[string]http.Handler{
+			"/build-info":                                 buildinfo.Handler(has.buildInfo),
+			"/api/i18n":                                   i18n.Handler(),
+			"/api/presence/heatmap":                       has.presenceService.Handler(),
+			"/api/presence/analytics":                     has.presenceService.AnalyticsHandler(),
+			"/api/rooms":                                  has.unifiedSensorService.Handler(),
+			"/api/thermostats":                            has.thermostatService.Handler(),
+			"/api/thermostats/fan":                        has.access.Require(has.thermostatService.FanHandler()),
+			"/api/thermostats/schedule-suggestions":       has.scheduleService.SuggestionsHandler(),
+			"/api/thermostats/schedule-suggestions/apply": has.access.RequireRole(access.RoleAdmin, has.scheduleService.ApplyHandler()),
+			"/api/thermostats/schedules":                  has.scheduleService.SchedulesHandler(),
+			"/api/thermostats/schedules/clear":            has.access.RequireRole(access.RoleAdmin, has.scheduleService.ClearHandler()),
+			"/api/thermostats/schedules/set":              has.access.RequireRole(access.RoleAdmin, has.scheduleService.SetHandler()),
+			"/api/thermostats/hold":                       has.access.Require(has.scheduleService.HoldHandler()),
+			"/api/thermostats/hold/resume":                has.access.Require(has.scheduleService.ResumeHandler()),
+			"/api/scenes":                                 has.sceneService.Handler(),
+			"/api/scenes/capture":                         has.access.RequireRole(access.RoleAdmin, has.sceneService.CaptureHandler()),
+			"/api/scenes/recall":                          has.access.Require(has.sceneService.RecallHandler()),
+			"/api/scenes/delete":                          has.access.RequireRole(access.RoleAdmin, has.sceneService.DeleteHandler()),
+			"/api/mqtt-devices":                           has.mqttDeviceService.Handler(),
+			"/api/mqtt-devices/command":                   has.access.Require(has.mqttDeviceService.CommandHandler()),
+			"/api/mqtt/legacy-topics":                     has.topicMigration.Handler(),
+			"/api/energy/rooms":                           has.roomEnergy.Handler(),
+			"/api/energy/rooms/daily":                     has.roomEnergy.DailyHandler(),
+		}
+		if has.holidays != nil {
+			routes["/api/calendar"] = has.holidays.Handler()
+		}
+		if has.followMe != nil {
+			routes["/api/lighting/follow-me"] = has.followMe.Handler()
+		}
+		if has.powerRestore != nil {
+			routes["/api/power/restoration"] = has.powerRestore.Handler()
+			routes["/api/power/restoration/run"] = has.access.Require(has.powerRestore.RestoreHandler())
+		}
+		if has.ups != nil {
+			routes["/api/power/ups"] = has.ups.Handler()
+		}
+		if has.alerts != nil {
+			routes["/api/alerts"] = has.alerts.Handler()
+			routes["/api/alerts/rules/enable"] = has.access.RequireRole(access.RoleAdmin, has.alerts.EnableHandler())
+		}
+		if has.scripts != nil {
+			routes["/api/scripts"] = has.scripts.Handler()
+			routes["/api/scripts/eval"] = has.scripts.EvalHandler()
+			routes["/api/scripts/enable"] = has.access.RequireRole(access.RoleAdmin, has.scripts.EnableHandler())
+		}
+		if has.webhooks != nil {
+			routes["/api/webhooks"] = has.webhooks.Handler()
+		}
+		if has.history != nil {
+			routes[services.HistoryPath] = has.history.Handler()
+		}
+		if has.residents != nil {
+			routes["/api/residents"] = has.residents.Handler()
+		}
+		if has.arrival != nil {
+			routes["/api/arrival"] = has.arrival.Handler()
+		}
+		if has.homeMode != nil {
+			routes["/api/mode"] = has.homeMode.Handler()
+			routes["/api/mode/set"] = has.access.Require(has.homeMode.SetHandler())
+			routes["/api/departure"] = has.departure.Handler()
+			routes["/api/departure/turn-off"] = has.access.Require(has.departure.TurnOffHandler())
+		}
+		if has.digest != nil {
+			routes["/api/digest"] = has.digest.Handler()
+			routes["/api/digest/send"] = has.access.Require(has.digest.SendHandler())
+		}
+		if has.roomClosures != nil {
+			routes["/api/rooms/closures"] = has.roomClosures.Handler()
+			routes["/api/rooms/closures/set"] = has.access.Require(has.roomClosures.SetHandler())
+		}
+		if has.hazards != nil {
+			routes["/api/hazards"] = has.hazards.Handler()
+		}
+		if has.gatewaySensors != nil {
+			routes["/api/gateway-sensors"] = has.gatewaySensors.Handler()
+		}
+		if has.bleSensors != nil {
+			routes["/api/ble-sensors"] = has.bleSensors.Handler()
+		}
+		if has.ota != nil {
+			routes["/api/ota"] = has.ota.Handler()
+			routes["/api/ota/rollout"] = has.access.RequireRole(access.RoleAdmin, has.ota.RolloutHandler(false))
+			routes["/api/ota/rollback"] = has.access.RequireRole(access.RoleAdmin, has.ota.RolloutHandler(true))
+		}
+		if has.plugins != nil {
+			routes["/api/plugins"] = has.plugins.Handler()
+			routes["/api/plugins/restart"] = has.access.RequireRole(access.RoleAdmin, has.plugins.RestartHandler())
+			routes["/api/plugins/enable"] = has.access.RequireRole(access.RoleAdmin, has.plugins.EnableHandler())
+		}
+		if has.failover != nil {
+			routes["/api/failover"] = has.failover.Handler()
+		}
+		if has.zones != nil {
+			routes["/api/hvac/zones"] = has.zones.Handler()
+		}
+		if has.condensation != nil {
+			routes["/api/condensation"] = has.condensation.Handler()
+		}
+		if has.weather != nil {
+			routes["/api/weather"] = has.weather.Handler()
+		}
+		if has.backup != nil {
+			routes["/api/backup"] = has.backup.Handler()
+			routes["/api/backup/run"] = has.access.RequireRole(access.RoleAdmin, has.backup.RunHandler())
+		}
+		if has.identities != nil {
+			routes["/api/inventory"] = identity.InventoryHandler(has.identities)
+			routes["/api/devices/registry"] = identity.DevicesHandler(has.identities)
+			routes["/api/devices/registry/create"] = has.access.Require(identity.CreateHandler(has.identities))
+			routes["/api/devices/registry/update"] = has.access.Require(identity.UpdateHandler(has.identities))
+			routes["/api/devices/registry/delete"] = has.access.RequireRole(access.RoleAdmin, identity.DeleteHandler(has.identities))
+			routes["/api/devices/registry/merge"] = has.access.RequireRole(access.RoleAdmin, identity.MergeHandler(has.identities))
+		}
+		if has.demo != nil {
+			routes["/api/demo"] = has.demo.Handler()
+		}
+		if has.assets != nil {
+			routes["/api/assets"] = has.assets.AssetsHandler()
+			routes["/api/assets/"] = has.assets.AssetHandler()
+			routes["/api/assets/export"] = has.assets.ExportHandler()
+		}
+		if has.provisioning != nil {
+			routes["/api/provisioning"] = has.provisioning.Handler()
+		}
+		if has.voiceConfig != nil {
+			home := services.NewVoiceHome(has.thermostatService, has.mqttDeviceService)
+			validator := voice.NewTokenValidator(has.voiceConfig)
+			routes["/api/voice/google"] = voice.GoogleHandler(home, validator, has.voiceConfig, logger.NewLogger("GoogleSmartHome", nil))
+			routes["/api/voice/alexa"] = voice.AlexaHandler(home, validator, has.voiceConfig, logger.NewLogger("AlexaSmartHome", nil))
+		}
+		if has.matterService != nil {
+			routes["/api/matter/nodes"] = has.matterService.Handler()
+			routes["/api/matter/commission"] = has.access.RequireRole(access.RoleAdmin, has.matterService.CommissionHandler())
+		}
+		if has.matterCommands != nil {
+			routes["/api/matter/commands"] = has.matterCommands.Handler()
+		}
+		routes["/api/sessions"] = has.access.RequireAdmin(has.access.SessionsHandler())
+		routes["/api/sessions/revoke"] = has.access.RequireAdmin(has.access.RevokeHandler())
+		routes["/api/access-log"] = has.access.RequireAdmin(has.access.LogHandler())
+		if has.readReplica {
+			for path, handler := range routes {
+				routes[path] = profiling.ReadOnly(handler)
+			}
+		}
+		for path, handler := range routes {
+			routes[path] = has.access.Record(has.access.Authenticate(handler))
+		}
+		// Probes poll every few seconds, so they stay out of the access log, as do the dashboard's files
+		routes["/healthz"] = has.health.LivenessHandler()
+		routes["/readyz"] = has.health.ReadinessHandler()
+		// Picos have no token to download their firmware with
+		if has.ota != nil {
+			routes[services.OTAFirmwarePath] = has.access.Record(has.ota.FirmwareHandler())
+		}
+		// Inbound webhooks authenticate with their hook's secret, as IFTTT and CI pipelines have no token
+		if has.webhooks != nil {
+			routes[services.HookPath] = has.access.Record(has.webhooks.HookHandler())
+		}
+		routes["/"] = web.Handler()
+		if err := profiling.Serve(ctx, addr, "unified", cfg.AdminToken, routes, logger.NewLogger("Profiling", nil)); err != nil {
+			has.logger.Printf("Debug server stopped: %v", err)
+		}
+	})
+}
+
+// startGRPCServer serves the sensors, devices, thermostats and automations over gRPC when an
+// address is configured, with the same tokens as the REST API
+func (has *HomeAutomationSystem) startGRPCServer(addr string) {
+	if addr == "" {
+		return
+	}
+
+	backends := grpcapi.Services{
+		Rooms:       has.unifiedSensorService,
+		Devices:     has.mqttDeviceService,
+		Thermostats: has.thermostatService,
+		Holds:       has.scheduleService,
+		Scenes:      has.sceneService,
+	}
+	if has.homeMode != nil {
+		backends.HomeMode = has.homeMode
+	}
+	if has.alerts != nil {
+		backends.Alerts = has.alerts
+	}
+
+	server := grpcapi.NewServer(logger.NewLogger("GRPC", nil))
+	grpcapi.Register(server, backends)
+	server.SetAuthorization(
+		func(next http.Handler) http.Handler { return has.access.Record(has.access.Authenticate(next)) },
+		func(next http.Handler) http.Handler {
+			return has.access.Record(has.access.Authenticate(has.access.Require(next)))
+		},
+	)
+	server.SetReadOnly(has.readReplica)
+
+	has.running.Go(has.ctx, "grpc_server", func(ctx context.Context) {
+		if err := server.Serve(ctx, addr); err != nil {
+			has.logger.Printf("gRPC server stopped: %v", err)
+		}
+	})
+}
+
+// registerHealthChecks gathers the checks behind /healthz and /readyz: the core services must
+// answer, the broker must be connected and the metrics collectable, while offline services and
+// a stale backup only degrade readiness
+func (has *HomeAutomationSystem) registerHealthChecks() {
+	has.health = health.NewRegistry("unified")
+	has.health.RegisterLiveness("thermostat_service", health.Responds(func() { has.thermostatService.GetAllThermostats() }))
+	has.health.RegisterLiveness("sensor_service", health.Responds(func() { has.unifiedSensorService.GetAllRoomSensors() }))
+	has.health.RegisterLiveness("mqtt_device_service", health.Responds(func() { has.mqttDeviceService.Devices() }))
+	has.health.RegisterReadiness("mqtt_connection", has.mqttClient.HealthCheck)
+	has.health.RegisterReadiness("prometheus", health.Prometheus(prometheus.DefaultGatherer))
+	has.health.RegisterOptional("service_availability", has.availability.HealthCheck)
+	if has.backup != nil {
+		has.health.RegisterOptional("backup", func() error { return has.backup.HealthCheck(time.Now()) })
+	}
+}
+
+// startDemo plays the bundled demo house on the loopback MQTT client
+func (has *HomeAutomationSystem) startDemo() {
+	house, err := demo.LoadHouse()
+	if err != nil {
+		has.logger.Printf("Failed to load the demo house: %v", err)
+		return
+	}
+	simulator := demo.NewSimulator(house, has.mqttClient, logger.NewLogger("DemoHouse", nil))
+	if err := simulator.Start(); err != nil {
+		has.logger.Printf("Failed to start the demo house: %v", err)
+		return
+	}
+	has.demo = simulator
+	has.running.Go(has.ctx, "demo_house", simulator.Run)
+}
+
+// startAssetDiscovery finds the assets on the network when HA_ASSET_DISCOVERY is set, over mDNS
+// and SSDP too, remembering them in the state directory for the inventory API
+func (has *HomeAutomationSystem) startAssetDiscovery() {
+	cfg := config.Load()
+	if !cfg.AssetDiscovery {
+		if cfg.ProvisioningFile != "" {
+			has.logger.Printf("Provisioning needs HA_ASSET_DISCOVERY, ignoring %s", cfg.ProvisioningFile)
+		}
+		return
+	}
+
+	manager, err := discovery.NewDiscoveryManager(discovery.DiscoveryConfig{
+		AutoQuery:    true,
+		Logger:       log.New(io.Discard, "", 0),
+		MDNS:         true,
+		SSDP:         true,
+		RegistryPath: discovery.AssetRegistryPath(cfg.StateDir),
+	})
+	if err == nil {
+		err = manager.Start()
+	}
+	if err != nil {
+		has.logger.Printf("Failed to start asset discovery: %v", err)
+		return
+	}
+	has.assets = manager
+	has.running.Start(has.ctx, "asset_discovery", lifecycle.OnStop(manager.Stop))
+
+	// Discovered assets join the device registry, linked to the devices the services claimed
+	if has.identities != nil && !has.readReplica {
+		links := services.NewAssetLinkService(has.identities, manager.Inventory, logger.NewLogger("AssetLinks", nil))
+		has.running.Go(has.ctx, "asset_links", links.Run)
+	}
+
+	// Rooms of the Pico sensors found get thermostats by the provisioning rules; the Tapo
+	// scraper provisions the plugs
+	if cfg.ProvisioningFile != "" && !has.readReplica {
+		provisioningConfig, err := services.LoadProvisioningConfig(cfg.ProvisioningFile)
+		if err != nil {
+			has.logger.Printf("Failed to load provisioning rules: %v", err)
+		} else {
+			has.provisioning = services.NewProvisioningService(provisioningConfig, logger.NewLogger("Provisioning", nil))
+			has.provisioning.SetThermostats(has.thermostatService)
+			has.running.Go(has.ctx, "provisioning", func(ctx context.Context) {
+				has.provisioning.Run(ctx, manager.GetDiscoveredChannel(), manager.GetUpdatedChannel())
+			})
+		}
+	}
+
+	if err := manager.Query(&discovery.Query{}); err != nil {
+		has.logger.Printf("Failed to query for assets: %v", err)
+	}
+}
+
+// startMDNS advertises the gateway as a _homeauto._tcp DNS-SD service when HA_MDNS is set, so
+// avahi-browse and other standard tools find its API on the debug server
+func (has *HomeAutomationSystem) startMDNS(debugAddr string) {
+	if !config.Load().MDNS {
+		return
+	}
+
+	builder := discovery.NewHomeAutomationGateway("Home Automation Gateway").
+		AutoDetectNetwork().
+		WithBuildInfo(has.buildInfo)
+	if has.failoverConfig != nil {
+		builder.WithName("Home Automation Gateway " + has.failoverConfig.NodeID)
+	}
+	if _, portText, err := net.SplitHostPort(debugAddr); err == nil {
+		if port, err := strconv.Atoi(portText); err == nil {
+			builder.WithHTTPService("api", port, "/api", "Home Automation API")
+		}
+	}
+
+	has.mdns = discovery.NewMDNSService(builder.Build())
+	if err := has.running.Start(has.ctx, "mdns", lifecycle.Hooks{
+		OnStart: func(context.Context) error { return has.mdns.Start() },
+		OnStop:  func(context.Context) error { return has.mdns.Stop() },
+	}); err != nil {
+		has.logger.Printf("Failed to advertise over mDNS: %v", err)
+	}
+}
+
+// announceBuildInfo logs and publishes the running build so multi-binary deployments can verify matching versions
+func (has *HomeAutomationSystem) announceBuildInfo(debugServer bool) {
+	has.buildInfo = buildinfo.Get("unified", buildinfo.Features(map[string]bool{
+		"safe_mode":    has.safeMode.Active(),
+		"observe_only": has.dryRun.ObserveOnly(),
+		"read_replica": has.readReplica,
+		"debug_server": debugServer,
+		"pprof":        debugServer && config.Load().AdminToken != "",
+	}))
+
+	has.logger.Printf("Build: %s, features: %v", has.buildInfo, has.buildInfo.Features)
+
+	if err := buildinfo.Announce(has.mqttClient, has.buildInfo); err != nil {
+		has.logger.Printf("Failed to announce build info: %v", err)
+	}
+}
+
 // handleMotionUpdate processes motion sensor updates for automation
 func (has *HomeAutomationSystem) handleMotionUpdate(roomID string, occupied bool) {
 	has.logger.Printf("Motion automation: Room %s is %s", roomID, map[bool]string{true: "occupied", false: "unoccupied"}[occupied])
@@ -135,7 +1507,7 @@ func (has *HomeAutomationSystem) handleLightUpdate(roomID string, lightState str
 }
 
 // startSystemMonitoring runs periodic system health checks
-func (has *HomeAutomationSystem) startSystemMonitoring() {
+func (has *HomeAutomationSystem) startSystemMonitoring(ctx context.Context) {
 	ticker := time.NewTicker(2 * time.Minute)
 	defer ticker.Stop()
 
@@ -143,7 +1515,7 @@ func (has *HomeAutomationSystem) startSystemMonitoring() {
 
 	for {
 		select {
-		case <-has.ctx.Done():
+		case <-ctx.Done():
 			has.logger.Println("System monitoring stopping...")
 			return
 		case <-ticker.C:
@@ -174,10 +1546,19 @@ func (has *HomeAutomationSystem) performSystemHealthCheck() {
 	if onlineDevices < totalRooms {
 		has.logger.Printf("WARNING: %d devices are offline", totalRooms-onlineDevices)
 	}
+
+	if err := has.availability.HealthCheck(); err != nil {
+		has.logger.Printf("WARNING: %v", err)
+	}
+	if has.backup != nil {
+		if err := has.backup.HealthCheck(time.Now()); err != nil {
+			has.logger.Printf("WARNING: %v", err)
+		}
+	}
 }
 
 // startSensorAnalysis runs periodic analysis of sensor patterns
-func (has *HomeAutomationSystem) startSensorAnalysis() {
+func (has *HomeAutomationSystem) startSensorAnalysis(ctx context.Context) {
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
 
@@ -185,7 +1566,7 @@ func (has *HomeAutomationSystem) startSensorAnalysis() {
 
 	for {
 		select {
-		case <-has.ctx.Done():
+		case <-ctx.Done():
 			has.logger.Println("Sensor analysis stopping...")
 			return
 		case <-ticker.C:
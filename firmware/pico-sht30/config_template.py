@@ -33,12 +33,19 @@ LIGHT_THRESHOLD_LOW = 10  # Percentage below which it's considered dark (0-100)
 LIGHT_THRESHOLD_HIGH = 80  # Percentage above which it's considered bright (0-100)
 LIGHT_READING_INTERVAL = 10  # Seconds between light level readings
 
+# MQTT topic namespace, must match MQTT_TOPIC_PREFIX of the services (e.g. "home1/"; empty for none)
+TOPIC_PREFIX = ""
+
 # MQTT Topics (will be formatted with room number)
 TEMP_TOPIC_TEMPLATE = "room-temp/{room}"
 HUM_TOPIC_TEMPLATE = "room-hum/{room}"
 MOTION_TOPIC_TEMPLATE = "room-motion/{room}"
 LIGHT_TOPIC_TEMPLATE = "room-light/{room}"
 
+# Firmware update topics (formatted with DEVICE_NAME)
+OTA_UPDATE_TOPIC_TEMPLATE = "home/ota/{device}/update"
+OTA_STATUS_TOPIC_TEMPLATE = "home/ota/{device}/status"
+
 # Advanced Settings
 MAX_WIFI_RETRIES = 30
 MAX_MQTT_RETRIES = 5
@@ -48,6 +48,11 @@ mpremote cp config.py :
 echo "Uploading sht30.py..."
 mpremote cp sht30.py :
 
+# Upload the OTA updater and the installed version
+echo "Uploading ota.py and version.py..."
+mpremote cp ota.py :
+mpremote cp version.py :
+
 # Upload main application
 echo "Uploading main.py..."
 mpremote cp main.py :
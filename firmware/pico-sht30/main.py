@@ -23,11 +23,32 @@ except ImportError:
     print("ERROR: sht30.py driver not found!")
     machine.reset()
 
+# Over-the-air updates
+import ota
+FIRMWARE_VERSION = ota.current_version()
+
 # Generate MQTT topics from configuration
-TEMP_TOPIC = TEMP_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
-HUM_TOPIC = HUM_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
-MOTION_TOPIC = MOTION_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
-LIGHT_TOPIC = LIGHT_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
+try:
+    TOPIC_PREFIX
+except NameError:
+    TOPIC_PREFIX = ""  # config.py from before topic namespaces
+if TOPIC_PREFIX and not TOPIC_PREFIX.endswith("/"):
+    TOPIC_PREFIX += "/"
+TEMP_TOPIC = TOPIC_PREFIX + TEMP_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
+HUM_TOPIC = TOPIC_PREFIX + HUM_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
+MOTION_TOPIC = TOPIC_PREFIX + MOTION_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
+LIGHT_TOPIC = TOPIC_PREFIX + LIGHT_TOPIC_TEMPLATE.format(room=ROOM_NUMBER)
+try:
+    OTA_UPDATE_TOPIC_TEMPLATE, OTA_STATUS_TOPIC_TEMPLATE
+except NameError:
+    # config.py from before OTA updates
+    OTA_UPDATE_TOPIC_TEMPLATE = "home/ota/{device}/update"
+    OTA_STATUS_TOPIC_TEMPLATE = "home/ota/{device}/status"
+OTA_UPDATE_TOPIC = TOPIC_PREFIX + OTA_UPDATE_TOPIC_TEMPLATE.format(device=DEVICE_NAME)
+OTA_STATUS_TOPIC = TOPIC_PREFIX + OTA_STATUS_TOPIC_TEMPLATE.format(device=DEVICE_NAME)
+
+# Update command received from the gateway, installed from the main loop
+ota_command = None
 
 # LED for status indication
 led = Pin("LED", Pin.OUT)
@@ -143,7 +164,8 @@ def publish_sensor_data(client, temperature, humidity):
             "room": ROOM_NUMBER,
             "sensor": "SHT-30",
             "timestamp": timestamp,
-            "device_id": DEVICE_NAME
+            "device_id": DEVICE_NAME,
+            "firmware_version": FIRMWARE_VERSION
         })
         
         hum_payload = ujson.dumps({
@@ -288,6 +310,31 @@ def determine_light_state(light_percent):
     else:
         return "normal"
 
+def on_mqtt_message(topic, msg):
+    """Keep the OTA command to install from the main loop"""
+    global ota_command
+    if topic.decode() == OTA_UPDATE_TOPIC:
+        ota_command = msg
+
+def subscribe_ota(client):
+    """Receive the gateway's update commands, including one retained while offline"""
+    try:
+        client.set_callback(on_mqtt_message)
+        client.subscribe(OTA_UPDATE_TOPIC, qos=1)
+        print(f"OTA updates on {OTA_UPDATE_TOPIC}, firmware {FIRMWARE_VERSION}")
+    except Exception as e:
+        print(f"OTA subscription failed: {e}")
+
+def publish_ota_status(client, state, version, error):
+    """Report update progress to the gateway"""
+    status = {"version": version, "state": state}
+    if error:
+        status["error"] = error
+    try:
+        client.publish(OTA_STATUS_TOPIC, ujson.dumps(status))
+    except Exception as e:
+        print(f"Failed to publish OTA status: {e}")
+
 def blink_led(times=1, delay=0.1):
     """Blink LED for status indication"""
     for _ in range(times):
@@ -338,6 +385,7 @@ def main():
     if not mqtt_client:
         print("Cannot continue without MQTT")
         return
+    subscribe_ota(mqtt_client)
     
     print(f"Starting sensor readings every {READING_INTERVAL} seconds...")
     if PIR_ENABLED:
@@ -354,6 +402,13 @@ def main():
         try:
             current_time = time.time()
             
+            # Install a firmware update from the gateway; a successful one restarts the Pico
+            mqtt_client.check_msg()
+            global ota_command
+            if ota_command is not None:
+                command, ota_command = ota_command, None
+                ota.install(command, lambda state, version, error: publish_ota_status(mqtt_client, state, version, error))
+            
             # Check motion sensor (check every loop iteration)
             if PIR_ENABLED:
                 motion_state = check_motion_sensor()
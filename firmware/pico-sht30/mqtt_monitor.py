@@ -4,6 +4,7 @@ MQTT Test Client for Pi Pico SHT-30 Sensor
 Subscribe to temperature and humidity topics and display data
 """
 
+import os
 import sys
 import json
 import time
@@ -36,10 +37,12 @@ class MQTTMonitor:
     def on_connect(self, client, userdata, flags, rc):
         if rc == 0:
             print(f"Connected to MQTT broker at {self.broker_host}:{self.broker_port}")
-            # Subscribe to all room temperature and humidity topics
-            client.subscribe("room-temp/+")
-            client.subscribe("room-hum/+")
-            print("Subscribed to topics: room-temp/+, room-hum/+")
+            # Subscribe to all room temperature and humidity topics in the MQTT_TOPIC_PREFIX namespace
+            prefix = os.environ.get("MQTT_TOPIC_PREFIX", "").strip("/")
+            prefix = prefix + "/" if prefix else ""
+            client.subscribe(prefix + "room-temp/+")
+            client.subscribe(prefix + "room-hum/+")
+            print(f"Subscribed to topics: {prefix}room-temp/+, {prefix}room-hum/+")
         else:
             print(f"Failed to connect to MQTT broker. Return code: {rc}")
     
@@ -0,0 +1,135 @@
+# Over-the-air firmware updates from the home automation gateway
+#
+# The gateway publishes a retained update command on home/ota/<device>/update:
+#   {"version": "1.2.0", "sha256": "...", "files": [{"path": "main.py", "url": "...", "sha256": "...", "size": 1234}]}
+# Every file is downloaded next to the one it replaces and checked against its hash before any
+# is installed. The replaced files are kept as <file>.bak. The Pico then restarts and reports
+# the new version with its readings.
+
+import gc
+import os
+import machine
+import ubinascii
+import uhashlib
+import ujson
+
+try:
+    import urequests
+except ImportError:
+    import requests as urequests
+
+VERSION_FILE = "version.py"
+CHUNK_SIZE = 512
+
+
+def current_version():
+    """Firmware version installed by the last update"""
+    try:
+        from version import FIRMWARE_VERSION
+        return FIRMWARE_VERSION
+    except ImportError:
+        return "unknown"
+
+
+def _hex(digest):
+    return ubinascii.hexlify(digest).decode()
+
+
+def _exists(path):
+    try:
+        os.stat(path)
+        return True
+    except OSError:
+        return False
+
+
+def _make_dirs(path):
+    parts = path.split("/")[:-1]
+    for i in range(len(parts)):
+        try:
+            os.mkdir("/".join(parts[:i + 1]))
+        except OSError:
+            pass  # Already there
+
+
+def _remove(path):
+    try:
+        os.remove(path)
+    except OSError:
+        pass
+
+
+def _download(file):
+    """Download a file to <path>.new and check its hash"""
+    _make_dirs(file["path"])
+    response = urequests.get(file["url"])
+    try:
+        if response.status_code != 200:
+            raise ValueError("HTTP {} for {}".format(response.status_code, file["path"]))
+        hash = uhashlib.sha256()
+        size = 0
+        with open(file["path"] + ".new", "wb") as out:
+            while True:
+                chunk = response.raw.read(CHUNK_SIZE)
+                if not chunk:
+                    break
+                hash.update(chunk)
+                out.write(chunk)
+                size += len(chunk)
+    finally:
+        response.close()
+        gc.collect()
+
+    if size != file["size"] or _hex(hash.digest()) != file["sha256"]:
+        raise ValueError("{} does not match its hash".format(file["path"]))
+
+
+def _release_hash(files):
+    """Hash of the release, as the gateway computes it"""
+    hash = uhashlib.sha256()
+    for file in sorted(files, key=lambda f: f["path"]):
+        hash.update("{} {}\n".format(file["sha256"], file["path"]).encode())
+    return _hex(hash.digest())
+
+
+def install(payload, publish_status):
+    """Install the update in a command payload and restart. publish_status(state, version, error)
+    reports the progress to the gateway. Returns only if nothing was installed."""
+    if not payload:
+        return  # The gateway cleared the command
+    try:
+        command = ujson.loads(payload)
+        version = command["version"]
+        files = command["files"]
+    except (ValueError, KeyError) as e:
+        print("Invalid OTA command: {}".format(e))
+        return
+    if version == current_version():
+        return
+
+    print("Updating firmware {} -> {}".format(current_version(), version))
+    publish_status("downloading", version, None)
+    try:
+        if _release_hash(files) != command.get("sha256"):
+            raise ValueError("the file list does not match the release hash")
+        for file in files:
+            _download(file)
+    except Exception as e:
+        for file in files:
+            _remove(file["path"] + ".new")
+        print("Firmware update failed: {}".format(e))
+        publish_status("failed", version, str(e))
+        return
+
+    publish_status("installing", version, None)
+    for file in files:
+        path = file["path"]
+        if _exists(path):
+            _remove(path + ".bak")
+            os.rename(path, path + ".bak")
+        os.rename(path + ".new", path)
+    with open(VERSION_FILE, "w") as out:
+        out.write("FIRMWARE_VERSION = {}\n".format(ujson.dumps(version)))
+
+    print("Firmware {} installed, restarting".format(version))
+    machine.reset()
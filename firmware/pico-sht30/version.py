@@ -0,0 +1,2 @@
+# Firmware version reported to the gateway, rewritten by each OTA update
+FIRMWARE_VERSION = "1.0.0"
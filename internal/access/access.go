@@ -0,0 +1,305 @@
+// Package access records who calls the API and manages the session tokens clients such as the
+// dashboard on a phone use instead of the admin token, so a lost device's token can be revoked
+// without changing HA_ADMIN_TOKEN everywhere. Each session has a role limiting what it may change.
+package access
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// Manager authenticates API tokens, checks their roles and keeps the access log
+type Manager struct {
+	adminToken   string
+	authReads    bool
+	follower     bool      // Sessions are managed by another service
+	sessionsMod  time.Time // Modification time of the sessions file last read or written
+	sessionsPath string
+	logPath      string
+	sessions     map[string]*Session // By ID
+	entries      []Entry
+	logFile      *os.File
+	logSize      int64
+	now          func() time.Time
+	logger       *logger.Logger
+	mu           sync.Mutex
+}
+
+// NewManager creates the manager, reading the sessions and recent access from their files. An
+// empty path keeps that part in memory only.
+func NewManager(adminToken, sessionsPath, logPath string, serviceLogger *logger.Logger) *Manager {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Access", nil)
+	}
+
+	m := &Manager{
+		adminToken:   adminToken,
+		sessionsPath: sessionsPath,
+		logPath:      logPath,
+		sessions:     make(map[string]*Session),
+		now:          time.Now,
+		logger:       serviceLogger,
+	}
+	if sessionsPath != "" {
+		if err := m.loadSessions(); err != nil {
+			serviceLogger.Error("Failed to load sessions, only the admin token is accepted", err)
+		}
+	}
+	if logPath != "" {
+		if err := m.loadLog(); err != nil {
+			serviceLogger.Error("Failed to read the access log, past access isn't listed", err)
+		}
+	}
+	return m
+}
+
+// FollowSessions accepts the sessions another service on the host manages, reloading them when
+// their file changes and never writing them
+func (m *Manager) FollowSessions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.follower = true
+}
+
+// SetAuthenticateReads requires a token for every route wrapped by Authenticate, not only for
+// changes (HA_API_AUTH)
+func (m *Manager) SetAuthenticateReads(enabled bool) {
+	m.authReads = enabled
+}
+
+// identify resolves the caller of a request and its role from its bearer token; a session
+// token's use is recorded
+func (m *Manager) identify(r *http.Request, now time.Time) (caller, sessionID, role string, authorized bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return CallerAnonymous, "", "", false
+	}
+	if m.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) == 1 {
+		return CallerAdmin, "", RoleAdmin, true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.follower {
+		m.refreshSessionsLocked()
+	}
+	session, active := m.authenticateLocked(token, remoteHost(r), now)
+	if session == nil {
+		return CallerUnknown, "", "", false
+	}
+	if !active {
+		return CallerUnknown, session.ID, "", false
+	}
+	return session.Name, session.ID, session.role(), true
+}
+
+// Require serves requests carrying the admin token or the token of an active session with at
+// least the resident role, for controlling the home
+func (m *Manager) Require(next http.Handler) http.Handler {
+	return m.RequireRole(RoleResident, next)
+}
+
+// RequireRole serves requests carrying the admin token or the token of an active session with
+// at least the role. Like profiling.RequireAdmin, every request is refused while no admin token
+// is configured and no session exists. A valid token whose role is too low is forbidden rather
+// than unauthorized.
+func (m *Manager) RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, callerRole, authorized := m.identify(r, m.now())
+		if !authorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "authorization required", http.StatusUnauthorized)
+			return
+		}
+		if !Allows(callerRole, role) {
+			http.Error(w, fmt.Sprintf("the %s role can't do this, it needs %s", callerRole, role), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate serves reads to anyone, or with SetAuthenticateReads only to requests carrying a
+// valid token of any role
+func (m *Manager) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.authReads {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.RequireRole(RoleReadOnly, next).ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin serves requests carrying the admin token only, for managing the sessions
+// themselves: a lost phone's token must not be able to issue new ones
+func (m *Manager) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caller, _, _, _ := m.identify(r, m.now()); caller != CallerAdmin {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "admin authorization required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder captures the status code a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses through the recorder
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Record logs every request to the handler with its caller, path and result
+func (m *Manager) Record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := m.now()
+		caller, sessionID, _, _ := m.identify(r, start)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		m.record(Entry{
+			Time:       start.Round(0),
+			Caller:     caller,
+			SessionID:  sessionID,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			DurationMs: m.now().Sub(start).Milliseconds(),
+			RemoteAddr: remoteHost(r),
+		})
+	})
+}
+
+// SessionsHandler lists the sessions on a GET and creates one on a POST of
+// {"name": "Ana's phone", "role": "resident", "expires_days": 90}. The created session's token
+// is only in this response.
+func (m *Manager) SessionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"sessions": m.Sessions(m.now())})
+		case http.MethodPost:
+			var request struct {
+				Name        string `json:"name"`
+				Role        string `json:"role,omitempty"`
+				ExpiresDays int    `json:"expires_days,omitempty"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "invalid session request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			session, token, err := m.CreateSession(request.Name, request.Role, time.Duration(request.ExpiresDays)*24*time.Hour, m.now())
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			m.logger.Info("API session created", map[string]interface{}{"session_id": session.ID, "name": session.Name, "role": session.Role})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"session": session, "token": token})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// RevokeHandler revokes the session given by ?id= on a POST
+func (m *Manager) RevokeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := m.RevokeSession(r.URL.Query().Get("id"), m.now())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		m.logger.Info("API session revoked", map[string]interface{}{"session_id": session.ID, "name": session.Name})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+	})
+}
+
+// LogHandler serves recent access, newest first, filtered by ?session=, ?caller=, ?since=
+// (RFC 3339) and ?limit= (default 100)
+func (m *Manager) LogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := LogFilter{SessionID: query.Get("session"), Caller: query.Get("caller"), Limit: 100}
+		if since := query.Get("since"); since != "" {
+			parsed, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter.Since = parsed
+		}
+		if limit := query.Get("limit"); limit != "" {
+			parsed, err := strconv.Atoi(limit)
+			if err != nil || parsed < 1 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			filter.Limit = parsed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": m.Recent(filter)})
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
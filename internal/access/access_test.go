@@ -0,0 +1,186 @@
+package access
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func request(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSessionsAreAcceptedUntilRevoked(t *testing.T) {
+	stateDir := t.TempDir()
+	manager := NewManager("admin-secret", SessionsPath(stateDir), LogPath(stateDir), nil)
+	defer manager.Close()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("done")) })
+	protected := manager.Record(manager.Require(ok))
+
+	session, token, err := manager.CreateSession("phone", "", 0, time.Now())
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	if got := request(protected, http.MethodPost, "/api/scenes/recall", token).Code; got != http.StatusOK {
+		t.Fatalf("Expected the session token accepted, got %d", got)
+	}
+	if got := request(protected, http.MethodPost, "/api/scenes/recall", "admin-secret").Code; got != http.StatusOK {
+		t.Fatalf("Expected the admin token accepted, got %d", got)
+	}
+	if got := request(protected, http.MethodPost, "/api/scenes/recall", "").Code; got != http.StatusUnauthorized {
+		t.Fatalf("Expected an anonymous request refused, got %d", got)
+	}
+
+	// Session management needs the admin token itself
+	if got := request(manager.RequireAdmin(manager.SessionsHandler()), http.MethodGet, "/api/sessions", token).Code; got != http.StatusUnauthorized {
+		t.Errorf("Expected a session token refused for session management, got %d", got)
+	}
+
+	if _, err := manager.RevokeSession(session.ID, time.Now()); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if got := request(protected, http.MethodPost, "/api/scenes/recall", token).Code; got != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked token refused, got %d", got)
+	}
+
+	entries := manager.Recent(LogFilter{SessionID: session.ID})
+	if len(entries) != 2 || entries[0].Status != http.StatusUnauthorized || entries[1].Caller != "phone" {
+		t.Fatalf("Expected the session's accepted and refused requests logged, got %+v", entries)
+	}
+	if anonymous := manager.Recent(LogFilter{Caller: CallerAnonymous}); len(anonymous) != 1 {
+		t.Errorf("Expected one anonymous request, got %+v", anonymous)
+	}
+
+	// A restart keeps the revocation, the last use and the log
+	restarted := NewManager("admin-secret", SessionsPath(stateDir), LogPath(stateDir), nil)
+	if got := request(restarted.Require(ok), http.MethodGet, "/", token).Code; got != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked token refused after a restart, got %d", got)
+	}
+	sessions := restarted.Sessions(time.Now())
+	if len(sessions) != 1 || sessions[0].Active || sessions[0].LastUsedAt.IsZero() {
+		t.Errorf("Expected the revoked session with its last use, got %+v", sessions)
+	}
+	if entries := restarted.Recent(LogFilter{}); len(entries) != 4 {
+		t.Errorf("Expected 4 logged requests after a restart, got %d", len(entries))
+	}
+
+	data, _ := os.ReadFile(SessionsPath(stateDir))
+	if len(data) == 0 || strings.Contains(string(data), token) {
+		t.Error("Expected the sessions file to hold the token hash only")
+	}
+}
+
+func TestRolesGovernEndpoints(t *testing.T) {
+	manager := NewManager("admin-secret", "", "", nil)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tokens := make(map[string]string)
+	for _, role := range []string{RoleReadOnly, RoleResident, RoleAdmin} {
+		_, token, err := manager.CreateSession(role+" phone", role, 0, time.Now())
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		tokens[role] = token
+	}
+	if _, _, err := manager.CreateSession("guest", "owner", 0, time.Now()); err == nil {
+		t.Error("Expected an unknown role to be rejected")
+	}
+
+	read, control, configure := manager.Authenticate(ok), manager.Require(ok), manager.RequireRole(RoleAdmin, ok)
+	for _, step := range []struct {
+		handler http.Handler
+		token   string
+		want    int
+	}{
+		{read, "", http.StatusOK}, // Reads are open until HA_API_AUTH
+		{control, tokens[RoleReadOnly], http.StatusForbidden},
+		{control, tokens[RoleResident], http.StatusOK},
+		{configure, tokens[RoleResident], http.StatusForbidden},
+		{configure, tokens[RoleAdmin], http.StatusOK},
+		{configure, "admin-secret", http.StatusOK},
+		{configure, "wrong", http.StatusUnauthorized},
+	} {
+		if got := request(step.handler, http.MethodPost, "/", step.token).Code; got != step.want {
+			t.Errorf("Token %q: expected %d, got %d", step.token, step.want, got)
+		}
+	}
+
+	manager.SetAuthenticateReads(true)
+	if got := request(read, http.MethodGet, "/", "").Code; got != http.StatusUnauthorized {
+		t.Errorf("Expected an anonymous read refused, got %d", got)
+	}
+	if got := request(read, http.MethodGet, "/", tokens[RoleReadOnly]).Code; got != http.StatusOK {
+		t.Errorf("Expected a read-only read served, got %d", got)
+	}
+
+	// Sessions issued before roles keep their full access
+	legacy := &Session{ID: "legacy", Name: "old phone", TokenHash: hashToken("ha_legacy"), CreatedAt: time.Now()}
+	manager.sessions[legacy.ID] = legacy
+	if got := request(configure, http.MethodPost, "/", "ha_legacy").Code; got != http.StatusOK {
+		t.Errorf("Expected a session without a role to keep admin access, got %d", got)
+	}
+}
+
+func TestFollowerSeesSessionChanges(t *testing.T) {
+	path := SessionsPath(t.TempDir())
+	gateway := NewManager("", path, "", nil)
+	server := NewManager("", path, "", nil)
+	server.FollowSessions()
+	ok := server.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	session, token, err := gateway.CreateSession("phone", RoleResident, 0, time.Now())
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if got := request(ok, http.MethodPost, "/", token).Code; got != http.StatusOK {
+		t.Fatalf("Expected a session created elsewhere accepted, got %d", got)
+	}
+
+	if _, err := gateway.RevokeSession(session.ID, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if got := request(ok, http.MethodPost, "/", token).Code; got != http.StatusUnauthorized {
+		t.Errorf("Expected a session revoked elsewhere refused, got %d", got)
+	}
+}
+
+func TestExpiredSessionAndLogRotation(t *testing.T) {
+	stateDir := t.TempDir()
+	manager := NewManager("", "", LogPath(stateDir), nil)
+	defer manager.Close()
+
+	_, token, err := manager.CreateSession("tablet", RoleResident, time.Hour, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if got := request(manager.Require(ok), http.MethodGet, "/", token).Code; got != http.StatusUnauthorized {
+		t.Errorf("Expected the expired token refused, got %d", got)
+	}
+	if _, _, err := manager.CreateSession("", "", 0, time.Now()); err == nil {
+		t.Error("Expected a session without a name to be rejected")
+	}
+
+	// The second entry doesn't fit the log any more
+	request(manager.Record(ok), http.MethodGet, "/api/scenes", "")
+	manager.logSize = maxLogBytes
+	request(manager.Record(ok), http.MethodGet, "/api/scenes", "")
+	if _, err := os.Stat(LogPath(stateDir) + ".1"); err != nil {
+		t.Errorf("Expected the full log rotated, got %v", err)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(stateDir, LogFileName+"*")); len(entries) != 2 {
+		t.Errorf("Expected the current and the rotated log, got %v", entries)
+	}
+}
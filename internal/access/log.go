@@ -0,0 +1,178 @@
+package access
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// LogFileName is the API access log, one JSON entry per line
+	LogFileName = "api-access.log"
+
+	// The log is moved to LogFileName.1 once it reaches maxLogBytes, so at most two are kept
+	maxLogBytes = 10 << 20
+
+	// Entries kept in memory for the API
+	maxRecentEntries = 1000
+)
+
+// Callers that aren't a session
+const (
+	CallerAdmin     = "admin"
+	CallerAnonymous = "anonymous"
+	CallerUnknown   = "unknown-token" // A token that matches nothing, or a revoked or expired session
+)
+
+// LogPath returns the access log path for a state directory
+func LogPath(stateDir string) string {
+	return filepath.Join(stateDir, LogFileName)
+}
+
+// Entry is one API request
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Caller     string    `json:"caller"`               // Session name, admin, anonymous or unknown-token
+	SessionID  string    `json:"session_id,omitempty"` // Set for session tokens, even revoked ones
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// LogFilter selects entries of the access log
+type LogFilter struct {
+	SessionID string
+	Caller    string
+	Since     time.Time
+	Limit     int // 0 returns every entry kept
+}
+
+func (f LogFilter) matches(entry Entry) bool {
+	return (f.SessionID == "" || entry.SessionID == f.SessionID) &&
+		(f.Caller == "" || entry.Caller == f.Caller) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since))
+}
+
+// Recent returns the latest entries matching the filter, newest first
+func (m *Manager) Recent(filter LogFilter) []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]Entry, 0)
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		if filter.matches(m.entries[i]) {
+			entries = append(entries, m.entries[i])
+		}
+	}
+	return entries
+}
+
+// record keeps an entry in memory and appends it to the log file
+func (m *Manager) record(entry Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(m.entries, entry)
+	if len(m.entries) > maxRecentEntries {
+		m.entries = m.entries[len(m.entries)-maxRecentEntries:]
+	}
+
+	if m.logPath == "" {
+		return
+	}
+	if err := m.appendLocked(entry); err != nil {
+		m.logger.Error("Failed to write API access log", err)
+	}
+}
+
+// appendLocked writes an entry to the log file, rotating it when full; callers must hold the lock
+func (m *Manager) appendLocked(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal access log entry", err)
+	}
+	line = append(line, '\n')
+
+	if m.logFile != nil && m.logSize+int64(len(line)) > maxLogBytes {
+		m.logFile.Close()
+		m.logFile = nil
+		if err := os.Rename(m.logPath, m.logPath+".1"); err != nil {
+			return errors.NewSystemError("failed to rotate access log", err)
+		}
+	}
+	if m.logFile == nil {
+		if err := os.MkdirAll(filepath.Dir(m.logPath), 0755); err != nil {
+			return errors.NewSystemError("failed to create state directory", err)
+		}
+		file, err := os.OpenFile(m.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.NewSystemError("failed to open access log", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return errors.NewSystemError("failed to open access log", err)
+		}
+		m.logFile, m.logSize = file, info.Size()
+	}
+
+	written, err := m.logFile.Write(line)
+	m.logSize += int64(written)
+	if err != nil {
+		return errors.NewSystemError("failed to write access log", err)
+	}
+	return nil
+}
+
+// loadLog reads the latest entries of the log file, so past access can be reviewed after a restart
+func (m *Manager) loadLog() error {
+	file, err := os.Open(m.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to open access log", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // A line cut off by a crash
+		}
+		m.entries = append(m.entries, entry)
+		if len(m.entries) > 2*maxRecentEntries {
+			m.entries = append(m.entries[:0], m.entries[len(m.entries)-maxRecentEntries:]...)
+		}
+	}
+	if len(m.entries) > maxRecentEntries {
+		m.entries = m.entries[len(m.entries)-maxRecentEntries:]
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.NewSystemError("failed to read access log", err)
+	}
+	return nil
+}
+
+// Close closes the log file
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.logFile == nil {
+		return nil
+	}
+	err := m.logFile.Close()
+	m.logFile = nil
+	return err
+}
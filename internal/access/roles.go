@@ -0,0 +1,42 @@
+package access
+
+import (
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Roles of API sessions, from the least to the most trusted. The admin token has RoleAdmin.
+const (
+	RoleReadOnly = "read_only" // Reads the API where HA_API_AUTH requires a token for reading
+	RoleResident = "resident"  // Also controls the home: devices, setpoints, scenes and modes
+	RoleAdmin    = "admin"     // Also changes how the home runs: rules, schedules and backups
+)
+
+// DefaultRole is given to sessions created without a role
+const DefaultRole = RoleResident
+
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleResident: 2,
+	RoleAdmin:    3,
+}
+
+// ValidRole checks a session role
+func ValidRole(role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return errors.NewValidationError("unknown role "+role+", use read_only, resident or admin", nil)
+	}
+	return nil
+}
+
+// Allows reports whether a caller with role may use an endpoint needing required
+func Allows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// role returns the session's role. Sessions issued before roles keep the full access they had.
+func (s *Session) role() string {
+	if s.Role == "" {
+		return RoleAdmin
+	}
+	return s.Role
+}
@@ -0,0 +1,255 @@
+package access
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// SessionsFileName keeps the issued API tokens, hashed
+const SessionsFileName = "sessions.json"
+
+// tokenPrefix marks session tokens so they are recognisable in configuration and logs
+const tokenPrefix = "ha_"
+
+// lastUsedResolution is how stale a session's last use may get before it is saved again
+const lastUsedResolution = time.Minute
+
+// SessionsPath returns the sessions file path for a state directory
+func SessionsPath(stateDir string) string {
+	return filepath.Join(stateDir, SessionsFileName)
+}
+
+// Session is an API token issued to one client, e.g. the dashboard on a phone. Only the
+// token's SHA-256 is kept, so the token is shown once, when the session is created.
+type Session struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role,omitempty"`
+	TokenHash  string    `json:"token_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	LastAddr   string    `json:"last_addr,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session's token is accepted at the given time
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt.IsZero() && (s.ExpiresAt.IsZero() || now.Before(s.ExpiresAt))
+}
+
+// SessionInfo is a session as listed by the API, without the token hash
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	LastAddr   string    `json:"last_addr,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty"`
+	Active     bool      `json:"active"`
+}
+
+func (s *Session) info(now time.Time) SessionInfo {
+	return SessionInfo{
+		ID:         s.ID,
+		Name:       s.Name,
+		Role:       s.role(),
+		CreatedAt:  s.CreatedAt,
+		ExpiresAt:  s.ExpiresAt,
+		LastUsedAt: s.LastUsedAt,
+		LastAddr:   s.LastAddr,
+		RevokedAt:  s.RevokedAt,
+		Active:     s.Active(now),
+	}
+}
+
+// CreateSession issues a token for a named client with a role, DefaultRole when empty; a ttl of
+// 0 never expires. The token is returned once and can't be recovered afterwards.
+func (m *Manager) CreateSession(name, role string, ttl time.Duration, now time.Time) (SessionInfo, string, error) {
+	if name == "" {
+		return SessionInfo{}, "", errors.NewValidationError("session name is required", nil)
+	}
+	if role == "" {
+		role = DefaultRole
+	}
+	if err := ValidRole(role); err != nil {
+		return SessionInfo{}, "", err
+	}
+	if ttl < 0 {
+		return SessionInfo{}, "", errors.NewValidationError("session lifetime must not be negative", nil)
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return SessionInfo{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return SessionInfo{}, "", err
+	}
+	token := tokenPrefix + secret
+
+	session := &Session{ID: id, Name: name, Role: role, TokenHash: hashToken(token), CreatedAt: now.Round(0)}
+	if ttl > 0 {
+		session.ExpiresAt = session.CreatedAt.Add(ttl)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = session
+	if err := m.saveSessionsLocked(); err != nil {
+		delete(m.sessions, id)
+		return SessionInfo{}, "", err
+	}
+	return session.info(now), token, nil
+}
+
+// RevokeSession stops accepting a session's token. Revoked sessions stay listed so their past
+// access can still be attributed.
+func (m *Manager) RevokeSession(id string, now time.Time) (SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return SessionInfo{}, errors.NewValidationError("unknown session "+id, nil)
+	}
+	if session.RevokedAt.IsZero() {
+		session.RevokedAt = now.Round(0)
+		if err := m.saveSessionsLocked(); err != nil {
+			session.RevokedAt = time.Time{}
+			return SessionInfo{}, err
+		}
+	}
+	return session.info(now), nil
+}
+
+// Sessions lists every session, newest first
+func (m *Manager) Sessions(now time.Time) []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session.info(now))
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// authenticateLocked returns the active session of a token and records its use; callers must
+// hold the lock
+func (m *Manager) authenticateLocked(token, addr string, now time.Time) (*Session, bool) {
+	hash := hashToken(token)
+	for _, session := range m.sessions {
+		if session.TokenHash != hash {
+			continue
+		}
+		if !session.Active(now) {
+			return session, false
+		}
+		if now.Sub(session.LastUsedAt) >= lastUsedResolution || session.LastAddr != addr {
+			session.LastUsedAt = now.Round(0)
+			session.LastAddr = addr
+			if err := m.saveSessionsLocked(); err != nil {
+				m.logger.Error("Failed to save session use", err, map[string]interface{}{"session_id": session.ID})
+			}
+		}
+		return session, true
+	}
+	return nil, false
+}
+
+func (m *Manager) loadSessions() error {
+	data, err := os.ReadFile(m.sessionsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read sessions", err)
+	}
+
+	var sessions []*Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return errors.NewSystemError("failed to parse sessions", err)
+	}
+	loaded := make(map[string]*Session, len(sessions))
+	for _, session := range sessions {
+		loaded[session.ID] = session
+	}
+	m.sessions = loaded
+	if info, err := os.Stat(m.sessionsPath); err == nil {
+		m.sessionsMod = info.ModTime()
+	}
+	return nil
+}
+
+// refreshSessionsLocked reloads the sessions when another service changed their file, so its
+// new and revoked sessions apply here too; callers must hold the lock
+func (m *Manager) refreshSessionsLocked() {
+	if m.sessionsPath == "" {
+		return
+	}
+	info, err := os.Stat(m.sessionsPath)
+	if err != nil || info.ModTime().Equal(m.sessionsMod) {
+		return
+	}
+	if err := m.loadSessions(); err != nil {
+		m.logger.Error("Failed to reload sessions, keeping the previous ones", err)
+	}
+}
+
+// saveSessionsLocked atomically writes the sessions; callers must hold the lock
+func (m *Manager) saveSessionsLocked() error {
+	if m.sessionsPath == "" || m.follower {
+		return nil
+	}
+
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal sessions", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.sessionsPath), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+	tmpPath := m.sessionsPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.NewSystemError("failed to write sessions", err)
+	}
+	if err := os.Rename(tmpPath, m.sessionsPath); err != nil {
+		return errors.NewSystemError("failed to replace sessions", err)
+	}
+	if info, err := os.Stat(m.sessionsPath); err == nil {
+		m.sessionsMod = info.ModTime()
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) (string, error) {
+	buffer := make([]byte, size)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", errors.NewSystemError("failed to generate random token", err)
+	}
+	return hex.EncodeToString(buffer), nil
+}
@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// ManifestName is the archive entry listing every file and its SHA-256
+const ManifestName = "MANIFEST.json"
+
+// Manifest describes the files of a backup archive
+type Manifest struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Host      string            `json:"host,omitempty"`
+	Files     map[string]string `json:"files"` // SHA-256 per archive path
+}
+
+// createArchive packs the sources, files or directories, into a gzipped tar. Files are stored
+// under their absolute path without the leading slash, so `tar -xzf backup.tar.gz -C /`
+// restores them in place. Missing sources, the exclude directory and temporary files of
+// atomic writes are skipped.
+func createArchive(sources []string, exclude, host string, now time.Time) ([]byte, *Manifest, error) {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+	manifest := &Manifest{CreatedAt: now, Host: host, Files: make(map[string]string)}
+
+	add := func(path string, info fs.FileInfo) error {
+		name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+		if _, done := manifest.Files[name]; done {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := writeEntry(tw, name, data, info.Mode().Perm(), info.ModTime()); err != nil {
+			return err
+		}
+		manifest.Files[name] = digest(data)
+		return nil
+	}
+
+	for _, source := range sources {
+		source, err := filepath.Abs(source)
+		if err != nil {
+			return nil, nil, errors.NewSystemError("invalid backup source "+source, err)
+		}
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+		err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() && exclude != "" && path == exclude {
+				return filepath.SkipDir
+			}
+			if !entry.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return add(path, info)
+		})
+		if err != nil {
+			return nil, nil, errors.NewSystemError("failed to archive "+source, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, errors.NewSystemError("failed to marshal backup manifest", err)
+	}
+	if err := writeEntry(tw, ManifestName, data, 0644, now); err != nil {
+		return nil, nil, errors.NewSystemError("failed to write backup manifest", err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, errors.NewSystemError("failed to finish backup archive", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, errors.NewSystemError("failed to compress backup archive", err)
+	}
+	return buffer.Bytes(), manifest, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte, mode fs.FileMode, modTime time.Time) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Verify checks that an archive is intact: it decompresses, carries a manifest, and every file
+// listed in the manifest is present with the recorded SHA-256
+func Verify(archive []byte) (*Manifest, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.NewValidationError("backup is not a gzip archive", err)
+	}
+	tr := tar.NewReader(gz)
+
+	digests := make(map[string]string)
+	var manifest *Manifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.NewValidationError("backup archive is corrupt", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.NewValidationError("backup archive is truncated", err)
+		}
+
+		if header.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, errors.NewValidationError("backup manifest is corrupt", err)
+			}
+			continue
+		}
+		digests[header.Name] = digest(data)
+	}
+
+	if manifest == nil {
+		return nil, errors.NewValidationError("backup archive has no manifest", nil)
+	}
+	var mismatched []string
+	for name, sum := range manifest.Files {
+		if digests[name] != sum {
+			mismatched = append(mismatched, name)
+		}
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return nil, errors.NewValidationError(fmt.Sprintf("backup files missing or damaged: %s", strings.Join(mismatched, ", ")), nil)
+	}
+	return manifest, nil
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
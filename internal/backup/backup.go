@@ -0,0 +1,476 @@
+// Package backup takes nightly backups of the configuration and state files. Archives go to a
+// directory, which may be an SMB or NFS mount, or to an S3-compatible bucket. Every archive is
+// read back and checked against its manifest before it counts, and old archives are pruned.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/s3"
+)
+
+const (
+	// StateFileName keeps the outcome of the last backups, inside the state directory
+	StateFileName = "backup.json"
+
+	archiveSuffix     = ".tar.gz"
+	archiveTimeFormat = "20060102T150405Z"
+	defaultAt         = "03:00"
+	defaultKeep       = 7
+	defaultName       = "home-automation"
+
+	// staleAfter is how old the last good backup may be before health reports it; a day and slack
+	staleAfter = 26 * time.Hour
+)
+
+// S3Config locates an S3-compatible bucket. Empty keys fall back to AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://nas:9000
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix,omitempty"` // e.g. "gateway/"
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+}
+
+// Config configures the nightly backup. Archives go to Dir or the S3 bucket. The newest Keep
+// archives are kept, and of those only the ones younger than KeepDays when it is set.
+type Config struct {
+	At       string    `json:"at,omitempty"`    // Local time of day, "03:00" by default
+	Paths    []string  `json:"paths,omitempty"` // Files and directories besides the state and config files
+	Dir      string    `json:"dir,omitempty"`
+	S3       *S3Config `json:"s3,omitempty"`
+	Keep     int       `json:"keep,omitempty"` // 7 by default
+	KeepDays int       `json:"keep_days,omitempty"`
+	Name     string    `json:"name,omitempty"` // Archive name prefix, "home-automation" by default
+}
+
+// LoadConfig reads the backup configuration from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read backup file", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse backup file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the time of day, retention and that there is exactly one destination
+func (c *Config) Validate() error {
+	if _, err := time.Parse("15:04", c.at()); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid backup time %q, use HH:MM", c.At), err)
+	}
+	if (c.Dir == "") == (c.S3 == nil) {
+		return errors.NewValidationError("backup needs either a dir or an s3 bucket", nil)
+	}
+	if c.S3 != nil && (c.S3.Endpoint == "" || c.S3.Bucket == "") {
+		return errors.NewValidationError("an s3 backup needs an endpoint and a bucket", nil)
+	}
+	if c.Keep < 0 || c.KeepDays < 0 {
+		return errors.NewValidationError("keep and keep_days must not be negative", nil)
+	}
+	if strings.ContainsAny(c.Name, "/\\") {
+		return errors.NewValidationError("the backup name must not contain slashes", nil)
+	}
+	return nil
+}
+
+func (c *Config) at() string {
+	if c.At != "" {
+		return c.At
+	}
+	return defaultAt
+}
+
+func (c *Config) keep() int {
+	if c.Keep > 0 {
+		return c.Keep
+	}
+	return defaultKeep
+}
+
+func (c *Config) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultName
+}
+
+// destination creates the archive store the configuration names
+func (c *Config) destination() Destination {
+	if c.S3 == nil {
+		return &localDestination{dir: c.Dir}
+	}
+
+	accessKey, secretKey := c.S3.AccessKey, c.S3.SecretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	prefix := c.S3.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Destination{client: s3.New(c.S3.Endpoint, c.S3.Region, c.S3.Bucket, accessKey, secretKey), prefix: prefix}
+}
+
+// Status is the outcome of the backups so far
+type Status struct {
+	LastAttempt         time.Time `json:"last_attempt,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastArchive         string    `json:"last_archive,omitempty"`
+	LastSizeBytes       int       `json:"last_size_bytes,omitempty"`
+	LastFiles           int       `json:"last_files,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Archives            []string  `json:"archives,omitempty"` // Kept archives, oldest first
+}
+
+// Service backs up the sources every night and keeps the outcome for health checks
+type Service struct {
+	config      *Config
+	destination Destination
+	sources     []string
+	host        string
+	path        string
+	status      Status
+	started     time.Time
+	lastSuccess prometheus.Gauge
+	failures    prometheus.Gauge
+	size        prometheus.Gauge
+	logger      *logger.Logger
+	run         sync.Mutex // Held for the length of a backup
+	mu          sync.Mutex
+}
+
+// StatePath returns the backup status file path for a state directory
+func StatePath(stateDir string) string {
+	return filepath.Join(stateDir, StateFileName)
+}
+
+// NewService creates the backup service for the files and directories in sources. The status
+// at path is restored, so a restart neither repeats last night's backup nor forgets failures.
+func NewService(cfg *Config, sources []string, path string, serviceLogger *logger.Logger) *Service {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Backup", nil)
+	}
+	host, _ := os.Hostname()
+
+	service := &Service{
+		config:      cfg,
+		destination: cfg.destination(),
+		sources:     append(append([]string(nil), sources...), cfg.Paths...),
+		host:        host,
+		path:        path,
+		started:     time.Now(),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_automation_backup_last_success_timestamp_seconds",
+			Help: "Time of the last verified backup",
+		}),
+		failures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_automation_backup_consecutive_failures",
+			Help: "Backups failed since the last verified one",
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_automation_backup_size_bytes",
+			Help: "Size of the last verified backup archive",
+		}),
+		logger: serviceLogger,
+	}
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load backup status", err)
+		}
+	}
+	service.updateMetrics()
+	return service
+}
+
+// RegisterMetrics registers the backup gauges
+func (s *Service) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.lastSuccess, s.failures, s.size} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register backup metrics", err)
+		}
+	}
+	return nil
+}
+
+// Run backs up once a night at the configured time until the context is cancelled. A failed
+// backup isn't retried before the next night, so a broken share isn't hammered.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if s.due(now) {
+				s.Backup(ctx, now)
+			}
+		}
+	}
+}
+
+// due reports whether tonight's backup time has passed without an attempt since
+func (s *Service) due(now time.Time) bool {
+	clock, _ := time.Parse("15:04", s.config.at())
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(scheduled) && s.status.LastAttempt.Before(scheduled)
+}
+
+// Backup archives the sources, stores the archive, reads it back to verify it and prunes old
+// archives. The outcome is recorded in the status whether it succeeds or not.
+func (s *Service) Backup(ctx context.Context, now time.Time) (Status, error) {
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	name, size, files, archives, err := s.backup(ctx, now)
+
+	s.mu.Lock()
+	s.status.LastAttempt = now
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.ConsecutiveFailures++
+		s.logger.Error("Backup failed", err, map[string]interface{}{
+			"consecutive_failures": s.status.ConsecutiveFailures,
+		})
+	} else {
+		s.status.LastSuccess, s.status.LastArchive, s.status.LastSizeBytes, s.status.LastFiles = now, name, size, files
+		s.status.LastError, s.status.ConsecutiveFailures = "", 0
+		s.logger.Info("Backup verified", map[string]interface{}{
+			"archive":    name,
+			"size_bytes": size,
+			"files":      files,
+		})
+	}
+	if archives != nil {
+		s.status.Archives = archives
+	}
+	if saveErr := s.save(); saveErr != nil {
+		s.logger.Error("Failed to save backup status", saveErr)
+	}
+	status := s.copyStatus()
+	s.mu.Unlock()
+
+	s.updateMetrics()
+	return status, err
+}
+
+func (s *Service) backup(ctx context.Context, now time.Time) (name string, size, files int, archives []string, err error) {
+	// A backup directory inside the state directory mustn't back itself up
+	exclude := ""
+	if s.config.Dir != "" {
+		exclude, _ = filepath.Abs(s.config.Dir)
+	}
+	archive, manifest, err := createArchive(s.sources, exclude, s.host, now)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+
+	name = fmt.Sprintf("%s-%s%s", s.config.name(), now.UTC().Format(archiveTimeFormat), archiveSuffix)
+	if err := s.destination.Put(ctx, name, archive); err != nil {
+		return "", 0, 0, nil, err
+	}
+
+	// Only an archive read back intact counts as a backup
+	stored, err := s.destination.Get(ctx, name)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	if digest(stored) != digest(archive) {
+		return "", 0, 0, nil, errors.NewValidationError("stored backup differs from the archive written", nil)
+	}
+	if _, err := Verify(stored); err != nil {
+		return "", 0, 0, nil, err
+	}
+
+	archives, err = s.prune(ctx, now)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	return name, len(archive), len(manifest.Files), archives, nil
+}
+
+// prune deletes all but the newest archives and, with KeepDays, the ones older than that. The
+// newest archive is always kept. It returns the archives left, oldest first.
+func (s *Service) prune(ctx context.Context, now time.Time) ([]string, error) {
+	names, err := s.destination.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Archive names sort by time; archives of other names, e.g. another gateway's, are left alone
+	prefix := s.config.name() + "-"
+	var archives []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			archives = append(archives, name)
+		}
+	}
+	sort.Strings(archives)
+
+	var kept []string
+	for i, name := range archives {
+		remaining := len(archives) - i
+		expired := false
+		if s.config.KeepDays > 0 && remaining > 1 {
+			created, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), archiveSuffix))
+			expired = err == nil && now.Sub(created) > time.Duration(s.config.KeepDays)*24*time.Hour
+		}
+		if remaining <= s.config.keep() && !expired {
+			kept = append(kept, name)
+			continue
+		}
+		if err := s.destination.Delete(ctx, name); err != nil {
+			return nil, err
+		}
+		s.logger.Info("Pruned old backup", map[string]interface{}{"archive": name})
+	}
+	return kept, nil
+}
+
+// HealthCheck reports failing backups, and a last good backup more than a day old
+func (s *Service) HealthCheck(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.status.ConsecutiveFailures > 0:
+		return errors.NewServiceError(fmt.Sprintf("last %d backups failed: %s", s.status.ConsecutiveFailures, s.status.LastError), nil)
+	case s.status.LastSuccess.IsZero() && now.Sub(s.started) > staleAfter:
+		return errors.NewServiceError("no backup has succeeded yet", nil)
+	case !s.status.LastSuccess.IsZero() && now.Sub(s.status.LastSuccess) > staleAfter:
+		return errors.NewServiceError(fmt.Sprintf("last backup succeeded %s ago", now.Sub(s.status.LastSuccess).Round(time.Hour)), nil)
+	}
+	return nil
+}
+
+// Status returns the outcome of the backups so far
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copyStatus()
+}
+
+// Handler serves the backup status and health as JSON
+func (s *Service) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"status":    s.Status(),
+			"healthy":   true,
+			"timestamp": time.Now(),
+		}
+		if err := s.HealthCheck(time.Now()); err != nil {
+			response["healthy"], response["health_error"] = false, err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// RunHandler takes a backup now on POST and returns its outcome
+func (s *Service) RunHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := s.Backup(r.Context(), time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+func (s *Service) updateMetrics() {
+	status := s.Status()
+	if !status.LastSuccess.IsZero() {
+		s.lastSuccess.Set(float64(status.LastSuccess.Unix()))
+	}
+	s.failures.Set(float64(status.ConsecutiveFailures))
+	s.size.Set(float64(status.LastSizeBytes))
+}
+
+// copyStatus returns a copy callers can use without the lock; callers must hold it
+func (s *Service) copyStatus() Status {
+	status := s.status
+	status.Archives = append([]string(nil), s.status.Archives...)
+	return status
+}
+
+func (s *Service) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read backup status", err)
+	}
+
+	if err := json.Unmarshal(data, &s.status); err != nil {
+		return errors.NewSystemError("failed to parse backup status", err)
+	}
+	return nil
+}
+
+// save atomically writes the status; callers must hold the lock
+func (s *Service) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.status, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal backup status", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write backup status", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace backup status", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupVerifiesAndPrunes(t *testing.T) {
+	stateDir := t.TempDir()
+	os.WriteFile(filepath.Join(stateDir, "devices.json"), []byte(`[]`), 0644)
+	os.WriteFile(filepath.Join(stateDir, "alerts.json.tmp"), []byte(`partial`), 0644)
+	backupDir := filepath.Join(stateDir, "backups")
+
+	cfg := &Config{Dir: backupDir, Keep: 2}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %v", err)
+	}
+	service := NewService(cfg, []string{stateDir, filepath.Join(stateDir, "missing.json")}, StatePath(stateDir), nil)
+
+	start := time.Date(2025, 3, 1, 3, 0, 0, 0, time.UTC)
+	for night := 0; night < 3; night++ {
+		if _, err := service.Backup(context.Background(), start.AddDate(0, 0, night)); err != nil {
+			t.Fatalf("Backup %d failed: %v", night, err)
+		}
+	}
+
+	status := service.Status()
+	if len(status.Archives) != 2 || status.Archives[1] != "home-automation-20250303T030000Z.tar.gz" {
+		t.Fatalf("Expected the two newest archives kept, got %v", status.Archives)
+	}
+	if entries, _ := os.ReadDir(backupDir); len(entries) != 2 {
+		t.Errorf("Expected old archives deleted, found %d", len(entries))
+	}
+
+	// The status file and devices.json are backed up; the temporary file and the backups aren't
+	archive, _ := os.ReadFile(filepath.Join(backupDir, status.LastArchive))
+	manifest, err := Verify(archive)
+	if err != nil {
+		t.Fatalf("Expected the archive to verify, got %v", err)
+	}
+	if len(manifest.Files) != 2 || status.LastFiles != 2 {
+		t.Errorf("Expected devices.json and backup.json archived, got %v", manifest.Files)
+	}
+	if err := service.HealthCheck(start.AddDate(0, 0, 2).Add(time.Hour)); err != nil {
+		t.Errorf("Expected healthy backups, got %v", err)
+	}
+	if err := service.HealthCheck(start.AddDate(0, 0, 4)); err == nil {
+		t.Error("Expected a two-day-old backup to be reported")
+	}
+
+	// A restart remembers tonight's backup
+	restarted := NewService(cfg, []string{stateDir}, StatePath(stateDir), nil)
+	if restarted.due(start.AddDate(0, 0, 2).Add(time.Hour)) || !restarted.due(start.AddDate(0, 0, 3)) {
+		t.Error("Expected the next backup due the following night only")
+	}
+}
+
+func TestVerifyDetectsDamage(t *testing.T) {
+	stateDir := t.TempDir()
+	os.WriteFile(filepath.Join(stateDir, "schedule.json"), []byte(`{"rooms": {}}`), 0644)
+
+	archive, _, err := createArchive([]string{stateDir}, "", "gateway", time.Now())
+	if err != nil {
+		t.Fatalf("createArchive failed: %v", err)
+	}
+
+	// Rewrite the archive with a file changed after the manifest was taken
+	gz, _ := gzip.NewReader(bytes.NewReader(archive))
+	plain, _ := io.ReadAll(gz)
+	damaged := bytes.Replace(plain, []byte(`{"rooms": {}}`), []byte(`{"rooms": []}`), 1)
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(damaged)
+	writer.Close()
+
+	if _, err := Verify(buffer.Bytes()); err == nil {
+		t.Error("Expected a changed file to fail verification")
+	}
+	if _, err := Verify(archive[:len(archive)/2]); err == nil {
+		t.Error("Expected a truncated archive to fail verification")
+	}
+}
+
+func TestBackupFailureIsReported(t *testing.T) {
+	stateDir := t.TempDir()
+	blocked := filepath.Join(stateDir, "not-a-dir")
+	os.WriteFile(blocked, []byte("file"), 0644)
+
+	service := NewService(&Config{Dir: filepath.Join(blocked, "backups")}, []string{stateDir}, "", nil)
+	if _, err := service.Backup(context.Background(), time.Now()); err == nil {
+		t.Fatal("Expected a backup to an unwritable directory to fail")
+	}
+	if err := service.HealthCheck(time.Now()); err == nil {
+		t.Error("Expected the failed backup to be reported by the health check")
+	}
+	if status := service.Status(); status.ConsecutiveFailures != 1 || status.LastError == "" {
+		t.Errorf("Expected one recorded failure, got %+v", status)
+	}
+}
@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/s3"
+)
+
+// Destination stores backup archives by name
+type Destination interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	// List returns the names of the stored archives
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// localDestination keeps archives in a directory, which may be an SMB or NFS mount
+type localDestination struct {
+	dir string
+}
+
+func (d *localDestination) Put(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return errors.NewSystemError("failed to create backup directory", err)
+	}
+
+	// Write under a temporary name so a cut-off copy is never taken for a backup
+	path := filepath.Join(d.dir, name)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.NewSystemError("failed to create backup file", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.NewSystemError("failed to write backup file", err)
+	}
+	// A network share may buffer the write; sync so verification reads what was stored
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.NewSystemError("failed to sync backup file", err)
+	}
+	if err := file.Close(); err != nil {
+		return errors.NewSystemError("failed to close backup file", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.NewSystemError("failed to replace backup file", err)
+	}
+	return nil
+}
+
+func (d *localDestination) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, errors.NewSystemError("failed to read backup file", err)
+	}
+	return data, nil
+}
+
+func (d *localDestination) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.NewSystemError("failed to list backup directory", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), archiveSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *localDestination) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
+		return errors.NewSystemError("failed to delete backup file", err)
+	}
+	return nil
+}
+
+// s3Destination keeps archives in an S3-compatible bucket under a prefix
+type s3Destination struct {
+	client *s3.Client
+	prefix string
+}
+
+func (d *s3Destination) Put(ctx context.Context, name string, data []byte) error {
+	if err := d.client.Put(ctx, d.prefix+name, data); err != nil {
+		return errors.NewServiceError("failed to upload backup", err)
+	}
+	return nil
+}
+
+func (d *s3Destination) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := d.client.Get(ctx, d.prefix+name)
+	if err != nil {
+		return nil, errors.NewServiceError("failed to download backup", err)
+	}
+	return data, nil
+}
+
+func (d *s3Destination) List(ctx context.Context) ([]string, error) {
+	objects, err := d.client.List(ctx, d.prefix)
+	if err != nil {
+		return nil, errors.NewServiceError("failed to list backups", err)
+	}
+
+	var names []string
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, d.prefix)
+		if !strings.Contains(name, "/") && strings.HasSuffix(name, archiveSuffix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (d *s3Destination) Delete(ctx context.Context, name string) error {
+	if err := d.client.Delete(ctx, d.prefix+name); err != nil {
+		return errors.NewServiceError("failed to delete backup", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Build variables, set at link time:
+//
+//	go build -ldflags "-X github.com/johnpr01/home-automation/internal/buildinfo.Version=v1.2.0 ..."
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// TopicPrefix is the MQTT topic prefix for retained build info announcements
+const TopicPrefix = "home-automation/build-info/"
+
+// startedAt records when the process started
+var startedAt = time.Now()
+
+// Info describes the build a daemon is running
+type Info struct {
+	Service   string    `json:"service"`
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	BuildDate string    `json:"build_date"`
+	GoVersion string    `json:"go_version"`
+	Features  []string  `json:"features"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Get returns the build info for a service with its enabled features.
+// Commit and build date fall back to the VCS stamp embedded by the Go toolchain.
+func Get(service string, features []string) Info {
+	info := Info{
+		Service:   service,
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Features:  features,
+		StartedAt: startedAt,
+	}
+
+	if info.Features == nil {
+		info.Features = []string{}
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+
+	return info
+}
+
+// Features returns the names of the enabled features, sorted
+func Features(flags map[string]bool) []string {
+	features := make([]string, 0, len(flags))
+	for name, enabled := range flags {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// String returns a one-line summary such as "unified v1.2.0 (abc1234, 2026-01-01T00:00:00Z)"
+func (i Info) String() string {
+	return i.Service + " " + i.Version + " (" + shortCommit(i.Commit) + ", " + i.BuildDate + ")"
+}
+
+// Metadata returns the build info as discovery asset metadata
+func (i Info) Metadata() map[string]string {
+	return map[string]string{
+		"service":    i.Service,
+		"version":    i.Version,
+		"commit":     i.Commit,
+		"build_date": i.BuildDate,
+		"features":   strings.Join(i.Features, ","),
+	}
+}
+
+// Topic returns the MQTT topic the service announces its build info on
+func (i Info) Topic() string {
+	return TopicPrefix + i.Service
+}
+
+// Handler serves the build info as JSON
+func Handler(info Info) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
+
+// Announce publishes the build info as a retained MQTT message so other daemons can compare versions
+func Announce(client *mqtt.Client, info Info) error {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal build info", err)
+	}
+
+	return client.Publish(&mqtt.Message{
+		Topic:   info.Topic(),
+		Payload: payload,
+		QoS:     1,
+		Retain:  true,
+	})
+}
+
+// shortCommit abbreviates a commit hash for display
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
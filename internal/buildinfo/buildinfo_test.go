@@ -0,0 +1,48 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetUsesLinkTimeVariables(t *testing.T) {
+	Version, Commit, BuildDate = "v1.2.0", "0123456789abcdef", "2026-01-02T03:04:05Z"
+	defer func() { Version, Commit, BuildDate = "dev", "", "" }()
+
+	info := Get("unified", []string{"safe_mode", "observe_only"})
+
+	if info.Version != "v1.2.0" || info.Commit != "0123456789abcdef" || info.BuildDate != "2026-01-02T03:04:05Z" {
+		t.Errorf("Expected link-time build variables, got %+v", info)
+	}
+
+	if info.String() != "unified v1.2.0 (0123456, 2026-01-02T03:04:05Z)" {
+		t.Errorf("Unexpected summary: %s", info.String())
+	}
+
+	metadata := info.Metadata()
+	if metadata["version"] != "v1.2.0" || metadata["features"] != "safe_mode,observe_only" {
+		t.Errorf("Unexpected discovery metadata: %v", metadata)
+	}
+
+	if info.Topic() != "home-automation/build-info/unified" {
+		t.Errorf("Unexpected topic: %s", info.Topic())
+	}
+}
+
+func TestHandlerServesJSON(t *testing.T) {
+	info := Get("server", nil)
+
+	rec := httptest.NewRecorder()
+	Handler(info).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/build-info", nil))
+
+	var decoded Info
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode build info: %v", err)
+	}
+
+	if decoded.Service != "server" || decoded.Version != Version || decoded.Features == nil {
+		t.Errorf("Unexpected build info: %+v", decoded)
+	}
+}
@@ -0,0 +1,269 @@
+// Package calendar knows the public holidays of a region plus custom days and periods, so
+// schedules and routines can treat special days differently.
+package calendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	dayLayout  = "01-02"
+
+	// AnyHoliday matches every holiday in InPeriod
+	AnyHoliday = "holiday"
+)
+
+// Config selects a region's public holidays and adds custom days and periods
+type Config struct {
+	Region  string   `json:"region,omitempty"` // Preset of public holidays: us, gb or de
+	Days    []Day    `json:"days,omitempty"`
+	Periods []Period `json:"periods,omitempty"`
+	// HolidaysAs is the weekday whose schedule applies on holidays, e.g. "saturday"
+	HolidaysAs string `json:"holidays_as,omitempty"`
+}
+
+// Day is a custom holiday, once on "YYYY-MM-DD" or every year on "MM-DD"
+type Day struct {
+	Name string `json:"name"`
+	Date string `json:"date"`
+}
+
+// Period is a named range of days such as December, from Start to End inclusive. Dates are
+// "MM-DD" and a period may wrap the new year.
+type Period struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Holiday is a day off on Date ("YYYY-MM-DD"). Public holidays falling on a weekend are moved
+// to the day off the region gives instead, with "(observed)" added to the name.
+type Holiday struct {
+	Name string `json:"name"`
+	Date string `json:"date"`
+}
+
+// Calendar answers whether a day is a holiday or within a period. A nil calendar has no
+// holidays or periods.
+type Calendar struct {
+	config     Config
+	holidaysAs *time.Weekday
+}
+
+// New validates a configuration and creates its calendar
+func New(cfg Config) (*Calendar, error) {
+	cfg.Region = strings.ToLower(cfg.Region)
+	if _, known := regions[cfg.Region]; cfg.Region != "" && !known {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown holiday region %q, use one of %s", cfg.Region, strings.Join(Regions(), ", ")), nil)
+	}
+
+	for _, day := range cfg.Days {
+		if _, err := time.Parse(dateLayout, day.Date); err != nil {
+			if _, err := time.Parse(dayLayout, day.Date); err != nil {
+				return nil, errors.NewValidationError(fmt.Sprintf("day %s has an invalid date %q, use YYYY-MM-DD or MM-DD", day.Name, day.Date), err)
+			}
+		}
+	}
+	for _, period := range cfg.Periods {
+		if period.Name == "" {
+			return nil, errors.NewValidationError("periods need a name", nil)
+		}
+		if _, err := time.Parse(dayLayout, period.Start); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("period %s has an invalid start %q, use MM-DD", period.Name, period.Start), err)
+		}
+		if _, err := time.Parse(dayLayout, period.End); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("period %s has an invalid end %q, use MM-DD", period.Name, period.End), err)
+		}
+	}
+
+	c := &Calendar{config: cfg}
+	if cfg.HolidaysAs != "" {
+		weekday, ok := parseWeekday(cfg.HolidaysAs)
+		if !ok {
+			return nil, errors.NewValidationError(fmt.Sprintf("invalid holidays_as %q, use a weekday such as saturday", cfg.HolidaysAs), nil)
+		}
+		c.holidaysAs = &weekday
+	}
+	return c, nil
+}
+
+// Load reads a calendar configuration from a JSON file
+func Load(path string) (*Calendar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read calendar file", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse calendar file", err)
+	}
+	return New(cfg)
+}
+
+// Holidays returns the holidays of a year in date order
+func (c *Calendar) Holidays(year int) []Holiday {
+	if c == nil {
+		return nil
+	}
+
+	var holidays []Holiday
+	if preset := regions[c.config.Region]; preset != nil {
+		// A holiday observed on a weekday of a neighbouring year, such as New Year's Day
+		// on a Saturday, belongs to the year it is observed in
+		for _, y := range []int{year - 1, year, year + 1} {
+			for _, holiday := range preset(y) {
+				if strings.HasPrefix(holiday.Date, strconv.Itoa(year)+"-") {
+					holidays = append(holidays, holiday)
+				}
+			}
+		}
+	}
+
+	for _, day := range c.config.Days {
+		date := day.Date
+		if len(date) == len(dayLayout) {
+			date = fmt.Sprintf("%04d-%s", year, date)
+		}
+		if strings.HasPrefix(date, strconv.Itoa(year)+"-") {
+			holidays = append(holidays, Holiday{Name: day.Name, Date: date})
+		}
+	}
+
+	sort.SliceStable(holidays, func(i, j int) bool {
+		return holidays[i].Date < holidays[j].Date
+	})
+	return holidays
+}
+
+// Holiday returns the holiday on the calendar day of date
+func (c *Calendar) Holiday(date time.Time) (Holiday, bool) {
+	day := date.Format(dateLayout)
+	for _, holiday := range c.Holidays(date.Year()) {
+		if holiday.Date == day {
+			return holiday, true
+		}
+	}
+	return Holiday{}, false
+}
+
+// Periods returns the names of the periods covering date
+func (c *Calendar) Periods(date time.Time) []string {
+	if c == nil {
+		return nil
+	}
+
+	var names []string
+	for _, period := range c.config.Periods {
+		if Within(period.Start, period.End, date) {
+			names = append(names, period.Name)
+		}
+	}
+	return names
+}
+
+// InPeriod reports whether date falls in the named period or is the named holiday.
+// AnyHoliday matches every holiday. Names are compared case-insensitively.
+func (c *Calendar) InPeriod(name string, date time.Time) bool {
+	for _, period := range c.Periods(date) {
+		if strings.EqualFold(period, name) {
+			return true
+		}
+	}
+	holiday, ok := c.Holiday(date)
+	if !ok {
+		return false
+	}
+	return strings.EqualFold(name, AnyHoliday) || strings.EqualFold(strings.TrimSuffix(holiday.Name, observedSuffix), name)
+}
+
+// Has reports whether name is a period, a holiday of the calendar or AnyHoliday
+func (c *Calendar) Has(name string) bool {
+	if strings.EqualFold(name, AnyHoliday) {
+		return true
+	}
+	if c == nil {
+		return false
+	}
+	for _, period := range c.config.Periods {
+		if strings.EqualFold(period.Name, name) {
+			return true
+		}
+	}
+	for _, holiday := range c.Holidays(time.Now().Year()) {
+		if strings.EqualFold(strings.TrimSuffix(holiday.Name, observedSuffix), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleDay returns the weekday whose schedule applies on date: HolidaysAs on holidays,
+// otherwise the date's own weekday
+func (c *Calendar) ScheduleDay(date time.Time) time.Weekday {
+	if c == nil || c.holidaysAs == nil {
+		return date.Weekday()
+	}
+	if _, holiday := c.Holiday(date); holiday {
+		return *c.holidaysAs
+	}
+	return date.Weekday()
+}
+
+// Handler serves the holidays of ?year= (default this year) and today's periods as JSON
+func (c *Calendar) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		year := now.Year()
+		if value := r.URL.Query().Get("year"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid year %q", value), http.StatusBadRequest)
+				return
+			}
+			year = parsed
+		}
+
+		response := map[string]interface{}{
+			"region":   c.config.Region,
+			"year":     year,
+			"holidays": c.Holidays(year),
+			"periods":  c.Periods(now),
+		}
+		if holiday, ok := c.Holiday(now); ok {
+			response["today"] = holiday
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// Within reports whether the calendar day of date is from start to end ("MM-DD"), inclusive,
+// wrapping the new year when end comes before start
+func Within(start, end string, date time.Time) bool {
+	day := date.Format(dayLayout)
+	if start <= end {
+		return day >= start && day <= end
+	}
+	return day >= start || day <= end
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) {
+			return day, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegionHolidays(t *testing.T) {
+	tests := []struct {
+		region string
+		date   string
+		name   string
+	}{
+		{"us", "2024-11-28", "Thanksgiving"},
+		{"us", "2024-05-27", "Memorial Day"},
+		{"us", "2021-07-05", "Independence Day (observed)"},
+		{"us", "2021-12-31", "New Year's Day (observed)"}, // New Year's Day 2022 was a Saturday
+		{"gb", "2024-03-29", "Good Friday"},
+		{"gb", "2024-04-01", "Easter Monday"},
+		{"gb", "2022-12-26", "Boxing Day"},
+		{"gb", "2022-12-27", "Christmas Day (observed)"},
+		{"gb", "2021-12-28", "Boxing Day (observed)"},
+		{"de", "2024-05-09", "Ascension Day"},
+		{"de", "2024-05-20", "Whit Monday"},
+	}
+
+	for _, test := range tests {
+		calendar, err := New(Config{Region: test.region})
+		if err != nil {
+			t.Fatalf("New(%s) failed: %v", test.region, err)
+		}
+		day, _ := time.Parse(dateLayout, test.date)
+		holiday, ok := calendar.Holiday(day)
+		if !ok || holiday.Name != test.name {
+			t.Errorf("%s: expected %s on %s, got %+v (%v)", test.region, test.name, test.date, holiday, ok)
+		}
+	}
+
+	calendar, _ := New(Config{Region: "us"})
+	if weekend, _ := time.Parse(dateLayout, "2021-07-04"); calendar.InPeriod(AnyHoliday, weekend) {
+		t.Error("Expected a holiday moved to its observed day not to fall on its weekend date")
+	}
+}
+
+func TestCustomDaysAndPeriods(t *testing.T) {
+	calendar, err := New(Config{
+		Region:     "us",
+		Days:       []Day{{Name: "Company Day", Date: "2025-07-18"}, {Name: "Anniversary", Date: "09-14"}},
+		Periods:    []Period{{Name: "December", Start: "12-01", End: "12-31"}, {Name: "Winter", Start: "12-15", End: "02-15"}},
+		HolidaysAs: "saturday",
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	companyDay := time.Date(2025, 7, 18, 9, 0, 0, 0, time.UTC)
+	if holiday, ok := calendar.Holiday(companyDay); !ok || holiday.Name != "Company Day" {
+		t.Errorf("Expected the company day, got %+v", holiday)
+	}
+	if _, ok := calendar.Holiday(time.Date(2026, 7, 18, 9, 0, 0, 0, time.UTC)); ok {
+		t.Error("Expected a dated custom day only once")
+	}
+	if !calendar.InPeriod("anniversary", time.Date(2030, 9, 14, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected a MM-DD custom day every year")
+	}
+
+	january := time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC)
+	if !calendar.InPeriod("winter", january) || calendar.InPeriod("December", january) {
+		t.Errorf("Expected January in winter only, got %v", calendar.Periods(january))
+	}
+
+	// Holidays follow the Saturday schedule; other days keep their own
+	if day := calendar.ScheduleDay(companyDay); day != time.Saturday {
+		t.Errorf("Expected the Saturday schedule on a holiday, got %s", day)
+	}
+	if day := calendar.ScheduleDay(january.AddDate(0, 0, 1)); day != time.Tuesday {
+		t.Errorf("Expected a Tuesday's own schedule, got %s", day)
+	}
+	var none *Calendar
+	if day := none.ScheduleDay(companyDay); day != time.Friday {
+		t.Errorf("Expected no calendar to keep the weekday, got %s", day)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"unknown region": {Region: "atlantis"},
+		"bad day":        {Days: []Day{{Name: "x", Date: "18/07"}}},
+		"bad period":     {Periods: []Period{{Name: "December", Start: "12-01", End: "Dec 31"}}},
+		"bad weekday":    {HolidaysAs: "weekend"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
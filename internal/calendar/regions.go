@@ -0,0 +1,143 @@
+package calendar
+
+import (
+	"sort"
+	"time"
+)
+
+const observedSuffix = " (observed)"
+
+// regions are the public holiday presets, each returning the holidays of a year with
+// weekend holidays moved to their observed day
+var regions = map[string]func(year int) []Holiday{
+	"us": unitedStates,
+	"gb": england,
+	"de": germany,
+}
+
+// Regions returns the names of the holiday presets
+func Regions() []string {
+	names := make([]string, 0, len(regions))
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unitedStates returns the US federal holidays. One falling on a Saturday is observed on the
+// Friday before, one on a Sunday on the Monday after.
+func unitedStates(year int) []Holiday {
+	fixed := []Holiday{
+		on("New Year's Day", date(year, time.January, 1)),
+		on("Juneteenth", date(year, time.June, 19)),
+		on("Independence Day", date(year, time.July, 4)),
+		on("Veterans Day", date(year, time.November, 11)),
+		on("Christmas Day", date(year, time.December, 25)),
+	}
+	for i, holiday := range fixed {
+		day, _ := time.Parse(dateLayout, holiday.Date)
+		switch day.Weekday() {
+		case time.Saturday:
+			fixed[i] = on(holiday.Name+observedSuffix, day.AddDate(0, 0, -1))
+		case time.Sunday:
+			fixed[i] = on(holiday.Name+observedSuffix, day.AddDate(0, 0, 1))
+		}
+	}
+
+	return append(fixed,
+		on("Martin Luther King Jr. Day", nthWeekday(year, time.January, time.Monday, 3)),
+		on("Presidents' Day", nthWeekday(year, time.February, time.Monday, 3)),
+		on("Memorial Day", lastWeekday(year, time.May, time.Monday)),
+		on("Labor Day", nthWeekday(year, time.September, time.Monday, 1)),
+		on("Columbus Day", nthWeekday(year, time.October, time.Monday, 2)),
+		on("Thanksgiving", nthWeekday(year, time.November, time.Thursday, 4)),
+	)
+}
+
+// england returns the bank holidays of England and Wales. One falling on a weekend gets a
+// substitute day on the next weekday that isn't already a holiday.
+func england(year int) []Holiday {
+	easter := easterSunday(year)
+	holidays := []Holiday{
+		on("New Year's Day", date(year, time.January, 1)),
+		on("Good Friday", easter.AddDate(0, 0, -2)),
+		on("Easter Monday", easter.AddDate(0, 0, 1)),
+		on("Early May Bank Holiday", nthWeekday(year, time.May, time.Monday, 1)),
+		on("Spring Bank Holiday", lastWeekday(year, time.May, time.Monday)),
+		on("Summer Bank Holiday", lastWeekday(year, time.August, time.Monday)),
+		on("Christmas Day", date(year, time.December, 25)),
+		on("Boxing Day", date(year, time.December, 26)),
+	}
+
+	taken := make(map[string]bool)
+	for _, holiday := range holidays {
+		taken[holiday.Date] = true
+	}
+	for i, holiday := range holidays {
+		day, _ := time.Parse(dateLayout, holiday.Date)
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			continue
+		}
+		for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday || taken[day.Format(dateLayout)] {
+			day = day.AddDate(0, 0, 1)
+		}
+		taken[day.Format(dateLayout)] = true
+		holidays[i] = on(holiday.Name+observedSuffix, day)
+	}
+	return holidays
+}
+
+// germany returns the nationwide public holidays of Germany, which are not moved off weekends
+func germany(year int) []Holiday {
+	easter := easterSunday(year)
+	return []Holiday{
+		on("New Year's Day", date(year, time.January, 1)),
+		on("Good Friday", easter.AddDate(0, 0, -2)),
+		on("Easter Monday", easter.AddDate(0, 0, 1)),
+		on("Labour Day", date(year, time.May, 1)),
+		on("Ascension Day", easter.AddDate(0, 0, 39)),
+		on("Whit Monday", easter.AddDate(0, 0, 50)),
+		on("German Unity Day", date(year, time.October, 3)),
+		on("Christmas Day", date(year, time.December, 25)),
+		on("St Stephen's Day", date(year, time.December, 26)),
+	}
+}
+
+func on(name string, day time.Time) Holiday {
+	return Holiday{Name: name, Date: day.Format(dateLayout)}
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// nthWeekday returns the nth weekday of a month, e.g. the 4th Thursday of November
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	first := date(year, month, 1)
+	offset := (int(weekday) - int(first.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, offset+7*(n-1))
+}
+
+// lastWeekday returns the last weekday of a month, e.g. the last Monday of May
+func lastWeekday(year int, month time.Month, weekday time.Weekday) time.Time {
+	last := date(year, month+1, 0)
+	offset := (int(last.Weekday()) - int(weekday) + 7) % 7
+	return last.AddDate(0, 0, -offset)
+}
+
+// easterSunday returns Western Easter Sunday by the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return date(year, time.Month(month), day)
+}
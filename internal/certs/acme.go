@@ -0,0 +1,461 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// pollInterval is how often a pending authorization or order is checked
+	pollInterval = 2 * time.Second
+	// pollAttempts bounds the checks before an order is given up, to be retried later
+	pollAttempts = 60
+
+	badNonce = "urn:ietf:params:acme:error:badNonce"
+)
+
+// acmeClient orders certificates from an ACME CA (RFC 8555) with HTTP-01 challenges. It keeps
+// its account key in the certificate directory so renewals use the same account.
+type acmeClient struct {
+	directoryURL string
+	email        string
+	keyPath      string
+	http         *http.Client
+	pollInterval time.Duration
+
+	key       *ecdsa.PrivateKey
+	directory acmeDirectory
+	account   string // Account URL, the key ID of signed requests
+	nonce     string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newACMEClient(directoryURL, email, keyPath string) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		email:        email,
+		keyPath:      keyPath,
+		http:         &http.Client{Timeout: 30 * time.Second},
+		pollInterval: pollInterval,
+	}
+}
+
+// issue orders a certificate for the configured domains, answering the challenges through
+// HTTPHandler, and saves it with its new key
+func (m *Manager) issue(ctx context.Context) (*tls.Certificate, error) {
+	c := m.acme
+	if err := c.register(ctx); err != nil {
+		return nil, err
+	}
+
+	identifiers := make([]map[string]string, 0, len(m.cfg.Domains))
+	for _, domain := range m.cfg.Domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+	}
+	var order acmeOrder
+	resp, err := c.post(ctx, c.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to generate key", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to create certificate request", err)
+	}
+	if _, err := c.post(ctx, order.Finalize, map[string]string{"csr": encode(csr)}, &order); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; order.Status != "valid"; attempt++ {
+		if order.Status == "invalid" {
+			return nil, problemError("order failed", order.Error)
+		}
+		if attempt == pollAttempts {
+			return nil, errors.NewTimeoutError("order was not issued in time", nil)
+		}
+		if err := c.sleep(ctx); err != nil {
+			return nil, err
+		}
+		if _, err := c.post(ctx, orderURL, nil, &order); err != nil {
+			return nil, err
+		}
+	}
+
+	var chain bytes.Buffer
+	if _, err := c.post(ctx, order.Certificate, nil, &chain); err != nil {
+		return nil, err
+	}
+	return m.savePair(acmeName, chain.Bytes(), key)
+}
+
+// authorize proves control of one domain by publishing the key authorization of its HTTP-01
+// challenge until the CA has checked it
+func (m *Manager) authorize(ctx context.Context, authzURL string) error {
+	c := m.acme
+	var authz acmeAuthorization
+	if _, err := c.post(ctx, authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			challenge = &authz.Challenges[i]
+		}
+	}
+	if challenge == nil {
+		return errors.NewServiceError("no http-01 challenge offered for "+authz.Identifier.Value, nil)
+	}
+
+	thumbprint, err := c.thumbprint()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.challenges[challenge.Token] = challenge.Token + "." + thumbprint
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.challenges, challenge.Token)
+		m.mu.Unlock()
+	}()
+
+	if _, err := c.post(ctx, challenge.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+
+	for attempt := 0; authz.Status != "valid"; attempt++ {
+		switch {
+		case authz.Status != "pending" && authz.Status != "processing" && authz.Status != "":
+			for _, offered := range authz.Challenges {
+				if offered.Type == "http-01" && offered.Error != nil {
+					return problemError("challenge for "+authz.Identifier.Value+" failed", offered.Error)
+				}
+			}
+			return errors.NewServiceError("authorization for "+authz.Identifier.Value+" is "+authz.Status, nil)
+		case attempt == pollAttempts:
+			return errors.NewTimeoutError("authorization for "+authz.Identifier.Value+" was not validated in time", nil)
+		}
+		if err := c.sleep(ctx); err != nil {
+			return err
+		}
+		if _, err := c.post(ctx, authzURL, nil, &authz); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register loads or creates the account key, reads the directory and finds or creates the account
+func (c *acmeClient) register(ctx context.Context) error {
+	if c.key == nil {
+		key, err := loadOrCreateKey(c.keyPath)
+		if err != nil {
+			return err
+		}
+		c.key = key
+	}
+
+	if c.directory.NewOrder == "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+		if err != nil {
+			return errors.NewConfigError("invalid ACME directory URL", err)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return errors.NewConnectionError("failed to reach ACME directory", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.NewServiceError(fmt.Sprintf("ACME directory returned %s", resp.Status), nil)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+			return errors.NewServiceError("failed to parse ACME directory", err)
+		}
+	}
+
+	if c.account != "" {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.email != "" {
+		account["contact"] = []string{"mailto:" + c.email}
+	}
+	resp, err := c.post(ctx, c.directory.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	c.account = resp.Header.Get("Location")
+	if c.account == "" {
+		return errors.NewServiceError("ACME server returned no account URL", nil)
+	}
+	return nil
+}
+
+// post sends a signed request. A nil payload makes it a POST-as-GET. The response is decoded into
+// out, or copied when out is a buffer. A rejected nonce is retried once with a fresh one.
+func (c *acmeClient) post(ctx context.Context, url string, payload interface{}, out interface{}) (*http.Response, error) {
+	body := []byte{}
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, errors.NewSystemError("failed to marshal ACME request", err)
+		}
+	}
+
+	for retried := false; ; retried = true {
+		resp, data, err := c.send(ctx, url, body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 300 {
+			if buffer, ok := out.(*bytes.Buffer); ok {
+				buffer.Write(data)
+			} else if out != nil {
+				if err := json.Unmarshal(data, out); err != nil {
+					return nil, errors.NewServiceError("failed to parse ACME response", err)
+				}
+			}
+			return resp, nil
+		}
+
+		var problem acmeProblem
+		json.Unmarshal(data, &problem)
+		if problem.Type == badNonce && !retried {
+			continue
+		}
+		if problem.Detail == "" {
+			problem.Detail = resp.Status
+		}
+		return nil, problemError("ACME request failed", &problem)
+	}
+}
+
+// send signs body for url with the current nonce and keeps the nonce of the response
+func (c *acmeClient) send(ctx context.Context, url string, body []byte) (*http.Response, []byte, error) {
+	if c.nonce == "" {
+		if err := c.fetchNonce(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.account != "" {
+		header["kid"] = c.account
+	} else {
+		header["jwk"] = c.jwk()
+	}
+	c.nonce = ""
+
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return nil, nil, errors.NewSystemError("failed to marshal ACME header", err)
+	}
+	signingInput := encode(protected) + "." + encode(body)
+	signature, err := c.sign([]byte(signingInput))
+	if err != nil {
+		return nil, nil, err
+	}
+	jws, _ := json.Marshal(map[string]string{
+		"protected": encode(protected),
+		"payload":   encode(body),
+		"signature": encode(signature),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, errors.NewServiceError("invalid ACME URL "+url, err)
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, errors.NewConnectionError("failed to reach ACME server", err)
+	}
+	defer resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.NewConnectionError("failed to read ACME response", err)
+	}
+	return resp, data, nil
+}
+
+func (c *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.directory.NewNonce, nil)
+	if err != nil {
+		return errors.NewServiceError("invalid ACME nonce URL", err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.NewConnectionError("failed to get ACME nonce", err)
+	}
+	resp.Body.Close()
+
+	if c.nonce = resp.Header.Get("Replay-Nonce"); c.nonce == "" {
+		return errors.NewServiceError("ACME server returned no nonce", nil)
+	}
+	return nil
+}
+
+// sign returns the ES256 signature of input: r and s as 32 bytes each
+func (c *acmeClient) sign(input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, errors.NewSystemError("failed to sign ACME request", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+func (c *acmeClient) jwk() acmeJWK {
+	return acmeJWK{
+		Crv: "P-256",
+		Kty: "EC",
+		X:   encode(c.key.X.FillBytes(make([]byte, 32))),
+		Y:   encode(c.key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the account key; the fields of acmeJWK are in the
+// lexical order it requires
+func (c *acmeClient) thumbprint() (string, error) {
+	data, err := json.Marshal(c.jwk())
+	if err != nil {
+		return "", errors.NewSystemError("failed to marshal account key", err)
+	}
+	digest := sha256.Sum256(data)
+	return encode(digest[:]), nil
+}
+
+func (c *acmeClient) sleep(ctx context.Context) error {
+	timer := time.NewTimer(c.pollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// loadOrCreateKey reads the account key, creating it on first use
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.NewConfigError("invalid ACME account key "+path, nil)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.NewConfigError("invalid ACME account key "+path, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.NewSystemError("failed to read ACME account key", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to generate account key", err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, keyPEM); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func problemError(message string, problem *acmeProblem) error {
+	if problem == nil {
+		return errors.NewServiceError(message, nil)
+	}
+	return errors.NewServiceError(message+": "+problem.Detail, nil)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
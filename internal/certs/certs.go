@@ -0,0 +1,412 @@
+// Package certs supplies the certificate the API is served with over HTTPS: one read from files
+// and reloaded when they are replaced, one issued by an ACME CA such as Let's Encrypt and renewed
+// before it expires, or a self-signed one generated into the state directory.
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+const (
+	// DirName keeps generated and issued certificates, inside the state directory
+	DirName = "tls"
+
+	selfSignedName = "self-signed"
+	acmeName       = "acme"
+
+	// renewBefore is how long before it expires a generated or issued certificate is replaced
+	renewBefore = 30 * 24 * time.Hour
+	// checkEvery is how often expiry is checked, and the longest wait between failed ACME attempts
+	checkEvery = 12 * time.Hour
+	// reloadEvery is how often certificate files are checked for a replacement
+	reloadEvery = time.Minute
+	// retryAfter is the first wait after a failed ACME attempt; it doubles up to checkEvery
+	retryAfter = time.Minute
+
+	selfSignedValidity = 365 * 24 * time.Hour
+	challengePrefix    = "/.well-known/acme-challenge/"
+)
+
+// Dir returns the certificate directory inside the state directory
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, DirName)
+}
+
+// Manager holds the current certificate and keeps it fresh while it is running
+type Manager struct {
+	cfg    config.TLSConfig
+	dir    string
+	logger *logger.Logger
+	acme   *acmeClient
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	modTime    time.Time // Of the certificate file last loaded
+	issued     bool      // The ACME certificate replaced the interim self-signed one
+	retry      time.Duration
+	challenges map[string]string // HTTP-01 key authorizations by token
+
+	background lifecycle.Background
+	now        func() time.Time
+}
+
+// NewManager loads the configured certificate, generating a self-signed one when none exists yet.
+// With ACME domains a self-signed certificate is served until the first one is issued.
+func NewManager(cfg config.TLSConfig, stateDir string, log *logger.Logger) (*Manager, error) {
+	if log == nil {
+		log = logger.NewLogger("TLS", nil)
+	}
+	m := &Manager{
+		cfg:        cfg,
+		dir:        Dir(stateDir),
+		logger:     log,
+		challenges: make(map[string]string),
+		now:        time.Now,
+	}
+
+	switch {
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.NewConfigError("HA_TLS_CERT and HA_TLS_KEY must be set together", nil)
+		}
+		if err := m.reloadFiles(); err != nil {
+			return nil, err
+		}
+	case len(cfg.Domains) > 0:
+		m.acme = newACMEClient(cfg.Directory, cfg.Email, filepath.Join(m.dir, acmeName+"-account.key"))
+		cert, err := m.loadPair(acmeName)
+		if err == nil && m.fresh(cert, cfg.Domains) {
+			m.cert, m.issued = cert, true
+			break
+		}
+		if err := m.ensureSelfSigned(); err != nil {
+			return nil, err
+		}
+	case cfg.SelfSigned:
+		if err := m.ensureSelfSigned(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.NewConfigError("no certificate configured", nil)
+	}
+	return m, nil
+}
+
+// TLSConfig returns a server configuration that always presents the current certificate
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// GetCertificate returns the current certificate for a TLS handshake
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.NewServiceError("no certificate loaded", nil)
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges and redirects everything else to HTTPS on httpsPort
+func (m *Manager) HTTPHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, challengePrefix); ok {
+			m.mu.RLock()
+			keyAuth, found := m.challenges[token]
+			m.mu.RUnlock()
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(keyAuth))
+			return
+		}
+
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Start keeps the certificate fresh: files are reloaded when replaced, a self-signed
+// certificate is regenerated and an ACME one renewed before it expires
+func (m *Manager) Start(ctx context.Context) error {
+	return m.background.Start(ctx, m.run)
+}
+
+// Stop ends the renewal loop, abandoning an ACME order in progress
+func (m *Manager) Stop(ctx context.Context) error {
+	return m.background.Stop(ctx)
+}
+
+func (m *Manager) run(ctx context.Context) {
+	wait := time.Duration(0)
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		wait = m.refresh(ctx)
+	}
+}
+
+// refresh renews or reloads the certificate if needed and returns when to check again
+func (m *Manager) refresh(ctx context.Context) time.Duration {
+	switch {
+	case m.cfg.CertFile != "":
+		if err := m.reloadFiles(); err != nil {
+			m.logger.Error("Failed to reload certificate", err, map[string]interface{}{"cert_file": m.cfg.CertFile})
+		}
+		return reloadEvery
+	case m.acme != nil:
+		return m.renewACME(ctx)
+	default:
+		if err := m.ensureSelfSigned(); err != nil {
+			m.logger.Error("Failed to renew self-signed certificate", err)
+		}
+		return checkEvery
+	}
+}
+
+// renewACME orders a certificate when none was issued or it expires soon, backing off on failure
+func (m *Manager) renewACME(ctx context.Context) time.Duration {
+	m.mu.RLock()
+	current, issued := m.cert, m.issued
+	m.mu.RUnlock()
+	if issued && m.fresh(current, m.cfg.Domains) {
+		return checkEvery
+	}
+
+	cert, err := m.issue(ctx)
+	if err != nil {
+		m.mu.Lock()
+		m.retry = min(max(m.retry*2, retryAfter), checkEvery)
+		retry := m.retry
+		m.mu.Unlock()
+		m.logger.Error("Failed to obtain certificate", err, map[string]interface{}{
+			"domains": m.cfg.Domains, "retry_in": retry.String(),
+		})
+		return retry
+	}
+
+	m.mu.Lock()
+	m.cert, m.issued, m.retry = cert, true, 0
+	m.mu.Unlock()
+	m.logger.Info("Certificate issued", map[string]interface{}{
+		"domains": m.cfg.Domains, "expires": cert.Leaf.NotAfter.Format(time.RFC3339),
+	})
+	return checkEvery
+}
+
+// reloadFiles loads the configured certificate files when they changed since the last load
+func (m *Manager) reloadFiles() error {
+	info, err := os.Stat(m.cfg.CertFile)
+	if err != nil {
+		return errors.NewConfigError("failed to read certificate file", err)
+	}
+
+	m.mu.RLock()
+	unchanged := m.cert != nil && info.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.cfg.CertFile, m.cfg.KeyFile)
+	if err != nil {
+		return errors.NewConfigError("failed to load certificate and key", err)
+	}
+
+	m.mu.Lock()
+	reloaded := m.cert != nil
+	m.cert, m.modTime = &cert, info.ModTime()
+	m.mu.Unlock()
+	if reloaded {
+		m.logger.Info("Certificate reloaded", map[string]interface{}{"cert_file": m.cfg.CertFile})
+	}
+	return nil
+}
+
+// ensureSelfSigned loads the self-signed certificate, generating a new one when it is missing,
+// expires soon or doesn't cover the configured hosts
+func (m *Manager) ensureSelfSigned() error {
+	names, addresses := m.selfSignedHosts()
+	hosts := append([]string(nil), names...)
+	for _, ip := range addresses {
+		hosts = append(hosts, ip.String())
+	}
+
+	cert, err := m.loadPair(selfSignedName)
+	if err != nil || !m.fresh(cert, hosts) {
+		if cert, err = m.generateSelfSigned(names, addresses); err != nil {
+			return err
+		}
+		m.logger.Info("Generated self-signed certificate", map[string]interface{}{
+			"hosts": hosts, "expires": cert.Leaf.NotAfter.Format(time.RFC3339),
+		})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.issued {
+		m.cert = cert
+	}
+	return nil
+}
+
+// selfSignedHosts returns the names and addresses of a self-signed certificate: localhost, this
+// host's name and the configured hosts
+func (m *Manager) selfSignedHosts() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	addresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	for _, host := range append(m.cfg.Hosts, m.cfg.Domains...) {
+		if ip := net.ParseIP(host); ip != nil {
+			addresses = append(addresses, ip)
+		} else {
+			names = append(names, host)
+		}
+	}
+	return names, addresses
+}
+
+func (m *Manager) generateSelfSigned(names []string, addresses []net.IP) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to generate key", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.NewSystemError("failed to generate serial number", err)
+	}
+
+	now := m.now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1], Organization: []string{"Home Automation"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true, // So it can be trusted as its own authority on clients
+		DNSNames:              names,
+		IPAddresses:           addresses,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to create certificate", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return m.savePair(selfSignedName, certPEM, key)
+}
+
+// fresh reports whether cert is valid for hosts and beyond the renewal window
+func (m *Manager) fresh(cert *tls.Certificate, hosts []string) bool {
+	if cert == nil || cert.Leaf == nil || m.now().Add(renewBefore).After(cert.Leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.Leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadPair reads a generated or issued certificate and its key from the certificate directory
+func (m *Manager) loadPair(name string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(m.certPath(name), m.keyPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// savePair writes a certificate chain and its key to the certificate directory and parses them
+func (m *Manager) savePair(name string, certPEM []byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to parse certificate", err)
+	}
+
+	if err := writeFile(m.keyPath(name), keyPEM); err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.certPath(name), certPEM); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) certPath(name string) string {
+	return filepath.Join(m.dir, name+".crt")
+}
+
+func (m *Manager) keyPath(name string) string {
+	return filepath.Join(m.dir, name+".key")
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to encode key", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFile replaces a file in the certificate directory, readable only by the owner
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.NewSystemError("failed to create certificate directory", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.NewSystemError("failed to write "+filepath.Base(path), err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.NewSystemError("failed to replace "+filepath.Base(path), err)
+	}
+	return nil
+}
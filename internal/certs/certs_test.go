@@ -0,0 +1,395 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestSelfSignedCertificateIsReused(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.TLSConfig{SelfSigned: true, Hosts: []string{"gateway.lan", "192.168.1.5"}}
+
+	first := leaf(t, newManager(t, cfg, dir))
+	for _, host := range []string{"localhost", "127.0.0.1", "gateway.lan", "192.168.1.5"} {
+		if err := first.VerifyHostname(host); err != nil {
+			t.Errorf("expected the certificate to cover %s: %v", host, err)
+		}
+	}
+
+	if again := leaf(t, newManager(t, cfg, dir)); again.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Error("expected the saved certificate to be reused")
+	}
+
+	cfg.Hosts = append(cfg.Hosts, "ha.example.com")
+	renewed := leaf(t, newManager(t, cfg, dir))
+	if renewed.SerialNumber.Cmp(first.SerialNumber) == 0 || renewed.VerifyHostname("ha.example.com") != nil {
+		t.Error("expected a new certificate covering the added host")
+	}
+}
+
+func TestCertificateFilesAreReloaded(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writePair(t, certFile, keyFile, "first.example.com")
+
+	manager := newManager(t, config.TLSConfig{CertFile: certFile, KeyFile: keyFile}, dir)
+	if leaf(t, manager).Subject.CommonName != "first.example.com" {
+		t.Fatal("expected the configured certificate")
+	}
+
+	writePair(t, certFile, keyFile, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	manager.refresh(context.Background())
+	if name := leaf(t, manager).Subject.CommonName; name != "second.example.com" {
+		t.Errorf("expected the replaced certificate after a refresh, got %s", name)
+	}
+
+	if _, err := NewManager(config.TLSConfig{CertFile: certFile}, dir, nil); err == nil {
+		t.Error("expected a certificate without a key to be rejected")
+	}
+}
+
+func TestHTTPHandlerRedirectsToHTTPS(t *testing.T) {
+	manager := newManager(t, config.TLSConfig{SelfSigned: true}, t.TempDir())
+	handler := manager.HTTPHandler("8443")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://gateway.lan/api/rooms?x=1", nil))
+	if location := recorder.Header().Get("Location"); location != "https://gateway.lan:8443/api/rooms?x=1" {
+		t.Errorf("expected a redirect to HTTPS, got %d %s", recorder.Code, location)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown challenge to be not found, got %d", recorder.Code)
+	}
+}
+
+func TestACMEIssuesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newFakeCA(t)
+
+	cfg := config.TLSConfig{Domains: []string{"home.example.com"}, Email: "admin@example.com", Directory: ca.URL + "/directory"}
+	manager := newManager(t, cfg, dir)
+	manager.acme.pollInterval = time.Millisecond
+	ca.challenges = manager.HTTPHandler("443")
+
+	if !leaf(t, manager).IsCA {
+		t.Fatal("expected a self-signed certificate until one is issued")
+	}
+
+	if wait := manager.refresh(context.Background()); wait != checkEvery {
+		t.Fatalf("expected the certificate to be issued, next check in %s", wait)
+	}
+	issued := leaf(t, manager)
+	if issued.Issuer.CommonName != "Fake CA" || issued.VerifyHostname("home.example.com") != nil {
+		t.Fatalf("expected a certificate from the CA for the domain, got %s %v", issued.Issuer.CommonName, issued.DNSNames)
+	}
+	if ca.contact != "mailto:admin@example.com" || ca.badNonces != 1 {
+		t.Errorf("expected the account contact and a retried nonce, got %q and %d", ca.contact, ca.badNonces)
+	}
+
+	// A restart serves the saved certificate without a new order
+	ca.orders = 0
+	restarted := newManager(t, cfg, dir)
+	if restarted.refresh(context.Background()); ca.orders != 0 || leaf(t, restarted).SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Error("expected the issued certificate to be reused after a restart")
+	}
+}
+
+func TestACMEFailureKeepsSelfSignedAndBacksOff(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.failChallenge = true
+
+	manager := newManager(t, config.TLSConfig{Domains: []string{"home.example.com"}, Directory: ca.URL + "/directory"}, t.TempDir())
+	manager.acme.pollInterval = time.Millisecond
+	ca.challenges = manager.HTTPHandler("443")
+
+	if wait := manager.refresh(context.Background()); wait != retryAfter {
+		t.Errorf("expected a retry after %s, got %s", retryAfter, wait)
+	}
+	if wait := manager.refresh(context.Background()); wait != 2*retryAfter {
+		t.Errorf("expected the retry to back off to %s, got %s", 2*retryAfter, wait)
+	}
+	if !leaf(t, manager).IsCA {
+		t.Error("expected the self-signed certificate to stay")
+	}
+}
+
+func newManager(t *testing.T, cfg config.TLSConfig, stateDir string) *Manager {
+	t.Helper()
+	manager, err := NewManager(cfg, stateDir, nil)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	return manager
+}
+
+func leaf(t *testing.T, manager *Manager) *x509.Certificate {
+	t.Helper()
+	cert, err := manager.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("no certificate: %v", err)
+	}
+	return cert.Leaf
+}
+
+func writePair(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, _ := encodeKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// fakeCA is an ACME server that checks the signatures and nonces of requests, validates the
+// HTTP-01 challenge against the manager's handler and signs the CSR with its own key
+type fakeCA struct {
+	*httptest.Server
+	t             *testing.T
+	challenges    http.Handler
+	failChallenge bool
+
+	mu         sync.Mutex
+	key        *ecdsa.PublicKey
+	thumbprint string
+	nonces     map[string]bool
+	nextNonce  int
+	authzValid bool
+	authzState string
+	orderValid bool
+	certPEM    []byte
+	contact    string
+	orders     int
+	badNonces  int
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+}
+
+const fakeToken = "token-1"
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{t: t, nonces: make(map[string]bool), authzState: "pending"}
+	ca.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.caCert = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca.Server = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nextNonce++
+	nonce := fmt.Sprintf("nonce-%d", ca.nextNonce)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce": ca.URL + "/nonce", "newAccount": ca.URL + "/account", "newOrder": ca.URL + "/order",
+		})
+		return
+	case "/nonce":
+		return
+	}
+
+	payload, problem := ca.verify(r)
+	if problem != "" {
+		if strings.HasPrefix(problem, "badNonce") {
+			ca.badNonces++
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"type": badNonce, "detail": problem})
+			return
+		}
+		ca.t.Errorf("%s: %s", r.URL.Path, problem)
+		http.Error(w, problem, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		var account struct {
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &account)
+		if len(account.Contact) > 0 {
+			ca.contact = account.Contact[0]
+		}
+		w.Header().Set("Location", ca.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		ca.orders++
+		ca.authzValid, ca.authzState, ca.orderValid = false, "pending", false
+		w.Header().Set("Location", ca.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w)
+	case "/order/1":
+		ca.writeOrder(w)
+	case "/authz/1":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     ca.authzState,
+			"identifier": map[string]string{"type": "dns", "value": "home.example.com"},
+			"challenges": []map[string]interface{}{
+				{"type": "dns-01", "url": ca.URL + "/challenge/dns", "token": "other"},
+				{"type": "http-01", "url": ca.URL + "/challenge/1", "token": fakeToken, "error": map[string]string{"detail": "wrong answer"}},
+			},
+		})
+	case "/challenge/1":
+		recorder := httptest.NewRecorder()
+		ca.challenges.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://home.example.com/.well-known/acme-challenge/"+fakeToken, nil))
+		if recorder.Body.String() == fakeToken+"."+ca.thumbprint && !ca.failChallenge {
+			ca.authzValid, ca.authzState = true, "valid"
+		} else {
+			ca.authzState = "invalid"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"type": "http-01", "status": "processing"})
+	case "/finalize/1":
+		var finalize struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &finalize)
+		ca.sign(finalize.CSR)
+		ca.writeOrder(w)
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeCA) writeOrder(w io.Writer) {
+	order := map[string]interface{}{
+		"status":         "pending",
+		"authorizations": []string{ca.URL + "/authz/1"},
+		"finalize":       ca.URL + "/finalize/1",
+	}
+	switch {
+	case ca.orderValid:
+		order["status"], order["certificate"] = "valid", ca.URL+"/cert/1"
+	case ca.certPEM != nil && ca.authzValid:
+		order["status"], ca.orderValid = "processing", true // Valid on the next poll
+	case ca.authzValid:
+		order["status"] = "ready"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// verify checks the JWS of a request and returns its payload. The first nonce is rejected once.
+func (ca *fakeCA) verify(r *http.Request) ([]byte, string) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "invalid JWS"
+	}
+	decode := func(s string) []byte { data, _ := base64.RawURLEncoding.DecodeString(s); return data }
+
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *acmeJWK
+	}
+	json.Unmarshal(decode(jws.Protected), &header)
+	if header.Alg != "ES256" || header.URL != ca.URL+r.URL.Path {
+		return nil, fmt.Sprintf("unexpected header %+v", header)
+	}
+	if !ca.nonces[header.Nonce] {
+		return nil, "unknown nonce " + header.Nonce
+	}
+	delete(ca.nonces, header.Nonce)
+	if r.URL.Path == "/account" && ca.badNonces == 0 {
+		return nil, "badNonce: rejected once"
+	}
+
+	if header.JWK != nil {
+		ca.key = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(header.JWK.X)),
+			Y:     new(big.Int).SetBytes(decode(header.JWK.Y)),
+		}
+		data, _ := json.Marshal(header.JWK)
+		digest := sha256.Sum256(data)
+		ca.thumbprint = base64.RawURLEncoding.EncodeToString(digest[:])
+	} else if header.Kid != ca.URL+"/account/1" || ca.key == nil {
+		return nil, "unknown account " + header.Kid
+	}
+
+	signature := decode(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(ca.key, digest[:],
+		new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, "bad signature"
+	}
+	return decode(jws.Payload), ""
+}
+
+func (ca *fakeCA) sign(encoded string) {
+	der, _ := base64.RawURLEncoding.DecodeString(encoded)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || csr.CheckSignature() != nil {
+		ca.t.Errorf("invalid CSR: %v", err)
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		ca.t.Errorf("failed to sign: %v", err)
+		return
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, ca.caCert, ca.caCert, &ca.caKey.PublicKey, ca.caKey)
+	ca.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+}
@@ -1,14 +1,210 @@
 package config
 
 import (
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/secrets"
 )
 
 type Config struct {
-	Port     string
-	Database string
-	MQTT     MQTTConfig
-	Kafka    KafkaConfig
+	Port        string
+	Database    string
+	StateDir    string
+	ObserveOnly bool
+	// ReadReplica serves the dashboard and API from the MQTT stream without controlling anything
+	ReadReplica bool
+	AdminToken  string
+	APIAuth     bool // Require a token for API reads too
+	DebugAddr   string
+	GRPCAddr    string // gRPC API of the unified service, disabled when empty
+	// ShutdownTimeout bounds the ordered shutdown of all services; each gets at most 10 seconds of it
+	ShutdownTimeout time.Duration
+	// LogLevel sets the log levels, e.g. "info,mqtt=debug"; everything is logged when empty
+	LogLevel string
+	// Locale is the language of notifications, reports and dashboard labels: en, es, de or fr
+	Locale string
+	// MessagesFile adds to or overrides the built-in translations, by locale and message key
+	MessagesFile string
+	TariffFile   string
+	// ExteriorLightingFile configures the sunset-relative exterior lighting controller
+	ExteriorLightingFile string
+	// CalendarFile configures the holiday calendar used by schedules and exterior lighting
+	CalendarFile string
+	// MQTTDevicesFile lists Tasmota and ESPHome devices to adapt
+	MQTTDevicesFile string
+	// TapoBulbsFile lists the Tapo L530/L900 bulbs controlled as lights
+	TapoBulbsFile string
+	// FollowMeFile configures the room adjacency graph for follow-me lighting
+	FollowMeFile string
+	// MatterURL is the WebSocket URL of the Matter controller, e.g. ws://localhost:5580/ws
+	MatterURL string
+	// PowerRestoreFile configures power-loss detection and the restoration routine
+	PowerRestoreFile string
+	// UPSFile configures the NUT UPS the gateway runs on and the loads shed on battery
+	UPSFile string
+	// VoiceFile configures the Google Assistant and Alexa webhooks and their account-linking tokens
+	VoiceFile string
+	// TopicMigrationsFile lists legacy topics to republish besides the built-in ones
+	TopicMigrationsFile string
+	// AlertsFile lists the alert rules evaluated against the room sensors and devices
+	AlertsFile string
+	// WebhooksFile lists the inbound webhooks that run actions and the outbound webhooks called
+	WebhooksFile string
+	// ScriptsFile lists the scripted automations: conditions and scripts run when they change
+	ScriptsFile string
+	// GatewaySensorsFile lists the DS18B20, SHT3x and BME280 sensors wired to the gateway itself
+	GatewaySensorsFile string
+	// BLESensorsFile lists the Bluetooth LE thermometers the gateway listens for
+	BLESensorsFile string
+	// OTAFile says where the Pico firmware releases are and how Picos download them
+	OTAFile string
+	// PluginDir holds a directory per plugin, each with a plugin.json manifest; empty runs none
+	PluginDir string
+	// FailoverFile runs this gateway as one of a hot standby pair; empty runs it alone
+	FailoverFile string
+	// HVACEquipmentFile describes multi-stage and heat-pump systems per thermostat
+	HVACEquipmentFile string
+	// HVACZonesFile lists HVAC systems shared by several thermostats, with their zone dampers
+	HVACZonesFile string
+	// ThermostatControlFile switches thermostats to PID control of their heat calls
+	ThermostatControlFile string
+	// WeatherFile locates the house for the forecast used by the thermostats
+	WeatherFile string
+	// HumidityFile sets humidity setpoints and the dehumidifiers and humidifiers keeping them
+	HumidityFile string
+	// CondensationFile guards cooling against condensation and rising humidity in humid homes
+	CondensationFile string
+	// WarrantyReminderDays is how many days before a device's warranty ends to remind; 0 never reminds
+	WarrantyReminderDays int
+	// LightingLoadsFile lists bulb wattages so room energy includes estimated lighting
+	LightingLoadsFile string
+	// BackupFile schedules nightly backups of the state directory and configuration files
+	BackupFile string
+	// HazardFile lists what to switch off when a leak or smoke detector triggers
+	HazardFile string
+	// PeakShavingFile sets the whole-home power budget and the loads shed to keep within it
+	PeakShavingFile string
+	// GridFile sets the solar, grid and electricity price sources, and the plug rules acting on them
+	GridFile string
+	// EVChargerFile lists the EV chargers connecting over OCPP
+	EVChargerFile string
+	// ResidentsFile lists the residents' phones that tell who is home
+	ResidentsFile string
+	// RoomClosuresFile schedules closed-off rooms and their deep setback
+	RoomClosuresFile string
+	// HomeModeFile schedules vacations, the night mode and vacation light simulation
+	HomeModeFile string
+	// DepartureFile lists the essential devices the departure check leaves on
+	DepartureFile string
+	// DigestFile schedules the plain-text home digest sent by email or Telegram
+	DigestFile string
+	// ProvisioningFile lists the rules that add discovered Tapo plugs and Pico sensors to the services
+	ProvisioningFile string
+	// MDNS advertises the gateway over mDNS/DNS-SD as _homeauto._tcp besides the custom discovery
+	MDNS bool
+	// AssetDiscovery runs discovery in the gateway to serve the network's asset inventory
+	AssetDiscovery bool
+	// AdaptiveLightingFile sets the brightness and color temperature of motion-activated lights by time of day
+	AdaptiveLightingFile string
+	// LightAutoOff sets how long rooms stay empty before motion-lit lights go off, e.g. "10m,bathroom=3m"
+	LightAutoOff []string
+	// CapabilityFallback degrades commands a device can't perform, e.g. turn_on instead of set_brightness
+	CapabilityFallback bool
+	Log                LogConfig
+	Tracing            TracingConfig
+	Limits             LimitsConfig
+	Commands           CommandQueueConfig
+	TimeSeries         TimeSeriesConfig
+	TLS                TLSConfig
+	MQTT               MQTTConfig
+	Kafka              KafkaConfig
+}
+
+// Files returns the configuration files that are set, for backups. New file settings belong here.
+func (c *Config) Files() []string {
+	var files []string
+	for _, file := range []string{
+		c.TariffFile, c.ExteriorLightingFile, c.CalendarFile, c.MQTTDevicesFile, c.TapoBulbsFile, c.FollowMeFile,
+		c.PowerRestoreFile, c.UPSFile, c.VoiceFile, c.TopicMigrationsFile, c.AlertsFile, c.WebhooksFile, c.ScriptsFile,
+		c.GatewaySensorsFile, c.BLESensorsFile, c.OTAFile, c.FailoverFile, c.HVACEquipmentFile, c.HVACZonesFile, c.ThermostatControlFile,
+		c.WeatherFile, c.HumidityFile, c.CondensationFile, c.LightingLoadsFile, c.BackupFile, c.HazardFile,
+		c.ResidentsFile, c.RoomClosuresFile, c.HomeModeFile, c.DepartureFile, c.MessagesFile, c.DigestFile,
+		c.ProvisioningFile, c.AdaptiveLightingFile, c.PeakShavingFile, c.GridFile, c.EVChargerFile, c.MQTT.KeyFile, c.TLS.CertFile, c.TLS.KeyFile,
+	} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// LogConfig sets how and where log entries are written
+type LogConfig struct {
+	Format string // json (one object per line), text, or empty for JSON after a [service] prefix
+	// File is written instead of stdout when set, rotated when it reaches MaxSizeMB and, when
+	// RotateHours is set, every RotateHours. MaxBackups rotated files are kept.
+	File        string
+	MaxSizeMB   int
+	RotateHours int
+	MaxBackups  int
+}
+
+// TracingConfig sets where trace spans are exported. Tracing is off without an endpoint.
+type TracingConfig struct {
+	Endpoint    string  // OTLP/HTTP collector, e.g. http://collector:4318; spans go to <endpoint>/v1/traces
+	SampleRatio float64 // Share of traces recorded, from 0 to 1
+}
+
+// LimitsConfig caps what a single service tracks so a runaway integration can't exhaust the gateway.
+// A limit of 0 means unlimited.
+type LimitsConfig struct {
+	MaxRooms int
+	MaxRules int
+}
+
+// CommandQueueConfig sets how device commands that fail are retried, and for how long they are
+// buffered for a device that is offline
+type CommandQueueConfig struct {
+	Enabled    bool
+	MaxDelay   time.Duration // Cap of the exponential backoff between attempts
+	Expiry     time.Duration // Commands not delivered by then are dropped
+	MaxPending int           // Commands buffered per device; the oldest are dropped beyond it
+}
+
+// TLSConfig serves the API over HTTPS. A certificate and key file take precedence, then
+// certificates from an ACME CA such as Let's Encrypt for Domains, then a self-signed certificate.
+// Without any of them the API is served over plain HTTP.
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool
+	// Hosts are the names and addresses a self-signed certificate is valid for, besides localhost
+	Hosts []string
+	// Domains are issued a certificate by ACME HTTP-01 challenges, answered on HTTPAddr
+	Domains   []string
+	Email     string
+	Directory string // ACME directory URL, Let's Encrypt by default
+	// HTTPAddr answers the challenges and redirects plain HTTP to HTTPS; empty serves no HTTP
+	HTTPAddr string
+}
+
+// Enabled reports whether the API is served over HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned || len(t.Domains) > 0
+}
+
+// TimeSeriesConfig selects where energy and sensor readings are stored
+type TimeSeriesConfig struct {
+	Backend      string // prometheus or influxdb
+	InfluxURL    string
+	InfluxToken  string
+	InfluxOrg    string
+	InfluxBucket string
 }
 
 type MQTTConfig struct {
@@ -16,6 +212,38 @@ type MQTTConfig struct {
 	Port     string
 	Username string
 	Password string
+	KeyFile  string // Per-topic payload encryption keys; payloads are sent in the clear when unset
+
+	// Brokers lists host:port failover brokers in order of preference; Broker and Port are used when empty
+	Brokers []string
+	// FailbackInterval is how often a client on a secondary broker retries the primary
+	FailbackInterval time.Duration
+	// StateMaxAge stops cached messages older than this from being replayed (0 = any age)
+	StateMaxAge time.Duration
+	// ProtocolVersion is 4 for MQTT 3.1.1 or 5 for MQTT v5 (shared subscriptions, expiry, user properties)
+	ProtocolVersion byte
+	// TopicPrefix namespaces every topic on the broker, e.g. "home1/" for home1/room-temp/kitchen
+	TopicPrefix string
+}
+
+// BrokerAddresses returns the brokers to connect to in order of preference
+func (c *MQTTConfig) BrokerAddresses() []string {
+	if len(c.Brokers) > 0 {
+		return c.Brokers
+	}
+	if c.Broker == "" {
+		return nil
+	}
+	return []string{net.JoinHostPort(c.Broker, c.Port)}
+}
+
+// ForIntegration returns the MQTT config for one integration, e.g. "tapo" or "sensors".
+// MQTT_BROKERS_<INTEGRATION> gives the integration its own brokers; otherwise the shared ones are used.
+func (c MQTTConfig) ForIntegration(name string) *MQTTConfig {
+	if brokers := getEnvList("MQTT_BROKERS_"+strings.ToUpper(name), nil); len(brokers) > 0 {
+		c.Brokers = brokers
+	}
+	return &c
 }
 
 type KafkaConfig struct {
@@ -28,13 +256,112 @@ type KafkaConfig struct {
 
 func Load() *Config {
 	return &Config{
-		Port:     getEnv("PORT", "8080"),
-		Database: getEnv("DATABASE_URL", ""),
+		Port:                  getEnv("PORT", "8080"),
+		Database:              getEnv("DATABASE_URL", ""),
+		StateDir:              getEnv("HA_STATE_DIR", "/var/lib/home-automation"),
+		ObserveOnly:           getEnvBool("HA_OBSERVE_ONLY", false),
+		ReadReplica:           getEnvBool("HA_READ_REPLICA", false),
+		AdminToken:            getEnv("HA_ADMIN_TOKEN", ""),
+		APIAuth:               getEnvBool("HA_API_AUTH", false),
+		DebugAddr:             getEnv("HA_DEBUG_ADDR", ""),
+		GRPCAddr:              getEnv("HA_GRPC_ADDR", ""),
+		LogLevel:              getEnv("HA_LOG_LEVEL", ""),
+		Locale:                getEnv("HA_LOCALE", "en"),
+		MessagesFile:          getEnv("HA_MESSAGES_FILE", ""),
+		TariffFile:            getEnv("HA_TARIFF_FILE", ""),
+		ExteriorLightingFile:  getEnv("HA_EXTERIOR_LIGHTING_FILE", ""),
+		CalendarFile:          getEnv("HA_CALENDAR_FILE", ""),
+		MQTTDevicesFile:       getEnv("HA_MQTT_DEVICES_FILE", ""),
+		TapoBulbsFile:         getEnv("HA_TAPO_BULBS_FILE", ""),
+		FollowMeFile:          getEnv("HA_FOLLOW_ME_FILE", ""),
+		MatterURL:             getEnv("HA_MATTER_URL", ""),
+		PowerRestoreFile:      getEnv("HA_POWER_RESTORE_FILE", ""),
+		UPSFile:               getEnv("HA_UPS_FILE", ""),
+		VoiceFile:             getEnv("HA_VOICE_FILE", ""),
+		TopicMigrationsFile:   getEnv("HA_TOPIC_MIGRATIONS_FILE", ""),
+		AlertsFile:            getEnv("HA_ALERTS_FILE", ""),
+		WebhooksFile:          getEnv("HA_WEBHOOKS_FILE", ""),
+		ScriptsFile:           getEnv("HA_SCRIPTS_FILE", ""),
+		GatewaySensorsFile:    getEnv("HA_GATEWAY_SENSORS_FILE", ""),
+		BLESensorsFile:        getEnv("HA_BLE_SENSORS_FILE", ""),
+		OTAFile:               getEnv("HA_OTA_FILE", ""),
+		PluginDir:             getEnv("HA_PLUGIN_DIR", ""),
+		FailoverFile:          getEnv("HA_FAILOVER_FILE", ""),
+		HVACEquipmentFile:     getEnv("HA_HVAC_EQUIPMENT_FILE", ""),
+		HVACZonesFile:         getEnv("HA_HVAC_ZONES_FILE", ""),
+		ThermostatControlFile: getEnv("HA_THERMOSTAT_CONTROL_FILE", ""),
+		WeatherFile:           getEnv("HA_WEATHER_FILE", ""),
+		HumidityFile:          getEnv("HA_HUMIDITY_FILE", ""),
+		CondensationFile:      getEnv("HA_CONDENSATION_FILE", ""),
+		LightingLoadsFile:     getEnv("HA_LIGHTING_LOADS_FILE", ""),
+		BackupFile:            getEnv("HA_BACKUP_FILE", ""),
+		HazardFile:            getEnv("HA_HAZARD_FILE", ""),
+		PeakShavingFile:       getEnv("HA_PEAK_SHAVING_FILE", ""),
+		GridFile:              getEnv("HA_GRID_FILE", ""),
+		EVChargerFile:         getEnv("HA_EV_CHARGER_FILE", ""),
+		ResidentsFile:         getEnv("HA_RESIDENTS_FILE", ""),
+		RoomClosuresFile:      getEnv("HA_ROOM_CLOSURES_FILE", ""),
+		HomeModeFile:          getEnv("HA_HOME_MODE_FILE", ""),
+		DepartureFile:         getEnv("HA_DEPARTURE_FILE", ""),
+		DigestFile:            getEnv("HA_DIGEST_FILE", ""),
+		ProvisioningFile:      getEnv("HA_PROVISIONING_FILE", ""),
+		WarrantyReminderDays:  getEnvInt("HA_WARRANTY_REMINDER_DAYS", 30),
+		MDNS:                  getEnvBool("HA_MDNS", false),
+		AssetDiscovery:        getEnvBool("HA_ASSET_DISCOVERY", false),
+		CapabilityFallback:    getEnvBool("HA_CAPABILITY_FALLBACK", false),
+		LightAutoOff:          getEnvList("HA_LIGHT_AUTO_OFF", nil),
+		AdaptiveLightingFile:  getEnv("HA_ADAPTIVE_LIGHTING_FILE", ""),
+		ShutdownTimeout:       getEnvDuration("HA_SHUTDOWN_TIMEOUT", 30*time.Second),
+		Log: LogConfig{
+			Format:      getEnv("HA_LOG_FORMAT", ""),
+			File:        getEnv("HA_LOG_FILE", ""),
+			MaxSizeMB:   getEnvInt("HA_LOG_MAX_SIZE_MB", 10),
+			RotateHours: getEnvInt("HA_LOG_ROTATE_HOURS", 0),
+			MaxBackups:  getEnvInt("HA_LOG_MAX_BACKUPS", 5),
+		},
+		Tracing: TracingConfig{
+			Endpoint:    getEnv("HA_OTLP_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+			SampleRatio: getEnvFloat("HA_TRACE_SAMPLE_RATIO", 1),
+		},
+		Limits: LimitsConfig{
+			MaxRooms: getEnvInt("HA_MAX_ROOMS", 100),
+			MaxRules: getEnvInt("HA_MAX_RULES", 500),
+		},
+		Commands: CommandQueueConfig{
+			Enabled:    getEnvBool("HA_COMMAND_QUEUE", true),
+			MaxDelay:   getEnvDuration("HA_COMMAND_RETRY_MAX_DELAY", time.Minute),
+			Expiry:     getEnvDuration("HA_COMMAND_EXPIRY", 10*time.Minute),
+			MaxPending: getEnvInt("HA_COMMAND_MAX_PENDING", 20),
+		},
+		TLS: TLSConfig{
+			CertFile:   getEnv("HA_TLS_CERT", ""),
+			KeyFile:    getEnv("HA_TLS_KEY", ""),
+			SelfSigned: getEnvBool("HA_TLS_SELF_SIGNED", false),
+			Hosts:      getEnvList("HA_TLS_HOSTS", nil),
+			Domains:    getEnvList("HA_ACME_DOMAINS", nil),
+			Email:      getEnv("HA_ACME_EMAIL", ""),
+			Directory:  getEnv("HA_ACME_DIRECTORY", "https://acme-v02.api.letsencrypt.org/directory"),
+			HTTPAddr:   getEnv("HA_TLS_HTTP_ADDR", ""),
+		},
+		TimeSeries: TimeSeriesConfig{
+			Backend:      getEnv("HA_TIMESERIES_BACKEND", "prometheus"),
+			InfluxURL:    getEnv("INFLUXDB_URL", "http://localhost:8086"),
+			InfluxToken:  getEnvSecret("INFLUXDB_TOKEN"),
+			InfluxOrg:    getEnv("INFLUXDB_ORG", ""),
+			InfluxBucket: getEnv("INFLUXDB_BUCKET", "home-automation"),
+		},
 		MQTT: MQTTConfig{
 			Broker:   getEnv("MQTT_BROKER", "localhost"),
 			Port:     getEnv("MQTT_PORT", "1883"),
-			Username: getEnv("MQTT_USERNAME", ""),
-			Password: getEnv("MQTT_PASSWORD", ""),
+			Username: getEnvSecret("MQTT_USERNAME"),
+			Password: getEnvSecret("MQTT_PASSWORD"),
+			KeyFile:  getEnv("MQTT_KEY_FILE", ""),
+
+			Brokers:          getEnvList("MQTT_BROKERS", nil),
+			FailbackInterval: getEnvDuration("MQTT_FAILBACK_INTERVAL", time.Minute),
+			StateMaxAge:      getEnvDuration("MQTT_STATE_MAX_AGE", time.Hour),
+			ProtocolVersion:  byte(getEnvInt("MQTT_PROTOCOL_VERSION", 4)),
+			TopicPrefix:      getEnv("MQTT_TOPIC_PREFIX", ""),
 		},
 		Kafka: KafkaConfig{
 			Brokers:   []string{getEnv("KAFKA_BROKERS", "localhost:9092")},
@@ -52,3 +379,59 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvSecret reads a credential, which may reference a secret such as secret:mqtt_password.
+// A reference that can't be resolved is logged and leaves the credential empty.
+func getEnvSecret(key string) string {
+	value, err := secrets.Resolve(os.Getenv(key))
+	if err != nil {
+		log.Printf("Failed to resolve %s: %v", key, err)
+		return ""
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value >= 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
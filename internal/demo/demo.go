@@ -0,0 +1,153 @@
+// Package demo bundles a simulated test house with the gateway, so the API, automations and
+// alerts can be explored without any hardware or MQTT broker. The profile's configuration files
+// are written to a scratch state directory and the simulator plays the house's sensors and
+// Tasmota devices over a loopback MQTT client.
+package demo
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+//go:embed profile/*.json
+var profile embed.FS
+
+// DefaultDebugAddr serves the demo's API when no debug address is configured
+const DefaultDebugAddr = "localhost:6060"
+
+// DefaultAdminToken authorizes the demo's mutating endpoints when no admin token is configured
+const DefaultAdminToken = "demo"
+
+// profileSettings maps the profile's configuration files to the settings that load them
+var profileSettings = map[string]string{
+	"mqtt_devices.json": "HA_MQTT_DEVICES_FILE",
+	"follow_me.json":    "HA_FOLLOW_ME_FILE",
+	"alerts.json":       "HA_ALERTS_FILE",
+}
+
+// House is the simulated house: its rooms, their climate and the devices in them
+type House struct {
+	IntervalSeconds int `json:"interval_seconds"` // Sensor readings and telemetry are sent this often
+	// A simulated day passes in this many minutes, so the daily temperature and daylight cycles
+	// can be watched
+	DayMinutes  int      `json:"day_minutes"`
+	MoveSeconds int      `json:"move_seconds"` // The resident moves to a neighbouring room this often
+	Bedroom     string   `json:"bedroom"`      // Where the resident sleeps at night
+	Rooms       []Room   `json:"rooms"`
+	Devices     []Device `json:"devices"`
+}
+
+// Room is a simulated room with a Pico sensor. Temperatures are in °F.
+type Room struct {
+	ID          string   `json:"id"`
+	Temperature float64  `json:"temperature"` // Daily mean
+	Swing       float64  `json:"swing"`       // Above the mean mid-afternoon, below it before dawn
+	Humidity    float64  `json:"humidity"`
+	Adjacent    []string `json:"adjacent"`
+}
+
+// Device is a simulated Tasmota relay with power monitoring
+type Device struct {
+	Topic  string  `json:"topic"`
+	Room   string  `json:"room,omitempty"` // Set for a light, which brightens the room while on
+	PowerW float64 `json:"power_w"`        // Drawn while on
+	On     bool    `json:"on"`             // At start
+}
+
+// Validate checks the rooms' neighbours exist
+func (h *House) Validate() error {
+	if h.IntervalSeconds <= 0 || h.DayMinutes <= 0 || h.MoveSeconds <= 0 {
+		return errors.NewValidationError("interval_seconds, day_minutes and move_seconds must be positive", nil)
+	}
+	rooms := make(map[string]bool)
+	for _, room := range h.Rooms {
+		rooms[room.ID] = true
+	}
+	for _, room := range h.Rooms {
+		for _, adjacent := range room.Adjacent {
+			if !rooms[adjacent] {
+				return errors.NewValidationError(fmt.Sprintf("room %s is next to unknown room %s", room.ID, adjacent), nil)
+			}
+		}
+	}
+	if !rooms[h.Bedroom] {
+		return errors.NewValidationError(fmt.Sprintf("unknown bedroom %q", h.Bedroom), nil)
+	}
+	return nil
+}
+
+// LoadHouse returns the bundled house
+func LoadHouse() (*House, error) {
+	data, err := profile.ReadFile("profile/house.json")
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read the demo house", err)
+	}
+	var house House
+	if err := json.Unmarshal(data, &house); err != nil {
+		return nil, errors.NewConfigError("failed to parse the demo house", err)
+	}
+	if err := house.Validate(); err != nil {
+		return nil, err
+	}
+	return &house, nil
+}
+
+// Setup writes the profile's configuration files under stateDir, a new temporary directory when
+// empty, and points the settings at them. Other configuration files are unset, so nothing
+// outside the directory is read or changed; the log file is kept. The debug address and admin token keep their values
+// when set. It returns the state directory.
+func Setup(stateDir string) (string, error) {
+	if stateDir == "" {
+		dir, err := os.MkdirTemp("", "home-automation-demo-")
+		if err != nil {
+			return "", errors.NewSystemError("failed to create the demo state directory", err)
+		}
+		stateDir = dir
+	} else if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", errors.NewSystemError("failed to create the demo state directory", err)
+	}
+
+	// Configuration files are kept apart from the state files, some of which share their names
+	configDir := filepath.Join(stateDir, "config")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return "", errors.NewSystemError("failed to create the demo configuration directory", err)
+	}
+
+	settings := map[string]string{"HA_STATE_DIR": stateDir}
+	for name, setting := range profileSettings {
+		data, err := profile.ReadFile("profile/" + name)
+		if err != nil {
+			return "", errors.NewConfigError("failed to read demo profile "+name, err)
+		}
+		path := filepath.Join(configDir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return "", errors.NewSystemError("failed to write demo profile "+name, err)
+		}
+		settings[setting] = path
+	}
+	if os.Getenv("HA_DEBUG_ADDR") == "" {
+		settings["HA_DEBUG_ADDR"] = DefaultDebugAddr
+	}
+	if os.Getenv("HA_ADMIN_TOKEN") == "" {
+		settings["HA_ADMIN_TOKEN"] = DefaultAdminToken
+	}
+
+	for _, entry := range os.Environ() {
+		setting, _, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(setting, "HA_") && strings.HasSuffix(setting, "_FILE") && setting != "HA_LOG_FILE" {
+			os.Unsetenv(setting)
+		}
+	}
+	for setting, value := range settings {
+		if err := os.Setenv(setting, value); err != nil {
+			return "", errors.NewSystemError("failed to set "+setting, err)
+		}
+	}
+	return stateDir, nil
+}
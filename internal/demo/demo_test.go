@@ -0,0 +1,128 @@
+package demo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/tasmota"
+)
+
+func TestSetup(t *testing.T) {
+	// Setup changes the environment; t.Setenv restores it after the test
+	for _, setting := range []string{"HA_STATE_DIR", "HA_DEBUG_ADDR", "HA_ADMIN_TOKEN", "HA_MQTT_DEVICES_FILE", "HA_FOLLOW_ME_FILE", "HA_ALERTS_FILE"} {
+		t.Setenv(setting, "")
+	}
+	t.Setenv("HA_HAZARD_FILE", "/etc/home-automation/hazards.json")
+
+	stateDir, err := Setup(filepath.Join(t.TempDir(), "demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Load()
+	if cfg.StateDir != stateDir || cfg.DebugAddr != DefaultDebugAddr || cfg.AdminToken != DefaultAdminToken || cfg.HazardFile != "" {
+		t.Errorf("Expected the demo settings alone, got %+v", cfg)
+	}
+
+	// The bundled files load with the services' own loaders
+	if _, err := services.LoadMQTTDevices(cfg.MQTTDevicesFile); err != nil {
+		t.Error(err)
+	}
+	if _, err := services.LoadFollowMeConfig(cfg.FollowMeFile); err != nil {
+		t.Error(err)
+	}
+	if _, err := services.LoadAlertConfig(cfg.AlertsFile); err != nil {
+		t.Error(err)
+	}
+	if filepath.Dir(cfg.AlertsFile) == stateDir {
+		t.Error("Expected the configuration files apart from the state files")
+	}
+	if _, err := os.Stat(cfg.AlertsFile); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	house, err := LoadHouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mqtt.NewClient(&config.MQTTConfig{Brokers: []string{"localhost:1883"}}, &mqtt.ClientOptions{Loopback: true})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan string, 200)
+	record := func(topic string, payload []byte) error {
+		received <- topic + " " + string(payload)
+		return nil
+	}
+	client.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomTemperature, "+"), record)
+	client.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomMotion, "+"), record)
+	client.Subscribe(tasmota.PowerTopic("+"), record)
+
+	simulator := NewSimulator(house, client, nil)
+	if err := simulator.Start(); err != nil {
+		t.Fatal(err)
+	}
+	now := simulator.started
+	simulator.step(now, time.Minute)
+
+	// The resident gets up and walks out of the bedroom
+	messages := collect(t, received, len(house.Rooms)+2)
+	var temperature struct {
+		Temperature float64 `json:"temperature"`
+		DeviceID    string  `json:"device_id"`
+	}
+	for _, message := range messages {
+		if topic, payload, _ := strings.Cut(message, " "); topic == "room-temp/office" {
+			json.Unmarshal([]byte(payload), &temperature)
+		}
+	}
+	if temperature.DeviceID != "demo-pico-office" || temperature.Temperature < 65 || temperature.Temperature > 75 {
+		t.Errorf("Expected a morning office temperature, got %+v", temperature)
+	}
+	if !strings.Contains(strings.Join(messages, "\n"), `room-motion/bedroom {"device_id":"demo-pico-bedroom","motion":false`) {
+		t.Errorf("Expected the bedroom left, got %v", messages)
+	}
+
+	// Lights obey commands and brighten their room
+	before := simulator.Status(now).Rooms["kitchen"].LightLevel
+	client.Publish(&mqtt.Message{Topic: tasmota.CommandTopic("kitchen_light", "POWER"), Payload: []byte("ON")})
+	if got := collect(t, received, 1)[0]; got != "stat/kitchen_light/POWER ON" {
+		t.Errorf("Expected the light's new state, got %s", got)
+	}
+	if after := simulator.Status(now).Rooms["kitchen"].LightLevel; after < before+lightBoost-5 {
+		t.Errorf("Expected the kitchen lit, got %.1f%% from %.1f%%", after, before)
+	}
+
+	// A day passes in DayMinutes, starting in the morning; the resident sleeps at night
+	if status := simulator.Status(now.Add(time.Duration(house.DayMinutes) * time.Minute / 2)); status.Time != "19:00" {
+		t.Errorf("Expected 19:00 half a simulated day later, got %s", status.Time)
+	}
+	if room, _ := simulator.move(now.Add(time.Duration(house.DayMinutes)*time.Minute*17/24), 23.5); room != house.Bedroom {
+		t.Errorf("Expected the resident in bed at night, got %s", room)
+	}
+}
+
+// collect waits for n messages
+func collect(t *testing.T, received chan string, n int) []string {
+	t.Helper()
+	var messages []string
+	for len(messages) < n {
+		select {
+		case message := <-received:
+			messages = append(messages, message)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %d messages, got %v", n, messages)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,346 @@
+package demo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/tasmota"
+)
+
+const (
+	startHour   = 7.0   // The simulated day starts in the morning
+	lightBoost  = 35.0  // Light level (%) a light adds to its room
+	mainsVolts  = 120.0 // Reported by the simulated plugs
+	wifiSignal  = -55.0 // dBm, reported by the simulated plugs
+	nightStarts = 23.0  // The resident is in bed from 23:00...
+	nightEnds   = 6.5   // ...to 06:30
+)
+
+// simulatedDevice is a Tasmota relay's state
+type simulatedDevice struct {
+	Device
+	on       bool
+	energyWh float64
+}
+
+// Simulator plays the house: the Pico sensor of every room, a resident walking between rooms,
+// and Tasmota relays that obey the gateway's commands and report their power
+type Simulator struct {
+	house    *House
+	client   *mqtt.Client
+	rooms    map[string]Room
+	devices  map[string]*simulatedDevice // By Tasmota topic
+	resident string
+	movedAt  time.Time
+	started  time.Time
+	random   *rand.Rand
+	mu       sync.Mutex
+	logger   *logger.Logger
+}
+
+// NewSimulator creates a simulator publishing on client, which loops the messages back
+func NewSimulator(house *House, client *mqtt.Client, simulatorLogger *logger.Logger) *Simulator {
+	if simulatorLogger == nil {
+		simulatorLogger = logger.NewLogger("DemoHouse", nil)
+	}
+	s := &Simulator{
+		house:    house,
+		client:   client,
+		rooms:    make(map[string]Room),
+		devices:  make(map[string]*simulatedDevice),
+		resident: house.Bedroom,
+		started:  time.Now(),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger:   simulatorLogger,
+	}
+	for _, room := range house.Rooms {
+		s.rooms[room.ID] = room
+	}
+	for _, device := range house.Devices {
+		s.devices[device.Topic] = &simulatedDevice{Device: device, on: device.On}
+	}
+	return s
+}
+
+// Start listens for device commands and brings the devices online
+func (s *Simulator) Start() error {
+	if err := s.client.Subscribe(tasmota.CommandTopic("+", "+"), s.handleCommand); err != nil {
+		return errors.NewMQTTError("failed to subscribe to demo device commands", err)
+	}
+	for _, topic := range s.deviceTopics() {
+		s.publish(tasmota.TelemetryTopic(topic, "LWT"), []byte("Online"), true)
+	}
+	return nil
+}
+
+// Run sends readings and telemetry every interval until ctx is cancelled
+func (s *Simulator) Run(ctx context.Context) {
+	interval := time.Duration(s.house.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.step(time.Now(), interval)
+	for {
+		select {
+		case <-ctx.Done():
+			for _, topic := range s.deviceTopics() {
+				s.publish(tasmota.TelemetryTopic(topic, "LWT"), []byte("Offline"), true)
+			}
+			return
+		case now := <-ticker.C:
+			s.step(now, interval)
+		}
+	}
+}
+
+// step moves the resident when it is time and sends one round of readings and telemetry
+func (s *Simulator) step(now time.Time, interval time.Duration) {
+	hour := s.hour(now)
+	if next, moved := s.move(now, hour); moved {
+		s.logger.Debug("Resident moved", map[string]interface{}{"room": next, "hour": fmt.Sprintf("%.1f", hour)})
+	}
+
+	for _, room := range s.house.Rooms {
+		reading := s.reading(room, hour)
+		for root, message := range map[string]map[string]interface{}{
+			mqtt.TopicRoomTemperature: {"temperature": reading.Temperature, "temp_unit": "F", "sensor": "SHT30"},
+			mqtt.TopicRoomHumidity:    {"humidity": reading.Humidity, "humidity_unit": "%", "sensor": "SHT30"},
+			mqtt.TopicRoomLight: {"light_level": reading.LightLevel, "light_percent": reading.LightLevel,
+				"light_state": lightState(reading.LightLevel), "sensor": "PhotoTransistor"},
+		} {
+			s.publishRoom(root, room.ID, now, message)
+		}
+	}
+
+	s.mu.Lock()
+	type telemetry struct {
+		topic         string
+		sensor, state []byte
+	}
+	var messages []telemetry
+	for _, topic := range s.deviceTopicsLocked() {
+		device := s.devices[topic]
+		power := 0.0
+		if device.on {
+			power = device.PowerW
+		}
+		device.energyWh += power * interval.Hours()
+		sensor, _ := json.Marshal(map[string]interface{}{
+			"Time": now.Format("2006-01-02T15:04:05"),
+			"ENERGY": map[string]float64{
+				"Total":   math.Round(device.energyWh) / 1000,
+				"Power":   power,
+				"Voltage": mainsVolts,
+				"Current": math.Round(power/mainsVolts*1000) / 1000,
+			},
+		})
+		state, _ := json.Marshal(map[string]interface{}{
+			"POWER":     powerState(device.on),
+			"UptimeSec": int(now.Sub(s.started).Seconds()),
+			"Wifi":      map[string]float64{"Signal": wifiSignal},
+		})
+		messages = append(messages, telemetry{topic, sensor, state})
+	}
+	s.mu.Unlock()
+
+	for _, message := range messages {
+		s.publish(tasmota.TelemetryTopic(message.topic, "SENSOR"), message.sensor, false)
+		s.publish(tasmota.TelemetryTopic(message.topic, "STATE"), message.state, false)
+	}
+}
+
+// move walks the resident to a neighbouring room every MoveSeconds, and to bed at night,
+// sending the motion of the room entered and the room left
+func (s *Simulator) move(now time.Time, hour float64) (string, bool) {
+	s.mu.Lock()
+	previous := s.resident
+	next := previous
+	if hour >= nightStarts || hour < nightEnds {
+		next = s.house.Bedroom
+	} else if now.Sub(s.movedAt) >= time.Duration(s.house.MoveSeconds)*time.Second {
+		if adjacent := s.rooms[previous].Adjacent; len(adjacent) > 0 {
+			next = adjacent[s.random.Intn(len(adjacent))]
+		}
+	}
+	if next == previous && !s.movedAt.IsZero() {
+		s.mu.Unlock()
+		return next, false
+	}
+	s.resident = next
+	s.movedAt = now
+	s.mu.Unlock()
+
+	s.publishRoom(mqtt.TopicRoomMotion, next, now, map[string]interface{}{"motion": true, "motion_start": now.Unix(), "sensor": "PIR"})
+	if previous != next {
+		s.publishRoom(mqtt.TopicRoomMotion, previous, now, map[string]interface{}{"motion": false, "sensor": "PIR"})
+	}
+	return next, true
+}
+
+// RoomReading is what a room's sensor reports. Temperatures are in °F.
+type RoomReading struct {
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+	LightLevel  float64 `json:"light_level"` // %
+}
+
+// reading returns a room's climate at a simulated hour: warmest mid-afternoon, lit by daylight
+// and by its lights
+func (s *Simulator) reading(room Room, hour float64) RoomReading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	daily := math.Sin(2 * math.Pi * (hour - 9) / 24) // Peaks at 15:00
+	daylight := math.Max(0, math.Sin(math.Pi*(hour-6)/12))
+	light := daylight*70 + s.random.Float64()*3
+	for _, device := range s.devices {
+		if device.Room == room.ID && device.on {
+			light += lightBoost
+		}
+	}
+	return RoomReading{
+		Temperature: round1(room.Temperature + room.Swing*daily + s.random.NormFloat64()*0.2),
+		Humidity:    round1(room.Humidity - 3*daily + s.random.NormFloat64()*0.5),
+		LightLevel:  round1(math.Min(light, 100)),
+	}
+}
+
+// hour returns the simulated hour of day, which runs DayMinutes to the day from the morning
+func (s *Simulator) hour(now time.Time) float64 {
+	day := time.Duration(s.house.DayMinutes) * time.Minute
+	elapsed := float64(now.Sub(s.started)) / float64(day) * 24
+	return math.Mod(startHour+elapsed, 24)
+}
+
+// handleCommand switches a simulated relay and reports its new state, as Tasmota does
+func (s *Simulator) handleCommand(topic string, payload []byte) error {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 3 {
+		return nil
+	}
+	deviceTopic, command := levels[1], strings.ToUpper(levels[2])
+
+	s.mu.Lock()
+	device, ok := s.devices[deviceTopic]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	switch command {
+	case "POWER":
+		if strings.EqualFold(strings.TrimSpace(string(payload)), "TOGGLE") {
+			device.on = !device.on
+		} else if on, valid := tasmota.ParsePower(string(payload)); valid {
+			device.on = on
+		}
+	case "DIMMER":
+		// Dimming a light to zero turns it off, anything else on
+		device.on = strings.TrimSpace(string(payload)) != "0"
+	}
+	on := device.on
+	s.mu.Unlock()
+
+	s.publish(tasmota.PowerTopic(deviceTopic), []byte(powerState(on)), false)
+	return nil
+}
+
+// publishRoom sends a Pico sensor reading
+func (s *Simulator) publishRoom(root, roomID string, now time.Time, message map[string]interface{}) {
+	message["room"] = roomID
+	message["device_id"] = "demo-pico-" + roomID
+	message["timestamp"] = now.Unix()
+	payload, _ := json.Marshal(message)
+	s.publish(mqtt.RoomTopic(root, roomID), payload, false)
+}
+
+func (s *Simulator) publish(topic string, payload []byte, retain bool) {
+	if err := s.client.Publish(&mqtt.Message{Topic: topic, Payload: payload, Retain: retain}); err != nil {
+		s.logger.Warn("Failed to publish demo message", map[string]interface{}{"topic": topic, "error": err.Error()})
+	}
+}
+
+func (s *Simulator) deviceTopics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deviceTopicsLocked()
+}
+
+func (s *Simulator) deviceTopicsLocked() []string {
+	topics := make([]string, 0, len(s.devices))
+	for topic := range s.devices {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Status is the state of the simulated house
+type Status struct {
+	Time     string                 `json:"time"` // Simulated time of day, HH:MM
+	Resident string                 `json:"resident"`
+	Rooms    map[string]RoomReading `json:"rooms"`
+	Devices  map[string]bool        `json:"devices"` // On or off, by Tasmota topic
+}
+
+// Status returns the simulated time of day, where the resident is, and what the rooms and
+// devices report
+func (s *Simulator) Status(now time.Time) Status {
+	hour := s.hour(now)
+	status := Status{
+		Time:    fmt.Sprintf("%02d:%02d", int(hour), int(math.Mod(hour, 1)*60)),
+		Rooms:   make(map[string]RoomReading),
+		Devices: make(map[string]bool),
+	}
+	for _, room := range s.house.Rooms {
+		status.Rooms[room.ID] = s.reading(room, hour)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status.Resident = s.resident
+	for topic, device := range s.devices {
+		status.Devices[topic] = device.on
+	}
+	return status
+}
+
+// Handler serves the state of the simulated house as JSON
+func (s *Simulator) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
+
+// lightState names a light level as the Pico firmware does
+func lightState(level float64) string {
+	switch {
+	case level < 20:
+		return "dark"
+	case level > 80:
+		return "bright"
+	}
+	return "normal"
+}
+
+func powerState(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func round1(value float64) float64 {
+	return math.Round(value*10) / 10
+}
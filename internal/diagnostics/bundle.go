@@ -0,0 +1,163 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/redact"
+)
+
+// Redacted replaces secrets in support bundles
+const Redacted = redact.Redacted
+
+// maxBundleFileSize caps each log and state file in a bundle; larger files keep their tail
+const maxBundleFileSize = 5 * 1024 * 1024
+
+// BundleOptions selects what goes into a support bundle
+type BundleOptions struct {
+	Reports []*Report
+	Config  *config.Config
+	LogDir  string // Optional; every regular file in it is included
+}
+
+// WriteBundle writes a gzipped tarball for support requests holding the reports, the config,
+// the state directory and the logs, all redacted. The MQTT key file is never included.
+func WriteBundle(w io.Writer, options BundleOptions) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+
+	for _, report := range options.Reports {
+		data, err := json.MarshalIndent(report.Redacted(), "", "  ")
+		if err != nil {
+			return errors.NewSystemError("failed to encode diagnostics report", err)
+		}
+		if err := addBundleFile(archive, "reports/"+report.Tool+".json", data, now); err != nil {
+			return err
+		}
+	}
+
+	if options.Config != nil {
+		data, err := json.MarshalIndent(RedactConfig(options.Config), "", "  ")
+		if err != nil {
+			return errors.NewSystemError("failed to encode config", err)
+		}
+		if err := addBundleFile(archive, "config.json", data, now); err != nil {
+			return err
+		}
+
+		exclude := map[string]bool{}
+		if options.Config.MQTT.KeyFile != "" {
+			if path, err := filepath.Abs(options.Config.MQTT.KeyFile); err == nil {
+				exclude[path] = true
+			}
+		}
+		if err := addBundleDir(archive, "state", options.Config.StateDir, exclude); err != nil {
+			return err
+		}
+	}
+
+	if options.LogDir != "" {
+		if err := addBundleDir(archive, "logs", options.LogDir, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return errors.NewSystemError("failed to write support bundle", err)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.NewSystemError("failed to write support bundle", err)
+	}
+	return nil
+}
+
+// RedactConfig returns the config as a map with passwords, tokens and URL credentials replaced
+func RedactConfig(cfg *config.Config) map[string]interface{} {
+	data, _ := json.Marshal(cfg) // A struct of plain fields always encodes
+	var values map[string]interface{}
+	json.Unmarshal(data, &values)
+	return redact.Map(values)
+}
+
+// addBundleDir adds the redacted regular files of dir under prefix, skipping excluded absolute
+// paths. A missing directory adds nothing.
+func addBundleDir(archive *tar.Writer, prefix, dir string, exclude map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError(fmt.Sprintf("failed to read %s", dir), err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+		if err != nil || exclude[path] {
+			continue
+		}
+
+		data, modTime, err := readTail(path, maxBundleFileSize)
+		if err != nil {
+			return err
+		}
+		if err := addBundleFile(archive, prefix+"/"+entry.Name(), redact.Bytes(data), modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTail reads at most limit bytes from the end of a file
+func readTail(path string, limit int64) ([]byte, time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, errors.NewSystemError(fmt.Sprintf("failed to open %s", path), err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, errors.NewSystemError(fmt.Sprintf("failed to stat %s", path), err)
+	}
+	if info.Size() > limit {
+		if _, err := file.Seek(-limit, io.SeekEnd); err != nil {
+			return nil, time.Time{}, errors.NewSystemError(fmt.Sprintf("failed to read %s", path), err)
+		}
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, time.Time{}, errors.NewSystemError(fmt.Sprintf("failed to read %s", path), err)
+	}
+	return data, info.ModTime(), nil
+}
+
+// addBundleFile adds one file to the tarball
+func addBundleFile(archive *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return errors.NewSystemError(fmt.Sprintf("failed to add %s to support bundle", name), err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return errors.NewSystemError(fmt.Sprintf("failed to add %s to support bundle", name), err)
+	}
+	return nil
+}
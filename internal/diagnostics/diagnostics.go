@@ -0,0 +1,206 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/redact"
+)
+
+// Exit codes shared by the diagnostic tools
+const (
+	ExitOK     = 0 // Every check passed (warnings allowed)
+	ExitFailed = 1 // At least one check failed
+	ExitUsage  = 2 // Missing or invalid arguments
+)
+
+// Status is the outcome of a check or a whole report
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// severity orders statuses so a report takes the worst of its checks
+var severity = map[Status]int{StatusSkip: 0, StatusPass: 1, StatusWarn: 2, StatusFail: 3}
+
+// Check is the result of one diagnostic step
+type Check struct {
+	Name       string                 `json:"name"`
+	Status     Status                 `json:"status"`
+	Message    string                 `json:"message,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	DurationMs int64                  `json:"duration_ms"`
+	Hints      []string               `json:"hints,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+// Report collects the checks of one tool run, e.g. for the commissioning wizard or health reports
+type Report struct {
+	Tool      string    `json:"tool"`
+	Target    string    `json:"target,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Status    Status    `json:"status"`
+	Checks    []*Check  `json:"checks"`
+}
+
+// NewReport starts a report for a tool and the device or subnet it examines
+func NewReport(tool, target string) *Report {
+	return &Report{
+		Tool:      tool,
+		Target:    target,
+		StartedAt: time.Now(),
+		Status:    StatusSkip,
+	}
+}
+
+// Run times fn and records it as a check that passes with the returned message, or fails with its error
+func (r *Report) Run(name string, fn func() (string, error)) *Check {
+	return r.run(name, fn, StatusFail)
+}
+
+// RunOptional is like Run, but an error only warns, e.g. for a fallback the device may not need
+func (r *Report) RunOptional(name string, fn func() (string, error)) *Check {
+	return r.run(name, fn, StatusWarn)
+}
+
+// run times fn and records the check with the given status on error
+func (r *Report) run(name string, fn func() (string, error), errorStatus Status) *Check {
+	start := time.Now()
+	message, err := fn()
+
+	check := &Check{Name: name, Status: StatusPass, Message: message}
+	if err != nil {
+		check.Status = errorStatus
+		check.Message = ""
+		check.Error = err.Error()
+	}
+	check.DurationMs = time.Since(start).Milliseconds()
+
+	r.Add(check)
+	return check
+}
+
+// Add records a check and updates the report status
+func (r *Report) Add(check *Check) {
+	r.Checks = append(r.Checks, check)
+	if severity[check.Status] > severity[r.Status] {
+		r.Status = check.Status
+	}
+}
+
+// ExitCode returns the process exit code for the report
+func (r *Report) ExitCode() int {
+	if r.Status == StatusFail {
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+// Redacted returns a copy of the report with credentials and precise locations removed from the
+// check messages, errors and data
+func (r *Report) Redacted() *Report {
+	redacted := *r
+	redacted.Checks = make([]*Check, len(r.Checks))
+	for i, check := range r.Checks {
+		copied := *check
+		copied.Message = redact.String(check.Message)
+		copied.Error = redact.String(check.Error)
+		copied.Data = redact.Map(check.Data)
+		redacted.Checks[i] = &copied
+	}
+	return &redacted
+}
+
+// Write prints the redacted report as indented JSON, or as one line per check followed by its
+// hints
+func (r *Report) Write(w io.Writer, asJSON bool) error {
+	r = r.Redacted()
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(r); err != nil {
+			return errors.NewSystemError("failed to encode diagnostics report", err)
+		}
+		return nil
+	}
+
+	for _, check := range r.Checks {
+		line := fmt.Sprintf("%s %s", statusSymbols[check.Status], check.Name)
+		if check.Message != "" {
+			line += ": " + check.Message
+		}
+		if check.Error != "" {
+			line += ": " + check.Error
+		}
+		fmt.Fprintln(w, line)
+		for _, hint := range check.Hints {
+			fmt.Fprintf(w, "   • %s\n", hint)
+		}
+	}
+	_, err := fmt.Fprintf(w, "\nResult: %s (%d checks)\n", r.Status, len(r.Checks))
+	return err
+}
+
+// statusSymbols prefix the text output of each check
+var statusSymbols = map[Status]string{
+	StatusPass: "✓",
+	StatusWarn: "⚠️",
+	StatusFail: "❌",
+	StatusSkip: "-",
+}
+
+// ProbeTCP checks that a host:port accepts TCP connections
+func ProbeTCP(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return errors.NewConnectionError("TCP connection failed", err).WithContext("address", address)
+	}
+	return conn.Close()
+}
+
+// ProbeHTTP sends a GET request and returns the response status
+func ProbeHTTP(url string, timeout time.Duration) (string, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", errors.NewConnectionError("HTTP request failed", err).WithContext("url", url)
+	}
+	resp.Body.Close()
+	return resp.Status, nil
+}
+
+// TapoHints suggests fixes for common Tapo connection error messages
+func TapoHints(message string) []string {
+	switch {
+	case strings.HasSuffix(message, "1003"):
+		return []string{
+			"Wrong credentials - verify username/password in the Tapo app",
+			"Account not linked to this device",
+			"Device firmware might not support the legacy protocol - try KLAP",
+		}
+	case strings.Contains(message, "hash verification failed"):
+		return []string{
+			"Verify your TP-Link account credentials are correct",
+			"Use your email address rather than a username",
+			"Check that the device firmware supports KLAP (1.1.0+)",
+			"Try the legacy protocol if KLAP continues to fail",
+		}
+	case strings.Contains(message, "connection refused"), strings.Contains(message, "timeout"),
+		strings.Contains(message, "no route to host"):
+		return []string{
+			"Check that the device is powered on and on the same network",
+			"Verify the IP address, e.g. with scan-tapo",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package diagnostics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportStatusAndExitCode(t *testing.T) {
+	report := NewReport("network-test", "192.168.1.50")
+	if report.ExitCode() != ExitOK {
+		t.Errorf("Expected an empty report to exit %d", ExitOK)
+	}
+
+	report.Run("TCP connectivity", func() (string, error) { return "port 80 open", nil })
+	report.RunOptional("KLAP as alternative", func() (string, error) { return "", fmt.Errorf("handshake failed") })
+	if report.Status != StatusWarn || report.ExitCode() != ExitOK {
+		t.Errorf("Expected an optional failure to only warn, got %s", report.Status)
+	}
+
+	check := report.Run("Tapo app endpoint", func() (string, error) { return "200 OK", fmt.Errorf("timeout") })
+	if check.Status != StatusFail || check.Message != "" || check.Error != "timeout" {
+		t.Errorf("Expected a failed check with the error, got %+v", check)
+	}
+	if report.Status != StatusFail || report.ExitCode() != ExitFailed {
+		t.Errorf("Expected the report to fail, got %s", report.Status)
+	}
+}
+
+func TestReportWriteJSON(t *testing.T) {
+	report := NewReport("scan-tapo", "192.168.68.0/24")
+	report.Add(&Check{Name: "192.168.68.53", Status: StatusPass, Data: map[string]interface{}{"tapo": true}})
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf, true); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, got %v: %s", err, buf.String())
+	}
+	if decoded.Tool != "scan-tapo" || decoded.Status != StatusPass || len(decoded.Checks) != 1 {
+		t.Errorf("Unexpected report: %+v", decoded)
+	}
+
+	buf.Reset()
+	report.Write(&buf, false)
+	if !strings.Contains(buf.String(), "✓ 192.168.68.53") {
+		t.Errorf("Expected a text line per check, got %q", buf.String())
+	}
+}
+
+func TestProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := ProbeTCP(strings.TrimPrefix(server.URL, "http://"), time.Second); err != nil {
+		t.Errorf("Expected TCP probe to succeed: %v", err)
+	}
+	status, err := ProbeHTTP(server.URL+"/app", time.Second)
+	if err != nil || status != "204 No Content" {
+		t.Errorf("Expected 204 No Content, got %q, %v", status, err)
+	}
+
+	server.Close()
+	if _, err := ProbeHTTP(server.URL, time.Second); err == nil {
+		t.Error("Expected HTTP probe of a closed server to fail")
+	}
+}
+
+func TestTapoHints(t *testing.T) {
+	if hints := TapoHints("tapo error code: 1003"); len(hints) == 0 {
+		t.Error("Expected hints for error 1003")
+	}
+	if hints := TapoHints("server hash verification failed"); len(hints) == 0 {
+		t.Error("Expected hints for a hash verification failure")
+	}
+	if hints := TapoHints(""); hints != nil {
+		t.Errorf("Expected no hints without an error, got %v", hints)
+	}
+}
@@ -0,0 +1,84 @@
+package diagnostics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+// CheckDiscovery sends a discovery query and lists the assets that answer within duration.
+// Assets that report themselves offline or unhealthy warn.
+func CheckDiscovery(report *Report, duration time.Duration) {
+	manager, err := discovery.NewDiscoveryManager(discovery.DiscoveryConfig{
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err == nil {
+		err = manager.Start()
+	}
+	if err != nil {
+		report.Add(&Check{
+			Name:   "Discovery protocol",
+			Status: StatusFail,
+			Error:  err.Error(),
+			Hints: []string{
+				fmt.Sprintf("Check that UDP port %d is free and multicast is allowed on this interface", discovery.DefaultMulticastPort),
+			},
+		})
+		return
+	}
+	defer manager.Stop()
+
+	query := report.Run("Discovery query", func() (string, error) {
+		return fmt.Sprintf("sent to %s:%d", discovery.DefaultMulticastAddress, discovery.DefaultMulticastPort), manager.QueryByType()
+	})
+	if query.Status != StatusPass {
+		return
+	}
+	time.Sleep(duration)
+
+	assets := make([]*discovery.AssetInfo, 0)
+	for _, asset := range manager.GetAllAssets() {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+
+	if len(assets) == 0 {
+		report.Add(&Check{
+			Name:   "Discovered assets",
+			Status: StatusWarn,
+			Error:  fmt.Sprintf("no asset answered within %s", duration),
+			Hints: []string{
+				"Check that the services are running and on the same network",
+				"Some WiFi access points drop multicast; try a wired connection",
+			},
+		})
+		return
+	}
+
+	for _, asset := range assets {
+		check := &Check{
+			Name:    asset.Name,
+			Status:  StatusPass,
+			Message: fmt.Sprintf("%s at %s (%s)", asset.Type, asset.IPAddress, asset.Status),
+			Data: map[string]interface{}{
+				"id":        asset.ID,
+				"type":      asset.Type,
+				"ip":        asset.IPAddress,
+				"room":      asset.Room,
+				"status":    asset.Status,
+				"health":    asset.Health,
+				"last_seen": asset.LastSeen,
+			},
+		}
+		if asset.Status == "offline" || asset.Status == "error" || asset.Health == "critical" {
+			check.Status = StatusWarn
+		}
+		report.Add(check)
+	}
+}
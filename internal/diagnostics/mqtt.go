@@ -0,0 +1,170 @@
+package diagnostics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// CheckMQTT checks that the configured brokers accept connections and that the payload key file loads.
+// Only one broker has to be reachable, the others are failover brokers.
+func CheckMQTT(report *Report, cfg *config.MQTTConfig) {
+	brokers := cfg.BrokerAddresses()
+	if len(brokers) == 0 {
+		report.Add(&Check{
+			Name:   "MQTT brokers",
+			Status: StatusFail,
+			Error:  "no MQTT broker configured",
+			Hints:  []string{"Set MQTT_BROKER and MQTT_PORT, or MQTT_BROKERS"},
+		})
+		return
+	}
+
+	reachable := 0
+	for _, broker := range brokers {
+		check := report.RunOptional("MQTT broker "+broker, func() (string, error) {
+			return "accepting connections", ProbeTCP(broker, 3*time.Second)
+		})
+		if check.Status == StatusPass {
+			reachable++
+		}
+	}
+	if reachable == 0 {
+		report.Add(&Check{
+			Name:   "MQTT brokers",
+			Status: StatusFail,
+			Error:  "no MQTT broker is reachable",
+			Hints: []string{
+				"Check that mosquitto is running, e.g. docker compose ps",
+				"Check that the broker port is not blocked by a firewall",
+			},
+		})
+	}
+
+	if namespace := mqtt.NewNamespace(cfg.TopicPrefix); namespace != "" {
+		report.Add(&Check{
+			Name:    "Topic namespace",
+			Status:  StatusPass,
+			Message: fmt.Sprintf("topics are prefixed with %s", namespace),
+			Hints:   []string{"Sensors must publish under the same prefix, e.g. " + namespace.Apply(mqtt.RoomTopic(mqtt.TopicRoomTemperature, "<room>"))},
+		})
+	}
+
+	if cfg.KeyFile != "" {
+		report.Run("Payload key file", func() (string, error) {
+			ring, err := mqtt.NewKeyRing(cfg.KeyFile)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d topic keys loaded", len(ring.Keys())), nil
+		})
+	}
+}
+
+// CheckServices reports the last availability each service announced, as kept in the MQTT
+// state cache of stateDir. A service whose last will was published fails.
+func CheckServices(report *Report, stateDir string) {
+	cache, ok := loadStateCache(report, stateDir)
+	if !ok {
+		return
+	}
+
+	tracker := mqtt.NewAvailabilityTracker()
+	received := make(map[string]time.Time)
+	for _, message := range cache.Matching([]string{mqtt.AvailabilityTopic("+")}, time.Now()) {
+		tracker.Handle(message.Topic, message.Payload)
+		received[message.Topic] = message.ReceivedAt
+	}
+
+	services := tracker.Services()
+	if len(services) == 0 {
+		report.Add(&Check{
+			Name:    "Service availability",
+			Status:  StatusWarn,
+			Message: "no service has announced its availability yet",
+		})
+		return
+	}
+
+	for _, availability := range services {
+		receivedAt := received[mqtt.AvailabilityTopic(availability.Service)]
+		check := &Check{
+			Name:    "Service " + availability.Service,
+			Status:  StatusPass,
+			Message: fmt.Sprintf("online (last seen %s ago)", time.Since(receivedAt).Round(time.Second)),
+		}
+		if !availability.Online {
+			check.Status = StatusFail
+			check.Message = ""
+			check.Error = fmt.Sprintf("offline since %s", receivedAt.Format(time.RFC3339))
+			check.Hints = []string{fmt.Sprintf("Check the logs of %s, e.g. journalctl -u %s", availability.Service, availability.Service)}
+		}
+		report.Add(check)
+	}
+}
+
+// CheckSensors reports the age of the last reading on each sensor topic, as kept in the MQTT
+// state cache of stateDir. Readings older than maxAge warn.
+func CheckSensors(report *Report, stateDir string, maxAge time.Duration) {
+	cache, ok := loadStateCache(report, stateDir)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	messages := cache.Matching(mqtt.SensorTopics, now)
+	if len(messages) == 0 {
+		report.Add(&Check{
+			Name:   "Sensor readings",
+			Status: StatusWarn,
+			Error:  "no sensor readings have been received",
+			Hints: []string{
+				"Check that the Pico sensors are powered and connected to WiFi",
+				"Check that the sensors publish to the configured MQTT broker",
+			},
+		})
+		return
+	}
+
+	for _, message := range messages {
+		age := now.Sub(message.ReceivedAt)
+		check := &Check{
+			Name:    message.Topic,
+			Status:  StatusPass,
+			Message: fmt.Sprintf("last reading %s ago", age.Round(time.Second)),
+			Data: map[string]interface{}{
+				"received_at": message.ReceivedAt,
+				"age_seconds": int64(age.Seconds()),
+			},
+		}
+		if age > maxAge {
+			check.Status = StatusWarn
+			check.Message = ""
+			check.Error = fmt.Sprintf("no reading for %s", age.Round(time.Second))
+			room := message.Topic[strings.LastIndex(message.Topic, "/")+1:]
+			check.Hints = []string{fmt.Sprintf("Check the power and WiFi of the sensor in room %s", room)}
+		}
+		report.Add(check)
+	}
+}
+
+// loadStateCache opens the MQTT state cache, recording a failed check if it can't be read
+func loadStateCache(report *Report, stateDir string) (*mqtt.StateCache, bool) {
+	var cache *mqtt.StateCache
+	check := report.Run("MQTT state cache", func() (string, error) {
+		if stateDir == "" {
+			return "", errors.NewConfigError("HA_STATE_DIR is not set", nil)
+		}
+		var err error
+		cache, err = mqtt.NewStateCache(mqtt.StateCachePath(stateDir), 0)
+		if err != nil {
+			return "", err
+		}
+		return mqtt.StateCachePath(stateDir), nil
+	})
+	return cache, check.Status == StatusPass
+}
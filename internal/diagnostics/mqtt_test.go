@@ -0,0 +1,55 @@
+package diagnostics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestCheckSensorsAndServices(t *testing.T) {
+	stateDir := t.TempDir()
+	cache, err := mqtt.NewStateCache(mqtt.StateCachePath(stateDir), 0)
+	if err != nil {
+		t.Fatalf("Failed to create state cache: %v", err)
+	}
+	now := time.Now()
+	cache.Store("room-temp/1", []byte(`{"temperature":21.5}`), now.Add(-time.Minute))
+	cache.Store("room-temp/2", []byte(`{"temperature":19.0}`), now.Add(-time.Hour))
+	cache.Store(mqtt.AvailabilityTopic("unified"), []byte(mqtt.PayloadOnline), now)
+	cache.Store(mqtt.AvailabilityTopic("thermostat-service"), []byte(mqtt.PayloadOffline), now)
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Failed to save state cache: %v", err)
+	}
+
+	sensors := NewReport("sensors", "")
+	CheckSensors(sensors, stateDir, 10*time.Minute)
+	statuses := map[string]Status{}
+	for _, check := range sensors.Checks {
+		statuses[check.Name] = check.Status
+	}
+	if statuses["room-temp/1"] != StatusPass || statuses["room-temp/2"] != StatusWarn {
+		t.Errorf("Expected the stale sensor to warn, got %v", statuses)
+	}
+	if sensors.ExitCode() != ExitOK {
+		t.Errorf("Expected stale sensors not to fail the report")
+	}
+
+	services := NewReport("mqtt", "")
+	CheckServices(services, stateDir)
+	statuses = map[string]Status{}
+	for _, check := range services.Checks {
+		statuses[check.Name] = check.Status
+	}
+	if statuses["Service unified"] != StatusPass || statuses["Service thermostat-service"] != StatusFail {
+		t.Errorf("Expected the offline service to fail, got %v", statuses)
+	}
+}
+
+func TestCheckSensorsWithoutStateDir(t *testing.T) {
+	report := NewReport("sensors", "")
+	CheckSensors(report, "", time.Minute)
+	if report.Status != StatusFail || len(report.Checks) != 1 {
+		t.Errorf("Expected a failed state cache check, got %+v", report.Checks)
+	}
+}
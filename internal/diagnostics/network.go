@@ -0,0 +1,97 @@
+package diagnostics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CheckNetwork checks that a device answers on port 80 and on the Tapo app endpoint
+func CheckNetwork(report *Report, ip string) {
+	tcp := report.Run("TCP connectivity", func() (string, error) {
+		return "port 80 open", ProbeTCP(ip+":80", 5*time.Second)
+	})
+	tcp.Hints = TapoHints(tcp.Error)
+
+	report.Run("HTTP response", func() (string, error) {
+		return ProbeHTTP(fmt.Sprintf("http://%s/", ip), 5*time.Second)
+	})
+
+	report.Run("Tapo app endpoint", func() (string, error) {
+		return ProbeHTTP(fmt.Sprintf("http://%s/app", ip), 5*time.Second)
+	})
+}
+
+// scanResult is a host that answered on port 80
+type scanResult struct {
+	ip     string
+	host   int    // Last octet, for sorting
+	status string // Status of the /app endpoint, empty if it didn't answer
+}
+
+// ScanSubnet probes every host of a /24 subnet (e.g. "192.168.68") for Tapo devices.
+// Each host that answers is a check; the scan fails if none of them is a Tapo device.
+func ScanSubnet(report *Report, subnet string) {
+	var wg sync.WaitGroup
+	foundDevices := make(chan scanResult, 255)
+
+	for i := 1; i <= 254; i++ {
+		wg.Add(1)
+		go func(host int) {
+			defer wg.Done()
+
+			target := fmt.Sprintf("%s.%d", subnet, host)
+			if err := ProbeTCP(target+":80", 1*time.Second); err != nil {
+				return // No response
+			}
+
+			// Tapo devices answer on the /app endpoint
+			status, _ := ProbeHTTP(fmt.Sprintf("http://%s/app", target), 2*time.Second)
+			foundDevices <- scanResult{ip: target, host: host, status: status}
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		close(foundDevices)
+	}()
+
+	var found []scanResult
+	for device := range foundDevices {
+		found = append(found, device)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].host < found[j].host
+	})
+
+	tapoCount := 0
+	for _, device := range found {
+		check := &Check{
+			Name:   device.ip,
+			Status: StatusPass,
+			Data:   map[string]interface{}{"ip": device.ip, "tapo": device.status != ""},
+		}
+		if device.status != "" {
+			check.Message = fmt.Sprintf("Tapo app endpoint answered (HTTP Status: %s)", device.status)
+			tapoCount++
+		} else {
+			check.Status = StatusSkip
+			check.Message = "HTTP device, but not Tapo"
+		}
+		report.Add(check)
+	}
+
+	if tapoCount == 0 {
+		report.Add(&Check{
+			Name:   "Tapo devices",
+			Status: StatusFail,
+			Error:  "no Tapo devices found on the network",
+			Hints: []string{
+				"Make sure your Tapo devices are powered on and connected",
+				"Make sure you're on the same network as the devices",
+				fmt.Sprintf("Check that the subnet '%s' is correct for your network", subnet),
+			},
+		})
+	}
+}
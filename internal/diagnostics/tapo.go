@@ -0,0 +1,122 @@
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/tapo"
+)
+
+// TapoTarget is a Tapo device and the account used to reach it
+type TapoTarget struct {
+	Host     string
+	Username string
+	Password string
+	Timeout  time.Duration
+	Logger   *logger.Logger
+}
+
+// CheckLegacy connects with the legacy protocol and reads the device info.
+// It returns whether the handshake worked.
+func CheckLegacy(report *Report, target TapoTarget, optional bool) bool {
+	client := tapo.NewTapoClient(target.Host, target.Username, target.Password, target.Logger)
+
+	handshake := runCheck(report, "Legacy handshake", optional, func() (string, error) {
+		return "successful", client.Connect()
+	})
+	handshake.Hints = TapoHints(handshake.Error)
+	if handshake.Status != StatusPass {
+		return false
+	}
+
+	report.Run("Legacy device info", func() (string, error) {
+		info, err := client.GetDeviceInfo()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (Model: %s)", info.Nickname, info.Model), nil
+	})
+	return true
+}
+
+// CheckKLAP connects with KLAP and reads the device info and energy usage.
+// It returns whether the handshake worked.
+func CheckKLAP(report *Report, target TapoTarget, optional bool) bool {
+	client := tapo.NewKlapClient(target.Host, target.Username, target.Password, target.Timeout, *target.Logger)
+	ctx := context.Background()
+
+	handshake := runCheck(report, "KLAP handshake", optional, func() (string, error) {
+		return "connected using KLAP protocol", client.Connect(ctx)
+	})
+	handshake.Hints = TapoHints(handshake.Error)
+	if handshake.Status != StatusPass {
+		return false
+	}
+
+	var deviceInfo *tapo.KlapDeviceInfo
+	info := report.Run("KLAP device info", func() (string, error) {
+		var err error
+		deviceInfo, err = client.GetDeviceInfo(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s, model %s, firmware %s", deviceInfo.DeviceID, deviceInfo.Model, deviceInfo.FwVersion), nil
+	})
+	if deviceInfo != nil {
+		info.Data = map[string]interface{}{
+			"device_id": deviceInfo.DeviceID,
+			"model":     deviceInfo.Model,
+			"firmware":  deviceInfo.FwVersion,
+			"device_on": deviceInfo.DeviceOn,
+			"rssi":      deviceInfo.RSSI,
+		}
+	}
+
+	var energyUsage *tapo.KlapEnergyUsage
+	energy := report.Run("KLAP energy usage", func() (string, error) {
+		var err error
+		energyUsage, err = client.GetEnergyUsage(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("current %d mW, today %d Wh", energyUsage.CurrentPower, energyUsage.TodayEnergy), nil
+	})
+	if energyUsage != nil {
+		energy.Data = map[string]interface{}{
+			"current_power_mw":      energyUsage.CurrentPower,
+			"today_energy_wh":       energyUsage.TodayEnergy,
+			"month_energy_wh":       energyUsage.MonthEnergy,
+			"today_runtime_minutes": energyUsage.TodayRuntime,
+		}
+	}
+	return true
+}
+
+// CheckTapo tries KLAP, then the legacy protocol, the same order TapoService probes devices in.
+// The device fails only if neither protocol works.
+func CheckTapo(report *Report, target TapoTarget) bool {
+	if CheckKLAP(report, target, true) || CheckLegacy(report, target, true) {
+		return true
+	}
+
+	report.Add(&Check{
+		Name:   "Tapo protocol",
+		Status: StatusFail,
+		Error:  "neither KLAP nor the legacy protocol connected",
+		Hints: []string{
+			"Verify the credentials in the Tapo mobile app",
+			"Check if the device firmware needs updating",
+		},
+	})
+	return false
+}
+
+// runCheck runs a required or optional check
+func runCheck(report *Report, name string, optional bool, fn func() (string, error)) *Check {
+	if optional {
+		return report.RunOptional(name, fn)
+	}
+	return report.Run(name, fn)
+}
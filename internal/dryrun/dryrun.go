@@ -0,0 +1,185 @@
+package dryrun
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// TraceFileName is the dry-run trace file inside the state directory
+const TraceFileName = "dry-run.jsonl"
+
+// DefaultMaxTraces is the number of traces kept in memory
+const DefaultMaxTraces = 500
+
+// Trace records a command a service would have sent outside observe-only mode
+type Trace struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Service   string                 `json:"service"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target"`
+	Reason    string                 `json:"reason,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Recorder gates command publishing in observe-only mode and keeps dry-run traces
+type Recorder struct {
+	observeOnly bool
+	standby     bool // Set while a failover standby waits to take over
+	path        string
+	maxTraces   int
+	traces      []Trace
+	mu          sync.RWMutex
+	logger      *logger.Logger
+}
+
+// NewRecorder creates a recorder; traces are appended to path when it is not empty
+func NewRecorder(observeOnly bool, path string, serviceLogger *logger.Logger) *Recorder {
+	return &Recorder{
+		observeOnly: observeOnly,
+		path:        path,
+		maxTraces:   DefaultMaxTraces,
+		traces:      make([]Trace, 0),
+		logger:      serviceLogger,
+	}
+}
+
+// TracePath returns the dry-run trace file path for a state directory
+func TracePath(stateDir string) string {
+	return filepath.Join(stateDir, TraceFileName)
+}
+
+// ObserveOnly reports whether commands must be withheld.
+// A nil recorder never observes, so services work unchanged without it wired in.
+func (r *Recorder) ObserveOnly() bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.observeOnly || r.standby
+}
+
+// SetStandby withholds commands while this gateway is a failover standby.
+// Observe-only mode still applies after the gateway takes over.
+func (r *Recorder) SetStandby(standby bool) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.standby = standby
+}
+
+// Record stores a dry-run trace for a command that was withheld
+func (r *Recorder) Record(service, action, target, reason string, details map[string]interface{}) {
+	if r == nil {
+		return
+	}
+
+	trace := Trace{
+		Timestamp: time.Now(),
+		Service:   service,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+		Details:   details,
+	}
+
+	r.mu.Lock()
+	r.traces = append(r.traces, trace)
+	if len(r.traces) > r.maxTraces {
+		r.traces = r.traces[len(r.traces)-r.maxTraces:]
+	}
+	r.mu.Unlock()
+
+	if r.logger != nil {
+		r.logger.Info("Dry run: command withheld in observe-only mode", map[string]interface{}{
+			"service": service,
+			"action":  action,
+			"target":  target,
+			"reason":  reason,
+		})
+	}
+
+	if r.path != "" {
+		if err := appendTrace(r.path, &trace); err != nil && r.logger != nil {
+			r.logger.Error("Failed to write dry-run trace", err, map[string]interface{}{
+				"path": r.path,
+			})
+		}
+	}
+}
+
+// GetTraces returns the traces kept in memory, oldest first
+func (r *Recorder) GetTraces() []Trace {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	traces := make([]Trace, len(r.traces))
+	copy(traces, r.traces)
+	return traces
+}
+
+// appendTrace appends a single trace as a JSON line
+func appendTrace(path string, trace *Trace) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal dry-run trace", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.NewSystemError("failed to open dry-run trace file", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return errors.NewSystemError("failed to write dry-run trace file", err)
+	}
+
+	return nil
+}
+
+// ReadTraces reads the most recent traces from a trace file, oldest first
+func ReadTraces(path string, limit int) ([]Trace, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []Trace{}, nil
+	}
+	if err != nil {
+		return nil, errors.NewSystemError("failed to open dry-run trace file", err)
+	}
+	defer file.Close()
+
+	traces := make([]Trace, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var trace Trace
+		if err := json.Unmarshal(scanner.Bytes(), &trace); err != nil {
+			continue
+		}
+		traces = append(traces, trace)
+		if limit > 0 && len(traces) > limit {
+			traces = traces[1:]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.NewSystemError("failed to read dry-run trace file", err)
+	}
+
+	return traces, nil
+}
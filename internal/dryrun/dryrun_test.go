@@ -0,0 +1,74 @@
+package dryrun
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNilRecorderNeverObserves(t *testing.T) {
+	var recorder *Recorder
+
+	if recorder.ObserveOnly() {
+		t.Error("Expected nil recorder to allow commands")
+	}
+
+	// Recording on a nil recorder must not panic
+	recorder.Record("thermostat", "set_mode", "thermostat-001", "test", nil)
+}
+
+func TestStandbyWithholdsCommands(t *testing.T) {
+	recorder := NewRecorder(false, "", nil)
+
+	recorder.SetStandby(true)
+	if !recorder.ObserveOnly() {
+		t.Error("Expected a standby gateway to withhold commands")
+	}
+	recorder.SetStandby(false)
+	if recorder.ObserveOnly() {
+		t.Error("Expected commands once the gateway takes over")
+	}
+
+	observing := NewRecorder(true, "", nil)
+	observing.SetStandby(false)
+	if !observing.ObserveOnly() {
+		t.Error("Expected observe-only mode to outlast a takeover")
+	}
+}
+
+func TestRecordPersistsTraces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), TraceFileName)
+	recorder := NewRecorder(true, path, nil)
+
+	if !recorder.ObserveOnly() {
+		t.Fatal("Expected recorder to be in observe-only mode")
+	}
+
+	recorder.Record("tapo", "set_state", "dryer", "", map[string]interface{}{"on": true})
+	recorder.Record("thermostat", "set_mode", "thermostat-001", "temperature below target", nil)
+	recorder.Record("automation", "light_on", "living-room", "motion detected", nil)
+
+	if traces := recorder.GetTraces(); len(traces) != 3 {
+		t.Fatalf("Expected 3 traces in memory, got %d", len(traces))
+	}
+
+	traces, err := ReadTraces(path, 2)
+	if err != nil {
+		t.Fatalf("ReadTraces failed: %v", err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("Expected 2 traces from file, got %d", len(traces))
+	}
+	if traces[0].Service != "thermostat" || traces[1].Target != "living-room" {
+		t.Errorf("Expected the most recent traces oldest first, got %+v", traces)
+	}
+}
+
+func TestReadTracesMissingFile(t *testing.T) {
+	traces, err := ReadTraces(filepath.Join(t.TempDir(), TraceFileName), 10)
+	if err != nil {
+		t.Fatalf("Expected no error for missing trace file, got %v", err)
+	}
+	if len(traces) != 0 {
+		t.Errorf("Expected no traces, got %d", len(traces))
+	}
+}
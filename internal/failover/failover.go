@@ -0,0 +1,422 @@
+// Package failover lets a second gateway run as a hot standby. Gateways send heartbeats with
+// the discovery protocol. The standby mirrors the active gateway's state files over MQTT. It
+// takes over automation and actuation once the active gateway's heartbeat stops.
+//
+// An election decides which standby takes over, so every gateway reaches the same answer. The
+// live standby with the highest priority wins, then the lowest node ID. Each takeover starts a
+// new epoch. A gateway that sees another active gateway with a higher epoch steps down at once.
+// This fencing keeps two gateways from controlling the house after a network partition heals.
+package failover
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// Role is what a gateway currently does
+type Role string
+
+const (
+	RoleActive  Role = "active"  // Runs automations and sends commands
+	RoleStandby Role = "standby" // Ingests data and mirrors state, but sends nothing
+)
+
+const (
+	// StateFileName holds the highest epoch a gateway has seen, inside the state directory
+	StateFileName = "failover.json"
+
+	defaultHeartbeat = 5 * time.Second
+	defaultFailAfter = 15 * time.Second
+)
+
+// Config describes this gateway's place in a failover pair
+type Config struct {
+	NodeID   string `json:"node_id"`
+	Priority int    `json:"priority,omitempty"` // Higher wins the election; ties go to the lowest node ID
+	// HeartbeatSeconds is how often the gateway announces itself, 5 by default
+	HeartbeatSeconds int `json:"heartbeat_seconds,omitempty"`
+	// FailAfterSeconds is how long a silent active gateway is given before a standby takes
+	// over, 15 by default. A starting gateway also waits this long to hear an active one.
+	FailAfterSeconds int `json:"fail_after_seconds,omitempty"`
+	// StateFiles are the files in the state directory mirrored to the standby
+	StateFiles []string `json:"state_files,omitempty"`
+}
+
+// LoadConfig reads the failover configuration from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read failover file", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse failover file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the node ID and that a heartbeat can be missed before failing over
+func (c *Config) Validate() error {
+	if c.NodeID == "" {
+		return errors.NewValidationError("failover needs a node_id, unique per gateway", nil)
+	}
+	if c.HeartbeatSeconds < 0 || c.FailAfterSeconds < 0 {
+		return errors.NewValidationError("heartbeat_seconds and fail_after_seconds must not be negative", nil)
+	}
+	if c.FailAfterSeconds > 0 && time.Duration(c.FailAfterSeconds)*time.Second < 2*c.heartbeat() {
+		return errors.NewValidationError("fail_after_seconds must cover at least two heartbeats", nil)
+	}
+	for _, name := range c.StateFiles {
+		if name == "" || filepath.Base(name) != name {
+			return errors.NewValidationError(fmt.Sprintf("state file %q must be a file name inside the state directory", name), nil)
+		}
+	}
+	return nil
+}
+
+func (c *Config) heartbeat() time.Duration {
+	if c.HeartbeatSeconds > 0 {
+		return time.Duration(c.HeartbeatSeconds) * time.Second
+	}
+	return defaultHeartbeat
+}
+
+func (c *Config) failAfter() time.Duration {
+	if c.FailAfterSeconds > 0 {
+		return time.Duration(c.FailAfterSeconds) * time.Second
+	}
+	return defaultFailAfter
+}
+
+// Peer is a gateway as seen in its last heartbeat
+type Peer struct {
+	NodeID   string    `json:"node_id"`
+	Role     Role      `json:"role"`
+	Priority int       `json:"priority"`
+	Epoch    uint64    `json:"epoch"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// outranks reports whether p wins an election against other
+func (p Peer) outranks(other Peer) bool {
+	if p.Priority != other.Priority {
+		return p.Priority > other.Priority
+	}
+	return p.NodeID < other.NodeID
+}
+
+// Status is the failover state served on the debug address
+type Status struct {
+	NodeID string    `json:"node_id"`
+	Role   Role      `json:"role"`
+	Epoch  uint64    `json:"epoch"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+	Peers  []Peer    `json:"peers"`
+}
+
+// persisted is the failover state file
+type persisted struct {
+	Epoch uint64 `json:"epoch"`
+}
+
+// Controller runs the election and tells the gateway when to take over and step down
+type Controller struct {
+	config    *Config
+	path      string
+	logger    *logger.Logger
+	role      Role
+	epoch     uint64 // Epoch of this gateway's current or last term as active
+	seenEpoch uint64 // Highest epoch seen anywhere
+	since     time.Time
+	started   time.Time
+	reason    string
+	peers     map[string]Peer
+	callbacks []func(role Role, epoch uint64)
+	mu        sync.Mutex
+}
+
+// StatePath returns the failover state file path for a state directory
+func StatePath(stateDir string) string {
+	return filepath.Join(stateDir, StateFileName)
+}
+
+// NewController creates a controller that starts as standby. It persists the highest epoch
+// seen to path, so a restarted gateway never reuses an old epoch.
+func NewController(cfg *Config, path string, serviceLogger *logger.Logger) *Controller {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Failover", nil)
+	}
+
+	now := time.Now()
+	c := &Controller{
+		config:  cfg,
+		path:    path,
+		logger:  serviceLogger,
+		role:    RoleStandby,
+		since:   now,
+		started: now,
+		reason:  "starting",
+		peers:   make(map[string]Peer),
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		var state persisted
+		if json.Unmarshal(data, &state) == nil {
+			c.seenEpoch = state.Epoch
+		}
+	}
+	return c
+}
+
+// OnRoleChange registers a callback run after every takeover and step-down, outside the lock
+func (c *Controller) OnRoleChange(callback func(role Role, epoch uint64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, callback)
+}
+
+// Role returns what this gateway currently does
+func (c *Controller) Role() Role {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+// Active reports whether this gateway runs automations and sends commands
+func (c *Controller) Active() bool {
+	return c.Role() == RoleActive
+}
+
+// Epoch returns the epoch of this gateway's current or last term as active
+func (c *Controller) Epoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// Self returns this gateway as its peers see it
+func (c *Controller) Self() Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.self(time.Now())
+}
+
+func (c *Controller) self(now time.Time) Peer {
+	return Peer{NodeID: c.config.NodeID, Role: c.role, Priority: c.config.Priority, Epoch: c.epoch, LastSeen: now}
+}
+
+// Observe records a peer's heartbeat. An active peer with a higher epoch fences this gateway
+// off at once rather than at the next evaluation.
+func (c *Controller) Observe(peer Peer) {
+	if peer.NodeID == "" || peer.NodeID == c.config.NodeID {
+		return
+	}
+
+	c.mu.Lock()
+	c.peers[peer.NodeID] = peer
+	c.noteEpoch(peer.Epoch)
+	var changed bool
+	if c.role == RoleActive && peer.Role == RoleActive && c.fencedBy(peer) {
+		changed = c.setRole(RoleStandby, peer.LastSeen, fmt.Sprintf("%s is active with epoch %d", peer.NodeID, peer.Epoch))
+	}
+	role, epoch, callbacks := c.role, c.epoch, c.callbacks
+	c.mu.Unlock()
+
+	if changed {
+		notify(callbacks, role, epoch)
+	}
+}
+
+// Forget drops a peer that said goodbye, so a clean shutdown of the active gateway fails over
+// without waiting for its heartbeat to time out
+func (c *Controller) Forget(nodeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, nodeID)
+}
+
+// Fence handles a claim to be active seen outside the heartbeat, e.g. the retained claim on
+// MQTT. It steps this gateway down if the claim has a newer epoch.
+func (c *Controller) Fence(nodeID string, epoch uint64, at time.Time) {
+	if nodeID == "" || nodeID == c.config.NodeID {
+		return
+	}
+
+	c.mu.Lock()
+	c.noteEpoch(epoch)
+	var changed bool
+	if c.role == RoleActive && epoch > c.epoch {
+		changed = c.setRole(RoleStandby, at, fmt.Sprintf("%s claimed epoch %d", nodeID, epoch))
+	}
+	role, current, callbacks := c.role, c.epoch, c.callbacks
+	c.mu.Unlock()
+
+	if changed {
+		notify(callbacks, role, current)
+	}
+}
+
+// Evaluate drops peers whose heartbeat stopped and runs the election: a standby takes over
+// when no live gateway is active and it outranks every live standby
+func (c *Controller) Evaluate(now time.Time) {
+	c.mu.Lock()
+	failAfter := c.config.failAfter()
+	for id, peer := range c.peers {
+		if now.Sub(peer.LastSeen) > failAfter {
+			c.logger.Warn("Failover peer stopped sending heartbeats", map[string]interface{}{
+				"node_id": id,
+				"role":    peer.Role,
+			})
+			delete(c.peers, id)
+		}
+	}
+
+	var changed bool
+	switch c.role {
+	case RoleActive:
+		for _, peer := range c.peers {
+			if peer.Role == RoleActive && c.fencedBy(peer) {
+				changed = c.setRole(RoleStandby, now, fmt.Sprintf("%s is active with epoch %d", peer.NodeID, peer.Epoch))
+				break
+			}
+		}
+	case RoleStandby:
+		changed = c.elect(now)
+	}
+	role, epoch, callbacks := c.role, c.epoch, c.callbacks
+	c.mu.Unlock()
+
+	if changed {
+		notify(callbacks, role, epoch)
+	}
+}
+
+// elect takes over if this standby wins; callers must hold the lock
+func (c *Controller) elect(now time.Time) bool {
+	// Give a gateway that just started time to hear the active one
+	if now.Sub(c.started) < c.config.failAfter() {
+		return false
+	}
+
+	self := c.self(now)
+	for _, peer := range c.peers {
+		if peer.Role == RoleActive {
+			return false
+		}
+		if peer.outranks(self) {
+			return false
+		}
+	}
+
+	c.epoch = c.seenEpoch + 1
+	c.seenEpoch = c.epoch
+	if err := c.save(); err != nil {
+		c.logger.Error("Failed to save failover epoch", err)
+	}
+	return c.setRole(RoleActive, now, "no active gateway")
+}
+
+// fencedBy reports whether an active peer wins over this active gateway: a newer epoch, or
+// the same epoch and a higher rank. Callers must hold the lock.
+func (c *Controller) fencedBy(peer Peer) bool {
+	if peer.Epoch != c.epoch {
+		return peer.Epoch > c.epoch
+	}
+	return peer.outranks(c.self(peer.LastSeen))
+}
+
+// setRole changes role and reports whether it changed; callers must hold the lock
+func (c *Controller) setRole(role Role, at time.Time, reason string) bool {
+	if c.role == role {
+		return false
+	}
+
+	c.role, c.since, c.reason = role, at, reason
+	if role == RoleActive {
+		c.logger.Warn("Taking over as the active gateway", map[string]interface{}{
+			"node_id": c.config.NodeID,
+			"epoch":   c.epoch,
+			"reason":  reason,
+		})
+	} else {
+		c.logger.Warn("Stepping down to standby", map[string]interface{}{
+			"node_id": c.config.NodeID,
+			"epoch":   c.epoch,
+			"reason":  reason,
+		})
+	}
+	return true
+}
+
+// noteEpoch remembers the highest epoch seen; callers must hold the lock
+func (c *Controller) noteEpoch(epoch uint64) {
+	if epoch <= c.seenEpoch {
+		return
+	}
+	c.seenEpoch = epoch
+	if err := c.save(); err != nil {
+		c.logger.Error("Failed to save failover epoch", err)
+	}
+}
+
+// save atomically writes the highest epoch seen; callers must hold the lock
+func (c *Controller) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(persisted{Epoch: c.seenEpoch}, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal failover state", err)
+	}
+	return writeAtomic(c.path, data)
+}
+
+// Status returns this gateway's role and the live peers, sorted by node ID
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := Status{
+		NodeID: c.config.NodeID,
+		Role:   c.role,
+		Epoch:  c.epoch,
+		Since:  c.since,
+		Reason: c.reason,
+		Peers:  make([]Peer, 0, len(c.peers)),
+	}
+	for _, peer := range c.peers {
+		status.Peers = append(status.Peers, peer)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].NodeID < status.Peers[j].NodeID })
+	return status
+}
+
+// Handler serves the failover status as JSON
+func (c *Controller) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+}
+
+func notify(callbacks []func(Role, uint64), role Role, epoch uint64) {
+	for _, callback := range callbacks {
+		callback(role, epoch)
+	}
+}
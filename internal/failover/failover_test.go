@@ -0,0 +1,248 @@
+package failover
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/discovery"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func newTestController(t *testing.T, nodeID string, priority int, dir string) *Controller {
+	t.Helper()
+	cfg := &Config{NodeID: nodeID, Priority: priority}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	return NewController(cfg, StatePath(dir), nil)
+}
+
+func TestConfigValidate(t *testing.T) {
+	invalid := []Config{
+		{},
+		{NodeID: "a", HeartbeatSeconds: -1},
+		{NodeID: "a", HeartbeatSeconds: 5, FailAfterSeconds: 8},
+		{NodeID: "a", StateFiles: []string{"../presence.json"}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", cfg)
+		}
+	}
+
+	valid := Config{NodeID: "a", HeartbeatSeconds: 2, FailAfterSeconds: 6, StateFiles: []string{"presence.json"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+}
+
+func TestElectionAndFencing(t *testing.T) {
+	primary := newTestController(t, "gw-a", 10, t.TempDir())
+	standbyDir := t.TempDir()
+	standby := newTestController(t, "gw-b", 5, standbyDir)
+
+	now := time.Now()
+	primary.Observe(Peer{NodeID: "gw-b", Role: RoleStandby, Priority: 5, LastSeen: now})
+	standby.Observe(Peer{NodeID: "gw-a", Role: RoleStandby, Priority: 10, LastSeen: now})
+
+	// Nobody takes over during the startup grace
+	primary.Evaluate(now)
+	if primary.Active() {
+		t.Fatal("Expected no takeover before the fail-after period")
+	}
+
+	now = now.Add(20 * time.Second)
+	primary.Observe(Peer{NodeID: "gw-b", Role: RoleStandby, Priority: 5, LastSeen: now})
+	standby.Observe(Peer{NodeID: "gw-a", Role: RoleStandby, Priority: 10, LastSeen: now})
+	primary.Evaluate(now)
+	standby.Evaluate(now)
+	if !primary.Active() || primary.Epoch() != 1 {
+		t.Fatalf("Expected the higher priority gateway to take over with epoch 1, got %+v", primary.Status())
+	}
+	if standby.Active() {
+		t.Fatal("Expected the lower priority gateway to stay standby")
+	}
+
+	// The standby waits while the active gateway keeps sending heartbeats
+	heartbeat := primary.Self()
+	heartbeat.LastSeen = now.Add(5 * time.Second)
+	standby.Observe(heartbeat)
+	standby.Evaluate(now.Add(5 * time.Second))
+	if standby.Active() {
+		t.Fatal("Expected the standby to wait while the active gateway is alive")
+	}
+
+	// Heartbeats stop: the standby takes over with a newer epoch
+	var changes []Role
+	standby.OnRoleChange(func(role Role, epoch uint64) { changes = append(changes, role) })
+	standby.Evaluate(now.Add(30 * time.Second))
+	if !standby.Active() || standby.Epoch() != 2 {
+		t.Fatalf("Expected the standby to take over with epoch 2, got %+v", standby.Status())
+	}
+	if len(changes) != 1 || changes[0] != RoleActive {
+		t.Errorf("Expected one takeover callback, got %v", changes)
+	}
+
+	// The old primary comes back still active and is fenced by the newer epoch
+	primary.Observe(Peer{NodeID: "gw-b", Role: RoleActive, Priority: 5, Epoch: 2, LastSeen: now.Add(31 * time.Second)})
+	if primary.Active() {
+		t.Fatal("Expected the old primary to step down when it sees a newer epoch")
+	}
+	standby.Observe(Peer{NodeID: "gw-a", Role: RoleActive, Priority: 10, Epoch: 1, LastSeen: now.Add(31 * time.Second)})
+	if !standby.Active() {
+		t.Fatal("Expected the newer epoch to keep control")
+	}
+
+	// The epoch survives a restart
+	restarted := NewController(&Config{NodeID: "gw-b"}, StatePath(standbyDir), nil)
+	restarted.started = now.Add(-time.Minute)
+	restarted.Evaluate(now)
+	if restarted.Epoch() != 3 {
+		t.Errorf("Expected a restarted gateway to move past the saved epoch, got %d", restarted.Epoch())
+	}
+}
+
+func TestFenceByClaim(t *testing.T) {
+	controller := newTestController(t, "gw-a", 0, t.TempDir())
+	controller.started = time.Now().Add(-time.Minute)
+	controller.Evaluate(time.Now())
+	if !controller.Active() {
+		t.Fatal("Expected a lone gateway to take over")
+	}
+
+	controller.Fence("gw-a", 7, time.Now())
+	if !controller.Active() {
+		t.Error("Expected a gateway to ignore its own claim")
+	}
+	controller.Fence("gw-b", 7, time.Now())
+	if controller.Active() {
+		t.Error("Expected a newer claim to fence the gateway")
+	}
+}
+
+func TestPeerFromAsset(t *testing.T) {
+	cfg := &Config{NodeID: "gw-a", Priority: 3}
+	asset := GatewayAsset(cfg, "Gateway A")
+	if asset.TTL != 15 {
+		t.Errorf("Expected a TTL of three heartbeats, got %d", asset.TTL)
+	}
+	if _, ok := PeerFromAsset(asset); ok {
+		t.Error("Expected an asset without a role to be ignored")
+	}
+
+	asset.Metadata[MetadataRole] = string(RoleActive)
+	asset.Metadata[MetadataPriority] = "3"
+	asset.Metadata[MetadataEpoch] = "4"
+	peer, ok := PeerFromAsset(asset)
+	if !ok || peer.NodeID != "gw-a" || peer.Role != RoleActive || peer.Priority != 3 || peer.Epoch != 4 {
+		t.Errorf("Unexpected peer %+v", peer)
+	}
+
+	asset.Type = discovery.AssetTypeSensor
+	if _, ok := PeerFromAsset(asset); ok {
+		t.Error("Expected non-gateway assets to be ignored")
+	}
+}
+
+func TestReplicatorMirrorsAndRestores(t *testing.T) {
+	activeDir, standbyDir := t.TempDir(), t.TempDir()
+	active := newTestController(t, "gw-a", 10, activeDir)
+	active.started = time.Now().Add(-time.Minute)
+	active.Evaluate(time.Now())
+
+	var messages []*mqtt.Message
+	source := NewReplicator(active, activeDir, []string{"presence.json"}, nil)
+	source.publish = func(msg *mqtt.Message) error {
+		messages = append(messages, msg)
+		return nil
+	}
+
+	if err := os.WriteFile(filepath.Join(activeDir, "presence.json"), []byte(`{"home":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source.Sync()
+	source.Sync()
+	if len(messages) != 1 || messages[0].Topic != StateTopic("presence.json") || !messages[0].Retain {
+		t.Fatalf("Expected one retained snapshot for an unchanged file, got %d", len(messages))
+	}
+
+	standby := newTestController(t, "gw-b", 5, standbyDir)
+	mirror := NewReplicator(standby, standbyDir, []string{"presence.json"}, nil)
+	var claims []Claim
+	mirror.publish = func(msg *mqtt.Message) error {
+		if msg.Topic == ClaimTopic {
+			var claim Claim
+			json.Unmarshal(msg.Payload, &claim)
+			claims = append(claims, claim)
+		}
+		return nil
+	}
+	reloaded := 0
+	mirror.OnTakeover(func() error {
+		reloaded++
+		return nil
+	})
+
+	if err := mirror.receive(messages[0].Payload); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(standbyDir, "presence.json")); !os.IsNotExist(err) {
+		t.Fatal("Expected the standby to keep mirrored state aside until it takes over")
+	}
+
+	standby.started = time.Now().Add(-time.Minute)
+	standby.Evaluate(time.Now())
+	data, err := os.ReadFile(filepath.Join(standbyDir, "presence.json"))
+	if err != nil || string(data) != `{"home":true}` {
+		t.Fatalf("Expected the mirrored file restored on takeover, got %q (%v)", data, err)
+	}
+	if reloaded != 1 {
+		t.Errorf("Expected the reload hook to run once, got %d", reloaded)
+	}
+	if standby.Epoch() != 2 {
+		t.Errorf("Expected the takeover to move past the mirrored epoch, got %d", standby.Epoch())
+	}
+	if len(claims) != 1 || claims[0].NodeID != "gw-b" || claims[0].Epoch != 2 {
+		t.Errorf("Expected a claim for the new epoch, got %+v", claims)
+	}
+}
+
+func TestFollowerAppliesSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	follower := NewFollower(dir, []string{"presence.json"}, nil)
+	reloaded := 0
+	follower.OnUpdate("presence.json", func() error {
+		reloaded++
+		return nil
+	})
+
+	snapshot := func(name string, epoch uint64, data string) []byte {
+		payload, _ := json.Marshal(Snapshot{NodeID: "gw-a", Epoch: epoch, Name: name, Data: []byte(data)})
+		return payload
+	}
+
+	if err := follower.receive(snapshot("presence.json", 2, `{"home":true}`)); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "presence.json"))
+	if err != nil || string(data) != `{"home":true}` {
+		t.Fatalf("Expected the snapshot written into the state directory, got %q (%v)", data, err)
+	}
+	if reloaded != 1 {
+		t.Errorf("Expected the reload hook to run once, got %d", reloaded)
+	}
+
+	// A fenced gateway's older snapshot and untracked files are ignored
+	follower.receive(snapshot("presence.json", 1, `{"home":false}`))
+	follower.receive(snapshot("alerts.json", 2, `{}`))
+	data, _ = os.ReadFile(filepath.Join(dir, "presence.json"))
+	if string(data) != `{"home":true}` || reloaded != 1 {
+		t.Errorf("Expected stale and untracked snapshots dropped, got %q after %d reloads", data, reloaded)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alerts.json")); !os.IsNotExist(err) {
+		t.Error("Expected untracked files not to be written")
+	}
+}
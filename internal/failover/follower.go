@@ -0,0 +1,94 @@
+package failover
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Follower keeps a read replica's state files in step with the active gateway. Unlike a
+// standby's replicator it never takes over: snapshots are written straight into the state
+// directory and the owning service reloads them, so the replica serves current state.
+type Follower struct {
+	stateDir string
+	files    []string
+	epochs   map[string]uint64 // Epoch of each file last written
+	reloads  map[string]func() error
+	logger   *logger.Logger
+	mu       sync.Mutex
+}
+
+// NewFollower creates a follower for the named files in stateDir
+func NewFollower(stateDir string, files []string, serviceLogger *logger.Logger) *Follower {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ReadReplica", nil)
+	}
+
+	return &Follower{
+		stateDir: stateDir,
+		files:    files,
+		epochs:   make(map[string]uint64),
+		reloads:  make(map[string]func() error),
+		logger:   serviceLogger,
+	}
+}
+
+// OnUpdate registers a hook that reloads a service's state after the named file changes
+func (f *Follower) OnUpdate(name string, reload func() error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reloads[name] = reload
+}
+
+// Subscribe follows the active gateway's state files
+func (f *Follower) Subscribe(client *mqtt.Client) error {
+	return client.Subscribe(StateTopic("+"), func(topic string, payload []byte) error {
+		return f.receive(payload)
+	})
+}
+
+// receive writes a state file from the active gateway and reloads its service. Snapshots from
+// an older epoch than the last one written come from a fenced gateway and are dropped.
+func (f *Follower) receive(payload []byte) error {
+	var snapshot Snapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return errors.NewValidationError("invalid failover state snapshot", err)
+	}
+
+	f.mu.Lock()
+	if !f.tracked(snapshot.Name) || snapshot.Epoch < f.epochs[snapshot.Name] {
+		f.mu.Unlock()
+		return nil
+	}
+	if err := writeAtomic(filepath.Join(f.stateDir, snapshot.Name), snapshot.Data); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	f.epochs[snapshot.Name] = snapshot.Epoch
+	reload := f.reloads[snapshot.Name]
+	f.mu.Unlock()
+
+	if reload == nil {
+		return nil
+	}
+	if err := reload(); err != nil {
+		f.logger.Error("Failed to reload followed state", err, map[string]interface{}{
+			"file": snapshot.Name,
+		})
+		return err
+	}
+	return nil
+}
+
+func (f *Follower) tracked(name string) bool {
+	for _, file := range f.files {
+		if file == name {
+			return true
+		}
+	}
+	return false
+}
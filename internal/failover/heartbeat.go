@@ -0,0 +1,165 @@
+package failover
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+// Discovery metadata keys that carry a gateway's failover heartbeat
+const (
+	MetadataNode     = "failover_node"
+	MetadataRole     = "failover_role"
+	MetadataPriority = "failover_priority"
+	MetadataEpoch    = "failover_epoch"
+)
+
+// Heartbeat carries the failover state in discovery announcements. It listens for the
+// announcements of other gateways and runs the election once per heartbeat.
+type Heartbeat struct {
+	controller *Controller
+	protocol   *discovery.DiscoveryProtocol
+	assets     map[string]string // Discovery asset ID to failover node ID
+	mu         sync.Mutex
+}
+
+// GatewayAsset builds the discovery asset announced by this gateway. Its TTL is three
+// heartbeats, so the discovery protocol announces it once per heartbeat.
+func GatewayAsset(cfg *Config, name string) *discovery.AssetInfo {
+	asset := discovery.NewHomeAutomationGateway(name).
+		WithID("gateway-" + cfg.NodeID).
+		WithTTL(int(3 * cfg.heartbeat() / time.Second)).
+		Build()
+	asset.Metadata[MetadataNode] = cfg.NodeID
+	return asset
+}
+
+// NewHeartbeat creates a heartbeat that announces through protocol; register it as a
+// listener on the same protocol
+func NewHeartbeat(controller *Controller, protocol *discovery.DiscoveryProtocol) *Heartbeat {
+	h := &Heartbeat{
+		controller: controller,
+		protocol:   protocol,
+		assets:     make(map[string]string),
+	}
+	h.update()
+	return h
+}
+
+// Run evaluates the election once per heartbeat and announces role changes at once
+func (h *Heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.controller.config.heartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			before := h.controller.Self()
+			h.controller.Evaluate(now)
+			after := h.update()
+			if after.Role != before.Role || after.Epoch != before.Epoch {
+				if err := h.protocol.Announce(); err != nil {
+					h.controller.logger.Error("Failed to announce failover role", err)
+				}
+			}
+		}
+	}
+}
+
+// update copies the controller state into the local asset's metadata
+func (h *Heartbeat) update() Peer {
+	self := h.controller.Self()
+	h.protocol.UpdateLocalAsset(func(asset *discovery.AssetInfo) {
+		if asset.Metadata == nil {
+			asset.Metadata = make(map[string]string)
+		}
+		asset.Metadata[MetadataNode] = self.NodeID
+		asset.Metadata[MetadataRole] = string(self.Role)
+		asset.Metadata[MetadataPriority] = strconv.Itoa(self.Priority)
+		asset.Metadata[MetadataEpoch] = strconv.FormatUint(self.Epoch, 10)
+	})
+	return self
+}
+
+// PeerFromAsset reads a gateway's failover heartbeat from its discovery asset
+func PeerFromAsset(asset *discovery.AssetInfo) (Peer, bool) {
+	if asset == nil || asset.Type != discovery.AssetTypeGateway || asset.Metadata[MetadataNode] == "" {
+		return Peer{}, false
+	}
+
+	role := Role(asset.Metadata[MetadataRole])
+	if role != RoleActive && role != RoleStandby {
+		return Peer{}, false
+	}
+	priority, err := strconv.Atoi(asset.Metadata[MetadataPriority])
+	if err != nil {
+		return Peer{}, false
+	}
+	epoch, err := strconv.ParseUint(asset.Metadata[MetadataEpoch], 10, 64)
+	if err != nil {
+		return Peer{}, false
+	}
+
+	lastSeen := asset.LastSeen
+	if lastSeen.IsZero() {
+		lastSeen = time.Now()
+	}
+	return Peer{
+		NodeID:   asset.Metadata[MetadataNode],
+		Role:     role,
+		Priority: priority,
+		Epoch:    epoch,
+		LastSeen: lastSeen,
+	}, true
+}
+
+// OnAssetDiscovered implements discovery.AssetDiscoveryListener
+func (h *Heartbeat) OnAssetDiscovered(asset *discovery.AssetInfo) {
+	h.observe(asset)
+}
+
+// OnAssetUpdated implements discovery.AssetDiscoveryListener
+func (h *Heartbeat) OnAssetUpdated(asset *discovery.AssetInfo) {
+	h.observe(asset)
+}
+
+// OnAssetLost implements discovery.AssetDiscoveryListener. A gateway that says goodbye is
+// dropped at once, so a clean shutdown fails over without waiting for the timeout.
+func (h *Heartbeat) OnAssetLost(assetID string) {
+	h.mu.Lock()
+	nodeID, ok := h.assets[assetID]
+	delete(h.assets, assetID)
+	h.mu.Unlock()
+
+	if ok {
+		h.controller.Forget(nodeID)
+	}
+}
+
+// OnQueryReceived implements discovery.AssetDiscoveryListener
+func (h *Heartbeat) OnQueryReceived(query *discovery.Query, sender string) {}
+
+func (h *Heartbeat) observe(asset *discovery.AssetInfo) {
+	peer, ok := PeerFromAsset(asset)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	h.assets[asset.ID] = peer.NodeID
+	h.mu.Unlock()
+
+	before := h.controller.Role()
+	h.controller.Observe(peer)
+	if before == RoleActive && h.controller.Role() != RoleActive {
+		h.update()
+		if err := h.protocol.Announce(); err != nil {
+			h.controller.logger.Error("Failed to announce failover role", err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// ClaimTopic holds the retained claim of the active gateway, a second fencing channel
+	// for gateways whose heartbeats do not reach each other
+	ClaimTopic = "home-automation/failover/active"
+	// StateTopicPrefix holds the active gateway's state files, retained, one per file
+	StateTopicPrefix = "home-automation/failover/state/"
+	// MirrorDirName is the directory inside the state directory where a standby keeps the
+	// active gateway's state files until it takes over
+	MirrorDirName = "failover"
+)
+
+// StateTopic returns the topic a state file is mirrored on
+func StateTopic(name string) string {
+	return StateTopicPrefix + name
+}
+
+// Claim is the retained message the active gateway publishes when it takes over
+type Claim struct {
+	NodeID string    `json:"node_id"`
+	Epoch  uint64    `json:"epoch"`
+	At     time.Time `json:"at"`
+}
+
+// Snapshot is one state file as published by the active gateway
+type Snapshot struct {
+	NodeID    string    `json:"node_id"`
+	Epoch     uint64    `json:"epoch"`
+	Name      string    `json:"name"`
+	Data      []byte    `json:"data"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Replicator mirrors state files from the active gateway to the standby over MQTT. On takeover
+// it moves the mirrored files into place and runs the reload hooks, so services continue from
+// the state the failed gateway left behind.
+type Replicator struct {
+	controller *Controller
+	stateDir   string
+	files      []string
+	publish    func(*mqtt.Message) error
+	sent       map[string]time.Time // Modification time of each file last published
+	mirrored   map[string]uint64    // Epoch of each mirrored file
+	reloads    []func() error
+	logger     *logger.Logger
+	mu         sync.Mutex
+}
+
+// NewReplicator creates a replicator for the named files in stateDir and hooks it into the
+// controller's takeovers
+func NewReplicator(controller *Controller, stateDir string, files []string, serviceLogger *logger.Logger) *Replicator {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Failover", nil)
+	}
+
+	r := &Replicator{
+		controller: controller,
+		stateDir:   stateDir,
+		files:      files,
+		sent:       make(map[string]time.Time),
+		mirrored:   make(map[string]uint64),
+		logger:     serviceLogger,
+	}
+	controller.OnRoleChange(r.roleChanged)
+	return r
+}
+
+// OnTakeover registers a hook that reloads a service's state after the mirrored files are in place
+func (r *Replicator) OnTakeover(reload func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloads = append(r.reloads, reload)
+}
+
+// Subscribe mirrors the active gateway's state files and fences on its claims
+func (r *Replicator) Subscribe(client *mqtt.Client) error {
+	r.mu.Lock()
+	r.publish = client.Publish
+	r.mu.Unlock()
+
+	if err := client.Subscribe(StateTopic("+"), func(topic string, payload []byte) error {
+		return r.receive(payload)
+	}); err != nil {
+		return err
+	}
+
+	return client.Subscribe(ClaimTopic, func(topic string, payload []byte) error {
+		var claim Claim
+		if err := json.Unmarshal(payload, &claim); err != nil {
+			return errors.NewValidationError("invalid failover claim", err)
+		}
+		r.controller.Fence(claim.NodeID, claim.Epoch, time.Now())
+		return nil
+	})
+}
+
+// Run publishes changed state files once per heartbeat while this gateway is active
+func (r *Replicator) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.controller.config.heartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Sync()
+		}
+	}
+}
+
+// Sync publishes the state files changed since they were last published. It does nothing on
+// a standby.
+func (r *Replicator) Sync() {
+	if !r.controller.Active() {
+		return
+	}
+	epoch := r.controller.Epoch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.publish == nil {
+		return
+	}
+
+	for _, name := range r.files {
+		path := filepath.Join(r.stateDir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // Not written yet
+		}
+		if info.ModTime().Equal(r.sent[name]) {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			r.logger.Error("Failed to read state file for the standby", err, map[string]interface{}{
+				"file": name,
+			})
+			continue
+		}
+		payload, err := json.Marshal(Snapshot{
+			NodeID:    r.controller.config.NodeID,
+			Epoch:     epoch,
+			Name:      name,
+			Data:      data,
+			UpdatedAt: info.ModTime(),
+		})
+		if err != nil {
+			continue
+		}
+		if err := r.publish(&mqtt.Message{Topic: StateTopic(name), Payload: payload, QoS: 1, Retain: true}); err != nil {
+			r.logger.Error("Failed to publish state file for the standby", err, map[string]interface{}{
+				"file": name,
+			})
+			continue
+		}
+		r.sent[name] = info.ModTime()
+	}
+}
+
+// receive stores a state file from the active gateway in the mirror directory. A snapshot
+// with a newer epoch fences this gateway; snapshots from an older epoch than the one already
+// mirrored come from a fenced gateway and are dropped.
+func (r *Replicator) receive(payload []byte) error {
+	var snapshot Snapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return errors.NewValidationError("invalid failover state snapshot", err)
+	}
+	if snapshot.NodeID == r.controller.config.NodeID {
+		return nil
+	}
+	r.controller.Fence(snapshot.NodeID, snapshot.Epoch, time.Now())
+	if r.controller.Active() {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.tracked(snapshot.Name) || snapshot.Epoch < r.mirrored[snapshot.Name] {
+		return nil
+	}
+
+	if err := writeAtomic(filepath.Join(r.stateDir, MirrorDirName, snapshot.Name), snapshot.Data); err != nil {
+		return err
+	}
+	r.mirrored[snapshot.Name] = snapshot.Epoch
+	return nil
+}
+
+func (r *Replicator) tracked(name string) bool {
+	for _, file := range r.files {
+		if file == name {
+			return true
+		}
+	}
+	return false
+}
+
+// roleChanged takes over the mirrored state when this gateway becomes active
+func (r *Replicator) roleChanged(role Role, epoch uint64) {
+	if role != RoleActive {
+		return
+	}
+
+	r.mu.Lock()
+	restored := 0
+	for name := range r.mirrored {
+		data, err := os.ReadFile(filepath.Join(r.stateDir, MirrorDirName, name))
+		if err != nil {
+			continue
+		}
+		if err := writeAtomic(filepath.Join(r.stateDir, name), data); err != nil {
+			r.logger.Error("Failed to restore mirrored state file", err, map[string]interface{}{
+				"file": name,
+			})
+			continue
+		}
+		restored++
+	}
+	r.mirrored = make(map[string]uint64)
+	r.sent = make(map[string]time.Time) // The new standby needs every file
+	reloads := r.reloads
+	publish := r.publish
+	r.mu.Unlock()
+
+	r.logger.Info("Restored mirrored state on takeover", map[string]interface{}{
+		"files": restored,
+		"epoch": epoch,
+	})
+	for _, reload := range reloads {
+		if err := reload(); err != nil {
+			r.logger.Error("Failed to reload state on takeover", err)
+		}
+	}
+
+	if publish != nil {
+		payload, _ := json.Marshal(Claim{NodeID: r.controller.config.NodeID, Epoch: epoch, At: time.Now()})
+		if err := publish(&mqtt.Message{Topic: ClaimTopic, Payload: payload, QoS: 1, Retain: true}); err != nil {
+			r.logger.Error("Failed to publish failover claim", err)
+		}
+	}
+	r.Sync()
+}
+
+// writeAtomic writes a file through a temporary file and rename
+func writeAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write state file", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.NewSystemError("failed to replace state file", err)
+	}
+	return nil
+}
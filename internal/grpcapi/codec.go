@@ -0,0 +1,268 @@
+package grpcapi
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of api/proto/homeautomation/v1/home_automation.proto are plain structs whose
+// fields carry their protobuf field number, e.g. `protobuf:"3"`. Marshal and Unmarshal encode
+// them in the protobuf wire format, which is all a gRPC client sees of them.
+//
+// Supported fields: string, bool, int32, int64 and double scalars; *bool, *float64 and
+// *string for proto3 optional fields; time.Time as google.protobuf.Timestamp; pointers to
+// messages; and repeated strings and messages.
+
+// field is one numbered field of a message struct
+type field struct {
+	number protowire.Number
+	index  int
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	fieldsMap sync.Map // reflect.Type -> []field
+)
+
+// messageFields returns the numbered fields of a message struct type
+func messageFields(t reflect.Type) []field {
+	if cached, ok := fieldsMap.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("protobuf")
+		if tag == "" {
+			continue
+		}
+		number, err := strconv.Atoi(tag)
+		if err != nil || !protowire.Number(number).IsValid() {
+			panic(fmt.Sprintf("grpcapi: invalid field number %q on %s.%s", tag, t.Name(), t.Field(i).Name))
+		}
+		fields = append(fields, field{number: protowire.Number(number), index: i})
+	}
+	fieldsMap.Store(t, fields)
+	return fields
+}
+
+// Marshal encodes a pointer to a message struct in the protobuf wire format
+func Marshal(message interface{}) ([]byte, error) {
+	value := reflect.ValueOf(message)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("grpcapi: can't marshal %T, expected a pointer to a message", message)
+	}
+	return appendMessage(nil, value.Elem())
+}
+
+func appendMessage(b []byte, message reflect.Value) ([]byte, error) {
+	var err error
+	for _, f := range messageFields(message.Type()) {
+		if b, err = appendField(b, f.number, message.Field(f.index), false); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendField appends a field, leaving out zero scalars unless the field is optional or an
+// element of a repeated field
+func appendField(b []byte, number protowire.Number, value reflect.Value, always bool) ([]byte, error) {
+	switch value.Kind() {
+	case reflect.String:
+		if value.String() != "" || always {
+			b = protowire.AppendTag(b, number, protowire.BytesType)
+			b = protowire.AppendString(b, value.String())
+		}
+	case reflect.Bool:
+		if value.Bool() || always {
+			b = protowire.AppendTag(b, number, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(value.Bool()))
+		}
+	case reflect.Int32, reflect.Int64, reflect.Int:
+		if value.Int() != 0 || always {
+			b = protowire.AppendTag(b, number, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(value.Int()))
+		}
+	case reflect.Float64:
+		if value.Float() != 0 || always {
+			b = protowire.AppendTag(b, number, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(value.Float()))
+		}
+	case reflect.Ptr:
+		if value.IsNil() {
+			return b, nil
+		}
+		if value.Elem().Kind() != reflect.Struct {
+			return appendField(b, number, value.Elem(), true)
+		}
+		return appendEmbedded(b, number, value.Elem())
+	case reflect.Struct:
+		if value.Type() != timeType {
+			return nil, fmt.Errorf("grpcapi: unsupported field type %s", value.Type())
+		}
+		if t := value.Interface().(time.Time); !t.IsZero() || always {
+			b = protowire.AppendTag(b, number, protowire.BytesType)
+			b = protowire.AppendBytes(b, appendTimestamp(nil, t))
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			var err error
+			if b, err = appendField(b, number, value.Index(i), true); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("grpcapi: unsupported field type %s", value.Type())
+	}
+	return b, nil
+}
+
+func appendEmbedded(b []byte, number protowire.Number, message reflect.Value) ([]byte, error) {
+	encoded, err := appendMessage(nil, message)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, encoded), nil
+}
+
+// appendTimestamp encodes a google.protobuf.Timestamp: seconds = 1, nanos = 2
+func appendTimestamp(b []byte, t time.Time) []byte {
+	if seconds := t.Unix(); seconds != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(nanos))
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf wire format into a pointer to a message struct. Unknown fields
+// are skipped, so older servers accept newer clients.
+func Unmarshal(data []byte, message interface{}) error {
+	value := reflect.ValueOf(message)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("grpcapi: can't unmarshal into %T, expected a pointer to a message", message)
+	}
+	return consumeMessage(data, value.Elem())
+}
+
+func consumeMessage(b []byte, message reflect.Value) error {
+	fields := make(map[protowire.Number]reflect.Value)
+	for _, f := range messageFields(message.Type()) {
+		fields[f.number] = message.Field(f.index)
+	}
+
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		target, known := fields[number]
+		if !known {
+			if n = protowire.ConsumeFieldValue(number, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		n, err := consumeField(b, typ, target)
+		if err != nil {
+			return fmt.Errorf("field %d: %w", number, err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeField decodes one value into a field and returns its length
+func consumeField(b []byte, typ protowire.Type, target reflect.Value) (int, error) {
+	switch target.Kind() {
+	case reflect.Ptr:
+		element := reflect.New(target.Type().Elem())
+		n, err := consumeField(b, typ, element.Elem())
+		if err == nil {
+			target.Set(element)
+		}
+		return n, err
+	case reflect.Slice:
+		element := reflect.New(target.Type().Elem()).Elem()
+		n, err := consumeField(b, typ, element)
+		if err == nil {
+			target.Set(reflect.Append(target, element))
+		}
+		return n, err
+	case reflect.String:
+		if err := expectType(typ, protowire.BytesType); err != nil {
+			return 0, err
+		}
+		v, n := protowire.ConsumeString(b)
+		target.SetString(v)
+		return parsed(n)
+	case reflect.Bool, reflect.Int32, reflect.Int64, reflect.Int:
+		if err := expectType(typ, protowire.VarintType); err != nil {
+			return 0, err
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if target.Kind() == reflect.Bool {
+			target.SetBool(protowire.DecodeBool(v))
+		} else {
+			target.SetInt(int64(v))
+		}
+		return parsed(n)
+	case reflect.Float64:
+		if err := expectType(typ, protowire.Fixed64Type); err != nil {
+			return 0, err
+		}
+		v, n := protowire.ConsumeFixed64(b)
+		target.SetFloat(math.Float64frombits(v))
+		return parsed(n)
+	case reflect.Struct:
+		if err := expectType(typ, protowire.BytesType); err != nil {
+			return 0, err
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return parsed(n)
+		}
+		if target.Type() == timeType {
+			var timestamp struct {
+				Seconds int64 `protobuf:"1"`
+				Nanos   int32 `protobuf:"2"`
+			}
+			if err := consumeMessage(v, reflect.ValueOf(&timestamp).Elem()); err != nil {
+				return 0, err
+			}
+			target.Set(reflect.ValueOf(time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC()))
+			return n, nil
+		}
+		return n, consumeMessage(v, target)
+	}
+	return 0, fmt.Errorf("unsupported field type %s", target.Type())
+}
+
+func expectType(got, want protowire.Type) error {
+	if got != want {
+		return fmt.Errorf("wire type %d, expected %d", got, want)
+	}
+	return nil
+}
+
+func parsed(n int) (int, error) {
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return n, nil
+}
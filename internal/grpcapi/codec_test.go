@@ -0,0 +1,80 @@
+package grpcapi
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	on := false
+	power := 12.5
+	lastSeen := time.Date(2024, 3, 1, 8, 30, 0, 250, time.UTC)
+	original := &ListDevicesResponse{Devices: []*Device{
+		{DeviceID: "lamp", Name: "Desk Lamp", RoomID: "office", Online: true, On: &on, PowerW: &power, LastSeen: lastSeen},
+		{DeviceID: "fan"},
+	}}
+
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	decoded := &ListDevicesResponse{}
+	if err := Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if len(decoded.Devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(decoded.Devices))
+	}
+	lamp := decoded.Devices[0]
+	if lamp.DeviceID != "lamp" || lamp.Name != "Desk Lamp" || lamp.RoomID != "office" || !lamp.Online {
+		t.Errorf("Unexpected lamp: %+v", lamp)
+	}
+	// An optional field set to its zero value still arrives
+	if lamp.On == nil || *lamp.On {
+		t.Errorf("Expected on to be present and false, got %v", lamp.On)
+	}
+	if lamp.PowerW == nil || *lamp.PowerW != 12.5 || lamp.EnergyWh != nil {
+		t.Errorf("Unexpected power %v and energy %v", lamp.PowerW, lamp.EnergyWh)
+	}
+	if !lamp.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected last seen %v, got %v", lastSeen, lamp.LastSeen)
+	}
+	if decoded.Devices[1].DeviceID != "fan" || decoded.Devices[1].On != nil {
+		t.Errorf("Unexpected fan: %+v", decoded.Devices[1])
+	}
+}
+
+func TestCodecWireFormat(t *testing.T) {
+	data, err := Marshal(&SetHoldRequest{ThermostatID: "living", TargetTemp: 70})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	// What protoc-generated code writes for thermostat_id = 1 and target_temp = 2
+	var expected []byte
+	expected = protowire.AppendTag(expected, 1, protowire.BytesType)
+	expected = protowire.AppendString(expected, "living")
+	expected = protowire.AppendTag(expected, 2, protowire.Fixed64Type)
+	expected = protowire.AppendFixed64(expected, 0x4051800000000000)
+	if string(data) != string(expected) {
+		t.Errorf("Expected %x, got %x", expected, data)
+	}
+
+	// Fields this server doesn't know are skipped
+	data = protowire.AppendTag(data, 99, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	decoded := &SetHoldRequest{}
+	if err := Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.ThermostatID != "living" || decoded.TargetTemp != 70 {
+		t.Errorf("Unexpected request: %+v", decoded)
+	}
+
+	if err := Unmarshal([]byte{0x0a, 0x05, 'a'}, decoded); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
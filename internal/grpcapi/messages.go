@@ -0,0 +1,161 @@
+package grpcapi
+
+import "time"
+
+// Messages of api/proto/homeautomation/v1/home_automation.proto, field for field.
+// TestMessagesMatchProto checks them against the file.
+
+type ListRoomsRequest struct{}
+
+type ListRoomsResponse struct {
+	Rooms []*Room `protobuf:"1"`
+}
+
+type GetRoomRequest struct {
+	RoomID string `protobuf:"1"`
+}
+
+type WatchRoomsRequest struct {
+	RoomID string `protobuf:"1"`
+}
+
+type Room struct {
+	RoomID          string    `protobuf:"1"`
+	DeviceID        string    `protobuf:"2"`
+	DeviceUUID      string    `protobuf:"3"`
+	Temperature     float64   `protobuf:"4"`
+	Humidity        float64   `protobuf:"5"`
+	Occupied        bool      `protobuf:"6"`
+	LightLevel      float64   `protobuf:"7"`
+	LightState      string    `protobuf:"8"`
+	LeakDetected    bool      `protobuf:"9"`
+	SmokeDetected   bool      `protobuf:"10"`
+	OpenContacts    []string  `protobuf:"11"`
+	Online          bool      `protobuf:"12"`
+	LastSeen        time.Time `protobuf:"13"`
+	FirmwareVersion string    `protobuf:"14"`
+}
+
+type ListDevicesRequest struct {
+	RoomID string `protobuf:"1"`
+}
+
+type ListDevicesResponse struct {
+	Devices []*Device `protobuf:"1"`
+}
+
+type Device struct {
+	DeviceID string    `protobuf:"1"`
+	Name     string    `protobuf:"2"`
+	RoomID   string    `protobuf:"3"`
+	Online   bool      `protobuf:"4"`
+	On       *bool     `protobuf:"5"`
+	PowerW   *float64  `protobuf:"6"`
+	EnergyWh *float64  `protobuf:"7"`
+	Firmware string    `protobuf:"8"`
+	LastSeen time.Time `protobuf:"9"`
+}
+
+type DeviceCommand struct {
+	DeviceID string   `protobuf:"1"`
+	Tag      string   `protobuf:"2"`
+	Action   string   `protobuf:"3"`
+	Value    *float64 `protobuf:"4"`
+}
+
+type DeviceCommandResponse struct{}
+
+type ListThermostatsRequest struct{}
+
+type ListThermostatsResponse struct {
+	Thermostats []*Thermostat `protobuf:"1"`
+}
+
+type Thermostat struct {
+	ID               string    `protobuf:"1"`
+	Name             string    `protobuf:"2"`
+	RoomID           string    `protobuf:"3"`
+	CurrentTemp      float64   `protobuf:"4"`
+	CurrentHumidity  float64   `protobuf:"5"`
+	TargetTemp       float64   `protobuf:"6"`
+	Mode             string    `protobuf:"7"`
+	Status           string    `protobuf:"8"`
+	Online           bool      `protobuf:"9"`
+	LastSensorUpdate time.Time `protobuf:"10"`
+}
+
+type SetHoldRequest struct {
+	ThermostatID string    `protobuf:"1"`
+	TargetTemp   float64   `protobuf:"2"`
+	Mode         string    `protobuf:"3"`
+	Until        time.Time `protobuf:"4"`
+}
+
+type Hold struct {
+	Mode       string    `protobuf:"1"`
+	TargetTemp float64   `protobuf:"2"`
+	Until      time.Time `protobuf:"3"`
+	SetAt      time.Time `protobuf:"4"`
+}
+
+type ResumeScheduleRequest struct {
+	ThermostatID string `protobuf:"1"`
+}
+
+type ResumeScheduleResponse struct{}
+
+type WatchThermostatsRequest struct {
+	ThermostatID string `protobuf:"1"`
+}
+
+type GetHomeModeRequest struct{}
+
+type HomeMode struct {
+	Mode     string    `protobuf:"1"`
+	Source   string    `protobuf:"2"`
+	Occupied bool      `protobuf:"3"`
+	Since    time.Time `protobuf:"4"`
+}
+
+type SetHomeModeRequest struct {
+	Mode          string  `protobuf:"1"`
+	DurationHours float64 `protobuf:"2"`
+}
+
+type ListAlertRulesRequest struct{}
+
+type ListAlertRulesResponse struct {
+	Rules  []*AlertRule `protobuf:"1"`
+	Active []*Alert     `protobuf:"2"`
+}
+
+type AlertRule struct {
+	ID       string `protobuf:"1"`
+	Name     string `protobuf:"2"`
+	Metric   string `protobuf:"3"`
+	Severity string `protobuf:"4"`
+	Disabled bool   `protobuf:"5"`
+}
+
+type Alert struct {
+	ID       string    `protobuf:"1"`
+	RuleID   string    `protobuf:"2"`
+	Subject  string    `protobuf:"3"`
+	Severity string    `protobuf:"4"`
+	Message  string    `protobuf:"5"`
+	Value    float64   `protobuf:"6"`
+	FiredAt  time.Time `protobuf:"7"`
+}
+
+type EnableAlertRuleRequest struct {
+	RuleID  string `protobuf:"1"`
+	Enabled bool   `protobuf:"2"`
+}
+
+type EnableAlertRuleResponse struct{}
+
+type RecallSceneRequest struct {
+	Name string `protobuf:"1"`
+}
+
+type RecallSceneResponse struct{}
@@ -0,0 +1,476 @@
+package grpcapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb" // Registers google/protobuf/timestamp.proto
+
+	"github.com/johnpr01/home-automation/internal/services"
+)
+
+const protoPath = "../../api/proto/homeautomation/v1/home_automation.proto"
+
+var protoTokens = regexp.MustCompile(`[A-Za-z0-9_.]+|"[^"]*"|[{}()=;]`)
+
+// loadProto reads the API's .proto file into a descriptor, resolved against the well-known
+// types by protobuf-go. It reads the subset of the language the file uses: messages of scalar,
+// message, repeated and optional fields, and services of unary and server-streaming methods.
+func loadProto(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	data, err := os.ReadFile(protoPath)
+	if err != nil {
+		t.Fatalf("Failed to read the proto file: %v", err)
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		tokens = append(tokens, protoTokens.FindAllString(line, -1)...)
+	}
+
+	file := &descriptorpb.FileDescriptorProto{Name: proto.String("homeautomation/v1/home_automation.proto"), Syntax: proto.String("proto3")}
+	scalars := make(map[string]descriptorpb.FieldDescriptorProto_Type)
+	for value, name := range descriptorpb.FieldDescriptorProto_Type_name {
+		if name != "TYPE_MESSAGE" && name != "TYPE_GROUP" && name != "TYPE_ENUM" {
+			scalars[strings.ToLower(strings.TrimPrefix(name, "TYPE_"))] = descriptorpb.FieldDescriptorProto_Type(value)
+		}
+	}
+	typeName := func(name string) *string {
+		if strings.Contains(name, ".") {
+			return proto.String("." + name)
+		}
+		return proto.String("." + file.GetPackage() + "." + name)
+	}
+	expect := func(i int, want string) {
+		if i >= len(tokens) || tokens[i] != want {
+			t.Fatalf("Unexpected proto syntax near token %d %v, expected %q", i, tokens[max(0, i-3):min(len(tokens), i+3)], want)
+		}
+	}
+
+	for i := 0; i < len(tokens); {
+		switch tokens[i] {
+		case "syntax", "option":
+			for tokens[i] != ";" {
+				i++
+			}
+			i++
+		case "package":
+			file.Package = proto.String(tokens[i+1])
+			i += 3
+		case "import":
+			file.Dependency = append(file.Dependency, strings.Trim(tokens[i+1], `"`))
+			i += 3
+		case "message":
+			message := &descriptorpb.DescriptorProto{Name: proto.String(tokens[i+1])}
+			expect(i+2, "{")
+			for i += 3; tokens[i] != "}"; i++ {
+				field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+				switch tokens[i] {
+				case "repeated":
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					i++
+				case "optional":
+					field.Proto3Optional = proto.Bool(true)
+					i++
+				}
+				if scalar, ok := scalars[tokens[i]]; ok {
+					field.Type = scalar.Enum()
+				} else {
+					field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+					field.TypeName = typeName(tokens[i])
+				}
+				field.Name = proto.String(tokens[i+1])
+				expect(i+2, "=")
+				number, err := strconv.Atoi(tokens[i+3])
+				if err != nil {
+					t.Fatalf("Invalid field number %q of %s.%s", tokens[i+3], message.GetName(), field.GetName())
+				}
+				field.Number = proto.Int32(int32(number))
+				expect(i+4, ";")
+				if field.GetProto3Optional() {
+					field.OneofIndex = proto.Int32(int32(len(message.OneofDecl)))
+					message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + field.GetName())})
+				}
+				message.Field = append(message.Field, field)
+				i += 4
+			}
+			file.MessageType = append(file.MessageType, message)
+			i++
+		case "service":
+			service := &descriptorpb.ServiceDescriptorProto{Name: proto.String(tokens[i+1])}
+			expect(i+2, "{")
+			for i += 3; tokens[i] != "}"; {
+				expect(i, "rpc")
+				method := &descriptorpb.MethodDescriptorProto{Name: proto.String(tokens[i+1]), InputType: typeName(tokens[i+3])}
+				expect(i+5, "returns")
+				i += 7
+				if tokens[i] == "stream" {
+					method.ServerStreaming = proto.Bool(true)
+					i++
+				}
+				method.OutputType = typeName(tokens[i])
+				expect(i+1, ")")
+				expect(i+2, ";")
+				service.Method = append(service.Method, method)
+				i += 3
+			}
+			file.Service = append(file.Service, service)
+			i++
+		default:
+			t.Fatalf("Unexpected proto token %q", tokens[i])
+		}
+	}
+
+	descriptor, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("The proto file doesn't resolve: %v", err)
+	}
+	return descriptor
+}
+
+// messageStructs lists the struct types declared in messages.go
+func messageStructs(t *testing.T) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "messages.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse messages.go: %v", err)
+	}
+	var names []string
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+			for _, spec := range gen.Specs {
+				names = append(names, spec.(*ast.TypeSpec).Name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// registeredTypes collects the message structs the methods of a server use, with the messages
+// they contain
+func registeredTypes(s *Server) map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t == timeType || types[t.Name()] != nil {
+			return
+		}
+		types[t.Name()] = t
+		for i := 0; i < t.NumField(); i++ {
+			add(t.Field(i).Type)
+		}
+	}
+	for _, m := range s.methods {
+		add(reflect.TypeOf(m.request()))
+		add(reflect.TypeOf(m.response()))
+	}
+	return types
+}
+
+// checkField reports how a struct field differs from the proto field it is numbered after
+func checkField(goField reflect.StructField, fd protoreflect.FieldDescriptor) error {
+	if strings.ToLower(goField.Name) != strings.ReplaceAll(string(fd.Name()), "_", "") {
+		return fmt.Errorf("named %s in the proto", fd.Name())
+	}
+	t := goField.Type
+	switch {
+	case fd.IsList():
+		if t.Kind() != reflect.Slice {
+			return fmt.Errorf("repeated in the proto, but a %s", t)
+		}
+		t = t.Elem()
+	case fd.HasOptionalKeyword():
+		if t.Kind() != reflect.Ptr {
+			return fmt.Errorf("optional in the proto, but a %s", t)
+		}
+		t = t.Elem()
+	}
+
+	scalars := map[protoreflect.Kind]reflect.Kind{
+		protoreflect.StringKind: reflect.String,
+		protoreflect.BoolKind:   reflect.Bool,
+		protoreflect.DoubleKind: reflect.Float64,
+		protoreflect.Int32Kind:  reflect.Int32,
+		protoreflect.Int64Kind:  reflect.Int64,
+	}
+	if kind, ok := scalars[fd.Kind()]; ok {
+		if t.Kind() != kind {
+			return fmt.Errorf("a %s in the proto, but a %s", fd.Kind(), t)
+		}
+		return nil
+	}
+	if fd.Kind() != protoreflect.MessageKind {
+		return fmt.Errorf("of proto type %s, which the codec doesn't support", fd.Kind())
+	}
+	if fd.Message().FullName() == "google.protobuf.Timestamp" {
+		if t != timeType {
+			return fmt.Errorf("a Timestamp in the proto, but a %s", t)
+		}
+		return nil
+	}
+	if t.Kind() != reflect.Ptr || t.Elem().Name() != string(fd.Message().Name()) {
+		return fmt.Errorf("a %s in the proto, but a %s", fd.Message().Name(), t)
+	}
+	return nil
+}
+
+func TestMessagesMatchProto(t *testing.T) {
+	file := loadProto(t)
+	server := NewServer(nil)
+	Register(server, Services{})
+	types := registeredTypes(server)
+
+	// Every struct is a message of the proto, and every message a struct
+	structs := messageStructs(t)
+	if len(structs) != file.Messages().Len() {
+		t.Errorf("messages.go declares %d messages, the proto %d", len(structs), file.Messages().Len())
+	}
+	for _, name := range structs {
+		if file.Messages().ByName(protoreflect.Name(name)) == nil {
+			t.Errorf("%s isn't a message of the proto", name)
+		}
+		if types[name] == nil {
+			t.Errorf("%s isn't used by any registered method", name)
+		}
+	}
+
+	for i := 0; i < file.Messages().Len(); i++ {
+		md := file.Messages().Get(i)
+		goType, ok := types[string(md.Name())]
+		if !ok {
+			t.Errorf("Message %s has no struct", md.Name())
+			continue
+		}
+		numbered := make(map[protowire.Number]bool)
+		for _, f := range messageFields(goType) {
+			goField := goType.Field(f.index)
+			fd := md.Fields().ByNumber(f.number)
+			if fd == nil {
+				t.Errorf("%s.%s has field number %d, which %s doesn't have", md.Name(), goField.Name, f.number, md.Name())
+				continue
+			}
+			if err := checkField(goField, fd); err != nil {
+				t.Errorf("%s.%s (%d) is %v", md.Name(), goField.Name, f.number, err)
+			}
+			numbered[f.number] = true
+		}
+		for j := 0; j < md.Fields().Len(); j++ {
+			if fd := md.Fields().Get(j); !numbered[fd.Number()] {
+				t.Errorf("%s.%s (%d) has no struct field", md.Name(), fd.Name(), fd.Number())
+			}
+		}
+	}
+
+	// Every method of the proto is registered with its messages, and nothing else is
+	methods := 0
+	for i := 0; i < file.Services().Len(); i++ {
+		sd := file.Services().Get(i)
+		for j := 0; j < sd.Methods().Len(); j++ {
+			md := sd.Methods().Get(j)
+			methods++
+			name := fmt.Sprintf("/%s/%s", sd.FullName(), md.Name())
+			m, ok := server.methods[name]
+			if !ok {
+				t.Errorf("%s isn't registered", name)
+				continue
+			}
+			if got := reflect.TypeOf(m.request()).Elem().Name(); got != string(md.Input().Name()) {
+				t.Errorf("%s takes a %s, the proto a %s", name, got, md.Input().Name())
+			}
+			if got := reflect.TypeOf(m.response()).Elem().Name(); got != string(md.Output().Name()) {
+				t.Errorf("%s answers a %s, the proto a %s", name, got, md.Output().Name())
+			}
+			if (m.stream != nil) != md.IsStreamingServer() || md.IsStreamingClient() {
+				t.Errorf("%s streams differently than the proto", name)
+			}
+		}
+	}
+	if methods != len(server.methods) {
+		t.Errorf("The proto has %d methods, the server %d", methods, len(server.methods))
+	}
+}
+
+// fillMessage sets every field of a message to a value unlike its default
+func fillMessage(m protoreflect.Message) {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		value := func() protoreflect.Value {
+			switch fd.Kind() {
+			case protoreflect.StringKind:
+				return protoreflect.ValueOfString(string(fd.Name()) + " é")
+			case protoreflect.BoolKind:
+				return protoreflect.ValueOfBool(true)
+			case protoreflect.DoubleKind:
+				return protoreflect.ValueOfFloat64(float64(fd.Number()) + 0.25)
+			case protoreflect.Int32Kind:
+				return protoreflect.ValueOfInt32(-int32(fd.Number()))
+			case protoreflect.Int64Kind:
+				return protoreflect.ValueOfInt64(1 << 40)
+			case protoreflect.MessageKind:
+			default:
+				return fd.Default()
+			}
+			element := dynamicpb.NewMessage(fd.Message())
+			if fd.Message().FullName() == "google.protobuf.Timestamp" {
+				element.Set(fd.Message().Fields().ByName("seconds"), protoreflect.ValueOfInt64(1752537600))
+				element.Set(fd.Message().Fields().ByName("nanos"), protoreflect.ValueOfInt32(250))
+			} else {
+				fillMessage(element)
+			}
+			return protoreflect.ValueOfMessage(element)
+		}
+		if fd.IsList() {
+			list := m.Mutable(fd).List()
+			list.Append(value())
+			list.Append(value())
+			continue
+		}
+		m.Set(fd, value())
+	}
+}
+
+func TestMessagesRoundTripWithProtobuf(t *testing.T) {
+	file := loadProto(t)
+	server := NewServer(nil)
+	Register(server, Services{})
+	types := registeredTypes(server)
+
+	for i := 0; i < file.Messages().Len(); i++ {
+		md := file.Messages().Get(i)
+		want := dynamicpb.NewMessage(md)
+		fillMessage(want)
+		encoded, err := proto.Marshal(want)
+		if err != nil {
+			t.Fatalf("%s: proto.Marshal failed: %v", md.Name(), err)
+		}
+
+		message := reflect.New(types[string(md.Name())]).Interface()
+		if err := Unmarshal(encoded, message); err != nil {
+			t.Errorf("%s: Unmarshal of protobuf's encoding failed: %v", md.Name(), err)
+			continue
+		}
+		reencoded, err := Marshal(message)
+		if err != nil {
+			t.Errorf("%s: Marshal failed: %v", md.Name(), err)
+			continue
+		}
+		got := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(reencoded, got); err != nil {
+			t.Errorf("%s: protobuf can't read Marshal's encoding: %v", md.Name(), err)
+			continue
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("%s changed on the way through the codec:\nwant %v\ngot  %v", md.Name(), want, got)
+		}
+	}
+}
+
+// protoCall makes a unary call with messages protobuf encodes and decodes from the proto's
+// descriptor, as a client generated from the .proto would, and returns the response and status
+func protoCall(t *testing.T, client *http.Client, url string, method protoreflect.MethodDescriptor, request proto.Message) (*dynamicpb.Message, Code, string) {
+	t.Helper()
+	data, err := proto.Marshal(request)
+	if err != nil {
+		t.Fatalf("proto.Marshal failed: %v", err)
+	}
+	body := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(data)))
+	httpRequest, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s/%s", url, method.Parent().FullName(), method.Name()), bytes.NewReader(append(body, data...)))
+	httpRequest.Header.Set("Content-Type", "application/grpc+proto")
+	httpRequest.Header.Set("TE", "trailers")
+	httpRequest.Header.Set("Grpc-Timeout", "5S")
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK || httpResponse.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("Expected a gRPC response, got %s %s", httpResponse.Status, httpResponse.Header.Get("Content-Type"))
+	}
+
+	response := dynamicpb.NewMessage(method.Output())
+	payload, _ := io.ReadAll(httpResponse.Body)
+	if len(payload) > 0 {
+		if len(payload) < 5 || payload[0] != 0 || int(binary.BigEndian.Uint32(payload[1:5])) != len(payload)-5 {
+			t.Fatalf("Expected one length-prefixed message, got % x", payload)
+		}
+		if err := proto.Unmarshal(payload[5:], response); err != nil {
+			t.Fatalf("proto.Unmarshal failed: %v", err)
+		}
+	}
+	code, err := strconv.Atoi(httpResponse.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("Expected a grpc-status trailer, got %v", httpResponse.Trailer)
+	}
+	return response, Code(code), httpResponse.Trailer.Get("Grpc-Message")
+}
+
+func TestCallsFromProtoDescriptor(t *testing.T) {
+	file := loadProto(t)
+	seen := time.Date(2026, 7, 15, 8, 30, 0, 0, time.UTC)
+	rooms := &fakeRooms{rooms: map[string]*services.RoomSensorData{
+		"office": {RoomID: "office", Temperature: 71.5, IsOccupied: true, LastSeen: seen},
+	}}
+	devices := &fakeDevices{}
+	server := NewServer(nil)
+	Register(server, Services{Rooms: rooms, Devices: devices})
+	httpServer, client := startServer(t, server)
+
+	sensors := file.Services().ByName("SensorService")
+	getRoom := sensors.Methods().ByName("GetRoom")
+	request := dynamicpb.NewMessage(getRoom.Input())
+	request.Set(getRoom.Input().Fields().ByName("room_id"), protoreflect.ValueOfString("office"))
+	room, code, message := protoCall(t, client, httpServer.URL, getRoom, request)
+	if code != OK {
+		t.Fatalf("Expected OK, got %d: %s", code, message)
+	}
+	fields := getRoom.Output().Fields()
+	lastSeen := room.Get(fields.ByName("last_seen")).Message()
+	if room.Get(fields.ByName("room_id")).String() != "office" || room.Get(fields.ByName("temperature")).Float() != 71.5 ||
+		!room.Get(fields.ByName("occupied")).Bool() || lastSeen.Get(lastSeen.Descriptor().Fields().ByName("seconds")).Int() != seen.Unix() {
+		t.Errorf("Unexpected room %v", room)
+	}
+
+	request.Set(getRoom.Input().Fields().ByName("room_id"), protoreflect.ValueOfString("attic"))
+	if _, code, message := protoCall(t, client, httpServer.URL, getRoom, request); code != NotFound || message == "" {
+		t.Errorf("Expected NotFound with a message for an unknown room, got %d %q", code, message)
+	}
+
+	sendCommand := file.Services().ByName("DeviceService").Methods().ByName("SendCommand")
+	command := dynamicpb.NewMessage(sendCommand.Input())
+	commandFields := sendCommand.Input().Fields()
+	command.Set(commandFields.ByName("device_id"), protoreflect.ValueOfString("lamp"))
+	command.Set(commandFields.ByName("action"), protoreflect.ValueOfString("set_brightness"))
+	command.Set(commandFields.ByName("value"), protoreflect.ValueOfFloat64(0))
+	if _, code, message := protoCall(t, client, httpServer.URL, sendCommand, command); code != OK {
+		t.Fatalf("Expected OK, got %d: %s", code, message)
+	}
+	// An optional value that is set arrives even when it is zero
+	if len(devices.commands) != 1 || devices.commands[0].DeviceID != "lamp" || devices.commands[0].Value != 0.0 {
+		t.Errorf("Unexpected commands %+v", devices.commands)
+	}
+}
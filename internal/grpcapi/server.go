@@ -0,0 +1,336 @@
+// Package grpcapi serves the gRPC API of api/proto/homeautomation/v1/home_automation.proto, for
+// services in other languages that want typed messages and streamed readings rather than
+// polling the REST API. It speaks the gRPC protocol over HTTP/2 without TLS (h2c), so standard
+// gRPC clients connect with insecure credentials; put a TLS proxy in front of it to reach it
+// from outside the home network.
+package grpcapi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// maxMessageSize bounds a request message, like the 4 MB default of gRPC servers
+const maxMessageSize = 4 << 20
+
+// Code is a gRPC status code
+type Code int
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// Status is an error answered with a gRPC status code
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status error
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// statusOf maps an error to its gRPC status: invalid requests to InvalidArgument and
+// conflicts to FailedPrecondition, like the REST API's 400 and 409
+func statusOf(err error) *Status {
+	switch e := err.(type) {
+	case *Status:
+		return e
+	case *errors.HomeAutomationError:
+		switch e.Type {
+		case errors.ErrorTypeValidation, errors.ErrorTypeConfig:
+			return &Status{Code: InvalidArgument, Message: e.Error()}
+		case errors.ErrorTypeBusiness:
+			return &Status{Code: FailedPrecondition, Message: e.Error()}
+		case errors.ErrorTypeConnection, errors.ErrorTypeDevice:
+			return &Status{Code: Unavailable, Message: e.Error()}
+		}
+	}
+	if err == context.Canceled {
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+	if err == context.DeadlineExceeded {
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	}
+	return &Status{Code: Internal, Message: err.Error()}
+}
+
+// method is a registered RPC; stream is nil for unary methods
+type method struct {
+	write    bool // Changes something, so needs a resident's token and isn't served read-only
+	request  func() interface{}
+	response func() interface{}
+	unary    func(ctx context.Context, request interface{}) (interface{}, error)
+	stream   func(ctx context.Context, request interface{}, send func(interface{}) error) error
+}
+
+// Server serves registered gRPC methods by their full name, e.g.
+// /homeautomation.v1.SensorService/ListRooms
+type Server struct {
+	methods  map[string]*method
+	read     func(http.Handler) http.Handler
+	write    func(http.Handler) http.Handler
+	readOnly bool
+	logger   *logger.Logger
+}
+
+// NewServer creates a server without methods; Register adds the home's services
+func NewServer(serviceLogger *logger.Logger) *Server {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("GRPC", nil)
+	}
+
+	passThrough := func(next http.Handler) http.Handler { return next }
+	return &Server{
+		methods: make(map[string]*method),
+		read:    passThrough,
+		write:   passThrough,
+		logger:  serviceLogger,
+	}
+}
+
+// SetAuthorization wraps the methods that read and those that change something, e.g. with
+// access.Manager's Authenticate and Require. The bearer token goes in the authorization
+// metadata. A refused call ends with HTTP 401 or 403, which clients report as Unauthenticated
+// or PermissionDenied.
+func (s *Server) SetAuthorization(read, write func(http.Handler) http.Handler) {
+	s.read, s.write = read, write
+}
+
+// SetReadOnly refuses the methods that change something with PermissionDenied, for a read replica
+func (s *Server) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// Unary registers a method answering one request with one response
+func Unary[Req, Resp any](s *Server, name string, write bool, handler func(ctx context.Context, request *Req) (*Resp, error)) {
+	s.methods[name] = &method{
+		write:    write,
+		request:  func() interface{} { return new(Req) },
+		response: func() interface{} { return new(Resp) },
+		unary: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return handler(ctx, request.(*Req))
+		},
+	}
+}
+
+// Stream registers a method answering one request with responses until it returns
+func Stream[Req, Resp any](s *Server, name string, handler func(ctx context.Context, request *Req, send func(*Resp) error) error) {
+	s.methods[name] = &method{
+		request:  func() interface{} { return new(Req) },
+		response: func() interface{} { return new(Resp) },
+		stream: func(ctx context.Context, request interface{}, send func(interface{}) error) error {
+			return handler(ctx, request.(*Req), func(response *Resp) error { return send(response) })
+		},
+	}
+}
+
+// Handler serves the registered methods over HTTP/2. Serve wraps it for clients without TLS.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for name, m := range s.methods {
+		handler := s.serveMethod(m)
+		if m.write {
+			mux.Handle(name, s.write(handler))
+		} else {
+			mux.Handle(name, s.read(handler))
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, known := s.methods[r.URL.Path]; !known {
+			writeStatus(w, &Status{Code: Unimplemented, Message: "unknown method " + r.URL.Path})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Serve listens on addr until the context is cancelled, which also ends open streams
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(s.Handler(), &http2.Server{}),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	s.logger.Info("gRPC server listening", map[string]interface{}{
+		"addr":    addr,
+		"methods": len(s.methods),
+	})
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.NewSystemError("gRPC server failed", err)
+	}
+	return nil
+}
+
+func (s *Server) serveMethod(m *method) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests are POSTed as application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+		if m.write && s.readOnly {
+			writeStatus(w, &Status{Code: PermissionDenied, Message: "this gateway is a read replica"})
+			return
+		}
+
+		ctx := r.Context()
+		if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		request := m.request()
+		if err := readMessage(r.Body, request); err != nil {
+			writeStatus(w, statusOf(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		if m.stream == nil {
+			response, err := m.unary(ctx, request)
+			if err == nil {
+				err = writeMessage(w, response)
+			}
+			writeStatus(w, statusOrOK(err))
+			return
+		}
+
+		err := m.stream(ctx, request, func(response interface{}) error {
+			return writeMessage(w, response)
+		})
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		writeStatus(w, statusOrOK(err))
+	})
+}
+
+// readMessage reads the single length-prefixed message of a request
+func readMessage(body io.Reader, request interface{}) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return Errorf(InvalidArgument, "missing request message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return Errorf(ResourceExhausted, "request message of %d bytes is larger than %d", size, maxMessageSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return Errorf(InvalidArgument, "truncated request message: %v", err)
+	}
+	if err := Unmarshal(data, request); err != nil {
+		return Errorf(InvalidArgument, "invalid request message: %v", err)
+	}
+	return nil
+}
+
+// writeMessage writes a length-prefixed response message and flushes it to the client
+func writeMessage(w http.ResponseWriter, response interface{}) error {
+	data, err := Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	if _, err := w.Write(append(frame, data...)); err != nil {
+		return err
+	}
+	// Flushed through wrappers such as the access log's, so streamed messages arrive at once
+	return http.NewResponseController(w).Flush()
+}
+
+func statusOrOK(err error) *Status {
+	if err == nil {
+		return &Status{Code: OK}
+	}
+	return statusOf(err)
+}
+
+// writeStatus ends the call with the grpc-status and grpc-message trailers
+func writeStatus(w http.ResponseWriter, status *Status) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/grpc")
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// encodeMessage percent-encodes a status message as gRPC requires
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseTimeout reads a grpc-timeout header, e.g. 250m for 250 milliseconds
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	return time.Duration(n) * unit, ok
+}
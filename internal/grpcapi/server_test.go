@@ -0,0 +1,245 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/services"
+)
+
+type fakeRooms struct {
+	rooms       map[string]*services.RoomSensorData
+	temperature func(roomID string, temperature float64)
+}
+
+func (f *fakeRooms) GetAllRoomSensors() map[string]*services.RoomSensorData { return f.rooms }
+
+func (f *fakeRooms) GetRoomSensorData(roomID string) (*services.RoomSensorData, bool) {
+	data, exists := f.rooms[roomID]
+	return data, exists
+}
+
+func (f *fakeRooms) AddTemperatureCallback(callback func(string, float64)) { f.temperature = callback }
+func (f *fakeRooms) AddMotionCallback(func(string, bool))                  {}
+func (f *fakeRooms) AddLightCallback(func(string, string, float64))        {}
+func (f *fakeRooms) AddHazardCallback(func(string, string, bool))          {}
+
+type fakeDevices struct {
+	commands []*models.DeviceCommand
+}
+
+func (f *fakeDevices) Devices() []services.MQTTDeviceStatus { return nil }
+
+func (f *fakeDevices) ExecuteCommand(cmd *models.DeviceCommand) error {
+	if cmd.DeviceID == "missing" {
+		return errors.NewValidationError("device missing not found", nil)
+	}
+	f.commands = append(f.commands, cmd)
+	return nil
+}
+
+// recorder hides the Flusher of the writer it wraps, like the access log's
+type recorder struct {
+	http.ResponseWriter
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// startServer serves the API over h2c and returns a client speaking HTTP/2 without TLS, as
+// gRPC clients with insecure credentials do
+func startServer(t *testing.T, server *Server) (*httptest.Server, *http.Client) {
+	t.Helper()
+	httpServer := httptest.NewServer(h2c.NewHandler(server.Handler(), &http2.Server{}))
+	t.Cleanup(httpServer.Close)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	return httpServer, client
+}
+
+func frame(t *testing.T, message interface{}) []byte {
+	t.Helper()
+	data, err := Marshal(message)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	return append(prefix, data...)
+}
+
+func readFrame(t *testing.T, body io.Reader, message interface{}) {
+	t.Helper()
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		t.Fatalf("Failed to read a message: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(body, data); err != nil {
+		t.Fatalf("Failed to read a message: %v", err)
+	}
+	if err := Unmarshal(data, message); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+}
+
+func post(ctx context.Context, t *testing.T, client *http.Client, url string, request interface{}) *http.Response {
+	t.Helper()
+	httpRequest, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(frame(t, request)))
+	httpRequest.Header.Set("Content-Type", "application/grpc")
+	httpRequest.Header.Set("TE", "trailers")
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	return response
+}
+
+// call makes a unary call and returns its status code
+func call(t *testing.T, client *http.Client, url string, request, response interface{}) Code {
+	t.Helper()
+	httpResponse := post(context.Background(), t, client, url, request)
+	defer httpResponse.Body.Close()
+
+	body, _ := io.ReadAll(httpResponse.Body)
+	code, _ := strconv.Atoi(httpResponse.Trailer.Get("Grpc-Status"))
+	if Code(code) == OK {
+		readFrame(t, bytes.NewReader(body), response)
+	}
+	return Code(code)
+}
+
+func TestUnaryCalls(t *testing.T) {
+	rooms := &fakeRooms{rooms: map[string]*services.RoomSensorData{
+		"office":  {RoomID: "office", Temperature: 71.5, IsOccupied: true},
+		"kitchen": {RoomID: "kitchen", Temperature: 68},
+	}}
+	devices := &fakeDevices{}
+	server := NewServer(nil)
+	Register(server, Services{Rooms: rooms, Devices: devices})
+	httpServer, client := startServer(t, server)
+
+	listed := &ListRoomsResponse{}
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.SensorService/ListRooms", &ListRoomsRequest{}, listed); code != OK {
+		t.Fatalf("Expected OK, got %d", code)
+	}
+	if len(listed.Rooms) != 2 || listed.Rooms[0].RoomID != "kitchen" || listed.Rooms[1].Temperature != 71.5 || !listed.Rooms[1].Occupied {
+		t.Errorf("Unexpected rooms: %+v", listed.Rooms)
+	}
+
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.SensorService/GetRoom", &GetRoomRequest{RoomID: "attic"}, &Room{}); code != NotFound {
+		t.Errorf("Expected NotFound for an unknown room, got %d", code)
+	}
+
+	value := 40.0
+	command := &DeviceCommand{DeviceID: "lamp", Action: "set_brightness", Value: &value}
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.DeviceService/SendCommand", command, &DeviceCommandResponse{}); code != OK {
+		t.Fatalf("Expected OK, got %d", code)
+	}
+	if len(devices.commands) != 1 || devices.commands[0].Value != 40.0 {
+		t.Errorf("Unexpected commands: %+v", devices.commands)
+	}
+
+	command = &DeviceCommand{DeviceID: "missing", Action: "turn_on"}
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.DeviceService/SendCommand", command, &DeviceCommandResponse{}); code != InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a validation error, got %d", code)
+	}
+
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.AutomationService/GetHomeMode", &GetHomeModeRequest{}, &HomeMode{}); code != Unimplemented {
+		t.Errorf("Expected Unimplemented without a home mode service, got %d", code)
+	}
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.SensorService/Nothing", &ListRoomsRequest{}, &Room{}); code != Unimplemented {
+		t.Errorf("Expected Unimplemented for an unknown method, got %d", code)
+	}
+
+	server.SetReadOnly(true)
+	command = &DeviceCommand{DeviceID: "lamp", Action: "turn_on"}
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.DeviceService/SendCommand", command, &DeviceCommandResponse{}); code != PermissionDenied {
+		t.Errorf("Expected PermissionDenied on a read replica, got %d", code)
+	}
+}
+
+func TestWatchRoomsStreamsReadings(t *testing.T) {
+	rooms := &fakeRooms{rooms: map[string]*services.RoomSensorData{
+		"office":  {RoomID: "office", Temperature: 71.5},
+		"kitchen": {RoomID: "kitchen", Temperature: 68},
+	}}
+	server := NewServer(nil)
+	Register(server, Services{Rooms: rooms})
+	recorded := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&recorder{ResponseWriter: w}, r)
+		})
+	}
+	server.SetAuthorization(recorded, recorded)
+	httpServer, client := startServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response := post(ctx, t, client, httpServer.URL+"/homeautomation.v1.SensorService/WatchRooms", &WatchRoomsRequest{RoomID: "office"})
+	defer response.Body.Close()
+
+	room := &Room{}
+	readFrame(t, response.Body, room)
+	if room.RoomID != "office" || room.Temperature != 71.5 {
+		t.Errorf("Expected the office as it is first, got %+v", room)
+	}
+
+	// Readings of other rooms are left out of the stream
+	rooms.rooms["kitchen"].Temperature = 69
+	rooms.temperature("kitchen", 69)
+	rooms.rooms["office"].Temperature = 72
+	rooms.temperature("office", 72)
+
+	room = &Room{}
+	readFrame(t, response.Body, room)
+	if room.RoomID != "office" || room.Temperature != 72 {
+		t.Errorf("Expected the office's new reading, got %+v", room)
+	}
+}
+
+func TestAuthorizationWrapsWriteMethods(t *testing.T) {
+	server := NewServer(nil)
+	Register(server, Services{Devices: &fakeDevices{}})
+	server.SetAuthorization(
+		func(next http.Handler) http.Handler { return next },
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer resident" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		},
+	)
+	httpServer, client := startServer(t, server)
+
+	if code := call(t, client, httpServer.URL+"/homeautomation.v1.DeviceService/ListDevices", &ListDevicesRequest{}, &ListDevicesResponse{}); code != OK {
+		t.Errorf("Expected reads to pass, got %d", code)
+	}
+
+	response := post(context.Background(), t, client, httpServer.URL+"/homeautomation.v1.DeviceService/SendCommand", &DeviceCommand{DeviceID: "lamp", Action: "turn_on"})
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a command without a token to be refused, got %d", response.StatusCode)
+	}
+}
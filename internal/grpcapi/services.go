@@ -0,0 +1,435 @@
+package grpcapi
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/services"
+)
+
+// RoomSensors reads the rooms and reports new readings, like UnifiedSensorService
+type RoomSensors interface {
+	GetAllRoomSensors() map[string]*services.RoomSensorData
+	GetRoomSensorData(roomID string) (*services.RoomSensorData, bool)
+	AddTemperatureCallback(callback func(roomID string, temperature float64))
+	AddMotionCallback(callback func(roomID string, occupied bool))
+	AddLightCallback(callback func(roomID string, lightState string, lightLevel float64))
+	AddHazardCallback(callback func(roomID string, hazard string, detected bool))
+}
+
+// DeviceController lists and switches devices, like MQTTDeviceService
+type DeviceController interface {
+	Devices() []services.MQTTDeviceStatus
+	ExecuteCommand(cmd *models.DeviceCommand) error
+}
+
+// Thermostats lists thermostats and reports when they start or stop, like ThermostatService
+type Thermostats interface {
+	GetAllThermostats() []*models.Thermostat
+	AddStatusCallback(callback func(models.Thermostat))
+}
+
+// ThermostatHolds holds and resumes thermostat schedules, like ScheduleService
+type ThermostatHolds interface {
+	Hold(thermostatID string, hold models.ThermostatHold, now time.Time) (*models.ThermostatHold, error)
+	Resume(thermostatID string, now time.Time) error
+}
+
+// HomeModes reads and sets the home mode, like HomeModeService
+type HomeModes interface {
+	Status(now time.Time) services.HomeModeStatus
+	Set(mode string, duration time.Duration, now time.Time) (services.HomeModeStatus, error)
+}
+
+// AlertRules lists and switches alert rules, like AlertService
+type AlertRules interface {
+	Rules() []services.AlertRule
+	Active() []services.Alert
+	EnableRule(id string, enabled bool) error
+}
+
+// SceneRecaller recalls scenes, like SceneService
+type SceneRecaller interface {
+	Recall(name string) error
+}
+
+// Services are the parts of the home the API reaches. A nil service answers its methods with
+// Unimplemented, e.g. AutomationService.SetHomeMode without a home mode configured.
+type Services struct {
+	Rooms       RoomSensors
+	Devices     DeviceController
+	Thermostats Thermostats
+	Holds       ThermostatHolds
+	HomeMode    HomeModes
+	Alerts      AlertRules
+	Scenes      SceneRecaller
+}
+
+// hub fans updates out to the open watch streams
+type hub[T any] struct {
+	mu          sync.Mutex
+	subscribers map[chan T]struct{}
+}
+
+func newHub[T any]() *hub[T] {
+	return &hub[T]{subscribers: make(map[chan T]struct{})}
+}
+
+func (h *hub[T]) subscribe() chan T {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	updates := make(chan T, 32)
+	h.subscribers[updates] = struct{}{}
+	return updates
+}
+
+func (h *hub[T]) unsubscribe(updates chan T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, updates)
+}
+
+// publish never blocks: a stream too slow to keep up misses updates rather than holding up the
+// service calling back
+func (h *hub[T]) publish(update T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for updates := range h.subscribers {
+		select {
+		case updates <- update:
+		default:
+		}
+	}
+}
+
+// Register adds the sensor, device, thermostat and automation services to the server
+func Register(s *Server, backends Services) {
+	registerSensors(s, backends.Rooms)
+	registerDevices(s, backends.Devices)
+	registerThermostats(s, backends.Thermostats, backends.Holds)
+	registerAutomation(s, backends)
+}
+
+func unimplemented(service string) error {
+	return Errorf(Unimplemented, "%s isn't running on this gateway", service)
+}
+
+func registerSensors(s *Server, rooms RoomSensors) {
+	roomUpdates := newHub[string]()
+	if rooms != nil {
+		rooms.AddTemperatureCallback(func(roomID string, _ float64) { roomUpdates.publish(roomID) })
+		rooms.AddMotionCallback(func(roomID string, _ bool) { roomUpdates.publish(roomID) })
+		rooms.AddLightCallback(func(roomID string, _ string, _ float64) { roomUpdates.publish(roomID) })
+		rooms.AddHazardCallback(func(roomID string, _ string, _ bool) { roomUpdates.publish(roomID) })
+	}
+
+	Unary(s, "/homeautomation.v1.SensorService/ListRooms", false, func(ctx context.Context, _ *ListRoomsRequest) (*ListRoomsResponse, error) {
+		if rooms == nil {
+			return nil, unimplemented("the sensor service")
+		}
+		all := rooms.GetAllRoomSensors()
+		response := &ListRoomsResponse{}
+		for _, roomID := range sortedRoomIDs(all) {
+			response.Rooms = append(response.Rooms, roomMessage(all[roomID]))
+		}
+		return response, nil
+	})
+
+	Unary(s, "/homeautomation.v1.SensorService/GetRoom", false, func(ctx context.Context, request *GetRoomRequest) (*Room, error) {
+		if rooms == nil {
+			return nil, unimplemented("the sensor service")
+		}
+		data, exists := rooms.GetRoomSensorData(request.RoomID)
+		if !exists {
+			return nil, Errorf(NotFound, "room %s not found", request.RoomID)
+		}
+		return roomMessage(data), nil
+	})
+
+	// WatchRooms sends the rooms as they are, then each room again as its readings arrive
+	Stream(s, "/homeautomation.v1.SensorService/WatchRooms", func(ctx context.Context, request *WatchRoomsRequest, send func(*Room) error) error {
+		if rooms == nil {
+			return unimplemented("the sensor service")
+		}
+		updates := roomUpdates.subscribe()
+		defer roomUpdates.unsubscribe(updates)
+
+		all := rooms.GetAllRoomSensors()
+		for _, roomID := range sortedRoomIDs(all) {
+			if request.RoomID != "" && roomID != request.RoomID {
+				continue
+			}
+			if err := send(roomMessage(all[roomID])); err != nil {
+				return err
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case roomID := <-updates:
+				if request.RoomID != "" && roomID != request.RoomID {
+					continue
+				}
+				data, exists := rooms.GetRoomSensorData(roomID)
+				if !exists {
+					continue
+				}
+				if err := send(roomMessage(data)); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+func registerDevices(s *Server, devices DeviceController) {
+	Unary(s, "/homeautomation.v1.DeviceService/ListDevices", false, func(ctx context.Context, request *ListDevicesRequest) (*ListDevicesResponse, error) {
+		if devices == nil {
+			return nil, unimplemented("the device service")
+		}
+		response := &ListDevicesResponse{}
+		for _, device := range devices.Devices() {
+			if request.RoomID != "" && device.RoomID != request.RoomID {
+				continue
+			}
+			response.Devices = append(response.Devices, &Device{
+				DeviceID: device.DeviceID,
+				Name:     device.DeviceName,
+				RoomID:   device.RoomID,
+				Online:   device.Online,
+				On:       device.On,
+				PowerW:   device.PowerW,
+				EnergyWh: device.EnergyWh,
+				Firmware: device.Firmware,
+				LastSeen: device.LastSeen,
+			})
+		}
+		return response, nil
+	})
+
+	Unary(s, "/homeautomation.v1.DeviceService/SendCommand", true, func(ctx context.Context, request *DeviceCommand) (*DeviceCommandResponse, error) {
+		if devices == nil {
+			return nil, unimplemented("the device service")
+		}
+		if request.Action == "" || (request.DeviceID == "" && request.Tag == "") {
+			return nil, Errorf(InvalidArgument, "a command needs an action and a device_id or tag")
+		}
+		command := &models.DeviceCommand{DeviceID: request.DeviceID, Tag: request.Tag, Action: request.Action}
+		if request.Value != nil {
+			command.Value = *request.Value
+		}
+		if err := devices.ExecuteCommand(command); err != nil {
+			return nil, err
+		}
+		return &DeviceCommandResponse{}, nil
+	})
+}
+
+func registerThermostats(s *Server, thermostats Thermostats, holds ThermostatHolds) {
+	thermostatUpdates := newHub[models.Thermostat]()
+	if thermostats != nil {
+		thermostats.AddStatusCallback(thermostatUpdates.publish)
+	}
+
+	Unary(s, "/homeautomation.v1.ThermostatService/ListThermostats", false, func(ctx context.Context, _ *ListThermostatsRequest) (*ListThermostatsResponse, error) {
+		if thermostats == nil {
+			return nil, unimplemented("the thermostat service")
+		}
+		response := &ListThermostatsResponse{}
+		for _, thermostat := range sortedThermostats(thermostats.GetAllThermostats()) {
+			response.Thermostats = append(response.Thermostats, thermostatMessage(thermostat))
+		}
+		return response, nil
+	})
+
+	Unary(s, "/homeautomation.v1.ThermostatService/SetHold", true, func(ctx context.Context, request *SetHoldRequest) (*Hold, error) {
+		if holds == nil {
+			return nil, unimplemented("the schedule service")
+		}
+		hold, err := holds.Hold(request.ThermostatID, models.ThermostatHold{
+			Mode:       models.HoldMode(request.Mode),
+			TargetTemp: request.TargetTemp,
+			Until:      request.Until,
+		}, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return &Hold{Mode: string(hold.Mode), TargetTemp: hold.TargetTemp, Until: hold.Until, SetAt: hold.SetAt}, nil
+	})
+
+	Unary(s, "/homeautomation.v1.ThermostatService/ResumeSchedule", true, func(ctx context.Context, request *ResumeScheduleRequest) (*ResumeScheduleResponse, error) {
+		if holds == nil {
+			return nil, unimplemented("the schedule service")
+		}
+		if err := holds.Resume(request.ThermostatID, time.Now()); err != nil {
+			return nil, err
+		}
+		return &ResumeScheduleResponse{}, nil
+	})
+
+	// WatchThermostats sends the thermostats as they are, then each one as it starts or stops
+	Stream(s, "/homeautomation.v1.ThermostatService/WatchThermostats", func(ctx context.Context, request *WatchThermostatsRequest, send func(*Thermostat) error) error {
+		if thermostats == nil {
+			return unimplemented("the thermostat service")
+		}
+		updates := thermostatUpdates.subscribe()
+		defer thermostatUpdates.unsubscribe(updates)
+
+		for _, thermostat := range sortedThermostats(thermostats.GetAllThermostats()) {
+			if request.ThermostatID != "" && thermostat.ID != request.ThermostatID {
+				continue
+			}
+			if err := send(thermostatMessage(thermostat)); err != nil {
+				return err
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case thermostat := <-updates:
+				if request.ThermostatID != "" && thermostat.ID != request.ThermostatID {
+					continue
+				}
+				if err := send(thermostatMessage(&thermostat)); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+func registerAutomation(s *Server, backends Services) {
+	Unary(s, "/homeautomation.v1.AutomationService/GetHomeMode", false, func(ctx context.Context, _ *GetHomeModeRequest) (*HomeMode, error) {
+		if backends.HomeMode == nil {
+			return nil, unimplemented("the home mode service")
+		}
+		return homeModeMessage(backends.HomeMode.Status(time.Now())), nil
+	})
+
+	Unary(s, "/homeautomation.v1.AutomationService/SetHomeMode", true, func(ctx context.Context, request *SetHomeModeRequest) (*HomeMode, error) {
+		if backends.HomeMode == nil {
+			return nil, unimplemented("the home mode service")
+		}
+		if request.DurationHours < 0 {
+			return nil, Errorf(InvalidArgument, "duration_hours must not be negative")
+		}
+		duration := time.Duration(request.DurationHours * float64(time.Hour))
+		status, err := backends.HomeMode.Set(request.Mode, duration, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return homeModeMessage(status), nil
+	})
+
+	Unary(s, "/homeautomation.v1.AutomationService/ListAlertRules", false, func(ctx context.Context, _ *ListAlertRulesRequest) (*ListAlertRulesResponse, error) {
+		if backends.Alerts == nil {
+			return nil, unimplemented("the alert service")
+		}
+		response := &ListAlertRulesResponse{}
+		for _, rule := range backends.Alerts.Rules() {
+			response.Rules = append(response.Rules, &AlertRule{
+				ID:       rule.ID,
+				Name:     rule.Name,
+				Metric:   rule.Metric,
+				Severity: rule.Severity,
+				Disabled: rule.Disabled,
+			})
+		}
+		for _, alert := range backends.Alerts.Active() {
+			response.Active = append(response.Active, &Alert{
+				ID:       alert.ID,
+				RuleID:   alert.RuleID,
+				Subject:  alert.Subject,
+				Severity: alert.Severity,
+				Message:  alert.Message,
+				Value:    alert.Value,
+				FiredAt:  alert.FiredAt,
+			})
+		}
+		return response, nil
+	})
+
+	Unary(s, "/homeautomation.v1.AutomationService/EnableAlertRule", true, func(ctx context.Context, request *EnableAlertRuleRequest) (*EnableAlertRuleResponse, error) {
+		if backends.Alerts == nil {
+			return nil, unimplemented("the alert service")
+		}
+		if err := backends.Alerts.EnableRule(request.RuleID, request.Enabled); err != nil {
+			return nil, err
+		}
+		return &EnableAlertRuleResponse{}, nil
+	})
+
+	Unary(s, "/homeautomation.v1.AutomationService/RecallScene", true, func(ctx context.Context, request *RecallSceneRequest) (*RecallSceneResponse, error) {
+		if backends.Scenes == nil {
+			return nil, unimplemented("the scene service")
+		}
+		if err := backends.Scenes.Recall(request.Name); err != nil {
+			return nil, err
+		}
+		return &RecallSceneResponse{}, nil
+	})
+}
+
+func roomMessage(data *services.RoomSensorData) *Room {
+	room := &Room{
+		RoomID:          data.RoomID,
+		DeviceID:        data.DeviceID,
+		DeviceUUID:      data.DeviceUUID,
+		Temperature:     data.Temperature,
+		Humidity:        data.Humidity,
+		Occupied:        data.IsOccupied,
+		LightLevel:      data.LightLevel,
+		LightState:      data.LightState,
+		LeakDetected:    data.LeakDetected,
+		SmokeDetected:   data.SmokeDetected,
+		Online:          data.IsOnline,
+		LastSeen:        data.LastSeen,
+		FirmwareVersion: data.FirmwareVersion,
+	}
+	for contact := range data.OpenContacts {
+		room.OpenContacts = append(room.OpenContacts, contact)
+	}
+	sort.Strings(room.OpenContacts)
+	return room
+}
+
+func thermostatMessage(thermostat *models.Thermostat) *Thermostat {
+	return &Thermostat{
+		ID:               thermostat.ID,
+		Name:             thermostat.Name,
+		RoomID:           thermostat.RoomID,
+		CurrentTemp:      thermostat.CurrentTemp,
+		CurrentHumidity:  thermostat.CurrentHumidity,
+		TargetTemp:       thermostat.TargetTemp,
+		Mode:             string(thermostat.Mode),
+		Status:           string(thermostat.Status),
+		Online:           thermostat.IsOnline,
+		LastSensorUpdate: thermostat.LastSensorUpdate,
+	}
+}
+
+func homeModeMessage(status services.HomeModeStatus) *HomeMode {
+	return &HomeMode{Mode: status.Mode, Source: status.Source, Occupied: status.Occupied, Since: status.Since}
+}
+
+func sortedRoomIDs(rooms map[string]*services.RoomSensorData) []string {
+	roomIDs := make([]string, 0, len(rooms))
+	for roomID := range rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+func sortedThermostats(thermostats []*models.Thermostat) []*models.Thermostat {
+	sorted := append([]*models.Thermostat(nil), thermostats...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
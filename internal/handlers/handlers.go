@@ -3,39 +3,36 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/models"
 )
 
 func RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/", homeHandler)
 	mux.HandleFunc("/api/devices", devicesHandler)
 	mux.HandleFunc("/api/sensors", sensorsHandler)
 	mux.HandleFunc("/api/status", statusHandler)
-}
-
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("<h1>Home Automation System</h1><p>Welcome to your smart home!</p>"))
+	mux.Handle("/api/i18n", i18n.Handler())
 }
 
 func devicesHandler(w http.ResponseWriter, r *http.Request) {
 	devices := []map[string]interface{}{
-		{"id": "1", "name": "Living Room Light", "type": "light", "status": "on"},
-		{"id": "2", "name": "Thermostat", "type": "climate", "status": "auto"},
+		{"id": "1", "name": "Living Room Light", "type": "light", "status": "on", "room_id": "living_room", "tags": []string{"holiday-lights"}},
+		{"id": "2", "name": "Thermostat", "type": "climate", "status": "auto", "room_id": "living_room", "tags": []string{"hvac"}},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(devices)
+	json.NewEncoder(w).Encode(filterByQuery(devices, r))
 }
 
 func sensorsHandler(w http.ResponseWriter, r *http.Request) {
 	sensors := []map[string]interface{}{
-		{"id": "1", "name": "Temperature Sensor", "type": "temperature", "value": 22.5},
-		{"id": "2", "name": "Motion Sensor", "type": "motion", "value": false},
+		{"id": "1", "name": "Temperature Sensor", "type": "temperature", "value": 22.5, "room_id": "living_room", "tags": []string{"climate"}},
+		{"id": "2", "name": "Motion Sensor", "type": "motion", "value": false, "room_id": "hallway", "tags": []string{"security"}},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sensors)
+	json.NewEncoder(w).Encode(filterByQuery(sensors, r))
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -49,3 +46,20 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
+
+// filterByQuery keeps the items matching the ?tag= and ?room= query parameters
+func filterByQuery(items []map[string]interface{}, r *http.Request) []map[string]interface{} {
+	tag, room := r.URL.Query().Get("tag"), r.URL.Query().Get("room")
+
+	filtered := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if room != "" && item["room_id"] != room {
+			continue
+		}
+		if tags, _ := item["tags"].([]string); tag != "" && !models.HasTag(tags, tag) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
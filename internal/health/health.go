@@ -0,0 +1,189 @@
+// Package health aggregates the health checks of a daemon's connections and services and
+// serves them as /healthz and /readyz for Docker, systemd watchdogs and Kubernetes probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/utils"
+)
+
+// Status is the overall state of a report or the state of one check
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded" // Only optional checks fail; still ready
+	StatusFailing  Status = "failing"
+)
+
+// CheckResult is the outcome of one check
+type CheckResult struct {
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// Report is the outcome of the checks behind /healthz or /readyz
+type Report struct {
+	Status    Status                 `json:"status"`
+	Service   string                 `json:"service"`
+	Uptime    string                 `json:"uptime"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]CheckResult `json:"checks"`
+}
+
+// Registry holds the health checks of a daemon in three groups:
+//
+//   - liveness: the process works, e.g. a service still answers; failing means restart it
+//   - readiness: it can do its job, e.g. the MQTT broker is connected; failing means wait
+//   - optional: nice to have, e.g. Kafka log shipping; failing degrades readiness without failing it
+//
+// Each check has the 5 second timeout of utils.HealthChecker.
+type Registry struct {
+	service   string
+	started   time.Time
+	liveness  *utils.HealthChecker
+	readiness *utils.HealthChecker
+	optional  *utils.HealthChecker
+	now       func() time.Time
+}
+
+// NewRegistry returns an empty registry for serviceName
+func NewRegistry(serviceName string) *Registry {
+	return &Registry{
+		service:   serviceName,
+		started:   time.Now(),
+		liveness:  utils.NewHealthChecker(),
+		readiness: utils.NewHealthChecker(),
+		optional:  utils.NewHealthChecker(),
+		now:       time.Now,
+	}
+}
+
+// RegisterLiveness adds a check that the process works; /healthz and /readyz run it
+func (r *Registry) RegisterLiveness(name string, check utils.HealthCheck) {
+	r.liveness.RegisterCheck(name, check)
+}
+
+// RegisterReadiness adds a check that the daemon can do its job; /readyz runs it
+func (r *Registry) RegisterReadiness(name string, check utils.HealthCheck) {
+	r.readiness.RegisterCheck(name, check)
+}
+
+// RegisterOptional adds a check whose failure degrades /readyz without failing it
+func (r *Registry) RegisterOptional(name string, check utils.HealthCheck) {
+	r.optional.RegisterCheck(name, check)
+}
+
+// Live runs the liveness checks
+func (r *Registry) Live(ctx context.Context) Report {
+	report := r.newReport()
+	r.add(&report, r.liveness.CheckHealth(ctx), false)
+	return report
+}
+
+// Ready runs every check
+func (r *Registry) Ready(ctx context.Context) Report {
+	report := r.newReport()
+	r.add(&report, r.liveness.CheckHealth(ctx), false)
+	r.add(&report, r.readiness.CheckHealth(ctx), false)
+	r.add(&report, r.optional.CheckHealth(ctx), true)
+	return report
+}
+
+// CheckHealth runs every check and returns their errors by name, as utils.HealthChecker does
+func (r *Registry) CheckHealth(ctx context.Context) map[string]error {
+	results := r.liveness.CheckHealth(ctx)
+	for name, err := range r.readiness.CheckHealth(ctx) {
+		results[name] = err
+	}
+	for name, err := range r.optional.CheckHealth(ctx) {
+		results[name] = err
+	}
+	return results
+}
+
+func (r *Registry) newReport() Report {
+	now := r.now()
+	return Report{
+		Status:    StatusOK,
+		Service:   r.service,
+		Uptime:    now.Sub(r.started).Round(time.Second).String(),
+		CheckedAt: now,
+		Checks:    make(map[string]CheckResult),
+	}
+}
+
+// add records results in the report, worsening its status for failures
+func (r *Registry) add(report *Report, results map[string]error, optional bool) {
+	for name, err := range results {
+		result := CheckResult{Status: StatusOK, Optional: optional}
+		if err != nil {
+			result.Status = StatusFailing
+			result.Error = err.Error()
+			switch {
+			case !optional:
+				report.Status = StatusFailing
+			case report.Status == StatusOK:
+				report.Status = StatusDegraded
+			}
+		}
+		report.Checks[name] = result
+	}
+}
+
+// LivenessHandler serves /healthz: 200 while the liveness checks pass, 503 otherwise
+func (r *Registry) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeReport(w, r.Live(req.Context()))
+	})
+}
+
+// ReadinessHandler serves /readyz: 200 while every check but the optional ones passes, 503 otherwise
+func (r *Registry) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeReport(w, r.Ready(req.Context()))
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == StatusFailing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Responds returns a liveness check that a service answers probe, e.g. a read taking the
+// service's lock, so a deadlocked service fails the check on its timeout. While a probe is
+// still stuck, later checks fail straight away instead of piling up goroutines behind it.
+func Responds(probe func()) utils.HealthCheck {
+	var inFlight atomic.Bool
+	return func() error {
+		if !inFlight.CompareAndSwap(false, true) {
+			return errors.NewServiceError("not answering since an earlier health check", nil)
+		}
+		probe()
+		inFlight.Store(false)
+		return nil
+	}
+}
+
+// Prometheus returns a check that the metrics of gatherer can be collected, as /metrics does
+func Prometheus(gatherer prometheus.Gatherer) utils.HealthCheck {
+	return func() error {
+		if _, err := gatherer.Gather(); err != nil {
+			return errors.NewSystemError("failed to gather metrics", err)
+		}
+		return nil
+	}
+}
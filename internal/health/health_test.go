@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+func TestRegistryHandlers(t *testing.T) {
+	registry := NewRegistry("unified")
+	mqttErr := error(nil)
+	kafkaErr := errors.NewKafkaError("Kafka client is not connected", nil)
+	registry.RegisterLiveness("thermostat_service", Responds(func() {}))
+	registry.RegisterReadiness("mqtt_connection", func() error { return mqttErr })
+	registry.RegisterReadiness("prometheus", Prometheus(prometheus.NewRegistry()))
+	registry.RegisterOptional("kafka_connection", func() error { return kafkaErr })
+
+	get := func(handler http.Handler) (int, Report) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		var report Report
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Expected a JSON report, got %s", recorder.Body.String())
+		}
+		return recorder.Code, report
+	}
+
+	// An optional check failing degrades readiness without failing it
+	code, report := get(registry.ReadinessHandler())
+	if code != http.StatusOK || report.Status != StatusDegraded || report.Service != "unified" || len(report.Checks) != 4 {
+		t.Errorf("Expected ready but degraded, got %d %+v", code, report)
+	}
+	if kafka := report.Checks["kafka_connection"]; kafka.Status != StatusFailing || !kafka.Optional || kafka.Error == "" {
+		t.Errorf("Expected the Kafka failure in the detail, got %+v", kafka)
+	}
+
+	// A readiness check failing fails readiness but not liveness
+	mqttErr = errors.NewMQTTError("MQTT client is not connected", nil)
+	if code, report := get(registry.ReadinessHandler()); code != http.StatusServiceUnavailable || report.Status != StatusFailing {
+		t.Errorf("Expected not ready without the broker, got %d %+v", code, report)
+	}
+	if code, report := get(registry.LivenessHandler()); code != http.StatusOK || report.Status != StatusOK || len(report.Checks) != 1 {
+		t.Errorf("Expected live with only the liveness checks run, got %d %+v", code, report)
+	}
+
+	if results := registry.CheckHealth(context.Background()); len(results) != 4 || results["mqtt_connection"] == nil {
+		t.Errorf("Expected every check's error by name, got %v", results)
+	}
+}
+
+func TestRespondsDetectsStuckService(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	check := Responds(func() { <-release })
+
+	registry := NewRegistry("thermostat-service")
+	registry.RegisterLiveness("thermostat_service", check)
+	// The probe's request timing out ends the check sooner than its own 5 seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if report := registry.Live(ctx); report.Status != StatusFailing {
+		t.Errorf("Expected a service stuck on its lock to fail liveness, got %+v", report)
+	}
+
+	// The stuck probe isn't started again
+	if err := check(); err == nil {
+		t.Error("Expected the check to fail while the earlier probe is stuck")
+	}
+}
@@ -0,0 +1,295 @@
+// Package i18n translates user-facing strings: notifications, reports and dashboard labels. Texts
+// are looked up in a message catalog by key, in the global locale or a resident's own.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Built-in locales; a messages file can add more
+const (
+	English = "en"
+	Spanish = "es"
+	German  = "de"
+	French  = "fr"
+
+	DefaultLocale = English
+)
+
+// Localizable is a user-facing string that can be shown in any locale
+type Localizable interface {
+	In(locale string) string
+}
+
+// Text is a catalog message with its arguments, formatted with fmt. Arguments that are
+// Localizable themselves are translated into the same locale. Translations may reorder the
+// arguments with explicit indexes such as %[2]s.
+type Text struct {
+	Key  string
+	Args []interface{}
+}
+
+// T returns the catalog message key with its arguments
+func T(key string, args ...interface{}) Text {
+	return Text{Key: key, Args: args}
+}
+
+// In formats the message in a locale, falling back to English and then the key itself
+func (t Text) In(locale string) string {
+	format := lookup(locale, t.Key)
+	if len(t.Args) == 0 {
+		return format
+	}
+	args := make([]interface{}, len(t.Args))
+	for i, arg := range t.Args {
+		if text, ok := arg.(Localizable); ok {
+			arg = text.In(locale)
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// String formats the message in the global locale
+func (t Text) String() string {
+	return t.In(Locale())
+}
+
+// Raw is a string shown as it is in every locale, such as a device name
+type Raw string
+
+// In returns the string unchanged
+func (r Raw) In(string) string {
+	return string(r)
+}
+
+// Lines shows texts one per line
+type Lines []Localizable
+
+// In joins the texts in a locale with newlines
+func (l Lines) In(locale string) string {
+	return join(l, locale, "\n")
+}
+
+// Sentences shows texts one after the other
+type Sentences []Localizable
+
+// In joins the texts in a locale with spaces
+func (s Sentences) In(locale string) string {
+	return join(s, locale, " ")
+}
+
+func join(texts []Localizable, locale, separator string) string {
+	parts := make([]string, len(texts))
+	for i, text := range texts {
+		parts[i] = text.In(locale)
+	}
+	return strings.Join(parts, separator)
+}
+
+// catalog holds the messages by locale and key
+var catalog = struct {
+	sync.RWMutex
+	messages map[string]map[string]string
+}{messages: map[string]map[string]string{
+	English: english,
+	Spanish: spanish,
+	German:  german,
+	French:  french,
+}}
+
+// settings holds the global locale and the residents' own. The global locale is English, so
+// processes that never configure one behave as before.
+var settings = struct {
+	sync.RWMutex
+	locale string
+	users  map[string]string
+}{locale: DefaultLocale, users: make(map[string]string)}
+
+func lookup(locale, key string) string {
+	catalog.RLock()
+	defer catalog.RUnlock()
+
+	if message, ok := catalog.messages[locale][key]; ok {
+		return message
+	}
+	if message, ok := catalog.messages[English][key]; ok {
+		return message
+	}
+	return key
+}
+
+// LoadMessages adds to the catalog from a JSON file of messages by locale and key, overriding
+// built-in messages or adding locales
+func LoadMessages(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.NewConfigError("failed to read messages file", err)
+	}
+
+	var messages map[string]map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return errors.NewConfigError("failed to parse messages file", err)
+	}
+
+	catalog.Lock()
+	defer catalog.Unlock()
+	for locale, entries := range messages {
+		locale = strings.ToLower(locale)
+		merged := make(map[string]string)
+		for key, message := range catalog.messages[locale] {
+			merged[key] = message
+		}
+		for key, message := range entries {
+			merged[key] = message
+		}
+		catalog.messages[locale] = merged
+	}
+	return nil
+}
+
+// Supported returns the locales of the catalog, sorted
+func Supported() []string {
+	catalog.RLock()
+	defer catalog.RUnlock()
+
+	locales := make([]string, 0, len(catalog.messages))
+	for locale := range catalog.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Normalize maps a language tag such as "de-AT" or "es_ES.UTF-8" to a locale of the catalog
+func Normalize(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_.;"); i >= 0 {
+		tag = tag[:i]
+	}
+	catalog.RLock()
+	defer catalog.RUnlock()
+	_, ok := catalog.messages[tag]
+	return tag, ok && tag != ""
+}
+
+// SetLocale sets the global locale, used for residents without one of their own
+func SetLocale(tag string) error {
+	locale, ok := Normalize(tag)
+	if !ok {
+		return errors.NewValidationError(fmt.Sprintf("unsupported locale %q", tag), nil)
+	}
+	settings.Lock()
+	defer settings.Unlock()
+	settings.locale = locale
+	return nil
+}
+
+// Locale returns the global locale
+func Locale() string {
+	settings.RLock()
+	defer settings.RUnlock()
+	return settings.locale
+}
+
+// SetUserLocale sets a resident's locale; an empty tag returns them to the global locale
+func SetUserLocale(user, tag string) error {
+	if tag == "" {
+		settings.Lock()
+		defer settings.Unlock()
+		delete(settings.users, user)
+		return nil
+	}
+	locale, ok := Normalize(tag)
+	if !ok {
+		return errors.NewValidationError(fmt.Sprintf("unsupported locale %q for %s", tag, user), nil)
+	}
+	settings.Lock()
+	defer settings.Unlock()
+	settings.users[user] = locale
+	return nil
+}
+
+// UserLocale returns a resident's locale, or the global one
+func UserLocale(user string) string {
+	settings.RLock()
+	defer settings.RUnlock()
+	if locale, ok := settings.users[user]; ok {
+		return locale
+	}
+	return settings.locale
+}
+
+// Locales returns the locales in use: the global locale first, then the residents' others
+func Locales() []string {
+	settings.RLock()
+	defer settings.RUnlock()
+
+	seen := map[string]bool{settings.locale: true}
+	var others []string
+	for _, locale := range settings.users {
+		if !seen[locale] {
+			seen[locale] = true
+			others = append(others, locale)
+		}
+	}
+	sort.Strings(others)
+	return append([]string{settings.locale}, others...)
+}
+
+// Negotiate picks the locale of a request: the lang query parameter, else the locale of the
+// resident named by the user parameter, else the first supported Accept-Language, else the
+// global locale
+func Negotiate(r *http.Request) string {
+	if locale, ok := Normalize(r.URL.Query().Get("lang")); ok {
+		return locale
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		return UserLocale(user)
+	}
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		if locale, ok := Normalize(tag); ok {
+			return locale
+		}
+	}
+	return Locale()
+}
+
+// Messages returns the messages whose keys start with prefix in a locale, with English filling
+// in missing translations
+func Messages(locale, prefix string) map[string]string {
+	catalog.RLock()
+	defer catalog.RUnlock()
+
+	messages := make(map[string]string)
+	for _, source := range []string{English, locale} {
+		for key, message := range catalog.messages[source] {
+			if strings.HasPrefix(key, prefix) {
+				messages[key] = message
+			}
+		}
+	}
+	return messages
+}
+
+// Handler serves the dashboard labels in the negotiated locale as JSON
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := Negotiate(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Language", locale)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"locale":    locale,
+			"supported": Supported(),
+			"messages":  Messages(locale, "dashboard."),
+		})
+	})
+}
@@ -0,0 +1,145 @@
+package i18n
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reset restores the English global locale and clears the residents' after a test
+func reset(t *testing.T) {
+	t.Cleanup(func() {
+		settings.Lock()
+		settings.locale, settings.users = DefaultLocale, make(map[string]string)
+		settings.Unlock()
+	})
+}
+
+func TestTranslate(t *testing.T) {
+	reset(t)
+
+	message := T("alert.above", "attic", T("metric.temperature"), 91.0, "°F", 90.0, "°F")
+	if got := message.In(English); got != "attic temperature is 91.0°F, above 90.0°F." {
+		t.Errorf("Unexpected English message %q", got)
+	}
+	if got := message.In(German); got != "attic: Temperatur beträgt 91.0°F, über 90.0°F." {
+		t.Errorf("Expected the metric translated too, got %q", got)
+	}
+	if got := T("cycle.finished", "Washer", 95*time.Minute).In(French); got != "Cycle de Washer terminé après 1h35m0s" {
+		t.Errorf("Unexpected French message %q", got)
+	}
+
+	// Every built-in locale translates every English message
+	for locale, messages := range map[string]map[string]string{Spanish: spanish, German: german, French: french} {
+		for key := range english {
+			if _, ok := messages[key]; !ok {
+				t.Errorf("%s is missing %s", locale, key)
+			}
+		}
+	}
+
+	// Missing translations fall back to English, unknown keys to the key itself
+	if got := T("departure.nothing").In("pt"); got != english["departure.nothing"] {
+		t.Errorf("Expected the English fallback, got %q", got)
+	}
+	if got := T("no.such.key").In(Spanish); got != "no.such.key" {
+		t.Errorf("Expected the key, got %q", got)
+	}
+
+	lines := Lines{T("departure.left_on", "Lamp"), Raw("Dryer")}
+	if got := lines.In(Spanish); got != "Lamp se quedó encendido\nDryer" {
+		t.Errorf("Unexpected lines %q", got)
+	}
+	if err := SetLocale("es-ES"); err != nil {
+		t.Fatal(err)
+	}
+	if got := T("power.restored.title").String(); got != "Corriente restablecida" {
+		t.Errorf("Expected the global locale, got %q", got)
+	}
+}
+
+func TestLocales(t *testing.T) {
+	reset(t)
+
+	for tag, want := range map[string]string{"de-AT": German, "es_ES.UTF-8": Spanish, "FR": French, "fr;q=0.8": French} {
+		if locale, ok := Normalize(tag); !ok || locale != want {
+			t.Errorf("%s: expected %s, got %s", tag, want, locale)
+		}
+	}
+	if _, ok := Normalize("pt-BR"); ok {
+		t.Error("Expected an unsupported locale rejected")
+	}
+	if err := SetLocale("pt"); err == nil || Locale() != English {
+		t.Errorf("Expected the global locale kept, got %s", Locale())
+	}
+
+	// Residents' own locales are translated besides the global one
+	SetUserLocale("alex", "fr")
+	SetUserLocale("sam", "de")
+	SetUserLocale("kim", "en")
+	if locales := Locales(); len(locales) != 3 || locales[0] != English || locales[1] != German || locales[2] != French {
+		t.Errorf("Expected the global locale first, got %v", locales)
+	}
+	SetUserLocale("sam", "")
+	if UserLocale("sam") != English || UserLocale("alex") != French {
+		t.Errorf("Expected sam back on the global locale, got %s", UserLocale("sam"))
+	}
+
+	request := httptest.NewRequest("GET", "/api/i18n", nil)
+	request.Header.Set("Accept-Language", "pt-BR, de;q=0.9, en;q=0.8")
+	if locale := Negotiate(request); locale != German {
+		t.Errorf("Expected the first supported language, got %s", locale)
+	}
+	if locale := Negotiate(httptest.NewRequest("GET", "/api/i18n?user=alex", nil)); locale != French {
+		t.Errorf("Expected the resident's locale, got %s", locale)
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/i18n?lang=es", nil))
+	if recorder.Header().Get("Content-Language") != Spanish {
+		t.Errorf("Expected Spanish labels, got %s", recorder.Header().Get("Content-Language"))
+	}
+	if labels := Messages(Spanish, "dashboard."); labels["dashboard.devices"] != "Dispositivos" || labels["alert.online"] != "" {
+		t.Errorf("Expected only the dashboard labels, got %v", labels)
+	}
+}
+
+func TestLoadMessages(t *testing.T) {
+	reset(t)
+	saved := make(map[string]map[string]string)
+	catalog.RLock()
+	for locale, messages := range catalog.messages {
+		saved[locale] = messages
+	}
+	catalog.RUnlock()
+	t.Cleanup(func() {
+		catalog.Lock()
+		catalog.messages = saved
+		catalog.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte(`{
+		"en": {"power.restored.title": "Mains power is back"},
+		"NL": {"power.restored.title": "Stroom hersteld"}
+	}`), 0644)
+	if err := LoadMessages(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := T("power.restored.title").In(English); got != "Mains power is back" {
+		t.Errorf("Expected the override, got %q", got)
+	}
+	if got := T("power.on_request").In(English); got != english["power.on_request"] {
+		t.Errorf("Expected the other messages kept, got %q", got)
+	}
+	if err := SetLocale("nl-NL"); err != nil || T("power.restored.title").String() != "Stroom hersteld" {
+		t.Errorf("Expected the added locale usable, got %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"en": [`), 0644)
+	if err := LoadMessages(path); err == nil {
+		t.Error("Expected an invalid messages file rejected")
+	}
+}
@@ -0,0 +1,536 @@
+package i18n
+
+// Built-in message catalog. Keys are grouped by the subsystem that shows them; dashboard.* keys
+// are served to the dashboard. Formats take the same arguments in every locale.
+
+var english = map[string]string{
+	"severity.info":     "info",
+	"severity.warning":  "warning",
+	"severity.critical": "critical",
+
+	"metric.temperature": "temperature",
+	"metric.humidity":    "humidity",
+	"metric.power":       "power",
+	"metric.offline":     "offline",
+
+	"alert.firing.title":   "[%s] %s",
+	"alert.resolved.title": "Resolved: %s",
+	"alert.offline":        "%s has been offline for %s.",
+	"alert.above":          "%s %s is %.1f%s, above %.1f%s.",
+	"alert.below":          "%s %s is %.1f%s, below %.1f%s.",
+	"alert.online":         "%s is back online.",
+	"alert.recovered":      "%s %s is back to %.1f%s.",
+	"alert.stuck":          "%s %s has been stuck at %.1f%s for %s.",
+	"alert.jump":           "%s %s jumped to %.1f%s from about %.1f%s.",
+	"alert.unusual":        "%s %s of %.1f%s is unusual, typically %.1f%s ± %.1f%s.",
+
+	"condensation.risk.title":   "Condensation risk in %s",
+	"condensation.risk":         "Dew point %.0f°F at %.0f%% humidity is near surfaces at %.0f°F; the fan runs faster and cooling holds back",
+	"condensation.rising.title": "Humidity rising while cooling in %s",
+	"condensation.rising":       "Humidity reached %.0f%% although the system is cooling; check the condensate drain, the coil and open windows",
+	"condensation.resolved":     "Humidity is %.0f%% with the dew point at %.0f°F",
+
+	"hazard.leak":            "Water leak",
+	"hazard.smoke":           "Smoke",
+	"hazard.detector.leak":   "leak",
+	"hazard.detector.smoke":  "smoke",
+	"hazard.detected.title":  "%s detected in %s",
+	"hazard.detected":        "The %s detector in %s triggered at %s",
+	"hazard.cleared.title":   "%s cleared in %s",
+	"hazard.cleared":         "The %s detector in %s cleared after %s",
+	"warranty.title":         "Warranty ending: %s",
+	"warranty.ending":        "The warranty of %s ends on %s, in %d days",
+	"warranty.ending.manual": "The warranty of %s ends on %s, in %d days. Manual: %s",
+	"cycle.finished.title":   "%s finished",
+	"cycle.finished":         "%s cycle complete after %s",
+
+	"power.restored.title":     "Power restored",
+	"power.back_after":         "Power came back after %s.",
+	"power.on_request":         "Restoration routine run on request.",
+	"power.unknown_outage":     "Power came back after an outage of unknown length.",
+	"power.result":             "%s: %s.",
+	"power.action.already_on":  "already on",
+	"power.action.switched_on": "switched on",
+	"power.action.sent":        "sent",
+	"power.action.skipped":     "skipped",
+	"power.action.failed":      "failed",
+
+	"departure.clear.title": "All clear after leaving",
+	"departure.check.title": "Check the house after leaving",
+	"departure.open":        "%s open in %s",
+	"departure.left_on":     "%s left on",
+	"departure.running":     "%s running at %.0f W",
+	"departure.nothing":     "No doors or windows open and nothing left on",
+	"departure.turn_off":    "Turn off non-essentials",
+
+	"digest.daily.subject":    "Home digest for %s",
+	"digest.weekly.subject":   "Weekly home digest to %s",
+	"digest.temperatures":     "Temperatures",
+	"digest.room":             "%s is %.0f°F at %.0f%% humidity.",
+	"digest.room.offline":     "%s has not reported since %s.",
+	"digest.outdoor":          "Outside it is %.0f°F.",
+	"digest.no_rooms":         "No room has reported a temperature.",
+	"digest.energy":           "Energy",
+	"digest.energy.daily":     "The home used %.1f kWh yesterday.",
+	"digest.energy.weekly":    "The home used %.1f kWh over the last 7 days.",
+	"digest.energy.more":      "That is %.0f%% more than the period before.",
+	"digest.energy.less":      "That is %.0f%% less than the period before.",
+	"digest.energy.top":       "%s used the most, %.1f kWh.",
+	"digest.energy.none":      "No energy use was recorded.",
+	"digest.alerts":           "Alerts",
+	"digest.alerts.count":     "Alerts in this period: %d.",
+	"digest.alerts.active":    "Still active: %s",
+	"digest.alerts.none":      "Nothing unusual happened.",
+	"digest.maintenance":      "Maintenance",
+	"digest.maintenance.none": "No maintenance is due.",
+	"digest.warranty":         "The warranty of %s ends on %s, in %d days.",
+
+	"dashboard.title":          "Home Automation Dashboard",
+	"dashboard.brand":          "Home Automation",
+	"dashboard.dashboard":      "Dashboard",
+	"dashboard.devices":        "Devices",
+	"dashboard.sensors":        "Sensors",
+	"dashboard.settings":       "Settings",
+	"dashboard.system_status":  "System Status",
+	"dashboard.active_devices": "Active Devices",
+	"dashboard.sensors_online": "Sensors Online",
+	"dashboard.loading":        "Loading...",
+	"dashboard.online":         "Online",
+	"dashboard.offline":        "Offline",
+	"dashboard.no_devices":     "No devices found.",
+	"dashboard.no_sensors":     "No sensors found.",
+	"dashboard.turn_on":        "Turn On",
+	"dashboard.turn_off":       "Turn Off",
+	"dashboard.dim":            "Dim",
+	"dashboard.no_controls":    "No controls available",
+	"dashboard.last_updated":   "Last updated",
+	"dashboard.unknown":        "Unknown",
+	"dashboard.rooms":          "Rooms",
+	"dashboard.thermostats":    "Thermostats",
+	"dashboard.energy":         "Energy",
+	"dashboard.energy_days":    "Daily energy use, last 7 days",
+	"dashboard.automations":    "Automations",
+	"dashboard.home_mode":      "Home mode",
+	"dashboard.mode_auto":      "Automatic",
+	"dashboard.mode_home":      "Home",
+	"dashboard.mode_away":      "Away",
+	"dashboard.mode_night":     "Night",
+	"dashboard.mode_vacation":  "Vacation",
+	"dashboard.alert_rules":    "Alert rules",
+	"dashboard.occupied":       "Occupied",
+	"dashboard.vacant":         "Vacant",
+	"dashboard.target":         "Target",
+	"dashboard.humidity":       "Humidity",
+	"dashboard.light":          "Light",
+	"dashboard.total":          "Total",
+	"dashboard.no_rooms":       "No room readings yet.",
+	"dashboard.access_token":   "API token",
+	"dashboard.save":           "Save",
+	"dashboard.token_hint":     "Needed to switch devices and change settings. Create one with home-automation-cli -cmd session-create.",
+	"dashboard.unauthorized":   "Set an API token in Settings to make changes.",
+	"dashboard.registry":       "Device registry",
+	"dashboard.registry_hint":  "Name each device and put it in a room. Tags are comma-separated.",
+	"dashboard.name":           "Name",
+	"dashboard.room":           "Room",
+	"dashboard.icon":           "Icon",
+	"dashboard.tags":           "Tags",
+}
+
+var spanish = map[string]string{
+	"severity.info":     "información",
+	"severity.warning":  "aviso",
+	"severity.critical": "crítico",
+
+	"metric.temperature": "temperatura",
+	"metric.humidity":    "humedad",
+	"metric.power":       "potencia",
+	"metric.offline":     "sin conexión",
+
+	"alert.firing.title":   "[%s] %s",
+	"alert.resolved.title": "Resuelto: %s",
+	"alert.offline":        "%s lleva %s sin conexión.",
+	"alert.above":          "%s: %s de %.1f%s, por encima de %.1f%s.",
+	"alert.below":          "%s: %s de %.1f%s, por debajo de %.1f%s.",
+	"alert.online":         "%s vuelve a estar conectado.",
+	"alert.recovered":      "%s: %s de nuevo en %.1f%s.",
+	"alert.stuck":          "%s: %s atascado en %.1f%s desde hace %s.",
+	"alert.jump":           "%s: %s saltó a %.1f%s desde unos %.1f%s.",
+	"alert.unusual":        "%s: %s de %.1f%s es inusual, normalmente %.1f%s ± %.1f%s.",
+
+	"condensation.risk.title":   "Riesgo de condensación en %s",
+	"condensation.risk":         "El punto de rocío de %.0f°F con %.0f%% de humedad se acerca a las superficies a %.0f°F; el ventilador acelera y la refrigeración se contiene",
+	"condensation.rising.title": "La humedad sube mientras se refrigera en %s",
+	"condensation.rising":       "La humedad llegó al %.0f%% aunque el sistema está refrigerando; revise el desagüe de condensados, la batería y las ventanas abiertas",
+	"condensation.resolved":     "La humedad es del %.0f%% con el punto de rocío a %.0f°F",
+
+	"hazard.leak":            "Fuga de agua",
+	"hazard.smoke":           "Humo",
+	"hazard.detector.leak":   "de fugas",
+	"hazard.detector.smoke":  "de humo",
+	"hazard.detected.title":  "Alarma: %s en %s",
+	"hazard.detected":        "El detector %s de %s se activó a las %s",
+	"hazard.cleared.title":   "Fin de la alarma: %s en %s",
+	"hazard.cleared":         "El detector %s de %s se normalizó tras %s",
+	"warranty.title":         "Fin de garantía: %s",
+	"warranty.ending":        "La garantía de %s termina el %s, en %d días",
+	"warranty.ending.manual": "La garantía de %s termina el %s, en %d días. Manual: %s",
+	"cycle.finished.title":   "%s ha terminado",
+	"cycle.finished":         "Ciclo de %s completado en %s",
+
+	"power.restored.title":     "Corriente restablecida",
+	"power.back_after":         "La corriente volvió tras %s.",
+	"power.on_request":         "Rutina de restablecimiento ejecutada a petición.",
+	"power.unknown_outage":     "La corriente volvió tras un corte de duración desconocida.",
+	"power.result":             "%s: %s.",
+	"power.action.already_on":  "ya encendidos",
+	"power.action.switched_on": "encendidos",
+	"power.action.sent":        "enviados",
+	"power.action.skipped":     "omitidos",
+	"power.action.failed":      "fallidos",
+
+	"departure.clear.title": "Todo en orden al salir",
+	"departure.check.title": "Revise la casa al salir",
+	"departure.open":        "%s abierta en %s",
+	"departure.left_on":     "%s se quedó encendido",
+	"departure.running":     "%s funcionando a %.0f W",
+	"departure.nothing":     "No hay puertas ni ventanas abiertas ni nada encendido",
+	"departure.turn_off":    "Apagar lo no esencial",
+
+	"digest.daily.subject":    "Resumen de la casa del %s",
+	"digest.weekly.subject":   "Resumen semanal de la casa hasta el %s",
+	"digest.temperatures":     "Temperaturas",
+	"digest.room":             "%s está a %.0f°F con un %.0f%% de humedad.",
+	"digest.room.offline":     "%s no informa desde %s.",
+	"digest.outdoor":          "Fuera hace %.0f°F.",
+	"digest.no_rooms":         "Ninguna habitación ha informado de la temperatura.",
+	"digest.energy":           "Energía",
+	"digest.energy.daily":     "La casa consumió %.1f kWh ayer.",
+	"digest.energy.weekly":    "La casa consumió %.1f kWh en los últimos 7 días.",
+	"digest.energy.more":      "Es un %.0f%% más que en el periodo anterior.",
+	"digest.energy.less":      "Es un %.0f%% menos que en el periodo anterior.",
+	"digest.energy.top":       "%s fue lo que más consumió, %.1f kWh.",
+	"digest.energy.none":      "No se registró consumo de energía.",
+	"digest.alerts":           "Alertas",
+	"digest.alerts.count":     "Alertas en este periodo: %d.",
+	"digest.alerts.active":    "Sigue activa: %s",
+	"digest.alerts.none":      "No pasó nada fuera de lo normal.",
+	"digest.maintenance":      "Mantenimiento",
+	"digest.maintenance.none": "No hay mantenimiento pendiente.",
+	"digest.warranty":         "La garantía de %s termina el %s, en %d días.",
+
+	"dashboard.title":          "Panel de domótica",
+	"dashboard.brand":          "Domótica",
+	"dashboard.dashboard":      "Panel",
+	"dashboard.devices":        "Dispositivos",
+	"dashboard.sensors":        "Sensores",
+	"dashboard.settings":       "Ajustes",
+	"dashboard.system_status":  "Estado del sistema",
+	"dashboard.active_devices": "Dispositivos activos",
+	"dashboard.sensors_online": "Sensores conectados",
+	"dashboard.loading":        "Cargando...",
+	"dashboard.online":         "Conectado",
+	"dashboard.offline":        "Desconectado",
+	"dashboard.no_devices":     "No se encontraron dispositivos.",
+	"dashboard.no_sensors":     "No se encontraron sensores.",
+	"dashboard.turn_on":        "Encender",
+	"dashboard.turn_off":       "Apagar",
+	"dashboard.dim":            "Atenuar",
+	"dashboard.no_controls":    "Sin controles disponibles",
+	"dashboard.last_updated":   "Última actualización",
+	"dashboard.unknown":        "Desconocido",
+	"dashboard.rooms":          "Habitaciones",
+	"dashboard.thermostats":    "Termostatos",
+	"dashboard.energy":         "Energía",
+	"dashboard.energy_days":    "Consumo diario, últimos 7 días",
+	"dashboard.automations":    "Automatizaciones",
+	"dashboard.home_mode":      "Modo de la casa",
+	"dashboard.mode_auto":      "Automático",
+	"dashboard.mode_home":      "En casa",
+	"dashboard.mode_away":      "Fuera",
+	"dashboard.mode_night":     "Noche",
+	"dashboard.mode_vacation":  "Vacaciones",
+	"dashboard.alert_rules":    "Reglas de alerta",
+	"dashboard.occupied":       "Ocupada",
+	"dashboard.vacant":         "Libre",
+	"dashboard.target":         "Objetivo",
+	"dashboard.humidity":       "Humedad",
+	"dashboard.light":          "Luz",
+	"dashboard.total":          "Total",
+	"dashboard.no_rooms":       "Aún no hay lecturas de habitaciones.",
+	"dashboard.access_token":   "Token de la API",
+	"dashboard.save":           "Guardar",
+	"dashboard.token_hint":     "Necesario para controlar dispositivos y cambiar ajustes. Créalo con home-automation-cli -cmd session-create.",
+	"dashboard.unauthorized":   "Introduce un token de la API en Ajustes para hacer cambios.",
+	"dashboard.registry":       "Registro de dispositivos",
+	"dashboard.registry_hint":  "Pon nombre a cada dispositivo y asígnalo a una habitación. Las etiquetas van separadas por comas.",
+	"dashboard.name":           "Nombre",
+	"dashboard.room":           "Habitación",
+	"dashboard.icon":           "Icono",
+	"dashboard.tags":           "Etiquetas",
+}
+
+var german = map[string]string{
+	"severity.info":     "Info",
+	"severity.warning":  "Warnung",
+	"severity.critical": "kritisch",
+
+	"metric.temperature": "Temperatur",
+	"metric.humidity":    "Luftfeuchtigkeit",
+	"metric.power":       "Leistung",
+	"metric.offline":     "offline",
+
+	"alert.firing.title":   "[%s] %s",
+	"alert.resolved.title": "Behoben: %s",
+	"alert.offline":        "%s ist seit %s offline.",
+	"alert.above":          "%s: %s beträgt %.1f%s, über %.1f%s.",
+	"alert.below":          "%s: %s beträgt %.1f%s, unter %.1f%s.",
+	"alert.online":         "%s ist wieder online.",
+	"alert.recovered":      "%s: %s ist wieder bei %.1f%s.",
+	"alert.stuck":          "%s: %s hängt bei %.1f%s seit %s.",
+	"alert.jump":           "%s: %s sprang auf %.1f%s von etwa %.1f%s.",
+	"alert.unusual":        "%s: %s von %.1f%s ist ungewöhnlich, sonst %.1f%s ± %.1f%s.",
+
+	"condensation.risk.title":   "Kondensationsgefahr in %s",
+	"condensation.risk":         "Der Taupunkt von %.0f°F bei %.0f%% Luftfeuchtigkeit liegt nahe an Oberflächen mit %.0f°F; der Lüfter läuft schneller und die Kühlung wird zurückgehalten",
+	"condensation.rising.title": "Luftfeuchtigkeit steigt beim Kühlen in %s",
+	"condensation.rising":       "Die Luftfeuchtigkeit erreichte %.0f%%, obwohl gekühlt wird; prüfen Sie den Kondensatablauf, den Verdampfer und offene Fenster",
+	"condensation.resolved":     "Die Luftfeuchtigkeit beträgt %.0f%% bei einem Taupunkt von %.0f°F",
+
+	"hazard.leak":            "Wasserleck",
+	"hazard.smoke":           "Rauch",
+	"hazard.detector.leak":   "Wassermelder",
+	"hazard.detector.smoke":  "Rauchmelder",
+	"hazard.detected.title":  "%s erkannt in %s",
+	"hazard.detected":        "Der %s in %s hat um %s ausgelöst",
+	"hazard.cleared.title":   "%s in %s behoben",
+	"hazard.cleared":         "Der %s in %s ist nach %s wieder ruhig",
+	"warranty.title":         "Garantie läuft ab: %s",
+	"warranty.ending":        "Die Garantie von %s endet am %s, in %d Tagen",
+	"warranty.ending.manual": "Die Garantie von %s endet am %s, in %d Tagen. Handbuch: %s",
+	"cycle.finished.title":   "%s ist fertig",
+	"cycle.finished":         "%s: Programm nach %s beendet",
+
+	"power.restored.title":     "Strom wieder da",
+	"power.back_after":         "Der Strom kam nach %s zurück.",
+	"power.on_request":         "Wiederherstellung auf Anfrage ausgeführt.",
+	"power.unknown_outage":     "Der Strom kam nach einem Ausfall unbekannter Dauer zurück.",
+	"power.result":             "%s: %s.",
+	"power.action.already_on":  "bereits an",
+	"power.action.switched_on": "eingeschaltet",
+	"power.action.sent":        "gesendet",
+	"power.action.skipped":     "übersprungen",
+	"power.action.failed":      "fehlgeschlagen",
+
+	"departure.clear.title": "Alles in Ordnung nach dem Verlassen",
+	"departure.check.title": "Bitte das Haus nach dem Verlassen prüfen",
+	"departure.open":        "%s offen in %s",
+	"departure.left_on":     "%s ist noch an",
+	"departure.running":     "%s läuft mit %.0f W",
+	"departure.nothing":     "Keine Türen oder Fenster offen und nichts eingeschaltet",
+	"departure.turn_off":    "Nicht Notwendiges ausschalten",
+
+	"digest.daily.subject":    "Hausbericht für %s",
+	"digest.weekly.subject":   "Wochenbericht bis %s",
+	"digest.temperatures":     "Temperaturen",
+	"digest.room":             "%s hat %.0f°F bei %.0f%% Luftfeuchtigkeit.",
+	"digest.room.offline":     "%s meldet sich seit %s nicht.",
+	"digest.outdoor":          "Draußen sind es %.0f°F.",
+	"digest.no_rooms":         "Kein Raum hat eine Temperatur gemeldet.",
+	"digest.energy":           "Energie",
+	"digest.energy.daily":     "Das Haus hat gestern %.1f kWh verbraucht.",
+	"digest.energy.weekly":    "Das Haus hat in den letzten 7 Tagen %.1f kWh verbraucht.",
+	"digest.energy.more":      "Das sind %.0f%% mehr als im Zeitraum davor.",
+	"digest.energy.less":      "Das sind %.0f%% weniger als im Zeitraum davor.",
+	"digest.energy.top":       "%s hat am meisten verbraucht, %.1f kWh.",
+	"digest.energy.none":      "Es wurde kein Verbrauch erfasst.",
+	"digest.alerts":           "Warnungen",
+	"digest.alerts.count":     "Warnungen in diesem Zeitraum: %d.",
+	"digest.alerts.active":    "Noch aktiv: %s",
+	"digest.alerts.none":      "Nichts Ungewöhnliches ist passiert.",
+	"digest.maintenance":      "Wartung",
+	"digest.maintenance.none": "Keine Wartung fällig.",
+	"digest.warranty":         "Die Garantie von %s endet am %s, in %d Tagen.",
+
+	"dashboard.title":          "Hausautomation-Dashboard",
+	"dashboard.brand":          "Hausautomation",
+	"dashboard.dashboard":      "Übersicht",
+	"dashboard.devices":        "Geräte",
+	"dashboard.sensors":        "Sensoren",
+	"dashboard.settings":       "Einstellungen",
+	"dashboard.system_status":  "Systemstatus",
+	"dashboard.active_devices": "Aktive Geräte",
+	"dashboard.sensors_online": "Sensoren online",
+	"dashboard.loading":        "Wird geladen...",
+	"dashboard.online":         "Online",
+	"dashboard.offline":        "Offline",
+	"dashboard.no_devices":     "Keine Geräte gefunden.",
+	"dashboard.no_sensors":     "Keine Sensoren gefunden.",
+	"dashboard.turn_on":        "Einschalten",
+	"dashboard.turn_off":       "Ausschalten",
+	"dashboard.dim":            "Dimmen",
+	"dashboard.no_controls":    "Keine Steuerung verfügbar",
+	"dashboard.last_updated":   "Zuletzt aktualisiert",
+	"dashboard.unknown":        "Unbekannt",
+	"dashboard.rooms":          "Räume",
+	"dashboard.thermostats":    "Thermostate",
+	"dashboard.energy":         "Energie",
+	"dashboard.energy_days":    "Täglicher Verbrauch, letzte 7 Tage",
+	"dashboard.automations":    "Automatisierungen",
+	"dashboard.home_mode":      "Hausmodus",
+	"dashboard.mode_auto":      "Automatisch",
+	"dashboard.mode_home":      "Zuhause",
+	"dashboard.mode_away":      "Abwesend",
+	"dashboard.mode_night":     "Nacht",
+	"dashboard.mode_vacation":  "Urlaub",
+	"dashboard.alert_rules":    "Alarmregeln",
+	"dashboard.occupied":       "Belegt",
+	"dashboard.vacant":         "Frei",
+	"dashboard.target":         "Soll",
+	"dashboard.humidity":       "Luftfeuchtigkeit",
+	"dashboard.light":          "Licht",
+	"dashboard.total":          "Gesamt",
+	"dashboard.no_rooms":       "Noch keine Raumwerte.",
+	"dashboard.access_token":   "API-Token",
+	"dashboard.save":           "Speichern",
+	"dashboard.token_hint":     "Wird zum Schalten von Geräten und Ändern von Einstellungen benötigt. Erstellen mit home-automation-cli -cmd session-create.",
+	"dashboard.unauthorized":   "Hinterlege unter Einstellungen ein API-Token, um Änderungen vorzunehmen.",
+	"dashboard.registry":       "Geräteverzeichnis",
+	"dashboard.registry_hint":  "Benenne jedes Gerät und ordne es einem Raum zu. Tags werden durch Kommas getrennt.",
+	"dashboard.name":           "Name",
+	"dashboard.room":           "Raum",
+	"dashboard.icon":           "Symbol",
+	"dashboard.tags":           "Tags",
+}
+
+var french = map[string]string{
+	"severity.info":     "info",
+	"severity.warning":  "avertissement",
+	"severity.critical": "critique",
+
+	"metric.temperature": "température",
+	"metric.humidity":    "humidité",
+	"metric.power":       "puissance",
+	"metric.offline":     "hors ligne",
+
+	"alert.firing.title":   "[%s] %s",
+	"alert.resolved.title": "Résolu : %s",
+	"alert.offline":        "%s est hors ligne depuis %s.",
+	"alert.above":          "%s : %s de %.1f%s, au-dessus de %.1f%s.",
+	"alert.below":          "%s : %s de %.1f%s, en dessous de %.1f%s.",
+	"alert.online":         "%s est de nouveau en ligne.",
+	"alert.recovered":      "%s : %s revenue à %.1f%s.",
+	"alert.stuck":          "%s : %s bloqué à %.1f%s depuis %s.",
+	"alert.jump":           "%s : %s passé à %.1f%s depuis environ %.1f%s.",
+	"alert.unusual":        "%s : %s de %.1f%s inhabituel, d'habitude %.1f%s ± %.1f%s.",
+
+	"condensation.risk.title":   "Risque de condensation dans %s",
+	"condensation.risk":         "Le point de rosée de %.0f°F à %.0f%% d'humidité est proche des surfaces à %.0f°F ; le ventilateur accélère et la climatisation est retenue",
+	"condensation.rising.title": "L'humidité monte pendant la climatisation dans %s",
+	"condensation.rising":       "L'humidité a atteint %.0f%% malgré la climatisation ; vérifiez l'évacuation des condensats, la batterie et les fenêtres ouvertes",
+	"condensation.resolved":     "L'humidité est de %.0f%% avec un point de rosée à %.0f°F",
+
+	"hazard.leak":            "Fuite d'eau",
+	"hazard.smoke":           "Fumée",
+	"hazard.detector.leak":   "de fuite",
+	"hazard.detector.smoke":  "de fumée",
+	"hazard.detected.title":  "%s détectée dans %s",
+	"hazard.detected":        "Le détecteur %s dans %s s'est déclenché à %s",
+	"hazard.cleared.title":   "Fin de l'alerte : %s dans %s",
+	"hazard.cleared":         "Le détecteur %s dans %s est revenu au calme après %s",
+	"warranty.title":         "Fin de garantie : %s",
+	"warranty.ending":        "La garantie de %s se termine le %s, dans %d jours",
+	"warranty.ending.manual": "La garantie de %s se termine le %s, dans %d jours. Manuel : %s",
+	"cycle.finished.title":   "%s a terminé",
+	"cycle.finished":         "Cycle de %s terminé après %s",
+
+	"power.restored.title":     "Courant rétabli",
+	"power.back_after":         "Le courant est revenu après %s.",
+	"power.on_request":         "Routine de rétablissement lancée à la demande.",
+	"power.unknown_outage":     "Le courant est revenu après une coupure de durée inconnue.",
+	"power.result":             "%s : %s.",
+	"power.action.already_on":  "déjà allumés",
+	"power.action.switched_on": "allumés",
+	"power.action.sent":        "envoyés",
+	"power.action.skipped":     "ignorés",
+	"power.action.failed":      "en échec",
+
+	"departure.clear.title": "Tout est en ordre après votre départ",
+	"departure.check.title": "Vérifiez la maison après votre départ",
+	"departure.open":        "%s ouverte dans %s",
+	"departure.left_on":     "%s resté allumé",
+	"departure.running":     "%s en marche à %.0f W",
+	"departure.nothing":     "Aucune porte ni fenêtre ouverte et rien d'allumé",
+	"departure.turn_off":    "Éteindre le non essentiel",
+
+	"digest.daily.subject":    "Bilan de la maison du %s",
+	"digest.weekly.subject":   "Bilan hebdomadaire de la maison jusqu'au %s",
+	"digest.temperatures":     "Températures",
+	"digest.room":             "%s est à %.0f°F avec %.0f%% d'humidité.",
+	"digest.room.offline":     "%s n'a rien signalé depuis %s.",
+	"digest.outdoor":          "Dehors, il fait %.0f°F.",
+	"digest.no_rooms":         "Aucune pièce n'a signalé de température.",
+	"digest.energy":           "Énergie",
+	"digest.energy.daily":     "La maison a consommé %.1f kWh hier.",
+	"digest.energy.weekly":    "La maison a consommé %.1f kWh ces 7 derniers jours.",
+	"digest.energy.more":      "C'est %.0f%% de plus que la période précédente.",
+	"digest.energy.less":      "C'est %.0f%% de moins que la période précédente.",
+	"digest.energy.top":       "%s a consommé le plus, %.1f kWh.",
+	"digest.energy.none":      "Aucune consommation n'a été enregistrée.",
+	"digest.alerts":           "Alertes",
+	"digest.alerts.count":     "Alertes sur la période : %d.",
+	"digest.alerts.active":    "Toujours active : %s",
+	"digest.alerts.none":      "Rien d'inhabituel ne s'est produit.",
+	"digest.maintenance":      "Entretien",
+	"digest.maintenance.none": "Aucun entretien n'est prévu.",
+	"digest.warranty":         "La garantie de %s se termine le %s, dans %d jours.",
+
+	"dashboard.title":          "Tableau de bord domotique",
+	"dashboard.brand":          "Domotique",
+	"dashboard.dashboard":      "Tableau de bord",
+	"dashboard.devices":        "Appareils",
+	"dashboard.sensors":        "Capteurs",
+	"dashboard.settings":       "Paramètres",
+	"dashboard.system_status":  "État du système",
+	"dashboard.active_devices": "Appareils actifs",
+	"dashboard.sensors_online": "Capteurs en ligne",
+	"dashboard.loading":        "Chargement...",
+	"dashboard.online":         "En ligne",
+	"dashboard.offline":        "Hors ligne",
+	"dashboard.no_devices":     "Aucun appareil trouvé.",
+	"dashboard.no_sensors":     "Aucun capteur trouvé.",
+	"dashboard.turn_on":        "Allumer",
+	"dashboard.turn_off":       "Éteindre",
+	"dashboard.dim":            "Tamiser",
+	"dashboard.no_controls":    "Aucune commande disponible",
+	"dashboard.last_updated":   "Dernière mise à jour",
+	"dashboard.unknown":        "Inconnu",
+	"dashboard.rooms":          "Pièces",
+	"dashboard.thermostats":    "Thermostats",
+	"dashboard.energy":         "Énergie",
+	"dashboard.energy_days":    "Consommation quotidienne, 7 derniers jours",
+	"dashboard.automations":    "Automatisations",
+	"dashboard.home_mode":      "Mode de la maison",
+	"dashboard.mode_auto":      "Automatique",
+	"dashboard.mode_home":      "Présent",
+	"dashboard.mode_away":      "Absent",
+	"dashboard.mode_night":     "Nuit",
+	"dashboard.mode_vacation":  "Vacances",
+	"dashboard.alert_rules":    "Règles d'alerte",
+	"dashboard.occupied":       "Occupée",
+	"dashboard.vacant":         "Libre",
+	"dashboard.target":         "Consigne",
+	"dashboard.humidity":       "Humidité",
+	"dashboard.light":          "Lumière",
+	"dashboard.total":          "Total",
+	"dashboard.no_rooms":       "Aucune mesure de pièce pour l'instant.",
+	"dashboard.access_token":   "Jeton d'API",
+	"dashboard.save":           "Enregistrer",
+	"dashboard.token_hint":     "Nécessaire pour commander les appareils et modifier les réglages. Créez-en un avec home-automation-cli -cmd session-create.",
+	"dashboard.unauthorized":   "Saisissez un jeton d'API dans Paramètres pour faire des modifications.",
+	"dashboard.registry":       "Registre des appareils",
+	"dashboard.registry_hint":  "Nommez chaque appareil et placez-le dans une pièce. Les étiquettes sont séparées par des virgules.",
+	"dashboard.name":           "Nom",
+	"dashboard.room":           "Pièce",
+	"dashboard.icon":           "Icône",
+	"dashboard.tags":           "Étiquettes",
+}
@@ -0,0 +1,178 @@
+package identity
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// AssetDateFormat is the format of purchase dates
+const AssetDateFormat = "2006-01-02"
+
+// Asset is the inventory record of a device: what it is, when it was bought and how long its
+// warranty runs, for insurance claims and maintenance
+type Asset struct {
+	Manufacturer   string  `json:"manufacturer,omitempty"`
+	Model          string  `json:"model,omitempty"`
+	SerialNumber   string  `json:"serial_number,omitempty"`
+	PurchaseDate   string  `json:"purchase_date,omitempty"` // YYYY-MM-DD
+	PurchasePrice  float64 `json:"purchase_price,omitempty"`
+	WarrantyMonths int     `json:"warranty_months,omitempty"` // 0 without a warranty
+	ManualURL      string  `json:"manual_url,omitempty"`
+	Notes          string  `json:"notes,omitempty"`
+}
+
+// Validate checks the purchase date and that a warranty has a purchase date to run from
+func (a *Asset) Validate() error {
+	if a.PurchaseDate != "" {
+		if _, err := time.Parse(AssetDateFormat, a.PurchaseDate); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("invalid purchase date %q, use YYYY-MM-DD", a.PurchaseDate), err)
+		}
+	}
+	if a.WarrantyMonths < 0 || a.PurchasePrice < 0 {
+		return errors.NewValidationError("warranty months and purchase price must not be negative", nil)
+	}
+	if a.WarrantyMonths > 0 && a.PurchaseDate == "" {
+		return errors.NewValidationError("a warranty needs a purchase date", nil)
+	}
+	return nil
+}
+
+// WarrantyExpires returns the day the warranty ends, if the device has one
+func (a *Asset) WarrantyExpires() (time.Time, bool) {
+	if a == nil || a.WarrantyMonths <= 0 {
+		return time.Time{}, false
+	}
+	purchased, err := time.Parse(AssetDateFormat, a.PurchaseDate)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return purchased.AddDate(0, a.WarrantyMonths, 0), true
+}
+
+// SetAsset replaces the inventory record of a claimed device
+func (r *Registry) SetAsset(uuid string, asset Asset) error {
+	if err := asset.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	identity, exists := r.identities[uuid]
+	if !exists {
+		return errors.NewValidationError("unknown device UUID: "+uuid, nil)
+	}
+
+	identity.Asset = &asset
+	identity.UpdatedAt = time.Now()
+	return r.save()
+}
+
+// ExpiringWarranties returns the devices whose warranty ends within the given time of now,
+// soonest first. Warranties that already ended are left out.
+func (r *Registry) ExpiringWarranties(now time.Time, within time.Duration) []Identity {
+	var expiring []Identity
+	for _, device := range r.List() {
+		expires, ok := device.Asset.WarrantyExpires()
+		if ok && expires.After(now) && expires.Sub(now) <= within {
+			expiring = append(expiring, device)
+		}
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		a, _ := expiring[i].Asset.WarrantyExpires()
+		b, _ := expiring[j].Asset.WarrantyExpires()
+		return a.Before(b)
+	})
+	return expiring
+}
+
+// inventoryColumns are the columns of the CSV inventory export
+var inventoryColumns = []string{
+	"uuid", "name", "manufacturer", "model", "serial_number", "purchase_date", "purchase_price",
+	"warranty_months", "warranty_expires", "manual_url", "notes", "aliases",
+}
+
+// WriteInventoryCSV writes the devices as a CSV inventory, one row per device, for insurers
+// and spreadsheets
+func WriteInventoryCSV(w io.Writer, devices []Identity) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(inventoryColumns); err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		asset := Asset{}
+		if device.Asset != nil {
+			asset = *device.Asset
+		}
+
+		var price, months, expires string
+		if asset.PurchasePrice > 0 {
+			price = strconv.FormatFloat(asset.PurchasePrice, 'f', 2, 64)
+		}
+		if asset.WarrantyMonths > 0 {
+			months = strconv.Itoa(asset.WarrantyMonths)
+		}
+		if end, ok := asset.WarrantyExpires(); ok {
+			expires = end.Format(AssetDateFormat)
+		}
+
+		aliases := make([]string, 0, len(device.Aliases))
+		for _, alias := range device.Aliases {
+			aliases = append(aliases, fmt.Sprintf("%s=%s", alias.Kind, alias.Value))
+		}
+
+		if err := writer.Write([]string{
+			device.UUID, device.Name, asset.Manufacturer, asset.Model, asset.SerialNumber, asset.PurchaseDate, price,
+			months, expires, asset.ManualURL, asset.Notes, strings.Join(aliases, " "),
+		}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// InventoryHandler serves the device inventory as JSON, or as CSV with ?format=csv. With
+// ?expiring_days= it lists only the warranties ending within that many days.
+func InventoryHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := registry.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		devices := registry.List()
+		if days := r.URL.Query().Get("expiring_days"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n < 0 {
+				http.Error(w, "expiring_days must be a number of days", http.StatusBadRequest)
+				return
+			}
+			devices = registry.ExpiringWarranties(time.Now(), time.Duration(n)*24*time.Hour)
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+			if err := WriteInventoryCSV(w, devices); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+	})
+}
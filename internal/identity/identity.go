@@ -0,0 +1,373 @@
+package identity
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// AliasKind names the kind of identifier a device is known by
+type AliasKind string
+
+const (
+	AliasDeviceID     AliasKind = "device_id"      // Free-form ID from configuration
+	AliasMAC          AliasKind = "mac"            // Network MAC address
+	AliasVendorID     AliasKind = "vendor_id"      // ID reported by the vendor firmware
+	AliasMQTTDeviceID AliasKind = "mqtt_device_id" // device_id field of sensor MQTT messages
+	AliasIP           AliasKind = "ip"             // Last known IP address, never used for matching
+	AliasAssetID      AliasKind = "asset_id"       // ID announced to asset discovery over mDNS or SSDP
+)
+
+// RegistryFileName is the device identity registry file inside the state directory
+const RegistryFileName = "devices.json"
+
+// Alias is one identifier a device is known by
+type Alias struct {
+	Kind  AliasKind `json:"kind"`
+	Value string    `json:"value"`
+}
+
+// Identity is a device with its stable UUID, all of its aliases and where it is in the home
+type Identity struct {
+	UUID    string   `json:"uuid"`
+	Name    string   `json:"name"`
+	Aliases []Alias  `json:"aliases"`
+	RoomID  string   `json:"room_id,omitempty"`
+	Icon    string   `json:"icon,omitempty"` // Dashboard icon, e.g. an emoji
+	Tags    []string `json:"tags,omitempty"`
+	// NameEdited is set once the user renames the device; services claiming it keep that name
+	NameEdited bool      `json:"name_edited,omitempty"`
+	ClaimedAt  time.Time `json:"claimed_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Asset is the device's purchase, warranty and manual record; nil until one is set
+	Asset *Asset `json:"asset,omitempty"`
+}
+
+// Registry assigns stable UUIDs to devices at claim time and maps their aliases to them
+type Registry struct {
+	path       string
+	identities map[string]*Identity
+	index      map[Alias]string
+	mu         sync.RWMutex
+}
+
+// NewRegistry creates a registry backed by path, loading previously claimed devices.
+// An empty path keeps the registry in memory only.
+func NewRegistry(path string) (*Registry, error) {
+	registry := &Registry{
+		path:       path,
+		identities: make(map[string]*Identity),
+		index:      make(map[Alias]string),
+	}
+
+	if err := registry.Reload(); err != nil {
+		return registry, err
+	}
+
+	return registry, nil
+}
+
+// Reload re-reads the registry file, picking up devices claimed by other processes
+func (r *Registry) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read device registry", err)
+	}
+
+	var identities []*Identity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return errors.NewConfigError("failed to parse device registry", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.identities = make(map[string]*Identity, len(identities))
+	r.index = make(map[Alias]string)
+	for _, identity := range identities {
+		r.identities[identity.UUID] = identity
+		for _, alias := range identity.Aliases {
+			r.index[alias] = identity.UUID
+		}
+	}
+
+	return nil
+}
+
+// Handler serves the claimed devices as JSON. With ?kind=&value= it resolves a single alias.
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := registry.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		kind, value := r.URL.Query().Get("kind"), r.URL.Query().Get("value")
+		if kind == "" && value == "" {
+			json.NewEncoder(w).Encode(registry.List())
+			return
+		}
+
+		uuid, exists := registry.Resolve(NewAlias(AliasKind(kind), value))
+		if !exists {
+			http.Error(w, "device not found", http.StatusNotFound)
+			return
+		}
+		identity, _ := registry.Get(uuid)
+		json.NewEncoder(w).Encode(identity)
+	})
+}
+
+// RegistryPath returns the device registry file path for a state directory
+func RegistryPath(stateDir string) string {
+	return filepath.Join(stateDir, RegistryFileName)
+}
+
+// NewAlias creates a normalized alias, e.g. MAC addresses in lower case with colons
+func NewAlias(kind AliasKind, value string) Alias {
+	value = strings.TrimSpace(value)
+	if kind == AliasMAC {
+		value = strings.ToLower(strings.ReplaceAll(value, "-", ":"))
+	}
+	return Alias{Kind: kind, Value: value}
+}
+
+// Claim returns the identity matching any of the aliases, or assigns a new UUID.
+// New aliases are attached to the identity; an alias claimed by another device moves over.
+// The name replaces the device's unless the user has renamed it.
+func (r *Registry) Claim(name string, aliases ...Alias) (Identity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	identity := r.match(aliases)
+	if identity == nil {
+		var err error
+		if identity, err = r.create(name, now); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	if name != "" && !identity.NameEdited {
+		identity.Name = name
+	}
+	for _, alias := range aliases {
+		r.attach(identity, alias)
+	}
+	identity.UpdatedAt = now
+
+	if err := r.save(); err != nil {
+		return Identity{}, err
+	}
+
+	return copyIdentity(identity), nil
+}
+
+// AddAlias attaches another alias to a claimed device
+func (r *Registry) AddAlias(uuid string, alias Alias) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	identity, exists := r.identities[uuid]
+	if !exists {
+		return errors.NewValidationError("unknown device UUID: "+uuid, nil)
+	}
+
+	if owner, exists := r.index[alias]; exists && owner == uuid && alias.Kind != AliasIP {
+		return nil
+	}
+
+	r.attach(identity, alias)
+	identity.UpdatedAt = time.Now()
+	return r.save()
+}
+
+// Resolve returns the UUID of the device known by an alias
+func (r *Registry) Resolve(alias Alias) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	uuid, exists := r.index[alias]
+	return uuid, exists
+}
+
+// Get returns a claimed device by UUID
+func (r *Registry) Get(uuid string) (Identity, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	identity, exists := r.identities[uuid]
+	if !exists {
+		return Identity{}, false
+	}
+	return copyIdentity(identity), true
+}
+
+// List returns all claimed devices sorted by name
+func (r *Registry) List() []Identity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	identities := make([]Identity, 0, len(r.identities))
+	for _, identity := range r.identities {
+		identities = append(identities, copyIdentity(identity))
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Name < identities[j].Name
+	})
+	return identities
+}
+
+// match returns the identity known by any of the aliases other than an IP; callers must hold the lock
+func (r *Registry) match(aliases []Alias) *Identity {
+	for _, alias := range aliases {
+		if alias.Kind == AliasIP || alias.Value == "" {
+			continue
+		}
+		if uuid, exists := r.index[alias]; exists {
+			return r.identities[uuid]
+		}
+	}
+	return nil
+}
+
+// create assigns a new UUID to a device without aliases yet; callers must hold the lock
+func (r *Registry) create(name string, now time.Time) (*Identity, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	identity := &Identity{
+		UUID:      uuid,
+		Name:      name,
+		Aliases:   make([]Alias, 0),
+		ClaimedAt: now,
+	}
+	r.identities[uuid] = identity
+	return identity, nil
+}
+
+// attach adds an alias to an identity, moving it from any other device; callers must hold the lock.
+// A device keeps a single IP alias, which is replaced when the address changes.
+func (r *Registry) attach(identity *Identity, alias Alias) {
+	if alias.Value == "" {
+		return
+	}
+
+	if owner, exists := r.index[alias]; exists {
+		if owner == identity.UUID {
+			return
+		}
+		r.detach(r.identities[owner], alias)
+	}
+
+	if alias.Kind == AliasIP {
+		for _, existing := range identity.Aliases {
+			if existing.Kind == AliasIP {
+				r.detach(identity, existing)
+				break
+			}
+		}
+	}
+
+	identity.Aliases = append(identity.Aliases, alias)
+	r.index[alias] = identity.UUID
+}
+
+// detach removes an alias from an identity; callers must hold the lock
+func (r *Registry) detach(identity *Identity, alias Alias) {
+	delete(r.index, alias)
+	if identity == nil {
+		return
+	}
+
+	remaining := identity.Aliases[:0]
+	for _, existing := range identity.Aliases {
+		if existing != alias {
+			remaining = append(remaining, existing)
+		}
+	}
+	identity.Aliases = remaining
+}
+
+// save atomically writes the registry file; callers must hold the lock
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	identities := make([]*Identity, 0, len(r.identities))
+	for _, identity := range r.identities {
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].ClaimedAt.Before(identities[j].ClaimedAt)
+	})
+
+	data, err := json.MarshalIndent(identities, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal device registry", err)
+	}
+
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write device registry", err)
+	}
+
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		return errors.NewSystemError("failed to replace device registry", err)
+	}
+
+	return nil
+}
+
+// copyIdentity returns a copy that callers can use without holding the lock
+func copyIdentity(identity *Identity) Identity {
+	result := *identity
+	result.Aliases = append([]Alias(nil), identity.Aliases...)
+	result.Tags = append([]string(nil), identity.Tags...)
+	if identity.Asset != nil {
+		asset := *identity.Asset
+		result.Asset = &asset
+	}
+	return result
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.NewSystemError("failed to generate device UUID", err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,303 @@
+package identity
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestClaimAssignsStableUUID(t *testing.T) {
+	registry, err := NewRegistry("")
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+
+	first, err := registry.Claim("Kitchen Plug", NewAlias(AliasDeviceID, "kitchen_plug"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if !uuidPattern.MatchString(first.UUID) {
+		t.Errorf("Expected a v4 UUID, got %q", first.UUID)
+	}
+
+	// Claiming again by a different alias of the same device keeps the UUID
+	if err := registry.AddAlias(first.UUID, NewAlias(AliasMAC, "AA-BB-CC-DD-EE-FF")); err != nil {
+		t.Fatalf("AddAlias failed: %v", err)
+	}
+	second, err := registry.Claim("", NewAlias(AliasMAC, "aa:bb:cc:dd:ee:ff"), NewAlias(AliasMQTTDeviceID, "pico-kitchen"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if second.UUID != first.UUID {
+		t.Errorf("Expected UUID %s, got %s", first.UUID, second.UUID)
+	}
+	if second.Name != "Kitchen Plug" {
+		t.Errorf("Expected name to be kept, got %q", second.Name)
+	}
+
+	uuid, exists := registry.Resolve(NewAlias(AliasMQTTDeviceID, "pico-kitchen"))
+	if !exists || uuid != first.UUID {
+		t.Errorf("Expected MQTT device ID to resolve to %s, got %q", first.UUID, uuid)
+	}
+
+	other, err := registry.Claim("Hall Plug", NewAlias(AliasDeviceID, "hall_plug"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if other.UUID == first.UUID {
+		t.Error("Expected a different device to get a new UUID")
+	}
+}
+
+func TestIPAliasIsNotUsedForMatching(t *testing.T) {
+	registry, _ := NewRegistry("")
+
+	first, _ := registry.Claim("Plug A", NewAlias(AliasDeviceID, "a"), NewAlias(AliasIP, "192.168.1.50"))
+
+	// DHCP handed the address to another device
+	second, err := registry.Claim("Plug B", NewAlias(AliasDeviceID, "b"), NewAlias(AliasIP, "192.168.1.50"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if second.UUID == first.UUID {
+		t.Fatal("Expected an IP alias not to merge two devices")
+	}
+
+	uuid, _ := registry.Resolve(NewAlias(AliasIP, "192.168.1.50"))
+	if uuid != second.UUID {
+		t.Errorf("Expected the IP to move to the latest claim, got %s", uuid)
+	}
+
+	moved, _ := registry.Get(first.UUID)
+	for _, alias := range moved.Aliases {
+		if alias.Kind == AliasIP {
+			t.Errorf("Expected the previous owner to lose the IP alias, still has %v", alias)
+		}
+	}
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	path := RegistryPath(t.TempDir())
+
+	registry, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	claimed, err := registry.Claim("Living Room Lamp", NewAlias(AliasDeviceID, "lamp"), NewAlias(AliasVendorID, "8022ABCD"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	reloaded, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("Failed to reload registry: %v", err)
+	}
+
+	uuid, exists := reloaded.Resolve(NewAlias(AliasVendorID, "8022ABCD"))
+	if !exists || uuid != claimed.UUID {
+		t.Errorf("Expected UUID %s after reload, got %q", claimed.UUID, uuid)
+	}
+
+	identities := reloaded.List()
+	if len(identities) != 1 || identities[0].Name != "Living Room Lamp" {
+		t.Errorf("Unexpected identities after reload: %+v", identities)
+	}
+
+	if filepath.Base(path) != RegistryFileName {
+		t.Errorf("Unexpected registry path %s", path)
+	}
+}
+
+func TestHandlerResolvesAlias(t *testing.T) {
+	registry, _ := NewRegistry("")
+	claimed, _ := registry.Claim("Hall Sensor", NewAlias(AliasMQTTDeviceID, "pico-hall"))
+
+	recorder := httptest.NewRecorder()
+	Handler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/api/device-identities?kind=mqtt_device_id&value=pico-hall", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+
+	var resolved Identity
+	if err := json.NewDecoder(recorder.Body).Decode(&resolved); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resolved.UUID != claimed.UUID {
+		t.Errorf("Expected UUID %s, got %s", claimed.UUID, resolved.UUID)
+	}
+
+	recorder = httptest.NewRecorder()
+	Handler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/api/device-identities?kind=mac&value=00:11:22:33:44:55", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown alias, got %d", recorder.Code)
+	}
+}
+
+func TestAssetWarrantyAndInventory(t *testing.T) {
+	registry, _ := NewRegistry(RegistryPath(t.TempDir()))
+	fridge, _ := registry.Claim("Fridge Plug", NewAlias(AliasDeviceID, "fridge_plug"))
+	heater, _ := registry.Claim("Heater Plug", NewAlias(AliasDeviceID, "heater_plug"))
+	registry.Claim("Hall Sensor", NewAlias(AliasMQTTDeviceID, "pico-hall"))
+
+	if err := registry.SetAsset(fridge.UUID, Asset{Model: "P110", WarrantyMonths: 24}); err == nil {
+		t.Error("Expected a warranty without a purchase date to be rejected")
+	}
+	if err := registry.SetAsset(fridge.UUID, Asset{Model: "P110", PurchaseDate: "2023-03-15", WarrantyMonths: 24, Notes: "Kitchen, behind the fridge"}); err != nil {
+		t.Fatalf("SetAsset failed: %v", err)
+	}
+	if err := registry.SetAsset(heater.UUID, Asset{PurchaseDate: "2022-01-10", WarrantyMonths: 12}); err != nil {
+		t.Fatalf("SetAsset failed: %v", err)
+	}
+
+	now := time.Date(2025, 2, 20, 12, 0, 0, 0, time.UTC)
+	expiring := registry.ExpiringWarranties(now, 30*24*time.Hour)
+	if len(expiring) != 1 || expiring[0].UUID != fridge.UUID {
+		t.Fatalf("Expected only the fridge plug's warranty to be expiring, got %+v", expiring)
+	}
+	if expires, _ := expiring[0].Asset.WarrantyExpires(); expires.Format(AssetDateFormat) != "2025-03-15" {
+		t.Errorf("Expected the warranty to end on 2025-03-15, got %s", expires)
+	}
+
+	recorder := httptest.NewRecorder()
+	InventoryHandler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/api/inventory?format=csv", nil))
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read the CSV inventory: %v", err)
+	}
+	if len(rows) != 4 || rows[1][1] != "Fridge Plug" || rows[1][8] != "2025-03-15" || rows[1][10] != "Kitchen, behind the fridge" {
+		t.Errorf("Unexpected CSV inventory: %v", rows)
+	}
+}
+
+func TestUpdateKeepsEditedName(t *testing.T) {
+	path := RegistryPath(t.TempDir())
+	registry, _ := NewRegistry(path)
+	plug, _ := registry.Claim("tapo_p110_01", NewAlias(AliasDeviceID, "plug_01"))
+
+	name, room := " Fridge ", "kitchen"
+	tags := []string{"appliance", " ", "appliance", "always-on"}
+	if _, err := registry.Update(plug.UUID, DeviceUpdate{Name: &name, RoomID: &room, Tags: &tags}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	empty := ""
+	if _, err := registry.Update(plug.UUID, DeviceUpdate{Name: &empty}); err == nil {
+		t.Error("Expected an empty name to be rejected")
+	}
+
+	// The service claiming the plug by its configured name doesn't undo the rename
+	claimed, err := registry.Claim("tapo_p110_01", NewAlias(AliasDeviceID, "plug_01"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if claimed.Name != "Fridge" || claimed.RoomID != "kitchen" || len(claimed.Tags) != 2 || claimed.Tags[1] != "always-on" {
+		t.Errorf("Unexpected device after claiming again: %+v", claimed)
+	}
+
+	reloaded, _ := NewRegistry(path)
+	if device, _ := reloaded.Get(plug.UUID); device.Name != "Fridge" || !device.NameEdited {
+		t.Errorf("Expected the edited name after reload, got %+v", device)
+	}
+}
+
+func TestMergeAndLinkDiscoveredDevices(t *testing.T) {
+	registry, _ := NewRegistry("")
+	lamp, _ := registry.Claim("Desk Lamp", NewAlias(AliasDeviceID, "desk_lamp"))
+
+	// Discovery finds the lamp under its MAC before anything ties the two together
+	found, err := registry.Link("tapo-l530", "office", NewAlias(AliasAssetID, "tapo-8022"), NewAlias(AliasMAC, "AA:BB:CC:00:11:22"))
+	if err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if found.UUID == lamp.UUID || found.Name != "tapo-l530" || found.RoomID != "office" {
+		t.Fatalf("Expected a new device for the discovered asset, got %+v", found)
+	}
+
+	merged, err := registry.Merge(lamp.UUID, found.UUID)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merged.Name != "Desk Lamp" || merged.RoomID != "office" || len(merged.Aliases) != 3 {
+		t.Errorf("Unexpected merged device: %+v", merged)
+	}
+	if _, exists := registry.Get(found.UUID); exists {
+		t.Error("Expected the merged device to be gone")
+	}
+	if uuid, _ := registry.Resolve(NewAlias(AliasMAC, "aa:bb:cc:00:11:22")); uuid != lamp.UUID {
+		t.Errorf("Expected the MAC to resolve to the lamp, got %q", uuid)
+	}
+
+	// Discovering it again links to the lamp without renaming or moving it
+	room := "living-room"
+	registry.Update(lamp.UUID, DeviceUpdate{RoomID: &room})
+	linked, _ := registry.Link("tapo-l530", "office", NewAlias(AliasAssetID, "tapo-8022"), NewAlias(AliasIP, "192.168.1.60"))
+	if linked.UUID != lamp.UUID || linked.Name != "Desk Lamp" || linked.RoomID != "living-room" || len(linked.Aliases) != 4 {
+		t.Errorf("Unexpected linked device: %+v", linked)
+	}
+
+	if err := registry.Delete(lamp.UUID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, exists := registry.Resolve(NewAlias(AliasDeviceID, "desk_lamp")); exists || len(registry.List()) != 0 {
+		t.Error("Expected the deleted device and its aliases to be forgotten")
+	}
+}
+
+func TestDeviceRegistryHandlers(t *testing.T) {
+	registry, _ := NewRegistry(RegistryPath(t.TempDir()))
+	registry.Claim("Hall Sensor", NewAlias(AliasMQTTDeviceID, "pico-hall"))
+
+	serve := func(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return recorder
+	}
+
+	recorder := serve(CreateHandler(registry), http.MethodPost, "/api/devices/registry/create",
+		`{"name": "Desk Lamp", "room_id": "office", "icon": "💡", "tags": ["lighting"], "aliases": [{"kind": "mac", "value": "AA-BB-CC-00-11-22"}]}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var lamp Identity
+	json.NewDecoder(recorder.Body).Decode(&lamp)
+	if lamp.Icon != "💡" || lamp.Aliases[0].Value != "aa:bb:cc:00:11:22" {
+		t.Errorf("Unexpected created device: %+v", lamp)
+	}
+	if recorder := serve(CreateHandler(registry), http.MethodPost, "/api/devices/registry/create", `{"room_id": "office"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a device without a name to be rejected, got %d", recorder.Code)
+	}
+
+	var devices []Identity
+	json.NewDecoder(serve(DevicesHandler(registry), http.MethodGet, "/api/devices/registry?room=office", "").Body).Decode(&devices)
+	if len(devices) != 1 || devices[0].UUID != lamp.UUID {
+		t.Errorf("Expected only the lamp in the office, got %+v", devices)
+	}
+
+	if recorder := serve(UpdateHandler(registry), http.MethodPost, "/api/devices/registry/update?uuid="+lamp.UUID, `{"tags": ["lighting", "evening"]}`); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	json.NewDecoder(serve(DevicesHandler(registry), http.MethodGet, "/api/devices/registry?tag=evening", "").Body).Decode(&devices)
+	if len(devices) != 1 || devices[0].RoomID != "office" {
+		t.Errorf("Expected the lamp tagged evening and still in the office, got %+v", devices)
+	}
+
+	if recorder := serve(UpdateHandler(registry), http.MethodPost, "/api/devices/registry/update?uuid=unknown", `{}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown device, got %d", recorder.Code)
+	}
+	if recorder := serve(DeleteHandler(registry), http.MethodGet, "/api/devices/registry/delete?uuid="+lamp.UUID, ""); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, got %d", recorder.Code)
+	}
+	if recorder := serve(DeleteHandler(registry), http.MethodPost, "/api/devices/registry/delete?uuid="+lamp.UUID, ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", recorder.Code)
+	}
+	if len(registry.List()) != 1 {
+		t.Errorf("Expected only the hall sensor left, got %+v", registry.List())
+	}
+}
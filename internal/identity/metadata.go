@@ -0,0 +1,372 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// DeviceUpdate changes the user-editable fields of a device; nil fields are left as they are
+type DeviceUpdate struct {
+	Name   *string   `json:"name,omitempty"`
+	RoomID *string   `json:"room_id,omitempty"`
+	Icon   *string   `json:"icon,omitempty"`
+	Tags   *[]string `json:"tags,omitempty"` // Replaces all tags; an empty list clears them
+}
+
+// Update changes a device's name, room, icon or tags. A name set here is kept over the names
+// the services claim the device with.
+func (r *Registry) Update(uuid string, update DeviceUpdate) (Identity, error) {
+	if update.Name != nil && strings.TrimSpace(*update.Name) == "" {
+		return Identity{}, errors.NewValidationError("a device name must not be empty", nil)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	identity, exists := r.identities[uuid]
+	if !exists {
+		return Identity{}, errors.NewValidationError("unknown device UUID: "+uuid, nil)
+	}
+
+	if update.Name != nil {
+		identity.Name = strings.TrimSpace(*update.Name)
+		identity.NameEdited = true
+	}
+	if update.RoomID != nil {
+		identity.RoomID = strings.TrimSpace(*update.RoomID)
+	}
+	if update.Icon != nil {
+		identity.Icon = strings.TrimSpace(*update.Icon)
+	}
+	if update.Tags != nil {
+		identity.Tags = normalizeTags(*update.Tags)
+	}
+	identity.UpdatedAt = time.Now()
+
+	if err := r.save(); err != nil {
+		return Identity{}, err
+	}
+	return copyIdentity(identity), nil
+}
+
+// Delete forgets a device and its aliases. A service that claims it again gets a new UUID.
+func (r *Registry) Delete(uuid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	identity, exists := r.identities[uuid]
+	if !exists {
+		return errors.NewValidationError("unknown device UUID: "+uuid, nil)
+	}
+
+	for _, alias := range identity.Aliases {
+		delete(r.index, alias)
+	}
+	delete(r.identities, uuid)
+	return r.save()
+}
+
+// Merge folds the device from into the device into, for one physical device claimed twice under
+// unrelated aliases. into gets all the aliases, keeps its own metadata and takes from's where it
+// has none; from is deleted.
+func (r *Registry) Merge(into, from string) (Identity, error) {
+	if into == from {
+		return Identity{}, errors.NewValidationError("can't merge a device into itself", nil)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	target, exists := r.identities[into]
+	if !exists {
+		return Identity{}, errors.NewValidationError("unknown device UUID: "+into, nil)
+	}
+	source, exists := r.identities[from]
+	if !exists {
+		return Identity{}, errors.NewValidationError("unknown device UUID: "+from, nil)
+	}
+
+	for _, alias := range append([]Alias(nil), source.Aliases...) {
+		r.attach(target, alias)
+	}
+	if target.Name == "" || (source.NameEdited && !target.NameEdited) {
+		target.Name = source.Name
+		target.NameEdited = source.NameEdited
+	}
+	if target.RoomID == "" {
+		target.RoomID = source.RoomID
+	}
+	if target.Icon == "" {
+		target.Icon = source.Icon
+	}
+	target.Tags = normalizeTags(append(target.Tags, source.Tags...))
+	if target.Asset == nil {
+		target.Asset = source.Asset
+	}
+	if source.ClaimedAt.Before(target.ClaimedAt) {
+		target.ClaimedAt = source.ClaimedAt
+	}
+	target.UpdatedAt = time.Now()
+	delete(r.identities, from)
+
+	if err := r.save(); err != nil {
+		return Identity{}, err
+	}
+	return copyIdentity(target), nil
+}
+
+// Link claims a device found by asset discovery. Unlike Claim, the discovered name and room
+// only fill in what the registry doesn't know yet, so a device the services named keeps its
+// name, and the file is only written when something changed.
+func (r *Registry) Link(name, roomID string, aliases ...Alias) (Identity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	identity := r.match(aliases)
+	if identity == nil {
+		var err error
+		if identity, err = r.create(name, now); err != nil {
+			return Identity{}, err
+		}
+		changed = true
+	}
+
+	if identity.Name == "" && name != "" {
+		identity.Name = name
+		changed = true
+	}
+	if identity.RoomID == "" && roomID != "" {
+		identity.RoomID = roomID
+		changed = true
+	}
+	for _, alias := range aliases {
+		if owner, exists := r.index[alias]; alias.Value != "" && (!exists || owner != identity.UUID) {
+			r.attach(identity, alias)
+			changed = true
+		}
+	}
+	if !changed {
+		return copyIdentity(identity), nil
+	}
+
+	identity.UpdatedAt = now
+	if err := r.save(); err != nil {
+		return Identity{}, err
+	}
+	return copyIdentity(identity), nil
+}
+
+// normalizeTags trims tags and drops empty and repeated ones, ignoring case, keeping their order
+func normalizeTags(tags []string) []string {
+	var result []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		duplicate := false
+		for _, existing := range result {
+			duplicate = duplicate || strings.EqualFold(existing, tag)
+		}
+		if !duplicate {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// hasTag reports whether a device carries a tag, ignoring case
+func hasTag(identity Identity, tag string) bool {
+	for _, existing := range identity.Tags {
+		if strings.EqualFold(existing, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// DevicesHandler serves the device registry as JSON, optionally only the devices in ?room= or
+// tagged ?tag=. With ?uuid= it serves a single device.
+func DevicesHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := registry.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		if uuid := query.Get("uuid"); uuid != "" {
+			device, exists := registry.Get(uuid)
+			if !exists {
+				http.Error(w, "device not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(device)
+			return
+		}
+
+		devices := make([]Identity, 0)
+		for _, device := range registry.List() {
+			if room := query.Get("room"); room != "" && device.RoomID != room {
+				continue
+			}
+			if tag := query.Get("tag"); tag != "" && !hasTag(device, tag) {
+				continue
+			}
+			devices = append(devices, device)
+		}
+		json.NewEncoder(w).Encode(devices)
+	})
+}
+
+// CreateHandler registers a device on POST with a JSON body of its name, aliases and metadata,
+// e.g. {"name": "Desk Lamp", "room_id": "office", "aliases": [{"kind": "mac", "value": "..."}]}.
+// A device already known by one of the aliases is updated instead.
+func CreateHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to register a device", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			DeviceUpdate
+			Aliases []Alias `json:"aliases"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid device request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if request.Name == nil || strings.TrimSpace(*request.Name) == "" {
+			http.Error(w, "a device needs a name", http.StatusBadRequest)
+			return
+		}
+		if err := registry.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		aliases := make([]Alias, 0, len(request.Aliases))
+		for _, alias := range request.Aliases {
+			aliases = append(aliases, NewAlias(alias.Kind, alias.Value))
+		}
+		claimed, err := registry.Claim("", aliases...)
+		if err == nil {
+			claimed, err = registry.Update(claimed.UUID, request.DeviceUpdate)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(claimed)
+	})
+}
+
+// UpdateHandler changes the device ?uuid= on POST with a JSON DeviceUpdate body,
+// e.g. {"room_id": "kitchen", "tags": ["lighting"]}
+func UpdateHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to update a device", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var update DeviceUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("invalid device update: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !reloadDevice(w, registry, r.URL.Query().Get("uuid")) {
+			return
+		}
+
+		device, err := registry.Update(r.URL.Query().Get("uuid"), update)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(device)
+	})
+}
+
+// DeleteHandler forgets the device ?uuid= on POST
+func DeleteHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to delete a device", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uuid := r.URL.Query().Get("uuid")
+		if !reloadDevice(w, registry, uuid) {
+			return
+		}
+		if err := registry.Delete(uuid); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// MergeHandler folds the device ?from= into the device ?into= on POST
+func MergeHandler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to merge devices", http.StatusMethodNotAllowed)
+			return
+		}
+
+		into, from := r.URL.Query().Get("into"), r.URL.Query().Get("from")
+		if !reloadDevice(w, registry, into) {
+			return
+		}
+		if _, exists := registry.Get(from); !exists {
+			http.Error(w, fmt.Sprintf("device %s not found", from), http.StatusNotFound)
+			return
+		}
+
+		merged, err := registry.Merge(into, from)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(merged)
+	})
+}
+
+// reloadDevice picks up changes from other processes and reports whether the device exists,
+// answering the request when it doesn't
+func reloadDevice(w http.ResponseWriter, registry *Registry, uuid string) bool {
+	if err := registry.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if _, exists := registry.Get(uuid); !exists {
+		http.Error(w, fmt.Sprintf("device %s not found", uuid), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// writeError answers with 400 for invalid requests and 500 for anything else
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,253 @@
+// Package lifecycle starts the services of a daemon and stops them again in reverse order,
+// each stop bounded by a timeout, so a shutdown finishes in-flight work, saves state and says
+// goodbye on the network instead of leaving goroutines running until the process exits.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// DefaultStopTimeout bounds the stop of one service when the group isn't given another
+const DefaultStopTimeout = 10 * time.Second
+
+// Service is a component with background work. Start begins the work and returns; Stop ends
+// it and waits for it to finish, giving up when its ctx is done.
+type Service interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Background runs the goroutines of a service between Start and Stop. Services embed it, or
+// hold it as a field, to implement Service for their loops.
+//
+// The loops run until Stop, not until the ctx given to Start is done: the ctx only passes on
+// its values, so a Group decides the order in which they end.
+type Background struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start runs each loop in its own goroutine with a context that is cancelled by Stop
+func (b *Background) Start(ctx context.Context, loops ...func(ctx context.Context)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cancel != nil {
+		return errors.NewServiceError("service is already running", nil)
+	}
+
+	ctx, b.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	for _, loop := range loops {
+		b.wg.Add(1)
+		go func(loop func(context.Context)) {
+			defer b.wg.Done()
+			loop(ctx)
+		}(loop)
+	}
+	return nil
+}
+
+// Running reports whether the loops were started and not stopped
+func (b *Background) Running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cancel != nil
+}
+
+// Stop cancels the loops and waits for them to return, or for ctx to be done. Stopping a
+// service that isn't running does nothing.
+func (b *Background) Stop(ctx context.Context) error {
+	b.mu.Lock()
+	cancel := b.cancel
+	b.cancel = nil
+	b.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.NewTimeoutError("service did not stop in time", ctx.Err())
+	}
+}
+
+// Run adapts a blocking run loop, such as a service's Run(ctx), to a Service
+func Run(run func(ctx context.Context)) Service {
+	return &runner{run: run}
+}
+
+type runner struct {
+	run        func(ctx context.Context)
+	background Background
+}
+
+func (r *runner) Start(ctx context.Context) error {
+	return r.background.Start(ctx, r.run)
+}
+
+func (r *runner) Stop(ctx context.Context) error {
+	return r.background.Stop(ctx)
+}
+
+// Hooks adapts a pair of functions to a Service, e.g. saving state on stop. Either may be nil.
+type Hooks struct {
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+// Start calls OnStart
+func (h Hooks) Start(ctx context.Context) error {
+	if h.OnStart == nil {
+		return nil
+	}
+	return h.OnStart(ctx)
+}
+
+// Stop calls OnStop
+func (h Hooks) Stop(ctx context.Context) error {
+	if h.OnStop == nil {
+		return nil
+	}
+	return h.OnStop(ctx)
+}
+
+// OnStop returns a Service that only calls stop when it is stopped, e.g. to save state or to
+// close a connection
+func OnStop(stop func() error) Service {
+	return Hooks{OnStop: func(context.Context) error { return stop() }}
+}
+
+// member is a started service of a group
+type member struct {
+	name    string
+	service Service
+}
+
+// Group holds the started services of a daemon and stops them in the reverse of the order
+// they were started in: automations before the services they drive, and those before the
+// connections and state they need on the way out.
+type Group struct {
+	mu          sync.Mutex
+	members     []member
+	stopping    bool
+	stopTimeout time.Duration
+	logger      *logger.Logger
+}
+
+// NewGroup returns an empty group stopping each service within stopTimeout, or within
+// DefaultStopTimeout when it is zero
+func NewGroup(stopTimeout time.Duration) *Group {
+	if stopTimeout <= 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+	return &Group{
+		stopTimeout: stopTimeout,
+		logger:      logger.NewLogger("lifecycle", nil),
+	}
+}
+
+// Start starts service and adds it to the group, to be stopped by Stop. A service that fails
+// to start isn't added.
+func (g *Group) Start(ctx context.Context, name string, service Service) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopping {
+		return errors.NewServiceError(fmt.Sprintf("not starting %s while shutting down", name), nil)
+	}
+	if err := service.Start(ctx); err != nil {
+		return errors.NewServiceError(fmt.Sprintf("failed to start %s", name), err)
+	}
+	g.members = append(g.members, member{name: name, service: service})
+	return nil
+}
+
+// Go starts a blocking run loop as a service of the group, as Start does with Run(run)
+func (g *Group) Go(ctx context.Context, name string, run func(ctx context.Context)) {
+	if err := g.Start(ctx, name, Run(run)); err != nil {
+		g.logger.Warn("Run loop not started", map[string]interface{}{
+			"service": name,
+			"error":   err.Error(),
+		})
+	}
+}
+
+// Names returns the names of the services in the order they were started
+func (g *Group) Names() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names := make([]string, len(g.members))
+	for i, m := range g.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// Stop stops the services in reverse order, each within the group's stop timeout and all of
+// them within ctx. A service that fails or times out is logged and the rest are still stopped;
+// once ctx is done, the rest are given up on. Services can't be started afterwards.
+func (g *Group) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	g.stopping = true
+	members := g.members
+	g.members = nil
+	g.mu.Unlock()
+
+	var failed []string
+	var firstErr error
+	for i := len(members) - 1; i >= 0; i-- {
+		m := members[i]
+		if ctx.Err() != nil {
+			failed = append(failed, m.name)
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			continue
+		}
+
+		started := time.Now()
+		stopCtx, cancel := context.WithTimeout(ctx, g.stopTimeout)
+		err := m.service.Stop(stopCtx)
+		cancel()
+		if err != nil {
+			failed = append(failed, m.name)
+			if firstErr == nil {
+				firstErr = err
+			}
+			g.logger.Error("Service did not stop cleanly", err, map[string]interface{}{
+				"service":  m.name,
+				"duration": time.Since(started).String(),
+			})
+			continue
+		}
+		g.logger.Debug("Service stopped", map[string]interface{}{
+			"service":  m.name,
+			"duration": time.Since(started).String(),
+		})
+	}
+
+	if len(failed) > 0 {
+		return errors.NewServiceError(fmt.Sprintf("%d of %d services did not stop cleanly: %s",
+			len(failed), len(members), strings.Join(failed, ", ")), firstErr)
+	}
+	return nil
+}
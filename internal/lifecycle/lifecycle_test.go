@@ -0,0 +1,128 @@
+package lifecycle
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+func TestGroupStopsInReverseOrder(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	// The parent context being cancelled, as on a signal, doesn't end the loops: the group does
+	parent, cancel := context.WithCancel(context.Background())
+	group := NewGroup(time.Second)
+	group.Start(parent, "state", OnStop(func() error {
+		record("saved")
+		return nil
+	}))
+	for _, name := range []string{"thermostats", "automations"} {
+		name := name
+		group.Go(parent, name, func(ctx context.Context) {
+			<-ctx.Done()
+			record(name + " stopped")
+		})
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if len(events) != 0 {
+		t.Errorf("Expected the loops running after the parent context ended, got %v", events)
+	}
+	mu.Unlock()
+
+	if names := group.Names(); strings.Join(names, ",") != "state,thermostats,automations" {
+		t.Errorf("Expected the services in start order, got %v", names)
+	}
+	if err := group.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(events, ","); got != "automations stopped,thermostats stopped,saved" {
+		t.Errorf("Expected the services stopped in reverse order, got %s", got)
+	}
+
+	if err := group.Start(context.Background(), "late", Hooks{}); err == nil {
+		t.Error("Expected no service started after the group stopped")
+	}
+}
+
+func TestGroupBoundsEachStop(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	group := NewGroup(50 * time.Millisecond)
+	saved := false
+	group.Start(context.Background(), "state", OnStop(func() error {
+		saved = true
+		return nil
+	}))
+	group.Go(context.Background(), "stuck", func(ctx context.Context) { <-release })
+	group.Start(context.Background(), "failing", OnStop(func() error {
+		return errors.NewServiceError("broker gone", nil)
+	}))
+
+	started := time.Now()
+	err := group.Stop(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 services did not stop cleanly: failing, stuck") {
+		t.Errorf("Expected the failed and stuck services reported, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the stuck service given up on after its timeout, took %v", elapsed)
+	}
+	if !saved {
+		t.Error("Expected the services after a stuck one still stopped")
+	}
+}
+
+func TestBackground(t *testing.T) {
+	var background Background
+	ticks := make(chan struct{}, 1)
+	loop := func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ticks <- struct{}{}:
+			}
+		}
+	}
+
+	if err := background.Stop(context.Background()); err != nil {
+		t.Errorf("Expected stopping a service never started to do nothing, got %v", err)
+	}
+	if err := background.Start(context.Background(), loop); err != nil {
+		t.Fatal(err)
+	}
+	if err := background.Start(context.Background(), loop); err == nil {
+		t.Error("Expected a second start rejected")
+	}
+	<-ticks
+	if !background.Running() {
+		t.Error("Expected the service running")
+	}
+
+	if err := background.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if background.Running() {
+		t.Error("Expected the service stopped")
+	}
+
+	// A stopped service can be started again
+	if err := background.Start(context.Background(), loop); err != nil {
+		t.Fatal(err)
+	}
+	if err := background.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
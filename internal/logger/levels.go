@@ -0,0 +1,303 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// Components whose verbosity can be changed at runtime. Loggers of other services are a
+	// component of their own, named after the service in lower case.
+	ComponentMQTT       = "mqtt"
+	ComponentTapo       = "tapo"
+	ComponentDiscovery  = "discovery"
+	ComponentAutomation = "automation"
+
+	// recentLogSize is how many entries are kept in memory whatever the levels, so debug logs
+	// from just before an incident can still be read
+	recentLogSize = 1000
+)
+
+// componentServices maps the service names of loggers to their component
+var componentServices = map[string]string{
+	"mqtt-client":             ComponentMQTT,
+	"MQTTDeviceService":       ComponentMQTT,
+	"TopicMigrationService":   ComponentMQTT,
+	"tapo-service":            ComponentTapo,
+	"tapo-metrics":            ComponentTapo,
+	"discovery":               ComponentDiscovery,
+	"AutomationService":       ComponentAutomation,
+	"MotionService":           ComponentAutomation,
+	"MotionTuner":             ComponentAutomation,
+	"LightService":            ComponentAutomation,
+	"FollowMeService":         ComponentAutomation,
+	"ExteriorLightingService": ComponentAutomation,
+	"SceneService":            ComponentAutomation,
+	"ScheduleService":         ComponentAutomation,
+	"AlertService":            ComponentAutomation,
+}
+
+var levelRank = map[LogLevel]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+	LogLevelFatal: 4,
+}
+
+// levels holds the default level and the per-component overrides. The default is DEBUG, so
+// services that never configure levels log everything as before.
+var levels = struct {
+	sync.RWMutex
+	fallback    LogLevel
+	byComponent map[string]LogLevel
+}{fallback: LogLevelDebug, byComponent: make(map[string]LogLevel)}
+
+// ComponentOf returns the component a service's logger belongs to
+func ComponentOf(serviceName string) string {
+	if component, ok := componentServices[serviceName]; ok {
+		return component
+	}
+	return strings.ToLower(serviceName)
+}
+
+// ParseLevel parses a level name such as "debug" or "WARN"
+func ParseLevel(name string) (LogLevel, error) {
+	level := LogLevel(strings.ToUpper(strings.TrimSpace(name)))
+	if level == "WARNING" {
+		level = LogLevelWarn
+	}
+	if _, ok := levelRank[level]; !ok {
+		return "", errors.NewValidationError(fmt.Sprintf("unknown log level %q", name), nil)
+	}
+	return level, nil
+}
+
+// ApplyLevels sets the levels from a spec such as "info,mqtt=debug,tapo=warn". A bare level
+// sets the default; component=level overrides it for one component.
+func ApplyLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		component, name, overrides := strings.Cut(part, "=")
+		if !overrides {
+			name = component
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		if overrides {
+			SetLevel(strings.TrimSpace(component), level)
+		} else {
+			SetDefaultLevel(level)
+		}
+	}
+	return nil
+}
+
+// SetDefaultLevel sets the level of components without an override
+func SetDefaultLevel(level LogLevel) {
+	levels.Lock()
+	defer levels.Unlock()
+	levels.fallback = level
+}
+
+// SetLevel overrides the level of one component
+func SetLevel(component string, level LogLevel) {
+	levels.Lock()
+	defer levels.Unlock()
+	levels.byComponent[component] = level
+}
+
+// ResetLevel returns a component to the default level
+func ResetLevel(component string) {
+	levels.Lock()
+	defer levels.Unlock()
+	delete(levels.byComponent, component)
+}
+
+// Level returns the level a component logs at
+func Level(component string) LogLevel {
+	levels.RLock()
+	defer levels.RUnlock()
+	if level, ok := levels.byComponent[component]; ok {
+		return level
+	}
+	return levels.fallback
+}
+
+// Enabled reports whether a component writes entries of a level
+func Enabled(component string, level LogLevel) bool {
+	return levelRank[level] >= levelRank[Level(component)]
+}
+
+// LevelStatus is the default level and the components overriding it
+type LevelStatus struct {
+	Default    LogLevel            `json:"default"`
+	Components map[string]LogLevel `json:"components"`
+}
+
+// Levels returns the current levels
+func Levels() LevelStatus {
+	levels.RLock()
+	defer levels.RUnlock()
+
+	status := LevelStatus{Default: levels.fallback, Components: make(map[string]LogLevel)}
+	for component, level := range levels.byComponent {
+		status.Components[component] = level
+	}
+	return status
+}
+
+// recentEntry is an entry kept in the ring buffer with the component that wrote it
+type recentEntry struct {
+	component string
+	entry     LogEntry
+}
+
+// recent is a ring buffer of the latest entries of every level
+var recent = struct {
+	sync.Mutex
+	entries []recentEntry
+	next    int
+}{}
+
+func record(component string, entry *LogEntry) {
+	recent.Lock()
+	defer recent.Unlock()
+
+	if len(recent.entries) < recentLogSize {
+		recent.entries = append(recent.entries, recentEntry{component, *entry})
+		return
+	}
+	recent.entries[recent.next] = recentEntry{component, *entry}
+	recent.next = (recent.next + 1) % recentLogSize
+}
+
+// Recent returns up to limit of the latest entries at or above minLevel, oldest first. An
+// empty component returns the entries of all components.
+func Recent(component string, minLevel LogLevel, limit int) []LogEntry {
+	recent.Lock()
+	defer recent.Unlock()
+
+	var entries []LogEntry
+	for i := range recent.entries {
+		kept := recent.entries[(recent.next+i)%len(recent.entries)]
+		if component != "" && kept.component != component {
+			continue
+		}
+		if levelRank[kept.entry.Level] < levelRank[minLevel] {
+			continue
+		}
+		entries = append(entries, kept.entry)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// LevelsHandler serves the levels on GET and changes one on POST with a body such as
+// {"component": "mqtt", "level": "debug"}. An empty component sets the default, and the level
+// "default" removes a component's override.
+func LevelsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var change struct {
+				Component string `json:"component"`
+				Level     string `json:"level"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+				http.Error(w, "invalid level change: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if change.Component != "" && strings.EqualFold(change.Level, "default") {
+				ResetLevel(change.Component)
+				break
+			}
+			level, err := ParseLevel(change.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if change.Component == "" {
+				SetDefaultLevel(level)
+			} else {
+				SetLevel(change.Component, level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Levels())
+	})
+}
+
+// RecentHandler serves the latest entries kept in memory. The component, level (minimum, debug
+// by default) and limit query parameters narrow them down.
+func RecentHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		minLevel := LogLevelDebug
+		if name := query.Get("level"); name != "" {
+			level, err := ParseLevel(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			minLevel = level
+		}
+		limit := 200
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		entries := Recent(query.Get("component"), minLevel, limit)
+		if entries == nil {
+			entries = []LogEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"components": components(),
+			"entries":    entries,
+		})
+	})
+}
+
+// components lists the known components and those seen in the ring buffer
+func components() []string {
+	seen := map[string]bool{ComponentMQTT: true, ComponentTapo: true, ComponentDiscovery: true, ComponentAutomation: true}
+	recent.Lock()
+	for _, kept := range recent.entries {
+		seen[kept.component] = true
+	}
+	recent.Unlock()
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
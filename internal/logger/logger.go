@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"time"
 
 	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/redact"
 	"github.com/johnpr01/home-automation/pkg/kafka"
 )
 
@@ -26,19 +28,28 @@ const (
 // Logger provides structured logging with error handling integration
 type Logger struct {
 	serviceName string
+	component   string
 	kafkaClient *kafka.Client
 	stdLogger   *log.Logger
+	plainLines  bool // Printf lines are written as they are in the default format
 }
 
 // NewLogger creates a new logger instance
 func NewLogger(serviceName string, kafkaClient *kafka.Client) *Logger {
 	return &Logger{
 		serviceName: serviceName,
+		component:   ComponentOf(serviceName),
 		kafkaClient: kafkaClient,
-		stdLogger:   log.New(os.Stdout, fmt.Sprintf("[%s] ", serviceName), log.LstdFlags|log.Lshortfile),
+		stdLogger:   log.New(sharedOutput{}, fmt.Sprintf("[%s] ", serviceName), log.LstdFlags|log.Lshortfile),
 	}
 }
 
+// SetOutput redirects the log lines of this logger alone, e.g. to stderr when stdout carries
+// structured output
+func (l *Logger) SetOutput(w io.Writer) {
+	l.stdLogger.SetOutput(w)
+}
+
 // LogEntry represents a structured log entry
 type LogEntry struct {
 	Timestamp time.Time              `json:"timestamp"`
@@ -170,8 +181,32 @@ func (l *Logger) log(level LogLevel, message string, err error, context ...map[s
 	}
 }
 
-// writeLog writes the log entry to stdout
+// writeLog redacts the log entry, keeps it in the recent log and writes it in the configured
+// format if its component logs at that level. Kafka gets the same redacted entry.
 func (l *Logger) writeLog(entry *LogEntry) {
+	entry.Message = redact.String(entry.Message)
+	entry.Error = redact.String(entry.Error)
+	entry.Context = redact.Map(entry.Context)
+	record(l.component, entry)
+	if !Enabled(l.component, entry.Level) {
+		return
+	}
+
+	switch Format() {
+	case FormatJSON:
+		if jsonData, err := json.Marshal(entry); err == nil {
+			l.stdLogger.Writer().Write(append(jsonData, '\n'))
+			return
+		}
+	case FormatText:
+		l.stdLogger.Writer().Write([]byte(formatText(entry)))
+		return
+	}
+	if l.plainLines {
+		l.stdLogger.Println(entry.Message)
+		return
+	}
+
 	// Write structured JSON for automated processing
 	if jsonData, err := json.Marshal(entry); err == nil {
 		l.stdLogger.Println(string(jsonData))
@@ -187,13 +222,16 @@ func (l *Logger) sendToKafka(entry *LogEntry) {
 		return
 	}
 
+	deviceUUID, _ := entry.Context["device_uuid"].(string)
+
 	kafkaMsg := &kafka.LogMessage{
-		Timestamp: entry.Timestamp.Format(time.RFC3339),
-		Level:     string(entry.Level),
-		Service:   entry.Service,
-		Message:   entry.Message,
-		DeviceID:  entry.DeviceID,
-		Action:    "log",
+		Timestamp:  entry.Timestamp.Format(time.RFC3339),
+		Level:      string(entry.Level),
+		Service:    entry.Service,
+		Message:    entry.Message,
+		DeviceID:   entry.DeviceID,
+		DeviceUUID: deviceUUID,
+		Action:     "log",
 		Metadata: map[string]interface{}{
 			"error_type": entry.ErrorType,
 			"severity":   entry.Severity,
@@ -0,0 +1,172 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// Formats of the log lines. The default, empty, writes each entry as JSON after the
+	// [service] prefix and time of the standard logger.
+	FormatJSON = "json" // One JSON object per line, for machine ingestion
+	FormatText = "text" // Time, level, service, message and context as key=value, for reading
+)
+
+// output is the format and writer of every logger not given an output of its own
+var output = struct {
+	sync.RWMutex
+	format string
+	writer io.Writer
+}{writer: os.Stdout}
+
+// sharedOutput writes to the configured writer
+type sharedOutput struct{}
+
+func (sharedOutput) Write(p []byte) (int, error) {
+	output.RLock()
+	writer := output.writer
+	output.RUnlock()
+	return writer.Write(p)
+}
+
+// SetFormat sets the format of the log lines: json, text or empty for the default
+func SetFormat(format string) error {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format != "" && format != FormatJSON && format != FormatText {
+		return errors.NewValidationError(fmt.Sprintf("unknown log format %q, use json or text", format), nil)
+	}
+	output.Lock()
+	defer output.Unlock()
+	output.format = format
+	return nil
+}
+
+// Format returns the format of the log lines
+func Format() string {
+	output.RLock()
+	defer output.RUnlock()
+	return output.format
+}
+
+// SetWriter sends the log lines of every logger without an output of its own to w
+func SetWriter(w io.Writer) {
+	output.Lock()
+	defer output.Unlock()
+	output.writer = w
+}
+
+// ConfigureOutput applies the format and log file of cfg. When either is set, lines written with
+// the standard log package become entries of serviceName too, as with NewStdLogger, so they are
+// filtered, formatted and written alike. It returns the log file to close on exit, nil for stdout.
+func ConfigureOutput(cfg config.LogConfig, serviceName string) (*RotatingFile, error) {
+	if err := SetFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+
+	var file *RotatingFile
+	if cfg.File != "" {
+		var err error
+		file, err = OpenRotatingFile(cfg.File, int64(cfg.MaxSizeMB)*1024*1024,
+			time.Duration(cfg.RotateHours)*time.Hour, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		SetWriter(file)
+	}
+
+	if cfg.Format != "" || cfg.File != "" {
+		log.SetFlags(0)
+		log.SetPrefix("")
+		log.SetOutput(&lineWriter{logger: newLineLogger(serviceName)})
+	}
+	return file, nil
+}
+
+// NewStdLogger returns a standard logger for services that log with Printf. Its lines become
+// entries of serviceName: lines starting with "Failed" or "Error" are errors and lines starting
+// with "Invalid" or "Warning" warnings, the others informational.
+func NewStdLogger(serviceName string) *log.Logger {
+	return log.New(&lineWriter{logger: newLineLogger(serviceName)}, "", 0)
+}
+
+// newLineLogger returns a logger for Printf lines, written as they are in the default format
+func newLineLogger(serviceName string) *Logger {
+	logger := NewLogger(serviceName, nil)
+	logger.plainLines = true
+	logger.stdLogger.SetFlags(log.LstdFlags)
+	return logger
+}
+
+// lineWriter turns the lines of a standard logger into entries
+type lineWriter struct {
+	logger *Logger
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.log(levelOfLine(line), line, nil)
+	}
+	return len(p), nil
+}
+
+// levelOfLine guesses the level of a Printf line from how it starts
+func levelOfLine(line string) LogLevel {
+	switch {
+	case strings.HasPrefix(line, "Failed"), strings.HasPrefix(line, "Error"):
+		return LogLevelError
+	case strings.HasPrefix(line, "Invalid"), strings.HasPrefix(line, "Warning"):
+		return LogLevelWarn
+	}
+	return LogLevelInfo
+}
+
+// formatText renders an entry as a line of text with its context sorted by key
+func formatText(entry *LogEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", entry.Timestamp.Format("2006-01-02T15:04:05.000Z07:00"), entry.Level, entry.Service, entry.Message)
+	if entry.Error != "" {
+		fmt.Fprintf(&b, " error=%s", textValue(entry.Error))
+	}
+	for _, field := range []struct{ key, value string }{
+		{"error_type", entry.ErrorType}, {"device_id", entry.DeviceID}, {"room_id", entry.RoomID},
+	} {
+		if _, inContext := entry.Context[field.key]; field.value != "" && !inContext {
+			fmt.Fprintf(&b, " %s=%s", field.key, textValue(field.value))
+		}
+	}
+
+	keys := make([]string, 0, len(entry.Context))
+	for key := range entry.Context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := entry.Context[key]
+		if _, isString := value.(string); !isString {
+			if data, err := json.Marshal(value); err == nil {
+				value = string(data)
+			}
+		}
+		fmt.Fprintf(&b, " %s=%s", key, textValue(fmt.Sprint(value)))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// textValue quotes values with spaces, quotes or equals signs
+func textValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetOutput(t *testing.T) {
+	resetLevels(t)
+	t.Cleanup(func() {
+		SetFormat("")
+		SetWriter(os.Stdout)
+	})
+}
+
+func TestOutputFormats(t *testing.T) {
+	resetOutput(t)
+	var out bytes.Buffer
+	SetWriter(&out)
+	serviceLogger := NewLogger("ThermostatService", nil)
+	std := NewStdLogger("unified")
+
+	if err := SetFormat("JSON"); err != nil {
+		t.Fatal(err)
+	}
+	serviceLogger.Info("Heating started", map[string]interface{}{"room_id": "kitchen"})
+	var entry LogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil || entry.Level != LogLevelInfo || entry.Context["room_id"] != "kitchen" {
+		t.Errorf("Expected a bare JSON object per line, got %q (%v)", out.String(), err)
+	}
+
+	// Printf lines are entries too, their level taken from how they start
+	out.Reset()
+	std.Printf("Failed to load alerts: %v", os.ErrNotExist)
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil || entry.Level != LogLevelError || entry.Service != "unified" {
+		t.Errorf("Expected the Printf line as an error entry, got %q", out.String())
+	}
+
+	out.Reset()
+	SetFormat("text")
+	serviceLogger.Error("Sensor offline", os.ErrDeadlineExceeded, map[string]interface{}{"room_id": "garage", "readings": []int{1, 2}})
+	line := out.String()
+	if !strings.Contains(line, " ERROR [ThermostatService] Sensor offline error=\"i/o timeout\" readings=[1,2] room_id=garage\n") {
+		t.Errorf("Unexpected text line %q", line)
+	}
+
+	// Levels filter the Printf lines as well
+	out.Reset()
+	SetDefaultLevel(LogLevelWarn)
+	std.Printf("Replayed %d messages", 3)
+	std.Printf("Invalid HA_LOCALE")
+	if strings.Contains(out.String(), "Replayed") || !strings.Contains(out.String(), "WARN  [unified] Invalid HA_LOCALE") {
+		t.Errorf("Expected only the warning written, got %q", out.String())
+	}
+
+	if err := SetFormat("xml"); err == nil {
+		t.Error("Expected an unknown format rejected")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "gateway.log")
+	file, err := OpenRotatingFile(path, 20, 24*time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	file.now = func() time.Time { return now }
+	file.period = file.periodOf(now)
+
+	// Rotated by size, with a suffix for rotations in the same second
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := file.Rotated()
+	if len(rotated) != 2 || !strings.HasSuffix(rotated[0], ".20261018-090000") || !strings.HasSuffix(rotated[1], ".20261018-090000-1") {
+		t.Fatalf("Expected two rotations by size, got %v", rotated)
+	}
+	if data, _ := os.ReadFile(rotated[0]); string(data) != "first line\n" {
+		t.Errorf("Expected the first line rotated first, got %q", data)
+	}
+
+	// Rotated at midnight, keeping two backups
+	now = now.Add(15 * time.Hour)
+	file.Write([]byte("next day\n"))
+	rotated, _ = file.Rotated()
+	if len(rotated) != 2 || !strings.HasSuffix(rotated[1], ".20261019-000000") {
+		t.Errorf("Expected the oldest pruned and a rotation for the new day, got %v", rotated)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "next day\n" {
+		t.Errorf("Expected the new day in the log file, got %q", data)
+	}
+}
@@ -0,0 +1,181 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// rotatedSuffix is the time format appended to a rotated file's name
+const rotatedSuffix = "20060102-150405"
+
+// RotatingFile is a log file that is rotated when it reaches a size and, with an interval, when
+// a new interval starts, e.g. every day at midnight UTC. Rotated files are renamed with the time
+// of rotation, gateway.log.20261018-000000, and the oldest beyond the backups to keep are
+// removed. It suits gateways writing to an SD card without a log stack to rotate for them.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	period     time.Time // Start of the interval the file was written in
+	now        func() time.Time
+	mu         sync.Mutex
+}
+
+// OpenRotatingFile opens or creates the log file at path. A maxSize or interval of 0 disables
+// that kind of rotation; maxBackups of 0 keeps every rotated file.
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.NewSystemError("failed to create the log directory", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file for appending, continuing the interval it was last written in
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewSystemError("failed to open log file "+f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.NewSystemError("failed to open log file "+f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.period = f.periodOf(info.ModTime())
+	if f.size == 0 {
+		f.period = f.periodOf(f.now())
+	}
+	return nil
+}
+
+// periodOf returns the start of the interval t is in
+func (f *RotatingFile) periodOf(t time.Time) time.Time {
+	if f.interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.interval)
+}
+
+// Write writes p to the file, rotating it first when p would take it past the size or a new
+// interval has started
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, errors.NewSystemError("log file "+f.path+" is closed", nil)
+	}
+	now := f.now()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) || !f.periodOf(now).Equal(f.period)) {
+		if err := f.rotate(now); err != nil {
+			// Keep logging to the full file rather than losing the entry
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file with the time and opens a new one; f.mu must be held
+func (f *RotatingFile) rotate(now time.Time) error {
+	rotated := f.path + "." + now.Format(rotatedSuffix)
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, now.Format(rotatedSuffix), i)
+	}
+
+	if err := f.file.Close(); err != nil {
+		return errors.NewSystemError("failed to close log file", err)
+	}
+	f.file = nil
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return errors.NewSystemError("failed to rename log file", renameErr)
+	}
+	f.period = f.periodOf(now)
+	return f.prune()
+}
+
+// prune removes the oldest rotated files beyond the backups to keep
+func (f *RotatingFile) prune() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	rotated, err := f.Rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > f.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return errors.NewSystemError("failed to remove old log file", err)
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Rotated returns the paths of the rotated files, oldest first
+func (f *RotatingFile) Rotated() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, errors.NewSystemError("failed to list rotated log files", err)
+	}
+	var rotated []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, f.path+".")
+		stamp, _, _ := strings.Cut(suffix, "-")
+		if len(suffix) >= len(rotatedSuffix) && len(stamp) == len("20060102") {
+			rotated = append(rotated, match)
+		}
+	}
+	// The timestamps sort in time order, a collision's -N after the plain name
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Close closes the file; later writes fail
+func (f *RotatingFile) Close() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,459 @@
+// Package migrate rewrites persisted state and configuration when the house changes shape, such
+// as a room being renamed, so history and mappings follow instead of being orphaned.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// validRoomID keeps room IDs usable as a single MQTT topic level and InfluxDB tag value
+var validRoomID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// motionRulePrefix names the motion-light rule generated for every room
+const motionRulePrefix = "motion-light-"
+
+// JSON fields holding room IDs, shared by the state and configuration files
+var (
+	roomValueFields = map[string]bool{"room_id": true, "room": true, "lux_room": true}
+	roomKeyFields   = map[string]bool{"rooms": true, "runtime": true, "daily": true}
+	roomListFields  = map[string]bool{"adjacent": true}
+	ruleFields      = map[string]bool{"rule_id": true}
+	targetFields    = map[string]bool{"enabled": true} // Safe mode targets, e.g. automation:motion-light-kitchen
+)
+
+// rootKind says how the top level of a file refers to rooms besides its fields
+type rootKind int
+
+const (
+	rootFields rootKind = iota // Only the fields above
+	rootKeys                   // An object keyed by room
+	rootValues                 // An object whose values are rooms
+)
+
+// stateFiles are the files of the state directory that refer to rooms
+var stateFiles = []struct {
+	name string
+	root rootKind
+}{
+	{services.PresenceFileName, rootKeys},
+	{services.ThermostatScheduleFileName, rootFields},
+	{services.RoomEnergyFileName, rootFields},
+	{services.GatewayRoomEnergyFileName, rootFields},
+	{services.EnergyCostFileName, rootFields},
+	{services.MotionTuningFileName, rootFields},
+	{services.MatterRoomsFileName, rootValues},
+	{identity.RegistryFileName, rootFields},
+	{safemode.StateFileName, rootFields},
+}
+
+// RoomHistory stores the historical readings of rooms, e.g. the InfluxDB client
+type RoomHistory interface {
+	CountRoomPoints(ctx context.Context, roomID string) (int64, error)
+	RenameRoom(ctx context.Context, from, to string) error
+}
+
+// Publisher moves retained messages on the broker, e.g. the MQTT client
+type Publisher interface {
+	Publish(msg *mqtt.Message) error
+}
+
+// RoomRename renames a room across the state directory, the configuration files, the retained
+// topics and the historical readings. The services must be stopped while it runs, or they
+// write the old room back.
+type RoomRename struct {
+	From        string
+	To          string
+	StateDir    string
+	ConfigFiles []string    // Configuration files naming rooms, e.g. the MQTT devices and follow-me files
+	History     RoomHistory // Nil when the readings aren't in InfluxDB
+	Broker      Publisher   // Nil leaves the broker alone; the state cache is still migrated
+}
+
+// Change is one thing a rename changes, for the preview
+type Change struct {
+	Target      string `json:"target"` // File path, topic or "history"
+	Description string `json:"description"`
+}
+
+// Plan is a prepared rename. Nothing is changed until it is applied.
+type Plan struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Changes []Change `json:"changes"`
+
+	rename  *RoomRename
+	files   []fileUpdate
+	topics  []topicMove
+	history bool
+}
+
+type fileUpdate struct {
+	path string
+	data []byte
+	mode os.FileMode
+}
+
+// topicMove moves a retained message; a nil payload only clears the old topic
+type topicMove struct {
+	from    string
+	to      string
+	payload []byte
+}
+
+// Plan works out everything the rename changes without changing anything
+func (r *RoomRename) Plan(ctx context.Context) (*Plan, error) {
+	if !validRoomID.MatchString(r.From) || !validRoomID.MatchString(r.To) {
+		return nil, errors.NewValidationError("room IDs may only contain letters, digits, '.', '_' and '-'", nil)
+	}
+	if r.From == r.To {
+		return nil, errors.NewValidationError("the room already has that ID", nil)
+	}
+
+	plan := &Plan{From: r.From, To: r.To, rename: r}
+
+	for _, file := range stateFiles {
+		if err := plan.addFile(filepath.Join(r.StateDir, file.name), file.root); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range r.ConfigFiles {
+		if path == "" {
+			continue
+		}
+		if err := plan.addFile(path, rootFields); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.addStateCache(mqtt.StateCachePath(r.StateDir)); err != nil {
+		return nil, err
+	}
+
+	if r.History != nil {
+		points, err := r.History.CountRoomPoints(ctx, r.From)
+		if err != nil {
+			return nil, err
+		}
+		if points > 0 {
+			plan.history = true
+			plan.Changes = append(plan.Changes, Change{Target: "history", Description: fmt.Sprintf("relabel %d readings", points)})
+		}
+	}
+	return plan, nil
+}
+
+// Apply carries out the plan. The files are written next to the originals first, so a failure
+// before the history is moved leaves everything as it was; the files then replace the originals
+// and the broker is updated last.
+func (p *Plan) Apply(ctx context.Context) error {
+	var written []string
+	for _, file := range p.files {
+		tmpPath := file.path + ".tmp"
+		if err := os.WriteFile(tmpPath, file.data, file.mode); err != nil {
+			removeAll(written)
+			return errors.NewSystemError("failed to write "+file.path, err)
+		}
+		written = append(written, tmpPath)
+	}
+
+	if p.history {
+		if err := p.rename.History.RenameRoom(ctx, p.From, p.To); err != nil {
+			removeAll(written)
+			return err
+		}
+	}
+
+	for _, file := range p.files {
+		if err := os.Rename(file.path+".tmp", file.path); err != nil {
+			return errors.NewSystemError("failed to replace "+file.path, err)
+		}
+	}
+
+	if p.rename.Broker == nil {
+		return nil
+	}
+	for _, move := range p.topics {
+		if move.payload != nil {
+			if err := p.rename.Broker.Publish(&mqtt.Message{Topic: move.to, Payload: move.payload, QoS: 1, Retain: true}); err != nil {
+				return err
+			}
+		}
+		// An empty retained message clears the old topic
+		if err := p.rename.Broker.Publish(&mqtt.Message{Topic: move.from, Payload: []byte{}, QoS: 1, Retain: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile plans the rewrite of a JSON file; missing files are skipped
+func (p *Plan) addFile(path string, root rootKind) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read "+path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.NewSystemError("failed to read "+path, err)
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return errors.NewConfigError("failed to parse "+path, err)
+	}
+
+	rewriter := &roomRewriter{from: p.From, to: p.To}
+	document = rewriter.root(document, root)
+	if rewriter.conflict != "" {
+		return errors.NewValidationError(fmt.Sprintf("%s already has room %s (%s); merge the rooms by hand", path, p.To, rewriter.conflict), nil)
+	}
+	if rewriter.changed == 0 {
+		return nil
+	}
+
+	updated, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal "+path, err)
+	}
+	p.files = append(p.files, fileUpdate{path: path, data: updated, mode: info.Mode().Perm()})
+	p.Changes = append(p.Changes, Change{Target: path, Description: "rename " + count(rewriter.changed, "reference")})
+	return nil
+}
+
+// addStateCache plans moving the cached messages of the room's topics, which are also the
+// retained messages to move on the broker
+func (p *Plan) addStateCache(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read MQTT state cache", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.NewSystemError("failed to read MQTT state cache", err)
+	}
+	var messages []mqtt.CachedMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return errors.NewConfigError("failed to parse MQTT state cache", err)
+	}
+
+	moved := make(map[string]string)
+	taken := make(map[string]bool)
+	for i, to := range roomTopics(p.To) {
+		moved[roomTopics(p.From)[i]] = to
+	}
+	for _, message := range messages {
+		taken[message.Topic] = true
+	}
+
+	kept := messages[:0]
+	for _, message := range messages {
+		to, isRoom := moved[message.Topic]
+		if !isRoom {
+			kept = append(kept, message)
+			continue
+		}
+
+		// The new topic's own message is newer, e.g. from a sensor already reconfigured. Encrypted
+		// payloads are bound to their topic and can't move; the device republishes them.
+		payload, ok := p.rewritePayload(message.Payload)
+		switch {
+		case taken[to]:
+			p.topics = append(p.topics, topicMove{from: message.Topic})
+			p.Changes = append(p.Changes, Change{Target: message.Topic, Description: "clear (" + to + " is already in use)"})
+			continue
+		case !ok:
+			p.topics = append(p.topics, topicMove{from: message.Topic})
+			p.Changes = append(p.Changes, Change{Target: message.Topic, Description: "clear (encrypted, republished by the device)"})
+			continue
+		}
+		p.topics = append(p.topics, topicMove{from: message.Topic, to: to, payload: payload})
+		p.Changes = append(p.Changes, Change{Target: message.Topic, Description: "move to " + to})
+		message.Topic, message.Payload = to, payload
+		kept = append(kept, message)
+	}
+	if len(p.topics) == 0 {
+		return nil
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Topic < kept[j].Topic
+	})
+	updated, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal MQTT state cache", err)
+	}
+	p.files = append(p.files, fileUpdate{path: path, data: updated, mode: info.Mode().Perm()})
+	p.Changes = append(p.Changes, Change{Target: path, Description: "move " + count(len(p.topics), "cached topic")})
+	return nil
+}
+
+// rewritePayload renames the room inside a JSON payload; ok is false for payloads that aren't JSON
+func (p *Plan) rewritePayload(payload []byte) ([]byte, bool) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, false
+	}
+
+	rewriter := &roomRewriter{from: p.From, to: p.To}
+	document = rewriter.root(document, rootFields)
+	if rewriter.changed == 0 {
+		return payload, true
+	}
+	updated, err := json.Marshal(document)
+	if err != nil {
+		return nil, false
+	}
+	return updated, true
+}
+
+// roomTopics lists the topics carrying a room's state, in the same order for every room
+func roomTopics(roomID string) []string {
+	return []string{
+		mqtt.RoomTopic(mqtt.TopicRoomTemperature, roomID),
+		mqtt.RoomTopic(mqtt.TopicRoomHumidity, roomID),
+		mqtt.RoomTopic(mqtt.TopicRoomMotion, roomID),
+		mqtt.RoomTopic(mqtt.TopicRoomLight, roomID),
+		services.RoomEnergyTopicPrefix + roomID,
+		mqtt.AutomationTopic(roomID),
+		mqtt.AutomationFeedbackTopic(roomID),
+	}
+}
+
+// roomRewriter renames a room inside a decoded JSON document
+type roomRewriter struct {
+	from     string
+	to       string
+	changed  int
+	conflict string // Where the new room already exists
+}
+
+func (w *roomRewriter) root(document interface{}, kind rootKind) interface{} {
+	object, isObject := document.(map[string]interface{})
+	switch {
+	case kind == rootKeys && isObject:
+		return w.walk(w.renameKeys(object, "top level"))
+	case kind == rootValues && isObject:
+		for key, value := range object {
+			object[key] = w.renameValue(value)
+		}
+		return object
+	}
+	return w.walk(document)
+}
+
+func (w *roomRewriter) walk(document interface{}) interface{} {
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			switch {
+			case roomValueFields[key]:
+				value[key] = w.renameValue(field)
+			case roomKeyFields[key]:
+				if object, ok := field.(map[string]interface{}); ok {
+					value[key] = w.walk(w.renameKeys(object, key))
+				}
+			case roomListFields[key]:
+				value[key] = w.renameList(field, "")
+			case ruleFields[key]:
+				value[key] = w.renamePrefixed(field, motionRulePrefix)
+			case targetFields[key]:
+				value[key] = w.renameList(field, "automation:"+motionRulePrefix)
+			default:
+				value[key] = w.walk(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = w.walk(element)
+		}
+	}
+	return document
+}
+
+func (w *roomRewriter) renameKeys(object map[string]interface{}, field string) map[string]interface{} {
+	value, exists := object[w.from]
+	if !exists {
+		return object
+	}
+	if _, taken := object[w.to]; taken {
+		w.conflict = field
+		return object
+	}
+	delete(object, w.from)
+	object[w.to] = value
+	w.changed++
+	return object
+}
+
+func (w *roomRewriter) renameValue(value interface{}) interface{} {
+	return w.renamePrefixed(value, "")
+}
+
+func (w *roomRewriter) renamePrefixed(value interface{}, prefix string) interface{} {
+	if s, ok := value.(string); ok && s == prefix+w.from {
+		w.changed++
+		return prefix + w.to
+	}
+	return value
+}
+
+func (w *roomRewriter) renameList(value interface{}, prefix string) interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	for i, element := range list {
+		list[i] = w.renamePrefixed(element, prefix)
+	}
+	return list
+}
+
+// count formats a number of things, e.g. "1 reference" or "3 references"
+func count(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+func removeAll(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// String formats the plan for the preview
+func (p *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rename room %s to %s:\n", p.From, p.To)
+	if len(p.Changes) == 0 {
+		b.WriteString("  nothing refers to the room\n")
+	}
+	for _, change := range p.Changes {
+		fmt.Fprintf(&b, "  %-50s %s\n", change.Target, change.Description)
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+type fakeHistory struct {
+	points  int64
+	renamed []string
+}
+
+func (f *fakeHistory) CountRoomPoints(ctx context.Context, roomID string) (int64, error) {
+	return f.points, nil
+}
+
+func (f *fakeHistory) RenameRoom(ctx context.Context, from, to string) error {
+	f.renamed = append(f.renamed, from+"->"+to)
+	return nil
+}
+
+type recordingBroker struct {
+	messages []*mqtt.Message
+}
+
+func (b *recordingBroker) Publish(msg *mqtt.Message) error {
+	b.messages = append(b.messages, msg)
+	return nil
+}
+
+func writeJSON(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSON(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRoomRename(t *testing.T) {
+	stateDir := t.TempDir()
+	writeJSON(t, filepath.Join(stateDir, "presence.json"), `{"kitchen": {"occupied_since": null}, "hall": {}}`)
+	writeJSON(t, filepath.Join(stateDir, "motion-tuning.json"),
+		`{"rooms": {"kitchen": {"cooldown": 300}}, "activations": [{"rule_id": "motion-light-kitchen", "room_id": "kitchen", "light_level": 12.5}]}`)
+	writeJSON(t, filepath.Join(stateDir, "matter-rooms.json"), `{"4": "kitchen", "5": "hall"}`)
+	writeJSON(t, filepath.Join(stateDir, "safemode.json"), `{"active": true, "enabled": ["automation:motion-light-kitchen", "thermostat"]}`)
+	writeJSON(t, filepath.Join(stateDir, "devices.json"), `[{"uuid": "a1", "name": "Fridge Plug", "room_id": "kitchen", "aliases": []}]`)
+	followMe := filepath.Join(stateDir, "follow-me.json")
+	writeJSON(t, followMe, `{"rooms": {"hall": {"adjacent": ["kitchen", "lounge"]}}}`)
+
+	cache, _ := json.Marshal([]mqtt.CachedMessage{
+		{Topic: "home-automation/energy/kitchen", Payload: []byte(`{"room_id":"kitchen","power_w":40}`)},
+		{Topic: "room-temp/kitchen", Payload: []byte{0x01, 0x02}},
+		{Topic: "room-temp/hall", Payload: []byte(`{"temperature":68}`)},
+	})
+	writeJSON(t, mqtt.StateCachePath(stateDir), string(cache))
+
+	history := &fakeHistory{points: 1200}
+	broker := &recordingBroker{}
+	rename := &RoomRename{From: "kitchen", To: "galley", StateDir: stateDir, ConfigFiles: []string{followMe}, History: history, Broker: broker}
+
+	plan, err := rename.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if !strings.Contains(plan.String(), "relabel 1200 readings") || !strings.Contains(plan.String(), "move to home-automation/energy/galley") {
+		t.Errorf("Unexpected preview:\n%s", plan)
+	}
+	if strings.Contains(readJSON(t, filepath.Join(stateDir, "presence.json")), "galley") || len(history.renamed) != 0 {
+		t.Fatal("Expected the preview to change nothing")
+	}
+
+	if err := plan.Apply(context.Background()); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	for name, want := range map[string][]string{
+		"presence.json":      {`"galley"`, `"hall"`},
+		"motion-tuning.json": {`"motion-light-galley"`, `"room_id": "galley"`, `"light_level": 12.5`},
+		"matter-rooms.json":  {`"4": "galley"`, `"5": "hall"`},
+		"safemode.json":      {`"automation:motion-light-galley"`, `"thermostat"`},
+		"devices.json":       {`"room_id": "galley"`, `"Fridge Plug"`},
+		"follow-me.json":     {`"galley"`, `"lounge"`},
+	} {
+		content := readJSON(t, filepath.Join(stateDir, name))
+		for _, s := range want {
+			if !strings.Contains(content, s) {
+				t.Errorf("%s: expected %s in %s", name, s, content)
+			}
+		}
+		if strings.Contains(content, "kitchen") {
+			t.Errorf("%s: expected no trace of the old room in %s", name, content)
+		}
+	}
+
+	var messages []mqtt.CachedMessage
+	json.Unmarshal([]byte(readJSON(t, mqtt.StateCachePath(stateDir))), &messages)
+	if len(messages) != 2 || messages[0].Topic != "home-automation/energy/galley" || !strings.Contains(string(messages[0].Payload), `"galley"`) {
+		t.Errorf("Unexpected state cache %+v", messages)
+	}
+
+	if len(history.renamed) != 1 || history.renamed[0] != "kitchen->galley" {
+		t.Errorf("Expected the history relabelled, got %v", history.renamed)
+	}
+
+	// The energy summary moves; the encrypted reading is only cleared
+	var published []string
+	for _, message := range broker.messages {
+		published = append(published, message.Topic+"="+string(message.Payload))
+	}
+	want := []string{`home-automation/energy/galley={"power_w":40,"room_id":"galley"}`, "home-automation/energy/kitchen=", "room-temp/kitchen="}
+	if strings.Join(published, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, published)
+	}
+}
+
+func TestRoomRenameRefusesMerge(t *testing.T) {
+	stateDir := t.TempDir()
+	writeJSON(t, filepath.Join(stateDir, "presence.json"), `{"kitchen": {}, "galley": {}}`)
+
+	if _, err := (&RoomRename{From: "kitchen", To: "galley", StateDir: stateDir}).Plan(context.Background()); err == nil {
+		t.Error("Expected renaming onto an existing room to be refused")
+	}
+	if _, err := (&RoomRename{From: "kitchen", To: "gal/ley", StateDir: stateDir}).Plan(context.Background()); err == nil {
+		t.Error("Expected a room ID with a topic separator to be refused")
+	}
+}
@@ -3,12 +3,16 @@ package models
 import "time"
 
 type Device struct {
-	ID          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Type        DeviceType             `json:"type"`
-	Status      string                 `json:"status"`
-	Properties  map[string]interface{} `json:"properties"`
-	LastUpdated time.Time              `json:"last_updated"`
+	ID           string                 `json:"id"`
+	UUID         string                 `json:"uuid,omitempty"`
+	Name         string                 `json:"name"`
+	Type         DeviceType             `json:"type"`
+	RoomID       string                 `json:"room_id,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Capabilities []string               `json:"capabilities,omitempty"` // e.g. dimmer, color, energy_monitor
+	Status       string                 `json:"status"`
+	Properties   map[string]interface{} `json:"properties"`
+	LastUpdated  time.Time              `json:"last_updated"`
 }
 
 type DeviceType string
@@ -22,8 +26,11 @@ const (
 	DeviceTypeLock    DeviceType = "lock"
 )
 
+// DeviceCommand targets a single device, or with Tag and no DeviceID every device
+// carrying the tag directly or through its room
 type DeviceCommand struct {
 	DeviceID string                 `json:"device_id"`
+	Tag      string                 `json:"tag,omitempty"`
 	Action   string                 `json:"action"`
 	Value    interface{}            `json:"value"`
 	Options  map[string]interface{} `json:"options,omitempty"`
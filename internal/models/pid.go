@@ -0,0 +1,348 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Default PID control settings, for a room whose response hasn't been learned yet
+const (
+	DefaultPIDCycleMinutes = 10
+	DefaultPIDMinOnMinutes = 2
+	defaultPIDKp           = 0.4      // Full heat 2.5°F below target
+	defaultPIDKi           = 0.4 / 60 // Integral time of an hour
+	minLearnedRiseF        = 0.3      // Rise that ends the dead time of a heating run
+	minLearnedRunMinutes   = 5.0      // Rising time needed to measure the heating rate
+	learnedResponseWeight  = 0.3      // Weight of a new run in the learned response
+	maxLearnedKp           = 5.0
+	minLearnedKp           = 0.05
+)
+
+// Control profiles: PID modulation, or its radiant floor variant for high thermal mass systems
+// such as underfloor heating, which adds long cycles, outdoor feed-forward and anticipation
+const (
+	ControlProfilePID          = "pid"
+	ControlProfileRadiantFloor = "radiant_floor"
+)
+
+// Defaults of the radiant floor profile: a slab takes hours to respond, so cycles are long,
+// the gains gentle and the heat stops well before the room reaches the target
+const (
+	RadiantCycleMinutes        = 60
+	RadiantMinOnMinutes        = 10
+	RadiantAnticipationMinutes = 90
+	RadiantFeedForward         = 0.015      // Duty per °F the outdoors is below the balance point
+	RadiantBalancePointF       = 65.0       // Outdoor temperature the house needs no heat at
+	radiantKp                  = 0.25       // Full heat 4°F below target
+	radiantKi                  = 0.25 / 240 // Integral time of four hours
+	radiantTrendMinutes        = 15.0       // Interval the room's warming trend is measured over
+	radiantTrendWeight         = 0.5        // Weight of a new interval in the trend
+)
+
+// PIDSettings configures proportional-integral-derivative control of heat calls. The output is
+// a duty cycle: the share of each cycle the heat runs. Gains are per °F below the target, with
+// Ki per °F·minute and Kd per °F/minute. Without gains they are learned from the room's
+// response when AutoTune is set, and defaults otherwise.
+type PIDSettings struct {
+	// Profile is pid (the default) or radiant_floor
+	Profile string  `json:"profile,omitempty"`
+	Kp      float64 `json:"kp,omitempty"`
+	Ki      float64 `json:"ki,omitempty"`
+	Kd      float64 `json:"kd,omitempty"`
+	// CycleMinutes is the length of one on/off cycle, 10 by default
+	CycleMinutes int `json:"cycle_minutes,omitempty"`
+	// MinOnMinutes is the shortest heat call; shorter calls are skipped, 2 by default
+	MinOnMinutes int  `json:"min_on_minutes,omitempty"`
+	AutoTune     bool `json:"auto_tune"`
+	// AnticipationMinutes is how far ahead the radiant floor profile projects the room's warming,
+	// the learned dead time with AutoTune, else 90 by default
+	AnticipationMinutes int `json:"anticipation_minutes,omitempty"`
+	// FeedForward is the duty the radiant floor profile adds per °F the outdoors is below
+	// BalancePointF, 0.015 and 65°F by default
+	FeedForward   float64 `json:"feed_forward,omitempty"`
+	BalancePointF float64 `json:"balance_point_f,omitempty"`
+}
+
+// Validate checks the gains and that the minimum on time fits in a cycle
+func (s *PIDSettings) Validate() error {
+	if s.Kp < 0 || s.Ki < 0 || s.Kd < 0 {
+		return fmt.Errorf("kp, ki and kd must not be negative")
+	}
+	if s.Kp == 0 && (s.Ki > 0 || s.Kd > 0) {
+		return fmt.Errorf("ki and kd need kp")
+	}
+	switch s.Profile {
+	case "", ControlProfilePID:
+		if s.AnticipationMinutes != 0 || s.FeedForward != 0 || s.BalancePointF != 0 {
+			return fmt.Errorf("anticipation_minutes, feed_forward and balance_point_f need the %s profile", ControlProfileRadiantFloor)
+		}
+	case ControlProfileRadiantFloor:
+		if s.AnticipationMinutes < 0 || s.FeedForward < 0 || s.FeedForward > 1 {
+			return fmt.Errorf("anticipation_minutes must not be negative and feed_forward must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown control profile %q", s.Profile)
+	}
+	if s.CycleMinutes < 0 || s.MinOnMinutes < 0 {
+		return fmt.Errorf("cycle_minutes and min_on_minutes must not be negative")
+	}
+	if 2*s.minOn() > s.cycle() {
+		return fmt.Errorf("min_on_minutes must be at most half of cycle_minutes")
+	}
+	return nil
+}
+
+// Radiant reports whether the settings select the radiant floor profile
+func (s *PIDSettings) Radiant() bool {
+	return s.Profile == ControlProfileRadiantFloor
+}
+
+func (s *PIDSettings) cycle() time.Duration {
+	switch {
+	case s.CycleMinutes > 0:
+		return time.Duration(s.CycleMinutes) * time.Minute
+	case s.Radiant():
+		return RadiantCycleMinutes * time.Minute
+	}
+	return DefaultPIDCycleMinutes * time.Minute
+}
+
+func (s *PIDSettings) minOn() time.Duration {
+	switch {
+	case s.MinOnMinutes > 0:
+		return time.Duration(s.MinOnMinutes) * time.Minute
+	case s.Radiant():
+		return RadiantMinOnMinutes * time.Minute
+	}
+	return DefaultPIDMinOnMinutes * time.Minute
+}
+
+func (s *PIDSettings) feedForward() (perDegree, balancePointF float64) {
+	perDegree, balancePointF = s.FeedForward, s.BalancePointF
+	if perDegree == 0 {
+		perDegree = RadiantFeedForward
+	}
+	if balancePointF == 0 {
+		balancePointF = RadiantBalancePointF
+	}
+	return perDegree, balancePointF
+}
+
+// ThermalResponse is how a room responds to heat, learned from its heating runs
+type ThermalResponse struct {
+	// HeatingRate is how fast the room warms once the heat reaches it, in °F per minute
+	HeatingRate float64 `json:"heating_rate_f_per_min"`
+	// DeadTimeMinutes is how long the room takes to start warming after the heat comes on
+	DeadTimeMinutes float64   `json:"dead_time_minutes"`
+	Samples         int       `json:"samples"`
+	UpdatedAt       time.Time `json:"updated_at,omitempty"`
+}
+
+// Gains derives PID gains from the response with the Ziegler-Nichols reaction curve rules
+func (r ThermalResponse) Gains() (kp, ki, kd float64, ok bool) {
+	if r.Samples == 0 || r.HeatingRate <= 0 || r.DeadTimeMinutes <= 0 {
+		return 0, 0, 0, false
+	}
+	kp = math.Max(minLearnedKp, math.Min(maxLearnedKp, 1.2/(r.HeatingRate*r.DeadTimeMinutes)))
+	return kp, kp / (2 * r.DeadTimeMinutes), kp * 0.5 * r.DeadTimeMinutes, true
+}
+
+// heatRun tracks a heating run to learn the room's response
+type heatRun struct {
+	start     time.Time
+	startTemp float64
+	rise      time.Time // When the room started warming
+	riseTemp  float64
+}
+
+// PIDControl is the PID state of a thermostat: its settings, learned response and current cycle
+type PIDControl struct {
+	Settings PIDSettings     `json:"settings"`
+	Learned  ThermalResponse `json:"learned"`
+	Integral float64         `json:"integral"`
+	Duty     float64         `json:"duty"` // Share of the current cycle the heat runs, 0 to 1
+	// Calling is whether the heat is on in the current cycle
+	Calling    bool      `json:"calling"`
+	CycleStart time.Time `json:"cycle_start,omitempty"`
+	LastError  float64   `json:"-"`
+	LastUpdate time.Time `json:"-"`
+	// Trend is how fast the room is warming in °F per minute, for the radiant floor profile's
+	// anticipation
+	Trend float64 `json:"trend_f_per_min,omitempty"`
+	// OutdoorF is the outdoor temperature fed forward by the radiant floor profile, when known
+	OutdoorF *float64 `json:"outdoor_f,omitempty"`
+	// FeedForward is the share of the duty cycle from the outdoor temperature
+	FeedForward float64 `json:"feed_forward,omitempty"`
+	run         *heatRun
+	trendTemp   float64
+	trendAt     time.Time
+}
+
+// NewPIDControl creates PID control that starts from a previously learned response
+func NewPIDControl(settings PIDSettings, learned ThermalResponse) *PIDControl {
+	return &PIDControl{Settings: settings, Learned: learned}
+}
+
+// Gains returns the configured gains, else the learned ones with AutoTune, else the defaults
+func (c *PIDControl) Gains() (kp, ki, kd float64) {
+	if c.Settings.Kp > 0 {
+		return c.Settings.Kp, c.Settings.Ki, c.Settings.Kd
+	}
+	if c.Settings.AutoTune {
+		if kp, ki, kd, ok := c.Learned.Gains(); ok {
+			return kp, ki, kd
+		}
+	}
+	if c.Settings.Radiant() {
+		return radiantKp, radiantKi, 0
+	}
+	return defaultPIDKp, defaultPIDKi, 0
+}
+
+// Anticipation is how much the room is expected to warm without more heat: the radiant floor
+// profile projects its current warming trend over the anticipation time, as a slab keeps
+// releasing its stored heat for hours after the call ends
+func (c *PIDControl) Anticipation() float64 {
+	if !c.Settings.Radiant() || c.Trend <= 0 {
+		return 0
+	}
+	minutes := float64(c.Settings.AnticipationMinutes)
+	if minutes == 0 {
+		minutes = RadiantAnticipationMinutes
+		if c.Settings.AutoTune && c.Learned.Samples > 0 && c.Learned.DeadTimeMinutes > 0 {
+			minutes = c.Learned.DeadTimeMinutes
+		}
+	}
+	return c.Trend * minutes
+}
+
+// UpdateControl advances PID control of the thermostat's heat calls and learns the room's
+// response from its heating runs. It reports whether the learned response changed.
+func (t *Thermostat) UpdateControl(now time.Time) bool {
+	c := t.Control
+	if c == nil {
+		return false
+	}
+
+	learned := c.learn(t.CurrentTemp, t.Status == StatusHeating, now)
+	if c.Settings.Radiant() {
+		c.observe(t.CurrentTemp, now)
+	}
+
+	if !t.HeatingEnabled || t.Mode == ModeOff || t.Mode == ModeCool || t.Mode == ModeFan {
+		// No heat to modulate; start a fresh cycle when heating is allowed again
+		c.Calling, c.Duty, c.Integral, c.CycleStart = false, 0, 0, time.Time{}
+		return learned
+	}
+
+	// The radiant floor profile controls on where the room is heading rather than where it is
+	predicted := t.CurrentTemp + c.Anticipation()
+	cycle := c.Settings.cycle()
+	if c.CycleStart.IsZero() || now.Sub(c.CycleStart) >= cycle {
+		c.Duty = c.duty(t.HeatTarget()-predicted, now)
+		c.CycleStart = now
+	}
+	c.Calling = now.Sub(c.CycleStart) < time.Duration(c.Duty*float64(cycle))
+	if c.Calling && c.Settings.Radiant() && c.Trend > 0 && predicted >= t.HeatTarget() {
+		// Already on course for the target: cut the call short rather than overshoot for hours
+		c.Calling = false
+	}
+	return learned
+}
+
+// observe tracks the room's warming trend over intervals long enough to see past sensor noise
+func (c *PIDControl) observe(current float64, now time.Time) {
+	if c.trendAt.IsZero() || now.Before(c.trendAt) {
+		c.trendTemp, c.trendAt = current, now
+		return
+	}
+	minutes := now.Sub(c.trendAt).Minutes()
+	if minutes < radiantTrendMinutes {
+		return
+	}
+	rate := (current - c.trendTemp) / minutes
+	if c.Trend == 0 {
+		c.Trend = rate
+	} else {
+		c.Trend = (1-radiantTrendWeight)*c.Trend + radiantTrendWeight*rate
+	}
+	c.trendTemp, c.trendAt = current, now
+}
+
+// feedForward is the duty the radiant floor profile adds for the outdoor temperature, heating
+// ahead of the house's losses instead of waiting for the room to cool
+func (c *PIDControl) feedForward() float64 {
+	if !c.Settings.Radiant() || c.OutdoorF == nil {
+		return 0
+	}
+	perDegree, balancePointF := c.Settings.feedForward()
+	return math.Min(1, math.Max(0, balancePointF-*c.OutdoorF)*perDegree)
+}
+
+// duty computes the duty cycle of the next cycle from the error, in °F below the target
+func (c *PIDControl) duty(err float64, now time.Time) float64 {
+	kp, ki, kd := c.Gains()
+
+	var derivative float64
+	if !c.LastUpdate.IsZero() {
+		minutes := math.Min(now.Sub(c.LastUpdate).Minutes(), 2*c.Settings.cycle().Minutes())
+		if minutes > 0 {
+			c.Integral += err * minutes
+			derivative = (err - c.LastError) / minutes
+		}
+	}
+	// Keep the integral from winding up beyond full heat, or far below none
+	if ki > 0 {
+		c.Integral = math.Max(-0.5/ki, math.Min(1/ki, c.Integral))
+	}
+	c.LastError, c.LastUpdate = err, now
+
+	c.FeedForward = c.feedForward()
+	duty := math.Max(0, math.Min(1, kp*err+ki*c.Integral+kd*derivative+c.FeedForward))
+
+	// Calls shorter than the minimum on or off time aren't worth cycling the heat for
+	minShare := c.Settings.minOn().Minutes() / c.Settings.cycle().Minutes()
+	switch {
+	case duty < minShare:
+		return 0
+	case duty > 1-minShare:
+		return 1
+	}
+	return duty
+}
+
+// learn measures the dead time and heating rate of each heating run long enough to tell
+func (c *PIDControl) learn(current float64, heating bool, now time.Time) bool {
+	if heating {
+		if c.run == nil {
+			c.run = &heatRun{start: now, startTemp: current}
+		} else if c.run.rise.IsZero() && current >= c.run.startTemp+minLearnedRiseF {
+			c.run.rise, c.run.riseTemp = now, current
+		}
+		return false
+	}
+
+	run := c.run
+	c.run = nil
+	if run == nil || run.rise.IsZero() {
+		return false
+	}
+	rising := now.Sub(run.rise).Minutes()
+	if rising < minLearnedRunMinutes || current <= run.riseTemp {
+		return false
+	}
+
+	rate := (current - run.riseTemp) / rising
+	deadTime := run.rise.Sub(run.start).Minutes()
+	if c.Learned.Samples == 0 {
+		c.Learned.HeatingRate, c.Learned.DeadTimeMinutes = rate, deadTime
+	} else {
+		w := learnedResponseWeight
+		c.Learned.HeatingRate = (1-w)*c.Learned.HeatingRate + w*rate
+		c.Learned.DeadTimeMinutes = (1-w)*c.Learned.DeadTimeMinutes + w*deadTime
+	}
+	c.Learned.Samples++
+	c.Learned.UpdatedAt = now
+	return true
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPIDSettingsValidate(t *testing.T) {
+	invalid := []PIDSettings{
+		{Kp: -1},
+		{Ki: 0.1},
+		{CycleMinutes: 4, MinOnMinutes: 3},
+		{Profile: "bang_bang"},
+		{FeedForward: 0.01},
+		{Profile: ControlProfileRadiantFloor, FeedForward: 2},
+	}
+	for _, settings := range invalid {
+		if err := settings.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", settings)
+		}
+	}
+	if err := (&PIDSettings{AutoTune: true}).Validate(); err != nil {
+		t.Errorf("Expected defaults to be valid, got %v", err)
+	}
+	if err := (&PIDSettings{Profile: ControlProfileRadiantFloor}).Validate(); err != nil {
+		t.Errorf("Expected the radiant floor defaults to be valid, got %v", err)
+	}
+}
+
+func TestRadiantFloorProfile(t *testing.T) {
+	start := time.Now()
+	outdoor := 55.0
+	thermostat := &Thermostat{
+		TargetTemp:     70,
+		CurrentTemp:    68,
+		Mode:           ModeHeat,
+		Hysteresis:     1,
+		HeatingEnabled: true,
+		Control:        NewPIDControl(PIDSettings{Profile: ControlProfileRadiantFloor}, ThermalResponse{}),
+	}
+	thermostat.Control.OutdoorF = &outdoor
+
+	// 2°F below target at kp 0.25, plus 10°F below the balance point at 0.015: heat for
+	// 39 minutes of an hour-long cycle
+	thermostat.UpdateControl(start)
+	if math.Abs(thermostat.Control.Duty-0.65) > 1e-9 || math.Abs(thermostat.Control.FeedForward-0.15) > 1e-9 {
+		t.Fatalf("Expected a 65%% duty cycle with 15%% fed forward, got %.2f and %.2f", thermostat.Control.Duty, thermostat.Control.FeedForward)
+	}
+
+	// Warming 0.02°F a minute, the slab will carry the room the last 1.8°F within 90 minutes
+	thermostat.Status = StatusHeating
+	thermostat.CurrentTemp = 68.3
+	thermostat.UpdateControl(start.Add(15 * time.Minute))
+	if math.Abs(thermostat.Control.Trend-0.02) > 1e-9 || thermostat.Control.Calling {
+		t.Fatalf("Expected the call cut short on course for the target, got trend %.3f", thermostat.Control.Trend)
+	}
+
+	// Heading above the target, the next cycle doesn't heat despite the cold outside
+	thermostat.Status = StatusIdle
+	thermostat.CurrentTemp = 69.2
+	thermostat.UpdateControl(start.Add(60 * time.Minute))
+	if thermostat.Control.Duty != 0 || thermostat.Control.CycleStart != start.Add(60*time.Minute) {
+		t.Errorf("Expected no heat for the anticipated overshoot, got duty %.2f", thermostat.Control.Duty)
+	}
+
+	// The standard profile ignores the outdoors
+	standard := NewPIDControl(PIDSettings{}, ThermalResponse{})
+	standard.OutdoorF = &outdoor
+	if standard.feedForward() != 0 || standard.Settings.cycle() != DefaultPIDCycleMinutes*time.Minute {
+		t.Error("Expected no feed-forward and short cycles without the radiant floor profile")
+	}
+}
+
+func TestPIDModulatesHeatCalls(t *testing.T) {
+	start := time.Now()
+	thermostat := &Thermostat{
+		TargetTemp:     70,
+		CurrentTemp:    69,
+		Mode:           ModeHeat,
+		Hysteresis:     1,
+		HeatingEnabled: true,
+		Control:        NewPIDControl(PIDSettings{Kp: 0.5, CycleMinutes: 10, MinOnMinutes: 2}, ThermalResponse{}),
+	}
+
+	// 1°F below target at kp 0.5: heat for half of each 10-minute cycle
+	thermostat.UpdateControl(start)
+	if thermostat.Control.Duty != 0.5 || thermostat.GetNextAction() != StatusHeating {
+		t.Fatalf("Expected a 50%% duty cycle heating, got duty %.2f", thermostat.Control.Duty)
+	}
+	thermostat.UpdateControl(start.Add(6 * time.Minute))
+	if thermostat.GetNextAction() != StatusIdle {
+		t.Error("Expected the heat off for the rest of the cycle")
+	}
+
+	// Close to the target the call would be too short to be worth it
+	thermostat.CurrentTemp = 69.7
+	thermostat.UpdateControl(start.Add(10 * time.Minute))
+	if thermostat.Control.Duty != 0 || thermostat.GetNextAction() != StatusIdle {
+		t.Errorf("Expected no call below the minimum on time, got duty %.2f", thermostat.Control.Duty)
+	}
+
+	// Far below target it heats throughout
+	thermostat.CurrentTemp = 66
+	thermostat.UpdateControl(start.Add(20 * time.Minute))
+	if thermostat.Control.Duty != 1 {
+		t.Errorf("Expected full heat 4°F below target, got duty %.2f", thermostat.Control.Duty)
+	}
+
+	thermostat.Mode = ModeCool
+	thermostat.UpdateControl(start.Add(21 * time.Minute))
+	if thermostat.Control.Calling || !thermostat.Control.CycleStart.IsZero() {
+		t.Error("Expected cooling mode to drop the heat call and its cycle")
+	}
+}
+
+func TestPIDLearnsRoomResponse(t *testing.T) {
+	start := time.Now()
+	thermostat := &Thermostat{
+		TargetTemp:     70,
+		CurrentTemp:    66,
+		Mode:           ModeHeat,
+		Status:         StatusHeating,
+		HeatingEnabled: true,
+		Control:        NewPIDControl(PIDSettings{AutoTune: true}, ThermalResponse{}),
+	}
+	defaultKp, _, _ := thermostat.Control.Gains()
+
+	// Radiators take 10 minutes to warm the room, then 0.1°F a minute
+	thermostat.UpdateControl(start)
+	thermostat.CurrentTemp = 66.4
+	thermostat.UpdateControl(start.Add(10 * time.Minute))
+	thermostat.CurrentTemp = 68.4
+	thermostat.Status = StatusIdle
+	if !thermostat.UpdateControl(start.Add(30 * time.Minute)) {
+		t.Fatal("Expected the heating run to be learned")
+	}
+
+	learned := thermostat.Control.Learned
+	if learned.Samples != 1 || learned.DeadTimeMinutes != 10 || learned.HeatingRate < 0.099 || learned.HeatingRate > 0.101 {
+		t.Fatalf("Unexpected learned response %+v", learned)
+	}
+	kp, ki, kd := thermostat.Control.Gains()
+	if kp < 1.19 || kp > 1.21 || ki <= 0 || kd <= 0 || kp == defaultKp {
+		t.Errorf("Expected gains derived from the response, got kp %.3f ki %.3f kd %.3f", kp, ki, kd)
+	}
+
+	// Explicit gains win over learned ones
+	thermostat.Control.Settings.Kp = 0.3
+	if kp, _, _ := thermostat.Control.Gains(); kp != 0.3 {
+		t.Errorf("Expected the configured kp, got %.2f", kp)
+	}
+}
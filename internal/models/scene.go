@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Scene is a named snapshot of device states, recalled to put the devices back the way they were
+type Scene struct {
+	Name      string        `json:"name"`
+	Devices   []SceneDevice `json:"devices"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// SceneDeviceKind says which service restores a captured device
+type SceneDeviceKind string
+
+const (
+	SceneKindLight      SceneDeviceKind = "light"
+	SceneKindSwitch     SceneDeviceKind = "switch"
+	SceneKindClimate    SceneDeviceKind = "climate"
+	SceneKindPlug       SceneDeviceKind = "plug"
+	SceneKindThermostat SceneDeviceKind = "thermostat"
+)
+
+// SceneDevice is the captured state of one device. Fields left unset are not touched on recall.
+type SceneDevice struct {
+	DeviceID   string          `json:"device_id"`
+	Kind       SceneDeviceKind `json:"kind"`
+	Power      *bool           `json:"power,omitempty"`
+	Brightness *float64        `json:"brightness,omitempty"`
+	TargetTemp *float64        `json:"target_temp,omitempty"`
+	Mode       ThermostatMode  `json:"mode,omitempty"`
+}
+
+// SceneSelection picks the devices to capture. A device is selected when it matches every
+// filter given; at least one is required.
+type SceneSelection struct {
+	DeviceIDs []string `json:"device_ids,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	RoomID    string   `json:"room_id,omitempty"`
+}
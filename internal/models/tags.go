@@ -0,0 +1,24 @@
+package models
+
+import "strings"
+
+// ParseTags splits a comma-separated tag list, dropping blanks
+func ParseTags(list string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// HasTag reports whether tags contains tag, ignoring case
+func HasTag(tags []string, tag string) bool {
+	for _, candidate := range tags {
+		if strings.EqualFold(candidate, tag) {
+			return true
+		}
+	}
+	return false
+}
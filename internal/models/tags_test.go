@@ -0,0 +1,20 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(" holiday-lights, ,outdoor ")
+	if !reflect.DeepEqual(tags, []string{"holiday-lights", "outdoor"}) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	if !HasTag(tags, "Outdoor") {
+		t.Error("Expected tag match to ignore case")
+	}
+	if HasTag(tags, "indoor") {
+		t.Error("Expected indoor not to match")
+	}
+}
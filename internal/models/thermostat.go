@@ -1,6 +1,10 @@
 package models
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -13,6 +17,8 @@ const (
 	ModeCool ThermostatMode = "cool"
 	ModeAuto ThermostatMode = "auto"
 	ModeFan  ThermostatMode = "fan"
+	// ModeEmergencyHeat heats with the auxiliary heat alone, locking out a failed heat pump
+	ModeEmergencyHeat ThermostatMode = "emergency_heat"
 )
 
 // ThermostatStatus represents the current status of the thermostat
@@ -25,6 +31,46 @@ const (
 	StatusFan     ThermostatStatus = "fan"
 )
 
+// FanMode is when a thermostat runs the HVAC blower outside the fan operating mode
+type FanMode string
+
+const (
+	FanAuto FanMode = "auto" // With heating and cooling only
+	FanOn   FanMode = "on"   // All the time
+	// FanCirculate also runs the blower alone until it has run CirculateMinutes each hour,
+	// counting heating and cooling
+	FanCirculate FanMode = "circulate"
+)
+
+// DefaultCirculateMinutes is the blower runtime each hour in circulate mode
+const DefaultCirculateMinutes = 15
+
+// FanSettings changes how a thermostat runs its blower. Zero fields keep their current value.
+type FanSettings struct {
+	Mode             FanMode `json:"mode,omitempty"`
+	CirculateMinutes int     `json:"circulate_minutes,omitempty"` // 1-60, 15 by default
+	Speed            *int    `json:"speed,omitempty"`             // 0-100
+}
+
+// Validate checks the mode, runtime and speed
+func (f *FanSettings) Validate() error {
+	switch f.Mode {
+	case "", FanAuto, FanOn, FanCirculate:
+	default:
+		return fmt.Errorf("unknown fan mode %q, use auto, on or circulate", f.Mode)
+	}
+	if f.CirculateMinutes < 0 || f.CirculateMinutes > 60 {
+		return fmt.Errorf("circulate_minutes must be between 1 and 60")
+	}
+	if f.Speed != nil && (*f.Speed < 0 || *f.Speed > 100) {
+		return fmt.Errorf("speed must be between 0 and 100")
+	}
+	if f.Mode == "" && f.CirculateMinutes == 0 && f.Speed == nil {
+		return fmt.Errorf("fan settings need a mode, circulate_minutes or speed")
+	}
+	return nil
+}
+
 // Thermostat represents a smart thermostat device
 // All temperature values are stored and processed in Fahrenheit
 type Thermostat struct {
@@ -47,6 +93,218 @@ type Thermostat struct {
 	CreatedAt         time.Time        `json:"created_at" db:"created_at"`
 	UpdatedAt         time.Time        `json:"updated_at" db:"updated_at"`
 	IsOnline          bool             `json:"is_online" db:"is_online"`
+	// Equipment describes multi-stage and heat-pump systems; nil is a single-stage furnace and AC
+	Equipment *HVACEquipment `json:"equipment,omitempty" db:"-"`
+	Stage     int            `json:"stage" db:"stage"`       // Running stage: 0 idle, 1 or 2
+	AuxHeat   bool           `json:"aux_heat" db:"aux_heat"` // Auxiliary or emergency heat is on
+	// Compressor is on, cooling or heating with a heat pump
+	Compressor bool `json:"compressor" db:"compressor"`
+	// CompressorStarted and CompressorStopped time the minimum run and rest of the compressor
+	CompressorStarted time.Time `json:"compressor_started,omitempty" db:"compressor_started"`
+	CompressorStopped time.Time `json:"compressor_stopped,omitempty" db:"compressor_stopped"`
+	// Control modulates heat calls with PID control; nil uses the hysteresis band
+	Control *PIDControl `json:"control,omitempty" db:"-"`
+	// Weather shifts control to the outdoor forecast; nil without a forecast
+	Weather *WeatherAdjustment `json:"weather,omitempty" db:"-"`
+	// Humidity is the room's humidity range, kept by a dehumidifier or humidifier; nil without one
+	Humidity *HumiditySetpoint `json:"humidity_setpoint,omitempty" db:"-"`
+	// Condensation changes cooling in a humid room; nil while the humidity is fine
+	Condensation *CondensationAdjustment `json:"condensation,omitempty" db:"-"`
+	// FanMode runs the blower with heating and cooling only when empty
+	FanMode          FanMode `json:"fan_mode,omitempty" db:"fan_mode"`
+	CirculateMinutes int     `json:"circulate_minutes,omitempty" db:"circulate_minutes"` // 15 when 0
+	Fan              bool    `json:"fan" db:"fan"`                                       // Blower is on
+	// FanStarted, FanHour and FanHourRuntime time the blower's runtime in the current clock hour
+	FanStarted     time.Time     `json:"fan_started,omitempty" db:"fan_started"`
+	FanHour        time.Time     `json:"-" db:"-"`
+	FanHourRuntime time.Duration `json:"-" db:"-"`
+}
+
+// WeatherAdjustment is how the outdoor forecast changes a thermostat's control
+type WeatherAdjustment struct {
+	// PreheatF raises the heating target ahead of a cold night
+	PreheatF float64 `json:"preheat_f,omitempty"`
+	// SkipCooling leaves cooling off while the outdoors will soon cool the room
+	SkipCooling bool   `json:"skip_cooling,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// HeatTarget is the temperature heating aims for: the target, raised by any pre-heat but not
+// beyond the maximum
+func (t *Thermostat) HeatTarget() float64 {
+	if t.Weather == nil || t.Weather.PreheatF <= 0 {
+		return t.TargetTemp
+	}
+	target := t.TargetTemp + t.Weather.PreheatF
+	if t.MaxTemp > 0 && target > t.MaxTemp {
+		return math.Max(t.MaxTemp, t.TargetTemp)
+	}
+	return target
+}
+
+// CondensationAdjustment is how the condensation guard changes cooling in a humid room
+type CondensationAdjustment struct {
+	// FanSpeed replaces the blower speed while it applies: slower wrings more moisture out of
+	// the air, faster keeps the supply air above the dew point. 0 leaves the fan speed.
+	FanSpeed int `json:"fan_speed,omitempty"`
+	// MinCoolF keeps cooling from taking the room's surfaces below the dew point; 0 has no floor
+	MinCoolF  float64 `json:"min_cool_f,omitempty"`
+	DewPointF float64 `json:"dew_point_f"`
+	Reason    string  `json:"reason"`
+}
+
+// CoolTarget is the temperature cooling aims for: the target, raised to any condensation floor
+func (t *Thermostat) CoolTarget() float64 {
+	if t.Condensation != nil && t.Condensation.MinCoolF > t.TargetTemp {
+		return t.Condensation.MinCoolF
+	}
+	return t.TargetTemp
+}
+
+// ControlFanSpeed is the blower speed sent with control commands, as changed by the
+// condensation guard
+func (t *Thermostat) ControlFanSpeed() int {
+	if t.Condensation != nil && t.Condensation.FanSpeed > 0 {
+		return t.Condensation.FanSpeed
+	}
+	return t.FanSpeed
+}
+
+// DewPointF returns the dew point of air at tempF and a relative humidity in percent, with the
+// Magnus formula
+func DewPointF(tempF, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	tempC := (tempF - 32) * 5 / 9
+	gamma := math.Log(humidity/100) + b*tempC/(c+tempC)
+	return c*gamma/(b-gamma)*9/5 + 32
+}
+
+// Kinds of humidity equipment
+const (
+	Dehumidifier = "dehumidifier"
+	Humidifier   = "humidifier"
+)
+
+// HumiditySetpoint is the relative humidity range of a room, in percent. A dehumidifier runs
+// above High and a humidifier below Low, until the humidity is Hysteresis back inside.
+type HumiditySetpoint struct {
+	Low        float64 `json:"low,omitempty"`        // 0 never humidifies
+	High       float64 `json:"high,omitempty"`       // 0 never dehumidifies
+	Hysteresis float64 `json:"hysteresis,omitempty"` // 5% by default
+}
+
+// Validate checks that the range is a percentage with Low below High
+func (h *HumiditySetpoint) Validate() error {
+	if h.Low < 0 || h.High < 0 || h.Low > 100 || h.High > 100 || h.Hysteresis < 0 {
+		return fmt.Errorf("low, high and hysteresis must be between 0 and 100")
+	}
+	if h.Low == 0 && h.High == 0 {
+		return fmt.Errorf("a humidity setpoint needs low or high")
+	}
+	if h.Low > 0 && h.High > 0 && h.Low >= h.High {
+		return fmt.Errorf("low must be below high")
+	}
+	return nil
+}
+
+func (h *HumiditySetpoint) band() float64 {
+	if h.Hysteresis > 0 {
+		return h.Hysteresis
+	}
+	return 5.0
+}
+
+// Wants reports whether a dehumidifier or humidifier should run at the current humidity. One
+// already running carries on until the humidity is the hysteresis past its threshold.
+func (h *HumiditySetpoint) Wants(kind string, current float64, running bool) bool {
+	switch kind {
+	case Dehumidifier:
+		if h.High <= 0 {
+			return false
+		}
+		if running {
+			return current > h.High-h.band()
+		}
+		return current > h.High
+	case Humidifier:
+		if h.Low <= 0 {
+			return false
+		}
+		if running {
+			return current < h.Low+h.band()
+		}
+		return current < h.Low
+	}
+	return false
+}
+
+// Reversing valve terminals of a heat pump
+const (
+	ValveO = "o" // Energized to cool (most brands)
+	ValveB = "b" // Energized to heat (Rheem, Ruud, older Trane)
+)
+
+// HVACEquipment describes the heating and cooling equipment wired to a thermostat
+type HVACEquipment struct {
+	HeatStages int `json:"heat_stages"` // 1 or 2; 0 means 1
+	CoolStages int `json:"cool_stages"` // 1 or 2; 0 means 1
+	// HeatPump heats with the compressor through a reversing valve
+	HeatPump       bool   `json:"heat_pump"`
+	ReversingValve string `json:"reversing_valve,omitempty"` // o or b, for a heat pump
+	// AuxHeat is backup heat, e.g. heat strips, that supplements a heat pump falling behind
+	AuxHeat bool `json:"aux_heat"`
+	// Stage2DeltaF calls the second stage this far beyond the target, 2°F by default
+	Stage2DeltaF float64 `json:"stage2_delta_f,omitempty"`
+	// AuxDeltaF calls auxiliary heat this far below the target, 3°F by default
+	AuxDeltaF float64 `json:"aux_delta_f,omitempty"`
+	// MinRunMinutes and MinRestMinutes protect the compressor from short cycling
+	MinRunMinutes  int `json:"min_run_minutes,omitempty"`
+	MinRestMinutes int `json:"min_rest_minutes,omitempty"`
+}
+
+// Validate checks the stages and that heat-pump options come with a heat pump
+func (e *HVACEquipment) Validate() error {
+	if e.HeatStages < 0 || e.HeatStages > 2 || e.CoolStages < 0 || e.CoolStages > 2 {
+		return fmt.Errorf("heat_stages and cool_stages must be 1 or 2")
+	}
+	if e.HeatPump {
+		if e.ReversingValve != ValveO && e.ReversingValve != ValveB {
+			return fmt.Errorf("a heat pump needs reversing_valve o or b")
+		}
+	} else if e.ReversingValve != "" || e.AuxHeat {
+		return fmt.Errorf("reversing_valve and aux_heat need a heat pump")
+	}
+	if e.Stage2DeltaF < 0 || e.AuxDeltaF < 0 || e.MinRunMinutes < 0 || e.MinRestMinutes < 0 {
+		return fmt.Errorf("deltas and minimum run and rest times must not be negative")
+	}
+	return nil
+}
+
+func (e *HVACEquipment) stage2Delta() float64 {
+	if e.Stage2DeltaF > 0 {
+		return e.Stage2DeltaF
+	}
+	return 2.0
+}
+
+func (e *HVACEquipment) auxDelta() float64 {
+	if e.AuxDeltaF > 0 {
+		return e.AuxDeltaF
+	}
+	return 3.0
+}
+
+// HVACCall is what a thermostat asks of its equipment
+type HVACCall struct {
+	Status ThermostatStatus `json:"status"`
+	Stage  int              `json:"stage"` // 0 idle, 1 or 2
+	// Compressor runs the heat pump or AC; a furnace heats without it
+	Compressor bool `json:"compressor"`
+	AuxHeat    bool `json:"aux_heat"`
+	// ReversingValve is whether the O/B terminal is energized
+	ReversingValve bool `json:"reversing_valve"`
+	// Fan runs the blower, with heating and cooling or alone
+	Fan bool `json:"fan"`
 }
 
 // ThermostatSchedule represents a scheduled temperature setting
@@ -63,6 +321,181 @@ type ThermostatSchedule struct {
 	UpdatedAt    time.Time      `json:"updated_at" db:"updated_at"`
 }
 
+// Periods of a day in a weekly schedule
+const (
+	PeriodWake   = "wake"
+	PeriodLeave  = "leave"
+	PeriodReturn = "return"
+	PeriodSleep  = "sleep"
+)
+
+// Day groups of a weekly schedule
+const (
+	DaysEveryday = "everyday"
+	DaysWeekdays = "weekdays"
+	DaysWeekend  = "weekend"
+)
+
+// ScheduleTimeBlock is one period of a day: its target applies from Start until the next block
+type ScheduleTimeBlock struct {
+	Period     string  `json:"period"` // wake, leave, return or sleep
+	Start      string  `json:"start"`  // HH:MM format
+	TargetTemp float64 `json:"target_temp"`
+}
+
+// WeeklySchedule holds the time blocks of each day, keyed by day name (sunday..saturday) or by
+// one of the groups everyday, weekdays and weekend. A day's own blocks replace those of its
+// group, and weekdays and weekend replace everyday.
+type WeeklySchedule map[string][]ScheduleTimeBlock
+
+// Entries validates the schedule and expands it into one schedule entry per block and day,
+// sorted by time of week
+func (w WeeklySchedule) Entries(thermostatID string, mode ThermostatMode, now time.Time) ([]ThermostatSchedule, error) {
+	for key, blocks := range w {
+		if !isScheduleDay(key) {
+			return nil, fmt.Errorf("unknown schedule day %q", key)
+		}
+		starts := make(map[int]bool, len(blocks))
+		for _, block := range blocks {
+			switch block.Period {
+			case PeriodWake, PeriodLeave, PeriodReturn, PeriodSleep:
+			default:
+				return nil, fmt.Errorf("%s: unknown period %q, use wake, leave, return or sleep", key, block.Period)
+			}
+			minute, err := parseClock(block.Start)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", key, block.Period, err)
+			}
+			if starts[minute] {
+				return nil, fmt.Errorf("%s: two blocks start at %s", key, block.Start)
+			}
+			starts[minute] = true
+		}
+	}
+
+	var entries []ThermostatSchedule
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		for _, block := range w.day(day) {
+			minute, _ := parseClock(block.Start)
+			start := fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+			entries = append(entries, ThermostatSchedule{
+				ID:           fmt.Sprintf("%s-%d-%s", thermostatID, day, start),
+				ThermostatID: thermostatID,
+				Name:         block.Period,
+				DayOfWeek:    int(day),
+				StartTime:    start,
+				TargetTemp:   block.TargetTemp,
+				Mode:         mode,
+				Enabled:      true,
+				CreatedAt:    now,
+				UpdatedAt:    now,
+			})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("schedule has no blocks")
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].DayOfWeek != entries[j].DayOfWeek {
+			return entries[i].DayOfWeek < entries[j].DayOfWeek
+		}
+		return entries[i].StartTime < entries[j].StartTime
+	})
+	return entries, nil
+}
+
+// day returns the blocks of a day: its own, or those of the most specific group it belongs to
+func (w WeeklySchedule) day(day time.Weekday) []ScheduleTimeBlock {
+	if blocks, ok := w[strings.ToLower(day.String())]; ok {
+		return blocks
+	}
+	group := DaysWeekdays
+	if day == time.Saturday || day == time.Sunday {
+		group = DaysWeekend
+	}
+	if blocks, ok := w[group]; ok {
+		return blocks
+	}
+	return w[DaysEveryday]
+}
+
+// isScheduleDay reports whether a schedule key is a day name or a day group
+func isScheduleDay(key string) bool {
+	switch key {
+	case DaysEveryday, DaysWeekdays, DaysWeekend:
+		return true
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if key == strings.ToLower(day.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns the minutes after midnight of an HH:MM time
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid start time %q, use HH:MM", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// HoldMode is how long a manual setpoint overrides the schedule
+type HoldMode string
+
+const (
+	HoldNextBlock HoldMode = "next_block" // Until the schedule's next block starts
+	HoldUntil     HoldMode = "until"      // Until a set time
+	HoldPermanent HoldMode = "permanent"  // Until the schedule is resumed
+)
+
+// IsValid checks if the hold mode is known
+func (m HoldMode) IsValid() bool {
+	switch m {
+	case HoldNextBlock, HoldUntil, HoldPermanent:
+		return true
+	default:
+		return false
+	}
+}
+
+// ThermostatHold is a manual setpoint the schedule leaves alone while it holds
+type ThermostatHold struct {
+	Mode       HoldMode  `json:"mode"`
+	TargetTemp float64   `json:"target_temp"`
+	Until      time.Time `json:"until,omitempty"`    // End of an until hold
+	EntryID    string    `json:"entry_id,omitempty"` // Schedule entry in force when the hold started
+	SetAt      time.Time `json:"set_at"`
+
+	// Reason is HoldReasonAway, HoldReasonClosed or HoldReasonArrival for automatic holds, empty for manual holds
+	Reason       string  `json:"reason,omitempty"`
+	PreviousTemp float64 `json:"previous_temp,omitempty"` // Target before an automatic hold, restored without a schedule
+}
+
+const (
+	// HoldReasonAway marks the holds placed while nobody is home
+	HoldReasonAway = "away"
+	// HoldReasonClosed marks the holds placed while a room is closed off
+	HoldReasonClosed = "closed"
+	// HoldReasonArrival marks the holds ending the away setback ahead of a resident's arrival
+	HoldReasonArrival = "arrival"
+)
+
+// Expired reports whether the hold ended at now, with entryID the schedule entry now in force
+func (h *ThermostatHold) Expired(now time.Time, entryID string) bool {
+	switch h.Mode {
+	case HoldNextBlock:
+		return entryID != h.EntryID
+	case HoldUntil:
+		return !now.Before(h.Until)
+	default:
+		return false
+	}
+}
+
 // ThermostatCommand represents a command to send to the thermostat
 type ThermostatCommand struct {
 	Type      string      `json:"type"`
@@ -75,6 +508,7 @@ const (
 	CmdSetTargetTemp = "set_target_temp"
 	CmdSetMode       = "set_mode"
 	CmdSetFanSpeed   = "set_fan_speed"
+	CmdSetFanMode    = "set_fan_mode"
 	CmdTurnOn        = "turn_on"
 	CmdTurnOff       = "turn_off"
 	CmdGetStatus     = "get_status"
@@ -85,6 +519,8 @@ func (t *Thermostat) IsValidMode(mode ThermostatMode) bool {
 	switch mode {
 	case ModeOff, ModeHeat, ModeCool, ModeAuto, ModeFan:
 		return true
+	case ModeEmergencyHeat:
+		return t.Equipment != nil && t.Equipment.HeatPump && t.Equipment.AuxHeat
 	default:
 		return false
 	}
@@ -101,18 +537,26 @@ func (t *Thermostat) ShouldHeat() bool {
 		return false
 	}
 
+	// PID control decides within its duty cycle
+	if t.Control != nil {
+		return t.Control.Calling
+	}
+
 	// Use hysteresis to prevent frequent on/off cycling
-	return t.CurrentTemp < (t.TargetTemp - t.Hysteresis/2)
+	return t.CurrentTemp < (t.HeatTarget() - t.Hysteresis/2)
 }
 
 // ShouldCool determines if cooling should be activated
 func (t *Thermostat) ShouldCool() bool {
-	if !t.CoolingEnabled || t.Mode == ModeOff || t.Mode == ModeHeat {
+	if !t.CoolingEnabled || t.Mode == ModeOff || t.Mode == ModeHeat || t.Mode == ModeEmergencyHeat {
+		return false
+	}
+	if t.Weather != nil && t.Weather.SkipCooling {
 		return false
 	}
 
 	// Use hysteresis to prevent frequent on/off cycling
-	return t.CurrentTemp > (t.TargetTemp + t.Hysteresis/2)
+	return t.CurrentTemp > (t.CoolTarget() + t.Hysteresis/2)
 }
 
 // GetNextAction determines what action the thermostat should take
@@ -122,7 +566,7 @@ func (t *Thermostat) GetNextAction() ThermostatStatus {
 	}
 
 	switch t.Mode {
-	case ModeHeat:
+	case ModeHeat, ModeEmergencyHeat:
 		if t.ShouldHeat() {
 			return StatusHeating
 		}
@@ -149,3 +593,134 @@ func (t *Thermostat) GetNextAction() ThermostatStatus {
 		return StatusIdle
 	}
 }
+
+// NextCall determines the stage, auxiliary heat, reversing valve and blower for the next action.
+// A compressor keeps running for its minimum run time once started and rests for its minimum
+// rest time once stopped, including between heating and cooling. An idle system runs the
+// blower alone when the fan mode asks for it, in any operating mode including off.
+func (t *Thermostat) NextCall(now time.Time) HVACCall {
+	call := t.equipmentCall(now)
+	if call.Status == StatusIdle && t.wantsFan(now) {
+		call.Status = StatusFan
+	}
+	call.Fan = call.Status != StatusIdle
+	return call
+}
+
+// wantsFan reports whether the fan mode runs the blower of an idle system. Circulation runs it
+// at the end of each clock hour, for as long as heating and cooling left short of the runtime.
+func (t *Thermostat) wantsFan(now time.Time) bool {
+	switch t.FanMode {
+	case FanOn:
+		return true
+	case FanCirculate:
+		needed := time.Duration(t.circulateMinutes())*time.Minute - t.FanRuntime(now)
+		if needed <= 0 {
+			return false
+		}
+		// Once started the runtime grows as fast as the hour runs out, so it runs to the hour
+		left := now.Truncate(time.Hour).Add(time.Hour).Sub(now)
+		return left <= needed
+	default:
+		return false
+	}
+}
+
+func (t *Thermostat) circulateMinutes() int {
+	if t.CirculateMinutes > 0 {
+		return t.CirculateMinutes
+	}
+	return DefaultCirculateMinutes
+}
+
+// FanRuntime is how long the blower has run in the clock hour of now
+func (t *Thermostat) FanRuntime(now time.Time) time.Duration {
+	hour := now.Truncate(time.Hour)
+	var runtime time.Duration
+	if t.FanHour.Equal(hour) {
+		runtime = t.FanHourRuntime
+	}
+	if t.Fan {
+		started := t.FanStarted
+		if started.Before(hour) {
+			started = hour
+		}
+		runtime += now.Sub(started)
+	}
+	return runtime
+}
+
+// equipmentCall is the call of the heating and cooling equipment, without the fan mode
+func (t *Thermostat) equipmentCall(now time.Time) HVACCall {
+	status := t.GetNextAction()
+	equipment := t.Equipment
+	if equipment == nil {
+		call := HVACCall{Status: status}
+		if status == StatusHeating || status == StatusCooling {
+			call.Stage = 1
+			call.Compressor = status == StatusCooling
+		}
+		return call
+	}
+
+	emergency := t.Mode == ModeEmergencyHeat
+	usesCompressor := status == StatusCooling || (status == StatusHeating && equipment.HeatPump && !emergency)
+
+	minRun := time.Duration(equipment.MinRunMinutes) * time.Minute
+	minRest := time.Duration(equipment.MinRestMinutes) * time.Minute
+	switch {
+	case t.Compressor && now.Sub(t.CompressorStarted) < minRun && t.Mode != ModeOff && !emergency:
+		// Finish the minimum run before stopping or reversing the compressor
+		status = t.Status
+	case !t.Compressor && usesCompressor && now.Sub(t.CompressorStopped) < minRest:
+		status = StatusIdle // Still resting
+	}
+
+	call := HVACCall{Status: status}
+	switch status {
+	case StatusHeating:
+		delta := t.TargetTemp - t.CurrentTemp
+		call.Stage = 1
+		if equipment.HeatStages == 2 && delta >= equipment.stage2Delta() {
+			call.Stage = 2
+		}
+		if emergency {
+			call.AuxHeat = true
+			return call
+		}
+		call.Compressor = equipment.HeatPump
+		call.AuxHeat = equipment.AuxHeat && delta >= equipment.auxDelta()
+		call.ReversingValve = equipment.HeatPump && equipment.ReversingValve == ValveB
+	case StatusCooling:
+		call.Stage = 1
+		if equipment.CoolStages == 2 && t.CurrentTemp-t.CoolTarget() >= equipment.stage2Delta() {
+			call.Stage = 2
+		}
+		call.Compressor = true
+		call.ReversingValve = equipment.HeatPump && equipment.ReversingValve == ValveO
+	}
+	return call
+}
+
+// ApplyCall records a call as the thermostat's state, timing the compressor's starts and stops
+// and the blower's runtime
+func (t *Thermostat) ApplyCall(call HVACCall, now time.Time) {
+	switch {
+	case call.Compressor && !t.Compressor:
+		t.CompressorStarted = now
+	case !call.Compressor && t.Compressor:
+		t.CompressorStopped = now
+	}
+	switch {
+	case call.Fan && !t.Fan:
+		t.FanStarted = now
+	case !call.Fan && t.Fan:
+		t.FanHourRuntime, t.FanHour = t.FanRuntime(now), now.Truncate(time.Hour)
+	}
+	t.Fan = call.Fan
+
+	t.Status = call.Status
+	t.Stage = call.Stage
+	t.AuxHeat = call.AuxHeat
+	t.Compressor = call.Compressor
+}
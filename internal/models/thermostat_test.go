@@ -204,3 +204,310 @@ func TestThermostatRoomAssignment(t *testing.T) {
 		t.Errorf("Expected room ID 'living-room', got '%s'", thermostat.RoomID)
 	}
 }
+
+func TestWeeklyScheduleEntries(t *testing.T) {
+	now := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	week := WeeklySchedule{
+		DaysWeekdays: {
+			{Period: PeriodWake, Start: "06:30", TargetTemp: 70},
+			{Period: PeriodLeave, Start: "08:00", TargetTemp: 62},
+			{Period: PeriodReturn, Start: "17:30", TargetTemp: 70},
+			{Period: PeriodSleep, Start: "22:00", TargetTemp: 64},
+		},
+		DaysEveryday: {
+			{Period: PeriodWake, Start: "08:00", TargetTemp: 69},
+			{Period: PeriodSleep, Start: "23:00", TargetTemp: 64},
+		},
+		"friday": {
+			{Period: PeriodWake, Start: "6:30", TargetTemp: 70},
+			{Period: PeriodSleep, Start: "23:30", TargetTemp: 64},
+		},
+	}
+
+	entries, err := week.Entries("hall", ModeHeat, now)
+	if err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	// Weekend days follow everyday, Monday to Thursday weekdays, Friday its own blocks
+	if len(entries) != 2*2+4*4+2 {
+		t.Fatalf("Expected 22 entries, got %d", len(entries))
+	}
+	if first := entries[0]; first.DayOfWeek != 0 || first.StartTime != "08:00" || first.Name != PeriodWake || first.ID != "hall-0-08:00" {
+		t.Errorf("Expected Sunday to start with the everyday wake block, got %+v", first)
+	}
+	if friday := entries[18]; friday.DayOfWeek != 5 || friday.StartTime != "06:30" || friday.TargetTemp != 70 {
+		t.Errorf("Expected Friday's own wake block, normalized to 06:30, got %+v", friday)
+	}
+
+	for name, invalid := range map[string]WeeklySchedule{
+		"unknown day":    {"someday": {{Period: PeriodWake, Start: "07:00", TargetTemp: 70}}},
+		"unknown period": {DaysEveryday: {{Period: "lunch", Start: "12:00", TargetTemp: 70}}},
+		"bad time":       {DaysEveryday: {{Period: PeriodWake, Start: "25:00", TargetTemp: 70}}},
+		"same start":     {DaysEveryday: {{Period: PeriodWake, Start: "07:00"}, {Period: PeriodLeave, Start: "07:00"}}},
+		"empty":          {},
+	} {
+		if _, err := invalid.Entries("hall", ModeHeat, now); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestThermostatHoldExpired(t *testing.T) {
+	now := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+
+	next := &ThermostatHold{Mode: HoldNextBlock, EntryID: "hall-0-08:00"}
+	if next.Expired(now, "hall-0-08:00") || !next.Expired(now, "hall-0-17:30") {
+		t.Error("Expected a next-block hold to end when the block changes")
+	}
+
+	until := &ThermostatHold{Mode: HoldUntil, Until: now.Add(time.Hour)}
+	if until.Expired(now, "") || !until.Expired(now.Add(time.Hour), "") {
+		t.Error("Expected an until hold to end at its time")
+	}
+
+	permanent := &ThermostatHold{Mode: HoldPermanent, EntryID: "hall-0-08:00"}
+	if permanent.Expired(now.AddDate(1, 0, 0), "hall-0-17:30") {
+		t.Error("Expected a permanent hold to last")
+	}
+	if HoldMode("forever").IsValid() {
+		t.Error("Expected an unknown hold mode to be invalid")
+	}
+}
+
+func TestNextCallStagesAndHeatPump(t *testing.T) {
+	now := time.Now()
+	thermostat := &Thermostat{
+		TargetTemp:     70,
+		CurrentTemp:    69,
+		Mode:           ModeHeat,
+		Hysteresis:     1,
+		HeatingEnabled: true,
+		CoolingEnabled: true,
+		Equipment: &HVACEquipment{
+			HeatStages:     2,
+			CoolStages:     2,
+			HeatPump:       true,
+			ReversingValve: ValveO,
+			AuxHeat:        true,
+		},
+	}
+	if err := thermostat.Equipment.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	call := thermostat.NextCall(now)
+	if call.Status != StatusHeating || call.Stage != 1 || !call.Compressor || call.AuxHeat || call.ReversingValve {
+		t.Errorf("Expected stage 1 heat pump heating without aux, got %+v", call)
+	}
+
+	thermostat.CurrentTemp = 66
+	call = thermostat.NextCall(now)
+	if call.Stage != 2 || !call.AuxHeat {
+		t.Errorf("Expected stage 2 with aux heat 4°F below target, got %+v", call)
+	}
+
+	thermostat.Mode = ModeEmergencyHeat
+	call = thermostat.NextCall(now)
+	if call.Status != StatusHeating || call.Compressor || !call.AuxHeat {
+		t.Errorf("Expected aux heat alone in emergency heat, got %+v", call)
+	}
+
+	thermostat.Mode = ModeCool
+	thermostat.CurrentTemp = 73
+	call = thermostat.NextCall(now)
+	if call.Status != StatusCooling || call.Stage != 2 || !call.Compressor || !call.ReversingValve {
+		t.Errorf("Expected stage 2 cooling with the O valve energized, got %+v", call)
+	}
+
+	furnace := &Thermostat{Equipment: &HVACEquipment{AuxHeat: true}}
+	if furnace.Equipment.Validate() == nil {
+		t.Error("Expected aux heat without a heat pump to be invalid")
+	}
+	if furnace.IsValidMode(ModeEmergencyHeat) {
+		t.Error("Expected emergency heat to need a heat pump with aux heat")
+	}
+}
+
+func TestNextCallCompressorProtection(t *testing.T) {
+	start := time.Now()
+	thermostat := &Thermostat{
+		TargetTemp:     72,
+		CurrentTemp:    75,
+		Mode:           ModeCool,
+		Hysteresis:     1,
+		CoolingEnabled: true,
+		Equipment:      &HVACEquipment{MinRunMinutes: 5, MinRestMinutes: 5},
+	}
+
+	thermostat.ApplyCall(thermostat.NextCall(start), start)
+	if !thermostat.Compressor || !thermostat.CompressorStarted.Equal(start) {
+		t.Fatalf("Expected the compressor to start, got %+v", thermostat)
+	}
+
+	// Target reached after two minutes: keep running until the minimum run is over
+	thermostat.CurrentTemp = 71
+	if call := thermostat.NextCall(start.Add(2 * time.Minute)); call.Status != StatusCooling {
+		t.Errorf("Expected the minimum run to keep cooling, got %+v", call)
+	}
+	stop := start.Add(6 * time.Minute)
+	thermostat.ApplyCall(thermostat.NextCall(stop), stop)
+	if thermostat.Compressor || thermostat.Status != StatusIdle {
+		t.Fatalf("Expected the compressor to stop after the minimum run, got %+v", thermostat)
+	}
+
+	// Warm again a minute later: rest first
+	thermostat.CurrentTemp = 75
+	if call := thermostat.NextCall(stop.Add(time.Minute)); call.Status != StatusIdle {
+		t.Errorf("Expected the compressor to rest, got %+v", call)
+	}
+	if call := thermostat.NextCall(stop.Add(6 * time.Minute)); call.Status != StatusCooling {
+		t.Errorf("Expected cooling after the minimum rest, got %+v", call)
+	}
+
+	// Turning the thermostat off stops the compressor at once
+	thermostat.ApplyCall(thermostat.NextCall(stop.Add(6*time.Minute)), stop.Add(6*time.Minute))
+	thermostat.Mode = ModeOff
+	if call := thermostat.NextCall(stop.Add(7 * time.Minute)); call.Status != StatusIdle || call.Compressor {
+		t.Errorf("Expected off to stop the compressor, got %+v", call)
+	}
+}
+
+func TestWeatherAdjustment(t *testing.T) {
+	thermostat := &Thermostat{
+		TargetTemp: 68, CurrentTemp: 68, Hysteresis: 1, MaxTemp: 69,
+		Mode: ModeAuto, HeatingEnabled: true, CoolingEnabled: true,
+	}
+	if thermostat.ShouldHeat() {
+		t.Fatal("Expected no heat at the target")
+	}
+
+	thermostat.Weather = &WeatherAdjustment{PreheatF: 2}
+	if thermostat.HeatTarget() != 69 || !thermostat.ShouldHeat() {
+		t.Errorf("Expected pre-heat capped at the maximum of 69°F, got %.1f", thermostat.HeatTarget())
+	}
+
+	thermostat.CurrentTemp = 71
+	thermostat.Weather = &WeatherAdjustment{SkipCooling: true}
+	if thermostat.ShouldCool() {
+		t.Error("Expected cooling skipped")
+	}
+	thermostat.Weather = nil
+	if !thermostat.ShouldCool() {
+		t.Error("Expected cooling without an adjustment")
+	}
+}
+
+func TestHumiditySetpointWants(t *testing.T) {
+	setpoint := &HumiditySetpoint{Low: 35, High: 55}
+	if err := setpoint.Validate(); err != nil {
+		t.Fatalf("Expected a valid setpoint, got %v", err)
+	}
+
+	if !setpoint.Wants(Dehumidifier, 56, false) || setpoint.Wants(Dehumidifier, 54, false) {
+		t.Error("Expected a dehumidifier to start above 55%")
+	}
+	if !setpoint.Wants(Dehumidifier, 51, true) || setpoint.Wants(Dehumidifier, 50, true) {
+		t.Error("Expected a running dehumidifier to stop at 50%")
+	}
+	if !setpoint.Wants(Humidifier, 34, false) || !setpoint.Wants(Humidifier, 39, true) || setpoint.Wants(Humidifier, 40, true) {
+		t.Error("Expected a humidifier to run from below 35% to 40%")
+	}
+
+	if err := (&HumiditySetpoint{Low: 60, High: 50}).Validate(); err == nil {
+		t.Error("Expected low above high to be rejected")
+	}
+}
+
+func TestCondensationAdjustment(t *testing.T) {
+	if dew := DewPointF(75, 60); dew < 60 || dew > 60.5 {
+		t.Errorf("Expected a dew point of about 60.2°F at 75°F and 60%%, got %.1f", dew)
+	}
+
+	thermostat := &Thermostat{TargetTemp: 72, CurrentTemp: 74, Hysteresis: 1, FanSpeed: 50, Mode: ModeCool, CoolingEnabled: true}
+	thermostat.Condensation = &CondensationAdjustment{FanSpeed: 100, MinCoolF: 75}
+	if thermostat.ShouldCool() || thermostat.CoolTarget() != 75 || thermostat.ControlFanSpeed() != 100 {
+		t.Error("Expected cooling held at the condensation floor with the fan at full speed")
+	}
+	thermostat.Condensation = &CondensationAdjustment{FanSpeed: 35, MinCoolF: 70}
+	if !thermostat.ShouldCool() || thermostat.CoolTarget() != 72 || thermostat.ControlFanSpeed() != 35 {
+		t.Error("Expected a floor below the target ignored")
+	}
+}
+
+func TestFanCirculation(t *testing.T) {
+	hour := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	thermostat := &Thermostat{
+		TargetTemp:     70,
+		CurrentTemp:    70,
+		Mode:           ModeHeat,
+		Hysteresis:     1,
+		HeatingEnabled: true,
+		FanMode:        FanCirculate,
+	}
+
+	// Ten minutes of heating count towards the 15 minutes an hour
+	thermostat.CurrentTemp = 68
+	thermostat.ApplyCall(thermostat.NextCall(hour), hour)
+	if !thermostat.Fan {
+		t.Fatalf("Expected the blower to run with the heat, got %+v", thermostat)
+	}
+	thermostat.CurrentTemp = 70
+	stop := hour.Add(10 * time.Minute)
+	thermostat.ApplyCall(thermostat.NextCall(stop), stop)
+	if thermostat.Fan || thermostat.FanRuntime(stop) != 10*time.Minute {
+		t.Fatalf("Expected the blower to stop after 10 minutes, got %v", thermostat.FanRuntime(stop))
+	}
+
+	if call := thermostat.NextCall(hour.Add(50 * time.Minute)); call.Status != StatusIdle || call.Fan {
+		t.Errorf("Expected no circulation before the last 5 minutes, got %+v", call)
+	}
+	start := hour.Add(55 * time.Minute)
+	call := thermostat.NextCall(start)
+	if call.Status != StatusFan || !call.Fan || call.Stage != 0 {
+		t.Fatalf("Expected the blower alone for the last 5 minutes, got %+v", call)
+	}
+	thermostat.ApplyCall(call, start)
+	if call := thermostat.NextCall(hour.Add(58 * time.Minute)); call.Status != StatusFan {
+		t.Errorf("Expected circulation to run to the hour, got %+v", call)
+	}
+
+	// The next hour counts its own minute, circulating for the other 14 at its end
+	next := hour.Add(61 * time.Minute)
+	thermostat.ApplyCall(thermostat.NextCall(next), next)
+	if thermostat.Fan || thermostat.FanRuntime(next) != time.Minute {
+		t.Errorf("Expected circulation to stop in the new hour, got %+v", thermostat)
+	}
+	if call := thermostat.NextCall(hour.Add(105 * time.Minute)); call.Status != StatusIdle {
+		t.Errorf("Expected no circulation with 15 minutes left, got %+v", call)
+	}
+	if call := thermostat.NextCall(hour.Add(106 * time.Minute)); call.Status != StatusFan {
+		t.Errorf("Expected circulation in the last 14 minutes, got %+v", call)
+	}
+
+	// On runs the blower of an off system; auto never runs it alone
+	thermostat.Mode = ModeOff
+	thermostat.FanMode = FanOn
+	if call := thermostat.NextCall(next); call.Status != StatusFan || !call.Fan {
+		t.Errorf("Expected fan on to run the blower, got %+v", call)
+	}
+	thermostat.FanMode = FanAuto
+	if call := thermostat.NextCall(hour.Add(119 * time.Minute)); call.Status != StatusIdle || call.Fan {
+		t.Errorf("Expected fan auto to leave the blower off, got %+v", call)
+	}
+}
+
+func TestFanSettingsValidate(t *testing.T) {
+	speed, tooFast := 40, 120
+	valid := []FanSettings{{Mode: FanOn}, {Mode: FanCirculate, CirculateMinutes: 20}, {Speed: &speed}}
+	for _, settings := range valid {
+		if err := settings.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", settings, err)
+		}
+	}
+	invalid := []FanSettings{{}, {Mode: "sometimes"}, {Mode: FanCirculate, CirculateMinutes: 61}, {Speed: &tooFast}}
+	for _, settings := range invalid {
+		if err := settings.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", settings)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// actionPrefix starts the device ID that addresses a plugin's automation actions, e.g.
+// plugin:zigbee. A device command to it with the action pair publishes on plugins/zigbee/actions/pair.
+const actionPrefix = "plugin:"
+
+// ActionDeviceID is the device ID to send a plugin's automation actions to, so scenes, rules and
+// the device command API can run them like any device command
+func ActionDeviceID(plugin string) string {
+	return actionPrefix + plugin
+}
+
+// announcedDevice is a device as its plugin announces it on plugins/<name>/devices
+type announcedDevice struct {
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	RoomID     string `json:"room_id"`
+}
+
+// deviceState is a device's state as its plugin reports it; readings left out keep their last value
+type deviceState struct {
+	Online      *bool    `json:"online,omitempty"`
+	On          *bool    `json:"on,omitempty"`
+	PowerW      *float64 `json:"power_w,omitempty"`
+	EnergyWh    *float64 `json:"energy_wh,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"` // °F
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Motion      *bool    `json:"motion,omitempty"`
+}
+
+// actionRequest is published on plugins/<name>/actions/<action>
+type actionRequest struct {
+	Action      string                 `json:"action"`
+	Value       interface{}            `json:"value,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	RequestedAt time.Time              `json:"requested_at"`
+}
+
+// Subscribe sends commands and actions with the client and follows what the plugins announce
+func (m *Manager) Subscribe(client *mqtt.Client) error {
+	m.mu.Lock()
+	m.publish = client.Publish
+	m.namespace = client.Namespace()
+	m.mu.Unlock()
+
+	subscriptions := map[string]func(topic string, payload []byte) error{
+		mqtt.PluginStatusTopic("+"):           m.handleStatus,
+		mqtt.PluginDevicesTopic("+"):          m.handleDevices,
+		mqtt.PluginDeviceStateTopic("+", "+"): m.handleDeviceState,
+	}
+	for topic, handler := range subscriptions {
+		if err := client.Subscribe(topic, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginOf returns the plugin a topic under plugins/ belongs to, or nil for an unknown plugin
+func (m *Manager) pluginOf(topic string) *plugin {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 {
+		return nil
+	}
+	return m.plugins[levels[1]]
+}
+
+// handleStatus follows a plugin's online or offline state
+func (m *Manager) handleStatus(topic string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.pluginOf(topic)
+	if p == nil {
+		return nil
+	}
+	if strings.TrimSpace(string(payload)) == mqtt.PayloadOnline {
+		p.status.Online = true
+	} else {
+		m.setOffline(p)
+	}
+	return nil
+}
+
+// handleDevices replaces the devices a plugin handles. A device ID another plugin already
+// announced stays with that plugin.
+func (m *Manager) handleDevices(topic string, payload []byte) error {
+	var announced []announcedDevice
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &announced); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("invalid device list on %s", topic), err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.pluginOf(topic)
+	if p == nil {
+		return nil
+	}
+	name := p.manifest.Name
+
+	devices := make(map[string]*services.MQTTDeviceStatus)
+	for _, device := range announced {
+		if !validLevel(device.DeviceID) {
+			m.logger.Warn("Plugin announced an invalid device ID", map[string]interface{}{"plugin": name, "device_id": device.DeviceID})
+			continue
+		}
+		if owner, taken := m.owners[device.DeviceID]; taken && owner != name {
+			m.logger.Warn("Plugin announced a device of another plugin", map[string]interface{}{
+				"plugin":    name,
+				"device_id": device.DeviceID,
+				"owner":     owner,
+			})
+			continue
+		}
+
+		status, known := p.devices[device.DeviceID]
+		if !known {
+			status = &services.MQTTDeviceStatus{DeviceID: device.DeviceID, Firmware: ActionDeviceID(name)}
+		}
+		status.DeviceName = device.DeviceName
+		status.RoomID = device.RoomID
+		devices[device.DeviceID] = status
+		m.owners[device.DeviceID] = name
+	}
+	for deviceID := range p.devices {
+		if _, kept := devices[deviceID]; !kept {
+			delete(m.owners, deviceID)
+		}
+	}
+	p.devices = devices
+
+	m.logger.Info("Plugin devices announced", map[string]interface{}{"plugin": name, "devices": len(devices)})
+	return nil
+}
+
+// handleDeviceState records the state of a device its plugin announced
+func (m *Manager) handleDeviceState(topic string, payload []byte) error {
+	var state deviceState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid device state on %s", topic), err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.pluginOf(topic)
+	levels := strings.Split(topic, "/")
+	if p == nil || len(levels) != 5 {
+		return nil
+	}
+	device, known := p.devices[levels[3]]
+	if !known {
+		return nil
+	}
+
+	device.Online = state.Online == nil || *state.Online
+	if state.On != nil {
+		device.On = state.On
+	}
+	if state.Motion != nil {
+		device.Motion = state.Motion
+	}
+	device.PowerW = orKeep(state.PowerW, device.PowerW)
+	device.EnergyWh = orKeep(state.EnergyWh, device.EnergyWh)
+	device.Temperature = orKeep(state.Temperature, device.Temperature)
+	device.Humidity = orKeep(state.Humidity, device.Humidity)
+	device.LastSeen = time.Now()
+	return nil
+}
+
+// setOffline marks a plugin and its devices offline; the caller holds m.mu
+func (m *Manager) setOffline(p *plugin) {
+	p.status.Online = false
+	for _, device := range p.devices {
+		device.Online = false
+	}
+}
+
+// Devices returns the devices the plugins announced, for MQTTDeviceService to list
+func (m *Manager) Devices() []services.MQTTDeviceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var devices []services.MQTTDeviceStatus
+	for _, p := range m.plugins {
+		for _, device := range p.devices {
+			devices = append(devices, *device)
+		}
+	}
+	return devices
+}
+
+// Handles reports whether a device ID is a plugin's device or addresses a plugin's actions
+func (m *Manager) Handles(deviceID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, owned := m.owners[deviceID]; owned {
+		return true
+	}
+	_, exists := m.plugins[strings.TrimPrefix(deviceID, actionPrefix)]
+	return exists && strings.HasPrefix(deviceID, actionPrefix)
+}
+
+// SendCommand publishes a command for a plugin's device, or a request for one of its actions
+// when addressed to ActionDeviceID. The plugin must be running.
+func (m *Manager) SendCommand(cmd *models.DeviceCommand) error {
+	m.mu.Lock()
+	name, owned := m.owners[cmd.DeviceID]
+	if !owned && strings.HasPrefix(cmd.DeviceID, actionPrefix) {
+		name = strings.TrimPrefix(cmd.DeviceID, actionPrefix)
+	}
+	p, exists := m.plugins[name]
+	publish := m.publish
+	running := exists && p.status.State == StateRunning
+	m.mu.Unlock()
+
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("device %s not found", cmd.DeviceID), nil)
+	}
+	if !validLevel(cmd.Action) {
+		return errors.NewValidationError(fmt.Sprintf("invalid action %q", cmd.Action), nil)
+	}
+	if !running {
+		return errors.NewDeviceError(fmt.Sprintf("plugin %s is not running", name), nil)
+	}
+	if publish == nil {
+		return errors.NewServiceError("no MQTT client to send plugin commands", nil)
+	}
+
+	var message *mqtt.Message
+	if owned {
+		payload, err := json.Marshal(cmd)
+		if err != nil {
+			return errors.NewSystemError("failed to encode plugin command", err)
+		}
+		message = &mqtt.Message{Topic: mqtt.PluginDeviceCommandTopic(name, cmd.DeviceID), Payload: payload, QoS: 1}
+	} else {
+		if !p.manifest.offers(cmd.Action) {
+			return errors.NewValidationError(fmt.Sprintf("plugin %s has no action %s, it offers %s",
+				name, cmd.Action, strings.Join(p.manifest.Actions, ", ")), nil)
+		}
+		payload, err := json.Marshal(actionRequest{Action: cmd.Action, Value: cmd.Value, Options: cmd.Options, RequestedAt: time.Now()})
+		if err != nil {
+			return errors.NewSystemError("failed to encode plugin action", err)
+		}
+		message = &mqtt.Message{Topic: mqtt.PluginActionTopic(name, cmd.Action), Payload: payload, QoS: 1}
+	}
+
+	if err := publish(message); err != nil {
+		return errors.NewDeviceError(fmt.Sprintf("failed to send '%s' to plugin %s", cmd.Action, name), err)
+	}
+	m.logger.Info("Sent plugin command", map[string]interface{}{
+		"plugin":    name,
+		"device_id": cmd.DeviceID,
+		"action":    cmd.Action,
+		"topic":     message.Topic,
+	})
+	return nil
+}
+
+// orKeep returns value, or previous when value is nil
+func orKeep(value, previous *float64) *float64 {
+	if value != nil {
+		return value
+	}
+	return previous
+}
+
+// validLevel reports whether a device ID or action fits in one topic level
+func validLevel(value string) bool {
+	return value != "" && !strings.ContainsAny(value, "/+#")
+}
@@ -0,0 +1,501 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/secrets"
+	"github.com/johnpr01/home-automation/internal/services"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// States of a plugin
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateBackoff  = "backoff"  // Exited, and restarted once its restart delay is over
+	StateExited   = "exited"   // Exited, and left stopped by its restart policy
+	StateDisabled = "disabled" // Not started, by its manifest or through the API
+	StateStopped  = "stopped"  // Stopped with the gateway
+	StateInvalid  = "invalid"  // Its manifest couldn't be loaded
+)
+
+const (
+	defaultMinRestartDelay = time.Second
+	defaultMaxRestartDelay = time.Minute
+
+	// stableAfter is how long a plugin runs before its restart delay starts over
+	stableAfter = time.Minute
+
+	// stopTimeout is how long a plugin has to exit on SIGTERM before it is killed
+	stopTimeout = 5 * time.Second
+
+	// maxOutputLine bounds a line of plugin output; longer lines are logged in pieces
+	maxOutputLine = 4096
+)
+
+// Status reports a plugin's process and what it announced
+type Status struct {
+	Name        string    `json:"name"`
+	Dir         string    `json:"dir"`
+	Version     string    `json:"version,omitempty"`
+	Description string    `json:"description,omitempty"`
+	State       string    `json:"state"`
+	Online      bool      `json:"online"` // Reported online on its status topic
+	PID         int       `json:"pid,omitempty"`
+	Restarts    int       `json:"restarts"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	LastExit    string    `json:"last_exit,omitempty"` // How the process last ended
+	Devices     int       `json:"devices"`
+	Actions     []string  `json:"actions,omitempty"`
+	Error       string    `json:"error,omitempty"` // Why an invalid plugin can't run
+}
+
+// plugin is a discovered plugin and its process
+type plugin struct {
+	manifest *Manifest
+	status   Status
+	enabled  bool
+	restart  bool          // A restart was requested through the API
+	wake     chan struct{} // Signals the supervisor of an enable, disable or restart
+	devices  map[string]*services.MQTTDeviceStatus
+}
+
+// Manager runs the plugins of a directory and routes device commands and actions to them
+type Manager struct {
+	plugins map[string]*plugin
+	invalid []Status
+	owners  map[string]string // Plugin of each announced device ID
+	publish func(*mqtt.Message) error
+	// namespace prefixes the topic plugins are told, since they publish on the wire
+	namespace mqtt.Namespace
+	logger    *logger.Logger
+	mu        sync.Mutex
+
+	minRestartDelay time.Duration
+	maxRestartDelay time.Duration
+}
+
+// NewManager discovers the plugins under dir. Invalid plugins are logged and listed, not run.
+func NewManager(dir string, serviceLogger *logger.Logger) (*Manager, error) {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Plugins", nil)
+	}
+
+	manifests, invalid, err := Discover(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		plugins:         make(map[string]*plugin),
+		owners:          make(map[string]string),
+		logger:          serviceLogger,
+		minRestartDelay: defaultMinRestartDelay,
+		maxRestartDelay: defaultMaxRestartDelay,
+	}
+	for _, manifest := range manifests {
+		m.plugins[manifest.Name] = &plugin{
+			manifest: manifest,
+			status: Status{
+				Name:        manifest.Name,
+				Dir:         manifest.Dir,
+				Version:     manifest.Version,
+				Description: manifest.Description,
+				State:       StateStarting,
+				Actions:     manifest.Actions,
+			},
+			enabled: !manifest.Disabled,
+			wake:    make(chan struct{}, 1),
+			devices: make(map[string]*services.MQTTDeviceStatus),
+		}
+	}
+	for entry, err := range invalid {
+		m.logger.Error("Invalid plugin, not starting it", err, map[string]interface{}{"dir": entry})
+		m.invalid = append(m.invalid, Status{Name: entry, Dir: entry, State: StateInvalid, Error: err.Error()})
+	}
+	sort.Slice(m.invalid, func(i, j int) bool { return m.invalid[i].Name < m.invalid[j].Name })
+	return m, nil
+}
+
+// Run starts the enabled plugins and keeps them running by their restart policies until ctx is
+// done, then stops them
+func (m *Manager) Run(ctx context.Context) {
+	m.logger.Info("Starting plugins", map[string]interface{}{"plugins": len(m.plugins), "invalid": len(m.invalid)})
+
+	var supervisors sync.WaitGroup
+	for _, p := range m.plugins {
+		supervisors.Add(1)
+		go func(p *plugin) {
+			defer supervisors.Done()
+			m.supervise(ctx, p)
+		}(p)
+	}
+	supervisors.Wait()
+}
+
+// supervise runs a plugin's process again and again, backing off while it keeps failing
+func (m *Manager) supervise(ctx context.Context, p *plugin) {
+	name := p.manifest.Name
+	delay := m.minRestartDelay
+	ran := false
+	for {
+		m.mu.Lock()
+		enabled := p.enabled
+		p.restart = false
+		if !enabled {
+			p.status.State = StateDisabled
+		} else if ran {
+			p.status.Restarts++
+		}
+		m.mu.Unlock()
+		if !enabled {
+			if !m.wait(ctx, p, 0) {
+				m.setState(p, StateStopped)
+				return
+			}
+			continue
+		}
+
+		started := time.Now()
+		err := m.runOnce(ctx, p)
+		ran = true
+
+		m.mu.Lock()
+		p.status.PID = 0
+		p.status.LastExit = exitDescription(err)
+		requested := p.restart || !p.enabled
+		m.setOffline(p)
+		m.mu.Unlock()
+
+		if ctx.Err() != nil {
+			m.setState(p, StateStopped)
+			return
+		}
+		if requested {
+			delay = m.minRestartDelay
+			continue
+		}
+
+		m.logger.Warn("Plugin exited", map[string]interface{}{"plugin": name, "exit": exitDescription(err)})
+		if p.manifest.Restart == RestartNever || (p.manifest.Restart == RestartOnFailure && err == nil) {
+			m.setState(p, StateExited)
+			if !m.wait(ctx, p, 0) {
+				m.setState(p, StateStopped)
+				return
+			}
+			delay = m.minRestartDelay
+			continue
+		}
+
+		if time.Since(started) >= stableAfter {
+			delay = m.minRestartDelay
+		}
+		m.setState(p, StateBackoff)
+		if !m.wait(ctx, p, delay) {
+			m.setState(p, StateStopped)
+			return
+		}
+		if delay *= 2; delay > m.maxRestartDelay {
+			delay = m.maxRestartDelay
+		}
+	}
+}
+
+// wait waits for the delay, or without one until woken, and reports false once ctx is done
+func (m *Manager) wait(ctx context.Context, p *plugin, delay time.Duration) bool {
+	var timeout <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-p.wake:
+	case <-timeout:
+	}
+	return true
+}
+
+// inheritedEnv is the part of the gateway's environment plugins inherit. Secrets, such as the
+// secrets backend's keys and tokens and the broker credentials, are left out; a plugin that
+// needs one references it in its manifest's env.
+var inheritedEnv = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"MQTT_BROKER", "MQTT_PORT", "MQTT_TOPIC_PREFIX",
+}
+
+// environment is the minimal environment a plugin runs with: the inherited variables, the
+// plugin's name and topic, and its manifest's env with secret references resolved
+func (m *Manager) environment(manifest *Manifest, namespace mqtt.Namespace) ([]string, error) {
+	var env []string
+	for _, key := range inheritedEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	env = append(env,
+		"HA_PLUGIN_NAME="+manifest.Name,
+		"HA_PLUGIN_TOPIC="+namespace.Apply(mqtt.Topic("plugins", manifest.Name)),
+	)
+	for _, key := range sortedKeys(manifest.Env) {
+		value, err := secrets.Resolve(manifest.Env[key])
+		if err != nil {
+			return nil, errors.NewConfigError(fmt.Sprintf("failed to resolve %s of plugin %s", key, manifest.Name), err)
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// runOnce starts the plugin's process and waits until it exits, or stops it when ctx is done or
+// a restart or disable is requested
+func (m *Manager) runOnce(ctx context.Context, p *plugin) error {
+	manifest := p.manifest
+	m.mu.Lock()
+	namespace := m.namespace
+	m.mu.Unlock()
+
+	env, err := m.environment(manifest, namespace)
+	if err != nil {
+		m.logger.Error("Failed to start plugin", err, map[string]interface{}{"plugin": manifest.Name})
+		return err
+	}
+
+	cmd := exec.Command(manifest.program(), manifest.Command[1:]...)
+	cmd.Dir = manifest.Dir
+	cmd.Env = env
+	cmd.Stdout = &outputLogger{plugin: manifest.Name, logger: m.logger}
+	cmd.Stderr = &outputLogger{plugin: manifest.Name, logger: m.logger, stderr: true}
+	cmd.WaitDelay = stopTimeout
+
+	m.setState(p, StateStarting)
+	if err := cmd.Start(); err != nil {
+		m.logger.Error("Failed to start plugin", err, map[string]interface{}{"plugin": manifest.Name})
+		return err
+	}
+
+	m.mu.Lock()
+	p.status.State = StateRunning
+	p.status.PID = cmd.Process.Pid
+	p.status.StartedAt = time.Now()
+	m.mu.Unlock()
+	m.logger.Info("Plugin started", map[string]interface{}{
+		"plugin":  manifest.Name,
+		"version": manifest.Version,
+		"pid":     cmd.Process.Pid,
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return stopProcess(cmd, done)
+		case <-p.wake:
+			m.mu.Lock()
+			stop := p.restart || !p.enabled
+			m.mu.Unlock()
+			if stop {
+				return stopProcess(cmd, done)
+			}
+		}
+	}
+}
+
+// stopProcess asks a plugin to exit with SIGTERM and kills it if it doesn't in time
+func stopProcess(cmd *exec.Cmd, done <-chan error) error {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		return <-done
+	}
+}
+
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+func (m *Manager) setState(p *plugin, state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p.status.State = state
+}
+
+// Restart stops a running plugin and starts it again, or starts one that exited
+func (m *Manager) Restart(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, exists := m.plugins[name]
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("unknown plugin %s", name), nil)
+	}
+	if !p.enabled {
+		return errors.NewBusinessError(fmt.Sprintf("plugin %s is disabled", name), nil)
+	}
+	p.restart = true
+	m.logger.Info("Restarting plugin", map[string]interface{}{"plugin": name})
+	signal(p.wake)
+	return nil
+}
+
+// Enable starts or stops a plugin until the gateway restarts, when its manifest applies again
+func (m *Manager) Enable(name string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, exists := m.plugins[name]
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("unknown plugin %s", name), nil)
+	}
+	if p.enabled == enabled {
+		return nil
+	}
+	p.enabled = enabled
+	m.logger.Info("Plugin changed", map[string]interface{}{"plugin": name, "enabled": enabled})
+	signal(p.wake)
+	return nil
+}
+
+// signal wakes a supervisor without blocking; one pending signal is enough
+func signal(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the status of every plugin, sorted by name, invalid ones last
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.plugins)+len(m.invalid))
+	for _, p := range m.plugins {
+		status := p.status
+		status.Devices = len(p.devices)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return append(statuses, m.invalid...)
+}
+
+// Handler serves the status of every plugin as JSON
+func (m *Manager) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"plugins": m.Status()})
+	})
+}
+
+// RestartHandler restarts the plugin ?name= on POST
+func (m *Manager) RestartHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to restart a plugin", http.StatusMethodNotAllowed)
+			return
+		}
+		writeResult(w, m.Restart(r.URL.Query().Get("name")))
+	})
+}
+
+// EnableHandler starts or stops the plugin ?name= on POST with ?enabled=true or false
+func (m *Manager) EnableHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to enable or disable a plugin", http.StatusMethodNotAllowed)
+			return
+		}
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		writeResult(w, m.Enable(r.URL.Query().Get("name"), enabled))
+	})
+}
+
+// writeResult answers 204, or 404 for an unknown plugin and 409 for a disabled one
+func writeResult(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	status := http.StatusInternalServerError
+	if appErr, ok := err.(*errors.HomeAutomationError); ok {
+		switch appErr.Type {
+		case errors.ErrorTypeValidation:
+			status = http.StatusNotFound
+		case errors.ErrorTypeBusiness:
+			status = http.StatusConflict
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// outputLogger logs a plugin's output line by line
+type outputLogger struct {
+	plugin  string
+	stderr  bool
+	logger  *logger.Logger
+	partial []byte
+}
+
+func (o *outputLogger) Write(data []byte) (int, error) {
+	o.partial = append(o.partial, data...)
+	for {
+		end, skip := bytes.IndexByte(o.partial, '\n'), 1
+		if end < 0 || end > maxOutputLine {
+			if len(o.partial) < maxOutputLine {
+				return len(data), nil
+			}
+			end, skip = maxOutputLine, 0
+		}
+		line := strings.TrimRight(string(o.partial[:end]), "\r")
+		o.partial = o.partial[end+skip:]
+
+		fields := map[string]interface{}{"plugin": o.plugin, "line": line}
+		if o.stderr {
+			o.logger.Warn("Plugin output", fields)
+		} else {
+			o.logger.Info("Plugin output", fields)
+		}
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,226 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func writeManifest(t *testing.T, dir, entry, manifest string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, entry), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, entry, ManifestFileName), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func statusOf(m *Manager, name string) Status {
+	for _, status := range m.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	return Status{}
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "zigbee", `{"name":"zigbee","command":["./zigbee"],"actions":["pair"]}`)
+	writeManifest(t, dir, "zigbee-copy", `{"name":"zigbee","command":["./zigbee"]}`)
+	writeManifest(t, dir, "broken", `{"name":"Broken","command":["./broken"]}`)
+	writeManifest(t, dir, "garage", `{"name":"garage","command":["./garage"],"restart":"sometimes"}`)
+	if err := os.MkdirAll(filepath.Join(dir, "notes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, invalid, err := Discover(dir)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if len(manifests) != 1 || manifests[0].Name != "zigbee" || manifests[0].Restart != RestartAlways {
+		t.Fatalf("Expected the zigbee plugin restarted always, got %+v", manifests)
+	}
+	if len(invalid) != 3 {
+		t.Fatalf("Expected the repeated name, bad name and bad restart policy reported, got %v", invalid)
+	}
+	if !manifests[0].offers("pair") || manifests[0].offers("reset") {
+		t.Fatal("Expected the zigbee plugin to offer pair only")
+	}
+}
+
+func TestPluginEnvironment(t *testing.T) {
+	t.Setenv("MQTT_BROKER", "broker.local")
+	t.Setenv("MQTT_PASSWORD", "broker-password")
+	t.Setenv("HA_SECRETS_KEY", "secrets-key")
+	m := &Manager{}
+	manifest := &Manifest{Name: "zigbee", Env: map[string]string{"ZIGBEE_CHANNEL": "15"}}
+
+	env, err := m.environment(manifest, mqtt.NewNamespace(""))
+	if err != nil {
+		t.Fatalf("environment failed: %v", err)
+	}
+	got := strings.Join(env, "\n")
+	for _, want := range []string{"MQTT_BROKER=broker.local", "HA_PLUGIN_NAME=zigbee", "HA_PLUGIN_TOPIC=plugins/zigbee", "ZIGBEE_CHANNEL=15"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %s in the plugin's environment, got %v", want, env)
+		}
+	}
+	if strings.Contains(got, "broker-password") || strings.Contains(got, "secrets-key") {
+		t.Errorf("Expected no secrets in the plugin's environment, got %v", env)
+	}
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "sleeper", `{"name":"sleeper","command":["sh","-c","echo started $HA_PLUGIN_TOPIC; exec sleep 30"]}`)
+	writeManifest(t, dir, "crasher", `{"name":"crasher","command":["sh","-c","exit 3"]}`)
+	writeManifest(t, dir, "once", `{"name":"once","command":["sh","-c","exit 0"],"restart":"on-failure"}`)
+	writeManifest(t, dir, "off", `{"name":"off","command":["sh","-c","exec sleep 30"],"disabled":true}`)
+
+	m, err := NewManager(dir, nil)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	m.minRestartDelay = 10 * time.Millisecond
+	m.maxRestartDelay = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.Run(ctx)
+	}()
+
+	waitFor(t, "the sleeper to run", func() bool { return statusOf(m, "sleeper").State == StateRunning })
+	waitFor(t, "the crasher to restart", func() bool { return statusOf(m, "crasher").Restarts >= 2 })
+	waitFor(t, "the one-shot plugin to exit", func() bool { return statusOf(m, "once").State == StateExited })
+	if status := statusOf(m, "crasher"); status.LastExit != "exit status 3" {
+		t.Fatalf("Expected the crasher's exit recorded, got %+v", status)
+	}
+	if status := statusOf(m, "off"); status.State != StateDisabled {
+		t.Fatalf("Expected the disabled plugin not started, got %+v", status)
+	}
+
+	pid := statusOf(m, "sleeper").PID
+	if err := m.Restart("sleeper"); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	waitFor(t, "the sleeper to restart", func() bool {
+		status := statusOf(m, "sleeper")
+		return status.State == StateRunning && status.PID != pid && status.PID != 0
+	})
+	if err := m.Restart("off"); err == nil {
+		t.Fatal("Expected a restart of a disabled plugin to fail")
+	}
+	if err := m.Restart("missing"); err == nil {
+		t.Fatal("Expected a restart of an unknown plugin to fail")
+	}
+
+	if err := m.Enable("off", true); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	waitFor(t, "the enabled plugin to run", func() bool { return statusOf(m, "off").State == StateRunning })
+	if err := m.Enable("sleeper", false); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+	waitFor(t, "the sleeper to stop", func() bool { return statusOf(m, "sleeper").State == StateDisabled })
+
+	cancel()
+	wg.Wait()
+	for _, status := range m.Status() {
+		if status.State != StateStopped || status.PID != 0 {
+			t.Errorf("Expected %s stopped with the gateway, got %+v", status.Name, status)
+		}
+	}
+}
+
+func TestManagerDevices(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "zigbee", `{"name":"zigbee","command":["./zigbee"],"actions":["pair"]}`)
+	writeManifest(t, dir, "lora", `{"name":"lora","command":["./lora"]}`)
+	m, err := NewManager(dir, nil)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	sent := make(map[string][]byte)
+	m.publish = func(msg *mqtt.Message) error {
+		sent[msg.Topic] = msg.Payload
+		return nil
+	}
+
+	m.handleDevices("plugins/zigbee/devices", []byte(`[{"device_id":"bulb-1","device_name":"Bulb","room_id":"office"},{"device_id":"bad/id"}]`))
+	m.handleDevices("plugins/lora/devices", []byte(`[{"device_id":"bulb-1"},{"device_id":"gate"}]`))
+	m.handleDeviceState("plugins/zigbee/devices/bulb-1/state", []byte(`{"on":true,"power_w":8.5}`))
+	m.handleDeviceState("plugins/zigbee/devices/bulb-1/state", []byte(`{"on":false}`))
+
+	devices := m.Devices()
+	if len(devices) != 2 {
+		t.Fatalf("Expected the bulb and the gate, got %+v", devices)
+	}
+	if !m.Handles("bulb-1") || !m.Handles("gate") || !m.Handles(ActionDeviceID("zigbee")) || m.Handles("zigbee") || m.Handles("plugin:missing") {
+		t.Fatal("Unexpected devices handled")
+	}
+	for _, device := range devices {
+		if device.DeviceID != "bulb-1" {
+			continue
+		}
+		if !device.Online || device.On == nil || *device.On || device.PowerW == nil || *device.PowerW != 8.5 || device.RoomID != "office" {
+			t.Fatalf("Unexpected bulb %+v", device)
+		}
+	}
+
+	command := &models.DeviceCommand{DeviceID: "bulb-1", Action: "turn_on"}
+	if err := m.SendCommand(command); err == nil {
+		t.Fatal("Expected a command to a plugin that isn't running to fail")
+	}
+
+	m.plugins["zigbee"].status.State = StateRunning
+	if err := m.SendCommand(command); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	var received models.DeviceCommand
+	if err := json.Unmarshal(sent["plugins/zigbee/devices/bulb-1/command"], &received); err != nil || received.Action != "turn_on" {
+		t.Fatalf("Expected the command on the device's topic, got %+v, %v", received, err)
+	}
+
+	if err := m.SendCommand(&models.DeviceCommand{DeviceID: ActionDeviceID("zigbee"), Action: "reset"}); err == nil {
+		t.Fatal("Expected an action the plugin doesn't offer to fail")
+	}
+	if err := m.SendCommand(&models.DeviceCommand{DeviceID: ActionDeviceID("zigbee"), Action: "pair", Value: 60}); err != nil {
+		t.Fatalf("SendCommand of an action failed: %v", err)
+	}
+	var request actionRequest
+	if err := json.Unmarshal(sent["plugins/zigbee/actions/pair"], &request); err != nil || request.Action != "pair" || request.Value != float64(60) {
+		t.Fatalf("Expected the action request, got %+v, %v", request, err)
+	}
+
+	// Going offline marks the plugin's devices offline
+	m.handleStatus("plugins/zigbee/status", []byte(mqtt.PayloadOffline))
+	for _, device := range m.Devices() {
+		if device.DeviceID == "bulb-1" && device.Online {
+			t.Fatal("Expected the bulb offline with its plugin")
+		}
+	}
+}
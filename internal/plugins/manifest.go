@@ -0,0 +1,146 @@
+// Package plugins runs third-party integrations as separate processes next to the unified
+// service. A plugin is a directory under HA_PLUGIN_DIR with a plugin.json manifest and any
+// program, in any language, that speaks MQTT: it publishes room readings on the usual room
+// topics, announces the devices it handles, and takes their commands and its automation actions
+// on its own topics under plugins/<name>/. The manager starts the plugins, restarts those that
+// exit, and routes device commands to them, so new device protocols and automation actions
+// need no change to the services.
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// ManifestFileName is the manifest in each plugin's directory
+const ManifestFileName = "plugin.json"
+
+// Restart policies of a plugin whose process exits
+const (
+	RestartAlways    = "always"     // Restarted however it exited (default)
+	RestartOnFailure = "on-failure" // Restarted only after a non-zero exit
+	RestartNever     = "never"      // Left stopped until restarted through the API
+)
+
+var pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Manifest describes a plugin: how to start it and what it offers
+type Manifest struct {
+	Name        string            `json:"name"` // Lowercase letters, digits, - and _; names its topics
+	Version     string            `json:"version,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Command     []string          `json:"command"`           // Program and arguments, the program relative to the plugin's directory or on the PATH
+	Env         map[string]string `json:"env,omitempty"`     // Added to the plugin's environment
+	Actions     []string          `json:"actions,omitempty"` // Automation actions it takes; any action when empty
+	Restart     string            `json:"restart,omitempty"` // always, on-failure or never
+	Disabled    bool              `json:"disabled,omitempty"`
+
+	Dir string `json:"-"` // Directory the manifest was found in
+}
+
+// Validate checks a manifest and fills in its default restart policy
+func (m *Manifest) Validate() error {
+	if !pluginNamePattern.MatchString(m.Name) {
+		return errors.NewConfigError(fmt.Sprintf("invalid plugin name %q, use lowercase letters, digits, - and _", m.Name), nil)
+	}
+	if len(m.Command) == 0 || m.Command[0] == "" {
+		return errors.NewConfigError(fmt.Sprintf("plugin %s has no command", m.Name), nil)
+	}
+	switch m.Restart {
+	case "":
+		m.Restart = RestartAlways
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return errors.NewConfigError(fmt.Sprintf("plugin %s has unknown restart policy %q, use always, on-failure or never", m.Name, m.Restart), nil)
+	}
+	return nil
+}
+
+// offers reports whether the plugin takes an automation action
+func (m *Manifest) offers(action string) bool {
+	if len(m.Actions) == 0 {
+		return true
+	}
+	for _, offered := range m.Actions {
+		if offered == action {
+			return true
+		}
+	}
+	return false
+}
+
+// program resolves the plugin's program: a file in its directory, or else a program on the PATH
+func (m *Manifest) program() string {
+	program := m.Command[0]
+	if filepath.IsAbs(program) {
+		return program
+	}
+	if local := filepath.Join(m.Dir, program); fileExists(local) {
+		return local
+	}
+	return program
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// LoadManifest reads and validates the manifest of the plugin in dir
+func LoadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read plugin manifest", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.NewConfigError(fmt.Sprintf("failed to parse plugin manifest in %s", dir), err)
+	}
+	manifest.Dir = dir
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Discover loads the manifests of the plugin directories under dir, sorted by name. Directories
+// without a manifest are skipped; invalid manifests and repeated names are returned as errors by
+// directory, so one broken plugin doesn't keep the others from running.
+func Discover(dir string) ([]*Manifest, map[string]error, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.NewConfigError("failed to read plugin directory", err)
+	}
+
+	var manifests []*Manifest
+	invalid := make(map[string]error)
+	names := make(map[string]string)
+	for _, entry := range entries {
+		pluginDir := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() || !fileExists(filepath.Join(pluginDir, ManifestFileName)) {
+			continue
+		}
+
+		manifest, err := LoadManifest(pluginDir)
+		if err != nil {
+			invalid[entry.Name()] = err
+			continue
+		}
+		if other, taken := names[manifest.Name]; taken {
+			invalid[entry.Name()] = errors.NewConfigError(fmt.Sprintf("plugin name %s is already used in %s", manifest.Name, other), nil)
+			continue
+		}
+		names[manifest.Name] = entry.Name()
+		manifests = append(manifests, manifest)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests, invalid, nil
+}
@@ -0,0 +1,145 @@
+package profiling
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// RequireAdmin only serves requests carrying the admin token as a bearer token.
+// An empty token rejects every request, so endpoints stay closed until a token is configured.
+func RequireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "admin authorization required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReadOnly only serves GET and HEAD requests, for a read replica that must not change anything.
+// Everything else is refused with a pointer to the control node.
+func ReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "read replica: send changes to the control node", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RegisterPprof registers the pprof endpoints under /debug/pprof/ behind admin auth
+func RegisterPprof(mux *http.ServeMux, adminToken string) {
+	mux.Handle("/debug/pprof/", RequireAdmin(adminToken, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", RequireAdmin(adminToken, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", RequireAdmin(adminToken, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", RequireAdmin(adminToken, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", RequireAdmin(adminToken, http.HandlerFunc(pprof.Trace)))
+}
+
+// RegisterLogEndpoints registers the runtime log level and recent log endpoints behind admin auth
+func RegisterLogEndpoints(mux *http.ServeMux, adminToken string) {
+	mux.Handle("/debug/log/levels", RequireAdmin(adminToken, logger.LevelsHandler()))
+	mux.Handle("/debug/log/recent", RequireAdmin(adminToken, logger.RecentHandler()))
+}
+
+// RegisterRuntimeGauges registers goroutine and heap gauges labelled with the service name
+func RegisterRuntimeGauges(registerer prometheus.Registerer, service string) error {
+	labels := prometheus.Labels{"service": service}
+
+	gauges := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "home_automation_goroutines",
+			Help:        "Number of goroutines running in the service",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(runtime.NumGoroutine())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "home_automation_heap_alloc_bytes",
+			Help:        "Bytes of allocated heap objects in the service",
+			ConstLabels: labels,
+		}, func() float64 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return float64(stats.HeapAlloc)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "home_automation_heap_objects",
+			Help:        "Number of allocated heap objects in the service",
+			ConstLabels: labels,
+		}, func() float64 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return float64(stats.HeapObjects)
+		}),
+	}
+
+	for _, gauge := range gauges {
+		if err := registerer.Register(gauge); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register runtime gauge", err)
+		}
+	}
+
+	return nil
+}
+
+// Serve runs a debug server exposing /metrics, admin-gated pprof and log levels and any extra routes until the context is cancelled
+func Serve(ctx context.Context, addr, service, adminToken string, routes map[string]http.Handler, serviceLogger *logger.Logger) error {
+	if err := RegisterRuntimeGauges(prometheus.DefaultRegisterer, service); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	RegisterPprof(mux, adminToken)
+	RegisterLogEndpoints(mux, adminToken)
+	for pattern, handler := range routes {
+		mux.Handle(pattern, handler)
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if serviceLogger != nil {
+		serviceLogger.Info("Debug server listening", map[string]interface{}{
+			"addr":          addr,
+			"service":       service,
+			"pprof_enabled": adminToken != "",
+		})
+	}
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.NewSystemError("debug server failed", err)
+	}
+
+	return nil
+}
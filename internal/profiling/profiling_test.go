@@ -0,0 +1,96 @@
+package profiling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestPprofRequiresAdminToken(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterPprof(mux, "secret")
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"admin token", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestPprofClosedWithoutToken(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterPprof(mux, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected pprof to be closed without an admin token, got status %d", rec.Code)
+	}
+}
+
+func TestReadOnlyRefusesChanges(t *testing.T) {
+	handler := ReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for method, status := range map[string]int{
+		http.MethodGet:    http.StatusOK,
+		http.MethodHead:   http.StatusOK,
+		http.MethodPost:   http.StatusMethodNotAllowed,
+		http.MethodDelete: http.StatusMethodNotAllowed,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/api/scenes/recall", nil))
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", method, status, rec.Code)
+		}
+	}
+}
+
+func TestRuntimeGauges(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterRuntimeGauges(registry, "test-service"); err != nil {
+		t.Fatalf("RegisterRuntimeGauges failed: %v", err)
+	}
+
+	// Registering again is harmless
+	if err := RegisterRuntimeGauges(registry, "test-service"); err != nil {
+		t.Fatalf("Second RegisterRuntimeGauges failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, metric := range []string{"home_automation_goroutines", "home_automation_heap_alloc_bytes", "home_automation_heap_objects"} {
+		if !strings.Contains(body, metric+`{service="test-service"}`) {
+			t.Errorf("Expected %s gauge for test-service", metric)
+		}
+	}
+}
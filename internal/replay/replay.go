@@ -0,0 +1,214 @@
+// Package replay records MQTT sensor traffic to a file and plays it back with its original
+// timing, sped up, or as fast as possible, so automation and thermostat behavior seen in the home
+// can be reproduced from the same readings.
+//
+// A recording is JSON lines, one message per line, so it can be read, trimmed and edited by hand:
+//
+//	{"offset_ms":0,"time":"2024-01-15T07:00:00Z","topic":"room-temp/kitchen","payload":{"temperature":68.5}}
+//	{"offset_ms":4200,"time":"2024-01-15T07:00:04.2Z","topic":"room-motion/hall","text":"ON"}
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Message is a recorded message. JSON payloads are kept as they are; others as text.
+type Message struct {
+	OffsetMS int64           `json:"offset_ms"` // Since the first message of the recording
+	Time     time.Time       `json:"time"`
+	Topic    string          `json:"topic"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Text     *string         `json:"text,omitempty"`
+}
+
+// Offset is when the message was received, from the start of the recording
+func (m Message) Offset() time.Duration {
+	return time.Duration(m.OffsetMS) * time.Millisecond
+}
+
+// Bytes returns the payload as it was received
+func (m Message) Bytes() []byte {
+	if m.Text != nil {
+		return []byte(*m.Text)
+	}
+	return m.Payload
+}
+
+// Recorder writes the messages it is handed to a recording
+type Recorder struct {
+	w     *bufio.Writer
+	start time.Time
+	count int
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+// NewRecorder creates a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: bufio.NewWriter(w), now: time.Now}
+}
+
+// Record writes a message; it is an mqtt.MessageHandler
+func (r *Recorder) Record(topic string, payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.count == 0 {
+		r.start = now
+	}
+	msg := Message{OffsetMS: now.Sub(r.start).Milliseconds(), Time: now, Topic: topic}
+	if len(payload) > 0 && json.Valid(payload) {
+		msg.Payload = json.RawMessage(payload)
+	} else {
+		text := string(payload)
+		msg.Text = &text
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return errors.NewSystemError("failed to encode recorded message", err)
+	}
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		return errors.NewSystemError("failed to write recording", err)
+	}
+	r.count++
+	return nil
+}
+
+// Count is the number of messages recorded
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// Flush writes buffered messages to the recording
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		return errors.NewSystemError("failed to write recording", err)
+	}
+	return nil
+}
+
+// Load reads a recording, ordered by offset
+func Load(r io.Reader) ([]Message, error) {
+	var messages []Message
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("invalid message on line %d", line), err)
+		}
+		if msg.Topic == "" {
+			return nil, errors.NewValidationError(fmt.Sprintf("message on line %d has no topic", line), nil)
+		}
+		messages = append(messages, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.NewSystemError("failed to read recording", err)
+	}
+
+	// Hand-edited recordings may be out of order; equal offsets keep their order
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].OffsetMS < messages[j].OffsetMS
+	})
+	return messages, nil
+}
+
+// Filter returns the messages on topics matching any of filters, all when there are none, from
+// offset from up to offset to; a zero to has no end
+func Filter(messages []Message, filters []string, from, to time.Duration) []Message {
+	var kept []Message
+	for _, msg := range messages {
+		if msg.Offset() < from || (to > 0 && msg.Offset() > to) {
+			continue
+		}
+		if len(filters) > 0 && !matchesAny(filters, msg.Topic) {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+func matchesAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if mqtt.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Player publishes recorded messages in order
+type Player struct {
+	// Speed scales the recorded timing: 1 is the original, 10 ten times faster, and 0 publishes
+	// every message as fast as possible
+	Speed   float64
+	Publish func(topic string, payload []byte) error
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewPlayer creates a player publishing at speed
+func NewPlayer(speed float64, publish func(topic string, payload []byte) error) *Player {
+	return &Player{Speed: speed, Publish: publish, now: time.Now, sleep: sleepContext}
+}
+
+// Play publishes the messages, waiting out the gaps between them scaled by the speed. Each wait
+// is measured from the start of the playback, so slow publishes don't add up to drift. It returns
+// how many messages were published, and stops at the first failed publish or when ctx is done.
+func (p *Player) Play(ctx context.Context, messages []Message) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	start := p.now()
+	first := messages[0].Offset()
+	for i, msg := range messages {
+		if p.Speed > 0 {
+			due := start.Add(time.Duration(float64(msg.Offset()-first) / p.Speed))
+			if wait := due.Sub(p.now()); wait > 0 {
+				if err := p.sleep(ctx, wait); err != nil {
+					return i, err
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := p.Publish(msg.Topic, msg.Bytes()); err != nil {
+			return i, errors.NewServiceError(fmt.Sprintf("failed to publish %s", msg.Topic), err)
+		}
+	}
+	return len(messages), nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording)
+	now := time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time { return now }
+
+	recorder.Record("room-temp/kitchen", []byte(`{"temperature":68.5}`))
+	now = now.Add(4200 * time.Millisecond)
+	recorder.Record("room-motion/hall", []byte("ON"))
+	now = now.Add(time.Second)
+	recorder.Record("room-temp/bedroom", []byte(`{"temperature":66}`))
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Count() != 3 {
+		t.Errorf("Expected 3 messages recorded, got %d", recorder.Count())
+	}
+	if !strings.Contains(recording.String(), `"payload":{"temperature":68.5}`) {
+		t.Errorf("Expected JSON payloads kept readable, got %s", recording.String())
+	}
+
+	messages, err := Load(&recording)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(messages) != 3 || messages[1].Offset() != 4200*time.Millisecond || string(messages[1].Bytes()) != "ON" {
+		t.Fatalf("Expected the recording back, got %+v", messages)
+	}
+
+	temps := Filter(messages, []string{"room-temp/+"}, time.Second, 0)
+	if len(temps) != 1 || temps[0].Topic != "room-temp/bedroom" {
+		t.Errorf("Expected the later temperature only, got %+v", temps)
+	}
+
+	if _, err := Load(strings.NewReader("{\"offset_ms\": 1}\n")); err == nil {
+		t.Error("Expected a message without a topic to be rejected")
+	}
+}
+
+func TestPlayTiming(t *testing.T) {
+	messages, err := Load(strings.NewReader(`{"offset_ms":1000,"topic":"b","text":"2"}
+{"offset_ms":0,"topic":"a","payload":{"n":1}}
+{"offset_ms":11000,"topic":"c","text":"3"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	player := NewPlayer(10, func(topic string, payload []byte) error {
+		published = append(published, topic+"="+string(payload))
+		return nil
+	})
+	clock := time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC)
+	start := clock
+	var waits []time.Duration
+	player.now = func() time.Time { return clock }
+	player.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		clock = clock.Add(d)
+		return nil
+	}
+
+	count, err := player.Play(context.Background(), messages)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 messages played, got %d %v", count, err)
+	}
+	if strings.Join(published, " ") != `a={"n":1} b=2 c=3` {
+		t.Errorf("Expected the messages in recorded order, got %v", published)
+	}
+	if len(waits) != 2 || waits[0] != 100*time.Millisecond || clock.Sub(start) != 1100*time.Millisecond {
+		t.Errorf("Expected the gaps ten times faster, got %v", waits)
+	}
+
+	// As fast as possible never waits; a cancelled playback stops
+	player.Speed = 0
+	waits = nil
+	if count, _ := player.Play(context.Background(), messages); count != 3 || len(waits) != 0 {
+		t.Errorf("Expected no waits at speed 0, got %d messages and %v", count, waits)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if count, err := player.Play(ctx, messages); count != 0 || err == nil {
+		t.Errorf("Expected a cancelled playback to stop, got %d %v", count, err)
+	}
+}
@@ -0,0 +1,128 @@
+package safemode
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Default crash loop thresholds
+const (
+	DefaultMaxCrashes  = 3
+	DefaultCrashWindow = 10 * time.Minute
+)
+
+// startRecord is the persisted start/shutdown history used for crash loop detection
+type startRecord struct {
+	Running      bool        `json:"running"`
+	LastStart    time.Time   `json:"last_start"`
+	UncleanStops []time.Time `json:"unclean_stops,omitempty"`
+}
+
+// CrashLoopDetector tracks process starts that were never followed by a clean shutdown
+type CrashLoopDetector struct {
+	path       string
+	maxCrashes int
+	window     time.Duration
+}
+
+// NewCrashLoopDetector creates a detector that trips after maxCrashes unclean stops within window
+func NewCrashLoopDetector(path string, maxCrashes int, window time.Duration) *CrashLoopDetector {
+	if maxCrashes <= 0 {
+		maxCrashes = DefaultMaxCrashes
+	}
+	if window <= 0 {
+		window = DefaultCrashWindow
+	}
+
+	return &CrashLoopDetector{
+		path:       path,
+		maxCrashes: maxCrashes,
+		window:     window,
+	}
+}
+
+// RecordStart records a process start and reports whether the service is crash looping
+func (d *CrashLoopDetector) RecordStart() (bool, error) {
+	record, err := d.load()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	// The previous run never reached RecordCleanShutdown, so it crashed
+	if record.Running {
+		record.UncleanStops = append(record.UncleanStops, record.LastStart)
+	}
+
+	recent := make([]time.Time, 0, len(record.UncleanStops))
+	for _, stop := range record.UncleanStops {
+		if now.Sub(stop) <= d.window {
+			recent = append(recent, stop)
+		}
+	}
+
+	record.UncleanStops = recent
+	record.Running = true
+	record.LastStart = now
+
+	if err := d.save(record); err != nil {
+		return false, err
+	}
+
+	return len(recent) >= d.maxCrashes, nil
+}
+
+// RecordCleanShutdown marks the current run as stopped cleanly and resets the crash history
+func (d *CrashLoopDetector) RecordCleanShutdown() error {
+	record, err := d.load()
+	if err != nil {
+		return err
+	}
+
+	record.Running = false
+	record.UncleanStops = nil
+
+	return d.save(record)
+}
+
+// load reads the start record, returning an empty record if none exists yet
+func (d *CrashLoopDetector) load() (*startRecord, error) {
+	data, err := os.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return &startRecord{}, nil
+	}
+	if err != nil {
+		return nil, errors.NewSystemError("failed to read start history", err)
+	}
+
+	record := &startRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		// A corrupt history should never block startup; start fresh
+		return &startRecord{}, nil
+	}
+
+	return record, nil
+}
+
+// save writes the start record
+func (d *CrashLoopDetector) save(record *startRecord) error {
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal start history", err)
+	}
+
+	if err := os.WriteFile(d.path, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write start history", err)
+	}
+
+	return nil
+}
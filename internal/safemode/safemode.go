@@ -0,0 +1,335 @@
+package safemode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// Components that are held back while safe mode is active
+const (
+	ComponentAutomation = "automation"
+	ComponentThermostat = "thermostat"
+	ComponentTapo       = "tapo"
+	ComponentDevice     = "device"
+)
+
+// State file names inside the state directory
+const (
+	StateFileName  = "safemode.json"
+	StartsFileName = "starts.json"
+)
+
+// State is the persisted safe mode state shared between the daemons and the CLI
+type State struct {
+	Active    bool      `json:"active"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Enabled   []string  `json:"enabled,omitempty"` // Components or component:id targets re-enabled by the user
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Controller decides whether automations and actuators may act while safe mode is active
+type Controller struct {
+	path    string
+	state   State
+	modTime time.Time
+	mu      sync.RWMutex
+	logger  *logger.Logger
+}
+
+// NewController creates a safe mode controller backed by the given state file
+func NewController(path string, serviceLogger *logger.Logger) *Controller {
+	return &Controller{
+		path:   path,
+		logger: serviceLogger,
+	}
+}
+
+// StatePath returns the safe mode state file path for a state directory
+func StatePath(stateDir string) string {
+	return filepath.Join(stateDir, StateFileName)
+}
+
+// StartsPath returns the crash loop tracking file path for a service in a state directory
+func StartsPath(stateDir, serviceName string) string {
+	return filepath.Join(stateDir, serviceName+"-"+StartsFileName)
+}
+
+// Startup resolves the safe mode state for a starting service. Safe mode is entered when forced
+// with --safe-mode or when the service is crash looping; otherwise a state persisted by an
+// earlier run is honoured until it is exited through the CLI.
+func Startup(stateDir, serviceName string, forced bool, serviceLogger *logger.Logger) (*Controller, *CrashLoopDetector, error) {
+	detector := NewCrashLoopDetector(StartsPath(stateDir, serviceName), DefaultMaxCrashes, DefaultCrashWindow)
+	controller := NewController(StatePath(stateDir), serviceLogger)
+
+	crashLoop, err := detector.RecordStart()
+	if err != nil && serviceLogger != nil {
+		serviceLogger.Error("Failed to record service start for crash loop detection", err, map[string]interface{}{
+			"service": serviceName,
+		})
+	}
+
+	switch {
+	case forced:
+		err = controller.Enter("started with --safe-mode")
+	case crashLoop:
+		err = controller.Enter(fmt.Sprintf("%s crash loop detected (%d unclean restarts within %s)",
+			serviceName, detector.maxCrashes, detector.window))
+	default:
+		err = controller.Reload()
+		if err == nil && controller.Active() && serviceLogger != nil {
+			serviceLogger.Warn("Safe mode still active from a previous run", map[string]interface{}{
+				"reason": controller.GetState().Reason,
+			})
+		}
+	}
+
+	return controller, detector, err
+}
+
+// Enter activates safe mode, clearing any previously re-enabled targets
+func (c *Controller) Enter(reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.state = State{
+		Active:    true,
+		Reason:    reason,
+		Since:     now,
+		UpdatedAt: now,
+	}
+
+	if c.logger != nil {
+		c.logger.Warn("Safe mode active: automations disabled and actuators untouched", map[string]interface{}{
+			"reason": reason,
+		})
+	}
+
+	return c.save()
+}
+
+// Exit deactivates safe mode so every component resumes normal operation
+func (c *Controller) Exit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasActive := c.state.Active
+	c.state = State{UpdatedAt: time.Now()}
+
+	if wasActive && c.logger != nil {
+		c.logger.Info("Safe mode exited, resuming normal operation")
+	}
+
+	return c.save()
+}
+
+// Enable re-enables a component ("thermostat") or a single target ("automation:motion-light-kitchen")
+func (c *Controller) Enable(target string) error {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return errors.NewValidationError("safe mode target cannot be empty", nil)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, enabled := range c.state.Enabled {
+		if enabled == target {
+			return nil
+		}
+	}
+
+	c.state.Enabled = append(c.state.Enabled, target)
+	sort.Strings(c.state.Enabled)
+	c.state.UpdatedAt = time.Now()
+
+	if c.logger != nil {
+		c.logger.Info("Safe mode target re-enabled", map[string]interface{}{
+			"target": target,
+		})
+	}
+
+	return c.save()
+}
+
+// Disable removes a previously re-enabled component or target
+func (c *Controller) Disable(target string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	remaining := make([]string, 0, len(c.state.Enabled))
+	for _, enabled := range c.state.Enabled {
+		if enabled != target {
+			remaining = append(remaining, enabled)
+		}
+	}
+
+	if len(remaining) == len(c.state.Enabled) {
+		return errors.NewValidationError("safe mode target is not enabled: "+target, nil)
+	}
+
+	c.state.Enabled = remaining
+	c.state.UpdatedAt = time.Now()
+
+	if c.logger != nil {
+		c.logger.Info("Safe mode target disabled", map[string]interface{}{
+			"target": target,
+		})
+	}
+
+	return c.save()
+}
+
+// Active reports whether safe mode is currently active
+func (c *Controller) Active() bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state.Active
+}
+
+// Allowed reports whether a component may act on the given target.
+// A nil controller always allows, so services work unchanged without safe mode wired in.
+func (c *Controller) Allowed(component, id string) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.state.Active {
+		return true
+	}
+
+	for _, enabled := range c.state.Enabled {
+		if enabled == component || (id != "" && enabled == component+":"+id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetState returns a copy of the current safe mode state
+func (c *Controller) GetState() State {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state := c.state
+	state.Enabled = append([]string(nil), c.state.Enabled...)
+	return state
+}
+
+// Reload reads the state file, picking up changes made by the CLI
+func (c *Controller) Reload() error {
+	info, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to stat safe mode state file", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !info.ModTime().After(c.modTime) {
+		return nil
+	}
+
+	state, err := Load(c.path)
+	if err != nil {
+		return err
+	}
+
+	c.state = *state
+	c.modTime = info.ModTime()
+	return nil
+}
+
+// Watch periodically reloads the state file until the context is cancelled
+func (c *Controller) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Reload(); err != nil && c.logger != nil {
+				c.logger.Error("Failed to reload safe mode state", err, map[string]interface{}{
+					"path": c.path,
+				})
+			}
+		}
+	}
+}
+
+// save writes the state file; callers must hold the lock
+func (c *Controller) save() error {
+	if err := Save(c.path, &c.state); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(c.path); err == nil {
+		c.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Load reads a safe mode state file
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, errors.NewSystemError("failed to read safe mode state file", err)
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.NewConfigError("failed to parse safe mode state file", err)
+	}
+
+	return state, nil
+}
+
+// Save atomically writes a safe mode state file
+func Save(path string, state *State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal safe mode state", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write safe mode state file", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.NewSystemError("failed to replace safe mode state file", err)
+	}
+
+	return nil
+}
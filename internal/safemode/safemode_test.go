@@ -0,0 +1,162 @@
+package safemode
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNilControllerAllowsEverything(t *testing.T) {
+	var controller *Controller
+
+	if !controller.Allowed(ComponentThermostat, "thermostat-001") {
+		t.Error("Expected nil controller to allow all components")
+	}
+
+	if controller.Active() {
+		t.Error("Expected nil controller to report safe mode inactive")
+	}
+}
+
+func TestSafeModeBlocksUntilEnabled(t *testing.T) {
+	controller := NewController(filepath.Join(t.TempDir(), StateFileName), nil)
+
+	if !controller.Allowed(ComponentAutomation, "motion-light-kitchen") {
+		t.Error("Expected components to be allowed before safe mode is entered")
+	}
+
+	if err := controller.Enter("test"); err != nil {
+		t.Fatalf("Enter failed: %v", err)
+	}
+
+	if controller.Allowed(ComponentAutomation, "motion-light-kitchen") {
+		t.Error("Expected automation to be blocked in safe mode")
+	}
+
+	if err := controller.Enable("automation:motion-light-kitchen"); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	if !controller.Allowed(ComponentAutomation, "motion-light-kitchen") {
+		t.Error("Expected re-enabled rule to be allowed")
+	}
+
+	if controller.Allowed(ComponentAutomation, "motion-light-office") {
+		t.Error("Expected other rules to stay blocked")
+	}
+
+	if err := controller.Enable(ComponentThermostat); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	if !controller.Allowed(ComponentThermostat, "thermostat-001") {
+		t.Error("Expected whole component to be allowed once enabled")
+	}
+
+	if err := controller.Disable(ComponentThermostat); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+
+	if controller.Allowed(ComponentThermostat, "thermostat-001") {
+		t.Error("Expected thermostat to be blocked again after disable")
+	}
+
+	if err := controller.Disable(ComponentTapo); err == nil {
+		t.Error("Expected error disabling a target that was never enabled")
+	}
+
+	if err := controller.Exit(); err != nil {
+		t.Fatalf("Exit failed: %v", err)
+	}
+
+	if !controller.Allowed(ComponentTapo, "dryer") {
+		t.Error("Expected everything to be allowed after exit")
+	}
+}
+
+func TestSafeModeStateSharedThroughFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StateFileName)
+
+	service := NewController(path, nil)
+	if err := service.Enter("test"); err != nil {
+		t.Fatalf("Enter failed: %v", err)
+	}
+
+	// Simulate the CLI changing the state from another process
+	time.Sleep(10 * time.Millisecond)
+	cli := NewController(path, nil)
+	if err := cli.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if !cli.Active() {
+		t.Fatal("Expected CLI to see active safe mode")
+	}
+	if err := cli.Enable(ComponentTapo); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	if err := service.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if !service.Allowed(ComponentTapo, "dryer") {
+		t.Error("Expected service to pick up target enabled by the CLI")
+	}
+}
+
+func TestCrashLoopDetection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test-"+StartsFileName)
+	detector := NewCrashLoopDetector(path, 2, time.Minute)
+
+	// First start has no history
+	crashLoop, err := detector.RecordStart()
+	if err != nil {
+		t.Fatalf("RecordStart failed: %v", err)
+	}
+	if crashLoop {
+		t.Error("Expected no crash loop on first start")
+	}
+
+	// Restart without a clean shutdown counts as one crash
+	crashLoop, _ = detector.RecordStart()
+	if crashLoop {
+		t.Error("Expected no crash loop after a single crash")
+	}
+
+	// Second crash trips the detector
+	crashLoop, _ = detector.RecordStart()
+	if !crashLoop {
+		t.Error("Expected crash loop after two crashes")
+	}
+
+	// A clean shutdown resets the history
+	if err := detector.RecordCleanShutdown(); err != nil {
+		t.Fatalf("RecordCleanShutdown failed: %v", err)
+	}
+
+	crashLoop, _ = detector.RecordStart()
+	if crashLoop {
+		t.Error("Expected no crash loop after a clean shutdown")
+	}
+}
+
+func TestStartupForcedSafeMode(t *testing.T) {
+	stateDir := t.TempDir()
+
+	controller, _, err := Startup(stateDir, "test", true, nil)
+	if err != nil {
+		t.Fatalf("Startup failed: %v", err)
+	}
+	if !controller.Active() {
+		t.Fatal("Expected safe mode to be active when forced")
+	}
+
+	// A later normal start honours the persisted state
+	controller, _, err = Startup(stateDir, "other", false, nil)
+	if err != nil {
+		t.Fatalf("Startup failed: %v", err)
+	}
+	if !controller.Active() {
+		t.Error("Expected persisted safe mode to carry over to the next start")
+	}
+}
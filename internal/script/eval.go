@@ -0,0 +1,400 @@
+// Package script is the small expression and scripting language of scripted automations, e.g.
+//
+//	temp("bedroom") > 78 && hour() >= 22 && !occupied("living-room")
+//
+// Programs only compute values and call the functions the host provides; they have no loops, so
+// they always finish, and each run is bounded by a step budget and the context's deadline.
+package script
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// DefaultMaxSteps bounds the nodes a run may evaluate when the environment sets no limit
+const DefaultMaxSteps = 10000
+
+// Func is a function the host provides to programs. Arguments and results are nil, bool,
+// float64 or string.
+type Func func(args []interface{}) (interface{}, error)
+
+// Env is what a program runs against: the host's functions and variables
+type Env struct {
+	Functions map[string]Func
+	Vars      map[string]interface{}
+	MaxSteps  int
+}
+
+// Program is a compiled expression or script
+type Program struct {
+	source string
+	body   []node
+	calls  []string
+}
+
+// CompileExpression compiles a single expression, such as a condition
+func CompileExpression(src string) (*Program, error) {
+	p, err := newParser(src)
+	if err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, syntaxError(t.pos, "expected the end of the expression, found %s", describe(t))
+	}
+	return &Program{source: src, body: []node{expr}, calls: sortedNames(p.calls)}, nil
+}
+
+// CompileScript compiles statements separated by newlines or semicolons: expressions, let
+// assignments and if/else blocks
+func CompileScript(src string) (*Program, error) {
+	p, err := newParser(src)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.statements(tokenEOF, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: src, body: body, calls: sortedNames(p.calls)}, nil
+}
+
+func newParser(src string) (*parser, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens, calls: make(map[string]bool)}, nil
+}
+
+// Calls lists the functions the program calls, so a host can reject unknown ones up front
+func (p *Program) Calls() []string {
+	return p.calls
+}
+
+// String returns the program's source
+func (p *Program) String() string {
+	return p.source
+}
+
+// Run evaluates the program and returns the value of its last statement
+func (p *Program) Run(ctx context.Context, env *Env) (interface{}, error) {
+	if env == nil {
+		env = &Env{}
+	}
+	run := &evaluation{ctx: ctx, env: env, locals: make(map[string]interface{}), steps: env.MaxSteps}
+	if run.steps <= 0 {
+		run.steps = DefaultMaxSteps
+	}
+	return run.block(p.body)
+}
+
+// Test evaluates a condition, which must be true or false
+func (p *Program) Test(ctx context.Context, env *Env) (bool, error) {
+	value, err := p.Run(ctx, env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, errors.NewValidationError(fmt.Sprintf("condition gave %s, not true or false", typeName(value)), nil)
+	}
+	return result, nil
+}
+
+// evaluationError reports a mistake found while running, at the node that made it
+func evaluationError(n node, format string, args ...interface{}) error {
+	return errors.NewValidationError(fmt.Sprintf("%s: %s", n.position(), fmt.Sprintf(format, args...)), nil)
+}
+
+type evaluation struct {
+	ctx    context.Context
+	env    *Env
+	locals map[string]interface{}
+	steps  int
+}
+
+func (e *evaluation) block(body []node) (interface{}, error) {
+	var last interface{}
+	for _, statement := range body {
+		value, err := e.eval(statement)
+		if err != nil {
+			return nil, err
+		}
+		last = value
+	}
+	return last, nil
+}
+
+func (e *evaluation) eval(n node) (interface{}, error) {
+	e.steps--
+	if e.steps < 0 {
+		return nil, errors.NewTimeoutError("script exceeded its step budget", nil)
+	}
+	if err := e.ctx.Err(); err != nil {
+		return nil, errors.NewTimeoutError("script ran out of time", err)
+	}
+
+	switch n := n.(type) {
+	case *literal:
+		return n.value, nil
+	case *variable:
+		if value, ok := e.locals[n.name]; ok {
+			return value, nil
+		}
+		if value, ok := e.env.Vars[n.name]; ok {
+			return value, nil
+		}
+		return nil, evaluationError(n, "unknown variable %s", n.name)
+	case *assignment:
+		value, err := e.eval(n.value)
+		if err != nil {
+			return nil, err
+		}
+		e.locals[n.name] = value
+		return value, nil
+	case *ifStatement:
+		cond, err := e.condition(n.cond, "if")
+		if err != nil {
+			return nil, err
+		}
+		if cond {
+			return e.block(n.then)
+		}
+		return e.block(n.otherwise)
+	case *conditional:
+		cond, err := e.condition(n.cond, "?")
+		if err != nil {
+			return nil, err
+		}
+		if cond {
+			return e.eval(n.then)
+		}
+		return e.eval(n.otherwise)
+	case *call:
+		fn, ok := e.env.Functions[n.name]
+		if !ok {
+			return nil, evaluationError(n, "unknown function %s", n.name)
+		}
+		args := make([]interface{}, len(n.args))
+		for i, arg := range n.args {
+			value, err := e.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		result, err := fn(args)
+		if err != nil {
+			return nil, errors.NewServiceError(fmt.Sprintf("%s: %s failed", n.pos, n.name), err)
+		}
+		switch value := result.(type) {
+		case nil, bool, float64, string:
+			return value, nil
+		case int:
+			return float64(value), nil
+		case int64:
+			return float64(value), nil
+		case float32:
+			return float64(value), nil
+		}
+		return nil, evaluationError(n, "%s gave %T, which scripts can't use", n.name, result)
+	case *unary:
+		operand, err := e.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			value, ok := operand.(bool)
+			if !ok {
+				return nil, evaluationError(n, "! needs true or false, not %s", typeName(operand))
+			}
+			return !value, nil
+		}
+		value, ok := operand.(float64)
+		if !ok {
+			return nil, evaluationError(n, "- needs a number, not %s", typeName(operand))
+		}
+		return -value, nil
+	case *binary:
+		return e.binary(n)
+	}
+	return nil, evaluationError(n, "unknown statement")
+}
+
+// condition evaluates what if and ?: choose by
+func (e *evaluation) condition(n node, what string) (bool, error) {
+	value, err := e.eval(n)
+	if err != nil {
+		return false, err
+	}
+	cond, ok := value.(bool)
+	if !ok {
+		return false, evaluationError(n, "%s needs true or false, not %s", what, typeName(value))
+	}
+	return cond, nil
+}
+
+func (e *evaluation) binary(n *binary) (interface{}, error) {
+	left, err := e.eval(n.left)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || don't evaluate their right side when the left decides
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, evaluationError(n, "%s needs true or false, not %s", n.op, typeName(left))
+		}
+		if (n.op == "&&") != l {
+			return l, nil
+		}
+		right, err := e.eval(n.right)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, evaluationError(n, "%s needs true or false, not %s", n.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := e.eval(n.right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "+":
+		// Adding to a string joins, so messages can include readings
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok || rok {
+			if !lok {
+				ls = Format(left)
+			}
+			if !rok {
+				rs = Format(right)
+			}
+			return ls + rs, nil
+		}
+	}
+
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			switch n.op {
+			case "<":
+				return ls < rs, nil
+			case "<=":
+				return ls <= rs, nil
+			case ">":
+				return ls > rs, nil
+			case ">=":
+				return ls >= rs, nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, evaluationError(n, "%s needs numbers, not %s and %s", n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, evaluationError(n, "division by zero")
+		}
+		if n.op == "%" {
+			return math.Mod(l, r), nil
+		}
+		return l / r, nil
+	}
+	return l + r, nil
+}
+
+// typeName names a value's type for error messages
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// Format writes a value the way a script shows it, e.g. 78.5, true or null
+func Format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ArgCount checks that a function got between least and most arguments
+func ArgCount(name string, args []interface{}, least, most int) error {
+	if len(args) < least || len(args) > most {
+		if least == most {
+			return errors.NewValidationError(fmt.Sprintf("%s takes %d arguments, got %d", name, least, len(args)), nil)
+		}
+		return errors.NewValidationError(fmt.Sprintf("%s takes %d to %d arguments, got %d", name, least, most, len(args)), nil)
+	}
+	return nil
+}
+
+// StringArg returns the i'th argument of a function, which must be a string
+func StringArg(name string, args []interface{}, i int) (string, error) {
+	value, ok := args[i].(string)
+	if !ok {
+		return "", errors.NewValidationError(fmt.Sprintf("argument %d of %s must be a string, not %s", i+1, name, typeName(args[i])), nil)
+	}
+	return value, nil
+}
+
+// NumberArg returns the i'th argument of a function, which must be a number
+func NumberArg(name string, args []interface{}, i int) (float64, error) {
+	value, ok := args[i].(float64)
+	if !ok {
+		return 0, errors.NewValidationError(fmt.Sprintf("argument %d of %s must be a number, not %s", i+1, name, typeName(args[i])), nil)
+	}
+	return value, nil
+}
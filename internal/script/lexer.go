@@ -0,0 +1,183 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNewline
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenKeyword
+	tokenOperator
+)
+
+var keywords = map[string]bool{
+	"let":   true,
+	"if":    true,
+	"else":  true,
+	"true":  true,
+	"false": true,
+	"null":  true,
+}
+
+// Operators, longest first so "<=" isn't read as "<"
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"!", "<", ">", "+", "-", "*", "/", "%", "=", "(", ")", "{", "}", ",", ";", "?", ":",
+}
+
+type token struct {
+	kind   tokenKind
+	text   string
+	number float64
+	pos    position
+}
+
+// position is where a token starts, for error messages
+type position struct {
+	line, col int
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%d:%d", p.line, p.col)
+}
+
+// syntaxError reports a mistake in the source at a position
+func syntaxError(pos position, format string, args ...interface{}) error {
+	return errors.NewValidationError(fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, args...)), nil)
+}
+
+// lex splits the source into tokens. Newlines end statements, except inside parentheses, so a
+// long condition may be broken over lines within them. Comments run from // or # to the end of
+// the line.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+	line, col := 1, 1
+	depth := 0
+
+	advance := func(n int) {
+		for i := 0; i < n; i++ {
+			if runes[0] == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+			runes = runes[1:]
+		}
+	}
+
+	for len(runes) > 0 {
+		pos := position{line, col}
+		r := runes[0]
+		switch {
+		case r == '\n':
+			if depth == 0 {
+				tokens = append(tokens, token{kind: tokenNewline, pos: pos})
+			}
+			advance(1)
+		case unicode.IsSpace(r):
+			advance(1)
+		case r == '#' || (r == '/' && len(runes) > 1 && runes[1] == '/'):
+			for len(runes) > 0 && runes[0] != '\n' {
+				advance(1)
+			}
+		case unicode.IsDigit(r) || (r == '.' && len(runes) > 1 && unicode.IsDigit(runes[1])):
+			n := 0
+			for n < len(runes) && (unicode.IsDigit(runes[n]) || runes[n] == '.') {
+				n++
+			}
+			text := string(runes[:n])
+			number, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, syntaxError(pos, "invalid number %q", text)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, number: number, pos: pos})
+			advance(n)
+		case r == '"' || r == '\'':
+			text, n, err := lexString(runes, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: pos})
+			advance(n)
+		case r == '_' || unicode.IsLetter(r):
+			n := 0
+			for n < len(runes) && (runes[n] == '_' || unicode.IsLetter(runes[n]) || unicode.IsDigit(runes[n])) {
+				n++
+			}
+			text := string(runes[:n])
+			kind := tokenIdent
+			if keywords[text] {
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: pos})
+			advance(n)
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(string(runes[:min(len(runes), 2)]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, syntaxError(pos, "unexpected %q", string(r))
+			}
+			switch op {
+			case "(":
+				depth++
+			case ")":
+				if depth > 0 {
+					depth--
+				}
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: pos})
+			advance(len(op))
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: position{line, col}}), nil
+}
+
+// lexString reads a quoted string, returning its value and how many runes it took
+func lexString(runes []rune, pos position) (string, int, error) {
+	quote := runes[0]
+	var value strings.Builder
+	for i := 1; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\n':
+			return "", 0, syntaxError(pos, "unterminated string")
+		case '\\':
+			if i+1 == len(runes) {
+				return "", 0, syntaxError(pos, "unterminated string")
+			}
+			i++
+			switch escaped := runes[i]; escaped {
+			case 'n':
+				value.WriteRune('\n')
+			case 't':
+				value.WriteRune('\t')
+			case '\\', '"', '\'':
+				value.WriteRune(escaped)
+			default:
+				return "", 0, syntaxError(pos, "unknown escape \\%c", escaped)
+			}
+		default:
+			value.WriteRune(r)
+		}
+	}
+	return "", 0, syntaxError(pos, "unterminated string")
+}
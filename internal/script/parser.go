@@ -0,0 +1,351 @@
+package script
+
+import (
+	"sort"
+)
+
+// node is an expression or statement of a parsed program
+type node interface {
+	position() position
+}
+
+type literal struct {
+	pos   position
+	value interface{}
+}
+
+type variable struct {
+	pos  position
+	name string
+}
+
+type call struct {
+	pos  position
+	name string
+	args []node
+}
+
+type unary struct {
+	pos     position
+	op      string
+	operand node
+}
+
+type binary struct {
+	pos         position
+	op          string
+	left, right node
+}
+
+type conditional struct {
+	pos                   position
+	cond, then, otherwise node
+}
+
+type assignment struct {
+	pos   position
+	name  string
+	value node
+}
+
+type ifStatement struct {
+	pos       position
+	cond      node
+	then      []node
+	otherwise []node // An else if is a block holding one ifStatement
+}
+
+func (n *literal) position() position     { return n.pos }
+func (n *variable) position() position    { return n.pos }
+func (n *call) position() position        { return n.pos }
+func (n *unary) position() position       { return n.pos }
+func (n *binary) position() position      { return n.pos }
+func (n *conditional) position() position { return n.pos }
+func (n *assignment) position() position  { return n.pos }
+func (n *ifStatement) position() position { return n.pos }
+
+// Binary operators by precedence, loosest first
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	next   int
+	calls  map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// is reports whether the next token is the operator or keyword
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokenOperator || t.kind == tokenKeyword) && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.is(text) {
+		return syntaxError(p.peek().pos, "expected %s, found %s", text, describe(p.peek()))
+	}
+	p.take()
+	return nil
+}
+
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokenNewline {
+		p.take()
+	}
+}
+
+// statements parses statements until the closing token, "}" or the end of the source
+func (p *parser) statements(closing tokenKind, closer string) ([]node, error) {
+	var body []node
+	for {
+		for p.peek().kind == tokenNewline || p.is(";") {
+			p.take()
+		}
+		if t := p.peek(); t.kind == closing && (closer == "" || t.text == closer) {
+			return body, nil
+		}
+		if p.peek().kind == tokenEOF {
+			return nil, syntaxError(p.peek().pos, "expected %s, found the end of the script", closer)
+		}
+
+		statement, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, statement)
+
+		if t := p.peek(); t.kind != tokenNewline && t.kind != tokenEOF && !p.is(";") && !(t.kind == closing && (closer == "" || t.text == closer)) {
+			return nil, syntaxError(t.pos, "expected the end of the statement, found %s", describe(t))
+		}
+	}
+}
+
+func (p *parser) statement() (node, error) {
+	switch {
+	case p.is("let"):
+		pos := p.take().pos
+		name := p.take()
+		if name.kind != tokenIdent {
+			return nil, syntaxError(name.pos, "expected a name after let, found %s", describe(name))
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &assignment{pos: pos, name: name.text, value: value}, nil
+	case p.is("if"):
+		return p.ifStatement()
+	default:
+		return p.expression()
+	}
+}
+
+func (p *parser) ifStatement() (node, error) {
+	pos := p.take().pos
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	statement := &ifStatement{pos: pos, cond: cond, then: then}
+
+	// else may follow the closing brace on the next line
+	next := p.next
+	p.skipNewlines()
+	if !p.is("else") {
+		p.next = next
+		return statement, nil
+	}
+	p.take()
+	if p.is("if") {
+		nested, err := p.ifStatement()
+		if err != nil {
+			return nil, err
+		}
+		statement.otherwise = []node{nested}
+		return statement, nil
+	}
+	if statement.otherwise, err = p.block(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *parser) block() ([]node, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	body, err := p.statements(tokenOperator, "}")
+	if err != nil {
+		return nil, err
+	}
+	p.take()
+	return body, nil
+}
+
+// expression parses a conditional expression, cond ? then : otherwise
+func (p *parser) expression() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.is("?") {
+		return cond, err
+	}
+	pos := p.take().pos
+	p.skipNewlines()
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{pos: pos, cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+// binary parses the operators of a precedence level and tighter ones. A line may end after an
+// operator and continue on the next.
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range precedence[level] {
+			if p.peek().kind == tokenOperator && p.peek().text == candidate {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		pos := p.take().pos
+		p.skipNewlines()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{pos: pos, op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.is("!") || p.is("-") {
+		t := p.take()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{pos: t.pos, op: t.text, operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenNumber:
+		return &literal{pos: t.pos, value: t.number}, nil
+	case tokenString:
+		return &literal{pos: t.pos, value: t.text}, nil
+	case tokenKeyword:
+		switch t.text {
+		case "true":
+			return &literal{pos: t.pos, value: true}, nil
+		case "false":
+			return &literal{pos: t.pos, value: false}, nil
+		case "null":
+			return &literal{pos: t.pos}, nil
+		}
+	case tokenIdent:
+		if !p.is("(") {
+			return &variable{pos: t.pos, name: t.text}, nil
+		}
+		p.take()
+		fn := &call{pos: t.pos, name: t.text}
+		for !p.is(")") {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			fn.args = append(fn.args, arg)
+			if !p.is(",") {
+				break
+			}
+			p.take()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		p.calls[t.text] = true
+		return fn, nil
+	case tokenOperator:
+		if t.text == "(" {
+			inner, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, syntaxError(t.pos, "unexpected %s", describe(t))
+}
+
+// describe names a token for error messages
+func describe(t token) string {
+	switch t.kind {
+	case tokenEOF:
+		return "the end of the script"
+	case tokenNewline:
+		return "the end of the line"
+	case tokenString:
+		return "a string"
+	default:
+		return "\"" + t.text + "\""
+	}
+}
+
+// sortedNames lists a set's names in order
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
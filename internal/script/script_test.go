@@ -0,0 +1,196 @@
+package script
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv(calls *[]string) *Env {
+	temps := map[string]interface{}{"bedroom": 79.5, "office": nil}
+	return &Env{
+		Functions: map[string]Func{
+			"temp": func(args []interface{}) (interface{}, error) {
+				if err := ArgCount("temp", args, 1, 1); err != nil {
+					return nil, err
+				}
+				room, err := StringArg("temp", args, 0)
+				if err != nil {
+					return nil, err
+				}
+				return temps[room], nil
+			},
+			"hour": func(args []interface{}) (interface{}, error) { return 23, nil },
+			"occupied": func(args []interface{}) (interface{}, error) {
+				return args[0] == "kitchen", nil
+			},
+			"act": func(args []interface{}) (interface{}, error) {
+				parts := make([]string, len(args))
+				for i, arg := range args {
+					parts[i] = Format(arg)
+				}
+				*calls = append(*calls, strings.Join(parts, " "))
+				return nil, nil
+			},
+		},
+		Vars: map[string]interface{}{"threshold": 78.0},
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	tests := map[string]interface{}{
+		`temp("bedroom") > 78 && hour() > 22 && !occupied("living-room")`: true,
+		`temp("bedroom") > threshold + 2`:                                 false,
+		`1 + 2 * 3 - 4 / 2`:                                               5.0,
+		`-(1 + 2) % 2`:                                                    -1.0,
+		`"it is " + temp("bedroom") + "°F"`:                               "it is 79.5°F",
+		`temp("office") == null ? "unknown" : "known"`:                    "unknown",
+		`"b" > "a" && 'single' == "single"`:                               true,
+		`false || occupied("kitchen")`:                                    true,
+		`1 == "1"`:                                                        false,
+		"(temp(\"bedroom\") > 70 &&\n  hour() < 24)":                      true,
+	}
+	for src, want := range tests {
+		program, err := CompileExpression(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		got, err := program.Run(context.Background(), testEnv(nil))
+		if err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v, %v", src, want, got, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	compile := map[string]string{
+		`temp("bedroom" > 78`: "expected )",
+		`1 +`:                 "unexpected the end of the script",
+		`"open`:               "unterminated string",
+		`1 2`:                 "expected the end of the expression",
+		`a = 1`:               "expected the end of the expression",
+		`temp("a") @ 1`:       `unexpected "@"`,
+	}
+	for src, want := range compile {
+		if _, err := CompileExpression(src); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", src, want, err)
+		}
+	}
+
+	run := map[string]string{
+		`temp("office") > 78`:       "1:16: > needs numbers, not null and a number",
+		`hour() && true`:            "&& needs true or false",
+		`missing(1)`:                "unknown function missing",
+		`nothing + 1`:               "unknown variable nothing",
+		`1 / 0`:                     "division by zero",
+		`temp(1)`:                   "argument 1 of temp must be a string",
+		`temp()`:                    "temp takes 1 arguments, got 0",
+		`hour() > 1 ? "yes" : 2`:    "",
+		`!occupied("hall") ? 1 : 0`: "",
+	}
+	for src, want := range run {
+		program, err := CompileExpression(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		_, err = program.Run(context.Background(), testEnv(nil))
+		if want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", src, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", src, want, err)
+		}
+	}
+
+	// Short-circuiting skips the failing side
+	program, _ := CompileExpression(`false && temp("office") > 78`)
+	if ok, err := program.Test(context.Background(), testEnv(nil)); ok || err != nil {
+		t.Errorf("Expected && to stop at false, got %v, %v", ok, err)
+	}
+	program, _ = CompileExpression(`hour()`)
+	if _, err := program.Test(context.Background(), testEnv(nil)); err == nil {
+		t.Error("Expected a condition giving a number to fail")
+	}
+}
+
+func TestScripts(t *testing.T) {
+	src := `
+# Cool the bedroom down
+let target = temp("bedroom") > 80 ? "high" : "low"
+if occupied("kitchen") {
+	act("fan", target); act("notify", "fan " + target)
+} else if hour() > 22 {
+	act("never")
+}
+else {
+	act("never")
+}
+act("done",
+	1, true)
+`
+	program, err := CompileScript(src)
+	if err != nil {
+		t.Fatalf("CompileScript failed: %v", err)
+	}
+	if calls := strings.Join(program.Calls(), ","); calls != "act,hour,occupied,temp" {
+		t.Fatalf("Unexpected calls %s", calls)
+	}
+
+	var calls []string
+	if _, err := program.Run(context.Background(), testEnv(&calls)); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := strings.Join(calls, "|"); got != "fan low|notify fan low|done 1 true" {
+		t.Fatalf("Unexpected calls %q", got)
+	}
+
+	for src, want := range map[string]string{
+		"if true { act(1) ":          "expected }",
+		"let = 1":                    "expected a name after let",
+		"act(1) act(2)":              "expected the end of the statement",
+		"if 1 > 0 act(1)":            "expected {",
+		"act(1)\n}":                  `unexpected "}"`,
+		"let x = 1\nif x { act(x) }": "",
+	} {
+		program, err := CompileScript(src)
+		if want == "" {
+			if err != nil {
+				t.Errorf("%q: %v", src, err)
+				continue
+			}
+			if _, err := program.Run(context.Background(), testEnv(&calls)); err == nil || !strings.Contains(err.Error(), "if needs true or false") {
+				t.Errorf("%q: expected if to need a boolean, got %v", src, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	program, err := CompileExpression(strings.Repeat("1 + ", 50) + "1")
+	if err != nil {
+		t.Fatalf("CompileExpression failed: %v", err)
+	}
+	if _, err := program.Run(context.Background(), &Env{MaxSteps: 20}); err == nil || !strings.Contains(err.Error(), "step budget") {
+		t.Fatalf("Expected the step budget exceeded, got %v", err)
+	}
+	if value, err := program.Run(context.Background(), &Env{}); err != nil || value != 51.0 {
+		t.Fatalf("Expected 51 within the default budget, got %v, %v", value, err)
+	}
+
+	slow, _ := CompileScript("wait()\nwait()")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	env := &Env{Functions: map[string]Func{"wait": func([]interface{}) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	}}}
+	if _, err := slow.Run(ctx, env); err == nil || !strings.Contains(err.Error(), "ran out of time") {
+		t.Fatalf("Expected the script to run out of time, got %v", err)
+	}
+}
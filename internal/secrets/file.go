@@ -0,0 +1,230 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// KeySize is the length of the AES-256 key of a secrets file
+	KeySize = 32
+
+	fileVersion = 1
+	// fileAAD binds the ciphertext to this file format
+	fileAAD = "home-automation-secrets-v1"
+)
+
+// encryptedFile is the format of a secrets file: the secrets as a JSON object, encrypted with
+// AES-256-GCM
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// File keeps secrets in an encrypted file. It is read on first use and again when it changes.
+type File struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	values  map[string]string
+	modTime time.Time
+}
+
+// OpenFile opens the secrets file of opts with its key. The file is created by the first Set.
+func OpenFile(opts Options) (*File, error) {
+	if opts.File == "" {
+		return nil, errors.NewConfigError("HA_SECRETS_FILE is required for the file backend", nil)
+	}
+
+	encoded := opts.Key
+	if encoded == "" && opts.KeyFile != "" {
+		data, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			return nil, errors.NewConfigError("failed to read secrets key file", err)
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, errors.NewConfigError("HA_SECRETS_KEY or HA_SECRETS_KEY_FILE is required for the file backend", nil)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != KeySize {
+		return nil, errors.NewConfigError("the secrets key must be 32 bytes in base64", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.NewConfigError("invalid secrets key", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to create cipher", err)
+	}
+	return &File{path: opts.File, aead: aead}, nil
+}
+
+// GenerateKey returns a new random key for a secrets file, in base64
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.NewSystemError("failed to generate key", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Get returns the named secret
+func (f *File) Get(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.loadLocked(); err != nil {
+		return "", err
+	}
+	value, ok := f.values[name]
+	if !ok {
+		return "", notFound(name)
+	}
+	return value, nil
+}
+
+// Names lists the secrets in the file
+func (f *File) Names() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.loadLocked(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(f.values))
+	for name := range f.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Set adds or replaces a secret and rewrites the file
+func (f *File) Set(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return errors.NewValidationError("secret names can't be empty or contain spaces", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.loadLocked(); err != nil {
+		return err
+	}
+	f.values[name] = value
+	return f.saveLocked()
+}
+
+// Delete removes a secret and rewrites the file
+func (f *File) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.loadLocked(); err != nil {
+		return err
+	}
+	if _, ok := f.values[name]; !ok {
+		return notFound(name)
+	}
+	delete(f.values, name)
+	return f.saveLocked()
+}
+
+// loadLocked decrypts the file unless it is unchanged since it was last read. A missing file
+// holds no secrets.
+func (f *File) loadLocked() error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		f.values, f.modTime = make(map[string]string), time.Time{}
+		return nil
+	}
+	if err != nil {
+		return errors.NewConfigError("failed to read secrets file", err)
+	}
+	if f.values != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return errors.NewConfigError("failed to read secrets file", err)
+	}
+	var file encryptedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return errors.NewConfigError("failed to parse secrets file", err)
+	}
+	if file.Version != fileVersion {
+		return errors.NewConfigError("unsupported secrets file version", nil)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(file.Nonce)
+	if err != nil || len(nonce) != f.aead.NonceSize() {
+		return errors.NewConfigError("invalid secrets file nonce", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(file.Ciphertext)
+	if err != nil {
+		return errors.NewConfigError("invalid secrets file ciphertext", err)
+	}
+
+	plaintext, err := f.aead.Open(nil, nonce, ciphertext, []byte(fileAAD))
+	if err != nil {
+		return errors.NewConfigError("failed to decrypt secrets file, is it the right key?", nil)
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return errors.NewConfigError("failed to parse decrypted secrets", err)
+	}
+	f.values, f.modTime = values, info.ModTime()
+	return nil
+}
+
+func (f *File) saveLocked() error {
+	plaintext, err := json.Marshal(f.values)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal secrets", err)
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.NewSystemError("failed to generate nonce", err)
+	}
+	data, err := json.MarshalIndent(encryptedFile{
+		Version:    fileVersion,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(f.aead.Seal(nil, nonce, plaintext, []byte(fileAAD))),
+	}, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal secrets file", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return errors.NewSystemError("failed to create secrets directory", err)
+	}
+	tmpPath := f.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.NewSystemError("failed to write secrets file", err)
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return errors.NewSystemError("failed to replace secrets file", err)
+	}
+
+	if info, err := os.Stat(f.path); err == nil {
+		f.modTime = info.ModTime()
+	}
+	return nil
+}
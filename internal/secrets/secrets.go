@@ -0,0 +1,154 @@
+// Package secrets resolves device and broker credentials from an encrypted file or HashiCorp
+// Vault, so configuration files and the environment only hold references such as
+// "secret:tplink_password" instead of the passwords themselves.
+package secrets
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/redact"
+)
+
+// Prefix marks a configuration value as a reference to a secret, e.g. secret:mqtt_password
+const Prefix = "secret:"
+
+// Backends of HA_SECRETS_BACKEND
+const (
+	BackendFile  = "file"
+	BackendVault = "vault"
+)
+
+// Provider looks up secrets by name
+type Provider interface {
+	Get(name string) (string, error)
+}
+
+// Map is a Provider of fixed secrets, for tests and tools
+type Map map[string]string
+
+// Get returns the named secret
+func (m Map) Get(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", notFound(name)
+	}
+	return value, nil
+}
+
+// Options select and locate the secrets backend
+type Options struct {
+	Backend        string // file, vault, or empty when references aren't used
+	File           string // Encrypted secrets file
+	Key            string // Base64 key of the file, or read from KeyFile
+	KeyFile        string
+	VaultAddr      string // e.g. https://vault.lan:8200
+	VaultToken     string // Or read from VaultTokenFile, e.g. the sink of a Vault agent
+	VaultTokenFile string
+	VaultPath      string // KV path holding the secrets, e.g. secret/data/home-automation
+}
+
+// OptionsFromEnv reads the options from HA_SECRETS_* and the usual VAULT_ADDR and VAULT_TOKEN
+func OptionsFromEnv() Options {
+	return Options{
+		Backend:        os.Getenv("HA_SECRETS_BACKEND"),
+		File:           os.Getenv("HA_SECRETS_FILE"),
+		Key:            os.Getenv("HA_SECRETS_KEY"),
+		KeyFile:        os.Getenv("HA_SECRETS_KEY_FILE"),
+		VaultAddr:      os.Getenv("VAULT_ADDR"),
+		VaultToken:     os.Getenv("VAULT_TOKEN"),
+		VaultTokenFile: os.Getenv("HA_VAULT_TOKEN_FILE"),
+		VaultPath:      os.Getenv("HA_VAULT_PATH"),
+	}
+}
+
+// New creates the provider of the selected backend
+func New(opts Options) (Provider, error) {
+	switch opts.Backend {
+	case BackendFile:
+		return OpenFile(opts)
+	case BackendVault:
+		return NewVault(opts)
+	case "":
+		return nil, errors.NewConfigError("no secrets backend configured, set HA_SECRETS_BACKEND", nil)
+	default:
+		return nil, errors.NewConfigError("unknown secrets backend "+opts.Backend+", use file or vault", nil)
+	}
+}
+
+var (
+	defaultMu       sync.Mutex
+	defaultProvider Provider
+	defaultErr      error
+	defaultLoaded   bool
+)
+
+// Default returns the provider configured by the environment, created on first use
+func Default() (Provider, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if !defaultLoaded {
+		defaultProvider, defaultErr = New(OptionsFromEnv())
+		defaultLoaded = true
+	}
+	return defaultProvider, defaultErr
+}
+
+// SetDefault replaces the provider references are resolved with; nil goes back to the environment
+func SetDefault(provider Provider) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultProvider, defaultErr, defaultLoaded = provider, nil, provider != nil
+}
+
+// IsReference reports whether a configuration value names a secret instead of holding one
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// Resolve returns the secret a value references with the default provider, or the value itself
+// when it isn't a reference
+func Resolve(value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	provider, err := Default()
+	if err != nil {
+		return "", err
+	}
+	return provider.Get(strings.TrimPrefix(value, Prefix))
+}
+
+// Value is a resolved secret. It prints and marshals as REDACTED, so a struct holding it can be
+// logged or served without leaking it; Reveal returns it where it is used.
+type Value string
+
+// Reveal returns the secret
+func (v Value) Reveal() string {
+	return string(v)
+}
+
+// String redacts the secret; an empty one stays empty so a missing credential still shows
+func (v Value) String() string {
+	if v == "" {
+		return ""
+	}
+	return redact.Redacted
+}
+
+// GoString redacts the secret from %#v
+func (v Value) GoString() string {
+	return `"` + v.String() + `"`
+}
+
+// MarshalJSON redacts the secret
+func (v Value) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func notFound(name string) error {
+	return errors.NewConfigError("secret "+name+" not found", nil)
+}
@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Backend: BackendFile, File: filepath.Join(t.TempDir(), "secrets.enc"), Key: key}
+
+	store, err := OpenFile(opts)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if err := store.Set("tplink_password", "hunter2"); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+	store.Set("mqtt_password", "broker-pass")
+
+	data, _ := os.ReadFile(opts.File)
+	if strings.Contains(string(data), "hunter2") {
+		t.Fatal("expected the file to be encrypted")
+	}
+
+	provider, err := New(opts)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	if value, err := provider.Get("tplink_password"); err != nil || value != "hunter2" {
+		t.Errorf("expected the stored secret, got %q %v", value, err)
+	}
+	if _, err := provider.Get("unknown"); err == nil {
+		t.Error("expected an unknown secret to fail")
+	}
+
+	// Changes by another process are read again
+	store.Delete("mqtt_password")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(opts.File, later, later)
+	if names, _ := provider.(*File).Names(); len(names) != 1 || names[0] != "tplink_password" {
+		t.Errorf("expected the deletion to be seen, got %v", names)
+	}
+
+	other, _ := GenerateKey()
+	opts.Key = other
+	wrong, _ := OpenFile(opts)
+	if _, err := wrong.Get("tplink_password"); err == nil {
+		t.Error("expected the wrong key to fail")
+	}
+}
+
+func TestVaultKV2(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/secret/data/home" || r.Header.Get("X-Vault-Token") != "root-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"data": {"tplink_password": "from-vault"}, "metadata": {"version": 3}}}`)
+	}))
+	defer server.Close()
+
+	vault, err := NewVault(Options{VaultAddr: server.URL + "/", VaultPath: "/secret/data/home", VaultToken: "root-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	vault.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if value, err := vault.Get("tplink_password"); err != nil || value != "from-vault" {
+			t.Fatalf("expected the Vault secret, got %q %v", value, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the secrets to be cached, got %d requests", requests)
+	}
+
+	// An old copy is kept when Vault is down
+	server.Close()
+	now = now.Add(vaultCacheTTL + time.Second)
+	if value, err := vault.Get("tplink_password"); err != nil || value != "from-vault" {
+		t.Errorf("expected the cached secret while Vault is down, got %q %v", value, err)
+	}
+
+	denied, _ := NewVault(Options{VaultAddr: server.URL, VaultPath: "secret/data/home", VaultToken: "wrong"})
+	if _, err := denied.Get("tplink_password"); err == nil {
+		t.Error("expected an unreachable Vault without a cached copy to fail")
+	}
+}
+
+func TestResolveAndRedact(t *testing.T) {
+	SetDefault(Map{"mqtt_password": "broker-pass"})
+	defer SetDefault(nil)
+
+	if value, err := Resolve("secret:mqtt_password"); err != nil || value != "broker-pass" {
+		t.Errorf("expected the reference to resolve, got %q %v", value, err)
+	}
+	if value, _ := Resolve("plain"); value != "plain" {
+		t.Errorf("expected a plain value to pass through, got %q", value)
+	}
+	if _, err := Resolve("secret:missing"); err == nil {
+		t.Error("expected a missing secret to fail")
+	}
+
+	device := struct {
+		Username string
+		Password Value
+	}{"user", Value("hunter2")}
+	data, _ := json.Marshal(device)
+	for _, text := range []string{fmt.Sprintf("%v %+v %#v %s", device, device, device, device.Password), string(data)} {
+		if strings.Contains(text, "hunter2") {
+			t.Errorf("expected the password to be redacted from %s", text)
+		}
+	}
+	if device.Password.Reveal() != "hunter2" {
+		t.Error("expected Reveal to return the secret")
+	}
+}
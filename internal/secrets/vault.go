@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// vaultCacheTTL is how long secrets read from Vault are reused before they are read again
+const vaultCacheTTL = 5 * time.Minute
+
+// Vault reads secrets from one path of a HashiCorp Vault KV secrets engine, version 1 or 2. The
+// secret names are the keys of the data at that path.
+type Vault struct {
+	addr      string
+	path      string
+	token     string
+	tokenFile string
+	client    *http.Client
+
+	mu      sync.Mutex
+	values  map[string]string
+	fetched time.Time
+	now     func() time.Time
+}
+
+// NewVault creates a provider for the Vault of opts
+func NewVault(opts Options) (*Vault, error) {
+	if opts.VaultAddr == "" || opts.VaultPath == "" {
+		return nil, errors.NewConfigError("VAULT_ADDR and HA_VAULT_PATH are required for the vault backend", nil)
+	}
+	if opts.VaultToken == "" && opts.VaultTokenFile == "" {
+		return nil, errors.NewConfigError("VAULT_TOKEN or HA_VAULT_TOKEN_FILE is required for the vault backend", nil)
+	}
+	return &Vault{
+		addr:      strings.TrimRight(opts.VaultAddr, "/"),
+		path:      strings.Trim(opts.VaultPath, "/"),
+		token:     opts.VaultToken,
+		tokenFile: opts.VaultTokenFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+	}, nil
+}
+
+// Get returns the named secret, reading the path again when the cached copy is old. When Vault
+// can't be reached a cached copy is used however old it is.
+func (v *Vault) Get(name string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.values == nil || v.now().Sub(v.fetched) > vaultCacheTTL {
+		values, err := v.fetch()
+		switch {
+		case err == nil:
+			v.values, v.fetched = values, v.now()
+		case v.values == nil:
+			return "", err
+		}
+	}
+
+	value, ok := v.values[name]
+	if !ok {
+		return "", notFound(name)
+	}
+	return value, nil
+}
+
+func (v *Vault) fetch() (map[string]string, error) {
+	token := v.token
+	if v.tokenFile != "" {
+		data, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return nil, errors.NewConfigError("failed to read Vault token file", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, errors.NewConfigError("invalid VAULT_ADDR", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errors.NewConnectionError("failed to reach Vault", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.NewServiceError(fmt.Sprintf("Vault returned %s for %s", resp.Status, v.path), nil)
+	}
+
+	// KV version 2 nests the secret in data.data next to data.metadata
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, errors.NewServiceError("failed to parse Vault response", err)
+	}
+	data := body.Data
+	if nested, ok := data["data"]; ok && data["metadata"] != nil {
+		data = nil
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return nil, errors.NewServiceError("failed to parse Vault secret", err)
+		}
+	}
+
+	values := make(map[string]string, len(data))
+	for key, raw := range data {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, errors.NewServiceError("Vault secret "+key+" is not a string", err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
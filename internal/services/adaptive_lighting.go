@@ -0,0 +1,282 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/solar"
+)
+
+// LightSetting is a brightness (%) and color temperature (K) for lights
+type LightSetting struct {
+	Brightness float64 `json:"brightness"`
+	ColorTemp  float64 `json:"color_temp"`
+}
+
+// AdaptiveLightingConfig sets the light motion-activated lights come on with through the day. Day
+// lasts from sunrise to sunset at the location, or from DayStart to DayEnd without one, evening
+// until NightStart, and night until the next day starts. Each phase fades in from the one before
+// over TransitionMinutes.
+type AdaptiveLightingConfig struct {
+	Latitude          float64       `json:"latitude,omitempty"`
+	Longitude         float64       `json:"longitude,omitempty"`
+	DayStart          string        `json:"day_start,omitempty"`   // HH:MM, default 07:00
+	DayEnd            string        `json:"day_end,omitempty"`     // HH:MM, default 19:00
+	NightStart        string        `json:"night_start,omitempty"` // HH:MM, default 22:00
+	TransitionMinutes int           `json:"transition_minutes,omitempty"`
+	Day               *LightSetting `json:"day,omitempty"`
+	Evening           *LightSetting `json:"evening,omitempty"`
+	Night             *LightSetting `json:"night,omitempty"`
+	// MinBrightness is the floor of the brightness once ambient light is taken off it, default 5
+	MinBrightness float64 `json:"min_brightness,omitempty"`
+}
+
+// Default adaptive lighting: full cool light by day, warm in the evening, dim and warm at night
+var (
+	DefaultDayLight     = LightSetting{Brightness: 100, ColorTemp: 5000}
+	DefaultEveningLight = LightSetting{Brightness: 80, ColorTemp: 2700}
+	DefaultNightLight   = LightSetting{Brightness: 20, ColorTemp: 2200}
+)
+
+// LoadAdaptiveLightingConfig reads the adaptive lighting configuration from a JSON file
+func LoadAdaptiveLightingConfig(path string) (*AdaptiveLightingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read adaptive lighting file", err)
+	}
+
+	var cfg AdaptiveLightingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse adaptive lighting file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the location, times and settings, filling in the defaults
+func (c *AdaptiveLightingConfig) Validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return errors.NewValidationError(fmt.Sprintf("invalid location %.4f, %.4f", c.Latitude, c.Longitude), nil)
+	}
+	for _, clock := range []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"day_start", &c.DayStart, "07:00"},
+		{"day_end", &c.DayEnd, "19:00"},
+		{"night_start", &c.NightStart, "22:00"},
+	} {
+		if *clock.value == "" {
+			*clock.value = clock.def
+		}
+		if _, err := time.Parse("15:04", *clock.value); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("invalid %s %q, use HH:MM", clock.name, *clock.value), err)
+		}
+	}
+	if clockMinutes(c.DayEnd) <= clockMinutes(c.DayStart) {
+		return errors.NewValidationError(fmt.Sprintf("day_end %s must be after day_start %s", c.DayEnd, c.DayStart), nil)
+	}
+	if c.TransitionMinutes < 0 {
+		return errors.NewValidationError("transition_minutes can't be negative", nil)
+	}
+	if c.TransitionMinutes == 0 {
+		c.TransitionMinutes = 30
+	}
+	if c.MinBrightness < 0 || c.MinBrightness > 100 {
+		return errors.NewValidationError(fmt.Sprintf("min_brightness %.0f must be from 0 to 100", c.MinBrightness), nil)
+	}
+	if c.MinBrightness == 0 {
+		c.MinBrightness = 5
+	}
+
+	for _, phase := range []struct {
+		name    string
+		setting **LightSetting
+		def     LightSetting
+	}{
+		{"day", &c.Day, DefaultDayLight},
+		{"evening", &c.Evening, DefaultEveningLight},
+		{"night", &c.Night, DefaultNightLight},
+	} {
+		if *phase.setting == nil {
+			def := phase.def
+			*phase.setting = &def
+		}
+		setting := *phase.setting
+		if setting.Brightness < 1 || setting.Brightness > 100 {
+			return errors.NewValidationError(fmt.Sprintf("%s brightness %.0f must be from 1 to 100", phase.name, setting.Brightness), nil)
+		}
+		if setting.ColorTemp < 1500 || setting.ColorTemp > 9000 {
+			return errors.NewValidationError(fmt.Sprintf("%s color_temp %.0fK must be from 1500 to 9000", phase.name, setting.ColorTemp), nil)
+		}
+	}
+	return nil
+}
+
+// hasLocation reports whether the day follows the sun rather than clock times
+func (c *AdaptiveLightingConfig) hasLocation() bool {
+	return c.Latitude != 0 || c.Longitude != 0
+}
+
+// clockMinutes returns the minutes after midnight of a validated HH:MM time
+func clockMinutes(clock string) int {
+	parsed, _ := time.Parse("15:04", clock)
+	return parsed.Hour()*60 + parsed.Minute()
+}
+
+// AdaptiveLighting picks the brightness and color temperature of lights from the time of day and
+// the ambient light of the room
+type AdaptiveLighting struct {
+	config *AdaptiveLightingConfig
+}
+
+// NewAdaptiveLighting creates adaptive lighting from a validated configuration
+func NewAdaptiveLighting(cfg *AdaptiveLightingConfig) *AdaptiveLighting {
+	return &AdaptiveLighting{config: cfg}
+}
+
+// Phase returns the phase of the day at now, day, evening or night
+func (a *AdaptiveLighting) Phase(now time.Time) string {
+	phase, _, _ := a.phase(now)
+	return phase
+}
+
+// phase returns the phase of the day at now, when it started and the phase before it
+func (a *AdaptiveLighting) phase(now time.Time) (string, time.Time, string) {
+	dayStart, dayEnd := a.day(now)
+	nightStart := atClock(now, clockMinutes(a.config.NightStart))
+	// A night starting before sunset, as in high summer, leaves no evening
+	beforeNight := "evening"
+	if !nightStart.After(dayEnd) {
+		nightStart, beforeNight = dayEnd, "day"
+	}
+
+	switch {
+	case now.Before(dayStart):
+		// Still last night; it started about a day before tonight's start
+		return "night", nightStart.AddDate(0, 0, -1), beforeNight
+	case now.Before(dayEnd):
+		return "day", dayStart, "night"
+	case now.Before(nightStart):
+		return "evening", dayEnd, "day"
+	default:
+		return "night", nightStart, beforeNight
+	}
+}
+
+// day returns when the day starts and ends on the calendar day of now
+func (a *AdaptiveLighting) day(now time.Time) (time.Time, time.Time) {
+	if a.config.hasLocation() {
+		if sunrise, sunset, ok := solar.Times(now, a.config.Latitude, a.config.Longitude); ok {
+			return sunrise, sunset
+		}
+	}
+	return atClock(now, clockMinutes(a.config.DayStart)), atClock(now, clockMinutes(a.config.DayEnd))
+}
+
+func atClock(day time.Time, minutes int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, day.Location())
+}
+
+func (a *AdaptiveLighting) setting(phase string) LightSetting {
+	switch phase {
+	case "day":
+		return *a.config.Day
+	case "evening":
+		return *a.config.Evening
+	default:
+		return *a.config.Night
+	}
+}
+
+// Setting returns the light for now in a room whose light sensor reads ambient (%). Daylight
+// already in the room is taken off the brightness, down to the minimum brightness.
+func (a *AdaptiveLighting) Setting(now time.Time, ambient float64) LightSetting {
+	phase, start, previous := a.phase(now)
+	target, from := a.setting(phase), a.setting(previous)
+
+	// Fade from the previous phase over the transition
+	progress := 1.0
+	if transition := time.Duration(a.config.TransitionMinutes) * time.Minute; now.Sub(start) < transition {
+		progress = float64(now.Sub(start)) / float64(transition)
+	}
+	setting := LightSetting{
+		Brightness: from.Brightness + (target.Brightness-from.Brightness)*progress,
+		ColorTemp:  from.ColorTemp + (target.ColorTemp-from.ColorTemp)*progress,
+	}
+
+	// A phase dimmer than the minimum keeps its own brightness
+	floor := math.Min(a.config.MinBrightness, setting.Brightness)
+	if ambient > 0 {
+		setting.Brightness -= ambient
+	}
+	setting.Brightness = math.Round(math.Max(floor, math.Min(100, setting.Brightness)))
+	setting.ColorTemp = math.Round(setting.ColorTemp/10) * 10
+	return setting
+}
+
+// SetAdaptiveLighting sets the brightness and color temperature of the lights motion turns on by
+// the time of day and the room's ambient light; nil leaves lights as they come on
+func (as *AutomationService) SetAdaptiveLighting(adaptive *AdaptiveLighting) {
+	as.adaptive = adaptive
+}
+
+// adaptiveCommands returns the commands adapting a light just turned on in a room, leaving out
+// what the light can't do, such as color temperature on a dimmer
+func (as *AutomationService) adaptiveCommands(roomID, deviceID string) []models.DeviceCommand {
+	if as.adaptive == nil {
+		return nil
+	}
+
+	// A room without a light sensor has no daylight to take off
+	ambient, state := as.getCurrentLightLevel(roomID)
+	if state == "unknown" {
+		ambient = 0
+	}
+	setting := as.adaptive.Setting(time.Now(), ambient)
+
+	options := map[string]interface{}{
+		"automation": "adaptive-lighting",
+		"phase":      as.adaptive.Phase(time.Now()),
+	}
+	var commands []models.DeviceCommand
+	if as.deviceService.Supports(deviceID, "set_brightness") {
+		commands = append(commands, models.DeviceCommand{DeviceID: deviceID, Action: "set_brightness", Value: setting.Brightness, Options: options})
+	}
+	if as.deviceService.Supports(deviceID, "set_color_temp") {
+		commands = append(commands, models.DeviceCommand{DeviceID: deviceID, Action: "set_color_temp", Value: setting.ColorTemp, Options: options})
+	}
+	return commands
+}
+
+// adaptLight sets the brightness and color temperature of a light motion just turned on
+func (as *AutomationService) adaptLight(roomID, deviceID string) {
+	for _, command := range as.adaptiveCommands(roomID, deviceID) {
+		if err := as.deviceService.ExecuteCommand(&command); err != nil {
+			as.logger.Printf("AutomationService: Failed to adapt %s in room %s: %v", deviceID, roomID, err)
+			continue
+		}
+		as.logger.Printf("AutomationService: Adaptive lighting %s of %s set to %.0f", command.Action, deviceID, command.Value)
+	}
+}
+
+// adaptiveStatus describes the light motion turns lights on with now, before ambient light
+func (as *AutomationService) adaptiveStatus() map[string]interface{} {
+	if as.adaptive == nil {
+		return nil
+	}
+	now := time.Now()
+	return map[string]interface{}{
+		"phase":   as.adaptive.Phase(now),
+		"setting": as.adaptive.Setting(now, 0),
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func TestAdaptiveLightingSetting(t *testing.T) {
+	cfg := &AdaptiveLightingConfig{NightStart: "22:00", TransitionMinutes: 60}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	adaptive := NewAdaptiveLighting(cfg)
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, 15, parsed.Hour(), parsed.Minute(), 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		clock   string
+		ambient float64
+		phase   string
+		want    LightSetting
+	}{
+		{"12:00", 0, "day", DefaultDayLight},
+		{"12:00", 30, "day", LightSetting{Brightness: 70, ColorTemp: 5000}},
+		{"19:30", 0, "evening", LightSetting{Brightness: 90, ColorTemp: 3850}}, // Half way from day
+		{"21:00", 0, "evening", DefaultEveningLight},
+		{"23:30", 0, "night", DefaultNightLight},
+		{"23:30", 10, "night", LightSetting{Brightness: 10, ColorTemp: 2200}},
+		{"03:00", 0, "night", DefaultNightLight},
+		{"07:15", 0, "day", LightSetting{Brightness: 40, ColorTemp: 2900}},
+	}
+	for _, tc := range cases {
+		if phase := adaptive.Phase(at(tc.clock)); phase != tc.phase {
+			t.Errorf("%s: expected %s, got %s", tc.clock, tc.phase, phase)
+		}
+		if got := adaptive.Setting(at(tc.clock), tc.ambient); got != tc.want {
+			t.Errorf("%s with %.0f%% ambient: expected %+v, got %+v", tc.clock, tc.ambient, tc.want, got)
+		}
+	}
+
+	// Ambient light never takes the brightness below the minimum, nor a dimmer phase below its own
+	if got := adaptive.Setting(at("21:00"), 90); got.Brightness != 5 {
+		t.Errorf("Expected the minimum brightness, got %+v", got)
+	}
+	cfg.Night.Brightness = 2
+	if got := adaptive.Setting(at("23:30"), 50); got.Brightness != 2 {
+		t.Errorf("Expected the night's own brightness, got %+v", got)
+	}
+
+	invalid := &AdaptiveLightingConfig{Night: &LightSetting{Brightness: 10, ColorTemp: 900}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected a color temperature out of range to be rejected")
+	}
+}
+
+func TestAdaptiveLightingCommands(t *testing.T) {
+	as, devices := newAutoOffTestService(t)
+	devices.AddDevice(&models.Device{
+		ID:           "light-bedroom",
+		Type:         models.DeviceTypeLight,
+		Status:       "off",
+		Capabilities: []string{"switch", "dimmer"},
+		Properties:   map[string]interface{}{"power": false},
+	})
+
+	if commands := as.adaptiveCommands("bedroom", "light-bedroom"); len(commands) != 0 {
+		t.Errorf("Expected no commands without adaptive lighting, got %+v", commands)
+	}
+
+	cfg := &AdaptiveLightingConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	as.SetAdaptiveLighting(NewAdaptiveLighting(cfg))
+
+	// A dimmer gets a brightness but no color temperature
+	commands := as.adaptiveCommands("bedroom", "light-bedroom")
+	if len(commands) != 1 || commands[0].Action != "set_brightness" {
+		t.Fatalf("Expected only a brightness for a dimmer, got %+v", commands)
+	}
+	as.adaptLight("bedroom", "light-bedroom")
+	device, _ := devices.GetDevice("light-bedroom")
+	if device.Properties["brightness"] != commands[0].Value {
+		t.Errorf("Expected the brightness set to %v, got %v", commands[0].Value, device.Properties["brightness"])
+	}
+
+	// Lights reporting no capabilities get both
+	if commands := as.adaptiveCommands("kitchen", "light-kitchen"); len(commands) != 2 {
+		t.Errorf("Expected brightness and color temperature, got %+v", commands)
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+)
+
+const (
+	defaultAnomalyAlpha        = 0.05
+	defaultAnomalyWarmup       = 30
+	defaultAnomalyMinDeviation = 0.5
+
+	// Kinds of anomaly, in the order they are checked
+	AnomalyStuck   = "stuck"   // The reading hasn't changed at all for StuckMinutes
+	AnomalyJump    = "jump"    // The reading is MaxJump or more from its recent average
+	AnomalyUnusual = "unusual" // The reading is ZScore standard deviations from its recent average
+)
+
+// AnomalyDetection fires a rule on readings unusual for the room or device instead of on a fixed
+// threshold. Each subject's readings are followed with an exponentially weighted moving average
+// (EWMA) and variance, learned afresh after a restart.
+type AnomalyDetection struct {
+	// StuckMinutes flags a sensor that keeps reporting exactly the same value, a frozen sensor
+	StuckMinutes int `json:"stuck_minutes,omitempty"`
+	// MaxJump flags a reading this far from the average, in the metric's unit: a physically
+	// impossible change such as a loose probe
+	MaxJump float64 `json:"max_jump,omitempty"`
+	// ZScore flags a reading this many standard deviations from the average, such as unusual power
+	ZScore float64 `json:"z_score,omitempty"`
+	// Alpha is the weight of each new reading in the average, 0.05 by default
+	Alpha float64 `json:"alpha,omitempty"`
+	// WarmupSamples are learned before z-scores count, 30 by default
+	WarmupSamples int `json:"warmup_samples,omitempty"`
+	// MinDeviation floors the standard deviation of steady readings, 0.5 by default
+	MinDeviation float64 `json:"min_deviation,omitempty"`
+}
+
+// validate checks the detection of a rule, filling in the defaults
+func (d *AnomalyDetection) validate(ruleID string) error {
+	if d.StuckMinutes < 0 || d.MaxJump < 0 || d.ZScore < 0 || d.WarmupSamples < 0 || d.MinDeviation < 0 {
+		return errors.NewValidationError(fmt.Sprintf("alert rule %s: anomaly settings must not be negative", ruleID), nil)
+	}
+	if d.StuckMinutes == 0 && d.MaxJump == 0 && d.ZScore == 0 {
+		return errors.NewValidationError(fmt.Sprintf("alert rule %s: anomaly detection needs stuck_minutes, max_jump or z_score", ruleID), nil)
+	}
+	if d.Alpha < 0 || d.Alpha > 1 {
+		return errors.NewValidationError(fmt.Sprintf("alert rule %s: alpha must be from 0 to 1", ruleID), nil)
+	}
+	if d.Alpha == 0 {
+		d.Alpha = defaultAnomalyAlpha
+	}
+	if d.WarmupSamples == 0 {
+		d.WarmupSamples = defaultAnomalyWarmup
+	}
+	if d.MinDeviation == 0 {
+		d.MinDeviation = defaultAnomalyMinDeviation
+	}
+	return nil
+}
+
+// anomalyFinding is what is unusual about a reading
+type anomalyFinding struct {
+	kind      string
+	average   float64
+	deviation float64   // Standard deviation, for unusual readings
+	since     time.Time // When a stuck reading last changed
+}
+
+// anomalyState follows the readings of one rule and subject
+type anomalyState struct {
+	mean      float64
+	variance  float64
+	samples   int
+	last      float64
+	lastAt    time.Time
+	changedAt time.Time
+	finding   *anomalyFinding // Of the latest reading
+}
+
+// detect checks a new reading against what was learned of the subject before it, then learns
+// it. A reading seen before, polled again, keeps its finding.
+func (s *AlertService) detect(rule *AlertRule, id string, sample alertSample) *anomalyFinding {
+	detection := rule.Anomaly
+	state, exists := s.anomalies[id]
+	if !exists {
+		s.anomalies[id] = &anomalyState{mean: sample.value, last: sample.value, lastAt: sample.at, changedAt: sample.at, samples: 1}
+		return nil
+	}
+	if !sample.at.After(state.lastAt) {
+		return state.finding
+	}
+
+	value := sample.value
+	distance := math.Abs(value - state.mean)
+	deviation := math.Max(math.Sqrt(state.variance), detection.MinDeviation)
+	var finding *anomalyFinding
+	switch {
+	case detection.StuckMinutes > 0 && value == state.last &&
+		sample.at.Sub(state.changedAt) >= time.Duration(detection.StuckMinutes)*time.Minute:
+		finding = &anomalyFinding{kind: AnomalyStuck, average: state.mean, since: state.changedAt}
+	case detection.MaxJump > 0 && distance >= detection.MaxJump:
+		finding = &anomalyFinding{kind: AnomalyJump, average: state.mean}
+	case detection.ZScore > 0 && state.samples >= detection.WarmupSamples && distance/deviation >= detection.ZScore:
+		finding = &anomalyFinding{kind: AnomalyUnusual, average: state.mean, deviation: deviation}
+	}
+
+	// Learn the reading, anomalous or not, so a lasting change becomes the new normal
+	if value != state.last {
+		state.changedAt = sample.at
+	}
+	difference := value - state.mean
+	state.mean += detection.Alpha * difference
+	state.variance = (1 - detection.Alpha) * (state.variance + detection.Alpha*difference*difference)
+	state.samples++
+	state.last, state.lastAt = value, sample.at
+	state.finding = finding
+	return finding
+}
+
+// anomalyMessage describes an anomaly in one line
+func anomalyMessage(rule *AlertRule, sample alertSample, now time.Time) i18n.Text {
+	finding, unit := sample.anomaly, alertUnit(rule.Metric)
+	metric := i18n.T("metric." + rule.Metric)
+	switch finding.kind {
+	case AnomalyStuck:
+		return i18n.T("alert.stuck", sample.subject, metric, sample.value, unit, now.Sub(finding.since).Round(time.Minute))
+	case AnomalyJump:
+		return i18n.T("alert.jump", sample.subject, metric, sample.value, unit, finding.average, unit)
+	default:
+		return i18n.T("alert.unusual", sample.subject, metric, sample.value, unit, finding.average, unit, finding.deviation, unit)
+	}
+}
+
+// anomalyKind is the kind of anomaly of a sample, empty for threshold rules
+func anomalyKind(sample alertSample) string {
+	if sample.anomaly == nil {
+		return ""
+	}
+	return sample.anomaly.kind
+}
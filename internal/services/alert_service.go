@@ -0,0 +1,775 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Metrics alert rules watch
+	AlertMetricTemperature = "temperature" // °F, rooms and devices
+	AlertMetricHumidity    = "humidity"    // %, rooms and devices
+	AlertMetricPower       = "power"       // W, devices
+	AlertMetricOffline     = "offline"     // Rooms and devices
+
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+
+	AlertStateFiring   = "firing"
+	AlertStateResolved = "resolved"
+
+	AlertsFileName = "alerts.json"
+
+	defaultAlertPoll       = 30 * time.Second
+	defaultAlertOfflineFor = 10 * time.Minute
+	alertHistorySize       = 100
+
+	// roomSensorStale is how long a room sensor may stay silent before it counts as offline;
+	// the sensor service itself only marks rooms offline after 10 minutes
+	roomSensorStale = 2 * time.Minute
+)
+
+// AlertRule raises an alert for every room or device whose metric stays above Above or below
+// Below for ForSeconds. Offline rules take no threshold; they fire once a room or device has been
+// silent for ForSeconds, 10 minutes by default. Rules with Anomaly fire on unusual readings
+// instead of a threshold.
+type AlertRule struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	Metric     string   `json:"metric"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	ForSeconds int      `json:"for_seconds,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"` // How far back past the threshold before resolving
+	Severity   string   `json:"severity"`
+	Subjects   []string `json:"subjects,omitempty"` // Rooms and devices watched, all when empty
+	Disabled   bool     `json:"disabled,omitempty"` // Not evaluated until enabled
+	Webhooks   []string `json:"webhooks,omitempty"` // Outbound webhooks called when it fires and resolves
+
+	Anomaly *AnomalyDetection `json:"anomaly,omitempty"`
+}
+
+// AlertConfig lists the alert rules. Firing alerts are notified again every RepeatMinutes until
+// they resolve; 0 notifies once.
+type AlertConfig struct {
+	PollSeconds   int         `json:"poll_seconds,omitempty"`
+	RepeatMinutes int         `json:"repeat_minutes,omitempty"`
+	Rules         []AlertRule `json:"rules"`
+}
+
+// LoadAlertConfig reads the alert rules from a JSON file
+func LoadAlertConfig(path string) (*AlertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read alerts file", err)
+	}
+
+	var cfg AlertConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse alerts file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that rule IDs are unique and every rule has a usable threshold
+func (c *AlertConfig) Validate() error {
+	if c.PollSeconds < 0 || c.RepeatMinutes < 0 {
+		return errors.NewValidationError("poll_seconds and repeat_minutes must not be negative", nil)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if rule.ID == "" {
+			return errors.NewValidationError("every alert rule needs an ID", nil)
+		}
+		if seen[rule.ID] {
+			return errors.NewValidationError(fmt.Sprintf("alert rule %s is defined twice", rule.ID), nil)
+		}
+		seen[rule.ID] = true
+
+		switch rule.Severity {
+		case AlertSeverityInfo, AlertSeverityWarning, AlertSeverityCritical:
+		default:
+			return errors.NewValidationError(fmt.Sprintf("alert rule %s has unknown severity %q", rule.ID, rule.Severity), nil)
+		}
+		if rule.ForSeconds < 0 || rule.Hysteresis < 0 {
+			return errors.NewValidationError(fmt.Sprintf("alert rule %s: for_seconds and hysteresis must not be negative", rule.ID), nil)
+		}
+
+		switch rule.Metric {
+		case AlertMetricTemperature, AlertMetricHumidity, AlertMetricPower:
+			if rule.Anomaly != nil {
+				if rule.Above != nil || rule.Below != nil {
+					return errors.NewValidationError(fmt.Sprintf("anomaly alert rule %s takes no threshold", rule.ID), nil)
+				}
+				if err := rule.Anomaly.validate(rule.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			if rule.Above == nil && rule.Below == nil {
+				return errors.NewValidationError(fmt.Sprintf("alert rule %s needs an above or below threshold", rule.ID), nil)
+			}
+			if rule.Above != nil && rule.Below != nil && *rule.Below >= *rule.Above {
+				return errors.NewValidationError(fmt.Sprintf("alert rule %s: below must be less than above", rule.ID), nil)
+			}
+		case AlertMetricOffline:
+			if rule.Above != nil || rule.Below != nil || rule.Anomaly != nil {
+				return errors.NewValidationError(fmt.Sprintf("offline alert rule %s takes no threshold or anomaly detection", rule.ID), nil)
+			}
+		default:
+			return errors.NewValidationError(fmt.Sprintf("alert rule %s has unknown metric %q", rule.ID, rule.Metric), nil)
+		}
+	}
+	return nil
+}
+
+// name is how the rule is shown in notifications
+func (r *AlertRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.ID
+}
+
+// holdFor is how long the condition must last before the alert fires
+func (r *AlertRule) holdFor() time.Duration {
+	if r.ForSeconds == 0 && r.Metric == AlertMetricOffline {
+		return defaultAlertOfflineFor
+	}
+	return time.Duration(r.ForSeconds) * time.Second
+}
+
+// watches reports whether the rule applies to a room or device
+func (r *AlertRule) watches(subject string) bool {
+	if len(r.Subjects) == 0 {
+		return true
+	}
+	for _, watched := range r.Subjects {
+		if watched == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// breached reports whether a sample is past the threshold. A firing alert only resolves once the
+// value is Hysteresis back inside, so a reading hovering at the threshold doesn't flap.
+func (r *AlertRule) breached(sample alertSample, firing bool) bool {
+	if r.Metric == AlertMetricOffline {
+		return sample.offline
+	}
+
+	margin := 0.0
+	if firing {
+		margin = r.Hysteresis
+	}
+	if r.Above != nil && sample.value > *r.Above-margin {
+		return true
+	}
+	return r.Below != nil && sample.value < *r.Below+margin
+}
+
+// threshold returns the threshold a value crossed, for notifications
+func (r *AlertRule) threshold(value float64) (string, float64) {
+	if r.Above != nil && (r.Below == nil || value > *r.Below) {
+		return "above", *r.Above
+	}
+	return "below", *r.Below
+}
+
+// Alert is a rule firing for one room or device. There is at most one active alert per rule and
+// subject; it is notified when it fires and again when it resolves.
+type Alert struct {
+	ID         string    `json:"id"` // rule:subject
+	RuleID     string    `json:"rule_id"`
+	Subject    string    `json:"subject"`
+	Metric     string    `json:"metric"`
+	Severity   string    `json:"severity"`
+	State      string    `json:"state"`
+	Value      float64   `json:"value"` // Latest value, or seconds offline
+	Anomaly    string    `json:"anomaly,omitempty"`
+	Message    string    `json:"message"`
+	FiredAt    time.Time `json:"fired_at"`
+	NotifiedAt time.Time `json:"notified_at"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty"`
+
+	text i18n.Localizable // Message, translatable
+}
+
+// describe sets the alert's message, kept in the global locale
+func (a *Alert) describe(text i18n.Localizable) {
+	a.text = text
+	a.Message = text.In(i18n.Locale())
+}
+
+// localized is the alert's message to translate; alerts restored from disk only have the stored one
+func (a *Alert) localized() i18n.Localizable {
+	if a.text != nil {
+		return a.text
+	}
+	return i18n.Raw(a.Message)
+}
+
+// alertSample is one room's or device's current value of a metric
+type alertSample struct {
+	subject string
+	value   float64
+	offline bool
+	since   time.Time // Last seen, for offline samples
+	at      time.Time // When the reading was taken, for anomaly detection
+	anomaly *anomalyFinding
+}
+
+// RoomSensorReader lists the latest readings of every room
+type RoomSensorReader interface {
+	GetAllRoomSensors() map[string]*RoomSensorData
+}
+
+// DeviceStatusReader lists the state of the Tasmota and ESPHome devices
+type DeviceStatusReader interface {
+	Devices() []MQTTDeviceStatus
+}
+
+// WebhookCaller calls outbound webhooks by ID; WebhookService implements it
+type WebhookCaller interface {
+	CallWebhook(id, source string, event map[string]interface{}) error
+}
+
+// AlertService evaluates the alert rules against the room sensors and devices, deduplicates the
+// alerts and notifies them when they fire and resolve
+type AlertService struct {
+	config  *AlertConfig
+	path    string
+	poll    time.Duration
+	repeat  time.Duration
+	rooms   RoomSensorReader
+	devices DeviceStatusReader
+	publish func(msg *mqtt.Message) error
+	pending map[string]time.Time // Since when each breach not yet fired has lasted
+	// What anomaly rules have learned of each subject, by alert ID
+	anomalies map[string]*anomalyState
+	active    map[string]*Alert
+	history   []Alert // Resolved alerts, oldest first
+	webhooks  WebhookCaller
+	logger    *logger.Logger
+	mu        sync.Mutex
+}
+
+// AlertsPath returns where the active alerts are kept under the state directory
+func AlertsPath(stateDir string) string {
+	return filepath.Join(stateDir, AlertsFileName)
+}
+
+// NewAlertService creates the alert evaluator; the active alerts at path are read on Start
+func NewAlertService(cfg *AlertConfig, path string, serviceLogger *logger.Logger) *AlertService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("AlertService", nil)
+	}
+
+	service := &AlertService{
+		config:    cfg,
+		path:      path,
+		poll:      defaultAlertPoll,
+		repeat:    time.Duration(cfg.RepeatMinutes) * time.Minute,
+		pending:   make(map[string]time.Time),
+		anomalies: make(map[string]*anomalyState),
+		active:    make(map[string]*Alert),
+		logger:    serviceLogger,
+	}
+	if cfg.PollSeconds > 0 {
+		service.poll = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	return service
+}
+
+// SetRoomSensors sets where room temperature, humidity and liveness are read
+func (s *AlertService) SetRoomSensors(rooms RoomSensorReader) {
+	s.rooms = rooms
+}
+
+// SetDevices sets where device power, readings and liveness are read
+func (s *AlertService) SetDevices(devices DeviceStatusReader) {
+	s.devices = devices
+}
+
+// SetMQTTClient attaches the client alerts are notified with
+func (s *AlertService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// SetWebhookCaller calls the outbound webhooks the rules list
+func (s *AlertService) SetWebhookCaller(webhooks WebhookCaller) {
+	s.webhooks = webhooks
+}
+
+// Start restores the alerts still active when the service stopped, so they aren't notified again
+func (s *AlertService) Start() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read active alerts", err)
+	}
+
+	var alerts []Alert
+	if err := json.Unmarshal(data, &alerts); err != nil {
+		s.logger.Warn("Corrupt active alerts, starting fresh", map[string]interface{}{"error": err.Error()})
+		return nil
+	}
+
+	rules := make(map[string]bool)
+	for _, rule := range s.config.Rules {
+		rules[rule.ID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range alerts {
+		// Alerts of rules removed since are dropped without a notification
+		if rules[alerts[i].RuleID] {
+			s.active[alerts[i].ID] = &alerts[i]
+		}
+	}
+	return nil
+}
+
+// Run evaluates the rules until the context is cancelled
+func (s *AlertService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.evaluate(time.Now())
+		}
+	}
+}
+
+// evaluate fires, repeats and resolves alerts against the current readings
+func (s *AlertService) evaluate(now time.Time) {
+	rooms, devices := s.readings()
+
+	var notify []Alert
+	s.mu.Lock()
+	changed := false
+	for i := range s.config.Rules {
+		rule := &s.config.Rules[i]
+		if rule.Disabled {
+			continue
+		}
+		for _, sample := range s.samples(rule, rooms, devices, now) {
+			if !rule.watches(sample.subject) {
+				continue
+			}
+
+			id := rule.ID + ":" + sample.subject
+			alert := s.active[id]
+			breached := rule.breached(sample, alert != nil)
+			if rule.Anomaly != nil {
+				sample.anomaly = s.detect(rule, id, sample)
+				breached = sample.anomaly != nil
+			}
+			if !breached {
+				delete(s.pending, id)
+				if alert != nil {
+					alert.State = AlertStateResolved
+					alert.ResolvedAt = now
+					alert.describe(resolvedMessage(rule, sample))
+					s.resolve(alert)
+					notify = append(notify, *alert)
+					changed = true
+				}
+				continue
+			}
+
+			if alert != nil {
+				alert.Value = sample.value
+				if s.repeat > 0 && now.Sub(alert.NotifiedAt) >= s.repeat {
+					alert.NotifiedAt = now
+					alert.describe(firingMessage(rule, sample, now))
+					notify = append(notify, *alert)
+					changed = true
+				}
+				continue
+			}
+
+			since := sample.since
+			if rule.Metric != AlertMetricOffline {
+				if _, ok := s.pending[id]; !ok {
+					s.pending[id] = now
+				}
+				since = s.pending[id]
+			}
+			if now.Sub(since) < rule.holdFor() {
+				continue
+			}
+
+			delete(s.pending, id)
+			alert = &Alert{
+				ID:         id,
+				RuleID:     rule.ID,
+				Subject:    sample.subject,
+				Metric:     rule.Metric,
+				Severity:   rule.Severity,
+				State:      AlertStateFiring,
+				Value:      sample.value,
+				Anomaly:    anomalyKind(sample),
+				FiredAt:    now,
+				NotifiedAt: now,
+			}
+			alert.describe(firingMessage(rule, sample, now))
+			s.active[id] = alert
+			notify = append(notify, *alert)
+			changed = true
+		}
+	}
+	s.mu.Unlock()
+
+	for _, alert := range notify {
+		s.notify(alert)
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// readings takes one snapshot of the rooms and devices for all rules
+func (s *AlertService) readings() (map[string]*RoomSensorData, []MQTTDeviceStatus) {
+	var rooms map[string]*RoomSensorData
+	var devices []MQTTDeviceStatus
+	if s.rooms != nil {
+		rooms = s.rooms.GetAllRoomSensors()
+	}
+	if s.devices != nil {
+		devices = s.devices.Devices()
+	}
+	return rooms, devices
+}
+
+// samples returns every room's and device's value of the rule's metric. Readings of offline rooms
+// and devices are stale and left out, so their alerts neither fire nor resolve until they return.
+func (s *AlertService) samples(rule *AlertRule, rooms map[string]*RoomSensorData, devices []MQTTDeviceStatus, now time.Time) []alertSample {
+	var samples []alertSample
+	for _, roomID := range sortedKeys(rooms) {
+		room := rooms[roomID]
+		offline := !room.IsOnline || now.Sub(room.LastSeen) > roomSensorStale
+		switch {
+		case rule.Metric == AlertMetricOffline:
+			samples = append(samples, alertSample{subject: roomID, value: now.Sub(room.LastSeen).Seconds(), offline: offline, since: room.LastSeen})
+		case offline:
+		case rule.Metric == AlertMetricTemperature && !room.TempLastUpdate.IsZero():
+			samples = append(samples, alertSample{subject: roomID, value: room.Temperature, at: room.TempLastUpdate})
+		case rule.Metric == AlertMetricHumidity && !room.TempLastUpdate.IsZero():
+			samples = append(samples, alertSample{subject: roomID, value: room.Humidity, at: room.TempLastUpdate})
+		}
+	}
+
+	for _, device := range devices {
+		var value *float64
+		switch rule.Metric {
+		case AlertMetricOffline:
+			samples = append(samples, alertSample{subject: device.DeviceID, value: now.Sub(device.LastSeen).Seconds(), offline: !device.Online, since: device.LastSeen})
+			continue
+		case AlertMetricTemperature:
+			value = device.Temperature
+		case AlertMetricHumidity:
+			value = device.Humidity
+		case AlertMetricPower:
+			value = device.PowerW
+		}
+		if device.Online && value != nil {
+			samples = append(samples, alertSample{subject: device.DeviceID, value: *value, at: device.LastSeen})
+		}
+	}
+	return samples
+}
+
+// resolve moves an alert from the active set to the history. Callers hold s.mu.
+func (s *AlertService) resolve(alert *Alert) {
+	delete(s.active, alert.ID)
+	s.history = append(s.history, *alert)
+	if len(s.history) > alertHistorySize {
+		s.history = s.history[len(s.history)-alertHistorySize:]
+	}
+	s.logger.Info("Alert resolved", map[string]interface{}{
+		"alert_id": alert.ID,
+		"message":  alert.Message,
+	})
+}
+
+// firingMessage describes what is wrong in one line
+func firingMessage(rule *AlertRule, sample alertSample, now time.Time) i18n.Text {
+	if rule.Metric == AlertMetricOffline {
+		return i18n.T("alert.offline", sample.subject, now.Sub(sample.since).Round(time.Minute))
+	}
+	if sample.anomaly != nil {
+		return anomalyMessage(rule, sample, now)
+	}
+	direction, threshold := rule.threshold(sample.value)
+	unit := alertUnit(rule.Metric)
+	return i18n.T("alert."+direction, sample.subject, i18n.T("metric."+rule.Metric), sample.value, unit, threshold, unit)
+}
+
+// resolvedMessage describes the recovery in one line
+func resolvedMessage(rule *AlertRule, sample alertSample) i18n.Text {
+	if rule.Metric == AlertMetricOffline {
+		return i18n.T("alert.online", sample.subject)
+	}
+	return i18n.T("alert.recovered", sample.subject, i18n.T("metric."+rule.Metric), sample.value, alertUnit(rule.Metric))
+}
+
+func alertUnit(metric string) string {
+	switch metric {
+	case AlertMetricTemperature:
+		return "°F"
+	case AlertMetricHumidity:
+		return "%"
+	case AlertMetricPower:
+		return " W"
+	}
+	return ""
+}
+
+// notify publishes an alert on the notification topic
+func (s *AlertService) notify(alert Alert) {
+	rule := s.rule(alert.RuleID)
+	title := i18n.T("alert.firing.title", i18n.T("severity."+alert.Severity), rule.name())
+	if alert.State == AlertStateResolved {
+		title = i18n.T("alert.resolved.title", rule.name())
+	} else {
+		s.logger.Warn("Alert firing", map[string]interface{}{
+			"alert_id": alert.ID,
+			"severity": alert.Severity,
+			"message":  alert.Message,
+		})
+	}
+	s.callWebhooks(rule, alert)
+	if s.publish == nil {
+		return
+	}
+
+	timestamp := alert.NotifiedAt
+	if alert.State == AlertStateResolved {
+		timestamp = alert.ResolvedAt
+	}
+	notification, err := localizedNotification(map[string]interface{}{
+		"source":    "alerts",
+		"severity":  alert.Severity,
+		"state":     alert.State,
+		"alert_id":  alert.ID,
+		"rule_id":   alert.RuleID,
+		"subject":   alert.Subject,
+		"anomaly":   alert.Anomaly,
+		"timestamp": timestamp.Unix(),
+	}, title, alert.localized())
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1}); err != nil {
+		s.logger.Error("Failed to publish alert notification", err, map[string]interface{}{"alert_id": alert.ID})
+	}
+}
+
+// callWebhooks calls the outbound webhooks of an alert's rule in the background. Their templates
+// see the alert as alert, e.g. {{.alert.subject}}; failures are logged by the webhook service.
+func (s *AlertService) callWebhooks(rule *AlertRule, alert Alert) {
+	if s.webhooks == nil || len(rule.Webhooks) == 0 {
+		return
+	}
+
+	var fields map[string]interface{}
+	data, err := json.Marshal(alert)
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err != nil {
+		s.logger.Error("Failed to encode alert for webhooks", err, map[string]interface{}{"alert_id": alert.ID})
+		return
+	}
+	event := map[string]interface{}{"event": "alert", "alert": fields}
+	for _, id := range rule.Webhooks {
+		go s.webhooks.CallWebhook(id, "alert:"+alert.ID, event)
+	}
+}
+
+func (s *AlertService) rule(id string) *AlertRule {
+	for i := range s.config.Rules {
+		if s.config.Rules[i].ID == id {
+			return &s.config.Rules[i]
+		}
+	}
+	return &AlertRule{ID: id}
+}
+
+// EnableRule turns a rule on or off until the service restarts. The alerts of a rule turned off
+// are dropped without a notification.
+func (s *AlertService) EnableRule(id string, enabled bool) error {
+	s.mu.Lock()
+	var rule *AlertRule
+	for i := range s.config.Rules {
+		if s.config.Rules[i].ID == id {
+			rule = &s.config.Rules[i]
+		}
+	}
+	if rule == nil {
+		s.mu.Unlock()
+		return errors.NewValidationError(fmt.Sprintf("unknown alert rule %s", id), nil)
+	}
+
+	rule.Disabled = !enabled
+	dropped := 0
+	if !enabled {
+		for alertID, alert := range s.active {
+			if alert.RuleID == id {
+				delete(s.active, alertID)
+				dropped++
+			}
+		}
+		for pendingID := range s.pending {
+			if strings.HasPrefix(pendingID, id+":") {
+				delete(s.pending, pendingID)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("Alert rule changed", map[string]interface{}{
+		"rule_id":        id,
+		"enabled":        enabled,
+		"dropped_alerts": dropped,
+	})
+	if dropped > 0 {
+		s.save()
+	}
+	return nil
+}
+
+// Rules returns the alert rules as they are evaluated now
+func (s *AlertService) Rules() []AlertRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AlertRule(nil), s.config.Rules...)
+}
+
+// Active returns the firing alerts, most severe first
+func (s *AlertService) Active() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(s.active))
+	for _, alert := range s.active {
+		alerts = append(alerts, *alert)
+	}
+	rank := map[string]int{AlertSeverityCritical: 0, AlertSeverityWarning: 1, AlertSeverityInfo: 2}
+	sort.Slice(alerts, func(i, j int) bool {
+		if rank[alerts[i].Severity] != rank[alerts[j].Severity] {
+			return rank[alerts[i].Severity] < rank[alerts[j].Severity]
+		}
+		if !alerts[i].FiredAt.Equal(alerts[j].FiredAt) {
+			return alerts[i].FiredAt.Before(alerts[j].FiredAt)
+		}
+		return alerts[i].ID < alerts[j].ID
+	})
+	return alerts
+}
+
+// Resolved returns the recently resolved alerts, newest first
+func (s *AlertService) Resolved() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alerts := make([]Alert, len(s.history))
+	for i, alert := range s.history {
+		alerts[len(s.history)-1-i] = alert
+	}
+	return alerts
+}
+
+// Handler serves the rules, the firing alerts and the recently resolved ones as JSON
+func (s *AlertService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules":    s.Rules(),
+			"active":   s.Active(),
+			"resolved": s.Resolved(),
+		})
+	})
+}
+
+// EnableHandler turns the rule ?rule= on or off on POST, as ?enabled=true or false says
+func (s *AlertService) EnableHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to enable or disable a rule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := s.EnableRule(r.URL.Query().Get("rule"), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// save writes the active alerts; a failed save is retried with the next change
+func (s *AlertService) save() {
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save active alerts", err)
+	}
+}
+
+func (s *AlertService) write() error {
+	alerts := s.Active()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(alerts, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal active alerts", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write active alerts", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace active alerts", err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+type fakeRoomSensors map[string]*RoomSensorData
+
+func (f fakeRoomSensors) GetAllRoomSensors() map[string]*RoomSensorData {
+	return f
+}
+
+type fakeDeviceStatuses []MQTTDeviceStatus
+
+func (f fakeDeviceStatuses) Devices() []MQTTDeviceStatus {
+	return f
+}
+
+func alertThreshold(v float64) *float64 {
+	return &v
+}
+
+func recordAlerts(service *AlertService) *[]map[string]interface{} {
+	var notifications []map[string]interface{}
+	service.publish = func(msg *mqtt.Message) error {
+		var notification map[string]interface{}
+		json.Unmarshal(msg.Payload, &notification)
+		notifications = append(notifications, notification)
+		return nil
+	}
+	return &notifications
+}
+
+// webhookEvents passes on the webhook calls of alerts, which are made in the background
+type webhookEvents chan map[string]interface{}
+
+func (w webhookEvents) CallWebhook(id, source string, event map[string]interface{}) error {
+	w <- map[string]interface{}{"id": id, "source": source, "alert": event["alert"]}
+	return nil
+}
+
+func TestAlertServiceDeduplicatesAndResolves(t *testing.T) {
+	cfg := &AlertConfig{Rules: []AlertRule{
+		{ID: "hot", Metric: AlertMetricTemperature, Above: alertThreshold(85), ForSeconds: 60, Hysteresis: 1, Severity: AlertSeverityWarning,
+			Webhooks: []string{"ifttt"}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	start := time.Date(2024, 7, 1, 15, 0, 0, 0, time.UTC)
+	room := &RoomSensorData{RoomID: "attic", Temperature: 86, TempLastUpdate: start, IsOnline: true, LastSeen: start}
+	path := filepath.Join(t.TempDir(), AlertsFileName)
+	service := NewAlertService(cfg, path, nil)
+	service.SetRoomSensors(fakeRoomSensors{"attic": room})
+	notifications := recordAlerts(service)
+	webhooks := make(webhookEvents, 2)
+	service.SetWebhookCaller(webhooks)
+
+	for _, step := range []struct {
+		after time.Duration
+		temp  float64
+		want  int
+	}{
+		{0, 86, 0},                 // Pending
+		{time.Minute, 86, 1},       // Held long enough
+		{90 * time.Second, 87, 1},  // Still firing, not notified again
+		{2 * time.Minute, 84.5, 1}, // Within the hysteresis
+		{3 * time.Minute, 83, 2},   // Resolved
+	} {
+		now := start.Add(step.after)
+		room.Temperature, room.LastSeen = step.temp, now
+		service.evaluate(now)
+		if len(*notifications) != step.want {
+			t.Fatalf("After %s at %.1f°F: expected %d notifications, got %v", step.after, step.temp, step.want, *notifications)
+		}
+	}
+
+	fired, resolved := (*notifications)[0], (*notifications)[1]
+	if fired["state"] != AlertStateFiring || fired["severity"] != AlertSeverityWarning || fired["alert_id"] != "hot:attic" || fired["source"] != "alerts" {
+		t.Errorf("Unexpected firing notification %v", fired)
+	}
+	if resolved["state"] != AlertStateResolved || resolved["message"] != "attic temperature is back to 83.0°F." {
+		t.Errorf("Unexpected resolve notification %v", resolved)
+	}
+	if len(service.Active()) != 0 || len(service.Resolved()) != 1 {
+		t.Errorf("Expected one resolved alert, got active %v resolved %v", service.Active(), service.Resolved())
+	}
+
+	// The rule's webhook is called as it fires and resolves
+	states := make(map[interface{}]bool)
+	for range []string{AlertStateFiring, AlertStateResolved} {
+		select {
+		case call := <-webhooks:
+			alert, _ := call["alert"].(map[string]interface{})
+			if call["id"] != "ifttt" || call["source"] != "alert:hot:attic" || alert["subject"] != "attic" {
+				t.Errorf("Unexpected webhook call %v", call)
+			}
+			states[alert["state"]] = true
+		case <-time.After(time.Second):
+			t.Fatal("Expected the webhook called as the alert fired and resolved")
+		}
+	}
+	if !states[AlertStateFiring] || !states[AlertStateResolved] {
+		t.Errorf("Expected the webhook called for the firing and resolved alert, got %v", states)
+	}
+}
+
+func TestAlertServiceEnableRule(t *testing.T) {
+	cfg := &AlertConfig{Rules: []AlertRule{
+		{ID: "hot", Metric: AlertMetricTemperature, Above: alertThreshold(85), Severity: AlertSeverityWarning},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	now := time.Date(2024, 7, 1, 15, 0, 0, 0, time.UTC)
+	room := &RoomSensorData{RoomID: "attic", Temperature: 90, TempLastUpdate: now, IsOnline: true, LastSeen: now}
+	service := NewAlertService(cfg, filepath.Join(t.TempDir(), AlertsFileName), nil)
+	service.SetRoomSensors(fakeRoomSensors{"attic": room})
+	notifications := recordAlerts(service)
+
+	service.evaluate(now)
+	if len(service.Active()) != 1 {
+		t.Fatalf("Expected the rule to fire, got %v", service.Active())
+	}
+
+	if err := service.EnableRule("cold", false); err == nil {
+		t.Error("Expected an unknown rule rejected")
+	}
+	if err := service.EnableRule("hot", false); err != nil {
+		t.Fatal(err)
+	}
+	service.evaluate(now.Add(time.Minute))
+	if len(service.Active()) != 0 || len(*notifications) != 1 || !service.Rules()[0].Disabled {
+		t.Errorf("Expected the disabled rule's alert dropped silently, got active %v notifications %v", service.Active(), *notifications)
+	}
+
+	if err := service.EnableRule("hot", true); err != nil {
+		t.Fatal(err)
+	}
+	service.evaluate(now.Add(2 * time.Minute))
+	if len(service.Active()) != 1 || len(*notifications) != 2 {
+		t.Errorf("Expected the enabled rule to fire again, got active %v notifications %v", service.Active(), *notifications)
+	}
+}
+
+func TestAlertServiceOfflineSurvivesRestart(t *testing.T) {
+	cfg := &AlertConfig{Rules: []AlertRule{
+		{ID: "offline", Metric: AlertMetricOffline, Severity: AlertSeverityCritical},
+		{ID: "heater", Metric: AlertMetricPower, Above: alertThreshold(2000), Severity: AlertSeverityInfo, Subjects: []string{"heater-plug"}},
+	}}
+
+	now := time.Date(2024, 7, 1, 15, 0, 0, 0, time.UTC)
+	devices := fakeDeviceStatuses{
+		{DeviceID: "fridge-plug", Online: false, LastSeen: now.Add(-11 * time.Minute)},
+		{DeviceID: "kettle-plug", Online: false, LastSeen: now.Add(-5 * time.Minute)},
+		{DeviceID: "oven-plug", Online: true, PowerW: alertThreshold(2500), LastSeen: now},
+	}
+	path := filepath.Join(t.TempDir(), AlertsFileName)
+	service := NewAlertService(cfg, path, nil)
+	service.SetDevices(devices)
+	notifications := recordAlerts(service)
+
+	service.evaluate(now)
+	if len(*notifications) != 1 || (*notifications)[0]["alert_id"] != "offline:fridge-plug" {
+		t.Fatalf("Expected only the fridge plug offline for 10 minutes to alert, got %v", *notifications)
+	}
+
+	// The restarted service knows the alert was already notified
+	restarted := NewAlertService(cfg, path, nil)
+	restarted.SetDevices(devices)
+	notifications = recordAlerts(restarted)
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	restarted.evaluate(now.Add(time.Minute))
+	if len(*notifications) != 0 || len(restarted.Active()) != 1 {
+		t.Fatalf("Expected the restored alert not to fire again, got %v", *notifications)
+	}
+
+	devices[0].Online, devices[0].LastSeen = true, now.Add(2*time.Minute)
+	restarted.evaluate(now.Add(2 * time.Minute))
+	if len(*notifications) != 1 || (*notifications)[0]["message"] != "fridge-plug is back online." {
+		t.Errorf("Expected the fridge plug's alert to resolve, got %v", *notifications)
+	}
+}
+
+func TestAlertConfigValidate(t *testing.T) {
+	for name, rule := range map[string]AlertRule{
+		"no threshold":     {ID: "a", Metric: AlertMetricHumidity, Severity: AlertSeverityWarning},
+		"unknown metric":   {ID: "a", Metric: "pressure", Above: alertThreshold(1), Severity: AlertSeverityWarning},
+		"unknown severity": {ID: "a", Metric: AlertMetricPower, Above: alertThreshold(1), Severity: "page"},
+		"inverted band":    {ID: "a", Metric: AlertMetricTemperature, Above: alertThreshold(60), Below: alertThreshold(80), Severity: AlertSeverityInfo},
+		"offline above":    {ID: "a", Metric: AlertMetricOffline, Above: alertThreshold(1), Severity: AlertSeverityInfo},
+		"anomaly nothing":  {ID: "a", Metric: AlertMetricPower, Anomaly: &AnomalyDetection{Alpha: 0.1}, Severity: AlertSeverityInfo},
+		"anomaly above":    {ID: "a", Metric: AlertMetricPower, Above: alertThreshold(1), Anomaly: &AnomalyDetection{ZScore: 3}, Severity: AlertSeverityInfo},
+		"anomaly offline":  {ID: "a", Metric: AlertMetricOffline, Anomaly: &AnomalyDetection{StuckMinutes: 30}, Severity: AlertSeverityInfo},
+	} {
+		if err := (&AlertConfig{Rules: []AlertRule{rule}}).Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
+
+func TestAlertServiceAnomalies(t *testing.T) {
+	cfg := &AlertConfig{Rules: []AlertRule{
+		{ID: "probe", Metric: AlertMetricTemperature, Anomaly: &AnomalyDetection{StuckMinutes: 30, MaxJump: 15}, Severity: AlertSeverityWarning},
+		{ID: "power", Metric: AlertMetricPower, Anomaly: &AnomalyDetection{ZScore: 4, WarmupSamples: 10}, Severity: AlertSeverityInfo},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	start := time.Date(2024, 7, 1, 15, 0, 0, 0, time.UTC)
+	room := &RoomSensorData{RoomID: "attic", IsOnline: true}
+	power := 0.0
+	devices := fakeDeviceStatuses{{DeviceID: "fridge-plug", Online: true, PowerW: &power}}
+	service := NewAlertService(cfg, filepath.Join(t.TempDir(), AlertsFileName), nil)
+	service.SetRoomSensors(fakeRoomSensors{"attic": room})
+	service.SetDevices(devices)
+	notifications := recordAlerts(service)
+
+	read := func(minute int, temp, watts float64) {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		room.Temperature, room.TempLastUpdate, room.LastSeen = temp, now, now
+		power, devices[0].LastSeen = watts, now
+		service.evaluate(now)
+	}
+	last := func() map[string]interface{} {
+		return (*notifications)[len(*notifications)-1]
+	}
+
+	// A temperature that doesn't move at all for half an hour is a frozen sensor
+	for minute := 0; minute <= 25; minute += 5 {
+		read(minute, 72, 100+float64(minute%10))
+	}
+	if len(*notifications) != 0 {
+		t.Fatalf("Expected no anomalies while learning, got %v", *notifications)
+	}
+	read(30, 72, 100)
+	if len(*notifications) != 1 || last()["alert_id"] != "probe:attic" || last()["anomaly"] != AnomalyStuck ||
+		last()["message"] != "attic temperature has been stuck at 72.0°F for 30m0s." {
+		t.Fatalf("Expected the stuck probe flagged, got %v", *notifications)
+	}
+
+	// Polling again without a new reading keeps the alert; the next change resolves it
+	service.evaluate(start.Add(31 * time.Minute))
+	if len(*notifications) != 1 {
+		t.Fatalf("Expected the same reading to keep its finding, got %v", *notifications)
+	}
+	read(35, 72.5, 105)
+	if len(*notifications) != 2 || last()["state"] != AlertStateResolved {
+		t.Fatalf("Expected the stuck alert to resolve, got %v", *notifications)
+	}
+
+	// A leap no room could make is a sensor fault
+	read(40, 95, 100)
+	if len(*notifications) != 3 || last()["anomaly"] != AnomalyJump {
+		t.Fatalf("Expected the jump flagged, got %v", *notifications)
+	}
+	read(45, 72, 105)
+
+	// Power far outside what the fridge usually draws is unusual once it has been learned
+	read(50, 73, 900)
+	if len(*notifications) != 5 || last()["alert_id"] != "power:fridge-plug" || last()["anomaly"] != AnomalyUnusual {
+		t.Fatalf("Expected unusual power flagged, got %v", *notifications)
+	}
+	if active := service.Active(); len(active) != 1 || active[0].Anomaly != AnomalyUnusual {
+		t.Errorf("Expected only the power alert active, got %v", active)
+	}
+}
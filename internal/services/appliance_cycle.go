@@ -0,0 +1,120 @@
+package services
+
+import (
+	"time"
+)
+
+// NotificationTopic carries human-readable notifications for phones, dashboards and chat bridges
+const NotificationTopic = "home-automation/notifications"
+
+// CycleConfig describes the power pattern of an appliance such as a washer or dryer.
+// A cycle starts when power reaches HighPowerW and completes once power stays below
+// IdlePowerW for IdleDuration.
+type CycleConfig struct {
+	HighPowerW     float64       `json:"high_power_w"`     // Power marking the running phase
+	IdlePowerW     float64       `json:"idle_power_w"`     // Power below which the appliance is considered done
+	IdleDuration   time.Duration `json:"idle_duration"`    // How long power must stay low
+	MinRunDuration time.Duration `json:"min_run_duration"` // Shorter runs (e.g. a door-lock spike) are ignored
+}
+
+// DefaultCycleConfig returns thresholds suited to most washers and dryers
+func DefaultCycleConfig() *CycleConfig {
+	return &CycleConfig{
+		HighPowerW:     100,
+		IdlePowerW:     5,
+		IdleDuration:   5 * time.Minute,
+		MinRunDuration: 10 * time.Minute,
+	}
+}
+
+// CycleEvent is emitted when an appliance cycle completes
+type CycleEvent struct {
+	DeviceID    string        `json:"device_id"`
+	DeviceUUID  string        `json:"device_uuid,omitempty"`
+	DeviceName  string        `json:"device_name"`
+	RoomID      string        `json:"room_id"`
+	StartedAt   time.Time     `json:"started_at"`
+	CompletedAt time.Time     `json:"completed_at"`
+	Duration    time.Duration `json:"duration"`
+	PeakPowerW  float64       `json:"peak_power_w"`
+	EnergyWh    float64       `json:"energy_wh"`
+}
+
+// cycleDetector tracks one appliance through idle, running and settling phases
+type cycleDetector struct {
+	config     CycleConfig
+	running    bool
+	startedAt  time.Time
+	belowSince time.Time // Zero while power is above IdlePowerW
+	lastSample time.Time
+	lastPowerW float64
+	peakPowerW float64
+	energyWh   float64
+}
+
+// newCycleDetector creates a detector, filling unset thresholds from the defaults
+func newCycleDetector(config *CycleConfig) *cycleDetector {
+	defaults := DefaultCycleConfig()
+	merged := *config
+	if merged.HighPowerW <= 0 {
+		merged.HighPowerW = defaults.HighPowerW
+	}
+	if merged.IdlePowerW <= 0 {
+		merged.IdlePowerW = defaults.IdlePowerW
+	}
+	if merged.IdleDuration <= 0 {
+		merged.IdleDuration = defaults.IdleDuration
+	}
+
+	return &cycleDetector{config: merged}
+}
+
+// observe feeds a power sample and returns a completed cycle, if any
+func (d *cycleDetector) observe(powerW float64, at time.Time) *CycleEvent {
+	// Integrate energy over the run; the plug's daily counter resets at midnight
+	if d.running && !d.lastSample.IsZero() {
+		d.energyWh += d.lastPowerW * at.Sub(d.lastSample).Hours()
+	}
+	d.lastSample = at
+	d.lastPowerW = powerW
+
+	if !d.running {
+		if powerW >= d.config.HighPowerW {
+			d.running = true
+			d.startedAt = at
+			d.belowSince = time.Time{}
+			d.peakPowerW = powerW
+			d.energyWh = 0
+		}
+		return nil
+	}
+
+	if powerW > d.peakPowerW {
+		d.peakPowerW = powerW
+	}
+
+	if powerW >= d.config.IdlePowerW {
+		d.belowSince = time.Time{} // Pauses between wash phases draw little, but not nothing
+		return nil
+	}
+
+	if d.belowSince.IsZero() {
+		d.belowSince = at
+	}
+	if at.Sub(d.belowSince) < d.config.IdleDuration {
+		return nil
+	}
+
+	d.running = false
+	if d.belowSince.Sub(d.startedAt) < d.config.MinRunDuration {
+		return nil
+	}
+
+	return &CycleEvent{
+		StartedAt:   d.startedAt,
+		CompletedAt: d.belowSince,
+		Duration:    d.belowSince.Sub(d.startedAt),
+		PeakPowerW:  d.peakPowerW,
+		EnergyWh:    d.energyWh,
+	}
+}
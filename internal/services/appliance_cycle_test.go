@@ -0,0 +1,71 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCycleDetectorWasherCycle(t *testing.T) {
+	detector := newCycleDetector(&CycleConfig{
+		HighPowerW:     100,
+		IdlePowerW:     5,
+		IdleDuration:   5 * time.Minute,
+		MinRunDuration: 10 * time.Minute,
+	})
+
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	samples := []struct {
+		minute int
+		powerW float64
+	}{
+		{0, 2},     // Standby
+		{1, 2000},  // Heating
+		{15, 300},  // Washing
+		{30, 3},    // Soaking pause, shorter than IdleDuration
+		{33, 500},  // Spin
+		{45, 1},    // Done
+		{48, 1},    // Still settling
+		{50, 1},    // Idle for 5 minutes
+		{60, 2000}, // Next load starts
+	}
+
+	var events []*CycleEvent
+	for _, sample := range samples {
+		if event := detector.observe(sample.powerW, start.Add(time.Duration(sample.minute)*time.Minute)); event != nil {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 completed cycle, got %d", len(events))
+	}
+
+	event := events[0]
+	if event.Duration != 44*time.Minute {
+		t.Errorf("Expected a 44 minute cycle, got %s", event.Duration)
+	}
+	if event.PeakPowerW != 2000 {
+		t.Errorf("Expected peak power 2000W, got %.0f", event.PeakPowerW)
+	}
+	if event.EnergyWh <= 0 {
+		t.Errorf("Expected energy to be integrated over the cycle, got %.1f", event.EnergyWh)
+	}
+	if !detector.running {
+		t.Error("Expected the next load to start a new cycle")
+	}
+}
+
+func TestCycleDetectorIgnoresShortRuns(t *testing.T) {
+	detector := newCycleDetector(&CycleConfig{MinRunDuration: 10 * time.Minute})
+
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	detector.observe(150, start)
+	detector.observe(1, start.Add(2*time.Minute))
+
+	if event := detector.observe(1, start.Add(8*time.Minute)); event != nil {
+		t.Errorf("Expected a 2 minute spike not to count as a cycle, got %+v", event)
+	}
+	if detector.running {
+		t.Error("Expected the detector to return to idle")
+	}
+}
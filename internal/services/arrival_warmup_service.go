@@ -0,0 +1,517 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/solar"
+)
+
+const (
+	// ArrivalWarmUpFileName holds the warm-up time learned for each thermostat
+	ArrivalWarmUpFileName = "arrival-warmup.json"
+
+	defaultWarmUpMarginMinutes    = 10
+	defaultWarmUpMaxLeadMinutes   = 120
+	defaultWarmUpMinutesPerDegree = 5.0
+	defaultPorchLightMinutes      = 5
+	defaultPorchLightOffMinutes   = 10
+	defaultArrivalGraceMinutes    = 30
+	warmUpReachedWithin           = 0.5 // °F from the target that counts as reached
+	warmUpMinDelta                = 1.0 // °F a run must cover to be learned from
+	warmUpMaxRun                  = 4 * time.Hour
+	warmUpLearningWeight          = 0.3
+	arrivalWarmUpCheck            = time.Minute
+)
+
+// ArrivalWarmUpPath returns the learned warm-up file path for a state directory
+func ArrivalWarmUpPath(stateDir string) string {
+	return filepath.Join(stateDir, ArrivalWarmUpFileName)
+}
+
+// ArrivalWarmUpConfig sets how far ahead of a resident's arrival the house is warmed or cooled
+// and the porch lit
+type ArrivalWarmUpConfig struct {
+	// Rooms warmed or cooled ahead of arrival; empty warms every room held at the away setback
+	Rooms []string `json:"rooms,omitempty"`
+	// MinutesPerDegree is the warm-up time per °F until a room's own is learned, default 5
+	MinutesPerDegree float64 `json:"minutes_per_degree,omitempty"`
+	// MarginMinutes is added to the warm-up time, default 10
+	MarginMinutes int `json:"margin_minutes,omitempty"`
+	// MaxLeadMinutes caps how early before the arrival a room starts, default 120
+	MaxLeadMinutes int `json:"max_lead_minutes,omitempty"`
+	// PorchLights are turned on ahead of an arrival after dark
+	PorchLights []string `json:"porch_lights,omitempty"`
+	// PorchLightMinutes is how long before the arrival the porch lights come on, default 5
+	PorchLightMinutes int `json:"porch_light_minutes,omitempty"`
+	// PorchLightOffMinutes is how long after the arrival the porch lights go off, default 10
+	PorchLightOffMinutes int `json:"porch_light_off_minutes,omitempty"`
+	// GraceMinutes is how long past the expected arrival the warm-up is undone when nobody
+	// came home, default 30
+	GraceMinutes int `json:"grace_minutes,omitempty"`
+}
+
+// Validate checks the warm-up settings
+func (c *ArrivalWarmUpConfig) Validate() error {
+	if c.MinutesPerDegree < 0 || c.MarginMinutes < 0 || c.MaxLeadMinutes < 0 || c.PorchLightMinutes < 0 ||
+		c.PorchLightOffMinutes < 0 || c.GraceMinutes < 0 {
+		return errors.NewValidationError("arrival_warm_up durations must not be negative", nil)
+	}
+	return nil
+}
+
+func (c *ArrivalWarmUpConfig) minutes(value, fallback int) time.Duration {
+	if value == 0 {
+		value = fallback
+	}
+	return time.Duration(value) * time.Minute
+}
+
+// WarmUpRate is the warm-up time learned for a thermostat's room
+type WarmUpRate struct {
+	MinutesPerDegree float64   `json:"minutes_per_degree"`
+	Samples          int       `json:"samples"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// WarmUpRun is a room warming or cooling toward its target, learned from once it gets there
+type WarmUpRun struct {
+	ThermostatID string    `json:"thermostat_id"`
+	Start        time.Time `json:"start"`
+	StartTemp    float64   `json:"start_temp"`
+	TargetTemp   float64   `json:"target_temp"`
+}
+
+// ArrivalWarmUpStatus is the expected arrivals, the rooms warming and the learned warm-up times
+type ArrivalWarmUpStatus struct {
+	Arrivals  map[string]time.Time  `json:"arrivals"`
+	Warming   []WarmUpRun           `json:"warming"`
+	PorchLit  bool                  `json:"porch_lit"`
+	Learned   map[string]WarmUpRate `json:"learned"`
+	LeadTimes map[string]string     `json:"lead_times"` // Current warm-up time by thermostat held away
+}
+
+// ArrivalWarmUpService ends the away setback of each room ahead of a resident's arrival, as
+// long before it as the room takes to get back to its target, and lights the porch. The
+// arrival comes from the OwnTracks approach; the warm-up time per °F is learned from every
+// warm-up. When nobody comes home after all, the away setback is put back.
+type ArrivalWarmUpService struct {
+	config      *ArrivalWarmUpConfig
+	enabled     map[string]bool // Residents whose arrival warms up the house
+	rooms       map[string]bool
+	schedules   *ScheduleService
+	thermostats *ThermostatService
+	commands    CommandExecutor
+	latitude    float64
+	longitude   float64
+	arrivals    map[string]time.Time             // Expected arrival by resident
+	replaced    map[string]models.ThermostatHold // Away holds the warm-up replaced, by thermostat ID
+	runs        map[string]*WarmUpRun
+	learned     map[string]WarmUpRate
+	porchLit    bool
+	porchOffAt  time.Time
+	path        string
+	logger      *logger.Logger
+	mu          sync.Mutex
+}
+
+// NewArrivalWarmUpService creates the arrival warm-up for the residents with warm_up set,
+// keeping the learned warm-up times at path
+func NewArrivalWarmUpService(cfg *ResidentPresenceConfig, path string, serviceLogger *logger.Logger) *ArrivalWarmUpService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ArrivalWarmUp", nil)
+	}
+	warmUp := cfg.ArrivalWarmUp
+	if warmUp == nil {
+		warmUp = &ArrivalWarmUpConfig{}
+	}
+
+	service := &ArrivalWarmUpService{
+		config:    warmUp,
+		enabled:   make(map[string]bool),
+		rooms:     make(map[string]bool),
+		latitude:  cfg.HomeLatitude,
+		longitude: cfg.HomeLongitude,
+		arrivals:  make(map[string]time.Time),
+		replaced:  make(map[string]models.ThermostatHold),
+		runs:      make(map[string]*WarmUpRun),
+		learned:   make(map[string]WarmUpRate),
+		path:      path,
+		logger:    serviceLogger,
+	}
+	for _, resident := range cfg.Residents {
+		service.enabled[resident.Name] = resident.WarmUp
+	}
+	for _, roomID := range warmUp.Rooms {
+		service.rooms[roomID] = true
+	}
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load learned warm-up times, starting over", err)
+		}
+	}
+	return service
+}
+
+// SetThermostats sets the thermostats warmed up and the schedules holding them away
+func (s *ArrivalWarmUpService) SetThermostats(schedules *ScheduleService, thermostats *ThermostatService) {
+	s.schedules = schedules
+	s.thermostats = thermostats
+}
+
+// SetCommandExecutor sets how the porch lights are switched
+func (s *ArrivalWarmUpService) SetCommandExecutor(executor CommandExecutor) {
+	s.commands = executor
+}
+
+// HandleApproach records when a resident heading home arrives
+func (s *ArrivalWarmUpService) HandleApproach(name string, eta time.Duration, now time.Time) {
+	s.mu.Lock()
+	if !s.enabled[name] {
+		s.mu.Unlock()
+		return
+	}
+	s.arrivals[name] = now.Add(eta)
+	s.mu.Unlock()
+
+	s.logger.Info("Resident heading home", map[string]interface{}{"resident": name, "eta_minutes": math.Round(eta.Minutes())})
+	s.Update(now)
+}
+
+// HandleResident forgets the arrival of a resident who came home or left again. Coming home
+// ends the warm-up: the home mode releases the warm-up holds with the away ones.
+func (s *ArrivalWarmUpService) HandleResident(name string, home bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, expected := s.arrivals[name]; !expected {
+		return
+	}
+	delete(s.arrivals, name)
+	if home {
+		s.replaced = make(map[string]models.ThermostatHold)
+		if s.porchLit {
+			s.porchOffAt = time.Now().Add(s.config.minutes(s.config.PorchLightOffMinutes, defaultPorchLightOffMinutes))
+		}
+	}
+}
+
+// Run checks the arrivals and the rooms warming every minute until the context is cancelled
+func (s *ArrivalWarmUpService) Run(ctx context.Context) {
+	ticker := time.NewTicker(arrivalWarmUpCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Update(now)
+		}
+	}
+}
+
+// Update starts the rooms whose warm-up time reaches the earliest arrival, lights the porch,
+// learns from the rooms that got to their target and undoes the warm-up when nobody came
+func (s *ArrivalWarmUpService) Update(now time.Time) {
+	if s.schedules == nil || s.thermostats == nil {
+		return
+	}
+	s.learn(now)
+
+	s.mu.Lock()
+	var arrival time.Time
+	for _, expected := range s.arrivals {
+		if arrival.IsZero() || expected.Before(arrival) {
+			arrival = expected
+		}
+	}
+	porchOff := s.porchLit && !s.porchOffAt.IsZero() && !now.Before(s.porchOffAt)
+	s.mu.Unlock()
+
+	if porchOff {
+		s.switchPorch(false)
+	}
+	if arrival.IsZero() {
+		return
+	}
+	if now.After(arrival.Add(s.config.minutes(s.config.GraceMinutes, defaultArrivalGraceMinutes))) {
+		s.cancel(now)
+		return
+	}
+
+	remaining := arrival.Sub(now)
+	maxLead := s.config.minutes(s.config.MaxLeadMinutes, defaultWarmUpMaxLeadMinutes)
+	margin := s.config.minutes(s.config.MarginMinutes, defaultWarmUpMarginMinutes)
+	for id, hold := range s.schedules.Holds() {
+		if hold.Reason != models.HoldReasonAway || hold.PreviousTemp == 0 {
+			continue
+		}
+		thermostat, err := s.thermostats.GetThermostat(id)
+		if err != nil || (len(s.rooms) > 0 && !s.rooms[thermostat.RoomID]) {
+			continue
+		}
+		if remaining > min(s.leadTime(thermostat, hold.PreviousTemp)+margin, maxLead) {
+			continue
+		}
+		s.start(thermostat, hold, now)
+	}
+
+	s.mu.Lock()
+	lightPorch := !s.porchLit && len(s.config.PorchLights) > 0 &&
+		remaining <= s.config.minutes(s.config.PorchLightMinutes, defaultPorchLightMinutes) && s.dark(now)
+	s.mu.Unlock()
+	if lightPorch {
+		s.switchPorch(true)
+	}
+}
+
+// start replaces a thermostat's away hold with one at the target from before leaving
+func (s *ArrivalWarmUpService) start(thermostat *models.Thermostat, away models.ThermostatHold, now time.Time) {
+	hold := models.ThermostatHold{
+		Mode:         models.HoldPermanent,
+		TargetTemp:   away.PreviousTemp,
+		Reason:       models.HoldReasonArrival,
+		PreviousTemp: away.PreviousTemp,
+	}
+	if _, err := s.schedules.Hold(thermostat.ID, hold, now); err != nil {
+		s.logger.Error("Failed to warm up thermostat before arrival", err, map[string]interface{}{"thermostat_id": thermostat.ID})
+		return
+	}
+
+	s.mu.Lock()
+	s.replaced[thermostat.ID] = away
+	s.runs[thermostat.ID] = &WarmUpRun{ThermostatID: thermostat.ID, Start: now, StartTemp: thermostat.CurrentTemp, TargetTemp: away.PreviousTemp}
+	s.mu.Unlock()
+
+	s.logger.Info("Warming up before arrival", map[string]interface{}{
+		"thermostat_id": thermostat.ID,
+		"room_id":       thermostat.RoomID,
+		"from":          thermostat.CurrentTemp,
+		"target_temp":   away.PreviousTemp,
+	})
+}
+
+// cancel puts back the away holds of the rooms warming up and turns the porch off, when nobody
+// arrived within the grace time
+func (s *ArrivalWarmUpService) cancel(now time.Time) {
+	s.mu.Lock()
+	replaced := s.replaced
+	s.replaced = make(map[string]models.ThermostatHold)
+	s.arrivals = make(map[string]time.Time)
+	porchLit := s.porchLit
+	s.mu.Unlock()
+
+	holds := s.schedules.Holds()
+	for id, away := range replaced {
+		if holds[id].Reason != models.HoldReasonArrival {
+			continue // Changed by hand since
+		}
+		if _, err := s.schedules.Hold(id, away, now); err != nil {
+			s.logger.Error("Failed to put back the away setback", err, map[string]interface{}{"thermostat_id": id})
+		}
+	}
+	if porchLit {
+		s.switchPorch(false)
+	}
+	s.logger.Info("Nobody arrived, away setback restored", map[string]interface{}{"thermostats": len(replaced)})
+}
+
+// leadTime is how long a thermostat's room takes to get to target: the learned time per °F,
+// else the one the PID control learned from heating, else the configured default
+func (s *ArrivalWarmUpService) leadTime(thermostat *models.Thermostat, target float64) time.Duration {
+	delta := target - thermostat.CurrentTemp
+	cooling := thermostat.Mode == models.ModeCool
+	if cooling {
+		delta = -delta
+	}
+	if delta <= 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	rate, learned := s.learned[thermostat.ID]
+	s.mu.Unlock()
+	if learned && rate.Samples > 0 {
+		return time.Duration(rate.MinutesPerDegree * delta * float64(time.Minute))
+	}
+	if response := s.thermostats.learnedResponse(thermostat.ID); !cooling && response.Samples > 0 && response.HeatingRate > 0 {
+		return time.Duration((response.DeadTimeMinutes + delta/response.HeatingRate) * float64(time.Minute))
+	}
+	perDegree := s.config.MinutesPerDegree
+	if perDegree == 0 {
+		perDegree = defaultWarmUpMinutesPerDegree
+	}
+	return time.Duration(perDegree * delta * float64(time.Minute))
+}
+
+// learn records the time per °F of the rooms that got to their target
+func (s *ArrivalWarmUpService) learn(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id, run := range s.runs {
+		thermostat, err := s.thermostats.GetThermostat(id)
+		if err != nil || now.Sub(run.Start) > warmUpMaxRun {
+			delete(s.runs, id)
+			continue
+		}
+		if math.Abs(thermostat.CurrentTemp-run.TargetTemp) > warmUpReachedWithin {
+			continue
+		}
+		delete(s.runs, id)
+
+		delta := math.Abs(run.TargetTemp - run.StartTemp)
+		if delta < warmUpMinDelta {
+			continue
+		}
+		sample := now.Sub(run.Start).Minutes() / delta
+		rate := s.learned[id]
+		if rate.Samples == 0 {
+			rate.MinutesPerDegree = sample
+		} else {
+			rate.MinutesPerDegree = (1-warmUpLearningWeight)*rate.MinutesPerDegree + warmUpLearningWeight*sample
+		}
+		rate.Samples++
+		rate.UpdatedAt = now
+		s.learned[id] = rate
+		changed = true
+
+		s.logger.Info("Learned warm-up time", map[string]interface{}{
+			"thermostat_id":      id,
+			"minutes_per_degree": math.Round(rate.MinutesPerDegree*10) / 10,
+			"samples":            rate.Samples,
+		})
+	}
+	if changed {
+		if err := s.saveLocked(); err != nil {
+			s.logger.Error("Failed to save learned warm-up times", err)
+		}
+	}
+}
+
+// dark reports whether now is between sunset and sunrise at home; without the home
+// coordinates it is always dark
+func (s *ArrivalWarmUpService) dark(now time.Time) bool {
+	if s.latitude == 0 && s.longitude == 0 {
+		return true
+	}
+	sunrise, sunset, ok := solar.Times(now, s.latitude, s.longitude)
+	if !ok {
+		return false
+	}
+	return now.Before(sunrise) || now.After(sunset)
+}
+
+// switchPorch turns the porch lights on or off
+func (s *ArrivalWarmUpService) switchPorch(on bool) {
+	s.mu.Lock()
+	s.porchLit, s.porchOffAt = on, time.Time{}
+	commands := s.commands
+	s.mu.Unlock()
+	if commands == nil {
+		return
+	}
+
+	action := "turn_off"
+	if on {
+		action = "turn_on"
+	}
+	for _, deviceID := range s.config.PorchLights {
+		err := commands.ExecuteCommand(&models.DeviceCommand{DeviceID: deviceID, Action: action,
+			Options: map[string]interface{}{"automation": "arrival"}})
+		if err != nil {
+			s.logger.Error("Failed to switch porch light", err, map[string]interface{}{"device_id": deviceID, "action": action})
+		}
+	}
+}
+
+// Status returns the expected arrivals, the rooms warming and the learned warm-up times
+func (s *ArrivalWarmUpService) Status() ArrivalWarmUpStatus {
+	leadTimes := make(map[string]string)
+	if s.schedules != nil && s.thermostats != nil {
+		for id, hold := range s.schedules.Holds() {
+			if hold.Reason != models.HoldReasonAway || hold.PreviousTemp == 0 {
+				continue
+			}
+			if thermostat, err := s.thermostats.GetThermostat(id); err == nil {
+				leadTimes[id] = s.leadTime(thermostat, hold.PreviousTemp).Round(time.Minute).String()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ArrivalWarmUpStatus{
+		Arrivals:  make(map[string]time.Time, len(s.arrivals)),
+		Warming:   make([]WarmUpRun, 0, len(s.runs)),
+		PorchLit:  s.porchLit,
+		Learned:   make(map[string]WarmUpRate, len(s.learned)),
+		LeadTimes: leadTimes,
+	}
+	for name, arrival := range s.arrivals {
+		status.Arrivals[name] = arrival
+	}
+	for _, id := range sortedKeys(s.runs) {
+		status.Warming = append(status.Warming, *s.runs[id])
+	}
+	for id, rate := range s.learned {
+		status.Learned[id] = rate
+	}
+	return status
+}
+
+// Handler serves the warm-up status as JSON
+func (s *ArrivalWarmUpService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+func (s *ArrivalWarmUpService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read learned warm-up times", err)
+	}
+	if err := json.Unmarshal(data, &s.learned); err != nil {
+		return errors.NewSystemError("failed to parse learned warm-up times", err)
+	}
+	return nil
+}
+
+// saveLocked atomically writes the learned warm-up times; callers must hold the lock
+func (s *ArrivalWarmUpService) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.learned, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal learned warm-up times", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write learned warm-up times", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace learned warm-up times", err)
+	}
+	return nil
+}
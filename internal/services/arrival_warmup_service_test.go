@@ -0,0 +1,118 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// ownTracksAt is a location report the given meters north of the home at 40°N
+func ownTracksAt(meters, kmh float64) []byte {
+	return []byte(fmt.Sprintf(`{"_type": "location", "lat": %f, "lon": -75, "vel": %f}`, 40+meters/111195, kmh))
+}
+
+func TestArrivalWarmUp(t *testing.T) {
+	testLogger := logger.NewLogger("arrival-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "hall", RoomID: "hall", Mode: models.ModeHeat, TargetTemp: 70, CurrentTemp: 60})
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "attic", RoomID: "attic", Mode: models.ModeHeat, TargetTemp: 68, CurrentTemp: 60})
+	schedules := NewScheduleService(thermostats, NewPresenceService("", nil), "", testLogger)
+	target := func(id string) float64 {
+		thermostat, _ := thermostats.GetThermostat(id)
+		return thermostat.TargetTemp
+	}
+
+	cfg := &ResidentPresenceConfig{
+		Residents: []Resident{
+			{Name: "alex", OwnTracksTopic: "owntracks/alex/phone", WarmUp: true},
+			{Name: "sam", OwnTracksTopic: "owntracks/sam/phone"},
+		},
+		HomeLatitude:  40,
+		HomeLongitude: -75,
+		AwaySetback:   &AwaySetback{HeatTemp: 62},
+		ArrivalWarmUp: &ArrivalWarmUpConfig{Rooms: []string{"hall"}, PorchLights: []string{"porch"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	residents := NewResidentPresenceService(cfg, testLogger)
+	path := filepath.Join(t.TempDir(), ArrivalWarmUpFileName)
+	service := NewArrivalWarmUpService(cfg, path, testLogger)
+	service.SetThermostats(schedules, thermostats)
+	lights := &recordingExecutor{}
+	service.SetCommandExecutor(lights)
+	residents.AddApproachCallback(service.HandleApproach)
+	residents.AddResidentCallback(service.HandleResident)
+
+	// Everyone leaves at 19:00 on a January evening, after dark
+	evening := time.Date(2024, 1, 10, 19, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	residents.HandleOwnTracks("sam", ownTracksAt(30000, 0), evening)
+	residents.HandleOwnTracks("alex", ownTracksAt(85000, 0), evening)
+	schedules.SetAway(true, *cfg.AwaySetback, evening)
+
+	// Heading home at 60 km/h from 80 km: 80 minutes out, while the hall needs 10°F at
+	// 5 minutes each plus the margin
+	start := evening.Add(5 * time.Minute)
+	residents.HandleOwnTracks("alex", ownTracksAt(80000, 60), start)
+	arrival := service.Status().Arrivals["alex"]
+	if eta := arrival.Sub(start); eta < 79*time.Minute || eta > 81*time.Minute {
+		t.Fatalf("Expected alex 80 minutes out, got %v", eta)
+	}
+	residents.HandleOwnTracks("sam", ownTracksAt(20000, 60), start)
+	if _, ok := service.Status().Arrivals["sam"]; ok {
+		t.Error("Expected sam's approach ignored without warm_up")
+	}
+	service.Update(start.Add(15 * time.Minute))
+	if target("hall") != 62 {
+		t.Fatalf("Expected the hall still set back an hour out, got %v", target("hall"))
+	}
+	service.Update(start.Add(21 * time.Minute))
+	if target("hall") != 70 || schedules.Holds()["hall"].Reason != models.HoldReasonArrival || target("attic") != 62 {
+		t.Fatalf("Expected only the hall warming up, got %v and %v", target("hall"), target("attic"))
+	}
+
+	// The hall gets there in 40 minutes, and the porch lights come on 5 minutes out
+	thermostats.HandleTemperatureUpdate("hall", 70)
+	service.Update(start.Add(61 * time.Minute))
+	if learned := service.Status().Learned["hall"]; learned.Samples != 1 || learned.MinutesPerDegree != 4 {
+		t.Errorf("Expected 4 minutes per degree learned, got %+v", learned)
+	}
+	service.Update(arrival.Add(-4 * time.Minute))
+	if commands := lights.take(); len(commands) != 1 || commands[0] != "turn_on porch" {
+		t.Errorf("Expected the porch lit, got %v", commands)
+	}
+
+	// Nobody came after all: the away setback returns and the porch goes dark
+	service.Update(arrival.Add(31 * time.Minute))
+	if target("hall") != 62 || schedules.Holds()["hall"].Reason != models.HoldReasonAway {
+		t.Errorf("Expected the away setback back, got %v", target("hall"))
+	}
+	if commands := lights.take(); len(commands) != 1 || commands[0] != "turn_off porch" {
+		t.Errorf("Expected the porch turned off, got %v", commands)
+	}
+
+	// The learned time survives a restart and sets the next lead time
+	restored := NewArrivalWarmUpService(cfg, path, testLogger)
+	restored.SetThermostats(schedules, thermostats)
+	thermostats.HandleTemperatureUpdate("hall", 61)
+	if lead := restored.Status().LeadTimes["hall"]; lead != "36m0s" {
+		t.Errorf("Expected a 36 minute lead time from the learned rate, got %s", lead)
+	}
+
+	// Coming home releases the warm-up holds with the away ones
+	restored.HandleApproach("alex", 30*time.Minute, time.Now())
+	if target("hall") != 70 {
+		t.Fatalf("Expected the hall warming up again, got %v", target("hall"))
+	}
+	restored.HandleResident("alex", true)
+	schedules.SetAway(false, *cfg.AwaySetback, time.Now())
+	if len(schedules.Holds()) != 0 || target("attic") != 68 {
+		t.Errorf("Expected every hold released, got %v", schedules.Holds())
+	}
+}
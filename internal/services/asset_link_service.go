@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+// assetLinkInterval is how often discovered assets are linked to the device registry
+const assetLinkInterval = time.Minute
+
+// AssetLinkService links the assets found by discovery to the device registry, so a plug that
+// the Tapo scraper claims by its device ID and discovery finds by its MAC is one device with
+// one UUID rather than two
+type AssetLinkService struct {
+	registry  *identity.Registry
+	inventory func() []discovery.InventoryEntry
+	logger    *logger.Logger
+}
+
+// NewAssetLinkService creates a service linking the assets inventory returns, e.g. those of
+// DiscoveryManager.Inventory
+func NewAssetLinkService(registry *identity.Registry, inventory func() []discovery.InventoryEntry, serviceLogger *logger.Logger) *AssetLinkService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("AssetLinks", nil)
+	}
+
+	return &AssetLinkService{
+		registry:  registry,
+		inventory: inventory,
+		logger:    serviceLogger,
+	}
+}
+
+// Run links the assets every minute until the context is cancelled
+func (s *AssetLinkService) Run(ctx context.Context) {
+	ticker := time.NewTicker(assetLinkInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(); err != nil {
+			s.logger.Error("Failed to link discovered assets", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync claims every discovered asset by its asset ID, MAC and IP address. Assets matching a
+// registered device add their aliases to it, and give it their room when it has none; the
+// others are registered under their discovered name.
+func (s *AssetLinkService) Sync() error {
+	// Devices are edited with the CLI in another process
+	if err := s.registry.Reload(); err != nil {
+		return err
+	}
+
+	for _, entry := range s.inventory() {
+		asset := entry.AssetInfo
+		if asset == nil || asset.ID == "" {
+			continue
+		}
+
+		if _, err := s.registry.Link(asset.Name, asset.Room,
+			identity.NewAlias(identity.AliasAssetID, asset.ID),
+			identity.NewAlias(identity.AliasMAC, asset.MACAddress),
+			identity.NewAlias(identity.AliasIP, asset.IPAddress)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+func TestAssetLinkService(t *testing.T) {
+	registry, _ := identity.NewRegistry(identity.RegistryPath(t.TempDir()))
+	plug, _ := registry.Claim("Fridge Plug", identity.NewAlias(identity.AliasDeviceID, "fridge_plug"),
+		identity.NewAlias(identity.AliasMAC, "AA:BB:CC:00:11:22"))
+
+	inventory := []discovery.InventoryEntry{
+		{AssetInfo: &discovery.AssetInfo{ID: "tapo-p110-1122", Name: "Tapo P110", Room: "kitchen", MACAddress: "aa-bb-cc-00-11-22", IPAddress: "192.168.1.40"}},
+		{AssetInfo: &discovery.AssetInfo{ID: "upnp-tv", Name: "Living Room TV", Room: "living-room", IPAddress: "192.168.1.41"}},
+		{AssetInfo: &discovery.AssetInfo{}},
+	}
+	service := NewAssetLinkService(registry, func() []discovery.InventoryEntry { return inventory }, nil)
+	if err := service.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// The plug found by its MAC is the plug already claimed
+	linked, _ := registry.Get(plug.UUID)
+	if linked.Name != "Fridge Plug" || linked.RoomID != "kitchen" || len(linked.Aliases) != 4 {
+		t.Errorf("Expected the discovered plug linked to the claimed one, got %+v", linked)
+	}
+	uuid, exists := registry.Resolve(identity.NewAlias(identity.AliasAssetID, "upnp-tv"))
+	if tv, _ := registry.Get(uuid); !exists || tv.Name != "Living Room TV" || tv.RoomID != "living-room" {
+		t.Errorf("Expected the TV registered under its discovered name, got %+v", tv)
+	}
+	if devices := registry.List(); len(devices) != 2 {
+		t.Errorf("Expected two devices, got %+v", devices)
+	}
+
+	// Syncing again changes nothing
+	if err := service.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if again, _ := registry.Get(plug.UUID); !again.UpdatedAt.Equal(linked.UpdatedAt) {
+		t.Error("Expected an unchanged asset not to touch the device")
+	}
+}
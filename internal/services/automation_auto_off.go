@@ -0,0 +1,317 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// DefaultAutoOffDelay is how long a room stays empty before its motion-lit lights go off
+const DefaultAutoOffDelay = 10 * time.Minute
+
+// SetAutoOffDelay sets how long a room must stay empty before auto-off switches off the lights
+// its motion rule turned on. Room "" sets the default of rooms without a delay of their own, also
+// for rooms not seen yet; a zero delay leaves the lights on.
+func (as *AutomationService) SetAutoOffDelay(roomID string, delay time.Duration) error {
+	if delay < 0 {
+		return errors.NewValidationError(fmt.Sprintf("auto-off delay %s can't be negative", delay), nil)
+	}
+
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+	if roomID == "" {
+		as.autoOffDelay = delay
+		as.logger.Printf("AutomationService: Auto-off delay set to %s", delay)
+	} else {
+		as.roomOffDelays[roomID] = delay
+		as.logger.Printf("AutomationService: Auto-off delay of room %s set to %s", roomID, delay)
+	}
+	return nil
+}
+
+// ConfigureAutoOff sets the auto-off delays from entries like "10m" for the default and
+// "bathroom=3m" or "bedroom=0" for a room, as in HA_LIGHT_AUTO_OFF
+func (as *AutomationService) ConfigureAutoOff(entries []string) error {
+	for _, entry := range entries {
+		roomID, value, found := strings.Cut(entry, "=")
+		if !found {
+			roomID, value = "", entry
+		}
+		roomID, value = strings.TrimSpace(roomID), strings.TrimSpace(value)
+
+		delay, err := time.ParseDuration(value)
+		if value == "0" {
+			delay, err = 0, nil
+		}
+		if err != nil {
+			return errors.NewConfigError(fmt.Sprintf("invalid auto-off delay %q", entry), err)
+		}
+		if err := as.SetAutoOffDelay(roomID, delay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// autoOffDelayLocked is the auto-off delay of a room; the caller holds autoOffMutex
+func (as *AutomationService) autoOffDelayLocked(roomID string) time.Duration {
+	if delay, exists := as.roomOffDelays[roomID]; exists {
+		return delay
+	}
+	return as.autoOffDelay
+}
+
+// scheduleAutoOff (re)starts the auto-off timer of a room that became empty
+func (as *AutomationService) scheduleAutoOff(roomID string) {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+
+	if timer, exists := as.offTimers[roomID]; exists {
+		timer.Stop()
+		delete(as.offTimers, roomID)
+	}
+	delay := as.autoOffDelayLocked(roomID)
+	if delay == 0 {
+		return
+	}
+
+	// A timer stopped too late to keep it from firing finds itself replaced and does nothing
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		as.autoOffMutex.Lock()
+		current := as.offTimers[roomID] == timer
+		if current {
+			delete(as.offTimers, roomID)
+		}
+		as.autoOffMutex.Unlock()
+
+		if current {
+			as.autoOff(roomID, delay)
+		}
+	})
+	as.offTimers[roomID] = timer
+	as.logger.Printf("AutomationService: Lights in room %s go off in %s unless motion returns", roomID, delay)
+}
+
+// cancelAutoOff stops the auto-off timer of a room someone came back to
+func (as *AutomationService) cancelAutoOff(roomID string) {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+
+	if timer, exists := as.offTimers[roomID]; exists {
+		timer.Stop()
+		delete(as.offTimers, roomID)
+		as.logger.Printf("AutomationService: Motion returned to room %s, auto-off cancelled", roomID)
+	}
+}
+
+// autoOff switches off the lights the motion rule of an empty room turned on. Lights a person
+// turned on are left on.
+func (as *AutomationService) autoOff(roomID string, delay time.Duration) {
+	// The sensor may have seen motion without its callback having cancelled the timer yet
+	if occupancy, exists := as.motionService.GetRoomOccupancy(roomID); exists && occupancy.IsOccupied {
+		as.logger.Printf("AutomationService: Room %s is occupied again, leaving its lights on", roomID)
+		return
+	}
+
+	ruleID := fmt.Sprintf("motion-light-%s", roomID)
+	as.rulesMutex.RLock()
+	rule, exists := as.rules[ruleID]
+	as.rulesMutex.RUnlock()
+	if !exists {
+		return
+	}
+	if !as.safeMode.Allowed(safemode.ComponentAutomation, ruleID) {
+		as.logger.Printf("AutomationService: Safe mode active, skipping auto-off of room %s", roomID)
+		return
+	}
+
+	reason := fmt.Sprintf("room %s empty for %s", roomID, delay)
+	var switchedOff []string
+	for _, action := range rule.Actions {
+		if action.Action != "turn_on" || action.DeviceID == "" {
+			continue
+		}
+		deviceID := action.DeviceID
+
+		as.autoOffMutex.Lock()
+		automated := as.autoLights[deviceID]
+		manual := as.manualLights[deviceID]
+		as.autoOffMutex.Unlock()
+		if manual {
+			as.logger.Printf("AutomationService: Light %s was turned on by hand, auto-off leaves it on", deviceID)
+			continue
+		}
+		if !automated {
+			continue
+		}
+
+		if as.dryRun.ObserveOnly() {
+			as.dryRun.Record("automation", "turn_off", deviceID, fmt.Sprintf("rule %s: %s", ruleID, reason),
+				map[string]interface{}{
+					"rule_id": ruleID,
+					"room_id": roomID,
+				})
+			as.forgetLight(deviceID)
+			continue
+		}
+
+		command := models.DeviceCommand{
+			DeviceID: deviceID,
+			Action:   "turn_off",
+			Options: map[string]interface{}{
+				"automation": "motion-auto-off",
+				"reason":     reason,
+			},
+		}
+		if err := as.deviceService.ExecuteCommand(&command); err != nil {
+			as.logger.Printf("AutomationService: Failed to turn off %s in room %s: %v", deviceID, roomID, err)
+			continue
+		}
+		as.forgetLight(deviceID)
+		switchedOff = append(switchedOff, deviceID)
+	}
+
+	if len(switchedOff) > 0 {
+		as.logger.Printf("AutomationService: Turned off %s, %s", strings.Join(switchedOff, ", "), reason)
+		as.publishAutomationEvent(roomID, "lights_off", "room_unoccupied", map[string]interface{}{
+			"device_ids": switchedOff,
+			"delay":      delay.String(),
+		})
+	}
+}
+
+// markAutomated records a light the motion rule is turning on, so auto-off may turn it off again.
+// A light a person turned on keeps its manual override.
+func (as *AutomationService) markAutomated(deviceID string) {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+	as.autoLights[deviceID] = true
+}
+
+// forgetLight clears what is known of who turned a light on, once it is off
+func (as *AutomationService) forgetLight(deviceID string) {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+	delete(as.autoLights, deviceID)
+	delete(as.manualLights, deviceID)
+}
+
+// HandleLightState tracks a light switched on or off. A light turning on that automation didn't
+// turn on was turned on by a person: it gets the manual override flag, and auto-off leaves it on
+// until it is next turned off.
+func (as *AutomationService) HandleLightState(deviceID string, on bool) {
+	if !on {
+		as.forgetLight(deviceID)
+		return
+	}
+
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+	if as.autoLights[deviceID] || as.manualLights[deviceID] {
+		return
+	}
+	as.manualLights[deviceID] = true
+	as.logger.Printf("AutomationService: Light %s turned on by hand, manual override set", deviceID)
+}
+
+// SetManualOverride flags a light as turned on by a person, or clears the flag, e.g. from a wall
+// switch integration that knows who pressed it
+func (as *AutomationService) SetManualOverride(deviceID string, manual bool) {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+	if manual {
+		as.manualLights[deviceID] = true
+		delete(as.autoLights, deviceID)
+	} else {
+		delete(as.manualLights, deviceID)
+	}
+}
+
+// SubscribeLightStates follows the device state topics, so lights turned on by hand get the
+// manual override flag
+func (as *AutomationService) SubscribeLightStates() error {
+	return as.mqttClient.Subscribe(mqtt.DeviceStateTopic("+"), func(topic string, payload []byte) error {
+		levels := strings.Split(topic, "/")
+		if len(levels) != 4 {
+			return nil
+		}
+		on, known, err := parsePowerState(payload)
+		if err != nil {
+			return err
+		}
+		if known {
+			as.HandleLightState(levels[2], on)
+		}
+		return nil
+	})
+}
+
+// parsePowerState reads whether a device state payload says the device is on: {"power": true},
+// {"status": "on"}, {"state": "ON"} or just ON. Known is false for states without power.
+func parsePowerState(payload []byte) (on, known bool, err error) {
+	text := strings.TrimSpace(string(payload))
+	if !strings.HasPrefix(text, "{") {
+		return powerWord(strings.Trim(text, `"`))
+	}
+
+	var state struct {
+		Power  *bool  `json:"power"`
+		Status string `json:"status"`
+		State  string `json:"state"`
+	}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return false, false, errors.NewValidationError("invalid device state", err)
+	}
+	if state.Power != nil {
+		return *state.Power, true, nil
+	}
+	if state.State != "" {
+		return powerWord(state.State)
+	}
+	return powerWord(state.Status)
+}
+
+func powerWord(word string) (on, known bool, err error) {
+	switch strings.ToLower(word) {
+	case "on":
+		return true, true, nil
+	case "off":
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// autoOffStatus describes the auto-off settings for the service status
+func (as *AutomationService) autoOffStatus() map[string]interface{} {
+	as.autoOffMutex.Lock()
+	defer as.autoOffMutex.Unlock()
+
+	rooms := make(map[string]string, len(as.roomOffDelays))
+	for roomID, delay := range as.roomOffDelays {
+		rooms[roomID] = delay.String()
+	}
+	pending := make([]string, 0, len(as.offTimers))
+	for roomID := range as.offTimers {
+		pending = append(pending, roomID)
+	}
+	manual := make([]string, 0, len(as.manualLights))
+	for deviceID := range as.manualLights {
+		manual = append(manual, deviceID)
+	}
+	sort.Strings(pending)
+	sort.Strings(manual)
+	return map[string]interface{}{
+		"delay":         as.autoOffDelay.String(),
+		"room_delays":   rooms,
+		"pending_rooms": pending,
+		"manual_lights": manual,
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func newAutoOffTestService(t *testing.T) (*AutomationService, *DeviceService) {
+	t.Helper()
+	client := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	testLogger := logger.NewLogger("test", nil)
+	devices := NewDeviceService(client, nil)
+	as := NewAutomationService(NewMotionService(client, testLogger), NewLightService(client, testLogger),
+		devices, client, log.New(io.Discard, "", 0))
+
+	for _, id := range []string{"light-kitchen", "light-office"} {
+		devices.AddDevice(&models.Device{
+			ID:         id,
+			Type:       models.DeviceTypeLight,
+			Status:     "off",
+			Properties: map[string]interface{}{"power": false},
+		})
+	}
+	return as, devices
+}
+
+// setOccupied sets a room's occupancy without calling back the automation service
+func setOccupied(as *AutomationService, roomID string, occupied bool) {
+	as.motionService.mu.Lock()
+	defer as.motionService.mu.Unlock()
+	as.motionService.roomOccupancy[roomID] = &RoomOccupancy{RoomID: roomID, IsOccupied: occupied}
+}
+
+func lightStatus(t *testing.T, devices *DeviceService, id string) string {
+	t.Helper()
+	device, err := devices.GetDevice(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device.Status
+}
+
+func TestAutoOff(t *testing.T) {
+	as, devices := newAutoOffTestService(t)
+	if err := as.ConfigureAutoOff([]string{"10m", "office=1h", "bedroom=0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Motion returning before the delay ends cancels the auto-off
+	setOccupied(as, "kitchen", true)
+	as.triggerMotionLighting("kitchen")
+	if lightStatus(t, devices, "light-kitchen") != "on" {
+		t.Fatal("Expected the motion rule to turn the kitchen light on")
+	}
+	setOccupied(as, "kitchen", false)
+	as.handleMotionUpdate("kitchen", false)
+	as.handleMotionUpdate("bedroom", false)
+	if pending := as.autoOffStatus()["pending_rooms"].([]string); len(pending) != 1 || pending[0] != "kitchen" {
+		t.Fatalf("Expected only the kitchen waiting to go dark, got %v", pending)
+	}
+	setOccupied(as, "kitchen", true)
+	as.handleMotionUpdate("kitchen", true)
+	if pending := as.autoOffStatus()["pending_rooms"].([]string); len(pending) != 0 {
+		t.Errorf("Expected motion to cancel the auto-off, got %v", pending)
+	}
+
+	// The occupancy is checked again when the delay ends
+	as.autoOff("kitchen", 10*time.Minute)
+	if lightStatus(t, devices, "light-kitchen") != "on" {
+		t.Error("Expected the light left on in an occupied room")
+	}
+	setOccupied(as, "kitchen", false)
+	as.autoOff("kitchen", 10*time.Minute)
+	if lightStatus(t, devices, "light-kitchen") != "off" {
+		t.Error("Expected the kitchen light off once the room was empty for its delay")
+	}
+
+	// A light turned on by hand keeps its manual override
+	as.HandleLightState("light-office", true)
+	setOccupied(as, "office", true)
+	as.triggerMotionLighting("office")
+	setOccupied(as, "office", false)
+	as.autoOff("office", time.Hour)
+	if lightStatus(t, devices, "light-office") != "on" {
+		t.Error("Expected auto-off to leave a light turned on by hand")
+	}
+	status := as.autoOffStatus()
+	if manual := status["manual_lights"].([]string); len(manual) != 1 || manual[0] != "light-office" {
+		t.Errorf("Expected the office light flagged manual, got %v", status["manual_lights"])
+	}
+	if status["room_delays"].(map[string]string)["office"] != "1h0m0s" {
+		t.Errorf("Expected the office delay, got %v", status["room_delays"])
+	}
+	as.HandleLightState("light-office", false)
+	if manual := as.autoOffStatus()["manual_lights"].([]string); len(manual) != 0 {
+		t.Errorf("Expected the override cleared once the light is off, got %v", manual)
+	}
+
+	if err := as.ConfigureAutoOff([]string{"bedroom=soon"}); err == nil {
+		t.Error("Expected an invalid delay to be rejected")
+	}
+}
+
+func TestParsePowerState(t *testing.T) {
+	cases := map[string]struct{ on, known bool }{
+		`{"power": true}`:          {true, true},
+		`{"status": "off"}`:        {false, true},
+		`{"state": "ON"}`:          {true, true},
+		`ON`:                       {true, true},
+		`{"temperature": 21.5}`:    {false, false},
+		`{"power": false, "x": 1}`: {false, true},
+	}
+	for payload, want := range cases {
+		on, known, err := parsePowerState([]byte(payload))
+		if err != nil || on != want.on || known != want.known {
+			t.Errorf("%s: expected on=%v known=%v, got %v %v %v", payload, want.on, want.known, on, known, err)
+		}
+	}
+}
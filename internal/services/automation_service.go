@@ -7,7 +7,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
 	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
@@ -34,12 +37,35 @@ type AutomationService struct {
 	logger        *log.Logger
 
 	// Automation rules and state
-	rules      map[string]*AutomationRule
-	rulesMutex sync.RWMutex
+	rules         map[string]*AutomationRule
+	rulesMutex    sync.RWMutex
+	maxRules      int
+	rejectedRules int
 
 	// Configuration
 	motionLightCooldown time.Duration
 	darkThreshold       float64
+
+	// Safe mode holds back rule execution until re-enabled
+	safeMode *safemode.Controller
+
+	// Observe-only mode records what rules would do instead of acting
+	dryRun *dryrun.Recorder
+
+	// Per-room cooldowns and dark thresholds adapted from unwanted-activation feedback
+	tuner *MotionTuner
+
+	// Lights the motion rules turned on go off once their room has been empty for its delay,
+	// unless a person turned them on
+	autoOffDelay  time.Duration
+	roomOffDelays map[string]time.Duration
+	offTimers     map[string]*time.Timer
+	autoLights    map[string]bool // Turned on by automation, by device
+	manualLights  map[string]bool // Turned on by hand, left on by auto-off
+	autoOffMutex  sync.Mutex
+
+	// Brightness and color temperature of motion-activated lights by time of day; nil leaves them
+	adaptive *AdaptiveLighting
 }
 
 // NewAutomationService creates a new automation service
@@ -53,8 +79,16 @@ func NewAutomationService(motionService *MotionService, lightService *LightServi
 		rules:               make(map[string]*AutomationRule),
 		motionLightCooldown: 5 * time.Minute, // Prevent rapid on/off cycles
 		darkThreshold:       20.0,            // Below 20% light level is considered dark
+		autoOffDelay:        DefaultAutoOffDelay,
+		roomOffDelays:       make(map[string]time.Duration),
+		offTimers:           make(map[string]*time.Timer),
+		autoLights:          make(map[string]bool),
+		manualLights:        make(map[string]bool),
 	}
 
+	// Rooms start at the defaults until feedback adapts them
+	service.tuner, _ = NewMotionTuner("", service.motionLightCooldown, service.darkThreshold, nil)
+
 	// Register callbacks with sensor services
 	service.setupSensorCallbacks()
 
@@ -110,7 +144,10 @@ func (as *AutomationService) createDefaultRules() {
 			Cooldown: as.motionLightCooldown,
 		}
 
-		as.addRule(rule)
+		if err := as.AddRule(rule); err != nil {
+			as.logger.Printf("AutomationService: Failed to create motion-light rule for room %s: %v", roomID, err)
+			continue
+		}
 		as.logger.Printf("AutomationService: Created motion-light rule for room %s", roomID)
 	}
 }
@@ -120,11 +157,14 @@ func (as *AutomationService) handleMotionUpdate(roomID string, occupied bool) {
 	as.logger.Printf("AutomationService: Motion update - Room %s occupied: %v", roomID, occupied)
 
 	if !occupied {
-		// Room is now unoccupied - could turn off lights after delay
+		// Room is now unoccupied - turn off its lights after a delay
 		as.handleRoomUnoccupied(roomID)
 		return
 	}
 
+	// Someone came back before the lights went off
+	as.cancelAutoOff(roomID)
+
 	// Room is occupied - check if we should turn on lights
 	lightLevel, lightState := as.getCurrentLightLevel(roomID)
 
@@ -132,7 +172,7 @@ func (as *AutomationService) handleMotionUpdate(roomID string, occupied bool) {
 		roomID, lightLevel, lightState)
 
 	// If room is dark and motion detected, turn on lights
-	if lightLevel < as.darkThreshold || lightState == "dark" {
+	if lightLevel < as.tuner.DarkThreshold(roomID) || lightState == "dark" {
 		as.triggerMotionLighting(roomID)
 	} else {
 		as.logger.Printf("AutomationService: Room %s has sufficient light (%.1f%%), not turning on lights",
@@ -147,7 +187,7 @@ func (as *AutomationService) handleLightUpdate(roomID string, lightState string,
 
 	// Check if room is occupied and now dark - turn on lights
 	if occupancy, exists := as.motionService.GetRoomOccupancy(roomID); exists && occupancy.IsOccupied {
-		if lightLevel < as.darkThreshold || lightState == "dark" {
+		if lightLevel < as.tuner.DarkThreshold(roomID) || lightState == "dark" {
 			as.logger.Printf("AutomationService: Room %s became dark while occupied, turning on lights", roomID)
 			as.triggerMotionLighting(roomID)
 		}
@@ -167,26 +207,70 @@ func (as *AutomationService) triggerMotionLighting(roomID string) {
 		return
 	}
 
-	// Check cooldown to prevent rapid triggering
-	if time.Since(rule.LastTriggered) < rule.Cooldown {
-		remaining := rule.Cooldown - time.Since(rule.LastTriggered)
+	if !as.safeMode.Allowed(safemode.ComponentAutomation, ruleID) {
+		as.logger.Printf("AutomationService: Safe mode active, skipping rule %s for room %s", ruleID, roomID)
+		return
+	}
+
+	// Check cooldown to prevent rapid triggering; feedback may have lengthened the room's cooldown
+	cooldown := as.tuner.Cooldown(roomID, rule.Cooldown)
+	if time.Since(rule.LastTriggered) < cooldown {
+		remaining := cooldown - time.Since(rule.LastTriggered)
 		as.logger.Printf("AutomationService: Rule %s on cooldown, %.0f seconds remaining",
 			ruleID, remaining.Seconds())
 		return
 	}
 
+	// In observe-only mode trace the actions instead of executing them
+	if as.dryRun.ObserveOnly() {
+		for _, action := range rule.Actions {
+			as.dryRun.Record("automation", action.Action, actionTarget(action),
+				fmt.Sprintf("rule %s: motion detected in dark room %s", ruleID, roomID),
+				map[string]interface{}{
+					"rule_id": ruleID,
+					"room_id": roomID,
+				})
+			if action.Action == "turn_on" && action.DeviceID != "" {
+				as.markAutomated(action.DeviceID)
+				for _, command := range as.adaptiveCommands(roomID, action.DeviceID) {
+					as.dryRun.Record("automation", command.Action, command.DeviceID,
+						fmt.Sprintf("rule %s: adaptive lighting in room %s", ruleID, roomID),
+						map[string]interface{}{
+							"rule_id": ruleID,
+							"room_id": roomID,
+							"value":   command.Value,
+						})
+				}
+			}
+		}
+
+		as.rulesMutex.Lock()
+		rule.LastTriggered = time.Now()
+		as.rulesMutex.Unlock()
+		return
+	}
+
 	// Execute the light control action
+	activated := false
 	for _, action := range rule.Actions {
 		as.logger.Printf("AutomationService: Executing action: Turn on %s (motion detected in dark room %s)",
 			action.DeviceID, roomID)
 
+		// Marked first, so the light's own state report doesn't read as turned on by hand
+		automated := action.Action == "turn_on" && action.DeviceID != ""
+		if automated {
+			as.markAutomated(action.DeviceID)
+		}
+
 		err := as.deviceService.ExecuteCommand(&action)
 		if err != nil {
 			as.logger.Printf("AutomationService: Failed to execute light command for room %s: %v",
 				roomID, err)
+			if automated {
+				as.forgetLight(action.DeviceID)
+			}
 		} else {
-			// Send MQTT message to notify about automation
-			as.publishAutomationEvent(roomID, "lights_on", "motion_detected_dark")
+			activated = true
 
 			// Update rule trigger time
 			as.rulesMutex.Lock()
@@ -194,25 +278,29 @@ func (as *AutomationService) triggerMotionLighting(roomID string) {
 			as.rulesMutex.Unlock()
 
 			as.logger.Printf("AutomationService: Successfully turned on lights in room %s due to motion in dark conditions", roomID)
+			if automated {
+				as.adaptLight(roomID, action.DeviceID)
+			}
 		}
 	}
+
+	if activated {
+		// Send MQTT message to notify about automation; the activation ID lets the user mark it unwanted
+		lightLevel, _ := as.getCurrentLightLevel(roomID)
+		activation := as.tuner.RecordActivation(ruleID, roomID, lightLevel, cooldown, time.Now())
+		as.publishAutomationEvent(roomID, "lights_on", "motion_detected_dark", map[string]interface{}{
+			"activation_id": activation.ID,
+			"feedback":      mqtt.AutomationFeedbackTopic(roomID),
+		})
+	}
 }
 
 // handleRoomUnoccupied handles when a room becomes unoccupied
 func (as *AutomationService) handleRoomUnoccupied(roomID string) {
 	as.logger.Printf("AutomationService: Room %s is now unoccupied", roomID)
 
-	// Could implement auto-off after delay, but for now just log
-	// This prevents accidentally turning off lights when someone briefly leaves
-	go func() {
-		time.Sleep(10 * time.Minute) // Wait 10 minutes before auto-off
-
-		// Check if room is still unoccupied
-		if occupancy, exists := as.motionService.GetRoomOccupancy(roomID); exists && !occupancy.IsOccupied {
-			as.logger.Printf("AutomationService: Room %s unoccupied for 10 minutes, could auto-turn off lights", roomID)
-			// Could implement auto-off here
-		}
-	}()
+	// The delay keeps the lights on when someone briefly leaves; motion cancels it
+	as.scheduleAutoOff(roomID)
 }
 
 // getCurrentLightLevel gets the current light level for a room
@@ -226,7 +314,7 @@ func (as *AutomationService) getCurrentLightLevel(roomID string) (float64, strin
 }
 
 // publishAutomationEvent publishes automation events to MQTT
-func (as *AutomationService) publishAutomationEvent(roomID, action, reason string) {
+func (as *AutomationService) publishAutomationEvent(roomID, action, reason string, details ...map[string]interface{}) {
 	event := map[string]interface{}{
 		"room_id":   roomID,
 		"action":    action,
@@ -234,6 +322,11 @@ func (as *AutomationService) publishAutomationEvent(roomID, action, reason strin
 		"timestamp": time.Now().Unix(),
 		"service":   "automation",
 	}
+	for _, detail := range details {
+		for key, value := range detail {
+			event[key] = value
+		}
+	}
 
 	payload, err := json.Marshal(event)
 	if err != nil {
@@ -241,7 +334,7 @@ func (as *AutomationService) publishAutomationEvent(roomID, action, reason strin
 		return
 	}
 
-	topic := fmt.Sprintf("automation/%s", roomID)
+	topic := mqtt.AutomationTopic(roomID)
 	msg := &mqtt.Message{
 		Topic:   topic,
 		Payload: payload,
@@ -254,11 +347,30 @@ func (as *AutomationService) publishAutomationEvent(roomID, action, reason strin
 	}
 }
 
-// addRule adds a new automation rule
-func (as *AutomationService) addRule(rule *AutomationRule) {
+// AddRule adds a new automation rule, rejecting it once the rule limit is reached.
+// Replacing an existing rule is always allowed.
+func (as *AutomationService) AddRule(rule *AutomationRule) error {
 	as.rulesMutex.Lock()
 	defer as.rulesMutex.Unlock()
+
+	if _, exists := as.rules[rule.ID]; !exists && as.maxRules > 0 && len(as.rules) >= as.maxRules {
+		as.rejectedRules++
+		if shouldLogRejection(as.rejectedRules) {
+			as.logger.Printf("AutomationService: Rule limit of %d reached, rejecting rule %s (%d rejected)",
+				as.maxRules, rule.ID, as.rejectedRules)
+		}
+		return errors.NewBusinessError(fmt.Sprintf("rule limit of %d reached, rule %s not added", as.maxRules, rule.ID), nil)
+	}
+
 	as.rules[rule.ID] = rule
+	return nil
+}
+
+// SetMaxRules limits the number of automation rules (0 = unlimited)
+func (as *AutomationService) SetMaxRules(limit int) {
+	as.rulesMutex.Lock()
+	defer as.rulesMutex.Unlock()
+	as.maxRules = limit
 }
 
 // GetRule returns a specific automation rule
@@ -281,6 +393,70 @@ func (as *AutomationService) GetAllRules() map[string]*AutomationRule {
 	return rules
 }
 
+// RunRule executes a rule's actions now, e.g. from a schedule or the API.
+// Safe mode, observe-only mode and the rule's cooldown apply as for sensor-triggered rules.
+func (as *AutomationService) RunRule(id, reason string) error {
+	as.rulesMutex.RLock()
+	rule, exists := as.rules[id]
+	as.rulesMutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("rule %s not found", id)
+	}
+	if !rule.Enabled {
+		return errors.NewBusinessError(fmt.Sprintf("rule %s is disabled", id), nil)
+	}
+	if !as.safeMode.Allowed(safemode.ComponentAutomation, id) {
+		return errors.NewBusinessError(fmt.Sprintf("safe mode active: rule %s is not enabled", id), nil)
+	}
+	if time.Since(rule.LastTriggered) < rule.Cooldown {
+		return errors.NewBusinessError(fmt.Sprintf("rule %s is on cooldown", id), nil)
+	}
+
+	// Check every action first so a rule never runs half way
+	for _, action := range rule.Actions {
+		if err := as.deviceService.ValidateCommand(&action); err != nil {
+			return err
+		}
+	}
+
+	if as.dryRun.ObserveOnly() {
+		for _, action := range rule.Actions {
+			as.dryRun.Record("automation", action.Action, actionTarget(action),
+				fmt.Sprintf("rule %s: %s", id, reason),
+				map[string]interface{}{"rule_id": id})
+		}
+	} else {
+		var failed int
+		for _, action := range rule.Actions {
+			as.logger.Printf("AutomationService: Rule %s executing %s on %s (%s)", id, action.Action, actionTarget(action), reason)
+			if err := as.deviceService.ExecuteCommand(&action); err != nil {
+				as.logger.Printf("AutomationService: Rule %s failed to execute %s on %s: %v", id, action.Action, actionTarget(action), err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return errors.NewBusinessError(fmt.Sprintf("%d of %d actions of rule %s failed", failed, len(rule.Actions), id), nil)
+		}
+		if rule.RoomID != "" {
+			as.publishAutomationEvent(rule.RoomID, "run_rule", reason)
+		}
+	}
+
+	as.rulesMutex.Lock()
+	rule.LastTriggered = time.Now()
+	as.rulesMutex.Unlock()
+	return nil
+}
+
+// actionTarget describes what an action addresses, for logs and dry-run traces
+func actionTarget(action models.DeviceCommand) string {
+	if action.DeviceID == "" && action.Tag != "" {
+		return "tag:" + action.Tag
+	}
+	return action.DeviceID
+}
+
 // EnableRule enables or disables a specific rule
 func (as *AutomationService) EnableRule(id string, enabled bool) error {
 	as.rulesMutex.Lock()
@@ -301,9 +477,59 @@ func (as *AutomationService) EnableRule(id string, enabled bool) error {
 	return nil
 }
 
+// SetSafeMode attaches a safe mode controller that gates rule execution
+func (as *AutomationService) SetSafeMode(controller *safemode.Controller) {
+	as.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces rule actions in observe-only mode
+func (as *AutomationService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	as.dryRun = recorder
+}
+
+// SetMotionTuner replaces the in-memory tuner, e.g. with one persisted in the state directory
+func (as *AutomationService) SetMotionTuner(tuner *MotionTuner) {
+	if tuner != nil {
+		as.tuner = tuner
+	}
+}
+
+// MotionTuner returns the tuner adapting motion-light rules, for its report and feedback handlers
+func (as *AutomationService) MotionTuner() *MotionTuner {
+	return as.tuner
+}
+
+// SubscribeFeedback marks activations unwanted from messages on the automation feedback topics,
+// e.g. sent by a dashboard or chat bot button
+func (as *AutomationService) SubscribeFeedback() error {
+	return as.mqttClient.Subscribe(mqtt.AutomationFeedbackTopic("+"), func(topic string, payload []byte) error {
+		var feedback MotionFeedback
+		if err := json.Unmarshal(payload, &feedback); err != nil {
+			return errors.NewValidationError("invalid automation feedback", err)
+		}
+		return as.handleFeedback(feedback)
+	})
+}
+
+func (as *AutomationService) handleFeedback(feedback MotionFeedback) error {
+	change, err := as.tuner.MarkUnwanted(feedback.ActivationID, feedback.Reason, time.Now())
+	if err != nil {
+		as.logger.Printf("AutomationService: Failed to apply feedback on %s: %v", feedback.ActivationID, err)
+		return err
+	}
+	if change == nil {
+		as.logger.Printf("AutomationService: Activation %s marked unwanted, its room is already at the tuning limits", feedback.ActivationID)
+		return nil
+	}
+	as.logger.Printf("AutomationService: Activation %s marked unwanted, %s of room %s adapted from %s to %s",
+		feedback.ActivationID, change.Parameter, change.RoomID, change.From, change.To)
+	return nil
+}
+
 // SetDarkThreshold sets the light level threshold for considering a room "dark"
 func (as *AutomationService) SetDarkThreshold(threshold float64) {
 	as.darkThreshold = threshold
+	as.tuner.SetDefaultDarkThreshold(threshold)
 	as.logger.Printf("AutomationService: Dark threshold set to %.1f%%", threshold)
 }
 
@@ -326,7 +552,14 @@ func (as *AutomationService) GetStatus() map[string]interface{} {
 		"status":          "active",
 		"total_rules":     totalRules,
 		"enabled_rules":   enabledRules,
+		"max_rules":       as.maxRules,
+		"rejected_rules":  as.rejectedRules,
 		"dark_threshold":  as.darkThreshold,
 		"motion_cooldown": as.motionLightCooldown.String(),
+		"tuned_rooms":     len(as.tuner.Report().Rooms),
+		"safe_mode":       as.safeMode.Active(),
+		"observe_only":    as.dryRun.ObserveOnly(),
+		"auto_off":        as.autoOffStatus(),
+		"adaptive":        as.adaptiveStatus(),
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/internal/models"
 	"github.com/johnpr01/home-automation/pkg/kafka"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
@@ -15,7 +16,7 @@ import (
 
 func TestAutomationService_MotionActivatedLighting(t *testing.T) {
 	// Create test logger
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 
 	// Create mock MQTT client
 	mqttConfig := &config.MQTTConfig{
@@ -28,10 +29,10 @@ func TestAutomationService_MotionActivatedLighting(t *testing.T) {
 	kafkaClient := kafka.NewClient([]string{"localhost:9092"}, "test-logs", nil)
 
 	// Create services
-	motionService := NewMotionService(mqttClient, logger)
-	lightService := NewLightService(mqttClient, logger)
+	motionService := NewMotionService(mqttClient, testLogger)
+	lightService := NewLightService(mqttClient, testLogger)
 	deviceService := NewDeviceService(mqttClient, kafkaClient)
-	automationService := NewAutomationService(motionService, lightService, deviceService, mqttClient, logger)
+	automationService := NewAutomationService(motionService, lightService, deviceService, mqttClient, log.New(os.Stdout, "[TEST] ", log.LstdFlags))
 
 	// Add a test light device (using one of the default room names)
 	lightDevice := &models.Device{
@@ -234,7 +235,7 @@ func TestAutomationService_MotionActivatedLighting(t *testing.T) {
 
 func TestAutomationService_CooldownLogic(t *testing.T) {
 	// Test cooldown logic to ensure lights don't rapidly cycle
-	logger := log.New(os.Stdout, "[TEST-COOLDOWN] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test-cooldown", nil)
 
 	mqttConfig := &config.MQTTConfig{
 		Broker: "localhost",
@@ -243,10 +244,10 @@ func TestAutomationService_CooldownLogic(t *testing.T) {
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 	kafkaClient := kafka.NewClient([]string{"localhost:9092"}, "test-logs", nil)
 
-	motionService := NewMotionService(mqttClient, logger)
-	lightService := NewLightService(mqttClient, logger)
+	motionService := NewMotionService(mqttClient, testLogger)
+	lightService := NewLightService(mqttClient, testLogger)
 	deviceService := NewDeviceService(mqttClient, kafkaClient)
-	automationService := NewAutomationService(motionService, lightService, deviceService, mqttClient, logger)
+	automationService := NewAutomationService(motionService, lightService, deviceService, mqttClient, log.New(os.Stdout, "[TEST-COOLDOWN] ", log.LstdFlags))
 
 	// Add test light device
 	lightDevice := &models.Device{
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/ble"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/utils"
+)
+
+const (
+	// defaultBLEPublish spaces the readings of a thermometer advertising every few seconds
+	defaultBLEPublish = time.Minute
+	bleScanRetry      = 30 * time.Second
+)
+
+// BLESensor is a Bluetooth LE thermometer and the room it measures
+type BLESensor struct {
+	ID      string  `json:"id"`
+	Address string  `json:"address"` // e.g. A4:C1:38:12:34:56
+	RoomID  string  `json:"room_id"`
+	OffsetF float64 `json:"offset_f,omitempty"` // Calibration added to every temperature
+}
+
+// BLESensorConfig lists the thermometers listened for
+type BLESensorConfig struct {
+	Adapter        int         `json:"adapter,omitempty"`         // The N of hciN, 0 by default
+	PublishSeconds int         `json:"publish_seconds,omitempty"` // 60 by default
+	Sensors        []BLESensor `json:"sensors"`
+}
+
+// LoadBLESensorConfig reads the BLE thermometers from a JSON file
+func LoadBLESensorConfig(path string) (*BLESensorConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read BLE sensors file", err)
+	}
+
+	var cfg BLESensorConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse BLE sensors file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that sensor IDs and addresses are unique and every sensor has a room
+func (c *BLESensorConfig) Validate() error {
+	if c.Adapter < 0 || c.PublishSeconds < 0 {
+		return errors.NewValidationError("adapter and publish_seconds must not be negative", nil)
+	}
+
+	ids, addresses := make(map[string]bool), make(map[string]bool)
+	for i := range c.Sensors {
+		sensor := &c.Sensors[i]
+		if sensor.ID == "" || sensor.RoomID == "" || sensor.Address == "" {
+			return errors.NewValidationError("every BLE sensor needs an ID, an address and a room", nil)
+		}
+		sensor.Address = ble.NormalizeAddress(sensor.Address)
+		if ids[sensor.ID] || addresses[sensor.Address] {
+			return errors.NewValidationError(fmt.Sprintf("BLE sensor %s is defined twice", sensor.ID), nil)
+		}
+		ids[sensor.ID], addresses[sensor.Address] = true, true
+	}
+	return nil
+}
+
+// BLESensorStatus is the last reading of a BLE thermometer
+type BLESensorStatus struct {
+	ID             string    `json:"id"`
+	Address        string    `json:"address"`
+	RoomID         string    `json:"room_id"`
+	Format         string    `json:"format,omitempty"` // bthome, mibeacon, atc, pvvx or switchbot
+	TemperatureF   *float64  `json:"temperature_f,omitempty"`
+	Humidity       *float64  `json:"humidity,omitempty"`
+	BatteryPercent *float64  `json:"battery_percent,omitempty"`
+	RSSI           int       `json:"rssi,omitempty"`
+	LastSeen       time.Time `json:"last_seen,omitempty"`
+	Error          string    `json:"error,omitempty"` // Why its advertisements can't be read
+}
+
+// BLESensorService listens for the advertisements of Bluetooth LE thermometers and publishes
+// their readings on the room-temp and room-hum topics, like a Pico in the room would
+type BLESensorService struct {
+	config      *BLESensorConfig
+	interval    time.Duration
+	logger      *logger.Logger
+	publish     func(*mqtt.Message) error
+	scan        func(ctx context.Context, adapter int, handle func(ble.Advertisement)) error
+	sensors     map[string]BLESensor // By address
+	status      map[string]*BLESensorStatus
+	lastPublish map[string]time.Time
+	mu          sync.Mutex
+}
+
+// NewBLESensorService creates a service listening for the configured thermometers
+func NewBLESensorService(cfg *BLESensorConfig, serviceLogger *logger.Logger) *BLESensorService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("BLESensorService", nil)
+	}
+
+	service := &BLESensorService{
+		config:      cfg,
+		interval:    defaultBLEPublish,
+		logger:      serviceLogger,
+		scan:        ble.Scan,
+		sensors:     make(map[string]BLESensor),
+		status:      make(map[string]*BLESensorStatus),
+		lastPublish: make(map[string]time.Time),
+	}
+	if cfg.PublishSeconds > 0 {
+		service.interval = time.Duration(cfg.PublishSeconds) * time.Second
+	}
+	for _, sensor := range cfg.Sensors {
+		service.sensors[sensor.Address] = sensor
+		service.status[sensor.ID] = &BLESensorStatus{ID: sensor.ID, Address: sensor.Address, RoomID: sensor.RoomID}
+	}
+	return service
+}
+
+// SetMQTTClient sets the client readings are published with
+func (s *BLESensorService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// Run scans until ctx is done, starting again 30 seconds after the adapter fails
+func (s *BLESensorService) Run(ctx context.Context) {
+	var lastError string
+	for {
+		err := s.scan(ctx, s.config.Adapter, func(adv ble.Advertisement) {
+			s.HandleAdvertisement(adv, time.Now())
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && err.Error() != lastError {
+			s.logger.Error("Bluetooth LE scan failed, retrying", err, map[string]interface{}{"adapter": s.config.Adapter})
+			lastError = err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(bleScanRetry):
+		}
+	}
+}
+
+// HandleAdvertisement records the reading of a configured thermometer, publishing it at most
+// every PublishSeconds. Thermometers sending temperature and humidity in separate frames publish
+// the latest of each.
+func (s *BLESensorService) HandleAdvertisement(adv ble.Advertisement, now time.Time) {
+	sensor, known := s.sensors[ble.NormalizeAddress(adv.Address)]
+	if !known {
+		return
+	}
+	reading, err := ble.Decode(adv)
+	if err == ble.ErrNoReading {
+		return
+	}
+
+	s.mu.Lock()
+	status := s.status[sensor.ID]
+	status.RSSI = adv.RSSI
+	status.LastSeen = now
+	if err != nil {
+		if status.Error != err.Error() {
+			s.logger.Warn("BLE sensor advertisements can't be read", map[string]interface{}{
+				"sensor_id": sensor.ID,
+				"error":     err.Error(),
+			})
+		}
+		status.Error = err.Error()
+		s.mu.Unlock()
+		return
+	}
+
+	status.Format, status.Error = reading.Format, ""
+	if reading.TemperatureC != nil {
+		temperature := math.Round((utils.CelsiusToFahrenheit(*reading.TemperatureC)+sensor.OffsetF)*100) / 100
+		status.TemperatureF = &temperature
+	}
+	if reading.Humidity != nil {
+		humidity := math.Round(*reading.Humidity*10) / 10
+		status.Humidity = &humidity
+	}
+	if reading.BatteryPercent != nil {
+		status.BatteryPercent = reading.BatteryPercent
+	}
+
+	due := status.TemperatureF != nil && now.Sub(s.lastPublish[sensor.ID]) >= s.interval
+	var messages []*mqtt.Message
+	if due && s.publish != nil {
+		s.lastPublish[sensor.ID] = now
+		sensorType := "ble-" + status.Format
+		temperature := UnifiedSensorMessage{Temperature: *status.TemperatureF, TempUnit: "F"}
+		if msg, err := roomSensorMessage(mqtt.TopicRoomTemperature, sensor.RoomID, sensorType, sensor.ID, temperature, now); err == nil {
+			messages = append(messages, msg)
+		}
+		if status.Humidity != nil {
+			humidity := UnifiedSensorMessage{Humidity: *status.Humidity, HumidityUnit: "%"}
+			if msg, err := roomSensorMessage(mqtt.TopicRoomHumidity, sensor.RoomID, sensorType, sensor.ID, humidity, now); err == nil {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, msg := range messages {
+		if err := s.publish(msg); err != nil {
+			s.logger.Error("Failed to publish BLE sensor reading", err, map[string]interface{}{
+				"sensor_id": sensor.ID,
+				"topic":     msg.Topic,
+			})
+		}
+	}
+}
+
+// Status returns the last reading of every sensor, sorted by ID
+func (s *BLESensorService) Status() []BLESensorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]BLESensorStatus, 0, len(s.status))
+	for _, status := range s.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Handler serves the BLE sensors and their last readings as JSON
+func (s *BLESensorService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sensors": s.Status(),
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/ble"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestBLESensorsPublishRoomReadings(t *testing.T) {
+	cfg := &BLESensorConfig{Sensors: []BLESensor{
+		{ID: "bedroom-thermometer", Address: "a4-c1-38-12-34-56", RoomID: "bedroom", OffsetF: 0.5},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	service := NewBLESensorService(cfg, nil)
+	messages := make(map[string]UnifiedSensorMessage)
+	service.publish = func(msg *mqtt.Message) error {
+		var message UnifiedSensorMessage
+		json.Unmarshal(msg.Payload, &message)
+		messages[msg.Topic] = message
+		return nil
+	}
+
+	// BTHome: 21 C, 45.5 %, battery 80 %
+	bthome := func(address string) ble.Advertisement {
+		return ble.Advertisement{Address: address, RSSI: -70, ServiceData: map[uint16][]byte{
+			0xfcd2: {0x40, 0x01, 0x50, 0x02, 0x34, 0x08, 0x03, 0xc6, 0x11},
+		}}
+	}
+	now := time.Now()
+	service.HandleAdvertisement(bthome("11:22:33:44:55:66"), now)
+	if len(messages) != 0 {
+		t.Fatalf("Expected unknown thermometers ignored, got %v", messages)
+	}
+
+	service.HandleAdvertisement(bthome("A4:C1:38:12:34:56"), now)
+	if temperature := messages["room-temp/bedroom"]; temperature.Temperature != 70.3 || temperature.Sensor != "ble-bthome" || temperature.DeviceID != "bedroom-thermometer" {
+		t.Errorf("Expected the calibrated temperature for the bedroom, got %+v", temperature)
+	}
+	if humidity := messages["room-hum/bedroom"]; humidity.Humidity != 45.5 {
+		t.Errorf("Expected the bedroom humidity, got %+v", humidity)
+	}
+
+	// Advertisements every few seconds are published once a minute
+	delete(messages, "room-temp/bedroom")
+	service.HandleAdvertisement(bthome("A4:C1:38:12:34:56"), now.Add(10*time.Second))
+	if _, published := messages["room-temp/bedroom"]; published {
+		t.Error("Expected readings within a minute of the last held back")
+	}
+	service.HandleAdvertisement(bthome("A4:C1:38:12:34:56"), now.Add(time.Minute))
+	if _, published := messages["room-temp/bedroom"]; !published {
+		t.Error("Expected a reading a minute later published")
+	}
+
+	// An encrypted thermometer is reported rather than published
+	service.HandleAdvertisement(ble.Advertisement{Address: "A4:C1:38:12:34:56", ServiceData: map[uint16][]byte{
+		0xfe95: {0x58, 0x58, 0x5b, 0x05, 0x01, 0x00},
+	}}, now.Add(2*time.Minute))
+	status := service.Status()[0]
+	if status.Error == "" || status.Format != "bthome" || *status.BatteryPercent != 80 || status.RSSI != 0 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestBLESensorConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensors []BLESensor
+		valid   bool
+	}{
+		{"no room", []BLESensor{{ID: "a", Address: "A4:C1:38:00:00:01"}}, false},
+		{"no address", []BLESensor{{ID: "a", RoomID: "bedroom"}}, false},
+		{"duplicate address", []BLESensor{
+			{ID: "a", Address: "A4:C1:38:00:00:01", RoomID: "bedroom"},
+			{ID: "b", Address: "a4:c1:38:00:00:01", RoomID: "office"},
+		}, false},
+		{"valid", []BLESensor{{ID: "a", Address: "A4:C1:38:00:00:01", RoomID: "bedroom"}}, true},
+	}
+
+	for _, test := range tests {
+		cfg := BLESensorConfig{Sensors: test.sensors}
+		if err := cfg.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
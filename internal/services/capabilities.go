@@ -0,0 +1,125 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+// actionCapabilities maps actions to the capability a device must report to perform them.
+// Actions not listed, such as turn_on and turn_off, need no particular capability.
+var actionCapabilities = map[string]discovery.AssetCapability{
+	"set_brightness":  discovery.CapabilityDimmer,
+	"set_color":       discovery.CapabilityColor,
+	"set_color_temp":  discovery.CapabilityColor,
+	"get_energy":      discovery.CapabilityEnergyMonitor,
+	"set_temperature": discovery.CapabilityThermostatCtrl,
+}
+
+// RequiredCapability returns the capability an action needs, if any
+func RequiredCapability(action string) (discovery.AssetCapability, bool) {
+	capability, exists := actionCapabilities[action]
+	return capability, exists
+}
+
+// hasCapability reports whether a device reports a capability.
+// Devices that report no capabilities at all are not negotiated with.
+func hasCapability(device *models.Device, capability discovery.AssetCapability) bool {
+	if len(device.Capabilities) == 0 {
+		return true
+	}
+	for _, candidate := range device.Capabilities {
+		if strings.EqualFold(candidate, string(capability)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports reports whether a device can perform an action without degrading it. Like command
+// negotiation, it counts devices that report no capabilities as able.
+func (s *DeviceService) Supports(deviceID, action string) bool {
+	device, err := s.GetDevice(deviceID)
+	if err != nil {
+		return false
+	}
+	capability, needed := RequiredCapability(action)
+	return !needed || hasCapability(device, capability)
+}
+
+// degradeCommand returns a simpler command that approximates cmd, e.g. turn_on instead of set_brightness
+func degradeCommand(cmd *models.DeviceCommand) (*models.DeviceCommand, bool) {
+	degraded := *cmd
+	degraded.Value = nil
+
+	switch cmd.Action {
+	case "set_brightness":
+		if value, ok := cmd.Value.(float64); ok && value <= 0 {
+			degraded.Action = "turn_off"
+		} else {
+			degraded.Action = "turn_on"
+		}
+	case "set_color", "set_color_temp":
+		degraded.Action = "turn_on"
+	default:
+		return nil, false
+	}
+
+	return &degraded, true
+}
+
+// negotiateCapability checks that the device can perform cmd. It returns the command to
+// execute, which is a degraded one when the device lacks the capability and fallback is allowed.
+func (s *DeviceService) negotiateCapability(device *models.Device, cmd *models.DeviceCommand) (*models.DeviceCommand, error) {
+	capability, needed := RequiredCapability(cmd.Action)
+	if !needed || hasCapability(device, capability) {
+		return cmd, nil
+	}
+
+	fallback := s.capabilityFallback
+	if option, ok := cmd.Options["fallback"].(bool); ok {
+		fallback = option
+	}
+
+	degraded, degradable := degradeCommand(cmd)
+	if fallback && degradable {
+		return degraded, nil
+	}
+
+	hint := "choose a device that reports it"
+	if degradable {
+		hint = fmt.Sprintf("use %s instead, or enable capability fallback (HA_CAPABILITY_FALLBACK=true or the fallback command option)", degraded.Action)
+	}
+
+	return nil, errors.NewValidationError(
+		fmt.Sprintf("device %s cannot %s: it does not report the %q capability (reports: %s); %s",
+			device.ID, cmd.Action, capability, strings.Join(device.Capabilities, ", "), hint), nil).
+		WithDevice(device.ID)
+}
+
+// ValidateCommand checks a command against the capabilities of its target devices without executing it
+func (s *DeviceService) ValidateCommand(cmd *models.DeviceCommand) error {
+	var devices []*models.Device
+	if cmd.DeviceID == "" && cmd.Tag != "" {
+		devices = s.GetDevicesByTag(cmd.Tag)
+		if len(devices) == 0 {
+			return errors.NewValidationError(fmt.Sprintf("no devices tagged %s", cmd.Tag), nil)
+		}
+	} else {
+		device, err := s.GetDevice(cmd.DeviceID)
+		if err != nil {
+			return errors.NewValidationError(fmt.Sprintf("device %s not found", cmd.DeviceID), err).WithDevice(cmd.DeviceID)
+		}
+		devices = []*models.Device{device}
+	}
+
+	for _, device := range devices {
+		if _, err := s.negotiateCapability(device, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/ocpp"
+)
+
+// EVChargerFileName holds which chargers are paused, and their meter at the start of the day
+const EVChargerFileName = "ev-chargers.json"
+
+const (
+	defaultMeterSampleSeconds = 30
+	chargerRequestTimeout     = 30 * time.Second
+	// Connector status of a charger delivering power
+	chargerStatusCharging = "Charging"
+)
+
+// EVCharger is a charger connecting over OCPP 1.6J
+type EVCharger struct {
+	ID          string `json:"id"` // Charge point identity, the end of the URL it connects to
+	Name        string `json:"name,omitempty"`
+	RoomID      string `json:"room_id,omitempty"`      // Room its energy counts towards
+	ConnectorID int    `json:"connector_id,omitempty"` // 1 by default
+	// Password is checked with HTTP basic authentication when set
+	Password string `json:"password,omitempty"`
+}
+
+// ChargerConfig lists the EV chargers allowed to connect
+type ChargerConfig struct {
+	Chargers []EVCharger `json:"chargers"`
+	// MeterSampleSeconds is how often chargers send meter values, set as they boot; 30 by default
+	MeterSampleSeconds int `json:"meter_sample_seconds,omitempty"`
+}
+
+// LoadChargerConfig reads the EV chargers from a JSON file
+func LoadChargerConfig(path string) (*ChargerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read EV charger file", err)
+	}
+
+	var cfg ChargerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse EV charger file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the chargers, filling in the defaults
+func (c *ChargerConfig) Validate() error {
+	if len(c.Chargers) == 0 {
+		return errors.NewValidationError("the EV charger file lists no chargers", nil)
+	}
+	if c.MeterSampleSeconds < 0 {
+		return errors.NewValidationError("meter_sample_seconds must not be negative", nil)
+	}
+	if c.MeterSampleSeconds == 0 {
+		c.MeterSampleSeconds = defaultMeterSampleSeconds
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Chargers {
+		charger := &c.Chargers[i]
+		if charger.ID == "" || seen[charger.ID] {
+			return errors.NewValidationError("every EV charger needs a unique id", nil)
+		}
+		seen[charger.ID] = true
+		if charger.ConnectorID < 0 {
+			return errors.NewValidationError(fmt.Sprintf("EV charger %s: connector_id must not be negative", charger.ID), nil)
+		}
+		if charger.ConnectorID == 0 {
+			charger.ConnectorID = 1
+		}
+		if charger.Name == "" {
+			charger.Name = charger.ID
+		}
+	}
+	return nil
+}
+
+// ChargerStatus is the state of a charger's connector
+type ChargerStatus struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	RoomID    string    `json:"room_id,omitempty"`
+	Connected bool      `json:"connected"`
+	Vendor    string    `json:"vendor,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Status    string    `json:"status,omitempty"` // OCPP connector status, e.g. Charging or SuspendedEVSE
+	ErrorCode string    `json:"error_code,omitempty"`
+	PowerW    float64   `json:"power_w"`
+	MeterWh   float64   `json:"meter_wh"`             // The charger's energy register
+	SessionWh float64   `json:"session_wh,omitempty"` // Energy of the current or last charge
+	Paused    bool      `json:"paused"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// ChargePointControl pauses, resumes and configures chargers; ocpp.Server implements it
+type ChargePointControl interface {
+	Pause(ctx context.Context, chargePointID string, connectorID int) error
+	Resume(ctx context.Context, chargePointID string, connectorID int) error
+	Configure(ctx context.Context, chargePointID, key, value string) error
+}
+
+// chargerState is the persisted state of a charger
+type chargerState struct {
+	Paused     bool    `json:"paused"`
+	Day        string  `json:"day,omitempty"` // 2006-01-02
+	DayStartWh float64 `json:"day_start_wh,omitempty"`
+}
+
+// ChargerService runs an OCPP central system for EV chargers. Their meter values become energy
+// readings, like a Tapo plug's, and pausing a charger sets a 0 A charging profile on it, so
+// peak shaving and grid rules can name a charger as a load.
+type ChargerService struct {
+	config    *ChargerConfig
+	path      string
+	server    *ocpp.Server
+	control   ChargePointControl
+	chargers  map[string]*ChargerStatus
+	state     map[string]*chargerState
+	sessionWh map[string]float64 // Meter at the start of the charge
+	callbacks []func(EnergyReading)
+	safeMode  *safemode.Controller
+	dryRun    *dryrun.Recorder
+	logger    *logger.Logger
+	mu        sync.Mutex
+
+	power     *prometheus.GaugeVec
+	meter     *prometheus.GaugeVec
+	paused    *prometheus.GaugeVec
+	connected *prometheus.GaugeVec
+}
+
+// NewChargerService creates the OCPP central system for a validated configuration. Pauses are
+// kept at path, or in memory if empty.
+func NewChargerService(cfg *ChargerConfig, path string, serviceLogger *logger.Logger) *ChargerService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ChargerService", nil)
+	}
+
+	passwords := make(map[string]string)
+	for _, charger := range cfg.Chargers {
+		passwords[charger.ID] = charger.Password
+	}
+	service := &ChargerService{
+		config:    cfg,
+		path:      path,
+		server:    ocpp.NewServer(passwords),
+		chargers:  make(map[string]*ChargerStatus),
+		state:     make(map[string]*chargerState),
+		sessionWh: make(map[string]float64),
+		logger:    serviceLogger,
+		power: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ev_charger_power_watts",
+			Help: "Power drawn by the EV charger",
+		}, []string{"charger"}),
+		meter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ev_charger_energy_wh",
+			Help: "Energy register of the EV charger",
+		}, []string{"charger"}),
+		paused: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ev_charger_paused",
+			Help: "Whether the EV charger is paused (1) or allowed to charge (0)",
+		}, []string{"charger"}),
+		connected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ev_charger_connected",
+			Help: "Whether the EV charger is connected to the central system",
+		}, []string{"charger"}),
+	}
+	service.control = service.server
+	service.server.AddEventCallback(service.HandleEvent)
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load EV charger state, pauses are not restored", err)
+		}
+	}
+	for _, charger := range cfg.Chargers {
+		service.chargers[charger.ID] = &ChargerStatus{ID: charger.ID, Name: charger.Name, RoomID: charger.RoomID}
+		if service.state[charger.ID] == nil {
+			service.state[charger.ID] = &chargerState{}
+		}
+		service.chargers[charger.ID].Paused = service.state[charger.ID].Paused
+		service.updateMetrics(service.chargers[charger.ID])
+	}
+	return service
+}
+
+// EVChargerPath returns the charger state file inside the state directory
+func EVChargerPath(stateDir string) string {
+	return filepath.Join(stateDir, EVChargerFileName)
+}
+
+// RegisterMetrics registers the charger metrics
+func (s *ChargerService) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.power, s.meter, s.paused, s.connected} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register EV charger metrics", err)
+		}
+	}
+	return nil
+}
+
+// SetSafeMode attaches a safe mode controller that blocks pausing and resuming chargers
+func (s *ChargerService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces pauses and resumes in observe-only mode
+func (s *ChargerService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// AddReadingCallback registers a callback for every charger energy reading, like TapoService's.
+// The reading's energy is a daily counter, and IsOn reports whether the charger may charge.
+func (s *ChargerService) AddReadingCallback(callback func(reading EnergyReading)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// OCPPHandler serves the chargers' WebSocket; chargers connect to its path followed by their ID
+func (s *ChargerService) OCPPHandler() http.Handler {
+	return s.server.Handler()
+}
+
+// Has reports whether a device ID is a configured charger
+func (s *ChargerService) Has(deviceID string) bool {
+	_, exists := s.charger(deviceID)
+	return exists
+}
+
+// HandleEvent follows a charger's connection, status and meter
+func (s *ChargerService) HandleEvent(event ocpp.Event) {
+	charger, exists := s.charger(event.ChargePointID)
+	if !exists {
+		return
+	}
+	if event.ConnectorID != 0 && event.ConnectorID != charger.ConnectorID {
+		return
+	}
+
+	s.mu.Lock()
+	status := s.chargers[charger.ID]
+	status.UpdatedAt = event.Time
+	var reading *EnergyReading
+
+	switch event.Action {
+	case ocpp.ActionConnected:
+		status.Connected = true
+		// Apply the pause, or its absence, once the charger's reader is free to answer
+		go s.apply(charger)
+	case ocpp.ActionDisconnected:
+		status.Connected, status.PowerW = false, 0
+	case "BootNotification":
+		status.Vendor, status.Model = event.Vendor, event.Model
+		go s.configure(charger)
+	case "StatusNotification":
+		if event.ConnectorID == 0 {
+			break // The charger as a whole
+		}
+		status.Status, status.ErrorCode = event.Status, event.ErrorCode
+		if event.ErrorCode == "NoError" {
+			status.ErrorCode = ""
+		}
+		if event.Status != chargerStatusCharging {
+			status.PowerW = 0
+		}
+	case "StartTransaction":
+		if event.EnergyWh != nil {
+			s.sessionWh[charger.ID] = *event.EnergyWh
+			status.SessionWh = 0
+		}
+	case "StopTransaction", "MeterValues":
+		if event.EnergyWh != nil {
+			status.MeterWh = *event.EnergyWh
+			if start, charging := s.sessionWh[charger.ID]; charging && *event.EnergyWh >= start {
+				status.SessionWh = *event.EnergyWh - start
+			}
+		}
+		if event.Action == "StopTransaction" {
+			delete(s.sessionWh, charger.ID)
+			status.PowerW = 0
+		} else if event.PowerW != nil {
+			status.PowerW = *event.PowerW
+		}
+		if event.EnergyWh != nil || event.PowerW != nil {
+			reading = s.reading(charger, status, event.Time)
+		}
+	}
+	s.updateMetrics(status)
+	callbacks := append([]func(EnergyReading){}, s.callbacks...)
+	s.mu.Unlock()
+
+	if reading != nil {
+		for _, callback := range callbacks {
+			callback(*reading)
+		}
+	}
+}
+
+// reading turns a charger's status into an energy reading whose energy counts from the start of
+// the day; the caller holds the lock
+func (s *ChargerService) reading(charger EVCharger, status *ChargerStatus, at time.Time) *EnergyReading {
+	state := s.state[charger.ID]
+	if day := at.Format("2006-01-02"); state.Day != day || status.MeterWh < state.DayStartWh {
+		state.Day, state.DayStartWh = day, status.MeterWh
+		s.save()
+	}
+	return &EnergyReading{
+		DeviceID:   charger.ID,
+		DeviceName: charger.Name,
+		RoomID:     charger.RoomID,
+		Tags:       []string{"ev-charger"},
+		PowerW:     status.PowerW,
+		EnergyWh:   status.MeterWh - state.DayStartWh,
+		IsOn:       !state.Paused,
+		Timestamp:  at,
+	}
+}
+
+// SetCharging pauses (false) or resumes (true) a charger; it fits where a plug is switched
+func (s *ChargerService) SetCharging(deviceID string, on bool) error {
+	charger, exists := s.charger(deviceID)
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("unknown EV charger %s", deviceID), nil)
+	}
+	if !s.safeMode.Allowed(safemode.ComponentDevice, deviceID) {
+		return errors.NewBusinessError(fmt.Sprintf("Safe mode active, EV charger %s not paused or resumed", deviceID), nil)
+	}
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("ev-charger", "set_charging", deviceID, "charger pause or resume requested", map[string]interface{}{"charging": on})
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chargerRequestTimeout)
+	defer cancel()
+	var err error
+	if on {
+		err = s.control.Resume(ctx, charger.ID, charger.ConnectorID)
+	} else {
+		err = s.control.Pause(ctx, charger.ID, charger.ConnectorID)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.state[charger.ID].Paused = !on
+	s.chargers[charger.ID].Paused = !on
+	s.updateMetrics(s.chargers[charger.ID])
+	s.save()
+	s.mu.Unlock()
+
+	s.logger.Info("Set EV charger", map[string]interface{}{"charger": charger.ID, "charging": on})
+	return nil
+}
+
+// switchLoad pauses or resumes a device that's an EV charger, and switches a plug otherwise
+func switchLoad(chargers *ChargerService, switchPlug func(deviceID string, on bool) error, deviceID string, on bool) error {
+	if chargers != nil && chargers.Has(deviceID) {
+		return chargers.SetCharging(deviceID, on)
+	}
+	if switchPlug == nil {
+		return errors.NewServiceError(fmt.Sprintf("%s is not an EV charger and there is no Tapo service", deviceID), nil)
+	}
+	return switchPlug(deviceID, on)
+}
+
+// apply sends a connecting charger its pause, or clears one left from before
+func (s *ChargerService) apply(charger EVCharger) {
+	s.mu.Lock()
+	paused := s.state[charger.ID].Paused
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), chargerRequestTimeout)
+	defer cancel()
+	var err error
+	if paused {
+		err = s.control.Pause(ctx, charger.ID, charger.ConnectorID)
+	} else {
+		err = s.control.Resume(ctx, charger.ID, charger.ConnectorID)
+	}
+	if err != nil {
+		s.logger.Error("Failed to apply EV charger pause", err, map[string]interface{}{"charger": charger.ID, "paused": paused})
+	}
+}
+
+// configure asks a booted charger for its power and energy every MeterSampleSeconds
+func (s *ChargerService) configure(charger EVCharger) {
+	ctx, cancel := context.WithTimeout(context.Background(), chargerRequestTimeout)
+	defer cancel()
+	for key, value := range map[string]string{
+		"MeterValueSampleInterval": strconv.Itoa(s.config.MeterSampleSeconds),
+		"MeterValuesSampledData":   ocpp.MeasurandEnergy + "," + ocpp.MeasurandPower,
+	} {
+		if err := s.control.Configure(ctx, charger.ID, key, value); err != nil {
+			s.logger.Warn("EV charger refused a setting, meter values may be missing", map[string]interface{}{
+				"charger": charger.ID,
+				"key":     key,
+				"error":   err.Error(),
+			})
+		}
+	}
+}
+
+func (s *ChargerService) charger(id string) (EVCharger, bool) {
+	for _, charger := range s.config.Chargers {
+		if charger.ID == id {
+			return charger, true
+		}
+	}
+	return EVCharger{}, false
+}
+
+// updateMetrics sets the gauges of a charger; the caller holds the lock
+func (s *ChargerService) updateMetrics(status *ChargerStatus) {
+	s.power.WithLabelValues(status.ID).Set(status.PowerW)
+	s.meter.WithLabelValues(status.ID).Set(status.MeterWh)
+	s.paused.WithLabelValues(status.ID).Set(boolGauge(status.Paused))
+	s.connected.WithLabelValues(status.ID).Set(boolGauge(status.Connected))
+}
+
+// Status returns the chargers in the order configured
+func (s *ChargerService) Status() []ChargerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ChargerStatus, 0, len(s.config.Chargers))
+	for _, charger := range s.config.Chargers {
+		statuses = append(statuses, *s.chargers[charger.ID])
+	}
+	return statuses
+}
+
+// Handler serves the chargers as JSON
+func (s *ChargerService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+// ControlHandler pauses or resumes the charger ?id= with ?charging=false or true on POST
+func (s *ChargerService) ControlHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to pause or resume a charger", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.URL.Query().Get("id")
+		if !s.Has(id) {
+			http.Error(w, fmt.Sprintf("EV charger %s not found", id), http.StatusNotFound)
+			return
+		}
+		charging, err := strconv.ParseBool(r.URL.Query().Get("charging"))
+		if err != nil {
+			http.Error(w, "charging must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetCharging(id, charging); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *ChargerService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read EV charger state", err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return errors.NewSystemError("failed to parse EV charger state", err)
+	}
+	return nil
+}
+
+// save keeps the pauses and day starts; the caller holds the lock
+func (s *ChargerService) save() {
+	if s.path == "" {
+		return
+	}
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save EV charger state", err)
+	}
+}
+
+func (s *ChargerService) write() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal EV charger state", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write EV charger state", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace EV charger state", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/ocpp"
+)
+
+type fakeChargePoints struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeChargePoints) record(request string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, request)
+	return nil
+}
+
+func (f *fakeChargePoints) Pause(ctx context.Context, chargePointID string, connectorID int) error {
+	return f.record("pause " + chargePointID)
+}
+
+func (f *fakeChargePoints) Resume(ctx context.Context, chargePointID string, connectorID int) error {
+	return f.record("resume " + chargePointID)
+}
+
+func (f *fakeChargePoints) Configure(ctx context.Context, chargePointID, key, value string) error {
+	return f.record("configure " + key + "=" + value)
+}
+
+func chargerWatts(w float64) *float64 { return &w }
+
+func TestChargerService(t *testing.T) {
+	cfg := &ChargerConfig{Chargers: []EVCharger{{ID: "garage", RoomID: "garage"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), EVChargerFileName)
+	service := NewChargerService(cfg, path, nil)
+	control := &fakeChargePoints{}
+	service.control = control
+	var readings []EnergyReading
+	service.AddReadingCallback(func(reading EnergyReading) { readings = append(readings, reading) })
+
+	day := time.Date(2024, 7, 1, 18, 0, 0, 0, time.UTC)
+	event := func(minutes int, action string, modify func(*ocpp.Event)) {
+		e := ocpp.Event{ChargePointID: "garage", Action: action, Time: day.Add(time.Duration(minutes) * time.Minute)}
+		if modify != nil {
+			modify(&e)
+		}
+		service.HandleEvent(e)
+	}
+
+	event(0, ocpp.ActionConnected, nil)
+	event(0, "BootNotification", func(e *ocpp.Event) { e.Vendor, e.Model = "Acme", "Wallbox 11" })
+	event(1, "StartTransaction", func(e *ocpp.Event) { e.ConnectorID, e.EnergyWh = 1, chargerWatts(120000) })
+	event(1, "StatusNotification", func(e *ocpp.Event) { e.ConnectorID, e.Status, e.ErrorCode = 1, "Charging", "NoError" })
+	event(2, "MeterValues", func(e *ocpp.Event) { e.ConnectorID, e.PowerW, e.EnergyWh = 1, chargerWatts(7200), chargerWatts(120100) })
+	event(30, "MeterValues", func(e *ocpp.Event) { e.ConnectorID, e.PowerW, e.EnergyWh = 1, chargerWatts(7200), chargerWatts(123500) })
+
+	status := service.Status()[0]
+	if !status.Connected || status.Model != "Wallbox 11" || status.Status != "Charging" || status.PowerW != 7200 || status.SessionWh != 3500 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if len(readings) != 2 || readings[0].EnergyWh != 0 || readings[1].EnergyWh != 3400 || readings[1].RoomID != "garage" || !readings[1].IsOn {
+		t.Fatalf("Expected readings counting from the day's first, got %+v", readings)
+	}
+
+	// Peak shaving and grid rules pause and resume it like a plug
+	if err := switchLoad(service, nil, "garage", false); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if err := switchLoad(service, nil, "dryer", false); err == nil {
+		t.Fatal("Expected a plug without a Tapo service to fail")
+	}
+	event(31, "MeterValues", func(e *ocpp.Event) { e.ConnectorID, e.PowerW, e.EnergyWh = 1, chargerWatts(0), chargerWatts(123510) })
+	if last := readings[len(readings)-1]; last.IsOn || last.PowerW != 0 {
+		t.Fatalf("Expected the reading to show the charger paused, got %+v", last)
+	}
+
+	// A new day starts the counter again, and the pause survives a restart
+	event(24*60, "MeterValues", func(e *ocpp.Event) { e.ConnectorID, e.EnergyWh = 1, chargerWatts(123600) })
+	if last := readings[len(readings)-1]; last.EnergyWh != 0 {
+		t.Fatalf("Expected the new day to start from zero, got %+v", last)
+	}
+	restarted := NewChargerService(cfg, path, nil)
+	restartedControl := &fakeChargePoints{}
+	restarted.control = restartedControl
+	if !restarted.Status()[0].Paused {
+		t.Fatal("Expected the pause restored from disk")
+	}
+	restarted.apply(cfg.Chargers[0])
+	if len(restartedControl.requests) != 1 || restartedControl.requests[0] != "pause garage" {
+		t.Fatalf("Expected the pause sent again on connecting, got %v", restartedControl.requests)
+	}
+
+	// Another connector's events and unknown chargers are ignored
+	event(24*60+1, "StatusNotification", func(e *ocpp.Event) { e.ConnectorID, e.Status = 2, "Faulted" })
+	service.HandleEvent(ocpp.Event{ChargePointID: "neighbour", Action: "StatusNotification", ConnectorID: 1, Status: "Faulted"})
+	if status := service.Status()[0]; status.Status != "Charging" {
+		t.Fatalf("Expected other connectors ignored, got %+v", status)
+	}
+
+	event(24*60+2, ocpp.ActionDisconnected, nil)
+	if status := service.Status()[0]; status.Connected || status.PowerW != 0 {
+		t.Fatalf("Expected the charger disconnected, got %+v", status)
+	}
+}
+
+func TestChargerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   ChargerConfig
+		valid bool
+	}{
+		{"no chargers", ChargerConfig{}, false},
+		{"no id", ChargerConfig{Chargers: []EVCharger{{Name: "Garage"}}}, false},
+		{"duplicate", ChargerConfig{Chargers: []EVCharger{{ID: "a"}, {ID: "a"}}}, false},
+		{"negative connector", ChargerConfig{Chargers: []EVCharger{{ID: "a", ConnectorID: -1}}}, false},
+		{"valid", ChargerConfig{Chargers: []EVCharger{{ID: "a"}}}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.cfg.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	cfg := ChargerConfig{Chargers: []EVCharger{{ID: "garage"}}}
+	if err := cfg.Validate(); err != nil || cfg.Chargers[0].ConnectorID != 1 || cfg.Chargers[0].Name != "garage" || cfg.MeterSampleSeconds != 30 {
+		t.Fatalf("Expected the defaults filled in, got %+v, %v", cfg, err)
+	}
+}
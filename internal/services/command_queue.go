@@ -0,0 +1,441 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// commandRetryInitialDelay is the wait before the first retry; each retry doubles it up to MaxDelay
+const commandRetryInitialDelay = time.Second
+
+// CommandDelivery sends a command to its device, returning an error when it didn't arrive
+type CommandDelivery func(cmd *models.DeviceCommand) error
+
+// QueuedCommand is a command waiting to be delivered to a device that didn't take it
+type QueuedCommand struct {
+	Command     *models.DeviceCommand `json:"command"`
+	QueuedAt    time.Time             `json:"queued_at"`
+	Attempts    int                   `json:"attempts"`
+	LastError   string                `json:"last_error,omitempty"`
+	NextAttempt time.Time             `json:"next_attempt"`
+}
+
+// CommandQueueStats counts what became of the commands that were queued
+type CommandQueueStats struct {
+	Queued     int `json:"queued"`
+	Delivered  int `json:"delivered"`
+	Superseded int `json:"superseded"` // Replaced by a later command for the same setting
+	Expired    int `json:"expired"`
+	Dropped    int `json:"dropped"` // Rejected by the device, or beyond MaxPending
+}
+
+// deviceCommands is the queue of one device
+type deviceCommands struct {
+	pending []*QueuedCommand
+	wake    chan struct{}
+	working bool
+}
+
+// CommandQueue delivers device commands that failed once they can be: each device has its
+// own queue, retried in order with exponential backoff and straight away when the device
+// reconnects. A command replaces the queued ones it makes pointless, e.g. turn_off a pending
+// turn_on, and commands that can never succeed, such as invalid values, aren't queued.
+type CommandQueue struct {
+	config  config.CommandQueueConfig
+	deliver CommandDelivery
+	logger  *logger.Logger
+	mu      sync.Mutex
+	devices map[string]*deviceCommands
+	stats   CommandQueueStats
+	ctx     context.Context // Ends the device workers; set by Start
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	now     func() time.Time
+}
+
+// NewCommandQueue returns a queue delivering commands with deliver. Zero settings take the
+// defaults of config.Load.
+func NewCommandQueue(cfg config.CommandQueueConfig, deliver CommandDelivery, serviceLogger *logger.Logger) *CommandQueue {
+	if cfg.MaxDelay < commandRetryInitialDelay {
+		cfg.MaxDelay = time.Minute
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = 10 * time.Minute
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = 20
+	}
+
+	return &CommandQueue{
+		config:  cfg,
+		deliver: deliver,
+		logger:  serviceLogger,
+		devices: make(map[string]*deviceCommands),
+		now:     time.Now,
+	}
+}
+
+// Submit delivers cmd, queueing it when the device can't be reached. A device that still has
+// queued commands gets cmd after them, so commands arrive in the order they were sent. The
+// error of a queued command says so and wraps why it wasn't delivered.
+func (q *CommandQueue) Submit(cmd *models.DeviceCommand) error {
+	q.mu.Lock()
+	if device := q.devices[cmd.DeviceID]; device != nil && len(device.pending) > 0 {
+		q.enqueue(cmd, nil)
+		q.mu.Unlock()
+		return errors.NewDeviceError(fmt.Sprintf("Device %s has undelivered commands, command '%s' queued after them",
+			cmd.DeviceID, cmd.Action), nil)
+	}
+	q.mu.Unlock()
+
+	err := q.deliver(cmd)
+	if err == nil || !commandRetryable(err) {
+		return err
+	}
+
+	q.mu.Lock()
+	q.enqueue(cmd, err)
+	q.mu.Unlock()
+	return errors.NewDeviceError(fmt.Sprintf("Device %s unreachable, command '%s' queued for delivery",
+		cmd.DeviceID, cmd.Action), err)
+}
+
+// Reconnected retries the queued commands of a device straight away instead of after their backoff
+func (q *CommandQueue) Reconnected(deviceID string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	device := q.devices[deviceID]
+	if device == nil || len(device.pending) == 0 {
+		return
+	}
+	device.pending[0].NextAttempt = q.now()
+	select {
+	case device.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Forget drops the queued commands of a device, e.g. when it is removed
+func (q *CommandQueue) Forget(deviceID string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if device := q.devices[deviceID]; device != nil {
+		q.stats.Dropped += len(device.pending)
+		device.pending = nil
+		select {
+		case device.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enqueue adds cmd to the end of its device's queue, replacing the queued commands it
+// supersedes; the caller holds the lock
+func (q *CommandQueue) enqueue(cmd *models.DeviceCommand, cause error) {
+	device := q.devices[cmd.DeviceID]
+	if device == nil {
+		device = &deviceCommands{wake: make(chan struct{}, 1)}
+		q.devices[cmd.DeviceID] = device
+	}
+
+	key := commandKey(cmd)
+	kept := device.pending[:0]
+	for _, queued := range device.pending {
+		if commandKey(queued.Command) == key {
+			q.stats.Superseded++
+			continue
+		}
+		kept = append(kept, queued)
+	}
+	device.pending = kept
+
+	now := q.now()
+	queued := &QueuedCommand{Command: cmd, QueuedAt: now, NextAttempt: now}
+	if cause != nil {
+		queued.Attempts = 1
+		queued.LastError = cause.Error()
+		queued.NextAttempt = now.Add(q.backoff(1))
+	}
+	device.pending = append(device.pending, queued)
+	q.stats.Queued++
+
+	if overflow := len(device.pending) - q.config.MaxPending; overflow > 0 {
+		q.logger.Warn("Device command queue full, dropping the oldest commands", map[string]interface{}{
+			"device_id": cmd.DeviceID,
+			"dropped":   overflow,
+		})
+		device.pending = device.pending[overflow:]
+		q.stats.Dropped += overflow
+	}
+
+	q.logger.Info("Queued device command for delivery", map[string]interface{}{
+		"device_id": cmd.DeviceID,
+		"action":    cmd.Action,
+		"pending":   len(device.pending),
+	})
+
+	select {
+	case device.wake <- struct{}{}:
+	default:
+	}
+	if q.ctx != nil && !device.working {
+		q.startWorker(cmd.DeviceID, device)
+	}
+}
+
+// commandKey names the setting a command changes; a later command for the same setting
+// makes a queued one pointless
+func commandKey(cmd *models.DeviceCommand) string {
+	switch cmd.Action {
+	case "turn_on", "turn_off", "toggle":
+		return "power"
+	case "set_color_temp", "set_color":
+		return "color"
+	default:
+		return cmd.Action
+	}
+}
+
+// commandRetryable reports whether a failed command may still succeed later. Errors that
+// aren't HomeAutomationErrors, like those of the network, are assumed to be retryable.
+func commandRetryable(err error) bool {
+	if homeErr, ok := err.(*errors.HomeAutomationError); ok {
+		return homeErr.IsRetryable()
+	}
+	return true
+}
+
+// backoff returns the wait after a command's attempts, doubling from the initial delay up to
+// MaxDelay, with up to 10% jitter so devices coming back together aren't retried in lockstep
+func (q *CommandQueue) backoff(attempts int) time.Duration {
+	delay := commandRetryInitialDelay
+	for i := 1; i < attempts && delay < q.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxDelay {
+		delay = q.config.MaxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
+
+// Start delivers the queued commands in the background, until Stop
+func (q *CommandQueue) Start(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.ctx != nil {
+		return errors.NewServiceError("command queue is already running", nil)
+	}
+	q.ctx, q.cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+	for deviceID, device := range q.devices {
+		if len(device.pending) > 0 {
+			q.startWorker(deviceID, device)
+		}
+	}
+	return nil
+}
+
+// Stop stops delivering, waiting for deliveries in progress or for ctx to be done. Commands
+// still queued are logged, as the queue only lives in memory.
+func (q *CommandQueue) Stop(ctx context.Context) error {
+	q.mu.Lock()
+	if q.ctx == nil {
+		q.mu.Unlock()
+		return nil
+	}
+	q.cancel()
+	q.ctx = nil
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.NewTimeoutError("command deliveries did not finish in time", ctx.Err())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for deviceID, device := range q.devices {
+		if len(device.pending) > 0 {
+			q.logger.Warn("Device commands left undelivered", map[string]interface{}{
+				"device_id": deviceID,
+				"pending":   len(device.pending),
+			})
+		}
+	}
+	return nil
+}
+
+// startWorker delivers a device's queue until it is empty; the caller holds the lock
+func (q *CommandQueue) startWorker(deviceID string, device *deviceCommands) {
+	ctx := q.ctx
+	device.working = true
+	q.workers.Add(1)
+	go func() {
+		defer q.workers.Done()
+		q.work(ctx, deviceID, device)
+	}()
+}
+
+// work retries the command at the head of a device's queue whenever it is due, until the
+// queue is empty or ctx is done
+func (q *CommandQueue) work(ctx context.Context, deviceID string, device *deviceCommands) {
+	for {
+		q.mu.Lock()
+		q.expire(deviceID, device)
+		if len(device.pending) == 0 || ctx.Err() != nil {
+			device.working = false
+			q.mu.Unlock()
+			return
+		}
+		head := device.pending[0]
+		wait := head.NextAttempt.Sub(q.now())
+		q.mu.Unlock()
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				continue
+			case <-device.wake:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+		}
+
+		err := q.deliver(head.Command)
+
+		q.mu.Lock()
+		q.delivered(deviceID, device, head, err)
+		q.mu.Unlock()
+	}
+}
+
+// expire drops the queued commands of a device that are too old to be wanted; the caller
+// holds the lock
+func (q *CommandQueue) expire(deviceID string, device *deviceCommands) {
+	now := q.now()
+	kept := device.pending[:0]
+	for _, queued := range device.pending {
+		if now.Sub(queued.QueuedAt) >= q.config.Expiry {
+			q.stats.Expired++
+			q.logger.Warn("Device command expired before it could be delivered", map[string]interface{}{
+				"device_id": deviceID,
+				"action":    queued.Command.Action,
+				"attempts":  queued.Attempts,
+				"error":     queued.LastError,
+			})
+			continue
+		}
+		kept = append(kept, queued)
+	}
+	device.pending = kept
+}
+
+// delivered records the outcome of an attempt to deliver head; the caller holds the lock
+func (q *CommandQueue) delivered(deviceID string, device *deviceCommands, head *QueuedCommand, err error) {
+	// A later command may have superseded the head while it was being delivered
+	if len(device.pending) == 0 || device.pending[0] != head {
+		return
+	}
+
+	head.Attempts++
+	switch {
+	case err == nil:
+		device.pending = device.pending[1:]
+		q.stats.Delivered++
+		q.logger.Info("Delivered queued device command", map[string]interface{}{
+			"device_id": deviceID,
+			"action":    head.Command.Action,
+			"attempts":  head.Attempts,
+			"delay":     q.now().Sub(head.QueuedAt).Round(time.Millisecond).String(),
+		})
+	case !commandRetryable(err):
+		device.pending = device.pending[1:]
+		q.stats.Dropped++
+		q.logger.Error("Device rejected queued command", err, map[string]interface{}{
+			"device_id": deviceID,
+			"action":    head.Command.Action,
+		})
+	default:
+		head.LastError = err.Error()
+		head.NextAttempt = q.now().Add(q.backoff(head.Attempts))
+		q.logger.Debug("Queued device command still undelivered", map[string]interface{}{
+			"device_id":    deviceID,
+			"action":       head.Command.Action,
+			"attempts":     head.Attempts,
+			"next_attempt": head.NextAttempt,
+			"error":        err.Error(),
+		})
+	}
+}
+
+// Pending returns the queued commands by device ID, each in delivery order
+func (q *CommandQueue) Pending() map[string][]QueuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := make(map[string][]QueuedCommand)
+	for deviceID, device := range q.devices {
+		for _, queued := range device.pending {
+			pending[deviceID] = append(pending[deviceID], *queued)
+		}
+	}
+	return pending
+}
+
+// Stats returns what became of the commands queued so far
+func (q *CommandQueue) Stats() CommandQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// Handler serves the queued commands and the queue's stats as JSON
+func (q *CommandQueue) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pending := q.Pending()
+		devices := make([]string, 0, len(pending))
+		for deviceID := range pending {
+			devices = append(devices, deviceID)
+		}
+		sort.Strings(devices)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"devices": devices,
+			"pending": pending,
+			"stats":   q.Stats(),
+		})
+	})
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// fakeDevices records the commands delivered to devices that are reachable
+type fakeDevices struct {
+	mu        sync.Mutex
+	offline   bool
+	delivered []string
+}
+
+func (d *fakeDevices) deliver(cmd *models.DeviceCommand) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cmd.Action == "set_brightness" && cmd.Value == nil {
+		return errors.NewValidationError("invalid brightness value: <nil>", nil)
+	}
+	if d.offline {
+		return errors.NewDeviceError("Failed to connect to device", nil)
+	}
+	d.delivered = append(d.delivered, cmd.DeviceID+":"+cmd.Action)
+	return nil
+}
+
+func (d *fakeDevices) setOffline(offline bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.offline = offline
+}
+
+func (d *fakeDevices) deliveries() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return strings.Join(d.delivered, ",")
+}
+
+func TestCommandQueueDeliversOnReconnect(t *testing.T) {
+	devices := &fakeDevices{}
+	queue := NewCommandQueue(config.CommandQueueConfig{}, devices.deliver, logger.NewLogger("test-command-queue", nil))
+
+	// A reachable device gets its command straight away
+	if err := queue.Submit(&models.DeviceCommand{DeviceID: "lamp", Action: "turn_on"}); err != nil {
+		t.Fatal(err)
+	}
+
+	devices.setOffline(true)
+	for _, action := range []string{"turn_on", "set_brightness", "turn_off"} {
+		err := queue.Submit(&models.DeviceCommand{DeviceID: "lamp", Action: action, Value: 40.0})
+		if err == nil || !strings.Contains(err.Error(), "queued") {
+			t.Errorf("Expected '%s' queued while the lamp is offline, got %v", action, err)
+		}
+	}
+	// Commands that can never succeed aren't queued
+	if err := queue.Submit(&models.DeviceCommand{DeviceID: "heater", Action: "set_brightness"}); err == nil || strings.Contains(err.Error(), "queued") {
+		t.Errorf("Expected an invalid command rejected, got %v", err)
+	}
+
+	pending := queue.Pending()["lamp"]
+	if len(pending) != 2 || pending[0].Command.Action != "set_brightness" || pending[1].Command.Action != "turn_off" {
+		t.Fatalf("Expected turn_off to replace the queued turn_on, got %+v", pending)
+	}
+	if pending[0].Attempts != 0 || pending[1].Attempts != 0 {
+		t.Errorf("Expected commands behind an undelivered one not attempted, got %+v", pending)
+	}
+
+	if err := queue.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop(context.Background())
+
+	devices.setOffline(false)
+	queue.Reconnected("lamp")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := devices.deliveries(); got != "lamp:turn_on,lamp:set_brightness,lamp:turn_off" {
+		t.Errorf("Expected the queued commands delivered in order, got %s", got)
+	}
+	if stats := queue.Stats(); stats.Queued != 3 || stats.Delivered != 2 || stats.Superseded != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCommandQueueBackoffAndExpiry(t *testing.T) {
+	devices := &fakeDevices{offline: true}
+	queue := NewCommandQueue(config.CommandQueueConfig{MaxDelay: 5 * time.Second, Expiry: time.Minute, MaxPending: 2},
+		devices.deliver, logger.NewLogger("test-command-queue", nil))
+
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 5 * time.Second} {
+		if delay := queue.backoff(attempts); delay < want || delay > want+want/10 {
+			t.Errorf("Expected a backoff of %v plus jitter after %d attempts, got %v", want, attempts, delay)
+		}
+	}
+
+	for _, action := range []string{"turn_on", "set_brightness", "set_color"} {
+		queue.Submit(&models.DeviceCommand{DeviceID: "lamp", Action: action, Value: 40.0})
+	}
+	if pending := queue.Pending()["lamp"]; len(pending) != 2 || pending[0].Command.Action != "set_brightness" {
+		t.Fatalf("Expected the oldest command dropped beyond MaxPending, got %+v", pending)
+	}
+
+	// Commands still undelivered when they expire are dropped
+	now := time.Now().Add(2 * time.Minute)
+	queue.now = func() time.Time { return now }
+	if err := queue.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := queue.Stats(); stats.Expired != 2 || stats.Dropped != 1 || devices.deliveries() != "" {
+		t.Errorf("Expected the queued commands expired, got %+v", stats)
+	}
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Defaults of the condensation guard
+const (
+	defaultCondensationMaxHumidity  = 60.0
+	defaultDehumidifyFanSpeed       = 35
+	defaultSurfaceBelowRoomF        = 10.0
+	defaultDewPointMarginF          = 2.0
+	defaultCondensationFanSpeed     = 100
+	defaultCondensationMaxRaiseF    = 4.0
+	defaultHumidityRisePercent      = 10.0
+	defaultHumidityRiseMinutes      = 60
+	condensationHysteresisF         = 1.0 // Dew point back below the surfaces before the risk clears
+	condensationHumidityHysteresis  = 3.0 // Humidity back below the maximum before dehumidifying stops
+	CondensationAlertRisk           = "condensation_risk"
+	CondensationAlertHumidityRising = "humidity_rising"
+)
+
+// CondensationGuardConfig sets when cooling turns to wringing moisture out of the air and when
+// the room's coldest surfaces risk sweating
+type CondensationGuardConfig struct {
+	// Rooms are the thermostats guarded, all when empty
+	Rooms []string `json:"rooms,omitempty"`
+	// MaxHumidity slows the fan to DehumidifyFanSpeed while cooling above it: 60% and 35 by default
+	MaxHumidity        float64 `json:"max_humidity,omitempty"`
+	DehumidifyFanSpeed int     `json:"dehumidify_fan_speed,omitempty"`
+	// SurfaceBelowRoomF is how much colder than the room its coldest surfaces run while cooling,
+	// such as supply registers and ducts: 10°F by default
+	SurfaceBelowRoomF float64 `json:"surface_below_room_f,omitempty"`
+	// DewPointMarginF is how close the dew point may come to those surfaces, 2°F by default
+	DewPointMarginF float64 `json:"dew_point_margin_f,omitempty"`
+	// RiskFanSpeed is the fan speed warming the supply air when surfaces risk condensation, and
+	// MaxRaiseF how far above its target cooling may stop to keep them dry: 100 and 4°F by default
+	RiskFanSpeed int     `json:"risk_fan_speed,omitempty"`
+	MaxRaiseF    float64 `json:"max_raise_f,omitempty"`
+	// RisePercent alerts when the humidity climbs this much within RiseMinutes of cooling, as
+	// with a clogged drain or a frozen coil: 10% and 60 minutes by default
+	RisePercent float64 `json:"rise_percent,omitempty"`
+	RiseMinutes int     `json:"rise_minutes,omitempty"`
+}
+
+// LoadCondensationGuardConfig reads the condensation guard settings from a JSON file
+func LoadCondensationGuardConfig(path string) (*CondensationGuardConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read condensation guard file", err)
+	}
+
+	var cfg CondensationGuardConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse condensation guard file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the percentages, fan speeds and temperature offsets
+func (c *CondensationGuardConfig) Validate() error {
+	if c.MaxHumidity < 0 || c.MaxHumidity > 100 || c.RisePercent < 0 || c.RisePercent > 100 {
+		return errors.NewValidationError("max_humidity and rise_percent must be between 0 and 100", nil)
+	}
+	if c.DehumidifyFanSpeed < 0 || c.DehumidifyFanSpeed > 100 || c.RiskFanSpeed < 0 || c.RiskFanSpeed > 100 {
+		return errors.NewValidationError("dehumidify_fan_speed and risk_fan_speed must be between 0 and 100", nil)
+	}
+	if c.SurfaceBelowRoomF < 0 || c.DewPointMarginF < 0 || c.MaxRaiseF < 0 || c.RiseMinutes < 0 {
+		return errors.NewValidationError("surface_below_room_f, dew_point_margin_f, max_raise_f and rise_minutes must not be negative", nil)
+	}
+	seen := make(map[string]bool)
+	for _, room := range c.Rooms {
+		if room == "" || seen[room] {
+			return errors.NewValidationError("rooms must be unique thermostat IDs", nil)
+		}
+		seen[room] = true
+	}
+	return nil
+}
+
+// humiditySample is a room's humidity while cooling
+type humiditySample struct {
+	humidity float64
+	at       time.Time
+}
+
+// condensationRoom is what the guard knows of a room
+type condensationRoom struct {
+	status  CondensationRoomStatus
+	samples []humiditySample // Since cooling started, within the rise window
+	firing  map[string]bool
+}
+
+// CondensationRoomStatus is the humidity of a cooled room against its surfaces
+type CondensationRoomStatus struct {
+	TemperatureF float64                        `json:"temperature_f"`
+	Humidity     float64                        `json:"humidity"`
+	DewPointF    float64                        `json:"dew_point_f"`
+	SurfaceF     float64                        `json:"surface_f"`
+	Cooling      bool                           `json:"cooling"`
+	Adjustment   *models.CondensationAdjustment `json:"adjustment,omitempty"`
+	Alerts       []string                       `json:"alerts,omitempty"`
+	Updated      time.Time                      `json:"updated"`
+}
+
+// CondensationGuardService protects humid homes while cooling. Above the maximum humidity it
+// slows the fan so the coil removes more moisture. When the dew point nears the room's coldest
+// surfaces it speeds the fan up, stops cooling short of the target and alerts, as it does when
+// the humidity climbs although the system cools.
+type CondensationGuardService struct {
+	config  *CondensationGuardConfig
+	rooms   map[string]*condensationRoom
+	publish func(msg *mqtt.Message) error
+	logger  *logger.Logger
+	mu      sync.Mutex
+}
+
+// NewCondensationGuardService creates a condensation guard for a validated configuration
+func NewCondensationGuardService(cfg *CondensationGuardConfig, serviceLogger *logger.Logger) *CondensationGuardService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("CondensationGuardService", nil)
+	}
+
+	return &CondensationGuardService{
+		config: cfg,
+		rooms:  make(map[string]*condensationRoom),
+		logger: serviceLogger,
+	}
+}
+
+// SetMQTTClient attaches the client alerts are notified with
+func (s *CondensationGuardService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// guards reports whether a thermostat is guarded
+func (s *CondensationGuardService) guards(id string) bool {
+	if len(s.config.Rooms) == 0 {
+		return true
+	}
+	for _, room := range s.config.Rooms {
+		if room == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Adjustment works out how the humidity changes a thermostat's cooling at now; nil leaves it
+// unchanged. It is called from the thermostat control loop and must not call back into it.
+func (s *CondensationGuardService) Adjustment(thermostat models.Thermostat, now time.Time) *models.CondensationAdjustment {
+	cooling := thermostat.CoolingEnabled && (thermostat.Mode == models.ModeCool || thermostat.Mode == models.ModeAuto)
+	if !s.guards(thermostat.ID) || !cooling || thermostat.CurrentHumidity <= 0 {
+		s.mu.Lock()
+		room := s.rooms[thermostat.ID]
+		delete(s.rooms, thermostat.ID)
+		s.mu.Unlock()
+		if room != nil {
+			for kind := range room.firing {
+				s.notify(thermostat.ID, kind, false, room.status, now)
+			}
+		}
+		return nil
+	}
+
+	cfg := s.config
+	humidity := thermostat.CurrentHumidity
+	dewPoint := models.DewPointF(thermostat.CurrentTemp, humidity)
+	surface := thermostat.CurrentTemp - positiveOrF(cfg.SurfaceBelowRoomF, defaultSurfaceBelowRoomF)
+	margin := positiveOrF(cfg.DewPointMarginF, defaultDewPointMarginF)
+
+	s.mu.Lock()
+	room := s.rooms[thermostat.ID]
+	if room == nil {
+		room = &condensationRoom{firing: make(map[string]bool)}
+		s.rooms[thermostat.ID] = room
+	}
+	previous := room.status.Adjustment
+
+	// Cooling should bring the humidity down; a climb while it runs is abnormal
+	running := thermostat.Status == models.StatusCooling
+	if running {
+		window := time.Duration(positiveOr(cfg.RiseMinutes, defaultHumidityRiseMinutes)) * time.Minute
+		kept := room.samples[:0]
+		for _, sample := range room.samples {
+			if now.Sub(sample.at) <= window {
+				kept = append(kept, sample)
+			}
+		}
+		room.samples = append(kept, humiditySample{humidity: humidity, at: now})
+	} else {
+		room.samples = nil
+	}
+	lowest := humidity
+	for _, sample := range room.samples {
+		lowest = math.Min(lowest, sample.humidity)
+	}
+	rise := positiveOrF(cfg.RisePercent, defaultHumidityRisePercent)
+	rising := humidity-lowest >= rise || (room.firing[CondensationAlertHumidityRising] && humidity-lowest >= rise/2)
+
+	risk := dewPoint >= surface-margin
+	if room.firing[CondensationAlertRisk] {
+		risk = dewPoint >= surface-margin-condensationHysteresisF
+	}
+	maxHumidity := positiveOrF(cfg.MaxHumidity, defaultCondensationMaxHumidity)
+	humid := humidity > maxHumidity || (previous != nil && humidity > maxHumidity-condensationHumidityHysteresis)
+
+	var adjustment *models.CondensationAdjustment
+	switch {
+	case risk:
+		// Faster air leaves the coil warmer; cooling stops once the surfaces would reach the dew point
+		floor := math.Ceil(dewPoint + margin + positiveOrF(cfg.SurfaceBelowRoomF, defaultSurfaceBelowRoomF))
+		floor = math.Min(floor, thermostat.TargetTemp+positiveOrF(cfg.MaxRaiseF, defaultCondensationMaxRaiseF))
+		adjustment = &models.CondensationAdjustment{
+			FanSpeed:  positiveOr(cfg.RiskFanSpeed, defaultCondensationFanSpeed),
+			DewPointF: math.Round(dewPoint*10) / 10,
+			Reason:    fmt.Sprintf("dew point %.0f°F near surfaces at %.0f°F", dewPoint, surface),
+		}
+		if floor > thermostat.TargetTemp {
+			adjustment.MinCoolF = floor
+		}
+	case humid || rising:
+		adjustment = &models.CondensationAdjustment{
+			FanSpeed:  positiveOr(cfg.DehumidifyFanSpeed, defaultDehumidifyFanSpeed),
+			DewPointF: math.Round(dewPoint*10) / 10,
+			Reason:    fmt.Sprintf("dehumidifying at %.0f%% humidity", humidity),
+		}
+	}
+
+	room.status = CondensationRoomStatus{
+		TemperatureF: thermostat.CurrentTemp,
+		Humidity:     humidity,
+		DewPointF:    math.Round(dewPoint*10) / 10,
+		SurfaceF:     surface,
+		Cooling:      running,
+		Adjustment:   adjustment,
+		Updated:      now,
+	}
+	var changed []string
+	for _, alert := range []struct {
+		kind   string
+		firing bool
+	}{{CondensationAlertRisk, risk}, {CondensationAlertHumidityRising, rising}} {
+		kind, firing := alert.kind, alert.firing
+		if firing != room.firing[kind] {
+			changed = append(changed, kind)
+		}
+		if firing {
+			room.firing[kind] = true
+			room.status.Alerts = append(room.status.Alerts, kind)
+		} else {
+			delete(room.firing, kind)
+		}
+	}
+	status := room.status
+	s.mu.Unlock()
+
+	if condensationReason(adjustment) != condensationReason(previous) {
+		s.logger.Info("Condensation guard changed", map[string]interface{}{
+			"thermostat_id": thermostat.ID,
+			"humidity":      humidity,
+			"dew_point_f":   status.DewPointF,
+			"adjustment":    condensationReason(adjustment),
+		})
+	}
+	for _, kind := range changed {
+		s.notify(thermostat.ID, kind, status.firing(kind), status, now)
+	}
+	return adjustment
+}
+
+// firing reports whether an alert of kind is firing in the status
+func (r CondensationRoomStatus) firing(kind string) bool {
+	for _, alert := range r.Alerts {
+		if alert == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// condensationReason describes an adjustment for the log, "none" without one
+func condensationReason(adjustment *models.CondensationAdjustment) string {
+	if adjustment == nil {
+		return "none"
+	}
+	return adjustment.Reason
+}
+
+// notify publishes a condensation alert firing or resolving in a room
+func (s *CondensationGuardService) notify(roomID, kind string, firing bool, status CondensationRoomStatus, now time.Time) {
+	title := i18n.T("condensation.risk.title", roomID)
+	message := i18n.T("condensation.risk", status.DewPointF, status.Humidity, status.SurfaceF)
+	if kind == CondensationAlertHumidityRising {
+		title = i18n.T("condensation.rising.title", roomID)
+		message = i18n.T("condensation.rising", status.Humidity)
+	}
+	state := AlertStateFiring
+	if !firing {
+		title, state = i18n.T("alert.resolved.title", title), AlertStateResolved
+		message = i18n.T("condensation.resolved", status.Humidity, status.DewPointF)
+	} else {
+		s.logger.Warn(title.In(i18n.English), map[string]interface{}{
+			"room_id":     roomID,
+			"humidity":    status.Humidity,
+			"dew_point_f": status.DewPointF,
+		})
+	}
+	if s.publish == nil {
+		return
+	}
+
+	payload, err := localizedNotification(map[string]interface{}{
+		"source":    "condensation",
+		"severity":  AlertSeverityWarning,
+		"state":     state,
+		"alert_id":  roomID + "-" + kind,
+		"subject":   roomID,
+		"timestamp": now.Unix(),
+	}, title, message)
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: NotificationTopic, Payload: payload, QoS: 1}); err != nil {
+		s.logger.Error("Failed to publish condensation notification", err, map[string]interface{}{"room_id": roomID})
+	}
+}
+
+// Status returns the guarded rooms that are cooling with a humidity reading
+func (s *CondensationGuardService) Status() map[string]CondensationRoomStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := make(map[string]CondensationRoomStatus, len(s.rooms))
+	for id, room := range s.rooms {
+		status[id] = room.status
+	}
+	return status
+}
+
+// Handler serves the status of the guarded rooms as JSON
+func (s *CondensationGuardService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestCondensationGuard(t *testing.T) {
+	if err := (&CondensationGuardConfig{MaxHumidity: 120}).Validate(); err == nil {
+		t.Error("Expected a maximum humidity above 100% to be rejected")
+	}
+
+	guard := NewCondensationGuardService(&CondensationGuardConfig{}, nil)
+	var notifications []map[string]interface{}
+	guard.publish = func(msg *mqtt.Message) error {
+		var notification map[string]interface{}
+		json.Unmarshal(msg.Payload, &notification)
+		notifications = append(notifications, notification)
+		return nil
+	}
+
+	now := time.Now()
+	thermostat := models.Thermostat{ID: "living", TargetTemp: 72, CurrentTemp: 75, CurrentHumidity: 55,
+		Mode: models.ModeCool, CoolingEnabled: true, Status: models.StatusCooling}
+	if adjustment := guard.Adjustment(thermostat, now); adjustment != nil {
+		t.Fatalf("Expected no adjustment at 55%%, got %+v", adjustment)
+	}
+
+	// Muggy air slows the fan so the coil wrings it out
+	thermostat.CurrentHumidity = 64
+	adjustment := guard.Adjustment(thermostat, now.Add(time.Minute))
+	if adjustment == nil || adjustment.FanSpeed != 35 || adjustment.MinCoolF != 0 || len(notifications) != 0 {
+		t.Fatalf("Expected the fan slowed without an alert, got %+v", adjustment)
+	}
+
+	// A dew point within 2°F of registers 10°F below the room speeds the fan up, holds cooling
+	// back and alerts, as does the humidity climbing 13% while cooling
+	thermostat.CurrentHumidity = 68
+	adjustment = guard.Adjustment(thermostat, now.Add(2*time.Minute))
+	if adjustment == nil || adjustment.FanSpeed != 100 || adjustment.MinCoolF != 76 || adjustment.DewPointF < 63.5 {
+		t.Fatalf("Expected the fan at full speed and cooling held at 76°F, got %+v", adjustment)
+	}
+	if len(notifications) != 2 || notifications[0]["alert_id"] != "living-condensation_risk" ||
+		notifications[1]["alert_id"] != "living-humidity_rising" || notifications[0]["state"] != AlertStateFiring {
+		t.Fatalf("Expected the condensation and rising humidity alerts, got %v", notifications)
+	}
+	thermostat.Condensation = adjustment
+	if thermostat.ShouldCool() {
+		t.Error("Expected no cooling below the condensation floor")
+	}
+
+	// Drier air clears both, and the fan keeps slowing until well below the maximum
+	notifications = nil
+	thermostat.CurrentHumidity = 59
+	adjustment = guard.Adjustment(thermostat, now.Add(3*time.Minute))
+	if adjustment == nil || adjustment.FanSpeed != 35 || len(notifications) != 2 || notifications[0]["state"] != AlertStateResolved {
+		t.Fatalf("Expected the alerts resolved while still dehumidifying, got %+v and %v", adjustment, notifications)
+	}
+	if status := guard.Status()["living"]; len(status.Alerts) != 0 || !status.Cooling {
+		t.Errorf("Expected no alerts left, got %+v", status)
+	}
+
+	// Heating or another room isn't guarded
+	thermostat.Mode = models.ModeHeat
+	if guard.Adjustment(thermostat, now.Add(4*time.Minute)) != nil || len(guard.Status()) != 0 {
+		t.Error("Expected no adjustment while heating")
+	}
+	guard = NewCondensationGuardService(&CondensationGuardConfig{Rooms: []string{"bedroom"}}, nil)
+	thermostat.Mode, thermostat.CurrentHumidity = models.ModeCool, 70
+	if guard.Adjustment(thermostat, now) != nil {
+		t.Error("Expected only the bedroom guarded")
+	}
+}
+
+func TestThermostatServiceCondensationGuard(t *testing.T) {
+	service := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), logger.NewLogger("test-thermostat", nil))
+	service.SetCondensationGuard(NewCondensationGuardService(&CondensationGuardConfig{}, nil))
+	service.RegisterThermostat(&models.Thermostat{ID: "den", RoomID: "den", TargetTemp: 72, Hysteresis: 1, FanSpeed: 50,
+		Mode: models.ModeCool, CoolingEnabled: true, CurrentHumidity: 68, MinTemp: 50, MaxTemp: 90})
+	service.HandleTemperatureUpdate("den", 75)
+
+	thermostats := service.RunOnce()
+	if len(thermostats) != 1 || thermostats[0].Condensation == nil || thermostats[0].Status != models.StatusIdle {
+		t.Fatalf("Expected cooling held back by the condensation guard, got %+v", thermostats)
+	}
+	if fan := thermostats[0].ControlFanSpeed(); fan != 100 {
+		t.Errorf("Expected the fan at full speed, got %d", fan)
+	}
+}
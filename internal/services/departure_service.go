@@ -0,0 +1,340 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// DepartureTurnOffAction is the notification action that turns off what the check found on
+	DepartureTurnOffAction = "turn_off_non_essentials"
+
+	defaultRunningAboveW = 10.0
+)
+
+// DepartureConfig tells the departure check which devices to leave alone
+type DepartureConfig struct {
+	// Essential devices, such as the fridge or the router, are never reported or turned off
+	Essential []string `json:"essential,omitempty"`
+	// RunningAboveW is the power above which a device counts as a running appliance rather than
+	// a light left on, default 10
+	RunningAboveW float64 `json:"running_above_w,omitempty"`
+}
+
+// LoadDepartureConfig reads the departure check settings from a JSON file
+func LoadDepartureConfig(path string) (*DepartureConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read departure file", err)
+	}
+
+	var cfg DepartureConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse departure file", err)
+	}
+
+	if cfg.RunningAboveW < 0 {
+		return nil, errors.NewValidationError("running_above_w must not be negative", nil)
+	}
+	return &cfg, nil
+}
+
+// OpenContact is a door or window left open
+type OpenContact struct {
+	RoomID    string    `json:"room_id"`
+	Contact   string    `json:"contact"`
+	OpenSince time.Time `json:"open_since"`
+}
+
+// DepartureDevice is a device left on
+type DepartureDevice struct {
+	DeviceID string   `json:"device_id"`
+	Name     string   `json:"name,omitempty"`
+	RoomID   string   `json:"room_id,omitempty"`
+	PowerW   *float64 `json:"power_w,omitempty"`
+}
+
+// DepartureReport is the result of a departure check
+type DepartureReport struct {
+	ID           string            `json:"id"`
+	CheckedAt    time.Time         `json:"checked_at"`
+	Mode         string            `json:"mode"`
+	OpenContacts []OpenContact     `json:"open_contacts"`
+	LightsOn     []DepartureDevice `json:"lights_on"`
+	Running      []DepartureDevice `json:"running"`
+	TurnedOffAt  time.Time         `json:"turned_off_at,omitempty"`
+	TurnedOff    []string          `json:"turned_off,omitempty"`
+	Failed       []string          `json:"failed,omitempty"`
+}
+
+// Clear reports whether nothing was found
+func (r *DepartureReport) Clear() bool {
+	return len(r.OpenContacts) == 0 && len(r.LightsOn) == 0 && len(r.Running) == 0
+}
+
+// DepartureService runs a checklist when the home goes away: doors and windows left open,
+// lights left on and appliances running. It notifies a summary with an action that turns off
+// the non-essential devices it found on; doors and windows are only reported.
+type DepartureService struct {
+	config    *DepartureConfig
+	essential map[string]bool
+	rooms     RoomSensorReader
+	devices   DeviceStatusReader
+	commands  CommandExecutor
+	publish   func(msg *mqtt.Message) error
+	last      *DepartureReport
+	gone      bool // Whether the home is away or on vacation
+	logger    *logger.Logger
+	mu        sync.Mutex
+}
+
+// NewDepartureService creates the departure check; a nil config reports every device
+func NewDepartureService(cfg *DepartureConfig, serviceLogger *logger.Logger) *DepartureService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Departure", nil)
+	}
+	if cfg == nil {
+		cfg = &DepartureConfig{}
+	}
+
+	service := &DepartureService{config: cfg, essential: make(map[string]bool), logger: serviceLogger}
+	for _, deviceID := range cfg.Essential {
+		service.essential[deviceID] = true
+	}
+	return service
+}
+
+// SetRoomSensors sets where the door and window contacts are read
+func (s *DepartureService) SetRoomSensors(rooms RoomSensorReader) {
+	s.rooms = rooms
+}
+
+// SetDevices sets where the devices are read and switched
+func (s *DepartureService) SetDevices(devices interface {
+	DeviceStatusReader
+	CommandExecutor
+}) {
+	s.devices = devices
+	s.commands = devices
+}
+
+// SetMQTTClient attaches the client the summary is notified with
+func (s *DepartureService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// HandleMode runs the check when the home goes away or on vacation, but not when it moves
+// from one to the other
+func (s *DepartureService) HandleMode(mode string) {
+	gone := mode == HomeModeAway || mode == HomeModeVacation
+	s.mu.Lock()
+	leaving := gone && !s.gone
+	s.gone = gone
+	s.mu.Unlock()
+
+	if leaving {
+		s.Check(mode, time.Now())
+	}
+}
+
+// Check runs the departure checklist and notifies the summary
+func (s *DepartureService) Check(mode string, now time.Time) *DepartureReport {
+	report := &DepartureReport{
+		ID:           fmt.Sprintf("%d", now.Unix()),
+		CheckedAt:    now,
+		Mode:         mode,
+		OpenContacts: make([]OpenContact, 0),
+		LightsOn:     make([]DepartureDevice, 0),
+		Running:      make([]DepartureDevice, 0),
+	}
+
+	if s.rooms != nil {
+		for roomID, room := range s.rooms.GetAllRoomSensors() {
+			for contact, openedAt := range room.OpenContacts {
+				report.OpenContacts = append(report.OpenContacts, OpenContact{RoomID: roomID, Contact: contact, OpenSince: openedAt})
+			}
+		}
+		sort.Slice(report.OpenContacts, func(i, j int) bool {
+			a, b := report.OpenContacts[i], report.OpenContacts[j]
+			return a.RoomID < b.RoomID || (a.RoomID == b.RoomID && a.Contact < b.Contact)
+		})
+	}
+
+	runningAbove := s.config.RunningAboveW
+	if runningAbove == 0 {
+		runningAbove = defaultRunningAboveW
+	}
+	if s.devices != nil {
+		for _, device := range s.devices.Devices() {
+			if s.essential[device.DeviceID] || device.On == nil || !*device.On {
+				continue
+			}
+			found := DepartureDevice{DeviceID: device.DeviceID, Name: device.DeviceName, RoomID: device.RoomID, PowerW: device.PowerW}
+			if device.PowerW != nil && *device.PowerW >= runningAbove {
+				report.Running = append(report.Running, found)
+			} else {
+				report.LightsOn = append(report.LightsOn, found)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.last = report
+	s.mu.Unlock()
+
+	s.logger.Info("Departure check", map[string]interface{}{
+		"mode":          mode,
+		"open_contacts": len(report.OpenContacts),
+		"lights_on":     len(report.LightsOn),
+		"running":       len(report.Running),
+	})
+	s.notify(report)
+	return report
+}
+
+// TurnOff switches off the devices the latest check found on, for the check with the given ID
+// so an old notification's action can't switch what was turned on since
+func (s *DepartureService) TurnOff(checkID string, now time.Time) (*DepartureReport, error) {
+	s.mu.Lock()
+	report := s.last
+	s.mu.Unlock()
+	if report == nil || report.ID != checkID {
+		return nil, errors.NewValidationError("unknown or outdated departure check "+checkID, nil)
+	}
+	if s.commands == nil {
+		return nil, errors.NewServiceError("no device service to turn devices off", nil)
+	}
+
+	var turnedOff, failed []string
+	for _, device := range append(append([]DepartureDevice{}, report.LightsOn...), report.Running...) {
+		err := s.commands.ExecuteCommand(&models.DeviceCommand{DeviceID: device.DeviceID, Action: "turn_off",
+			Options: map[string]interface{}{"automation": "departure"}})
+		if err != nil {
+			s.logger.Error("Failed to turn off device after departure", err, map[string]interface{}{"device_id": device.DeviceID})
+			failed = append(failed, device.DeviceID)
+			continue
+		}
+		turnedOff = append(turnedOff, device.DeviceID)
+	}
+
+	s.mu.Lock()
+	report.TurnedOffAt, report.TurnedOff, report.Failed = now, turnedOff, failed
+	result := *report
+	s.mu.Unlock()
+
+	s.logger.Info("Turned off non-essentials after departure", map[string]interface{}{"turned_off": len(turnedOff), "failed": len(failed)})
+	return &result, nil
+}
+
+// Last returns the latest check, or nil before the first
+func (s *DepartureService) Last() *DepartureReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return nil
+	}
+	report := *s.last
+	return &report
+}
+
+// notify publishes the summary, with the turn-off action when devices were found on
+func (s *DepartureService) notify(report *DepartureReport) {
+	if s.publish == nil {
+		return
+	}
+
+	title, severity := i18n.T("departure.clear.title"), AlertSeverityInfo
+	var lines i18n.Lines
+	if !report.Clear() {
+		title, severity = i18n.T("departure.check.title"), AlertSeverityWarning
+	}
+	for _, contact := range report.OpenContacts {
+		lines = append(lines, i18n.T("departure.open", contact.Contact, contact.RoomID))
+	}
+	for _, device := range report.LightsOn {
+		lines = append(lines, i18n.T("departure.left_on", departureName(device)))
+	}
+	for _, device := range report.Running {
+		lines = append(lines, i18n.T("departure.running", departureName(device), *device.PowerW))
+	}
+	var message i18n.Localizable = i18n.T("departure.nothing")
+	if len(lines) > 0 {
+		message = lines
+	}
+
+	notification := map[string]interface{}{
+		"source":    "departure",
+		"severity":  severity,
+		"state":     AlertStateFiring,
+		"check_id":  report.ID,
+		"timestamp": report.CheckedAt.Unix(),
+	}
+	if len(report.LightsOn)+len(report.Running) > 0 {
+		notification["actions"] = []map[string]string{{
+			"id":     DepartureTurnOffAction,
+			"title":  i18n.T("departure.turn_off").String(),
+			"method": http.MethodPost,
+			"path":   "/api/departure/turn-off?check=" + report.ID,
+		}}
+	}
+
+	payload, err := localizedNotification(notification, title, message)
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: NotificationTopic, Payload: payload, QoS: 1}); err != nil {
+		s.logger.Error("Failed to publish departure notification", err)
+	}
+}
+
+func departureName(device DepartureDevice) string {
+	if device.Name != "" {
+		return device.Name
+	}
+	return device.DeviceID
+}
+
+// Handler serves the latest departure check as JSON
+func (s *DepartureService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"check": s.Last()})
+	})
+}
+
+// TurnOffHandler turns off the non-essentials of ?check= on a POST
+func (s *DepartureService) TurnOffHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to turn off the non-essentials", http.StatusMethodNotAllowed)
+			return
+		}
+
+		report, err := s.TurnOff(r.URL.Query().Get("check"), time.Now())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// departureDevices lists fixed device states and records commands
+type departureDevices struct {
+	recordingExecutor
+	devices []MQTTDeviceStatus
+}
+
+func (d *departureDevices) Devices() []MQTTDeviceStatus {
+	return d.devices
+}
+
+func TestDepartureCheck(t *testing.T) {
+	sensors := NewUnifiedSensorService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), log.New(os.Stdout, "", 0))
+	for _, message := range []struct{ topic, payload string }{
+		{"room-contact/hall", `{"open": true, "sensor": "front-door", "room": "hall", "device_id": "contact-hall"}`},
+		{"room-contact/kitchen", `{"open": true, "sensor": "kitchen-window", "room": "kitchen", "device_id": "contact-kitchen"}`},
+		{"room-contact/kitchen", `{"open": false, "sensor": "kitchen-window", "room": "kitchen", "device_id": "contact-kitchen"}`},
+	} {
+		if err := sensors.handleContactMessage(message.topic, []byte(message.payload)); err != nil {
+			t.Fatalf("Expected the contact report to be accepted, got %v", err)
+		}
+	}
+	if err := sensors.handleContactMessage("room-contact/hall", []byte(`{"room": "hall"}`)); err == nil {
+		t.Error("Expected a contact report without a state to be rejected")
+	}
+
+	on, off := true, false
+	lampW, dryerW := 6.0, 2400.0
+	devices := &departureDevices{devices: []MQTTDeviceStatus{
+		{DeviceID: "desk-lamp", DeviceName: "Desk lamp", On: &on, PowerW: &lampW},
+		{DeviceID: "dryer-plug", DeviceName: "Dryer", On: &on, PowerW: &dryerW},
+		{DeviceID: "fridge-plug", On: &on, PowerW: &dryerW},
+		{DeviceID: "tv-plug", On: &off},
+	}}
+
+	service := NewDepartureService(&DepartureConfig{Essential: []string{"fridge-plug"}}, nil)
+	service.SetRoomSensors(sensors)
+	service.SetDevices(devices)
+	var notification map[string]interface{}
+	service.publish = func(msg *mqtt.Message) error {
+		json.Unmarshal(msg.Payload, &notification)
+		return nil
+	}
+
+	// Only leaving runs the check, not moving from away to vacation
+	service.HandleMode(HomeModeHome)
+	service.HandleMode(HomeModeAway)
+	report := service.Last()
+	if report == nil || len(report.OpenContacts) != 1 || report.OpenContacts[0].Contact != "front-door" ||
+		len(report.LightsOn) != 1 || len(report.Running) != 1 || report.Running[0].DeviceID != "dryer-plug" {
+		t.Fatalf("Expected the open door, the lamp and the dryer, got %+v", report)
+	}
+	message, _ := notification["message"].(string)
+	if notification["severity"] != AlertSeverityWarning || !strings.Contains(message, "front-door open in hall") || notification["actions"] == nil {
+		t.Fatalf("Expected a warning with the turn-off action, got %v", notification)
+	}
+	notification = nil
+	service.HandleMode(HomeModeVacation)
+	if notification != nil {
+		t.Errorf("Expected no second check when the away home goes on vacation, got %v", notification)
+	}
+
+	// The action turns off the lamp and the dryer of this check only
+	recorder := httptest.NewRecorder()
+	service.TurnOffHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/departure/turn-off?check=stale", nil))
+	if recorder.Code != 409 {
+		t.Errorf("Expected an outdated check refused, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	service.TurnOffHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/departure/turn-off?check="+report.ID, nil))
+	commands := devices.take()
+	if recorder.Code != 200 || len(commands) != 2 || commands[0] != "turn_off desk-lamp" || commands[1] != "turn_off dryer-plug" {
+		t.Errorf("Expected the lamp and the dryer turned off, got %d with %v", recorder.Code, commands)
+	}
+
+	// Nothing left on is all clear, without an action
+	service.SetDevices(&departureDevices{})
+	sensors.handleContactMessage("room-contact/hall", []byte(`{"open": false, "sensor": "front-door", "room": "hall"}`))
+	service.Check(HomeModeAway, time.Now())
+	if notification["severity"] != AlertSeverityInfo || notification["actions"] != nil {
+		t.Errorf("Expected an all-clear notification, got %v", notification)
+	}
+}
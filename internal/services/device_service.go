@@ -1,22 +1,46 @@
 package services
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/identity"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/discovery"
 	"github.com/johnpr01/home-automation/pkg/kafka"
+	"github.com/johnpr01/home-automation/pkg/matter"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/tapo"
 )
 
+// bulbCommandTimeout bounds a single request to a real smart bulb
+const bulbCommandTimeout = 10 * time.Second
+
 type DeviceService struct {
 	devices     map[string]*models.Device
 	mutex       sync.RWMutex
 	mqttClient  *mqtt.Client
 	kafkaClient *kafka.Client
 	logger      *logger.Logger
+	safeMode    *safemode.Controller
+	dryRun      *dryrun.Recorder
+	bulbs       map[string]*tapo.BulbClient // Real Tapo bulbs backing light devices
+	matter      map[string]matterTarget     // Matter endpoints backing lights and switches
+	identities  *identity.Registry
+	roomTags    map[string][]string // Tags applied to every device in a room
+	commands    *CommandQueue       // Retries commands for bulbs and Matter devices that can't be reached
+
+	// Degrade commands a device lacks the capability for, e.g. turn_on instead of set_brightness
+	capabilityFallback bool
 }
 
 func NewDeviceService(mqttClient *mqtt.Client, kafkaClient *kafka.Client) *DeviceService {
@@ -24,12 +48,57 @@ func NewDeviceService(mqttClient *mqtt.Client, kafkaClient *kafka.Client) *Devic
 
 	return &DeviceService{
 		devices:     make(map[string]*models.Device),
+		bulbs:       make(map[string]*tapo.BulbClient),
+		matter:      make(map[string]matterTarget),
+		roomTags:    make(map[string][]string),
 		mqttClient:  mqttClient,
 		kafkaClient: kafkaClient,
 		logger:      logger,
 	}
 }
 
+// SetSafeMode attaches a safe mode controller that blocks device commands
+func (s *DeviceService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces commands in observe-only mode
+func (s *DeviceService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// SetCapabilityFallback allows commands to degrade when the device lacks the needed capability
+func (s *DeviceService) SetCapabilityFallback(enabled bool) {
+	s.capabilityFallback = enabled
+}
+
+// EnableCommandQueue queues the commands that Tapo bulbs and Matter devices can't be reached
+// for, delivering them once they can. The queue retries only while it is started.
+func (s *DeviceService) EnableCommandQueue(cfg config.CommandQueueConfig) *CommandQueue {
+	s.commands = NewCommandQueue(cfg, s.deliverCommand, s.logger)
+	return s.commands
+}
+
+// UpdateCapabilities replaces the capabilities a device reports, e.g. from discovery
+func (s *DeviceService) UpdateCapabilities(deviceID string, capabilities []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	device, exists := s.devices[deviceID]
+	if !exists {
+		return fmt.Errorf("device with id %s not found", deviceID)
+	}
+
+	device.Capabilities = capabilities
+	return nil
+}
+
+// SetIdentityRegistry assigns stable UUIDs to devices as they are added, and gives them the
+// name, room, icon and tags edited in the registry
+func (s *DeviceService) SetIdentityRegistry(registry *identity.Registry) {
+	s.identities = registry
+}
+
 // logWithKafka logs to both file and Kafka
 func (s *DeviceService) logWithKafka(level, message string, deviceID, action string, metadata map[string]interface{}) {
 	// Log to structured logger
@@ -38,13 +107,14 @@ func (s *DeviceService) logWithKafka(level, message string, deviceID, action str
 	// Send to Kafka if client is available
 	if s.kafkaClient != nil {
 		logMsg := &kafka.LogMessage{
-			Level:     level,
-			Service:   "DeviceService",
-			Message:   message,
-			DeviceID:  deviceID,
-			Action:    action,
-			Timestamp: time.Now().Format(time.RFC3339),
-			Metadata:  metadata,
+			Level:      level,
+			Service:    "DeviceService",
+			Message:    message,
+			DeviceID:   deviceID,
+			DeviceUUID: s.deviceUUID(deviceID),
+			Action:     action,
+			Timestamp:  time.Now().Format(time.RFC3339),
+			Metadata:   metadata,
 		}
 		err := s.kafkaClient.PublishLogMessage(logMsg)
 		if err != nil {
@@ -57,6 +127,12 @@ func (s *DeviceService) logWithKafka(level, message string, deviceID, action str
 	}
 }
 
+// deviceUUID returns the stable UUID claimed for a device ID, if any
+func (s *DeviceService) deviceUUID(deviceID string) string {
+	uuid, _ := s.identities.Resolve(identity.NewAlias(identity.AliasDeviceID, deviceID))
+	return uuid
+}
+
 func (s *DeviceService) GetDevice(id string) (*models.Device, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -85,18 +161,128 @@ func (s *DeviceService) AddDevice(device *models.Device) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.identities != nil {
+		claimed, err := s.identities.Claim(device.Name, deviceAliases(device)...)
+		if err != nil {
+			return fmt.Errorf("failed to claim identity for device %s: %w", device.ID, err)
+		}
+		device.UUID = claimed.UUID
+		applyIdentity(device, claimed)
+	}
+
 	s.devices[device.ID] = device
 
 	message := fmt.Sprintf("Device added: %s (%s)", device.Name, device.ID)
 	metadata := map[string]interface{}{
 		"device_name": device.Name,
 		"device_type": string(device.Type),
+		"device_uuid": device.UUID,
 	}
 	s.logWithKafka("INFO", message, device.ID, "add_device", metadata)
 
 	return nil
 }
 
+// applyIdentity overrides a device's configured metadata with what the user set in the registry
+func applyIdentity(device *models.Device, claimed identity.Identity) {
+	if claimed.NameEdited {
+		device.Name = claimed.Name
+	}
+	if claimed.RoomID != "" {
+		device.RoomID = claimed.RoomID
+	}
+	if len(claimed.Tags) > 0 {
+		device.Tags = claimed.Tags
+	}
+	if claimed.Icon != "" {
+		if device.Properties == nil {
+			device.Properties = make(map[string]interface{})
+		}
+		device.Properties["icon"] = claimed.Icon
+	}
+}
+
+// deviceAliases returns the identifiers a device is known by: its ID plus any
+// mac, vendor_id, mqtt_device_id or ip_address properties
+func deviceAliases(device *models.Device) []identity.Alias {
+	aliases := []identity.Alias{identity.NewAlias(identity.AliasDeviceID, device.ID)}
+
+	properties := map[string]identity.AliasKind{
+		"mac":            identity.AliasMAC,
+		"vendor_id":      identity.AliasVendorID,
+		"mqtt_device_id": identity.AliasMQTTDeviceID,
+		"ip_address":     identity.AliasIP,
+	}
+	for property, kind := range properties {
+		if value, ok := device.Properties[property].(string); ok && value != "" {
+			aliases = append(aliases, identity.NewAlias(kind, value))
+		}
+	}
+
+	return aliases
+}
+
+// AddTapoBulb connects to a real Tapo L530/L900 bulb and adds a light device backed by it.
+// Light commands for the device are sent to the bulb instead of only updating its simulated state.
+func (s *DeviceService) AddTapoBulb(ctx context.Context, device *models.Device, bulb *tapo.BulbClient) error {
+	if device.Type != models.DeviceTypeLight {
+		return fmt.Errorf("device %s is not a light", device.ID)
+	}
+
+	if device.Properties == nil {
+		device.Properties = make(map[string]interface{})
+	}
+	device.Properties["backend"] = "tapo"
+	if len(device.Capabilities) == 0 {
+		device.Capabilities = []string{
+			string(discovery.CapabilitySwitch),
+			string(discovery.CapabilityDimmer),
+			string(discovery.CapabilityColor),
+		}
+	}
+
+	if err := bulb.Connect(ctx); err != nil {
+		return errors.NewDeviceError(fmt.Sprintf("failed to connect to Tapo bulb %s", device.ID), err).WithDevice(device.ID)
+	}
+	if err := s.AddDevice(device); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.bulbs[device.ID] = bulb
+	s.mutex.Unlock()
+	return nil
+}
+
+// MatterCommander sends cluster commands to Matter nodes; *matter.Client implements it
+type MatterCommander interface {
+	SendCommand(ctx context.Context, nodeID uint64, endpoint int, cmd matter.Command) error
+}
+
+// matterTarget is the node endpoint a device's commands go to
+type matterTarget struct {
+	commander MatterCommander
+	nodeID    uint64
+	endpoint  int
+}
+
+// AddMatterDevice adds a light, switch or sensor device backed by an endpoint of a commissioned
+// Matter node. Light and switch commands for the device are sent to the node.
+func (s *DeviceService) AddMatterDevice(device *models.Device, commander MatterCommander, nodeID uint64, endpoint int) error {
+	if device.Properties == nil {
+		device.Properties = make(map[string]interface{})
+	}
+	device.Properties["backend"] = "matter"
+	device.Properties["matter_node_id"] = nodeID
+	device.Properties["matter_endpoint"] = endpoint
+
+	s.mutex.Lock()
+	s.matter[device.ID] = matterTarget{commander: commander, nodeID: nodeID, endpoint: endpoint}
+	s.mutex.Unlock()
+
+	return s.AddDevice(device)
+}
+
 func (s *DeviceService) UpdateDevice(id string, updates map[string]interface{}) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -114,7 +300,61 @@ func (s *DeviceService) UpdateDevice(id string, updates map[string]interface{})
 	return nil
 }
 
+// SetRoomTags sets the tags of a room; its devices match them as if tagged themselves
+func (s *DeviceService) SetRoomTags(roomID string, tags []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.roomTags[roomID] = tags
+}
+
+// GetRoomTags returns the tags of a room
+func (s *DeviceService) GetRoomTags(roomID string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.roomTags[roomID]
+}
+
+// DeviceTags returns a device's own tags plus those of its room
+func (s *DeviceService) DeviceTags(device *models.Device) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.deviceTags(device)
+}
+
+// deviceTags merges device and room tags; callers must hold the lock
+func (s *DeviceService) deviceTags(device *models.Device) []string {
+	tags := append([]string{}, device.Tags...)
+	for _, tag := range s.roomTags[device.RoomID] {
+		if !models.HasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// GetDevicesByTag returns the devices carrying a tag directly or through their room, sorted by ID
+func (s *DeviceService) GetDevicesByTag(tag string) []*models.Device {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	devices := make([]*models.Device, 0)
+	for _, device := range s.devices {
+		if models.HasTag(s.deviceTags(device), tag) {
+			devices = append(devices, device)
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices
+}
+
 func (s *DeviceService) ExecuteCommand(cmd *models.DeviceCommand) error {
+	if cmd.DeviceID == "" && cmd.Tag != "" {
+		return s.executeTagCommand(cmd)
+	}
+
 	device, err := s.GetDevice(cmd.DeviceID)
 	if err != nil {
 		message := fmt.Sprintf("Failed to execute command: device %s not found", cmd.DeviceID)
@@ -122,6 +362,35 @@ func (s *DeviceService) ExecuteCommand(cmd *models.DeviceCommand) error {
 		return err
 	}
 
+	// Make sure the device can perform the action, degrading it when allowed
+	resolved, err := s.negotiateCapability(device, cmd)
+	if err != nil {
+		s.logWithKafka("ERROR", err.Error(), cmd.DeviceID, cmd.Action, nil)
+		return err
+	}
+	if resolved != cmd {
+		message := fmt.Sprintf("Device %s lacks the capability for '%s', degrading to '%s'", cmd.DeviceID, cmd.Action, resolved.Action)
+		s.logWithKafka("WARN", message, cmd.DeviceID, cmd.Action, map[string]interface{}{
+			"requested_action": cmd.Action,
+			"degraded_action":  resolved.Action,
+		})
+		cmd = resolved
+	}
+
+	if !s.safeMode.Allowed(safemode.ComponentDevice, cmd.DeviceID) {
+		message := fmt.Sprintf("Safe mode active, command '%s' on device %s not executed", cmd.Action, cmd.DeviceID)
+		s.logWithKafka("WARN", message, cmd.DeviceID, cmd.Action, nil)
+		return fmt.Errorf("safe mode active: device %s is not enabled", cmd.DeviceID)
+	}
+
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("device", cmd.Action, cmd.DeviceID, "device command requested", map[string]interface{}{
+			"device_type": string(device.Type),
+			"value":       cmd.Value,
+		})
+		return nil
+	}
+
 	message := fmt.Sprintf("Executing command '%s' on device %s", cmd.Action, cmd.DeviceID)
 	metadata := map[string]interface{}{
 		"device_type":   string(device.Type),
@@ -129,7 +398,32 @@ func (s *DeviceService) ExecuteCommand(cmd *models.DeviceCommand) error {
 	}
 	s.logWithKafka("INFO", message, cmd.DeviceID, cmd.Action, metadata)
 
-	// Execute command based on device type and action
+	if s.commands != nil && s.hasBackend(device.ID) {
+		return s.commands.Submit(cmd)
+	}
+	return s.dispatchCommand(device, cmd)
+}
+
+// hasBackend reports whether a device's commands are sent to a real bulb or Matter node
+func (s *DeviceService) hasBackend(deviceID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, bulb := s.bulbs[deviceID]
+	_, node := s.matter[deviceID]
+	return bulb || node
+}
+
+// deliverCommand dispatches a command the queue delivers or retries
+func (s *DeviceService) deliverCommand(cmd *models.DeviceCommand) error {
+	device, err := s.GetDevice(cmd.DeviceID)
+	if err != nil {
+		return errors.NewValidationError(fmt.Sprintf("device with id %s not found", cmd.DeviceID), err)
+	}
+	return s.dispatchCommand(device, cmd)
+}
+
+// dispatchCommand executes a command based on device type and action
+func (s *DeviceService) dispatchCommand(device *models.Device, cmd *models.DeviceCommand) error {
 	switch device.Type {
 	case models.DeviceTypeLight:
 		return s.executeLightCommand(device, cmd)
@@ -139,14 +433,53 @@ func (s *DeviceService) ExecuteCommand(cmd *models.DeviceCommand) error {
 		return s.executeClimateCommand(device, cmd)
 	default:
 		message := fmt.Sprintf("Unsupported device type: %s for device %s", device.Type, device.ID)
-		s.logWithKafka("ERROR", message, device.ID, cmd.Action, metadata)
+		s.logWithKafka("ERROR", message, device.ID, cmd.Action, map[string]interface{}{
+			"device_type":   string(device.Type),
+			"command_value": cmd.Value,
+		})
 		return fmt.Errorf("unsupported device type: %s", device.Type)
 	}
 }
 
+// executeTagCommand runs a command on every device carrying its tag, continuing past failures
+func (s *DeviceService) executeTagCommand(cmd *models.DeviceCommand) error {
+	devices := s.GetDevicesByTag(cmd.Tag)
+	if len(devices) == 0 {
+		message := fmt.Sprintf("Failed to execute command: no devices tagged %s", cmd.Tag)
+		s.logWithKafka("ERROR", message, "", cmd.Action, map[string]interface{}{"tag": cmd.Tag})
+		return fmt.Errorf("no devices tagged %s", cmd.Tag)
+	}
+
+	var failed []string
+	for _, device := range devices {
+		deviceCmd := *cmd
+		deviceCmd.DeviceID = device.ID
+		if err := s.ExecuteCommand(&deviceCmd); err != nil {
+			failed = append(failed, device.ID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("command '%s' failed on %d of %d devices tagged %s: %s",
+			cmd.Action, len(failed), len(devices), cmd.Tag, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 // Internal command execution methods
 func (s *DeviceService) executeLightCommand(device *models.Device, cmd *models.DeviceCommand) error {
-	// Implement light-specific commands (on, off, dim, etc.)
+	// Implement light-specific commands (on, off, dim, color, etc.)
+	if err := s.sendBulbCommand(device, cmd); err != nil {
+		message := fmt.Sprintf("Failed to send '%s' to Tapo bulb %s", cmd.Action, device.ID)
+		s.logWithKafka("ERROR", message, device.ID, cmd.Action, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	if err := s.sendMatterCommand(device, cmd); err != nil {
+		message := fmt.Sprintf("Failed to send '%s' to Matter device %s", cmd.Action, device.ID)
+		s.logWithKafka("ERROR", message, device.ID, cmd.Action, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
 	switch cmd.Action {
 	case "turn_on":
 		device.Status = "on"
@@ -167,6 +500,24 @@ func (s *DeviceService) executeLightCommand(device *models.Device, cmd *models.D
 			metadata := map[string]interface{}{"brightness": value}
 			s.logWithKafka("INFO", message, device.ID, cmd.Action, metadata)
 		}
+	case "set_color_temp":
+		if value, ok := cmd.Value.(float64); ok {
+			device.Properties["color_temp"] = value
+			delete(device.Properties, "hue")
+			delete(device.Properties, "saturation")
+			message := fmt.Sprintf("Light %s color temperature set to %.0fK", device.ID, value)
+			metadata := map[string]interface{}{"color_temp": value}
+			s.logWithKafka("INFO", message, device.ID, cmd.Action, metadata)
+		}
+	case "set_color":
+		if hue, saturation, ok := parseHueSaturation(cmd.Value); ok {
+			device.Properties["hue"] = hue
+			device.Properties["saturation"] = saturation
+			delete(device.Properties, "color_temp")
+			message := fmt.Sprintf("Light %s color set to hue %.0f saturation %.0f", device.ID, hue, saturation)
+			metadata := map[string]interface{}{"hue": hue, "saturation": saturation}
+			s.logWithKafka("INFO", message, device.ID, cmd.Action, metadata)
+		}
 	default:
 		message := fmt.Sprintf("Unknown light command: %s for device %s", cmd.Action, device.ID)
 		s.logWithKafka("WARN", message, device.ID, cmd.Action, nil)
@@ -174,7 +525,106 @@ func (s *DeviceService) executeLightCommand(device *models.Device, cmd *models.D
 	return nil
 }
 
+// sendBulbCommand forwards a light command to the Tapo bulb backing the device, if any
+func (s *DeviceService) sendBulbCommand(device *models.Device, cmd *models.DeviceCommand) error {
+	s.mutex.RLock()
+	bulb, exists := s.bulbs[device.ID]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulbCommandTimeout)
+	defer cancel()
+
+	switch cmd.Action {
+	case "turn_on":
+		return bulb.SetOn(ctx, true)
+	case "turn_off":
+		return bulb.SetOn(ctx, false)
+	case "set_brightness":
+		if value, ok := cmd.Value.(float64); ok {
+			return bulb.SetBrightness(ctx, int(value))
+		}
+		return errors.NewValidationError(fmt.Sprintf("invalid brightness value: %v", cmd.Value), nil)
+	case "set_color_temp":
+		if value, ok := cmd.Value.(float64); ok {
+			return bulb.SetColorTemp(ctx, int(value))
+		}
+		return errors.NewValidationError(fmt.Sprintf("invalid color temperature value: %v", cmd.Value), nil)
+	case "set_color":
+		if hue, saturation, ok := parseHueSaturation(cmd.Value); ok {
+			return bulb.SetHueSaturation(ctx, int(hue), int(saturation))
+		}
+		return errors.NewValidationError(fmt.Sprintf("invalid color value: %v", cmd.Value), nil)
+	}
+
+	return nil
+}
+
+// sendMatterCommand forwards a light or switch command to the Matter endpoint backing the device, if any
+func (s *DeviceService) sendMatterCommand(device *models.Device, cmd *models.DeviceCommand) error {
+	s.mutex.RLock()
+	target, exists := s.matter[device.ID]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return nil
+	}
+
+	var command matter.Command
+	switch cmd.Action {
+	case "turn_on":
+		command = matter.OnCommand(true)
+	case "turn_off":
+		command = matter.OnCommand(false)
+	case "set_brightness":
+		value, ok := cmd.Value.(float64)
+		if !ok {
+			return errors.NewValidationError(fmt.Sprintf("invalid brightness value: %v", cmd.Value), nil)
+		}
+		command = matter.LevelCommand(int(value))
+	case "set_color_temp":
+		value, ok := cmd.Value.(float64)
+		if !ok {
+			return errors.NewValidationError(fmt.Sprintf("invalid color temperature value: %v", cmd.Value), nil)
+		}
+		command = matter.ColorTempCommand(int(value))
+	case "set_color":
+		hue, saturation, ok := parseHueSaturation(cmd.Value)
+		if !ok {
+			return errors.NewValidationError(fmt.Sprintf("invalid color value: %v", cmd.Value), nil)
+		}
+		command = matter.HueSaturationCommand(int(hue), int(saturation))
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulbCommandTimeout)
+	defer cancel()
+	return target.commander.SendCommand(ctx, target.nodeID, target.endpoint, command)
+}
+
+// parseHueSaturation extracts a {"hue": h, "saturation": s} command value
+func parseHueSaturation(value interface{}) (float64, float64, bool) {
+	color, ok := value.(map[string]interface{})
+	if !ok {
+		return 0, 0, false
+	}
+
+	hue, hueOK := color["hue"].(float64)
+	saturation, saturationOK := color["saturation"].(float64)
+	return hue, saturation, hueOK && saturationOK
+}
+
 func (s *DeviceService) executeSwitchCommand(device *models.Device, cmd *models.DeviceCommand) error {
+	if err := s.sendMatterCommand(device, cmd); err != nil {
+		message := fmt.Sprintf("Failed to send '%s' to Matter device %s", cmd.Action, device.ID)
+		s.logWithKafka("ERROR", message, device.ID, cmd.Action, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
 	// Implement switch-specific commands (on, off)
 	switch cmd.Action {
 	case "turn_on":
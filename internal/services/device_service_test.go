@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func TestExecuteCommandByTag(t *testing.T) {
+	service := NewDeviceService(nil, nil)
+
+	devices := []*models.Device{
+		{ID: "porch-light", Type: models.DeviceTypeLight, Status: "on", Tags: []string{"holiday-lights"}, Properties: map[string]interface{}{}},
+		{ID: "tree-plug", Type: models.DeviceTypeSwitch, Status: "on", RoomID: "living_room", Properties: map[string]interface{}{}},
+		{ID: "desk-lamp", Type: models.DeviceTypeLight, Status: "on", RoomID: "office", Properties: map[string]interface{}{}},
+	}
+	for _, device := range devices {
+		if err := service.AddDevice(device); err != nil {
+			t.Fatalf("AddDevice failed: %v", err)
+		}
+	}
+
+	// Room tags apply to every device in the room
+	service.SetRoomTags("living_room", []string{"Holiday-Lights"})
+
+	tagged := service.GetDevicesByTag("holiday-lights")
+	if len(tagged) != 2 || tagged[0].ID != "porch-light" || tagged[1].ID != "tree-plug" {
+		t.Fatalf("Expected porch-light and tree-plug to be tagged, got %v", tagged)
+	}
+
+	if err := service.ExecuteCommand(&models.DeviceCommand{Tag: "holiday-lights", Action: "turn_off"}); err != nil {
+		t.Fatalf("ExecuteCommand failed: %v", err)
+	}
+
+	for _, id := range []string{"porch-light", "tree-plug"} {
+		if device, _ := service.GetDevice(id); device.Status != "off" {
+			t.Errorf("Expected %s to be switched off, got %s", id, device.Status)
+		}
+	}
+	if device, _ := service.GetDevice("desk-lamp"); device.Status != "on" {
+		t.Errorf("Expected untagged desk-lamp to stay on, got %s", device.Status)
+	}
+
+	if err := service.ExecuteCommand(&models.DeviceCommand{Tag: "no-such-tag", Action: "turn_off"}); err == nil {
+		t.Error("Expected an error for a tag without devices")
+	}
+}
+
+func TestExecuteCommandChecksCapabilities(t *testing.T) {
+	service := NewDeviceService(nil, nil)
+
+	devices := []*models.Device{
+		{ID: "hall-light", Type: models.DeviceTypeLight, Status: "off", Tags: []string{"hall"}, Capabilities: []string{"switch"}, Properties: map[string]interface{}{}},
+		{ID: "lounge-lamp", Type: models.DeviceTypeLight, Status: "off", Capabilities: []string{"switch", "dimmer"}, Properties: map[string]interface{}{}},
+		{ID: "old-lamp", Type: models.DeviceTypeLight, Status: "off", Properties: map[string]interface{}{}},
+	}
+	for _, device := range devices {
+		if err := service.AddDevice(device); err != nil {
+			t.Fatalf("AddDevice failed: %v", err)
+		}
+	}
+
+	err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "hall-light", Action: "set_brightness", Value: 50.0})
+	if err == nil || !strings.Contains(err.Error(), `"dimmer"`) || !strings.Contains(err.Error(), "turn_on") {
+		t.Fatalf("Expected an error naming the dimmer capability and turn_on, got %v", err)
+	}
+	if err := service.ValidateCommand(&models.DeviceCommand{Tag: "hall", Action: "set_brightness", Value: 50.0}); err == nil {
+		t.Error("Expected tag command validation to fail for hall-light")
+	}
+
+	// Devices that report the capability, or none at all, are not restricted
+	for _, id := range []string{"lounge-lamp", "old-lamp"} {
+		if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: id, Action: "set_brightness", Value: 50.0}); err != nil {
+			t.Errorf("Expected set_brightness on %s to succeed, got %v", id, err)
+		}
+	}
+
+	// A command can opt into fallback
+	err = service.ExecuteCommand(&models.DeviceCommand{DeviceID: "hall-light", Action: "set_brightness", Value: 50.0,
+		Options: map[string]interface{}{"fallback": true}})
+	if err != nil {
+		t.Fatalf("Expected fallback to succeed, got %v", err)
+	}
+	if device, _ := service.GetDevice("hall-light"); device.Status != "on" {
+		t.Errorf("Expected hall-light to be turned on instead, got %s", device.Status)
+	}
+
+	// ...or out of it when fallback is enabled for the service
+	service.SetCapabilityFallback(true)
+	if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "hall-light", Action: "set_brightness", Value: 0.0}); err != nil {
+		t.Fatalf("Expected fallback to succeed, got %v", err)
+	}
+	if device, _ := service.GetDevice("hall-light"); device.Status != "off" {
+		t.Errorf("Expected zero brightness to turn hall-light off, got %s", device.Status)
+	}
+	if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "hall-light", Action: "set_color", Value: "red",
+		Options: map[string]interface{}{"fallback": false}}); err == nil {
+		t.Error("Expected the fallback option to override the service setting")
+	}
+}
+
+func TestAddDeviceAppliesRegistryMetadata(t *testing.T) {
+	registry, _ := identity.NewRegistry("")
+	claimed, _ := registry.Claim("plug_01", identity.NewAlias(identity.AliasDeviceID, "plug_01"))
+	name, room, icon := "Fridge", "kitchen", "🧊"
+	tags := []string{"appliance"}
+	registry.Update(claimed.UUID, identity.DeviceUpdate{Name: &name, RoomID: &room, Icon: &icon, Tags: &tags})
+
+	service := NewDeviceService(nil, nil)
+	service.SetIdentityRegistry(registry)
+	device := &models.Device{ID: "plug_01", Name: "plug_01", Type: models.DeviceTypeSwitch, RoomID: "garage"}
+	if err := service.AddDevice(device); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	if device.UUID != claimed.UUID || device.Name != "Fridge" || device.RoomID != "kitchen" || device.Properties["icon"] != "🧊" {
+		t.Errorf("Expected the registry's metadata on the device, got %+v", device)
+	}
+	if tagged := service.GetDevicesByTag("appliance"); len(tagged) != 1 {
+		t.Errorf("Expected the device tagged from the registry, got %v", tagged)
+	}
+}
+
+func TestAddTapoBulbRequiresConnection(t *testing.T) {
+	service := NewDeviceService(nil, nil)
+	bulbs := service.TapoBulbs()
+
+	// Nothing listens on port 1, so neither protocol connects
+	cfg := TapoBulbConfig{DeviceID: "desk-bulb", IPAddress: "127.0.0.1:1", Username: "user", Password: "pass"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := service.AddConfiguredTapoBulb(ctx, cfg)
+	if appErr, ok := err.(*errors.HomeAutomationError); !ok || appErr.Type != errors.ErrorTypeDevice {
+		t.Fatalf("Expected a device error for an unreachable bulb, got %v", err)
+	}
+	if _, err := service.GetDevice("desk-bulb"); err == nil || bulbs.Handles("desk-bulb") || len(bulbs.Devices()) != 0 {
+		t.Fatal("Expected an unreachable bulb to be neither added nor registered")
+	}
+}
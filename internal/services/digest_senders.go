@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	defaultSMTPPort        = 587
+	defaultTelegramAPIURL  = "https://api.telegram.org"
+	telegramMaxMessageSize = 4096 // Characters Telegram accepts in one message
+)
+
+// DigestEmailConfig sends the digest over SMTP. STARTTLS is used when the server offers it. An
+// empty password falls back to HA_DIGEST_SMTP_PASSWORD.
+type DigestEmailConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port,omitempty"` // 587 by default
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Validate checks there is a server, a sender and recipients
+func (c *DigestEmailConfig) Validate() error {
+	if c.Host == "" || c.From == "" || len(c.To) == 0 {
+		return errors.NewValidationError("digest email needs a host, from and to", nil)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.NewValidationError(fmt.Sprintf("invalid digest smtp port %d", c.Port), nil)
+	}
+	return nil
+}
+
+// DigestTelegramConfig sends the digest with a Telegram bot to its chats. An empty token falls
+// back to HA_DIGEST_TELEGRAM_TOKEN.
+type DigestTelegramConfig struct {
+	BotToken string   `json:"bot_token,omitempty"`
+	ChatIDs  []string `json:"chat_ids"`
+	APIURL   string   `json:"api_url,omitempty"` // https://api.telegram.org by default
+}
+
+// Validate checks there are chats to send to
+func (c *DigestTelegramConfig) Validate() error {
+	if len(c.ChatIDs) == 0 {
+		return errors.NewValidationError("digest telegram needs chat_ids", nil)
+	}
+	return nil
+}
+
+// emailDigestSender mails the digest as plain UTF-8 text
+type emailDigestSender struct {
+	config   *DigestEmailConfig
+	password string
+	sendMail func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newEmailDigestSender(config *DigestEmailConfig) *emailDigestSender {
+	password := config.Password
+	if password == "" {
+		password = os.Getenv("HA_DIGEST_SMTP_PASSWORD")
+	}
+	return &emailDigestSender{config: config, password: password, sendMail: smtp.SendMail}
+}
+
+// Send mails the digest to every recipient
+func (e *emailDigestSender) Send(subject, body string) error {
+	port := e.config.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if e.config.Username != "" {
+		auth = smtp.PlainAuth("", e.config.Username, e.password, e.config.Host)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	message.WriteString("\r\n")
+
+	addr := net.JoinHostPort(e.config.Host, strconv.Itoa(port))
+	if err := e.sendMail(addr, auth, e.config.From, e.config.To, message.Bytes()); err != nil {
+		return errors.NewServiceError("failed to mail the digest", err)
+	}
+	return nil
+}
+
+// telegramDigestSender posts the digest to Telegram chats through the Bot API
+type telegramDigestSender struct {
+	apiURL string
+	token  string
+	chats  []string
+	client *http.Client
+}
+
+func newTelegramDigestSender(config *DigestTelegramConfig) *telegramDigestSender {
+	token := config.BotToken
+	if token == "" {
+		token = os.Getenv("HA_DIGEST_TELEGRAM_TOKEN")
+	}
+	apiURL := config.APIURL
+	if apiURL == "" {
+		apiURL = defaultTelegramAPIURL
+	}
+	return &telegramDigestSender{
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		token:  token,
+		chats:  config.ChatIDs,
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Send posts the digest to every chat, split where it exceeds Telegram's message size
+func (t *telegramDigestSender) Send(subject, body string) error {
+	if t.token == "" {
+		return errors.NewConfigError("no telegram bot token", nil)
+	}
+	parts := splitMessage(subject+"\n\n"+body, telegramMaxMessageSize)
+	for _, chat := range t.chats {
+		for _, part := range parts {
+			if err := t.sendMessage(chat, part); err != nil {
+				return errors.NewServiceError("failed to send the digest to telegram chat "+chat, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *telegramDigestSender) sendMessage(chat, text string) error {
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", t.apiURL, t.token)
+	resp, err := t.client.PostForm(endpoint, url.Values{"chat_id": {chat}, "text": {text}})
+	if err != nil {
+		// The request URL holds the token; keep it out of logs
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || !result.OK {
+		return fmt.Errorf("telegram returned %d: %s", resp.StatusCode, result.Description)
+	}
+	return nil
+}
+
+// splitMessage splits text into parts of at most size characters, at line breaks where it can
+func splitMessage(text string, size int) []string {
+	var parts []string
+	runes := []rune(text)
+	for len(runes) > size {
+		cut := size
+		if i := strings.LastIndex(string(runes[:size]), "\n"); i > 0 {
+			cut = len([]rune(string(runes[:size])[:i]))
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), "\n"))
+	}
+	return append(parts, string(runes))
+}
@@ -0,0 +1,549 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// Digest schedules
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestFileName keeps when the digest was last sent, so a restart doesn't send it again
+const DigestFileName = "digest.json"
+
+// DigestPath returns the digest state file path for a state directory
+func DigestPath(stateDir string) string {
+	return filepath.Join(stateDir, DigestFileName)
+}
+
+// Defaults of the digest
+const (
+	defaultDigestAt              = "07:30"
+	defaultDigestWeekday         = "monday"
+	defaultDigestMaintenanceDays = 30
+)
+
+// DigestConfig schedules the plain-text digest and where it is sent
+type DigestConfig struct {
+	Schedule string `json:"schedule,omitempty"` // daily (default) or weekly
+	At       string `json:"at,omitempty"`       // Local time of day, "07:30" by default
+	Weekday  string `json:"weekday,omitempty"`  // Day of weekly digests, "monday" by default
+	// Locale of the digest; the global locale when unset
+	Locale string `json:"locale,omitempty"`
+	// MaintenanceDays is how far ahead warranties ending are listed, 30 by default
+	MaintenanceDays int                   `json:"maintenance_days,omitempty"`
+	Email           *DigestEmailConfig    `json:"email,omitempty"`
+	Telegram        *DigestTelegramConfig `json:"telegram,omitempty"`
+}
+
+// LoadDigestConfig reads the digest configuration from a JSON file
+func LoadDigestConfig(path string) (*DigestConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read digest file", err)
+	}
+
+	var cfg DigestConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse digest file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the schedule, the locale and that the digest goes somewhere
+func (c *DigestConfig) Validate() error {
+	switch c.Schedule {
+	case "", DigestDaily, DigestWeekly:
+	default:
+		return errors.NewValidationError(fmt.Sprintf("unknown digest schedule %q, use daily or weekly", c.Schedule), nil)
+	}
+	if _, err := time.Parse("15:04", c.at()); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid digest time %q, use HH:MM", c.At), err)
+	}
+	if _, ok := parseWeekday(c.weekday()); !ok {
+		return errors.NewValidationError(fmt.Sprintf("unknown digest weekday %q", c.Weekday), nil)
+	}
+	if _, ok := i18n.Normalize(c.Locale); c.Locale != "" && !ok {
+		return errors.NewValidationError(fmt.Sprintf("unsupported digest locale %q", c.Locale), nil)
+	}
+	if c.MaintenanceDays < 0 {
+		return errors.NewValidationError("maintenance_days must not be negative", nil)
+	}
+	if c.Email == nil && c.Telegram == nil {
+		return errors.NewValidationError("the digest needs an email or a telegram destination", nil)
+	}
+	if c.Email != nil {
+		if err := c.Email.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Telegram != nil {
+		return c.Telegram.Validate()
+	}
+	return nil
+}
+
+func (c *DigestConfig) at() string {
+	if c.At != "" {
+		return c.At
+	}
+	return defaultDigestAt
+}
+
+func (c *DigestConfig) weekday() string {
+	if c.Weekday != "" {
+		return c.Weekday
+	}
+	return defaultDigestWeekday
+}
+
+func (c *DigestConfig) maintenanceDays() int {
+	if c.MaintenanceDays > 0 {
+		return c.MaintenanceDays
+	}
+	return defaultDigestMaintenanceDays
+}
+
+// days is how many days a digest covers
+func (c *DigestConfig) days() int {
+	if c.Schedule == DigestWeekly {
+		return 7
+	}
+	return 1
+}
+
+func (c *DigestConfig) locale() string {
+	if locale, ok := i18n.Normalize(c.Locale); ok {
+		return locale
+	}
+	return i18n.Locale()
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// DigestStatus is the outcome of the last digest
+type DigestStatus struct {
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastSent    time.Time `json:"last_sent,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// EnergyHistory is the daily energy use of every room; EnergyService implements it
+type EnergyHistory interface {
+	Daily(days int, now time.Time) []RoomEnergyDays
+}
+
+// AlertHistory lists the firing and recently resolved alerts; AlertService implements it
+type AlertHistory interface {
+	Active() []Alert
+	Resolved() []Alert
+}
+
+// OutdoorTemperatureReader reports the outdoor temperature; WeatherService implements it
+type OutdoorTemperatureReader interface {
+	OutdoorTemperature(now time.Time) (float64, bool)
+}
+
+// digestSender delivers a digest to one destination
+type digestSender interface {
+	Send(subject, body string) error
+}
+
+// DigestService sends a daily or weekly digest of the home in plain sentences, by email or
+// Telegram, for residents who don't use the dashboard. It reads the rooms, the energy history,
+// the alerts and the asset records; sections whose source isn't set are left out.
+type DigestService struct {
+	config     *DigestConfig
+	path       string
+	senders    []digestSender
+	rooms      RoomSensorReader
+	energy     EnergyHistory
+	alerts     AlertHistory
+	warranties *identity.Registry
+	weather    OutdoorTemperatureReader
+	status     DigestStatus
+	logger     *logger.Logger
+	mu         sync.Mutex
+	run        sync.Mutex // Serializes sending
+}
+
+// NewDigestService creates the digest service, restoring when the digest was last sent
+func NewDigestService(config *DigestConfig, path string, serviceLogger *logger.Logger) *DigestService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("Digest", nil)
+	}
+
+	service := &DigestService{config: config, path: path, logger: serviceLogger}
+	if config.Email != nil {
+		service.senders = append(service.senders, newEmailDigestSender(config.Email))
+	}
+	if config.Telegram != nil {
+		service.senders = append(service.senders, newTelegramDigestSender(config.Telegram))
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &service.status); err != nil {
+			serviceLogger.Error("Failed to parse digest state", err)
+		}
+	}
+	return service
+}
+
+// SetRoomSensors sets where room temperatures come from
+func (s *DigestService) SetRoomSensors(rooms RoomSensorReader) {
+	s.rooms = rooms
+}
+
+// SetEnergy sets where the daily energy use comes from
+func (s *DigestService) SetEnergy(energy EnergyHistory) {
+	s.energy = energy
+}
+
+// SetAlerts sets where the alerts come from
+func (s *DigestService) SetAlerts(alerts AlertHistory) {
+	s.alerts = alerts
+}
+
+// SetWarranties lists the warranties ending soon from the asset records
+func (s *DigestService) SetWarranties(registry *identity.Registry) {
+	s.warranties = registry
+}
+
+// SetWeather adds the outdoor temperature
+func (s *DigestService) SetWeather(weather OutdoorTemperatureReader) {
+	s.weather = weather
+}
+
+// Run sends the digest when it is due until the context is cancelled
+func (s *DigestService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if s.due(now) {
+				if err := s.Send(now); err != nil {
+					s.logger.Error("Failed to send the digest", err)
+				}
+			}
+		}
+	}
+}
+
+// due reports whether the scheduled time has passed today without an attempt, on the weekday
+// of weekly digests
+func (s *DigestService) due(now time.Time) bool {
+	if s.config.Schedule == DigestWeekly {
+		if weekday, _ := parseWeekday(s.config.weekday()); now.Weekday() != weekday {
+			return false
+		}
+	}
+	clock, _ := time.Parse("15:04", s.config.at())
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(scheduled) && s.status.LastAttempt.Before(scheduled)
+}
+
+// Send composes the digest and sends it to every destination. It is sent wherever possible;
+// the first failure is returned.
+func (s *DigestService) Send(now time.Time) error {
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	subject, body := s.Compose(now, s.config.locale())
+	var failed error
+	for _, sender := range s.senders {
+		if err := sender.Send(subject, body); err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	s.mu.Lock()
+	s.status.LastAttempt = now
+	s.status.LastError = ""
+	if failed != nil {
+		s.status.LastError = failed.Error()
+	} else {
+		s.status.LastSent = now
+	}
+	status := s.status
+	s.mu.Unlock()
+
+	if s.path != "" {
+		if err := s.save(status); err != nil {
+			s.logger.Error("Failed to save digest state", err)
+		}
+	}
+	if failed == nil {
+		s.logger.Info("Digest sent", map[string]interface{}{"subject": subject, "destinations": len(s.senders)})
+	}
+	return failed
+}
+
+// save atomically writes when the digest was last sent
+func (s *DigestService) save(status DigestStatus) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal digest state", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write digest state", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace digest state", err)
+	}
+	return nil
+}
+
+// Status returns the outcome of the last digest
+func (s *DigestService) Status() DigestStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Compose writes the digest in a locale: a subject and a body of short sections
+func (s *DigestService) Compose(now time.Time, locale string) (string, string) {
+	subject, body := s.compose(now)
+	return subject.In(locale), body.In(locale)
+}
+
+func (s *DigestService) compose(now time.Time) (i18n.Text, i18n.Lines) {
+	days := s.config.days()
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+	subject := i18n.T("digest.daily.subject", yesterday)
+	if s.config.Schedule == DigestWeekly {
+		subject = i18n.T("digest.weekly.subject", yesterday)
+	}
+
+	var body i18n.Lines
+	for _, section := range []i18n.Lines{
+		s.temperatures(now),
+		s.energyUse(now, days),
+		s.anomalies(now, days),
+		s.maintenance(now),
+	} {
+		if len(section) == 0 {
+			continue
+		}
+		if len(body) > 0 {
+			body = append(body, i18n.Raw(""))
+		}
+		body = append(body, section...)
+	}
+	return subject, body
+}
+
+// temperatures describes every room's temperature and humidity, and the rooms gone quiet
+func (s *DigestService) temperatures(now time.Time) i18n.Lines {
+	if s.rooms == nil {
+		return nil
+	}
+
+	lines := i18n.Lines{i18n.T("digest.temperatures")}
+	rooms := s.rooms.GetAllRoomSensors()
+	for _, roomID := range sortedKeys(rooms) {
+		room := rooms[roomID]
+		switch {
+		case room.TempLastUpdate.IsZero():
+		case !room.IsOnline || now.Sub(room.LastSeen) > roomSensorStale:
+			lines = append(lines, i18n.T("digest.room.offline", roomID, digestTime(room.LastSeen, now)))
+		default:
+			lines = append(lines, i18n.T("digest.room", roomID, room.Temperature, room.Humidity))
+		}
+	}
+	if len(lines) == 1 {
+		lines = append(lines, i18n.T("digest.no_rooms"))
+	}
+	if s.weather != nil {
+		if outdoor, ok := s.weather.OutdoorTemperature(now); ok {
+			lines = append(lines, i18n.T("digest.outdoor", outdoor))
+		}
+	}
+	return lines
+}
+
+// digestTime shows a time of day, with the date when it isn't today
+func digestTime(t, now time.Time) string {
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("15:04")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// energyUse describes the energy used over the digest's days up to yesterday, against the days
+// before, and the room that used the most
+func (s *DigestService) energyUse(now time.Time, days int) i18n.Lines {
+	if s.energy == nil {
+		return nil
+	}
+
+	var total, previous, topKWh float64
+	var topRoom string
+	for _, room := range s.energy.Daily(2*days, now.AddDate(0, 0, -1)) {
+		var roomKWh float64
+		for i, day := range room.Days {
+			if i < len(room.Days)-days {
+				previous += day.KWh
+			} else {
+				roomKWh += day.KWh
+			}
+		}
+		total += roomKWh
+		if roomKWh > topKWh {
+			topRoom, topKWh = room.RoomID, roomKWh
+		}
+	}
+
+	lines := i18n.Lines{i18n.T("digest.energy")}
+	if total == 0 {
+		return append(lines, i18n.T("digest.energy.none"))
+	}
+	used := i18n.T("digest.energy.daily", total)
+	if days > 1 {
+		used = i18n.T("digest.energy.weekly", total)
+	}
+	sentences := i18n.Sentences{used}
+	if previous > 0 {
+		change := (total - previous) / previous * 100
+		if change >= 1 {
+			sentences = append(sentences, i18n.T("digest.energy.more", change))
+		} else if change <= -1 {
+			sentences = append(sentences, i18n.T("digest.energy.less", math.Abs(change)))
+		}
+	}
+	lines = append(lines, sentences)
+	if topRoom != "" {
+		lines = append(lines, i18n.T("digest.energy.top", topRoom, topKWh))
+	}
+	return lines
+}
+
+// anomalies lists the alerts still firing and those that fired and resolved within the digest's days
+func (s *DigestService) anomalies(now time.Time, days int) i18n.Lines {
+	if s.alerts == nil {
+		return nil
+	}
+
+	since := now.AddDate(0, 0, -days)
+	active := s.alerts.Active()
+	var resolved []Alert
+	count := 0
+	for _, alert := range active {
+		if alert.FiredAt.After(since) {
+			count++
+		}
+	}
+	for _, alert := range s.alerts.Resolved() {
+		if alert.ResolvedAt.After(since) {
+			resolved = append(resolved, alert)
+			if alert.FiredAt.After(since) {
+				count++
+			}
+		}
+	}
+
+	lines := i18n.Lines{i18n.T("digest.alerts")}
+	if len(active) == 0 && len(resolved) == 0 {
+		return append(lines, i18n.T("digest.alerts.none"))
+	}
+	lines = append(lines, i18n.T("digest.alerts.count", count))
+	for i := range active {
+		lines = append(lines, i18n.T("digest.alerts.active", active[i].localized()))
+	}
+	for i := len(resolved) - 1; i >= 0; i-- {
+		lines = append(lines, resolved[i].localized())
+	}
+	return lines
+}
+
+// maintenance lists the warranties ending soon
+func (s *DigestService) maintenance(now time.Time) i18n.Lines {
+	if s.warranties == nil {
+		return nil
+	}
+	// Asset records are set by the CLI in another process
+	if err := s.warranties.Reload(); err != nil {
+		s.logger.Error("Failed to reload asset records", err)
+	}
+
+	lines := i18n.Lines{i18n.T("digest.maintenance")}
+	lead := time.Duration(s.config.maintenanceDays()) * 24 * time.Hour
+	for _, device := range s.warranties.ExpiringWarranties(now, lead) {
+		expires, _ := device.Asset.WarrantyExpires()
+		days := int(expires.Sub(now).Hours()/24) + 1
+		lines = append(lines, i18n.T("digest.warranty", device.Name, expires.Format(identity.AssetDateFormat), days))
+	}
+	if len(lines) == 1 {
+		lines = append(lines, i18n.T("digest.maintenance.none"))
+	}
+	return lines
+}
+
+// Handler previews the digest as plain text, in the digest's locale or the one of ?lang=
+func (s *DigestService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := s.config.locale()
+		if requested, ok := i18n.Normalize(r.URL.Query().Get("lang")); ok {
+			locale = requested
+		}
+		subject, body := s.Compose(time.Now(), locale)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Language", locale)
+		fmt.Fprintf(w, "%s\n\n%s\n", subject, body)
+	})
+}
+
+// SendHandler sends the digest now; POST only
+func (s *DigestService) SendHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		err := s.Send(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
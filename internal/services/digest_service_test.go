@@ -0,0 +1,152 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/i18n"
+)
+
+type fakeEnergyHistory map[string][]float64 // kWh per room, oldest day first
+
+func (f fakeEnergyHistory) Daily(days int, now time.Time) []RoomEnergyDays {
+	var rooms []RoomEnergyDays
+	for _, roomID := range sortedKeys(f) {
+		room := RoomEnergyDays{RoomID: roomID}
+		for i, kwh := range f[roomID][len(f[roomID])-days:] {
+			room.Days = append(room.Days, RoomEnergyDay{Date: now.AddDate(0, 0, i-days+1).Format("2006-01-02"), KWh: kwh})
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+type fakeAlertHistory struct{ active, resolved []Alert }
+
+func (f fakeAlertHistory) Active() []Alert   { return f.active }
+func (f fakeAlertHistory) Resolved() []Alert { return f.resolved }
+
+type recordingDigestSender struct{ subjects, bodies []string }
+
+func (r *recordingDigestSender) Send(subject, body string) error {
+	r.subjects = append(r.subjects, subject)
+	r.bodies = append(r.bodies, body)
+	return nil
+}
+
+func TestDigestComposeAndSchedule(t *testing.T) {
+	cfg := &DigestConfig{At: "07:30", Telegram: &DigestTelegramConfig{BotToken: "token", ChatIDs: []string{"42"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %v", err)
+	}
+	now := time.Date(2025, 3, 4, 7, 30, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), DigestFileName)
+
+	service := NewDigestService(cfg, path, nil)
+	sender := &recordingDigestSender{}
+	service.senders = []digestSender{sender}
+	service.SetRoomSensors(fakeRoomSensors{
+		"kitchen": {Temperature: 70.4, Humidity: 45, TempLastUpdate: now, IsOnline: true, LastSeen: now},
+		"garage":  {Temperature: 50, TempLastUpdate: now.Add(-3 * time.Hour), IsOnline: false, LastSeen: now.Add(-3 * time.Hour)},
+	})
+	service.SetEnergy(fakeEnergyHistory{"kitchen": {4, 5}, "office": {4, 4.9}})
+	attic := Alert{ID: "hot:attic", FiredAt: now.Add(-2 * time.Hour)}
+	attic.describe(i18n.T("alert.above", "attic", i18n.T("metric.temperature"), 91.0, "°F", 90.0, "°F"))
+	service.SetAlerts(fakeAlertHistory{active: []Alert{attic}})
+
+	subject, body := service.Compose(now, i18n.English)
+	for _, want := range []string{
+		"garage has not reported since 04:30.",
+		"kitchen is 70°F at 45% humidity.",
+		"The home used 9.9 kWh yesterday. That is 24% more than the period before.",
+		"kitchen used the most, 5.0 kWh.",
+		"Alerts in this period: 1.\nStill active: attic temperature is 91.0°F, above 90.0°F.",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the digest:\n%s", want, body)
+		}
+	}
+	if subject != "Home digest for 2025-03-03" || strings.Contains(body, "Maintenance") {
+		t.Errorf("Unexpected subject %q or a maintenance section without asset records", subject)
+	}
+	if _, body := service.Compose(now, i18n.German); !strings.Contains(body, "Noch aktiv: attic: Temperatur beträgt 91.0°F") {
+		t.Errorf("Expected the digest in German, got:\n%s", body)
+	}
+
+	// Sent once at the scheduled time, including after a restart
+	if service.due(now.Add(-time.Minute)) || !service.due(now) {
+		t.Fatal("Expected the digest due from 07:30")
+	}
+	if err := service.Send(now); err != nil || len(sender.bodies) != 1 {
+		t.Fatalf("Expected the digest sent, got %v", err)
+	}
+	restarted := NewDigestService(cfg, path, nil)
+	if restarted.due(now.Add(time.Hour)) || !restarted.due(now.Add(24*time.Hour)) {
+		t.Error("Expected the digest sent once a day across restarts")
+	}
+
+	// Weekly digests wait for their weekday and cover seven days
+	weekly := NewDigestService(&DigestConfig{Schedule: DigestWeekly, Weekday: "Monday"}, "", nil)
+	weekly.SetEnergy(fakeEnergyHistory{"kitchen": {1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}})
+	if weekly.due(now) || !weekly.due(now.AddDate(0, 0, 6)) {
+		t.Error("Expected the weekly digest due on Mondays")
+	}
+	if _, body := weekly.Compose(now, i18n.English); !strings.Contains(body, "The home used 7.0 kWh over the last 7 days.\n") {
+		t.Errorf("Expected the week's energy without a change, got:\n%s", body)
+	}
+}
+
+func TestDigestSenders(t *testing.T) {
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendMessage" || r.FormValue("chat_id") != "42" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"ok": false, "description": "Not Found"}`)
+			return
+		}
+		texts = append(texts, r.FormValue("text"))
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer server.Close()
+
+	telegram := newTelegramDigestSender(&DigestTelegramConfig{BotToken: "token", ChatIDs: []string{"42"}, APIURL: server.URL})
+	long := strings.Repeat("kitchen is 70°F at 45% humidity.\n", 200)
+	if err := telegram.Send("Home digest", long); err != nil {
+		t.Fatal(err)
+	}
+	if len(texts) != 2 || !strings.HasPrefix(texts[0], "Home digest\n\n") || len([]rune(texts[0])) > telegramMaxMessageSize {
+		t.Errorf("Expected the digest split in two messages, got %d", len(texts))
+	}
+	wrongChat := newTelegramDigestSender(&DigestTelegramConfig{BotToken: "token", ChatIDs: []string{"7"}, APIURL: server.URL})
+	if err := wrongChat.Send("Home digest", "body"); err == nil || strings.Contains(err.Error(), "token") {
+		t.Errorf("Expected an error without the token, got %v", err)
+	}
+
+	email := newEmailDigestSender(&DigestEmailConfig{Host: "mail.example.com", From: "home@example.com", To: []string{"alex@example.com"}})
+	var addr string
+	var message []byte
+	email.sendMail = func(a string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		addr, message = a, msg
+		return nil
+	}
+	if err := email.Send("Résumé de la maison", "line one\nline two"); err != nil {
+		t.Fatal(err)
+	}
+	if addr != "mail.example.com:587" || !strings.Contains(string(message), "Subject: =?utf-8?q?R=C3=A9sum=C3=A9_de_la_maison?=\r\n") ||
+		!strings.HasSuffix(string(message), "\r\n\r\nline one\r\nline two\r\n") {
+		t.Errorf("Unexpected mail to %s:\n%s", addr, message)
+	}
+
+	if err := (&DigestConfig{}).Validate(); err == nil {
+		t.Error("Expected a digest without destination rejected")
+	}
+	if err := (&DigestConfig{Weekday: "funday", Email: &DigestEmailConfig{Host: "h", From: "f", To: []string{"t"}}}).Validate(); err == nil {
+		t.Error("Expected an unknown weekday rejected")
+	}
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/tariff"
+)
+
+// EnergyCostFileName holds the running cost totals inside the state directory
+const EnergyCostFileName = "energy-cost.json"
+
+// energyCostSaveInterval limits how often totals are written, sparing SD cards
+const energyCostSaveInterval = 5 * time.Minute
+
+// DeviceCost is the energy use and cost of one device today and this month
+type DeviceCost struct {
+	DeviceID   string  `json:"device_id"`
+	DeviceUUID string  `json:"device_uuid,omitempty"`
+	DeviceName string  `json:"device_name"`
+	RoomID     string  `json:"room_id"`
+	Day        string  `json:"day"`
+	Month      string  `json:"month"`
+	DayKWh     float64 `json:"day_kwh"`
+	DayCost    float64 `json:"day_cost"`
+	MonthKWh   float64 `json:"month_kwh"`
+	MonthCost  float64 `json:"month_cost"`
+
+	LastEnergyWh float64   `json:"last_energy_wh"` // Plug's daily counter at the last reading
+	LastReading  time.Time `json:"last_reading"`
+}
+
+// RoomCost is the energy use and cost of all devices in a room
+type RoomCost struct {
+	RoomID    string  `json:"room_id"`
+	DayKWh    float64 `json:"day_kwh"`
+	DayCost   float64 `json:"day_cost"`
+	MonthKWh  float64 `json:"month_kwh"`
+	MonthCost float64 `json:"month_cost"`
+}
+
+// energyCostState is the persisted form of the running totals
+type energyCostState struct {
+	Month    string                 `json:"month"`
+	MonthKWh float64                `json:"month_kwh"` // Household consumption, for tiered tariffs
+	Devices  map[string]*DeviceCost `json:"devices"`
+}
+
+// EnergyCostService converts energy readings to cost using a tariff
+type EnergyCostService struct {
+	tariff   *tariff.Tariff
+	path     string
+	logger   *logger.Logger
+	state    energyCostState
+	lastSave time.Time
+	mu       sync.RWMutex
+
+	deviceCost *prometheus.GaugeVec
+	roomCost   *prometheus.GaugeVec
+}
+
+// NewEnergyCostService creates a cost service. Totals are persisted to path, or kept in memory if empty.
+func NewEnergyCostService(t *tariff.Tariff, path string, serviceLogger *logger.Logger) *EnergyCostService {
+	service := &EnergyCostService{
+		tariff: t,
+		path:   path,
+		logger: serviceLogger,
+		state:  energyCostState{Devices: make(map[string]*DeviceCost)},
+		deviceCost: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "home_automation_device_energy_cost",
+			Help: "Energy cost per device for the current day or month",
+		}, []string{"device_id", "device_name", "room_id", "period", "currency"}),
+		roomCost: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "home_automation_room_energy_cost",
+			Help: "Energy cost per room for the current day or month",
+		}, []string{"room_id", "period", "currency"}),
+	}
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load energy cost totals, starting from zero", err)
+		}
+	}
+
+	return service
+}
+
+// EnergyCostPath returns the cost totals file path for a state directory
+func EnergyCostPath(stateDir string) string {
+	return filepath.Join(stateDir, EnergyCostFileName)
+}
+
+// RegisterMetrics registers the cost gauges
+func (s *EnergyCostService) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.deviceCost, s.roomCost} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register energy cost metrics", err)
+		}
+	}
+	return nil
+}
+
+// Record prices the energy used since the device's previous reading.
+// The first reading of a device only sets its baseline.
+func (s *EnergyCostService) Record(reading EnergyReading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at := reading.Timestamp
+	day, month := at.Format("2006-01-02"), at.Format("2006-01")
+
+	if s.state.Month != month {
+		s.state.Month = month
+		s.state.MonthKWh = 0
+	}
+
+	device, exists := s.state.Devices[reading.DeviceID]
+	if !exists {
+		device = &DeviceCost{DeviceID: reading.DeviceID, Day: day, Month: month}
+		s.state.Devices[reading.DeviceID] = device
+	}
+	device.DeviceUUID = reading.DeviceUUID
+	device.DeviceName = reading.DeviceName
+	device.RoomID = reading.RoomID
+
+	var kWh float64
+	if exists {
+		kWh = energyDeltaWh(device.LastEnergyWh, device.LastReading, reading) / 1000.0
+	}
+
+	if device.Month != month {
+		device.Month = month
+		device.MonthKWh, device.MonthCost = 0, 0
+	}
+	if device.Day != day {
+		device.Day = day
+		device.DayKWh, device.DayCost = 0, 0
+	}
+
+	cost := s.tariff.Cost(kWh, at, s.state.MonthKWh)
+	s.state.MonthKWh += kWh
+	device.DayKWh += kWh
+	device.DayCost += cost
+	device.MonthKWh += kWh
+	device.MonthCost += cost
+	device.LastEnergyWh = reading.EnergyWh
+	device.LastReading = at
+
+	s.updateMetrics(device)
+
+	if s.path != "" && time.Since(s.lastSave) >= energyCostSaveInterval {
+		if err := s.save(); err != nil {
+			s.logger.Error("Failed to save energy cost totals", err)
+		}
+	}
+}
+
+// DeviceCosts returns the cost of every device, sorted by device ID.
+// Totals from an earlier day or month report as zero.
+func (s *EnergyCostService) DeviceCosts(now time.Time) []DeviceCost {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	costs := make([]DeviceCost, 0, len(s.state.Devices))
+	for _, device := range s.state.Devices {
+		cost := *device
+		if cost.Day != day {
+			cost.DayKWh, cost.DayCost = 0, 0
+		}
+		if cost.Month != month {
+			cost.MonthKWh, cost.MonthCost = 0, 0
+		}
+		costs = append(costs, cost)
+	}
+
+	sort.Slice(costs, func(i, j int) bool {
+		return costs[i].DeviceID < costs[j].DeviceID
+	})
+	return costs
+}
+
+// RoomCosts returns the cost of every room, sorted by room ID
+func (s *EnergyCostService) RoomCosts(now time.Time) []RoomCost {
+	rooms := make(map[string]*RoomCost)
+	for _, device := range s.DeviceCosts(now) {
+		room, exists := rooms[device.RoomID]
+		if !exists {
+			room = &RoomCost{RoomID: device.RoomID}
+			rooms[device.RoomID] = room
+		}
+		room.DayKWh += device.DayKWh
+		room.DayCost += device.DayCost
+		room.MonthKWh += device.MonthKWh
+		room.MonthCost += device.MonthCost
+	}
+
+	costs := make([]RoomCost, 0, len(rooms))
+	for _, room := range rooms {
+		costs = append(costs, *room)
+	}
+
+	sort.Slice(costs, func(i, j int) bool {
+		return costs[i].RoomID < costs[j].RoomID
+	})
+	return costs
+}
+
+// Handler serves daily and monthly cost per device and per room as JSON; ?room= filters by room
+func (s *EnergyCostService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		roomID := r.URL.Query().Get("room")
+
+		devices := s.DeviceCosts(now)
+		rooms := s.RoomCosts(now)
+		if roomID != "" {
+			filteredDevices := make([]DeviceCost, 0)
+			for _, device := range devices {
+				if device.RoomID == roomID {
+					filteredDevices = append(filteredDevices, device)
+				}
+			}
+			filteredRooms := make([]RoomCost, 0, 1)
+			for _, room := range rooms {
+				if room.RoomID == roomID {
+					filteredRooms = append(filteredRooms, room)
+				}
+			}
+			devices, rooms = filteredDevices, filteredRooms
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tariff":   s.tariff.Type,
+			"currency": s.tariff.Currency,
+			"devices":  devices,
+			"rooms":    rooms,
+		})
+	})
+}
+
+// Save writes the running totals, e.g. on shutdown
+func (s *EnergyCostService) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// updateMetrics refreshes the gauges of a device and its room; callers must hold the lock
+func (s *EnergyCostService) updateMetrics(device *DeviceCost) {
+	currency := s.tariff.Currency
+	deviceID := device.DeviceID
+	if device.DeviceUUID != "" {
+		deviceID = device.DeviceUUID // Match the device_id label of the energy metrics
+	}
+
+	s.deviceCost.WithLabelValues(deviceID, device.DeviceName, device.RoomID, "day", currency).Set(device.DayCost)
+	s.deviceCost.WithLabelValues(deviceID, device.DeviceName, device.RoomID, "month", currency).Set(device.MonthCost)
+
+	var dayCost, monthCost float64
+	for _, other := range s.state.Devices {
+		if other.RoomID != device.RoomID {
+			continue
+		}
+		if other.Day == device.Day {
+			dayCost += other.DayCost
+		}
+		if other.Month == device.Month {
+			monthCost += other.MonthCost
+		}
+	}
+	s.roomCost.WithLabelValues(device.RoomID, "day", currency).Set(dayCost)
+	s.roomCost.WithLabelValues(device.RoomID, "month", currency).Set(monthCost)
+}
+
+// load reads persisted totals
+func (s *EnergyCostService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read energy cost totals", err)
+	}
+
+	var state energyCostState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.NewSystemError("failed to parse energy cost totals", err)
+	}
+	if state.Devices == nil {
+		state.Devices = make(map[string]*DeviceCost)
+	}
+
+	s.state = state
+	return nil
+}
+
+// save atomically writes the totals; callers must hold the lock
+func (s *EnergyCostService) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal energy cost totals", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write energy cost totals", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace energy cost totals", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/tariff"
+)
+
+func TestEnergyCostServiceRecord(t *testing.T) {
+	service := NewEnergyCostService(tariff.Flat(0.50, "USD"), "", logger.NewLogger("test-energy-cost", nil))
+
+	day := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	readings := []EnergyReading{
+		{DeviceID: "washer", RoomID: "laundry", EnergyWh: 1000, Timestamp: day},                      // Baseline
+		{DeviceID: "washer", RoomID: "laundry", EnergyWh: 3000, Timestamp: day.Add(time.Hour)},       // 2 kWh
+		{DeviceID: "dryer", RoomID: "laundry", EnergyWh: 500, Timestamp: day.Add(time.Hour)},         // Baseline
+		{DeviceID: "dryer", RoomID: "laundry", EnergyWh: 1500, Timestamp: day.Add(2 * time.Hour)},    // 1 kWh
+		{DeviceID: "washer", RoomID: "laundry", EnergyWh: 400, Timestamp: day.Add(15 * time.Hour)},   // Next day, counter reset: 0.4 kWh
+		{DeviceID: "hifi", RoomID: "living_room", EnergyWh: 200, Timestamp: day.Add(15 * time.Hour)}, // Baseline
+	}
+	for _, reading := range readings {
+		service.Record(reading)
+	}
+
+	now := day.Add(15 * time.Hour)
+	devices := service.DeviceCosts(now)
+	if len(devices) != 3 {
+		t.Fatalf("Expected 3 devices, got %d", len(devices))
+	}
+
+	washer := devices[2]
+	if washer.DeviceID != "washer" {
+		t.Fatalf("Expected devices sorted by ID, got %s last", washer.DeviceID)
+	}
+	if math.Abs(washer.DayCost-0.20) > 1e-9 || math.Abs(washer.MonthCost-1.20) > 1e-9 {
+		t.Errorf("Expected washer day 0.20 and month 1.20, got %.2f and %.2f", washer.DayCost, washer.MonthCost)
+	}
+
+	dryer := devices[0]
+	if dryer.DayCost != 0 || math.Abs(dryer.MonthCost-0.50) > 1e-9 {
+		t.Errorf("Expected dryer's day to roll over, got day %.2f month %.2f", dryer.DayCost, dryer.MonthCost)
+	}
+
+	rooms := service.RoomCosts(now)
+	if len(rooms) != 2 || rooms[0].RoomID != "laundry" {
+		t.Fatalf("Unexpected rooms %+v", rooms)
+	}
+	if math.Abs(rooms[0].MonthCost-1.70) > 1e-9 || math.Abs(rooms[0].MonthKWh-3.4) > 1e-9 {
+		t.Errorf("Expected laundry month cost 1.70 for 3.4 kWh, got %.2f for %.2f kWh", rooms[0].MonthCost, rooms[0].MonthKWh)
+	}
+}
+
+func TestEnergyCostServicePersistence(t *testing.T) {
+	path := EnergyCostPath(t.TempDir())
+	flat := tariff.Flat(1.0, "USD")
+	at := time.Now()
+
+	service := NewEnergyCostService(flat, path, logger.NewLogger("test-energy-cost", nil))
+	service.Record(EnergyReading{DeviceID: "boiler", RoomID: "utility", EnergyWh: 1000, Timestamp: at})
+	service.Record(EnergyReading{DeviceID: "boiler", RoomID: "utility", EnergyWh: 2000, Timestamp: at.Add(time.Minute)})
+	if err := service.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Energy used while the service was down is counted from the persisted counter
+	restarted := NewEnergyCostService(flat, path, logger.NewLogger("test-energy-cost", nil))
+	restarted.Record(EnergyReading{DeviceID: "boiler", RoomID: "utility", EnergyWh: 2500, Timestamp: at.Add(2 * time.Minute)})
+
+	recorder := httptest.NewRecorder()
+	restarted.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/energy/cost?room=utility", nil))
+
+	var response struct {
+		Currency string       `json:"currency"`
+		Devices  []DeviceCost `json:"devices"`
+		Rooms    []RoomCost   `json:"rooms"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Devices) != 1 || len(response.Rooms) != 1 {
+		t.Fatalf("Expected one device and room, got %+v", response)
+	}
+	if math.Abs(response.Rooms[0].MonthKWh-1.5) > 1e-9 {
+		t.Errorf("Expected 1.5 kWh after restart, got %.2f", response.Rooms[0].MonthKWh)
+	}
+}
@@ -0,0 +1,561 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// RoomEnergyFileName holds the per-room energy totals inside the state directory
+const RoomEnergyFileName = "energy-rooms.json"
+
+// GatewayRoomEnergyFileName holds the unified service's room energy totals, kept apart from the
+// Tapo scraper's when both share a state directory
+const GatewayRoomEnergyFileName = "energy-rooms-gateway.json"
+
+// roomEnergyHistoryDays is how many days of daily room totals are kept
+const roomEnergyHistoryDays = 31
+
+// RoomEnergyTopicPrefix is where room energy summaries are published, followed by the room ID
+const RoomEnergyTopicPrefix = "home-automation/energy/"
+
+// Energy aggregation windows
+const (
+	WindowHour  = "hour"
+	WindowDay   = "day"
+	WindowMonth = "month"
+)
+
+// energyWindows lists the aggregation windows with the layout that identifies the current one
+var energyWindows = []struct {
+	name   string
+	layout string
+}{
+	{WindowHour, "2006-01-02T15"},
+	{WindowDay, "2006-01-02"},
+	{WindowMonth, "2006-01"},
+}
+
+// EnergyWindow is a room's energy use and peak power within one hour, day or month
+type EnergyWindow struct {
+	Period     string    `json:"period"` // e.g. 2024-03-01T14 for an hour
+	EnergyWh   float64   `json:"energy_wh"`
+	PeakPowerW float64   `json:"peak_power_w"`
+	PeakAt     time.Time `json:"peak_at,omitempty"`
+	// EstimatedWh is the share of EnergyWh estimated from lighting loads rather than metered
+	EstimatedWh float64 `json:"estimated_wh,omitempty"`
+}
+
+// RoomEnergy is the aggregated energy use of all devices in a room
+type RoomEnergy struct {
+	RoomID        string                   `json:"room_id"`
+	PowerW        float64                  `json:"power_w"`         // Sum of the latest reading of every device
+	TotalEnergyWh float64                  `json:"total_energy_wh"` // Since tracking began
+	EstimatedWh   float64                  `json:"estimated_wh,omitempty"`
+	Windows       map[string]*EnergyWindow `json:"windows"`
+	Devices       []string                 `json:"devices"`
+	UpdatedAt     time.Time                `json:"updated_at"`
+}
+
+// RoomEnergyDay is a room's energy use on one day, split into metered and estimated
+type RoomEnergyDay struct {
+	Date         string  `json:"date"` // 2006-01-02
+	KWh          float64 `json:"kwh"`
+	MeteredKWh   float64 `json:"metered_kwh"`
+	EstimatedKWh float64 `json:"estimated_kwh"`
+}
+
+// RoomEnergyDays is the daily energy use of one room, oldest day first
+type RoomEnergyDays struct {
+	RoomID string          `json:"room_id"`
+	Days   []RoomEnergyDay `json:"days"`
+}
+
+// roomDevice is the last reading of a device, used to turn the plug's daily counter into deltas
+type roomDevice struct {
+	RoomID       string    `json:"room_id"`
+	PowerW       float64   `json:"power_w"`
+	LastEnergyWh float64   `json:"last_energy_wh"`
+	LastReading  time.Time `json:"last_reading"`
+}
+
+// roomEnergyState is the persisted form of the room totals
+type roomEnergyState struct {
+	Rooms   map[string]*RoomEnergy `json:"rooms"`
+	Devices map[string]*roomDevice `json:"devices"`
+	// Days holds the daily totals of each room, oldest first
+	Days map[string][]RoomEnergyDay `json:"daily,omitempty"`
+}
+
+// EnergyService aggregates Tapo energy readings by room over hour, day and month windows
+type EnergyService struct {
+	mqttClient *mqtt.Client
+	path       string
+	logger     *logger.Logger
+	state      roomEnergyState
+	lastSave   time.Time
+	mu         sync.RWMutex
+
+	energyTotal *prometheus.CounterVec
+	energy      *prometheus.GaugeVec
+	peakPower   *prometheus.GaugeVec
+	power       *prometheus.GaugeVec
+}
+
+// NewEnergyService creates a room energy service. Summaries are published when mqttClient is set,
+// and totals are persisted to path, or kept in memory if empty.
+func NewEnergyService(mqttClient *mqtt.Client, path string, serviceLogger *logger.Logger) *EnergyService {
+	service := &EnergyService{
+		mqttClient: mqttClient,
+		path:       path,
+		logger:     serviceLogger,
+		state: roomEnergyState{
+			Rooms:   make(map[string]*RoomEnergy),
+			Devices: make(map[string]*roomDevice),
+			Days:    make(map[string][]RoomEnergyDay),
+		},
+		energyTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "room_energy_wh_total",
+			Help: "Energy used by all devices in a room in watt-hours",
+		}, []string{"room_id"}),
+		energy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "room_energy_wh",
+			Help: "Energy used by all devices in a room in the current hour, day or month",
+		}, []string{"room_id", "window"}),
+		peakPower: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "room_peak_power_watts",
+			Help: "Highest combined power draw of a room in the current hour, day or month",
+		}, []string{"room_id", "window"}),
+		power: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "room_power_watts",
+			Help: "Combined latest power draw of all devices in a room",
+		}, []string{"room_id"}),
+	}
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load room energy totals, starting from zero", err)
+		}
+	}
+
+	// Continue the counters from the persisted totals
+	for roomID, room := range service.state.Rooms {
+		service.energyTotal.WithLabelValues(roomID).Add(room.TotalEnergyWh)
+	}
+
+	return service
+}
+
+// RoomEnergyPath returns the room energy totals file path for a state directory
+func RoomEnergyPath(stateDir string) string {
+	return filepath.Join(stateDir, RoomEnergyFileName)
+}
+
+// GatewayRoomEnergyPath returns the unified service's room energy totals file path for a state directory
+func GatewayRoomEnergyPath(stateDir string) string {
+	return filepath.Join(stateDir, GatewayRoomEnergyFileName)
+}
+
+// RegisterMetrics registers the room energy metrics
+func (s *EnergyService) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.energyTotal, s.energy, s.peakPower, s.power} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register room energy metrics", err)
+		}
+	}
+	return nil
+}
+
+// Record adds the energy used since the device's previous reading to its room.
+// The first reading of a device only sets its baseline. Readings without a room are ignored.
+// Estimated readings are totalled like metered ones and also reported as the estimated share.
+func (s *EnergyService) Record(reading EnergyReading) {
+	if reading.RoomID == "" {
+		return
+	}
+
+	s.mu.Lock()
+	at := reading.Timestamp
+
+	device, exists := s.state.Devices[reading.DeviceID]
+	if !exists {
+		device = &roomDevice{}
+		s.state.Devices[reading.DeviceID] = device
+	}
+
+	var deltaWh float64
+	if exists {
+		deltaWh = energyDeltaWh(device.LastEnergyWh, device.LastReading, reading)
+	}
+
+	// A device that moved rooms no longer adds to its old room's power
+	if exists && device.RoomID != reading.RoomID {
+		if previous := s.state.Rooms[device.RoomID]; previous != nil {
+			s.refreshRoomPower(previous)
+			s.updateMetrics(previous, at)
+		}
+	}
+	device.RoomID = reading.RoomID
+	device.PowerW = reading.PowerW
+	device.LastEnergyWh = reading.EnergyWh
+	device.LastReading = at
+
+	room, exists := s.state.Rooms[reading.RoomID]
+	if !exists {
+		room = &RoomEnergy{RoomID: reading.RoomID, Windows: make(map[string]*EnergyWindow)}
+		s.state.Rooms[reading.RoomID] = room
+	}
+	s.refreshRoomPower(room)
+	room.TotalEnergyWh += deltaWh
+	var estimatedWh float64
+	if reading.Estimated {
+		estimatedWh = deltaWh
+		room.EstimatedWh += deltaWh
+	}
+	room.UpdatedAt = at
+	s.addDay(room.RoomID, at, deltaWh, estimatedWh)
+
+	for _, window := range energyWindows {
+		period := at.Format(window.layout)
+		current, exists := room.Windows[window.name]
+		if !exists || current.Period != period {
+			current = &EnergyWindow{Period: period}
+			room.Windows[window.name] = current
+		}
+		current.EnergyWh += deltaWh
+		current.EstimatedWh += estimatedWh
+		if room.PowerW > current.PeakPowerW {
+			current.PeakPowerW = room.PowerW
+			current.PeakAt = at
+		}
+	}
+
+	if deltaWh > 0 {
+		s.energyTotal.WithLabelValues(room.RoomID).Add(deltaWh)
+	}
+	s.updateMetrics(room, at)
+	summary := s.snapshot(room, at)
+
+	if s.path != "" && time.Since(s.lastSave) >= energyCostSaveInterval {
+		if err := s.save(); err != nil {
+			s.logger.Error("Failed to save room energy totals", err)
+		}
+	}
+	s.mu.Unlock()
+
+	s.publish(summary)
+}
+
+// Rooms returns the energy use of every room, sorted by room ID.
+// Windows from an earlier hour, day or month report as zero.
+func (s *EnergyService) Rooms(now time.Time) []RoomEnergy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]RoomEnergy, 0, len(s.state.Rooms))
+	for _, room := range s.state.Rooms {
+		rooms = append(rooms, s.snapshot(room, now))
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+// Room returns the energy use of one room
+func (s *EnergyService) Room(roomID string, now time.Time) (RoomEnergy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, exists := s.state.Rooms[roomID]
+	if !exists {
+		return RoomEnergy{}, false
+	}
+	return s.snapshot(room, now), true
+}
+
+// Daily returns the daily energy use of every room for the last days days including today,
+// sorted by room ID. Days without readings report as zero.
+func (s *EnergyService) Daily(days int, now time.Time) []RoomEnergyDays {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dates := make([]string, days)
+	for i := range dates {
+		dates[i] = now.AddDate(0, 0, i-days+1).Format("2006-01-02")
+	}
+
+	rooms := make([]RoomEnergyDays, 0, len(s.state.Days))
+	for roomID, history := range s.state.Days {
+		recorded := make(map[string]RoomEnergyDay, len(history))
+		for _, day := range history {
+			recorded[day.Date] = day
+		}
+		room := RoomEnergyDays{RoomID: roomID, Days: make([]RoomEnergyDay, len(dates))}
+		for i, date := range dates {
+			day, exists := recorded[date]
+			if !exists {
+				day = RoomEnergyDay{Date: date}
+			}
+			room.Days[i] = day
+		}
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+// DailyHandler serves per-room daily kWh as JSON; ?room= selects one room and ?days= how many
+// days, 7 by default
+func (s *EnergyService) DailyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		roomID := r.URL.Query().Get("room")
+
+		days := 7
+		if value := r.URL.Query().Get("days"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > roomEnergyHistoryDays {
+				http.Error(w, fmt.Sprintf("days must be between 1 and %d", roomEnergyHistoryDays), http.StatusBadRequest)
+				return
+			}
+			days = parsed
+		}
+
+		rooms := s.Daily(days, now)
+		if roomID != "" {
+			var selected []RoomEnergyDays
+			for _, room := range rooms {
+				if room.RoomID == roomID {
+					selected = append(selected, room)
+				}
+			}
+			if len(selected) == 0 {
+				http.Error(w, fmt.Sprintf("no energy readings for room %s", roomID), http.StatusNotFound)
+				return
+			}
+			rooms = selected
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms":     rooms,
+			"timestamp": now,
+		})
+	})
+}
+
+// Handler serves per-room totals and peaks as JSON; ?room= selects one room and ?window= one window
+func (s *EnergyService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		roomID := r.URL.Query().Get("room")
+		windowName := r.URL.Query().Get("window")
+
+		if windowName != "" && windowName != WindowHour && windowName != WindowDay && windowName != WindowMonth {
+			http.Error(w, fmt.Sprintf("unknown window %q: use hour, day or month", windowName), http.StatusBadRequest)
+			return
+		}
+
+		rooms := s.Rooms(now)
+		if roomID != "" {
+			room, exists := s.Room(roomID, now)
+			if !exists {
+				http.Error(w, fmt.Sprintf("no energy readings for room %s", roomID), http.StatusNotFound)
+				return
+			}
+			rooms = []RoomEnergy{room}
+		}
+		if windowName != "" {
+			for i := range rooms {
+				rooms[i].Windows = map[string]*EnergyWindow{windowName: rooms[i].Windows[windowName]}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms":     rooms,
+			"timestamp": now,
+		})
+	})
+}
+
+// Save writes the room totals, e.g. on shutdown
+func (s *EnergyService) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// energyDeltaWh returns the energy a device used since its previous reading. Tapo plugs report
+// a daily counter, so a new day or a counter that went backwards starts again from zero.
+func energyDeltaWh(lastEnergyWh float64, lastReading time.Time, reading EnergyReading) float64 {
+	deltaWh := reading.EnergyWh - lastEnergyWh
+	if lastReading.Format("2006-01-02") != reading.Timestamp.Format("2006-01-02") || deltaWh < 0 {
+		deltaWh = reading.EnergyWh // The plug's daily counter reset at midnight
+	}
+	return deltaWh
+}
+
+// addDay adds energy to a room's total for the day, dropping days beyond the history;
+// callers must hold the lock
+func (s *EnergyService) addDay(roomID string, at time.Time, deltaWh, estimatedWh float64) {
+	date := at.Format("2006-01-02")
+	history := s.state.Days[roomID]
+	if len(history) == 0 || history[len(history)-1].Date != date {
+		history = append(history, RoomEnergyDay{Date: date})
+	}
+	today := &history[len(history)-1]
+	today.KWh += deltaWh / 1000
+	today.EstimatedKWh += estimatedWh / 1000
+	today.MeteredKWh = today.KWh - today.EstimatedKWh
+
+	oldest := at.AddDate(0, 0, -roomEnergyHistoryDays+1).Format("2006-01-02")
+	for len(history) > 0 && history[0].Date < oldest {
+		history = history[1:]
+	}
+	s.state.Days[roomID] = history
+}
+
+// refreshRoomPower sums the latest power draw of the room's devices; callers must hold the lock
+func (s *EnergyService) refreshRoomPower(room *RoomEnergy) {
+	room.PowerW = 0
+	room.Devices = room.Devices[:0]
+	for deviceID, device := range s.state.Devices {
+		if device.RoomID == room.RoomID {
+			room.PowerW += device.PowerW
+			room.Devices = append(room.Devices, deviceID)
+		}
+	}
+	sort.Strings(room.Devices)
+}
+
+// snapshot copies a room, zeroing windows that have ended; callers must hold the lock
+func (s *EnergyService) snapshot(room *RoomEnergy, now time.Time) RoomEnergy {
+	copied := *room
+	copied.Devices = append([]string(nil), room.Devices...)
+	copied.Windows = make(map[string]*EnergyWindow, len(energyWindows))
+	for _, window := range energyWindows {
+		period := now.Format(window.layout)
+		current := EnergyWindow{Period: period}
+		if existing, exists := room.Windows[window.name]; exists && existing.Period == period {
+			current = *existing
+		}
+		copied.Windows[window.name] = &current
+	}
+	return copied
+}
+
+// updateMetrics refreshes the gauges of a room; callers must hold the lock
+func (s *EnergyService) updateMetrics(room *RoomEnergy, now time.Time) {
+	current := s.snapshot(room, now)
+	s.power.WithLabelValues(room.RoomID).Set(current.PowerW)
+	for name, window := range current.Windows {
+		s.energy.WithLabelValues(room.RoomID, name).Set(window.EnergyWh)
+		s.peakPower.WithLabelValues(room.RoomID, name).Set(window.PeakPowerW)
+	}
+}
+
+// publish sends a room summary to MQTT
+func (s *EnergyService) publish(room RoomEnergy) {
+	if s.mqttClient == nil {
+		return
+	}
+
+	payload, err := json.Marshal(room)
+	if err != nil {
+		s.logger.Error("Failed to marshal room energy summary", err)
+		return
+	}
+
+	message := &mqtt.Message{
+		Topic:   RoomEnergyTopicPrefix + room.RoomID,
+		Payload: payload,
+		QoS:     0,
+		Retain:  true,
+	}
+	if err := s.mqttClient.Publish(message); err != nil {
+		s.logger.Error("Failed to publish room energy summary", err, map[string]interface{}{
+			"room_id": room.RoomID,
+		})
+	}
+}
+
+// load reads persisted totals
+func (s *EnergyService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read room energy totals", err)
+	}
+
+	var state roomEnergyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.NewSystemError("failed to parse room energy totals", err)
+	}
+	if state.Rooms == nil {
+		state.Rooms = make(map[string]*RoomEnergy)
+	}
+	if state.Devices == nil {
+		state.Devices = make(map[string]*roomDevice)
+	}
+	if state.Days == nil {
+		state.Days = make(map[string][]RoomEnergyDay)
+	}
+	for _, room := range state.Rooms {
+		if room.Windows == nil {
+			room.Windows = make(map[string]*EnergyWindow)
+		}
+	}
+
+	s.state = state
+	return nil
+}
+
+// save atomically writes the totals; callers must hold the lock
+func (s *EnergyService) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal room energy totals", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write room energy totals", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace room energy totals", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+func TestEnergyServiceAggregatesRooms(t *testing.T) {
+	service := NewEnergyService(nil, "", logger.NewLogger("test-energy", nil))
+
+	day := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	readings := []EnergyReading{
+		{DeviceID: "washer", RoomID: "laundry", PowerW: 500, EnergyWh: 1000, Timestamp: day},                      // Baseline
+		{DeviceID: "dryer", RoomID: "laundry", PowerW: 2000, EnergyWh: 300, Timestamp: day.Add(10 * time.Minute)}, // Baseline, peak 2500W
+		{DeviceID: "washer", RoomID: "laundry", PowerW: 10, EnergyWh: 1400, Timestamp: day.Add(time.Hour)},        // 400 Wh in the next hour
+		{DeviceID: "dryer", RoomID: "laundry", PowerW: 0, EnergyWh: 900, Timestamp: day.Add(70 * time.Minute)},    // 600 Wh
+		{DeviceID: "hifi", PowerW: 40, EnergyWh: 100, Timestamp: day.Add(70 * time.Minute)},                       // No room, ignored
+	}
+	for _, reading := range readings {
+		service.Record(reading)
+	}
+
+	now := day.Add(75 * time.Minute)
+	rooms := service.Rooms(now)
+	if len(rooms) != 1 || rooms[0].RoomID != "laundry" {
+		t.Fatalf("Expected only the laundry room, got %+v", rooms)
+	}
+
+	laundry := rooms[0]
+	if laundry.TotalEnergyWh != 1000 || laundry.PowerW != 10 {
+		t.Errorf("Expected 1000 Wh total at 10W, got %.0f Wh at %.0fW", laundry.TotalEnergyWh, laundry.PowerW)
+	}
+	if hour := laundry.Windows[WindowHour]; hour.EnergyWh != 1000 || hour.PeakPowerW != 2010 {
+		t.Errorf("Expected hour window of 1000 Wh peaking at 2010W, got %+v", hour)
+	}
+	if dayWindow := laundry.Windows[WindowDay]; dayWindow.EnergyWh != 1000 || dayWindow.PeakPowerW != 2500 {
+		t.Errorf("Expected day window of 1000 Wh peaking at 2500W, got %+v", dayWindow)
+	}
+	if len(laundry.Devices) != 2 || laundry.Devices[0] != "dryer" {
+		t.Errorf("Expected dryer and washer in laundry, got %v", laundry.Devices)
+	}
+
+	// Ended windows report as zero
+	later, _ := service.Room("laundry", day.Add(3*time.Hour))
+	if later.Windows[WindowHour].EnergyWh != 0 || later.Windows[WindowDay].EnergyWh != 1000 {
+		t.Errorf("Expected the hour window to roll over, got %+v", later.Windows)
+	}
+
+	if total := testutil.ToFloat64(service.energyTotal.WithLabelValues("laundry")); total != 1000 {
+		t.Errorf("Expected room_energy_wh_total 1000, got %.0f", total)
+	}
+	if err := service.RegisterMetrics(prometheus.NewRegistry()); err != nil {
+		t.Errorf("RegisterMetrics failed: %v", err)
+	}
+}
+
+func TestEnergyServicePersistenceAndHandler(t *testing.T) {
+	path := RoomEnergyPath(t.TempDir())
+	now := time.Now()
+
+	service := NewEnergyService(nil, path, logger.NewLogger("test-energy", nil))
+	service.Record(EnergyReading{DeviceID: "boiler", RoomID: "utility", PowerW: 1500, EnergyWh: 100, Timestamp: now})
+	service.Record(EnergyReading{DeviceID: "boiler", RoomID: "utility", PowerW: 1500, EnergyWh: 250, Timestamp: now})
+	if err := service.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	reloaded := NewEnergyService(nil, path, logger.NewLogger("test-energy", nil))
+	if total := testutil.ToFloat64(reloaded.energyTotal.WithLabelValues("utility")); total != 150 {
+		t.Errorf("Expected the counter to continue from 150 Wh, got %.0f", total)
+	}
+
+	recorder := httptest.NewRecorder()
+	reloaded.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/energy/rooms?room=utility&window=day", nil))
+
+	var response struct {
+		Rooms []RoomEnergy `json:"rooms"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Rooms) != 1 || len(response.Rooms[0].Windows) != 1 || response.Rooms[0].Windows[WindowDay].EnergyWh != 150 {
+		t.Errorf("Expected utility's day window of 150 Wh, got %+v", response.Rooms)
+	}
+
+	for _, query := range []string{"?room=garage", "?window=week"} {
+		recorder = httptest.NewRecorder()
+		reloaded.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/energy/rooms"+query, nil))
+		if recorder.Code == 200 {
+			t.Errorf("Expected %s to fail", query)
+		}
+	}
+}
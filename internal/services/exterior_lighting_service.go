@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/calendar"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/solar"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// ExteriorOffAtSunrise keeps exterior lights on until sunrise instead of a clock time
+	ExteriorOffAtSunrise = "sunrise"
+
+	// exteriorLightMaxAge is how long a light sensor reading counts for the dark override
+	exteriorLightMaxAge = 30 * time.Minute
+)
+
+// ExteriorLightingConfig configures the exterior lighting controller. Lights go on SunsetOffsetMinutes
+// before sunset and off at Off, a clock time such as "23:30" or "sunrise". Off times before noon are
+// the next morning. When the light sensor of LuxRoom reads below DarkBelow in the afternoon, as under
+// a storm, the lights go on early.
+type ExteriorLightingConfig struct {
+	Latitude            float64           `json:"latitude"`
+	Longitude           float64           `json:"longitude"`
+	SunsetOffsetMinutes int               `json:"sunset_offset_minutes"`
+	Off                 string            `json:"off"`
+	DeviceIDs           []string          `json:"device_ids,omitempty"`
+	Tag                 string            `json:"tag,omitempty"`
+	LuxRoom             string            `json:"lux_room,omitempty"`
+	DarkBelow           float64           `json:"dark_below,omitempty"` // Light level (%) of the sensor
+	Holidays            []HolidayLighting `json:"holidays,omitempty"`
+}
+
+// HolidayLighting switches extra lights, such as string lights tagged holiday-lights, with the
+// exterior lights on the evenings from Start to End. Dates are "MM-DD" and may wrap the new year.
+// Calendar names a period or holiday of the holiday calendar to use instead of Start and End.
+type HolidayLighting struct {
+	Name      string   `json:"name"`
+	Start     string   `json:"start,omitempty"`
+	End       string   `json:"end,omitempty"`
+	Calendar  string   `json:"calendar,omitempty"`
+	DeviceIDs []string `json:"device_ids,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	Off       string   `json:"off,omitempty"` // Overrides the exterior Off time for these lights
+}
+
+// LoadExteriorLightingConfig reads the exterior lighting configuration from a JSON file
+func LoadExteriorLightingConfig(path string) (*ExteriorLightingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read exterior lighting file", err)
+	}
+
+	var cfg ExteriorLightingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse exterior lighting file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the location, times and lights of the configuration
+func (c *ExteriorLightingConfig) Validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return errors.NewValidationError(fmt.Sprintf("invalid location %.4f, %.4f", c.Latitude, c.Longitude), nil)
+	}
+	if err := validateExteriorOff(c.Off); err != nil {
+		return err
+	}
+	if len(c.DeviceIDs) == 0 && c.Tag == "" {
+		return errors.NewValidationError("exterior lighting needs device_ids or a tag", nil)
+	}
+	if c.LuxRoom != "" && c.DarkBelow <= 0 {
+		return errors.NewValidationError("lux_room needs a dark_below light level", nil)
+	}
+
+	for _, holiday := range c.Holidays {
+		if holiday.Calendar == "" {
+			if _, err := time.Parse("01-02", holiday.Start); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("holiday %s has an invalid start %q, use MM-DD", holiday.Name, holiday.Start), err)
+			}
+			if _, err := time.Parse("01-02", holiday.End); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("holiday %s has an invalid end %q, use MM-DD", holiday.Name, holiday.End), err)
+			}
+		}
+		if len(holiday.DeviceIDs) == 0 && holiday.Tag == "" {
+			return errors.NewValidationError(fmt.Sprintf("holiday %s needs device_ids or a tag", holiday.Name), nil)
+		}
+		if holiday.Off != "" {
+			if err := validateExteriorOff(holiday.Off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateExteriorOff(off string) error {
+	if off == ExteriorOffAtSunrise {
+		return nil
+	}
+	if _, err := time.Parse("15:04", off); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid off time %q, use HH:MM or sunrise", off), err)
+	}
+	return nil
+}
+
+// ExteriorLightingStatus reports tonight's lighting window and what the controller wants each light to be
+type ExteriorLightingStatus struct {
+	Lit        bool            `json:"lit"`
+	Reason     string          `json:"reason"` // schedule, dark or off
+	Sunrise    time.Time       `json:"sunrise,omitempty"`
+	Sunset     time.Time       `json:"sunset,omitempty"`
+	On         time.Time       `json:"on,omitempty"`
+	Off        time.Time       `json:"off,omitempty"`
+	Holidays   []string        `json:"holidays,omitempty"`
+	LightLevel *float64        `json:"light_level,omitempty"`
+	Devices    map[string]bool `json:"devices"`
+}
+
+// exteriorGroup is a set of lights sharing an off time: the exterior lights or one holiday's lights
+type exteriorGroup struct {
+	holiday   string
+	deviceIDs []string
+	tag       string
+	off       string
+}
+
+// ExteriorLightingService switches exterior lights from sunset to a configured time or sunrise.
+// Lights are switched through the device service or, for plugs, the Tapo service. A light is only
+// commanded when its wanted state changes, so switching a light by hand sticks until the next change.
+type ExteriorLightingService struct {
+	config      *ExteriorLightingConfig
+	devices     *DeviceService
+	tapo        *TapoService
+	calendar    *calendar.Calendar
+	plugs       map[string]EnergyReading // Last reading per Tapo plug, for tags
+	lit         map[string]bool          // Last state commanded per light
+	lightLevel  float64
+	lightUpdate time.Time
+	logger      *logger.Logger
+	mu          sync.Mutex
+}
+
+// NewExteriorLightingService creates an exterior lighting controller
+func NewExteriorLightingService(cfg *ExteriorLightingConfig, serviceLogger *logger.Logger) *ExteriorLightingService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ExteriorLightingService", nil)
+	}
+
+	return &ExteriorLightingService{
+		config: cfg,
+		plugs:  make(map[string]EnergyReading),
+		lit:    make(map[string]bool),
+		logger: serviceLogger,
+	}
+}
+
+// SetDeviceService switches lights and switches known to the device service
+func (s *ExteriorLightingService) SetDeviceService(devices *DeviceService) {
+	s.devices = devices
+}
+
+// SetTapoService switches Tapo plugs; their tags come from RecordPlugReading
+func (s *ExteriorLightingService) SetTapoService(tapo *TapoService) {
+	s.tapo = tapo
+}
+
+// SetCalendar resolves the holidays that name a calendar period or holiday
+func (s *ExteriorLightingService) SetCalendar(cal *calendar.Calendar) {
+	for _, holiday := range s.config.Holidays {
+		if holiday.Calendar != "" && !cal.Has(holiday.Calendar) {
+			s.logger.Warn("Holiday lighting names no period or holiday of the calendar", map[string]interface{}{
+				"holiday":  holiday.Name,
+				"calendar": holiday.Calendar,
+			})
+		}
+	}
+	s.calendar = cal
+}
+
+// RecordPlugReading remembers the tags of a plug; it fits TapoService.AddReadingCallback
+func (s *ExteriorLightingService) RecordPlugReading(reading EnergyReading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugs[reading.DeviceID] = reading
+}
+
+// HandleLightLevel records the light sensor of the configured room; it fits AddLightCallback
+func (s *ExteriorLightingService) HandleLightLevel(roomID, lightState string, lightLevel float64) {
+	if roomID == s.config.LuxRoom {
+		s.recordLightLevel(lightLevel, time.Now())
+	}
+}
+
+func (s *ExteriorLightingService) recordLightLevel(lightLevel float64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lightLevel = lightLevel
+	s.lightUpdate = at
+}
+
+// Subscribe follows every reading of the configured room's light sensor, for services without
+// a unified sensor service
+func (s *ExteriorLightingService) Subscribe(client *mqtt.Client) error {
+	if s.config.LuxRoom == "" {
+		return nil
+	}
+
+	return client.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomLight, s.config.LuxRoom), func(topic string, payload []byte) error {
+		var message UnifiedSensorMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			return err
+		}
+		if message.LightLevel != nil {
+			s.HandleLightLevel(s.config.LuxRoom, message.LightState, *message.LightLevel)
+		}
+		return nil
+	})
+}
+
+// Run switches the lights every minute until the context is cancelled
+func (s *ExteriorLightingService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	s.apply(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.apply(now)
+		}
+	}
+}
+
+func (s *ExteriorLightingService) apply(now time.Time) {
+	if err := s.Apply(now); err != nil {
+		s.logger.Error("Failed to switch exterior lights", err)
+	}
+}
+
+// Apply switches every light whose wanted state changed, continuing past failures.
+// A failed light is retried on the next call.
+func (s *ExteriorLightingService) Apply(now time.Time) error {
+	status := s.Status(now)
+
+	s.mu.Lock()
+	var changed []string
+	for id, on := range status.Devices {
+		if lit, known := s.lit[id]; !known || lit != on {
+			changed = append(changed, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(changed)
+
+	var failed []string
+	for _, id := range changed {
+		on := status.Devices[id]
+		if err := s.switchLight(id, on); err != nil {
+			s.logger.Error("Failed to switch exterior light", err, map[string]interface{}{
+				"device_id": id,
+				"on":        on,
+			})
+			failed = append(failed, id)
+			continue
+		}
+
+		s.mu.Lock()
+		s.lit[id] = on
+		s.mu.Unlock()
+		s.logger.Info("Switched exterior light", map[string]interface{}{
+			"device_id": id,
+			"on":        on,
+		})
+	}
+
+	if len(failed) > 0 {
+		return errors.NewDeviceError(fmt.Sprintf("exterior lighting failed on %d of %d lights: %s",
+			len(failed), len(changed), strings.Join(failed, ", ")), nil)
+	}
+	return nil
+}
+
+// Status returns the wanted state of every light at now. Tonight's window is checked along with
+// last night's, which may run past midnight.
+func (s *ExteriorLightingService) Status(now time.Time) ExteriorLightingStatus {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	yesterday := today.AddDate(0, 0, -1)
+	dark, level, hasLevel := s.dark(now)
+
+	status := ExteriorLightingStatus{Reason: "off", Devices: make(map[string]bool)}
+	if sunrise, sunset, ok := solar.Times(today, s.config.Latitude, s.config.Longitude); ok {
+		status.Sunrise, status.Sunset = sunrise, sunset
+	}
+	if hasLevel {
+		status.LightLevel = &level
+	}
+
+	// Lights commanded before stay known, so holiday lights are switched off once the holiday is over
+	s.mu.Lock()
+	for id := range s.lit {
+		status.Devices[id] = false
+	}
+	s.mu.Unlock()
+
+	for _, date := range []time.Time{yesterday, today} {
+		for _, group := range s.groups(date) {
+			on, off, ok := s.window(date, group.off)
+			if date.Equal(today) && group.holiday == "" && ok {
+				status.On, status.Off = on, off
+			}
+			if date.Equal(today) && group.holiday != "" {
+				status.Holidays = append(status.Holidays, group.holiday)
+			}
+
+			reason := ""
+			switch {
+			case ok && !now.Before(on) && now.Before(off):
+				reason = "schedule"
+			case ok && date.Equal(today) && dark && now.Hour() >= 12 && now.Before(off):
+				reason = "dark"
+			}
+
+			for _, id := range s.targets(group) {
+				status.Devices[id] = status.Devices[id] || reason != ""
+			}
+			if reason != "" && (status.Reason == "off" || reason == "schedule") {
+				status.Lit, status.Reason = true, reason
+			}
+		}
+	}
+	return status
+}
+
+// Handler serves the lighting status as JSON
+func (s *ExteriorLightingService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
+
+// window returns the on and off times of the evening of date. ok is false when the sun doesn't
+// set, or the off time comes before the lights would go on, as with an early off time in summer.
+func (s *ExteriorLightingService) window(date time.Time, offSetting string) (on, off time.Time, ok bool) {
+	_, sunset, ok := solar.Times(date, s.config.Latitude, s.config.Longitude)
+	if !ok {
+		return on, off, false
+	}
+	on = sunset.Add(-time.Duration(s.config.SunsetOffsetMinutes) * time.Minute)
+
+	if offSetting == ExteriorOffAtSunrise {
+		sunrise, _, ok := solar.Times(date.AddDate(0, 0, 1), s.config.Latitude, s.config.Longitude)
+		if !ok {
+			return on, off, false
+		}
+		off = sunrise
+	} else {
+		clock, err := time.Parse("15:04", offSetting)
+		if err != nil {
+			return on, off, false
+		}
+		off = time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), 0, 0, date.Location())
+		if clock.Hour() < 12 {
+			off = off.AddDate(0, 0, 1)
+		}
+	}
+	return on, off, off.After(on)
+}
+
+// groups returns the exterior lights and the lights of every holiday on date
+func (s *ExteriorLightingService) groups(date time.Time) []exteriorGroup {
+	groups := []exteriorGroup{{deviceIDs: s.config.DeviceIDs, tag: s.config.Tag, off: s.config.Off}}
+	for _, holiday := range s.config.Holidays {
+		if !s.holidayActive(holiday, date) {
+			continue
+		}
+		off := holiday.Off
+		if off == "" {
+			off = s.config.Off
+		}
+		groups = append(groups, exteriorGroup{holiday: holiday.Name, deviceIDs: holiday.DeviceIDs, tag: holiday.Tag, off: off})
+	}
+	return groups
+}
+
+// holidayActive reports whether date falls in a holiday's calendar period, or from its start to
+// its end inclusive
+func (s *ExteriorLightingService) holidayActive(holiday HolidayLighting, date time.Time) bool {
+	if holiday.Calendar != "" {
+		return s.calendar.InPeriod(holiday.Calendar, date)
+	}
+	return calendar.Within(holiday.Start, holiday.End, date)
+}
+
+// targets returns the IDs of a group's lights, resolving its tag on devices and plugs
+func (s *ExteriorLightingService) targets(group exteriorGroup) []string {
+	ids := append([]string(nil), group.deviceIDs...)
+	if group.tag == "" {
+		return ids
+	}
+
+	if s.devices != nil {
+		for _, device := range s.devices.GetDevicesByTag(group.tag) {
+			ids = append(ids, device.ID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reading := range s.plugs {
+		if models.HasTag(reading.Tags, group.tag) {
+			ids = append(ids, reading.DeviceID)
+		}
+	}
+	return ids
+}
+
+// dark reports whether the configured light sensor recently read below the dark level
+func (s *ExteriorLightingService) dark(now time.Time) (bool, float64, bool) {
+	if s.config.LuxRoom == "" {
+		return false, 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lightUpdate.IsZero() || now.Sub(s.lightUpdate) > exteriorLightMaxAge {
+		return false, 0, false
+	}
+	return s.lightLevel < s.config.DarkBelow, s.lightLevel, true
+}
+
+// switchLight turns a light on or off through the device service, or as a Tapo plug
+func (s *ExteriorLightingService) switchLight(id string, on bool) error {
+	if s.devices != nil {
+		if _, err := s.devices.GetDevice(id); err == nil {
+			action := "turn_off"
+			if on {
+				action = "turn_on"
+			}
+			return s.devices.ExecuteCommand(&models.DeviceCommand{DeviceID: id, Action: action})
+		}
+	}
+	if s.tapo != nil {
+		return s.tapo.SetDeviceState(id, on)
+	}
+	return errors.NewServiceError("no device or Tapo service to switch "+id, nil)
+}
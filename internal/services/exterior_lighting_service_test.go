@@ -0,0 +1,143 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/calendar"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func TestExteriorLighting(t *testing.T) {
+	devices := NewDeviceService(nil, nil)
+	devices.AddDevice(&models.Device{ID: "porch", Type: models.DeviceTypeLight, Tags: []string{"exterior"},
+		Properties: map[string]interface{}{"power": false}})
+	devices.AddDevice(&models.Device{ID: "string-lights", Type: models.DeviceTypeSwitch, Tags: []string{"holiday-lights"},
+		Properties: map[string]interface{}{"power": false}})
+
+	// London, where the sun sets at 15:53 UTC on the winter solstice
+	service := NewExteriorLightingService(&ExteriorLightingConfig{
+		Latitude:            51.5074,
+		Longitude:           -0.1278,
+		SunsetOffsetMinutes: 15,
+		Off:                 "23:00",
+		Tag:                 "exterior",
+		LuxRoom:             "garden",
+		DarkBelow:           20,
+		Holidays: []HolidayLighting{
+			{Name: "winter", Start: "12-01", End: "01-06", Tag: "holiday-lights", Off: ExteriorOffAtSunrise},
+		},
+	}, nil)
+	service.SetDeviceService(devices)
+
+	power := func(id string) interface{} {
+		device, _ := devices.GetDevice(id)
+		return device.Properties["power"]
+	}
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		porch, extra bool
+	}{
+		{"afternoon", time.Date(2024, 12, 21, 15, 0, 0, 0, time.UTC), false, false},
+		{"before sunset", time.Date(2024, 12, 21, 15, 45, 0, 0, time.UTC), true, true},
+		{"after the off time", time.Date(2024, 12, 21, 23, 30, 0, 0, time.UTC), false, true},
+		{"before sunrise", time.Date(2024, 12, 22, 7, 30, 0, 0, time.UTC), false, true},
+		{"after sunrise", time.Date(2024, 12, 22, 8, 30, 0, 0, time.UTC), false, false},
+	}
+	for _, test := range tests {
+		if err := service.Apply(test.now); err != nil {
+			t.Fatalf("%s: Apply failed: %v", test.name, err)
+		}
+		if power("porch") != test.porch || power("string-lights") != test.extra {
+			t.Errorf("%s: expected porch %v and string lights %v, got %v and %v",
+				test.name, test.porch, test.extra, power("porch"), power("string-lights"))
+		}
+	}
+
+	// A dark afternoon switches the lights on early
+	afternoon := time.Date(2024, 12, 22, 14, 0, 0, 0, time.UTC)
+	service.recordLightLevel(5, afternoon)
+	if status := service.Status(afternoon); !status.Lit || status.Reason != "dark" || !status.Devices["porch"] {
+		t.Errorf("Expected the dark override to switch the porch on, got %+v", status)
+	}
+
+	// Holiday lights stay off once the holiday is over
+	evening := time.Date(2025, 1, 10, 17, 0, 0, 0, time.UTC)
+	if status := service.Status(evening); !status.Devices["porch"] || status.Devices["string-lights"] || len(status.Holidays) != 0 {
+		t.Errorf("Expected only the porch on after the holiday, got %+v", status)
+	}
+}
+
+func TestExteriorLightingWindow(t *testing.T) {
+	service := NewExteriorLightingService(&ExteriorLightingConfig{Latitude: 51.5074, Longitude: -0.1278, Off: "01:30", Tag: "exterior"}, nil)
+
+	winter := time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC)
+	if _, off, ok := service.window(winter, "01:30"); !ok || !off.Equal(time.Date(2024, 12, 22, 1, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected an off time before noon to be the next morning, got %s (%v)", off, ok)
+	}
+
+	// The sun sets at 20:21 UTC in June, so an off time of 20:00 means no lighting
+	summer := time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC)
+	if _, _, ok := service.window(summer, "20:00"); ok {
+		t.Error("Expected no window when the off time comes before sunset")
+	}
+}
+
+func TestExteriorLightingConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ExteriorLightingConfig
+		valid  bool
+	}{
+		{"valid", ExteriorLightingConfig{Latitude: 51.5, Off: "sunrise", Tag: "exterior"}, true},
+		{"bad off time", ExteriorLightingConfig{Latitude: 51.5, Off: "late", Tag: "exterior"}, false},
+		{"no lights", ExteriorLightingConfig{Latitude: 51.5, Off: "23:00"}, false},
+		{"bad latitude", ExteriorLightingConfig{Latitude: 95, Off: "23:00", Tag: "exterior"}, false},
+		{"lux room without level", ExteriorLightingConfig{Off: "23:00", Tag: "exterior", LuxRoom: "garden"}, false},
+		{"bad holiday", ExteriorLightingConfig{Off: "23:00", Tag: "exterior",
+			Holidays: []HolidayLighting{{Name: "winter", Start: "December", End: "01-06", Tag: "holiday-lights"}}}, false},
+	}
+	for _, test := range tests {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestExteriorLightingCalendar(t *testing.T) {
+	holidays, err := calendar.New(calendar.Config{Region: "us", Periods: []calendar.Period{{Name: "December", Start: "12-01", End: "12-31"}}})
+	if err != nil {
+		t.Fatalf("calendar.New failed: %v", err)
+	}
+
+	service := NewExteriorLightingService(&ExteriorLightingConfig{
+		Latitude:  40.7128,
+		Longitude: -74.0060,
+		Off:       "23:00",
+		DeviceIDs: []string{"porch"},
+		Holidays: []HolidayLighting{
+			{Name: "december", Calendar: "December", DeviceIDs: []string{"tree"}},
+			{Name: "independence", Calendar: "Independence Day", DeviceIDs: []string{"flag"}},
+		},
+	}, nil)
+	service.SetCalendar(holidays)
+
+	eastern := time.FixedZone("EDT", -4*3600)
+	tests := []struct {
+		now        time.Time
+		tree, flag bool
+	}{
+		{time.Date(2024, 12, 10, 20, 0, 0, 0, eastern), true, false},
+		{time.Date(2024, 7, 4, 18, 0, 0, 0, eastern), false, false}, // The sun sets at 20:31
+		{time.Date(2024, 7, 4, 21, 0, 0, 0, eastern), false, true},
+		{time.Date(2024, 7, 5, 21, 0, 0, 0, eastern), false, false},
+	}
+	for _, test := range tests {
+		status := service.Status(test.now)
+		if status.Devices["tree"] != test.tree || status.Devices["flag"] != test.flag {
+			t.Errorf("%s: expected tree %v and flag %v, got %v", test.now, test.tree, test.flag, status.Devices)
+		}
+	}
+}
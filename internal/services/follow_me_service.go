@@ -0,0 +1,429 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+)
+
+const (
+	// Follow-me reasons for a room being lit
+	FollowMeHere   = "here"   // The person is in the room
+	FollowMeAhead  = "ahead"  // The room is next on the way the person is walking
+	FollowMeBehind = "behind" // The person has left the room
+
+	defaultFollowMeGrace      = 60 * time.Second
+	defaultFollowMeTransition = 30 * time.Second
+)
+
+// FollowMeConfig configures follow-me lighting. Rooms maps each room to the rooms it opens onto
+// and its lights; adjacency is symmetric, so each door only needs listing once. Motion in a
+// neighbour within TransitionSeconds of motion in the current room counts as walking through.
+type FollowMeConfig struct {
+	GraceSeconds      int                     `json:"grace_seconds,omitempty"`      // Lights behind stay on this long, default 60
+	TransitionSeconds int                     `json:"transition_seconds,omitempty"` // Default 30
+	DarkBelow         float64                 `json:"dark_below,omitempty"`         // Light level (%) below which lights go on, 0 = always
+	Rooms             map[string]FollowMeRoom `json:"rooms"`
+}
+
+// FollowMeRoom is a room of the follow-me graph. Lights default to the light-<room> device.
+type FollowMeRoom struct {
+	Adjacent  []string `json:"adjacent,omitempty"`
+	DeviceIDs []string `json:"device_ids,omitempty"`
+}
+
+// LoadFollowMeConfig reads the follow-me lighting configuration from a JSON file
+func LoadFollowMeConfig(path string) (*FollowMeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read follow-me file", err)
+	}
+
+	var cfg FollowMeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse follow-me file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the timings and that every neighbour is a configured room
+func (c *FollowMeConfig) Validate() error {
+	if c.GraceSeconds < 0 || c.TransitionSeconds < 0 {
+		return errors.NewValidationError("grace_seconds and transition_seconds must not be negative", nil)
+	}
+	if len(c.Rooms) == 0 {
+		return errors.NewValidationError("follow-me lighting needs rooms", nil)
+	}
+	for roomID, room := range c.Rooms {
+		for _, neighbour := range room.Adjacent {
+			if _, ok := c.Rooms[neighbour]; !ok {
+				return errors.NewValidationError(fmt.Sprintf("room %s is adjacent to unknown room %s", roomID, neighbour), nil)
+			}
+			if neighbour == roomID {
+				return errors.NewValidationError(fmt.Sprintf("room %s is adjacent to itself", roomID), nil)
+			}
+		}
+	}
+	return nil
+}
+
+// CommandExecutor executes device commands; DeviceService and MQTTDeviceService implement it
+type CommandExecutor interface {
+	ExecuteCommand(cmd *models.DeviceCommand) error
+}
+
+// FollowMeLight is a room lit by follow-me lighting
+type FollowMeLight struct {
+	Reason string    `json:"reason"`
+	OffAt  time.Time `json:"off_at,omitempty"` // Zero while the room is in use
+}
+
+// FollowMeStatus reports where follow-me lighting thinks the person is and which rooms it lit
+type FollowMeStatus struct {
+	Current     string                   `json:"current,omitempty"`
+	Previous    string                   `json:"previous,omitempty"`
+	Lit         map[string]FollowMeLight `json:"lit"`
+	Occupied    []string                 `json:"occupied"`
+	Transitions map[string]int           `json:"transitions"` // Moves seen per "from>to" pair
+}
+
+// FollowMeService lights the way through the house. Motion in a room lights it and, when the
+// motion continues a walk from a neighbouring room, the rooms beyond it. Rooms left behind go
+// dark once their sensor clears and the grace period passes; rooms lit ahead but not entered go
+// dark after the grace period. Compared to per-room motion rules, lights are already on when the
+// person arrives and don't flicker off behind someone pausing in a doorway.
+type FollowMeService struct {
+	config      *FollowMeConfig
+	adjacency   map[string][]string
+	grace       time.Duration
+	transition  time.Duration
+	devices     CommandExecutor
+	safeMode    *safemode.Controller
+	dryRun      *dryrun.Recorder
+	current     string
+	previous    string
+	lastMotion  map[string]time.Time
+	occupied    map[string]bool
+	lit         map[string]*FollowMeLight
+	lightLevels map[string]float64
+	transitions map[string]int
+	logger      *logger.Logger
+	mu          sync.Mutex
+}
+
+// followMeSwitch is a room to switch once the state lock is released
+type followMeSwitch struct {
+	roomID string
+	on     bool
+	reason string
+}
+
+// NewFollowMeService creates a follow-me lighting controller
+func NewFollowMeService(cfg *FollowMeConfig, serviceLogger *logger.Logger) *FollowMeService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("FollowMeService", nil)
+	}
+
+	service := &FollowMeService{
+		config:      cfg,
+		adjacency:   make(map[string][]string),
+		grace:       defaultFollowMeGrace,
+		transition:  defaultFollowMeTransition,
+		lastMotion:  make(map[string]time.Time),
+		occupied:    make(map[string]bool),
+		lit:         make(map[string]*FollowMeLight),
+		lightLevels: make(map[string]float64),
+		transitions: make(map[string]int),
+		logger:      serviceLogger,
+	}
+	if cfg.GraceSeconds > 0 {
+		service.grace = time.Duration(cfg.GraceSeconds) * time.Second
+	}
+	if cfg.TransitionSeconds > 0 {
+		service.transition = time.Duration(cfg.TransitionSeconds) * time.Second
+	}
+
+	neighbours := make(map[string]map[string]bool)
+	for roomID, room := range cfg.Rooms {
+		for _, neighbour := range room.Adjacent {
+			for _, pair := range [][2]string{{roomID, neighbour}, {neighbour, roomID}} {
+				if neighbours[pair[0]] == nil {
+					neighbours[pair[0]] = make(map[string]bool)
+				}
+				neighbours[pair[0]][pair[1]] = true
+			}
+		}
+	}
+	for roomID, set := range neighbours {
+		for neighbour := range set {
+			service.adjacency[roomID] = append(service.adjacency[roomID], neighbour)
+		}
+		sort.Strings(service.adjacency[roomID])
+	}
+	return service
+}
+
+// SetCommandExecutor switches the room lights through a device or MQTT device service
+func (s *FollowMeService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetSafeMode holds back light commands while safe mode is active
+func (s *FollowMeService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder records light commands instead of sending them in observe-only mode
+func (s *FollowMeService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// HandleLightLevel records a room's light level for the dark check; matches the light callback signature
+func (s *FollowMeService) HandleLightLevel(roomID, lightState string, lightLevel float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lightLevels[roomID] = lightLevel
+}
+
+// HandleOccupancy follows motion through the house; matches the motion callback signature
+func (s *FollowMeService) HandleOccupancy(roomID string, occupied bool) {
+	s.switchRooms(s.handleOccupancy(roomID, occupied, time.Now()))
+}
+
+func (s *FollowMeService) handleOccupancy(roomID string, occupied bool, at time.Time) []followMeSwitch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.config.Rooms[roomID]; !ok {
+		return nil
+	}
+	s.occupied[roomID] = occupied
+
+	if !occupied {
+		// The room the person is in keeps its lights when they sit still; rooms behind start their grace period
+		if light, ok := s.lit[roomID]; ok && roomID != s.current {
+			light.Reason = FollowMeBehind
+			light.OffAt = at.Add(s.grace)
+		}
+		return nil
+	}
+
+	from := ""
+	if s.current != "" && s.current != roomID && s.isAdjacent(s.current, roomID) &&
+		at.Sub(s.lastMotion[s.current]) <= s.transition {
+		from = s.current
+		s.transitions[from+">"+roomID]++
+		s.logger.Debug("Follow-me transition", map[string]interface{}{"from": from, "to": roomID})
+	}
+	s.lastMotion[roomID] = at
+	s.previous, s.current = from, roomID
+
+	var switches []followMeSwitch
+
+	// Light the room and, when walking through, the rooms beyond it
+	wanted := map[string]string{roomID: FollowMeHere}
+	if from != "" {
+		for _, neighbour := range s.adjacency[roomID] {
+			if neighbour != from {
+				wanted[neighbour] = FollowMeAhead
+			}
+		}
+	}
+	order := []string{roomID}
+	for _, target := range sortedKeys(wanted) {
+		if target != roomID {
+			order = append(order, target)
+		}
+	}
+	for _, target := range order {
+		reason := wanted[target]
+		light, ok := s.lit[target]
+		switch {
+		case !ok:
+			if reason == FollowMeAhead && s.occupied[target] {
+				continue // Someone is there and has their own lights
+			}
+			if !s.dark(target) {
+				continue
+			}
+			light = &FollowMeLight{}
+			s.lit[target] = light
+			switches = append(switches, followMeSwitch{roomID: target, on: true, reason: reason})
+		case reason == FollowMeAhead && light.Reason == FollowMeHere:
+			continue
+		}
+		light.Reason = reason
+		light.OffAt = time.Time{}
+		if reason == FollowMeAhead {
+			light.OffAt = at.Add(s.grace)
+		}
+	}
+
+	// Rooms left behind wait for their sensor to clear before the grace period starts
+	for target, light := range s.lit {
+		if _, ok := wanted[target]; ok || light.Reason != FollowMeHere {
+			continue
+		}
+		light.Reason = FollowMeBehind
+		if !s.occupied[target] {
+			light.OffAt = at.Add(s.grace)
+		}
+	}
+	return switches
+}
+
+// Run switches off rooms whose grace period has passed until the context is cancelled
+func (s *FollowMeService) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.switchRooms(s.expire(now))
+		}
+	}
+}
+
+// expire drops the rooms whose grace period has passed and nobody has entered since
+func (s *FollowMeService) expire(now time.Time) []followMeSwitch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var switches []followMeSwitch
+	for _, roomID := range sortedKeys(s.lit) {
+		light := s.lit[roomID]
+		if light.OffAt.IsZero() || now.Before(light.OffAt) || s.occupied[roomID] {
+			continue
+		}
+		delete(s.lit, roomID)
+		switches = append(switches, followMeSwitch{roomID: roomID, on: false, reason: light.Reason})
+	}
+	return switches
+}
+
+// Status returns the tracked position and the rooms lit by follow-me lighting
+func (s *FollowMeService) Status() FollowMeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := FollowMeStatus{
+		Current:     s.current,
+		Previous:    s.previous,
+		Lit:         make(map[string]FollowMeLight, len(s.lit)),
+		Occupied:    []string{},
+		Transitions: make(map[string]int, len(s.transitions)),
+	}
+	for roomID, light := range s.lit {
+		status.Lit[roomID] = *light
+	}
+	for _, roomID := range sortedKeys(s.occupied) {
+		if s.occupied[roomID] {
+			status.Occupied = append(status.Occupied, roomID)
+		}
+	}
+	for pair, count := range s.transitions {
+		status.Transitions[pair] = count
+	}
+	return status
+}
+
+// Handler serves the follow-me status as JSON
+func (s *FollowMeService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+func (s *FollowMeService) isAdjacent(a, b string) bool {
+	for _, neighbour := range s.adjacency[a] {
+		if neighbour == b {
+			return true
+		}
+	}
+	return false
+}
+
+// dark reports whether a room needs light; rooms without a light sensor reading do
+func (s *FollowMeService) dark(roomID string) bool {
+	if s.config.DarkBelow <= 0 {
+		return true
+	}
+	level, ok := s.lightLevels[roomID]
+	return !ok || level < s.config.DarkBelow
+}
+
+func (s *FollowMeService) roomLights(roomID string) []string {
+	if ids := s.config.Rooms[roomID].DeviceIDs; len(ids) > 0 {
+		return ids
+	}
+	return []string{fmt.Sprintf("light-%s", roomID)}
+}
+
+// switchRooms commands the lights of each room. A room that fails to light is forgotten so the
+// next motion there retries it.
+func (s *FollowMeService) switchRooms(switches []followMeSwitch) {
+	for _, sw := range switches {
+		action := "turn_off"
+		if sw.on {
+			action = "turn_on"
+		}
+		if !s.safeMode.Allowed(safemode.ComponentAutomation, "follow-me") {
+			s.logger.Info("Safe mode active, skipping follow-me lights", map[string]interface{}{"room_id": sw.roomID, "action": action})
+			continue
+		}
+
+		for _, deviceID := range s.roomLights(sw.roomID) {
+			if s.dryRun.ObserveOnly() {
+				s.dryRun.Record("follow-me", action, deviceID, fmt.Sprintf("follow-me: room %s is %s", sw.roomID, sw.reason),
+					map[string]interface{}{"room_id": sw.roomID})
+				continue
+			}
+
+			var err error
+			if s.devices == nil {
+				err = errors.NewServiceError("no device service to switch "+deviceID, nil)
+			} else {
+				err = s.devices.ExecuteCommand(&models.DeviceCommand{DeviceID: deviceID, Action: action,
+					Options: map[string]interface{}{"automation": "follow-me", "reason": sw.reason}})
+			}
+			if err != nil {
+				s.logger.Error("Failed to switch follow-me light", err, map[string]interface{}{"room_id": sw.roomID, "device_id": deviceID})
+				if sw.on {
+					s.mu.Lock()
+					delete(s.lit, sw.roomID)
+					s.mu.Unlock()
+				}
+				continue
+			}
+			s.logger.Info("Switched follow-me light", map[string]interface{}{"room_id": sw.roomID, "device_id": deviceID, "action": action, "reason": sw.reason})
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+type recordingExecutor struct {
+	commands []string
+}
+
+func (r *recordingExecutor) ExecuteCommand(cmd *models.DeviceCommand) error {
+	r.commands = append(r.commands, cmd.Action+" "+cmd.DeviceID)
+	return nil
+}
+
+func (r *recordingExecutor) take() []string {
+	commands := r.commands
+	r.commands = nil
+	return commands
+}
+
+func followMeHouse() *FollowMeConfig {
+	return &FollowMeConfig{
+		GraceSeconds: 60,
+		Rooms: map[string]FollowMeRoom{
+			"bedroom": {Adjacent: []string{"hallway"}},
+			"hallway": {Adjacent: []string{"kitchen"}},
+			"kitchen": {Adjacent: []string{"dining"}, DeviceIDs: []string{"kitchen-spots", "kitchen-strip"}},
+			"dining":  {},
+		},
+	}
+}
+
+func TestFollowMeLighting(t *testing.T) {
+	service := NewFollowMeService(followMeHouse(), nil)
+	lights := &recordingExecutor{}
+	service.SetCommandExecutor(lights)
+
+	t0 := time.Date(2024, 1, 14, 22, 0, 0, 0, time.UTC)
+	step := func(roomID string, occupied bool, offset time.Duration) []string {
+		service.switchRooms(service.handleOccupancy(roomID, occupied, t0.Add(offset)))
+		return lights.take()
+	}
+	expect := func(got []string, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("Expected %v, got %v", want, got)
+			}
+		}
+	}
+
+	// Waking up lights the bedroom only; nobody is walking yet
+	expect(step("bedroom", true, 0), "turn_on light-bedroom")
+
+	// Walking into the hallway lights the kitchen ahead
+	expect(step("hallway", true, 10*time.Second), "turn_on light-hallway", "turn_on kitchen-spots", "turn_on kitchen-strip")
+	if status := service.Status(); status.Previous != "bedroom" || status.Lit["kitchen"].Reason != FollowMeAhead || status.Lit["bedroom"].Reason != FollowMeBehind {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	// Walking on into the kitchen lights the dining room ahead
+	expect(step("kitchen", true, 25*time.Second), "turn_on light-dining")
+
+	// Rooms behind stay lit while their sensors hold occupancy, then wait out the grace period
+	expect(step("bedroom", false, 40*time.Second))
+	expect(step("hallway", false, 45*time.Second))
+	service.switchRooms(service.expire(t0.Add(90 * time.Second)))
+	expect(lights.take(), "turn_off light-dining")
+	service.switchRooms(service.expire(t0.Add(110 * time.Second)))
+	expect(lights.take(), "turn_off light-bedroom", "turn_off light-hallway")
+	if status := service.Status(); len(status.Lit) != 1 || status.Lit["kitchen"].Reason != FollowMeHere || status.Transitions["hallway>kitchen"] != 1 {
+		t.Errorf("Expected only the kitchen lit, got %+v", status)
+	}
+}
+
+func TestFollowMeDarkAndJumps(t *testing.T) {
+	cfg := followMeHouse()
+	cfg.DarkBelow = 20
+	service := NewFollowMeService(cfg, nil)
+	lights := &recordingExecutor{}
+	service.SetCommandExecutor(lights)
+	service.HandleLightLevel("hallway", "bright", 80)
+
+	t0 := time.Date(2024, 1, 14, 22, 0, 0, 0, time.UTC)
+	service.switchRooms(service.handleOccupancy("bedroom", true, t0))
+	service.switchRooms(service.handleOccupancy("hallway", true, t0.Add(5*time.Second)))
+	if got := lights.take(); len(got) != 3 || got[0] != "turn_on light-bedroom" || got[1] != "turn_on kitchen-spots" {
+		t.Errorf("Expected the bright hallway to stay off, got %v", got)
+	}
+
+	// Motion long after the last is not a walk and lights nothing ahead
+	service.switchRooms(service.expire(t0.Add(5 * time.Minute)))
+	lights.take()
+	service.switchRooms(service.handleOccupancy("kitchen", true, t0.Add(10*time.Minute)))
+	if got := lights.take(); len(got) != 2 {
+		t.Errorf("Expected only the kitchen lights, got %v", got)
+	}
+	if status := service.Status(); status.Previous != "" {
+		t.Errorf("Expected no transition, got %+v", status)
+	}
+
+	// Rooms outside the graph are ignored
+	if switches := service.handleOccupancy("garage", true, t0); switches != nil {
+		t.Errorf("Expected no switches for an unknown room, got %v", switches)
+	}
+}
+
+func TestFollowMeConfigValidate(t *testing.T) {
+	if err := followMeHouse().Validate(); err != nil {
+		t.Errorf("Expected the house to validate: %v", err)
+	}
+	for name, cfg := range map[string]FollowMeConfig{
+		"no rooms":       {},
+		"unknown room":   {Rooms: map[string]FollowMeRoom{"hallway": {Adjacent: []string{"attic"}}}},
+		"self adjacent":  {Rooms: map[string]FollowMeRoom{"hallway": {Adjacent: []string{"hallway"}}}},
+		"negative grace": {GraceSeconds: -1, Rooms: map[string]FollowMeRoom{"hallway": {}}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
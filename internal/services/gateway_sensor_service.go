@@ -0,0 +1,349 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/hwsensors"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/utils"
+)
+
+const (
+	defaultGatewaySensorPoll = 30 * time.Second
+	defaultGatewayI2CBus     = 1 // The I2C bus on a Raspberry Pi's header pins
+)
+
+// GatewaySensor is a sensor wired to the gateway itself, and the room it measures
+type GatewaySensor struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"` // ds18b20, sht3x or bme280
+	RoomID string `json:"room_id"`
+	// Device is the 1-Wire ID of a DS18B20, e.g. 28-0316a2795fff; empty takes the only probe
+	Device string `json:"device,omitempty"`
+	// Bus and Address locate an I2C sensor; bus 0 means bus 1, and an empty address the
+	// sensor's default (0x44 for SHT3x, 0x76 for BME280)
+	Bus     int     `json:"bus,omitempty"`
+	Address string  `json:"address,omitempty"`
+	OffsetF float64 `json:"offset_f,omitempty"` // Calibration added to every temperature
+}
+
+// GatewaySensorConfig lists the sensors attached to the gateway
+type GatewaySensorConfig struct {
+	PollSeconds int             `json:"poll_seconds,omitempty"`
+	OneWireRoot string          `json:"one_wire_root,omitempty"` // /sys/bus/w1/devices by default
+	Sensors     []GatewaySensor `json:"sensors"`
+}
+
+// LoadGatewaySensorConfig reads the gateway sensors from a JSON file
+func LoadGatewaySensorConfig(path string) (*GatewaySensorConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read gateway sensors file", err)
+	}
+
+	var cfg GatewaySensorConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse gateway sensors file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that sensor IDs are unique and every sensor has a room and a usable address
+func (c *GatewaySensorConfig) Validate() error {
+	if c.PollSeconds < 0 {
+		return errors.NewValidationError("poll_seconds must not be negative", nil)
+	}
+
+	seen := make(map[string]bool)
+	for _, sensor := range c.Sensors {
+		if sensor.ID == "" || sensor.RoomID == "" {
+			return errors.NewValidationError("every gateway sensor needs an ID and a room", nil)
+		}
+		if seen[sensor.ID] {
+			return errors.NewValidationError(fmt.Sprintf("gateway sensor %s is defined twice", sensor.ID), nil)
+		}
+		seen[sensor.ID] = true
+
+		switch sensor.Type {
+		case hwsensors.TypeDS18B20:
+			if sensor.Address != "" {
+				return errors.NewValidationError(fmt.Sprintf("gateway sensor %s: a DS18B20 takes a 1-Wire device, not an I2C address", sensor.ID), nil)
+			}
+		case hwsensors.TypeSHT3x, hwsensors.TypeBME280:
+			if _, err := sensor.i2cAddress(); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("gateway sensor %s: %v", sensor.ID, err), nil)
+			}
+		default:
+			return errors.NewValidationError(fmt.Sprintf("gateway sensor %s: unknown type %q, use ds18b20, sht3x or bme280", sensor.ID, sensor.Type), nil)
+		}
+	}
+	return nil
+}
+
+// i2cAddress parses the sensor's address, e.g. 0x44, or returns its type's default
+func (s GatewaySensor) i2cAddress() (uint16, error) {
+	if s.Address == "" {
+		if s.Type == hwsensors.TypeBME280 {
+			return hwsensors.DefaultBME280Address, nil
+		}
+		return hwsensors.DefaultSHT3xAddress, nil
+	}
+	addr, err := strconv.ParseUint(s.Address, 0, 7)
+	if err != nil {
+		return 0, fmt.Errorf("invalid I2C address %q", s.Address)
+	}
+	return uint16(addr), nil
+}
+
+// GatewaySensorStatus is the last reading of a gateway sensor, or why it failed
+type GatewaySensorStatus struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	RoomID       string    `json:"room_id"`
+	TemperatureF *float64  `json:"temperature_f,omitempty"`
+	Humidity     *float64  `json:"humidity,omitempty"`
+	PressureHPa  *float64  `json:"pressure_hpa,omitempty"`
+	LastRead     time.Time `json:"last_read,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Failures     int       `json:"failures"` // Consecutive failed reads
+}
+
+// GatewaySensorService polls the sensors attached to the gateway and publishes their readings
+// on the room-temp and room-hum topics, like a Pico in the room would
+type GatewaySensorService struct {
+	config  *GatewaySensorConfig
+	poll    time.Duration
+	logger  *logger.Logger
+	publish func(*mqtt.Message) error
+	read    func(GatewaySensor) (hwsensors.Reading, error)
+	buses   map[int]hwsensors.Bus
+	status  map[string]*GatewaySensorStatus
+	mu      sync.Mutex
+}
+
+// NewGatewaySensorService creates a service reading the configured sensors
+func NewGatewaySensorService(cfg *GatewaySensorConfig, serviceLogger *logger.Logger) *GatewaySensorService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("GatewaySensorService", nil)
+	}
+	if cfg.OneWireRoot == "" {
+		cfg.OneWireRoot = hwsensors.OneWireRoot
+	}
+
+	service := &GatewaySensorService{
+		config: cfg,
+		poll:   defaultGatewaySensorPoll,
+		logger: serviceLogger,
+		buses:  make(map[int]hwsensors.Bus),
+		status: make(map[string]*GatewaySensorStatus),
+	}
+	if cfg.PollSeconds > 0 {
+		service.poll = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	service.read = service.readSensor
+
+	for _, sensor := range cfg.Sensors {
+		service.status[sensor.ID] = &GatewaySensorStatus{ID: sensor.ID, Type: sensor.Type, RoomID: sensor.RoomID}
+	}
+	return service
+}
+
+// SetMQTTClient sets the client readings are published with
+func (s *GatewaySensorService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// Run reads every sensor at the poll interval until ctx is done, then closes the I2C buses
+func (s *GatewaySensorService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+	defer s.close()
+
+	s.readAll(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.readAll(now)
+		}
+	}
+}
+
+// readAll reads and publishes every sensor. Failures are logged when a sensor starts and stops
+// failing rather than on every poll.
+func (s *GatewaySensorService) readAll(now time.Time) {
+	for _, sensor := range s.config.Sensors {
+		reading, err := s.read(sensor)
+
+		s.mu.Lock()
+		status := s.status[sensor.ID]
+		if err != nil {
+			if status.Failures == 0 {
+				s.logger.Error("Failed to read gateway sensor", err, map[string]interface{}{
+					"sensor_id": sensor.ID,
+					"type":      sensor.Type,
+					"room_id":   sensor.RoomID,
+				})
+			}
+			status.Error = err.Error()
+			status.Failures++
+			s.mu.Unlock()
+			continue
+		}
+		if status.Failures > 0 {
+			s.logger.Info("Gateway sensor recovered", map[string]interface{}{
+				"sensor_id": sensor.ID,
+				"failures":  status.Failures,
+			})
+		}
+
+		temperature := math.Round((utils.CelsiusToFahrenheit(reading.TemperatureC)+sensor.OffsetF)*100) / 100
+		status.TemperatureF = &temperature
+		status.Humidity = reading.Humidity
+		status.PressureHPa = reading.PressureHPa
+		status.LastRead = now
+		status.Error = ""
+		status.Failures = 0
+		s.mu.Unlock()
+
+		s.publishReading(sensor, mqtt.TopicRoomTemperature, UnifiedSensorMessage{Temperature: temperature, TempUnit: "F"}, now)
+		if reading.Humidity != nil {
+			humidity := math.Round(*reading.Humidity*10) / 10
+			s.publishReading(sensor, mqtt.TopicRoomHumidity, UnifiedSensorMessage{Humidity: humidity, HumidityUnit: "%"}, now)
+		}
+	}
+}
+
+// publishReading publishes a reading as a room sensor message
+func (s *GatewaySensorService) publishReading(sensor GatewaySensor, root string, message UnifiedSensorMessage, now time.Time) {
+	if s.publish == nil {
+		return
+	}
+
+	msg, err := roomSensorMessage(root, sensor.RoomID, sensor.Type, sensor.ID, message, now)
+	if err != nil {
+		return
+	}
+	if err := s.publish(msg); err != nil {
+		s.logger.Error("Failed to publish gateway sensor reading", err, map[string]interface{}{
+			"sensor_id": sensor.ID,
+			"topic":     msg.Topic,
+		})
+	}
+}
+
+// roomSensorMessage is a reading as a Pico in the room would publish it
+func roomSensorMessage(root, roomID, sensorType, deviceID string, message UnifiedSensorMessage, now time.Time) (*mqtt.Message, error) {
+	message.Room = roomID
+	message.Sensor = sensorType
+	message.DeviceID = deviceID
+	message.Timestamp = now.Unix()
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&mqtt.Message{Topic: mqtt.RoomTopic(root, roomID), Payload: payload, QoS: 1}).
+		WithProperty(mqtt.PropertyDevice, deviceID).WithProperty(mqtt.PropertyRoom, roomID), nil
+}
+
+// readSensor reads one sensor from the hardware
+func (s *GatewaySensorService) readSensor(sensor GatewaySensor) (hwsensors.Reading, error) {
+	if sensor.Type == hwsensors.TypeDS18B20 {
+		device := sensor.Device
+		if device == "" {
+			devices, err := hwsensors.OneWireDevices(s.config.OneWireRoot)
+			if err != nil {
+				return hwsensors.Reading{}, err
+			}
+			if len(devices) != 1 {
+				return hwsensors.Reading{}, fmt.Errorf("found %d DS18B20 probes (%s), set the device of sensor %s",
+					len(devices), strings.Join(devices, ", "), sensor.ID)
+			}
+			device = devices[0]
+		}
+		return hwsensors.ReadDS18B20(s.config.OneWireRoot, device)
+	}
+
+	bus, err := s.bus(sensor.Bus)
+	if err != nil {
+		return hwsensors.Reading{}, err
+	}
+	addr, _ := sensor.i2cAddress()
+	if sensor.Type == hwsensors.TypeBME280 {
+		return hwsensors.ReadBME280(bus, addr)
+	}
+	return hwsensors.ReadSHT3x(bus, addr)
+}
+
+// bus opens an I2C bus on first use; sensors on the same bus share it
+func (s *GatewaySensorService) bus(number int) (hwsensors.Bus, error) {
+	if number == 0 {
+		number = defaultGatewayI2CBus
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bus, ok := s.buses[number]; ok {
+		return bus, nil
+	}
+	bus, err := hwsensors.OpenI2C(number)
+	if err != nil {
+		return nil, err
+	}
+	s.buses[number] = bus
+	return bus, nil
+}
+
+func (s *GatewaySensorService) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for number, bus := range s.buses {
+		bus.Close()
+		delete(s.buses, number)
+	}
+}
+
+// Status returns the last reading of every sensor, sorted by ID
+func (s *GatewaySensorService) Status() []GatewaySensorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]GatewaySensorStatus, 0, len(s.status))
+	for _, status := range s.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Handler serves the gateway sensors and their last readings as JSON
+func (s *GatewaySensorService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sensors": s.Status(),
+		})
+	})
+}
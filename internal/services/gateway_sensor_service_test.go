@@ -0,0 +1,83 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/hwsensors"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestGatewaySensorsPublishRoomReadings(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "28-0316a2795fff"), 0755)
+	os.WriteFile(filepath.Join(root, "28-0316a2795fff", "w1_slave"),
+		[]byte("72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=21000\n"), 0644)
+
+	cfg := &GatewaySensorConfig{OneWireRoot: root, Sensors: []GatewaySensor{
+		{ID: "closet-probe", Type: hwsensors.TypeDS18B20, RoomID: "utility", OffsetF: -0.8},
+		{ID: "office-sht", Type: hwsensors.TypeSHT3x, RoomID: "office", Bus: 1, Address: "0x45"},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	service := NewGatewaySensorService(cfg, nil)
+	hardwareRead := service.read
+	shtFails := true
+	service.read = func(sensor GatewaySensor) (hwsensors.Reading, error) {
+		if sensor.Type != hwsensors.TypeSHT3x {
+			return hardwareRead(sensor)
+		}
+		if shtFails {
+			return hwsensors.Reading{}, fmt.Errorf("no ACK from 0x45")
+		}
+		humidity := 41.26
+		return hwsensors.Reading{TemperatureC: 20, Humidity: &humidity}, nil
+	}
+	messages := make(map[string]UnifiedSensorMessage)
+	service.publish = func(msg *mqtt.Message) error {
+		var message UnifiedSensorMessage
+		json.Unmarshal(msg.Payload, &message)
+		messages[msg.Topic] = message
+		return nil
+	}
+
+	now := time.Now()
+	service.readAll(now)
+	if probe := messages["room-temp/utility"]; probe.Temperature != 69 || probe.TempUnit != "F" || probe.Sensor != "ds18b20" || probe.DeviceID != "closet-probe" {
+		t.Errorf("Expected the calibrated probe reading as the utility room's temperature, got %+v", probe)
+	}
+	if status := service.Status(); status[1].ID != "office-sht" || status[1].Failures != 1 || status[1].Error == "" {
+		t.Errorf("Expected the SHT3x failure in its status, got %+v", status)
+	}
+
+	shtFails = false
+	service.readAll(now.Add(30 * time.Second))
+	if office := messages["room-temp/office"]; office.Temperature != 68 || office.Room != "office" {
+		t.Errorf("Expected the office temperature, got %+v", office)
+	}
+	if office := messages["room-hum/office"]; office.Humidity != 41.3 || office.HumidityUnit != "%" {
+		t.Errorf("Expected the office humidity, got %+v", office)
+	}
+	if status := service.Status(); status[1].Failures != 0 || status[1].Error != "" {
+		t.Errorf("Expected the SHT3x to have recovered, got %+v", status[1])
+	}
+}
+
+func TestGatewaySensorConfigValidate(t *testing.T) {
+	for name, sensor := range map[string]GatewaySensor{
+		"no room":          {ID: "a", Type: hwsensors.TypeDS18B20},
+		"unknown type":     {ID: "a", Type: "dht22", RoomID: "office"},
+		"bad address":      {ID: "a", Type: hwsensors.TypeBME280, RoomID: "office", Address: "0x1ff"},
+		"1-wire addressed": {ID: "a", Type: hwsensors.TypeDS18B20, RoomID: "office", Address: "0x44"},
+	} {
+		if err := (&GatewaySensorConfig{Sensors: []GatewaySensor{sensor}}).Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/prices"
+	"github.com/johnpr01/home-automation/pkg/sunspec"
+)
+
+const (
+	defaultGridPoll = 10 * time.Second
+	// gridPricePoll is how often prices are fetched; suppliers publish the next day's once a day
+	gridPricePoll = 30 * time.Minute
+	// gridReadingMaxAge is how long a solar or grid reading counts
+	gridReadingMaxAge = 5 * time.Minute
+
+	GridMatchAny = "any"
+	GridMatchAll = "all"
+)
+
+// GridSource reads a power from a SunSpec inverter or meter over Modbus TCP, or from an MQTT
+// topic carrying messages as the peak-shaving meter's
+type GridSource struct {
+	SunSpec     string `json:"sunspec,omitempty"`      // host:port, e.g. 192.168.1.40:502
+	UnitID      int    `json:"unit_id,omitempty"`      // Modbus unit, 1 by default
+	BaseAddress int    `json:"base_address,omitempty"` // Start of the SunSpec map, 40000 by default
+	Topic       string `json:"topic,omitempty"`
+	// Invert flips the sign, for grid meters counting export as positive
+	Invert bool `json:"invert,omitempty"`
+}
+
+// validate checks a source has exactly one of a SunSpec device and a topic
+func (s *GridSource) validate(name string) error {
+	if (s.SunSpec == "") == (s.Topic == "") {
+		return errors.NewValidationError(fmt.Sprintf("%s needs either a sunspec address or a topic", name), nil)
+	}
+	if s.UnitID < 0 || s.UnitID > 247 || s.BaseAddress < 0 || s.BaseAddress > 65535 {
+		return errors.NewValidationError(fmt.Sprintf("%s: invalid unit_id or base_address", name), nil)
+	}
+	if s.UnitID == 0 {
+		s.UnitID = 1
+	}
+	if s.BaseAddress == 0 {
+		s.BaseAddress = sunspec.DefaultBaseAddress
+	}
+	return nil
+}
+
+// GridRule switches a Tapo plug on while the home has solar to spare or electricity is cheap.
+// The rule holds when any of its conditions does, or all of them with Match "all".
+type GridRule struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id"`
+	// Conditions; a condition whose signal isn't known doesn't hold
+	ExportAboveW *float64 `json:"export_above_w,omitempty"`
+	SolarAboveW  *float64 `json:"solar_above_w,omitempty"`
+	PriceBelow   *float64 `json:"price_below,omitempty"` // Per kWh in the supplier's currency
+	Match        string   `json:"match,omitempty"`       // any (default) or all
+	// ForMinutes is how long the rule must hold, or stop holding, before the plug is switched
+	ForMinutes int `json:"for_minutes,omitempty"`
+	// SwitchOff switches the plug off once the rule stops holding. It's left on otherwise, so
+	// an appliance such as a dryer finishes its cycle.
+	SwitchOff bool `json:"switch_off,omitempty"`
+	Disabled  bool `json:"disabled,omitempty"`
+}
+
+// holds reports whether the rule's conditions hold for the signals
+func (r *GridRule) holds(signals GridSignals) bool {
+	var results []bool
+	if r.ExportAboveW != nil {
+		results = append(results, signals.ExportW != nil && *signals.ExportW > *r.ExportAboveW)
+	}
+	if r.SolarAboveW != nil {
+		results = append(results, signals.SolarW != nil && *signals.SolarW > *r.SolarAboveW)
+	}
+	if r.PriceBelow != nil {
+		results = append(results, signals.Price != nil && *signals.Price < *r.PriceBelow)
+	}
+
+	all := r.Match == GridMatchAll
+	for _, result := range results {
+		if result != all {
+			return result
+		}
+	}
+	return all
+}
+
+// GridConfig sets where solar production, grid power and electricity prices come from, and
+// the rules acting on them
+type GridConfig struct {
+	Solar       *GridSource    `json:"solar,omitempty"` // Production of the inverter
+	Grid        *GridSource    `json:"grid,omitempty"`  // Import positive, export negative
+	Prices      *prices.Config `json:"prices,omitempty"`
+	PollSeconds int            `json:"poll_seconds,omitempty"` // SunSpec devices, 10 by default
+	Rules       []GridRule     `json:"rules,omitempty"`
+}
+
+// LoadGridConfig reads the solar, grid and price sources and their rules from a JSON file
+func LoadGridConfig(path string) (*GridConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read grid file", err)
+	}
+
+	var cfg GridConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse grid file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the sources and rules, filling in the defaults
+func (c *GridConfig) Validate() error {
+	if c.Solar == nil && c.Grid == nil && c.Prices == nil {
+		return errors.NewValidationError("the grid file needs a solar, grid or prices source", nil)
+	}
+	if c.Solar != nil {
+		if err := c.Solar.validate("solar"); err != nil {
+			return err
+		}
+	}
+	if c.Grid != nil {
+		if err := c.Grid.validate("grid"); err != nil {
+			return err
+		}
+	}
+	if c.Prices != nil {
+		if _, err := prices.New(*c.Prices); err != nil {
+			return errors.NewValidationError("invalid prices", err)
+		}
+	}
+	if c.PollSeconds < 0 {
+		return errors.NewValidationError("poll_seconds must not be negative", nil)
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.ID == "" || seen[rule.ID] {
+			return errors.NewValidationError("every grid rule needs a unique id", nil)
+		}
+		seen[rule.ID] = true
+		if rule.DeviceID == "" {
+			return errors.NewValidationError(fmt.Sprintf("grid rule %s needs a device_id", rule.ID), nil)
+		}
+		if rule.ExportAboveW == nil && rule.SolarAboveW == nil && rule.PriceBelow == nil {
+			return errors.NewValidationError(fmt.Sprintf("grid rule %s needs export_above_w, solar_above_w or price_below", rule.ID), nil)
+		}
+		if (rule.ExportAboveW != nil && c.Grid == nil) || (rule.SolarAboveW != nil && c.Solar == nil) ||
+			(rule.PriceBelow != nil && c.Prices == nil) {
+			return errors.NewValidationError(fmt.Sprintf("grid rule %s uses a signal without a source", rule.ID), nil)
+		}
+		if rule.ForMinutes < 0 {
+			return errors.NewValidationError(fmt.Sprintf("grid rule %s: for_minutes must not be negative", rule.ID), nil)
+		}
+		switch rule.Match {
+		case "":
+			rule.Match = GridMatchAny
+		case GridMatchAny, GridMatchAll:
+		default:
+			return errors.NewValidationError(fmt.Sprintf("grid rule %s: match must be any or all", rule.ID), nil)
+		}
+	}
+	return nil
+}
+
+// GridSignals is the latest solar production, grid power and electricity price. Signals not
+// known, or older than 5 minutes, are left out.
+type GridSignals struct {
+	SolarW   *float64  `json:"solar_w,omitempty"`
+	GridW    *float64  `json:"grid_w,omitempty"`   // Import positive, export negative
+	ExportW  *float64  `json:"export_w,omitempty"` // Power sent to the grid, 0 while importing
+	Price    *float64  `json:"price,omitempty"`    // Per kWh
+	Currency string    `json:"currency,omitempty"`
+	PriceEnd time.Time `json:"price_end,omitempty"` // When the current price ends
+	Time     time.Time `json:"time"`
+}
+
+// GridRuleStatus is whether a rule holds and what it did about it
+type GridRuleStatus struct {
+	DeviceID string    `json:"device_id"`
+	Holds    bool      `json:"holds"`
+	Since    time.Time `json:"since,omitempty"`
+	On       bool      `json:"on"` // Switched on by the rule
+	Disabled bool      `json:"disabled,omitempty"`
+}
+
+// GridStatus reports the signals, the prices known and the rules
+type GridStatus struct {
+	Signals GridSignals               `json:"signals"`
+	Prices  *prices.Schedule          `json:"prices,omitempty"`
+	Rules   map[string]GridRuleStatus `json:"rules"`
+	// Failures are the sources failing to read, with the error
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// SunSpecReader reads a SunSpec device; sunspec.Client implements it
+type SunSpecReader interface {
+	Read(ctx context.Context) (sunspec.Reading, error)
+}
+
+// gridReading is the last power of a source
+type gridReading struct {
+	watts float64
+	at    time.Time
+}
+
+// gridRuleState follows whether a rule holds
+type gridRuleState struct {
+	holds bool
+	since time.Time
+	on    bool
+}
+
+// GridService turns solar production, grid import and export and dynamic electricity prices into
+// signals: published retained on home/energy/grid, exported as metrics and acted on by rules that
+// switch Tapo plugs, such as running the dryer while the panels export more than 1 kW.
+type GridService struct {
+	config     *GridConfig
+	devices    map[string]SunSpecReader // By address
+	prices     prices.Provider
+	schedule   *prices.Schedule
+	priceAt    time.Time // Last price fetch attempt
+	solar      *gridReading
+	grid       *gridReading
+	rules      map[string]*gridRuleState
+	failures   map[string]string // By source
+	switchPlug func(deviceID string, on bool) error
+	chargers   *ChargerService
+	mqttClient *mqtt.Client
+	logger     *logger.Logger
+	mu         sync.Mutex
+
+	solarPower prometheus.Gauge
+	gridPower  prometheus.Gauge
+	price      prometheus.Gauge
+}
+
+// NewGridService creates the grid signal service for a validated configuration
+func NewGridService(cfg *GridConfig, serviceLogger *logger.Logger) *GridService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("GridService", nil)
+	}
+
+	service := &GridService{
+		config:   cfg,
+		devices:  make(map[string]SunSpecReader),
+		rules:    make(map[string]*gridRuleState),
+		failures: make(map[string]string),
+		logger:   serviceLogger,
+		solarPower: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_solar_power_watts",
+			Help: "Power produced by the solar inverter",
+		}),
+		gridPower: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_grid_power_watts",
+			Help: "Power drawn from the grid, negative while exporting",
+		}),
+		price: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "electricity_price_per_kwh",
+			Help: "Current dynamic electricity price per kWh in the supplier's currency",
+		}),
+	}
+	for _, source := range []*GridSource{cfg.Solar, cfg.Grid} {
+		if source != nil && source.SunSpec != "" {
+			if _, exists := service.devices[source.SunSpec]; !exists {
+				client := sunspec.NewClient(source.SunSpec, byte(source.UnitID))
+				client.BaseAddress = uint16(source.BaseAddress)
+				service.devices[source.SunSpec] = client
+			}
+		}
+	}
+	if cfg.Prices != nil {
+		service.prices, _ = prices.New(*cfg.Prices)
+	}
+	for _, rule := range cfg.Rules {
+		service.rules[rule.ID] = &gridRuleState{}
+	}
+	return service
+}
+
+// RegisterMetrics registers the solar, grid and price metrics
+func (s *GridService) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.solarPower, s.gridPower, s.price} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register grid metrics", err)
+		}
+	}
+	return nil
+}
+
+// SetTapoService switches the rules' plugs; safe mode and dry runs apply as for any plug
+func (s *GridService) SetTapoService(tapo *TapoService) {
+	s.switchPlug = tapo.SetDeviceState
+}
+
+// SetChargerService lets rules name EV chargers, which charge while the rule switches them on
+func (s *GridService) SetChargerService(chargers *ChargerService) {
+	s.chargers = chargers
+}
+
+// SetMQTTClient publishes the signals on home/energy/grid
+func (s *GridService) SetMQTTClient(client *mqtt.Client) {
+	s.mqttClient = client
+}
+
+// Subscribe follows the solar and grid sources read over MQTT
+func (s *GridService) Subscribe(client *mqtt.Client) error {
+	for _, source := range []struct {
+		config  *GridSource
+		reading **gridReading
+	}{
+		{s.config.Solar, &s.solar},
+		{s.config.Grid, &s.grid},
+	} {
+		if source.config == nil || source.config.Topic == "" {
+			continue
+		}
+		config, reading := source.config, source.reading
+		err := client.Subscribe(config.Topic, func(topic string, payload []byte) error {
+			watts, err := parseMeterPower(payload)
+			if err != nil {
+				return err
+			}
+			s.record(reading, config, watts, time.Now())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleSolar records the solar production
+func (s *GridService) HandleSolar(watts float64, at time.Time) {
+	if s.config.Solar != nil {
+		s.record(&s.solar, s.config.Solar, watts, at)
+	}
+}
+
+// HandleGrid records the grid power, import positive
+func (s *GridService) HandleGrid(watts float64, at time.Time) {
+	if s.config.Grid != nil {
+		s.record(&s.grid, s.config.Grid, watts, at)
+	}
+}
+
+func (s *GridService) record(reading **gridReading, source *GridSource, watts float64, at time.Time) {
+	if source.Invert {
+		watts = -watts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*reading = &gridReading{watts: watts, at: at}
+}
+
+// Run polls the SunSpec devices and prices, and applies the rules, until the context is cancelled
+func (s *GridService) Run(ctx context.Context) {
+	poll := defaultGridPoll
+	if s.config.PollSeconds > 0 {
+		poll = time.Duration(s.config.PollSeconds) * time.Second
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		s.poll(ctx, poll, now)
+		s.refreshPrices(ctx, now)
+		if err := s.Evaluate(now); err != nil {
+			s.logger.Error("Failed to apply grid rules", err)
+		}
+		s.publish(s.Signals(now))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads every SunSpec device once
+func (s *GridService) poll(ctx context.Context, timeout time.Duration, now time.Time) {
+	addresses := make([]string, 0, len(s.devices))
+	for address := range s.devices {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		readCtx, cancel := context.WithTimeout(ctx, timeout)
+		reading, err := s.devices[address].Read(readCtx)
+		cancel()
+		s.result("sunspec "+address, err)
+		if err != nil {
+			continue
+		}
+
+		if solar := s.config.Solar; solar != nil && solar.SunSpec == address && reading.InverterW != nil {
+			s.record(&s.solar, solar, *reading.InverterW, now)
+		}
+		if grid := s.config.Grid; grid != nil && grid.SunSpec == address && reading.MeterW != nil {
+			s.record(&s.grid, grid, *reading.MeterW, now)
+		}
+	}
+}
+
+// refreshPrices fetches the prices every 30 minutes, and sooner once the current price is unknown
+func (s *GridService) refreshPrices(ctx context.Context, now time.Time) {
+	if s.prices == nil {
+		return
+	}
+	s.mu.Lock()
+	known := s.schedule != nil && now.Before(s.schedule.Until())
+	due := now.Sub(s.priceAt) >= gridPricePoll || (!known && now.Sub(s.priceAt) >= time.Minute)
+	if due {
+		s.priceAt = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+
+	schedule, err := s.prices.Fetch(ctx)
+	s.result("prices", err)
+	if err != nil {
+		return
+	}
+	s.SetPrices(schedule)
+}
+
+// SetPrices replaces the prices known
+func (s *GridService) SetPrices(schedule *prices.Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule = schedule
+}
+
+// result records whether a source was read, logging a failure once until it changes
+func (s *GridService) result(source string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		if _, failing := s.failures[source]; failing {
+			s.logger.Info("Grid source read again", map[string]interface{}{"source": source})
+			delete(s.failures, source)
+		}
+		return
+	}
+	if s.failures[source] != err.Error() {
+		s.logger.Error("Failed to read grid source", err, map[string]interface{}{"source": source})
+	}
+	s.failures[source] = err.Error()
+}
+
+// Signals returns the signals at now
+func (s *GridService) Signals(now time.Time) GridSignals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signals(now)
+}
+
+func (s *GridService) signals(now time.Time) GridSignals {
+	signals := GridSignals{Time: now}
+	fresh := func(reading *gridReading) *float64 {
+		if reading == nil || now.Sub(reading.at) > gridReadingMaxAge {
+			return nil
+		}
+		watts := reading.watts
+		return &watts
+	}
+	signals.SolarW, signals.GridW = fresh(s.solar), fresh(s.grid)
+	if signals.GridW != nil {
+		export := 0.0
+		if *signals.GridW < 0 {
+			export = -*signals.GridW
+		}
+		signals.ExportW = &export
+	}
+	if s.schedule != nil {
+		if price, ok := s.schedule.At(now); ok {
+			perKWh := price.PerKWh
+			signals.Price, signals.Currency, signals.PriceEnd = &perKWh, s.schedule.Currency, price.End
+		}
+	}
+	return signals
+}
+
+// Evaluate switches the plug of every rule that has held, or stopped holding, for its
+// ForMinutes. A failed switch is retried on the next call.
+func (s *GridService) Evaluate(now time.Time) error {
+	s.mu.Lock()
+	signals := s.signals(now)
+	s.updateMetrics(signals)
+
+	type change struct {
+		rule *GridRule
+		on   bool
+	}
+	var changes []change
+	for i := range s.config.Rules {
+		rule := &s.config.Rules[i]
+		state := s.rules[rule.ID]
+		if rule.Disabled {
+			continue
+		}
+		holds := rule.holds(signals)
+		if holds != state.holds || state.since.IsZero() {
+			state.holds, state.since = holds, now
+		}
+		if now.Sub(state.since) < time.Duration(rule.ForMinutes)*time.Minute {
+			continue
+		}
+		switch {
+		case holds && !state.on:
+			changes = append(changes, change{rule, true})
+		case !holds && state.on && rule.SwitchOff:
+			changes = append(changes, change{rule, false})
+		case !holds && state.on:
+			// Left on for the appliance to finish; the next time the rule holds switches it on again
+			state.on = false
+		}
+	}
+	s.mu.Unlock()
+
+	if len(changes) > 0 && s.switchPlug == nil && s.chargers == nil {
+		return errors.NewServiceError("grid rules have no Tapo service", nil)
+	}
+	var failed int
+	for _, change := range changes {
+		if err := switchLoad(s.chargers, s.switchPlug, change.rule.DeviceID, change.on); err != nil {
+			s.logger.Error("Failed to switch grid rule plug", err, map[string]interface{}{"rule": change.rule.ID, "device_id": change.rule.DeviceID})
+			failed++
+			continue
+		}
+		s.mu.Lock()
+		s.rules[change.rule.ID].on = change.on
+		s.mu.Unlock()
+		s.logger.Info("Switched grid rule plug", map[string]interface{}{
+			"rule":      change.rule.ID,
+			"device_id": change.rule.DeviceID,
+			"on":        change.on,
+			"signals":   signals,
+		})
+	}
+	if failed > 0 {
+		return errors.NewDeviceError(fmt.Sprintf("grid rules failed to switch %d of %d plugs", failed, len(changes)), nil)
+	}
+	return nil
+}
+
+// updateMetrics sets the gauges of the known signals; the caller holds the lock
+func (s *GridService) updateMetrics(signals GridSignals) {
+	if signals.SolarW != nil {
+		s.solarPower.Set(*signals.SolarW)
+	}
+	if signals.GridW != nil {
+		s.gridPower.Set(*signals.GridW)
+	}
+	if signals.Price != nil {
+		s.price.Set(*signals.Price)
+	}
+}
+
+// publish announces the signals as a retained message
+func (s *GridService) publish(signals GridSignals) {
+	if s.mqttClient == nil {
+		return
+	}
+	payload, err := json.Marshal(signals)
+	if err != nil {
+		return
+	}
+	if err := s.mqttClient.Publish(&mqtt.Message{Topic: mqtt.GridTopic, Payload: payload, Retain: true}); err != nil {
+		s.logger.Error("Failed to publish grid signals", err)
+	}
+}
+
+// Status returns the signals, prices and rules at now
+func (s *GridService) Status(now time.Time) GridStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := GridStatus{
+		Signals: s.signals(now),
+		Prices:  s.schedule,
+		Rules:   make(map[string]GridRuleStatus),
+	}
+	if len(s.failures) > 0 {
+		status.Failures = make(map[string]string)
+		for source, failure := range s.failures {
+			status.Failures[source] = failure
+		}
+	}
+	for _, rule := range s.config.Rules {
+		state := s.rules[rule.ID]
+		status.Rules[rule.ID] = GridRuleStatus{
+			DeviceID: rule.DeviceID,
+			Holds:    state.holds,
+			Since:    state.since,
+			On:       state.on,
+			Disabled: rule.Disabled,
+		}
+	}
+	return status
+}
+
+// Handler serves the grid status as JSON
+func (s *GridService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
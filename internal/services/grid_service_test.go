@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/prices"
+	"github.com/johnpr01/home-automation/pkg/sunspec"
+)
+
+type fakeSunSpec struct {
+	reading sunspec.Reading
+	err     error
+}
+
+func (f *fakeSunSpec) Read(ctx context.Context) (sunspec.Reading, error) {
+	return f.reading, f.err
+}
+
+func gridWatts(w float64) *float64 { return &w }
+
+func TestGridRules(t *testing.T) {
+	cfg := &GridConfig{
+		Solar:  &GridSource{SunSpec: "192.168.1.40:502"},
+		Grid:   &GridSource{Topic: "home/meter", Invert: true},
+		Prices: &prices.Config{Provider: prices.ProviderOctopus, Product: "AGILE", Tariff: "E-1R-AGILE-C"},
+		Rules: []GridRule{
+			{ID: "dryer", DeviceID: "dryer", ExportAboveW: gridWatts(1000), PriceBelow: gridWatts(0.10), ForMinutes: 2},
+			{ID: "heater", DeviceID: "heater", SolarAboveW: gridWatts(2000), ExportAboveW: gridWatts(500), Match: GridMatchAll, SwitchOff: true},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	service := NewGridService(cfg, nil)
+	inverter := &fakeSunSpec{reading: sunspec.Reading{InverterW: gridWatts(3000)}}
+	service.devices["192.168.1.40:502"] = inverter
+	plugs := make(map[string]bool)
+	service.switchPlug = func(deviceID string, on bool) error {
+		plugs[deviceID] = on
+		return nil
+	}
+
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	step := func(minutes int, meterW float64) {
+		service.poll(context.Background(), time.Second, at(minutes))
+		service.HandleGrid(meterW, at(minutes))
+		if err := service.Evaluate(at(minutes)); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	// The meter counts export as positive, so it's inverted
+	step(0, 1500)
+	signals := service.Signals(at(0))
+	if *signals.SolarW != 3000 || *signals.GridW != -1500 || *signals.ExportW != 1500 || signals.Price != nil {
+		t.Fatalf("Unexpected signals %+v", signals)
+	}
+	if !plugs["heater"] || plugs["dryer"] {
+		t.Fatalf("Expected only the heater on straight away, got %v", plugs)
+	}
+	step(2, 1500)
+	if !plugs["dryer"] {
+		t.Fatal("Expected the dryer on once export lasted 2 minutes")
+	}
+
+	// Importing switches the heater off, and leaves the dryer to finish
+	step(3, -200)
+	if plugs["heater"] {
+		t.Fatal("Expected the heater switched off once export stopped")
+	}
+	step(5, -200)
+	if !plugs["dryer"] {
+		t.Fatal("Expected the dryer left on")
+	}
+	if status := service.Status(at(5)); status.Rules["dryer"].On || status.Rules["dryer"].Holds {
+		t.Fatalf("Expected the dryer rule released, got %+v", status.Rules["dryer"])
+	}
+
+	// A cheap price holds the dryer rule on its own
+	plugs["dryer"] = false
+	service.SetPrices(&prices.Schedule{Currency: "GBP", Prices: []prices.Price{
+		{Start: at(0), End: at(30), PerKWh: 0.25},
+		{Start: at(30), End: at(60), PerKWh: 0.05},
+	}})
+	step(30, -200)
+	step(32, -200)
+	if !plugs["dryer"] {
+		t.Fatal("Expected the dryer on while electricity is cheap")
+	}
+	if signals := service.Signals(at(32)); *signals.Price != 0.05 || signals.Currency != "GBP" || !signals.PriceEnd.Equal(at(60)) {
+		t.Fatalf("Unexpected price signals %+v", signals)
+	}
+
+	// Readings stop counting once stale, and failing sources are reported
+	inverter.err = fmt.Errorf("connection refused")
+	service.poll(context.Background(), time.Second, at(40))
+	status := service.Status(at(40))
+	if status.Signals.SolarW != nil || status.Failures["sunspec 192.168.1.40:502"] == "" {
+		t.Fatalf("Expected the stale solar reading dropped and the failure reported, got %+v", status)
+	}
+	inverter.err = nil
+	service.poll(context.Background(), time.Second, at(41))
+	if status := service.Status(at(41)); len(status.Failures) != 0 || *status.Signals.SolarW != 3000 {
+		t.Fatalf("Expected the inverter read again, got %+v", status)
+	}
+}
+
+func TestGridConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   GridConfig
+		valid bool
+	}{
+		{"no sources", GridConfig{}, false},
+		{"both sunspec and topic", GridConfig{Solar: &GridSource{SunSpec: "inverter:502", Topic: "solar"}}, false},
+		{"unknown provider", GridConfig{Prices: &prices.Config{Provider: "acme"}}, false},
+		{"rule without conditions", GridConfig{Grid: &GridSource{Topic: "grid"}, Rules: []GridRule{{ID: "a", DeviceID: "plug"}}}, false},
+		{"rule without source", GridConfig{Grid: &GridSource{Topic: "grid"}, Rules: []GridRule{{ID: "a", DeviceID: "plug", SolarAboveW: gridWatts(1000)}}}, false},
+		{"bad match", GridConfig{Grid: &GridSource{Topic: "grid"}, Rules: []GridRule{{ID: "a", DeviceID: "plug", ExportAboveW: gridWatts(1000), Match: "most"}}}, false},
+		{"duplicate rules", GridConfig{Grid: &GridSource{Topic: "grid"}, Rules: []GridRule{
+			{ID: "a", DeviceID: "plug", ExportAboveW: gridWatts(1000)},
+			{ID: "a", DeviceID: "other", ExportAboveW: gridWatts(1000)},
+		}}, false},
+		{"valid", GridConfig{Solar: &GridSource{SunSpec: "inverter:502"}, Rules: []GridRule{{ID: "a", DeviceID: "plug", SolarAboveW: gridWatts(1000)}}}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.cfg.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	cfg := GridConfig{Solar: &GridSource{SunSpec: "inverter:502"}}
+	if err := cfg.Validate(); err != nil || cfg.Solar.UnitID != 1 || cfg.Solar.BaseAddress != sunspec.DefaultBaseAddress {
+		t.Fatalf("Expected the SunSpec defaults filled in, got %+v, %v", cfg.Solar, err)
+	}
+}
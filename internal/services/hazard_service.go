@@ -0,0 +1,384 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Hazards reported by leak and smoke detectors
+	HazardLeak  = "leak"
+	HazardSmoke = "smoke"
+
+	// Results of hazard responses
+	HazardActionSent   = "sent"
+	HazardActionFailed = "failed"
+
+	maxHazardHistory = 50
+)
+
+// HazardRule responds to a hazard in some or all rooms. Tapo plugs are switched off by the
+// Tapo metrics scraper, which owns them; the commands are sent by the unified service to its
+// MQTT devices.
+type HazardRule struct {
+	Hazard    string                 `json:"hazard"`               // leak or smoke
+	Rooms     []string               `json:"rooms,omitempty"`      // Empty matches every room
+	TapoPlugs []string               `json:"tapo_plugs,omitempty"` // Switched off, e.g. the washing machine or a space heater
+	Commands  []models.DeviceCommand `json:"commands,omitempty"`   // MQTT device commands, e.g. closing a water valve
+}
+
+// HazardConfig configures the responses to leak and smoke detectors
+type HazardConfig struct {
+	Rules         []HazardRule `json:"rules"`
+	RemindMinutes int          `json:"remind_minutes,omitempty"` // Repeat the alert while the hazard persists, 0 alerts once
+}
+
+// LoadHazardConfig reads the hazard responses from a JSON file
+func LoadHazardConfig(path string) (*HazardConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read hazard file", err)
+	}
+
+	var cfg HazardConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse hazard file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the hazards of the rules and that every command names a device and an action
+func (c *HazardConfig) Validate() error {
+	if c.RemindMinutes < 0 {
+		return errors.NewValidationError("remind_minutes must not be negative", nil)
+	}
+	for i, rule := range c.Rules {
+		if rule.Hazard != HazardLeak && rule.Hazard != HazardSmoke {
+			return errors.NewValidationError(fmt.Sprintf("hazard rule %d has unknown hazard %q", i+1, rule.Hazard), nil)
+		}
+		if len(rule.TapoPlugs) == 0 && len(rule.Commands) == 0 {
+			return errors.NewValidationError(fmt.Sprintf("hazard rule %d needs tapo_plugs or commands", i+1), nil)
+		}
+		for _, cmd := range rule.Commands {
+			if cmd.DeviceID == "" || cmd.Action == "" {
+				return errors.NewValidationError(fmt.Sprintf("hazard rule %d has a command without a device_id or an action", i+1), nil)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *HazardRule) matches(roomID, hazard string) bool {
+	if r.Hazard != hazard {
+		return false
+	}
+	if len(r.Rooms) == 0 {
+		return true
+	}
+	for _, room := range r.Rooms {
+		if room == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// HazardResponse is the outcome of one action taken on a hazard
+type HazardResponse struct {
+	DeviceID string `json:"device_id"`
+	Action   string `json:"action"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HazardEvent is a hazard detected in a room
+type HazardEvent struct {
+	RoomID     string           `json:"room_id"`
+	Hazard     string           `json:"hazard"`
+	DetectedAt time.Time        `json:"detected_at"`
+	ClearedAt  time.Time        `json:"cleared_at,omitempty"`
+	NotifiedAt time.Time        `json:"notified_at,omitempty"`
+	Responses  []HazardResponse `json:"responses,omitempty"`
+}
+
+// HazardStatus reports the active hazards and the most recent ones
+type HazardStatus struct {
+	Active  []HazardEvent `json:"active"`
+	History []HazardEvent `json:"history"`
+}
+
+// HazardService raises a critical alert the moment a leak or smoke detector triggers and runs
+// the configured responses, e.g. switching off the washing machine on a leak. Devices are not
+// switched back on when the hazard clears; that is left to someone who checked the room.
+type HazardService struct {
+	config     *HazardConfig
+	remind     time.Duration
+	devices    CommandExecutor
+	switchPlug func(deviceID string, on bool) error
+	publish    func(msg *mqtt.Message) error
+	active     map[string]*HazardEvent // By room and hazard
+	history    []HazardEvent
+	logger     *logger.Logger
+	mu         sync.Mutex
+}
+
+// NewHazardService creates the hazard responder; a nil config only alerts
+func NewHazardService(cfg *HazardConfig, serviceLogger *logger.Logger) *HazardService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("HazardService", nil)
+	}
+	if cfg == nil {
+		cfg = &HazardConfig{}
+	}
+
+	return &HazardService{
+		config: cfg,
+		remind: time.Duration(cfg.RemindMinutes) * time.Minute,
+		active: make(map[string]*HazardEvent),
+		logger: serviceLogger,
+	}
+}
+
+// SetCommandExecutor sends the MQTT device commands of the rules
+func (s *HazardService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetTapoService switches off the Tapo plugs of the rules
+func (s *HazardService) SetTapoService(tapo *TapoService) {
+	s.switchPlug = tapo.SetDeviceState
+}
+
+// SetMQTTClient publishes the alerts on the notification topic
+func (s *HazardService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// HandleHazard records a detector turning on or off; it fits UnifiedSensorService.AddHazardCallback
+func (s *HazardService) HandleHazard(roomID, hazard string, detected bool) {
+	s.handle(roomID, hazard, detected, time.Now())
+}
+
+func (s *HazardService) handle(roomID, hazard string, detected bool, now time.Time) {
+	key := roomID + "/" + hazard
+
+	s.mu.Lock()
+	event, active := s.active[key]
+	if detected == active {
+		s.mu.Unlock()
+		return
+	}
+	if !detected {
+		delete(s.active, key)
+		event.ClearedAt = now
+		s.recordLocked(*event)
+		cleared := *event
+		s.mu.Unlock()
+
+		s.logger.Info("Hazard cleared", map[string]interface{}{"room_id": roomID, "hazard": hazard})
+		s.notify(cleared, now)
+		return
+	}
+	event = &HazardEvent{RoomID: roomID, Hazard: hazard, DetectedAt: now}
+	s.active[key] = event
+	s.mu.Unlock()
+
+	s.logger.Warn("Hazard detected", map[string]interface{}{"room_id": roomID, "hazard": hazard})
+
+	// Alert before acting: a slow or failing device must not hold the alert back
+	s.notify(*event, now)
+	responses := s.respond(roomID, hazard)
+
+	s.mu.Lock()
+	event.NotifiedAt = now
+	event.Responses = responses
+	s.mu.Unlock()
+}
+
+// respond runs the actions of every rule matching the hazard
+func (s *HazardService) respond(roomID, hazard string) []HazardResponse {
+	var responses []HazardResponse
+	for _, rule := range s.config.Rules {
+		if !rule.matches(roomID, hazard) {
+			continue
+		}
+		if s.switchPlug != nil {
+			for _, deviceID := range rule.TapoPlugs {
+				response := HazardResponse{DeviceID: deviceID, Action: "turn_off"}
+				responses = append(responses, s.logResponse(response, roomID, hazard, s.switchPlug(deviceID, false)))
+			}
+		}
+		if s.devices != nil {
+			for _, cmd := range rule.Commands {
+				cmd.Options = map[string]interface{}{"automation": "hazard"}
+				response := HazardResponse{DeviceID: cmd.DeviceID, Action: cmd.Action}
+				responses = append(responses, s.logResponse(response, roomID, hazard, s.devices.ExecuteCommand(&cmd)))
+			}
+		}
+	}
+	return responses
+}
+
+// logResponse records the result of a response action
+func (s *HazardService) logResponse(response HazardResponse, roomID, hazard string, err error) HazardResponse {
+	fields := map[string]interface{}{"room_id": roomID, "hazard": hazard, "device_id": response.DeviceID, "action": response.Action}
+	if err != nil {
+		s.logger.Error("Hazard response failed", err, fields)
+		response.Result, response.Error = HazardActionFailed, err.Error()
+		return response
+	}
+	s.logger.Info("Hazard response sent", fields)
+	response.Result = HazardActionSent
+	return response
+}
+
+// recordLocked keeps an event in the bounded history; callers must hold the lock
+func (s *HazardService) recordLocked(event HazardEvent) {
+	s.history = append(s.history, event)
+	if len(s.history) > maxHazardHistory {
+		s.history = s.history[len(s.history)-maxHazardHistory:]
+	}
+}
+
+// Run repeats the alerts of persisting hazards until the context is cancelled
+func (s *HazardService) Run(ctx context.Context) {
+	if s.remind <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.remindActive(now)
+		}
+	}
+}
+
+// remindActive notifies again of the hazards not alerted of within the reminder interval
+func (s *HazardService) remindActive(now time.Time) {
+	s.mu.Lock()
+	var due []HazardEvent
+	for _, event := range s.active {
+		if !event.NotifiedAt.IsZero() && now.Sub(event.NotifiedAt) >= s.remind {
+			event.NotifiedAt = now
+			due = append(due, *event)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, event := range due {
+		s.notify(event, now)
+	}
+}
+
+// notify publishes a critical alert for a detected hazard, or an info notification once it cleared
+func (s *HazardService) notify(event HazardEvent, now time.Time) {
+	if s.publish == nil {
+		return
+	}
+
+	name, detector := i18n.T("hazard."+event.Hazard), i18n.T("hazard.detector."+event.Hazard)
+	title := i18n.T("hazard.detected.title", name, event.RoomID)
+	message := i18n.T("hazard.detected", detector, event.RoomID, event.DetectedAt.Format("15:04"))
+	severity, state := AlertSeverityCritical, AlertStateFiring
+	if !event.ClearedAt.IsZero() {
+		title = i18n.T("hazard.cleared.title", name, event.RoomID)
+		message = i18n.T("hazard.cleared", detector, event.RoomID, event.ClearedAt.Sub(event.DetectedAt).Round(time.Second))
+		severity, state = AlertSeverityInfo, AlertStateResolved
+	}
+
+	notification, err := localizedNotification(map[string]interface{}{
+		"source":    "hazard",
+		"severity":  severity,
+		"state":     state,
+		"hazard":    event.Hazard,
+		"room_id":   event.RoomID,
+		"timestamp": now.Unix(),
+	}, title, message)
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1}); err != nil {
+		s.logger.Error("Failed to publish hazard notification", err, map[string]interface{}{"room_id": event.RoomID, "hazard": event.Hazard})
+	}
+}
+
+// Subscribe follows the leak and smoke detectors over MQTT, for processes without a sensor service
+func (s *HazardService) Subscribe(client *mqtt.Client) error {
+	for _, hazard := range []string{HazardLeak, HazardSmoke} {
+		hazard := hazard
+		root := mqtt.TopicRoomLeak
+		if hazard == HazardSmoke {
+			root = mqtt.TopicRoomSmoke
+		}
+		err := client.Subscribe(mqtt.RoomTopic(root, "+"), func(topic string, payload []byte) error {
+			var message UnifiedSensorMessage
+			if err := json.Unmarshal(payload, &message); err != nil {
+				return err
+			}
+			reading := message.Leak
+			if hazard == HazardSmoke {
+				reading = message.Smoke
+			}
+			if reading == nil {
+				return fmt.Errorf("%s message on %s carries no %s state", hazard, topic, hazard)
+			}
+			s.HandleHazard(topic[strings.LastIndex(topic, "/")+1:], hazard, *reading)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status returns the active hazards and the most recent ones, newest first
+func (s *HazardService) Status() HazardStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := HazardStatus{Active: make([]HazardEvent, 0, len(s.active)), History: make([]HazardEvent, 0, len(s.history))}
+	for _, event := range s.active {
+		status.Active = append(status.Active, *event)
+	}
+	sort.Slice(status.Active, func(i, j int) bool { return status.Active[i].DetectedAt.After(status.Active[j].DetectedAt) })
+	for i := len(s.history) - 1; i >= 0; i-- {
+		status.History = append(status.History, s.history[i])
+	}
+	return status
+}
+
+// Handler serves the hazard status as JSON
+func (s *HazardService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
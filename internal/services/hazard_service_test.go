@@ -0,0 +1,98 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestHazardServiceAlertsAndResponds(t *testing.T) {
+	cfg := &HazardConfig{
+		RemindMinutes: 10,
+		Rules: []HazardRule{
+			{Hazard: HazardLeak, Rooms: []string{"utility"}, TapoPlugs: []string{"washing-machine"},
+				Commands: []models.DeviceCommand{{DeviceID: "water-valve", Action: "turn_off"}}},
+			{Hazard: HazardSmoke, TapoPlugs: []string{"space-heater"}},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %v", err)
+	}
+
+	service := NewHazardService(cfg, nil)
+	var switched []string
+	service.switchPlug = func(deviceID string, on bool) error {
+		if on {
+			t.Errorf("Expected %s switched off", deviceID)
+		}
+		switched = append(switched, deviceID)
+		return nil
+	}
+	executor := &recordingExecutor{}
+	service.SetCommandExecutor(executor)
+	var notifications []map[string]interface{}
+	service.publish = func(msg *mqtt.Message) error {
+		var notification map[string]interface{}
+		json.Unmarshal(msg.Payload, &notification)
+		notifications = append(notifications, notification)
+		return nil
+	}
+
+	start := time.Date(2025, 3, 1, 14, 0, 0, 0, time.UTC)
+	service.handle("utility", HazardLeak, true, start)
+	service.handle("utility", HazardLeak, true, start.Add(time.Second)) // Detector heartbeat
+
+	if len(notifications) != 1 || notifications[0]["severity"] != AlertSeverityCritical {
+		t.Fatalf("Expected one critical alert, got %v", notifications)
+	}
+	if len(switched) != 1 || switched[0] != "washing-machine" {
+		t.Errorf("Expected the washing machine switched off, got %v", switched)
+	}
+	if commands := executor.take(); len(commands) != 1 || commands[0] != "turn_off water-valve" {
+		t.Errorf("Expected the water valve closed, got %v", commands)
+	}
+
+	// A leak elsewhere alerts without a response
+	service.handle("kitchen", HazardLeak, true, start)
+	if len(switched) != 1 || len(notifications) != 2 {
+		t.Errorf("Expected only an alert for the kitchen, got %v and %d notifications", switched, len(notifications))
+	}
+
+	service.remindActive(start.Add(5 * time.Minute))
+	if len(notifications) != 2 {
+		t.Errorf("Expected no reminder before the interval, got %d notifications", len(notifications))
+	}
+	service.remindActive(start.Add(10 * time.Minute))
+	if len(notifications) != 4 {
+		t.Errorf("Expected reminders for both leaks, got %d notifications", len(notifications))
+	}
+
+	service.handle("utility", HazardLeak, false, start.Add(15*time.Minute))
+	if last := notifications[len(notifications)-1]; last["state"] != AlertStateResolved {
+		t.Errorf("Expected a resolved notification, got %v", last)
+	}
+	status := service.Status()
+	if len(status.Active) != 1 || status.Active[0].RoomID != "kitchen" {
+		t.Errorf("Expected only the kitchen leak active, got %+v", status.Active)
+	}
+	if len(status.History) != 1 || len(status.History[0].Responses) != 2 {
+		t.Errorf("Expected the utility leak and its responses in the history, got %+v", status.History)
+	}
+}
+
+func TestHazardConfigValidation(t *testing.T) {
+	invalid := []HazardConfig{
+		{Rules: []HazardRule{{Hazard: "flood", TapoPlugs: []string{"pump"}}}},
+		{Rules: []HazardRule{{Hazard: HazardLeak}}},
+		{Rules: []HazardRule{{Hazard: HazardSmoke, Commands: []models.DeviceCommand{{DeviceID: "hvac"}}}}},
+		{RemindMinutes: -1},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected configuration %d to be rejected", i+1)
+		}
+	}
+}
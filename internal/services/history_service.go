@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/influxdb"
+)
+
+const (
+	// HistoryPath serves downsampled history, followed by the metric, e.g.
+	// /api/history/temperature?room=bedroom&from=24h&resolution=5m
+	HistoryPath = "/api/history/"
+
+	defaultHistoryRange = 24 * time.Hour
+	targetHistoryPoints = 300  // An automatic resolution gives about this many points
+	maxHistoryPoints    = 5000 // A chosen resolution may give at most this many
+	historyQueryTimeout = 15 * time.Second
+)
+
+// historyResolutions are the steps an automatic resolution is picked from
+var historyResolutions = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// validHistoryID is the charset of the room and device IDs a series is selected by
+var validHistoryID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*$`)
+
+// historyMetric is where a metric is stored in InfluxDB
+type historyMetric struct {
+	measurement string
+	field       string
+	unit        string
+	sumRooms    bool // A room's series is the sum of its devices', not their mean
+}
+
+var historyMetrics = map[string]historyMetric{
+	"temperature": {measurement: influxdb.MeasurementEnvironment, field: "temperature_f", unit: "°F"},
+	"humidity":    {measurement: influxdb.MeasurementEnvironment, field: "humidity", unit: "%"},
+	"power":       {measurement: influxdb.MeasurementEnergy, field: "power_w", unit: "W", sumRooms: true},
+}
+
+// HistoryQuerier reads downsampled series, as the InfluxDB client does
+type HistoryQuerier interface {
+	QuerySeries(ctx context.Context, q influxdb.SeriesQuery) ([]influxdb.SeriesPoint, error)
+}
+
+// HistoryRequest selects the series of a metric for a room or a device. A zero resolution is
+// picked to suit the range, and a blank aggregate is the mean.
+type HistoryRequest struct {
+	Metric     string
+	Room       string
+	Device     string
+	From       time.Time
+	To         time.Time
+	Resolution time.Duration
+	Aggregate  string
+}
+
+// HistoryPoint is a downsampled value, timed at the start of its window
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// HistorySeries is a downsampled series; windows without readings are left out
+type HistorySeries struct {
+	Metric            string         `json:"metric"`
+	Unit              string         `json:"unit"`
+	Room              string         `json:"room,omitempty"`
+	Device            string         `json:"device,omitempty"`
+	From              time.Time      `json:"from"`
+	To                time.Time      `json:"to"`
+	Resolution        string         `json:"resolution"`
+	ResolutionSeconds int64          `json:"resolution_seconds"`
+	Aggregate         string         `json:"aggregate"`
+	Points            []HistoryPoint `json:"points"`
+}
+
+// HistoryService serves the history of room and device readings from the time series
+// database, downsampled so dashboards can chart any range without querying it themselves
+type HistoryService struct {
+	querier HistoryQuerier
+	logger  *logger.Logger
+}
+
+// NewHistoryService creates a history service reading from querier
+func NewHistoryService(querier HistoryQuerier, serviceLogger *logger.Logger) *HistoryService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("HistoryService", nil)
+	}
+	return &HistoryService{querier: querier, logger: serviceLogger}
+}
+
+// Series queries a downsampled series
+func (s *HistoryService) Series(ctx context.Context, request HistoryRequest) (*HistorySeries, error) {
+	metric, ok := historyMetrics[request.Metric]
+	if !ok {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown metric %q, use %s", request.Metric, strings.Join(sortedKeys(historyMetrics), ", ")), nil)
+	}
+	if (request.Room == "") == (request.Device == "") {
+		return nil, errors.NewValidationError("select either a room or a device", nil)
+	}
+	if id := request.Room + request.Device; !validHistoryID.MatchString(id) {
+		return nil, errors.NewValidationError(fmt.Sprintf("%q is not a room or device ID", id), nil)
+	}
+	if !request.From.Before(request.To) {
+		return nil, errors.NewValidationError("from must be before to", nil)
+	}
+	if request.Aggregate == "" {
+		request.Aggregate = influxdb.AggregateMean
+	}
+	if request.Aggregate != influxdb.AggregateMean && request.Aggregate != influxdb.AggregateMin && request.Aggregate != influxdb.AggregateMax {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown aggregate %q, use mean, min or max", request.Aggregate), nil)
+	}
+
+	span := request.To.Sub(request.From)
+	if request.Resolution == 0 {
+		request.Resolution = autoResolution(span)
+	}
+	if request.Resolution < time.Second || request.Resolution%time.Second != 0 {
+		return nil, errors.NewValidationError("resolution must be a whole number of seconds", nil)
+	}
+	if span/request.Resolution > maxHistoryPoints {
+		return nil, errors.NewValidationError(fmt.Sprintf("resolution %s is too fine for the range, which may have at most %d points",
+			formatResolution(request.Resolution), maxHistoryPoints), nil)
+	}
+
+	q := influxdb.SeriesQuery{
+		Measurement: metric.measurement,
+		Field:       metric.field,
+		TagKey:      "device_id",
+		TagValue:    request.Device,
+		Start:       request.From,
+		Stop:        request.To,
+		Every:       request.Resolution,
+		Aggregate:   request.Aggregate,
+	}
+	if request.Room != "" {
+		q.TagKey, q.TagValue, q.SumSeries = "room_id", request.Room, metric.sumRooms
+	}
+	points, err := s.querier.QuerySeries(ctx, q)
+	if err != nil {
+		s.logger.Error("Failed to query history", err, map[string]interface{}{
+			"metric": request.Metric,
+			"room":   request.Room,
+			"device": request.Device,
+		})
+		return nil, err
+	}
+
+	series := &HistorySeries{
+		Metric:            request.Metric,
+		Unit:              metric.unit,
+		Room:              request.Room,
+		Device:            request.Device,
+		From:              request.From,
+		To:                request.To,
+		Resolution:        formatResolution(request.Resolution),
+		ResolutionSeconds: int64(request.Resolution / time.Second),
+		Aggregate:         request.Aggregate,
+		Points:            make([]HistoryPoint, 0, len(points)),
+	}
+	for _, point := range points {
+		series.Points = append(series.Points, HistoryPoint{Time: point.Time, Value: point.Value})
+	}
+	return series, nil
+}
+
+// Handler serves the series of the metric named after HistoryPath. ?room= or ?device= selects
+// the series; ?from= and ?to= are RFC 3339 times or how long ago, e.g. 6h or 7d, and default to
+// the last day; ?resolution= is a duration such as 5m, picked to suit the range when left out;
+// and ?agg= is mean, min or max.
+func (s *HistoryService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET to read history", http.StatusMethodNotAllowed)
+			return
+		}
+
+		now := time.Now()
+		query := r.URL.Query()
+		request := HistoryRequest{
+			Metric:    strings.TrimPrefix(r.URL.Path, HistoryPath),
+			Room:      query.Get("room"),
+			Device:    query.Get("device"),
+			To:        now,
+			Aggregate: query.Get("agg"),
+		}
+		var err error
+		if value := query.Get("to"); value != "" {
+			if request.To, err = parseHistoryTime(value, now); err != nil {
+				http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		request.From = request.To.Add(-defaultHistoryRange)
+		if value := query.Get("from"); value != "" {
+			if request.From, err = parseHistoryTime(value, now); err != nil {
+				http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := query.Get("resolution"); value != "" && value != "auto" {
+			if request.Resolution, err = parseHistoryDuration(value); err != nil || request.Resolution <= 0 {
+				http.Error(w, "resolution must be a duration such as 30s, 5m, 1h or 1d", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), historyQueryTimeout)
+		defer cancel()
+		series, err := s.Series(ctx, request)
+		if err != nil {
+			code := http.StatusBadGateway
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+	})
+}
+
+// autoResolution picks the finest step that keeps a range to about targetHistoryPoints
+func autoResolution(span time.Duration) time.Duration {
+	for _, step := range historyResolutions {
+		if span/step <= targetHistoryPoints {
+			return step
+		}
+	}
+	return historyResolutions[len(historyResolutions)-1]
+}
+
+// parseHistoryTime reads an RFC 3339 time, "now", or a duration meaning that long before now,
+// with or without a leading minus, e.g. 24h or -7d
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	ago, err := parseHistoryDuration(strings.TrimPrefix(value, "-"))
+	if err != nil || ago < 0 {
+		return time.Time{}, errors.NewValidationError(fmt.Sprintf("%q is neither an RFC 3339 time nor a duration such as 24h or 7d", value), nil)
+	}
+	return now.Add(-ago), nil
+}
+
+// parseHistoryDuration parses a Go duration, or a whole number of days such as 7d
+func parseHistoryDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// formatResolution writes a resolution briefly, e.g. 5m rather than 5m0s, or 1d
+func formatResolution(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/influxdb"
+)
+
+type fakeHistoryQuerier struct {
+	queries []influxdb.SeriesQuery
+	points  []influxdb.SeriesPoint
+	err     error
+}
+
+func (f *fakeHistoryQuerier) QuerySeries(ctx context.Context, q influxdb.SeriesQuery) ([]influxdb.SeriesPoint, error) {
+	f.queries = append(f.queries, q)
+	return f.points, f.err
+}
+
+func TestHistoryService(t *testing.T) {
+	start := time.Date(2026, 7, 14, 22, 0, 0, 0, time.UTC)
+	querier := &fakeHistoryQuerier{points: []influxdb.SeriesPoint{
+		{Time: start, Value: 71.5},
+		{Time: start.Add(5 * time.Minute), Value: 72},
+	}}
+	service := NewHistoryService(querier, nil)
+	get := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		service.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder
+	}
+
+	recorder := get("/api/history/temperature?room=bedroom&from=2026-07-14T22:00:00Z&to=2026-07-14T23:00:00Z&resolution=5m")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var series HistorySeries
+	if err := json.Unmarshal(recorder.Body.Bytes(), &series); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if series.Unit != "°F" || series.Resolution != "5m" || series.Aggregate != "mean" || len(series.Points) != 2 || series.Points[1].Value != 72 {
+		t.Fatalf("Unexpected series %+v", series)
+	}
+	q := querier.queries[0]
+	if q.Measurement != influxdb.MeasurementEnvironment || q.Field != "temperature_f" || q.TagKey != "room_id" || q.TagValue != "bedroom" ||
+		q.Every != 5*time.Minute || !q.Stop.Equal(start.Add(time.Hour)) || q.SumSeries {
+		t.Fatalf("Unexpected query %+v", q)
+	}
+
+	// A room's power adds up its devices; a device's doesn't. Ranges default to the last day.
+	if recorder := get("/api/history/power?room=kitchen&agg=max"); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if q := querier.queries[1]; !q.SumSeries || q.Aggregate != "max" || q.Stop.Sub(q.Start) != 24*time.Hour || q.Every != 5*time.Minute {
+		t.Fatalf("Unexpected room power query %+v", q)
+	}
+	if recorder := get("/api/history/power?device=heater-plug&from=-7d&resolution=1d"); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if q := querier.queries[2]; q.SumSeries || q.TagKey != "device_id" || q.Stop.Sub(q.Start) != 7*24*time.Hour || q.Every != 24*time.Hour {
+		t.Fatalf("Unexpected device power query %+v", q)
+	}
+
+	for target, code := range map[string]int{
+		"/api/history/pressure?room=bedroom":                                    http.StatusBadRequest,
+		"/api/history/temperature":                                              http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&device=sensor-1":                 http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&from=yesterday":                  http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&from=1h&to=2h":                   http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&resolution=1s":                   http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&resolution=fast":                 http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&agg=sum":                         http.StatusBadRequest,
+		"/api/history/temperature?room=%22%29%20or%20true%20or%20%28%22":        http.StatusBadRequest,
+		"/api/history/power?device=%24%7Br._value%7D":                           http.StatusBadRequest,
+		"/api/history/temperature?room=bedroom&from=30d&to=now&resolution=auto": http.StatusOK,
+	} {
+		if recorder := get(target); recorder.Code != code {
+			t.Errorf("%s: expected %d, got %d: %s", target, code, recorder.Code, recorder.Body)
+		}
+	}
+
+	querier.err = errors.NewConnectionError("InfluxDB is down", nil)
+	if recorder := get("/api/history/humidity?room=bedroom"); recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 when the query fails, got %d", recorder.Code)
+	}
+}
+
+func TestAutoResolution(t *testing.T) {
+	for span, want := range map[time.Duration]time.Duration{
+		time.Hour:            time.Minute,
+		24 * time.Hour:       5 * time.Minute,
+		7 * 24 * time.Hour:   time.Hour,
+		365 * 24 * time.Hour: 24 * time.Hour,
+	} {
+		if got := autoResolution(span); got != want {
+			t.Errorf("%s: expected %s, got %s", span, want, got)
+		}
+	}
+	for d, want := range map[time.Duration]string{30 * time.Second: "30s", 5 * time.Minute: "5m", 3 * time.Hour: "3h", 90 * time.Minute: "1h30m", 48 * time.Hour: "2d"} {
+		if got := formatResolution(d); got != want {
+			t.Errorf("%s: expected %s, got %s", d, want, got)
+		}
+	}
+}
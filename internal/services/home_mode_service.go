@@ -0,0 +1,561 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Modes of the home, which automations and thermostats key on
+	HomeModeHome     = "home"
+	HomeModeAway     = "away"
+	HomeModeNight    = "night"
+	HomeModeVacation = "vacation"
+
+	// HomeModeAuto returns the home to its automatic mode through the API
+	HomeModeAuto = "auto"
+
+	// HomeModeFileName keeps the manual mode across restarts
+	HomeModeFileName = "home-mode.json"
+
+	vacationDateLayout       = "2006-01-02"
+	homeModeCheck            = time.Minute
+	defaultSimulationStart   = "18:00"
+	defaultSimulationEnd     = "23:00"
+	defaultSimulationMinutes = 20
+	defaultSimulationMax     = 90
+)
+
+// HomeModePath returns the home mode file path for a state directory
+func HomeModePath(stateDir string) string {
+	return filepath.Join(stateDir, HomeModeFileName)
+}
+
+// Vacation is a stay away from home, from the start of one day to the end of another
+type Vacation struct {
+	Name  string `json:"name,omitempty"`
+	From  string `json:"from"`  // YYYY-MM-DD
+	Until string `json:"until"` // YYYY-MM-DD, inclusive
+}
+
+func (v Vacation) contains(t time.Time) bool {
+	from, _ := time.ParseInLocation(vacationDateLayout, v.From, t.Location())
+	until, _ := time.ParseInLocation(vacationDateLayout, v.Until, t.Location())
+	return !t.Before(from) && t.Before(until.AddDate(0, 0, 1))
+}
+
+// NightWindow is when an occupied home is in night mode, e.g. 22:30 until 06:30
+type NightWindow struct {
+	Start string `json:"start"` // HH:MM
+	End   string `json:"end"`   // HH:MM, the next morning when before Start
+}
+
+// LightSimulation switches lights on and off at random in the evenings of a vacation, so the
+// home looks lived in. Each light stays on or off for a random MinMinutes to MaxMinutes.
+type LightSimulation struct {
+	DeviceIDs  []string `json:"device_ids"`
+	Start      string   `json:"start,omitempty"` // HH:MM, default 18:00
+	End        string   `json:"end,omitempty"`   // HH:MM, default 23:00; every simulated light is off after
+	MinMinutes int      `json:"min_minutes,omitempty"`
+	MaxMinutes int      `json:"max_minutes,omitempty"`
+}
+
+// HomeModeConfig configures the automatic modes: vacation on the vacation dates, away while
+// nobody is home, night in the night window, home otherwise
+type HomeModeConfig struct {
+	Vacations       []Vacation       `json:"vacations,omitempty"`
+	Night           *NightWindow     `json:"night,omitempty"`
+	VacationSetback *AwaySetback     `json:"vacation_setback,omitempty"` // Default the away setback
+	LightSimulation *LightSimulation `json:"light_simulation,omitempty"`
+}
+
+// LoadHomeModeConfig reads the home modes from a JSON file
+func LoadHomeModeConfig(path string) (*HomeModeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read home mode file", err)
+	}
+
+	var cfg HomeModeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse home mode file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the dates, times and lights of the configuration
+func (c *HomeModeConfig) Validate() error {
+	for _, vacation := range c.Vacations {
+		from, err := time.Parse(vacationDateLayout, vacation.From)
+		if err != nil {
+			return errors.NewValidationError(fmt.Sprintf("vacation %s has an invalid from %q, use YYYY-MM-DD", vacation.Name, vacation.From), err)
+		}
+		until, err := time.Parse(vacationDateLayout, vacation.Until)
+		if err != nil {
+			return errors.NewValidationError(fmt.Sprintf("vacation %s has an invalid until %q, use YYYY-MM-DD", vacation.Name, vacation.Until), err)
+		}
+		if until.Before(from) {
+			return errors.NewValidationError(fmt.Sprintf("vacation %s ends before it starts", vacation.Name), nil)
+		}
+	}
+	if c.Night != nil {
+		if err := validateClocks(c.Night.Start, c.Night.End); err != nil {
+			return err
+		}
+	}
+	if sim := c.LightSimulation; sim != nil {
+		if len(sim.DeviceIDs) == 0 {
+			return errors.NewValidationError("light_simulation needs device_ids", nil)
+		}
+		if err := validateClocks(sim.Start, sim.End); err != nil {
+			return err
+		}
+		if sim.MinMinutes < 0 || sim.MaxMinutes < 0 || (sim.MaxMinutes > 0 && sim.MaxMinutes < sim.MinMinutes) {
+			return errors.NewValidationError("light_simulation needs 0 <= min_minutes <= max_minutes", nil)
+		}
+	}
+	return nil
+}
+
+func validateClocks(clocks ...string) error {
+	for _, clock := range clocks {
+		if clock == "" {
+			continue
+		}
+		if _, err := time.Parse("15:04", clock); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("invalid time %q, use HH:MM", clock), err)
+		}
+	}
+	return nil
+}
+
+// inClockWindow reports whether now is between two HH:MM times, the end wrapping past midnight
+// when it is before the start
+func inClockWindow(now time.Time, start, end string) bool {
+	startClock, _ := time.Parse("15:04", start)
+	endClock, _ := time.Parse("15:04", end)
+	minute := now.Hour()*60 + now.Minute()
+	from := startClock.Hour()*60 + startClock.Minute()
+	to := endClock.Hour()*60 + endClock.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// ManualHomeMode is a mode set through the API
+type ManualHomeMode struct {
+	Mode  string    `json:"mode"`
+	SetAt time.Time `json:"set_at"`
+	Until time.Time `json:"until,omitempty"` // Zero lasts until the home is set back to auto
+}
+
+// HomeModeStatus is the mode of the home and why
+type HomeModeStatus struct {
+	Mode      string          `json:"mode"`
+	Source    string          `json:"source"` // manual, vacation, presence, night or default
+	Since     time.Time       `json:"since,omitempty"`
+	Manual    *ManualHomeMode `json:"manual,omitempty"`
+	Occupied  bool            `json:"occupied"`
+	Vacation  string          `json:"vacation,omitempty"`
+	Simulated []string        `json:"simulated_lights,omitempty"` // Lights the simulation has on
+}
+
+// HomeModeService keeps the mode of the home — home, away, night or vacation — publishes it
+// retained on home/mode and calls back on changes. While on vacation it simulates occupancy with
+// lights switched at random in the evenings.
+type HomeModeService struct {
+	config    *HomeModeConfig
+	path      string
+	manual    *ManualHomeMode
+	occupied  bool
+	mode      string
+	source    string
+	since     time.Time
+	simulated map[string]bool      // Lights the simulation switched on
+	nextFlip  map[string]time.Time // When the simulation next switches each light
+	random    *rand.Rand
+	devices   CommandExecutor
+	publish   func(msg *mqtt.Message) error
+	callbacks []func(mode string)
+	logger    *logger.Logger
+	mu        sync.Mutex
+}
+
+// NewHomeModeService creates the service, restoring a manual mode from path. The home counts as
+// occupied until told otherwise.
+func NewHomeModeService(cfg *HomeModeConfig, path string, serviceLogger *logger.Logger) *HomeModeService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("HomeMode", nil)
+	}
+	if cfg == nil {
+		cfg = &HomeModeConfig{}
+	}
+
+	service := &HomeModeService{
+		config:    cfg,
+		path:      path,
+		occupied:  true,
+		simulated: make(map[string]bool),
+		nextFlip:  make(map[string]time.Time),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger:    serviceLogger,
+	}
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load the manual home mode, following the automatic mode", err)
+		}
+	}
+	return service
+}
+
+// SetCommandExecutor sets the device service that switches the simulated lights
+func (s *HomeModeService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetMQTTClient publishes the mode as a retained message
+func (s *HomeModeService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// AddModeCallback registers a callback for mode changes
+func (s *HomeModeService) AddModeCallback(callback func(mode string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// SetOccupied records whether anyone is home, e.g. from resident presence
+func (s *HomeModeService) SetOccupied(occupied bool) {
+	s.mu.Lock()
+	s.occupied = occupied
+	s.mu.Unlock()
+	s.Update(time.Now())
+}
+
+// Mode returns the current mode of the home
+func (s *HomeModeService) Mode() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mode == "" {
+		return HomeModeHome
+	}
+	return s.mode
+}
+
+// VacationSetback returns the setback for vacations, falling back to the given away setback
+func (s *HomeModeService) VacationSetback(away *AwaySetback) *AwaySetback {
+	if s.config.VacationSetback != nil {
+		return s.config.VacationSetback
+	}
+	return away
+}
+
+// vacation returns the vacation on the day of now
+func (s *HomeModeService) vacation(now time.Time) (Vacation, bool) {
+	for _, vacation := range s.config.Vacations {
+		if vacation.contains(now) {
+			return vacation, true
+		}
+	}
+	return Vacation{}, false
+}
+
+// resolveLocked works out the mode and its source; callers must hold the lock
+func (s *HomeModeService) resolveLocked(now time.Time) (string, string) {
+	if s.manual != nil {
+		if s.manual.Until.IsZero() || now.Before(s.manual.Until) {
+			return s.manual.Mode, "manual"
+		}
+		s.manual = nil
+		if err := s.saveLocked(); err != nil {
+			s.logger.Error("Failed to save home mode", err)
+		}
+	}
+	if _, ok := s.vacation(now); ok {
+		return HomeModeVacation, "vacation"
+	}
+	if !s.occupied {
+		return HomeModeAway, "presence"
+	}
+	if s.config.Night != nil && inClockWindow(now, s.config.Night.Start, s.config.Night.End) {
+		return HomeModeNight, "night"
+	}
+	return HomeModeHome, "default"
+}
+
+// Update works out the mode, publishing and calling back when it changed, and runs the light simulation
+func (s *HomeModeService) Update(now time.Time) {
+	s.mu.Lock()
+	mode, source := s.resolveLocked(now)
+	changed := mode != s.mode
+	if changed {
+		s.logger.Info("Home mode changed", map[string]interface{}{"from": s.mode, "to": mode, "source": source})
+		s.mode, s.since = mode, now
+	}
+	s.source = source
+	callbacks := append([]func(string){}, s.callbacks...)
+	s.mu.Unlock()
+
+	if changed {
+		s.publishMode(now)
+		for _, callback := range callbacks {
+			callback(mode)
+		}
+	}
+	s.simulate(now)
+}
+
+// Set puts the home in a mode until it is set back to auto, or for a duration when positive
+func (s *HomeModeService) Set(mode string, duration time.Duration, now time.Time) (HomeModeStatus, error) {
+	s.mu.Lock()
+	switch mode {
+	case HomeModeAuto:
+		s.manual = nil
+	case HomeModeHome, HomeModeAway, HomeModeNight, HomeModeVacation:
+		s.manual = &ManualHomeMode{Mode: mode, SetAt: now}
+		if duration > 0 {
+			s.manual.Until = now.Add(duration)
+		}
+	default:
+		s.mu.Unlock()
+		return HomeModeStatus{}, errors.NewValidationError(fmt.Sprintf("unknown mode %q, use home, away, night, vacation or auto", mode), nil)
+	}
+	err := s.saveLocked()
+	s.mu.Unlock()
+
+	s.Update(now)
+	return s.Status(now), err
+}
+
+// simulate switches the vacation lights: during the simulation window each light flips after a
+// random time, and outside it, or when the vacation ends, the lights it switched on go off
+func (s *HomeModeService) simulate(now time.Time) {
+	sim := s.config.LightSimulation
+	if sim == nil {
+		return
+	}
+	start, end := sim.Start, sim.End
+	if start == "" {
+		start = defaultSimulationStart
+	}
+	if end == "" {
+		end = defaultSimulationEnd
+	}
+	minMinutes, maxMinutes := sim.MinMinutes, sim.MaxMinutes
+	if minMinutes == 0 {
+		minMinutes = defaultSimulationMinutes
+	}
+	if maxMinutes == 0 {
+		maxMinutes = max(defaultSimulationMax, minMinutes)
+	}
+
+	s.mu.Lock()
+	active := s.mode == HomeModeVacation && inClockWindow(now, start, end)
+	switches := make(map[string]bool)
+	for _, deviceID := range sim.DeviceIDs {
+		if !active {
+			if s.simulated[deviceID] {
+				switches[deviceID] = false
+			}
+			delete(s.nextFlip, deviceID)
+			continue
+		}
+		next, scheduled := s.nextFlip[deviceID]
+		if !scheduled {
+			// Stagger the first switch of each light within the first hour
+			s.nextFlip[deviceID] = now.Add(time.Duration(s.random.Intn(60)) * time.Minute)
+			continue
+		}
+		if now.Before(next) {
+			continue
+		}
+		switches[deviceID] = !s.simulated[deviceID]
+		minutes := minMinutes + s.random.Intn(maxMinutes-minMinutes+1)
+		s.nextFlip[deviceID] = now.Add(time.Duration(minutes) * time.Minute)
+	}
+	s.mu.Unlock()
+
+	for _, deviceID := range sortedKeys(switches) {
+		on := switches[deviceID]
+		action := "turn_off"
+		if on {
+			action = "turn_on"
+		}
+		if s.devices == nil {
+			s.logger.Warn("No device service to switch simulated light", map[string]interface{}{"device_id": deviceID})
+			continue
+		}
+		err := s.devices.ExecuteCommand(&models.DeviceCommand{DeviceID: deviceID, Action: action,
+			Options: map[string]interface{}{"automation": "vacation-simulation"}})
+		if err != nil {
+			s.logger.Error("Failed to switch simulated light", err, map[string]interface{}{"device_id": deviceID})
+			continue
+		}
+		s.mu.Lock()
+		if on {
+			s.simulated[deviceID] = true
+		} else {
+			delete(s.simulated, deviceID)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *HomeModeService) publishMode(now time.Time) {
+	if s.publish == nil {
+		return
+	}
+	status := s.Status(now)
+	payload, err := json.Marshal(map[string]interface{}{"mode": status.Mode, "source": status.Source, "since": status.Since})
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: mqtt.HomeModeTopic, Payload: payload, QoS: 1, Retain: true}); err != nil {
+		s.logger.Error("Failed to publish home mode", err)
+	}
+}
+
+// Run updates the mode and the light simulation every minute until the context is cancelled
+func (s *HomeModeService) Run(ctx context.Context) {
+	ticker := time.NewTicker(homeModeCheck)
+	defer ticker.Stop()
+
+	s.Update(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Update(now)
+		}
+	}
+}
+
+// Status returns the mode of the home and why
+func (s *HomeModeService) Status(now time.Time) HomeModeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := HomeModeStatus{Mode: s.mode, Source: s.source, Since: s.since, Occupied: s.occupied}
+	if status.Mode == "" {
+		status.Mode, status.Source = s.resolveLocked(now)
+	}
+	if s.manual != nil {
+		manual := *s.manual
+		status.Manual = &manual
+	}
+	if vacation, ok := s.vacation(now); ok {
+		status.Vacation = vacation.Name
+		if status.Vacation == "" {
+			status.Vacation = vacation.From + " to " + vacation.Until
+		}
+	}
+	for deviceID := range s.simulated {
+		status.Simulated = append(status.Simulated, deviceID)
+	}
+	sort.Strings(status.Simulated)
+	return status
+}
+
+// Handler serves the mode of the home as JSON
+func (s *HomeModeService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
+
+// SetHandler sets the mode on a POST of ?mode=, with ?hours= for a mode that ends by itself;
+// ?mode=auto returns the home to its automatic mode
+func (s *HomeModeService) SetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to set the home mode", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		var duration time.Duration
+		if hours := query.Get("hours"); hours != "" {
+			parsed, err := strconv.ParseFloat(hours, 64)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+				return
+			}
+			duration = time.Duration(parsed * float64(time.Hour))
+		}
+
+		status, err := s.Set(query.Get("mode"), duration, time.Now())
+		if err != nil {
+			code := http.StatusInternalServerError
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+func (s *HomeModeService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read home mode", err)
+	}
+	if err := json.Unmarshal(data, &s.manual); err != nil {
+		return errors.NewSystemError("failed to parse home mode", err)
+	}
+	return nil
+}
+
+// saveLocked atomically writes the manual mode; callers must hold the lock
+func (s *HomeModeService) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.manual, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal home mode", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write home mode", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace home mode", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestHomeModes(t *testing.T) {
+	cfg := &HomeModeConfig{
+		Vacations: []Vacation{{Name: "summer", From: "2024-07-01", Until: "2024-07-14"}},
+		Night:     &NightWindow{Start: "22:30", End: "06:30"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), HomeModeFileName)
+	service := NewHomeModeService(cfg, path, nil)
+	var modes []string
+	service.AddModeCallback(func(mode string) { modes = append(modes, mode) })
+	var published []string
+	service.publish = func(msg *mqtt.Message) error {
+		var state map[string]interface{}
+		json.Unmarshal(msg.Payload, &state)
+		if msg.Topic != mqtt.HomeModeTopic || !msg.Retain {
+			t.Errorf("Expected the retained mode on %s, got %s", mqtt.HomeModeTopic, msg.Topic)
+		}
+		published = append(published, state["mode"].(string))
+		return nil
+	}
+
+	june := time.Date(2024, 6, 20, 12, 0, 0, 0, time.Local)
+	service.Update(june)
+	service.Update(june.Add(11 * time.Hour)) // 23:00
+	service.occupied = false
+	service.Update(june.Add(12 * time.Hour))
+	service.occupied = true
+	service.Update(time.Date(2024, 7, 14, 20, 0, 0, 0, time.Local))
+	service.Update(time.Date(2024, 7, 15, 12, 0, 0, 0, time.Local))
+	want := []string{HomeModeHome, HomeModeNight, HomeModeAway, HomeModeVacation, HomeModeHome}
+	if len(modes) != len(want) || len(published) != len(want) {
+		t.Fatalf("Expected modes %v, got %v", want, modes)
+	}
+	for i := range want {
+		if modes[i] != want[i] {
+			t.Fatalf("Expected modes %v, got %v", want, modes)
+		}
+	}
+
+	// A manual mode outlasts the automatic changes and a restart until set back to auto
+	recorder := httptest.NewRecorder()
+	service.SetHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/mode/set?mode=vacation", nil))
+	if recorder.Code != 200 || service.Mode() != HomeModeVacation {
+		t.Fatalf("Expected the vacation mode set, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	restored := NewHomeModeService(cfg, path, nil)
+	restored.Update(time.Date(2024, 8, 1, 23, 0, 0, 0, time.Local))
+	if restored.Mode() != HomeModeVacation || restored.Status(time.Now()).Source != "manual" {
+		t.Errorf("Expected the manual vacation restored, got %+v", restored.Status(time.Now()))
+	}
+	if _, err := restored.Set(HomeModeAuto, 0, time.Date(2024, 8, 1, 23, 0, 0, 0, time.Local)); err != nil || restored.Mode() != HomeModeNight {
+		t.Errorf("Expected auto to return to the night mode, got %s, %v", restored.Mode(), err)
+	}
+	if _, err := restored.Set("party", 0, time.Now()); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+
+	// A timed mode ends by itself
+	noon := time.Date(2024, 8, 2, 12, 0, 0, 0, time.Local)
+	restored.Set(HomeModeAway, 2*time.Hour, noon)
+	restored.Update(noon.Add(3 * time.Hour))
+	if restored.Mode() != HomeModeHome {
+		t.Errorf("Expected the timed away mode to end, got %s", restored.Mode())
+	}
+}
+
+func TestVacationSetbackAndLightSimulation(t *testing.T) {
+	testLogger := logger.NewLogger("mode-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "hall", RoomID: "hall", Mode: models.ModeHeat, TargetTemp: 70})
+	schedules := NewScheduleService(thermostats, NewPresenceService("", nil), "", testLogger)
+	target := func() float64 {
+		thermostat, _ := thermostats.GetThermostat("hall")
+		return thermostat.TargetTemp
+	}
+
+	cfg := &HomeModeConfig{
+		Vacations:       []Vacation{{From: "2024-07-01", Until: "2024-07-14"}},
+		VacationSetback: &AwaySetback{HeatTemp: 55},
+		LightSimulation: &LightSimulation{DeviceIDs: []string{"lamp-living", "lamp-bedroom"}, MinMinutes: 30, MaxMinutes: 30},
+	}
+	service := NewHomeModeService(cfg, "", testLogger)
+	service.random = rand.New(rand.NewSource(1))
+	lights := &recordingExecutor{}
+	service.SetCommandExecutor(lights)
+	away := &AwaySetback{HeatTemp: 62}
+	service.AddModeCallback(func(mode string) {
+		switch mode {
+		case HomeModeAway:
+			schedules.SetAway(true, *away, time.Now())
+		case HomeModeVacation:
+			schedules.SetAway(true, *service.VacationSetback(away), time.Now())
+		default:
+			schedules.SetAway(false, *away, time.Now())
+		}
+	})
+
+	// Leaving holds the away setback, and the vacation moves the hold deeper
+	service.occupied = false
+	service.Update(time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local))
+	if target() != 62 {
+		t.Fatalf("Expected the away setback, got %v", target())
+	}
+	evening := time.Date(2024, 7, 1, 18, 0, 0, 0, time.Local)
+	service.Update(evening)
+	if target() != 55 || service.Mode() != HomeModeVacation {
+		t.Fatalf("Expected the vacation setback, got %v in %s", target(), service.Mode())
+	}
+
+	// Every light is switched at least once in the evening, and the lights left on go off at 23:00
+	switched := make(map[string]bool)
+	for minute := 1; minute < 5*60; minute++ {
+		service.Update(evening.Add(time.Duration(minute) * time.Minute))
+		for _, command := range lights.take() {
+			switched[command] = true
+		}
+	}
+	if !switched["turn_on lamp-living"] || !switched["turn_on lamp-bedroom"] || !switched["turn_off lamp-living"] {
+		t.Errorf("Expected the lamps switched through the evening, got %v", switched)
+	}
+	service.Update(evening.Add(5*time.Hour + time.Minute))
+	if status := service.Status(evening); len(status.Simulated) != 0 {
+		t.Errorf("Expected every simulated light off after the window, got %v", status.Simulated)
+	}
+
+	// Back home, the hold ends and the target from before leaving returns
+	service.occupied = true
+	service.Update(time.Date(2024, 7, 15, 12, 0, 0, 0, time.Local))
+	if target() != 70 {
+		t.Errorf("Expected the target restored after the vacation, got %v", target())
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// humidityMaxAge is how long a humidity reading counts; without a fresh one devices stop
+	humidityMaxAge = 30 * time.Minute
+
+	// maxRunHumidityRest is the shortest rest after a run hits its maximum, e.g. to empty a tank
+	maxRunHumidityRest = 30 * time.Minute
+)
+
+// HumidityDevice is a dehumidifier or humidifier on a Tapo plug. Runs last at least
+// MinRunMinutes, and at most MaxRunMinutes, after which the device rests, as with a full tank.
+// Between runs it rests at least MinRestMinutes.
+type HumidityDevice struct {
+	DeviceID       string `json:"device_id"`
+	Kind           string `json:"kind"` // dehumidifier or humidifier
+	MinRunMinutes  int    `json:"min_run_minutes,omitempty"`
+	MinRestMinutes int    `json:"min_rest_minutes,omitempty"`
+	MaxRunMinutes  int    `json:"max_run_minutes,omitempty"` // 0 runs until the setpoint is met
+}
+
+// HumidityControl is the humidity setpoint of a room and the devices keeping it
+type HumidityControl struct {
+	Setpoint models.HumiditySetpoint `json:"setpoint"`
+	Devices  []HumidityDevice        `json:"devices,omitempty"`
+}
+
+// LoadHumidityControl reads the humidity setpoint and devices of each room, keyed by room ID,
+// which is also the ID of the room's thermostat
+func LoadHumidityControl(path string) (map[string]HumidityControl, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read humidity control file", err)
+	}
+
+	var controls map[string]HumidityControl
+	if err := json.Unmarshal(data, &controls); err != nil {
+		return nil, errors.NewConfigError("failed to parse humidity control file", err)
+	}
+
+	seen := make(map[string]bool)
+	for roomID, control := range controls {
+		if err := control.Setpoint.Validate(); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("room %s", roomID), err)
+		}
+		for _, device := range control.Devices {
+			if device.DeviceID == "" || seen[device.DeviceID] {
+				return nil, errors.NewValidationError(fmt.Sprintf("room %s: every humidity device needs a unique device_id", roomID), nil)
+			}
+			seen[device.DeviceID] = true
+			if device.Kind != models.Dehumidifier && device.Kind != models.Humidifier {
+				return nil, errors.NewValidationError(fmt.Sprintf("humidity device %s: kind must be dehumidifier or humidifier", device.DeviceID), nil)
+			}
+			if device.MinRunMinutes < 0 || device.MinRestMinutes < 0 || device.MaxRunMinutes < 0 {
+				return nil, errors.NewValidationError(fmt.Sprintf("humidity device %s: run and rest times must not be negative", device.DeviceID), nil)
+			}
+			if device.MaxRunMinutes > 0 && device.MaxRunMinutes < device.MinRunMinutes {
+				return nil, errors.NewValidationError(fmt.Sprintf("humidity device %s: max_run_minutes is below min_run_minutes", device.DeviceID), nil)
+			}
+		}
+	}
+	return controls, nil
+}
+
+// SetHumiditySetpoint sets the humidity range of a thermostat's room. It applies to a
+// thermostat created later for the same room too.
+func (ts *ThermostatService) SetHumiditySetpoint(id string, setpoint models.HumiditySetpoint) error {
+	if err := setpoint.Validate(); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid humidity setpoint for thermostat %s", id), err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.humidity[id] = &setpoint
+	if thermostat, exists := ts.thermostats[id]; exists {
+		thermostat.Humidity = &setpoint
+	}
+
+	ts.logger.Info("Set humidity setpoint", map[string]interface{}{
+		"thermostat_id": id,
+		"low":           setpoint.Low,
+		"high":          setpoint.High,
+	})
+	return nil
+}
+
+// humidityReading is the last humidity of a room
+type humidityReading struct {
+	humidity float64
+	at       time.Time
+}
+
+// humidityRun is the state of a device: whether it runs, since when, and whether its last run
+// was cut short by the maximum run time
+type humidityRun struct {
+	on      bool
+	known   bool
+	changed time.Time
+	capped  bool
+}
+
+// HumidityDeviceStatus is what the controller wants of a device, and why
+type HumidityDeviceStatus struct {
+	Kind   string    `json:"kind"`
+	RoomID string    `json:"room_id"`
+	On     bool      `json:"on"`
+	Reason string    `json:"reason"` // humidity, setpoint, no_reading, min_run, resting or max_run
+	Since  time.Time `json:"since,omitempty"`
+}
+
+// HumidityRoomStatus is the humidity of a room against its setpoint
+type HumidityRoomStatus struct {
+	Humidity *float64                `json:"humidity,omitempty"`
+	Updated  time.Time               `json:"updated,omitempty"`
+	Setpoint models.HumiditySetpoint `json:"setpoint"`
+}
+
+// HumidityStatus reports every room and device of the controller
+type HumidityStatus struct {
+	Rooms   map[string]HumidityRoomStatus   `json:"rooms"`
+	Devices map[string]HumidityDeviceStatus `json:"devices"`
+}
+
+// HumidityControlService switches dehumidifiers and humidifiers on Tapo plugs to keep each room
+// within its humidity setpoint. Like the thermostat's compressor protection, devices run and rest
+// for minimum times, and a run is cut off at its maximum so a full tank doesn't run all day.
+type HumidityControlService struct {
+	controls   map[string]HumidityControl
+	switchPlug func(deviceID string, on bool) error
+	readings   map[string]humidityReading // Per room
+	runs       map[string]*humidityRun    // Per device
+	logger     *logger.Logger
+	mu         sync.Mutex
+}
+
+// NewHumidityControlService creates a humidity controller for the rooms of controls
+func NewHumidityControlService(controls map[string]HumidityControl, serviceLogger *logger.Logger) *HumidityControlService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("HumidityControlService", nil)
+	}
+
+	return &HumidityControlService{
+		controls: controls,
+		readings: make(map[string]humidityReading),
+		runs:     make(map[string]*humidityRun),
+		logger:   serviceLogger,
+	}
+}
+
+// SetTapoService switches the devices' plugs; safe mode and dry runs apply as for any plug
+func (s *HumidityControlService) SetTapoService(tapo *TapoService) {
+	s.switchPlug = tapo.SetDeviceState
+}
+
+// HandleHumidity records the humidity of a room
+func (s *HumidityControlService) HandleHumidity(roomID string, humidity float64, at time.Time) {
+	if _, exists := s.controls[roomID]; !exists {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings[roomID] = humidityReading{humidity: humidity, at: at}
+}
+
+// Subscribe follows the humidity sensors of the controlled rooms, which only MQTT carries here
+func (s *HumidityControlService) Subscribe(client *mqtt.Client) error {
+	for roomID := range s.controls {
+		roomID := roomID
+		err := client.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomHumidity, roomID), func(topic string, payload []byte) error {
+			var message UnifiedSensorMessage
+			if err := json.Unmarshal(payload, &message); err != nil {
+				return err
+			}
+			s.HandleHumidity(roomID, message.Humidity, time.Now())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run switches the devices every minute until the context is cancelled
+func (s *HumidityControlService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	s.apply(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.apply(now)
+		}
+	}
+}
+
+func (s *HumidityControlService) apply(now time.Time) {
+	if err := s.Apply(now); err != nil {
+		s.logger.Error("Failed to switch humidity devices", err)
+	}
+}
+
+// Apply switches every device whose wanted state changed, continuing past failures. A failed
+// device is retried on the next call.
+func (s *HumidityControlService) Apply(now time.Time) error {
+	if s.switchPlug == nil {
+		return errors.NewServiceError("humidity control has no Tapo service", nil)
+	}
+	status := s.Status(now)
+
+	var changed []string
+	s.mu.Lock()
+	for id, device := range status.Devices {
+		if run := s.runs[id]; run == nil || !run.known || run.on != device.On {
+			changed = append(changed, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(changed)
+
+	var failed []string
+	for _, id := range changed {
+		device := status.Devices[id]
+		if err := s.switchPlug(id, device.On); err != nil {
+			s.logger.Error("Failed to switch humidity device", err, map[string]interface{}{
+				"device_id": id,
+				"on":        device.On,
+			})
+			failed = append(failed, id)
+			continue
+		}
+
+		s.mu.Lock()
+		run := s.runs[id]
+		if run == nil {
+			run = &humidityRun{}
+			s.runs[id] = run
+		}
+		run.on, run.known, run.changed, run.capped = device.On, true, now, device.Reason == "max_run"
+		s.mu.Unlock()
+
+		s.logger.Info("Switched humidity device", map[string]interface{}{
+			"device_id": id,
+			"kind":      device.Kind,
+			"room_id":   device.RoomID,
+			"on":        device.On,
+			"reason":    device.Reason,
+		})
+	}
+
+	if len(failed) > 0 {
+		return errors.NewDeviceError(fmt.Sprintf("humidity control failed on %d of %d devices: %s",
+			len(failed), len(changed), strings.Join(failed, ", ")), nil)
+	}
+	return nil
+}
+
+// Status returns the humidity of every room and the wanted state of every device at now
+func (s *HumidityControlService) Status(now time.Time) HumidityStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := HumidityStatus{
+		Rooms:   make(map[string]HumidityRoomStatus),
+		Devices: make(map[string]HumidityDeviceStatus),
+	}
+	for roomID, control := range s.controls {
+		room := HumidityRoomStatus{Setpoint: control.Setpoint}
+		reading, hasReading := s.readings[roomID]
+		if hasReading {
+			humidity := reading.humidity
+			room.Humidity, room.Updated = &humidity, reading.at
+		}
+		status.Rooms[roomID] = room
+
+		fresh := hasReading && now.Sub(reading.at) <= humidityMaxAge
+		for _, device := range control.Devices {
+			status.Devices[device.DeviceID] = s.want(roomID, control.Setpoint, device, reading.humidity, fresh, now)
+		}
+	}
+	return status
+}
+
+// want decides whether a device runs: the setpoint calls for it, bounded by its run and rest times
+func (s *HumidityControlService) want(roomID string, setpoint models.HumiditySetpoint, device HumidityDevice,
+	humidity float64, fresh bool, now time.Time) HumidityDeviceStatus {
+	run := s.runs[device.DeviceID]
+	if run == nil {
+		run = &humidityRun{}
+	}
+	status := HumidityDeviceStatus{Kind: device.Kind, RoomID: roomID, Since: run.changed}
+	elapsed := now.Sub(run.changed)
+
+	demand := fresh && setpoint.Wants(device.Kind, humidity, run.on)
+	rest := time.Duration(device.MinRestMinutes) * time.Minute
+	if run.capped && rest < maxRunHumidityRest {
+		rest = maxRunHumidityRest
+	}
+
+	switch {
+	case run.on && device.MaxRunMinutes > 0 && elapsed >= time.Duration(device.MaxRunMinutes)*time.Minute:
+		status.On, status.Reason = false, "max_run"
+	case run.on && !demand && elapsed < time.Duration(device.MinRunMinutes)*time.Minute:
+		status.On, status.Reason = true, "min_run"
+	case !run.on && demand && elapsed < rest:
+		status.On, status.Reason = false, "resting"
+	case demand:
+		status.On, status.Reason = true, "humidity"
+	case !fresh:
+		status.On, status.Reason = false, "no_reading"
+	default:
+		status.On, status.Reason = false, "setpoint"
+	}
+	return status
+}
+
+// Handler serves the humidity status as JSON
+func (s *HumidityControlService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestHumidityControl(t *testing.T) {
+	service := NewHumidityControlService(map[string]HumidityControl{
+		"basement": {
+			Setpoint: models.HumiditySetpoint{High: 55},
+			Devices: []HumidityDevice{
+				{DeviceID: "dehumidifier", Kind: models.Dehumidifier, MinRunMinutes: 15, MinRestMinutes: 10, MaxRunMinutes: 120},
+			},
+		},
+	}, nil)
+	plugs := make(map[string]bool)
+	service.switchPlug = func(deviceID string, on bool) error {
+		plugs[deviceID] = on
+		return nil
+	}
+
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	steps := []struct {
+		name     string
+		minutes  int
+		humidity float64
+		on       bool
+		reason   string
+	}{
+		{"dry", 0, 50, false, "setpoint"},
+		{"damp", 20, 60, true, "humidity"},
+		{"dried quickly", 25, 45, true, "min_run"},
+		{"ran long enough", 40, 45, false, "setpoint"},
+		{"damp while resting", 45, 60, false, "resting"},
+		{"rested", 50, 60, true, "humidity"},
+		{"within the hysteresis", 100, 52, true, "humidity"},
+		{"max run", 170, 58, false, "max_run"},
+		{"resting after max run", 190, 58, false, "resting"},
+		{"rested after max run", 200, 58, true, "humidity"},
+	}
+	for _, step := range steps {
+		service.HandleHumidity("basement", step.humidity, at(step.minutes))
+		device := service.Status(at(step.minutes)).Devices["dehumidifier"]
+		if device.Reason != step.reason {
+			t.Errorf("%s: expected reason %s, got %s", step.name, step.reason, device.Reason)
+		}
+		if err := service.Apply(at(step.minutes)); err != nil {
+			t.Fatalf("%s: Apply failed: %v", step.name, err)
+		}
+		if plugs["dehumidifier"] != step.on {
+			t.Errorf("%s: expected the dehumidifier on %v, got %v", step.name, step.on, plugs["dehumidifier"])
+		}
+	}
+
+	// Without a fresh reading the dehumidifier stops
+	if device := service.Status(at(300)).Devices["dehumidifier"]; device.On || device.Reason != "no_reading" {
+		t.Errorf("Expected a stale reading to stop the dehumidifier, got %+v", device)
+	}
+}
+
+func TestLoadHumidityControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "humidity.json")
+	os.WriteFile(path, []byte(`{"nursery": {"setpoint": {"low": 40}, "devices": [{"device_id": "mist", "kind": "humidifier"}]}}`), 0644)
+	controls, err := LoadHumidityControl(path)
+	if err != nil || controls["nursery"].Setpoint.Low != 40 {
+		t.Fatalf("Expected the nursery's humidity control, got %+v (%v)", controls, err)
+	}
+
+	os.WriteFile(path, []byte(`{"nursery": {"setpoint": {"low": 40}, "devices": [{"device_id": "mist", "kind": "fan"}]}}`), 0644)
+	if _, err := LoadHumidityControl(path); err == nil {
+		t.Error("Expected an unknown kind to be rejected")
+	}
+}
+
+func TestThermostatHumiditySetpoint(t *testing.T) {
+	service := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), logger.NewLogger("humidity-test", nil))
+	if err := service.SetHumiditySetpoint("basement", models.HumiditySetpoint{High: 55}); err != nil {
+		t.Fatalf("SetHumiditySetpoint failed: %v", err)
+	}
+	service.RegisterThermostat(&models.Thermostat{ID: "basement", RoomID: "basement", Mode: models.ModeHeat, TargetTemp: 68})
+
+	thermostat, err := service.GetThermostat("basement")
+	if err != nil || thermostat.Humidity == nil || thermostat.Humidity.High != 55 {
+		t.Errorf("Expected the thermostat registered later to get the setpoint, got %+v", thermostat)
+	}
+}
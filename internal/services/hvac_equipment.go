@@ -0,0 +1,58 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// LoadHVACEquipment reads the HVAC equipment of each thermostat, keyed by thermostat ID
+func LoadHVACEquipment(path string) (map[string]models.HVACEquipment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read HVAC equipment file", err)
+	}
+
+	var equipment map[string]models.HVACEquipment
+	if err := json.Unmarshal(data, &equipment); err != nil {
+		return nil, errors.NewConfigError("failed to parse HVAC equipment file", err)
+	}
+
+	for id, entry := range equipment {
+		if err := entry.Validate(); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("thermostat %s", id), err)
+		}
+	}
+	return equipment, nil
+}
+
+// SetEquipment describes the stages, heat pump and compressor protection of a thermostat's
+// HVAC system. It applies to a thermostat created later for the same room too.
+func (ts *ThermostatService) SetEquipment(id string, equipment models.HVACEquipment) error {
+	if err := equipment.Validate(); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid HVAC equipment for thermostat %s", id), err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.equipment[id] = &equipment
+	if thermostat, exists := ts.thermostats[id]; exists {
+		thermostat.Equipment = &equipment
+		if thermostat.Mode == models.ModeEmergencyHeat && !thermostat.IsValidMode(models.ModeEmergencyHeat) {
+			thermostat.Mode = models.ModeHeat
+		}
+	}
+
+	ts.logger.Info("Set HVAC equipment", map[string]interface{}{
+		"thermostat_id": id,
+		"heat_stages":   equipment.HeatStages,
+		"cool_stages":   equipment.CoolStages,
+		"heat_pump":     equipment.HeatPump,
+		"aux_heat":      equipment.AuxHeat,
+	})
+	return nil
+}
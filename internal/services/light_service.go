@@ -1,12 +1,14 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
@@ -46,6 +48,12 @@ type LightService struct {
 	// Configuration thresholds
 	darkThreshold   float64 // Below this is considered "dark"
 	brightThreshold float64 // Above this is considered "bright"
+
+	// Resource limits
+	maxRooms      int
+	rejectedRooms int
+
+	background lifecycle.Background // Runs the offline and day/night checks between Start and Stop
 }
 
 // NewLightService creates a new light sensor service
@@ -62,13 +70,17 @@ func NewLightService(mqttClient *mqtt.Client, logger *logger.Logger) *LightServi
 	// Subscribe to light sensor topics
 	service.subscribeLightTopics()
 
-	// Start cleanup routine for stale data
-	go service.cleanupRoutine()
+	return service
+}
 
-	// Start day/night cycle detection
-	go service.dayNightDetection()
+// Start starts marking stale sensors offline and detecting the day/night cycle, until Stop
+func (ls *LightService) Start(ctx context.Context) error {
+	return ls.background.Start(ctx, ls.cleanupRoutine, ls.dayNightDetection)
+}
 
-	return service
+// Stop stops the background checks and waits for them to return
+func (ls *LightService) Stop(ctx context.Context) error {
+	return ls.background.Stop(ctx)
 }
 
 // SetThresholds allows customization of light level thresholds
@@ -79,6 +91,13 @@ func (ls *LightService) SetThresholds(darkThreshold, brightThreshold float64) {
 	ls.brightThreshold = brightThreshold
 }
 
+// SetMaxRooms limits the number of rooms tracked; readings for further rooms are rejected (0 = unlimited)
+func (ls *LightService) SetMaxRooms(limit int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.maxRooms = limit
+}
+
 // AddLightCallback registers a callback for light level changes
 func (ls *LightService) AddLightCallback(callback func(roomID string, lightState string, lightLevel float64)) {
 	ls.mu.Lock()
@@ -117,7 +136,7 @@ func (ls *LightService) GetAllLightLevels() map[string]*RoomLightLevel {
 // subscribeLightTopics sets up MQTT subscriptions for light sensor data
 func (ls *LightService) subscribeLightTopics() {
 	// Subscribe to light sensor messages
-	ls.mqttClient.Subscribe("room-light/+", ls.handleLightMessage)
+	ls.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomLight, "+"), countedHandler("light", "light", ls.handleLightMessage))
 	ls.logger.Info("Subscribed to room-light/+ topics")
 }
 
@@ -133,8 +152,7 @@ func (ls *LightService) handleLightMessage(topic string, payload []byte) error {
 	// Parse light message
 	var lightMsg LightSensorMessage
 	if err := json.Unmarshal(payload, &lightMsg); err != nil {
-		ls.logger.Error("Failed to parse light sensor message", map[string]interface{}{
-			"error":   err.Error(),
+		ls.logger.Error("Failed to parse light sensor message", err, map[string]interface{}{
 			"room_id": roomID,
 			"payload": string(payload),
 		})
@@ -147,6 +165,18 @@ func (ls *LightService) handleLightMessage(topic string, payload []byte) error {
 	// Get or create room light level record
 	lightLevel, exists := ls.roomLightLevels[roomID]
 	if !exists {
+		if roomLimitReached(len(ls.roomLightLevels), ls.maxRooms) {
+			ls.rejectedRooms++
+			if shouldLogRejection(ls.rejectedRooms) {
+				ls.logger.Warn("Room limit reached, rejecting light sensor reading", map[string]interface{}{
+					"room_id":   roomID,
+					"max_rooms": ls.maxRooms,
+					"rejected":  ls.rejectedRooms,
+				})
+			}
+			return newRoomLimitError(roomID, ls.maxRooms)
+		}
+
 		lightLevel = &RoomLightLevel{
 			RoomID:     roomID,
 			LightLevel: 0,
@@ -167,6 +197,7 @@ func (ls *LightService) handleLightMessage(topic string, payload []byte) error {
 	previousState := lightLevel.LightState
 
 	lightLevel.LightLevel = lightMsg.LightLevel
+	roomLightLevel.WithLabelValues(roomID).Set(lightLevel.LightLevel)
 	lightLevel.LightState = lightMsg.LightState
 
 	// Determine day/night cycle based on light level patterns
@@ -218,12 +249,18 @@ func (ls *LightService) determineDayNightCycle(lightLevel float64) string {
 	}
 }
 
-// cleanupRoutine periodically marks sensors as offline if no recent updates
-func (ls *LightService) cleanupRoutine() {
+// cleanupRoutine periodically marks sensors as offline if no recent updates, until ctx is done
+func (ls *LightService) cleanupRoutine(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		ls.mu.Lock()
 		currentTime := time.Now()
 
@@ -244,12 +281,18 @@ func (ls *LightService) cleanupRoutine() {
 	}
 }
 
-// dayNightDetection tracks overall day/night patterns
-func (ls *LightService) dayNightDetection() {
+// dayNightDetection tracks overall day/night patterns until ctx is done
+func (ls *LightService) dayNightDetection(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		ls.mu.RLock()
 
 		// Analyze light patterns across all rooms
@@ -305,6 +348,8 @@ func (ls *LightService) GetLightSummary() map[string]interface{} {
 
 	summary := make(map[string]interface{})
 	summary["total_rooms"] = len(ls.roomLightLevels)
+	summary["max_rooms"] = ls.maxRooms
+	summary["rejected_rooms"] = ls.rejectedRooms
 
 	darkCount := 0
 	brightCount := 0
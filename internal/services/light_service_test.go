@@ -3,21 +3,20 @@ package services
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"testing"
 	"time"
 
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 func TestNewLightService(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	if service == nil {
 		t.Fatal("Expected service to be created")
@@ -27,17 +26,17 @@ func TestNewLightService(t *testing.T) {
 		t.Error("Expected roomLightLevels map to be initialized")
 	}
 
-	if service.logger != logger {
+	if service.logger != testLogger {
 		t.Error("Expected logger to be set")
 	}
 }
 
 func TestAddLightCallback(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	callbackCalled := false
 	var callbackRoomID string
@@ -93,11 +92,11 @@ func TestAddLightCallback(t *testing.T) {
 }
 
 func TestGetRoomLightLevel(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Test non-existent room
 	lightData, exists := service.GetRoomLightLevel("non-existent")
@@ -148,11 +147,11 @@ func TestGetRoomLightLevel(t *testing.T) {
 }
 
 func TestGetAllLightLevels(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Initially should be empty
 	lightDataMap := service.GetAllLightLevels()
@@ -209,11 +208,11 @@ func TestGetAllLightLevels(t *testing.T) {
 }
 
 func TestHandleLightMessage(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Test light sensor data
 	lightMsg := LightSensorMessage{
@@ -274,11 +273,11 @@ func TestHandleLightMessage(t *testing.T) {
 }
 
 func TestLightServiceSummary(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Add light data for multiple rooms
 	rooms := []struct {
@@ -336,11 +335,11 @@ func TestLightServiceSummary(t *testing.T) {
 }
 
 func TestLightStates(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Test different light states
 	testCases := []struct {
@@ -388,11 +387,11 @@ func TestLightStates(t *testing.T) {
 }
 
 func TestInvalidLightMessage(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Test invalid JSON
 	invalidPayload := []byte(`{invalid json}`)
@@ -410,11 +409,11 @@ func TestInvalidLightMessage(t *testing.T) {
 }
 
 func TestConcurrentLightUpdates(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Test concurrent light updates
 	done := make(chan bool, 10)
@@ -470,11 +469,11 @@ func TestConcurrentLightUpdates(t *testing.T) {
 }
 
 func TestDeviceOnlineStatusLight(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewLightService(mqttClient, logger)
+	service := NewLightService(mqttClient, testLogger)
 
 	// Add light sensor data
 	lightMsg := LightSensorMessage{
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+const defaultLightingSample = time.Minute
+
+// LightingLoad is an unmetered light fitting: the device switching it, the room it lights and
+// the wattage of its bulbs
+type LightingLoad struct {
+	DeviceID string  `json:"device_id"`
+	RoomID   string  `json:"room_id"`
+	Watts    float64 `json:"watts"`           // Per bulb
+	Bulbs    int     `json:"bulbs,omitempty"` // 1 by default
+}
+
+// power returns the load's total draw while on
+func (l LightingLoad) power() float64 {
+	if l.Bulbs > 0 {
+		return l.Watts * float64(l.Bulbs)
+	}
+	return l.Watts
+}
+
+// LightingConfig lists the lighting loads whose energy is estimated from their on-time
+type LightingConfig struct {
+	SampleSeconds int            `json:"sample_seconds,omitempty"` // 60 by default
+	Loads         []LightingLoad `json:"loads"`
+}
+
+// LoadLightingConfig reads the lighting loads from a JSON file
+func LoadLightingConfig(path string) (*LightingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read lighting loads file", err)
+	}
+
+	var cfg LightingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse lighting loads file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that every load has a device, a room and a wattage, and devices are unique
+func (c *LightingConfig) Validate() error {
+	if c.SampleSeconds < 0 {
+		return errors.NewValidationError("sample_seconds must not be negative", nil)
+	}
+
+	seen := make(map[string]bool)
+	for _, load := range c.Loads {
+		if load.DeviceID == "" || load.RoomID == "" {
+			return errors.NewValidationError("every lighting load needs a device and a room", nil)
+		}
+		if seen[load.DeviceID] {
+			return errors.NewValidationError(fmt.Sprintf("lighting load %s is defined twice", load.DeviceID), nil)
+		}
+		seen[load.DeviceID] = true
+		if load.Watts <= 0 || load.Bulbs < 0 {
+			return errors.NewValidationError(fmt.Sprintf("lighting load %s: watts must be positive and bulbs not negative", load.DeviceID), nil)
+		}
+	}
+	return nil
+}
+
+// lightingRun is the estimated energy of a load so far today
+type lightingRun struct {
+	on       bool
+	sampled  time.Time
+	energyWh float64
+}
+
+// LightingEnergyEstimator estimates the energy of unmetered lights from their wattage and the
+// time their switch reports on. Each sample is passed on as an estimated reading with a daily
+// counter, like a Tapo plug's, so the room energy service attributes it to the load's room.
+type LightingEnergyEstimator struct {
+	config    *LightingConfig
+	states    PowerStateReader
+	logger    *logger.Logger
+	runs      map[string]*lightingRun
+	callbacks []func(reading EnergyReading)
+	mu        sync.Mutex
+}
+
+// NewLightingEnergyEstimator creates an estimator reading the loads' on/off state from states
+func NewLightingEnergyEstimator(cfg *LightingConfig, states PowerStateReader, serviceLogger *logger.Logger) *LightingEnergyEstimator {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("LightingEnergy", nil)
+	}
+
+	return &LightingEnergyEstimator{
+		config: cfg,
+		states: states,
+		logger: serviceLogger,
+		runs:   make(map[string]*lightingRun),
+	}
+}
+
+// AddReadingCallback adds a callback for every estimated reading, e.g. EnergyService.Record
+func (e *LightingEnergyEstimator) AddReadingCallback(callback func(reading EnergyReading)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.callbacks = append(e.callbacks, callback)
+}
+
+// Run samples the loads until the context is cancelled
+func (e *LightingEnergyEstimator) Run(ctx context.Context) {
+	interval := defaultLightingSample
+	if e.config.SampleSeconds > 0 {
+		interval = time.Duration(e.config.SampleSeconds) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	e.Sample(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.Sample(time.Now())
+		}
+	}
+}
+
+// Sample adds the energy each load used since the previous sample, when it was on then, and
+// emits a reading per load whose state is known. A load counts as on for the whole interval
+// if it was on at its start, so short switches between samples are missed.
+func (e *LightingEnergyEstimator) Sample(now time.Time) {
+	var readings []EnergyReading
+
+	e.mu.Lock()
+	for _, load := range e.config.Loads {
+		on, known := e.states.PowerState(load.DeviceID)
+		if !known {
+			continue
+		}
+
+		run, exists := e.runs[load.DeviceID]
+		if !exists {
+			run = &lightingRun{}
+			e.runs[load.DeviceID] = run
+		}
+		if exists && run.sampled.Format("2006-01-02") != now.Format("2006-01-02") {
+			run.energyWh = 0 // A new day, like the plugs' daily counters
+		}
+		if exists && run.on && now.After(run.sampled) {
+			run.energyWh += load.power() * now.Sub(run.sampled).Hours()
+		}
+		run.on, run.sampled = on, now
+
+		reading := EnergyReading{
+			DeviceID:  load.DeviceID,
+			RoomID:    load.RoomID,
+			Tags:      []string{"lighting"},
+			EnergyWh:  run.energyWh,
+			IsOn:      on,
+			Timestamp: now,
+			Estimated: true,
+		}
+		if on {
+			reading.PowerW = load.power()
+		}
+		readings = append(readings, reading)
+	}
+	callbacks := append([]func(EnergyReading){}, e.callbacks...)
+	e.mu.Unlock()
+
+	for _, reading := range readings {
+		for _, callback := range callbacks {
+			callback(reading)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+func TestLightingConfigValidate(t *testing.T) {
+	invalid := []LightingConfig{
+		{Loads: []LightingLoad{{DeviceID: "lamp", Watts: 9}}},
+		{Loads: []LightingLoad{{DeviceID: "lamp", RoomID: "den"}}},
+		{Loads: []LightingLoad{{DeviceID: "lamp", RoomID: "den", Watts: 9}, {DeviceID: "lamp", RoomID: "hall", Watts: 9}}},
+		{SampleSeconds: -1},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestLightingEnergyAttributedToRooms(t *testing.T) {
+	states := fakePowerStates{"kitchen-lights": true, "den-lamp": false}
+	estimator := NewLightingEnergyEstimator(&LightingConfig{Loads: []LightingLoad{
+		{DeviceID: "kitchen-lights", RoomID: "kitchen", Watts: 10, Bulbs: 6},
+		{DeviceID: "den-lamp", RoomID: "den", Watts: 40},
+		{DeviceID: "unknown", RoomID: "hall", Watts: 5}, // Never reports a state
+	}}, states, nil)
+
+	energy := NewEnergyService(nil, "", logger.NewLogger("test-energy", nil))
+	estimator.AddReadingCallback(energy.Record)
+
+	day := time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)
+	estimator.Sample(day)
+	estimator.Sample(day.Add(30 * time.Minute)) // Kitchen on for half an hour: 30 Wh
+	states["kitchen-lights"] = false
+	states["den-lamp"] = true
+	estimator.Sample(day.Add(time.Hour)) // Kitchen was on until now: another 30 Wh
+	estimator.Sample(day.Add(2 * time.Hour))
+
+	// A metered plug in the kitchen adds to the same room
+	energy.Record(EnergyReading{DeviceID: "kettle", RoomID: "kitchen", PowerW: 0, EnergyWh: 100, Timestamp: day})
+	energy.Record(EnergyReading{DeviceID: "kettle", RoomID: "kitchen", PowerW: 0, EnergyWh: 220, Timestamp: day.Add(time.Hour)})
+
+	kitchen, _ := energy.Room("kitchen", day.Add(2*time.Hour))
+	if window := kitchen.Windows[WindowDay]; window.EnergyWh != 180 || window.EstimatedWh != 60 {
+		t.Errorf("Expected 180 Wh in the kitchen, 60 Wh of it estimated, got %+v", window)
+	}
+	den, _ := energy.Room("den", day.Add(2*time.Hour))
+	if den.EstimatedWh != 40 || den.PowerW != 40 {
+		t.Errorf("Expected the den lamp's 40 Wh at 40W, got %.0f Wh at %.0fW", den.EstimatedWh, den.PowerW)
+	}
+	if _, exists := energy.Room("hall", day.Add(2*time.Hour)); exists {
+		t.Error("Expected a load without a known state to be skipped")
+	}
+
+	daily := energy.Daily(2, day.Add(2*time.Hour))
+	if len(daily) != 2 || daily[1].RoomID != "kitchen" || len(daily[1].Days) != 2 {
+		t.Fatalf("Expected two days for den and kitchen, got %+v", daily)
+	}
+	today := daily[1].Days[1]
+	if today.Date != "2024-06-01" || today.KWh != 0.18 || today.EstimatedKWh != 0.06 || today.MeteredKWh != 0.12 {
+		t.Errorf("Unexpected kitchen day %+v", today)
+	}
+	if daily[1].Days[0].KWh != 0 {
+		t.Errorf("Expected no energy the day before, got %+v", daily[1].Days[0])
+	}
+
+	// The daily counter starts again on a new day
+	estimator.Sample(day.Add(7 * time.Hour)) // Den on through midnight: 200 Wh
+	den, _ = energy.Room("den", day.Add(7*time.Hour))
+	if den.EstimatedWh != 240 {
+		t.Errorf("Expected the den's estimate to carry across midnight, got %.0f Wh", den.EstimatedWh)
+	}
+
+	recorder := httptest.NewRecorder()
+	energy.DailyHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/energy/rooms/daily?room=den&days=3", nil))
+	var response struct {
+		Rooms []RoomEnergyDays `json:"rooms"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || len(response.Rooms) != 1 || len(response.Rooms[0].Days) != 3 {
+		t.Errorf("Expected three days for the den, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	energy.DailyHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/energy/rooms/daily?days=90", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Expected more days than are kept to be rejected, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,26 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// rejectionLogInterval limits how often repeated limit rejections are logged
+const rejectionLogInterval = 100
+
+// roomLimitReached reports whether a service tracking count rooms may not add another.
+// A limit of 0 means unlimited.
+func roomLimitReached(count, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+// newRoomLimitError is returned when a service refuses to track another room
+func newRoomLimitError(roomID string, limit int) error {
+	return errors.NewBusinessError(fmt.Sprintf("room limit of %d reached, ignoring room %s", limit, roomID), nil).WithRoom(roomID)
+}
+
+// shouldLogRejection avoids flooding the logs when a runaway integration keeps hitting a limit
+func shouldLogRejection(rejected int) bool {
+	return rejected == 1 || rejected%rejectionLogInterval == 0
+}
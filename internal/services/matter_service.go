@@ -0,0 +1,409 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+	"github.com/johnpr01/home-automation/pkg/matter"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// MatterRoomsFileName is the file, in the state directory, assigning commissioned nodes to rooms
+	MatterRoomsFileName = "matter-rooms.json"
+
+	// matterCommissionTimeout bounds commissioning, which includes the controller interviewing the node
+	matterCommissionTimeout = 2 * time.Minute
+)
+
+// MatterController commissions nodes and sends them commands; *matter.Client implements it
+type MatterController interface {
+	MatterCommander
+	Commission(ctx context.Context, code string, networkOnly bool) (*matter.Node, error)
+	Nodes(ctx context.Context) ([]matter.Node, error)
+}
+
+// MatterNodeStatus describes a commissioned node and the devices made from its endpoints
+type MatterNodeStatus struct {
+	NodeID    uint64   `json:"node_id"`
+	Label     string   `json:"label"`
+	Available bool     `json:"available"`
+	RoomID    string   `json:"room_id,omitempty"`
+	Devices   []string `json:"devices"`
+}
+
+// MatterService exposes the endpoints of commissioned Matter nodes as devices of the device
+// service: on/off endpoints become switches, or lights when they dim, and measurement endpoints
+// become sensors. Attribute reports keep the device properties current, and climate and
+// occupancy readings of nodes in a room are republished on the room sensor topics.
+type MatterService struct {
+	controller MatterController
+	devices    *DeviceService
+	mqttClient *mqtt.Client
+	path       string
+	nodes      map[uint64]matter.Node
+	rooms      map[uint64]string // Room of each node
+	endpoints  map[string]string // Device ID per "node/endpoint"
+	logger     *logger.Logger
+	mu         sync.Mutex
+}
+
+// NewMatterService creates a Matter service; a non-empty path persists the room of each node
+func NewMatterService(controller MatterController, devices *DeviceService, path string, serviceLogger *logger.Logger) *MatterService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("MatterService", nil)
+	}
+
+	service := &MatterService{
+		controller: controller,
+		devices:    devices,
+		path:       path,
+		nodes:      make(map[uint64]matter.Node),
+		rooms:      make(map[uint64]string),
+		endpoints:  make(map[string]string),
+		logger:     serviceLogger,
+	}
+
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(data, &service.rooms); err != nil {
+				serviceLogger.Error("Failed to parse Matter room assignments", err)
+			}
+		}
+	}
+	return service
+}
+
+// MatterRoomsPath returns the Matter room assignment file path for a state directory
+func MatterRoomsPath(stateDir string) string {
+	return filepath.Join(stateDir, MatterRoomsFileName)
+}
+
+// SetMQTTClient republishes sensor readings of nodes assigned to a room on the room topics
+func (s *MatterService) SetMQTTClient(client *mqtt.Client) {
+	s.mqttClient = client
+}
+
+// Sync adds the devices of every node on the controller's fabric
+func (s *MatterService) Sync(ctx context.Context) error {
+	nodes, err := s.controller.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		s.HandleNode(node)
+	}
+	return nil
+}
+
+// Commission adds a device to the fabric from its setup code and its endpoints to the device service
+func (s *MatterService) Commission(ctx context.Context, code, roomID string, networkOnly bool) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, matterCommissionTimeout)
+	defer cancel()
+
+	node, err := s.controller.Commission(ctx, code, networkOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if roomID != "" {
+		s.rooms[node.NodeID] = roomID
+		if err := s.saveRooms(); err != nil {
+			s.logger.Error("Failed to save Matter room assignments", err)
+		}
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("Commissioned Matter node", map[string]interface{}{"node_id": node.NodeID, "label": node.Label(), "room_id": roomID})
+	return s.HandleNode(*node), nil
+}
+
+// HandleNode adds the devices of a node, or refreshes them when the controller re-interviewed it.
+// It returns the IDs of the node's devices.
+func (s *MatterService) HandleNode(node matter.Node) []string {
+	s.mu.Lock()
+	s.nodes[node.NodeID] = node
+	roomID := s.rooms[node.NodeID]
+	s.mu.Unlock()
+
+	endpoints := node.Endpoints()
+	var ids []string
+	for _, endpoint := range endpoints {
+		device, ok := matterDevice(node, endpoint, len(endpoints) > 1)
+		if !ok {
+			continue
+		}
+		if roomID != "" {
+			device.Properties["room_id"] = roomID
+		}
+
+		s.mu.Lock()
+		s.endpoints[matterEndpointKey(node.NodeID, endpoint)] = device.ID
+		s.mu.Unlock()
+		ids = append(ids, device.ID)
+
+		if _, err := s.devices.GetDevice(device.ID); err == nil {
+			s.devices.UpdateDevice(device.ID, device.Properties)
+			continue
+		}
+		if err := s.devices.AddMatterDevice(device, s.controller, node.NodeID, endpoint); err != nil {
+			s.logger.Error("Failed to add Matter device", err, map[string]interface{}{"device_id": device.ID})
+		}
+	}
+	return ids
+}
+
+// HandleAttribute applies an attribute report to the node's device; matches the client's attribute callback
+func (s *MatterService) HandleAttribute(nodeID uint64, path matter.AttributePath, value interface{}) {
+	s.mu.Lock()
+	deviceID, ok := s.endpoints[matterEndpointKey(nodeID, path.Endpoint)]
+	roomID := s.rooms[nodeID]
+	if node, known := s.nodes[nodeID]; known {
+		node.Attributes[path.String()] = value
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	updates := matterProperties(path, value)
+	if len(updates) == 0 {
+		return
+	}
+	if err := s.devices.UpdateDevice(deviceID, updates); err != nil {
+		return
+	}
+	if power, ok := updates["power"].(bool); ok {
+		if device, err := s.devices.GetDevice(deviceID); err == nil {
+			device.Status = map[bool]string{true: "on", false: "off"}[power]
+		}
+	}
+	s.publishRoomSensor(deviceID, roomID, updates)
+}
+
+// Nodes returns the commissioned nodes with their rooms and devices
+func (s *MatterService) Nodes() []MatterNodeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes := make([]MatterNodeStatus, 0, len(s.nodes))
+	for nodeID, node := range s.nodes {
+		status := MatterNodeStatus{NodeID: nodeID, Label: node.Label(), Available: node.Available, RoomID: s.rooms[nodeID], Devices: []string{}}
+		for _, endpoint := range node.Endpoints() {
+			if deviceID, ok := s.endpoints[matterEndpointKey(nodeID, endpoint)]; ok {
+				status.Devices = append(status.Devices, deviceID)
+			}
+		}
+		nodes = append(nodes, status)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	return nodes
+}
+
+// Handler serves the commissioned nodes as JSON
+func (s *MatterService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Nodes())
+	})
+}
+
+// CommissionHandler commissions a device from a POSTed {"code", "room_id", "network_only"}
+func (s *MatterService) CommissionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Code        string `json:"code"`
+			RoomID      string `json:"room_id"`
+			NetworkOnly bool   `json:"network_only"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid commissioning request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		devices, err := s.Commission(r.Context(), request.Code, request.RoomID, request.NetworkOnly)
+		if err != nil {
+			status := http.StatusBadGateway
+			if haErr, ok := err.(*errors.HomeAutomationError); ok && haErr.Type == errors.ErrorTypeValidation {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+	})
+}
+
+// matterDevice makes a device from an endpoint serving on/off or measurement clusters
+func matterDevice(node matter.Node, endpoint int, multiple bool) (*models.Device, bool) {
+	device := &models.Device{
+		ID:          fmt.Sprintf("matter-%d-%d", node.NodeID, endpoint),
+		Name:        node.Label(),
+		Properties:  make(map[string]interface{}),
+		Status:      "online",
+		LastUpdated: time.Now(),
+	}
+	if multiple {
+		device.Name = fmt.Sprintf("%s %d", device.Name, endpoint)
+	}
+	if !node.Available {
+		device.Status = "offline"
+	}
+
+	switch {
+	case node.HasCluster(endpoint, matter.ClusterOnOff):
+		device.Type = models.DeviceTypeSwitch
+		device.Capabilities = []string{string(discovery.CapabilitySwitch)}
+		if node.HasCluster(endpoint, matter.ClusterLevelControl) {
+			device.Type = models.DeviceTypeLight
+			device.Capabilities = append(device.Capabilities, string(discovery.CapabilityDimmer))
+		}
+		if node.HasCluster(endpoint, matter.ClusterColorControl) {
+			device.Type = models.DeviceTypeLight
+			device.Capabilities = append(device.Capabilities, string(discovery.CapabilityColor))
+		}
+		if node.HasCluster(endpoint, matter.ClusterElectricalPower) {
+			device.Capabilities = append(device.Capabilities, string(discovery.CapabilityPower))
+		}
+	default:
+		device.Type = models.DeviceTypeSensor
+		for cluster, capability := range map[uint32]discovery.AssetCapability{
+			matter.ClusterTemperature:      discovery.CapabilityTemperature,
+			matter.ClusterRelativeHumidity: discovery.CapabilityHumidity,
+			matter.ClusterOccupancySensing: discovery.CapabilityMotion,
+			matter.ClusterIlluminance:      discovery.CapabilityLight,
+			matter.ClusterBooleanState:     "contact",
+		} {
+			if node.HasCluster(endpoint, cluster) {
+				device.Capabilities = append(device.Capabilities, string(capability))
+			}
+		}
+		if len(device.Capabilities) == 0 {
+			return nil, false
+		}
+		sort.Strings(device.Capabilities)
+	}
+
+	for path, value := range node.Attributes {
+		parsed, err := matter.ParseAttributePath(path)
+		if err != nil || parsed.Endpoint != endpoint {
+			continue
+		}
+		for key, property := range matterProperties(parsed, value) {
+			device.Properties[key] = property
+		}
+	}
+	if power, ok := device.Properties["power"].(bool); ok && node.Available {
+		device.Status = map[bool]string{true: "on", false: "off"}[power]
+	}
+	return device, true
+}
+
+// matterProperties converts an attribute value into device properties, temperatures in °F
+func matterProperties(path matter.AttributePath, value interface{}) map[string]interface{} {
+	if on, ok := value.(bool); ok {
+		switch {
+		case path.Cluster == matter.ClusterOnOff && path.Attribute == matter.AttributeOnOff:
+			return map[string]interface{}{"power": on}
+		case path.Cluster == matter.ClusterBooleanState && path.Attribute == matter.AttributeStateValue:
+			return map[string]interface{}{"contact": on}
+		}
+		return nil
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return nil
+	}
+	switch {
+	case path.Cluster == matter.ClusterLevelControl && path.Attribute == matter.AttributeCurrentLevel:
+		return map[string]interface{}{"brightness": matter.LevelPercent(number)}
+	case path.Cluster == matter.ClusterTemperature && path.Attribute == matter.AttributeMeasuredValue:
+		return map[string]interface{}{"temperature": matter.Celsius(number)*9/5 + 32}
+	case path.Cluster == matter.ClusterRelativeHumidity && path.Attribute == matter.AttributeMeasuredValue:
+		return map[string]interface{}{"humidity": matter.HumidityPercent(number)}
+	case path.Cluster == matter.ClusterIlluminance && path.Attribute == matter.AttributeMeasuredValue:
+		return map[string]interface{}{"illuminance_lux": matter.Lux(number)}
+	case path.Cluster == matter.ClusterOccupancySensing && path.Attribute == matter.AttributeOccupancy:
+		return map[string]interface{}{"occupied": int(number)&1 == 1}
+	case path.Cluster == matter.ClusterElectricalPower && path.Attribute == matter.AttributeActivePower:
+		return map[string]interface{}{"power_w": number / 1000}
+	}
+	return nil
+}
+
+// publishRoomSensor republishes temperature, humidity and occupancy as a room sensor reading
+func (s *MatterService) publishRoomSensor(deviceID, roomID string, updates map[string]interface{}) {
+	if s.mqttClient == nil || roomID == "" {
+		return
+	}
+
+	message := UnifiedSensorMessage{Room: roomID, Sensor: "matter", DeviceID: deviceID, Timestamp: time.Now().Unix()}
+	var root string
+	if temperature, ok := updates["temperature"].(float64); ok {
+		root, message.Temperature, message.TempUnit = mqtt.TopicRoomTemperature, temperature, "F"
+	} else if humidity, ok := updates["humidity"].(float64); ok {
+		root, message.Humidity, message.HumidityUnit = mqtt.TopicRoomHumidity, humidity, "%"
+	} else if occupied, ok := updates["occupied"].(bool); ok {
+		root, message.Motion = mqtt.TopicRoomMotion, &occupied
+	} else {
+		return
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	msg := (&mqtt.Message{Topic: mqtt.RoomTopic(root, roomID), Payload: payload, QoS: 1}).
+		WithProperty(mqtt.PropertyDevice, deviceID).WithProperty(mqtt.PropertyRoom, roomID)
+	if err := s.mqttClient.Publish(msg); err != nil {
+		s.logger.Error("Failed to publish room sensor reading", err, map[string]interface{}{"device_id": deviceID, "topic": msg.Topic})
+	}
+}
+
+func (s *MatterService) saveRooms() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.rooms, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal Matter room assignments", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write Matter room assignments", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace Matter room assignments", err)
+	}
+	return nil
+}
+
+func matterEndpointKey(nodeID uint64, endpoint int) string {
+	return fmt.Sprintf("%d/%d", nodeID, endpoint)
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/matter"
+)
+
+type fakeMatterController struct {
+	node     matter.Node
+	commands []matter.Command
+}
+
+func (f *fakeMatterController) SendCommand(ctx context.Context, nodeID uint64, endpoint int, cmd matter.Command) error {
+	f.commands = append(f.commands, cmd)
+	return nil
+}
+
+func (f *fakeMatterController) Commission(ctx context.Context, code string, networkOnly bool) (*matter.Node, error) {
+	if _, err := matter.ParseSetupCode(code); err != nil {
+		return nil, err
+	}
+	return &f.node, nil
+}
+
+func (f *fakeMatterController) Nodes(ctx context.Context) ([]matter.Node, error) {
+	return []matter.Node{f.node}, nil
+}
+
+func TestMatterDevices(t *testing.T) {
+	controller := &fakeMatterController{node: matter.Node{NodeID: 7, Available: true, Attributes: map[string]interface{}{
+		"0/40/5":   "Desk",
+		"1/6/0":    true,
+		"1/8/0":    127.0,
+		"2/1026/0": 2150.0,
+		"3/29/1":   []interface{}{},
+	}}}
+	devices := NewDeviceService(nil, nil)
+	path := filepath.Join(t.TempDir(), MatterRoomsFileName)
+	service := NewMatterService(controller, devices, path, nil)
+
+	ids, err := service.Commission(context.Background(), "34970112332", "office", false)
+	if err != nil {
+		t.Fatalf("Commission failed: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != "matter-7-1" || ids[1] != "matter-7-2" {
+		t.Fatalf("Expected a light and a sensor, got %v", ids)
+	}
+
+	light, _ := devices.GetDevice("matter-7-1")
+	if light.Type != models.DeviceTypeLight || light.Status != "on" || light.Properties["brightness"] != 50.0 || light.Properties["room_id"] != "office" {
+		t.Errorf("Unexpected light %+v", light)
+	}
+	sensor, _ := devices.GetDevice("matter-7-2")
+	if sensor.Type != models.DeviceTypeSensor || sensor.Properties["temperature"] != 70.7 {
+		t.Errorf("Expected a 70.7 F sensor, got %+v", sensor)
+	}
+
+	if err := devices.ExecuteCommand(&models.DeviceCommand{DeviceID: "matter-7-1", Action: "set_brightness", Value: 100.0}); err != nil {
+		t.Fatalf("ExecuteCommand failed: %v", err)
+	}
+	if len(controller.commands) != 1 || controller.commands[0].Name != "MoveToLevelWithOnOff" || controller.commands[0].Payload["level"] != 254 {
+		t.Errorf("Expected a level command, got %+v", controller.commands)
+	}
+
+	service.HandleAttribute(7, matter.AttributePath{Endpoint: 1, Cluster: matter.ClusterOnOff, Attribute: matter.AttributeOnOff}, false)
+	if light.Properties["power"] != false || light.Status != "off" {
+		t.Errorf("Expected the light reported off, got %+v", light)
+	}
+
+	// The room assignment survives a restart
+	restarted := NewMatterService(controller, NewDeviceService(nil, nil), path, nil)
+	if err := restarted.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if nodes := restarted.Nodes(); len(nodes) != 1 || nodes[0].RoomID != "office" || nodes[0].Label != "Desk" || len(nodes[0].Devices) != 2 {
+		t.Errorf("Unexpected nodes %+v", nodes)
+	}
+
+	if _, err := service.Commission(context.Background(), "123", "", false); err == nil {
+		t.Error("Expected an invalid setup code to be rejected")
+	}
+}
@@ -1,12 +1,14 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
@@ -40,6 +42,12 @@ type MotionService struct {
 	mu            sync.RWMutex
 	logger        *logger.Logger
 	callbacks     []func(roomID string, occupied bool)
+
+	// Resource limits
+	maxRooms      int
+	rejectedRooms int
+
+	background lifecycle.Background // Runs the offline check between Start and Stop
 }
 
 // NewMotionService creates a new motion detection service
@@ -54,12 +62,26 @@ func NewMotionService(mqttClient *mqtt.Client, logger *logger.Logger) *MotionSer
 	// Subscribe to motion topics
 	service.subscribeMotionTopics()
 
-	// Start cleanup routine for stale data
-	go service.cleanupRoutine()
-
 	return service
 }
 
+// Start starts marking stale sensors offline, until Stop
+func (ms *MotionService) Start(ctx context.Context) error {
+	return ms.background.Start(ctx, ms.cleanupRoutine)
+}
+
+// Stop stops the offline check and waits for it to return
+func (ms *MotionService) Stop(ctx context.Context) error {
+	return ms.background.Stop(ctx)
+}
+
+// SetMaxRooms limits the number of rooms tracked; motion from further rooms is rejected (0 = unlimited)
+func (ms *MotionService) SetMaxRooms(limit int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.maxRooms = limit
+}
+
 // AddOccupancyCallback registers a callback for occupancy changes
 func (ms *MotionService) AddOccupancyCallback(callback func(roomID string, occupied bool)) {
 	ms.mu.Lock()
@@ -98,7 +120,7 @@ func (ms *MotionService) GetAllOccupancy() map[string]*RoomOccupancy {
 // subscribeMotionTopics sets up MQTT subscriptions for motion detection
 func (ms *MotionService) subscribeMotionTopics() {
 	// Subscribe to motion detection messages
-	ms.mqttClient.Subscribe("room-motion/+", ms.handleMotionMessage)
+	ms.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomMotion, "+"), countedHandler("motion", "motion", ms.handleMotionMessage))
 	ms.logger.Info("Subscribed to room-motion/+ topics")
 }
 
@@ -136,6 +158,15 @@ func (ms *MotionService) handleMotionMessage(topic string, payload []byte) error
 	// Get or create room occupancy record
 	occupancy, exists := ms.roomOccupancy[roomID]
 	if !exists {
+		if roomLimitReached(len(ms.roomOccupancy), ms.maxRooms) {
+			ms.rejectedRooms++
+			if shouldLogRejection(ms.rejectedRooms) {
+				ms.logger.Warn(fmt.Sprintf("Room limit of %d reached, rejecting motion from room %s (%d rejected)",
+					ms.maxRooms, roomID, ms.rejectedRooms))
+			}
+			return newRoomLimitError(roomID, ms.maxRooms)
+		}
+
 		occupancy = &RoomOccupancy{
 			RoomID:     roomID,
 			IsOccupied: false,
@@ -152,6 +183,9 @@ func (ms *MotionService) handleMotionMessage(topic string, payload []byte) error
 	// Track occupancy state changes
 	previouslyOccupied := occupancy.IsOccupied
 	currentTime := time.Now()
+	defer func() {
+		roomOccupied.WithLabelValues(roomID).Set(boolGauge(occupancy.IsOccupied))
+	}()
 
 	if motionMsg.Motion {
 		// Motion detected
@@ -192,12 +226,18 @@ func (ms *MotionService) handleMotionMessage(topic string, payload []byte) error
 	return nil
 }
 
-// cleanupRoutine periodically marks sensors as offline if no recent updates
-func (ms *MotionService) cleanupRoutine() {
+// cleanupRoutine periodically marks sensors as offline if no recent updates, until ctx is done
+func (ms *MotionService) cleanupRoutine(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		ms.mu.Lock()
 		currentTime := time.Now()
 
@@ -223,6 +263,8 @@ func (ms *MotionService) GetMotionSummary() map[string]interface{} {
 
 	summary := make(map[string]interface{})
 	summary["total_rooms"] = len(ms.roomOccupancy)
+	summary["max_rooms"] = ms.maxRooms
+	summary["rejected_rooms"] = ms.rejectedRooms
 
 	occupiedCount := 0
 	onlineCount := 0
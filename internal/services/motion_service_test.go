@@ -3,21 +3,20 @@ package services
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"testing"
 	"time"
 
 	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 func TestNewMotionService(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	if service == nil {
 		t.Fatal("Expected service to be created")
@@ -27,17 +26,17 @@ func TestNewMotionService(t *testing.T) {
 		t.Error("Expected roomOccupancy map to be initialized")
 	}
 
-	if service.logger != logger {
+	if service.logger != testLogger {
 		t.Error("Expected logger to be set")
 	}
 }
 
 func TestAddMotionCallback(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	callbackCalled := false
 	var callbackRoomID string
@@ -86,11 +85,11 @@ func TestAddMotionCallback(t *testing.T) {
 }
 
 func TestGetRoomOccupancy(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Test non-existent room
 	occupancy, exists := service.GetRoomOccupancy("non-existent")
@@ -136,11 +135,11 @@ func TestGetRoomOccupancy(t *testing.T) {
 }
 
 func TestGetAllRoomOccupancy(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Initially should be empty
 	occupancies := service.GetAllOccupancy()
@@ -185,11 +184,11 @@ func TestGetAllRoomOccupancy(t *testing.T) {
 }
 
 func TestHandleMotionMessage(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Test motion detected
 	motionMsg := MotionDetectionMessage{
@@ -242,11 +241,11 @@ func TestHandleMotionMessage(t *testing.T) {
 }
 
 func TestExtractRoomIDFromTopic(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	tests := []struct {
 		topic    string
@@ -279,11 +278,11 @@ func TestExtractRoomIDFromTopic(t *testing.T) {
 }
 
 func TestMotionServiceSummary(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Add motion for some rooms (some occupied, some not)
 	rooms := []struct {
@@ -337,11 +336,11 @@ func TestMotionServiceSummary(t *testing.T) {
 }
 
 func TestInvalidMotionMessage(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Test invalid JSON
 	invalidPayload := []byte(`{invalid json}`)
@@ -359,11 +358,11 @@ func TestInvalidMotionMessage(t *testing.T) {
 }
 
 func TestConcurrentMotionUpdates(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Test concurrent motion updates
 	done := make(chan bool, 10)
@@ -405,11 +404,11 @@ func TestConcurrentMotionUpdates(t *testing.T) {
 }
 
 func TestMotionTimeout(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Add motion detection
 	motionMsg := MotionDetectionMessage{
@@ -443,11 +442,11 @@ func TestMotionTimeout(t *testing.T) {
 }
 
 func TestDeviceOnlineStatus(t *testing.T) {
-	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	testLogger := logger.NewLogger("test", nil)
 	mqttConfig := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
 	mqttClient := mqtt.NewClient(mqttConfig, nil)
 
-	service := NewMotionService(mqttClient, logger)
+	service := NewMotionService(mqttClient, testLogger)
 
 	// Add motion detection
 	motionMsg := MotionDetectionMessage{
@@ -0,0 +1,391 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+const (
+	// MotionTuningFileName is the file, in the state directory, holding adapted motion-light parameters
+	MotionTuningFileName = "motion-tuning.json"
+
+	// Activations whose light level was this close to the dark threshold count as "not dark enough"
+	// when marked unwanted; others count as retriggering too soon
+	motionTuningBorderline = 10.0
+
+	motionTuningThresholdStep = 2.0
+	motionTuningMinThreshold  = 5.0
+	motionTuningCooldownStep  = 1.5
+	motionTuningMaxCooldown   = 30 * time.Minute
+
+	// Activations nobody complained about within the window count as wanted; after
+	// motionTuningRelaxAfter of them in a row a room steps back towards the defaults
+	motionTuningFeedbackWindow = time.Hour
+	motionTuningRelaxAfter     = 10
+
+	maxMotionActivations = 100
+	maxMotionTuningLog   = 200
+)
+
+// MotionActivation is a motion-light rule switching lights on, which the user may mark unwanted
+type MotionActivation struct {
+	ID            string        `json:"id"`
+	RuleID        string        `json:"rule_id"`
+	RoomID        string        `json:"room_id"`
+	At            time.Time     `json:"at"`
+	LightLevel    float64       `json:"light_level"`
+	DarkThreshold float64       `json:"dark_threshold"`
+	Cooldown      time.Duration `json:"cooldown"`
+	Unwanted      bool          `json:"unwanted,omitempty"`
+	Reason        string        `json:"reason,omitempty"`
+	Evaluated     bool          `json:"evaluated,omitempty"` // Counted as wanted after the feedback window
+}
+
+// RoomMotionTuning holds a room's adapted motion-light parameters
+type RoomMotionTuning struct {
+	Cooldown      time.Duration `json:"cooldown"`
+	DarkThreshold float64       `json:"dark_threshold"`
+	Unwanted      int           `json:"unwanted"`   // Activations marked unwanted in total
+	Undisputed    int           `json:"undisputed"` // Wanted activations since the last change
+}
+
+// MotionTuningChange records one adaptation of a room's parameters
+type MotionTuningChange struct {
+	At           time.Time `json:"at"`
+	RoomID       string    `json:"room_id"`
+	Parameter    string    `json:"parameter"` // cooldown or dark_threshold
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Reason       string    `json:"reason"` // retrigger, not_dark or no_complaints
+	ActivationID string    `json:"activation_id,omitempty"`
+}
+
+// MotionTuningReport shows the adapted parameters, how they got there and the recent activations
+type MotionTuningReport struct {
+	DefaultCooldown      time.Duration                `json:"default_cooldown"`
+	DefaultDarkThreshold float64                      `json:"default_dark_threshold"`
+	Rooms                map[string]*RoomMotionTuning `json:"rooms"`
+	History              []MotionTuningChange         `json:"history"`
+	Activations          []MotionActivation           `json:"activations"`
+}
+
+// motionTuningState is the persisted part of the tuner
+type motionTuningState struct {
+	Rooms       map[string]*RoomMotionTuning `json:"rooms"`
+	History     []MotionTuningChange         `json:"history"`
+	Activations []MotionActivation           `json:"activations"`
+}
+
+// MotionTuner adapts each room's motion-light cooldown and dark threshold from feedback. Marking
+// an activation unwanted lowers the dark threshold when the room was nearly bright enough and
+// lengthens the cooldown otherwise; a run of activations without complaints steps back towards
+// the defaults.
+type MotionTuner struct {
+	path             string
+	defaultCooldown  time.Duration
+	defaultThreshold float64
+	state            motionTuningState
+	logger           *logger.Logger
+	mu               sync.Mutex
+}
+
+// NewMotionTuner creates a tuner starting every room at the defaults; a non-empty path persists it
+func NewMotionTuner(path string, defaultCooldown time.Duration, defaultThreshold float64, serviceLogger *logger.Logger) (*MotionTuner, error) {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("MotionTuner", nil)
+	}
+
+	tuner := &MotionTuner{
+		path:             path,
+		defaultCooldown:  defaultCooldown,
+		defaultThreshold: defaultThreshold,
+		state:            motionTuningState{Rooms: make(map[string]*RoomMotionTuning)},
+		logger:           serviceLogger,
+	}
+	if path == "" {
+		return tuner, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tuner, nil
+	}
+	if err != nil {
+		return tuner, errors.NewSystemError("failed to read motion tuning", err)
+	}
+	if err := json.Unmarshal(data, &tuner.state); err != nil {
+		return tuner, errors.NewSystemError("failed to parse motion tuning", err)
+	}
+	if tuner.state.Rooms == nil {
+		tuner.state.Rooms = make(map[string]*RoomMotionTuning)
+	}
+	return tuner, nil
+}
+
+// MotionTuningPath returns the motion tuning file path for a state directory
+func MotionTuningPath(stateDir string) string {
+	return filepath.Join(stateDir, MotionTuningFileName)
+}
+
+// SetDefaultDarkThreshold changes the threshold of rooms that haven't been tuned
+func (t *MotionTuner) SetDefaultDarkThreshold(threshold float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.defaultThreshold = threshold
+}
+
+// Cooldown returns a room's motion-light cooldown, or fallback when the room hasn't been tuned
+func (t *MotionTuner) Cooldown(roomID string, fallback time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if room, ok := t.state.Rooms[roomID]; ok && room.Cooldown > 0 {
+		return room.Cooldown
+	}
+	return fallback
+}
+
+// DarkThreshold returns the light level (%) below which a room counts as dark
+func (t *MotionTuner) DarkThreshold(roomID string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if room, ok := t.state.Rooms[roomID]; ok && room.DarkThreshold > 0 {
+		return room.DarkThreshold
+	}
+	return t.defaultThreshold
+}
+
+// RecordActivation notes that a rule switched a room's lights on and returns the activation
+// for feedback. Older activations nobody complained about count towards relaxing the room.
+func (t *MotionTuner) RecordActivation(ruleID, roomID string, lightLevel float64, cooldown time.Duration, at time.Time) MotionActivation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.relax(roomID, at)
+
+	activation := MotionActivation{
+		ID:            fmt.Sprintf("%s-%d", roomID, at.UnixMilli()),
+		RuleID:        ruleID,
+		RoomID:        roomID,
+		At:            at,
+		LightLevel:    lightLevel,
+		DarkThreshold: t.thresholdLocked(roomID),
+		Cooldown:      cooldown,
+	}
+	t.state.Activations = append(t.state.Activations, activation)
+	if len(t.state.Activations) > maxMotionActivations {
+		t.state.Activations = t.state.Activations[len(t.state.Activations)-maxMotionActivations:]
+	}
+	t.save()
+	return activation
+}
+
+// MarkUnwanted records that an activation switched lights on that the user didn't want and adapts
+// the room. It returns the change made, or nil when the room is already at its limits.
+func (t *MotionTuner) MarkUnwanted(activationID, reason string, at time.Time) (*MotionTuningChange, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var activation *MotionActivation
+	for i := range t.state.Activations {
+		if t.state.Activations[i].ID == activationID {
+			activation = &t.state.Activations[i]
+		}
+	}
+	if activation == nil {
+		return nil, errors.NewValidationError(fmt.Sprintf("activation %s not found", activationID), nil)
+	}
+	if activation.Unwanted {
+		return nil, errors.NewBusinessError(fmt.Sprintf("activation %s is already marked unwanted", activationID), nil)
+	}
+	activation.Unwanted = true
+	activation.Reason = reason
+
+	room := t.roomLocked(activation.RoomID, activation.Cooldown)
+	room.Unwanted++
+	room.Undisputed = 0
+
+	change := MotionTuningChange{At: at, RoomID: activation.RoomID, ActivationID: activationID}
+	if activation.DarkThreshold-activation.LightLevel <= motionTuningBorderline && room.DarkThreshold > motionTuningMinThreshold {
+		// The room was nearly bright enough: only switch on when it is darker
+		from := room.DarkThreshold
+		room.DarkThreshold = max(from-motionTuningThresholdStep, motionTuningMinThreshold)
+		change.Parameter, change.Reason = "dark_threshold", "not_dark"
+		change.From, change.To = fmt.Sprintf("%.1f", from), fmt.Sprintf("%.1f", room.DarkThreshold)
+	} else {
+		// Lights came back on too soon: wait longer before the next activation
+		from := room.Cooldown
+		room.Cooldown = min(time.Duration(float64(from)*motionTuningCooldownStep).Round(time.Second), motionTuningMaxCooldown)
+		change.Parameter, change.Reason = "cooldown", "retrigger"
+		change.From, change.To = from.String(), room.Cooldown.String()
+	}
+	if change.From == change.To {
+		t.save()
+		return nil, nil
+	}
+	t.logChange(change)
+	t.save()
+	return &change, nil
+}
+
+// Report returns the adapted parameters, their history and the recent activations
+func (t *MotionTuner) Report() MotionTuningReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := MotionTuningReport{
+		DefaultCooldown:      t.defaultCooldown,
+		DefaultDarkThreshold: t.defaultThreshold,
+		Rooms:                make(map[string]*RoomMotionTuning, len(t.state.Rooms)),
+		History:              append([]MotionTuningChange{}, t.state.History...),
+		Activations:          append([]MotionActivation{}, t.state.Activations...),
+	}
+	for roomID, room := range t.state.Rooms {
+		copied := *room
+		report.Rooms[roomID] = &copied
+	}
+	return report
+}
+
+// Handler serves the tuning report as JSON
+func (t *MotionTuner) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Report())
+	})
+}
+
+// FeedbackHandler marks an activation unwanted from a POSTed {"activation_id", "reason"}
+func (t *MotionTuner) FeedbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var feedback MotionFeedback
+		if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil {
+			http.Error(w, "invalid feedback: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		change, err := t.MarkUnwanted(feedback.ActivationID, feedback.Reason, time.Now())
+		if err != nil {
+			status := http.StatusNotFound
+			if haErr, ok := err.(*errors.HomeAutomationError); ok && haErr.Type == errors.ErrorTypeBusiness {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"activation_id": feedback.ActivationID, "change": change})
+	})
+}
+
+// MotionFeedback marks an activation unwanted, from the API or the automation feedback topic
+type MotionFeedback struct {
+	ActivationID string `json:"activation_id"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// relax counts the room's activations past the feedback window as wanted and steps a room with
+// enough of them in a row back towards the defaults
+func (t *MotionTuner) relax(roomID string, now time.Time) {
+	room, ok := t.state.Rooms[roomID]
+	if !ok {
+		return
+	}
+	for i := range t.state.Activations {
+		activation := &t.state.Activations[i]
+		if activation.RoomID != roomID || activation.Unwanted || activation.Evaluated || now.Sub(activation.At) < motionTuningFeedbackWindow {
+			continue
+		}
+		activation.Evaluated = true
+		room.Undisputed++
+	}
+	if room.Undisputed < motionTuningRelaxAfter {
+		return
+	}
+	room.Undisputed = 0
+
+	if room.Cooldown > t.defaultCooldown {
+		from := room.Cooldown
+		room.Cooldown = max(time.Duration(float64(from)/motionTuningCooldownStep).Round(time.Second), t.defaultCooldown)
+		t.logChange(MotionTuningChange{At: now, RoomID: roomID, Parameter: "cooldown", From: from.String(), To: room.Cooldown.String(), Reason: "no_complaints"})
+	}
+	if room.DarkThreshold < t.defaultThreshold {
+		from := room.DarkThreshold
+		room.DarkThreshold = min(from+motionTuningThresholdStep, t.defaultThreshold)
+		t.logChange(MotionTuningChange{At: now, RoomID: roomID, Parameter: "dark_threshold",
+			From: fmt.Sprintf("%.1f", from), To: fmt.Sprintf("%.1f", room.DarkThreshold), Reason: "no_complaints"})
+	}
+	if room.Cooldown <= t.defaultCooldown && room.DarkThreshold >= t.defaultThreshold {
+		delete(t.state.Rooms, roomID)
+	}
+}
+
+// roomLocked returns a room's tuning, starting from the defaults and the cooldown in effect
+func (t *MotionTuner) roomLocked(roomID string, cooldown time.Duration) *RoomMotionTuning {
+	room, ok := t.state.Rooms[roomID]
+	if !ok {
+		if cooldown <= 0 {
+			cooldown = t.defaultCooldown
+		}
+		room = &RoomMotionTuning{Cooldown: cooldown, DarkThreshold: t.defaultThreshold}
+		t.state.Rooms[roomID] = room
+	}
+	return room
+}
+
+func (t *MotionTuner) thresholdLocked(roomID string) float64 {
+	if room, ok := t.state.Rooms[roomID]; ok && room.DarkThreshold > 0 {
+		return room.DarkThreshold
+	}
+	return t.defaultThreshold
+}
+
+func (t *MotionTuner) logChange(change MotionTuningChange) {
+	t.state.History = append(t.state.History, change)
+	if len(t.state.History) > maxMotionTuningLog {
+		t.state.History = t.state.History[len(t.state.History)-maxMotionTuningLog:]
+	}
+}
+
+// save writes the tuning state; a failed save keeps the state in memory for the next attempt
+func (t *MotionTuner) save() {
+	if t.path == "" {
+		return
+	}
+	if err := t.write(); err != nil {
+		t.logger.Error("Failed to save motion tuning", err)
+	}
+}
+
+func (t *MotionTuner) write() error {
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal motion tuning", err)
+	}
+
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write motion tuning", err)
+	}
+	if err := os.Rename(tmpPath, t.path); err != nil {
+		return errors.NewSystemError("failed to replace motion tuning", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+func TestMotionTunerFeedback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), MotionTuningFileName)
+	tuner, err := NewMotionTuner(path, 5*time.Minute, 20, nil)
+	if err != nil {
+		t.Fatalf("NewMotionTuner failed: %v", err)
+	}
+	t0 := time.Date(2024, 1, 14, 18, 0, 0, 0, time.UTC)
+
+	// Lights on at 15% with a 20% threshold: the room was nearly bright enough
+	dusk := tuner.RecordActivation("motion-light-hallway", "hallway", 15, 5*time.Minute, t0)
+	change, err := tuner.MarkUnwanted(dusk.ID, "still light out", t0.Add(time.Minute))
+	if err != nil || change == nil || change.Parameter != "dark_threshold" || change.To != "18.0" {
+		t.Fatalf("Expected the threshold lowered to 18, got %+v (%v)", change, err)
+	}
+	if threshold := tuner.DarkThreshold("hallway"); threshold != 18 {
+		t.Errorf("Expected a hallway threshold of 18, got %.1f", threshold)
+	}
+	if threshold := tuner.DarkThreshold("kitchen"); threshold != 20 {
+		t.Errorf("Expected other rooms to keep the default, got %.1f", threshold)
+	}
+
+	// Lights on in a dark room that the user didn't want: the cooldown grows
+	night := tuner.RecordActivation("motion-light-hallway", "hallway", 2, 5*time.Minute, t0.Add(10*time.Minute))
+	if change, err := tuner.MarkUnwanted(night.ID, "", t0.Add(11*time.Minute)); err != nil || change.Parameter != "cooldown" || change.To != "7m30s" {
+		t.Fatalf("Expected the cooldown raised to 7m30s, got %+v (%v)", change, err)
+	}
+	if cooldown := tuner.Cooldown("hallway", 5*time.Minute); cooldown != 450*time.Second {
+		t.Errorf("Expected a 7m30s cooldown, got %s", cooldown)
+	}
+
+	if _, err := tuner.MarkUnwanted(night.ID, "", t0.Add(12*time.Minute)); !isErrorType(err, errors.ErrorTypeBusiness) {
+		t.Errorf("Expected marking twice to conflict, got %v", err)
+	}
+	if _, err := tuner.MarkUnwanted("missing", "", t0); !isErrorType(err, errors.ErrorTypeValidation) {
+		t.Errorf("Expected an unknown activation to be rejected, got %v", err)
+	}
+
+	// The adaptation survives a restart
+	reloaded, err := NewMotionTuner(path, 5*time.Minute, 20, nil)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	report := reloaded.Report()
+	if room := report.Rooms["hallway"]; room == nil || room.Unwanted != 2 || room.DarkThreshold != 18 || len(report.History) != 2 {
+		t.Errorf("Expected the hallway tuning and history to be reloaded, got %+v", report)
+	}
+}
+
+func TestMotionTunerRelaxes(t *testing.T) {
+	tuner, _ := NewMotionTuner("", 5*time.Minute, 20, nil)
+	t0 := time.Date(2024, 1, 14, 18, 0, 0, 0, time.UTC)
+
+	unwanted := tuner.RecordActivation("motion-light-office", "office", 1, 5*time.Minute, t0)
+	tuner.MarkUnwanted(unwanted.ID, "", t0)
+
+	// Ten activations nobody complains about step the cooldown back to the default
+	at := t0
+	for i := 0; i < motionTuningRelaxAfter+1; i++ {
+		at = at.Add(2 * time.Hour)
+		tuner.RecordActivation("motion-light-office", "office", 1, 450*time.Second, at)
+	}
+
+	report := tuner.Report()
+	if _, tuned := report.Rooms["office"]; tuned {
+		t.Errorf("Expected the office back at the defaults, got %+v", report.Rooms["office"])
+	}
+	if last := report.History[len(report.History)-1]; last.Reason != "no_complaints" || last.To != "5m0s" {
+		t.Errorf("Expected the relaxation in the history, got %+v", last)
+	}
+}
+
+func isErrorType(err error, errorType errors.ErrorType) bool {
+	haErr, ok := err.(*errors.HomeAutomationError)
+	return ok && haErr.Type == errorType
+}
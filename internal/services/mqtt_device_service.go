@@ -0,0 +1,681 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/esphome"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/tasmota"
+)
+
+// Firmwares of DIY devices
+const (
+	FirmwareTasmota = "tasmota"
+	FirmwareESPHome = "esphome"
+)
+
+// MQTTDeviceConfig describes a DIY plug, light or sensor running Tasmota or ESPHome
+type MQTTDeviceConfig struct {
+	DeviceID   string   `json:"device_id"`
+	DeviceName string   `json:"device_name"`
+	RoomID     string   `json:"room_id"`
+	Tags       []string `json:"tags,omitempty"`
+	Firmware   string   `json:"firmware"` // tasmota or esphome
+	Topic      string   `json:"topic"`    // Tasmota device topic, or ESPHome topic prefix (the node name)
+
+	// ESPHome only. Component and ObjectID name the entity taking commands, switch/relay by
+	// default. Sensors maps readings (power, energy, voltage, current, temperature, humidity,
+	// motion, uptime) to sensor object IDs; a reading defaults to an object ID of its own name.
+	Component string            `json:"component,omitempty"`
+	ObjectID  string            `json:"object_id,omitempty"`
+	Sensors   map[string]string `json:"sensors,omitempty"`
+	TempUnit  string            `json:"temp_unit,omitempty"` // C (default) or F
+}
+
+// MQTTDeviceStatus is the last known state of a DIY device. Temperatures are in °F.
+type MQTTDeviceStatus struct {
+	DeviceID    string    `json:"device_id"`
+	DeviceName  string    `json:"device_name"`
+	RoomID      string    `json:"room_id"`
+	Firmware    string    `json:"firmware"`
+	Online      bool      `json:"online"`
+	On          *bool     `json:"on,omitempty"`
+	PowerW      *float64  `json:"power_w,omitempty"`
+	EnergyWh    *float64  `json:"energy_wh,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Humidity    *float64  `json:"humidity,omitempty"`
+	Motion      *bool     `json:"motion,omitempty"`
+	BootedAt    time.Time `json:"booted_at,omitempty"` // From the uptime the device reports
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+}
+
+// deviceBootJitter is how far boot times derived from successive uptime reports may drift
+// before they count as a new boot
+const deviceBootJitter = time.Minute
+
+// LoadMQTTDevices reads DIY device configurations from a JSON file
+func LoadMQTTDevices(path string) ([]MQTTDeviceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read MQTT devices file", err)
+	}
+
+	var configs []MQTTDeviceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, errors.NewConfigError("failed to parse MQTT devices file", err)
+	}
+	return configs, nil
+}
+
+// MQTTDeviceService adapts Tasmota and ESPHome devices. Their telemetry becomes energy readings
+// and room sensor messages on the room-temp, room-hum and room-motion topics, and device commands
+// are translated into their command topics.
+type MQTTDeviceService struct {
+	mqttClient       *mqtt.Client
+	tsClient         TimeSeriesClient
+	devices          map[string]*MQTTDeviceStatus
+	configs          map[string]MQTTDeviceConfig
+	readingCallbacks []func(EnergyReading)
+	bootCallbacks    []func(deviceID string, bootedAt time.Time)
+	providers        []DeviceProvider
+	safeMode         *safemode.Controller
+	dryRun           *dryrun.Recorder
+	logger           *logger.Logger
+	mu               sync.RWMutex
+}
+
+// DeviceProvider contributes devices handled outside this service, such as by plugins, to the
+// devices listed and commanded here. Safe mode and observe-only mode apply to their commands too.
+type DeviceProvider interface {
+	Devices() []MQTTDeviceStatus
+	Handles(deviceID string) bool
+	SendCommand(cmd *models.DeviceCommand) error
+}
+
+// NewMQTTDeviceService creates an adapter for DIY devices; tsClient may be nil
+func NewMQTTDeviceService(mqttClient *mqtt.Client, tsClient TimeSeriesClient, serviceLogger *logger.Logger) *MQTTDeviceService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("MQTTDeviceService", nil)
+	}
+
+	return &MQTTDeviceService{
+		mqttClient: mqttClient,
+		tsClient:   tsClient,
+		devices:    make(map[string]*MQTTDeviceStatus),
+		configs:    make(map[string]MQTTDeviceConfig),
+		logger:     serviceLogger,
+	}
+}
+
+// SetSafeMode attaches a safe mode controller that blocks device commands
+func (s *MQTTDeviceService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces commands in observe-only mode
+func (s *MQTTDeviceService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// AddDeviceProvider lists and commands the devices of a provider along with the configured ones,
+// which take precedence on a repeated device ID
+func (s *MQTTDeviceService) AddDeviceProvider(provider DeviceProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers = append(s.providers, provider)
+}
+
+// AddReadingCallback registers a callback for every energy reading, like TapoService's
+func (s *MQTTDeviceService) AddReadingCallback(callback func(reading EnergyReading)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readingCallbacks = append(s.readingCallbacks, callback)
+}
+
+// AddBootCallback registers a callback for devices reporting a new boot through their uptime
+func (s *MQTTDeviceService) AddBootCallback(callback func(deviceID string, bootedAt time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bootCallbacks = append(s.bootCallbacks, callback)
+}
+
+// AddDevice validates a device and subscribes to its telemetry
+func (s *MQTTDeviceService) AddDevice(config MQTTDeviceConfig) error {
+	if config.DeviceID == "" || config.Topic == "" {
+		return errors.NewValidationError("MQTT devices need a device_id and a topic", nil)
+	}
+	if config.DeviceName == "" {
+		config.DeviceName = config.DeviceID
+	}
+
+	var topics []string
+	var handler mqtt.MessageHandler
+	switch config.Firmware {
+	case FirmwareTasmota:
+		topics = []string{mqtt.Topic(tasmota.PrefixTelemetry, config.Topic, "+"), tasmota.PowerTopic(config.Topic)}
+		handler = s.tasmotaHandler(config.DeviceID)
+	case FirmwareESPHome:
+		if config.Component == "" {
+			config.Component = esphome.ComponentSwitch
+		}
+		if config.Component != esphome.ComponentSwitch && config.Component != esphome.ComponentLight {
+			return errors.NewValidationError(fmt.Sprintf("device %s: component must be switch or light", config.DeviceID), nil)
+		}
+		if config.ObjectID == "" {
+			config.ObjectID = "relay"
+		}
+		topics = []string{mqtt.Topic(config.Topic, "+", "+", "state"), esphome.StatusTopic(config.Topic)}
+		handler = s.esphomeHandler(config.DeviceID)
+	default:
+		return errors.NewValidationError(fmt.Sprintf("device %s: unknown firmware %q, use tasmota or esphome", config.DeviceID, config.Firmware), nil)
+	}
+
+	s.mu.Lock()
+	if _, exists := s.configs[config.DeviceID]; exists {
+		s.mu.Unlock()
+		return errors.NewValidationError(fmt.Sprintf("device %s already exists", config.DeviceID), nil)
+	}
+	s.configs[config.DeviceID] = config
+	s.devices[config.DeviceID] = &MQTTDeviceStatus{
+		DeviceID:   config.DeviceID,
+		DeviceName: config.DeviceName,
+		RoomID:     config.RoomID,
+		Firmware:   config.Firmware,
+	}
+	s.mu.Unlock()
+
+	if s.mqttClient == nil {
+		return nil
+	}
+	for _, topic := range topics {
+		if err := s.mqttClient.Subscribe(topic, handler); err != nil {
+			return errors.NewMQTTError(fmt.Sprintf("failed to subscribe to %s", topic), err)
+		}
+	}
+	return nil
+}
+
+// tasmotaHandler handles the telemetry and power state messages of a Tasmota device
+func (s *MQTTDeviceService) tasmotaHandler(deviceID string) mqtt.MessageHandler {
+	return func(topic string, payload []byte) error {
+		switch topic[strings.LastIndex(topic, "/")+1:] {
+		case "SENSOR":
+			telemetry, err := tasmota.ParseSensor(payload)
+			if err != nil {
+				return err
+			}
+			s.update(deviceID, telemetry.On, func(device *MQTTDeviceStatus) {
+				device.PowerW = orKeep(telemetry.PowerW, device.PowerW)
+				device.EnergyWh = orKeep(telemetry.EnergyWh, device.EnergyWh)
+			})
+			if telemetry.PowerW != nil {
+				s.emitReading(deviceID, telemetry.VoltageV, telemetry.CurrentA, telemetry.RSSI)
+			}
+			s.reportClimate(deviceID, telemetry.Temperature, telemetry.TempUnit, telemetry.Humidity)
+
+		case "STATE":
+			telemetry, err := tasmota.ParseState(payload)
+			if err != nil {
+				return err
+			}
+			s.update(deviceID, telemetry.On, nil)
+			if telemetry.UptimeSec != nil {
+				s.recordUptime(deviceID, *telemetry.UptimeSec)
+			}
+
+		case "POWER":
+			on, ok := tasmota.ParsePower(string(payload))
+			if !ok {
+				return fmt.Errorf("invalid power state %q", payload)
+			}
+			s.update(deviceID, &on, nil)
+
+		case "LWT":
+			s.setOnline(deviceID, strings.EqualFold(string(payload), "Online"))
+		}
+		return nil
+	}
+}
+
+// esphomeHandler handles the entity states and availability of an ESPHome node
+func (s *MQTTDeviceService) esphomeHandler(deviceID string) mqtt.MessageHandler {
+	return func(topic string, payload []byte) error {
+		s.mu.RLock()
+		config := s.configs[deviceID]
+		s.mu.RUnlock()
+
+		if topic == esphome.StatusTopic(config.Topic) {
+			s.setOnline(deviceID, string(payload) == "online")
+			return nil
+		}
+
+		component, objectID, ok := esphome.ParseStateTopic(config.Topic, topic)
+		if !ok {
+			return nil
+		}
+
+		switch {
+		case component == config.Component && objectID == config.ObjectID:
+			on, err := esphomeOn(component, payload)
+			if err != nil {
+				return err
+			}
+			s.update(deviceID, &on, nil)
+
+		case component == esphome.ComponentBinarySensor && objectID == sensorObjectID(config, "motion"):
+			motion, err := esphome.ParseBinary(payload)
+			if err != nil {
+				return err
+			}
+			s.update(deviceID, nil, func(device *MQTTDeviceStatus) { device.Motion = &motion })
+			s.publishRoomSensor(deviceID, mqtt.TopicRoomMotion, UnifiedSensorMessage{Motion: &motion})
+
+		case component == esphome.ComponentSensor:
+			value, err := esphome.ParseNumber(payload)
+			if err != nil {
+				return err
+			}
+			s.handleESPHomeSensor(deviceID, config, objectID, value)
+		}
+		return nil
+	}
+}
+
+// handleESPHomeSensor records the reading of an ESPHome sensor entity
+func (s *MQTTDeviceService) handleESPHomeSensor(deviceID string, config MQTTDeviceConfig, objectID string, value float64) {
+	switch objectID {
+	case sensorObjectID(config, "power"):
+		s.update(deviceID, nil, func(device *MQTTDeviceStatus) { device.PowerW = &value })
+		s.emitReading(deviceID, nil, nil, nil)
+	case sensorObjectID(config, "energy"):
+		wh := value * 1000 // ESPHome total energy sensors report kWh
+		s.update(deviceID, nil, func(device *MQTTDeviceStatus) { device.EnergyWh = &wh })
+	case sensorObjectID(config, "temperature"):
+		unit := config.TempUnit
+		if unit == "" {
+			unit = "C"
+		}
+		s.reportClimate(deviceID, &value, unit, nil)
+	case sensorObjectID(config, "humidity"):
+		s.reportClimate(deviceID, nil, "", &value)
+	case sensorObjectID(config, "uptime"):
+		s.recordUptime(deviceID, value)
+	}
+}
+
+// sensorObjectID returns the object ID of an ESPHome sensor, by default the reading's own name
+func sensorObjectID(config MQTTDeviceConfig, reading string) string {
+	if objectID, ok := config.Sensors[reading]; ok {
+		return objectID
+	}
+	return reading
+}
+
+// esphomeOn parses the state of the switch or light entity of a device
+func esphomeOn(component string, payload []byte) (bool, error) {
+	if component != esphome.ComponentLight {
+		return esphome.ParseBinary(payload)
+	}
+	state, err := esphome.ParseLight(payload)
+	if err != nil {
+		return false, err
+	}
+	return esphome.ParseBinary([]byte(state.State))
+}
+
+// update applies a change to the status of a device and marks it seen
+func (s *MQTTDeviceService) update(deviceID string, on *bool, change func(device *MQTTDeviceStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, exists := s.devices[deviceID]
+	if !exists {
+		return
+	}
+	if on != nil {
+		device.On = on
+	}
+	if change != nil {
+		change(device)
+	}
+	device.Online = true
+	device.LastSeen = time.Now()
+}
+
+func (s *MQTTDeviceService) setOnline(deviceID string, online bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device, exists := s.devices[deviceID]; exists {
+		device.Online = online
+	}
+}
+
+// recordUptime derives the boot time of a device from its uptime in seconds and reports new boots
+func (s *MQTTDeviceService) recordUptime(deviceID string, uptimeSec float64) {
+	bootedAt := time.Now().Add(-time.Duration(uptimeSec * float64(time.Second)))
+
+	s.mu.Lock()
+	device, exists := s.devices[deviceID]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	previous := device.BootedAt
+	if !previous.IsZero() && bootedAt.Sub(previous).Abs() <= deviceBootJitter {
+		s.mu.Unlock()
+		return
+	}
+	device.BootedAt = bootedAt
+	callbacks := append([]func(string, time.Time){}, s.bootCallbacks...)
+	s.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(deviceID, bootedAt)
+	}
+}
+
+// PowerState returns the last reported relay state of a device; known is false until it reports one
+func (s *MQTTDeviceService) PowerState(deviceID string) (on bool, known bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	device, exists := s.devices[deviceID]
+	if !exists || device.On == nil {
+		return false, false
+	}
+	return *device.On, true
+}
+
+// emitReading passes the latest energy state of a device to the reading callbacks and time series
+func (s *MQTTDeviceService) emitReading(deviceID string, voltage, current, rssi *float64) {
+	s.mu.RLock()
+	device, exists := s.devices[deviceID]
+	if !exists || device.PowerW == nil {
+		s.mu.RUnlock()
+		return
+	}
+	config := s.configs[deviceID]
+	reading := EnergyReading{
+		DeviceID:   deviceID,
+		DeviceName: device.DeviceName,
+		RoomID:     device.RoomID,
+		Tags:       config.Tags,
+		PowerW:     *device.PowerW,
+		IsOn:       device.On == nil || *device.On,
+		Timestamp:  time.Now(),
+	}
+	if device.EnergyWh != nil {
+		reading.EnergyWh = *device.EnergyWh
+	}
+	if voltage != nil {
+		reading.VoltageV = *voltage
+	}
+	if current != nil {
+		reading.CurrentA = *current
+	}
+	if rssi != nil {
+		reading.SignalStrength = *rssi
+	}
+	callbacks := append([]func(EnergyReading){}, s.readingCallbacks...)
+	s.mu.RUnlock()
+
+	if s.tsClient != nil {
+		if err := s.tsClient.WriteEnergyReading(context.Background(), reading.DeviceID, reading.RoomID,
+			reading.PowerW, reading.EnergyWh, reading.VoltageV, reading.CurrentA, reading.IsOn, reading.Timestamp); err != nil {
+			s.logger.Error("Failed to write energy reading", err, map[string]interface{}{
+				"device_id": deviceID,
+			})
+		}
+	}
+	for _, callback := range callbacks {
+		callback(reading)
+	}
+}
+
+// reportClimate records a temperature and humidity and publishes them for the device's room.
+// Temperatures are converted to °F, the unit of the room sensors.
+func (s *MQTTDeviceService) reportClimate(deviceID string, temperature *float64, unit string, humidity *float64) {
+	if temperature != nil && !strings.EqualFold(unit, "F") {
+		fahrenheit := *temperature*9/5 + 32
+		temperature = &fahrenheit
+	}
+	if temperature == nil && humidity == nil {
+		return
+	}
+
+	s.update(deviceID, nil, func(device *MQTTDeviceStatus) {
+		device.Temperature = orKeep(temperature, device.Temperature)
+		device.Humidity = orKeep(humidity, device.Humidity)
+	})
+	if temperature != nil {
+		s.publishRoomSensor(deviceID, mqtt.TopicRoomTemperature, UnifiedSensorMessage{Temperature: *temperature, TempUnit: "F"})
+	}
+	if humidity != nil {
+		s.publishRoomSensor(deviceID, mqtt.TopicRoomHumidity, UnifiedSensorMessage{Humidity: *humidity, HumidityUnit: "%"})
+	}
+}
+
+// publishRoomSensor publishes a reading on the room sensor topic, as a Pi Pico would
+func (s *MQTTDeviceService) publishRoomSensor(deviceID, root string, message UnifiedSensorMessage) {
+	s.mu.RLock()
+	config := s.configs[deviceID]
+	s.mu.RUnlock()
+	if s.mqttClient == nil || config.RoomID == "" {
+		return
+	}
+
+	message.Room = config.RoomID
+	message.Sensor = config.Firmware
+	message.DeviceID = deviceID
+	message.Timestamp = time.Now().Unix()
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	msg := (&mqtt.Message{Topic: mqtt.RoomTopic(root, config.RoomID), Payload: payload, QoS: 1}).
+		WithProperty(mqtt.PropertyDevice, deviceID).WithProperty(mqtt.PropertyRoom, config.RoomID)
+	if err := s.mqttClient.Publish(msg); err != nil {
+		s.logger.Error("Failed to publish room sensor reading", err, map[string]interface{}{
+			"device_id": deviceID,
+			"topic":     msg.Topic,
+		})
+	}
+}
+
+// ExecuteCommand translates a device command into the device's command topic and publishes it
+func (s *MQTTDeviceService) ExecuteCommand(cmd *models.DeviceCommand) error {
+	s.mu.RLock()
+	config, exists := s.configs[cmd.DeviceID]
+	providers := s.providers
+	s.mu.RUnlock()
+	if !exists {
+		for _, provider := range providers {
+			if provider.Handles(cmd.DeviceID) {
+				return s.executeProvided(provider, cmd)
+			}
+		}
+		return errors.NewValidationError(fmt.Sprintf("device %s not found", cmd.DeviceID), nil)
+	}
+
+	message, err := commandMessage(config, cmd)
+	if err != nil {
+		return err
+	}
+
+	if !s.safeMode.Allowed(safemode.ComponentDevice, cmd.DeviceID) {
+		return errors.NewBusinessError(fmt.Sprintf("Safe mode active, command '%s' on device %s not executed", cmd.Action, cmd.DeviceID), nil)
+	}
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("mqtt-device", cmd.Action, cmd.DeviceID, "device command requested", map[string]interface{}{
+			"topic":   message.Topic,
+			"payload": string(message.Payload),
+		})
+		return nil
+	}
+	if s.mqttClient == nil {
+		return errors.NewServiceError("no MQTT client to send commands", nil)
+	}
+
+	if err := s.mqttClient.Publish(message); err != nil {
+		return errors.NewDeviceError(fmt.Sprintf("failed to send '%s' to %s", cmd.Action, cmd.DeviceID), err)
+	}
+	s.logger.Info("Sent device command", map[string]interface{}{
+		"device_id": cmd.DeviceID,
+		"action":    cmd.Action,
+		"topic":     message.Topic,
+	})
+	return nil
+}
+
+// executeProvided hands a command for a provider's device to the provider
+func (s *MQTTDeviceService) executeProvided(provider DeviceProvider, cmd *models.DeviceCommand) error {
+	if !s.safeMode.Allowed(safemode.ComponentDevice, cmd.DeviceID) {
+		return errors.NewBusinessError(fmt.Sprintf("Safe mode active, command '%s' on device %s not executed", cmd.Action, cmd.DeviceID), nil)
+	}
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("mqtt-device", cmd.Action, cmd.DeviceID, "device command requested", map[string]interface{}{
+			"value": cmd.Value,
+		})
+		return nil
+	}
+	return provider.SendCommand(cmd)
+}
+
+// commandMessage translates a device command for the firmware of a device
+func commandMessage(config MQTTDeviceConfig, cmd *models.DeviceCommand) (*mqtt.Message, error) {
+	value, _ := cmd.Value.(float64)
+	unsupported := errors.NewValidationError(fmt.Sprintf("%s device %s does not support '%s'", config.Firmware, config.DeviceID, cmd.Action), nil)
+
+	if config.Firmware == FirmwareTasmota {
+		var command tasmota.Command
+		switch cmd.Action {
+		case "turn_on", "turn_off":
+			command = tasmota.Power(cmd.Action == "turn_on")
+		case "set_brightness":
+			command = tasmota.Dimmer(int(value))
+		case "set_color_temp":
+			command = tasmota.ColorTemp(int(value))
+		case "set_color":
+			hue, saturation, ok := parseHueSaturation(cmd.Value)
+			if !ok {
+				return nil, errors.NewValidationError(fmt.Sprintf("invalid color value: %v", cmd.Value), nil)
+			}
+			command = tasmota.HueSaturation(int(hue), int(saturation))
+		default:
+			return nil, unsupported
+		}
+		return &mqtt.Message{Topic: tasmota.CommandTopic(config.Topic, command.Name), Payload: []byte(command.Payload), QoS: 1}, nil
+	}
+
+	topic := esphome.CommandTopic(config.Topic, config.Component, config.ObjectID)
+	if config.Component == esphome.ComponentSwitch {
+		if cmd.Action != "turn_on" && cmd.Action != "turn_off" {
+			return nil, unsupported
+		}
+		return &mqtt.Message{Topic: topic, Payload: esphome.SwitchCommand(cmd.Action == "turn_on"), QoS: 1}, nil
+	}
+
+	var payload []byte
+	switch cmd.Action {
+	case "turn_on", "turn_off":
+		payload = esphome.PowerCommand(cmd.Action == "turn_on")
+	case "set_brightness":
+		payload = esphome.BrightnessCommand(int(value))
+	case "set_color_temp":
+		payload = esphome.ColorTempCommand(int(value))
+	case "set_color":
+		hue, saturation, ok := parseHueSaturation(cmd.Value)
+		if !ok {
+			return nil, errors.NewValidationError(fmt.Sprintf("invalid color value: %v", cmd.Value), nil)
+		}
+		payload = esphome.ColorCommand(int(hue), int(saturation))
+	default:
+		return nil, unsupported
+	}
+	return &mqtt.Message{Topic: topic, Payload: payload, QoS: 1}, nil
+}
+
+// Devices returns the status of every device, sorted by ID
+func (s *MQTTDeviceService) Devices() []MQTTDeviceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	devices := make([]MQTTDeviceStatus, 0, len(s.devices))
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	for _, provider := range s.providers {
+		for _, device := range provider.Devices() {
+			if _, configured := s.configs[device.DeviceID]; !configured {
+				devices = append(devices, device)
+			}
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices
+}
+
+// Handler serves the status of every device as JSON
+func (s *MQTTDeviceService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"devices": s.Devices(),
+		})
+	})
+}
+
+// CommandHandler executes a device command posted as JSON, e.g. {"device_id": "desk-lamp", "action": "turn_on"}
+func (s *MQTTDeviceService) CommandHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to send a command", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var cmd models.DeviceCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, fmt.Sprintf("invalid command: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.ExecuteCommand(&cmd); err != nil {
+			status := http.StatusBadGateway
+			if appErr, ok := err.(*errors.HomeAutomationError); ok {
+				switch appErr.Type {
+				case errors.ErrorTypeValidation:
+					status = http.StatusBadRequest
+				case errors.ErrorTypeBusiness:
+					status = http.StatusConflict
+				}
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// orKeep returns value, or previous when value is nil
+func orKeep(value, previous *float64) *float64 {
+	if value != nil {
+		return value
+	}
+	return previous
+}
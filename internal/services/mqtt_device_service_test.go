@@ -0,0 +1,151 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func TestMQTTDeviceTelemetry(t *testing.T) {
+	service := NewMQTTDeviceService(nil, nil, nil)
+	if err := service.AddDevice(MQTTDeviceConfig{DeviceID: "garage-plug", RoomID: "garage", Firmware: FirmwareTasmota, Topic: "garage_plug", Tags: []string{"exterior"}}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if err := service.AddDevice(MQTTDeviceConfig{DeviceID: "desk", RoomID: "office", Firmware: FirmwareESPHome, Topic: "desk-node",
+		Sensors: map[string]string{"power": "desk_power"}}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	var readings []EnergyReading
+	service.AddReadingCallback(func(reading EnergyReading) {
+		readings = append(readings, reading)
+	})
+
+	tasmotaMessages := map[string]string{
+		"stat/garage_plug/POWER":  "ON",
+		"tele/garage_plug/SENSOR": `{"ENERGY":{"Total":1.5,"Power":42,"Voltage":120,"Current":0.35},"DS18B20":{"Temperature":20}}`,
+	}
+	for _, topic := range []string{"stat/garage_plug/POWER", "tele/garage_plug/SENSOR"} {
+		if err := service.tasmotaHandler("garage-plug")(topic, []byte(tasmotaMessages[topic])); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+	}
+	service.esphomeHandler("desk")("desk-node/switch/relay/state", []byte("OFF"))
+	service.esphomeHandler("desk")("desk-node/sensor/desk_power/state", []byte("3.2"))
+
+	if len(readings) != 2 {
+		t.Fatalf("Expected a reading from each plug, got %+v", readings)
+	}
+	if plug := readings[0]; plug.DeviceID != "garage-plug" || plug.PowerW != 42 || plug.EnergyWh != 1500 || plug.VoltageV != 120 || !plug.IsOn || plug.Tags[0] != "exterior" {
+		t.Errorf("Unexpected Tasmota reading %+v", plug)
+	}
+	if desk := readings[1]; desk.DeviceID != "desk" || desk.PowerW != 3.2 || desk.IsOn {
+		t.Errorf("Unexpected ESPHome reading %+v", desk)
+	}
+
+	devices := service.Devices()
+	if garage := devices[1]; garage.Temperature == nil || *garage.Temperature != 68 || !garage.Online {
+		t.Errorf("Expected the plug's 20 C sensor as 68 F, got %+v", garage)
+	}
+	if on, known := service.PowerState("garage-plug"); !on || !known {
+		t.Error("Expected the plug reported on")
+	}
+
+	// Uptime reports are only passed on when the device has booted since the last one
+	var boots []string
+	service.AddBootCallback(func(deviceID string, bootedAt time.Time) {
+		boots = append(boots, deviceID)
+	})
+	service.tasmotaHandler("garage-plug")("tele/garage_plug/STATE", []byte(`{"UptimeSec":30,"POWER":"ON"}`))
+	service.tasmotaHandler("garage-plug")("tele/garage_plug/STATE", []byte(`{"UptimeSec":31,"POWER":"ON"}`))
+	service.esphomeHandler("desk")("desk-node/sensor/uptime/state", []byte("12"))
+	if len(boots) != 2 || boots[0] != "garage-plug" || boots[1] != "desk" {
+		t.Errorf("Expected a boot of each device, got %v", boots)
+	}
+}
+
+func TestMQTTDeviceCommands(t *testing.T) {
+	tasmota := MQTTDeviceConfig{DeviceID: "bulb", Firmware: FirmwareTasmota, Topic: "porch_bulb"}
+	light := MQTTDeviceConfig{DeviceID: "lamp", Firmware: FirmwareESPHome, Topic: "lamp-node", Component: "light", ObjectID: "lamp"}
+	relay := MQTTDeviceConfig{DeviceID: "fan", Firmware: FirmwareESPHome, Topic: "fan-node", Component: "switch", ObjectID: "relay"}
+
+	tests := []struct {
+		config         MQTTDeviceConfig
+		cmd            models.DeviceCommand
+		topic, payload string
+	}{
+		{tasmota, models.DeviceCommand{Action: "turn_on"}, "cmnd/porch_bulb/POWER", "ON"},
+		{tasmota, models.DeviceCommand{Action: "set_brightness", Value: 40.0}, "cmnd/porch_bulb/Dimmer", "40"},
+		{light, models.DeviceCommand{Action: "set_color_temp", Value: 4000.0}, "lamp-node/light/lamp/command", `{"state":"ON","color_temp":250}`},
+		{relay, models.DeviceCommand{Action: "turn_off"}, "fan-node/switch/relay/command", "OFF"},
+	}
+	for _, test := range tests {
+		message, err := commandMessage(test.config, &test.cmd)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.config.DeviceID, test.cmd.Action, err)
+		}
+		if message.Topic != test.topic || string(message.Payload) != test.payload {
+			t.Errorf("Expected %s %s, got %s %s", test.topic, test.payload, message.Topic, message.Payload)
+		}
+	}
+
+	if _, err := commandMessage(relay, &models.DeviceCommand{Action: "set_brightness", Value: 50.0}); err == nil {
+		t.Error("Expected a switch to reject set_brightness")
+	}
+
+	service := NewMQTTDeviceService(nil, nil, nil)
+	if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "missing", Action: "turn_on"}); err == nil {
+		t.Error("Expected a command for an unknown device to fail")
+	}
+	if err := service.AddDevice(MQTTDeviceConfig{DeviceID: "x", Firmware: "shelly", Topic: "x"}); err == nil {
+		t.Error("Expected an unknown firmware to be rejected")
+	}
+}
+
+// fakeProvider handles the devices it lists and records the commands it gets
+type fakeProvider struct {
+	devices []MQTTDeviceStatus
+	sent    []string
+}
+
+func (p *fakeProvider) Devices() []MQTTDeviceStatus { return p.devices }
+
+func (p *fakeProvider) Handles(deviceID string) bool {
+	for _, device := range p.devices {
+		if device.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *fakeProvider) SendCommand(cmd *models.DeviceCommand) error {
+	p.sent = append(p.sent, cmd.DeviceID+" "+cmd.Action)
+	return nil
+}
+
+func TestMQTTDeviceProviders(t *testing.T) {
+	service := NewMQTTDeviceService(nil, nil, nil)
+	if err := service.AddDevice(MQTTDeviceConfig{DeviceID: "bulb", Firmware: FirmwareTasmota, Topic: "porch_bulb"}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	provider := &fakeProvider{devices: []MQTTDeviceStatus{{DeviceID: "zigbee-bulb"}, {DeviceID: "bulb"}}}
+	service.AddDeviceProvider(provider)
+
+	// The configured bulb takes precedence over the provider's
+	devices := service.Devices()
+	if len(devices) != 2 || devices[0].DeviceID != "bulb" || devices[1].DeviceID != "zigbee-bulb" {
+		t.Fatalf("Expected the configured bulb and the provider's, got %+v", devices)
+	}
+
+	if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "zigbee-bulb", Action: "turn_on"}); err != nil {
+		t.Fatalf("ExecuteCommand failed: %v", err)
+	}
+	if len(provider.sent) != 1 || provider.sent[0] != "zigbee-bulb turn_on" {
+		t.Fatalf("Expected the command handed to the provider, got %v", provider.sent)
+	}
+	if err := service.ExecuteCommand(&models.DeviceCommand{DeviceID: "missing", Action: "turn_on"}); err == nil {
+		t.Error("Expected a command for a device no provider handles to fail")
+	}
+}
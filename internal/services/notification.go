@@ -0,0 +1,28 @@
+package services
+
+import (
+	"encoding/json"
+
+	"github.com/johnpr01/home-automation/internal/i18n"
+)
+
+// localizedNotification encodes a notification with its title and message in the global locale.
+// When residents use other locales, their translations are added by locale, so that a phone or
+// chat bridge can show each resident their own.
+func localizedNotification(fields map[string]interface{}, title, message i18n.Localizable) ([]byte, error) {
+	locales := i18n.Locales()
+	fields["title"] = title.In(locales[0])
+	fields["message"] = message.In(locales[0])
+	fields["locale"] = locales[0]
+	if len(locales) > 1 {
+		translations := make(map[string]map[string]string)
+		for _, locale := range locales[1:] {
+			translations[locale] = map[string]string{
+				"title":   title.In(locale),
+				"message": message.In(locale),
+			}
+		}
+		fields["translations"] = translations
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestNotificationsTranslated(t *testing.T) {
+	t.Cleanup(func() {
+		i18n.SetLocale(i18n.English)
+		i18n.SetUserLocale("alex", "")
+	})
+	if err := i18n.SetLocale("es"); err != nil {
+		t.Fatal(err)
+	}
+	i18n.SetUserLocale("alex", "fr")
+
+	service := NewHazardService(&HazardConfig{Rules: []HazardRule{{Hazard: HazardSmoke}}}, nil)
+	var notification map[string]interface{}
+	service.publish = func(msg *mqtt.Message) error {
+		return json.Unmarshal(msg.Payload, &notification)
+	}
+	service.handle("kitchen", HazardSmoke, true, time.Date(2025, 3, 1, 14, 5, 0, 0, time.UTC))
+
+	if notification["locale"] != "es" || notification["title"] != "Alarma: Humo en kitchen" ||
+		notification["message"] != "El detector de humo de kitchen se activó a las 14:05" {
+		t.Errorf("Expected the notification in Spanish, got %v", notification)
+	}
+	translations, _ := notification["translations"].(map[string]interface{})
+	french, _ := translations["fr"].(map[string]interface{})
+	if len(translations) != 1 || french["title"] != "Fumée détectée dans kitchen" {
+		t.Errorf("Expected the French translation for alex, got %v", notification["translations"])
+	}
+
+	// The alert's stored message follows the global locale
+	rule := &AlertRule{ID: "attic-heat", Metric: AlertMetricTemperature, Above: alertThreshold(90)}
+	alert := &Alert{}
+	alert.describe(firingMessage(rule, alertSample{subject: "attic", value: 95}, time.Now()))
+	if alert.Message != "attic: temperatura de 95.0°F, por encima de 90.0°F." {
+		t.Errorf("Unexpected alert message %q", alert.Message)
+	}
+}
@@ -0,0 +1,669 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// OTAFileName holds the firmware version of every Pico and the updates in progress
+const OTAFileName = "ota.json"
+
+// OTAFirmwarePath is the path the firmware files are served under, followed by the version and
+// the file, e.g. /ota/firmware/1.2.0/main.py
+const OTAFirmwarePath = "/ota/firmware/"
+
+// Update states of a Pico. Pending, downloading and installing are reported until the Pico
+// comes back with the new version, or fails.
+const (
+	OTAPending     = "pending"
+	OTADownloading = "downloading"
+	OTAInstalling  = "installing"
+	OTAUpdated     = "updated"
+	OTAFailed      = "failed"
+)
+
+const (
+	defaultOTATimeoutMinutes = 15
+	otaCheckInterval         = time.Minute
+)
+
+// validFirmwareVersion matches the release directory names, which end up in URLs and topics
+var validFirmwareVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// OTAConfig says where the firmware releases are and how Picos download them
+type OTAConfig struct {
+	Dir            string `json:"dir"`                       // A directory per release, named by its version
+	BaseURL        string `json:"base_url"`                  // The unified debug server as Picos reach it, e.g. http://192.168.1.100:6060
+	TimeoutMinutes int    `json:"timeout_minutes,omitempty"` // 15 by default
+}
+
+// LoadOTAConfig reads the OTA settings from a JSON file
+func LoadOTAConfig(path string) (*OTAConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read OTA file", err)
+	}
+
+	var cfg OTAConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse OTA file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the release directory and base URL are set and fills in the timeout
+func (c *OTAConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.NewValidationError("OTA needs the firmware directory", nil)
+	}
+	base, err := url.Parse(c.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return errors.NewValidationError(fmt.Sprintf("OTA base_url %q must be an http or https URL", c.BaseURL), err)
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	if c.TimeoutMinutes < 0 {
+		return errors.NewValidationError("timeout_minutes must not be negative", nil)
+	}
+	if c.TimeoutMinutes == 0 {
+		c.TimeoutMinutes = defaultOTATimeoutMinutes
+	}
+	return nil
+}
+
+// FirmwareFile is one file of a release, installed at Path on the Pico
+type FirmwareFile struct {
+	Path   string `json:"path"`
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// FirmwareRelease is a version of the Pico firmware. Its hash covers every file's path and hash.
+type FirmwareRelease struct {
+	Version string         `json:"version"`
+	SHA256  string         `json:"sha256"`
+	Files   []FirmwareFile `json:"files"`
+	Created time.Time      `json:"created"`
+}
+
+// OTACommand is the retained update command a Pico installs
+type OTACommand struct {
+	Version string         `json:"version"`
+	SHA256  string         `json:"sha256"`
+	Files   []FirmwareFile `json:"files"`
+}
+
+// OTAProgress is what a Pico reports while installing an update
+type OTAProgress struct {
+	Version string `json:"version"`
+	State   string `json:"state"` // downloading, installing or failed
+	Error   string `json:"error,omitempty"`
+}
+
+// PicoFirmware is the firmware a Pico runs and its update in progress
+type PicoFirmware struct {
+	DeviceID        string     `json:"device_id"`
+	RoomID          string     `json:"room_id,omitempty"`
+	Version         string     `json:"version"`
+	PreviousVersion string     `json:"previous_version,omitempty"` // Rolled back to
+	LastSeen        time.Time  `json:"last_seen"`
+	Target          string     `json:"target,omitempty"` // Version being installed
+	State           string     `json:"state,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+}
+
+// updating reports whether an update was sent and hasn't finished
+func (p *PicoFirmware) updating() bool {
+	return p.State == OTAPending || p.State == OTADownloading || p.State == OTAInstalling
+}
+
+// OTAService hosts the Pico firmware releases, sends update commands and follows the version
+// every Pico reports until it runs the new release
+type OTAService struct {
+	config   *OTAConfig
+	path     string
+	publish  func(*mqtt.Message) error
+	devices  map[string]*PicoFirmware
+	safeMode *safemode.Controller
+	dryRun   *dryrun.Recorder
+	logger   *logger.Logger
+	mu       sync.Mutex
+}
+
+// NewOTAService creates the service for a validated configuration. Versions and updates are
+// kept at path, or in memory if empty.
+func NewOTAService(cfg *OTAConfig, path string, serviceLogger *logger.Logger) *OTAService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("OTAService", nil)
+	}
+
+	service := &OTAService{
+		config:  cfg,
+		path:    path,
+		devices: make(map[string]*PicoFirmware),
+		logger:  serviceLogger,
+	}
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load Pico firmware versions", err)
+		}
+	}
+	return service
+}
+
+// OTAPath returns the OTA state file inside the state directory
+func OTAPath(stateDir string) string {
+	return filepath.Join(stateDir, OTAFileName)
+}
+
+// SetSafeMode attaches a safe mode controller that blocks updating Picos
+func (s *OTAService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces updates in observe-only mode
+func (s *OTAService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// Subscribe sends update commands with the client and follows the Picos' progress
+func (s *OTAService) Subscribe(client *mqtt.Client) error {
+	s.publish = client.Publish
+	return client.Subscribe(mqtt.OTAStatusTopic("+"), func(topic string, payload []byte) error {
+		return s.handleProgress(topic, payload, time.Now())
+	})
+}
+
+// Run fails updates that haven't finished within the timeout until ctx is done
+func (s *OTAService) Run(ctx context.Context) {
+	ticker := time.NewTicker(otaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.checkTimeouts(now)
+		}
+	}
+}
+
+// Releases returns the releases in the firmware directory, newest first
+func (s *OTAService) Releases() ([]FirmwareRelease, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, errors.NewSystemError("failed to read firmware directory", err)
+	}
+
+	releases := make([]FirmwareRelease, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !validFirmwareVersion.MatchString(entry.Name()) {
+			continue
+		}
+		release, err := s.release(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(release.Files) > 0 {
+			releases = append(releases, *release)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if !releases[i].Created.Equal(releases[j].Created) {
+			return releases[i].Created.After(releases[j].Created)
+		}
+		return releases[i].Version > releases[j].Version
+	})
+	return releases, nil
+}
+
+// release hashes the files of a release. Hidden files are left out.
+func (s *OTAService) release(version string) (*FirmwareRelease, error) {
+	if !validFirmwareVersion.MatchString(version) {
+		return nil, errors.NewValidationError(fmt.Sprintf("invalid firmware version %q", version), nil)
+	}
+	root := filepath.Join(s.config.Dir, version)
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return nil, errors.NewValidationError(fmt.Sprintf("firmware release %s not found", version), err)
+	}
+
+	release := &FirmwareRelease{Version: version, Created: info.ModTime().UTC()}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		file := FirmwareFile{Path: filepath.ToSlash(relative)}
+		file.URL = s.config.BaseURL + OTAFirmwarePath + version + "/" + file.Path
+		file.SHA256, file.Size, err = hashFile(path)
+		if err != nil {
+			return err
+		}
+		release.Files = append(release.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.NewSystemError(fmt.Sprintf("failed to read firmware release %s", version), err)
+	}
+
+	// WalkDir visits files in lexical order, so the hash doesn't depend on the file system
+	hash := sha256.New()
+	for _, file := range release.Files {
+		fmt.Fprintf(hash, "%s %s\n", file.SHA256, file.Path)
+	}
+	release.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return release, nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// HandleFirmwareVersion records the version a Pico reports. An update finishes when the Pico
+// reports its target version.
+func (s *OTAService) HandleFirmwareVersion(deviceID, roomID, version string) {
+	s.handleVersion(deviceID, roomID, version, time.Now())
+}
+
+func (s *OTAService) handleVersion(deviceID, roomID, version string, now time.Time) {
+	if deviceID == "" || version == "" {
+		return
+	}
+
+	s.mu.Lock()
+	device, known := s.devices[deviceID]
+	if !known {
+		device = &PicoFirmware{DeviceID: deviceID}
+		s.devices[deviceID] = device
+	}
+	changed := device.Version != version || device.RoomID != roomID
+	if device.Version != "" && device.Version != version {
+		device.PreviousVersion = device.Version
+	}
+	device.Version, device.RoomID, device.LastSeen = version, roomID, now
+
+	finished := device.updating() && device.Target == version
+	if finished {
+		device.State, device.Error = OTAUpdated, ""
+		device.FinishedAt = &now
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+	s.mu.Unlock()
+
+	if finished {
+		s.logger.Info("Pico firmware updated", map[string]interface{}{
+			"device_id": deviceID,
+			"version":   version,
+		})
+		s.clearCommand(deviceID)
+	}
+}
+
+// handleProgress follows a Pico downloading and installing its update
+func (s *OTAService) handleProgress(topic string, payload []byte, now time.Time) error {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 4 {
+		return nil
+	}
+	deviceID := levels[2]
+
+	var progress OTAProgress
+	if err := json.Unmarshal(payload, &progress); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid OTA progress from %s", deviceID), err)
+	}
+
+	s.mu.Lock()
+	device, known := s.devices[deviceID]
+	if !known || !device.updating() || progress.Version != device.Target {
+		s.mu.Unlock()
+		return nil
+	}
+	switch progress.State {
+	case OTADownloading, OTAInstalling:
+		device.State = progress.State
+	case OTAFailed:
+		device.State, device.Error = OTAFailed, progress.Error
+		device.FinishedAt = &now
+	default:
+		s.mu.Unlock()
+		return nil
+	}
+	s.save()
+	s.mu.Unlock()
+
+	if progress.State == OTAFailed {
+		s.logger.Warn("Pico firmware update failed", map[string]interface{}{
+			"device_id": deviceID,
+			"version":   progress.Version,
+			"error":     progress.Error,
+		})
+		s.clearCommand(deviceID)
+	}
+	return nil
+}
+
+// checkTimeouts fails the updates of Picos that haven't come back with their target version
+func (s *OTAService) checkTimeouts(now time.Time) {
+	timeout := time.Duration(s.config.TimeoutMinutes) * time.Minute
+
+	var timedOut []string
+	s.mu.Lock()
+	for _, device := range s.devices {
+		if device.updating() && device.StartedAt != nil && now.Sub(*device.StartedAt) >= timeout {
+			device.State = OTAFailed
+			device.Error = fmt.Sprintf("still on %s after %d minutes", device.Version, s.config.TimeoutMinutes)
+			device.FinishedAt = &now
+			timedOut = append(timedOut, device.DeviceID)
+		}
+	}
+	if len(timedOut) > 0 {
+		s.save()
+	}
+	s.mu.Unlock()
+
+	for _, deviceID := range timedOut {
+		s.logger.Warn("Pico firmware update timed out", map[string]interface{}{"device_id": deviceID})
+		s.clearCommand(deviceID)
+	}
+}
+
+// Rollout sends the update to a release to the Picos, or to every Pico not running it when
+// none are given, and returns the Picos it was sent to. Picos already running the release are
+// skipped.
+func (s *OTAService) Rollout(version string, deviceIDs []string) ([]string, error) {
+	release, err := s.release(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(release.Files) == 0 {
+		return nil, errors.NewValidationError(fmt.Sprintf("firmware release %s has no files", version), nil)
+	}
+
+	s.mu.Lock()
+	if len(deviceIDs) == 0 {
+		for deviceID := range s.devices {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		sort.Strings(deviceIDs)
+	}
+	var targets []string
+	for _, deviceID := range deviceIDs {
+		device, known := s.devices[deviceID]
+		if !known {
+			s.mu.Unlock()
+			return nil, errors.NewValidationError(fmt.Sprintf("Pico %s hasn't reported a firmware version", deviceID), nil)
+		}
+		if device.Version != version || device.updating() {
+			targets = append(targets, deviceID)
+		}
+	}
+	s.mu.Unlock()
+
+	command := OTACommand{Version: release.Version, SHA256: release.SHA256, Files: release.Files}
+	var sent []string
+	for _, deviceID := range targets {
+		if err := s.sendCommand(deviceID, command); err != nil {
+			return sent, err
+		}
+		sent = append(sent, deviceID)
+	}
+	return sent, nil
+}
+
+// Rollback sends the update to the version each Pico ran before its current one
+func (s *OTAService) Rollback(deviceIDs []string) ([]string, error) {
+	if len(deviceIDs) == 0 {
+		return nil, errors.NewValidationError("rollback needs the Picos to roll back", nil)
+	}
+
+	previous := make(map[string]string)
+	s.mu.Lock()
+	for _, deviceID := range deviceIDs {
+		device, known := s.devices[deviceID]
+		if !known || device.PreviousVersion == "" {
+			s.mu.Unlock()
+			return nil, errors.NewValidationError(fmt.Sprintf("Pico %s has no previous firmware version", deviceID), nil)
+		}
+		previous[deviceID] = device.PreviousVersion
+	}
+	s.mu.Unlock()
+
+	var sent []string
+	for _, deviceID := range deviceIDs {
+		release, err := s.release(previous[deviceID])
+		if err != nil {
+			return sent, err
+		}
+		command := OTACommand{Version: release.Version, SHA256: release.SHA256, Files: release.Files}
+		if err := s.sendCommand(deviceID, command); err != nil {
+			return sent, err
+		}
+		sent = append(sent, deviceID)
+	}
+	return sent, nil
+}
+
+// sendCommand publishes the retained update command for a Pico, so one that's asleep or
+// reconnecting still receives it
+func (s *OTAService) sendCommand(deviceID string, command OTACommand) error {
+	if !s.safeMode.Allowed(safemode.ComponentDevice, deviceID) {
+		return errors.NewBusinessError(fmt.Sprintf("Safe mode active, Pico %s not updated", deviceID), nil)
+	}
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("ota", "update", deviceID, "firmware update requested", map[string]interface{}{"version": command.Version})
+		return nil
+	}
+	if s.publish == nil {
+		return errors.NewServiceError("OTA updates need an MQTT client", nil)
+	}
+
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return errors.NewSystemError("failed to marshal OTA command", err)
+	}
+	if err := s.publish(&mqtt.Message{Topic: mqtt.OTAUpdateTopic(deviceID), Payload: payload, QoS: 1, Retain: true}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	device := s.devices[deviceID]
+	device.Target, device.State, device.Error = command.Version, OTAPending, ""
+	device.StartedAt, device.FinishedAt = &now, nil
+	from := device.Version
+	s.save()
+	s.mu.Unlock()
+
+	s.logger.Info("Sent Pico firmware update", map[string]interface{}{
+		"device_id": deviceID,
+		"from":      from,
+		"to":        command.Version,
+	})
+	return nil
+}
+
+// clearCommand removes a finished update's retained command, so the Pico doesn't install it
+// again when it reconnects
+func (s *OTAService) clearCommand(deviceID string) {
+	if s.publish == nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: mqtt.OTAUpdateTopic(deviceID), QoS: 1, Retain: true}); err != nil {
+		s.logger.Error("Failed to clear OTA command", err, map[string]interface{}{"device_id": deviceID})
+	}
+}
+
+// Devices returns the firmware of every Pico that reported a version, sorted by ID
+func (s *OTAService) Devices() []PicoFirmware {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]PicoFirmware, 0, len(s.devices))
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices
+}
+
+// Handler serves the releases and the firmware of every Pico as JSON
+func (s *OTAService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		releases, err := s.Releases()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"releases": releases,
+			"devices":  s.Devices(),
+		})
+	})
+}
+
+// RolloutHandler sends an update on a POST of {"version": "1.2.0", "devices": ["pico-kitchen"]};
+// without devices every Pico is updated. A POST to the rollback path of {"devices": [...]} rolls
+// them back instead.
+func (s *OTAService) RolloutHandler(rollback bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to update Picos", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Version string   `json:"version"`
+			Devices []string `json:"devices"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid OTA request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var sent []string
+		var err error
+		if rollback {
+			sent, err = s.Rollback(request.Devices)
+		} else {
+			sent, err = s.Rollout(request.Version, request.Devices)
+		}
+		if err != nil {
+			status := http.StatusBadGateway
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if sent == nil {
+			sent = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": sent})
+	})
+}
+
+// FirmwareHandler serves the release files to the Picos, which download them without a token
+func (s *OTAService) FirmwareHandler() http.Handler {
+	return http.StripPrefix(OTAFirmwarePath, http.FileServer(http.Dir(s.config.Dir)))
+}
+
+func (s *OTAService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read OTA state", err)
+	}
+	if err := json.Unmarshal(data, &s.devices); err != nil {
+		return errors.NewSystemError("failed to parse OTA state", err)
+	}
+	return nil
+}
+
+// save keeps the versions and updates; the caller holds the lock
+func (s *OTAService) save() {
+	if s.path == "" {
+		return
+	}
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save OTA state", err)
+	}
+}
+
+func (s *OTAService) write() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.devices, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal OTA state", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write OTA state", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace OTA state", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func writeFirmware(t *testing.T, dir, version, main string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, version), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"main.py": main, "sht30.py": "# driver", ".notes": "left out"} {
+		if err := os.WriteFile(filepath.Join(dir, version, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOTAService(t *testing.T) {
+	dir := t.TempDir()
+	writeFirmware(t, dir, "1.0.0", "VERSION = '1.0.0'")
+	writeFirmware(t, dir, "1.1.0", "VERSION = '1.1.0'")
+	cfg := &OTAConfig{Dir: dir, BaseURL: "http://gateway:6060/"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), OTAFileName)
+	service := NewOTAService(cfg, path, nil)
+	commands := make(map[string][]byte)
+	service.publish = func(msg *mqtt.Message) error {
+		if !msg.Retain {
+			t.Errorf("Expected the command on %s retained", msg.Topic)
+		}
+		commands[msg.Topic] = msg.Payload
+		return nil
+	}
+
+	now := time.Now()
+	service.handleVersion("pico-kitchen", "kitchen", "1.0.0", now)
+	service.handleVersion("pico-office", "office", "1.1.0", now)
+
+	if _, err := service.Rollout("2.0.0", nil); err == nil {
+		t.Fatal("Expected a rollout of a missing release to fail")
+	}
+	if _, err := service.Rollout("1.1.0", []string{"pico-garage"}); err == nil {
+		t.Fatal("Expected a rollout to an unknown Pico to fail")
+	}
+
+	// Picos already running the release are skipped
+	sent, err := service.Rollout("1.1.0", nil)
+	if err != nil || len(sent) != 1 || sent[0] != "pico-kitchen" {
+		t.Fatalf("Expected the update sent to the kitchen only, got %v, %v", sent, err)
+	}
+	var command OTACommand
+	if err := json.Unmarshal(commands["home/ota/pico-kitchen/update"], &command); err != nil {
+		t.Fatalf("Expected an update command, got %v", err)
+	}
+	if command.Version != "1.1.0" || len(command.Files) != 2 || command.SHA256 == "" {
+		t.Fatalf("Unexpected command %+v", command)
+	}
+	if file := command.Files[0]; file.Path != "main.py" || file.URL != "http://gateway:6060/ota/firmware/1.1.0/main.py" || file.Size != 17 {
+		t.Fatalf("Unexpected file %+v", file)
+	}
+
+	// Progress from the Pico, then the new version in its sensor messages
+	service.handleProgress("home/ota/pico-kitchen/status", []byte(`{"version":"1.1.0","state":"downloading"}`), now)
+	if device := service.Devices()[0]; device.State != OTADownloading {
+		t.Fatalf("Expected the kitchen downloading, got %+v", device)
+	}
+	service.handleVersion("pico-kitchen", "kitchen", "1.1.0", now.Add(time.Minute))
+	device := service.Devices()[0]
+	if device.State != OTAUpdated || device.Version != "1.1.0" || device.PreviousVersion != "1.0.0" {
+		t.Fatalf("Expected the kitchen updated, got %+v", device)
+	}
+	if len(commands["home/ota/pico-kitchen/update"]) != 0 {
+		t.Fatal("Expected the retained command cleared")
+	}
+
+	// Rolling back installs the previous version, and a Pico that never comes back fails
+	if _, err := service.Rollback([]string{"pico-office"}); err == nil {
+		t.Fatal("Expected a rollback without a previous version to fail")
+	}
+	if sent, err := service.Rollback([]string{"pico-kitchen"}); err != nil || len(sent) != 1 {
+		t.Fatalf("Rollback failed: %v, %v", sent, err)
+	}
+	if !strings.Contains(string(commands["home/ota/pico-kitchen/update"]), `"version":"1.0.0"`) {
+		t.Fatalf("Expected the rollback to 1.0.0 sent, got %s", commands["home/ota/pico-kitchen/update"])
+	}
+	service.checkTimeouts(time.Now().Add(time.Duration(cfg.TimeoutMinutes) * time.Minute))
+	if device := service.Devices()[0]; device.State != OTAFailed || device.Error == "" {
+		t.Fatalf("Expected the rollback timed out, got %+v", device)
+	}
+
+	// Versions survive a restart
+	restarted := NewOTAService(cfg, path, nil)
+	if devices := restarted.Devices(); len(devices) != 2 || devices[0].PreviousVersion != "1.0.0" {
+		t.Fatalf("Expected the versions restored from disk, got %+v", devices)
+	}
+
+	releases, err := service.Releases()
+	if err != nil || len(releases) != 2 {
+		t.Fatalf("Expected two releases, got %+v, %v", releases, err)
+	}
+}
+
+func TestOTAConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   OTAConfig
+		valid bool
+	}{
+		{"no dir", OTAConfig{BaseURL: "http://gateway:6060"}, false},
+		{"no base url", OTAConfig{Dir: "/srv/firmware"}, false},
+		{"relative base url", OTAConfig{Dir: "/srv/firmware", BaseURL: "gateway:6060"}, false},
+		{"negative timeout", OTAConfig{Dir: "/srv/firmware", BaseURL: "http://gateway:6060", TimeoutMinutes: -1}, false},
+		{"valid", OTAConfig{Dir: "/srv/firmware", BaseURL: "http://gateway:6060"}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.cfg.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
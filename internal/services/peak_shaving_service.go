@@ -0,0 +1,564 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// PeakShavingFileName holds the loads shed for a peak inside the state directory
+const PeakShavingFileName = "peak-shaving.json"
+
+const (
+	defaultPeakShedAfter     = 30 * time.Second
+	defaultPeakRestoreAfter  = 5 * time.Minute
+	defaultPeakMinOffMinutes = 10
+	defaultPeakPoll          = 10 * time.Second
+
+	// peakSettle is the least time between two switches, for the readings to catch up
+	peakSettle = 30 * time.Second
+	// peakReadingMaxAge is how long a plug or meter reading counts towards the home's power
+	peakReadingMaxAge = 5 * time.Minute
+)
+
+// PeakLoad is a plug that may be switched off while the home draws more than its budget
+type PeakLoad struct {
+	DeviceID string `json:"device_id"`
+	// PowerW is what the load draws when on, to check it fits back in the budget; the draw
+	// before it was shed when 0
+	PowerW        float64 `json:"power_w,omitempty"`
+	MinOffMinutes int     `json:"min_off_minutes,omitempty"` // Default 10
+}
+
+// PeakMeter is a CT-clamp meter publishing its power over MQTT, as {"power_w": 1234},
+// {"power": 1234}, Tasmota's {"ENERGY": {"Power": 1234}} or a bare number
+type PeakMeter struct {
+	Topic string `json:"topic"`
+	// IncludesPlugs is set for a clamp on the mains, which measures the plugs too. A clamp on
+	// other circuits is added to the plugs.
+	IncludesPlugs bool `json:"includes_plugs,omitempty"`
+}
+
+// PeakShavingConfig sets the power budget of the home and the loads shed to keep within it. Loads
+// are shed in the order listed, the least important first, and restored in reverse.
+type PeakShavingConfig struct {
+	BudgetW float64 `json:"budget_w"`
+	// RestoreMarginW is how far below the budget the home must stay, with the load back on, for a
+	// shed load to return; 10% of the budget by default
+	RestoreMarginW      float64    `json:"restore_margin_w,omitempty"`
+	ShedAfterSeconds    int        `json:"shed_after_seconds,omitempty"`    // Default 30
+	RestoreAfterMinutes int        `json:"restore_after_minutes,omitempty"` // Default 5
+	Meter               *PeakMeter `json:"meter,omitempty"`
+	Loads               []PeakLoad `json:"loads"`
+}
+
+// LoadPeakShavingConfig reads the power budget and sheddable loads from a JSON file
+func LoadPeakShavingConfig(path string) (*PeakShavingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read peak shaving file", err)
+	}
+
+	var cfg PeakShavingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse peak shaving file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the budget and loads, filling in the defaults
+func (c *PeakShavingConfig) Validate() error {
+	if c.BudgetW <= 0 {
+		return errors.NewValidationError("budget_w must be positive", nil)
+	}
+	if c.RestoreMarginW < 0 || c.ShedAfterSeconds < 0 || c.RestoreAfterMinutes < 0 {
+		return errors.NewValidationError("restore_margin_w, shed_after_seconds and restore_after_minutes must not be negative", nil)
+	}
+	if c.RestoreMarginW == 0 {
+		c.RestoreMarginW = c.BudgetW / 10
+	}
+	if c.RestoreMarginW >= c.BudgetW {
+		return errors.NewValidationError(fmt.Sprintf("restore_margin_w %.0f must be below the budget of %.0f W", c.RestoreMarginW, c.BudgetW), nil)
+	}
+	if c.Meter != nil && c.Meter.Topic == "" {
+		return errors.NewValidationError("the meter needs a topic", nil)
+	}
+	if len(c.Loads) == 0 {
+		return errors.NewValidationError("peak shaving needs loads to shed", nil)
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Loads {
+		load := &c.Loads[i]
+		if load.DeviceID == "" || seen[load.DeviceID] {
+			return errors.NewValidationError("every load needs a unique device_id", nil)
+		}
+		seen[load.DeviceID] = true
+		if load.PowerW < 0 || load.MinOffMinutes < 0 {
+			return errors.NewValidationError(fmt.Sprintf("load %s: power_w and min_off_minutes must not be negative", load.DeviceID), nil)
+		}
+		if load.MinOffMinutes == 0 {
+			load.MinOffMinutes = defaultPeakMinOffMinutes
+		}
+	}
+	return nil
+}
+
+// PeakShavingPath returns where the shed loads are kept under the state directory
+func PeakShavingPath(stateDir string) string {
+	return filepath.Join(stateDir, PeakShavingFileName)
+}
+
+// ShedLoad is a load switched off for a peak
+type ShedLoad struct {
+	DeviceID string    `json:"device_id"`
+	PowerW   float64   `json:"power_w"` // Draw before it was shed
+	ShedAt   time.Time `json:"shed_at"`
+	// Confirmed once a reading shows the plug off, so it turning on again is a resident's doing
+	Confirmed bool `json:"confirmed,omitempty"`
+}
+
+// PeakShavingStatus is the home's power against its budget and the loads shed
+type PeakShavingStatus struct {
+	BudgetW    float64    `json:"budget_w"`
+	PowerW     float64    `json:"power_w"`
+	PlugsW     float64    `json:"plugs_w"`
+	MeterW     *float64   `json:"meter_w,omitempty"`
+	OverSince  time.Time  `json:"over_since,omitempty"`
+	UnderSince time.Time  `json:"under_since,omitempty"` // Below the budget less the margin
+	Shed       []ShedLoad `json:"shed"`
+}
+
+// PeakShavingService keeps the whole-home power, the sum of the Tapo plugs and an optional
+// CT-clamp meter, within a budget. A peak lasting ShedAfterSeconds switches off the next load
+// of the priority list, one at a time, and loads return once the home has stayed well below the
+// budget long enough for them to fit again.
+type PeakShavingService struct {
+	config     *PeakShavingConfig
+	path       string
+	switchPlug func(deviceID string, on bool) error
+	chargers   *ChargerService
+	plugs      map[string]EnergyReading
+	meterW     float64
+	meterAt    time.Time
+	overSince  time.Time
+	underSince time.Time
+	lastSwitch time.Time
+	shed       []ShedLoad // In the order shed
+	logger     *logger.Logger
+	mu         sync.Mutex
+
+	power  prometheus.Gauge
+	budget prometheus.Gauge
+	loads  prometheus.Gauge
+	sheds  prometheus.Counter
+}
+
+// NewPeakShavingService creates the peak-shaving controller. Loads shed are kept at path, so a
+// restart still restores them, or in memory if empty.
+func NewPeakShavingService(cfg *PeakShavingConfig, path string, serviceLogger *logger.Logger) *PeakShavingService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("PeakShavingService", nil)
+	}
+
+	service := &PeakShavingService{
+		config: cfg,
+		path:   path,
+		plugs:  make(map[string]EnergyReading),
+		logger: serviceLogger,
+		power: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_power_watts",
+			Help: "Whole-home power draw tracked against the budget",
+		}),
+		budget: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_power_budget_watts",
+			Help: "Power budget of the home",
+		}),
+		loads: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "home_power_shed_loads",
+			Help: "Loads currently switched off to keep within the power budget",
+		}),
+		sheds: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "home_power_load_sheds_total",
+			Help: "Loads switched off to keep within the power budget",
+		}),
+	}
+	service.budget.Set(cfg.BudgetW)
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load shed loads, they are not restored", err)
+		}
+	}
+	service.loads.Set(float64(len(service.shed)))
+	return service
+}
+
+// RegisterMetrics registers the power budget metrics
+func (s *PeakShavingService) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{s.power, s.budget, s.loads, s.sheds} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register peak shaving metrics", err)
+		}
+	}
+	return nil
+}
+
+// SetTapoService switches the loads' plugs; safe mode and dry runs apply as for any plug
+func (s *PeakShavingService) SetTapoService(tapo *TapoService) {
+	s.switchPlug = tapo.SetDeviceState
+}
+
+// SetChargerService lets loads name EV chargers, which are paused rather than switched off.
+// Their readings arrive through RecordPlugReading like a plug's.
+func (s *PeakShavingService) SetChargerService(chargers *ChargerService) {
+	s.chargers = chargers
+}
+
+// RecordPlugReading adds a plug's power to the home's; it fits AddReadingCallback. A shed load
+// turned back on by a resident is theirs again and isn't shed for the rest of the peak.
+func (s *PeakShavingService) RecordPlugReading(reading EnergyReading) {
+	if reading.Estimated {
+		return
+	}
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugs[reading.DeviceID] = reading
+
+	for i := range s.shed {
+		load := &s.shed[i]
+		if load.DeviceID != reading.DeviceID || !reading.Timestamp.After(load.ShedAt) {
+			continue
+		}
+		switch {
+		case !reading.IsOn && !load.Confirmed:
+			load.Confirmed = true
+			s.save()
+		case reading.IsOn && load.Confirmed:
+			s.logger.Info("Shed load turned back on by hand", map[string]interface{}{"device_id": load.DeviceID})
+			s.shed = append(s.shed[:i], s.shed[i+1:]...)
+			s.loads.Set(float64(len(s.shed)))
+			s.save()
+		}
+		return
+	}
+}
+
+// HandleMeter records the power of the CT-clamp meter
+func (s *PeakShavingService) HandleMeter(powerW float64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meterW, s.meterAt = powerW, at
+}
+
+// Subscribe follows the CT-clamp meter, when there is one
+func (s *PeakShavingService) Subscribe(client *mqtt.Client) error {
+	if s.config.Meter == nil {
+		return nil
+	}
+	return client.Subscribe(s.config.Meter.Topic, func(topic string, payload []byte) error {
+		powerW, err := parseMeterPower(payload)
+		if err != nil {
+			return err
+		}
+		s.HandleMeter(powerW, time.Now())
+		return nil
+	})
+}
+
+// parseMeterPower reads the power of a meter message
+func parseMeterPower(payload []byte) (float64, error) {
+	if powerW, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		return powerW, nil
+	}
+
+	var message struct {
+		PowerW *float64 `json:"power_w"`
+		Power  *float64 `json:"power"`
+		Energy *struct {
+			Power *float64 `json:"Power"`
+		} `json:"ENERGY"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, errors.NewValidationError("invalid meter message", err)
+	}
+	switch {
+	case message.PowerW != nil:
+		return *message.PowerW, nil
+	case message.Power != nil:
+		return *message.Power, nil
+	case message.Energy != nil && message.Energy.Power != nil:
+		return *message.Energy.Power, nil
+	}
+	return 0, errors.NewValidationError("meter message carries no power", nil)
+}
+
+// Run checks the home's power until the context is cancelled
+func (s *PeakShavingService) Run(ctx context.Context) {
+	ticker := time.NewTicker(defaultPeakPoll)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Evaluate(time.Now()); err != nil {
+			s.logger.Error("Failed to switch peak load", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate sheds the next load while the home has been over budget for ShedAfterSeconds, or
+// restores the most important shed load that fits once it has stayed below the budget less the
+// margin for RestoreAfterMinutes. At most one load is switched per call, and none within 30
+// seconds of the last switch, so the readings show its effect first.
+func (s *PeakShavingService) Evaluate(now time.Time) error {
+	if s.switchPlug == nil && s.chargers == nil {
+		return errors.NewServiceError("peak shaving has no Tapo service", nil)
+	}
+
+	s.mu.Lock()
+	status := s.status(now)
+	s.power.Set(status.PowerW)
+	settled := now.Sub(s.lastSwitch) >= peakSettle
+
+	var deviceID, reason string
+	var on bool
+	var drawW float64
+	switch {
+	case status.PowerW > s.config.BudgetW:
+		s.underSince = time.Time{}
+		if s.overSince.IsZero() {
+			s.overSince = now
+		}
+		shedAfter := defaultPeakShedAfter
+		if s.config.ShedAfterSeconds > 0 {
+			shedAfter = time.Duration(s.config.ShedAfterSeconds) * time.Second
+		}
+		if settled && now.Sub(s.overSince) >= shedAfter {
+			if load, reading, ok := s.nextToShed(now); ok {
+				deviceID, drawW = load.DeviceID, reading.PowerW
+				reason = fmt.Sprintf("home at %.0f W, over the %.0f W budget", status.PowerW, s.config.BudgetW)
+			}
+		}
+	case status.PowerW <= s.config.BudgetW-s.config.RestoreMarginW:
+		s.overSince = time.Time{}
+		if s.underSince.IsZero() {
+			s.underSince = now
+		}
+		restoreAfter := defaultPeakRestoreAfter
+		if s.config.RestoreAfterMinutes > 0 {
+			restoreAfter = time.Duration(s.config.RestoreAfterMinutes) * time.Minute
+		}
+		if settled && now.Sub(s.underSince) >= restoreAfter {
+			if load, ok := s.nextToRestore(status.PowerW, now); ok {
+				deviceID, on = load.DeviceID, true
+				reason = fmt.Sprintf("home at %.0f W, within the %.0f W budget", status.PowerW, s.config.BudgetW)
+			}
+		}
+	default:
+		// Between the budget and the margin: neither shed nor restore
+		s.overSince, s.underSince = time.Time{}, time.Time{}
+	}
+	s.mu.Unlock()
+
+	if deviceID == "" {
+		return nil
+	}
+	if err := switchLoad(s.chargers, s.switchPlug, deviceID, on); err != nil {
+		return errors.NewDeviceError(fmt.Sprintf("failed to switch peak load %s", deviceID), err)
+	}
+
+	s.mu.Lock()
+	s.lastSwitch = now
+	if on {
+		for i, load := range s.shed {
+			if load.DeviceID == deviceID {
+				s.shed = append(s.shed[:i], s.shed[i+1:]...)
+				break
+			}
+		}
+	} else {
+		s.shed = append(s.shed, ShedLoad{DeviceID: deviceID, PowerW: drawW, ShedAt: now})
+		s.sheds.Inc()
+	}
+	s.loads.Set(float64(len(s.shed)))
+	s.save()
+	s.mu.Unlock()
+
+	action := "Shed load"
+	if on {
+		action = "Restored load"
+	}
+	s.logger.Info(action, map[string]interface{}{"device_id": deviceID, "reason": reason})
+	return nil
+}
+
+// nextToShed returns the first load of the priority list that is on and not shed yet
+func (s *PeakShavingService) nextToShed(now time.Time) (PeakLoad, EnergyReading, bool) {
+	for _, load := range s.config.Loads {
+		if s.isShed(load.DeviceID) {
+			continue
+		}
+		reading, known := s.plugs[load.DeviceID]
+		if known && reading.IsOn && now.Sub(reading.Timestamp) <= peakReadingMaxAge {
+			return load, reading, true
+		}
+	}
+	return PeakLoad{}, EnergyReading{}, false
+}
+
+// nextToRestore returns the shed load last shed, the most important, that has been off long
+// enough and fits back within the budget less the margin
+func (s *PeakShavingService) nextToRestore(powerW float64, now time.Time) (PeakLoad, bool) {
+	for i := len(s.shed) - 1; i >= 0; i-- {
+		shed := s.shed[i]
+		load, configured := s.configuredLoad(shed.DeviceID)
+		if !configured {
+			// No longer a load of the configuration; give it back
+			return PeakLoad{DeviceID: shed.DeviceID}, true
+		}
+		if now.Sub(shed.ShedAt) < time.Duration(load.MinOffMinutes)*time.Minute {
+			continue
+		}
+		drawW := load.PowerW
+		if drawW == 0 {
+			drawW = shed.PowerW
+		}
+		if powerW+drawW <= s.config.BudgetW-s.config.RestoreMarginW {
+			return load, true
+		}
+	}
+	return PeakLoad{}, false
+}
+
+func (s *PeakShavingService) isShed(deviceID string) bool {
+	for _, load := range s.shed {
+		if load.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PeakShavingService) configuredLoad(deviceID string) (PeakLoad, bool) {
+	for _, load := range s.config.Loads {
+		if load.DeviceID == deviceID {
+			return load, true
+		}
+	}
+	return PeakLoad{}, false
+}
+
+// status adds up the home's power from the fresh plug and meter readings
+func (s *PeakShavingService) status(now time.Time) PeakShavingStatus {
+	status := PeakShavingStatus{
+		BudgetW:    s.config.BudgetW,
+		OverSince:  s.overSince,
+		UnderSince: s.underSince,
+		Shed:       append([]ShedLoad{}, s.shed...),
+	}
+	for _, reading := range s.plugs {
+		if now.Sub(reading.Timestamp) <= peakReadingMaxAge {
+			status.PlugsW += reading.PowerW
+		}
+	}
+	status.PowerW = status.PlugsW
+
+	if s.config.Meter != nil && !s.meterAt.IsZero() && now.Sub(s.meterAt) <= peakReadingMaxAge {
+		meterW := s.meterW
+		status.MeterW = &meterW
+		if s.config.Meter.IncludesPlugs {
+			status.PowerW = meterW
+		} else {
+			status.PowerW += meterW
+		}
+	}
+	return status
+}
+
+// Status returns the home's power against its budget and the loads shed
+func (s *PeakShavingService) Status(now time.Time) PeakShavingStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(now)
+}
+
+// Handler serves the peak shaving status as JSON
+func (s *PeakShavingService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(time.Now()))
+	})
+}
+
+func (s *PeakShavingService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read shed loads", err)
+	}
+	if err := json.Unmarshal(data, &s.shed); err != nil {
+		return errors.NewSystemError("failed to parse shed loads", err)
+	}
+	return nil
+}
+
+// save keeps the shed loads; the caller holds the lock
+func (s *PeakShavingService) save() {
+	if s.path == "" {
+		return
+	}
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save shed loads", err)
+	}
+}
+
+func (s *PeakShavingService) write() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.shed, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal shed loads", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write shed loads", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace shed loads", err)
+	}
+	return nil
+}
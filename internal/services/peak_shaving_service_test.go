@@ -0,0 +1,117 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeakShaving(t *testing.T) {
+	cfg := &PeakShavingConfig{
+		BudgetW: 5000,
+		Meter:   &PeakMeter{Topic: "home/meter", IncludesPlugs: true},
+		Loads: []PeakLoad{
+			{DeviceID: "pool-pump"},
+			{DeviceID: "water-heater", PowerW: 2000, MinOffMinutes: 5},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), PeakShavingFileName)
+	service := NewPeakShavingService(cfg, path, nil)
+	plugs := map[string]bool{"pool-pump": true, "water-heater": true}
+	service.switchPlug = func(deviceID string, on bool) error {
+		plugs[deviceID] = on
+		return nil
+	}
+
+	start := time.Date(2024, 7, 1, 17, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	read := func(seconds int, meterW float64) {
+		for id, on := range plugs {
+			power := 0.0
+			if on {
+				power = 1000
+			}
+			service.RecordPlugReading(EnergyReading{DeviceID: id, PowerW: power, IsOn: on, Timestamp: at(seconds)})
+		}
+		service.HandleMeter(meterW, at(seconds))
+		if err := service.Evaluate(at(seconds)); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	// A peak sheds the least important load once it has lasted, then the next
+	read(0, 6500)
+	if !plugs["pool-pump"] {
+		t.Fatal("Expected a short peak to be ridden out")
+	}
+	read(30, 6500)
+	if plugs["pool-pump"] || !plugs["water-heater"] {
+		t.Fatalf("Expected the pool pump shed first, got %v", plugs)
+	}
+	read(40, 5500)
+	if !plugs["water-heater"] {
+		t.Fatal("Expected time for the readings to catch up before shedding again")
+	}
+	read(60, 5500)
+	if plugs["water-heater"] {
+		t.Fatal("Expected the water heater shed while the peak lasts")
+	}
+	if status := service.Status(at(60)); len(status.Shed) != 2 || status.PowerW != 5500 || *status.MeterW != 5500 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	// The most important load returns first, once it fits within the budget less the margin
+	for seconds := 120; seconds <= 420; seconds += 60 {
+		read(seconds, 2400)
+	}
+	if !plugs["water-heater"] || plugs["pool-pump"] {
+		t.Fatalf("Expected only the water heater restored, got %v", plugs)
+	}
+
+	// A restart remembers the pool pump is still shed
+	restarted := NewPeakShavingService(cfg, path, nil)
+	if shed := restarted.Status(at(420)).Shed; len(shed) != 1 || shed[0].DeviceID != "pool-pump" || !shed[0].Confirmed {
+		t.Fatalf("Expected the shed pool pump restored from disk, got %+v", shed)
+	}
+
+	// A resident turning the pump back on takes it out of the controller's hands
+	plugs["pool-pump"] = true
+	read(480, 4700)
+	if shed := service.Status(at(480)).Shed; len(shed) != 0 {
+		t.Errorf("Expected the pump turned on by hand no longer shed, got %+v", shed)
+	}
+}
+
+func TestParseMeterPower(t *testing.T) {
+	for payload, want := range map[string]float64{
+		`1234.5`:                      1234.5,
+		`{"power_w": 800}`:            800,
+		`{"power": 650}`:              650,
+		`{"ENERGY": {"Power": 2100}}`: 2100,
+	} {
+		if got, err := parseMeterPower([]byte(payload)); err != nil || got != want {
+			t.Errorf("%s: expected %.1f, got %.1f %v", payload, want, got, err)
+		}
+	}
+	if _, err := parseMeterPower([]byte(`{"voltage": 230}`)); err == nil {
+		t.Error("Expected a message without power rejected")
+	}
+}
+
+func TestPeakShavingConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]PeakShavingConfig{
+		"no budget":      {Loads: []PeakLoad{{DeviceID: "a"}}},
+		"no loads":       {BudgetW: 5000},
+		"duplicate load": {BudgetW: 5000, Loads: []PeakLoad{{DeviceID: "a"}, {DeviceID: "a"}}},
+		"margin":         {BudgetW: 5000, RestoreMarginW: 5000, Loads: []PeakLoad{{DeviceID: "a"}}},
+		"meter topic":    {BudgetW: 5000, Meter: &PeakMeter{}, Loads: []PeakLoad{{DeviceID: "a"}}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Signals that a gateway restart was caused by a power loss
+	PowerSignalHostReboot  = "host_reboot"  // The host booted shortly before and the last run never shut down
+	PowerSignalClockReset  = "clock_reset"  // The clock came up behind the last heartbeat or jumped forward after boot
+	PowerSignalDevicesBoot = "devices_boot" // Most devices booted together with the gateway
+	PowerSignalUPSShutdown = "ups_shutdown" // The last run shut down on a depleted UPS; enough on its own
+	PowerSignalManual      = "manual"       // The routine was started through the API
+
+	// Results of restoration actions
+	PowerActionOn       = "already_on"
+	PowerActionSwitched = "switched_on"
+	PowerActionSent     = "sent"
+	PowerActionSkipped  = "skipped"
+	PowerActionFailed   = "failed"
+
+	PowerStateFileName = "power-state.json"
+
+	powerHeartbeatInterval      = time.Minute
+	defaultPowerMinSignals      = 2
+	defaultPowerBootUptime      = 10 * time.Minute
+	defaultPowerReconnectWindow = 5 * time.Minute
+	defaultPowerDeviceBootRatio = 0.75
+)
+
+// PowerRestoreConfig configures power-loss detection and the routine run after an outage.
+// A restart counts as a power loss once MinSignals of the host reboot, clock reset and device
+// boot signals agree; a crash or a restart of the service alone raises at most one.
+type PowerRestoreConfig struct {
+	CriticalDevices        []string               `json:"critical_devices"`                   // Plugs that must be on, e.g. fridge, freezer, boiler
+	Rearm                  []models.DeviceCommand `json:"rearm,omitempty"`                    // Commands that re-arm security, sent after the plugs
+	MinSignals             int                    `json:"min_signals,omitempty"`              // Default 2
+	BootUptimeSeconds      int                    `json:"boot_uptime_seconds,omitempty"`      // Host uptime counting as a fresh boot, default 600
+	ReconnectWindowSeconds int                    `json:"reconnect_window_seconds,omitempty"` // Time given to devices to report back, default 300
+	DeviceBootRatio        float64                `json:"device_boot_ratio,omitempty"`        // Share of known devices booting with the gateway, default 0.75
+}
+
+// LoadPowerRestoreConfig reads the power restoration routine from a JSON file
+func LoadPowerRestoreConfig(path string) (*PowerRestoreConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read power restore file", err)
+	}
+
+	var cfg PowerRestoreConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse power restore file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the thresholds and that every re-arm command names a device and an action
+func (c *PowerRestoreConfig) Validate() error {
+	if c.MinSignals < 0 || c.MinSignals > 3 {
+		return errors.NewValidationError("min_signals must be between 1 and 3", nil)
+	}
+	if c.BootUptimeSeconds < 0 || c.ReconnectWindowSeconds < 0 {
+		return errors.NewValidationError("boot_uptime_seconds and reconnect_window_seconds must not be negative", nil)
+	}
+	if c.DeviceBootRatio < 0 || c.DeviceBootRatio > 1 {
+		return errors.NewValidationError("device_boot_ratio must be between 0 and 1", nil)
+	}
+	for i, cmd := range c.Rearm {
+		if cmd.DeviceID == "" || cmd.Action == "" {
+			return errors.NewValidationError(fmt.Sprintf("rearm command %d needs a device_id and an action", i+1), nil)
+		}
+	}
+	return nil
+}
+
+// PowerStateReader reports the last known relay state of a device; MQTTDeviceService implements it
+type PowerStateReader interface {
+	PowerState(deviceID string) (on bool, known bool)
+}
+
+// PowerRestoreAction is the outcome of one step of the restoration routine
+type PowerRestoreAction struct {
+	DeviceID string `json:"device_id"`
+	Action   string `json:"action"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PowerLossReport describes a detected power loss and what the restoration routine did
+type PowerLossReport struct {
+	DetectedAt    time.Time            `json:"detected_at"`
+	Signals       []string             `json:"signals"`
+	LastHeartbeat time.Time            `json:"last_heartbeat,omitempty"`
+	BootedAt      time.Time            `json:"booted_at,omitempty"`
+	Downtime      time.Duration        `json:"downtime,omitempty"` // Zero when the clock can't be trusted
+	DevicesBooted []string             `json:"devices_booted,omitempty"`
+	Actions       []PowerRestoreAction `json:"actions"`
+	Summary       string               `json:"summary"`
+}
+
+// PowerRestoreStatus reports the signals seen since the start and the last power loss
+type PowerRestoreStatus struct {
+	StartedAt  time.Time        `json:"started_at"`
+	BootedAt   time.Time        `json:"booted_at,omitempty"`
+	Signals    []string         `json:"signals"`
+	Evaluated  bool             `json:"evaluated"`
+	LastReport *PowerLossReport `json:"last_report,omitempty"`
+}
+
+// powerState is the persisted heartbeat, the devices seen and the last report
+type powerState struct {
+	Running       bool             `json:"running"`
+	LastHeartbeat time.Time        `json:"last_heartbeat"`
+	Devices       []string         `json:"devices,omitempty"`
+	UPSShutdown   string           `json:"ups_shutdown,omitempty"` // Why the last run shut down on battery
+	LastReport    *PowerLossReport `json:"last_report,omitempty"`
+}
+
+// PowerRestoreService notices gateway restarts caused by a power loss and runs the restoration
+// routine: critical plugs are switched back on if they came up off, security is re-armed and a
+// summary notification is sent. A heartbeat in the state directory tells how long the gateway
+// was down and whether it stopped cleanly.
+type PowerRestoreService struct {
+	config          *PowerRestoreConfig
+	path            string
+	minSignals      int
+	bootUptime      time.Duration
+	reconnectWindow time.Duration
+	bootRatio       float64
+	devices         CommandExecutor
+	powerStates     PowerStateReader
+	mqttClient      *mqtt.Client
+	safeMode        *safemode.Controller
+	dryRun          *dryrun.Recorder
+	uptime          func() (time.Duration, error)
+	state           powerState
+	previous        powerState // As left by the last run
+	startedAt       time.Time
+	bootedAt        time.Time
+	signals         map[string]bool
+	deviceBoots     map[string]time.Time
+	evaluated       bool
+	logger          *logger.Logger
+	mu              sync.Mutex
+}
+
+// PowerStatePath returns the power heartbeat file path for a state directory
+func PowerStatePath(stateDir string) string {
+	return filepath.Join(stateDir, PowerStateFileName)
+}
+
+// NewPowerRestoreService creates the power-loss detector; the state at path is read on Start
+func NewPowerRestoreService(cfg *PowerRestoreConfig, path string, serviceLogger *logger.Logger) *PowerRestoreService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("PowerRestoreService", nil)
+	}
+
+	service := &PowerRestoreService{
+		config:          cfg,
+		path:            path,
+		minSignals:      defaultPowerMinSignals,
+		bootUptime:      defaultPowerBootUptime,
+		reconnectWindow: defaultPowerReconnectWindow,
+		bootRatio:       defaultPowerDeviceBootRatio,
+		uptime:          hostUptime,
+		signals:         make(map[string]bool),
+		deviceBoots:     make(map[string]time.Time),
+		logger:          serviceLogger,
+	}
+	if cfg.MinSignals > 0 {
+		service.minSignals = cfg.MinSignals
+	}
+	if cfg.BootUptimeSeconds > 0 {
+		service.bootUptime = time.Duration(cfg.BootUptimeSeconds) * time.Second
+	}
+	if cfg.ReconnectWindowSeconds > 0 {
+		service.reconnectWindow = time.Duration(cfg.ReconnectWindowSeconds) * time.Second
+	}
+	if cfg.DeviceBootRatio > 0 {
+		service.bootRatio = cfg.DeviceBootRatio
+	}
+	return service
+}
+
+// SetCommandExecutor sends the plug and re-arm commands through a device or MQTT device service
+func (s *PowerRestoreService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetPowerStateReader lets the routine skip plugs that came back on by themselves
+func (s *PowerRestoreService) SetPowerStateReader(reader PowerStateReader) {
+	s.powerStates = reader
+}
+
+// SetMQTTClient attaches the client the summary notification is published with
+func (s *PowerRestoreService) SetMQTTClient(client *mqtt.Client) {
+	s.mqttClient = client
+}
+
+// SetSafeMode holds back the restoration commands while safe mode is active
+func (s *PowerRestoreService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder records the restoration commands instead of sending them in observe-only mode
+func (s *PowerRestoreService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// Start reads the state left by the last run, raises the host reboot and clock reset signals
+// and marks this run as running
+func (s *PowerRestoreService) Start(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startedAt = now
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.previous = s.state
+
+	if uptime, err := s.uptime(); err != nil {
+		s.logger.Warn("Host uptime unavailable, skipping the host reboot signal", map[string]interface{}{"error": err.Error()})
+	} else {
+		s.bootedAt = now.Add(-uptime)
+		if s.previous.Running && uptime <= s.bootUptime {
+			s.signals[PowerSignalHostReboot] = true
+		}
+	}
+
+	// A run that shut down on battery is followed by the restoration routine whatever the other signals say
+	if s.previous.UPSShutdown != "" {
+		s.signals[PowerSignalUPSShutdown] = true
+		s.state.UPSShutdown = ""
+	}
+
+	// Boards without an RTC come up at the last saved time, behind the last heartbeat
+	if !s.previous.LastHeartbeat.IsZero() && now.Round(0).Before(s.previous.LastHeartbeat) {
+		s.signals[PowerSignalClockReset] = true
+	}
+
+	s.state.Running = true
+	s.state.LastHeartbeat = now.Round(0)
+	return s.write()
+}
+
+// RecordUPSShutdown records that the gateway is shutting down on a depleted UPS, so the next
+// start runs the restoration routine
+func (s *PowerRestoreService) RecordUPSShutdown(at time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.UPSShutdown = reason
+	s.state.LastHeartbeat = at.Round(0)
+	return s.write()
+}
+
+// HandleDeviceBoot records the boot time a device reported; matches the boot callback signature
+func (s *PowerRestoreService) HandleDeviceBoot(deviceID string, bootedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deviceBoots[deviceID] = bootedAt
+	for _, known := range s.state.Devices {
+		if known == deviceID {
+			return
+		}
+	}
+	s.state.Devices = append(s.state.Devices, deviceID)
+	sort.Strings(s.state.Devices)
+}
+
+// Run writes the heartbeat and evaluates the signals once the devices had the reconnect window to
+// report back, until the context is cancelled
+func (s *PowerRestoreService) Run(ctx context.Context) {
+	ticker := time.NewTicker(powerHeartbeatInterval)
+	defer ticker.Stop()
+
+	evaluate := time.NewTimer(s.reconnectWindow)
+	defer evaluate.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-evaluate.C:
+			if report := s.evaluate(now); report != nil {
+				s.restore(report)
+			}
+		case now := <-ticker.C:
+			s.heartbeat(last, now)
+			last = now
+		}
+	}
+}
+
+// heartbeat records that the gateway is up. A wall clock running ahead of the monotonic clock
+// during the reconnect window means NTP corrected a clock that booted without an RTC.
+func (s *PowerRestoreService) heartbeat(last, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.evaluated && now.Round(0).Sub(last.Round(0))-now.Sub(last) > powerHeartbeatInterval {
+		s.signals[PowerSignalClockReset] = true
+	}
+	s.state.LastHeartbeat = now.Round(0)
+	s.save()
+}
+
+// evaluate decides whether the restart was a power loss and returns the report to restore from,
+// or nil for an ordinary restart
+func (s *PowerRestoreService) evaluate(now time.Time) *PowerLossReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.evaluated {
+		return nil
+	}
+	s.evaluated = true
+
+	booted := s.devicesBootedLocked()
+	known := len(s.previous.Devices)
+	if known > 0 && float64(len(booted)) >= s.bootRatio*float64(known) && len(booted) >= 2 {
+		s.signals[PowerSignalDevicesBoot] = true
+	}
+
+	signals := sortedKeys(s.signals)
+	if len(signals) < s.minSignals && !s.signals[PowerSignalUPSShutdown] {
+		if len(signals) > 0 {
+			s.logger.Info("Restart not considered a power loss", map[string]interface{}{"signals": signals, "needed": s.minSignals})
+		}
+		return nil
+	}
+
+	report := &PowerLossReport{
+		DetectedAt:    now.Round(0),
+		Signals:       signals,
+		LastHeartbeat: s.previous.LastHeartbeat,
+		BootedAt:      s.bootedAt.Round(0),
+		DevicesBooted: booted,
+	}
+	if !s.signals[PowerSignalClockReset] && !s.bootedAt.IsZero() && s.bootedAt.After(s.previous.LastHeartbeat) {
+		report.Downtime = s.bootedAt.Sub(s.previous.LastHeartbeat).Round(time.Second)
+	}
+	s.logger.Warn("Gateway restart caused by a power loss", map[string]interface{}{
+		"signals":  signals,
+		"downtime": report.Downtime.String(),
+		"devices":  len(booted),
+	})
+	return report
+}
+
+// devicesBootedLocked returns the devices that booted within the reconnect window of the gateway
+func (s *PowerRestoreService) devicesBootedLocked() []string {
+	if s.bootedAt.IsZero() {
+		return nil
+	}
+	var booted []string
+	for _, deviceID := range sortedKeys(s.deviceBoots) {
+		if s.deviceBoots[deviceID].Sub(s.bootedAt).Abs() <= s.reconnectWindow {
+			booted = append(booted, deviceID)
+		}
+	}
+	return booted
+}
+
+// Restore runs the restoration routine on demand, as after a power loss the gateway rode out
+func (s *PowerRestoreService) Restore() *PowerLossReport {
+	report := &PowerLossReport{DetectedAt: time.Now(), Signals: []string{PowerSignalManual}}
+	s.restore(report)
+	return report
+}
+
+// restore switches the critical plugs back on, re-arms security, notifies and saves the report
+func (s *PowerRestoreService) restore(report *PowerLossReport) {
+	if !s.safeMode.Allowed(safemode.ComponentAutomation, "power-restore") {
+		s.logger.Info("Safe mode active, skipping power restoration commands", nil)
+		for _, deviceID := range s.config.CriticalDevices {
+			report.Actions = append(report.Actions, PowerRestoreAction{DeviceID: deviceID, Action: "turn_on", Result: PowerActionSkipped, Error: "safe mode"})
+		}
+		for _, cmd := range s.config.Rearm {
+			report.Actions = append(report.Actions, PowerRestoreAction{DeviceID: cmd.DeviceID, Action: cmd.Action, Result: PowerActionSkipped, Error: "safe mode"})
+		}
+	} else {
+		for _, deviceID := range s.config.CriticalDevices {
+			if s.powerStates != nil {
+				if on, known := s.powerStates.PowerState(deviceID); known && on {
+					report.Actions = append(report.Actions, PowerRestoreAction{DeviceID: deviceID, Action: "turn_on", Result: PowerActionOn})
+					continue
+				}
+			}
+			cmd := models.DeviceCommand{DeviceID: deviceID, Action: "turn_on"}
+			report.Actions = append(report.Actions, s.send(cmd, PowerActionSwitched))
+		}
+		for _, cmd := range s.config.Rearm {
+			report.Actions = append(report.Actions, s.send(cmd, PowerActionSent))
+		}
+	}
+	summary := powerSummary(report)
+	report.Summary = summary.In(i18n.Locale())
+
+	s.notify(report, summary)
+
+	s.mu.Lock()
+	s.state.LastReport = report
+	s.save()
+	s.mu.Unlock()
+}
+
+// send executes one restoration command, recording it instead in observe-only mode
+func (s *PowerRestoreService) send(cmd models.DeviceCommand, result string) PowerRestoreAction {
+	action := PowerRestoreAction{DeviceID: cmd.DeviceID, Action: cmd.Action, Result: result}
+
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("power-restore", cmd.Action, cmd.DeviceID, "power restored after an outage", map[string]interface{}{"value": cmd.Value})
+		action.Result = PowerActionSkipped
+		action.Error = "observe-only"
+		return action
+	}
+
+	cmd.Options = map[string]interface{}{"automation": "power-restore"}
+	var err error
+	if s.devices == nil {
+		err = errors.NewServiceError("no device service to command "+cmd.DeviceID, nil)
+	} else {
+		err = s.devices.ExecuteCommand(&cmd)
+	}
+	if err != nil {
+		s.logger.Error("Power restoration command failed", err, map[string]interface{}{"device_id": cmd.DeviceID, "action": cmd.Action})
+		action.Result = PowerActionFailed
+		action.Error = err.Error()
+		return action
+	}
+	s.logger.Info("Power restoration command sent", map[string]interface{}{"device_id": cmd.DeviceID, "action": cmd.Action})
+	return action
+}
+
+// notify publishes the summary on the notification topic
+func (s *PowerRestoreService) notify(report *PowerLossReport, summary i18n.Localizable) {
+	if s.mqttClient == nil {
+		return
+	}
+
+	notification, err := localizedNotification(map[string]interface{}{
+		"source":    "power",
+		"signals":   report.Signals,
+		"timestamp": report.DetectedAt.Unix(),
+	}, i18n.T("power.restored.title"), summary)
+	if err != nil {
+		return
+	}
+	if err := s.mqttClient.Publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1}); err != nil {
+		s.logger.Error("Failed to publish power restoration notification", err)
+	}
+}
+
+// powerSummary describes the outage and the routine's results in one line
+func powerSummary(report *PowerLossReport) i18n.Sentences {
+	var parts i18n.Sentences
+	if report.Downtime > 0 {
+		parts = append(parts, i18n.T("power.back_after", report.Downtime))
+	} else if report.Signals[0] == PowerSignalManual {
+		parts = append(parts, i18n.T("power.on_request"))
+	} else {
+		parts = append(parts, i18n.T("power.unknown_outage"))
+	}
+
+	byResult := make(map[string][]string)
+	for _, action := range report.Actions {
+		byResult[action.Result] = append(byResult[action.Result], action.DeviceID)
+	}
+	for _, result := range []string{PowerActionSwitched, PowerActionOn, PowerActionSent, PowerActionFailed, PowerActionSkipped} {
+		if devices := byResult[result]; len(devices) > 0 {
+			parts = append(parts, i18n.T("power.result", i18n.T("power.action."+result), strings.Join(devices, ", ")))
+		}
+	}
+	return parts
+}
+
+// Stop marks the run stopped cleanly so the next start isn't taken for a power loss
+func (s *PowerRestoreService) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.Running = false
+	s.state.LastHeartbeat = time.Now().Round(0)
+	return s.write()
+}
+
+// Status returns the signals seen since the start and the last power loss report
+func (s *PowerRestoreService) Status() PowerRestoreStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return PowerRestoreStatus{
+		StartedAt:  s.startedAt,
+		BootedAt:   s.bootedAt,
+		Signals:    sortedKeys(s.signals),
+		Evaluated:  s.evaluated,
+		LastReport: s.state.LastReport,
+	}
+}
+
+// Handler serves the power restoration status as JSON
+func (s *PowerRestoreService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+// RestoreHandler runs the restoration routine on a POST and returns its report
+func (s *PowerRestoreService) RestoreHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Restore())
+	})
+}
+
+// hostUptime reads how long the host has been up from /proc/uptime
+func hostUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, errors.NewSystemError("failed to read host uptime", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.NewSystemError("empty /proc/uptime", nil)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, errors.NewSystemError("invalid /proc/uptime", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// load reads the state left by the last run; a missing or corrupt file starts fresh
+func (s *PowerRestoreService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read power state", err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		s.logger.Warn("Corrupt power state, starting fresh", map[string]interface{}{"error": err.Error()})
+		s.state = powerState{}
+	}
+	return nil
+}
+
+// save writes the state; a failed save is retried with the next heartbeat
+func (s *PowerRestoreService) save() {
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save power state", err)
+	}
+}
+
+func (s *PowerRestoreService) write() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal power state", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write power state", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace power state", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+type fakePowerStates map[string]bool
+
+func (f fakePowerStates) PowerState(deviceID string) (bool, bool) {
+	on, known := f[deviceID]
+	return on, known
+}
+
+// writePowerState leaves the state of a previous run behind
+func writePowerState(t *testing.T, path string, state powerState) {
+	data, _ := json.Marshal(state)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPowerRestoreAfterOutage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PowerStateFileName)
+	start := time.Date(2024, 3, 9, 7, 0, 0, 0, time.UTC)
+	writePowerState(t, path, powerState{Running: true, LastHeartbeat: start.Add(-time.Hour), Devices: []string{"alarm", "fridge", "freezer"}})
+
+	cfg := &PowerRestoreConfig{
+		CriticalDevices: []string{"fridge", "freezer"},
+		Rearm:           []models.DeviceCommand{{DeviceID: "alarm", Action: "turn_on"}},
+	}
+	executor := &recordingExecutor{}
+	service := NewPowerRestoreService(cfg, path, nil)
+	service.SetCommandExecutor(executor)
+	service.SetPowerStateReader(fakePowerStates{"fridge": true, "freezer": false})
+	service.uptime = func() (time.Duration, error) { return 2 * time.Minute, nil }
+
+	if err := service.Start(start); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for _, deviceID := range []string{"alarm", "fridge", "freezer"} {
+		service.HandleDeviceBoot(deviceID, start.Add(-100*time.Second))
+	}
+
+	report := service.evaluate(start.Add(5 * time.Minute))
+	if report == nil {
+		t.Fatal("Expected a power loss")
+	}
+	if strings.Join(report.Signals, ",") != "devices_boot,host_reboot" || report.Downtime != 58*time.Minute {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	service.restore(report)
+	if commands := executor.take(); len(commands) != 2 || commands[0] != "turn_on freezer" || commands[1] != "turn_on alarm" {
+		t.Errorf("Expected the freezer switched on and the alarm re-armed, got %v", commands)
+	}
+	if !strings.Contains(report.Summary, "58m0s") || !strings.Contains(report.Summary, "switched on: freezer") {
+		t.Errorf("Unexpected summary %q", report.Summary)
+	}
+
+	// The next start after a clean stop on a long-running host is an ordinary restart
+	if err := service.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	restarted := NewPowerRestoreService(cfg, path, nil)
+	restarted.uptime = func() (time.Duration, error) { return 72 * time.Hour, nil }
+	if err := restarted.Start(time.Now()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if report := restarted.evaluate(time.Now()); report != nil {
+		t.Errorf("Expected no power loss, got %+v", report)
+	}
+	if status := restarted.Status(); status.LastReport == nil || status.LastReport.Downtime != 58*time.Minute {
+		t.Errorf("Expected the last report kept, got %+v", status)
+	}
+}
+
+func TestPowerRestoreSingleSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PowerStateFileName)
+	start := time.Date(2024, 3, 9, 7, 0, 0, 0, time.UTC)
+
+	// A crash on a host that just booted raises only the host reboot signal
+	writePowerState(t, path, powerState{Running: true, LastHeartbeat: start.Add(-time.Minute)})
+	service := NewPowerRestoreService(&PowerRestoreConfig{CriticalDevices: []string{"fridge"}}, path, nil)
+	service.uptime = func() (time.Duration, error) { return time.Minute, nil }
+	if err := service.Start(start); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if report := service.evaluate(start.Add(5 * time.Minute)); report != nil {
+		t.Errorf("Expected no power loss, got %+v", report)
+	}
+
+	// A clock behind the last heartbeat adds the second signal
+	writePowerState(t, path, powerState{Running: true, LastHeartbeat: start.Add(time.Hour)})
+	service = NewPowerRestoreService(&PowerRestoreConfig{}, path, nil)
+	service.uptime = func() (time.Duration, error) { return time.Minute, nil }
+	if err := service.Start(start); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	report := service.evaluate(start.Add(5 * time.Minute))
+	if report == nil || report.Downtime != 0 {
+		t.Fatalf("Expected a power loss of unknown length, got %+v", report)
+	}
+	service.restore(report)
+	if !strings.Contains(report.Summary, "unknown length") {
+		t.Errorf("Unexpected summary %q", report.Summary)
+	}
+}
+
+func TestPowerRestoreAfterUPSShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PowerStateFileName)
+	now := time.Now()
+
+	service := NewPowerRestoreService(&PowerRestoreConfig{}, path, nil)
+	service.uptime = func() (time.Duration, error) { return 72 * time.Hour, nil }
+	if err := service.Start(now); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := service.RecordUPSShutdown(now, "battery at 19%"); err != nil {
+		t.Fatalf("RecordUPSShutdown failed: %v", err)
+	}
+	if err := service.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// The clean stop leaves only the UPS shutdown to go by
+	restarted := NewPowerRestoreService(&PowerRestoreConfig{}, path, nil)
+	restarted.uptime = func() (time.Duration, error) { return time.Minute, nil }
+	if err := restarted.Start(now.Add(time.Hour)); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	report := restarted.evaluate(now.Add(time.Hour + 5*time.Minute))
+	if report == nil || strings.Join(report.Signals, ",") != "ups_shutdown" || report.Downtime < 58*time.Minute {
+		t.Fatalf("Expected a power loss from the UPS shutdown, got %+v", report)
+	}
+}
+
+func TestPowerRestoreConfigValidate(t *testing.T) {
+	for _, cfg := range []PowerRestoreConfig{
+		{MinSignals: 4},
+		{DeviceBootRatio: 1.5},
+		{Rearm: []models.DeviceCommand{{DeviceID: "alarm"}}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
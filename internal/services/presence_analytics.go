@@ -0,0 +1,352 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+const (
+	// presenceDailyDays is how many days of daily occupancy totals a room keeps
+	presenceDailyDays = 90
+
+	presenceDateFormat = "2006-01-02"
+)
+
+// dayPresence is the occupancy of a room on one local calendar day
+type dayPresence struct {
+	Seconds      float64 `json:"seconds"`
+	MotionEvents int     `json:"motion_events"`
+}
+
+// PresenceDay is how long a room was occupied on a local calendar day
+type PresenceDay struct {
+	Date          string  `json:"date"` // YYYY-MM-DD
+	OccupiedHours float64 `json:"occupied_hours"`
+	MotionEvents  int     `json:"motion_events"`
+}
+
+// OccupancyPeriod is a stretch of a day a room is usually occupied, from Start to End as HH:MM.
+// An End of 24:00 runs to midnight.
+type OccupancyPeriod struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// TypicalDay is when a room is usually occupied on a day of the week
+type TypicalDay struct {
+	Day     string            `json:"day"`
+	Periods []OccupancyPeriod `json:"periods"`
+	// ExpectedHours sums the occupancy of the day's hours, the hours the room is occupied on average
+	ExpectedHours float64 `json:"expected_hours"`
+}
+
+// OccupancyAnalytics summarizes the occupancy of a room: its typical week, recent days, and
+// what the history expects now and next
+type OccupancyAnalytics struct {
+	RoomID string    `json:"room_id"`
+	Since  time.Time `json:"since"`
+	// Learned is true once there is a week of history; until then the schedule is a guess
+	Learned     bool    `json:"learned"`
+	OccupiedNow bool    `json:"occupied_now"`
+	ExpectedNow float64 `json:"expected_now"` // Typical occupancy of this hour of the week (0-1)
+	// NextOccupied is when the next typical occupied period starts, once learned
+	NextOccupied      *time.Time    `json:"next_occupied,omitempty"`
+	Schedule          []TypicalDay  `json:"schedule"`
+	Daily             []PresenceDay `json:"daily"`
+	AverageDailyHours float64       `json:"average_daily_hours"`
+}
+
+// day returns the daily totals of the local day of at, creating them
+func (room *roomPresence) day(at time.Time) *dayPresence {
+	if room.Daily == nil {
+		room.Daily = make(map[string]*dayPresence)
+	}
+	date := at.Local().Format(presenceDateFormat)
+	day, exists := room.Daily[date]
+	if !exists {
+		day = &dayPresence{}
+		room.Daily[date] = day
+	}
+	return day
+}
+
+// addDaily adds the seconds between start and end to the local days they fall in, and drops
+// days older than the kept history
+func (room *roomPresence) addDaily(start, end time.Time) {
+	start, end = start.Local(), end.Local()
+	for start.Before(end) {
+		next := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+		if next.After(end) {
+			next = end
+		}
+		room.day(start).Seconds += next.Sub(start).Seconds()
+		start = next
+	}
+
+	oldest := end.AddDate(0, 0, -presenceDailyDays).Format(presenceDateFormat)
+	for date := range room.Daily {
+		if date < oldest {
+			delete(room.Daily, date)
+		}
+	}
+}
+
+// daily returns the totals of the last days days up to now, oldest first, counting an
+// occupancy still going on; days without history are left out
+func (room *roomPresence) daily(days int, now time.Time) []PresenceDay {
+	totals := make(map[string]dayPresence, len(room.Daily))
+	for date, day := range room.Daily {
+		totals[date] = *day
+	}
+	if room.OccupiedSince != nil {
+		ongoing := &roomPresence{}
+		ongoing.addDaily(*room.OccupiedSince, now)
+		for date, day := range ongoing.Daily {
+			total := totals[date]
+			total.Seconds += day.Seconds
+			totals[date] = total
+		}
+	}
+
+	local := now.Local()
+	oldest := time.Date(local.Year(), local.Month(), local.Day()-days+1, 0, 0, 0, 0, local.Location())
+	var result []PresenceDay
+	for date, day := range totals {
+		if date < oldest.Format(presenceDateFormat) {
+			continue
+		}
+		result = append(result, PresenceDay{
+			Date:          date,
+			OccupiedHours: day.Seconds / 3600,
+			MotionEvents:  day.MotionEvents,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Date < result[j].Date
+	})
+	return result
+}
+
+// Analytics returns the occupancy analytics of a room with days of daily totals
+func (s *PresenceService) Analytics(roomID string, days int, now time.Time) (OccupancyAnalytics, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, exists := s.rooms[roomID]
+	if !exists {
+		return OccupancyAnalytics{}, false
+	}
+	return room.analytics(roomID, days, now), true
+}
+
+// AllAnalytics returns the occupancy analytics of every room, sorted by room ID
+func (s *PresenceService) AllAnalytics(days int, now time.Time) []OccupancyAnalytics {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	analytics := make([]OccupancyAnalytics, 0, len(s.rooms))
+	for roomID, room := range s.rooms {
+		analytics = append(analytics, room.analytics(roomID, days, now))
+	}
+	sort.Slice(analytics, func(i, j int) bool {
+		return analytics[i].RoomID < analytics[j].RoomID
+	})
+	return analytics
+}
+
+// NextOccupied returns when a room is next expected to become occupied from its typical week,
+// e.g. to start heating it in time. ok is false until a week of history has been learned, and
+// for rooms with no typical occupied period or occupied around the clock.
+func (s *PresenceService) NextOccupied(roomID string, now time.Time) (time.Time, bool) {
+	analytics, exists := s.Analytics(roomID, 0, now)
+	if !exists || analytics.NextOccupied == nil {
+		return time.Time{}, false
+	}
+	return *analytics.NextOccupied, true
+}
+
+func (room *roomPresence) analytics(roomID string, days int, now time.Time) OccupancyAnalytics {
+	heatmap := room.heatmap(roomID, now)
+	local := now.Local()
+	blocks := occupiedBlocks(heatmap, 0)
+
+	analytics := OccupancyAnalytics{
+		RoomID:      roomID,
+		Since:       room.Since,
+		Learned:     now.Sub(room.Since) >= minScheduleHistory,
+		OccupiedNow: room.OccupiedSince != nil,
+		ExpectedNow: heatmap.Occupancy[local.Weekday()][local.Hour()],
+		Schedule:    typicalWeek(heatmap, blocks),
+		Daily:       room.daily(days, now),
+	}
+
+	if analytics.Learned {
+		if next, ok := nextBlockStart(blocks, local); ok {
+			analytics.NextOccupied = &next
+		}
+	}
+
+	if len(analytics.Daily) > 0 {
+		var total float64
+		for _, day := range analytics.Daily {
+			total += day.OccupiedHours
+		}
+		analytics.AverageDailyHours = total / float64(len(analytics.Daily))
+	}
+	return analytics
+}
+
+// typicalWeek splits the occupied blocks of the week into periods of each day
+func typicalWeek(heatmap PresenceHeatmap, blocks [][2]int) []TypicalDay {
+	week := make([]TypicalDay, 7)
+	for day := range week {
+		week[day] = TypicalDay{Day: Weekdays[day], Periods: []OccupancyPeriod{}}
+		for hour := range heatmap.Occupancy[day] {
+			week[day].ExpectedHours += heatmap.Occupancy[day][hour]
+		}
+	}
+
+	for _, block := range blocks {
+		start, end := block[0], block[1]
+		if end <= start {
+			end += minutesPerWeek // Wraps past Saturday midnight, or runs around the clock
+		}
+		for start < end {
+			dayEnd := (start/(24*60) + 1) * 24 * 60
+			stop := min(dayEnd, end)
+			day := start / (24 * 60) % 7
+			week[day].Periods = append(week[day].Periods, OccupancyPeriod{
+				Start: clockText(start % (24 * 60)),
+				End:   clockText(stop - start/(24*60)*24*60),
+			})
+			start = stop
+		}
+	}
+
+	for day := range week {
+		sort.Slice(week[day].Periods, func(i, j int) bool {
+			return week[day].Periods[i].Start < week[day].Periods[j].Start
+		})
+	}
+	return week
+}
+
+// nextBlockStart returns the start of the next occupied block after now
+func nextBlockStart(blocks [][2]int, now time.Time) (time.Time, bool) {
+	if len(blocks) == 0 || (len(blocks) == 1 && blocks[0][0] == blocks[0][1]) {
+		return time.Time{}, false
+	}
+
+	minute := int(now.Weekday())*24*60 + now.Hour()*60 + now.Minute()
+	wait := -1
+	for _, block := range blocks {
+		delta := (block[0] - minute + minutesPerWeek) % minutesPerWeek
+		if delta == 0 {
+			delta = minutesPerWeek // Starting now; the next start is a week away
+		}
+		if wait < 0 || delta < wait {
+			wait = delta
+		}
+	}
+	return now.Truncate(time.Minute).Add(time.Duration(wait) * time.Minute), true
+}
+
+// clockText formats minutes after midnight as HH:MM
+func clockText(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// AnalyticsHandler serves the occupancy analytics as JSON; ?room= selects one room and ?days=
+// the days of daily totals, 30 by default and at most 90
+func (s *PresenceService) AnalyticsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		days := 30
+		if value := r.URL.Query().Get("days"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > presenceDailyDays {
+				http.Error(w, fmt.Sprintf("days must be from 1 to %d", presenceDailyDays), http.StatusBadRequest)
+				return
+			}
+			days = parsed
+		}
+
+		now := time.Now()
+		analytics := s.AllAnalytics(days, now)
+		if roomID := r.URL.Query().Get("room"); roomID != "" {
+			room, exists := s.Analytics(roomID, days, now)
+			if !exists {
+				http.Error(w, fmt.Sprintf("no occupancy history for room %s", roomID), http.StatusNotFound)
+				return
+			}
+			analytics = []OccupancyAnalytics{room}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms":     analytics,
+			"timezone":  now.Location().String(),
+			"timestamp": now,
+		})
+	})
+}
+
+// presenceCollector exports the occupancy analytics of every room when scraped
+type presenceCollector struct {
+	service       *PresenceService
+	expected      *prometheus.Desc
+	occupiedToday *prometheus.Desc
+	nextOccupied  *prometheus.Desc
+}
+
+// RegisterMetrics exports the typical occupancy of each room's current hour, its occupied hours
+// today and the time to its next typical occupancy
+func (s *PresenceService) RegisterMetrics(registerer prometheus.Registerer) error {
+	collector := &presenceCollector{
+		service: s,
+		expected: prometheus.NewDesc("home_automation_room_expected_occupancy",
+			"Typical occupancy of the room at this hour of the week (0-1)", []string{"room_id"}, nil),
+		occupiedToday: prometheus.NewDesc("home_automation_room_occupied_hours_today",
+			"Hours the room has been occupied today", []string{"room_id"}, nil),
+		nextOccupied: prometheus.NewDesc("home_automation_room_next_occupied_seconds",
+			"Seconds until the room's next typical occupied period, once a week has been learned", []string{"room_id"}, nil),
+	}
+	if err := registerer.Register(collector); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return nil
+		}
+		return errors.NewSystemError("failed to register occupancy metrics", err)
+	}
+	return nil
+}
+
+func (c *presenceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.expected
+	ch <- c.occupiedToday
+	ch <- c.nextOccupied
+}
+
+func (c *presenceCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, room := range c.service.AllAnalytics(1, now) {
+		ch <- prometheus.MustNewConstMetric(c.expected, prometheus.GaugeValue, room.ExpectedNow, room.RoomID)
+
+		var today float64
+		if len(room.Daily) > 0 {
+			today = room.Daily[len(room.Daily)-1].OccupiedHours
+		}
+		ch <- prometheus.MustNewConstMetric(c.occupiedToday, prometheus.GaugeValue, today, room.RoomID)
+
+		if room.NextOccupied != nil {
+			ch <- prometheus.MustNewConstMetric(c.nextOccupied, prometheus.GaugeValue,
+				room.NextOccupied.Sub(now).Seconds(), room.RoomID)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+// PresenceFileName holds the per-room occupancy history inside the state directory
+const PresenceFileName = "presence.json"
+
+// presenceSaveInterval limits how often occupancy history is written, sparing SD cards
+const presenceSaveInterval = 5 * time.Minute
+
+// Weekdays labels the rows of a heatmap, indexed by time.Weekday
+var Weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// HourGrid holds one value per hour of the day (columns) and day of the week (rows, Sunday first)
+type HourGrid [7][24]float64
+
+// roomPresence is the occupancy history of a room
+type roomPresence struct {
+	Since         time.Time  `json:"since"`          // First occupancy report, the start of observation
+	OccupiedSince *time.Time `json:"occupied_since"` // Start of the current occupancy, nil while unoccupied
+	Occupied      HourGrid   `json:"occupied"`       // Seconds occupied per hour of the week
+	MotionEvents  HourGrid   `json:"motion_events"`  // Times the room became occupied per hour of the week
+	// Daily totals by local date, for the last presenceDailyDays days
+	Daily map[string]*dayPresence `json:"daily,omitempty"`
+}
+
+// PresenceHeatmap is the occupancy of a room by hour of day and day of week
+type PresenceHeatmap struct {
+	RoomID string    `json:"room_id"`
+	Since  time.Time `json:"since"`
+	Days   []string  `json:"days"`
+	// Occupancy is the fraction of observed time the room was occupied (0-1)
+	Occupancy    HourGrid `json:"occupancy"`
+	MotionEvents HourGrid `json:"motion_events"`
+	// ObservedHours counts how long each hour of the week was observed, so sparse cells stand out
+	ObservedHours HourGrid `json:"observed_hours"`
+	OccupiedHours float64  `json:"occupied_hours"`
+}
+
+// PresenceService aggregates room occupancy into hour-of-day by day-of-week heatmaps, daily
+// totals and typical schedules
+type PresenceService struct {
+	path     string
+	logger   *logger.Logger
+	rooms    map[string]*roomPresence
+	lastSave time.Time
+	mu       sync.RWMutex
+}
+
+// NewPresenceService creates a presence service persisting to path, or keeping history in memory if empty
+func NewPresenceService(path string, serviceLogger *logger.Logger) *PresenceService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("PresenceService", nil)
+	}
+
+	service := &PresenceService{
+		path:   path,
+		logger: serviceLogger,
+		rooms:  make(map[string]*roomPresence),
+	}
+
+	if err := service.Reload(); err != nil {
+		serviceLogger.Error("Failed to load occupancy history, starting empty", err)
+	}
+	return service
+}
+
+// PresencePath returns the occupancy history file path for a state directory
+func PresencePath(stateDir string) string {
+	return filepath.Join(stateDir, PresenceFileName)
+}
+
+// Record notes that a room became occupied or unoccupied
+func (s *PresenceService) Record(roomID string, occupied bool, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, exists := s.rooms[roomID]
+	if !exists {
+		room = &roomPresence{Since: at}
+		s.rooms[roomID] = room
+	}
+
+	switch {
+	case occupied && room.OccupiedSince == nil:
+		start := at
+		room.OccupiedSince = &start
+		local := at.Local()
+		room.MotionEvents[local.Weekday()][local.Hour()]++
+		room.day(at).MotionEvents++
+	case !occupied && room.OccupiedSince != nil:
+		addSeconds(&room.Occupied, *room.OccupiedSince, at)
+		room.addDaily(*room.OccupiedSince, at)
+		room.OccupiedSince = nil
+	}
+
+	if s.path != "" && time.Since(s.lastSave) >= presenceSaveInterval {
+		if err := s.save(); err != nil {
+			s.logger.Error("Failed to save occupancy history", err)
+		}
+	}
+}
+
+// HandleOccupancy records an occupancy change now; it fits UnifiedSensorService.AddMotionCallback
+func (s *PresenceService) HandleOccupancy(roomID string, occupied bool) {
+	s.Record(roomID, occupied, time.Now())
+}
+
+// Heatmaps returns the heatmap of every room, sorted by room ID. A room still occupied counts up to now.
+func (s *PresenceService) Heatmaps(now time.Time) []PresenceHeatmap {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	heatmaps := make([]PresenceHeatmap, 0, len(s.rooms))
+	for roomID, room := range s.rooms {
+		heatmaps = append(heatmaps, room.heatmap(roomID, now))
+	}
+	sort.Slice(heatmaps, func(i, j int) bool {
+		return heatmaps[i].RoomID < heatmaps[j].RoomID
+	})
+	return heatmaps
+}
+
+// Heatmap returns the heatmap of one room
+func (s *PresenceService) Heatmap(roomID string, now time.Time) (PresenceHeatmap, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, exists := s.rooms[roomID]
+	if !exists {
+		return PresenceHeatmap{}, false
+	}
+	return room.heatmap(roomID, now), true
+}
+
+// Handler serves the heatmaps as JSON; ?room= selects one room
+func (s *PresenceService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		heatmaps := s.Heatmaps(now)
+
+		if roomID := r.URL.Query().Get("room"); roomID != "" {
+			heatmap, exists := s.Heatmap(roomID, now)
+			if !exists {
+				http.Error(w, fmt.Sprintf("no occupancy history for room %s", roomID), http.StatusNotFound)
+				return
+			}
+			heatmaps = []PresenceHeatmap{heatmap}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms":     heatmaps,
+			"timezone":  now.Location().String(),
+			"timestamp": now,
+		})
+	})
+}
+
+// Reload re-reads the history file, e.g. in the API server while the unified service records
+func (s *PresenceService) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read occupancy history", err)
+	}
+
+	rooms := make(map[string]*roomPresence)
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return errors.NewSystemError("failed to parse occupancy history", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms = rooms
+	return nil
+}
+
+// Save writes the history, e.g. on shutdown
+func (s *PresenceService) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// save atomically writes the history; callers must hold the lock
+func (s *PresenceService) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.rooms, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal occupancy history", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write occupancy history", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace occupancy history", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
+
+// heatmap computes the occupancy fractions of a room as of now
+func (room *roomPresence) heatmap(roomID string, now time.Time) PresenceHeatmap {
+	occupied := room.Occupied
+	if room.OccupiedSince != nil {
+		addSeconds(&occupied, *room.OccupiedSince, now)
+	}
+
+	var observed HourGrid
+	addSeconds(&observed, room.Since, now)
+
+	heatmap := PresenceHeatmap{
+		RoomID:       roomID,
+		Since:        room.Since,
+		Days:         Weekdays,
+		MotionEvents: room.MotionEvents,
+	}
+	for day := range occupied {
+		for hour := range occupied[day] {
+			heatmap.OccupiedHours += occupied[day][hour] / 3600
+			heatmap.ObservedHours[day][hour] = observed[day][hour] / 3600
+			if observed[day][hour] > 0 {
+				heatmap.Occupancy[day][hour] = min(occupied[day][hour]/observed[day][hour], 1)
+			}
+		}
+	}
+	return heatmap
+}
+
+// addSeconds adds the seconds between start and end to the hours of the week they fall in
+func addSeconds(grid *HourGrid, start, end time.Time) {
+	start, end = start.Local(), end.Local()
+	for start.Before(end) {
+		next := time.Date(start.Year(), start.Month(), start.Day(), start.Hour()+1, 0, 0, 0, start.Location())
+		if next.After(end) {
+			next = end
+		}
+		grid[start.Weekday()][start.Hour()] += next.Sub(start).Seconds()
+		start = next
+	}
+}
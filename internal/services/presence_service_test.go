@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPresenceHeatmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PresenceFileName)
+	service := NewPresenceService(path, nil)
+
+	// Monday 08:00 to 10:30, local time
+	monday := time.Date(2024, 1, 15, 8, 0, 0, 0, time.Local)
+	service.Record("kitchen", true, monday)
+	service.Record("kitchen", true, monday.Add(10*time.Minute)) // Already occupied
+	service.Record("kitchen", false, monday.Add(150*time.Minute))
+
+	heatmap, exists := service.Heatmap("kitchen", monday.Add(7*24*time.Hour))
+	if !exists {
+		t.Fatal("Expected a heatmap for the kitchen")
+	}
+	if heatmap.Occupancy[time.Monday][8] != 1 || heatmap.Occupancy[time.Monday][9] != 1 {
+		t.Errorf("Expected 08:00 and 09:00 on Monday to be fully occupied, got %v", heatmap.Occupancy[time.Monday][7:12])
+	}
+	if heatmap.Occupancy[time.Monday][10] != 0.5 {
+		t.Errorf("Expected 10:00 on Monday to be half occupied, got %v", heatmap.Occupancy[time.Monday][10])
+	}
+	if heatmap.MotionEvents[time.Monday][8] != 1 {
+		t.Errorf("Expected one motion event at 08:00, got %v", heatmap.MotionEvents[time.Monday][8])
+	}
+	if heatmap.OccupiedHours != 2.5 {
+		t.Errorf("Expected 2.5 occupied hours, got %v", heatmap.OccupiedHours)
+	}
+
+	// Persisted history is served by another process
+	if err := service.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	reader := NewPresenceService(path, nil)
+
+	recorder := httptest.NewRecorder()
+	reader.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/presence/heatmap?room=kitchen", nil))
+	var response struct {
+		Rooms []PresenceHeatmap `json:"rooms"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected JSON, got %s", recorder.Body.String())
+	}
+	if len(response.Rooms) != 1 || response.Rooms[0].MotionEvents[time.Monday][8] != 1 {
+		t.Errorf("Expected the kitchen heatmap, got %+v", response.Rooms)
+	}
+
+	recorder = httptest.NewRecorder()
+	reader.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/presence/heatmap?room=attic", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Expected 404 for a room without history, got %d", recorder.Code)
+	}
+}
+
+func TestPresenceHeatmapCountsCurrentOccupancy(t *testing.T) {
+	service := NewPresenceService("", nil)
+	start := time.Date(2024, 1, 20, 22, 30, 0, 0, time.Local) // Saturday
+	service.Record("bedroom", true, start)
+
+	heatmap, _ := service.Heatmap("bedroom", start.Add(2*time.Hour))
+	if heatmap.Occupancy[time.Saturday][22] != 1 || heatmap.Occupancy[time.Saturday][23] != 1 || heatmap.Occupancy[time.Sunday][0] != 1 {
+		t.Errorf("Expected the ongoing occupancy to span midnight, got %v", heatmap.Occupancy)
+	}
+	if heatmap.OccupiedHours != 2 {
+		t.Errorf("Expected 2 occupied hours, got %v", heatmap.OccupiedHours)
+	}
+}
+
+func TestPresenceAnalytics(t *testing.T) {
+	service := NewPresenceService("", nil)
+
+	// Two weeks of mornings and evenings in the kitchen, from Monday the 15th
+	first := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+	for day := 0; day < 14; day++ {
+		date := first.AddDate(0, 0, day)
+		for _, period := range [][2]int{{7, 9}, {18, 22}} {
+			service.Record("kitchen", true, date.Add(time.Duration(period[0])*time.Hour))
+			service.Record("kitchen", false, date.Add(time.Duration(period[1])*time.Hour))
+		}
+	}
+
+	now := time.Date(2024, 1, 29, 12, 0, 0, 0, time.Local) // Monday noon
+	analytics, exists := service.Analytics("kitchen", 7, now)
+	if !exists {
+		t.Fatal("Expected analytics for the kitchen")
+	}
+	if !analytics.Learned || analytics.OccupiedNow || analytics.ExpectedNow != 0 {
+		t.Errorf("Expected a learned, empty kitchen at noon, got %+v", analytics)
+	}
+	tuesday := analytics.Schedule[time.Tuesday]
+	want := []OccupancyPeriod{{"07:00", "09:00"}, {"18:00", "22:00"}}
+	if len(tuesday.Periods) != 2 || tuesday.Periods[0] != want[0] || tuesday.Periods[1] != want[1] || tuesday.ExpectedHours != 6 {
+		t.Errorf("Expected Tuesday occupied 07:00-09:00 and 18:00-22:00, got %+v", tuesday)
+	}
+	if analytics.NextOccupied == nil || !analytics.NextOccupied.Equal(now.Add(6*time.Hour)) {
+		t.Errorf("Expected the kitchen occupied next at 18:00, got %v", analytics.NextOccupied)
+	}
+	if next, ok := service.NextOccupied("kitchen", now); !ok || next.Hour() != 18 {
+		t.Errorf("Expected NextOccupied at 18:00, got %v %v", next, ok)
+	}
+
+	// The last 7 days have history for the 23rd to the 28th
+	if len(analytics.Daily) != 6 || analytics.Daily[0].Date != "2024-01-23" || analytics.Daily[0].OccupiedHours != 6 ||
+		analytics.Daily[0].MotionEvents != 2 || analytics.AverageDailyHours != 6 {
+		t.Errorf("Expected 6 days of 6 hours, got %+v", analytics.Daily)
+	}
+
+	// A week isn't learned yet, so there is no next occupancy
+	service.Record("den", true, now.Add(-3*time.Hour))
+	den, _ := service.Analytics("den", 7, now)
+	if den.Learned || den.NextOccupied != nil || !den.OccupiedNow || len(den.Daily) != 1 || den.Daily[0].OccupiedHours != 3 {
+		t.Errorf("Expected an unlearned den occupied for 3 hours today, got %+v", den)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := service.RegisterMetrics(registry); err != nil {
+		t.Fatalf("RegisterMetrics failed: %v", err)
+	}
+	if count, err := testutil.GatherAndCount(registry, "home_automation_room_expected_occupancy"); err != nil || count != 2 {
+		t.Errorf("Expected the expected occupancy of 2 rooms, got %d %v", count, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	service.AnalyticsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/presence/analytics?days=500", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Expected 400 for too many days, got %d", recorder.Code)
+	}
+}
+
+func TestPresenceDailySplitsAtMidnight(t *testing.T) {
+	service := NewPresenceService("", nil)
+	start := time.Date(2024, 1, 20, 23, 0, 0, 0, time.Local)
+	service.Record("bedroom", true, start)
+	service.Record("bedroom", false, start.Add(2*time.Hour))
+
+	analytics, _ := service.Analytics("bedroom", 7, start.Add(3*time.Hour))
+	if len(analytics.Daily) != 2 || analytics.Daily[0].OccupiedHours != 1 || analytics.Daily[1].OccupiedHours != 1 {
+		t.Errorf("Expected an hour on each side of midnight, got %+v", analytics.Daily)
+	}
+	saturday := analytics.Schedule[time.Saturday].Periods
+	if len(saturday) != 1 || saturday[0] != (OccupancyPeriod{"23:00", "24:00"}) {
+		t.Errorf("Expected Saturday occupied until midnight, got %+v", saturday)
+	}
+}
@@ -0,0 +1,385 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+const (
+	// Services a provisioning rule adds discovered assets to
+	ProvisionTapo       = "tapo"       // Tapo smart plugs are monitored by the Tapo service
+	ProvisionThermostat = "thermostat" // Rooms with a temperature sensor get a thermostat
+
+	// A failed provisioning is retried when the asset is seen again after this long
+	provisioningRetry = 5 * time.Minute
+)
+
+// ProvisioningConfig lists the rules that add discovered assets to the services. Each asset is
+// provisioned by the first rule that matches it, for each target.
+type ProvisioningConfig struct {
+	Rules []ProvisioningRule `json:"rules"`
+}
+
+// ProvisioningRule matches discovered assets and says how to set them up. Empty match fields
+// match any asset; the type defaults to smart_plug for Tapo rules and to a sensor with the
+// temperature capability for thermostat rules.
+type ProvisioningRule struct {
+	Name   string `json:"name"`
+	Target string `json:"target"` // tapo or thermostat
+
+	Type         string   `json:"type,omitempty"`         // Discovery asset type
+	Manufacturer string   `json:"manufacturer,omitempty"` // Case-insensitive
+	Model        string   `json:"model,omitempty"`        // Case-insensitive prefix, e.g. "P110"
+	Capability   string   `json:"capability,omitempty"`
+	Subnet       string   `json:"subnet,omitempty"` // CIDR the asset's address is in, e.g. 192.168.68.0/24
+	Rooms        []string `json:"rooms,omitempty"`
+	Exclude      []string `json:"exclude,omitempty"` // Asset IDs never provisioned by the rule
+
+	Room string `json:"room,omitempty"` // For assets that don't report a room
+
+	// Tapo plugs
+	PollSeconds int          `json:"poll_seconds,omitempty"` // Default 30
+	Cycle       *CycleConfig `json:"cycle,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+
+	// Thermostats
+	TargetTemp float64               `json:"target_temp,omitempty"` // °F, default 70
+	Mode       models.ThermostatMode `json:"mode,omitempty"`        // Default auto
+}
+
+// LoadProvisioningConfig reads the provisioning rules from a JSON file
+func LoadProvisioningConfig(path string) (*ProvisioningConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read provisioning file", err)
+	}
+
+	var cfg ProvisioningConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse provisioning file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks every rule is named once, has a known target and a valid subnet and settings
+func (c *ProvisioningConfig) Validate() error {
+	if len(c.Rules) == 0 {
+		return errors.NewValidationError("provisioning needs rules", nil)
+	}
+	names := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return errors.NewValidationError("provisioning rules need a name", nil)
+		}
+		if names[rule.Name] {
+			return errors.NewValidationError(fmt.Sprintf("duplicate provisioning rule %s", rule.Name), nil)
+		}
+		names[rule.Name] = true
+
+		if rule.Target != ProvisionTapo && rule.Target != ProvisionThermostat {
+			return errors.NewValidationError(fmt.Sprintf("rule %s: unknown target %q, use tapo or thermostat", rule.Name, rule.Target), nil)
+		}
+		if rule.Subnet != "" {
+			if _, _, err := net.ParseCIDR(rule.Subnet); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("rule %s: invalid subnet %q", rule.Name, rule.Subnet), err)
+			}
+		}
+		if rule.PollSeconds < 0 || rule.TargetTemp < 0 {
+			return errors.NewValidationError(fmt.Sprintf("rule %s: poll_seconds and target_temp must not be negative", rule.Name), nil)
+		}
+		switch rule.Mode {
+		case "", models.ModeOff, models.ModeHeat, models.ModeCool, models.ModeAuto, models.ModeFan:
+		default:
+			return errors.NewValidationError(fmt.Sprintf("rule %s: unknown mode %q", rule.Name, rule.Mode), nil)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule provisions the asset
+func (r *ProvisioningRule) matches(asset *discovery.AssetInfo, room string) bool {
+	assetType, capability := r.Type, r.Capability
+	if assetType == "" && r.Target == ProvisionTapo {
+		assetType = string(discovery.AssetTypeSmartPlug)
+	}
+	if assetType == "" && r.Target == ProvisionThermostat {
+		assetType = string(discovery.AssetTypeSensor)
+		if capability == "" {
+			capability = string(discovery.CapabilityTemperature)
+		}
+	}
+
+	if string(asset.Type) != assetType {
+		return false
+	}
+	if r.Manufacturer != "" && !strings.EqualFold(asset.Manufacturer, r.Manufacturer) {
+		return false
+	}
+	if r.Model != "" && !strings.HasPrefix(strings.ToLower(asset.Model), strings.ToLower(r.Model)) {
+		return false
+	}
+	if capability != "" && !hasAssetCapability(asset, discovery.AssetCapability(capability)) {
+		return false
+	}
+	if r.Subnet != "" {
+		_, subnet, _ := net.ParseCIDR(r.Subnet)
+		if ip := net.ParseIP(asset.IPAddress); ip == nil || !subnet.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.Rooms) > 0 && !containsString(r.Rooms, room) {
+		return false
+	}
+	return !containsString(r.Exclude, asset.ID)
+}
+
+func hasAssetCapability(asset *discovery.AssetInfo, capability discovery.AssetCapability) bool {
+	for _, c := range asset.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TapoDeviceAdder monitors Tapo plugs; TapoService implements it
+type TapoDeviceAdder interface {
+	AddDevice(config *TapoConfig) error
+	HasDeviceAt(ipAddress string) bool
+}
+
+// ThermostatRegistrar controls room thermostats; ThermostatService implements it
+type ThermostatRegistrar interface {
+	GetThermostat(id string) (*models.Thermostat, error)
+	RegisterThermostat(thermostat *models.Thermostat)
+}
+
+// ProvisionedAsset is a discovered asset added to a service, or that failed to be
+type ProvisionedAsset struct {
+	AssetID  string    `json:"asset_id"`
+	Name     string    `json:"name"`
+	Target   string    `json:"target"`
+	Rule     string    `json:"rule"`
+	DeviceID string    `json:"device_id"` // Tapo device or thermostat ID
+	RoomID   string    `json:"room_id,omitempty"`
+	At       time.Time `json:"at"`
+	Error    string    `json:"error,omitempty"` // Retried when the asset is seen again
+}
+
+// ProvisioningService adds the Tapo plugs and temperature sensors that discovery finds to the
+// Tapo and thermostat services by rule, so new devices needn't be configured one by one. Plugs
+// already configured at their address and rooms that already have a thermostat are left alone.
+// Only the targets set on the service are provisioned, so each process provisions the services
+// it runs.
+type ProvisioningService struct {
+	config       *ProvisioningConfig
+	tapo         TapoDeviceAdder
+	tapoUsername string
+	tapoPassword string
+	thermostats  ThermostatRegistrar
+	provisioned  map[string]*ProvisionedAsset // By target and asset ID
+	logger       *logger.Logger
+	mu           sync.Mutex
+}
+
+// NewProvisioningService creates a provisioner with the rules
+func NewProvisioningService(cfg *ProvisioningConfig, serviceLogger *logger.Logger) *ProvisioningService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ProvisioningService", nil)
+	}
+	return &ProvisioningService{
+		config:      cfg,
+		provisioned: make(map[string]*ProvisionedAsset),
+		logger:      serviceLogger,
+	}
+}
+
+// SetTapo provisions Tapo rules to the service, logging in to the plugs with the account
+func (s *ProvisioningService) SetTapo(adder TapoDeviceAdder, username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tapo = adder
+	s.tapoUsername = username
+	s.tapoPassword = password
+}
+
+// SetThermostats provisions thermostat rules to the service
+func (s *ProvisioningService) SetThermostats(registrar ThermostatRegistrar) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.thermostats = registrar
+}
+
+// Run provisions the assets discovered or updated until ctx is cancelled
+func (s *ProvisioningService) Run(ctx context.Context, discovered, updated <-chan *discovery.AssetInfo) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case asset := <-discovered:
+			s.Provision(asset, time.Now())
+		case asset := <-updated:
+			s.Provision(asset, time.Now())
+		}
+	}
+}
+
+// Provision adds the asset to the services whose rules match it, unless it was already added.
+// It returns what was provisioned.
+func (s *ProvisioningService) Provision(asset *discovery.AssetInfo, now time.Time) []ProvisionedAsset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []ProvisionedAsset
+	for _, target := range []string{ProvisionTapo, ProvisionThermostat} {
+		if (target == ProvisionTapo && s.tapo == nil) || (target == ProvisionThermostat && s.thermostats == nil) {
+			continue
+		}
+		key := target + "/" + asset.ID
+		if previous, ok := s.provisioned[key]; ok && (previous.Error == "" || now.Sub(previous.At) < provisioningRetry) {
+			continue
+		}
+
+		for i := range s.config.Rules {
+			rule := &s.config.Rules[i]
+			room := asset.Room
+			if room == "" {
+				room = rule.Room
+			}
+			if rule.Target != target || !rule.matches(asset, room) {
+				continue
+			}
+
+			result, ok := s.provision(rule, asset, room, now)
+			if ok {
+				s.provisioned[key] = result
+				results = append(results, *result)
+			}
+			break
+		}
+	}
+	return results
+}
+
+// provision adds the asset to the rule's target. It returns false when the asset is already
+// there or can't be provisioned for lack of an address or room.
+func (s *ProvisioningService) provision(rule *ProvisioningRule, asset *discovery.AssetInfo, room string, now time.Time) (*ProvisionedAsset, bool) {
+	result := &ProvisionedAsset{
+		AssetID: asset.ID,
+		Name:    asset.Name,
+		Target:  rule.Target,
+		Rule:    rule.Name,
+		RoomID:  room,
+		At:      now,
+	}
+	fields := map[string]interface{}{"asset_id": asset.ID, "rule": rule.Name, "room_id": room}
+
+	switch rule.Target {
+	case ProvisionTapo:
+		if asset.IPAddress == "" || s.tapo.HasDeviceAt(asset.IPAddress) {
+			return nil, false
+		}
+		pollInterval := 30 * time.Second
+		if rule.PollSeconds > 0 {
+			pollInterval = time.Duration(rule.PollSeconds) * time.Second
+		}
+		result.DeviceID = asset.ID
+		err := s.tapo.AddDevice(&TapoConfig{
+			DeviceID:     asset.ID,
+			DeviceName:   asset.Name,
+			RoomID:       room,
+			IPAddress:    asset.IPAddress,
+			Username:     s.tapoUsername,
+			Password:     s.tapoPassword,
+			PollInterval: pollInterval,
+			Cycle:        rule.Cycle,
+			Tags:         rule.Tags,
+		})
+		if err != nil {
+			result.Error = err.Error()
+			s.logger.Error("Failed to provision Tapo plug", err, fields)
+			return result, true
+		}
+		fields["ip_address"] = asset.IPAddress
+
+	case ProvisionThermostat:
+		if room == "" {
+			return nil, false
+		}
+		if _, err := s.thermostats.GetThermostat(room); err == nil {
+			return nil, false
+		}
+		mode := rule.Mode
+		if mode == "" {
+			mode = models.ModeAuto
+		}
+		result.DeviceID = room
+		s.thermostats.RegisterThermostat(&models.Thermostat{
+			ID:             room,
+			Name:           "Thermostat-" + room,
+			RoomID:         room,
+			TargetTemp:     rule.TargetTemp,
+			Mode:           mode,
+			Status:         models.StatusIdle,
+			HeatingEnabled: true,
+			CoolingEnabled: true,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+
+	s.logger.Info("Provisioned discovered asset to "+rule.Target, fields)
+	return result, true
+}
+
+// Provisioned returns what was provisioned, newest first
+func (s *ProvisioningService) Provisioned() []ProvisionedAsset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provisioned := make([]ProvisionedAsset, 0, len(s.provisioned))
+	for _, result := range s.provisioned {
+		provisioned = append(provisioned, *result)
+	}
+	sort.Slice(provisioned, func(i, j int) bool {
+		if !provisioned[i].At.Equal(provisioned[j].At) {
+			return provisioned[i].At.After(provisioned[j].At)
+		}
+		return provisioned[i].AssetID < provisioned[j].AssetID
+	})
+	return provisioned
+}
+
+// Handler serves what was provisioned as JSON
+func (s *ProvisioningService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Provisioned())
+	})
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/discovery"
+)
+
+type fakeTapoAdder struct {
+	added []*TapoConfig
+	fail  bool
+}
+
+func (f *fakeTapoAdder) AddDevice(config *TapoConfig) error {
+	if f.fail {
+		return fmt.Errorf("no answer from %s", config.IPAddress)
+	}
+	f.added = append(f.added, config)
+	return nil
+}
+
+func (f *fakeTapoAdder) HasDeviceAt(ipAddress string) bool {
+	for _, config := range f.added {
+		if config.IPAddress == ipAddress {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeThermostats map[string]*models.Thermostat
+
+func (f fakeThermostats) GetThermostat(id string) (*models.Thermostat, error) {
+	if thermostat, ok := f[id]; ok {
+		return thermostat, nil
+	}
+	return nil, fmt.Errorf("thermostat not found: %s", id)
+}
+
+func (f fakeThermostats) RegisterThermostat(thermostat *models.Thermostat) {
+	f[thermostat.ID] = thermostat
+}
+
+func TestProvisioningService(t *testing.T) {
+	cfg := &ProvisioningConfig{Rules: []ProvisioningRule{
+		{Name: "laundry", Target: ProvisionTapo, Model: "P110", Subnet: "192.168.68.0/24", Room: "laundry_room", PollSeconds: 10},
+		{Name: "plugs", Target: ProvisionTapo, Manufacturer: "tp-link", Exclude: []string{"plug-tv"}},
+		{Name: "bedrooms", Target: ProvisionThermostat, Rooms: []string{"bedroom"}, TargetTemp: 66, Mode: models.ModeHeat},
+		{Name: "rooms", Target: ProvisionThermostat},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tapo := &fakeTapoAdder{}
+	thermostats := fakeThermostats{"kitchen": {ID: "kitchen"}}
+	service := NewProvisioningService(cfg, nil)
+	service.SetTapo(tapo, "me@example.com", "secret")
+	service.SetThermostats(thermostats)
+	now := time.Now()
+
+	washer := discovery.NewTapoSmartPlug("Washer", "192.168.68.53", "P110").WithID("plug-washer").Build()
+	if results := service.Provision(washer, now); len(results) != 1 || results[0].Rule != "laundry" {
+		t.Fatalf("Expected the washer provisioned by the laundry rule, got %+v", results)
+	}
+	if added := tapo.added[0]; added.RoomID != "laundry_room" || added.PollInterval != 10*time.Second || added.Password != "secret" {
+		t.Errorf("Expected the rule's room, interval and the account, got %+v", added)
+	}
+	if results := service.Provision(washer, now); len(results) != 0 {
+		t.Errorf("Expected the washer provisioned once, got %+v", results)
+	}
+
+	// The first matching rule wins; excluded assets and other subnets fall through
+	lamp := discovery.NewTapoSmartPlug("Lamp", "10.0.0.7", "P100").WithID("plug-lamp").Build()
+	tv := discovery.NewTapoSmartPlug("TV", "10.0.0.8", "P100").WithID("plug-tv").Build()
+	if results := service.Provision(lamp, now); len(results) != 1 || results[0].Rule != "plugs" || results[0].RoomID != "" {
+		t.Errorf("Expected the lamp provisioned by the plugs rule, got %+v", results)
+	}
+	if results := service.Provision(tv, now); len(results) != 0 {
+		t.Errorf("Expected the excluded TV left alone, got %+v", results)
+	}
+
+	// Pico sensors give their room a thermostat, unless it has one
+	bedroom := discovery.NewPicoSensor("Bedroom Pico", "bedroom", []discovery.AssetCapability{discovery.CapabilityTemperature}).WithID("pico-bedroom").Build()
+	kitchen := discovery.NewPicoSensor("Kitchen Pico", "kitchen", []discovery.AssetCapability{discovery.CapabilityTemperature}).WithID("pico-kitchen").Build()
+	motion := discovery.NewPicoSensor("Hall Pico", "hallway", []discovery.AssetCapability{discovery.CapabilityMotion}).WithID("pico-hallway").Build()
+	service.Provision(bedroom, now)
+	service.Provision(kitchen, now)
+	service.Provision(motion, now)
+	if thermostat := thermostats["bedroom"]; thermostat == nil || thermostat.TargetTemp != 66 || thermostat.Mode != models.ModeHeat {
+		t.Errorf("Expected a bedroom thermostat from the bedrooms rule, got %+v", thermostat)
+	}
+	if len(thermostats) != 2 {
+		t.Errorf("Expected the kitchen kept and no thermostat for a motion sensor, got %v", thermostats)
+	}
+
+	// Failures are retried when the asset is seen again later
+	tapo.fail = true
+	dryer := discovery.NewTapoSmartPlug("Dryer", "192.168.68.54", "P110").WithID("plug-dryer").Build()
+	if results := service.Provision(dryer, now); len(results) != 1 || results[0].Error == "" {
+		t.Fatalf("Expected the failure recorded, got %+v", results)
+	}
+	tapo.fail = false
+	if results := service.Provision(dryer, now.Add(time.Minute)); len(results) != 0 {
+		t.Errorf("Expected no retry straight away, got %+v", results)
+	}
+	if results := service.Provision(dryer, now.Add(provisioningRetry)); len(results) != 1 || results[0].Error != "" {
+		t.Errorf("Expected the dryer provisioned on retry, got %+v", results)
+	}
+
+	if provisioned := service.Provisioned(); len(provisioned) != 4 || provisioned[0].AssetID != "plug-dryer" {
+		t.Errorf("Expected four assets provisioned, newest first, got %+v", provisioned)
+	}
+	if err := (&ProvisioningConfig{Rules: []ProvisioningRule{{Name: "x", Target: "hue"}}}).Validate(); err == nil {
+		t.Error("Expected an unknown target rejected")
+	}
+}
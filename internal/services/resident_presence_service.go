@@ -0,0 +1,635 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Presence states of a resident and of the whole home
+	ResidentHome    = "home"
+	ResidentAway    = "away"
+	ResidentUnknown = "unknown" // Not seen yet since the start, and not missed for long enough
+
+	// Sources a resident was last detected by
+	PresenceSourceWiFi      = "wifi"
+	PresenceSourceBluetooth = "bluetooth"
+	PresenceSourceOwnTracks = "owntracks"
+
+	defaultResidentPoll       = 30 * time.Second
+	defaultResidentAwayAfter  = 10 * time.Minute
+	defaultOwnTracksRegion    = "home"
+	defaultHomeRadiusMeters   = 150.0
+	minApproachKmh            = 5.0  // Slower reports, e.g. walking around, give no arrival time
+	minApproachMeters         = 50.0 // How much closer a report must be to count as approaching
+	residentProbeTimeout      = 5 * time.Second
+	earthRadiusMeters         = 6371000.0
+	arpTablePath              = "/proc/net/arp"
+	arpFlagComplete           = "0x2"
+	residentPresenceComponent = "ResidentPresence"
+)
+
+// Resident is a person whose phone tells whether they are home. Any of the detection methods
+// may be set; the resident is home while any of them says so.
+type Resident struct {
+	Name           string `json:"name"`
+	IP             string `json:"ip,omitempty"`              // Reserved Wi-Fi address of the phone, pinged
+	MAC            string `json:"mac,omitempty"`             // Wi-Fi MAC of the phone, found in the ARP table
+	BluetoothMAC   string `json:"bluetooth_mac,omitempty"`   // Looked up by name over Bluetooth
+	OwnTracksTopic string `json:"owntracks_topic,omitempty"` // e.g. owntracks/alex/phone
+	// WarmUp lets the resident's OwnTracks arrival time warm or cool the house before they arrive
+	WarmUp bool `json:"warm_up,omitempty"`
+	// Locale translates the resident's notifications when it differs from the global locale
+	Locale string `json:"locale,omitempty"`
+}
+
+func (r *Resident) probed() bool {
+	return r.IP != "" || r.MAC != "" || r.BluetoothMAC != ""
+}
+
+// ResidentPresenceConfig lists the residents and how they are detected
+type ResidentPresenceConfig struct {
+	Residents   []Resident `json:"residents"`
+	PollSeconds int        `json:"poll_seconds,omitempty"` // How often phones are probed, default 30
+	// AwayMinutes is how long a phone probed over Wi-Fi or Bluetooth may go unseen before its
+	// resident counts as away, default 10. Phones sleep their Wi-Fi, so keep it generous.
+	AwayMinutes int `json:"away_minutes,omitempty"`
+
+	// OwnTracks reports count as home inside the home region, or within HomeRadiusMeters of the
+	// home coordinates when those are set
+	OwnTracksRegion  string  `json:"owntracks_region,omitempty"` // Default home
+	HomeLatitude     float64 `json:"home_latitude,omitempty"`
+	HomeLongitude    float64 `json:"home_longitude,omitempty"`
+	HomeRadiusMeters float64 `json:"home_radius_meters,omitempty"` // Default 150
+
+	// AwaySetback holds the thermostats while nobody is home; unset leaves them alone
+	AwaySetback *AwaySetback `json:"away_setback,omitempty"`
+	// ArrivalWarmUp ends the away setback and turns on the porch lights ahead of the residents
+	// with warm_up set, from their OwnTracks arrival time; needs the home coordinates
+	ArrivalWarmUp *ArrivalWarmUpConfig `json:"arrival_warm_up,omitempty"`
+}
+
+// LoadResidentPresenceConfig reads the residents from a JSON file
+func LoadResidentPresenceConfig(path string) (*ResidentPresenceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read residents file", err)
+	}
+
+	var cfg ResidentPresenceConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse residents file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that every resident has a unique name and a way to be detected
+func (c *ResidentPresenceConfig) Validate() error {
+	if len(c.Residents) == 0 {
+		return errors.NewValidationError("at least one resident is required", nil)
+	}
+	if c.PollSeconds < 0 || c.AwayMinutes < 0 || c.HomeRadiusMeters < 0 {
+		return errors.NewValidationError("poll_seconds, away_minutes and home_radius_meters must not be negative", nil)
+	}
+	names := make(map[string]bool)
+	for _, resident := range c.Residents {
+		if resident.Name == "" || strings.ContainsAny(resident.Name, "/+#") {
+			return errors.NewValidationError(fmt.Sprintf("invalid resident name %q", resident.Name), nil)
+		}
+		if names[resident.Name] {
+			return errors.NewValidationError("duplicate resident "+resident.Name, nil)
+		}
+		names[resident.Name] = true
+		if !resident.probed() && resident.OwnTracksTopic == "" {
+			return errors.NewValidationError(fmt.Sprintf("resident %s needs an ip, mac, bluetooth_mac or owntracks_topic", resident.Name), nil)
+		}
+		if _, ok := i18n.Normalize(resident.Locale); resident.Locale != "" && !ok {
+			return errors.NewValidationError(fmt.Sprintf("resident %s has an unsupported locale %q", resident.Name, resident.Locale), nil)
+		}
+	}
+	if c.AwaySetback != nil && c.AwaySetback.HeatTemp == 0 && c.AwaySetback.CoolTemp == 0 {
+		return errors.NewValidationError("away_setback needs a heat_temp or a cool_temp", nil)
+	}
+	if c.ArrivalWarmUp != nil {
+		if c.HomeLatitude == 0 && c.HomeLongitude == 0 {
+			return errors.NewValidationError("arrival_warm_up needs home_latitude and home_longitude", nil)
+		}
+		return c.ArrivalWarmUp.Validate()
+	}
+	return nil
+}
+
+// ResidentStatus is the presence of one resident
+type ResidentStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Source    string    `json:"source,omitempty"` // What detected the current state
+	Since     time.Time `json:"since,omitempty"`
+	LastSeen  time.Time `json:"last_seen,omitempty"` // Last Wi-Fi or Bluetooth sighting
+	OwnTracks string    `json:"owntracks,omitempty"` // Last state OwnTracks reported
+	Arrival   time.Time `json:"arrival,omitempty"`   // Expected arrival while heading home
+}
+
+// HomePresenceStatus is the presence of every resident and of the whole home
+type HomePresenceStatus struct {
+	State     string           `json:"state"`
+	Since     time.Time        `json:"since,omitempty"`
+	Residents []ResidentStatus `json:"residents"`
+}
+
+// residentState tracks the sightings of one resident
+type residentState struct {
+	resident   Resident
+	seen       time.Time // Last Wi-Fi or Bluetooth sighting
+	seenSource string
+	ownTracks  string    // home or away, as last reported
+	distance   float64   // Meters from home at the last OwnTracks location, for the approach
+	distanceAt time.Time // When the distance was reported
+	arrival    time.Time // Expected arrival while approaching
+	state      string
+	source     string
+	since      time.Time
+}
+
+// ResidentPresenceService tells who is home from their phones: answering on the Wi-Fi, in
+// Bluetooth range, or reporting their location through OwnTracks. It publishes each resident's
+// state and the whole-home occupancy, and calls back on changes, e.g. to hold the thermostats
+// at an away setback.
+type ResidentPresenceService struct {
+	config         *ResidentPresenceConfig
+	poll           time.Duration
+	awayAfter      time.Duration
+	region         string
+	radius         float64
+	residents      []*residentState
+	home           string
+	homeSince      time.Time
+	startedAt      time.Time
+	probeWiFi      func(ctx context.Context, resident Resident) bool
+	probeBluetooth func(ctx context.Context, mac string) bool
+	publish        func(msg *mqtt.Message) error
+	residentCbs    []func(name string, home bool)
+	homeCbs        []func(occupied bool)
+	approachCbs    []func(name string, eta time.Duration, now time.Time)
+	logger         *logger.Logger
+	mu             sync.Mutex
+}
+
+// NewResidentPresenceService creates the presence detector; every resident is unknown until seen
+// or missed for the away time
+func NewResidentPresenceService(cfg *ResidentPresenceConfig, serviceLogger *logger.Logger) *ResidentPresenceService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger(residentPresenceComponent, nil)
+	}
+
+	now := time.Now()
+	service := &ResidentPresenceService{
+		config:         cfg,
+		poll:           defaultResidentPoll,
+		awayAfter:      defaultResidentAwayAfter,
+		region:         defaultOwnTracksRegion,
+		radius:         defaultHomeRadiusMeters,
+		home:           ResidentUnknown,
+		startedAt:      now,
+		probeWiFi:      probeWiFi,
+		probeBluetooth: probeBluetooth,
+		logger:         serviceLogger,
+	}
+	if cfg.PollSeconds > 0 {
+		service.poll = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	if cfg.AwayMinutes > 0 {
+		service.awayAfter = time.Duration(cfg.AwayMinutes) * time.Minute
+	}
+	if cfg.OwnTracksRegion != "" {
+		service.region = cfg.OwnTracksRegion
+	}
+	if cfg.HomeRadiusMeters > 0 {
+		service.radius = cfg.HomeRadiusMeters
+	}
+	for _, resident := range cfg.Residents {
+		service.residents = append(service.residents, &residentState{resident: resident, state: ResidentUnknown})
+	}
+	return service
+}
+
+// SetMQTTClient publishes the presence states as retained messages
+func (s *ResidentPresenceService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// AddResidentCallback registers a callback for a resident arriving or leaving
+func (s *ResidentPresenceService) AddResidentCallback(callback func(name string, home bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.residentCbs = append(s.residentCbs, callback)
+}
+
+// AddHomeCallback registers a callback for the home becoming occupied, when the first resident
+// arrives, or empty, when the last one leaves
+func (s *ResidentPresenceService) AddHomeCallback(callback func(occupied bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.homeCbs = append(s.homeCbs, callback)
+}
+
+// AddApproachCallback registers a callback for an away resident heading home, with the time
+// until they arrive, on every OwnTracks report that brings them closer
+func (s *ResidentPresenceService) AddApproachCallback(callback func(name string, eta time.Duration, now time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approachCbs = append(s.approachCbs, callback)
+}
+
+// Subscribe follows the OwnTracks location reports of the residents
+func (s *ResidentPresenceService) Subscribe(client *mqtt.Client) error {
+	for _, state := range s.residents {
+		if state.resident.OwnTracksTopic == "" {
+			continue
+		}
+		name := state.resident.Name
+		err := client.Subscribe(state.resident.OwnTracksTopic, func(topic string, payload []byte) error {
+			return s.HandleOwnTracks(name, payload, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownTracksMessage is the part of an OwnTracks location or transition report that tells
+// whether the phone is home
+type ownTracksMessage struct {
+	Type      string   `json:"_type"`
+	Latitude  float64  `json:"lat"`
+	Longitude float64  `json:"lon"`
+	Velocity  float64  `json:"vel"` // km/h, when the phone reports it
+	InRegions []string `json:"inregions"`
+	Event     string   `json:"event"` // enter or leave, for transitions
+	Region    string   `json:"desc"`  // Region of a transition
+}
+
+// HandleOwnTracks records an OwnTracks report of a resident's phone
+func (s *ResidentPresenceService) HandleOwnTracks(name string, payload []byte, now time.Time) error {
+	var message ownTracksMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return err
+	}
+
+	var state string
+	switch message.Type {
+	case "transition":
+		if message.Region != s.region {
+			return nil
+		}
+		state = ResidentAway
+		if message.Event == "enter" {
+			state = ResidentHome
+		}
+	case "location":
+		state = ResidentAway
+		if s.config.HomeLatitude != 0 || s.config.HomeLongitude != 0 {
+			if distanceMeters(message.Latitude, message.Longitude, s.config.HomeLatitude, s.config.HomeLongitude) <= s.radius {
+				state = ResidentHome
+			}
+		} else {
+			for _, region := range message.InRegions {
+				if region == s.region {
+					state = ResidentHome
+				}
+			}
+		}
+	default:
+		return nil // Waypoints, last wills and the like
+	}
+
+	s.mu.Lock()
+	var eta time.Duration
+	for _, resident := range s.residents {
+		if resident.resident.Name == name {
+			resident.ownTracks = state
+			eta = s.approachLocked(resident, message, now)
+		}
+	}
+	approachCbs := append([]func(string, time.Duration, time.Time){}, s.approachCbs...)
+	s.mu.Unlock()
+
+	s.evaluate(now)
+	if eta > 0 {
+		for _, callback := range approachCbs {
+			callback(name, eta, now)
+		}
+	}
+	return nil
+}
+
+// approachLocked works out how long until an away resident arrives from the distance to the
+// home coordinates and the speed: the one the phone reports, else the one between the last
+// two reports. It returns 0 unless the resident is away and getting closer; callers must hold
+// the lock.
+func (s *ResidentPresenceService) approachLocked(resident *residentState, message ownTracksMessage, now time.Time) time.Duration {
+	if s.config.HomeLatitude == 0 && s.config.HomeLongitude == 0 {
+		return 0
+	}
+	if message.Latitude == 0 && message.Longitude == 0 {
+		return 0 // Transitions of regions defined without coordinates
+	}
+
+	distance := distanceMeters(message.Latitude, message.Longitude, s.config.HomeLatitude, s.config.HomeLongitude)
+	previous, previousAt := resident.distance, resident.distanceAt
+	resident.distance, resident.distanceAt = distance, now
+	resident.arrival = time.Time{}
+	if resident.ownTracks != ResidentAway || previousAt.IsZero() || previous-distance < minApproachMeters {
+		return 0
+	}
+
+	speed := message.Velocity * 1000 / 3600 // m/s
+	if message.Velocity < minApproachKmh {
+		elapsed := now.Sub(previousAt).Seconds()
+		if elapsed <= 0 {
+			return 0
+		}
+		speed = (previous - distance) / elapsed
+	}
+	if speed*3.6 < minApproachKmh {
+		return 0
+	}
+
+	eta := time.Duration((distance - s.radius) / speed * float64(time.Second))
+	if eta <= 0 {
+		return 0
+	}
+	resident.arrival = now.Add(eta)
+	return eta
+}
+
+// Run probes the phones every poll interval until the context is cancelled
+func (s *ResidentPresenceService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	s.Probe(ctx, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Probe(ctx, now)
+		}
+	}
+}
+
+// Probe looks for every resident's phone on the Wi-Fi and over Bluetooth, then updates the states
+func (s *ResidentPresenceService) Probe(ctx context.Context, now time.Time) {
+	var wg sync.WaitGroup
+	for _, state := range s.residents {
+		if !state.resident.probed() {
+			continue
+		}
+		wg.Add(1)
+		go func(state *residentState) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, residentProbeTimeout)
+			defer cancel()
+
+			source := ""
+			if (state.resident.IP != "" || state.resident.MAC != "") && s.probeWiFi(probeCtx, state.resident) {
+				source = PresenceSourceWiFi
+			} else if state.resident.BluetoothMAC != "" && s.probeBluetooth(probeCtx, state.resident.BluetoothMAC) {
+				source = PresenceSourceBluetooth
+			}
+			if source == "" {
+				return
+			}
+
+			s.mu.Lock()
+			state.seen, state.seenSource = now, source
+			s.mu.Unlock()
+		}(state)
+	}
+	wg.Wait()
+
+	s.evaluate(now)
+}
+
+// evaluate updates the state of every resident and of the home, publishing and calling back on changes
+func (s *ResidentPresenceService) evaluate(now time.Time) {
+	type change struct {
+		name  string
+		state string
+	}
+
+	s.mu.Lock()
+	var changes []change
+	var published []ResidentStatus
+	anyHome, allAway := false, true
+	for _, resident := range s.residents {
+		state, source := s.stateLocked(resident, now)
+		if state != resident.state {
+			s.logger.Info("Resident presence changed", map[string]interface{}{
+				"resident": resident.resident.Name,
+				"from":     resident.state,
+				"to":       state,
+				"source":   source,
+			})
+			resident.state, resident.source, resident.since = state, source, now
+			if state == ResidentHome {
+				resident.arrival = time.Time{}
+			}
+			changes = append(changes, change{resident.resident.Name, state})
+			published = append(published, resident.status())
+		}
+		anyHome = anyHome || state == ResidentHome
+		allAway = allAway && state == ResidentAway
+	}
+
+	home := ResidentUnknown
+	if anyHome {
+		home = ResidentHome
+	} else if allAway {
+		home = ResidentAway
+	}
+	homeChanged := home != s.home
+	if homeChanged {
+		s.logger.Info("Home occupancy changed", map[string]interface{}{"from": s.home, "to": home})
+		s.home, s.homeSince = home, now
+	}
+	residentCbs := append([]func(string, bool){}, s.residentCbs...)
+	homeCbs := append([]func(bool){}, s.homeCbs...)
+	s.mu.Unlock()
+
+	for _, status := range published {
+		s.publishState(mqtt.PresenceTopic(status.Name), status)
+	}
+	if homeChanged {
+		s.publishState(mqtt.OccupancyTopic, map[string]interface{}{"state": home, "since": now})
+	}
+
+	// Callbacks only learn of known states; a resident turning unknown changes nothing
+	for _, c := range changes {
+		if c.state == ResidentUnknown {
+			continue
+		}
+		for _, callback := range residentCbs {
+			callback(c.name, c.state == ResidentHome)
+		}
+	}
+	if homeChanged && home != ResidentUnknown {
+		for _, callback := range homeCbs {
+			callback(home == ResidentHome)
+		}
+	}
+}
+
+// stateLocked works out a resident's state: home while the phone was seen within the away
+// time or OwnTracks places it home, away once OwnTracks places it away or the phone was missed
+// for the away time; callers must hold the lock
+func (s *ResidentPresenceService) stateLocked(resident *residentState, now time.Time) (string, string) {
+	if !resident.seen.IsZero() && now.Sub(resident.seen) < s.awayAfter {
+		return ResidentHome, resident.seenSource
+	}
+	switch resident.ownTracks {
+	case ResidentHome:
+		return ResidentHome, PresenceSourceOwnTracks
+	case ResidentAway:
+		return ResidentAway, PresenceSourceOwnTracks
+	}
+	if resident.resident.probed() && now.Sub(s.startedAt) >= s.awayAfter {
+		return ResidentAway, resident.seenSource
+	}
+	return ResidentUnknown, ""
+}
+
+func (r *residentState) status() ResidentStatus {
+	return ResidentStatus{
+		Name:      r.resident.Name,
+		State:     r.state,
+		Source:    r.source,
+		Since:     r.since,
+		LastSeen:  r.seen,
+		OwnTracks: r.ownTracks,
+		Arrival:   r.arrival,
+	}
+}
+
+func (s *ResidentPresenceService) publishState(topic string, state interface{}) {
+	if s.publish == nil {
+		return
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := s.publish(&mqtt.Message{Topic: topic, Payload: payload, QoS: 1, Retain: true}); err != nil {
+		s.logger.Error("Failed to publish presence", err, map[string]interface{}{"topic": topic})
+	}
+}
+
+// Occupied reports whether any resident is home; false while the occupancy is unknown
+func (s *ResidentPresenceService) Occupied() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.home == ResidentHome
+}
+
+// Status returns the presence of every resident and of the home
+func (s *ResidentPresenceService) Status() HomePresenceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := HomePresenceStatus{State: s.home, Since: s.homeSince, Residents: make([]ResidentStatus, 0, len(s.residents))}
+	for _, resident := range s.residents {
+		status.Residents = append(status.Residents, resident.status())
+	}
+	sort.Slice(status.Residents, func(i, j int) bool { return status.Residents[i].Name < status.Residents[j].Name })
+	return status
+}
+
+// Handler serves the presence status as JSON
+func (s *ResidentPresenceService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+// probeWiFi pings the phone. Phones that ignore pings while asleep still answer the ARP request
+// the ping sends, so a complete ARP entry for the phone's MAC counts as well.
+func probeWiFi(ctx context.Context, resident Resident) bool {
+	ip := resident.IP
+	if ip == "" {
+		ip, _ = arpLookup(resident.MAC, "")
+	}
+	if ip == "" {
+		return false
+	}
+	if exec.CommandContext(ctx, "ping", "-c", "1", "-W", "1", ip).Run() == nil {
+		return true
+	}
+	if resident.MAC == "" {
+		return false
+	}
+	_, found := arpLookup(resident.MAC, ip)
+	return found
+}
+
+// arpLookup finds a complete ARP entry for a MAC, at ip if set, and returns its address
+func arpLookup(mac, ip string) (string, bool) {
+	file, err := os.Open(arpTablePath)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != arpFlagComplete || !strings.EqualFold(fields[3], mac) {
+			continue
+		}
+		if ip == "" || fields[0] == ip {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
+
+// probeBluetooth asks the phone for its name, which only a device in range answers
+func probeBluetooth(ctx context.Context, mac string) bool {
+	output, err := exec.CommandContext(ctx, "hcitool", "name", mac).Output()
+	return err == nil && strings.TrimSpace(string(output)) != ""
+}
+
+// distanceMeters is the great-circle distance between two coordinates
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat, dLon := toRad(lat2-lat1), toRad(lon2-lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
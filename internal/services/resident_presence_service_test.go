@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestResidentPresenceHoldsThermostatsWhileAway(t *testing.T) {
+	testLogger := logger.NewLogger("presence-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "hall", RoomID: "hall", Mode: models.ModeHeat, TargetTemp: 70})
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "office", RoomID: "office", Mode: models.ModeCool, TargetTemp: 74})
+	schedules := NewScheduleService(thermostats, NewPresenceService("", nil), "", testLogger)
+	setback := AwaySetback{HeatTemp: 62, CoolTemp: 82}
+
+	cfg := &ResidentPresenceConfig{
+		Residents: []Resident{
+			{Name: "alex", MAC: "aa:bb:cc:dd:ee:ff"},
+			{Name: "sam", OwnTracksTopic: "owntracks/sam/phone"},
+		},
+		AwayMinutes:   10,
+		HomeLatitude:  51.5,
+		HomeLongitude: -0.12,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	service := NewResidentPresenceService(cfg, testLogger)
+	start := time.Date(2024, 3, 4, 8, 0, 0, 0, time.Local)
+	service.startedAt = start
+
+	alexHome := true
+	service.probeWiFi = func(ctx context.Context, resident Resident) bool { return alexHome }
+	var mu sync.Mutex
+	published := make(map[string]string)
+	service.publish = func(msg *mqtt.Message) error {
+		var state struct {
+			State string `json:"state"`
+		}
+		json.Unmarshal(msg.Payload, &state)
+		if !msg.Retain {
+			t.Errorf("Expected retained presence on %s", msg.Topic)
+		}
+		mu.Lock()
+		published[msg.Topic] = state.State
+		mu.Unlock()
+		return nil
+	}
+	var occupancy []bool
+	service.AddHomeCallback(func(occupied bool) {
+		occupancy = append(occupancy, occupied)
+		schedules.SetAway(!occupied, setback, start)
+	})
+	target := func(id string) float64 {
+		thermostat, _ := thermostats.GetThermostat(id)
+		return thermostat.TargetTemp
+	}
+
+	// Alex's phone answers, Sam hasn't reported yet
+	service.Probe(context.Background(), start)
+	if !service.Occupied() || published[mqtt.PresenceTopic("alex")] != ResidentHome || published[mqtt.OccupancyTopic] != ResidentHome {
+		t.Fatalf("Expected alex and the home to be home, got %+v", service.Status())
+	}
+
+	// Sam's phone reports a location 2 km away; alex's phone is gone but not for long enough yet
+	away := []byte(`{"_type": "location", "lat": 51.52, "lon": -0.12, "tst": 1709539200}`)
+	if err := service.HandleOwnTracks("sam", away, start.Add(time.Minute)); err != nil {
+		t.Fatalf("HandleOwnTracks failed: %v", err)
+	}
+	alexHome = false
+	service.Probe(context.Background(), start.Add(5*time.Minute))
+	if !service.Occupied() || published[mqtt.PresenceTopic("sam")] != ResidentAway {
+		t.Fatalf("Expected sam away with alex still counted home, got %+v", service.Status())
+	}
+
+	service.Probe(context.Background(), start.Add(11*time.Minute))
+	if status := service.Status(); status.State != ResidentAway || published[mqtt.OccupancyTopic] != ResidentAway {
+		t.Fatalf("Expected the home to be empty, got %+v", status)
+	}
+	if target("hall") != 62 || target("office") != 82 {
+		t.Fatalf("Expected the away setbacks, got %v and %v", target("hall"), target("office"))
+	}
+
+	// Sam entering the home region ends the away holds and restores the targets
+	if err := service.HandleOwnTracks("sam", []byte(`{"_type": "transition", "event": "enter", "desc": "home"}`), start.Add(time.Hour)); err != nil {
+		t.Fatalf("HandleOwnTracks failed: %v", err)
+	}
+	if target("hall") != 70 || target("office") != 74 || len(schedules.Holds()) != 0 {
+		t.Errorf("Expected the targets restored, got %v and %v with %v", target("hall"), target("office"), schedules.Holds())
+	}
+	if len(occupancy) != 3 || !occupancy[0] || occupancy[1] || !occupancy[2] {
+		t.Errorf("Expected occupied, empty, occupied, got %v", occupancy)
+	}
+}
+
+func TestResidentPresenceConfigValidation(t *testing.T) {
+	for name, cfg := range map[string]ResidentPresenceConfig{
+		"no residents":     {},
+		"no detection":     {Residents: []Resident{{Name: "alex"}}},
+		"duplicate":        {Residents: []Resident{{Name: "alex", IP: "192.168.1.20"}, {Name: "alex", IP: "192.168.1.21"}}},
+		"wildcard name":    {Residents: []Resident{{Name: "al+ex", IP: "192.168.1.20"}}},
+		"negative minutes": {Residents: []Resident{{Name: "alex", IP: "192.168.1.20"}}, AwayMinutes: -1},
+		"empty setback":    {Residents: []Resident{{Name: "alex", IP: "192.168.1.20"}}, AwaySetback: &AwaySetback{}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	// Without home coordinates, OwnTracks' own region decides
+	service := NewResidentPresenceService(&ResidentPresenceConfig{Residents: []Resident{{Name: "sam", OwnTracksTopic: "owntracks/sam/phone"}}}, nil)
+	service.HandleOwnTracks("sam", []byte(`{"_type": "location", "lat": 1, "lon": 2, "inregions": ["home"]}`), time.Now())
+	if !service.Occupied() {
+		t.Errorf("Expected the home region to count as home, got %+v", service.Status())
+	}
+}
@@ -0,0 +1,395 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+const (
+	// RoomClosuresFileName keeps the rooms closed or opened through the API
+	RoomClosuresFileName = "room-closures.json"
+
+	// Sources of a room's closure
+	ClosureSourceSchedule = "schedule"
+	ClosureSourceManual   = "manual"
+
+	closurePeriodLayout   = "01-02" // Month and day, every year
+	roomClosureCheck      = time.Minute
+	defaultClosedHeatTemp = 50.0
+	defaultClosedCoolTemp = 85.0
+)
+
+// RoomClosuresPath returns the room closures file path for a state directory
+func RoomClosuresPath(stateDir string) string {
+	return filepath.Join(stateDir, RoomClosuresFileName)
+}
+
+// ClosurePeriod closes a room every year from one day to another, inclusive; a period may run
+// over the new year, e.g. from 11-01 until 03-31
+type ClosurePeriod struct {
+	From  string `json:"from"`  // MM-DD
+	Until string `json:"until"` // MM-DD
+}
+
+// contains reports whether the period includes the day of t
+func (p ClosurePeriod) contains(t time.Time) bool {
+	from, _ := time.Parse(closurePeriodLayout, p.From)
+	until, _ := time.Parse(closurePeriodLayout, p.Until)
+	day := int(t.Month())*100 + t.Day()
+	start := int(from.Month())*100 + from.Day()
+	end := int(until.Month())*100 + until.Day()
+	if start <= end {
+		return day >= start && day <= end
+	}
+	return day >= start || day <= end
+}
+
+// ClosedRoomConfig is the closure schedule and setback of one room
+type ClosedRoomConfig struct {
+	Closed  []ClosurePeriod `json:"closed,omitempty"`
+	Setback *AwaySetback    `json:"setback,omitempty"` // Default the home's closed setback
+}
+
+// RoomClosureConfig lists the rooms closed on a schedule and the deep setback of closed rooms.
+// Any room can also be closed through the API without being listed.
+type RoomClosureConfig struct {
+	Rooms   map[string]ClosedRoomConfig `json:"rooms,omitempty"`
+	Setback *AwaySetback                `json:"setback,omitempty"` // Default 50°F heating, 85°F cooling
+}
+
+// LoadRoomClosureConfig reads the room closure schedules from a JSON file
+func LoadRoomClosureConfig(path string) (*RoomClosureConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read room closures file", err)
+	}
+
+	var cfg RoomClosureConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse room closures file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the closure periods
+func (c *RoomClosureConfig) Validate() error {
+	for roomID, room := range c.Rooms {
+		for _, period := range room.Closed {
+			for _, day := range []string{period.From, period.Until} {
+				if _, err := time.Parse(closurePeriodLayout, day); err != nil {
+					return errors.NewValidationError(fmt.Sprintf("room %s: invalid day %q, use MM-DD", roomID, day), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// roomOverride is a room closed or opened through the API. It lasts until the room's schedule
+// next changes, like a next-block thermostat hold.
+type roomOverride struct {
+	Closed    bool      `json:"closed"`
+	Scheduled bool      `json:"scheduled"` // What the schedule said when the override was set
+	SetAt     time.Time `json:"set_at"`
+}
+
+// RoomClosure is the closure state of a room
+type RoomClosure struct {
+	RoomID string    `json:"room_id"`
+	Closed bool      `json:"closed"`
+	Source string    `json:"source"`
+	SetAt  time.Time `json:"set_at,omitempty"` // When a manual override was set
+}
+
+// RoomClosureService tracks closed-off rooms, such as a guest room between visits or a
+// sunroom over the winter. Closed rooms are left out of the room averages and automations, and
+// their thermostats are held at a deep setback through the closure callbacks.
+type RoomClosureService struct {
+	config    *RoomClosureConfig
+	path      string
+	overrides map[string]*roomOverride
+	applied   map[string]bool
+	callbacks []func(roomID string, closed bool)
+	logger    *logger.Logger
+	mu        sync.Mutex
+}
+
+// NewRoomClosureService creates the service, restoring the API overrides from path; a nil
+// config closes rooms through the API only
+func NewRoomClosureService(cfg *RoomClosureConfig, path string, serviceLogger *logger.Logger) *RoomClosureService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("RoomClosure", nil)
+	}
+	if cfg == nil {
+		cfg = &RoomClosureConfig{}
+	}
+
+	service := &RoomClosureService{
+		config:    cfg,
+		path:      path,
+		overrides: make(map[string]*roomOverride),
+		applied:   make(map[string]bool),
+		logger:    serviceLogger,
+	}
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load room closures, following the schedule", err)
+		}
+	}
+	return service
+}
+
+// AddClosureCallback registers a callback for a room being closed or opened. Every known room
+// is reported once by the first Apply, so holds left from before a restart are settled.
+func (s *RoomClosureService) AddClosureCallback(callback func(roomID string, closed bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// scheduled reports whether the schedule closes a room on the day of now
+func (s *RoomClosureService) scheduled(roomID string, now time.Time) bool {
+	for _, period := range s.config.Rooms[roomID].Closed {
+		if period.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// closureLocked returns a room's closure, dropping an override the schedule has moved past;
+// callers must hold the lock
+func (s *RoomClosureService) closureLocked(roomID string, now time.Time) RoomClosure {
+	scheduled := s.scheduled(roomID, now)
+	if override, ok := s.overrides[roomID]; ok {
+		if override.Scheduled == scheduled {
+			return RoomClosure{RoomID: roomID, Closed: override.Closed, Source: ClosureSourceManual, SetAt: override.SetAt}
+		}
+		delete(s.overrides, roomID)
+		if err := s.saveLocked(); err != nil {
+			s.logger.Error("Failed to save room closures", err)
+		}
+	}
+	return RoomClosure{RoomID: roomID, Closed: scheduled, Source: ClosureSourceSchedule}
+}
+
+// Closed reports whether a room is closed off now
+func (s *RoomClosureService) Closed(roomID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closureLocked(roomID, time.Now()).Closed
+}
+
+// Setback returns the deep setback of a closed room
+func (s *RoomClosureService) Setback(roomID string) AwaySetback {
+	if setback := s.config.Rooms[roomID].Setback; setback != nil {
+		return *setback
+	}
+	if s.config.Setback != nil {
+		return *s.config.Setback
+	}
+	return AwaySetback{HeatTemp: defaultClosedHeatTemp, CoolTemp: defaultClosedCoolTemp}
+}
+
+// Set closes or opens a room until its schedule next changes
+func (s *RoomClosureService) Set(roomID string, closed bool, now time.Time) (RoomClosure, error) {
+	if roomID == "" {
+		return RoomClosure{}, errors.NewValidationError("room is required", nil)
+	}
+
+	s.mu.Lock()
+	s.overrides[roomID] = &roomOverride{Closed: closed, Scheduled: s.scheduled(roomID, now), SetAt: now}
+	err := s.saveLocked()
+	s.mu.Unlock()
+
+	s.Apply(now)
+	return s.closure(roomID, now), err
+}
+
+// Reset drops a room's override, returning it to its schedule
+func (s *RoomClosureService) Reset(roomID string, now time.Time) (RoomClosure, error) {
+	s.mu.Lock()
+	delete(s.overrides, roomID)
+	err := s.saveLocked()
+	s.mu.Unlock()
+
+	s.Apply(now)
+	return s.closure(roomID, now), err
+}
+
+func (s *RoomClosureService) closure(roomID string, now time.Time) RoomClosure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closureLocked(roomID, now)
+}
+
+// Apply calls back for every room whose closure changed since the last call
+func (s *RoomClosureService) Apply(now time.Time) {
+	s.mu.Lock()
+	var changed []RoomClosure
+	for _, roomID := range s.roomsLocked() {
+		closure := s.closureLocked(roomID, now)
+		if previous, known := s.applied[roomID]; known && previous == closure.Closed {
+			continue
+		}
+		s.applied[roomID] = closure.Closed
+		changed = append(changed, closure)
+	}
+	callbacks := append([]func(string, bool){}, s.callbacks...)
+	s.mu.Unlock()
+
+	for _, closure := range changed {
+		s.logger.Info("Room closure applied", map[string]interface{}{
+			"room_id": closure.RoomID,
+			"closed":  closure.Closed,
+			"source":  closure.Source,
+		})
+		for _, callback := range callbacks {
+			callback(closure.RoomID, closure.Closed)
+		}
+	}
+}
+
+// roomsLocked lists the rooms with a schedule or an override; callers must hold the lock
+func (s *RoomClosureService) roomsLocked() []string {
+	known := make(map[string]bool)
+	for roomID := range s.config.Rooms {
+		known[roomID] = true
+	}
+	for roomID := range s.overrides {
+		known[roomID] = true
+	}
+	for roomID := range s.applied {
+		known[roomID] = true
+	}
+	rooms := make([]string, 0, len(known))
+	for roomID := range known {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Run applies the closure schedules every minute until the context is cancelled
+func (s *RoomClosureService) Run(ctx context.Context) {
+	ticker := time.NewTicker(roomClosureCheck)
+	defer ticker.Stop()
+
+	s.Apply(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Apply(now)
+		}
+	}
+}
+
+// Closures returns every room with a schedule or an override
+func (s *RoomClosureService) Closures(now time.Time) []RoomClosure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	closures := make([]RoomClosure, 0)
+	for _, roomID := range s.roomsLocked() {
+		closures = append(closures, s.closureLocked(roomID, now))
+	}
+	return closures
+}
+
+// Handler serves the room closures as JSON
+func (s *RoomClosureService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"rooms": s.Closures(time.Now())})
+	})
+}
+
+// SetHandler closes or opens ?room= on a POST with ?closed=true or false, or returns it to its
+// schedule with ?closed=schedule
+func (s *RoomClosureService) SetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to close or open a room", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		var closure RoomClosure
+		var err error
+		if value := query.Get("closed"); value == ClosureSourceSchedule {
+			closure, err = s.Reset(query.Get("room"), time.Now())
+		} else {
+			closed, parseErr := strconv.ParseBool(value)
+			if parseErr != nil {
+				http.Error(w, "closed must be true, false or schedule", http.StatusBadRequest)
+				return
+			}
+			closure, err = s.Set(query.Get("room"), closed, time.Now())
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(closure)
+	})
+}
+
+func (s *RoomClosureService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read room closures", err)
+	}
+	if err := json.Unmarshal(data, &s.overrides); err != nil {
+		return errors.NewSystemError("failed to parse room closures", err)
+	}
+	return nil
+}
+
+// saveLocked atomically writes the overrides; callers must hold the lock
+func (s *RoomClosureService) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.overrides, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal room closures", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write room closures", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace room closures", err)
+	}
+	return nil
+}
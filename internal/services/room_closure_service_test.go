@@ -0,0 +1,108 @@
+package services
+
+import (
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestRoomClosureHoldsDeepSetback(t *testing.T) {
+	testLogger := logger.NewLogger("closure-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "sunroom", RoomID: "sunroom", Mode: models.ModeHeat, TargetTemp: 68})
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "guest", RoomID: "guest", Mode: models.ModeHeat, TargetTemp: 70})
+	schedules := NewScheduleService(thermostats, NewPresenceService("", nil), "", testLogger)
+	target := func(id string) float64 {
+		thermostat, _ := thermostats.GetThermostat(id)
+		return thermostat.TargetTemp
+	}
+
+	cfg := &RoomClosureConfig{Rooms: map[string]ClosedRoomConfig{
+		"sunroom": {Closed: []ClosurePeriod{{From: "11-01", Until: "03-31"}}, Setback: &AwaySetback{HeatTemp: 55}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), RoomClosuresFileName)
+	service := NewRoomClosureService(cfg, path, testLogger)
+	service.AddClosureCallback(func(roomID string, closed bool) {
+		schedules.SetClosed(roomID, closed, service.Setback(roomID), time.Now())
+	})
+
+	// The winter closure runs over the new year
+	january := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	service.Apply(january)
+	if target("sunroom") != 55 || target("guest") != 70 {
+		t.Fatalf("Expected only the sunroom at its setback, got %v and %v", target("sunroom"), target("guest"))
+	}
+
+	// The guest room is closed through the API at the default deep setback, over a manual hold
+	if _, err := schedules.Hold("guest", models.ThermostatHold{TargetTemp: 72}, january); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	service.SetHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/rooms/closures/set?room=guest&closed=true", nil))
+	if recorder.Code != 200 || !service.Closed("guest") || target("guest") != defaultClosedHeatTemp {
+		t.Fatalf("Expected the guest room closed, got %d: %s at %v", recorder.Code, recorder.Body.String(), target("guest"))
+	}
+
+	// The override survives a restart; reopening restores the held target from before closing
+	restored := NewRoomClosureService(cfg, path, testLogger)
+	restored.AddClosureCallback(func(roomID string, closed bool) {
+		schedules.SetClosed(roomID, closed, restored.Setback(roomID), time.Now())
+	})
+	if closures := restored.Closures(time.Now()); len(closures) != 2 || closures[0].RoomID != "guest" || closures[0].Source != ClosureSourceManual {
+		t.Fatalf("Expected the guest room override restored, got %+v", closures)
+	}
+	if _, err := restored.Set("guest", false, january); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if target("guest") != 72 || len(schedules.Holds()) != 1 {
+		t.Errorf("Expected the guest room target restored, got %v with %v", target("guest"), schedules.Holds())
+	}
+
+	// Opening the sunroom by hand lasts until the schedule next changes
+	restored.Set("sunroom", false, january)
+	if restored.Closed("sunroom") || target("sunroom") != 68 {
+		t.Fatalf("Expected the sunroom opened, got %v", target("sunroom"))
+	}
+	april := time.Date(2024, 4, 1, 12, 0, 0, 0, time.Local)
+	restored.Apply(april)
+	november := time.Date(2024, 11, 1, 0, 0, 0, 0, time.Local)
+	restored.Apply(november)
+	if target("sunroom") != 55 {
+		t.Errorf("Expected the next winter to close the sunroom again, got %v", target("sunroom"))
+	}
+
+	if err := (&RoomClosureConfig{Rooms: map[string]ClosedRoomConfig{"attic": {Closed: []ClosurePeriod{{From: "13-01", Until: "02-01"}}}}}).Validate(); err == nil {
+		t.Error("Expected an invalid day to be rejected")
+	}
+}
+
+func TestClosedRoomsLeaveAveragesAndAutomations(t *testing.T) {
+	service := NewUnifiedSensorService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), log.New(os.Stdout, "", 0))
+	service.SetClosedRooms(func(roomID string) bool { return roomID == "guest" })
+	motions := make(chan string, 2)
+	service.AddMotionCallback(func(roomID string, occupied bool) { motions <- roomID })
+
+	service.handleTemperatureMessage("room-temp/guest", []byte(`{"temperature": 50, "humidity": 40, "room": "guest", "device_id": "pico-guest"}`))
+	service.handleTemperatureMessage("room-temp/kitchen", []byte(`{"temperature": 70, "humidity": 40, "room": "kitchen", "device_id": "pico-kitchen"}`))
+	service.handleMotionMessage("room-motion/guest", []byte(`{"motion": true, "room": "guest", "device_id": "pico-guest"}`))
+	service.handleMotionMessage("room-motion/kitchen", []byte(`{"motion": true, "room": "kitchen", "device_id": "pico-kitchen"}`))
+
+	if roomID := <-motions; roomID != "kitchen" {
+		t.Errorf("Expected motion callbacks for the kitchen only, got %s", roomID)
+	}
+	summary := service.GetSensorSummary()
+	if summary["average_temperature"] != 70.0 || summary["occupied_rooms"] != 1 || summary["closed_rooms"] != 1 || summary["online_devices"] != 2 {
+		t.Errorf("Expected the guest room left out of the averages, got %+v", summary)
+	}
+}
@@ -0,0 +1,478 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// ScenesFileName holds the captured scenes of a service inside the state directory
+const ScenesFileName = "scenes-%s.json"
+
+// SceneService captures the current state of a set of devices as a named scene and recalls it.
+// Lights, switches and climate devices come from the device service, plugs from the last Tapo
+// reading and thermostats from the thermostat service; each source is optional.
+type SceneService struct {
+	devices     *DeviceService
+	thermostats *ThermostatService
+	tapo        *TapoService
+	plugs       map[string]EnergyReading // Last reading per Tapo plug
+	path        string
+	logger      *logger.Logger
+	scenes      map[string]*models.Scene
+	mu          sync.RWMutex
+}
+
+// NewSceneService creates a scene service persisting to path, or keeping scenes in memory if empty
+func NewSceneService(path string, serviceLogger *logger.Logger) *SceneService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("SceneService", nil)
+	}
+
+	service := &SceneService{
+		plugs:  make(map[string]EnergyReading),
+		path:   path,
+		logger: serviceLogger,
+		scenes: make(map[string]*models.Scene),
+	}
+
+	if err := service.Reload(); err != nil {
+		serviceLogger.Error("Failed to load scenes, starting without", err)
+	}
+	return service
+}
+
+// ScenesPath returns the scenes file of a service in a state directory. Each service keeps the
+// scenes of the devices it controls, so services don't overwrite each other's scenes.
+func ScenesPath(stateDir, service string) string {
+	return filepath.Join(stateDir, fmt.Sprintf(ScenesFileName, service))
+}
+
+// SetDeviceService captures and restores lights, switches and climate devices
+func (s *SceneService) SetDeviceService(devices *DeviceService) {
+	s.devices = devices
+}
+
+// SetThermostatService captures and restores thermostat targets and modes
+func (s *SceneService) SetThermostatService(thermostats *ThermostatService) {
+	s.thermostats = thermostats
+}
+
+// SetTapoService restores Tapo plugs; their state is captured from RecordPlugReading
+func (s *SceneService) SetTapoService(tapo *TapoService) {
+	s.tapo = tapo
+}
+
+// RecordPlugReading remembers whether a plug is on; it fits TapoService.AddReadingCallback
+func (s *SceneService) RecordPlugReading(reading EnergyReading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugs[reading.DeviceID] = reading
+}
+
+// Capture saves the current state of the selected devices as a scene, replacing any scene of the same name
+func (s *SceneService) Capture(name string, selection models.SceneSelection) (*models.Scene, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.NewValidationError("scene name cannot be empty", nil)
+	}
+	if len(selection.DeviceIDs) == 0 && selection.Tag == "" && selection.RoomID == "" {
+		return nil, errors.NewValidationError("select devices by ID, tag or room", nil)
+	}
+
+	captured := s.captureDevices(selection)
+
+	// Every device asked for by ID must have been found
+	var missing []string
+	for _, id := range selection.DeviceIDs {
+		if !slices.ContainsFunc(captured, func(device models.SceneDevice) bool { return device.DeviceID == id }) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown devices: %s", strings.Join(missing, ", ")), nil)
+	}
+	if len(captured) == 0 {
+		return nil, errors.NewValidationError("no devices match the selection", nil)
+	}
+
+	sort.Slice(captured, func(i, j int) bool {
+		return captured[i].DeviceID < captured[j].DeviceID
+	})
+	scene := &models.Scene{Name: name, Devices: captured, CreatedAt: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenes[name] = scene
+
+	s.logger.Info("Captured scene", map[string]interface{}{
+		"scene":   name,
+		"devices": len(captured),
+	})
+	return scene, s.save()
+}
+
+// Recall puts every device of a scene back into its captured state, continuing past failures
+func (s *SceneService) Recall(name string) error {
+	scene, exists := s.Scene(name)
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("scene %s not found", name), nil)
+	}
+
+	var failed []string
+	for _, device := range scene.Devices {
+		if err := s.restore(device); err != nil {
+			s.logger.Error("Failed to restore scene device", err, map[string]interface{}{
+				"scene":     name,
+				"device_id": device.DeviceID,
+			})
+			failed = append(failed, device.DeviceID)
+		}
+	}
+
+	s.logger.Info("Recalled scene", map[string]interface{}{
+		"scene":   name,
+		"devices": len(scene.Devices),
+		"failed":  len(failed),
+	})
+
+	if len(failed) > 0 {
+		return errors.NewDeviceError(fmt.Sprintf("scene %s failed on %d of %d devices: %s",
+			name, len(failed), len(scene.Devices), strings.Join(failed, ", ")), nil)
+	}
+	return nil
+}
+
+// Delete removes a scene
+func (s *SceneService) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.scenes[name]; !exists {
+		return errors.NewValidationError(fmt.Sprintf("scene %s not found", name), nil)
+	}
+	delete(s.scenes, name)
+	return s.save()
+}
+
+// Scene returns a scene by name
+func (s *SceneService) Scene(name string) (*models.Scene, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scene, exists := s.scenes[name]
+	return scene, exists
+}
+
+// Scenes returns every scene, sorted by name
+func (s *SceneService) Scenes() []*models.Scene {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	scenes := make([]*models.Scene, 0, len(s.scenes))
+	for _, scene := range s.scenes {
+		scenes = append(scenes, scene)
+	}
+	sort.Slice(scenes, func(i, j int) bool {
+		return scenes[i].Name < scenes[j].Name
+	})
+	return scenes
+}
+
+// Handler serves the scenes as JSON; ?name= selects one scene
+func (s *SceneService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scenes := s.Scenes()
+		if name := r.URL.Query().Get("name"); name != "" {
+			scene, exists := s.Scene(name)
+			if !exists {
+				http.Error(w, fmt.Sprintf("scene %s not found", name), http.StatusNotFound)
+				return
+			}
+			scenes = []*models.Scene{scene}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"scenes": scenes,
+		})
+	})
+}
+
+// CaptureHandler captures a scene on POST with a JSON body of the name and selection,
+// e.g. {"name": "movie night", "room_id": "living-room"}
+func (s *SceneService) CaptureHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to capture a scene", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Name string `json:"name"`
+			models.SceneSelection
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid scene request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		scene, err := s.Capture(request.Name, request.SceneSelection)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if appErr, ok := err.(*errors.HomeAutomationError); ok && appErr.Type == errors.ErrorTypeValidation {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(scene)
+	})
+}
+
+// RecallHandler recalls the scene ?name= on POST
+func (s *SceneService) RecallHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to recall a scene", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if _, exists := s.Scene(name); !exists {
+			http.Error(w, fmt.Sprintf("scene %s not found", name), http.StatusNotFound)
+			return
+		}
+		if err := s.Recall(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// DeleteHandler deletes the scene ?name= on POST
+func (s *SceneService) DeleteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to delete a scene", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if _, exists := s.Scene(name); !exists {
+			http.Error(w, fmt.Sprintf("scene %s not found", name), http.StatusNotFound)
+			return
+		}
+		if err := s.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Reload re-reads the scenes file
+func (s *SceneService) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read scenes", err)
+	}
+
+	scenes := make(map[string]*models.Scene)
+	if err := json.Unmarshal(data, &scenes); err != nil {
+		return errors.NewSystemError("failed to parse scenes", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenes = scenes
+	return nil
+}
+
+// save atomically writes the scenes; callers must hold the lock
+func (s *SceneService) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.scenes, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal scenes", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write scenes", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace scenes", err)
+	}
+	return nil
+}
+
+// captureDevices returns the current state of every selected device
+func (s *SceneService) captureDevices(selection models.SceneSelection) []models.SceneDevice {
+	var captured []models.SceneDevice
+
+	if s.devices != nil {
+		for _, device := range s.devices.GetAllDevices() {
+			if !selected(selection, device.ID, device.RoomID, s.devices.DeviceTags(device)) {
+				continue
+			}
+			if state, ok := captureDevice(device); ok {
+				captured = append(captured, state)
+			}
+		}
+	}
+
+	if s.thermostats != nil {
+		for _, thermostat := range s.thermostats.GetAllThermostats() {
+			if !selected(selection, thermostat.ID, thermostat.RoomID, nil) {
+				continue
+			}
+			target := thermostat.TargetTemp
+			captured = append(captured, models.SceneDevice{
+				DeviceID:   thermostat.ID,
+				Kind:       models.SceneKindThermostat,
+				TargetTemp: &target,
+				Mode:       thermostat.Mode,
+			})
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, reading := range s.plugs {
+		if !selected(selection, reading.DeviceID, reading.RoomID, reading.Tags) {
+			continue
+		}
+		on := reading.IsOn
+		captured = append(captured, models.SceneDevice{DeviceID: reading.DeviceID, Kind: models.SceneKindPlug, Power: &on})
+	}
+	return captured
+}
+
+// captureDevice returns the state of a light, switch or climate device
+func captureDevice(device *models.Device) (models.SceneDevice, bool) {
+	state := models.SceneDevice{DeviceID: device.ID}
+	if power, ok := device.Properties["power"].(bool); ok {
+		state.Power = &power
+	}
+
+	switch device.Type {
+	case models.DeviceTypeLight:
+		state.Kind = models.SceneKindLight
+		if brightness, ok := device.Properties["brightness"].(float64); ok {
+			state.Brightness = &brightness
+		}
+	case models.DeviceTypeSwitch:
+		state.Kind = models.SceneKindSwitch
+	case models.DeviceTypeClimate:
+		state.Kind = models.SceneKindClimate
+		if temperature, ok := device.Properties["temperature"].(float64); ok {
+			state.TargetTemp = &temperature
+		}
+	default:
+		return state, false // Sensors, cameras and locks have no state to recall
+	}
+	return state, true
+}
+
+// restore puts one device back into its captured state
+func (s *SceneService) restore(device models.SceneDevice) error {
+	switch device.Kind {
+	case models.SceneKindLight, models.SceneKindSwitch, models.SceneKindClimate:
+		if s.devices == nil {
+			return errors.NewServiceError("no device service to restore "+device.DeviceID, nil)
+		}
+		return s.restoreDevice(device)
+
+	case models.SceneKindPlug:
+		if s.tapo == nil {
+			return errors.NewServiceError("no Tapo service to restore "+device.DeviceID, nil)
+		}
+		if device.Power == nil {
+			return nil
+		}
+		return s.tapo.SetDeviceState(device.DeviceID, *device.Power)
+
+	case models.SceneKindThermostat:
+		if s.thermostats == nil {
+			return errors.NewServiceError("no thermostat service to restore "+device.DeviceID, nil)
+		}
+		if device.Mode != "" {
+			if err := s.thermostats.SetMode(device.DeviceID, device.Mode); err != nil {
+				return err
+			}
+		}
+		if device.TargetTemp != nil {
+			return s.thermostats.SetTargetTemperature(device.DeviceID, *device.TargetTemp)
+		}
+		return nil
+	}
+	return errors.NewValidationError(fmt.Sprintf("unknown scene device kind %s", device.Kind), nil)
+}
+
+// restoreDevice sends the device service the commands that reproduce a captured state.
+// A light that was on gets its brightness after being switched on.
+func (s *SceneService) restoreDevice(device models.SceneDevice) error {
+	var commands []*models.DeviceCommand
+	if device.Power != nil {
+		action := "turn_off"
+		if *device.Power {
+			action = "turn_on"
+		}
+		commands = append(commands, &models.DeviceCommand{DeviceID: device.DeviceID, Action: action})
+	}
+	if device.Brightness != nil && (device.Power == nil || *device.Power) {
+		commands = append(commands, &models.DeviceCommand{DeviceID: device.DeviceID, Action: "set_brightness", Value: *device.Brightness})
+	}
+	if device.TargetTemp != nil {
+		commands = append(commands, &models.DeviceCommand{DeviceID: device.DeviceID, Action: "set_temperature", Value: *device.TargetTemp})
+	}
+
+	for _, cmd := range commands {
+		if err := s.devices.ExecuteCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selected reports whether a device matches every filter of a selection
+func selected(selection models.SceneSelection, id, roomID string, tags []string) bool {
+	if len(selection.DeviceIDs) > 0 && !slices.Contains(selection.DeviceIDs, id) {
+		return false
+	}
+	if selection.RoomID != "" && selection.RoomID != roomID {
+		return false
+	}
+	if selection.Tag != "" && !models.HasTag(tags, selection.Tag) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestSceneCaptureAndRecall(t *testing.T) {
+	devices := NewDeviceService(nil, nil)
+	devices.AddDevice(&models.Device{ID: "lamp", Type: models.DeviceTypeLight, RoomID: "living-room",
+		Properties: map[string]interface{}{"power": true, "brightness": 30.0}})
+	devices.AddDevice(&models.Device{ID: "tv-plug", Type: models.DeviceTypeSwitch, RoomID: "living-room",
+		Properties: map[string]interface{}{"power": true}})
+	devices.AddDevice(&models.Device{ID: "hall", Type: models.DeviceTypeLight, RoomID: "hallway",
+		Properties: map[string]interface{}{"power": true}})
+
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), logger.NewLogger("scene-test", nil))
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "living-room", RoomID: "living-room", Mode: models.ModeHeat, TargetTemp: 68})
+
+	path := ScenesPath(t.TempDir(), "unified")
+	service := NewSceneService(path, nil)
+	service.SetDeviceService(devices)
+	service.SetThermostatService(thermostats)
+
+	scene, err := service.Capture("movie night", models.SceneSelection{RoomID: "living-room"})
+	if err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if len(scene.Devices) != 3 {
+		t.Fatalf("Expected the lamp, TV plug and thermostat, got %+v", scene.Devices)
+	}
+
+	// Change everything, then recall
+	devices.ExecuteCommand(&models.DeviceCommand{DeviceID: "lamp", Action: "set_brightness", Value: 100.0})
+	devices.ExecuteCommand(&models.DeviceCommand{DeviceID: "tv-plug", Action: "turn_off"})
+	devices.ExecuteCommand(&models.DeviceCommand{DeviceID: "hall", Action: "turn_off"})
+	thermostats.SetTargetTemperature("living-room", 72)
+
+	if err := service.Recall("movie night"); err != nil {
+		t.Fatalf("Recall failed: %v", err)
+	}
+	if lamp, _ := devices.GetDevice("lamp"); lamp.Properties["brightness"] != 30.0 || lamp.Properties["power"] != true {
+		t.Errorf("Expected the lamp back on at 30%%, got %v", lamp.Properties)
+	}
+	if plug, _ := devices.GetDevice("tv-plug"); plug.Properties["power"] != true {
+		t.Errorf("Expected the TV plug back on, got %v", plug.Properties)
+	}
+	if hall, _ := devices.GetDevice("hall"); hall.Properties["power"] != false {
+		t.Errorf("Expected the hallway light outside the scene to stay off, got %v", hall.Properties)
+	}
+	if thermostat, _ := thermostats.GetThermostat("living-room"); thermostat.TargetTemp != 68 {
+		t.Errorf("Expected the thermostat back at 68, got %v", thermostat.TargetTemp)
+	}
+
+	// Scenes survive a restart
+	if restored := NewSceneService(path, nil); len(restored.Scenes()) != 1 {
+		t.Errorf("Expected the scene to be restored, got %+v", restored.Scenes())
+	}
+}
+
+func TestSceneCaptureHandler(t *testing.T) {
+	devices := NewDeviceService(nil, nil)
+	devices.AddDevice(&models.Device{ID: "lamp", Type: models.DeviceTypeLight, Tags: []string{"holiday-lights"},
+		Properties: map[string]interface{}{"power": false}})
+
+	service := NewSceneService("", nil)
+	service.SetDeviceService(devices)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"name": "holiday", "tag": "holiday-lights"}`, 201},
+		{`{"name": "everything"}`, 400},
+		{`{"name": "missing", "device_ids": ["lamp", "porch"]}`, 400},
+		{`not json`, 400},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		service.CaptureHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/scenes/capture", bytes.NewBufferString(test.body)))
+		if recorder.Code != test.code {
+			t.Errorf("Expected %d for %s, got %d: %s", test.code, test.body, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	service.RecallHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/scenes/recall?name=unknown", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Expected 404 for an unknown scene, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,1088 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/calendar"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// ThermostatScheduleFileName holds HVAC runtime and applied schedules inside the state directory
+const ThermostatScheduleFileName = "thermostat-schedules.json"
+
+// Schedule suggestion parameters
+const (
+	occupiedThreshold    = 0.3                // Fraction of an hour a room must be occupied to count as occupied
+	minScheduleHistory   = 7 * 24 * time.Hour // Occupancy history needed before suggesting a schedule
+	heatingSetbackF      = 6.0                // Unoccupied heating setpoint below the comfort setpoint
+	coolingSetbackF      = 4.0                // Unoccupied cooling setpoint above the comfort setpoint
+	maxPreconditioning   = time.Hour          // Longest head start before an occupied block
+	minutesPerWeek       = 7 * 24 * 60
+	scheduleSaveInterval = 5 * time.Minute
+)
+
+// roomRuntime is the HVAC runtime of a room by hour of the week
+type roomRuntime struct {
+	Heating     HourGrid                `json:"heating"` // Seconds spent heating
+	Cooling     HourGrid                `json:"cooling"` // Seconds spent cooling
+	HeatingRuns int                     `json:"heating_runs"`
+	CoolingRuns int                     `json:"cooling_runs"`
+	Status      models.ThermostatStatus `json:"status"`
+	StatusSince time.Time               `json:"status_since"`
+}
+
+// scheduleState is persisted across restarts
+type scheduleState struct {
+	Runtime   map[string]*roomRuntime                `json:"runtime"`
+	Schedules map[string][]models.ThermostatSchedule `json:"schedules"`
+	Holds     map[string]*models.ThermostatHold      `json:"holds,omitempty"`
+}
+
+// ScheduleEdit is the body of a schedule change, over REST or on a thermostat's schedule/set topic
+type ScheduleEdit struct {
+	Days models.WeeklySchedule `json:"days"`
+}
+
+// ScheduleBlock is one occupied or unoccupied stretch of a suggested schedule, for review
+type ScheduleBlock struct {
+	StartDay   string  `json:"start_day"`
+	Start      string  `json:"start"` // HH:MM
+	EndDay     string  `json:"end_day"`
+	End        string  `json:"end"`
+	Occupied   bool    `json:"occupied"`
+	TargetTemp float64 `json:"target_temp"`
+}
+
+// ScheduleSuggestion is a weekly schedule derived from a room's occupancy and HVAC runtime
+type ScheduleSuggestion struct {
+	ThermostatID string                `json:"thermostat_id"`
+	RoomID       string                `json:"room_id"`
+	Mode         models.ThermostatMode `json:"mode"` // Season the setback is for: heat or cool
+	ComfortTemp  float64               `json:"comfort_temp"`
+	SetbackTemp  float64               `json:"setback_temp"`
+	// PreconditionMinutes starts occupied blocks early so the room is comfortable on arrival
+	PreconditionMinutes int                         `json:"precondition_minutes"`
+	Blocks              []ScheduleBlock             `json:"blocks"`
+	Schedule            []models.ThermostatSchedule `json:"schedule"`
+	GeneratedAt         time.Time                   `json:"generated_at"`
+}
+
+// ScheduleService suggests weekly thermostat schedules from occupancy heatmaps and HVAC runtime,
+// keeps edited weekly schedules, and applies their setpoints unless a manual hold overrides them
+type ScheduleService struct {
+	thermostats *ThermostatService
+	presence    *PresenceService
+	calendar    *calendar.Calendar // Picks the weekday schedule of holidays; nil follows the weekday
+	path        string
+	logger      *logger.Logger
+	state       scheduleState
+	suggestions map[string]*ScheduleSuggestion // Last suggestion per thermostat, the one Apply installs
+	applied     map[string]string              // ID of the schedule entry last applied per thermostat
+	publish     func(*mqtt.Message) error      // Publishes retained schedule state; nil without MQTT
+	lastSave    time.Time
+	mu          sync.Mutex
+}
+
+// NewScheduleService creates a schedule service persisting to path, or keeping state in memory if empty
+func NewScheduleService(thermostats *ThermostatService, presence *PresenceService, path string, serviceLogger *logger.Logger) *ScheduleService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ScheduleService", nil)
+	}
+
+	service := &ScheduleService{
+		thermostats: thermostats,
+		presence:    presence,
+		path:        path,
+		logger:      serviceLogger,
+		state: scheduleState{
+			Runtime:   make(map[string]*roomRuntime),
+			Schedules: make(map[string][]models.ThermostatSchedule),
+			Holds:     make(map[string]*models.ThermostatHold),
+		},
+		suggestions: make(map[string]*ScheduleSuggestion),
+		applied:     make(map[string]string),
+	}
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load thermostat schedules, starting without", err)
+		}
+	}
+	return service
+}
+
+// Reload replaces the schedules and holds with the ones on disk, e.g. after a failover
+// takeover restored the state file of the failed gateway
+func (s *ScheduleService) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.applied = make(map[string]string) // Reapply the current blocks
+	return nil
+}
+
+// ThermostatSchedulePath returns the schedule file path for a state directory
+func ThermostatSchedulePath(stateDir string) string {
+	return filepath.Join(stateDir, ThermostatScheduleFileName)
+}
+
+// SetCalendar makes holidays follow the schedule of the calendar's holidays_as weekday
+func (s *ScheduleService) SetCalendar(cal *calendar.Calendar) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calendar = cal
+}
+
+// RecordStatus accumulates HVAC runtime; it fits ThermostatService.AddStatusCallback
+func (s *ScheduleService) RecordStatus(thermostat models.Thermostat) {
+	s.recordStatus(thermostat.RoomID, thermostat.Status, thermostat.UpdatedAt)
+}
+
+// recordStatus closes the running heating or cooling period of a room and starts the next
+func (s *ScheduleService) recordStatus(roomID string, status models.ThermostatStatus, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runtime, exists := s.state.Runtime[roomID]
+	if !exists {
+		runtime = &roomRuntime{}
+		s.state.Runtime[roomID] = runtime
+	}
+
+	switch runtime.Status {
+	case models.StatusHeating:
+		addSeconds(&runtime.Heating, runtime.StatusSince, at)
+	case models.StatusCooling:
+		addSeconds(&runtime.Cooling, runtime.StatusSince, at)
+	}
+
+	if status != runtime.Status {
+		switch status {
+		case models.StatusHeating:
+			runtime.HeatingRuns++
+		case models.StatusCooling:
+			runtime.CoolingRuns++
+		}
+	}
+	runtime.Status = status
+	runtime.StatusSince = at
+
+	if s.path != "" && time.Since(s.lastSave) >= scheduleSaveInterval {
+		if err := s.save(); err != nil {
+			s.logger.Error("Failed to save thermostat schedules", err)
+		}
+	}
+}
+
+// Suggest derives a weekly schedule for a thermostat from its room's occupancy heatmap. Hours
+// occupied at least 30% of the time get the comfort setpoint, the rest a setback, and occupied
+// blocks start early by the average heating or cooling run. The suggestion is kept for Apply.
+func (s *ScheduleService) Suggest(thermostatID string, now time.Time) (*ScheduleSuggestion, error) {
+	current, err := s.thermostats.GetThermostat(thermostatID)
+	if err != nil {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown thermostat %s", thermostatID), err)
+	}
+	thermostat := *current
+
+	heatmap, exists := s.presence.Heatmap(thermostat.RoomID, now)
+	if !exists || now.Sub(heatmap.Since) < minScheduleHistory {
+		days := 0
+		if exists {
+			days = int(now.Sub(heatmap.Since).Hours() / 24)
+		}
+		return nil, errors.NewBusinessError(fmt.Sprintf("not enough occupancy history for room %s (%d days, need %d)",
+			thermostat.RoomID, days, int(minScheduleHistory.Hours()/24)), nil).WithRoom(thermostat.RoomID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suggestion := &ScheduleSuggestion{
+		ThermostatID: thermostat.ID,
+		RoomID:       thermostat.RoomID,
+		Mode:         models.ModeHeat,
+		ComfortTemp:  s.comfortTemp(thermostat),
+		GeneratedAt:  now,
+	}
+
+	// The season is whichever of heating and cooling ran longer, or the thermostat's mode without history
+	var runtimeSeconds float64
+	var runs int
+	runtime := s.state.Runtime[thermostat.RoomID]
+	if runtime != nil {
+		heating, cooling := gridTotal(runtime.Heating), gridTotal(runtime.Cooling)
+		runtimeSeconds, runs = heating, runtime.HeatingRuns
+		if cooling > heating {
+			suggestion.Mode = models.ModeCool
+			runtimeSeconds, runs = cooling, runtime.CoolingRuns
+		}
+	}
+	if (runtime == nil || runtimeSeconds == 0) && thermostat.Mode == models.ModeCool {
+		suggestion.Mode = models.ModeCool
+	}
+
+	if suggestion.Mode == models.ModeCool {
+		suggestion.SetbackTemp = math.Min(suggestion.ComfortTemp+coolingSetbackF, thermostat.MaxTemp)
+	} else {
+		suggestion.SetbackTemp = math.Max(suggestion.ComfortTemp-heatingSetbackF, thermostat.MinTemp)
+	}
+
+	// Start early by the average run, in 15 minute steps
+	if runs > 0 {
+		average := time.Duration(runtimeSeconds/float64(runs)) * time.Second
+		lead := min((average + 14*time.Minute).Truncate(15*time.Minute), maxPreconditioning)
+		suggestion.PreconditionMinutes = int(lead.Minutes())
+	}
+
+	blocks := occupiedBlocks(heatmap, suggestion.PreconditionMinutes)
+	suggestion.Schedule = scheduleEntries(thermostat, blocks, suggestion.ComfortTemp, suggestion.SetbackTemp, now)
+	suggestion.Blocks = reviewBlocks(suggestion.Schedule)
+
+	s.suggestions[thermostat.ID] = suggestion
+	return suggestion, nil
+}
+
+// Apply installs the last suggestion for a thermostat as its schedule; the setpoint of the current
+// block is applied at the next schedule check
+func (s *ScheduleService) Apply(thermostatID string) ([]models.ThermostatSchedule, error) {
+	s.mu.Lock()
+	suggestion, exists := s.suggestions[thermostatID]
+	if !exists {
+		s.mu.Unlock()
+		return nil, errors.NewBusinessError(fmt.Sprintf("no schedule suggestion to apply for thermostat %s, review one first", thermostatID), nil)
+	}
+
+	s.state.Schedules[thermostatID] = suggestion.Schedule
+	delete(s.suggestions, thermostatID)
+	delete(s.applied, thermostatID)
+
+	s.logger.Info("Applied suggested thermostat schedule", map[string]interface{}{
+		"thermostat_id": thermostatID,
+		"entries":       len(suggestion.Schedule),
+		"comfort_temp":  suggestion.ComfortTemp,
+		"setback_temp":  suggestion.SetbackTemp,
+	})
+
+	var err error
+	if s.path != "" {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	s.publishState(thermostatID)
+	return suggestion.Schedule, err
+}
+
+// Clear removes the schedule and hold of a thermostat, leaving its current setpoint in place
+func (s *ScheduleService) Clear(thermostatID string) error {
+	s.mu.Lock()
+	delete(s.state.Schedules, thermostatID)
+	delete(s.state.Holds, thermostatID)
+	delete(s.applied, thermostatID)
+	var err error
+	if s.path != "" {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	s.publishState(thermostatID)
+	return err
+}
+
+// SetSchedule replaces the schedule of a thermostat with the blocks of a weekly schedule. The
+// setpoint of the current block is applied at the next schedule check, unless a hold is on.
+func (s *ScheduleService) SetSchedule(thermostatID string, week models.WeeklySchedule, now time.Time) ([]models.ThermostatSchedule, error) {
+	thermostat, err := s.thermostats.GetThermostat(thermostatID)
+	if err != nil {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown thermostat %s", thermostatID), err)
+	}
+
+	entries, err := week.Entries(thermostat.ID, thermostat.Mode, now)
+	if err != nil {
+		return nil, errors.NewConfigError(fmt.Sprintf("invalid schedule for thermostat %s", thermostatID), err)
+	}
+	for _, entry := range entries {
+		if !thermostat.IsValidTargetTemp(entry.TargetTemp) {
+			return nil, errors.NewConfigError(fmt.Sprintf("%s block on %s at %s: target %.1f°F is outside %.1f-%.1f°F",
+				entry.Name, Weekdays[entry.DayOfWeek], entry.StartTime, entry.TargetTemp, thermostat.MinTemp, thermostat.MaxTemp), nil)
+		}
+	}
+
+	s.mu.Lock()
+	s.state.Schedules[thermostatID] = entries
+	delete(s.applied, thermostatID)
+	s.logger.Info("Set weekly thermostat schedule", map[string]interface{}{
+		"thermostat_id": thermostatID,
+		"entries":       len(entries),
+	})
+	if s.path != "" {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	s.publishState(thermostatID)
+	return entries, err
+}
+
+// Hold sets a manual setpoint the schedule leaves alone until the next block starts, until a
+// time, or until Resume, depending on the hold's mode. An empty mode holds until the next block.
+func (s *ScheduleService) Hold(thermostatID string, hold models.ThermostatHold, now time.Time) (*models.ThermostatHold, error) {
+	thermostat, err := s.thermostats.GetThermostat(thermostatID)
+	if err != nil {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown thermostat %s", thermostatID), err)
+	}
+
+	if hold.Mode == "" {
+		hold.Mode = models.HoldNextBlock
+	}
+	if !hold.Mode.IsValid() {
+		return nil, errors.NewConfigError(fmt.Sprintf("unknown hold mode %q, use next_block, until or permanent", hold.Mode), nil)
+	}
+	if hold.Mode == models.HoldUntil && !hold.Until.After(now) {
+		return nil, errors.NewConfigError("an until hold needs an until time in the future", nil)
+	}
+	if hold.Mode != models.HoldUntil {
+		hold.Until = time.Time{}
+	}
+	if !thermostat.IsValidTargetTemp(hold.TargetTemp) {
+		return nil, errors.NewConfigError(fmt.Sprintf("hold target %.1f°F is outside %.1f-%.1f°F",
+			hold.TargetTemp, thermostat.MinTemp, thermostat.MaxTemp), nil)
+	}
+
+	if err := s.thermostats.SetTargetTemperature(thermostatID, hold.TargetTemp); err != nil {
+		return nil, errors.NewSystemError(fmt.Sprintf("failed to hold thermostat %s", thermostatID), err)
+	}
+
+	s.mu.Lock()
+	entry, _ := activeEntry(s.state.Schedules[thermostatID], now, s.calendar.ScheduleDay(now.Local()))
+	hold.EntryID = entry.ID
+	hold.SetAt = now
+	s.state.Holds[thermostatID] = &hold
+	s.logger.Info("Holding thermostat setpoint", map[string]interface{}{
+		"thermostat_id": thermostatID,
+		"target_temp":   hold.TargetTemp,
+		"mode":          hold.Mode,
+	})
+	if s.path != "" {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	s.publishState(thermostatID)
+	return &hold, err
+}
+
+// Resume ends the hold of a thermostat and applies the setpoint of its current block
+func (s *ScheduleService) Resume(thermostatID string, now time.Time) error {
+	s.mu.Lock()
+	if _, held := s.state.Holds[thermostatID]; !held {
+		s.mu.Unlock()
+		return errors.NewBusinessError(fmt.Sprintf("thermostat %s is not on hold", thermostatID), nil)
+	}
+	delete(s.state.Holds, thermostatID)
+	delete(s.applied, thermostatID)
+	var err error
+	if s.path != "" {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("Resumed thermostat schedule", map[string]interface{}{"thermostat_id": thermostatID})
+	s.ApplyDue(now)
+	s.publishState(thermostatID)
+	return err
+}
+
+// AwaySetback is the setpoint thermostats are held at while nobody is home, or while their
+// room is closed off
+type AwaySetback struct {
+	HeatTemp float64 `json:"heat_temp"` // For thermostats in heat mode, e.g. 62
+	CoolTemp float64 `json:"cool_temp"` // For thermostats in cool mode, e.g. 82
+}
+
+// target returns the setback for a thermostat's mode; thermostats in auto, fan or off mode,
+// and modes without a setback, have none
+func (a AwaySetback) target(mode models.ThermostatMode) (float64, bool) {
+	target := a.HeatTemp
+	switch mode {
+	case models.ModeHeat, models.ModeEmergencyHeat:
+	case models.ModeCool:
+		target = a.CoolTemp
+	default:
+		return 0, false
+	}
+	return target, target != 0
+}
+
+// SetAway holds every heating or cooling thermostat at its away setback while the home is
+// empty, and resumes the thermostats it held once someone is back. Calling it again with a
+// different setback, e.g. when a vacation starts, moves the away holds. Thermostats in auto, fan
+// or off mode are left alone, as are manual holds, including those set while away, and closed rooms.
+// Coming back also releases the arrival holds that ended the setback ahead of a resident.
+func (s *ScheduleService) SetAway(away bool, setback AwaySetback, now time.Time) {
+	if !away {
+		s.release(func(thermostatID string, hold models.ThermostatHold) bool {
+			return hold.Reason == models.HoldReasonAway || hold.Reason == models.HoldReasonArrival
+		}, now)
+		return
+	}
+
+	holds := s.Holds()
+	for _, thermostat := range s.thermostats.GetAllThermostats() {
+		target, ok := setback.target(thermostat.Mode)
+		if !ok {
+			continue
+		}
+		previous := thermostat.TargetTemp
+		if existing, held := holds[thermostat.ID]; held {
+			if existing.Reason != models.HoldReasonAway || existing.TargetTemp == target {
+				continue
+			}
+			previous = existing.PreviousTemp
+		}
+		hold := models.ThermostatHold{
+			Mode:         models.HoldPermanent,
+			TargetTemp:   target,
+			Reason:       models.HoldReasonAway,
+			PreviousTemp: previous,
+		}
+		if _, err := s.Hold(thermostat.ID, hold, now); err != nil {
+			s.logger.Error("Failed to hold thermostat while away", err, map[string]interface{}{"thermostat_id": thermostat.ID})
+		}
+	}
+}
+
+// SetClosed holds the heating or cooling thermostats of a closed-off room at a deep setback,
+// and resumes them when the room is opened again. Closing replaces any other hold, since the
+// room isn't used; the target from before the first hold is kept for reopening.
+func (s *ScheduleService) SetClosed(roomID string, closed bool, setback AwaySetback, now time.Time) {
+	inRoom := make(map[string]bool)
+	for _, thermostat := range s.thermostats.GetAllThermostats() {
+		if thermostat.RoomID == roomID {
+			inRoom[thermostat.ID] = true
+		}
+	}
+
+	if !closed {
+		s.release(func(thermostatID string, hold models.ThermostatHold) bool {
+			return inRoom[thermostatID] && hold.Reason == models.HoldReasonClosed
+		}, now)
+		return
+	}
+
+	holds := s.Holds()
+	for _, thermostat := range s.thermostats.GetAllThermostats() {
+		if !inRoom[thermostat.ID] {
+			continue
+		}
+		target, ok := setback.target(thermostat.Mode)
+		if !ok {
+			continue
+		}
+		previous := thermostat.TargetTemp
+		if existing, held := holds[thermostat.ID]; held {
+			if existing.Reason == models.HoldReasonClosed {
+				continue
+			}
+			if existing.PreviousTemp != 0 {
+				previous = existing.PreviousTemp
+			}
+		}
+		hold := models.ThermostatHold{
+			Mode:         models.HoldPermanent,
+			TargetTemp:   target,
+			Reason:       models.HoldReasonClosed,
+			PreviousTemp: previous,
+		}
+		if _, err := s.Hold(thermostat.ID, hold, now); err != nil {
+			s.logger.Error("Failed to hold thermostat of closed room", err, map[string]interface{}{
+				"thermostat_id": thermostat.ID,
+				"room_id":       roomID,
+			})
+		}
+	}
+}
+
+// release resumes the matching holds. Thermostats without a schedule block to return to get
+// back the target from before the hold.
+func (s *ScheduleService) release(match func(thermostatID string, hold models.ThermostatHold) bool, now time.Time) {
+	for thermostatID, hold := range s.Holds() {
+		if !match(thermostatID, hold) {
+			continue
+		}
+		if err := s.Resume(thermostatID, now); err != nil {
+			s.logger.Error("Failed to resume thermostat schedule", err, map[string]interface{}{"thermostat_id": thermostatID})
+			continue
+		}
+
+		s.mu.Lock()
+		_, scheduled := activeEntry(s.state.Schedules[thermostatID], now, s.calendar.ScheduleDay(now.Local()))
+		s.mu.Unlock()
+		if !scheduled && hold.PreviousTemp != 0 {
+			if err := s.thermostats.SetTargetTemperature(thermostatID, hold.PreviousTemp); err != nil {
+				s.logger.Error("Failed to restore thermostat target", err, map[string]interface{}{"thermostat_id": thermostatID})
+			}
+		}
+	}
+}
+
+// Holds returns the manual and automatic holds by thermostat ID
+func (s *ScheduleService) Holds() map[string]models.ThermostatHold {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holds := make(map[string]models.ThermostatHold, len(s.state.Holds))
+	for id, hold := range s.state.Holds {
+		holds[id] = *hold
+	}
+	return holds
+}
+
+// Subscribe takes schedule edits and holds from the thermostat schedule/set and hold topics, and
+// publishes each thermostat's schedule and hold as retained state on its schedule topic. An
+// empty payload on the hold topic resumes the schedule.
+func (s *ScheduleService) Subscribe(client *mqtt.Client) error {
+	s.mu.Lock()
+	s.publish = client.Publish
+	s.mu.Unlock()
+
+	err := client.Subscribe(mqtt.ThermostatScheduleSetTopic("+"), func(topic string, payload []byte) error {
+		var edit ScheduleEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return errors.NewValidationError("invalid thermostat schedule", err)
+		}
+		_, err := s.SetSchedule(topicThermostat(topic), edit.Days, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return client.Subscribe(mqtt.ThermostatHoldTopic("+"), func(topic string, payload []byte) error {
+		if len(strings.TrimSpace(string(payload))) == 0 {
+			return s.Resume(topicThermostat(topic), time.Now())
+		}
+		var hold models.ThermostatHold
+		if err := json.Unmarshal(payload, &hold); err != nil {
+			return errors.NewValidationError("invalid thermostat hold", err)
+		}
+		_, err := s.Hold(topicThermostat(topic), hold, time.Now())
+		return err
+	})
+}
+
+// publishState publishes the schedule and hold of a thermostat as retained state
+func (s *ScheduleService) publishState(thermostatID string) {
+	s.mu.Lock()
+	publish := s.publish
+	state := map[string]interface{}{
+		"thermostat_id": thermostatID,
+		"schedule":      s.state.Schedules[thermostatID],
+		"hold":          s.state.Holds[thermostatID],
+	}
+	payload, err := json.Marshal(state)
+	s.mu.Unlock()
+	if publish == nil {
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to marshal thermostat schedule state", err)
+		return
+	}
+
+	if err := publish(&mqtt.Message{
+		Topic:   mqtt.ThermostatScheduleTopic(thermostatID),
+		Payload: payload,
+		QoS:     1,
+		Retain:  true,
+	}); err != nil {
+		s.logger.Error("Failed to publish thermostat schedule state", err, map[string]interface{}{"thermostat_id": thermostatID})
+	}
+}
+
+// Schedules returns the applied schedules by thermostat ID
+func (s *ScheduleService) Schedules() map[string][]models.ThermostatSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := make(map[string][]models.ThermostatSchedule, len(s.state.Schedules))
+	for id, schedule := range s.state.Schedules {
+		schedules[id] = append([]models.ThermostatSchedule(nil), schedule...)
+	}
+	return schedules
+}
+
+// Run applies the setpoint of each thermostat's current schedule block every minute until ctx is done
+func (s *ScheduleService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	s.ApplyDue(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.ApplyDue(now)
+		}
+	}
+}
+
+// ApplyDue ends expired holds and sets the target temperature of every thermostat not on hold
+// whose schedule entered a new block or that just left a hold
+func (s *ScheduleService) ApplyDue(now time.Time) {
+	type due struct {
+		thermostatID string
+		entry        models.ThermostatSchedule
+	}
+
+	s.mu.Lock()
+	day := s.calendar.ScheduleDay(now.Local())
+
+	// Holds that ended give the thermostat back to its current block
+	var ended []string
+	for id, hold := range s.state.Holds {
+		entry, _ := activeEntry(s.state.Schedules[id], now, day)
+		if hold.Expired(now, entry.ID) {
+			delete(s.state.Holds, id)
+			delete(s.applied, id)
+			ended = append(ended, id)
+		}
+	}
+	if len(ended) > 0 {
+		s.logger.Info("Thermostat holds ended", map[string]interface{}{"thermostat_ids": ended})
+		if s.path != "" {
+			if err := s.save(); err != nil {
+				s.logger.Error("Failed to save thermostat schedules", err)
+			}
+		}
+	}
+
+	var pending []due
+	for id, schedule := range s.state.Schedules {
+		if _, held := s.state.Holds[id]; held {
+			continue
+		}
+		entry, ok := activeEntry(schedule, now, day)
+		if ok && s.applied[id] != entry.ID {
+			pending = append(pending, due{id, entry})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ended {
+		s.publishState(id)
+	}
+
+	// The thermostat service takes its own lock, and calls RecordStatus while holding it
+	for _, item := range pending {
+		if err := s.thermostats.SetTargetTemperature(item.thermostatID, item.entry.TargetTemp); err != nil {
+			s.logger.Error("Failed to apply scheduled setpoint", err, map[string]interface{}{
+				"thermostat_id": item.thermostatID,
+				"entry":         item.entry.ID,
+			})
+			continue
+		}
+
+		s.mu.Lock()
+		s.applied[item.thermostatID] = item.entry.ID
+		s.mu.Unlock()
+	}
+}
+
+// SuggestionsHandler serves a schedule suggestion for ?thermostat= as JSON
+func (s *ScheduleService) SuggestionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suggestion, err := s.Suggest(r.URL.Query().Get("thermostat"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), scheduleErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suggestion)
+	})
+}
+
+// ApplyHandler installs the last suggestion for ?thermostat= on POST
+func (s *ScheduleService) ApplyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to apply a schedule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		schedule, err := s.Apply(r.URL.Query().Get("thermostat"))
+		if err != nil {
+			http.Error(w, err.Error(), scheduleErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"thermostat_id": r.URL.Query().Get("thermostat"),
+			"schedule":      schedule,
+		})
+	})
+}
+
+// SchedulesHandler serves the applied schedules and the holds as JSON
+func (s *ScheduleService) SchedulesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schedules": s.Schedules(),
+			"holds":     s.Holds(),
+		})
+	})
+}
+
+// SetHandler replaces the schedule of ?thermostat= with the weekly schedule in a POST body
+// such as {"days": {"weekdays": [{"period": "wake", "start": "06:30", "target_temp": 70}]}}
+func (s *ScheduleService) SetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "use POST or PUT to set a schedule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var edit ScheduleEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			http.Error(w, "invalid schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		thermostatID := r.URL.Query().Get("thermostat")
+		schedule, err := s.SetSchedule(thermostatID, edit.Days, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), scheduleErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"thermostat_id": thermostatID,
+			"schedule":      schedule,
+		})
+	})
+}
+
+// HoldHandler holds the setpoint of ?thermostat= from a POST body such as
+// {"mode": "until", "target_temp": 72, "until": "2024-01-14T18:00:00Z"}
+func (s *ScheduleService) HoldHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to hold a setpoint", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var hold models.ThermostatHold
+		if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+			http.Error(w, "invalid hold: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		held, err := s.Hold(r.URL.Query().Get("thermostat"), hold, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), scheduleErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(held)
+	})
+}
+
+// ResumeHandler ends the hold of ?thermostat= on POST
+func (s *ScheduleService) ResumeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to resume a schedule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.Resume(r.URL.Query().Get("thermostat"), time.Now()); err != nil {
+			http.Error(w, err.Error(), scheduleErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ClearHandler removes the schedule of ?thermostat= on POST
+func (s *ScheduleService) ClearHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to clear a schedule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.Clear(r.URL.Query().Get("thermostat")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Save writes runtime and schedules, e.g. on shutdown
+func (s *ScheduleService) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// comfortTemp is the occupied setpoint of an applied schedule, or the thermostat's target without one.
+// Callers must hold the lock.
+func (s *ScheduleService) comfortTemp(thermostat models.Thermostat) float64 {
+	for _, entry := range s.state.Schedules[thermostat.ID] {
+		if entry.Name == "occupied" {
+			return entry.TargetTemp
+		}
+	}
+	return thermostat.TargetTemp
+}
+
+// load reads persisted runtime and schedules
+func (s *ScheduleService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read thermostat schedules", err)
+	}
+
+	var state scheduleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.NewSystemError("failed to parse thermostat schedules", err)
+	}
+	if state.Runtime == nil {
+		state.Runtime = make(map[string]*roomRuntime)
+	}
+	if state.Schedules == nil {
+		state.Schedules = make(map[string][]models.ThermostatSchedule)
+	}
+	if state.Holds == nil {
+		state.Holds = make(map[string]*models.ThermostatHold)
+	}
+
+	s.state = state
+	return nil
+}
+
+// save atomically writes runtime and schedules; callers must hold the lock
+func (s *ScheduleService) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal thermostat schedules", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write thermostat schedules", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace thermostat schedules", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
+
+// scheduleErrorStatus maps a schedule error to an HTTP status
+func scheduleErrorStatus(err error) int {
+	if appErr, ok := err.(*errors.HomeAutomationError); ok {
+		switch appErr.Type {
+		case errors.ErrorTypeValidation:
+			return http.StatusNotFound
+		case errors.ErrorTypeBusiness:
+			return http.StatusConflict
+		case errors.ErrorTypeConfig:
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// occupiedBlocks returns the occupied stretches of the week as [start, end) minutes from Sunday
+// midnight. Single unoccupied hours between occupied ones are bridged, and each block starts
+// leadMinutes early.
+func occupiedBlocks(heatmap PresenceHeatmap, leadMinutes int) [][2]int {
+	var occupied [7 * 24]bool
+	for day := range heatmap.Occupancy {
+		for hour := range heatmap.Occupancy[day] {
+			occupied[day*24+hour] = heatmap.Occupancy[day][hour] >= occupiedThreshold
+		}
+	}
+
+	slots := len(occupied)
+	bridged := occupied
+	for i := range occupied {
+		if !occupied[i] && occupied[(i+slots-1)%slots] && occupied[(i+1)%slots] {
+			bridged[i] = true
+		}
+	}
+
+	// Start at an unoccupied hour so no block is split at the end of the week
+	first := -1
+	for i, isOccupied := range bridged {
+		if !isOccupied {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return [][2]int{{0, 0}} // Occupied around the clock, a block without an end
+	}
+
+	var blocks [][2]int
+	for n := 0; n < slots; n++ {
+		i := (first + n) % slots
+		if !bridged[i] {
+			continue
+		}
+		start := i * 60
+		if len(blocks) > 0 && blocks[len(blocks)-1][1] == start {
+			blocks[len(blocks)-1][1] = start + 60
+			continue
+		}
+		blocks = append(blocks, [2]int{start, start + 60})
+	}
+
+	for i := range blocks {
+		blocks[i][0] = (blocks[i][0] - leadMinutes + minutesPerWeek) % minutesPerWeek
+		blocks[i][1] %= minutesPerWeek
+	}
+	return blocks
+}
+
+// scheduleEntries turns occupied blocks into comfort and setback entries, sorted by time of week
+func scheduleEntries(thermostat models.Thermostat, blocks [][2]int, comfort, setback float64, now time.Time) []models.ThermostatSchedule {
+	entry := func(minute int, name string, target float64) models.ThermostatSchedule {
+		day, start := minute/(24*60), fmt.Sprintf("%02d:%02d", minute/60%24, minute%60)
+		return models.ThermostatSchedule{
+			ID:           fmt.Sprintf("%s-%d-%s", thermostat.ID, day, start),
+			ThermostatID: thermostat.ID,
+			Name:         name,
+			DayOfWeek:    day,
+			StartTime:    start,
+			TargetTemp:   target,
+			Mode:         thermostat.Mode,
+			Enabled:      true,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+	}
+
+	if len(blocks) == 0 {
+		return []models.ThermostatSchedule{entry(0, "unoccupied", setback)} // Never occupied
+	}
+
+	entries := make([]models.ThermostatSchedule, 0, 2*len(blocks))
+	for _, block := range blocks {
+		entries = append(entries, entry(block[0], "occupied", comfort))
+		if block[1] != block[0] {
+			entries = append(entries, entry(block[1], "unoccupied", setback))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entryMinute(entries[i]) < entryMinute(entries[j])
+	})
+	return entries
+}
+
+// reviewBlocks lists each entry with the time the next entry takes over
+func reviewBlocks(entries []models.ThermostatSchedule) []ScheduleBlock {
+	blocks := make([]ScheduleBlock, 0, len(entries))
+	for i, entry := range entries {
+		next := entries[(i+1)%len(entries)]
+		blocks = append(blocks, ScheduleBlock{
+			StartDay:   Weekdays[entry.DayOfWeek],
+			Start:      entry.StartTime,
+			EndDay:     Weekdays[next.DayOfWeek],
+			End:        next.StartTime,
+			Occupied:   entry.Name == "occupied",
+			TargetTemp: entry.TargetTemp,
+		})
+	}
+	return blocks
+}
+
+// activeEntry returns the enabled entry in force at the time of day of now on the schedule of
+// day: the latest one that started this week, or the last one of the week before
+func activeEntry(entries []models.ThermostatSchedule, now time.Time, day time.Weekday) (models.ThermostatSchedule, bool) {
+	local := now.Local()
+	current := int(day)*24*60 + local.Hour()*60 + local.Minute()
+
+	var active, last models.ThermostatSchedule
+	found, enabled := false, false
+	for _, entry := range entries {
+		if !entry.Enabled {
+			continue
+		}
+		minute := entryMinute(entry)
+		if !enabled || minute > entryMinute(last) {
+			last, enabled = entry, true
+		}
+		if minute <= current && (!found || minute > entryMinute(active)) {
+			active, found = entry, true
+		}
+	}
+	if !found {
+		return last, enabled
+	}
+	return active, true
+}
+
+// topicThermostat returns the thermostat ID of a thermostat/<id>/... topic
+func topicThermostat(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// entryMinute returns the minutes from Sunday midnight at which an entry starts
+func entryMinute(entry models.ThermostatSchedule) int {
+	var hour, minute int
+	fmt.Sscanf(entry.StartTime, "%d:%d", &hour, &minute)
+	return entry.DayOfWeek*24*60 + hour*60 + minute
+}
+
+// gridTotal sums the values of a grid
+func gridTotal(grid HourGrid) float64 {
+	var total float64
+	for day := range grid {
+		for hour := range grid[day] {
+			total += grid[day][hour]
+		}
+	}
+	return total
+}
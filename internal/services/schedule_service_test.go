@@ -0,0 +1,244 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/calendar"
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestScheduleSuggestion(t *testing.T) {
+	testLogger := logger.NewLogger("schedule-test", nil)
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	thermostats := NewThermostatService(mqttClient, testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "living-room", RoomID: "living-room", Mode: models.ModeHeat, TargetTemp: 70})
+
+	presence := NewPresenceService("", nil)
+	path := filepath.Join(t.TempDir(), ThermostatScheduleFileName)
+	service := NewScheduleService(thermostats, presence, path, testLogger)
+
+	// Occupied 18:00 to 22:00 every evening for a week, heating for 30 minutes beforehand
+	sunday := time.Date(2024, 1, 14, 0, 0, 0, 0, time.Local)
+	presence.Record("living-room", false, sunday)
+	for day := 0; day < 8; day++ {
+		evening := sunday.AddDate(0, 0, day).Add(18 * time.Hour)
+		presence.Record("living-room", true, evening)
+		presence.Record("living-room", false, evening.Add(4*time.Hour))
+		service.recordStatus("living-room", models.StatusHeating, evening.Add(-30*time.Minute))
+		service.recordStatus("living-room", models.StatusIdle, evening)
+	}
+	now := sunday.AddDate(0, 0, 8)
+
+	// Nothing to apply before a suggestion was reviewed
+	if _, err := service.Apply("living-room"); err == nil {
+		t.Error("Expected Apply without a suggestion to fail")
+	}
+
+	suggestion, err := service.Suggest("living-room", now)
+	if err != nil {
+		t.Fatalf("Suggest failed: %v", err)
+	}
+	if suggestion.Mode != models.ModeHeat || suggestion.ComfortTemp != 70 || suggestion.SetbackTemp != 64 {
+		t.Errorf("Expected heating from 70 with a setback to 64, got %s %v/%v", suggestion.Mode, suggestion.ComfortTemp, suggestion.SetbackTemp)
+	}
+	if suggestion.PreconditionMinutes != 30 {
+		t.Errorf("Expected a 30 minute head start, got %d", suggestion.PreconditionMinutes)
+	}
+	if len(suggestion.Schedule) != 14 {
+		t.Fatalf("Expected an occupied and an unoccupied entry per day, got %+v", suggestion.Schedule)
+	}
+	first := suggestion.Blocks[0]
+	if first.StartDay != "sunday" || first.Start != "17:30" || first.End != "22:00" || !first.Occupied || first.TargetTemp != 70 {
+		t.Errorf("Expected Sunday 17:30-22:00 at 70, got %+v", first)
+	}
+	if second := suggestion.Blocks[1]; second.Occupied || second.EndDay != "monday" || second.End != "17:30" || second.TargetTemp != 64 {
+		t.Errorf("Expected a setback until Monday 17:30, got %+v", second)
+	}
+
+	// One call applies the reviewed suggestion, and the current block's setpoint follows
+	recorder := httptest.NewRecorder()
+	service.ApplyHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/thermostats/schedule-suggestions/apply?thermostat=living-room", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected the schedule to be applied, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	service.ApplyDue(sunday.AddDate(0, 0, 2).Add(12 * time.Hour)) // Tuesday noon
+	if thermostat, _ := thermostats.GetThermostat("living-room"); thermostat.TargetTemp != 64 {
+		t.Errorf("Expected the setback at noon, got %v", thermostat.TargetTemp)
+	}
+	service.ApplyDue(sunday.AddDate(0, 0, 2).Add(17*time.Hour + 45*time.Minute))
+	if thermostat, _ := thermostats.GetThermostat("living-room"); thermostat.TargetTemp != 70 {
+		t.Errorf("Expected the comfort setpoint at 17:45, got %v", thermostat.TargetTemp)
+	}
+
+	// Applied schedules survive a restart
+	if err := service.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	restored := NewScheduleService(thermostats, presence, path, testLogger)
+	if len(restored.Schedules()["living-room"]) != 14 {
+		t.Errorf("Expected the schedule to be restored, got %+v", restored.Schedules())
+	}
+}
+
+func TestScheduleSuggestionNeedsHistory(t *testing.T) {
+	testLogger := logger.NewLogger("schedule-test", nil)
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	thermostats := NewThermostatService(mqttClient, testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "bedroom", RoomID: "bedroom", Mode: models.ModeHeat})
+
+	presence := NewPresenceService("", nil)
+	now := time.Now()
+	presence.Record("bedroom", true, now.Add(-48*time.Hour))
+	service := NewScheduleService(thermostats, presence, "", testLogger)
+
+	recorder := httptest.NewRecorder()
+	service.SuggestionsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/thermostats/schedule-suggestions?thermostat=bedroom", nil))
+	if recorder.Code != 409 {
+		t.Errorf("Expected 409 with two days of history, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	service.SuggestionsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/thermostats/schedule-suggestions?thermostat=attic", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Expected 404 for an unknown thermostat, got %d", recorder.Code)
+	}
+}
+
+func TestScheduleHolidaysAsWeekend(t *testing.T) {
+	testLogger := logger.NewLogger("schedule-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "living-room", RoomID: "living-room", Mode: models.ModeHeat, TargetTemp: 70})
+
+	service := NewScheduleService(thermostats, NewPresenceService("", nil), "", testLogger)
+	service.state.Schedules["living-room"] = []models.ThermostatSchedule{
+		{ID: "weekday", DayOfWeek: 1, StartTime: "06:00", TargetTemp: 68, Enabled: true},
+		{ID: "saturday", DayOfWeek: 6, StartTime: "09:00", TargetTemp: 72, Enabled: true},
+	}
+	holidays, err := calendar.New(calendar.Config{Region: "us", HolidaysAs: "saturday"})
+	if err != nil {
+		t.Fatalf("calendar.New failed: %v", err)
+	}
+	service.SetCalendar(holidays)
+
+	// Memorial Day 2024 is a Monday, so it follows the Saturday schedule
+	service.ApplyDue(time.Date(2024, 5, 27, 10, 0, 0, 0, time.Local))
+	if thermostat, _ := thermostats.GetThermostat("living-room"); thermostat.TargetTemp != 72 {
+		t.Errorf("Expected the Saturday setpoint on a holiday, got %v", thermostat.TargetTemp)
+	}
+
+	service.ApplyDue(time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local))
+	if thermostat, _ := thermostats.GetThermostat("living-room"); thermostat.TargetTemp != 68 {
+		t.Errorf("Expected the weekday setpoint on a normal Monday, got %v", thermostat.TargetTemp)
+	}
+}
+
+func TestWeeklyScheduleWithHolds(t *testing.T) {
+	testLogger := logger.NewLogger("schedule-test", nil)
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), testLogger)
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "hall", RoomID: "hall", Mode: models.ModeHeat, TargetTemp: 70})
+
+	path := filepath.Join(t.TempDir(), ThermostatScheduleFileName)
+	service := NewScheduleService(thermostats, NewPresenceService("", nil), path, testLogger)
+	var published []map[string]interface{}
+	service.publish = func(msg *mqtt.Message) error {
+		var state map[string]interface{}
+		json.Unmarshal(msg.Payload, &state)
+		if msg.Topic != "thermostat/hall/schedule" || !msg.Retain {
+			t.Errorf("Expected retained state on the schedule topic, got %s", msg.Topic)
+		}
+		published = append(published, state)
+		return nil
+	}
+	target := func() float64 {
+		thermostat, _ := thermostats.GetThermostat("hall")
+		return thermostat.TargetTemp
+	}
+
+	body := `{"days": {"weekdays": [
+		{"period": "wake", "start": "06:30", "target_temp": 70},
+		{"period": "leave", "start": "08:00", "target_temp": 62},
+		{"period": "return", "start": "17:30", "target_temp": 70},
+		{"period": "sleep", "start": "22:00", "target_temp": 64}
+	]}}`
+	recorder := httptest.NewRecorder()
+	service.SetHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/thermostats/schedules/set?thermostat=hall", strings.NewReader(body)))
+	if recorder.Code != 200 || len(service.Schedules()["hall"]) != 20 || len(published) != 1 {
+		t.Fatalf("Expected the weekday schedule to be set, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	tuesday := time.Date(2024, 1, 16, 0, 0, 0, 0, time.Local)
+	service.ApplyDue(tuesday.Add(9 * time.Hour))
+	if target() != 62 {
+		t.Fatalf("Expected the leave setpoint at 9:00, got %v", target())
+	}
+
+	// A next-block hold lasts until the return block
+	if _, err := service.Hold("hall", models.ThermostatHold{TargetTemp: 68}, tuesday.Add(10*time.Hour)); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	service.ApplyDue(tuesday.Add(12 * time.Hour))
+	if target() != 68 {
+		t.Errorf("Expected the hold to survive the schedule check, got %v", target())
+	}
+	service.ApplyDue(tuesday.Add(17*time.Hour + 30*time.Minute))
+	if target() != 70 || len(service.Holds()) != 0 {
+		t.Errorf("Expected the return block to end the hold, got %v with %v", target(), service.Holds())
+	}
+
+	// An until hold ends mid-block and gives the thermostat back to the current block
+	until := models.ThermostatHold{Mode: models.HoldUntil, TargetTemp: 74, Until: tuesday.Add(19 * time.Hour)}
+	if _, err := service.Hold("hall", until, tuesday.Add(18*time.Hour)); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	service.ApplyDue(tuesday.Add(19 * time.Hour))
+	if target() != 70 {
+		t.Errorf("Expected the return setpoint after the until hold, got %v", target())
+	}
+
+	// A permanent hold outlasts blocks and restarts until resumed
+	if _, err := service.Hold("hall", models.ThermostatHold{Mode: models.HoldPermanent, TargetTemp: 60}, tuesday.Add(20*time.Hour)); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	restored := NewScheduleService(thermostats, NewPresenceService("", nil), path, testLogger)
+	restored.publish = service.publish
+	restored.ApplyDue(tuesday.Add(30 * time.Hour))
+	if target() != 60 {
+		t.Errorf("Expected the permanent hold to survive a restart and blocks, got %v", target())
+	}
+	recorder = httptest.NewRecorder()
+	restored.ResumeHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/api/thermostats/hold/resume?thermostat=hall", nil))
+	if recorder.Code != 204 || len(restored.Holds()) != 0 {
+		t.Fatalf("Expected the hold to be resumed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(published) == 0 || published[len(published)-1]["hold"] != nil {
+		t.Errorf("Expected the last published state without a hold, got %d states", len(published))
+	}
+
+	for name, request := range map[string]struct {
+		handler http.Handler
+		target  string
+		body    string
+		want    int
+	}{
+		"unknown period": {service.SetHandler(), "hall", `{"days": {"everyday": [{"period": "lunch", "start": "12:00", "target_temp": 70}]}}`, 400},
+		"out of range":   {service.SetHandler(), "hall", `{"days": {"everyday": [{"period": "wake", "start": "07:00", "target_temp": 120}]}}`, 400},
+		"past until":     {service.HoldHandler(), "hall", `{"mode": "until", "target_temp": 70, "until": "2020-01-01T00:00:00Z"}`, 400},
+		"unknown":        {service.HoldHandler(), "attic", `{"target_temp": 70}`, 404},
+	} {
+		recorder := httptest.NewRecorder()
+		request.handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/?thermostat="+request.target, strings.NewReader(request.body)))
+		if recorder.Code != request.want {
+			t.Errorf("%s: expected %d, got %d: %s", name, request.want, recorder.Code, recorder.Body.String())
+		}
+	}
+}
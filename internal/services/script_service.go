@@ -0,0 +1,878 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/internal/script"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+const (
+	// Results of script runs
+	ScriptResultOK     = "ok"
+	ScriptResultFailed = "failed"
+	ScriptResultTraced = "traced" // Recorded instead of run in observe-only mode
+	ScriptResultHeld   = "held"   // Not run while safe mode is active
+
+	defaultScriptPoll    = 30 * time.Second
+	defaultScriptTimeout = 500 * time.Millisecond
+	scriptHistorySize    = 50
+	maxScriptRequest     = 16 << 10
+)
+
+// Functions conditions may call; they only read the home
+var scriptQueries = map[string]bool{
+	"temp":        true,
+	"humidity":    true,
+	"occupied":    true,
+	"power":       true,
+	"on":          true,
+	"online":      true,
+	"hour":        true,
+	"minute":      true,
+	"weekday":     true,
+	"between":     true,
+	"mode":        true,
+	"anyone_home": true,
+}
+
+// Functions only scripts may call; they act on the home
+var scriptActions = map[string]bool{
+	"command": true,
+	"scene":   true,
+	"notify":  true,
+	"webhook": true,
+	"log":     true,
+}
+
+// ScriptRule runs its Then script once its When condition has held for ForSeconds, and its Else
+// script once the condition turns false again, e.g.
+//
+//	"when": "temp(\"bedroom\") > 78 && hour() >= 22 && !occupied(\"living-room\")"
+//	"then": "command(\"bedroom-fan\", \"turn_on\")"
+type ScriptRule struct {
+	ID              string `json:"id"`
+	Name            string `json:"name,omitempty"`
+	When            string `json:"when"`
+	Then            string `json:"then"`
+	Else            string `json:"else,omitempty"`
+	ForSeconds      int    `json:"for_seconds,omitempty"`
+	CooldownSeconds int    `json:"cooldown_seconds,omitempty"` // Least time between two runs of Then
+	Disabled        bool   `json:"disabled,omitempty"`
+
+	when, then, otherwise *script.Program
+}
+
+// ScriptConfig lists the scripted automations. Each condition and script must finish within
+// TimeoutMillis and MaxSteps.
+type ScriptConfig struct {
+	PollSeconds   int          `json:"poll_seconds,omitempty"`
+	TimeoutMillis int          `json:"timeout_ms,omitempty"`
+	MaxSteps      int          `json:"max_steps,omitempty"`
+	Rules         []ScriptRule `json:"rules"`
+}
+
+// LoadScriptConfig reads the scripted automations from a JSON file and compiles them
+func LoadScriptConfig(path string) (*ScriptConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read scripts file", err)
+	}
+
+	var cfg ScriptConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse scripts file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate compiles every rule, checking that conditions only read the home and scripts call
+// functions that exist
+func (c *ScriptConfig) Validate() error {
+	if c.PollSeconds < 0 || c.TimeoutMillis < 0 || c.MaxSteps < 0 {
+		return errors.NewValidationError("poll_seconds, timeout_ms and max_steps must not be negative", nil)
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.ID == "" {
+			return errors.NewValidationError("every script rule needs an ID", nil)
+		}
+		if seen[rule.ID] {
+			return errors.NewValidationError(fmt.Sprintf("script rule %s is defined twice", rule.ID), nil)
+		}
+		seen[rule.ID] = true
+		if rule.ForSeconds < 0 || rule.CooldownSeconds < 0 {
+			return errors.NewValidationError(fmt.Sprintf("script rule %s: for_seconds and cooldown_seconds must not be negative", rule.ID), nil)
+		}
+		if strings.TrimSpace(rule.When) == "" || strings.TrimSpace(rule.Then) == "" {
+			return errors.NewValidationError(fmt.Sprintf("script rule %s needs a when condition and a then script", rule.ID), nil)
+		}
+
+		var err error
+		if rule.when, err = compileCondition(rule.When); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("script rule %s: when", rule.ID), err)
+		}
+		if rule.then, err = compileScript(rule.Then); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("script rule %s: then", rule.ID), err)
+		}
+		if strings.TrimSpace(rule.Else) != "" {
+			if rule.otherwise, err = compileScript(rule.Else); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("script rule %s: else", rule.ID), err)
+			}
+		}
+	}
+	return nil
+}
+
+// compileCondition compiles an expression that may only call the query functions
+func compileCondition(src string) (*script.Program, error) {
+	program, err := script.CompileExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range program.Calls() {
+		if scriptActions[name] {
+			return nil, errors.NewValidationError(fmt.Sprintf("%s acts on the home; conditions may only read it", name), nil)
+		}
+		if !scriptQueries[name] {
+			return nil, errors.NewValidationError(fmt.Sprintf("unknown function %s", name), nil)
+		}
+	}
+	return program, nil
+}
+
+// compileScript compiles statements that may call the query and action functions
+func compileScript(src string) (*script.Program, error) {
+	program, err := script.CompileScript(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range program.Calls() {
+		if !scriptQueries[name] && !scriptActions[name] {
+			return nil, errors.NewValidationError(fmt.Sprintf("unknown function %s", name), nil)
+		}
+	}
+	return program, nil
+}
+
+// name is how the rule is shown in notifications
+func (r *ScriptRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.ID
+}
+
+// HomeModeReader tells the home's mode; HomeModeService implements it
+type HomeModeReader interface {
+	Mode() string
+}
+
+// HomeOccupancyReader tells whether anyone is home; ResidentPresenceService implements it
+type HomeOccupancyReader interface {
+	Occupied() bool
+}
+
+// ScriptRun is a recent run of a rule's then or else script
+type ScriptRun struct {
+	Rule    string    `json:"rule"`
+	Branch  string    `json:"branch"` // then or else
+	At      time.Time `json:"at"`
+	Result  string    `json:"result"`
+	Actions int       `json:"actions"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ScriptRuleStatus is a rule with where its condition stands
+type ScriptRuleStatus struct {
+	ScriptRule
+	Active  bool       `json:"active"`            // The then script ran and the condition still holds
+	Pending *time.Time `json:"pending,omitempty"` // Since when the condition has held, waiting for for_seconds
+	LastRun *time.Time `json:"last_run,omitempty"`
+	Runs    int        `json:"runs"`
+	Error   string     `json:"error,omitempty"` // Why the condition last failed to evaluate
+}
+
+// scriptState is where a rule's condition stands
+type scriptState struct {
+	active  bool
+	pending time.Time
+	lastRun time.Time
+	runs    int
+	err     string
+}
+
+// ScriptService evaluates the conditions of scripted automations against the room sensors, the
+// devices, the clock and the home's mode, and runs their scripts when the conditions change
+type ScriptService struct {
+	config    *ScriptConfig
+	poll      time.Duration
+	timeout   time.Duration
+	rooms     RoomSensorReader
+	devices   DeviceStatusReader
+	commands  CommandExecutor
+	scenes    SceneRecaller
+	webhooks  WebhookCaller
+	mode      HomeModeReader
+	residents HomeOccupancyReader
+	safeMode  *safemode.Controller
+	dryRun    *dryrun.Recorder
+	publish   func(msg *mqtt.Message) error
+	states    map[string]*scriptState
+	history   []ScriptRun
+	logger    *logger.Logger
+	mu        sync.Mutex
+}
+
+// NewScriptService creates the service for a validated configuration
+func NewScriptService(cfg *ScriptConfig, serviceLogger *logger.Logger) *ScriptService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ScriptService", nil)
+	}
+
+	service := &ScriptService{
+		config:  cfg,
+		poll:    defaultScriptPoll,
+		timeout: defaultScriptTimeout,
+		states:  make(map[string]*scriptState),
+		logger:  serviceLogger,
+	}
+	if cfg.PollSeconds > 0 {
+		service.poll = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	if cfg.TimeoutMillis > 0 {
+		service.timeout = time.Duration(cfg.TimeoutMillis) * time.Millisecond
+	}
+	for _, rule := range cfg.Rules {
+		service.states[rule.ID] = &scriptState{}
+	}
+	return service
+}
+
+// SetRoomSensors sets where room temperature, humidity and occupancy are read
+func (s *ScriptService) SetRoomSensors(rooms RoomSensorReader) {
+	s.rooms = rooms
+}
+
+// SetDevices sets where device power, state and readings are read
+func (s *ScriptService) SetDevices(devices DeviceStatusReader) {
+	s.devices = devices
+}
+
+// SetCommandExecutor sends the device commands of the scripts
+func (s *ScriptService) SetCommandExecutor(commands CommandExecutor) {
+	s.commands = commands
+}
+
+// SetSceneRecaller recalls the scenes of the scripts
+func (s *ScriptService) SetSceneRecaller(scenes SceneRecaller) {
+	s.scenes = scenes
+}
+
+// SetWebhookCaller calls the outbound webhooks of the scripts
+func (s *ScriptService) SetWebhookCaller(webhooks WebhookCaller) {
+	s.webhooks = webhooks
+}
+
+// SetHomeMode sets where mode() is read
+func (s *ScriptService) SetHomeMode(mode HomeModeReader) {
+	s.mode = mode
+}
+
+// SetResidents sets where anyone_home() is read
+func (s *ScriptService) SetResidents(residents HomeOccupancyReader) {
+	s.residents = residents
+}
+
+// SetSafeMode holds back scripts while safe mode is active, unless re-enabled as automation:<rule>
+func (s *ScriptService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder records the actions of scripts instead of running them in observe-only mode
+func (s *ScriptService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// SetMQTTClient attaches the client notify() publishes with
+func (s *ScriptService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// Run evaluates the conditions until the context is cancelled
+func (s *ScriptService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.evaluate(time.Now())
+		}
+	}
+}
+
+// scriptBranch is a then or else script due to run
+type scriptBranch struct {
+	rule    *ScriptRule
+	name    string
+	program *script.Program
+}
+
+// evaluate tests every condition against one snapshot of the home and runs the scripts of those
+// that changed. A condition that fails to evaluate, e.g. on a reading of an offline room, leaves
+// its rule as it was.
+func (s *ScriptService) evaluate(now time.Time) {
+	readings := s.readings(now)
+
+	var due []scriptBranch
+	for i := range s.config.Rules {
+		rule := &s.config.Rules[i]
+		s.mu.Lock()
+		disabled := rule.Disabled
+		s.mu.Unlock()
+		if disabled {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		held, err := rule.when.Test(ctx, s.env(readings, nil))
+		cancel()
+
+		s.mu.Lock()
+		state := s.states[rule.ID]
+		if err != nil {
+			if state.err != err.Error() {
+				s.logger.Error("Script condition failed", err, map[string]interface{}{"rule": rule.ID})
+			}
+			state.err = err.Error()
+			s.mu.Unlock()
+			continue
+		}
+		state.err = ""
+
+		switch {
+		case held && !state.active:
+			if state.pending.IsZero() {
+				state.pending = now
+			}
+			cooling := !state.lastRun.IsZero() && now.Sub(state.lastRun) < time.Duration(rule.CooldownSeconds)*time.Second
+			if now.Sub(state.pending) >= time.Duration(rule.ForSeconds)*time.Second && !cooling {
+				state.active = true
+				state.pending = time.Time{}
+				state.lastRun = now
+				state.runs++
+				due = append(due, scriptBranch{rule: rule, name: "then", program: rule.then})
+			}
+		case !held:
+			state.pending = time.Time{}
+			if state.active {
+				state.active = false
+				if rule.otherwise != nil {
+					due = append(due, scriptBranch{rule: rule, name: "else", program: rule.otherwise})
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	for _, branch := range due {
+		s.runScript(branch, readings, now)
+	}
+}
+
+// runScript runs a then or else script and records the run
+func (s *ScriptService) runScript(branch scriptBranch, readings *scriptReadings, now time.Time) {
+	run := ScriptRun{Rule: branch.rule.ID, Branch: branch.name, At: now, Result: ScriptResultOK}
+	if !s.safeMode.Allowed(safemode.ComponentAutomation, branch.rule.ID) {
+		run.Result = ScriptResultHeld
+		s.record(run)
+		return
+	}
+
+	actions := &scriptActionCount{}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	_, err := branch.program.Run(ctx, s.env(readings, &scriptActor{service: s, rule: branch.rule, count: actions}))
+	cancel()
+
+	run.Actions = actions.run
+	switch {
+	case err != nil:
+		run.Result = ScriptResultFailed
+		run.Error = err.Error()
+		s.logger.Error("Script failed", err, map[string]interface{}{"rule": branch.rule.ID, "branch": branch.name})
+	case s.dryRun.ObserveOnly():
+		run.Result = ScriptResultTraced
+	default:
+		s.logger.Info("Script ran", map[string]interface{}{"rule": branch.rule.ID, "branch": branch.name, "actions": run.Actions})
+	}
+	s.record(run)
+}
+
+func (s *ScriptService) record(run ScriptRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, run)
+	if len(s.history) > scriptHistorySize {
+		s.history = s.history[len(s.history)-scriptHistorySize:]
+	}
+}
+
+// scriptReadings is one snapshot of the home all rules of an evaluation read
+type scriptReadings struct {
+	now       time.Time
+	rooms     map[string]*RoomSensorData
+	devices   map[string]MQTTDeviceStatus
+	mode      string
+	residents *bool
+}
+
+func (s *ScriptService) readings(now time.Time) *scriptReadings {
+	readings := &scriptReadings{now: now, devices: make(map[string]MQTTDeviceStatus)}
+	if s.rooms != nil {
+		readings.rooms = s.rooms.GetAllRoomSensors()
+	}
+	if s.devices != nil {
+		for _, device := range s.devices.Devices() {
+			readings.devices[device.DeviceID] = device
+		}
+	}
+	if s.mode != nil {
+		readings.mode = s.mode.Mode()
+	}
+	if s.residents != nil {
+		occupied := s.residents.Occupied()
+		readings.residents = &occupied
+	}
+	return readings
+}
+
+// room returns a room's readings, or nil while it is offline. ok is false for a name that is
+// neither a room nor a device.
+func (r *scriptReadings) room(name string) (room *RoomSensorData, device *MQTTDeviceStatus, ok bool) {
+	if data, exists := r.rooms[name]; exists {
+		if !data.IsOnline || r.now.Sub(data.LastSeen) > roomSensorStale {
+			return nil, nil, true
+		}
+		return data, nil, true
+	}
+	if data, exists := r.devices[name]; exists {
+		if !data.Online {
+			return nil, nil, true
+		}
+		return nil, &data, true
+	}
+	return nil, nil, false
+}
+
+// reading returns a room's or device's reading, or null while it is offline or hasn't reported it
+func (r *scriptReadings) reading(fn string, args []interface{}, ofRoom func(*RoomSensorData) interface{}, ofDevice func(*MQTTDeviceStatus) interface{}) (interface{}, error) {
+	if err := script.ArgCount(fn, args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := script.StringArg(fn, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	room, device, ok := r.room(name)
+	if !ok {
+		return nil, errors.NewValidationError(fmt.Sprintf("no room or device %s", name), nil)
+	}
+	switch {
+	case room != nil && ofRoom != nil:
+		return ofRoom(room), nil
+	case device != nil && ofDevice != nil:
+		return ofDevice(device), nil
+	}
+	return nil, nil
+}
+
+// scriptNumber returns a device's optional reading as a script value
+func scriptNumber(value *float64) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+// scriptBool returns a device's optional state as a script value
+func scriptBool(value *bool) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+// scriptActionCount counts the actions a script ran
+type scriptActionCount struct {
+	run int
+}
+
+// scriptActor runs the actions of one rule's script
+type scriptActor struct {
+	service *ScriptService
+	rule    *ScriptRule
+	count   *scriptActionCount
+}
+
+// env returns the functions a condition, or with an actor a script, may call
+func (s *ScriptService) env(r *scriptReadings, actor *scriptActor) *script.Env {
+	functions := map[string]script.Func{
+		"temp": func(args []interface{}) (interface{}, error) {
+			return r.reading("temp", args, func(room *RoomSensorData) interface{} {
+				if room.TempLastUpdate.IsZero() {
+					return nil
+				}
+				return room.Temperature
+			}, func(device *MQTTDeviceStatus) interface{} { return scriptNumber(device.Temperature) })
+		},
+		"humidity": func(args []interface{}) (interface{}, error) {
+			return r.reading("humidity", args, func(room *RoomSensorData) interface{} {
+				if room.TempLastUpdate.IsZero() {
+					return nil
+				}
+				return room.Humidity
+			}, func(device *MQTTDeviceStatus) interface{} { return scriptNumber(device.Humidity) })
+		},
+		"occupied": func(args []interface{}) (interface{}, error) {
+			return r.reading("occupied", args, func(room *RoomSensorData) interface{} { return room.IsOccupied },
+				func(device *MQTTDeviceStatus) interface{} { return scriptBool(device.Motion) })
+		},
+		"power": func(args []interface{}) (interface{}, error) {
+			return r.reading("power", args, nil, func(device *MQTTDeviceStatus) interface{} { return scriptNumber(device.PowerW) })
+		},
+		"on": func(args []interface{}) (interface{}, error) {
+			return r.reading("on", args, nil, func(device *MQTTDeviceStatus) interface{} { return scriptBool(device.On) })
+		},
+		"online": func(args []interface{}) (interface{}, error) {
+			if err := script.ArgCount("online", args, 1, 1); err != nil {
+				return nil, err
+			}
+			name, err := script.StringArg("online", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			room, device, ok := r.room(name)
+			if !ok {
+				return nil, errors.NewValidationError(fmt.Sprintf("no room or device %s", name), nil)
+			}
+			return room != nil || device != nil, nil
+		},
+		"hour": func(args []interface{}) (interface{}, error) {
+			return float64(r.now.Hour()), script.ArgCount("hour", args, 0, 0)
+		},
+		"minute": func(args []interface{}) (interface{}, error) {
+			return float64(r.now.Minute()), script.ArgCount("minute", args, 0, 0)
+		},
+		"weekday": func(args []interface{}) (interface{}, error) {
+			return strings.ToLower(r.now.Weekday().String()), script.ArgCount("weekday", args, 0, 0)
+		},
+		"between": func(args []interface{}) (interface{}, error) {
+			return scriptBetween(r.now, args)
+		},
+		"mode": func(args []interface{}) (interface{}, error) {
+			if r.mode == "" {
+				return nil, script.ArgCount("mode", args, 0, 0)
+			}
+			return r.mode, script.ArgCount("mode", args, 0, 0)
+		},
+		"anyone_home": func(args []interface{}) (interface{}, error) {
+			if r.residents == nil {
+				return nil, script.ArgCount("anyone_home", args, 0, 0)
+			}
+			return *r.residents, script.ArgCount("anyone_home", args, 0, 0)
+		},
+	}
+	if actor != nil {
+		functions["command"] = actor.command
+		functions["scene"] = actor.scene
+		functions["notify"] = actor.notify
+		functions["webhook"] = actor.webhook
+		functions["log"] = actor.log
+	}
+	return &script.Env{Functions: functions, MaxSteps: s.config.MaxSteps}
+}
+
+// scriptBetween reports whether now is from the first HH:MM up to the second, wrapping past midnight
+func scriptBetween(now time.Time, args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("between", args, 2, 2); err != nil {
+		return nil, err
+	}
+	var minutes [2]int
+	for i := range minutes {
+		text, err := script.StringArg("between", args, i)
+		if err != nil {
+			return nil, err
+		}
+		at, err := time.Parse("15:04", text)
+		if err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("invalid time %q, expected HH:MM", text), err)
+		}
+		minutes[i] = at.Hour()*60 + at.Minute()
+	}
+	current := now.Hour()*60 + now.Minute()
+	if minutes[0] <= minutes[1] {
+		return current >= minutes[0] && current < minutes[1], nil
+	}
+	return current >= minutes[0] || current < minutes[1], nil
+}
+
+// traced records an action instead of running it in observe-only mode
+func (a *scriptActor) traced(action, target string, details map[string]interface{}) bool {
+	if !a.service.dryRun.ObserveOnly() {
+		return false
+	}
+	details["rule"] = a.rule.ID
+	a.service.dryRun.Record("script", action, target, "script "+a.rule.ID, details)
+	return true
+}
+
+// command(device, action[, value]) sends a device command
+func (a *scriptActor) command(args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("command", args, 2, 3); err != nil {
+		return nil, err
+	}
+	device, err := script.StringArg("command", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	action, err := script.StringArg("command", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &models.DeviceCommand{DeviceID: device, Action: action, Options: map[string]interface{}{"automation": "script:" + a.rule.ID}}
+	if len(args) == 3 {
+		cmd.Value = args[2]
+	}
+
+	a.count.run++
+	if a.traced(action, device, map[string]interface{}{"value": cmd.Value}) {
+		return nil, nil
+	}
+	if a.service.commands == nil {
+		return nil, errors.NewServiceError("no devices to command", nil)
+	}
+	return nil, a.service.commands.ExecuteCommand(cmd)
+}
+
+// scene(name) recalls a saved scene
+func (a *scriptActor) scene(args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("scene", args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := script.StringArg("scene", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	a.count.run++
+	if a.traced("recall_scene", name, map[string]interface{}{}) {
+		return nil, nil
+	}
+	if a.service.scenes == nil {
+		return nil, errors.NewServiceError("no scenes to recall", nil)
+	}
+	return nil, a.service.scenes.Recall(name)
+}
+
+// notify(message) notifies the residents, titled with the rule's name
+func (a *scriptActor) notify(args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("notify", args, 1, 1); err != nil {
+		return nil, err
+	}
+	message := script.Format(args[0])
+
+	a.count.run++
+	if a.traced("notify", NotificationTopic, map[string]interface{}{"message": message}) {
+		return nil, nil
+	}
+	if a.service.publish == nil {
+		return nil, errors.NewServiceError("no MQTT client to notify with", nil)
+	}
+	notification, err := localizedNotification(map[string]interface{}{
+		"source":    "scripts",
+		"severity":  AlertSeverityInfo,
+		"rule_id":   a.rule.ID,
+		"timestamp": time.Now().Unix(),
+	}, i18n.Raw(a.rule.name()), i18n.Raw(message))
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.service.publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1})
+}
+
+// webhook(id) calls an outbound webhook in the background; its templates see the rule as script
+func (a *scriptActor) webhook(args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("webhook", args, 1, 1); err != nil {
+		return nil, err
+	}
+	id, err := script.StringArg("webhook", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if a.service.webhooks == nil {
+		return nil, errors.NewServiceError("no webhooks to call", nil)
+	}
+
+	// Webhooks are traced by the webhook service itself in observe-only mode
+	a.count.run++
+	event := map[string]interface{}{"event": "script", "script": a.rule.ID}
+	go a.service.webhooks.CallWebhook(id, "script:"+a.rule.ID, event)
+	return nil, nil
+}
+
+// log(message) writes a line to the service's log
+func (a *scriptActor) log(args []interface{}) (interface{}, error) {
+	if err := script.ArgCount("log", args, 1, 1); err != nil {
+		return nil, err
+	}
+	a.service.logger.Info("Script log", map[string]interface{}{"rule": a.rule.ID, "message": script.Format(args[0])})
+	return nil, nil
+}
+
+// Evaluate evaluates an expression against the home as it is, e.g. to try a condition before
+// adding it. Actions can't be called.
+func (s *ScriptService) Evaluate(expression string, now time.Time) (interface{}, error) {
+	program, err := compileCondition(expression)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return program.Run(ctx, s.env(s.readings(now), nil))
+}
+
+// EnableRule turns a rule on or off until the service restarts. Turning a rule off forgets where
+// its condition stood, without running its else script.
+func (s *ScriptService) EnableRule(id string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.config.Rules {
+		rule := &s.config.Rules[i]
+		if rule.ID != id {
+			continue
+		}
+		rule.Disabled = !enabled
+		if !enabled {
+			*s.states[id] = scriptState{lastRun: s.states[id].lastRun, runs: s.states[id].runs}
+		}
+		s.logger.Info("Script rule changed", map[string]interface{}{"rule": id, "enabled": enabled})
+		return nil
+	}
+	return errors.NewValidationError(fmt.Sprintf("unknown script rule %s", id), nil)
+}
+
+// ScriptStatus is the rules and their recent runs, newest first
+type ScriptStatus struct {
+	Rules   []ScriptRuleStatus `json:"rules"`
+	History []ScriptRun        `json:"history"`
+}
+
+// Status returns the rules with where their conditions stand and the recent runs
+func (s *ScriptService) Status() ScriptStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ScriptStatus{Rules: make([]ScriptRuleStatus, 0, len(s.config.Rules)), History: make([]ScriptRun, 0, len(s.history))}
+	for _, rule := range s.config.Rules {
+		state := s.states[rule.ID]
+		ruleStatus := ScriptRuleStatus{ScriptRule: rule, Active: state.active, Runs: state.runs, Error: state.err}
+		if !state.pending.IsZero() {
+			pending := state.pending
+			ruleStatus.Pending = &pending
+		}
+		if !state.lastRun.IsZero() {
+			lastRun := state.lastRun
+			ruleStatus.LastRun = &lastRun
+		}
+		status.Rules = append(status.Rules, ruleStatus)
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		status.History = append(status.History, s.history[i])
+	}
+	return status
+}
+
+// Handler serves the rules and recent runs as JSON
+func (s *ScriptService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+// ScriptEvalRequest is an expression to evaluate against the home as it is
+type ScriptEvalRequest struct {
+	Expression string `json:"expression"`
+}
+
+// EvalHandler evaluates the expression POSTed as a ScriptEvalRequest and answers its value
+func (s *ScriptService) EvalHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to evaluate an expression", http.StatusMethodNotAllowed)
+			return
+		}
+		var request ScriptEvalRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxScriptRequest)).Decode(&request); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		value, err := s.Evaluate(request.Expression, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+	})
+}
+
+// EnableHandler turns the rule ?rule= on or off on POST, as ?enabled=true or false says
+func (s *ScriptService) EnableHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to enable or disable a rule", http.StatusMethodNotAllowed)
+			return
+		}
+
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := s.EnableRule(r.URL.Query().Get("rule"), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+type fakeHomeMode string
+
+func (f fakeHomeMode) Mode() string {
+	return string(f)
+}
+
+func TestScriptConfigValidate(t *testing.T) {
+	valid := func() *ScriptConfig {
+		return &ScriptConfig{Rules: []ScriptRule{{
+			ID:   "fan",
+			When: `temp("bedroom") > 78 && between("22:00", "06:00")`,
+			Then: `command("bedroom-fan", "turn_on")`,
+			Else: `command("bedroom-fan", "turn_off")`,
+		}}}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+
+	broken := map[string]func(c *ScriptConfig){
+		"no condition":      func(c *ScriptConfig) { c.Rules[0].When = " " },
+		"repeated rule":     func(c *ScriptConfig) { c.Rules = append(c.Rules, c.Rules[0]) },
+		"syntax error":      func(c *ScriptConfig) { c.Rules[0].When = `temp("bedroom" > 78` },
+		"unknown function":  func(c *ScriptConfig) { c.Rules[0].Then = `comand("bedroom-fan", "turn_on")` },
+		"action in when":    func(c *ScriptConfig) { c.Rules[0].When = `command("fan", "turn_on") == null` },
+		"broken else":       func(c *ScriptConfig) { c.Rules[0].Else = `if true {` },
+		"negative cooldown": func(c *ScriptConfig) { c.Rules[0].CooldownSeconds = -1 },
+		"negative timeout":  func(c *ScriptConfig) { c.TimeoutMillis = -1 },
+	}
+	for name, breakConfig := range broken {
+		cfg := valid()
+		breakConfig(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestScriptServiceFunctions(t *testing.T) {
+	// Every function the validator knows is provided, and no other
+	service := NewScriptService(&ScriptConfig{}, nil)
+	env := service.env(service.readings(time.Now()), &scriptActor{service: service, rule: &ScriptRule{ID: "test"}, count: &scriptActionCount{}})
+	for name := range env.Functions {
+		if !scriptQueries[name] && !scriptActions[name] {
+			t.Errorf("%s is provided but not known to the validator", name)
+		}
+	}
+	for _, names := range []map[string]bool{scriptQueries, scriptActions} {
+		for name := range names {
+			if env.Functions[name] == nil {
+				t.Errorf("%s is known to the validator but not provided", name)
+			}
+		}
+	}
+}
+
+func TestScriptService(t *testing.T) {
+	now := time.Date(2026, 7, 14, 22, 30, 0, 0, time.Local)
+	rooms := fakeRoomSensors{
+		"bedroom":     {RoomID: "bedroom", Temperature: 79, IsOnline: true, LastSeen: now, TempLastUpdate: now},
+		"living-room": {RoomID: "living-room", Temperature: 72, IsOnline: true, LastSeen: now, TempLastUpdate: now, IsOccupied: false},
+		"attic":       {RoomID: "attic", Temperature: 95, IsOnline: false, LastSeen: now.Add(-time.Hour), TempLastUpdate: now.Add(-time.Hour)},
+	}
+	power := 1500.0
+	devices := fakeDeviceStatuses{{DeviceID: "heater-plug", Online: true, PowerW: &power}}
+
+	cfg := &ScriptConfig{Rules: []ScriptRule{
+		{
+			ID:         "fan",
+			Name:       "Bedroom fan",
+			When:       `temp("bedroom") > 78 && hour() >= 22 && !occupied("living-room")`,
+			Then:       "command(\"bedroom-fan\", \"turn_on\", temp(\"bedroom\") > 80 ? \"high\" : \"low\")\nnotify(\"Bedroom at \" + temp(\"bedroom\") + \"°F\")",
+			Else:       `command("bedroom-fan", "turn_off")`,
+			ForSeconds: 60,
+		},
+		{ID: "attic", When: `temp("attic") > 90`, Then: `scene("cool")`},
+		{ID: "heater", When: `power("heater-plug") > 1000 && mode() == "away"`, Then: `command("heater-plug", "turn_off")`},
+		{ID: "broken", When: `true`, Then: `command("fan", "turn_on"); log(1 / 0)`},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	service := NewScriptService(cfg, nil)
+	service.SetRoomSensors(rooms)
+	service.SetDevices(devices)
+	service.SetHomeMode(fakeHomeMode("away"))
+	commands := &commandRecorder{}
+	service.SetCommandExecutor(commands)
+	var notifications [][]byte
+	service.publish = func(msg *mqtt.Message) error {
+		notifications = append(notifications, msg.Payload)
+		return nil
+	}
+
+	// evaluate runs the rules a while after now, with the online rooms just heard from
+	evaluate := func(after time.Duration) {
+		for _, room := range rooms {
+			if room.IsOnline {
+				room.LastSeen = now.Add(after)
+			}
+		}
+		service.evaluate(now.Add(after))
+	}
+
+	// The fan waits for the condition to hold a minute; the heater and the broken rule run at once
+	evaluate(0)
+	if len(commands.commands) != 2 || commands.commands[0].DeviceID != "heater-plug" || commands.commands[1].DeviceID != "fan" {
+		t.Fatalf("Expected the heater turned off and the broken rule's command, got %+v", commands.commands)
+	}
+	status := service.Status()
+	if status.Rules[0].Pending == nil || status.Rules[0].Active {
+		t.Fatalf("Expected the fan rule pending, got %+v", status.Rules[0])
+	}
+	if !strings.Contains(status.Rules[1].Error, "null") {
+		t.Fatalf("Expected the offline attic's condition to fail, got %+v", status.Rules[1])
+	}
+	if status.History[0].Rule != "broken" || status.History[0].Result != ScriptResultFailed || status.History[0].Actions != 1 ||
+		!strings.Contains(status.History[0].Error, "division by zero") {
+		t.Fatalf("Expected the broken rule's failure recorded, got %+v", status.History[0])
+	}
+
+	evaluate(time.Minute)
+	if len(commands.commands) != 3 {
+		t.Fatalf("Expected the fan turned on once, got %+v", commands.commands)
+	}
+	cmd := commands.commands[2]
+	if cmd.DeviceID != "bedroom-fan" || cmd.Action != "turn_on" || cmd.Value != "low" || cmd.Options["automation"] != "script:fan" {
+		t.Fatalf("Unexpected fan command %+v", cmd)
+	}
+	var notification map[string]interface{}
+	if len(notifications) != 1 || json.Unmarshal(notifications[0], &notification) != nil ||
+		notification["title"] != "Bedroom fan" || notification["message"] != "Bedroom at 79°F" {
+		t.Fatalf("Unexpected notifications %s", notifications)
+	}
+
+	// Held conditions don't run again; the fan's else runs once it stops holding
+	evaluate(2 * time.Minute)
+	if len(commands.commands) != 3 {
+		t.Fatalf("Expected nothing more while the conditions hold, got %+v", commands.commands[3:])
+	}
+	rooms["living-room"].IsOccupied = true
+	evaluate(3 * time.Minute)
+	if len(commands.commands) != 4 || commands.commands[3].Action != "turn_off" {
+		t.Fatalf("Expected the fan turned off, got %+v", commands.commands)
+	}
+	if status := service.Status(); status.Rules[0].Active || status.Rules[0].Runs != 1 || status.History[0].Branch != "else" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	// Observe-only mode traces the actions instead
+	if err := service.EnableRule("broken", false); err != nil {
+		t.Fatalf("EnableRule failed: %v", err)
+	}
+	service.SetDryRunRecorder(dryrun.NewRecorder(true, "", nil))
+	rooms["living-room"].IsOccupied = false
+	evaluate(4 * time.Minute)
+	evaluate(5 * time.Minute)
+	if len(commands.commands) != 4 || len(notifications) != 1 {
+		t.Fatalf("Expected nothing sent in observe-only mode, got %+v", commands.commands[4:])
+	}
+	if run := service.Status().History[0]; run.Rule != "fan" || run.Result != ScriptResultTraced || run.Actions != 2 {
+		t.Fatalf("Expected the fan's run traced, got %+v", run)
+	}
+
+	if value, err := service.Evaluate(`occupied("living-room") || weekday() == "tuesday"`, now); err != nil || value != true {
+		t.Fatalf("Expected the expression true, got %v, %v", value, err)
+	}
+	if _, err := service.Evaluate(`notify("hi")`, now); err == nil {
+		t.Fatal("Expected an action rejected in an expression")
+	}
+	if _, err := service.Evaluate(`temp("garage")`, now); err == nil {
+		t.Fatal("Expected an unknown room to fail")
+	}
+}
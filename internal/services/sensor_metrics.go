@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Room sensor and thermostat metrics. They are shared by the sensor services, which may run
+// side by side in one process, and are exported once RegisterSensorMetrics has been called.
+var (
+	roomTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_temperature_fahrenheit",
+		Help: "Latest room temperature reported by the room's sensor",
+	}, []string{"room_id"})
+	roomHumidity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_humidity_percent",
+		Help: "Latest relative humidity reported by the room's sensor",
+	}, []string{"room_id"})
+	roomOccupied = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_occupied",
+		Help: "Whether motion is detected in the room (1) or not (0)",
+	}, []string{"room_id"})
+	roomLightLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_light_level_percent",
+		Help: "Latest light level reported by the room's sensor",
+	}, []string{"room_id"})
+	roomHazard = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_hazard_detected",
+		Help: "Whether the room's leak or smoke detector is triggered (1) or not (0)",
+	}, []string{"room_id", "hazard"})
+	roomContactOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_room_contact_open",
+		Help: "Whether a door or window contact of the room is open (1) or closed (0)",
+	}, []string{"room_id", "contact"})
+	thermostatTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_thermostat_temperature_fahrenheit",
+		Help: "Current and target temperature of a thermostat",
+	}, []string{"thermostat_id", "room_id", "kind"})
+	thermostatStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_thermostat_status",
+		Help: "1 for the thermostat's current status (idle, heating, cooling, fan), 0 otherwise",
+	}, []string{"thermostat_id", "room_id", "status"})
+	thermostatOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "home_automation_thermostat_online",
+		Help: "Whether the thermostat has recent sensor data (1) or not (0)",
+	}, []string{"thermostat_id", "room_id"})
+	sensorMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "home_automation_sensor_messages_total",
+		Help: "MQTT sensor messages handled, by service, message type and result",
+	}, []string{"service", "type", "result"})
+)
+
+// thermostatStatuses lists every status so the previous one is reset to 0 on a change
+var thermostatStatuses = []models.ThermostatStatus{
+	models.StatusIdle, models.StatusHeating, models.StatusCooling, models.StatusFan,
+}
+
+// RegisterSensorMetrics registers the room sensor and thermostat metrics
+func RegisterSensorMetrics(registerer prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		roomTemperature, roomHumidity, roomOccupied, roomLightLevel, roomHazard, roomContactOpen,
+		thermostatTemperature, thermostatStatus, thermostatOnline, sensorMessages,
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
+			}
+			return errors.NewSystemError("failed to register sensor metrics", err)
+		}
+	}
+	return nil
+}
+
+// countedHandler counts the messages a handler processes and whether it failed
+func countedHandler(service, messageType string, handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(topic string, payload []byte) error {
+		err := handler(topic, payload)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		sensorMessages.WithLabelValues(service, messageType, result).Inc()
+		return err
+	}
+}
+
+// countedContextHandler is countedHandler for a handler continuing the message's trace
+func countedContextHandler(service, messageType string, handler mqtt.ContextHandler) mqtt.ContextHandler {
+	return func(ctx context.Context, topic string, payload []byte) error {
+		err := handler(ctx, topic, payload)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		sensorMessages.WithLabelValues(service, messageType, result).Inc()
+		return err
+	}
+}
+
+// boolGauge converts a state to a gauge value
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// recordThermostatMetrics exports a thermostat's temperatures, status and connectivity
+func recordThermostatMetrics(thermostat *models.Thermostat) {
+	thermostatTemperature.WithLabelValues(thermostat.ID, thermostat.RoomID, "current").Set(thermostat.CurrentTemp)
+	thermostatTemperature.WithLabelValues(thermostat.ID, thermostat.RoomID, "target").Set(thermostat.TargetTemp)
+	for _, status := range thermostatStatuses {
+		thermostatStatus.WithLabelValues(thermostat.ID, thermostat.RoomID, string(status)).Set(boolGauge(thermostat.Status == status))
+	}
+	thermostatOnline.WithLabelValues(thermostat.ID, thermostat.RoomID).Set(boolGauge(thermostat.IsOnline))
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestSensorMetrics(t *testing.T) {
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	service := NewUnifiedSensorService(mqttClient, log.New(os.Stdout, "[TEST] ", log.LstdFlags))
+
+	handler := countedHandler("unified", "temperature", service.handleTemperatureMessage)
+	if err := handler("room-temp/metrics-room", []byte(`{"temperature": 70.5, "device_id": "pico-metrics"}`)); err != nil {
+		t.Fatalf("handleTemperatureMessage failed: %v", err)
+	}
+	handler("room-temp/metrics-room", []byte(`not json`))
+	service.handleMotionMessage("room-motion/metrics-room", []byte(`{"motion": true, "device_id": "pico-metrics"}`))
+
+	if value := testutil.ToFloat64(roomTemperature.WithLabelValues("metrics-room")); value != 70.5 {
+		t.Errorf("Expected room temperature 70.5, got %.1f", value)
+	}
+	if value := testutil.ToFloat64(roomOccupied.WithLabelValues("metrics-room")); value != 1 {
+		t.Errorf("Expected room to be occupied, got %.0f", value)
+	}
+	for result, want := range map[string]float64{"ok": 1, "error": 1} {
+		if value := testutil.ToFloat64(sensorMessages.WithLabelValues("unified", "temperature", result)); value < want {
+			t.Errorf("Expected at least %.0f %s messages, got %.0f", want, result, value)
+		}
+	}
+
+	thermostat := &models.Thermostat{ID: "metrics-thermostat", RoomID: "metrics-room", CurrentTemp: 66, TargetTemp: 70, Status: models.StatusHeating, IsOnline: true}
+	recordThermostatMetrics(thermostat)
+	thermostat.Status = models.StatusIdle
+	recordThermostatMetrics(thermostat)
+	for status, want := range map[models.ThermostatStatus]float64{models.StatusHeating: 0, models.StatusIdle: 1} {
+		if value := testutil.ToFloat64(thermostatStatus.WithLabelValues("metrics-thermostat", "metrics-room", string(status))); value != want {
+			t.Errorf("Expected %s status gauge %.0f, got %.0f", status, want, value)
+		}
+	}
+
+	if err := RegisterSensorMetrics(prometheus.NewRegistry()); err != nil {
+		t.Errorf("RegisterSensorMetrics failed: %v", err)
+	}
+}
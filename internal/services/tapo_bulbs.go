@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/secrets"
+	"github.com/johnpr01/home-automation/pkg/tapo"
+)
+
+// FirmwareTapo marks the Tapo bulbs listed alongside the Tasmota and ESPHome devices
+const FirmwareTapo = "tapo"
+
+// tapoBulbTimeout bounds the requests of a Tapo bulb client
+const tapoBulbTimeout = 10 * time.Second
+
+// TapoBulbConfig configures a Tapo L530/L900 bulb controlled as a light
+type TapoBulbConfig struct {
+	DeviceID   string        `json:"device_id"`
+	DeviceName string        `json:"device_name"`
+	RoomID     string        `json:"room_id"`
+	IPAddress  string        `json:"ip_address"`
+	Username   string        `json:"username"` // Or a reference such as secret:tplink_username
+	Password   string        `json:"password"` // Or a reference such as secret:tplink_password
+	Protocol   tapo.Protocol `json:"protocol"` // auto (default), klap or legacy
+	Tags       []string      `json:"tags,omitempty"`
+}
+
+// LoadTapoBulbs reads Tapo bulb configurations from a JSON file
+func LoadTapoBulbs(path string) ([]TapoBulbConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read Tapo bulbs file", err)
+	}
+
+	var configs []TapoBulbConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, errors.NewConfigError("failed to parse Tapo bulbs file", err)
+	}
+	seen := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.DeviceID == "" || cfg.IPAddress == "" {
+			return nil, errors.NewConfigError("every Tapo bulb needs a device_id and an ip_address", nil)
+		}
+		if seen[cfg.DeviceID] {
+			return nil, errors.NewConfigError(fmt.Sprintf("Tapo bulb %s is listed twice", cfg.DeviceID), nil)
+		}
+		seen[cfg.DeviceID] = true
+		switch cfg.Protocol {
+		case "", tapo.ProtocolAuto, tapo.ProtocolKlap, tapo.ProtocolLegacy:
+		default:
+			return nil, errors.NewConfigError(fmt.Sprintf("Tapo bulb %s has unknown protocol %q, use auto, klap or legacy", cfg.DeviceID, cfg.Protocol), nil)
+		}
+	}
+	return configs, nil
+}
+
+// AddConfiguredTapoBulb connects to a configured bulb and adds it as a light. With the auto
+// protocol KLAP is tried first, then the legacy protocol of older firmware.
+func (s *DeviceService) AddConfiguredTapoBulb(ctx context.Context, cfg TapoBulbConfig) error {
+	username, err := secrets.Resolve(cfg.Username)
+	if err != nil {
+		return errors.NewConfigError(fmt.Sprintf("Failed to resolve the username of Tapo bulb %s", cfg.DeviceID), err)
+	}
+	password, err := secrets.Resolve(cfg.Password)
+	if err != nil {
+		return errors.NewConfigError(fmt.Sprintf("Failed to resolve the password of Tapo bulb %s", cfg.DeviceID), err)
+	}
+
+	protocols := []tapo.Protocol{tapo.ProtocolKlap, tapo.ProtocolLegacy}
+	if cfg.Protocol == tapo.ProtocolKlap || cfg.Protocol == tapo.ProtocolLegacy {
+		protocols = []tapo.Protocol{cfg.Protocol}
+	}
+
+	var lastErr error
+	for _, protocol := range protocols {
+		var bulb *tapo.BulbClient
+		if protocol == tapo.ProtocolKlap {
+			bulb = tapo.NewKlapBulbClient(tapo.NewKlapClient(cfg.IPAddress, username, password, tapoBulbTimeout, *s.logger))
+		} else {
+			bulb = tapo.NewBulbClient(tapo.NewTapoClient(cfg.IPAddress, username, password, s.logger))
+		}
+
+		name := cfg.DeviceName
+		if name == "" {
+			name = cfg.DeviceID
+		}
+		device := &models.Device{
+			ID:         cfg.DeviceID,
+			Name:       name,
+			Type:       models.DeviceTypeLight,
+			RoomID:     cfg.RoomID,
+			Tags:       cfg.Tags,
+			Properties: map[string]interface{}{"ip_address": cfg.IPAddress, "protocol": string(protocol)},
+		}
+		err := s.AddTapoBulb(ctx, device, bulb)
+		if err == nil {
+			return nil
+		}
+		// Only a failed connection is worth retrying with the other protocol
+		if appErr, ok := err.(*errors.HomeAutomationError); !ok || appErr.Type != errors.ErrorTypeDevice {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// TapoBulbs lists and commands the service's Tapo bulbs as a DeviceProvider, so they are
+// controlled through the same device API and automations as the MQTT devices
+func (s *DeviceService) TapoBulbs() DeviceProvider {
+	return tapoBulbProvider{devices: s}
+}
+
+type tapoBulbProvider struct {
+	devices *DeviceService
+}
+
+func (p tapoBulbProvider) Devices() []MQTTDeviceStatus {
+	s := p.devices
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	statuses := make([]MQTTDeviceStatus, 0, len(s.bulbs))
+	for id := range s.bulbs {
+		device, exists := s.devices[id]
+		if !exists {
+			continue
+		}
+		status := MQTTDeviceStatus{
+			DeviceID:   device.ID,
+			DeviceName: device.Name,
+			RoomID:     device.RoomID,
+			Firmware:   FirmwareTapo,
+			Online:     true,
+			LastSeen:   device.LastUpdated,
+		}
+		if device.Status == "on" || device.Status == "off" {
+			on := device.Status == "on"
+			status.On = &on
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DeviceID < statuses[j].DeviceID
+	})
+	return statuses
+}
+
+func (p tapoBulbProvider) Handles(deviceID string) bool {
+	p.devices.mutex.RLock()
+	defer p.devices.mutex.RUnlock()
+	_, exists := p.devices.bulbs[deviceID]
+	return exists
+}
+
+func (p tapoBulbProvider) SendCommand(cmd *models.DeviceCommand) error {
+	return p.devices.ExecuteCommand(cmd)
+}
@@ -4,11 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/dryrun"
 	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/identity"
 	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/internal/secrets"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 	"github.com/johnpr01/home-automation/pkg/tapo"
 )
@@ -21,23 +30,38 @@ type TapoService struct {
 	logger     *logger.Logger
 	mu         sync.RWMutex
 	running    bool
-	stopChan   chan struct{}
+	ctx        context.Context // Ends the device monitors; set by Start
+	cancel     context.CancelFunc
+	monitors   sync.WaitGroup
+	safeMode   *safemode.Controller
+	dryRun     *dryrun.Recorder
+	protocols  *tapo.ProtocolCache
+	identities *identity.Registry
+	commands   *CommandQueue // Delivers state changes to plugs that were unreachable when they reconnect
+
+	// Callbacks for completed appliance cycles and energy readings
+	cycleCallbacks   []func(event CycleEvent)
+	readingCallbacks []func(reading EnergyReading)
 }
 
 // TapoDeviceManager manages a single Tapo device
 type TapoDeviceManager struct {
 	DeviceID     string
+	UUID         string // Stable identifier assigned by the identity registry
 	DeviceName   string
 	RoomID       string
 	IPAddress    string
 	Username     string
-	Password     string
-	Client       interface{} // Can be *tapo.TapoClient or *tapo.KlapClient
+	Password     secrets.Value // Redacted when the manager is logged or served
+	Client       interface{}   // Can be *tapo.TapoClient or *tapo.KlapClient
 	KlapClient   *tapo.KlapClient
 	PollInterval time.Duration
 	LastReading  time.Time
 	IsConnected  bool
-	UseKlap      bool
+	UseKlap      bool          // Protocol currently in use
+	Protocol     tapo.Protocol // Configured protocol; auto detects and falls back
+	Tags         []string
+	cycle        *cycleDetector
 }
 
 // TapoConfig represents configuration for Tapo devices
@@ -46,20 +70,27 @@ type TapoConfig struct {
 	DeviceName   string        `json:"device_name"`
 	RoomID       string        `json:"room_id"`
 	IPAddress    string        `json:"ip_address"`
-	Username     string        `json:"username"`
-	Password     string        `json:"password"`
+	Username     string        `json:"username"` // Or a reference such as secret:tplink_username
+	Password     string        `json:"password"` // Or a reference such as secret:tplink_password
 	PollInterval time.Duration `json:"poll_interval"`
-	UseKlap      bool          `json:"use_klap"`
+	UseKlap      bool          `json:"use_klap"` // Deprecated: the protocol is detected automatically
+	Protocol     tapo.Protocol `json:"protocol"` // auto (default), klap or legacy
+	// Cycle enables appliance-cycle detection (washer, dryer); nil disables it
+	Cycle *CycleConfig `json:"cycle,omitempty"`
+	// Tags group devices for queries and metrics, e.g. "holiday-lights"
+	Tags []string `json:"tags,omitempty"`
 }
 
 // NewTapoService creates a new Tapo service
 func NewTapoService(mqttClient *mqtt.Client, tsClient TimeSeriesClient, serviceLogger *logger.Logger) *TapoService {
+	protocols, _ := tapo.NewProtocolCache("")
+
 	return &TapoService{
 		devices:    make(map[string]*TapoDeviceManager),
 		mqttClient: mqttClient,
 		tsClient:   tsClient,
 		logger:     serviceLogger,
-		stopChan:   make(chan struct{}),
+		protocols:  protocols,
 	}
 }
 
@@ -72,53 +103,77 @@ func (ts *TapoService) AddDevice(config *TapoConfig) error {
 		config.PollInterval = 30 * time.Second // Default 30 seconds
 	}
 
+	protocol := config.Protocol
+	if protocol == "" {
+		protocol = tapo.ProtocolAuto
+	}
+
+	username, err := secrets.Resolve(config.Username)
+	if err != nil {
+		return errors.NewConfigError(fmt.Sprintf("Failed to resolve the username of Tapo device %s", config.DeviceID), err)
+	}
+	password, err := secrets.Resolve(config.Password)
+	if err != nil {
+		return errors.NewConfigError(fmt.Sprintf("Failed to resolve the password of Tapo device %s", config.DeviceID), err)
+	}
+
 	manager := &TapoDeviceManager{
 		DeviceID:     config.DeviceID,
 		DeviceName:   config.DeviceName,
 		RoomID:       config.RoomID,
 		IPAddress:    config.IPAddress,
-		Username:     config.Username,
-		Password:     config.Password,
+		Username:     username,
+		Password:     secrets.Value(password),
 		PollInterval: config.PollInterval,
-		UseKlap:      config.UseKlap,
+		Protocol:     protocol,
+		Tags:         config.Tags,
+	}
+	if config.Cycle != nil {
+		manager.cycle = newCycleDetector(config.Cycle)
 	}
 
-	// Create appropriate client based on configuration
-	if config.UseKlap {
-		// Create KLAP client for newer firmware
-		klapClient := tapo.NewKlapClient(config.IPAddress, config.Username, config.Password, 30*time.Second, *ts.logger)
-		manager.KlapClient = klapClient
-
-		// Test connection
-		ctx := context.Background()
-		if err := klapClient.Connect(ctx); err != nil {
-			return errors.NewDeviceError(fmt.Sprintf("Failed to connect to Tapo device %s using KLAP", config.DeviceID), err)
-		}
-	} else {
-		// Create legacy client for older firmware
-		client := tapo.NewTapoClient(config.IPAddress, config.Username, config.Password, ts.logger)
-		manager.Client = client
+	if err := ts.connect(manager); err != nil {
+		return errors.NewDeviceError(fmt.Sprintf("Failed to connect to Tapo device %s", config.DeviceID), err)
+	}
 
-		// Test connection
-		if err := client.Connect(); err != nil {
-			return errors.NewDeviceError(fmt.Sprintf("Failed to connect to Tapo device %s", config.DeviceID), err)
-		}
+	if err := ts.claimIdentity(manager); err != nil {
+		ts.logger.Error("Failed to claim device identity", err, map[string]interface{}{
+			"device_id": config.DeviceID,
+		})
 	}
 
-	manager.IsConnected = true
 	ts.devices[config.DeviceID] = manager
 
+	// Devices added while the service runs, e.g. by provisioning, are monitored straight away
+	if ts.running {
+		ts.startMonitor(config.DeviceID, manager)
+	}
+
 	ts.logger.Info("Added Tapo device", map[string]interface{}{
 		"device_id":   config.DeviceID,
+		"device_uuid": manager.UUID,
 		"device_name": config.DeviceName,
 		"room_id":     config.RoomID,
 		"ip_address":  config.IPAddress,
-		"use_klap":    config.UseKlap,
+		"use_klap":    manager.UseKlap,
 	})
 
 	return nil
 }
 
+// HasDeviceAt reports whether a device with the IP address is monitored
+func (ts *TapoService) HasDeviceAt(ipAddress string) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	for _, manager := range ts.devices {
+		if manager.IPAddress == ipAddress {
+			return true
+		}
+	}
+	return false
+}
+
 // RemoveDevice removes a Tapo device from monitoring
 func (ts *TapoService) RemoveDevice(deviceID string) error {
 	ts.mu.Lock()
@@ -129,6 +184,7 @@ func (ts *TapoService) RemoveDevice(deviceID string) error {
 	}
 
 	delete(ts.devices, deviceID)
+	ts.commands.Forget(deviceID)
 
 	ts.logger.Info("Removed Tapo device", map[string]interface{}{
 		"device_id": deviceID,
@@ -137,8 +193,8 @@ func (ts *TapoService) RemoveDevice(deviceID string) error {
 	return nil
 }
 
-// Start begins monitoring all configured devices
-func (ts *TapoService) Start() error {
+// Start begins monitoring all configured devices, until Stop
+func (ts *TapoService) Start(ctx context.Context) error {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
@@ -147,10 +203,11 @@ func (ts *TapoService) Start() error {
 	}
 
 	ts.running = true
+	ts.ctx, ts.cancel = context.WithCancel(context.WithoutCancel(ctx))
 
 	// Start monitoring goroutines for each device
 	for deviceID, manager := range ts.devices {
-		go ts.monitorDevice(deviceID, manager)
+		ts.startMonitor(deviceID, manager)
 	}
 
 	ts.logger.Info("Started Tapo monitoring service", map[string]interface{}{
@@ -160,24 +217,85 @@ func (ts *TapoService) Start() error {
 	return nil
 }
 
-// Stop stops monitoring all devices
-func (ts *TapoService) Stop() error {
+// Stop stops monitoring all devices, waiting for polls in progress to finish or ctx to be done
+func (ts *TapoService) Stop(ctx context.Context) error {
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
-
 	if !ts.running {
+		ts.mu.Unlock()
 		return nil
 	}
-
 	ts.running = false
-	close(ts.stopChan)
+	ts.cancel()
+	ts.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ts.monitors.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.NewTimeoutError("Tapo device polls did not finish in time", ctx.Err())
+	}
 
 	ts.logger.Info("Stopped Tapo monitoring service")
 	return nil
 }
 
-// monitorDevice continuously monitors a single Tapo device
-func (ts *TapoService) monitorDevice(deviceID string, manager *TapoDeviceManager) {
+// startMonitor monitors a device until Stop; the caller holds the lock
+func (ts *TapoService) startMonitor(deviceID string, manager *TapoDeviceManager) {
+	ctx := ts.ctx
+	ts.monitors.Add(1)
+	go func() {
+		defer ts.monitors.Done()
+		ts.monitorDevice(ctx, deviceID, manager)
+	}()
+}
+
+// PollResult is the outcome of polling one device in one-shot mode
+type PollResult struct {
+	DeviceID   string         `json:"device_id"`
+	DeviceName string         `json:"device_name"`
+	RoomID     string         `json:"room_id"`
+	Reading    *EnergyReading `json:"reading,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// PollOnce polls every configured device a single time without starting the monitoring
+// goroutines, e.g. for cron-based deployments. Results are sorted by device ID.
+func (ts *TapoService) PollOnce() []PollResult {
+	ts.mu.RLock()
+	managers := make([]*TapoDeviceManager, 0, len(ts.devices))
+	for _, manager := range ts.devices {
+		managers = append(managers, manager)
+	}
+	ts.mu.RUnlock()
+
+	sort.Slice(managers, func(i, j int) bool {
+		return managers[i].DeviceID < managers[j].DeviceID
+	})
+
+	results := make([]PollResult, 0, len(managers))
+	for _, manager := range managers {
+		result := PollResult{
+			DeviceID:   manager.DeviceID,
+			DeviceName: manager.DeviceName,
+			RoomID:     manager.RoomID,
+		}
+		reading, err := ts.pollDevice(manager)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Reading = reading
+		results = append(results, result)
+	}
+	return results
+}
+
+// monitorDevice continuously monitors a single Tapo device until ctx is done
+func (ts *TapoService) monitorDevice(ctx context.Context, deviceID string, manager *TapoDeviceManager) {
 	ticker := time.NewTicker(manager.PollInterval)
 	defer ticker.Stop()
 
@@ -188,7 +306,7 @@ func (ts *TapoService) monitorDevice(deviceID string, manager *TapoDeviceManager
 
 	for {
 		select {
-		case <-ts.stopChan:
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			ts.pollDevice(manager)
@@ -196,32 +314,17 @@ func (ts *TapoService) monitorDevice(deviceID string, manager *TapoDeviceManager
 	}
 }
 
-// pollDevice polls a single device for energy data
-func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
-	// Reconnect if needed
+// pollDevice polls a single device for energy data and returns the reading it recorded
+func (ts *TapoService) pollDevice(manager *TapoDeviceManager) (*EnergyReading, error) {
+	// Reconnect if needed, falling back to the other protocol
 	if !manager.IsConnected {
-		if manager.UseKlap && manager.KlapClient != nil {
-			ctx := context.Background()
-			if err := manager.KlapClient.Connect(ctx); err != nil {
-				ts.logger.Error("Failed to reconnect to Tapo device using KLAP", err, map[string]interface{}{
-					"device_id": manager.DeviceID,
-				})
-				return
-			}
-		} else if client, ok := manager.Client.(*tapo.TapoClient); ok {
-			if err := client.Connect(); err != nil {
-				ts.logger.Error("Failed to reconnect to Tapo device", err, map[string]interface{}{
-					"device_id": manager.DeviceID,
-				})
-				return
-			}
-		} else {
-			ts.logger.Error("Invalid client type for device", nil, map[string]interface{}{
+		if err := ts.connect(manager); err != nil {
+			ts.logger.Error("Failed to reconnect to Tapo device", err, map[string]interface{}{
 				"device_id": manager.DeviceID,
 			})
-			return
+			return nil, err
 		}
-		manager.IsConnected = true
+		ts.commands.Reconnected(manager.DeviceID)
 	}
 
 	var deviceInfo interface{}
@@ -236,7 +339,7 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 				"device_id": manager.DeviceID,
 			})
 			manager.IsConnected = false
-			return
+			return nil, err
 		}
 		deviceInfo = klapDeviceInfo
 
@@ -245,7 +348,7 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 			ts.logger.Error("Failed to get energy usage via KLAP", err, map[string]interface{}{
 				"device_id": manager.DeviceID,
 			})
-			return
+			return nil, err
 		}
 		energyUsage = klapEnergyUsage
 	} else if client, ok := manager.Client.(*tapo.TapoClient); ok {
@@ -255,7 +358,7 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 				"device_id": manager.DeviceID,
 			})
 			manager.IsConnected = false
-			return
+			return nil, err
 		}
 		deviceInfo = legacyDeviceInfo
 
@@ -264,26 +367,31 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 			ts.logger.Error("Failed to get energy usage", err, map[string]interface{}{
 				"device_id": manager.DeviceID,
 			})
-			return
+			return nil, err
 		}
 		energyUsage = legacyEnergyUsage
 	} else {
-		ts.logger.Error("Invalid client type for device", nil, map[string]interface{}{
+		err := errors.NewDeviceError("invalid client type for device", nil).WithDevice(manager.DeviceID)
+		ts.logger.Error("Invalid client type for device", err, map[string]interface{}{
 			"device_id": manager.DeviceID,
 		})
-		return
+		return nil, err
 	}
 
 	// Convert to energy reading (handle both device info types)
 	var reading *EnergyReading
 	if manager.UseKlap {
 		klapDeviceInfo := deviceInfo.(*tapo.KlapDeviceInfo)
+		ts.checkFirmware(manager, klapDeviceInfo.FwVersion)
+		ts.recordAliases(manager, klapDeviceInfo.MAC, klapDeviceInfo.DeviceID)
 		klapEnergyUsage := energyUsage.(*tapo.KlapEnergyUsage)
 
 		reading = &EnergyReading{
 			DeviceID:       manager.DeviceID,
+			DeviceUUID:     manager.UUID,
 			DeviceName:     manager.DeviceName,
 			RoomID:         manager.RoomID,
+			Tags:           manager.Tags,
 			PowerW:         float64(klapEnergyUsage.CurrentPower) / 1000.0, // Convert mW to W
 			EnergyWh:       float64(klapEnergyUsage.TodayEnergy),
 			IsOn:           klapDeviceInfo.DeviceOn,
@@ -292,12 +400,16 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 		}
 	} else {
 		legacyDeviceInfo := deviceInfo.(*tapo.TapoDevice)
+		ts.checkFirmware(manager, legacyDeviceInfo.FirmwareVer)
+		ts.recordAliases(manager, legacyDeviceInfo.MACAddress, legacyDeviceInfo.DeviceID)
 		legacyEnergyUsage := energyUsage.(*tapo.EnergyUsage)
 
 		reading = &EnergyReading{
 			DeviceID:       manager.DeviceID,
+			DeviceUUID:     manager.UUID,
 			DeviceName:     manager.DeviceName,
 			RoomID:         manager.RoomID,
+			Tags:           manager.Tags,
 			PowerW:         float64(legacyEnergyUsage.CurrentPowerMw) / 1000.0, // Convert mW to W
 			EnergyWh:       float64(legacyEnergyUsage.TodayEnergyWh),
 			IsOn:           legacyDeviceInfo.IsOn,
@@ -306,9 +418,34 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 		}
 	}
 
-	// Store in time series database
+	// Watch for the end of washer/dryer cycles
+	if manager.cycle != nil {
+		if event := manager.cycle.observe(reading.PowerW, reading.Timestamp); event != nil {
+			ts.emitCycleComplete(manager, event)
+		}
+	}
+
+	// Feed the energy pipeline, e.g. cost tracking
+	ts.mu.RLock()
+	readingCallbacks := ts.readingCallbacks
+	ts.mu.RUnlock()
+	for _, callback := range readingCallbacks {
+		callback(*reading)
+	}
+
+	// Store in time series database, keyed by UUID once the device has been claimed
 	if ts.tsClient != nil {
-		if err := ts.tsClient.WriteEnergyReading(context.Background(), reading.DeviceID, reading.RoomID,
+		seriesID := reading.DeviceID
+		if reading.DeviceUUID != "" {
+			seriesID = reading.DeviceUUID
+			if namer, ok := ts.tsClient.(deviceNamer); ok {
+				namer.SetDeviceName(seriesID, reading.DeviceName)
+			}
+		}
+		if tagger, ok := ts.tsClient.(deviceTagger); ok && len(reading.Tags) > 0 {
+			tagger.SetDeviceTags(seriesID, reading.Tags)
+		}
+		if err := ts.tsClient.WriteEnergyReading(context.Background(), seriesID, reading.RoomID,
 			reading.PowerW, reading.EnergyWh, 0, 0, reading.IsOn, reading.Timestamp); err != nil {
 			ts.logger.Error("Failed to write energy reading to time series database", err, map[string]interface{}{
 				"device_id": manager.DeviceID,
@@ -318,12 +455,14 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 
 	// Publish to MQTT
 	if ts.mqttClient != nil {
-		topic := fmt.Sprintf("tapo/%s/energy", manager.DeviceID)
+		topic := mqtt.TapoEnergyTopic(manager.DeviceID)
 
 		payload := map[string]interface{}{
 			"device_id":       reading.DeviceID,
+			"device_uuid":     reading.DeviceUUID,
 			"device_name":     reading.DeviceName,
 			"room_id":         reading.RoomID,
+			"tags":            reading.Tags,
 			"power_w":         reading.PowerW,
 			"energy_wh":       reading.EnergyWh,
 			"is_on":           reading.IsOn,
@@ -337,15 +476,15 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 			ts.logger.Error("Failed to marshal MQTT payload", err, map[string]interface{}{
 				"device_id": manager.DeviceID,
 			})
-			return
+			return reading, nil
 		}
 
-		message := &mqtt.Message{
+		message := (&mqtt.Message{
 			Topic:   topic,
 			Payload: payloadBytes,
 			QoS:     1,
 			Retain:  false,
-		}
+		}).WithProperty(mqtt.PropertyDevice, manager.DeviceID).WithProperty(mqtt.PropertyRoom, manager.RoomID)
 
 		if err := ts.mqttClient.Publish(message); err != nil {
 			ts.logger.Error("Failed to publish energy data to MQTT", err, map[string]interface{}{
@@ -363,6 +502,7 @@ func (ts *TapoService) pollDevice(manager *TapoDeviceManager) {
 		"energy_wh": reading.EnergyWh,
 		"is_on":     reading.IsOn,
 	})
+	return reading, nil
 }
 
 // SetDeviceState turns a device on or off
@@ -375,27 +515,62 @@ func (ts *TapoService) SetDeviceState(deviceID string, on bool) error {
 		return errors.NewValidationError(fmt.Sprintf("Device %s not found", deviceID), nil)
 	}
 
+	if !ts.safeMode.Allowed(safemode.ComponentTapo, deviceID) {
+		return errors.NewBusinessError(fmt.Sprintf("Safe mode active, device %s state not changed", deviceID), nil)
+	}
+
+	if ts.dryRun.ObserveOnly() {
+		ts.dryRun.Record("tapo", "set_device_on", deviceID, "device state change requested", map[string]interface{}{
+			"state": on,
+		})
+		return nil
+	}
+
+	if ts.commands != nil {
+		action := "turn_off"
+		if on {
+			action = "turn_on"
+		}
+		return ts.commands.Submit(&models.DeviceCommand{DeviceID: deviceID, Action: action})
+	}
+	return ts.setDeviceState(manager, on)
+}
+
+// EnableCommandQueue queues the state changes of plugs that can't be reached, delivering them
+// when the plug reconnects. The queue retries only while it is started.
+func (ts *TapoService) EnableCommandQueue(cfg config.CommandQueueConfig) *CommandQueue {
+	ts.commands = NewCommandQueue(cfg, ts.deliverCommand, ts.logger)
+	return ts.commands
+}
+
+// deliverCommand sets the state a queued turn_on or turn_off command asks for
+func (ts *TapoService) deliverCommand(cmd *models.DeviceCommand) error {
+	ts.mu.RLock()
+	manager, exists := ts.devices[cmd.DeviceID]
+	ts.mu.RUnlock()
+
+	if !exists {
+		return errors.NewValidationError(fmt.Sprintf("Device %s not found", cmd.DeviceID), nil)
+	}
+	return ts.setDeviceState(manager, cmd.Action == "turn_on")
+}
+
+// setDeviceState turns a device on or off, connecting to it first if needed
+func (ts *TapoService) setDeviceState(manager *TapoDeviceManager, on bool) error {
+	deviceID := manager.DeviceID
 	if !manager.IsConnected {
-		if manager.UseKlap && manager.KlapClient != nil {
-			ctx := context.Background()
-			if err := manager.KlapClient.Connect(ctx); err != nil {
-				return errors.NewDeviceError("Failed to connect to device via KLAP", err)
-			}
-		} else if client, ok := manager.Client.(*tapo.TapoClient); ok {
-			if err := client.Connect(); err != nil {
-				return errors.NewDeviceError("Failed to connect to device", err)
-			}
-		} else {
-			return errors.NewDeviceError("Invalid client type for device", nil)
+		if err := ts.connect(manager); err != nil {
+			return errors.NewDeviceError("Failed to connect to device", err)
 		}
-		manager.IsConnected = true
 	}
 
 	// Set device state based on client type
 	if manager.UseKlap && manager.KlapClient != nil {
-		// KLAP protocol doesn't have SetDeviceOn implemented yet
-		// For now, we'll return an error indicating this feature is not available
-		return errors.NewBusinessError("SetDeviceOn not implemented for KLAP protocol", nil)
+		ctx := context.Background()
+		if err := manager.KlapClient.SetDeviceOn(ctx, on); err != nil {
+			manager.IsConnected = false
+			return errors.NewDeviceError("Failed to set device state via KLAP", err)
+		}
 	} else if client, ok := manager.Client.(*tapo.TapoClient); ok {
 		if err := client.SetDeviceOn(on); err != nil {
 			manager.IsConnected = false
@@ -413,6 +588,305 @@ func (ts *TapoService) SetDeviceState(deviceID string, on bool) error {
 	return nil
 }
 
+// connect establishes a session with the device. In auto mode the remembered protocol is
+// tried first, then KLAP, then legacy; whichever works is remembered for the next start.
+func (ts *TapoService) connect(manager *TapoDeviceManager) error {
+	var lastErr error
+
+	for _, protocol := range ts.protocolOrder(manager) {
+		if err := ts.connectWith(manager, protocol); err != nil {
+			lastErr = err
+			ts.logger.Debug("Tapo protocol attempt failed", map[string]interface{}{
+				"device_id": manager.DeviceID,
+				"protocol":  string(protocol),
+				"error":     err.Error(),
+			})
+			continue
+		}
+
+		manager.IsConnected = true
+
+		record, exists := ts.protocols.Get(manager.DeviceID)
+		if !exists || record.Protocol != protocol {
+			if exists {
+				ts.logger.Info("Tapo device switched protocol", map[string]interface{}{
+					"device_id":     manager.DeviceID,
+					"from_protocol": string(record.Protocol),
+					"to_protocol":   string(protocol),
+				})
+			}
+			if err := ts.protocols.Remember(manager.DeviceID, protocol, ""); err != nil {
+				ts.logger.Error("Failed to remember Tapo protocol", err, map[string]interface{}{
+					"device_id": manager.DeviceID,
+				})
+			}
+		}
+
+		return nil
+	}
+
+	return lastErr
+}
+
+// protocolOrder returns the protocols to try for a device, most likely first
+func (ts *TapoService) protocolOrder(manager *TapoDeviceManager) []tapo.Protocol {
+	if manager.Protocol == tapo.ProtocolKlap || manager.Protocol == tapo.ProtocolLegacy {
+		return []tapo.Protocol{manager.Protocol}
+	}
+
+	if record, exists := ts.protocols.Get(manager.DeviceID); exists && record.Protocol == tapo.ProtocolLegacy {
+		return []tapo.Protocol{tapo.ProtocolLegacy, tapo.ProtocolKlap}
+	}
+
+	return []tapo.Protocol{tapo.ProtocolKlap, tapo.ProtocolLegacy}
+}
+
+// connectWith connects to a device using a single protocol
+func (ts *TapoService) connectWith(manager *TapoDeviceManager, protocol tapo.Protocol) error {
+	if protocol == tapo.ProtocolKlap {
+		if manager.KlapClient == nil {
+			manager.KlapClient = tapo.NewKlapClient(manager.IPAddress, manager.Username, manager.Password.Reveal(), 30*time.Second, *ts.logger)
+		}
+		if err := manager.KlapClient.Connect(context.Background()); err != nil {
+			return errors.NewDeviceError("Failed to connect using KLAP", err)
+		}
+		manager.UseKlap = true
+		return nil
+	}
+
+	client, ok := manager.Client.(*tapo.TapoClient)
+	if !ok {
+		client = tapo.NewTapoClient(manager.IPAddress, manager.Username, manager.Password.Reveal(), ts.logger)
+		manager.Client = client
+	}
+	if err := client.Connect(); err != nil {
+		return errors.NewDeviceError("Failed to connect using legacy protocol", err)
+	}
+	manager.UseKlap = false
+	return nil
+}
+
+// checkFirmware records the firmware version of a device. After a firmware update the
+// remembered protocol is dropped and the device is re-probed on the next poll.
+func (ts *TapoService) checkFirmware(manager *TapoDeviceManager, firmwareVersion string) {
+	if firmwareVersion == "" {
+		return
+	}
+
+	record, exists := ts.protocols.Get(manager.DeviceID)
+	if !exists || record.FirmwareVersion == firmwareVersion {
+		return
+	}
+
+	if record.FirmwareVersion == "" {
+		if err := ts.protocols.Remember(manager.DeviceID, record.Protocol, firmwareVersion); err != nil {
+			ts.logger.Error("Failed to remember Tapo firmware version", err, map[string]interface{}{
+				"device_id": manager.DeviceID,
+			})
+		}
+		return
+	}
+
+	ts.logger.Info("Tapo firmware changed, re-probing protocol", map[string]interface{}{
+		"device_id":    manager.DeviceID,
+		"old_firmware": record.FirmwareVersion,
+		"new_firmware": firmwareVersion,
+	})
+
+	if err := ts.protocols.Forget(manager.DeviceID); err != nil {
+		ts.logger.Error("Failed to forget Tapo protocol", err, map[string]interface{}{
+			"device_id": manager.DeviceID,
+		})
+	}
+	manager.IsConnected = false
+}
+
+// SetProtocolCache replaces the in-memory protocol cache, e.g. with one persisted in the state directory
+func (ts *TapoService) SetProtocolCache(cache *tapo.ProtocolCache) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.protocols = cache
+}
+
+// AddCycleCallback registers a callback for completed appliance cycles
+func (ts *TapoService) AddCycleCallback(callback func(event CycleEvent)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.cycleCallbacks = append(ts.cycleCallbacks, callback)
+}
+
+// AddReadingCallback registers a callback for every energy reading, called from the polling goroutine
+func (ts *TapoService) AddReadingCallback(callback func(reading EnergyReading)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.readingCallbacks = append(ts.readingCallbacks, callback)
+}
+
+// emitCycleComplete publishes a completed appliance cycle on MQTT and to the callbacks
+func (ts *TapoService) emitCycleComplete(manager *TapoDeviceManager, event *CycleEvent) {
+	event.DeviceID = manager.DeviceID
+	event.DeviceUUID = manager.UUID
+	event.DeviceName = manager.DeviceName
+	event.RoomID = manager.RoomID
+
+	ts.logger.Info("Appliance cycle complete", map[string]interface{}{
+		"device_id":    manager.DeviceID,
+		"device_uuid":  manager.UUID,
+		"duration":     event.Duration.String(),
+		"peak_power_w": event.PeakPowerW,
+		"energy_wh":    event.EnergyWh,
+	})
+
+	if ts.mqttClient != nil {
+		payload, err := json.Marshal(map[string]interface{}{
+			"event":        "cycle_complete",
+			"device_id":    event.DeviceID,
+			"device_uuid":  event.DeviceUUID,
+			"device_name":  event.DeviceName,
+			"room_id":      event.RoomID,
+			"started_at":   event.StartedAt.Unix(),
+			"completed_at": event.CompletedAt.Unix(),
+			"duration_s":   int(event.Duration.Seconds()),
+			"peak_power_w": event.PeakPowerW,
+			"energy_wh":    event.EnergyWh,
+		})
+		if err == nil {
+			topic := mqtt.TapoCycleTopic(manager.DeviceID)
+			if err := ts.mqttClient.Publish(&mqtt.Message{Topic: topic, Payload: payload, QoS: 1}); err != nil {
+				ts.logger.Error("Failed to publish cycle event to MQTT", err, map[string]interface{}{
+					"device_id": manager.DeviceID,
+					"topic":     topic,
+				})
+			}
+		}
+
+		name := event.DeviceName
+		if name == "" {
+			name = event.DeviceID
+		}
+		notification, err := localizedNotification(map[string]interface{}{
+			"source":    "tapo",
+			"device_id": event.DeviceID,
+			"room_id":   event.RoomID,
+			"timestamp": event.CompletedAt.Unix(),
+		}, i18n.T("cycle.finished.title", name), i18n.T("cycle.finished", name, event.Duration.Round(time.Minute)))
+		if err == nil {
+			if err := ts.mqttClient.Publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1}); err != nil {
+				ts.logger.Error("Failed to publish cycle notification", err, map[string]interface{}{
+					"device_id": manager.DeviceID,
+				})
+			}
+		}
+	}
+
+	ts.mu.RLock()
+	callbacks := append([]func(CycleEvent){}, ts.cycleCallbacks...)
+	ts.mu.RUnlock()
+
+	for _, callback := range callbacks {
+		go callback(*event)
+	}
+}
+
+// SetIdentityRegistry assigns stable UUIDs to devices and maps their MAC and vendor IDs
+func (ts *TapoService) SetIdentityRegistry(registry *identity.Registry) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.identities = registry
+
+	for _, manager := range ts.devices {
+		if err := ts.claimIdentity(manager); err != nil {
+			ts.logger.Error("Failed to claim device identity", err, map[string]interface{}{
+				"device_id": manager.DeviceID,
+			})
+		}
+	}
+}
+
+// claimIdentity assigns the device its stable UUID; callers must hold the lock
+func (ts *TapoService) claimIdentity(manager *TapoDeviceManager) error {
+	if ts.identities == nil {
+		return nil
+	}
+
+	claimed, err := ts.identities.Claim(manager.DeviceName,
+		identity.NewAlias(identity.AliasDeviceID, manager.DeviceID),
+		identity.NewAlias(identity.AliasIP, manager.IPAddress))
+	if err != nil {
+		return err
+	}
+
+	manager.UUID = claimed.UUID
+	return nil
+}
+
+// recordAliases maps the MAC and vendor ID reported by a device to its UUID
+func (ts *TapoService) recordAliases(manager *TapoDeviceManager, mac, vendorID string) {
+	if ts.identities == nil || manager.UUID == "" {
+		return
+	}
+
+	for _, alias := range []identity.Alias{
+		identity.NewAlias(identity.AliasMAC, mac),
+		identity.NewAlias(identity.AliasVendorID, vendorID),
+	} {
+		if alias.Value == "" {
+			continue
+		}
+		if uuid, exists := ts.identities.Resolve(alias); exists && uuid == manager.UUID {
+			continue
+		}
+		if err := ts.identities.AddAlias(manager.UUID, alias); err != nil {
+			ts.logger.Error("Failed to record device alias", err, map[string]interface{}{
+				"device_id":   manager.DeviceID,
+				"device_uuid": manager.UUID,
+				"alias_kind":  string(alias.Kind),
+			})
+		}
+	}
+}
+
+// SetSafeMode attaches a safe mode controller that blocks switching plugs
+func (ts *TapoService) SetSafeMode(controller *safemode.Controller) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.safeMode = controller
+}
+
+// SetDryRunRecorder attaches a recorder that traces switching in observe-only mode
+func (ts *TapoService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.dryRun = recorder
+}
+
+// HealthCheck fails while the service isn't polling its devices; it fits utils.HealthChecker
+func (ts *TapoService) HealthCheck() error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if !ts.running {
+		return errors.NewServiceError("tapo service is not running", nil)
+	}
+	return nil
+}
+
+// DeviceHealthCheck fails while any device is disconnected, naming them
+func (ts *TapoService) DeviceHealthCheck() error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	var offline []string
+	for deviceID, manager := range ts.devices {
+		if !manager.IsConnected {
+			offline = append(offline, deviceID)
+		}
+	}
+	if len(offline) > 0 {
+		sort.Strings(offline)
+		return errors.NewDeviceError(fmt.Sprintf("%d of %d tapo devices offline: %s", len(offline), len(ts.devices), strings.Join(offline, ", ")), nil)
+	}
+	return nil
+}
+
 // GetDeviceStatus returns the current status of all devices
 func (ts *TapoService) GetDeviceStatus() map[string]interface{} {
 	ts.mu.RLock()
@@ -421,10 +895,13 @@ func (ts *TapoService) GetDeviceStatus() map[string]interface{} {
 	status := make(map[string]interface{})
 	for deviceID, manager := range ts.devices {
 		status[deviceID] = map[string]interface{}{
+			"device_uuid":   manager.UUID,
 			"device_name":   manager.DeviceName,
 			"room_id":       manager.RoomID,
+			"tags":          manager.Tags,
 			"ip_address":    manager.IPAddress,
 			"is_connected":  manager.IsConnected,
+			"use_klap":      manager.UseKlap,
 			"last_reading":  manager.LastReading,
 			"poll_interval": manager.PollInterval.String(),
 		}
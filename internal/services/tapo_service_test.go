@@ -1,10 +1,19 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/identity"
 	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/tapo"
 )
 
 func TestNewTapoService(t *testing.T) {
@@ -26,8 +35,8 @@ func TestNewTapoService(t *testing.T) {
 		t.Error("Service logger is nil")
 	}
 
-	if service.stopChan == nil {
-		t.Error("Service stop channel is nil")
+	if service.running {
+		t.Error("Service monitors devices before Start")
 	}
 }
 
@@ -129,3 +138,234 @@ func TestEnergyReading(t *testing.T) {
 		t.Errorf("Expected energy to be 1000Wh, got %f", reading.EnergyWh)
 	}
 }
+
+// newLegacyTapoDevice starts a fake device that only speaks the legacy protocol
+func newLegacyTapoDevice(t *testing.T, firmware *string) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app" {
+			http.NotFound(w, r) // No KLAP handshake endpoints
+			return
+		}
+
+		var request tapo.LoginRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		response := tapo.TapoResponse{}
+		switch request.Method {
+		case "login_device":
+			response.Result = map[string]interface{}{"token": "legacy-token"}
+		case "get_device_info":
+			response.Result = map[string]interface{}{"device_on": true, "fw_ver": *firmware, "mac": "AA-BB-CC-DD-EE-01", "device_id": "8022VENDOR01"}
+		case "get_energy_usage":
+			response.Result = map[string]interface{}{"current_power": 5000}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestAddDeviceFallsBackToLegacy(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+	cachePath := filepath.Join(t.TempDir(), tapo.ProtocolCacheFileName)
+
+	cache, err := tapo.NewProtocolCache(cachePath)
+	if err != nil {
+		t.Fatalf("NewProtocolCache failed: %v", err)
+	}
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	service.SetProtocolCache(cache)
+
+	// UseKlap is a wrong guess; the service must detect the legacy protocol itself
+	if err := service.AddDevice(&TapoConfig{DeviceID: "lamp", IPAddress: host, UseKlap: true}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	manager := service.devices["lamp"]
+	if manager.UseKlap {
+		t.Error("Expected legacy protocol to be selected after KLAP failed")
+	}
+
+	record, exists := cache.Get("lamp")
+	if !exists || record.Protocol != tapo.ProtocolLegacy {
+		t.Fatalf("Expected legacy protocol to be remembered, got %+v", record)
+	}
+
+	// The first poll records the firmware version
+	service.pollDevice(manager)
+	if record, _ := cache.Get("lamp"); record.FirmwareVersion != "1.0.3" {
+		t.Errorf("Expected firmware 1.0.3 to be remembered, got %q", record.FirmwareVersion)
+	}
+
+	// A firmware update drops the remembered protocol so the device is re-probed
+	firmware = "1.1.0"
+	service.pollDevice(manager)
+	if _, exists := cache.Get("lamp"); exists {
+		t.Error("Expected protocol to be forgotten after a firmware update")
+	}
+	if manager.IsConnected {
+		t.Error("Expected device to reconnect after a firmware update")
+	}
+
+	service.pollDevice(manager)
+	if record, exists := cache.Get("lamp"); !exists || record.Protocol != tapo.ProtocolLegacy {
+		t.Errorf("Expected legacy protocol to be re-detected, got %+v", record)
+	}
+}
+
+func TestAddDeviceForcedProtocolDoesNotFallBack(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	err := service.AddDevice(&TapoConfig{DeviceID: "lamp", IPAddress: host, Protocol: tapo.ProtocolKlap})
+	if err == nil {
+		t.Error("Expected forced KLAP protocol to fail against a legacy device")
+	}
+}
+
+func TestPollOnceReportsEveryDevice(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	if err := service.AddDevice(&TapoConfig{DeviceID: "lamp", DeviceName: "Desk Lamp", IPAddress: host}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	service.devices["broken"] = &TapoDeviceManager{DeviceID: "broken", IPAddress: "127.0.0.1:1", Protocol: tapo.ProtocolLegacy}
+
+	results := service.PollOnce()
+	if len(results) != 2 {
+		t.Fatalf("Expected a result per device, got %+v", results)
+	}
+	if results[0].DeviceID != "broken" || results[0].Error == "" || results[0].Reading != nil {
+		t.Errorf("Expected the unreachable device to report an error, got %+v", results[0])
+	}
+	if results[1].DeviceID != "lamp" || results[1].Error != "" || results[1].Reading == nil || results[1].Reading.PowerW != 5 {
+		t.Errorf("Expected a 5W reading from the lamp, got %+v", results[1])
+	}
+}
+
+func TestTapoServiceStopsMonitors(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	if err := service.AddDevice(&TapoConfig{DeviceID: "lamp", IPAddress: host, PollInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if err := service.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Devices added while running are monitored and stopped too
+	if err := service.AddDevice(&TapoConfig{DeviceID: "heater", IPAddress: host, PollInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if err := service.HealthCheck(); err != nil {
+		t.Errorf("Expected the service healthy while running, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := service.Stop(ctx); err != nil {
+		t.Fatalf("Expected the monitors to stop, got %v", err)
+	}
+	if err := service.HealthCheck(); err == nil {
+		t.Error("Expected the health check to fail once stopped")
+	}
+	if err := service.Start(context.Background()); err != nil {
+		t.Errorf("Expected a stopped service to start again, got %v", err)
+	}
+	service.Stop(ctx)
+}
+
+func TestSetDeviceStateQueuedUntilReconnect(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	if err := service.AddDevice(&TapoConfig{DeviceID: "heater", IPAddress: host}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	queue := service.EnableCommandQueue(config.CommandQueueConfig{MaxDelay: time.Hour})
+	if err := queue.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop(context.Background())
+
+	// Moving the plug's address makes the next connect use new clients for it
+	manager := service.devices["heater"]
+	moveTo := func(ipAddress string) {
+		manager.IPAddress = ipAddress
+		manager.Client, manager.KlapClient = nil, nil
+		manager.IsConnected = false
+	}
+
+	// The plug drops off the network
+	moveTo("127.0.0.1:1")
+	if err := service.SetDeviceState("heater", false); err == nil || !strings.Contains(err.Error(), "queued") {
+		t.Fatalf("Expected the state change queued, got %v", err)
+	}
+
+	// It comes back and the next poll reconnects, delivering the command without waiting out its backoff
+	moveTo(host)
+	if _, err := service.pollDevice(manager); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Stats().Delivered == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := queue.Stats(); stats.Delivered != 1 || len(queue.Pending()) != 0 {
+		t.Errorf("Expected the queued command delivered on reconnect, got %+v", stats)
+	}
+}
+
+func TestAddDeviceClaimsStableUUID(t *testing.T) {
+	firmware := "1.0.3"
+	host := newLegacyTapoDevice(t, &firmware)
+
+	registry, err := identity.NewRegistry("")
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+
+	service := NewTapoService(nil, nil, logger.NewLogger("test-tapo-service", nil))
+	service.SetIdentityRegistry(registry)
+
+	if err := service.AddDevice(&TapoConfig{DeviceID: "lamp", DeviceName: "Desk Lamp", IPAddress: host}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	manager := service.devices["lamp"]
+	if manager.UUID == "" {
+		t.Fatal("Expected the device to be assigned a UUID")
+	}
+
+	// Polling maps the MAC and vendor ID reported by the device to the same UUID
+	service.pollDevice(manager)
+	for _, alias := range []identity.Alias{
+		identity.NewAlias(identity.AliasMAC, "aa:bb:cc:dd:ee:01"),
+		identity.NewAlias(identity.AliasVendorID, "8022VENDOR01"),
+	} {
+		if uuid, exists := registry.Resolve(alias); !exists || uuid != manager.UUID {
+			t.Errorf("Expected %s alias to resolve to %s, got %q", alias.Kind, manager.UUID, uuid)
+		}
+	}
+
+	// Re-adding the device under the same ID keeps its UUID
+	previous := manager.UUID
+	service.RemoveDevice("lamp")
+	if err := service.AddDevice(&TapoConfig{DeviceID: "lamp", IPAddress: host}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if service.devices["lamp"].UUID != previous {
+		t.Errorf("Expected UUID %s to be kept, got %s", previous, service.devices["lamp"].UUID)
+	}
+}
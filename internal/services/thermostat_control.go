@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// ThermostatControlFileName holds the learned thermal response of each room
+const ThermostatControlFileName = "thermostat-control.json"
+
+// ThermostatControlPath returns the learned thermal response file path for a state directory
+func ThermostatControlPath(stateDir string) string {
+	return filepath.Join(stateDir, ThermostatControlFileName)
+}
+
+// LoadThermostatControl reads the PID control settings of each thermostat, keyed by thermostat ID
+func LoadThermostatControl(path string) (map[string]models.PIDSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read thermostat control file", err)
+	}
+
+	var settings map[string]models.PIDSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, errors.NewConfigError("failed to parse thermostat control file", err)
+	}
+
+	for id, entry := range settings {
+		if err := entry.Validate(); err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("thermostat %s", id), err)
+		}
+	}
+	return settings, nil
+}
+
+// SetControlStatePath loads the room responses learned before and keeps saving them to path
+func (ts *ThermostatService) SetControlStatePath(path string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.controlPath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read learned thermal responses", err)
+	}
+
+	learned := make(map[string]models.ThermalResponse)
+	if err := json.Unmarshal(data, &learned); err != nil {
+		return errors.NewSystemError("failed to parse learned thermal responses", err)
+	}
+	ts.learnedMu.Lock()
+	ts.learned = learned
+	ts.learnedMu.Unlock()
+	for id, thermostat := range ts.thermostats {
+		if thermostat.Control != nil && thermostat.Control.Learned.Samples == 0 {
+			thermostat.Control.Learned = learned[id]
+		}
+	}
+	return nil
+}
+
+// SetControl switches a thermostat's heat calls from the hysteresis band to PID control. It
+// applies to a thermostat created later for the same room too.
+func (ts *ThermostatService) SetControl(id string, settings models.PIDSettings) error {
+	if err := settings.Validate(); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid PID control for thermostat %s", id), err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.controls[id] = &settings
+	if thermostat, exists := ts.thermostats[id]; exists {
+		thermostat.Control = nil
+		ts.attachControl(thermostat)
+	}
+
+	kp, ki, kd := models.NewPIDControl(settings, ts.learnedResponse(id)).Gains()
+	ts.logger.Info("Set PID thermostat control", map[string]interface{}{
+		"thermostat_id": id,
+		"kp":            kp,
+		"ki":            ki,
+		"kd":            kd,
+		"auto_tune":     settings.AutoTune,
+		"radiant_floor": settings.Radiant(),
+	})
+	return nil
+}
+
+// attachControl gives a thermostat its PID control, if configured; callers must hold the lock
+func (ts *ThermostatService) attachControl(thermostat *models.Thermostat) {
+	if settings, ok := ts.controls[thermostat.ID]; ok {
+		thermostat.Control = models.NewPIDControl(*settings, ts.learnedResponse(thermostat.ID))
+	}
+}
+
+func (ts *ThermostatService) learnedResponse(id string) models.ThermalResponse {
+	ts.learnedMu.Lock()
+	defer ts.learnedMu.Unlock()
+	return ts.learned[id]
+}
+
+// saveLearned records a thermostat's newly learned room response
+func (ts *ThermostatService) saveLearned(thermostat *models.Thermostat) {
+	ts.learnedMu.Lock()
+	defer ts.learnedMu.Unlock()
+
+	ts.learned[thermostat.ID] = thermostat.Control.Learned
+	kp, ki, kd := thermostat.Control.Gains()
+	ts.logger.Info("Learned room thermal response", map[string]interface{}{
+		"thermostat_id":     thermostat.ID,
+		"heating_rate":      thermostat.Control.Learned.HeatingRate,
+		"dead_time_minutes": thermostat.Control.Learned.DeadTimeMinutes,
+		"samples":           thermostat.Control.Learned.Samples,
+		"kp":                kp,
+		"ki":                ki,
+		"kd":                kd,
+	})
+	if ts.controlPath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(ts.learned, "", "  ")
+	if err != nil {
+		ts.logger.Error("Failed to marshal learned thermal responses", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(ts.controlPath), 0755); err != nil {
+		ts.logger.Error("Failed to create state directory", err)
+		return
+	}
+	tmpPath := ts.controlPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		ts.logger.Error("Failed to write learned thermal responses", err)
+		return
+	}
+	if err := os.Rename(tmpPath, ts.controlPath); err != nil {
+		ts.logger.Error("Failed to replace learned thermal responses", err)
+	}
+}
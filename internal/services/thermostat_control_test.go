@@ -0,0 +1,66 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestThermostatControlLearnsAndPersists(t *testing.T) {
+	dir := t.TempDir()
+	controlFile := filepath.Join(dir, "control.json")
+	if err := os.WriteFile(controlFile, []byte(`{"living-room": {"auto_tune": true}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := LoadThermostatControl(controlFile)
+	if err != nil {
+		t.Fatalf("LoadThermostatControl failed: %v", err)
+	}
+
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	thermostats := NewThermostatService(mqttClient, logger.NewLogger("control-test", nil))
+	statePath := ThermostatControlPath(dir)
+	if err := thermostats.SetControlStatePath(statePath); err != nil {
+		t.Fatalf("SetControlStatePath failed: %v", err)
+	}
+	if err := thermostats.SetControl("living-room", settings["living-room"]); err != nil {
+		t.Fatalf("SetControl failed: %v", err)
+	}
+	if err := thermostats.SetControl("bedroom", models.PIDSettings{Ki: 1}); err == nil {
+		t.Error("Expected ki without kp to be rejected")
+	}
+
+	// Control applies to the thermostat created for the room later
+	thermostat := &models.Thermostat{ID: "living-room", RoomID: "living-room", Mode: models.ModeHeat, TargetTemp: 70, HeatingEnabled: true}
+	thermostats.RegisterThermostat(thermostat)
+	if thermostat.Control == nil {
+		t.Fatal("Expected PID control attached on registration")
+	}
+
+	start := time.Now()
+	thermostat.Status = models.StatusHeating
+	thermostat.CurrentTemp = 66
+	thermostat.UpdateControl(start)
+	thermostat.CurrentTemp = 66.5
+	thermostat.UpdateControl(start.Add(8 * time.Minute))
+	thermostat.CurrentTemp = 68.5
+	thermostat.Status = models.StatusIdle
+	if !thermostat.UpdateControl(start.Add(28 * time.Minute)) {
+		t.Fatal("Expected the heating run to be learned")
+	}
+	thermostats.saveLearned(thermostat)
+
+	restarted := NewThermostatService(mqttClient, logger.NewLogger("control-test", nil))
+	if err := restarted.SetControlStatePath(statePath); err != nil {
+		t.Fatalf("SetControlStatePath failed: %v", err)
+	}
+	if learned := restarted.learnedResponse("living-room"); learned.Samples != 1 || learned.DeadTimeMinutes != 8 {
+		t.Errorf("Expected the learned response to survive a restart, got %+v", learned)
+	}
+}
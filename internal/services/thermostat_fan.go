@@ -0,0 +1,130 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// SetFan changes when and how fast a thermostat runs its blower, and tells the thermostat. It
+// applies to a thermostat created later for the same room too.
+func (ts *ThermostatService) SetFan(id string, settings models.FanSettings) error {
+	if err := settings.Validate(); err != nil {
+		return errors.NewValidationError(fmt.Sprintf("invalid fan settings for thermostat %s", id), err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	merged := ts.fans[id]
+	if settings.Mode != "" {
+		merged.Mode = settings.Mode
+	}
+	if settings.CirculateMinutes > 0 {
+		merged.CirculateMinutes = settings.CirculateMinutes
+	}
+	if settings.Speed != nil {
+		merged.Speed = settings.Speed
+	}
+	ts.fans[id] = merged
+
+	ts.logger.Info("Set thermostat fan", map[string]interface{}{
+		"thermostat_id":     id,
+		"fan_mode":          merged.Mode,
+		"circulate_minutes": merged.CirculateMinutes,
+	})
+
+	thermostat, exists := ts.thermostats[id]
+	if !exists {
+		return nil
+	}
+	applyFan(thermostat, merged)
+
+	if settings.Mode != "" || settings.CirculateMinutes > 0 {
+		ts.publishThermostatCommand(id, models.CmdSetFanMode, map[string]interface{}{
+			"mode":              fanMode(thermostat),
+			"circulate_minutes": thermostat.CirculateMinutes,
+		})
+	}
+	if settings.Speed != nil {
+		ts.publishThermostatCommand(id, models.CmdSetFanSpeed, *settings.Speed)
+	}
+
+	// Start or stop the blower now rather than on the next control cycle
+	ts.processThermostat(thermostat)
+	return nil
+}
+
+// applyFan copies the set fields of settings to a thermostat
+func applyFan(thermostat *models.Thermostat, settings models.FanSettings) {
+	if settings.Mode != "" {
+		thermostat.FanMode = settings.Mode
+	}
+	if settings.CirculateMinutes > 0 {
+		thermostat.CirculateMinutes = settings.CirculateMinutes
+	}
+	if settings.Speed != nil {
+		thermostat.FanSpeed = *settings.Speed
+	}
+}
+
+// fanMode is the fan mode of a thermostat, auto when it has none
+func fanMode(thermostat *models.Thermostat) models.FanMode {
+	if thermostat.FanMode == "" {
+		return models.FanAuto
+	}
+	return thermostat.FanMode
+}
+
+// handleFanMessage changes the fan of the thermostat of a thermostat/<id>/fan message, whose
+// payload is fan settings or just the mode, e.g. circulate
+func (ts *ThermostatService) handleFanMessage(topic string, payload []byte) error {
+	var settings models.FanSettings
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal(payload, &settings); err != nil {
+			return errors.NewValidationError("invalid thermostat fan settings", err)
+		}
+	} else {
+		settings.Mode = models.FanMode(strings.Trim(text, `"`))
+	}
+	return ts.SetFan(topicThermostat(topic), settings)
+}
+
+// FanHandler changes the fan of ?thermostat= on POST, with fan settings as the body
+func (ts *ThermostatService) FanHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to set the fan", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var settings models.FanSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "invalid fan settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := r.URL.Query().Get("thermostat")
+		if id == "" {
+			http.Error(w, "thermostat is required", http.StatusBadRequest)
+			return
+		}
+		if err := ts.SetFan(id, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ts.mu.RLock()
+		settings = ts.fans[id]
+		ts.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"thermostat_id": id,
+			"fan":           settings,
+		})
+	})
+}
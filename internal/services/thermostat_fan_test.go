@@ -0,0 +1,62 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestThermostatFan(t *testing.T) {
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	thermostats := NewThermostatService(mqttClient, logger.NewLogger("fan-test", nil))
+
+	// Settings for a room without a thermostat yet apply when it is created
+	if err := thermostats.handleFanMessage(mqtt.ThermostatFanTopic("bedroom"), []byte("circulate")); err != nil {
+		t.Fatalf("Expected a bare mode to be accepted, got %v", err)
+	}
+	thermostats.HandleTemperatureUpdate("bedroom", 70)
+	bedroom, _ := thermostats.GetThermostat("bedroom")
+	if bedroom.FanMode != models.FanCirculate {
+		t.Errorf("Expected circulate on the new thermostat, got %q", bedroom.FanMode)
+	}
+
+	thermostat := &models.Thermostat{
+		ID: "office", RoomID: "office", Mode: models.ModeOff, TargetTemp: 70, CurrentTemp: 70,
+		LastSensorUpdate: time.Now(),
+	}
+	thermostats.RegisterThermostat(thermostat)
+	speed := 30
+	if err := thermostats.SetFan("office", models.FanSettings{Mode: models.FanOn, Speed: &speed}); err != nil {
+		t.Fatalf("SetFan failed: %v", err)
+	}
+	if !thermostat.Fan || thermostat.Status != models.StatusFan || thermostat.FanSpeed != 30 {
+		t.Errorf("Expected the blower to start at once at speed 30, got %+v", thermostat)
+	}
+
+	// Speed alone keeps the mode
+	err := thermostats.handleFanMessage(mqtt.ThermostatFanTopic("office"), []byte(`{"speed": 60}`))
+	if err != nil || thermostat.FanMode != models.FanOn || thermostat.FanSpeed != 60 {
+		t.Errorf("Expected the speed to change alone, got %v %+v", err, thermostat)
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/thermostats/fan?thermostat=office", strings.NewReader(`{"mode": "auto"}`))
+	thermostats.FanHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || thermostat.Fan || thermostat.Status != models.StatusIdle {
+		t.Errorf("Expected auto to stop the blower of an idle system, got %d %+v", recorder.Code, thermostat)
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "/api/thermostats/fan?thermostat=office", strings.NewReader(`{"mode": "high"}`))
+	thermostats.FanHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown mode to return 400, got %d", recorder.Code)
+	}
+}
@@ -1,19 +1,30 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/dryrun"
 	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
 	"github.com/johnpr01/home-automation/internal/logger"
 	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/internal/tracing"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 	"github.com/johnpr01/home-automation/pkg/utils"
 )
 
+// controlCommandExpiry drops HVAC control commands the broker couldn't deliver in time (MQTT v5);
+// the control loop sends a fresh one every 30 seconds
+const controlCommandExpiry = 2 * time.Minute
+
 // ThermostatService manages smart thermostats and processes sensor data
 type ThermostatService struct {
 	thermostats  map[string]*models.Thermostat
@@ -21,12 +32,52 @@ type ThermostatService struct {
 	mu           sync.RWMutex
 	logger       *logger.Logger
 	errorHandler *errors.ErrorHandler
+	safeMode     *safemode.Controller
+	dryRun       *dryrun.Recorder
+	equipment    map[string]*models.HVACEquipment // Per thermostat ID, also for rooms not seen yet
+	controls     map[string]*models.PIDSettings   // PID control per thermostat ID, likewise
+	humidity     map[string]*models.HumiditySetpoint // Humidity range per thermostat ID, likewise
+	fans         map[string]models.FanSettings // Fan mode and speed per thermostat ID, likewise
+	learned      map[string]models.ThermalResponse
+	learnedMu    sync.Mutex // Guards learned; the control path may run without the service lock
+	controlPath  string // Persists the learned room responses; empty keeps them in memory
+	weather      WeatherAdvisor
+	condensation CondensationAdvisor
+	zoning       ZoneCoordinator
+	background   lifecycle.Background // Runs the control loop between Start and Stop
+
+	statusCallbacks []func(models.Thermostat)
+}
+
+// WeatherAdvisor adjusts thermostats to the outdoor forecast; WeatherService implements it
+type WeatherAdvisor interface {
+	Adjustment(thermostat models.Thermostat, now time.Time) *models.WeatherAdjustment
+	// OutdoorRoom is the virtual room of the outdoor sensors, which gets no thermostat
+	OutdoorRoom() string
+	// OutdoorTemperature is the current outdoor temperature, fed forward by radiant floor control
+	OutdoorTemperature(now time.Time) (float64, bool)
+}
+
+// CondensationAdvisor guards cooling in humid rooms; CondensationGuardService implements it
+type CondensationAdvisor interface {
+	Adjustment(thermostat models.Thermostat, now time.Time) *models.CondensationAdjustment
+}
+
+// ZoneCoordinator shares one HVAC system between the thermostats of its zones; ZoneController
+// implements it
+type ZoneCoordinator interface {
+	Coordinate(thermostat models.Thermostat, call models.HVACCall, now time.Time) models.HVACCall
 }
 
 // NewThermostatService creates a new thermostat service
 func NewThermostatService(mqttClient *mqtt.Client, serviceLogger *logger.Logger) *ThermostatService {
 	service := &ThermostatService{
 		thermostats:  make(map[string]*models.Thermostat),
+		equipment:    make(map[string]*models.HVACEquipment),
+		controls:     make(map[string]*models.PIDSettings),
+		humidity:     make(map[string]*models.HumiditySetpoint),
+		fans:         make(map[string]models.FanSettings),
+		learned:      make(map[string]models.ThermalResponse),
 		mqttClient:   mqttClient,
 		logger:       serviceLogger,
 		errorHandler: errors.NewErrorHandler("thermostat-service"),
@@ -35,19 +86,40 @@ func NewThermostatService(mqttClient *mqtt.Client, serviceLogger *logger.Logger)
 	// Subscribe to sensor topics
 	service.subscribeSensorTopics()
 
-	// Start control loop
-	go service.controlLoop()
-
 	return service
 }
 
+// Start starts the control loop, which evaluates every thermostat every 30 seconds until Stop
+func (ts *ThermostatService) Start(ctx context.Context) error {
+	return ts.background.Start(ctx, ts.controlLoop)
+}
+
+// Stop stops the control loop, waiting for a cycle in progress to finish
+func (ts *ThermostatService) Stop(ctx context.Context) error {
+	return ts.background.Stop(ctx)
+}
+
 // HandleTemperatureUpdate handles temperature updates from unified sensor service
 func (ts *ThermostatService) HandleTemperatureUpdate(roomID string, temperature float64) {
+	ts.HandleTemperatureUpdateContext(context.Background(), roomID, temperature)
+}
+
+// HandleTemperatureUpdateContext handles a temperature update within the trace of the sensor
+// message, which the control evaluation and any HVAC command it publishes continue
+func (ts *ThermostatService) HandleTemperatureUpdateContext(ctx context.Context, roomID string, temperature float64) {
+	ctx, span := tracing.Start(ctx, "ThermostatService temperature update", tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("room_id", roomID)
+	span.SetAttribute("temperature", temperature)
+
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
 	// Get or create thermostat for this room
 	thermostat, exists := ts.thermostats[roomID]
+	if !exists && ts.weather != nil && roomID == ts.weather.OutdoorRoom() {
+		return
+	}
 	if !exists {
 		// Create default thermostat for this room
 		thermostat = &models.Thermostat{
@@ -67,7 +139,11 @@ func (ts *ThermostatService) HandleTemperatureUpdate(roomID string, temperature
 			CreatedAt:        time.Now(),
 			UpdatedAt:        time.Now(),
 			IsOnline:         true,
+			Equipment:        ts.equipment[roomID],
+			Humidity:         ts.humidity[roomID],
 		}
+		ts.attachControl(thermostat)
+		applyFan(thermostat, ts.fans[roomID])
 		ts.thermostats[roomID] = thermostat
 		ts.logger.Info("Created new thermostat for room", map[string]interface{}{
 			"room_id": roomID,
@@ -96,8 +172,54 @@ func (ts *ThermostatService) HandleTemperatureUpdate(roomID string, temperature
 		"device_id": thermostat.ID,
 	})
 
-	// Trigger control logic evaluation
-	go ts.processThermostat(thermostat)
+	// Evaluate the control logic under the lock, as the control loop does, so readings arriving
+	// close together don't update the PID and the run and rest times at once
+	ts.processThermostatContext(ctx, thermostat)
+}
+
+// SetSafeMode attaches a safe mode controller that holds back HVAC commands
+func (ts *ThermostatService) SetSafeMode(controller *safemode.Controller) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.safeMode = controller
+}
+
+// SetWeather lets the outdoor forecast pre-heat rooms and skip cooling
+func (ts *ThermostatService) SetWeather(advisor WeatherAdvisor) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.weather = advisor
+}
+
+// SetCondensationGuard lets the condensation guard slow or speed up the fan and hold cooling
+// above the dew point of surfaces
+func (ts *ThermostatService) SetCondensationGuard(advisor CondensationAdvisor) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.condensation = advisor
+}
+
+// SetZoning lets thermostats sharing an HVAC system take turns instead of calling for heating
+// and cooling at once
+func (ts *ThermostatService) SetZoning(coordinator ZoneCoordinator) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.zoning = coordinator
+}
+
+// SetDryRunRecorder attaches a recorder that traces HVAC commands in observe-only mode
+func (ts *ThermostatService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.dryRun = recorder
+}
+
+// AddStatusCallback registers a function called with a copy of a thermostat whenever it starts or
+// stops heating or cooling. Callbacks run with the service lock held and must not call back into it.
+func (ts *ThermostatService) AddStatusCallback(callback func(models.Thermostat)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.statusCallbacks = append(ts.statusCallbacks, callback)
 }
 
 // RegisterThermostat registers a new thermostat
@@ -118,6 +240,18 @@ func (ts *ThermostatService) RegisterThermostat(thermostat *models.Thermostat) {
 	if thermostat.TargetTemp == 0 {
 		thermostat.TargetTemp = utils.DefaultTargetTemp // 70°F default target
 	}
+	if thermostat.Equipment == nil {
+		thermostat.Equipment = ts.equipment[thermostat.ID]
+	}
+	if thermostat.Humidity == nil {
+		thermostat.Humidity = ts.humidity[thermostat.ID]
+	}
+	if thermostat.Control == nil {
+		ts.attachControl(thermostat)
+	}
+	if thermostat.FanMode == "" {
+		applyFan(thermostat, ts.fans[thermostat.ID])
+	}
 
 	ts.thermostats[thermostat.ID] = thermostat
 	ts.logger.Info("Registered new thermostat", map[string]interface{}{
@@ -155,6 +289,26 @@ func (ts *ThermostatService) GetAllThermostats() []*models.Thermostat {
 	return thermostats
 }
 
+// Handler serves the state of every thermostat as JSON, sorted by ID
+func (ts *ThermostatService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.RLock()
+		thermostats := make([]models.Thermostat, 0, len(ts.thermostats))
+		for _, thermostat := range ts.thermostats {
+			thermostats = append(thermostats, *thermostat)
+		}
+		ts.mu.RUnlock()
+		sort.Slice(thermostats, func(i, j int) bool {
+			return thermostats[i].ID < thermostats[j].ID
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"thermostats": thermostats,
+		})
+	})
+}
+
 // SetTargetTemperature sets the target temperature for a thermostat
 func (ts *ThermostatService) SetTargetTemperature(id string, temp float64) error {
 	ts.mu.Lock()
@@ -162,7 +316,7 @@ func (ts *ThermostatService) SetTargetTemperature(id string, temp float64) error
 
 	thermostat, exists := ts.thermostats[id]
 	if !exists {
-		ts.logger.Error("Thermostat not found when setting target temperature", map[string]interface{}{
+		ts.logger.Error("Thermostat not found when setting target temperature", nil, map[string]interface{}{
 			"thermostat_id": id,
 			"target_temp":   temp,
 		})
@@ -170,7 +324,7 @@ func (ts *ThermostatService) SetTargetTemperature(id string, temp float64) error
 	}
 
 	if !thermostat.IsValidTargetTemp(temp) {
-		ts.logger.Error("Invalid target temperature", map[string]interface{}{
+		ts.logger.Error("Invalid target temperature", nil, map[string]interface{}{
 			"thermostat_id": id,
 			"target_temp":   temp,
 			"min_temp":      thermostat.MinTemp,
@@ -204,7 +358,7 @@ func (ts *ThermostatService) SetMode(id string, mode models.ThermostatMode) erro
 
 	thermostat, exists := ts.thermostats[id]
 	if !exists {
-		ts.logger.Error("Thermostat not found when setting mode", map[string]interface{}{
+		ts.logger.Error("Thermostat not found when setting mode", nil, map[string]interface{}{
 			"thermostat_id": id,
 			"mode":         mode,
 		})
@@ -212,7 +366,7 @@ func (ts *ThermostatService) SetMode(id string, mode models.ThermostatMode) erro
 	}
 
 	if !thermostat.IsValidMode(mode) {
-		ts.logger.Error("Invalid thermostat mode", map[string]interface{}{
+		ts.logger.Error("Invalid thermostat mode", nil, map[string]interface{}{
 			"thermostat_id": id,
 			"mode":         mode,
 			"current_mode": thermostat.Mode,
@@ -242,10 +396,11 @@ func (ts *ThermostatService) SetMode(id string, mode models.ThermostatMode) erro
 // subscribeSensorTopics subscribes to MQTT topics for sensor data
 func (ts *ThermostatService) subscribeSensorTopics() {
 	// Subscribe to temperature topics from Pi Pico sensors
-	ts.mqttClient.Subscribe("room-temp/+", ts.handleTemperatureMessage)
-	ts.mqttClient.Subscribe("room-hum/+", ts.handleHumidityMessage)
+	ts.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomTemperature, "+"), countedHandler("thermostat", "temperature", ts.handleTemperatureMessage))
+	ts.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomHumidity, "+"), countedHandler("thermostat", "humidity", ts.handleHumidityMessage))
+	ts.mqttClient.Subscribe(mqtt.ThermostatFanTopic("+"), countedHandler("thermostat", "fan", ts.handleFanMessage))
 
-	ts.logger.Info("Subscribed to sensor MQTT topics: temp, humidity")
+	ts.logger.Info("Subscribed to sensor MQTT topics: temp, humidity, fan")
 }
 
 // handleTemperatureMessage processes temperature messages from Pi Pico sensors
@@ -253,7 +408,7 @@ func (ts *ThermostatService) handleTemperatureMessage(topic string, payload []by
 	// Extract room number from topic (room-temp/1)
 	parts := strings.Split(topic, "/")
 	if len(parts) != 2 {
-		ts.logger.Error("Invalid temperature topic format", map[string]interface{}{
+		ts.logger.Error("Invalid temperature topic format", nil, map[string]interface{}{
 			"topic": topic,
 			"parts": len(parts),
 		})
@@ -265,8 +420,7 @@ func (ts *ThermostatService) handleTemperatureMessage(topic string, payload []by
 	// Parse JSON payload
 	var sensorData map[string]interface{}
 	if err := json.Unmarshal(payload, &sensorData); err != nil {
-		ts.logger.Error("Failed to parse temperature message", map[string]interface{}{
-			"error":   err.Error(),
+		ts.logger.Error("Failed to parse temperature message", err, map[string]interface{}{
 			"topic":   topic,
 			"payload": string(payload),
 		})
@@ -352,13 +506,18 @@ func (ts *ThermostatService) handleHumidityMessage(topic string, payload []byte)
 	return nil
 }
 
-// controlLoop runs the main control logic for all thermostats
-func (ts *ThermostatService) controlLoop() {
+// controlLoop runs the main control logic for all thermostats until ctx is done
+func (ts *ThermostatService) controlLoop(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
 	defer ticker.Stop()
 
-	for range ticker.C {
-		ts.processAllThermostats()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ts.processAllThermostats()
+		}
 	}
 }
 
@@ -372,8 +531,37 @@ func (ts *ThermostatService) processAllThermostats() {
 	}
 }
 
+// RunOnce runs a single control cycle over all thermostats and returns their resulting state,
+// sorted by ID. It is used by one-shot mode in place of the 30-second control loop.
+func (ts *ThermostatService) RunOnce() []models.Thermostat {
+	ts.processAllThermostats()
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	thermostats := make([]models.Thermostat, 0, len(ts.thermostats))
+	for _, thermostat := range ts.thermostats {
+		thermostats = append(thermostats, *thermostat)
+	}
+	sort.Slice(thermostats, func(i, j int) bool {
+		return thermostats[i].ID < thermostats[j].ID
+	})
+	return thermostats
+}
+
 // processThermostat processes control logic for a single thermostat
 func (ts *ThermostatService) processThermostat(thermostat *models.Thermostat) {
+	ts.processThermostatContext(context.Background(), thermostat)
+}
+
+// processThermostatContext is processThermostat within a trace, e.g. of the sensor message that
+// triggered it
+func (ts *ThermostatService) processThermostatContext(ctx context.Context, thermostat *models.Thermostat) {
+	ctx, span := tracing.Start(ctx, "ThermostatService process", tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("thermostat_id", thermostat.ID)
+	defer recordThermostatMetrics(thermostat)
+
 	// Check if sensor data is stale
 	if time.Since(thermostat.LastSensorUpdate) > 5*time.Minute {
 		thermostat.IsOnline = false
@@ -386,14 +574,54 @@ func (ts *ThermostatService) processThermostat(thermostat *models.Thermostat) {
 		return
 	}
 
-	// Determine next action
-	nextStatus := thermostat.GetNextAction()
+	// Determine next action, its stage and auxiliary heat
+	now := time.Now()
+	if ts.weather != nil {
+		previous := weatherReason(thermostat.Weather)
+		thermostat.Weather = ts.weather.Adjustment(*thermostat, now)
+		if reason := weatherReason(thermostat.Weather); reason != previous {
+			ts.logger.Info("Weather adjustment changed", map[string]interface{}{
+				"thermostat_id": thermostat.ID,
+				"adjustment":    reason,
+			})
+		}
+	}
+	fanSpeed := thermostat.ControlFanSpeed()
+	if ts.condensation != nil {
+		thermostat.Condensation = ts.condensation.Adjustment(*thermostat, now)
+	}
+	if thermostat.Control != nil && thermostat.Control.Settings.Radiant() {
+		thermostat.Control.OutdoorF = nil
+		if ts.weather != nil {
+			if outdoor, ok := ts.weather.OutdoorTemperature(now); ok {
+				thermostat.Control.OutdoorF = &outdoor
+			}
+		}
+	}
+	if thermostat.UpdateControl(now) {
+		ts.saveLearned(thermostat)
+	}
+	call := thermostat.NextCall(now)
+	if ts.zoning != nil {
+		call = ts.zoning.Coordinate(*thermostat, call, now)
+	}
+	nextStatus := call.Status
+
+	// Only act if status or stage changed, or the fan speed of a running system
+	fanChanged := nextStatus != models.StatusIdle && thermostat.ControlFanSpeed() != fanSpeed
+	if nextStatus != thermostat.Status || call.Stage != thermostat.Stage || call.AuxHeat != thermostat.AuxHeat || call.Compressor != thermostat.Compressor || fanChanged {
+		if !ts.safeMode.Allowed(safemode.ComponentThermostat, thermostat.ID) {
+			ts.logger.Debug("Safe mode active, leaving HVAC untouched", map[string]interface{}{
+				"thermostat_id": thermostat.ID,
+				"status":        thermostat.Status,
+				"next_status":   nextStatus,
+			})
+			return
+		}
 
-	// Only act if status changed
-	if nextStatus != thermostat.Status {
 		oldStatus := thermostat.Status
-		thermostat.Status = nextStatus
-		thermostat.UpdatedAt = time.Now()
+		thermostat.ApplyCall(call, now)
+		thermostat.UpdatedAt = now
 
 		ts.logger.Info("Thermostat status changed", map[string]interface{}{
 			"thermostat_id": thermostat.ID,
@@ -403,30 +631,73 @@ func (ts *ThermostatService) processThermostat(thermostat *models.Thermostat) {
 			"current_temp": thermostat.CurrentTemp,
 			"target_temp":  thermostat.TargetTemp,
 			"mode":         thermostat.Mode,
+			"stage":        call.Stage,
+			"aux_heat":     call.AuxHeat,
 			"updated_at":   thermostat.UpdatedAt,
 		})
 
 		// Send control command
-		ts.sendControlCommand(thermostat, nextStatus)
+		span.SetAttribute("status", string(nextStatus))
+		ts.sendControlCommand(ctx, thermostat, call)
+
+		if nextStatus != oldStatus {
+			for _, callback := range ts.statusCallbacks {
+				callback(*thermostat)
+			}
+		}
 	}
 }
 
+// weatherReason describes a weather adjustment for the log, "none" without one
+func weatherReason(adjustment *models.WeatherAdjustment) string {
+	if adjustment == nil {
+		return "none"
+	}
+	return adjustment.Reason
+}
+
 // sendControlCommand sends a control command to the HVAC system
-func (ts *ThermostatService) sendControlCommand(thermostat *models.Thermostat, status models.ThermostatStatus) {
-	topic := fmt.Sprintf("thermostat/%s/control", thermostat.ID)
+func (ts *ThermostatService) sendControlCommand(ctx context.Context, thermostat *models.Thermostat, call models.HVACCall) {
+	topic := mqtt.ThermostatControlTopic(thermostat.ID)
+	status := call.Status
+
+	if ts.dryRun.ObserveOnly() {
+		ts.dryRun.Record("thermostat", string(status), thermostat.ID,
+			fmt.Sprintf("current %.1f°F, target %.1f°F, mode %s", thermostat.CurrentTemp, thermostat.TargetTemp, thermostat.Mode),
+			map[string]interface{}{
+				"topic":        topic,
+				"current_temp": thermostat.CurrentTemp,
+				"target_temp":  thermostat.TargetTemp,
+				"stage":        call.Stage,
+				"aux_heat":     call.AuxHeat,
+				"fan":          call.Fan,
+			})
+		return
+	}
 
 	command := map[string]interface{}{
 		"action":    string(status),
 		"target":    thermostat.TargetTemp,
 		"current":   thermostat.CurrentTemp,
-		"fan_speed": thermostat.FanSpeed,
+		"fan_speed": thermostat.ControlFanSpeed(),
+		"fan":       call.Fan,
+		"fan_mode":  fanMode(thermostat),
 		"timestamp": time.Now().Unix(),
 	}
+	// Multi-stage and heat-pump equipment needs the terminals to energize, not just the action
+	if equipment := thermostat.Equipment; equipment != nil {
+		command["stage"] = call.Stage
+		command["compressor"] = call.Compressor
+		command["aux_heat"] = call.AuxHeat
+		command["emergency_heat"] = thermostat.Mode == models.ModeEmergencyHeat
+		if equipment.HeatPump {
+			command["reversing_valve"] = call.ReversingValve
+		}
+	}
 
 	payload, err := json.Marshal(command)
 	if err != nil {
-		ts.logger.Error("Failed to marshal control command", map[string]interface{}{
-			"error":         err.Error(),
+		ts.logger.Error("Failed to marshal control command", err, map[string]interface{}{
 			"thermostat_id": thermostat.ID,
 			"status":        status,
 			"target_temp":   thermostat.TargetTemp,
@@ -434,16 +705,16 @@ func (ts *ThermostatService) sendControlCommand(thermostat *models.Thermostat, s
 		return
 	}
 
-	msg := &mqtt.Message{
+	msg := (&mqtt.Message{
 		Topic:   topic,
 		Payload: payload,
 		QoS:     1,
 		Retain:  false,
-	}
+		Expiry:  controlCommandExpiry,
+	}).WithProperty(mqtt.PropertyDevice, thermostat.ID).WithProperty(mqtt.PropertyRoom, thermostat.RoomID)
 
-	if err := ts.mqttClient.Publish(msg); err != nil {
-		ts.logger.Error("Failed to publish control command", map[string]interface{}{
-			"error":         err.Error(),
+	if err := ts.mqttClient.PublishContext(ctx, msg); err != nil {
+		ts.logger.Error("Failed to publish control command", err, map[string]interface{}{
 			"thermostat_id": thermostat.ID,
 			"topic":         topic,
 			"status":        status,
@@ -456,14 +727,31 @@ func (ts *ThermostatService) sendControlCommand(thermostat *models.Thermostat, s
 			"topic":         topic,
 			"target_temp":   thermostat.TargetTemp,
 			"current_temp":  thermostat.CurrentTemp,
-			"fan_speed":     thermostat.FanSpeed,
+			"fan_speed":     thermostat.ControlFanSpeed(),
 		})
 	}
 }
 
 // publishThermostatCommand publishes a command to the thermostat
 func (ts *ThermostatService) publishThermostatCommand(id string, cmdType string, value interface{}) {
-	topic := fmt.Sprintf("thermostat/%s/command", id)
+	if !ts.safeMode.Allowed(safemode.ComponentThermostat, id) {
+		ts.logger.Info("Safe mode active, thermostat command not sent", map[string]interface{}{
+			"thermostat_id": id,
+			"command_type":  cmdType,
+			"value":         value,
+		})
+		return
+	}
+
+	topic := mqtt.ThermostatCommandTopic(id)
+
+	if ts.dryRun.ObserveOnly() {
+		ts.dryRun.Record("thermostat", cmdType, id, "thermostat setting changed", map[string]interface{}{
+			"topic": topic,
+			"value": value,
+		})
+		return
+	}
 
 	command := models.ThermostatCommand{
 		Type:      cmdType,
@@ -473,8 +761,7 @@ func (ts *ThermostatService) publishThermostatCommand(id string, cmdType string,
 
 	payload, err := json.Marshal(command)
 	if err != nil {
-		ts.logger.Error("Failed to marshal thermostat command", map[string]interface{}{
-			"error":         err.Error(),
+		ts.logger.Error("Failed to marshal thermostat command", err, map[string]interface{}{
 			"thermostat_id": id,
 			"command_type":  cmdType,
 			"value":         value,
@@ -490,8 +777,7 @@ func (ts *ThermostatService) publishThermostatCommand(id string, cmdType string,
 	}
 
 	if err := ts.mqttClient.Publish(msg); err != nil {
-		ts.logger.Error("Failed to publish thermostat command", map[string]interface{}{
-			"error":         err.Error(),
+		ts.logger.Error("Failed to publish thermostat command", err, map[string]interface{}{
 			"thermostat_id": id,
 			"topic":         topic,
 			"command_type":  cmdType,
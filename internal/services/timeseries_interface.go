@@ -2,7 +2,12 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/pkg/influxdb"
 )
 
 // TimeSeriesClient defines the interface for time series databases
@@ -13,11 +18,41 @@ type TimeSeriesClient interface {
 	WriteTemperatureReading(ctx context.Context, deviceID, roomID string, tempF, humidity float64, timestamp time.Time) error
 }
 
+// SelectTimeSeriesClient returns the client for the configured backend: an InfluxDB client
+// for "influxdb", or prometheusClient for "prometheus"
+func SelectTimeSeriesClient(cfg config.TimeSeriesConfig, prometheusClient TimeSeriesClient) (TimeSeriesClient, error) {
+	switch cfg.Backend {
+	case "", "prometheus":
+		return prometheusClient, nil
+	case "influxdb":
+		client, err := influxdb.NewClient(cfg.InfluxURL, cfg.InfluxToken, cfg.InfluxOrg, cfg.InfluxBucket)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	default:
+		return nil, errors.NewConfigError(fmt.Sprintf("unknown time series backend %q, use prometheus or influxdb", cfg.Backend), nil)
+	}
+}
+
+// deviceNamer is implemented by time series clients that label series with a device name
+// separate from the device ID, so UUID-keyed series stay human-readable
+type deviceNamer interface {
+	SetDeviceName(deviceID, name string)
+}
+
+// deviceTagger is implemented by time series clients that publish device tags for grouping
+type deviceTagger interface {
+	SetDeviceTags(deviceID string, tags []string)
+}
+
 // EnergyReading represents energy data from smart plugs
 type EnergyReading struct {
 	DeviceID       string    `json:"device_id"`
+	DeviceUUID     string    `json:"device_uuid,omitempty"`
 	DeviceName     string    `json:"device_name"`
 	RoomID         string    `json:"room_id"`
+	Tags           []string  `json:"tags,omitempty"`
 	PowerW         float64   `json:"power_w"`
 	EnergyWh       float64   `json:"energy_wh"`
 	VoltageV       float64   `json:"voltage_v"`
@@ -26,4 +61,6 @@ type EnergyReading struct {
 	SignalStrength float64   `json:"signal_strength"`
 	Temperature    float64   `json:"temperature"`
 	Timestamp      time.Time `json:"timestamp"`
+	// Estimated readings come from configured loads, e.g. bulb wattage × on-time, not a meter
+	Estimated bool `json:"estimated,omitempty"`
 }
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// LegacyTopicStats is the traffic still arriving on one legacy topic, so the devices that need
+// new firmware can be found before the legacy topic is retired
+type LegacyTopicStats struct {
+	Topic     string    `json:"topic"`
+	Current   string    `json:"current"`
+	Messages  int       `json:"messages"`
+	Failed    int       `json:"failed"` // Messages that couldn't be republished
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// LoadTopicMigrations reads additional topic migrations from a JSON file
+func LoadTopicMigrations(path string) ([]mqtt.TopicMigration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read topic migrations file", err)
+	}
+
+	var migrations []mqtt.TopicMigration
+	if err := json.Unmarshal(data, &migrations); err != nil {
+		return nil, errors.NewConfigError("failed to parse topic migrations file", err)
+	}
+
+	for _, migration := range migrations {
+		if err := migration.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return migrations, nil
+}
+
+// TopicMigrationService republishes messages on legacy topics to their current topics, so
+// firmware can be migrated one device at a time, and counts the legacy traffic that remains
+type TopicMigrationService struct {
+	mqttClient *mqtt.Client
+	migrations []mqtt.TopicMigration
+	publish    func(msg *mqtt.Message) error
+	stats      map[string]*LegacyTopicStats
+	logger     *logger.Logger
+	mu         sync.Mutex
+
+	legacyMessages *prometheus.CounterVec
+}
+
+// NewTopicMigrationService creates a shim for the built-in legacy topics and any extra migrations
+func NewTopicMigrationService(mqttClient *mqtt.Client, migrations []mqtt.TopicMigration, serviceLogger *logger.Logger) *TopicMigrationService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("TopicMigrationService", nil)
+	}
+
+	return &TopicMigrationService{
+		mqttClient: mqttClient,
+		migrations: append(append([]mqtt.TopicMigration(nil), mqtt.LegacyTopics...), migrations...),
+		publish:    mqttClient.Publish,
+		stats:      make(map[string]*LegacyTopicStats),
+		logger:     serviceLogger,
+		legacyMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "home_automation_mqtt_legacy_messages_total",
+			Help: "Messages received on legacy topics and republished on their current topics",
+		}, []string{"legacy_filter"}),
+	}
+}
+
+// RegisterMetrics registers the legacy traffic counter
+func (s *TopicMigrationService) RegisterMetrics(registerer prometheus.Registerer) error {
+	if err := registerer.Register(s.legacyMessages); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return nil
+		}
+		return errors.NewSystemError("failed to register legacy topic metrics", err)
+	}
+	return nil
+}
+
+// Start subscribes to the legacy topics
+func (s *TopicMigrationService) Start() error {
+	for _, migration := range s.migrations {
+		if err := s.mqttClient.Subscribe(migration.Legacy, s.handler(migration)); err != nil {
+			return err
+		}
+	}
+	s.logger.Info("Republishing legacy topics", map[string]interface{}{
+		"migrations": len(s.migrations),
+	})
+	return nil
+}
+
+func (s *TopicMigrationService) handler(migration mqtt.TopicMigration) mqtt.MessageHandler {
+	return func(topic string, payload []byte) error {
+		return s.handle(migration, topic, payload, time.Now())
+	}
+}
+
+// handle republishes one legacy message on its current topic
+func (s *TopicMigrationService) handle(migration mqtt.TopicMigration, topic string, payload []byte, now time.Time) error {
+	current, ok := migration.Translate(topic)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	stats, seen := s.stats[topic]
+	if !seen {
+		stats = &LegacyTopicStats{Topic: topic, Current: current, FirstSeen: now}
+		s.stats[topic] = stats
+	}
+	stats.Messages++
+	stats.LastSeen = now
+	s.mu.Unlock()
+	s.legacyMessages.WithLabelValues(migration.Legacy).Inc()
+
+	if !seen {
+		s.logger.Warn("Device publishing on a legacy topic, update its firmware", map[string]interface{}{
+			"topic":   topic,
+			"current": current,
+		})
+	}
+
+	if err := s.publish(&mqtt.Message{Topic: current, Payload: payload, QoS: 1}); err != nil {
+		s.mu.Lock()
+		stats.Failed++
+		s.mu.Unlock()
+		s.logger.Error("Failed to republish legacy message", err, map[string]interface{}{
+			"topic":   topic,
+			"current": current,
+		})
+		return err
+	}
+	return nil
+}
+
+// Stats returns the traffic of every legacy topic seen, most recently seen first
+func (s *TopicMigrationService) Stats() []LegacyTopicStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]LegacyTopicStats, 0, len(s.stats))
+	for _, topic := range s.stats {
+		stats = append(stats, *topic)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].LastSeen.Equal(stats[j].LastSeen) {
+			return stats[i].LastSeen.After(stats[j].LastSeen)
+		}
+		return stats[i].Topic < stats[j].Topic
+	})
+	return stats
+}
+
+// Handler serves the migrations and the legacy traffic still arriving as JSON
+func (s *TopicMigrationService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"migrations": s.migrations,
+			"legacy":     s.Stats(),
+		})
+	})
+}
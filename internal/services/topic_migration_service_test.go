@@ -0,0 +1,32 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestTopicMigrationRepublishes(t *testing.T) {
+	service := NewTopicMigrationService(nil, []mqtt.TopicMigration{{Legacy: "sensors/+/temp", Current: "room-temp/+"}}, nil)
+	var published []*mqtt.Message
+	service.publish = func(msg *mqtt.Message) error {
+		published = append(published, msg)
+		return nil
+	}
+
+	at := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	humidity := service.migrations[0]
+	service.handle(humidity, "room-humidity/kitchen", []byte(`{"humidity":41}`), at)
+	service.handle(humidity, "room-humidity/kitchen", []byte(`{"humidity":42}`), at.Add(time.Minute))
+	service.handle(service.migrations[1], "sensors/hall/temp", []byte(`{"temperature":67}`), at.Add(2*time.Minute))
+
+	if len(published) != 3 || published[0].Topic != "room-hum/kitchen" || string(published[1].Payload) != `{"humidity":42}` || published[2].Topic != "room-temp/hall" {
+		t.Fatalf("Unexpected republished messages %+v", published)
+	}
+
+	stats := service.Stats()
+	if len(stats) != 2 || stats[0].Topic != "sensors/hall/temp" || stats[1].Messages != 2 || !stats[1].FirstSeen.Equal(at) {
+		t.Errorf("Unexpected legacy traffic %+v", stats)
+	}
+}
@@ -1,13 +1,19 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/lifecycle"
+	"github.com/johnpr01/home-automation/internal/tracing"
 	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
@@ -30,17 +36,28 @@ type UnifiedSensorMessage struct {
 	LightPercent *float64 `json:"light_percent,omitempty"`
 	LightState   string   `json:"light_state,omitempty"`
 
+	// Leak and smoke detector data
+	Leak  *bool `json:"leak,omitempty"`
+	Smoke *bool `json:"smoke,omitempty"`
+
+	// Door and window contact data; Sensor names the contact, e.g. back-door
+	Open *bool `json:"open,omitempty"`
+
 	// Common metadata
 	Room      string `json:"room"`
 	Sensor    string `json:"sensor"`
 	Timestamp int64  `json:"timestamp"`
 	DeviceID  string `json:"device_id"`
+
+	// Firmware of the Pico, sent with its temperature readings by firmware supporting OTA updates
+	FirmwareVersion string `json:"firmware_version,omitempty"`
 }
 
 // RoomSensorData aggregates all sensor data for a room
 type RoomSensorData struct {
-	RoomID   string `json:"room_id"`
-	DeviceID string `json:"device_id"`
+	RoomID     string `json:"room_id"`
+	DeviceID   string `json:"device_id"`
+	DeviceUUID string `json:"device_uuid,omitempty"` // Resolved from the MQTT device_id once claimed
 
 	// Temperature/Humidity
 	Temperature    float64   `json:"temperature"`
@@ -58,9 +75,19 @@ type RoomSensorData struct {
 	DayNightCycle   string    `json:"day_night_cycle"`
 	LightLastUpdate time.Time `json:"light_last_update"`
 
+	// Leak and smoke detectors
+	LeakDetected  bool      `json:"leak_detected"`
+	LeakLastTime  time.Time `json:"leak_last_time,omitempty"`
+	SmokeDetected bool      `json:"smoke_detected"`
+	SmokeLastTime time.Time `json:"smoke_last_time,omitempty"`
+
+	// Door and window contacts that are open, with when they opened
+	OpenContacts map[string]time.Time `json:"open_contacts,omitempty"`
+
 	// Device status
-	IsOnline bool      `json:"is_online"`
-	LastSeen time.Time `json:"last_seen"`
+	IsOnline        bool      `json:"is_online"`
+	LastSeen        time.Time `json:"last_seen"`
+	FirmwareVersion string    `json:"firmware_version,omitempty"`
 }
 
 // UnifiedSensorService manages all sensor data from Pi Pico devices
@@ -70,10 +97,27 @@ type UnifiedSensorService struct {
 	mu          sync.RWMutex
 	logger      *log.Logger
 
+	// Resource limits
+	maxRooms      int
+	rejectedRooms int
+
+	// Stable device UUIDs for MQTT device IDs
+	identities *identity.Registry
+
+	// Optional time series storage for temperature and humidity
+	tsClient TimeSeriesClient
+
+	// Reports closed-off rooms, which are left out of averages and automations
+	closedRoom func(roomID string) bool
+
 	// Callbacks for other services
-	tempCallbacks   []func(roomID string, temperature float64)
-	motionCallbacks []func(roomID string, occupied bool)
-	lightCallbacks  []func(roomID string, lightState string, lightLevel float64)
+	tempCallbacks     []func(ctx context.Context, roomID string, temperature float64)
+	motionCallbacks   []func(roomID string, occupied bool)
+	lightCallbacks    []func(roomID string, lightState string, lightLevel float64)
+	hazardCallbacks   []func(roomID string, hazard string, detected bool)
+	firmwareCallbacks []func(deviceID, roomID, version string)
+
+	background lifecycle.Background // Runs the offline check between Start and Stop
 }
 
 // NewUnifiedSensorService creates a new unified sensor service
@@ -82,22 +126,38 @@ func NewUnifiedSensorService(mqttClient *mqtt.Client, logger *log.Logger) *Unifi
 		roomSensors:     make(map[string]*RoomSensorData),
 		mqttClient:      mqttClient,
 		logger:          logger,
-		tempCallbacks:   make([]func(string, float64), 0),
+		tempCallbacks:   make([]func(context.Context, string, float64), 0),
 		motionCallbacks: make([]func(string, bool), 0),
 		lightCallbacks:  make([]func(string, string, float64), 0),
+		hazardCallbacks: make([]func(string, string, bool), 0),
 	}
 
 	// Subscribe to all sensor topics from Pi Pico devices
 	service.subscribeSensorTopics()
 
-	// Start cleanup routine
-	go service.cleanupRoutine()
-
 	return service
 }
 
+// Start starts marking rooms whose sensors went quiet offline, until Stop
+func (uss *UnifiedSensorService) Start(ctx context.Context) error {
+	return uss.background.Start(ctx, uss.cleanupRoutine)
+}
+
+// Stop stops the offline check and waits for it to return
+func (uss *UnifiedSensorService) Stop(ctx context.Context) error {
+	return uss.background.Stop(ctx)
+}
+
 // AddTemperatureCallback registers a callback for temperature updates
 func (uss *UnifiedSensorService) AddTemperatureCallback(callback func(roomID string, temperature float64)) {
+	uss.AddTemperatureCallbackContext(func(_ context.Context, roomID string, temperature float64) {
+		callback(roomID, temperature)
+	})
+}
+
+// AddTemperatureCallbackContext registers a callback for temperature updates that continues
+// the trace of the sensor message
+func (uss *UnifiedSensorService) AddTemperatureCallbackContext(callback func(ctx context.Context, roomID string, temperature float64)) {
 	uss.mu.Lock()
 	defer uss.mu.Unlock()
 	uss.tempCallbacks = append(uss.tempCallbacks, callback)
@@ -117,6 +177,33 @@ func (uss *UnifiedSensorService) AddLightCallback(callback func(roomID string, l
 	uss.lightCallbacks = append(uss.lightCallbacks, callback)
 }
 
+// AddHazardCallback registers a callback for leak and smoke detectors turning on or off
+func (uss *UnifiedSensorService) AddHazardCallback(callback func(roomID string, hazard string, detected bool)) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.hazardCallbacks = append(uss.hazardCallbacks, callback)
+}
+
+// AddFirmwareCallback registers a callback for the firmware version Picos report with their
+// temperature readings
+func (uss *UnifiedSensorService) AddFirmwareCallback(callback func(deviceID, roomID, version string)) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.firmwareCallbacks = append(uss.firmwareCallbacks, callback)
+}
+
+// SetClosedRooms leaves the rooms closed reports out of the averages and the motion and light
+// callbacks. Their readings are still kept, and temperature and hazard callbacks still fire.
+func (uss *UnifiedSensorService) SetClosedRooms(closed func(roomID string) bool) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.closedRoom = closed
+}
+
+func (uss *UnifiedSensorService) isClosed(roomID string) bool {
+	return uss.closedRoom != nil && uss.closedRoom(roomID)
+}
+
 // GetRoomSensorData returns all sensor data for a room
 func (uss *UnifiedSensorService) GetRoomSensorData(roomID string) (*RoomSensorData, bool) {
 	uss.mu.RLock()
@@ -140,6 +227,12 @@ func (uss *UnifiedSensorService) GetAllRoomSensors() map[string]*RoomSensorData
 	result := make(map[string]*RoomSensorData)
 	for roomID, data := range uss.roomSensors {
 		dataCopy := *data
+		if data.OpenContacts != nil {
+			dataCopy.OpenContacts = make(map[string]time.Time, len(data.OpenContacts))
+			for contact, openedAt := range data.OpenContacts {
+				dataCopy.OpenContacts[contact] = openedAt
+			}
+		}
 		result[roomID] = &dataCopy
 	}
 	return result
@@ -148,36 +241,58 @@ func (uss *UnifiedSensorService) GetAllRoomSensors() map[string]*RoomSensorData
 // subscribeSensorTopics sets up MQTT subscriptions for all sensor data
 func (uss *UnifiedSensorService) subscribeSensorTopics() {
 	// Subscribe to all sensor topics from Pi Pico devices
-	uss.mqttClient.Subscribe("room-temp/+", uss.handleTemperatureMessage)
-	uss.mqttClient.Subscribe("room-hum/+", uss.handleHumidityMessage)
-	uss.mqttClient.Subscribe("room-motion/+", uss.handleMotionMessage)
-	uss.mqttClient.Subscribe("room-light/+", uss.handleLightMessage)
+	uss.mqttClient.SubscribeContext(mqtt.RoomTopic(mqtt.TopicRoomTemperature, "+"), countedContextHandler("unified", "temperature", uss.handleTemperatureMessageContext))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomHumidity, "+"), countedHandler("unified", "humidity", uss.handleHumidityMessage))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomMotion, "+"), countedHandler("unified", "motion", uss.handleMotionMessage))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomLight, "+"), countedHandler("unified", "light", uss.handleLightMessage))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomLeak, "+"), countedHandler("unified", "leak", uss.handleLeakMessage))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomContact, "+"), countedHandler("unified", "contact", uss.handleContactMessage))
+	uss.mqttClient.Subscribe(mqtt.RoomTopic(mqtt.TopicRoomSmoke, "+"), countedHandler("unified", "smoke", uss.handleSmokeMessage))
 
 	uss.logger.Println("UnifiedSensorService: Subscribed to all Pi Pico sensor topics")
 }
 
 // handleTemperatureMessage processes temperature messages from Pi Pico
 func (uss *UnifiedSensorService) handleTemperatureMessage(topic string, payload []byte) error {
+	return uss.handleTemperatureMessageContext(context.Background(), topic, payload)
+}
+
+// handleTemperatureMessageContext processes a temperature message within its trace, which the
+// temperature callbacks continue
+func (uss *UnifiedSensorService) handleTemperatureMessageContext(ctx context.Context, topic string, payload []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "UnifiedSensorService temperature", tracing.KindInternal)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	roomID, err := uss.extractRoomID(topic)
 	if err != nil {
 		return err
 	}
+	span.SetAttribute("room_id", roomID)
 
 	var tempMsg UnifiedSensorMessage
 	if err := json.Unmarshal(payload, &tempMsg); err != nil {
 		uss.logger.Printf("Failed to parse temperature message for room %s: %v", roomID, err)
 		return err
 	}
+	span.SetAttribute("temperature", tempMsg.Temperature)
+	span.SetAttribute("device_id", tempMsg.DeviceID)
 
 	uss.mu.Lock()
 	defer uss.mu.Unlock()
 
 	// Get or create room sensor data
-	roomData := uss.getOrCreateRoomData(roomID, tempMsg.DeviceID)
+	roomData, err := uss.getOrCreateRoomData(roomID, tempMsg.DeviceID)
+	if err != nil {
+		return err
+	}
 
 	// Update temperature data
 	oldTemp := roomData.Temperature
 	roomData.Temperature = tempMsg.Temperature
+	roomTemperature.WithLabelValues(roomID).Set(roomData.Temperature)
 	roomData.TempLastUpdate = time.Now()
 	roomData.LastSeen = time.Now()
 	roomData.IsOnline = true
@@ -185,9 +300,18 @@ func (uss *UnifiedSensorService) handleTemperatureMessage(topic string, payload
 	uss.logger.Printf("UnifiedSensor: Room %s temperature: %.1f°F -> %.1f°F (device: %s)",
 		roomID, oldTemp, roomData.Temperature, roomData.DeviceID)
 
+	uss.writeEnvironment(roomData)
+
 	// Notify temperature callbacks
 	for _, callback := range uss.tempCallbacks {
-		go callback(roomID, roomData.Temperature)
+		go callback(ctx, roomID, roomData.Temperature)
+	}
+
+	if tempMsg.FirmwareVersion != "" {
+		roomData.FirmwareVersion = tempMsg.FirmwareVersion
+		for _, callback := range uss.firmwareCallbacks {
+			go callback(tempMsg.DeviceID, roomID, tempMsg.FirmwareVersion)
+		}
 	}
 
 	return nil
@@ -210,17 +334,23 @@ func (uss *UnifiedSensorService) handleHumidityMessage(topic string, payload []b
 	defer uss.mu.Unlock()
 
 	// Get or create room sensor data
-	roomData := uss.getOrCreateRoomData(roomID, humMsg.DeviceID)
+	roomData, err := uss.getOrCreateRoomData(roomID, humMsg.DeviceID)
+	if err != nil {
+		return err
+	}
 
 	// Update humidity data
 	oldHumidity := roomData.Humidity
 	roomData.Humidity = humMsg.Humidity
+	roomHumidity.WithLabelValues(roomID).Set(roomData.Humidity)
 	roomData.LastSeen = time.Now()
 	roomData.IsOnline = true
 
 	uss.logger.Printf("UnifiedSensor: Room %s humidity: %.1f%% -> %.1f%% (device: %s)",
 		roomID, oldHumidity, roomData.Humidity, roomData.DeviceID)
 
+	uss.writeEnvironment(roomData)
+
 	return nil
 }
 
@@ -241,7 +371,10 @@ func (uss *UnifiedSensorService) handleMotionMessage(topic string, payload []byt
 	defer uss.mu.Unlock()
 
 	// Get or create room sensor data
-	roomData := uss.getOrCreateRoomData(roomID, motionMsg.DeviceID)
+	roomData, err := uss.getOrCreateRoomData(roomID, motionMsg.DeviceID)
+	if err != nil {
+		return err
+	}
 
 	// Update motion data
 	previouslyOccupied := roomData.IsOccupied
@@ -249,6 +382,7 @@ func (uss *UnifiedSensorService) handleMotionMessage(topic string, payload []byt
 
 	if motionMsg.Motion != nil {
 		roomData.IsOccupied = *motionMsg.Motion
+		roomOccupied.WithLabelValues(roomID).Set(boolGauge(roomData.IsOccupied))
 
 		if *motionMsg.Motion {
 			roomData.MotionLastTime = currentTime
@@ -268,7 +402,10 @@ func (uss *UnifiedSensorService) handleMotionMessage(topic string, payload []byt
 			uss.logger.Printf("UnifiedSensor: Room %s is now %s (device: %s)",
 				roomID, status, roomData.DeviceID)
 
-			// Notify motion callbacks
+			// Notify motion callbacks, unless the room is closed off
+			if uss.isClosed(roomID) {
+				return nil
+			}
 			for _, callback := range uss.motionCallbacks {
 				go callback(roomID, roomData.IsOccupied)
 			}
@@ -295,7 +432,10 @@ func (uss *UnifiedSensorService) handleLightMessage(topic string, payload []byte
 	defer uss.mu.Unlock()
 
 	// Get or create room sensor data
-	roomData := uss.getOrCreateRoomData(roomID, lightMsg.DeviceID)
+	roomData, err := uss.getOrCreateRoomData(roomID, lightMsg.DeviceID)
+	if err != nil {
+		return err
+	}
 
 	// Update light data
 	previousState := roomData.LightState
@@ -303,6 +443,7 @@ func (uss *UnifiedSensorService) handleLightMessage(topic string, payload []byte
 
 	if lightMsg.LightLevel != nil {
 		roomData.LightLevel = *lightMsg.LightLevel
+		roomLightLevel.WithLabelValues(roomID).Set(roomData.LightLevel)
 		roomData.LightState = lightMsg.LightState
 		roomData.DayNightCycle = uss.determineDayNightCycle(*lightMsg.LightLevel)
 		roomData.LightLastUpdate = currentTime
@@ -314,7 +455,10 @@ func (uss *UnifiedSensorService) handleLightMessage(topic string, payload []byte
 			uss.logger.Printf("UnifiedSensor: Room %s light: %s -> %s (%.1f%%) (device: %s)",
 				roomID, previousState, roomData.LightState, roomData.LightLevel, roomData.DeviceID)
 
-			// Notify light callbacks
+			// Notify light callbacks, unless the room is closed off
+			if uss.isClosed(roomID) {
+				return nil
+			}
 			for _, callback := range uss.lightCallbacks {
 				go callback(roomID, roomData.LightState, roomData.LightLevel)
 			}
@@ -324,6 +468,129 @@ func (uss *UnifiedSensorService) handleLightMessage(topic string, payload []byte
 	return nil
 }
 
+// handleLeakMessage processes water leak detector messages
+func (uss *UnifiedSensorService) handleLeakMessage(topic string, payload []byte) error {
+	return uss.handleHazardMessage(topic, payload, HazardLeak)
+}
+
+// handleSmokeMessage processes smoke detector messages
+func (uss *UnifiedSensorService) handleSmokeMessage(topic string, payload []byte) error {
+	return uss.handleHazardMessage(topic, payload, HazardSmoke)
+}
+
+// handleHazardMessage records a leak or smoke detector state and notifies the hazard callbacks
+// when it changes. Detectors repeat their state as a heartbeat, so unchanged reports only
+// refresh the room's last seen time.
+func (uss *UnifiedSensorService) handleHazardMessage(topic string, payload []byte, hazard string) error {
+	roomID, err := uss.extractRoomID(topic)
+	if err != nil {
+		return err
+	}
+
+	var hazardMsg UnifiedSensorMessage
+	if err := json.Unmarshal(payload, &hazardMsg); err != nil {
+		uss.logger.Printf("Failed to parse %s message for room %s: %v", hazard, roomID, err)
+		return err
+	}
+
+	reading := hazardMsg.Leak
+	if hazard == HazardSmoke {
+		reading = hazardMsg.Smoke
+	}
+	if reading == nil {
+		return fmt.Errorf("%s message for room %s carries no %s state", hazard, roomID, hazard)
+	}
+
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+
+	// Get or create room sensor data
+	roomData, err := uss.getOrCreateRoomData(roomID, hazardMsg.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	currentTime := time.Now()
+	detected, lastTime := &roomData.LeakDetected, &roomData.LeakLastTime
+	if hazard == HazardSmoke {
+		detected, lastTime = &roomData.SmokeDetected, &roomData.SmokeLastTime
+	}
+
+	changed := *detected != *reading
+	*detected = *reading
+	if *reading {
+		*lastTime = currentTime
+	}
+	roomHazard.WithLabelValues(roomID, hazard).Set(boolGauge(*reading))
+	roomData.LastSeen = currentTime
+	roomData.IsOnline = true
+
+	if changed {
+		status := "CLEAR"
+		if *reading {
+			status = "DETECTED"
+		}
+		uss.logger.Printf("UnifiedSensor: Room %s %s %s (device: %s)", roomID, hazard, status, roomData.DeviceID)
+
+		// Notify hazard callbacks
+		for _, callback := range uss.hazardCallbacks {
+			go callback(roomID, hazard, *reading)
+		}
+	}
+
+	return nil
+}
+
+// handleContactMessage records a door or window contact opening or closing. A room may have
+// several contacts, named by the message's sensor field, or its device ID.
+func (uss *UnifiedSensorService) handleContactMessage(topic string, payload []byte) error {
+	roomID, err := uss.extractRoomID(topic)
+	if err != nil {
+		return err
+	}
+
+	var contactMsg UnifiedSensorMessage
+	if err := json.Unmarshal(payload, &contactMsg); err != nil {
+		uss.logger.Printf("Failed to parse contact message for room %s: %v", roomID, err)
+		return err
+	}
+	if contactMsg.Open == nil {
+		return fmt.Errorf("contact message for room %s carries no open state", roomID)
+	}
+	contact := contactMsg.Sensor
+	if contact == "" {
+		contact = contactMsg.DeviceID
+	}
+	if contact == "" {
+		return fmt.Errorf("contact message for room %s names no sensor or device", roomID)
+	}
+
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+
+	roomData, err := uss.getOrCreateRoomData(roomID, contactMsg.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	currentTime := time.Now()
+	_, wasOpen := roomData.OpenContacts[contact]
+	if *contactMsg.Open && !wasOpen {
+		if roomData.OpenContacts == nil {
+			roomData.OpenContacts = make(map[string]time.Time)
+		}
+		roomData.OpenContacts[contact] = currentTime
+		uss.logger.Printf("UnifiedSensor: Room %s contact %s OPEN", roomID, contact)
+	} else if !*contactMsg.Open && wasOpen {
+		delete(roomData.OpenContacts, contact)
+		uss.logger.Printf("UnifiedSensor: Room %s contact %s CLOSED", roomID, contact)
+	}
+	roomContactOpen.WithLabelValues(roomID, contact).Set(boolGauge(*contactMsg.Open))
+	roomData.LastSeen = currentTime
+	roomData.IsOnline = true
+	return nil
+}
+
 // extractRoomID extracts room ID from MQTT topic
 func (uss *UnifiedSensorService) extractRoomID(topic string) (string, error) {
 	parts := strings.Split(topic, "/")
@@ -333,10 +600,62 @@ func (uss *UnifiedSensorService) extractRoomID(topic string) (string, error) {
 	return parts[1], nil
 }
 
+// SetMaxRooms limits the number of rooms tracked; readings for further rooms are rejected (0 = unlimited)
+func (uss *UnifiedSensorService) SetMaxRooms(limit int) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.maxRooms = limit
+}
+
+// SetIdentityRegistry resolves sensor MQTT device IDs to their claimed UUIDs
+func (uss *UnifiedSensorService) SetIdentityRegistry(registry *identity.Registry) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.identities = registry
+}
+
+// SetTimeSeriesClient stores temperature and humidity readings, e.g. in InfluxDB
+func (uss *UnifiedSensorService) SetTimeSeriesClient(client TimeSeriesClient) {
+	uss.mu.Lock()
+	defer uss.mu.Unlock()
+	uss.tsClient = client
+}
+
+// writeEnvironment stores a room's latest temperature and humidity in the background; callers must hold the lock
+func (uss *UnifiedSensorService) writeEnvironment(roomData *RoomSensorData) {
+	if uss.tsClient == nil {
+		return
+	}
+
+	client := uss.tsClient
+	deviceID := roomData.DeviceID
+	if roomData.DeviceUUID != "" {
+		deviceID = roomData.DeviceUUID
+	}
+	roomID, temperature, humidity, at := roomData.RoomID, roomData.Temperature, roomData.Humidity, roomData.LastSeen
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := client.WriteTemperatureReading(ctx, deviceID, roomID, temperature, humidity, at); err != nil {
+			uss.logger.Printf("UnifiedSensor: Failed to store readings for room %s: %v", roomID, err)
+		}
+	}()
+}
+
 // getOrCreateRoomData gets existing room data or creates new entry
-func (uss *UnifiedSensorService) getOrCreateRoomData(roomID, deviceID string) *RoomSensorData {
+func (uss *UnifiedSensorService) getOrCreateRoomData(roomID, deviceID string) (*RoomSensorData, error) {
 	roomData, exists := uss.roomSensors[roomID]
 	if !exists {
+		if roomLimitReached(len(uss.roomSensors), uss.maxRooms) {
+			uss.rejectedRooms++
+			if shouldLogRejection(uss.rejectedRooms) {
+				uss.logger.Printf("UnifiedSensor: Room limit of %d reached, rejecting room %s (device: %s, %d rejected)",
+					uss.maxRooms, roomID, deviceID, uss.rejectedRooms)
+			}
+			return nil, newRoomLimitError(roomID, uss.maxRooms)
+		}
+
 		roomData = &RoomSensorData{
 			RoomID:        roomID,
 			DeviceID:      deviceID,
@@ -348,11 +667,12 @@ func (uss *UnifiedSensorService) getOrCreateRoomData(roomID, deviceID string) *R
 	}
 
 	// Update device ID if it changed
-	if roomData.DeviceID != deviceID {
+	if roomData.DeviceID != deviceID || roomData.DeviceUUID == "" {
 		roomData.DeviceID = deviceID
+		roomData.DeviceUUID, _ = uss.identities.Resolve(identity.NewAlias(identity.AliasMQTTDeviceID, deviceID))
 	}
 
-	return roomData
+	return roomData, nil
 }
 
 // determineDayNightCycle determines day/night cycle based on light level
@@ -372,12 +692,18 @@ func (uss *UnifiedSensorService) determineDayNightCycle(lightLevel float64) stri
 	}
 }
 
-// cleanupRoutine marks sensors as offline if no recent updates
-func (uss *UnifiedSensorService) cleanupRoutine() {
+// cleanupRoutine marks sensors as offline if no recent updates, until ctx is done
+func (uss *UnifiedSensorService) cleanupRoutine(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		uss.mu.Lock()
 		currentTime := time.Now()
 
@@ -402,9 +728,13 @@ func (uss *UnifiedSensorService) GetSensorSummary() map[string]interface{} {
 
 	summary := make(map[string]interface{})
 	summary["total_rooms"] = len(uss.roomSensors)
+	summary["max_rooms"] = uss.maxRooms
+	summary["rejected_rooms"] = uss.rejectedRooms
 
 	onlineCount := 0
 	occupiedCount := 0
+	closedCount := 0
+	averagedCount := 0
 	avgTemp := 0.0
 	avgHumidity := 0.0
 	avgLight := 0.0
@@ -412,43 +742,68 @@ func (uss *UnifiedSensorService) GetSensorSummary() map[string]interface{} {
 	rooms := make([]map[string]interface{}, 0, len(uss.roomSensors))
 
 	for _, roomData := range uss.roomSensors {
+		closed := uss.isClosed(roomData.RoomID)
 		if roomData.IsOnline {
 			onlineCount++
-			avgTemp += roomData.Temperature
-			avgHumidity += roomData.Humidity
-			avgLight += roomData.LightLevel
 		}
-		if roomData.IsOccupied {
-			occupiedCount++
+		if closed {
+			closedCount++
+		} else {
+			if roomData.IsOnline {
+				averagedCount++
+				avgTemp += roomData.Temperature
+				avgHumidity += roomData.Humidity
+				avgLight += roomData.LightLevel
+			}
+			if roomData.IsOccupied {
+				occupiedCount++
+			}
 		}
 
 		roomInfo := map[string]interface{}{
 			"room_id":         roomData.RoomID,
 			"device_id":       roomData.DeviceID,
+			"device_uuid":     roomData.DeviceUUID,
 			"temperature":     roomData.Temperature,
 			"humidity":        roomData.Humidity,
 			"is_occupied":     roomData.IsOccupied,
 			"light_level":     roomData.LightLevel,
 			"light_state":     roomData.LightState,
 			"day_night_cycle": roomData.DayNightCycle,
+			"leak_detected":   roomData.LeakDetected,
+			"smoke_detected":  roomData.SmokeDetected,
+			"open_contacts":   len(roomData.OpenContacts),
 			"is_online":       roomData.IsOnline,
+			"closed":          closed,
 			"last_seen":       roomData.LastSeen.Format(time.RFC3339),
 		}
 		rooms = append(rooms, roomInfo)
 	}
 
-	if onlineCount > 0 {
-		avgTemp = avgTemp / float64(onlineCount)
-		avgHumidity = avgHumidity / float64(onlineCount)
-		avgLight = avgLight / float64(onlineCount)
+	if averagedCount > 0 {
+		avgTemp = avgTemp / float64(averagedCount)
+		avgHumidity = avgHumidity / float64(averagedCount)
+		avgLight = avgLight / float64(averagedCount)
 	}
 
 	summary["online_devices"] = onlineCount
 	summary["occupied_rooms"] = occupiedCount
+	summary["closed_rooms"] = closedCount
 	summary["average_temperature"] = avgTemp
 	summary["average_humidity"] = avgHumidity
 	summary["average_light_level"] = avgLight
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i]["room_id"].(string) < rooms[j]["room_id"].(string)
+	})
 	summary["rooms"] = rooms
 
 	return summary
 }
+
+// Handler serves the sensor summary with every room's latest readings as JSON
+func (uss *UnifiedSensorService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uss.GetSensorSummary())
+	})
+}
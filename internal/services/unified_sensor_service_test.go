@@ -2,6 +2,7 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -201,3 +202,84 @@ func TestDayNightCycle(t *testing.T) {
 		}
 	}
 }
+
+func TestRoomLimit(t *testing.T) {
+	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+
+	service := NewUnifiedSensorService(mqttClient, logger)
+	service.SetMaxRooms(2)
+
+	for _, roomID := range []string{"kitchen", "office", "garage"} {
+		payload, _ := json.Marshal(UnifiedSensorMessage{
+			Temperature: 70.0,
+			Room:        roomID,
+			Timestamp:   time.Now().Unix(),
+			DeviceID:    "pico-" + roomID,
+		})
+		err := service.handleTemperatureMessage("room-temp/"+roomID, payload)
+
+		if roomID == "garage" && err == nil {
+			t.Error("Expected reading for a third room to be rejected")
+		} else if roomID != "garage" && err != nil {
+			t.Errorf("Expected reading for %s to be accepted, got %v", roomID, err)
+		}
+	}
+
+	// Rooms that are already tracked keep updating
+	payload, _ := json.Marshal(UnifiedSensorMessage{Temperature: 71.0, Room: "kitchen", DeviceID: "pico-kitchen"})
+	if err := service.handleTemperatureMessage("room-temp/kitchen", payload); err != nil {
+		t.Errorf("Expected tracked room to keep updating, got %v", err)
+	}
+
+	summary := service.GetSensorSummary()
+	if summary["total_rooms"] != 2 || summary["rejected_rooms"] != 1 {
+		t.Errorf("Expected 2 tracked and 1 rejected room, got %v tracked and %v rejected",
+			summary["total_rooms"], summary["rejected_rooms"])
+	}
+}
+
+func TestHazardMessages(t *testing.T) {
+	logger := log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+	mqttClient := mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+
+	service := NewUnifiedSensorService(mqttClient, logger)
+	changes := make(chan string, 4)
+	service.AddHazardCallback(func(roomID string, hazard string, detected bool) {
+		changes <- fmt.Sprintf("%s/%s/%t", roomID, hazard, detected)
+	})
+
+	detected, clear := true, false
+	leak, _ := json.Marshal(UnifiedSensorMessage{Leak: &detected, Room: "utility", DeviceID: "leak-utility"})
+	for i := 0; i < 2; i++ { // The repeated report is a heartbeat
+		if err := service.handleLeakMessage("room-leak/utility", leak); err != nil {
+			t.Fatalf("Expected the leak report to be accepted, got %v", err)
+		}
+	}
+	smoke, _ := json.Marshal(UnifiedSensorMessage{Smoke: &clear, Room: "utility", DeviceID: "leak-utility"})
+	service.handleSmokeMessage("room-smoke/utility", smoke)
+
+	select {
+	case change := <-changes:
+		if change != "utility/leak/true" {
+			t.Errorf("Expected the leak reported, got %s", change)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hazard callback was not called")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Errorf("Expected one hazard change, got %d more", len(changes))
+	}
+
+	roomData, _ := service.GetRoomSensorData("utility")
+	if !roomData.LeakDetected || roomData.SmokeDetected || roomData.LeakLastTime.IsZero() {
+		t.Errorf("Expected a leak and no smoke recorded, got %+v", roomData)
+	}
+
+	// A message without the detector state is rejected
+	empty, _ := json.Marshal(UnifiedSensorMessage{Room: "utility", DeviceID: "leak-utility"})
+	if err := service.handleSmokeMessage("room-smoke/utility", empty); err == nil {
+		t.Error("Expected a smoke message without a state to be rejected")
+	}
+}
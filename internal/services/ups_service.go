@@ -0,0 +1,415 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/nut"
+)
+
+const (
+	// States published on the gateway power topic
+	UPSStateMains     = "mains"
+	UPSStateBattery   = "battery"
+	UPSStateGoingDown = "going_down"
+
+	defaultUPSPoll            = 10 * time.Second
+	defaultUPSShedCharge      = 50
+	defaultUPSShutdownCharge  = 20
+	defaultUPSShutdownRuntime = 5 * time.Minute
+)
+
+// UPSConfig configures the UPS the gateway runs on. Non-critical loads are shed once the battery
+// drops to ShedCharge, and the gateway shuts down at ShutdownCharge, at ShutdownRuntimeSeconds of
+// runtime left or when the UPS reports a low battery, whichever comes first.
+type UPSConfig struct {
+	Address                string   `json:"address,omitempty"` // upsd, default localhost:3493
+	UPS                    string   `json:"ups"`               // UPS name in ups.conf
+	PollSeconds            int      `json:"poll_seconds,omitempty"`
+	ShedLoads              []string `json:"shed_loads,omitempty"`               // Devices switched off on battery
+	ShedCharge             float64  `json:"shed_charge,omitempty"`              // %, default 50
+	ShutdownCharge         float64  `json:"shutdown_charge,omitempty"`          // %, default 20
+	ShutdownRuntimeSeconds int      `json:"shutdown_runtime_seconds,omitempty"` // Default 300
+}
+
+// LoadUPSConfig reads the UPS configuration from a JSON file
+func LoadUPSConfig(path string) (*UPSConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read UPS file", err)
+	}
+
+	var cfg UPSConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse UPS file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that the UPS is named and the charge thresholds are in order
+func (c *UPSConfig) Validate() error {
+	if c.UPS == "" {
+		return errors.NewValidationError("the UPS needs a name", nil)
+	}
+	if c.PollSeconds < 0 || c.ShutdownRuntimeSeconds < 0 {
+		return errors.NewValidationError("poll_seconds and shutdown_runtime_seconds must not be negative", nil)
+	}
+	if c.ShedCharge < 0 || c.ShedCharge > 100 || c.ShutdownCharge < 0 || c.ShutdownCharge > 100 {
+		return errors.NewValidationError("charges must be between 0 and 100", nil)
+	}
+	if c.ShedCharge > 0 && c.ShutdownCharge > 0 && c.ShedCharge < c.ShutdownCharge {
+		return errors.NewValidationError("shed_charge must not be below shutdown_charge", nil)
+	}
+	return nil
+}
+
+// UPSReader reads the state of a UPS; nut.Client implements it
+type UPSReader interface {
+	Status(ctx context.Context, ups string) (nut.Status, error)
+}
+
+// UPSShutdownRecorder keeps a UPS shutdown for the next start; PowerRestoreService implements it
+type UPSShutdownRecorder interface {
+	RecordUPSShutdown(at time.Time, reason string) error
+}
+
+// upsHook persists state before the gateway goes down
+type upsHook struct {
+	name string
+	save func() error
+}
+
+// UPSServiceStatus reports the last UPS reading and what the service did about it
+type UPSServiceStatus struct {
+	UPS            string      `json:"ups"`
+	State          string      `json:"state"`
+	Status         *nut.Status `json:"status,omitempty"`
+	LastPoll       time.Time   `json:"last_poll,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	Shed           bool        `json:"shed"`
+	BatterySince   time.Time   `json:"battery_since,omitempty"`
+	ShutdownAt     time.Time   `json:"shutdown_at,omitempty"`
+	ShutdownReason string      `json:"shutdown_reason,omitempty"`
+}
+
+// UPSService watches the UPS through NUT and coordinates an orderly shutdown as the battery
+// depletes: state is persisted, a retained "going down" message is published on the gateway
+// power topic, non-critical loads are switched off and the shutdown is recorded for the power
+// restoration routine. Switching off the host is left to upsmon.
+type UPSService struct {
+	config          *UPSConfig
+	reader          UPSReader
+	poll            time.Duration
+	shedCharge      float64
+	shutdownCharge  float64
+	shutdownRuntime time.Duration
+	devices         CommandExecutor
+	mqttClient      *mqtt.Client
+	recorder        UPSShutdownRecorder
+	hooks           []upsHook
+	shutdown        func()
+	safeMode        *safemode.Controller
+	dryRun          *dryrun.Recorder
+	status          UPSServiceStatus
+	logger          *logger.Logger
+	mu              sync.Mutex
+}
+
+// NewUPSService creates the UPS coordinator
+func NewUPSService(cfg *UPSConfig, reader UPSReader, serviceLogger *logger.Logger) *UPSService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("UPSService", nil)
+	}
+
+	service := &UPSService{
+		config:          cfg,
+		reader:          reader,
+		poll:            defaultUPSPoll,
+		shedCharge:      defaultUPSShedCharge,
+		shutdownCharge:  defaultUPSShutdownCharge,
+		shutdownRuntime: defaultUPSShutdownRuntime,
+		status:          UPSServiceStatus{UPS: cfg.UPS},
+		logger:          serviceLogger,
+	}
+	if cfg.PollSeconds > 0 {
+		service.poll = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	if cfg.ShedCharge > 0 {
+		service.shedCharge = cfg.ShedCharge
+	}
+	if cfg.ShutdownCharge > 0 {
+		service.shutdownCharge = cfg.ShutdownCharge
+	}
+	if cfg.ShutdownRuntimeSeconds > 0 {
+		service.shutdownRuntime = time.Duration(cfg.ShutdownRuntimeSeconds) * time.Second
+	}
+	return service
+}
+
+// SetCommandExecutor switches the non-critical loads through a device or MQTT device service
+func (s *UPSService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetMQTTClient attaches the client the gateway power state is published with
+func (s *UPSService) SetMQTTClient(client *mqtt.Client) {
+	s.mqttClient = client
+}
+
+// SetShutdownRecorder records the shutdown for the power restoration routine
+func (s *UPSService) SetShutdownRecorder(recorder UPSShutdownRecorder) {
+	s.recorder = recorder
+}
+
+// SetShutdownFunc sets what stops the service once the shutdown is prepared, usually cancelling
+// the main context
+func (s *UPSService) SetShutdownFunc(shutdown func()) {
+	s.shutdown = shutdown
+}
+
+// AddShutdownHook registers state to persist before the gateway goes down
+func (s *UPSService) AddShutdownHook(name string, save func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, upsHook{name: name, save: save})
+}
+
+// SetSafeMode holds back load shedding while safe mode is active
+func (s *UPSService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder records load shedding instead of sending it in observe-only mode
+func (s *UPSService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// Run polls the UPS until the context is cancelled
+func (s *UPSService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	for {
+		s.check(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check reads the UPS and acts on its state
+func (s *UPSService) check(ctx context.Context, now time.Time) {
+	pollCtx, cancel := context.WithTimeout(ctx, s.poll)
+	status, err := s.reader.Status(pollCtx, s.config.UPS)
+	cancel()
+
+	s.mu.Lock()
+	s.status.LastPoll = now
+	if err != nil {
+		// An unreachable upsd is no reason to act; upsmon shuts the host down if it must
+		if s.status.Error == "" {
+			s.logger.Error("Failed to read UPS", err, map[string]interface{}{"ups": s.config.UPS})
+		}
+		s.status.Error = err.Error()
+		s.mu.Unlock()
+		return
+	}
+	s.status.Error = ""
+	s.status.Status = &status
+	s.mu.Unlock()
+
+	s.handleStatus(status, now)
+}
+
+// handleStatus follows the UPS between mains and battery, shedding loads and shutting down
+// as the battery depletes
+func (s *UPSService) handleStatus(status nut.Status, now time.Time) {
+	s.mu.Lock()
+	if !s.status.ShutdownAt.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+
+	previous := s.status.State
+	state := UPSStateMains
+	if status.OnBattery {
+		state = UPSStateBattery
+	}
+	s.status.State = state
+
+	var shed, restore bool
+	reason := ""
+	switch {
+	case state == UPSStateMains:
+		if previous == UPSStateBattery {
+			s.logger.Info("UPS back on mains", map[string]interface{}{"ups": s.config.UPS, "charge": status.Charge})
+		}
+		s.status.BatterySince = time.Time{}
+		restore = s.status.Shed
+		s.status.Shed = false
+	default:
+		if previous != UPSStateBattery {
+			s.status.BatterySince = now
+			s.logger.Warn("UPS on battery", map[string]interface{}{"ups": s.config.UPS, "charge": status.Charge, "runtime_sec": status.RuntimeSec})
+		}
+		reason = s.shutdownReason(status)
+		if !s.status.Shed && reason == "" && status.Charge >= 0 && status.Charge <= s.shedCharge {
+			shed = true
+			s.status.Shed = true
+		}
+	}
+	s.mu.Unlock()
+
+	if reason != "" {
+		s.goDown(status, reason, now)
+		return
+	}
+	if state != previous {
+		s.publish(state, status, "", now)
+	}
+	if shed {
+		s.switchLoads(false, fmt.Sprintf("UPS battery at %.0f%%", status.Charge))
+	}
+	if restore {
+		s.switchLoads(true, "UPS back on mains")
+	}
+}
+
+// shutdownReason returns why the gateway must go down now, or "" while the battery lasts
+func (s *UPSService) shutdownReason(status nut.Status) string {
+	switch {
+	case status.Shutdown:
+		return "forced shutdown"
+	case status.LowBattery:
+		return "low battery"
+	case status.Charge >= 0 && status.Charge <= s.shutdownCharge:
+		return fmt.Sprintf("battery at %.0f%%", status.Charge)
+	case status.RuntimeSec >= 0 && time.Duration(status.RuntimeSec)*time.Second <= s.shutdownRuntime:
+		return fmt.Sprintf("%.0f s of runtime left", status.RuntimeSec)
+	}
+	return ""
+}
+
+// goDown persists state, announces the shutdown, switches off the non-critical loads and records
+// the shutdown for the restoration routine before stopping
+func (s *UPSService) goDown(status nut.Status, reason string, now time.Time) {
+	s.mu.Lock()
+	s.status.State = UPSStateGoingDown
+	s.status.ShutdownAt = now
+	s.status.ShutdownReason = reason
+	s.status.Shed = true
+	hooks := append([]upsHook{}, s.hooks...)
+	s.mu.Unlock()
+
+	s.logger.Warn("UPS battery depleting, shutting down", map[string]interface{}{"ups": s.config.UPS, "reason": reason})
+
+	for _, hook := range hooks {
+		if err := hook.save(); err != nil {
+			s.logger.Error("Failed to persist state before shutdown", err, map[string]interface{}{"hook": hook.name})
+		}
+	}
+
+	s.publish(UPSStateGoingDown, status, reason, now)
+	s.switchLoads(false, "gateway shutting down on UPS: "+reason)
+
+	if s.recorder != nil {
+		if err := s.recorder.RecordUPSShutdown(now, reason); err != nil {
+			s.logger.Error("Failed to record UPS shutdown", err)
+		}
+	}
+
+	if s.shutdown != nil {
+		s.shutdown()
+	}
+}
+
+// publish announces the gateway power state as a retained message
+func (s *UPSService) publish(state string, status nut.Status, reason string, now time.Time) {
+	if s.mqttClient == nil {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"state":       state,
+		"ups":         s.config.UPS,
+		"charge":      status.Charge,
+		"runtime_sec": status.RuntimeSec,
+		"reason":      reason,
+		"timestamp":   now.Unix(),
+	})
+	if err != nil {
+		return
+	}
+	message := &mqtt.Message{Topic: mqtt.GatewayTopic("power"), Payload: payload, QoS: 1, Retain: true}
+	if err := s.mqttClient.Publish(message); err != nil {
+		s.logger.Error("Failed to publish gateway power state", err, map[string]interface{}{"state": state})
+	}
+}
+
+// switchLoads switches the non-critical loads off on battery, or back on when mains returns
+func (s *UPSService) switchLoads(on bool, reason string) {
+	if len(s.config.ShedLoads) == 0 {
+		return
+	}
+	action := "turn_off"
+	if on {
+		action = "turn_on"
+	}
+	if !s.safeMode.Allowed(safemode.ComponentAutomation, "ups") {
+		s.logger.Info("Safe mode active, not switching UPS loads", map[string]interface{}{"action": action})
+		return
+	}
+
+	for _, deviceID := range s.config.ShedLoads {
+		if s.dryRun.ObserveOnly() {
+			s.dryRun.Record("ups", action, deviceID, reason, nil)
+			continue
+		}
+
+		var err error
+		if s.devices == nil {
+			err = errors.NewServiceError("no device service to switch "+deviceID, nil)
+		} else {
+			err = s.devices.ExecuteCommand(&models.DeviceCommand{DeviceID: deviceID, Action: action,
+				Options: map[string]interface{}{"automation": "ups", "reason": reason}})
+		}
+		if err != nil {
+			s.logger.Error("Failed to switch UPS load", err, map[string]interface{}{"device_id": deviceID, "action": action})
+			continue
+		}
+		s.logger.Info("Switched UPS load", map[string]interface{}{"device_id": deviceID, "action": action, "reason": reason})
+	}
+}
+
+// Status returns the last UPS reading and the actions taken
+func (s *UPSService) Status() UPSServiceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Handler serves the UPS status as JSON
+func (s *UPSService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
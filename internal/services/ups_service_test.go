@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/pkg/nut"
+)
+
+type fakeUPS struct {
+	status nut.Status
+}
+
+func (f *fakeUPS) Status(ctx context.Context, ups string) (nut.Status, error) {
+	return f.status, nil
+}
+
+type recordingShutdown struct {
+	reasons []string
+}
+
+func (r *recordingShutdown) RecordUPSShutdown(at time.Time, reason string) error {
+	r.reasons = append(r.reasons, reason)
+	return nil
+}
+
+func TestUPSShutdownCoordination(t *testing.T) {
+	ups := &fakeUPS{}
+	executor := &recordingExecutor{}
+	recorder := &recordingShutdown{}
+	service := NewUPSService(&UPSConfig{UPS: "gateway", ShedLoads: []string{"aquarium-heater"}}, ups, nil)
+	service.SetCommandExecutor(executor)
+	service.SetShutdownRecorder(recorder)
+
+	var steps []string
+	service.AddShutdownHook("schedules", func() error {
+		steps = append(steps, "saved")
+		return nil
+	})
+	service.SetShutdownFunc(func() { steps = append(steps, "stopped") })
+
+	at := time.Date(2024, 3, 9, 7, 0, 0, 0, time.UTC)
+	poll := func(status nut.Status) []string {
+		ups.status = status
+		service.check(context.Background(), at)
+		at = at.Add(time.Minute)
+		return executor.take()
+	}
+
+	if commands := poll(nut.Status{Charge: 100, RuntimeSec: 1800}); len(commands) != 0 {
+		t.Errorf("Expected nothing on mains, got %v", commands)
+	}
+	if commands := poll(nut.Status{OnBattery: true, Charge: 80, RuntimeSec: 1500}); len(commands) != 0 {
+		t.Errorf("Expected the loads kept on a full battery, got %v", commands)
+	}
+	if commands := poll(nut.Status{OnBattery: true, Charge: 45, RuntimeSec: 900}); len(commands) != 1 || commands[0] != "turn_off aquarium-heater" {
+		t.Errorf("Expected the load shed at 45%%, got %v", commands)
+	}
+	if commands := poll(nut.Status{Charging: true, Charge: 46, RuntimeSec: 900}); len(commands) != 1 || commands[0] != "turn_on aquarium-heater" {
+		t.Errorf("Expected the load back on with mains, got %v", commands)
+	}
+
+	// A low battery flag shuts down even before the configured charge is reached
+	poll(nut.Status{OnBattery: true, Charge: 40, RuntimeSec: 600})
+	if commands := poll(nut.Status{OnBattery: true, LowBattery: true, Charge: 35, RuntimeSec: 600}); len(commands) != 1 || commands[0] != "turn_off aquarium-heater" {
+		t.Errorf("Expected the loads off on shutdown, got %v", commands)
+	}
+	if len(steps) != 2 || steps[0] != "saved" || steps[1] != "stopped" {
+		t.Errorf("Expected state saved before stopping, got %v", steps)
+	}
+	if len(recorder.reasons) != 1 || recorder.reasons[0] != "low battery" {
+		t.Errorf("Expected the shutdown recorded, got %v", recorder.reasons)
+	}
+	if status := service.Status(); status.State != UPSStateGoingDown || status.ShutdownReason != "low battery" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// Nothing more happens once the shutdown has started
+	poll(nut.Status{OnBattery: true, Charge: 10, RuntimeSec: 60})
+	if len(steps) != 2 || len(recorder.reasons) != 1 {
+		t.Error("Expected a single shutdown")
+	}
+}
+
+func TestUPSShutdownReason(t *testing.T) {
+	service := NewUPSService(&UPSConfig{UPS: "gateway", ShutdownCharge: 25, ShutdownRuntimeSeconds: 120}, &fakeUPS{}, nil)
+	tests := map[string]nut.Status{
+		"":                     {OnBattery: true, Charge: 60, RuntimeSec: 900},
+		"battery at 25%":       {OnBattery: true, Charge: 25, RuntimeSec: 900},
+		"90 s of runtime left": {OnBattery: true, Charge: 60, RuntimeSec: 90},
+		"forced shutdown":      {OnBattery: true, Shutdown: true, Charge: -1, RuntimeSec: -1},
+		"low battery":          {OnBattery: true, LowBattery: true, Charge: -1, RuntimeSec: -1},
+	}
+	for want, status := range tests {
+		if got := service.shutdownReason(status); got != want {
+			t.Errorf("%+v: expected %q, got %q", status, want, got)
+		}
+	}
+
+	if err := (&UPSConfig{UPS: "gateway", ShedCharge: 10, ShutdownCharge: 20}).Validate(); err == nil {
+		t.Error("Expected shedding below the shutdown charge to be rejected")
+	}
+}
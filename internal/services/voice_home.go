@@ -0,0 +1,107 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/voice"
+	"github.com/johnpr01/home-automation/pkg/esphome"
+)
+
+// VoiceHome exposes the thermostats and the Tasmota/ESPHome plugs and lights to voice assistants
+type VoiceHome struct {
+	thermostats *ThermostatService
+	devices     *MQTTDeviceService
+}
+
+// NewVoiceHome creates a voice assistant controller; either service may be nil
+func NewVoiceHome(thermostats *ThermostatService, devices *MQTTDeviceService) *VoiceHome {
+	return &VoiceHome{thermostats: thermostats, devices: devices}
+}
+
+// Devices lists the thermostats and DIY devices, thermostats first
+func (h *VoiceHome) Devices() []voice.Device {
+	var devices []voice.Device
+	if h.thermostats != nil {
+		thermostats := make(map[string]*models.Thermostat)
+		for _, thermostat := range h.thermostats.GetAllThermostats() {
+			thermostats[thermostat.ID] = thermostat
+		}
+		for _, id := range sortedKeys(thermostats) {
+			thermostat := thermostats[id]
+			devices = append(devices, voice.Device{
+				ID:          thermostat.ID,
+				Name:        thermostat.Name,
+				RoomID:      thermostat.RoomID,
+				Kind:        voice.KindThermostat,
+				Online:      thermostat.IsOnline,
+				Mode:        thermostat.Mode,
+				TargetTemp:  thermostat.TargetTemp,
+				CurrentTemp: thermostat.CurrentTemp,
+				Humidity:    thermostat.CurrentHumidity,
+				MinTemp:     thermostat.MinTemp,
+				MaxTemp:     thermostat.MaxTemp,
+			})
+		}
+	}
+
+	if h.devices != nil {
+		for _, status := range h.devices.Devices() {
+			devices = append(devices, voice.Device{
+				ID:     status.DeviceID,
+				Name:   status.DeviceName,
+				RoomID: status.RoomID,
+				Kind:   h.deviceKind(status.DeviceID),
+				Online: status.Online,
+				On:     status.On,
+			})
+		}
+	}
+	return devices
+}
+
+// deviceKind tells ESPHome lights from plugs; Tasmota devices are treated as plugs
+func (h *VoiceHome) deviceKind(deviceID string) string {
+	h.devices.mu.RLock()
+	defer h.devices.mu.RUnlock()
+
+	if config := h.devices.configs[deviceID]; config.Firmware == FirmwareESPHome && config.Component == esphome.ComponentLight {
+		return voice.KindLight
+	}
+	return voice.KindPlug
+}
+
+// SetPower switches a plug or light through its firmware
+func (h *VoiceHome) SetPower(deviceID string, on bool) error {
+	if h.devices == nil {
+		return errors.NewValidationError(fmt.Sprintf("device %s not found", deviceID), nil)
+	}
+	action := "turn_off"
+	if on {
+		action = "turn_on"
+	}
+	return h.devices.ExecuteCommand(&models.DeviceCommand{DeviceID: deviceID, Action: action})
+}
+
+// SetTargetTemperature changes a thermostat's setpoint
+func (h *VoiceHome) SetTargetTemperature(deviceID string, tempF float64) error {
+	if h.thermostats == nil {
+		return errors.NewValidationError(fmt.Sprintf("thermostat %s not found", deviceID), nil)
+	}
+	if err := h.thermostats.SetTargetTemperature(deviceID, tempF); err != nil {
+		return errors.NewValidationError("failed to set target temperature", err)
+	}
+	return nil
+}
+
+// SetThermostatMode changes a thermostat's mode
+func (h *VoiceHome) SetThermostatMode(deviceID string, mode models.ThermostatMode) error {
+	if h.thermostats == nil {
+		return errors.NewValidationError(fmt.Sprintf("thermostat %s not found", deviceID), nil)
+	}
+	if err := h.thermostats.SetMode(deviceID, mode); err != nil {
+		return errors.NewValidationError("failed to set thermostat mode", err)
+	}
+	return nil
+}
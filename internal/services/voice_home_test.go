@@ -0,0 +1,43 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/voice"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestVoiceHomeDevices(t *testing.T) {
+	thermostats := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), logger.NewLogger("voice-test", nil))
+	thermostats.RegisterThermostat(&models.Thermostat{ID: "hall", RoomID: "hall", Mode: models.ModeHeat, TargetTemp: 68, MinTemp: 50, MaxTemp: 85})
+
+	devices := NewMQTTDeviceService(nil, nil, nil)
+	if err := devices.AddDevice(MQTTDeviceConfig{DeviceID: "kettle", RoomID: "kitchen", Firmware: FirmwareTasmota, Topic: "kettle"}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if err := devices.AddDevice(MQTTDeviceConfig{DeviceID: "strip", RoomID: "office", Firmware: FirmwareESPHome, Topic: "strip-node", Component: "light", ObjectID: "strip"}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+
+	home := NewVoiceHome(thermostats, devices)
+	kinds := map[string]string{}
+	for _, device := range home.Devices() {
+		kinds[device.ID] = device.Kind
+	}
+	if kinds["hall"] != voice.KindThermostat || kinds["kettle"] != voice.KindPlug || kinds["strip"] != voice.KindLight {
+		t.Errorf("Unexpected device kinds %v", kinds)
+	}
+
+	if err := home.SetTargetTemperature("hall", 90); err == nil {
+		t.Error("Expected a setpoint out of range rejected")
+	}
+	if err := home.SetThermostatMode("hall", models.ModeCool); err != nil {
+		t.Errorf("SetThermostatMode failed: %v", err)
+	}
+	if thermostat, _ := thermostats.GetThermostat("hall"); thermostat.Mode != models.ModeCool {
+		t.Errorf("Expected the thermostat cooling, got %s", thermostat.Mode)
+	}
+}
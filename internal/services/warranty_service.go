@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/i18n"
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// WarrantyRemindersFileName keeps the warranty expiries already reminded of, so a restart
+// doesn't remind again
+const WarrantyRemindersFileName = "warranty-reminders.json"
+
+// WarrantyRemindersPath returns the reminders file path for a state directory
+func WarrantyRemindersPath(stateDir string) string {
+	return filepath.Join(stateDir, WarrantyRemindersFileName)
+}
+
+// WarrantyReminderService notifies once per device when its warranty is about to end, so a
+// faulty device can still be claimed under warranty. Asset records are set with the CLI.
+type WarrantyReminderService struct {
+	registry *identity.Registry
+	lead     time.Duration
+	path     string
+	reminded map[string]string // Warranty end date reminded of, per device UUID
+	publish  func(msg *mqtt.Message) error
+	logger   *logger.Logger
+	mu       sync.Mutex
+}
+
+// NewWarrantyReminderService creates a service reminding leadDays before warranties end
+func NewWarrantyReminderService(registry *identity.Registry, leadDays int, path string, serviceLogger *logger.Logger) *WarrantyReminderService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("WarrantyReminders", nil)
+	}
+
+	service := &WarrantyReminderService{
+		registry: registry,
+		lead:     time.Duration(leadDays) * 24 * time.Hour,
+		path:     path,
+		reminded: make(map[string]string),
+		logger:   serviceLogger,
+	}
+
+	if path != "" {
+		if err := service.load(); err != nil {
+			serviceLogger.Error("Failed to load warranty reminders, reminding again", err)
+		}
+	}
+	return service
+}
+
+// SetMQTTClient publishes the reminders on the notification topic
+func (s *WarrantyReminderService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// Run checks the warranties every hour until the context is cancelled
+func (s *WarrantyReminderService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	s.check(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.check(now)
+		}
+	}
+}
+
+func (s *WarrantyReminderService) check(now time.Time) {
+	if err := s.Check(now); err != nil {
+		s.logger.Error("Failed to check warranties", err)
+	}
+}
+
+// Check reminds of every warranty ending within the lead time that hasn't been reminded of.
+// A device whose purchase date or warranty changes is reminded of its new end date.
+func (s *WarrantyReminderService) Check(now time.Time) error {
+	// Asset records are set by the CLI in another process
+	if err := s.registry.Reload(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, device := range s.registry.ExpiringWarranties(now, s.lead) {
+		expires, _ := device.Asset.WarrantyExpires()
+		date := expires.Format(identity.AssetDateFormat)
+		if s.reminded[device.UUID] == date {
+			continue
+		}
+		if err := s.notify(device, expires, now); err != nil {
+			s.logger.Error("Failed to publish warranty reminder", err, map[string]interface{}{"device_uuid": device.UUID})
+			continue
+		}
+		s.reminded[device.UUID] = date
+		changed = true
+	}
+
+	if !changed || s.path == "" {
+		return nil
+	}
+	return s.save()
+}
+
+// notify publishes a reminder that a device's warranty ends soon
+func (s *WarrantyReminderService) notify(device identity.Identity, expires, now time.Time) error {
+	days := int(expires.Sub(now).Hours()/24) + 1
+	message := i18n.T("warranty.ending", device.Name, expires.Format(identity.AssetDateFormat), days)
+	if device.Asset.ManualURL != "" {
+		message = i18n.T("warranty.ending.manual", device.Name, expires.Format(identity.AssetDateFormat), days, device.Asset.ManualURL)
+	}
+	s.logger.Info("Warranty ending", map[string]interface{}{
+		"device_uuid": device.UUID,
+		"device_name": device.Name,
+		"expires":     expires.Format(identity.AssetDateFormat),
+	})
+	if s.publish == nil {
+		return nil
+	}
+
+	notification, err := localizedNotification(map[string]interface{}{
+		"source":      "warranty",
+		"severity":    "info",
+		"device_uuid": device.UUID,
+		"expires":     expires.Format(identity.AssetDateFormat),
+		"timestamp":   now.Unix(),
+	}, i18n.T("warranty.title", device.Name), message)
+	if err != nil {
+		return err
+	}
+	return s.publish(&mqtt.Message{Topic: NotificationTopic, Payload: notification, QoS: 1})
+}
+
+func (s *WarrantyReminderService) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.NewSystemError("failed to read warranty reminders", err)
+	}
+
+	reminded := make(map[string]string)
+	if err := json.Unmarshal(data, &reminded); err != nil {
+		return errors.NewSystemError("failed to parse warranty reminders", err)
+	}
+	s.reminded = reminded
+	return nil
+}
+
+// save atomically writes the reminders; callers must hold the lock
+func (s *WarrantyReminderService) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(s.reminded, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal warranty reminders", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write warranty reminders", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace warranty reminders", err)
+	}
+	return nil
+}
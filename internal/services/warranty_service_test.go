@@ -0,0 +1,47 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/identity"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestWarrantyReminders(t *testing.T) {
+	dir := t.TempDir()
+	registry, _ := identity.NewRegistry(identity.RegistryPath(dir))
+	fridge, _ := registry.Claim("Fridge Plug", identity.NewAlias(identity.AliasDeviceID, "fridge_plug"))
+	if err := registry.SetAsset(fridge.UUID, identity.Asset{PurchaseDate: "2023-03-15", WarrantyMonths: 24}); err != nil {
+		t.Fatalf("SetAsset failed: %v", err)
+	}
+
+	var published []map[string]interface{}
+	publish := func(msg *mqtt.Message) error {
+		var notification map[string]interface{}
+		json.Unmarshal(msg.Payload, &notification)
+		published = append(published, notification)
+		return nil
+	}
+
+	service := NewWarrantyReminderService(registry, 30, WarrantyRemindersPath(dir), nil)
+	service.publish = publish
+
+	if service.Check(time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)); len(published) != 0 {
+		t.Fatalf("Expected no reminder 73 days ahead, got %v", published)
+	}
+	service.Check(time.Date(2025, 2, 20, 9, 0, 0, 0, time.UTC))
+	service.Check(time.Date(2025, 2, 21, 9, 0, 0, 0, time.UTC))
+	if len(published) != 1 || published[0]["source"] != "warranty" || published[0]["expires"] != "2025-03-15" {
+		t.Fatalf("Expected one warranty reminder, got %v", published)
+	}
+
+	// A restart doesn't remind again
+	restarted := NewWarrantyReminderService(registry, 30, WarrantyRemindersPath(dir), nil)
+	restarted.publish = publish
+	restarted.Check(time.Date(2025, 2, 22, 9, 0, 0, 0, time.UTC))
+	if len(published) != 1 {
+		t.Errorf("Expected no reminder after a restart, got %v", published)
+	}
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/weather"
+)
+
+// Defaults of the weather configuration
+const (
+	DefaultOutdoorRoomID          = "outdoor"
+	defaultWeatherPollMinutes     = 30
+	defaultPreheatBelowF          = 32.0
+	defaultPreheatF               = 2.0
+	defaultPreheatHours           = 6
+	defaultSkipCoolingHours       = 3
+	defaultSkipCoolingMarginF     = 5.0
+	defaultSkipCoolingMaxOverF    = 3.0
+	minWeatherStale               = 3 * time.Hour
+	weatherSensorType             = "weather"
+	weatherForecastDisplayedHours = 24
+)
+
+// WeatherConfig locates the house and sets how the forecast adjusts the thermostats
+type WeatherConfig struct {
+	Provider  string  `json:"provider,omitempty"` // metno (default) or openweathermap
+	APIKey    string  `json:"api_key,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"` // Met.no asks for an app name and contact
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// PollMinutes is how often the forecast is fetched, 30 by default
+	PollMinutes int `json:"poll_minutes,omitempty"`
+	// OutdoorRoomID is the virtual room the outdoor conditions are published for, "outdoor" by default
+	OutdoorRoomID string `json:"outdoor_room_id,omitempty"`
+
+	// Preheat raises heating targets by PreheatF when the forecast drops to PreheatBelowF
+	// within PreheatHours: 2°F, 32°F and 6 hours by default
+	Preheat       bool     `json:"preheat"`
+	PreheatBelowF *float64 `json:"preheat_below_f,omitempty"`
+	PreheatF      float64  `json:"preheat_f,omitempty"`
+	PreheatHours  int      `json:"preheat_hours,omitempty"`
+
+	// SkipCooling leaves cooling off when the outdoors will be SkipCoolingMarginF below the
+	// target within SkipCoolingHours, unless the room is more than SkipCoolingMaxOverF over it:
+	// 5°F, 3 hours and 3°F by default
+	SkipCooling         bool    `json:"skip_cooling"`
+	SkipCoolingHours    int     `json:"skip_cooling_hours,omitempty"`
+	SkipCoolingMarginF  float64 `json:"skip_cooling_margin_f,omitempty"`
+	SkipCoolingMaxOverF float64 `json:"skip_cooling_max_over_f,omitempty"`
+}
+
+// LoadWeatherConfig reads the weather configuration from a JSON file
+func LoadWeatherConfig(path string) (*WeatherConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read weather file", err)
+	}
+
+	var cfg WeatherConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse weather file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the location, the provider and the adjustments
+func (c *WeatherConfig) Validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return errors.NewValidationError("latitude and longitude are out of range", nil)
+	}
+	if c.Latitude == 0 && c.Longitude == 0 {
+		return errors.NewValidationError("latitude and longitude are required", nil)
+	}
+	if _, err := weather.New(c.Provider, c.APIKey, c.UserAgent); err != nil {
+		return errors.NewValidationError(err.Error(), nil)
+	}
+	if c.PollMinutes < 0 || c.PreheatHours < 0 || c.SkipCoolingHours < 0 {
+		return errors.NewValidationError("poll_minutes, preheat_hours and skip_cooling_hours must not be negative", nil)
+	}
+	if c.PreheatF < 0 || c.PreheatF > 5 {
+		return errors.NewValidationError("preheat_f must be between 0 and 5", nil)
+	}
+	if c.SkipCoolingMarginF < 0 || c.SkipCoolingMaxOverF < 0 {
+		return errors.NewValidationError("skip_cooling_margin_f and skip_cooling_max_over_f must not be negative", nil)
+	}
+	return nil
+}
+
+func (c *WeatherConfig) poll() time.Duration {
+	return time.Duration(positiveOr(c.PollMinutes, defaultWeatherPollMinutes)) * time.Minute
+}
+
+func (c *WeatherConfig) outdoorRoom() string {
+	if c.OutdoorRoomID != "" {
+		return c.OutdoorRoomID
+	}
+	return DefaultOutdoorRoomID
+}
+
+// positiveOr returns value, or fallback when it is unset
+func positiveOr(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func positiveOrF(value, fallback float64) float64 {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// WeatherService fetches the outdoor conditions and forecast, publishes them as the sensors of
+// a virtual outdoor room and adjusts the thermostats to the forecast
+type WeatherService struct {
+	config   *WeatherConfig
+	provider weather.Provider
+	publish  func(*mqtt.Message) error
+	logger   *logger.Logger
+	report   *weather.Report
+	lastErr  error
+	mu       sync.RWMutex
+}
+
+// NewWeatherService creates a weather service for a validated configuration
+func NewWeatherService(cfg *WeatherConfig, serviceLogger *logger.Logger) *WeatherService {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("WeatherService", nil)
+	}
+	provider, _ := weather.New(cfg.Provider, cfg.APIKey, cfg.UserAgent)
+
+	return &WeatherService{
+		config:   cfg,
+		provider: provider,
+		logger:   serviceLogger,
+	}
+}
+
+// SetMQTTClient sets the client outdoor readings are published with
+func (s *WeatherService) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		s.publish = nil
+		return
+	}
+	s.publish = client.Publish
+}
+
+// OutdoorRoom returns the virtual room of the outdoor conditions
+func (s *WeatherService) OutdoorRoom() string {
+	return s.config.outdoorRoom()
+}
+
+// OutdoorTemperature returns the current outdoor temperature, if the report isn't stale
+func (s *WeatherService) OutdoorTemperature(now time.Time) (float64, bool) {
+	report := s.Report(now)
+	if report == nil {
+		return 0, false
+	}
+	return report.Current.TemperatureF, true
+}
+
+// Run fetches the weather at the poll interval until ctx is done
+func (s *WeatherService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.poll())
+	defer ticker.Stop()
+
+	s.Refresh(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh fetches the weather and publishes the outdoor conditions. A failed fetch keeps the
+// previous report until it goes stale.
+func (s *WeatherService) Refresh(ctx context.Context) error {
+	report, err := s.provider.Fetch(ctx, s.config.Latitude, s.config.Longitude)
+
+	s.mu.Lock()
+	failing := s.lastErr != nil
+	s.lastErr = err
+	if err == nil {
+		s.report = report
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		if !failing {
+			s.logger.Error("Failed to fetch the weather", err, map[string]interface{}{
+				"provider": s.config.Provider,
+			})
+		}
+		return err
+	}
+	if failing {
+		s.logger.Info("Weather fetch recovered")
+	}
+
+	s.publishOutdoor(report)
+	return nil
+}
+
+// Report returns the latest weather report, or nil before the first fetch or once it is stale
+func (s *WeatherService) Report(now time.Time) *weather.Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stale := 3 * s.config.poll()
+	if stale < minWeatherStale {
+		stale = minWeatherStale
+	}
+	if s.report == nil || now.Sub(s.report.FetchedAt) > stale {
+		return nil
+	}
+	return s.report
+}
+
+// Adjustment works out how the forecast changes a thermostat's control at now; nil leaves it
+// unchanged
+func (s *WeatherService) Adjustment(thermostat models.Thermostat, now time.Time) *models.WeatherAdjustment {
+	report := s.Report(now)
+	if report == nil {
+		return nil
+	}
+
+	cfg := s.config
+	adjustment := &models.WeatherAdjustment{}
+
+	heating := thermostat.HeatingEnabled && (thermostat.Mode == models.ModeHeat || thermostat.Mode == models.ModeAuto)
+	if cfg.Preheat && heating {
+		belowF := defaultPreheatBelowF
+		if cfg.PreheatBelowF != nil {
+			belowF = *cfg.PreheatBelowF
+		}
+		hours := time.Duration(positiveOr(cfg.PreheatHours, defaultPreheatHours)) * time.Hour
+		if low, ok := report.Coldest(now, now.Add(hours)); ok && low.TemperatureF <= belowF {
+			adjustment.PreheatF = positiveOrF(cfg.PreheatF, defaultPreheatF)
+			adjustment.Reason = fmt.Sprintf("pre-heating for a low of %.0f°F at %s", low.TemperatureF, low.Time.Local().Format("15:04"))
+		}
+	}
+
+	cooling := thermostat.CoolingEnabled && (thermostat.Mode == models.ModeCool || thermostat.Mode == models.ModeAuto)
+	if cfg.SkipCooling && cooling && adjustment.PreheatF == 0 {
+		hours := time.Duration(positiveOr(cfg.SkipCoolingHours, defaultSkipCoolingHours)) * time.Hour
+		coolEnough := thermostat.TargetTemp - positiveOrF(cfg.SkipCoolingMarginF, defaultSkipCoolingMarginF)
+		maxOver := positiveOrF(cfg.SkipCoolingMaxOverF, defaultSkipCoolingMaxOverF)
+		low, ok := report.Coldest(now, now.Add(hours))
+		if ok && low.TemperatureF <= coolEnough && low.TemperatureF < report.Current.TemperatureF &&
+			thermostat.CurrentTemp <= thermostat.TargetTemp+maxOver {
+			adjustment.SkipCooling = true
+			adjustment.Reason = fmt.Sprintf("skipping cooling, outdoors drops to %.0f°F by %s", low.TemperatureF, low.Time.Local().Format("15:04"))
+		}
+	}
+
+	if adjustment.PreheatF == 0 && !adjustment.SkipCooling {
+		return nil
+	}
+	return adjustment
+}
+
+// Handler serves the outdoor conditions and the next day's forecast as JSON
+func (s *WeatherService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		report := s.Report(now)
+
+		s.mu.RLock()
+		lastErr := s.lastErr
+		s.mu.RUnlock()
+
+		response := map[string]interface{}{
+			"room_id":   s.OutdoorRoom(),
+			"timestamp": now,
+		}
+		if lastErr != nil {
+			response["error"] = lastErr.Error()
+		}
+		if report != nil {
+			var forecast []weather.Conditions
+			until := now.Add(weatherForecastDisplayedHours * time.Hour)
+			for _, point := range report.Forecast {
+				if !point.Time.Before(now.Add(-time.Hour)) && !point.Time.After(until) {
+					forecast = append(forecast, point)
+				}
+			}
+			response["provider"] = report.Provider
+			response["current"] = report.Current
+			response["forecast"] = forecast
+			response["fetched_at"] = report.FetchedAt
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// publishOutdoor publishes the current conditions as the outdoor room's temperature and humidity
+func (s *WeatherService) publishOutdoor(report *weather.Report) {
+	if s.publish == nil {
+		return
+	}
+
+	roomID := s.OutdoorRoom()
+	now := time.Now()
+	readings := []struct {
+		root    string
+		message UnifiedSensorMessage
+	}{
+		{mqtt.TopicRoomTemperature, UnifiedSensorMessage{Temperature: math.Round(report.Current.TemperatureF*10) / 10, TempUnit: "F"}},
+		{mqtt.TopicRoomHumidity, UnifiedSensorMessage{Humidity: math.Round(report.Current.Humidity), HumidityUnit: "%"}},
+	}
+	for _, reading := range readings {
+		message := reading.message
+		message.Room = roomID
+		message.Sensor = weatherSensorType
+		message.DeviceID = weatherSensorType + "-" + report.Provider
+		message.Timestamp = now.Unix()
+		payload, err := json.Marshal(message)
+		if err != nil {
+			continue
+		}
+
+		msg := (&mqtt.Message{Topic: mqtt.RoomTopic(reading.root, roomID), Payload: payload, QoS: 1}).
+			WithProperty(mqtt.PropertyDevice, message.DeviceID).WithProperty(mqtt.PropertyRoom, roomID)
+		if err := s.publish(msg); err != nil {
+			s.logger.Error("Failed to publish outdoor conditions", err, map[string]interface{}{
+				"topic": msg.Topic,
+			})
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+	"github.com/johnpr01/home-automation/pkg/weather"
+)
+
+// fakeWeather returns a fixed report
+type fakeWeather struct {
+	report *weather.Report
+	err    error
+}
+
+func (f *fakeWeather) Fetch(ctx context.Context, latitude, longitude float64) (*weather.Report, error) {
+	return f.report, f.err
+}
+
+func TestWeatherConfigValidate(t *testing.T) {
+	invalid := []WeatherConfig{
+		{},
+		{Latitude: 95, Longitude: 10},
+		{Latitude: 40, Longitude: -74, Provider: "openweathermap"},
+		{Latitude: 40, Longitude: -74, PreheatF: 8},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", cfg)
+		}
+	}
+
+	valid := WeatherConfig{Latitude: 40, Longitude: -74, Preheat: true, SkipCooling: true}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+}
+
+func TestWeatherServiceAdjustsThermostats(t *testing.T) {
+	now := time.Date(2024, 1, 10, 17, 0, 0, 0, time.UTC)
+	freezing := &weather.Report{
+		Provider:  weather.ProviderMetNo,
+		Current:   weather.Conditions{Time: now, TemperatureF: 38, Humidity: 70},
+		Forecast:  []weather.Conditions{{Time: now.Add(time.Hour), TemperatureF: 35}, {Time: now.Add(5 * time.Hour), TemperatureF: 24}},
+		FetchedAt: now,
+	}
+	provider := &fakeWeather{report: freezing}
+	service := NewWeatherService(&WeatherConfig{Latitude: 40, Longitude: -74, Preheat: true, SkipCooling: true}, nil)
+	service.provider = provider
+
+	var messages []*mqtt.Message
+	service.publish = func(msg *mqtt.Message) error {
+		messages = append(messages, msg)
+		return nil
+	}
+
+	thermostat := models.Thermostat{TargetTemp: 68, CurrentTemp: 67, Mode: models.ModeAuto, HeatingEnabled: true, CoolingEnabled: true}
+	if service.Adjustment(thermostat, now) != nil {
+		t.Fatal("Expected no adjustment before the first fetch")
+	}
+
+	if err := service.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Topic != "room-temp/outdoor" || messages[1].Topic != "room-hum/outdoor" {
+		t.Fatalf("Expected the outdoor room's temperature and humidity, got %d messages", len(messages))
+	}
+	var reading UnifiedSensorMessage
+	json.Unmarshal(messages[0].Payload, &reading)
+	if reading.Temperature != 38 || reading.Sensor != "weather" || reading.Room != "outdoor" {
+		t.Errorf("Unexpected outdoor reading %+v", reading)
+	}
+
+	adjustment := service.Adjustment(thermostat, now)
+	if adjustment == nil || adjustment.PreheatF != 2 || adjustment.SkipCooling {
+		t.Errorf("Expected 2°F of pre-heat for a night at 24°F, got %+v", adjustment)
+	}
+	thermostat.HeatingEnabled = false
+	if adjustment := service.Adjustment(thermostat, now); adjustment == nil || adjustment.PreheatF != 0 {
+		t.Errorf("Expected no pre-heat when heating is off, got %+v", adjustment)
+	}
+
+	// A warm afternoon that cools off in the evening
+	provider.report = &weather.Report{
+		Provider:  weather.ProviderMetNo,
+		Current:   weather.Conditions{Time: now, TemperatureF: 80},
+		Forecast:  []weather.Conditions{{Time: now.Add(time.Hour), TemperatureF: 74}, {Time: now.Add(2 * time.Hour), TemperatureF: 66}},
+		FetchedAt: now,
+	}
+	service.Refresh(context.Background())
+	thermostat = models.Thermostat{TargetTemp: 72, CurrentTemp: 74, Mode: models.ModeCool, CoolingEnabled: true}
+	if adjustment := service.Adjustment(thermostat, now); adjustment == nil || !adjustment.SkipCooling {
+		t.Errorf("Expected cooling skipped ahead of a cool evening, got %+v", adjustment)
+	}
+	thermostat.CurrentTemp = 76
+	if adjustment := service.Adjustment(thermostat, now); adjustment != nil {
+		t.Errorf("Expected cooling when the room is well over the target, got %+v", adjustment)
+	}
+
+	// A stale report stops adjusting
+	if service.Adjustment(models.Thermostat{TargetTemp: 72, CurrentTemp: 74, Mode: models.ModeCool, CoolingEnabled: true}, now.Add(4*time.Hour)) != nil {
+		t.Error("Expected a stale report to be ignored")
+	}
+}
+
+func TestThermostatServiceIgnoresOutdoorRoom(t *testing.T) {
+	service := NewThermostatService(mqtt.NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil), logger.NewLogger("test-thermostat", nil))
+	service.SetWeather(NewWeatherService(&WeatherConfig{Latitude: 40, Longitude: -74}, nil))
+
+	service.HandleTemperatureUpdate("outdoor", 30)
+	service.HandleTemperatureUpdate("kitchen", 70)
+	if _, err := service.GetThermostat("outdoor"); err == nil {
+		t.Error("Expected no thermostat for the outdoor room")
+	}
+	if _, err := service.GetThermostat("kitchen"); err != nil {
+		t.Errorf("Expected a thermostat for the kitchen: %v", err)
+	}
+}
@@ -0,0 +1,747 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/redact"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/internal/secrets"
+)
+
+const (
+	// HookPath is where inbound webhooks are POSTed, followed by the hook's ID, e.g.
+	// /api/hooks/deploy-finished
+	HookPath = "/api/hooks/"
+
+	// Results of webhook calls
+	WebhookResultOK     = "ok"
+	WebhookResultFailed = "failed"
+	WebhookResultTraced = "traced" // Recorded instead of run in observe-only mode
+
+	defaultWebhookTimeout = 10 * time.Second
+	maxHookBody           = 1 << 20
+	maxWebhookResponse    = 4096
+	webhookHistorySize    = 50
+)
+
+// WebhookHook runs its actions when its webhook is POSTed to /api/hooks/<id>. Device IDs,
+// actions, string values and options of its actions may be Go templates of the request, e.g.
+// "{{.payload.brightness}}"; a value that renders as a number or true or false is sent as one.
+type WebhookHook struct {
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name,omitempty"`
+	Secret   string                 `json:"secret"`             // Sent as X-Hook-Token or ?token=, or signing the body as X-Hub-Signature-256; may be a secret: reference
+	Actions  []models.DeviceCommand `json:"actions,omitempty"`  // Device commands, sent in order
+	Scene    string                 `json:"scene,omitempty"`    // Recalled before the actions
+	Webhooks []string               `json:"webhooks,omitempty"` // Outbound webhooks called after the actions
+	Cooldown int                    `json:"cooldown_seconds,omitempty"`
+	Disabled bool                   `json:"disabled,omitempty"`
+}
+
+// Webhook is an outbound webhook that hooks and alert rules call, e.g. an IFTTT applet or a CI
+// pipeline trigger. The URL, header values and body are Go templates of the event.
+type Webhook struct {
+	ID             string            `json:"id"`
+	URL            string            `json:"url"`
+	Method         string            `json:"method,omitempty"`  // POST by default
+	Headers        map[string]string `json:"headers,omitempty"` // Values may be secret: references
+	Body           string            `json:"body,omitempty"`    // The event as JSON when empty
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// WebhookConfig lists the inbound hooks and the outbound webhooks
+type WebhookConfig struct {
+	Hooks    []WebhookHook `json:"hooks"`
+	Webhooks []Webhook     `json:"webhooks"`
+}
+
+// LoadWebhookConfig reads the hooks and webhooks from a JSON file
+func LoadWebhookConfig(path string) (*WebhookConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read webhooks file", err)
+	}
+
+	var cfg WebhookConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse webhooks file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the IDs, that every hook has a secret and something to do, and that the
+// templates parse and the webhooks called exist
+func (c *WebhookConfig) Validate() error {
+	webhooks := make(map[string]bool)
+	for _, webhook := range c.Webhooks {
+		if webhook.ID == "" {
+			return errors.NewValidationError("every webhook needs an ID", nil)
+		}
+		if webhooks[webhook.ID] {
+			return errors.NewValidationError(fmt.Sprintf("webhook %s is defined twice", webhook.ID), nil)
+		}
+		webhooks[webhook.ID] = true
+
+		if webhook.URL == "" {
+			return errors.NewValidationError(fmt.Sprintf("webhook %s needs a url", webhook.ID), nil)
+		}
+		if webhook.TimeoutSeconds < 0 {
+			return errors.NewValidationError(fmt.Sprintf("webhook %s: timeout_seconds must not be negative", webhook.ID), nil)
+		}
+		switch strings.ToUpper(webhook.Method) {
+		case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			return errors.NewValidationError(fmt.Sprintf("webhook %s has unsupported method %q", webhook.ID, webhook.Method), nil)
+		}
+		texts := []string{webhook.URL, webhook.Body}
+		for _, value := range webhook.Headers {
+			texts = append(texts, value)
+		}
+		if err := checkTemplates("webhook "+webhook.ID, texts); err != nil {
+			return err
+		}
+	}
+
+	hooks := make(map[string]bool)
+	for _, hook := range c.Hooks {
+		if hook.ID == "" || strings.Contains(hook.ID, "/") {
+			return errors.NewValidationError(fmt.Sprintf("hook ID %q must be set and contain no /", hook.ID), nil)
+		}
+		if hooks[hook.ID] {
+			return errors.NewValidationError(fmt.Sprintf("hook %s is defined twice", hook.ID), nil)
+		}
+		hooks[hook.ID] = true
+
+		if hook.Secret == "" {
+			return errors.NewValidationError(fmt.Sprintf("hook %s needs a secret", hook.ID), nil)
+		}
+		if hook.Cooldown < 0 {
+			return errors.NewValidationError(fmt.Sprintf("hook %s: cooldown_seconds must not be negative", hook.ID), nil)
+		}
+		if len(hook.Actions) == 0 && hook.Scene == "" && len(hook.Webhooks) == 0 {
+			return errors.NewValidationError(fmt.Sprintf("hook %s needs actions, a scene or webhooks", hook.ID), nil)
+		}
+		var texts []string
+		for _, cmd := range hook.Actions {
+			if (cmd.DeviceID == "" && cmd.Tag == "") || cmd.Action == "" {
+				return errors.NewValidationError(fmt.Sprintf("hook %s has an action without a device_id or action", hook.ID), nil)
+			}
+			texts = append(texts, cmd.DeviceID, cmd.Action)
+			if value, ok := cmd.Value.(string); ok {
+				texts = append(texts, value)
+			}
+			for _, option := range cmd.Options {
+				if value, ok := option.(string); ok {
+					texts = append(texts, value)
+				}
+			}
+		}
+		if err := checkTemplates("hook "+hook.ID, texts); err != nil {
+			return err
+		}
+		for _, id := range hook.Webhooks {
+			if !webhooks[id] {
+				return errors.NewValidationError(fmt.Sprintf("hook %s calls unknown webhook %s", hook.ID, id), nil)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTemplates parses the templates of a hook or webhook
+func checkTemplates(owner string, texts []string) error {
+	for _, text := range texts {
+		if _, err := parseWebhookTemplate(text); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("%s has an invalid template %q", owner, text), err)
+		}
+	}
+	return nil
+}
+
+// parseWebhookTemplate parses a template; a missing field fails rather than rendering as <no value>
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+		"default": func(fallback, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return fallback
+			}
+			return value
+		},
+	}).Parse(text)
+}
+
+// renderTemplate renders a template of the event; text without a template is returned as is
+func renderTemplate(text string, event map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := parseWebhookTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, event); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderValue renders a string value, keeping numbers and true or false typed
+func renderValue(value interface{}, event map[string]interface{}) (interface{}, error) {
+	text, ok := value.(string)
+	if !ok || !strings.Contains(text, "{{") {
+		return value, nil
+	}
+	rendered, err := renderTemplate(text, event)
+	if err != nil {
+		return nil, err
+	}
+	var typed interface{}
+	if err := json.Unmarshal([]byte(rendered), &typed); err == nil {
+		switch typed.(type) {
+		case float64, bool:
+			return typed, nil
+		}
+	}
+	return rendered, nil
+}
+
+// WebhookCall is a recent hook trigger or webhook call
+type WebhookCall struct {
+	Kind   string    `json:"kind"` // hook or webhook
+	ID     string    `json:"id"`
+	Source string    `json:"source,omitempty"` // What called a webhook, e.g. hook:deploy or alert:freezer-warm
+	At     time.Time `json:"at"`
+	Result string    `json:"result"`
+	Status int       `json:"status,omitempty"` // HTTP status of a webhook call
+	Error  string    `json:"error,omitempty"`
+}
+
+// HookResult reports what a triggered hook did
+type HookResult struct {
+	Hook     string        `json:"hook"`
+	Actions  int           `json:"actions"`
+	Failed   int           `json:"failed"`
+	Webhooks []WebhookCall `json:"webhooks,omitempty"`
+	Traced   bool          `json:"traced,omitempty"` // Observe-only mode recorded the actions instead
+}
+
+// SceneRecaller recalls a saved scene; SceneService implements it
+type SceneRecaller interface {
+	Recall(name string) error
+}
+
+// WebhookService runs hooks triggered by inbound webhooks and calls outbound webhooks for hooks
+// and alert rules
+type WebhookService struct {
+	hooks       map[string]*WebhookHook
+	webhooks    map[string]*Webhook
+	secrets     map[string]secrets.Value // Resolved hook secrets and header values, by hook ID or webhook ID + header
+	lastTrigger map[string]time.Time
+	history     []WebhookCall
+	devices     CommandExecutor
+	scenes      SceneRecaller
+	safeMode    *safemode.Controller
+	dryRun      *dryrun.Recorder
+	client      *http.Client
+	logger      *logger.Logger
+	mu          sync.Mutex
+}
+
+// NewWebhookService creates the service; a secret that can't be resolved is a configuration error
+func NewWebhookService(cfg *WebhookConfig, serviceLogger *logger.Logger) (*WebhookService, error) {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("WebhookService", nil)
+	}
+
+	s := &WebhookService{
+		hooks:       make(map[string]*WebhookHook),
+		webhooks:    make(map[string]*Webhook),
+		secrets:     make(map[string]secrets.Value),
+		lastTrigger: make(map[string]time.Time),
+		client:      &http.Client{},
+		logger:      serviceLogger,
+	}
+	for i := range cfg.Hooks {
+		hook := &cfg.Hooks[i]
+		secret, err := secrets.Resolve(hook.Secret)
+		if err != nil {
+			return nil, errors.NewConfigError(fmt.Sprintf("failed to resolve the secret of hook %s", hook.ID), err)
+		}
+		s.hooks[hook.ID] = hook
+		s.secrets[hook.ID] = secrets.Value(secret)
+	}
+	for i := range cfg.Webhooks {
+		webhook := &cfg.Webhooks[i]
+		for header, value := range webhook.Headers {
+			resolved, err := secrets.Resolve(value)
+			if err != nil {
+				return nil, errors.NewConfigError(fmt.Sprintf("failed to resolve header %s of webhook %s", header, webhook.ID), err)
+			}
+			s.secrets[webhook.ID+"\n"+header] = secrets.Value(resolved)
+		}
+		s.webhooks[webhook.ID] = webhook
+	}
+	return s, nil
+}
+
+// SetCommandExecutor sends the device commands of the hooks
+func (s *WebhookService) SetCommandExecutor(devices CommandExecutor) {
+	s.devices = devices
+}
+
+// SetSceneRecaller recalls the scenes of the hooks
+func (s *WebhookService) SetSceneRecaller(scenes SceneRecaller) {
+	s.scenes = scenes
+}
+
+// SetSafeMode holds back hooks while safe mode is active, unless re-enabled as automation:<hook>
+func (s *WebhookService) SetSafeMode(controller *safemode.Controller) {
+	s.safeMode = controller
+}
+
+// SetDryRunRecorder records hooks and webhook calls instead of running them in observe-only mode
+func (s *WebhookService) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	s.dryRun = recorder
+}
+
+// Trigger runs a hook for an inbound webhook. The event holds the request for the templates:
+// the hook's ID as hook, the JSON body as payload (the raw body when it isn't JSON) and the
+// query parameters as query.
+func (s *WebhookService) Trigger(id string, event map[string]interface{}, now time.Time) (*HookResult, error) {
+	s.mu.Lock()
+	hook, exists := s.hooks[id]
+	if !exists {
+		s.mu.Unlock()
+		return nil, errors.NewValidationError(fmt.Sprintf("hook %s not found", id), nil)
+	}
+	if hook.Disabled {
+		s.mu.Unlock()
+		return nil, errors.NewBusinessError(fmt.Sprintf("hook %s is disabled", id), nil)
+	}
+	last, triggered := s.lastTrigger[id]
+	if triggered && now.Sub(last) < time.Duration(hook.Cooldown)*time.Second {
+		s.mu.Unlock()
+		return nil, errors.NewBusinessError(fmt.Sprintf("hook %s is on cooldown", id), nil)
+	}
+	// Reserve the run, so concurrent triggers are on cooldown until it is released
+	s.lastTrigger[id] = now
+	s.mu.Unlock()
+	release := func() {
+		s.mu.Lock()
+		if s.lastTrigger[id].Equal(now) {
+			if triggered {
+				s.lastTrigger[id] = last
+			} else {
+				delete(s.lastTrigger, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	if !s.safeMode.Allowed(safemode.ComponentAutomation, id) {
+		release()
+		return nil, errors.NewBusinessError(fmt.Sprintf("safe mode active: hook %s is not enabled", id), nil)
+	}
+
+	// Render every action first, so a payload missing a field runs nothing
+	commands := make([]models.DeviceCommand, 0, len(hook.Actions))
+	for _, action := range hook.Actions {
+		cmd, err := renderCommand(action, event)
+		if err != nil {
+			release()
+			return nil, errors.NewValidationError(fmt.Sprintf("hook %s: the payload doesn't fit action %s", id, action.Action), err)
+		}
+		commands = append(commands, cmd)
+	}
+
+	result := &HookResult{Hook: id, Actions: len(commands)}
+	if hook.Scene != "" {
+		result.Actions++
+	}
+	if s.dryRun.ObserveOnly() {
+		result.Traced = true
+		if hook.Scene != "" {
+			s.dryRun.Record("webhook", "recall_scene", hook.Scene, "hook "+id, map[string]interface{}{"hook": id})
+		}
+		for _, cmd := range commands {
+			s.dryRun.Record("webhook", cmd.Action, actionTarget(cmd), "hook "+id, map[string]interface{}{"hook": id, "value": cmd.Value})
+		}
+	} else {
+		if hook.Scene != "" {
+			if s.scenes == nil {
+				result.Failed++
+				s.logger.Warn("Hook recalls a scene without a scene service", map[string]interface{}{"hook": id, "scene": hook.Scene})
+			} else if err := s.scenes.Recall(hook.Scene); err != nil {
+				result.Failed++
+				s.logger.Error("Hook failed to recall its scene", err, map[string]interface{}{"hook": id, "scene": hook.Scene})
+			}
+		}
+		for i := range commands {
+			cmd := &commands[i]
+			if cmd.Options == nil {
+				cmd.Options = make(map[string]interface{})
+			}
+			cmd.Options["automation"] = "hook:" + id
+			if s.devices == nil {
+				result.Failed++
+				continue
+			}
+			if err := s.devices.ExecuteCommand(cmd); err != nil {
+				result.Failed++
+				s.logger.Error("Hook action failed", err, map[string]interface{}{"hook": id, "device_id": actionTarget(*cmd), "action": cmd.Action})
+			}
+		}
+	}
+
+	failedWebhooks := 0
+	for _, webhookID := range hook.Webhooks {
+		call := s.call(context.Background(), webhookID, "hook:"+id, event, now)
+		if call.Result == WebhookResultFailed {
+			failedWebhooks++
+		}
+		result.Webhooks = append(result.Webhooks, call)
+	}
+
+	s.mu.Lock()
+	call := WebhookCall{Kind: "hook", ID: id, At: now, Result: WebhookResultOK}
+	if result.Traced {
+		call.Result = WebhookResultTraced
+	} else if result.Failed > 0 || failedWebhooks > 0 {
+		call.Result = WebhookResultFailed
+		call.Error = fmt.Sprintf("%d of %d actions and %d of %d webhooks failed", result.Failed, result.Actions, failedWebhooks, len(hook.Webhooks))
+	}
+	s.recordLocked(call)
+	s.mu.Unlock()
+
+	s.logger.Info("Hook triggered", map[string]interface{}{
+		"hook":    id,
+		"actions": result.Actions,
+		"failed":  result.Failed,
+	})
+	return result, nil
+}
+
+// renderCommand renders the templates of a hook's action
+func renderCommand(action models.DeviceCommand, event map[string]interface{}) (models.DeviceCommand, error) {
+	cmd := action
+	var err error
+	if cmd.DeviceID, err = renderTemplate(action.DeviceID, event); err != nil {
+		return cmd, err
+	}
+	if cmd.Action, err = renderTemplate(action.Action, event); err != nil {
+		return cmd, err
+	}
+	if cmd.Value, err = renderValue(action.Value, event); err != nil {
+		return cmd, err
+	}
+	if len(action.Options) > 0 {
+		cmd.Options = make(map[string]interface{}, len(action.Options))
+		for key, option := range action.Options {
+			if cmd.Options[key], err = renderValue(option, event); err != nil {
+				return cmd, err
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// CallWebhook calls an outbound webhook for an event, e.g. an alert firing. The event is what
+// the webhook's templates render.
+func (s *WebhookService) CallWebhook(id, source string, event map[string]interface{}) error {
+	call := s.call(context.Background(), id, source, event, time.Now())
+	if call.Result == WebhookResultFailed {
+		return errors.NewConnectionError(fmt.Sprintf("webhook %s failed: %s", id, call.Error), nil)
+	}
+	return nil
+}
+
+// call sends a webhook and records the call
+func (s *WebhookService) call(ctx context.Context, id, source string, event map[string]interface{}, now time.Time) WebhookCall {
+	call := WebhookCall{Kind: "webhook", ID: id, Source: source, At: now}
+	status, err := s.send(ctx, id, source, event)
+	switch {
+	case err != nil:
+		call.Result, call.Status, call.Error = WebhookResultFailed, status, err.Error()
+		s.logger.Error("Webhook call failed", err, map[string]interface{}{"webhook": id, "source": source})
+	case status == 0:
+		call.Result = WebhookResultTraced
+	default:
+		call.Result, call.Status = WebhookResultOK, status
+		s.logger.Info("Webhook called", map[string]interface{}{"webhook": id, "source": source, "status": status})
+	}
+
+	s.mu.Lock()
+	s.recordLocked(call)
+	s.mu.Unlock()
+	return call
+}
+
+// send renders and sends a webhook request, returning the HTTP status, or 0 when observe-only
+// mode traced it instead
+func (s *WebhookService) send(ctx context.Context, id, source string, event map[string]interface{}) (int, error) {
+	webhook, exists := s.webhooks[id]
+	if !exists {
+		return 0, fmt.Errorf("unknown webhook %s", id)
+	}
+
+	target, err := renderTemplate(webhook.URL, event)
+	if err != nil {
+		return 0, fmt.Errorf("url: %w", err)
+	}
+	if parsed, err := url.Parse(target); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return 0, fmt.Errorf("url %s is not an http or https URL", redactWebhookURL(target))
+	}
+	body := webhook.Body
+	if body == "" {
+		body = "{{json .}}"
+	}
+	if body, err = renderTemplate(body, event); err != nil {
+		return 0, fmt.Errorf("body: %w", err)
+	}
+
+	if s.dryRun.ObserveOnly() {
+		s.dryRun.Record("webhook", "call_webhook", id, source, map[string]interface{}{"url": redactWebhookURL(target)})
+		return 0, nil
+	}
+
+	method := strings.ToUpper(webhook.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	var reader io.Reader
+	if method != http.MethodGet {
+		reader = strings.NewReader(body)
+	}
+	timeout := defaultWebhookTimeout
+	if webhook.TimeoutSeconds > 0 {
+		timeout = time.Duration(webhook.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return 0, redactURLError(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for header := range webhook.Headers {
+		rendered, err := renderTemplate(s.secrets[id+"\n"+header].Reveal(), event)
+		if err != nil {
+			return 0, fmt.Errorf("header %s: %w", header, err)
+		}
+		req.Header.Set(header, rendered)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, redactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+		return resp.StatusCode, fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp.StatusCode, nil
+}
+
+// recordLocked keeps a call in the bounded history; callers must hold the lock
+func (s *WebhookService) recordLocked(call WebhookCall) {
+	s.history = append(s.history, call)
+	if len(s.history) > webhookHistorySize {
+		s.history = s.history[len(s.history)-webhookHistorySize:]
+	}
+}
+
+// authorized checks a request's hook secret: an X-Hook-Token header, a token query parameter,
+// or an X-Hub-Signature-256 HMAC of the body as GitHub and others send
+func (s *WebhookService) authorized(id string, r *http.Request, body []byte) bool {
+	s.mu.Lock()
+	secret, exists := s.secrets[id]
+	s.mu.Unlock()
+	if !exists || secret == "" {
+		return false
+	}
+
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret.Reveal()))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+	token := r.Header.Get("X-Hook-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret.Reveal())) == 1
+}
+
+// HookHandler serves POST /api/hooks/<id>. Callers authenticate with the hook's secret rather
+// than an API token, so IFTTT-style services and CI pipelines need no session.
+func (s *WebhookService) HookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to trigger a hook", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, HookPath)
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+		if err != nil {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// An unknown hook answers like a wrong secret, so hook IDs can't be probed
+		if !s.authorized(id, r, body) {
+			http.Error(w, "invalid hook secret", http.StatusUnauthorized)
+			return
+		}
+
+		var payload interface{}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &payload); err != nil {
+				payload = string(body)
+			}
+		}
+		query := make(map[string]interface{})
+		for key, values := range r.URL.Query() {
+			if key != "token" {
+				query[key] = values[0]
+			}
+		}
+		now := time.Now()
+		event := map[string]interface{}{
+			"hook":    id,
+			"payload": payload,
+			"query":   query,
+			"time":    now.Format(time.RFC3339),
+		}
+
+		result, err := s.Trigger(id, event, now)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if appErr, ok := err.(*errors.HomeAutomationError); ok {
+				switch appErr.Type {
+				case errors.ErrorTypeValidation:
+					status = http.StatusBadRequest
+				case errors.ErrorTypeBusiness:
+					status = http.StatusConflict
+				}
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if result.Failed > 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			for _, call := range result.Webhooks {
+				if call.Result == WebhookResultFailed {
+					w.WriteHeader(http.StatusBadGateway)
+					break
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// WebhookStatus lists the hooks and webhooks, without their secrets, and the recent calls. Only
+// the scheme and host of a webhook's URL are listed.
+type WebhookStatus struct {
+	Hooks    []WebhookHook `json:"hooks"`
+	Webhooks []Webhook     `json:"webhooks"`
+	History  []WebhookCall `json:"history"`
+}
+
+// Status returns the hooks and webhooks sorted by ID and the recent calls, newest first
+func (s *WebhookService) Status() WebhookStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := WebhookStatus{Hooks: []WebhookHook{}, Webhooks: []Webhook{}, History: make([]WebhookCall, 0, len(s.history))}
+	for _, id := range sortedKeys(s.hooks) {
+		hook := *s.hooks[id]
+		hook.Secret = ""
+		status.Hooks = append(status.Hooks, hook)
+	}
+	for _, id := range sortedKeys(s.webhooks) {
+		webhook := *s.webhooks[id]
+		webhook.URL = redactWebhookURL(webhook.URL)
+		if len(webhook.Headers) > 0 {
+			// Header values often carry API keys
+			webhook.Headers = make(map[string]string, len(webhook.Headers))
+			for header := range s.webhooks[id].Headers {
+				webhook.Headers[header] = s.secrets[id+"\n"+header].String()
+			}
+		}
+		status.Webhooks = append(status.Webhooks, webhook)
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		status.History = append(status.History, s.history[i])
+	}
+	return status
+}
+
+// redactWebhookURL keeps the scheme and host of a webhook's URL. Its user info, path and query
+// often carry the key, as in Slack and IFTTT URLs.
+func redactWebhookURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || strings.Contains(parsed.Host, "{{") {
+		return redact.Redacted
+	}
+	redacted := parsed.Scheme + "://" + parsed.Host
+	if parsed.Path != "" && parsed.Path != "/" {
+		redacted += "/" + redact.Redacted
+	}
+	if parsed.RawQuery != "" {
+		redacted += "?" + redact.Redacted
+	}
+	return redacted
+}
+
+// redactURLError redacts the URL the HTTP client quotes in its errors, so a failed call's
+// history and log don't reveal the key
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: redactWebhookURL(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+// Handler serves the hooks, webhooks and recent calls as JSON
+func (s *WebhookService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
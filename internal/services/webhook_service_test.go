@@ -0,0 +1,241 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// commandRecorder keeps the device commands it is sent whole, for checking rendered values
+type commandRecorder struct {
+	commands []models.DeviceCommand
+}
+
+func (e *commandRecorder) ExecuteCommand(cmd *models.DeviceCommand) error {
+	e.commands = append(e.commands, *cmd)
+	return nil
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	valid := func() *WebhookConfig {
+		return &WebhookConfig{
+			Hooks: []WebhookHook{{ID: "deploy", Secret: "s3cret", Actions: []models.DeviceCommand{{DeviceID: "lamp", Action: "turn_on"}},
+				Webhooks: []string{"ifttt"}}},
+			Webhooks: []Webhook{{ID: "ifttt", URL: "https://maker.ifttt.com/trigger/{{.hook}}"}},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+
+	broken := map[string]func(c *WebhookConfig){
+		"no secret":        func(c *WebhookConfig) { c.Hooks[0].Secret = "" },
+		"nothing to do":    func(c *WebhookConfig) { c.Hooks[0].Actions, c.Hooks[0].Webhooks = nil, nil },
+		"unknown webhook":  func(c *WebhookConfig) { c.Hooks[0].Webhooks = []string{"slack"} },
+		"bad template":     func(c *WebhookConfig) { c.Hooks[0].Actions[0].Value = "{{.payload.level" },
+		"slash in ID":      func(c *WebhookConfig) { c.Hooks[0].ID = "ci/deploy" },
+		"repeated webhook": func(c *WebhookConfig) { c.Webhooks = append(c.Webhooks, c.Webhooks[0]) },
+		"bad method":       func(c *WebhookConfig) { c.Webhooks[0].Method = "DELETE" },
+	}
+	for name, breakConfig := range broken {
+		cfg := valid()
+		breakConfig(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestWebhookService(t *testing.T) {
+	type received struct {
+		path, body, key string
+	}
+	calls := make(chan received, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls <- received{r.URL.Path, string(body), r.Header.Get("X-Api-Key")}
+		if strings.HasSuffix(r.URL.Path, "/broken") {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &WebhookConfig{
+		Hooks: []WebhookHook{
+			{
+				ID:     "dim",
+				Secret: "s3cret",
+				Actions: []models.DeviceCommand{{DeviceID: "{{.payload.device}}", Action: "set_brightness", Value: "{{.payload.level}}",
+					Options: map[string]interface{}{"reason": "{{.query.source}}"}}},
+				Webhooks: []string{"notify"},
+				Cooldown: 60,
+			},
+			{ID: "fail", Secret: "other", Webhooks: []string{"broken"}},
+		},
+		Webhooks: []Webhook{
+			{ID: "notify", URL: server.URL + "/notify/{{.hook}}", Headers: map[string]string{"X-Api-Key": "key-1"},
+				Body: `{"value1":"{{.payload.device}}"}`},
+			{ID: "broken", URL: server.URL + "/broken"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	service, err := NewWebhookService(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewWebhookService failed: %v", err)
+	}
+	devices := &commandRecorder{}
+	service.SetCommandExecutor(devices)
+	handler := service.HookHandler()
+
+	post := func(path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for name, header := range map[string]http.Header{
+		"no secret":     nil,
+		"wrong secret":  {"X-Hook-Token": {"guess"}},
+		"bad signature": {"X-Hub-Signature-256": {"sha256=00"}},
+	} {
+		if recorder := post("/api/hooks/dim", `{}`, header); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, recorder.Code)
+		}
+	}
+	if recorder := post("/api/hooks/missing?token=s3cret", `{}`, nil); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown hook answered like a wrong secret, got %d", recorder.Code)
+	}
+
+	// A payload without the fields the templates use runs nothing
+	if recorder := post("/api/hooks/dim?token=s3cret", `{"device":"lamp"}`, nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a payload missing the level, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if len(devices.commands) != 0 {
+		t.Fatalf("Expected no commands, got %+v", devices.commands)
+	}
+
+	// Signed like GitHub's webhooks
+	body := `{"device":"lamp","level":40}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	signature := http.Header{"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(mac.Sum(nil))}}
+	recorder := post("/api/hooks/dim?source=ci", body, signature)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the hook to run, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var result HookResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || result.Actions != 1 || result.Failed != 0 || len(result.Webhooks) != 1 {
+		t.Fatalf("Unexpected result %+v, %v", result, err)
+	}
+	cmd := devices.commands[0]
+	if cmd.DeviceID != "lamp" || cmd.Value != float64(40) || cmd.Options["reason"] != "ci" || cmd.Options["automation"] != "hook:dim" {
+		t.Fatalf("Unexpected command %+v", cmd)
+	}
+	select {
+	case call := <-calls:
+		if call.path != "/notify/dim" || call.body != `{"value1":"lamp"}` || call.key != "key-1" {
+			t.Fatalf("Unexpected webhook call %+v", call)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the webhook called")
+	}
+
+	if recorder := post("/api/hooks/dim", body, signature); recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected the hook on cooldown, got %d", recorder.Code)
+	}
+
+	// A failing webhook fails the hook
+	if recorder := post("/api/hooks/fail", ``, http.Header{"X-Hook-Token": {"other"}}); recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 for the failed webhook, got %d: %s", recorder.Code, recorder.Body)
+	}
+	<-calls
+	if err := service.CallWebhook("broken", "test", map[string]interface{}{}); err == nil {
+		t.Fatal("Expected a webhook answering 503 to fail")
+	}
+	<-calls
+
+	status := service.Status()
+	if status.Hooks[0].Secret != "" || status.Webhooks[1].Headers["X-Api-Key"] == "key-1" {
+		t.Fatalf("Expected the secrets left out of the status, got %+v", status)
+	}
+	if url := status.Webhooks[1].URL; url != server.URL+"/REDACTED" {
+		t.Fatalf("Expected the webhook's path left out of the status, got %s", url)
+	}
+	if len(status.History) != 5 || status.History[0].Result != WebhookResultFailed || status.History[0].Status != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected history %+v", status.History)
+	}
+}
+
+// countingExecutor counts the device commands it is sent, from any goroutine
+type countingExecutor struct {
+	count atomic.Int32
+}
+
+func (e *countingExecutor) ExecuteCommand(cmd *models.DeviceCommand) error {
+	e.count.Add(1)
+	return nil
+}
+
+func TestWebhookCooldownConcurrentTriggers(t *testing.T) {
+	cfg := &WebhookConfig{Hooks: []WebhookHook{{ID: "doorbell", Secret: "ding", Cooldown: 60,
+		Actions: []models.DeviceCommand{{DeviceID: "chime", Action: "turn_on"}}}}}
+	service, err := NewWebhookService(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewWebhookService failed: %v", err)
+	}
+	executor := &countingExecutor{}
+	service.SetCommandExecutor(executor)
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service.Trigger("doorbell", map[string]interface{}{}, now)
+		}()
+	}
+	wg.Wait()
+	if count := executor.count.Load(); count != 1 {
+		t.Fatalf("Expected one run within the cooldown, got %d", count)
+	}
+}
+
+func TestWebhookFailureRedactsURL(t *testing.T) {
+	cfg := &WebhookConfig{Webhooks: []Webhook{{ID: "slack", URL: "http://127.0.0.1:1/services/T0/B0/SECRETKEY?token=abc"}}}
+	service, err := NewWebhookService(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewWebhookService failed: %v", err)
+	}
+
+	err = service.CallWebhook("slack", "test", map[string]interface{}{})
+	if err == nil {
+		t.Fatal("Expected a refused connection to fail")
+	}
+	history := service.Status().History
+	if len(history) != 1 || history[0].Result != WebhookResultFailed {
+		t.Fatalf("Expected the failed call recorded, got %+v", history)
+	}
+	for _, text := range []string{err.Error(), history[0].Error} {
+		if strings.Contains(text, "SECRETKEY") || strings.Contains(text, "token=abc") || !strings.Contains(text, "127.0.0.1:1") {
+			t.Errorf("Expected only the webhook's host in %q", text)
+		}
+	}
+}
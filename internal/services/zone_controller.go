@@ -0,0 +1,485 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+// Defaults of the zone controller
+const (
+	defaultChangeoverMinutes  = 5
+	defaultZoneMaxWaitMinutes = 30
+	// zoneRequestTTL forgets the call of a thermostat that stopped being evaluated, e.g. one
+	// offline; the control loop evaluates every thermostat every 30 seconds
+	zoneRequestTTL = 2 * time.Minute
+)
+
+// ZoneConfig lists the HVAC systems shared by several room thermostats
+type ZoneConfig struct {
+	Systems []ZoneSystem `json:"systems"`
+}
+
+// ZoneSystem is one furnace, air conditioner or heat pump serving several zones through dampers
+// or valves
+type ZoneSystem struct {
+	ID    string `json:"id"`
+	Zones []Zone `json:"zones"`
+	// ChangeoverMinutes is how long the system rests between heating and cooling, 5 by default
+	ChangeoverMinutes int `json:"changeover_minutes,omitempty"`
+	// MaxWaitMinutes is how long zones calling for the other mode wait before the system changes
+	// over although zones still call for the running one, 30 by default
+	MaxWaitMinutes int `json:"max_wait_minutes,omitempty"`
+}
+
+// Zone is a thermostat of a shared system and the damper or valve of its ducts or loop
+type Zone struct {
+	Thermostat string `json:"thermostat"`
+	Damper     string `json:"damper,omitempty"` // Damper or valve ID, the thermostat ID by default
+}
+
+// damper is the ID the damper of a zone is published under
+func (z Zone) damper() string {
+	if z.Damper != "" {
+		return z.Damper
+	}
+	return z.Thermostat
+}
+
+// LoadZoneConfig reads the zoned HVAC systems from a JSON file
+func LoadZoneConfig(path string) (*ZoneConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read HVAC zones file", err)
+	}
+
+	var cfg ZoneConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse HVAC zones file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that systems have IDs and zones, and that a thermostat is in one zone only
+func (c *ZoneConfig) Validate() error {
+	systems := make(map[string]bool)
+	thermostats := make(map[string]string)
+	for _, system := range c.Systems {
+		if system.ID == "" || systems[system.ID] {
+			return errors.NewValidationError("HVAC systems need unique IDs", nil)
+		}
+		systems[system.ID] = true
+		if len(system.Zones) == 0 {
+			return errors.NewValidationError(fmt.Sprintf("HVAC system %s has no zones", system.ID), nil)
+		}
+		if system.ChangeoverMinutes < 0 || system.MaxWaitMinutes < 0 {
+			return errors.NewValidationError(fmt.Sprintf("HVAC system %s: changeover_minutes and max_wait_minutes must not be negative", system.ID), nil)
+		}
+		dampers := make(map[string]bool)
+		for _, zone := range system.Zones {
+			if zone.Thermostat == "" {
+				return errors.NewValidationError(fmt.Sprintf("HVAC system %s has a zone without a thermostat", system.ID), nil)
+			}
+			if other, taken := thermostats[zone.Thermostat]; taken {
+				return errors.NewValidationError(fmt.Sprintf("thermostat %s is a zone of %s and %s", zone.Thermostat, other, system.ID), nil)
+			}
+			thermostats[zone.Thermostat] = system.ID
+			if dampers[zone.damper()] {
+				return errors.NewValidationError(fmt.Sprintf("HVAC system %s has damper %s twice", system.ID, zone.damper()), nil)
+			}
+			dampers[zone.damper()] = true
+		}
+	}
+	return nil
+}
+
+// zoneRequest is the last call of a zone's thermostat
+type zoneRequest struct {
+	status models.ThermostatStatus
+	demand float64 // °F beyond the target
+	at     time.Time
+}
+
+// zoneSystem is the state of a shared system
+type zoneSystem struct {
+	config   ZoneSystem
+	mode     models.ThermostatStatus // What the system does: heating, cooling, fan or idle
+	since    time.Time
+	lastMode models.ThermostatStatus // Last heating or cooling, for the changeover rest
+	stopped  time.Time
+	next     models.ThermostatStatus // Mode owed to zones that waited too long
+	waiting  time.Time               // Since zones call for the other mode than the running one
+	requests map[string]zoneRequest  // Per thermostat
+	open     map[string]bool         // Published damper positions, per thermostat
+}
+
+// ZoneStatus is the call and damper of a zone
+type ZoneStatus struct {
+	Damper  string                  `json:"damper"`
+	Call    models.ThermostatStatus `json:"call"`
+	DemandF float64                 `json:"demand_f"`
+	Waiting bool                    `json:"waiting"` // Calls for a mode the system isn't running
+	Open    bool                    `json:"open"`
+	Updated time.Time               `json:"updated,omitempty"`
+}
+
+// ZoneSystemStatus is the mode of a shared system and the aggregate demand of its zones
+type ZoneSystemStatus struct {
+	Mode            models.ThermostatStatus `json:"mode"`
+	Since           time.Time               `json:"since,omitempty"`
+	HeatDemandF     float64                 `json:"heat_demand_f"`
+	CoolDemandF     float64                 `json:"cool_demand_f"`
+	ChangeoverUntil time.Time               `json:"changeover_until,omitempty"`
+	Zones           map[string]ZoneStatus   `json:"zones"`
+}
+
+// ZoneController coordinates the thermostats of zones sharing one HVAC system. The system runs
+// one mode at a time: zones calling for the other mode wait, with their dampers or valves
+// closed, until the running mode's calls end or they have waited too long. When both are
+// called for at once, the mode with the larger total demand in °F starts first. Between heating
+// and cooling the system rests for the changeover time.
+type ZoneController struct {
+	systems  map[string]*zoneSystem
+	zones    map[string]*zoneSystem // Per thermostat
+	publish  func(msg *mqtt.Message) error
+	safeMode *safemode.Controller
+	dryRun   *dryrun.Recorder
+	logger   *logger.Logger
+	mu       sync.Mutex
+}
+
+// NewZoneController creates a zone controller for a validated configuration
+func NewZoneController(cfg *ZoneConfig, serviceLogger *logger.Logger) *ZoneController {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("ZoneController", nil)
+	}
+
+	controller := &ZoneController{
+		systems: make(map[string]*zoneSystem),
+		zones:   make(map[string]*zoneSystem),
+		logger:  serviceLogger,
+	}
+	for _, config := range cfg.Systems {
+		system := &zoneSystem{
+			config:   config,
+			mode:     models.StatusIdle,
+			requests: make(map[string]zoneRequest),
+			open:     make(map[string]bool),
+		}
+		controller.systems[config.ID] = system
+		for _, zone := range config.Zones {
+			controller.zones[zone.Thermostat] = system
+		}
+	}
+	return controller
+}
+
+// SetMQTTClient attaches the client the system mode and damper positions are published with
+func (c *ZoneController) SetMQTTClient(client *mqtt.Client) {
+	if client == nil {
+		c.publish = nil
+		return
+	}
+	c.publish = client.Publish
+}
+
+// SetSafeMode attaches the safe mode controller; while it holds a thermostat back, its calls
+// leave the shared system untouched
+func (c *ZoneController) SetSafeMode(controller *safemode.Controller) {
+	c.safeMode = controller
+}
+
+// SetDryRunRecorder attaches the recorder the system mode and damper positions are traced to,
+// rather than published, in observe-only mode
+func (c *ZoneController) SetDryRunRecorder(recorder *dryrun.Recorder) {
+	c.dryRun = recorder
+}
+
+// Coordinate records the call of a zone's thermostat and returns what the shared system grants
+// it: the call itself, or idle while the system runs another mode. It is called from the
+// thermostat control loop and must not call back into it.
+func (c *ZoneController) Coordinate(thermostat models.Thermostat, call models.HVACCall, now time.Time) models.HVACCall {
+	if !c.safeMode.Allowed(safemode.ComponentThermostat, thermostat.ID) {
+		return call
+	}
+
+	c.mu.Lock()
+	system := c.zones[thermostat.ID]
+	if system == nil {
+		c.mu.Unlock()
+		return call
+	}
+
+	system.requests[thermostat.ID] = zoneRequest{status: call.Status, demand: zoneDemand(thermostat, call.Status), at: now}
+	previous := system.mode
+	system.decide(now)
+	messages := c.positionDampers(system, now)
+	if system.mode != previous {
+		messages = append(messages, c.plantMessage(system, now))
+	}
+	mode := system.mode
+	c.mu.Unlock()
+
+	if mode != previous {
+		c.logger.Info("Zoned HVAC system changed mode", map[string]interface{}{
+			"system":    system.config.ID,
+			"old_mode":  previous,
+			"new_mode":  mode,
+			"triggered": thermostat.ID,
+		})
+	}
+	c.send(messages)
+
+	if call.Status != models.StatusIdle && call.Status != mode {
+		return models.HVACCall{Status: models.StatusIdle}
+	}
+	return call
+}
+
+// zoneDemand is how far a thermostat calling for heat or cooling is beyond its target
+func zoneDemand(thermostat models.Thermostat, status models.ThermostatStatus) float64 {
+	switch status {
+	case models.StatusHeating:
+		return math.Max(thermostat.HeatTarget()-thermostat.CurrentTemp, 0)
+	case models.StatusCooling:
+		return math.Max(thermostat.CurrentTemp-thermostat.CoolTarget(), 0)
+	}
+	return 0
+}
+
+// active returns the calls of the zones that are still being evaluated
+func (s *zoneSystem) active(now time.Time) map[string]zoneRequest {
+	active := make(map[string]zoneRequest, len(s.requests))
+	for id, request := range s.requests {
+		if now.Sub(request.at) <= zoneRequestTTL {
+			active[id] = request
+		}
+	}
+	return active
+}
+
+// demand totals the calls of the zones by mode
+func (s *zoneSystem) demand(now time.Time) (calls map[models.ThermostatStatus]bool, heat, cool float64) {
+	calls = make(map[models.ThermostatStatus]bool)
+	for _, request := range s.active(now) {
+		calls[request.status] = true
+		switch request.status {
+		case models.StatusHeating:
+			heat += request.demand
+		case models.StatusCooling:
+			cool += request.demand
+		}
+	}
+	return calls, heat, cool
+}
+
+// changeoverUntil is when the system may start the other mode than the one it last ran
+func (s *zoneSystem) changeoverUntil() time.Time {
+	if s.lastMode == "" {
+		return time.Time{}
+	}
+	return s.stopped.Add(time.Duration(positiveOr(s.config.ChangeoverMinutes, defaultChangeoverMinutes)) * time.Minute)
+}
+
+// decide picks the mode of the system from the calls of its zones
+func (s *zoneSystem) decide(now time.Time) {
+	calls, heat, cool := s.demand(now)
+
+	if s.mode == models.StatusHeating || s.mode == models.StatusCooling {
+		other := oppositeMode(s.mode)
+		if !calls[other] {
+			s.waiting = time.Time{}
+		} else if s.waiting.IsZero() {
+			s.waiting = now
+		}
+		maxWait := time.Duration(positiveOr(s.config.MaxWaitMinutes, defaultZoneMaxWaitMinutes)) * time.Minute
+		overdue := !s.waiting.IsZero() && now.Sub(s.waiting) >= maxWait
+		if calls[s.mode] && !overdue {
+			return
+		}
+		if overdue {
+			s.next = other
+		}
+		s.lastMode, s.stopped, s.waiting = s.mode, now, time.Time{}
+	}
+
+	if s.next != "" && !calls[s.next] {
+		s.next = ""
+	}
+	var mode models.ThermostatStatus
+	switch {
+	case s.next != "":
+		mode = s.next
+	case calls[models.StatusHeating] && calls[models.StatusCooling]:
+		mode = models.StatusHeating
+		if cool > heat {
+			mode = models.StatusCooling
+		}
+	case calls[models.StatusHeating]:
+		mode = models.StatusHeating
+	case calls[models.StatusCooling]:
+		mode = models.StatusCooling
+	}
+	if mode != "" && mode != s.lastMode && now.Before(s.changeoverUntil()) {
+		mode = "" // Resting between heating and cooling
+	}
+	if mode == s.next {
+		s.next = ""
+	}
+	if mode == "" {
+		mode = models.StatusIdle
+		if calls[models.StatusFan] {
+			mode = models.StatusFan
+		}
+	}
+
+	if mode != s.mode {
+		s.mode, s.since = mode, now
+	}
+}
+
+func oppositeMode(mode models.ThermostatStatus) models.ThermostatStatus {
+	if mode == models.StatusHeating {
+		return models.StatusCooling
+	}
+	return models.StatusHeating
+}
+
+// wantsOpen reports whether a zone's damper should be open: all are while the system is idle,
+// otherwise those of the zones calling for the running mode
+func (s *zoneSystem) wantsOpen(thermostatID string, now time.Time) bool {
+	if s.mode == models.StatusIdle {
+		return true
+	}
+	request, ok := s.requests[thermostatID]
+	return ok && now.Sub(request.at) <= zoneRequestTTL && request.status == s.mode
+}
+
+// positionDampers returns the messages moving the dampers of a system that changed position
+func (c *ZoneController) positionDampers(system *zoneSystem, now time.Time) []*mqtt.Message {
+	var messages []*mqtt.Message
+	for _, zone := range system.config.Zones {
+		open := system.wantsOpen(zone.Thermostat, now)
+		if current, known := system.open[zone.Thermostat]; known && current == open {
+			continue
+		}
+		system.open[zone.Thermostat] = open
+		position := 0
+		if open {
+			position = 100
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"open":       open,
+			"position":   position,
+			"thermostat": zone.Thermostat,
+			"timestamp":  now.Unix(),
+		})
+		if err != nil {
+			continue
+		}
+		messages = append(messages, &mqtt.Message{
+			Topic:   mqtt.HVACDamperTopic(system.config.ID, zone.damper()),
+			Payload: payload,
+			QoS:     1,
+			Retain:  true,
+		})
+	}
+	return messages
+}
+
+// plantMessage is the retained state of a system, with the zones it serves
+func (c *ZoneController) plantMessage(system *zoneSystem, now time.Time) *mqtt.Message {
+	zones := make([]string, 0, len(system.config.Zones))
+	for _, zone := range system.config.Zones {
+		if system.mode != models.StatusIdle && system.wantsOpen(zone.Thermostat, now) {
+			zones = append(zones, zone.Thermostat)
+		}
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"action":    string(system.mode),
+		"zones":     zones,
+		"timestamp": now.Unix(),
+	})
+	return &mqtt.Message{
+		Topic:   mqtt.HVACPlantTopic(system.config.ID),
+		Payload: payload,
+		QoS:     1,
+		Retain:  true,
+	}
+}
+
+func (c *ZoneController) send(messages []*mqtt.Message) {
+	if c.dryRun.ObserveOnly() {
+		for _, msg := range messages {
+			var state map[string]interface{}
+			json.Unmarshal(msg.Payload, &state)
+			c.dryRun.Record("hvac-zones", "publish_state", msg.Topic, "zoned HVAC system changed", state)
+		}
+		return
+	}
+	if c.publish == nil {
+		return
+	}
+	for _, msg := range messages {
+		if err := c.publish(msg); err != nil {
+			c.logger.Error("Failed to publish zone state", err, map[string]interface{}{"topic": msg.Topic})
+		}
+	}
+}
+
+// Status returns every system with its zones
+func (c *ZoneController) Status(now time.Time) map[string]ZoneSystemStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := make(map[string]ZoneSystemStatus, len(c.systems))
+	for id, system := range c.systems {
+		_, heat, cool := system.demand(now)
+		systemStatus := ZoneSystemStatus{
+			Mode:        system.mode,
+			Since:       system.since,
+			HeatDemandF: math.Round(heat*10) / 10,
+			CoolDemandF: math.Round(cool*10) / 10,
+			Zones:       make(map[string]ZoneStatus, len(system.config.Zones)),
+		}
+		if until := system.changeoverUntil(); now.Before(until) {
+			systemStatus.ChangeoverUntil = until
+		}
+		active := system.active(now)
+		for _, zone := range system.config.Zones {
+			zoneStatus := ZoneStatus{Damper: zone.damper(), Call: models.StatusIdle, Open: system.open[zone.Thermostat]}
+			if request, ok := active[zone.Thermostat]; ok {
+				zoneStatus.Call = request.status
+				zoneStatus.DemandF = math.Round(request.demand*10) / 10
+				zoneStatus.Waiting = request.status != models.StatusIdle && request.status != system.mode
+				zoneStatus.Updated = request.at
+			}
+			systemStatus.Zones[zone.Thermostat] = zoneStatus
+		}
+		status[id] = systemStatus
+	}
+	return status
+}
+
+// Handler serves the status of the zoned systems as JSON
+func (c *ZoneController) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status(time.Now()))
+	})
+}
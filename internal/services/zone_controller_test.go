@@ -0,0 +1,140 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/dryrun"
+	"github.com/johnpr01/home-automation/internal/models"
+	"github.com/johnpr01/home-automation/internal/safemode"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
+)
+
+func TestZoneController(t *testing.T) {
+	invalid := &ZoneConfig{Systems: []ZoneSystem{
+		{ID: "up", Zones: []Zone{{Thermostat: "bedroom"}}},
+		{ID: "down", Zones: []Zone{{Thermostat: "bedroom"}}},
+	}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected a thermostat in two systems to be rejected")
+	}
+
+	cfg := &ZoneConfig{Systems: []ZoneSystem{{ID: "main", Zones: []Zone{
+		{Thermostat: "living", Damper: "damper-living"},
+		{Thermostat: "office"},
+		{Thermostat: "bedroom"},
+	}}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	zones := NewZoneController(cfg, nil)
+	published := make(map[string]map[string]interface{})
+	zones.publish = func(msg *mqtt.Message) error {
+		var payload map[string]interface{}
+		json.Unmarshal(msg.Payload, &payload)
+		published[msg.Topic] = payload
+		return nil
+	}
+
+	now := time.Now()
+	living := models.Thermostat{ID: "living", TargetTemp: 70, CurrentTemp: 67, Mode: models.ModeAuto}
+	office := models.Thermostat{ID: "office", TargetTemp: 70, CurrentTemp: 72, Mode: models.ModeAuto}
+	heat := models.HVACCall{Status: models.StatusHeating, Stage: 1, Fan: true}
+	cool := models.HVACCall{Status: models.StatusCooling, Stage: 1, Compressor: true, Fan: true}
+
+	// The office calls for cooling first; the living room's larger heat demand waits its turn
+	if call := zones.Coordinate(office, cool, now); call.Status != models.StatusCooling {
+		t.Fatalf("Expected the first call granted, got %+v", call)
+	}
+	if call := zones.Coordinate(living, heat, now); call.Status != models.StatusIdle {
+		t.Errorf("Expected heating to wait while the system cools, got %+v", call)
+	}
+	if published[mqtt.HVACPlantTopic("main")]["action"] != "cooling" {
+		t.Errorf("Expected the system to cool, got %v", published[mqtt.HVACPlantTopic("main")])
+	}
+	for damper, open := range map[string]bool{"damper-living": false, "office": true, "bedroom": false} {
+		if state := published[mqtt.HVACDamperTopic("main", damper)]; state["open"] != open {
+			t.Errorf("Expected damper %s open=%v, got %v", damper, open, state)
+		}
+	}
+	status := zones.Status(now)["main"]
+	if !status.Zones["living"].Waiting || status.HeatDemandF != 3 {
+		t.Errorf("Expected the living room waiting with 3°F of demand, got %+v", status)
+	}
+
+	// Cooling ends; heating rests for the changeover before starting
+	later := now.Add(10 * time.Minute)
+	zones.Coordinate(office, models.HVACCall{Status: models.StatusIdle}, later)
+	if call := zones.Coordinate(living, heat, later.Add(time.Minute)); call.Status != models.StatusIdle {
+		t.Errorf("Expected heating to wait for the changeover, got %+v", call)
+	}
+	if state := published[mqtt.HVACDamperTopic("main", "bedroom")]; state["open"] != true {
+		t.Errorf("Expected the dampers open while the system is idle, got %v", state)
+	}
+	if call := zones.Coordinate(living, heat, later.Add(6*time.Minute)); call.Status != models.StatusHeating {
+		t.Errorf("Expected heating after the changeover, got %+v", call)
+	}
+
+	// Cooling calls wait at most 30 minutes for a heating run that won't end
+	start := later.Add(6 * time.Minute)
+	for minute := 0; minute < 30; minute++ {
+		at := start.Add(time.Duration(minute) * time.Minute)
+		zones.Coordinate(living, heat, at)
+		if call := zones.Coordinate(office, cool, at); call.Status != models.StatusIdle {
+			t.Fatalf("Expected cooling to wait, got %+v after %d minutes", call, minute)
+		}
+	}
+	if call := zones.Coordinate(living, heat, start.Add(30*time.Minute)); call.Status != models.StatusIdle {
+		t.Errorf("Expected heating to stop for the waiting zone, got %+v", call)
+	}
+	zones.Coordinate(office, cool, start.Add(33*time.Minute))
+	zones.Coordinate(living, heat, start.Add(34*time.Minute))
+	if call := zones.Coordinate(office, cool, start.Add(35*time.Minute)); call.Status != models.StatusCooling {
+		t.Errorf("Expected the waiting zone to cool after the changeover, got %+v", call)
+	}
+
+	// A thermostat outside the zones is left alone
+	if call := zones.Coordinate(models.Thermostat{ID: "garage"}, heat, now); call != heat {
+		t.Errorf("Expected an unzoned call unchanged, got %+v", call)
+	}
+}
+
+func TestZoneControllerSafeModeAndObserveOnly(t *testing.T) {
+	cfg := &ZoneConfig{Systems: []ZoneSystem{{ID: "main", Zones: []Zone{{Thermostat: "living"}, {Thermostat: "office"}}}}}
+	zones := NewZoneController(cfg, nil)
+	published := 0
+	zones.publish = func(msg *mqtt.Message) error {
+		published++
+		return nil
+	}
+	now := time.Now()
+	living := models.Thermostat{ID: "living", TargetTemp: 70, CurrentTemp: 67, Mode: models.ModeAuto}
+	heat := models.HVACCall{Status: models.StatusHeating, Stage: 1, Fan: true}
+
+	// Safe mode leaves the shared system as it was
+	controller := safemode.NewController(t.TempDir()+"/safe_mode.json", nil)
+	if err := controller.Enter("test"); err != nil {
+		t.Fatalf("Enter failed: %v", err)
+	}
+	zones.SetSafeMode(controller)
+	zones.Coordinate(living, heat, now)
+	if published != 0 || zones.Status(now)["main"].Mode != models.StatusIdle {
+		t.Fatalf("Expected nothing published in safe mode, got %d messages and %+v", published, zones.Status(now)["main"])
+	}
+
+	// Observe-only traces the dampers and the plant instead of publishing them
+	zones.SetSafeMode(nil)
+	recorder := dryrun.NewRecorder(true, "", nil)
+	zones.SetDryRunRecorder(recorder)
+	if call := zones.Coordinate(living, heat, now); call.Status != models.StatusHeating {
+		t.Errorf("Expected the call granted, got %+v", call)
+	}
+	if published != 0 {
+		t.Errorf("Expected nothing published in observe-only mode, got %d messages", published)
+	}
+	traces := recorder.GetTraces()
+	if len(traces) != 3 || traces[len(traces)-1].Target != mqtt.HVACPlantTopic("main") {
+		t.Errorf("Expected two dampers and the plant traced, got %+v", traces)
+	}
+}
@@ -0,0 +1,60 @@
+// Package solar calculates sunrise and sunset from a location, for lighting that follows the sun.
+package solar
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+	julian2000      = 2451545.0 // Julian date of 2000-01-01 12:00 UTC
+	obliquity       = 23.4397   // Tilt of the earth's axis in degrees
+	horizon         = -0.833    // Sun altitude at sunrise and sunset, allowing for refraction and the sun's disc
+)
+
+// Times returns sunrise and sunset on the calendar day of date, in date's location. Latitude is
+// positive north, longitude positive east. ok is false when the sun doesn't rise or set that day,
+// as in polar summer and winter.
+func Times(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	// Days since the J2000 epoch at noon of the calendar day
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	day := math.Round(julian(noon) - julian2000 + 0.0008)
+
+	meanSolarNoon := day - longitude/360
+	anomaly := normalize(357.5291 + 0.98560028*meanSolarNoon)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	eclipticLongitude := normalize(anomaly + center + 180 + 102.9372)
+	transit := julian2000 + meanSolarNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*eclipticLongitude)
+
+	declination := math.Asin(sin(eclipticLongitude) * sin(obliquity))
+	cosHourAngle := (sin(horizon) - sin(latitude)*math.Sin(declination)) / (cos(latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	sunrise = fromJulian(transit - hourAngle/360).In(date.Location())
+	sunset = fromJulian(transit + hourAngle/360).In(date.Location())
+	return sunrise, sunset, true
+}
+
+func julian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0)
+}
+
+func normalize(degrees float64) float64 {
+	return math.Mod(math.Mod(degrees, 360)+360, 360)
+}
+
+func sin(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cos(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
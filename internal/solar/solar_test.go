@@ -0,0 +1,50 @@
+package solar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimes(t *testing.T) {
+	tests := []struct {
+		name                string
+		date                time.Time
+		latitude, longitude float64
+		sunrise, sunset     string
+	}{
+		{"London midsummer", time.Date(2024, 6, 21, 0, 0, 0, 0, time.FixedZone("BST", 3600)), 51.5074, -0.1278, "04:43", "21:21"},
+		{"London midwinter", time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278, "08:04", "15:53"},
+		{"Sydney", time.Date(2024, 3, 1, 0, 0, 0, 0, time.FixedZone("AEDT", 11*3600)), -33.8688, 151.2093, "06:43", "19:32"},
+	}
+
+	for _, test := range tests {
+		sunrise, sunset, ok := Times(test.date, test.latitude, test.longitude)
+		if !ok {
+			t.Fatalf("%s: expected the sun to rise and set", test.name)
+		}
+		assertClose(t, test.name+" sunrise", sunrise, test.date, test.sunrise)
+		assertClose(t, test.name+" sunset", sunset, test.date, test.sunset)
+	}
+}
+
+func TestTimesPolar(t *testing.T) {
+	// Tromsø has midnight sun in June and polar night in December
+	for _, date := range []time.Time{
+		time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC),
+	} {
+		if _, _, ok := Times(date, 69.6492, 18.9553); ok {
+			t.Errorf("Expected no sunrise or sunset in Tromsø on %s", date.Format("2006-01-02"))
+		}
+	}
+}
+
+// assertClose checks that a time is within three minutes of a clock time on the day of date
+func assertClose(t *testing.T, name string, got, date time.Time, clock string) {
+	t.Helper()
+	parsed, _ := time.Parse("15:04", clock)
+	want := time.Date(date.Year(), date.Month(), date.Day(), parsed.Hour(), parsed.Minute(), 0, 0, date.Location())
+	if diff := got.Sub(want); diff < -3*time.Minute || diff > 3*time.Minute {
+		t.Errorf("%s: expected about %s, got %s", name, clock, got.In(date.Location()).Format("15:04"))
+	}
+}
@@ -0,0 +1,212 @@
+package tariff
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Type selects how energy is priced
+type Type string
+
+const (
+	TypeFlat      Type = "flat"        // One rate at all times
+	TypeTimeOfUse Type = "time_of_use" // Rate depends on the time of day and weekday
+	TypeTiered    Type = "tiered"      // Rate depends on the household's monthly consumption so far
+)
+
+// Tariff converts energy to cost. Rates are per kWh in Currency.
+type Tariff struct {
+	Type     Type     `json:"type"`
+	Currency string   `json:"currency"`
+	Rate     float64  `json:"rate"`    // Flat rate, and the time-of-use rate outside all periods
+	Periods  []Period `json:"periods"` // Time-of-use periods, first match wins
+	Tiers    []Tier   `json:"tiers"`   // Tiers in ascending order of UpToKWh
+}
+
+// Period is a time-of-use window such as "16:00"-"21:00" on weekdays; End may wrap past midnight
+type Period struct {
+	Name  string   `json:"name"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Days  []string `json:"days,omitempty"` // e.g. ["mon", "tue"]; empty means every day
+	Rate  float64  `json:"rate"`
+}
+
+// Tier prices monthly consumption up to UpToKWh; 0 means unlimited
+type Tier struct {
+	UpToKWh float64 `json:"up_to_kwh"`
+	Rate    float64 `json:"rate"`
+}
+
+// Flat creates a flat tariff
+func Flat(rate float64, currency string) *Tariff {
+	return &Tariff{Type: TypeFlat, Currency: currency, Rate: rate}
+}
+
+// Load reads a tariff from a JSON file
+func Load(path string) (*Tariff, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read tariff file", err)
+	}
+
+	var t Tariff
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errors.NewConfigError("failed to parse tariff file", err)
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Validate checks that the tariff is complete for its type
+func (t *Tariff) Validate() error {
+	switch t.Type {
+	case TypeFlat:
+		if t.Rate < 0 {
+			return errors.NewValidationError("flat tariff rate must not be negative", nil)
+		}
+	case TypeTimeOfUse:
+		if len(t.Periods) == 0 {
+			return errors.NewValidationError("time-of-use tariff needs at least one period", nil)
+		}
+		for _, period := range t.Periods {
+			if _, err := parseClock(period.Start); err != nil {
+				return err
+			}
+			if _, err := parseClock(period.End); err != nil {
+				return err
+			}
+			for _, day := range period.Days {
+				if _, exists := weekdays[strings.ToLower(day)]; !exists {
+					return errors.NewValidationError(fmt.Sprintf("unknown day %q in period %s", day, period.Name), nil)
+				}
+			}
+		}
+	case TypeTiered:
+		if len(t.Tiers) == 0 {
+			return errors.NewValidationError("tiered tariff needs at least one tier", nil)
+		}
+		for i, tier := range t.Tiers {
+			last := i == len(t.Tiers)-1
+			if tier.UpToKWh == 0 && !last {
+				return errors.NewValidationError("only the last tier may be unlimited", nil)
+			}
+			if i > 0 && tier.UpToKWh != 0 && tier.UpToKWh <= t.Tiers[i-1].UpToKWh {
+				return errors.NewValidationError("tiers must be in ascending order", nil)
+			}
+		}
+	default:
+		return errors.NewValidationError(fmt.Sprintf("unknown tariff type %q", t.Type), nil)
+	}
+
+	return nil
+}
+
+// Cost prices kWh consumed at time at. monthToDateKWh is the household's consumption
+// earlier in the month, used to pick tiers; an increment crossing a tier boundary is split.
+func (t *Tariff) Cost(kWh float64, at time.Time, monthToDateKWh float64) float64 {
+	if kWh <= 0 {
+		return 0
+	}
+
+	switch t.Type {
+	case TypeTimeOfUse:
+		return kWh * t.RateAt(at)
+	case TypeTiered:
+		return t.tieredCost(kWh, monthToDateKWh)
+	default:
+		return kWh * t.Rate
+	}
+}
+
+// RateAt returns the time-of-use rate in effect at a time
+func (t *Tariff) RateAt(at time.Time) float64 {
+	if t.Type != TypeTimeOfUse {
+		return t.Rate
+	}
+
+	minute := at.Hour()*60 + at.Minute()
+	day := at.Weekday()
+
+	for _, period := range t.Periods {
+		start, _ := parseClock(period.Start)
+		end, _ := parseClock(period.End)
+
+		inside := minute >= start && minute < end && period.appliesOn(day)
+		if end <= start {
+			// Wraps past midnight, e.g. 23:00-07:00; the hours after midnight belong to the
+			// day the period started, so fri 23:00-07:00 covers Saturday morning
+			previous := (day + 6) % 7
+			inside = (minute >= start && period.appliesOn(day)) || (minute < end && period.appliesOn(previous))
+		}
+		if inside {
+			return period.Rate
+		}
+	}
+
+	return t.Rate
+}
+
+// tieredCost prices kWh starting at monthToDateKWh, splitting it across tiers
+func (t *Tariff) tieredCost(kWh, monthToDateKWh float64) float64 {
+	cost := 0.0
+	position := monthToDateKWh
+	remaining := kWh
+
+	for _, tier := range t.Tiers {
+		if tier.UpToKWh != 0 && position >= tier.UpToKWh {
+			continue
+		}
+
+		inTier := remaining
+		if tier.UpToKWh != 0 {
+			inTier = min(remaining, tier.UpToKWh-position)
+		}
+
+		cost += inTier * tier.Rate
+		remaining -= inTier
+		position += inTier
+		if remaining <= 0 {
+			return cost
+		}
+	}
+
+	// Consumption beyond a bounded last tier stays at its rate
+	return cost + remaining*t.Tiers[len(t.Tiers)-1].Rate
+}
+
+// appliesOn reports whether the period covers a weekday
+func (p Period) appliesOn(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, name := range p.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock converts "HH:MM" to minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.NewValidationError(fmt.Sprintf("invalid time %q, expected HH:MM", value), err)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
@@ -0,0 +1,137 @@
+package tariff
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestFlatCost(t *testing.T) {
+	flat := Flat(0.25, "USD")
+	if err := flat.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	if cost := flat.Cost(2, time.Now(), 0); !almostEqual(cost, 0.5) {
+		t.Errorf("Expected 0.50, got %.4f", cost)
+	}
+}
+
+func TestTimeOfUseRates(t *testing.T) {
+	tou := &Tariff{
+		Type: TypeTimeOfUse,
+		Rate: 0.20,
+		Periods: []Period{
+			{Name: "peak", Start: "16:00", End: "21:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Rate: 0.40},
+			{Name: "night", Start: "23:00", End: "07:00", Rate: 0.10},
+		},
+	}
+	if err := tou.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		rate float64
+	}{
+		{time.Date(2024, 6, 3, 17, 30, 0, 0, time.UTC), 0.40}, // Monday peak
+		{time.Date(2024, 6, 1, 17, 30, 0, 0, time.UTC), 0.20}, // Saturday, no peak
+		{time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC), 0.10}, // Night before midnight
+		{time.Date(2024, 6, 4, 6, 59, 0, 0, time.UTC), 0.10},  // Night after midnight
+		{time.Date(2024, 6, 4, 7, 0, 0, 0, time.UTC), 0.20},   // Night ended
+	}
+
+	for _, test := range tests {
+		if rate := tou.RateAt(test.at); rate != test.rate {
+			t.Errorf("At %s expected rate %.2f, got %.2f", test.at.Format("Mon 15:04"), test.rate, rate)
+		}
+	}
+}
+
+func TestTimeOfUseWrappingPeriodDays(t *testing.T) {
+	// The weekend night rate starts Friday evening and runs into Saturday morning
+	tou := &Tariff{
+		Type:    TypeTimeOfUse,
+		Rate:    0.20,
+		Periods: []Period{{Name: "weekend-night", Start: "23:00", End: "07:00", Days: []string{"fri", "sat"}, Rate: 0.08}},
+	}
+	if err := tou.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		rate float64
+	}{
+		{time.Date(2024, 6, 7, 23, 30, 0, 0, time.UTC), 0.08}, // Friday night
+		{time.Date(2024, 6, 8, 0, 0, 0, 0, time.UTC), 0.08},   // Saturday morning, from Friday
+		{time.Date(2024, 6, 9, 6, 59, 0, 0, time.UTC), 0.08},  // Sunday morning, from Saturday
+		{time.Date(2024, 6, 9, 23, 30, 0, 0, time.UTC), 0.20}, // Sunday night isn't listed
+		{time.Date(2024, 6, 7, 6, 0, 0, 0, time.UTC), 0.20},   // Friday morning follows Thursday
+	}
+	for _, test := range tests {
+		if rate := tou.RateAt(test.at); rate != test.rate {
+			t.Errorf("At %s expected rate %.2f, got %.2f", test.at.Format("Mon 15:04"), test.rate, rate)
+		}
+	}
+}
+
+func TestTieredCostSplitsAcrossTiers(t *testing.T) {
+	tiered := &Tariff{
+		Type: TypeTiered,
+		Tiers: []Tier{
+			{UpToKWh: 100, Rate: 0.10},
+			{UpToKWh: 300, Rate: 0.20},
+			{Rate: 0.30},
+		},
+	}
+	if err := tiered.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	// 10 kWh in the first tier, 10 kWh in the second
+	if cost := tiered.Cost(20, time.Now(), 90); !almostEqual(cost, 3.0) {
+		t.Errorf("Expected 3.00, got %.4f", cost)
+	}
+
+	if cost := tiered.Cost(10, time.Now(), 350); !almostEqual(cost, 3.0) {
+		t.Errorf("Expected 3.00 in the top tier, got %.4f", cost)
+	}
+}
+
+func TestValidateRejectsIncompleteTariffs(t *testing.T) {
+	invalid := []*Tariff{
+		{Type: "hourly"},
+		{Type: TypeTimeOfUse},
+		{Type: TypeTimeOfUse, Periods: []Period{{Start: "25:00", End: "07:00"}}},
+		{Type: TypeTimeOfUse, Periods: []Period{{Start: "07:00", End: "09:00", Days: []string{"someday"}}}},
+		{Type: TypeTiered},
+		{Type: TypeTiered, Tiers: []Tier{{Rate: 0.1}, {UpToKWh: 100, Rate: 0.2}}},
+		{Type: TypeTiered, Tiers: []Tier{{UpToKWh: 200, Rate: 0.1}, {UpToKWh: 100, Rate: 0.2}}},
+	}
+
+	for _, tariff := range invalid {
+		if err := tariff.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", tariff)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tariff.json")
+	os.WriteFile(path, []byte(`{"type": "flat", "currency": "EUR", "rate": 0.32}`), 0644)
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.Type != TypeFlat || loaded.Rate != 0.32 || loaded.Currency != "EUR" {
+		t.Errorf("Unexpected tariff %+v", loaded)
+	}
+}
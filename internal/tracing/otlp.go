@@ -0,0 +1,327 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+const (
+	exportQueueSize = 2048            // Ended spans waiting for export before new ones are dropped
+	exportBatchSize = 256             // Spans sent in one request
+	exportInterval  = 5 * time.Second // How often a partial batch is sent
+	exportTimeout   = 10 * time.Second
+	tracesPath      = "/v1/traces"
+	scopeName       = "github.com/johnpr01/home-automation"
+)
+
+// Tracer starts spans and exports the sampled ones, in batches, to an OTLP/HTTP collector
+// as JSON. It needs no collector libraries, so it runs on the Pi gateway as it is.
+type Tracer struct {
+	endpoint    string
+	service     string
+	sampleRatio float64
+	client      *http.Client
+	logger      *logger.Logger
+	now         func() time.Time
+
+	queue        chan *Span
+	done         chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
+	dropped      atomic.Int64
+}
+
+// NewTracer returns a tracer exporting to the collector at endpoint, e.g. http://collector:4318,
+// as serviceName. sampleRatio is the share of new traces recorded; traces continued from a
+// message keep the sampling decision of their sender.
+func NewTracer(endpoint, serviceName string, sampleRatio float64) (*Tracer, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.NewConfigError(fmt.Sprintf("invalid OTLP endpoint %q, use http://host:4318", endpoint), err)
+	}
+	if !strings.HasSuffix(parsed.Path, tracesPath) {
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + tracesPath
+	}
+
+	t := &Tracer{
+		endpoint:    parsed.String(),
+		service:     serviceName,
+		sampleRatio: sampleRatio,
+		client:      &http.Client{Timeout: exportTimeout},
+		logger:      logger.NewLogger("tracing", nil),
+		now:         time.Now,
+		queue:       make(chan *Span, exportQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// Start starts a span, as the package's Start does with this tracer
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	sc := SpanContext{}
+	parent, ok := SpanContextFrom(ctx)
+	if ok {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		newID(sc.TraceID[:])
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+	newID(sc.SpanID[:])
+
+	ctx = ContextWithSpanContext(ctx, sc)
+	if !sc.Sampled {
+		// Not recorded, but the context still travels so the rest of the trace isn't either
+		return ctx, nil
+	}
+	return ctx, &Span{
+		tracer:     t,
+		context:    sc,
+		parentID:   parent.SpanID,
+		name:       name,
+		kind:       kind,
+		start:      t.now(),
+		attributes: make(map[string]interface{}),
+	}
+}
+
+// sample decides from the trace ID whether a new trace is recorded, so every service tracing
+// at the same ratio makes the same decision
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])) < t.sampleRatio*math.MaxUint64
+}
+
+// enqueue queues an ended span for export, dropping it when the queue is full
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run exports the queued spans in batches until Shutdown
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.logger.Warn("Failed to export trace spans", map[string]interface{}{
+				"endpoint": t.endpoint,
+				"spans":    len(batch),
+				"error":    err.Error(),
+			})
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if dropped := t.dropped.Swap(0); dropped > 0 {
+				t.logger.Warn("Trace export queue full, dropped spans", map[string]interface{}{
+					"dropped": dropped,
+				})
+			}
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.queue:
+					if batch = append(batch, span); len(batch) >= exportBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the spans still queued and stops the tracer. Spans ended afterwards are
+// dropped. It is safe on a nil tracer, as returned when tracing is off.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.shutdownOnce.Do(func() { close(t.done) })
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return errors.NewSystemError("timed out exporting the last trace spans", ctx.Err())
+	}
+}
+
+// export sends spans to the collector as an OTLP ExportTraceServiceRequest
+func (t *Tracer) export(spans []*Span) error {
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{attribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: scopeName},
+			Spans: make([]otlpSpan, 0, len(spans)),
+		}},
+	}}}
+	for _, span := range spans {
+		request.ResourceSpans[0].ScopeSpans[0].Spans = append(request.ResourceSpans[0].ScopeSpans[0].Spans, span.otlp())
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.NewSystemError("failed to encode trace spans", err)
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.NewServiceError("failed to send trace spans", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.NewServiceError(fmt.Sprintf("collector answered %s: %s", resp.Status, strings.TrimSpace(string(message))), nil)
+	}
+	return nil
+}
+
+// otlp returns the span in the OTLP JSON encoding
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+		Name:              s.name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		span.Status = &otlpStatus{Code: statusError, Message: s.err}
+	}
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes, attribute(key, s.attributes[key]))
+	}
+	return span
+}
+
+// statusError is the OTLP status code of a failed span
+const statusError = 2
+
+// The OTLP/HTTP JSON encoding of the trace export request; IDs are hex and times are decimal
+// strings of nanoseconds, as the protocol's JSON mapping requires
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// attribute encodes a key and value, values other than strings, bools and numbers as text
+func attribute(key string, value interface{}) otlpAttribute {
+	var encoded otlpValue
+	switch v := value.(type) {
+	case bool:
+		encoded.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		encoded.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		encoded.IntValue = &s
+	case float64:
+		encoded.DoubleValue = &v
+	case string:
+		encoded.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		encoded.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: encoded}
+}
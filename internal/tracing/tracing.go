@@ -0,0 +1,209 @@
+// Package tracing records spans of the automation chain, e.g. a sensor message through the
+// unified sensor service and the thermostat service to the HVAC command it publishes, and
+// exports them to an OpenTelemetry collector over OTLP/HTTP. Trace context crosses MQTT in the
+// W3C traceparent format.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// SpanKind says what a span's work is, as in OTLP
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+	KindProducer SpanKind = 4 // Publishing a message
+	KindConsumer SpanKind = 5 // Handling a received message
+)
+
+// SpanContext identifies a span within its trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the context has a trace and span ID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the context as a W3C traceparent, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceParent parses a W3C traceparent; ok is false for a missing or malformed one
+func ParseTraceParent(traceParent string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns ctx carrying sc, the parent of spans started from it
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFrom returns the span context ctx carries
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Extract returns ctx continuing the trace of a traceparent received with a message. A missing
+// or malformed traceparent leaves ctx as it is, so the next span starts a new trace.
+func Extract(ctx context.Context, traceParent string) context.Context {
+	if sc, ok := ParseTraceParent(traceParent); ok {
+		return ContextWithSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// Inject returns the traceparent to send with a message published within ctx, "" outside a trace
+func Inject(ctx context.Context) string {
+	if sc, ok := SpanContextFrom(ctx); ok {
+		return sc.TraceParent()
+	}
+	return ""
+}
+
+// Span is an operation within a trace. A nil span, returned when tracing is off or the trace
+// isn't sampled, ignores every call, so callers never check.
+type Span struct {
+	tracer     *Tracer
+	context    SpanContext
+	parentID   [8]byte
+	name       string
+	kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+	mu         sync.Mutex
+}
+
+// SetAttribute sets an attribute of the span, e.g. the room of a reading
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// RecordError marks the span failed with err; a nil err is ignored
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export; later calls are ignored
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = s.tracer.now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// Context returns the span's context
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// global is the tracer of Start; nil when tracing is off
+var global atomic.Pointer[Tracer]
+
+// SetTracer makes t the tracer of Start; nil turns tracing off
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+// Configure starts exporting spans to the endpoint of cfg as serviceName and makes the tracer
+// the one Start uses. It returns the tracer to shut down on exit, nil when tracing is off.
+func Configure(cfg config.TracingConfig, serviceName string) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		SetTracer(nil)
+		return nil, nil
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, errors.NewValidationError(fmt.Sprintf("trace sample ratio %g must be between 0 and 1", cfg.SampleRatio), nil)
+	}
+	tracer, err := NewTracer(cfg.Endpoint, serviceName, cfg.SampleRatio)
+	if err != nil {
+		return nil, err
+	}
+	SetTracer(tracer)
+	return tracer, nil
+}
+
+// Start starts a span named name as a child of the span ctx carries, or the root of a new
+// trace. It returns ctx carrying the new span, for its children and the messages it publishes.
+// The span is nil when tracing is off.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	tracer := global.Load()
+	if tracer == nil {
+		return ctx, nil
+	}
+	return tracer.Start(ctx, name, kind)
+}
+
+// newID fills id with random bytes, never all zero
+func newID(id []byte) {
+	for {
+		rand.Read(id)
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestTraceParent(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceParent(traceParent)
+	if !ok || !sc.Sampled || sc.TraceParent() != traceParent {
+		t.Fatalf("Expected the traceparent round-tripped, got %+v (%v)", sc, ok)
+	}
+	for _, invalid := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01"} {
+		if _, ok := ParseTraceParent(invalid); ok {
+			t.Errorf("Expected %q rejected", invalid)
+		}
+	}
+
+	// Outside a trace nothing is injected, and tracing off leaves the context alone
+	SetTracer(nil)
+	ctx, span := Start(context.Background(), "off", KindInternal)
+	if span != nil || Inject(ctx) != "" {
+		t.Error("Expected no span or traceparent with tracing off")
+	}
+	span.SetAttribute("room_id", "kitchen")
+	span.End()
+}
+
+func TestTracerExportsOTLP(t *testing.T) {
+	requests := make(chan otlpRequest, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request otlpRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("Expected an OTLP JSON request, got %s", body)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	tracer, err := Configure(config.TracingConfig{Endpoint: collector.URL, SampleRatio: 1}, "unified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTracer(nil)
+
+	// A message received with a traceparent continues its sender's trace
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, receive := Start(Extract(context.Background(), remote), "mqtt receive", KindConsumer)
+	receive.SetAttribute("messaging.destination.name", "room-temp/kitchen")
+	childCtx, process := Start(ctx, "ThermostatService process", KindInternal)
+	process.SetAttribute("temperature", 68.5)
+	process.SetAttribute("stage", 2)
+	process.RecordError(io.ErrUnexpectedEOF)
+	if sent, _ := ParseTraceParent(Inject(childCtx)); sent.TraceID != receive.Context().TraceID || sent.SpanID != process.Context().SpanID {
+		t.Errorf("Expected the process span's traceparent injected, got %s", Inject(childCtx))
+	}
+	process.End()
+	receive.End()
+	receive.End()
+
+	// An unsampled trace is carried on but not recorded
+	_, unsampled := Start(Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "skipped", KindInternal)
+	if unsampled != nil {
+		t.Error("Expected no span for an unsampled trace")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+	resource := request.ResourceSpans[0]
+	if name := resource.Resource.Attributes[0]; name.Key != "service.name" || *name.Value.StringValue != "unified" {
+		t.Errorf("Expected the service name as a resource attribute, got %+v", name)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected two spans exported once, got %+v", spans)
+	}
+	processed, received := spans[0], spans[1]
+	if received.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || received.ParentSpanID != "00f067aa0ba902b7" || received.Kind != int(KindConsumer) {
+		t.Errorf("Expected the receive span a child of the remote span, got %+v", received)
+	}
+	if processed.ParentSpanID != received.SpanID || processed.Status == nil || processed.Status.Code != statusError {
+		t.Errorf("Expected the process span a failed child of the receive span, got %+v", processed)
+	}
+	if len(processed.Attributes) != 2 || *processed.Attributes[0].Value.IntValue != "2" || *processed.Attributes[1].Value.DoubleValue != 68.5 {
+		t.Errorf("Expected typed attributes sorted by key, got %+v", processed.Attributes)
+	}
+
+	if _, err := Configure(config.TracingConfig{Endpoint: "collector:4318", SampleRatio: 1}, "unified"); err == nil {
+		t.Error("Expected an endpoint without a scheme rejected")
+	}
+	if _, err := Configure(config.TracingConfig{Endpoint: collector.URL, SampleRatio: 2}, "unified"); err == nil {
+		t.Error("Expected a sample ratio above 1 rejected")
+	}
+}
@@ -231,31 +231,43 @@ func (hc *HealthChecker) RegisterCheck(name string, check HealthCheck) {
 	hc.checks[name] = check
 }
 
-// CheckHealth performs all registered health checks
+// CheckHealth performs all registered health checks. They run at the same time, so a check
+// that hangs delays the results by its timeout only once.
 func (hc *HealthChecker) CheckHealth(ctx context.Context) map[string]error {
 	hc.mutex.RLock()
 	defer hc.mutex.RUnlock()
 
 	results := make(map[string]error)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
 
 	for name, check := range hc.checks {
-		// Run each check with timeout
-		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
 
-		checkErr := make(chan error, 1)
-		go func() {
-			checkErr <- check()
-		}()
+			// Run each check with timeout
+			checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
 
-		select {
-		case err := <-checkErr:
-			results[name] = err
-		case <-checkCtx.Done():
-			results[name] = errors.NewTimeoutError("health check timed out", checkCtx.Err())
-		}
+			checkErr := make(chan error, 1)
+			go func() {
+				checkErr <- check()
+			}()
 
-		cancel()
+			var err error
+			select {
+			case err = <-checkErr:
+			case <-checkCtx.Done():
+				err = errors.NewTimeoutError("health check timed out", checkCtx.Err())
+			}
+
+			resultsMutex.Lock()
+			results[name] = err
+			resultsMutex.Unlock()
+		}(name, check)
 	}
+	wg.Wait()
 
 	return results
 }
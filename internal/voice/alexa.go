@@ -0,0 +1,376 @@
+package voice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// Alexa interfaces the webhook understands
+const (
+	alexaInterface        = "Alexa"
+	alexaDiscovery        = "Alexa.Discovery"
+	alexaAuthorization    = "Alexa.Authorization"
+	alexaPower            = "Alexa.PowerController"
+	alexaThermostat       = "Alexa.ThermostatController"
+	alexaTemperature      = "Alexa.TemperatureSensor"
+	alexaEndpointHealth   = "Alexa.EndpointHealth"
+	alexaPayloadVersion   = "3"
+	alexaUncertaintyMilli = 500
+)
+
+// alexaModes maps thermostat modes to Alexa's; Alexa has no fan-only mode
+var alexaModes = map[models.ThermostatMode]string{
+	models.ModeOff:  "OFF",
+	models.ModeHeat: "HEAT",
+	models.ModeCool: "COOL",
+	models.ModeAuto: "AUTO",
+}
+
+// alexaErrorTypes maps failures to Alexa's error response types
+var alexaErrorTypes = map[string]string{
+	failureNotFound:   "NO_SUCH_ENDPOINT",
+	failureOffline:    "ENDPOINT_UNREACHABLE",
+	failureRange:      "TEMPERATURE_VALUE_OUT_OF_RANGE",
+	failureBlocked:    "NOT_SUPPORTED_IN_CURRENT_MODE",
+	failureNotAllowed: "INVALID_DIRECTIVE",
+	failureInternal:   "INTERNAL_ERROR",
+}
+
+type alexaHeader struct {
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	MessageID        string `json:"messageId"`
+	CorrelationToken string `json:"correlationToken,omitempty"`
+	PayloadVersion   string `json:"payloadVersion"`
+}
+
+type alexaScope struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+type alexaTemperatureValue struct {
+	Value float64 `json:"value"`
+	Scale string  `json:"scale"`
+}
+
+type alexaRequest struct {
+	Directive struct {
+		Header   alexaHeader `json:"header"`
+		Endpoint *struct {
+			Scope      alexaScope `json:"scope"`
+			EndpointID string     `json:"endpointId"`
+		} `json:"endpoint"`
+		Payload struct {
+			Scope               *alexaScope            `json:"scope"`   // Discovery
+			Grantee             *alexaScope            `json:"grantee"` // AcceptGrant
+			TargetSetpoint      *alexaTemperatureValue `json:"targetSetpoint"`
+			TargetSetpointDelta *alexaTemperatureValue `json:"targetSetpointDelta"`
+			ThermostatMode      *struct {
+				Value string `json:"value"`
+			} `json:"thermostatMode"`
+		} `json:"payload"`
+	} `json:"directive"`
+}
+
+type alexaProperty struct {
+	Namespace                 string      `json:"namespace"`
+	Name                      string      `json:"name"`
+	Value                     interface{} `json:"value"`
+	TimeOfSample              string      `json:"timeOfSample"`
+	UncertaintyInMilliseconds int         `json:"uncertaintyInMilliseconds"`
+}
+
+// AlexaHandler serves the directives of an Alexa Smart Home skill. The token is taken from the
+// directive's scope, or from an Authorization header when the skill's Lambda forwards it there.
+func AlexaHandler(controller Controller, validator TokenValidator, cfg *Config, serviceLogger *logger.Logger) http.Handler {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("AlexaSmartHome", nil)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req alexaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Directive.Header.Namespace == "" {
+			http.Error(w, "invalid smart home directive", http.StatusBadRequest)
+			return
+		}
+		directive := req.Directive
+		header := directive.Header
+		endpointID := ""
+		if directive.Endpoint != nil {
+			endpointID = directive.Endpoint.EndpointID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		respond := func(response interface{}) {
+			json.NewEncoder(w).Encode(response)
+		}
+
+		token := bearerToken(r)
+		switch {
+		case directive.Endpoint != nil:
+			token = directive.Endpoint.Scope.Token
+		case directive.Payload.Scope != nil:
+			token = directive.Payload.Scope.Token
+		case directive.Payload.Grantee != nil:
+			token = directive.Payload.Grantee.Token
+		}
+		if err := validator.Validate(r.Context(), token); err != nil {
+			errorType := "INVALID_AUTHORIZATION_CREDENTIAL"
+			if haErr, ok := err.(*errors.HomeAutomationError); !ok || haErr.Type != errors.ErrorTypeValidation {
+				errorType = "INTERNAL_ERROR"
+			}
+			respond(alexaError(header, endpointID, errorType, err.Error()))
+			return
+		}
+
+		devices := exposed(controller, cfg)
+		switch header.Namespace + "." + header.Name {
+		case alexaDiscovery + ".Discover":
+			respond(alexaEvent(alexaHeader{Namespace: alexaDiscovery, Name: "Discover.Response"}, "",
+				map[string]interface{}{"endpoints": alexaEndpoints(devices)}, nil))
+			return
+		case alexaAuthorization + ".AcceptGrant":
+			serviceLogger.Info("Alexa account linked", nil)
+			respond(alexaEvent(alexaHeader{Namespace: alexaAuthorization, Name: "AcceptGrant.Response"}, "", map[string]interface{}{}, nil))
+			return
+		}
+
+		device, ok := findDevice(devices, endpointID)
+		if !ok {
+			respond(alexaError(header, endpointID, alexaErrorTypes[failureNotFound], "unknown endpoint "+endpointID))
+			return
+		}
+		if !device.Online && header.Name != "ReportState" {
+			respond(alexaError(header, endpointID, alexaErrorTypes[failureOffline], device.Name+" is offline"))
+			return
+		}
+
+		reason := ""
+		var err error
+		switch header.Namespace + "." + header.Name {
+		case alexaInterface + ".ReportState":
+		case alexaPower + ".TurnOn", alexaPower + ".TurnOff":
+			if device.Kind == KindThermostat {
+				reason = failureNotAllowed
+				break
+			}
+			err = controller.SetPower(device.ID, header.Name == "TurnOn")
+		case alexaThermostat + ".SetTargetTemperature", alexaThermostat + ".AdjustTargetTemperature":
+			if device.Kind != KindThermostat {
+				reason = failureNotAllowed
+				break
+			}
+			target := device.TargetTemp
+			if setpoint := directive.Payload.TargetSetpoint; setpoint != nil && header.Name == "SetTargetTemperature" {
+				target = alexaFahrenheit(*setpoint)
+			} else if delta := directive.Payload.TargetSetpointDelta; delta != nil && header.Name == "AdjustTargetTemperature" {
+				if delta.Scale == "CELSIUS" {
+					target += delta.Value * 9 / 5
+				} else {
+					target += delta.Value
+				}
+			} else {
+				reason = failureNotAllowed
+				break
+			}
+			if target < device.MinTemp || target > device.MaxTemp {
+				reason = failureRange
+				break
+			}
+			err = controller.SetTargetTemperature(device.ID, target)
+		case alexaThermostat + ".SetThermostatMode":
+			mode, ok := modeFromAlexa(directive.Payload.ThermostatMode)
+			if !ok || device.Kind != KindThermostat {
+				reason = failureNotAllowed
+				break
+			}
+			err = controller.SetThermostatMode(device.ID, mode)
+		default:
+			reason = failureNotAllowed
+		}
+		if err != nil {
+			reason = failure(err)
+		}
+		if reason != "" {
+			serviceLogger.Warn("Alexa directive failed", map[string]interface{}{"endpoint_id": endpointID, "directive": header.Namespace + "." + header.Name, "reason": reason})
+			message := "directive failed"
+			if err != nil {
+				message = err.Error()
+			}
+			respond(alexaError(header, endpointID, alexaErrorTypes[reason], message))
+			return
+		}
+
+		// Report the state after the change
+		if updated, ok := findDevice(exposed(controller, cfg), endpointID); ok {
+			device = updated
+		}
+		name := "Response"
+		if header.Name == "ReportState" {
+			name = "StateReport"
+		}
+		respond(alexaEvent(alexaHeader{Namespace: alexaInterface, Name: name, CorrelationToken: header.CorrelationToken},
+			endpointID, map[string]interface{}{}, alexaProperties(device)))
+	})
+}
+
+// alexaEndpoints describes the devices and the interfaces they support
+func alexaEndpoints(devices []Device) []map[string]interface{} {
+	endpoints := make([]map[string]interface{}, 0, len(devices))
+	for _, device := range devices {
+		capabilities := []map[string]interface{}{
+			{"type": "AlexaInterface", "interface": alexaInterface, "version": alexaPayloadVersion},
+			alexaCapability(alexaEndpointHealth, "connectivity"),
+		}
+		category := "SMARTPLUG"
+		switch device.Kind {
+		case KindThermostat:
+			category = "THERMOSTAT"
+			thermostat := alexaCapability(alexaThermostat, "targetSetpoint", "thermostatMode")
+			thermostat["configuration"] = map[string]interface{}{
+				"supportedModes":     []string{"OFF", "HEAT", "COOL", "AUTO"},
+				"supportsScheduling": false,
+			}
+			capabilities = append(capabilities, thermostat, alexaCapability(alexaTemperature, "temperature"))
+		case KindLight:
+			category = "LIGHT"
+			capabilities = append(capabilities, alexaCapability(alexaPower, "powerState"))
+		default:
+			capabilities = append(capabilities, alexaCapability(alexaPower, "powerState"))
+		}
+
+		description := "Home automation " + device.Kind
+		if device.RoomID != "" {
+			description += " in " + device.RoomID
+		}
+		endpoints = append(endpoints, map[string]interface{}{
+			"endpointId":        device.ID,
+			"manufacturerName":  "Home Automation",
+			"friendlyName":      device.Name,
+			"description":       description,
+			"displayCategories": []string{category},
+			"capabilities":      capabilities,
+		})
+	}
+	return endpoints
+}
+
+func alexaCapability(iface string, properties ...string) map[string]interface{} {
+	supported := make([]map[string]string, len(properties))
+	for i, property := range properties {
+		supported[i] = map[string]string{"name": property}
+	}
+	return map[string]interface{}{
+		"type":      "AlexaInterface",
+		"interface": iface,
+		"version":   alexaPayloadVersion,
+		"properties": map[string]interface{}{
+			"supported":           supported,
+			"retrievable":         true,
+			"proactivelyReported": false,
+		},
+	}
+}
+
+// alexaProperties reports the state of a device; temperatures stay in Fahrenheit
+func alexaProperties(device Device) []alexaProperty {
+	now := time.Now().UTC().Format(time.RFC3339)
+	property := func(namespace, name string, value interface{}) alexaProperty {
+		return alexaProperty{Namespace: namespace, Name: name, Value: value, TimeOfSample: now, UncertaintyInMilliseconds: alexaUncertaintyMilli}
+	}
+
+	connectivity := "UNREACHABLE"
+	if device.Online {
+		connectivity = "OK"
+	}
+	properties := []alexaProperty{property(alexaEndpointHealth, "connectivity", map[string]string{"value": connectivity})}
+
+	if device.Kind == KindThermostat {
+		mode, ok := alexaModes[device.Mode]
+		if !ok {
+			mode = "OFF"
+		}
+		properties = append(properties,
+			property(alexaThermostat, "thermostatMode", mode),
+			property(alexaThermostat, "targetSetpoint", alexaTemperatureValue{Value: device.TargetTemp, Scale: "FAHRENHEIT"}))
+		if device.CurrentTemp != 0 {
+			properties = append(properties, property(alexaTemperature, "temperature", alexaTemperatureValue{Value: device.CurrentTemp, Scale: "FAHRENHEIT"}))
+		}
+		return properties
+	}
+	if device.On != nil {
+		state := "OFF"
+		if *device.On {
+			state = "ON"
+		}
+		properties = append(properties, property(alexaPower, "powerState", state))
+	}
+	return properties
+}
+
+func alexaEvent(header alexaHeader, endpointID string, payload interface{}, properties []alexaProperty) map[string]interface{} {
+	header.MessageID = alexaMessageID()
+	header.PayloadVersion = alexaPayloadVersion
+
+	event := map[string]interface{}{"header": header, "payload": payload}
+	if endpointID != "" {
+		event["endpoint"] = map[string]string{"endpointId": endpointID}
+	}
+	response := map[string]interface{}{"event": event}
+	if properties != nil {
+		response["context"] = map[string]interface{}{"properties": properties}
+	}
+	return response
+}
+
+func alexaError(request alexaHeader, endpointID, errorType, message string) map[string]interface{} {
+	header := alexaHeader{Namespace: alexaInterface, Name: "ErrorResponse", CorrelationToken: request.CorrelationToken}
+	if request.Namespace == alexaAuthorization {
+		header = alexaHeader{Namespace: alexaAuthorization, Name: "ErrorResponse"}
+		errorType = "ACCEPT_GRANT_FAILED"
+	}
+	return alexaEvent(header, endpointID, map[string]string{"type": errorType, "message": message}, nil)
+}
+
+func alexaFahrenheit(value alexaTemperatureValue) float64 {
+	switch value.Scale {
+	case "CELSIUS":
+		return fahrenheit(value.Value)
+	case "KELVIN":
+		return fahrenheit(value.Value - 273.15)
+	}
+	return value.Value
+}
+
+func modeFromAlexa(mode *struct {
+	Value string `json:"value"`
+}) (models.ThermostatMode, bool) {
+	if mode == nil {
+		return "", false
+	}
+	for thermostatMode, name := range alexaModes {
+		if name == mode.Value {
+			return thermostatMode, true
+		}
+	}
+	return "", false
+}
+
+func alexaMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,96 @@
+package voice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func alexaDirective(t *testing.T, handler http.Handler, body string) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/voice/alexa", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	return response
+}
+
+func alexaEventOf(response map[string]interface{}) (name string, payload map[string]interface{}) {
+	event := response["event"].(map[string]interface{})
+	header := event["header"].(map[string]interface{})
+	return header["namespace"].(string) + "." + header["name"].(string), event["payload"].(map[string]interface{})
+}
+
+func TestAlexaSmartHome(t *testing.T) {
+	controller := newFakeController()
+	cfg := testConfig()
+	handler := AlexaHandler(controller, NewTokenValidator(cfg), cfg, nil)
+
+	directive := func(namespace, name, endpointID, token, payload string) string {
+		return `{"directive":{"header":{"namespace":"` + namespace + `","name":"` + name + `","messageId":"m","correlationToken":"c","payloadVersion":"3"},` +
+			`"endpoint":{"scope":{"type":"BearerToken","token":"` + token + `"},"endpointId":"` + endpointID + `"},"payload":` + payload + `}}`
+	}
+
+	response := alexaDirective(t, handler, `{"directive":{"header":{"namespace":"Alexa.Discovery","name":"Discover","messageId":"m","payloadVersion":"3"},`+
+		`"payload":{"scope":{"type":"BearerToken","token":"`+testToken+`"}}}}`)
+	name, payload := alexaEventOf(response)
+	if endpoints := payload["endpoints"].([]interface{}); name != "Alexa.Discovery.Discover.Response" || len(endpoints) != 3 {
+		t.Fatalf("Unexpected discovery %v", response)
+	}
+
+	name, payload = alexaEventOf(alexaDirective(t, handler, directive(alexaPower, "TurnOn", "kettle-plug", "wrong-token", "{}")))
+	if name != "Alexa.ErrorResponse" || payload["type"] != "INVALID_AUTHORIZATION_CREDENTIAL" {
+		t.Errorf("Expected an invalid token rejected, got %s %v", name, payload)
+	}
+
+	response = alexaDirective(t, handler, directive(alexaPower, "TurnOn", "kettle-plug", testToken, "{}"))
+	if name, _ := alexaEventOf(response); name != "Alexa.Response" {
+		t.Errorf("Expected the kettle switched on, got %v", response)
+	}
+	if on := controller.devices["kettle-plug"].On; on == nil || !*on {
+		t.Error("Expected the kettle switched on")
+	}
+
+	alexaDirective(t, handler, directive(alexaThermostat, "SetTargetTemperature", "hall-thermostat", testToken, `{"targetSetpoint":{"value":22,"scale":"CELSIUS"}}`))
+	alexaDirective(t, handler, directive(alexaThermostat, "AdjustTargetTemperature", "hall-thermostat", testToken, `{"targetSetpointDelta":{"value":-2,"scale":"FAHRENHEIT"}}`))
+	alexaDirective(t, handler, directive(alexaThermostat, "SetThermostatMode", "hall-thermostat", testToken, `{"thermostatMode":{"value":"COOL"}}`))
+	if hall := controller.devices["hall-thermostat"]; hall.TargetTemp != 69.6 || hall.Mode != models.ModeCool {
+		t.Errorf("Expected the thermostat cooling to 69.6°F, got %s at %.1f", hall.Mode, hall.TargetTemp)
+	}
+
+	failures := map[string]string{
+		directive(alexaThermostat, "SetTargetTemperature", "hall-thermostat", testToken, `{"targetSetpoint":{"value":95,"scale":"FAHRENHEIT"}}`): "TEMPERATURE_VALUE_OUT_OF_RANGE",
+		directive(alexaPower, "TurnOn", "garage-plug", testToken, "{}"):                                                                          "ENDPOINT_UNREACHABLE",
+		directive(alexaPower, "TurnOn", "attic-fan", testToken, "{}"):                                                                            "NO_SUCH_ENDPOINT",
+		directive(alexaPower, "TurnOn", "hall-thermostat", testToken, "{}"):                                                                      "INVALID_DIRECTIVE",
+	}
+	for body, want := range failures {
+		if name, payload := alexaEventOf(alexaDirective(t, handler, body)); name != "Alexa.ErrorResponse" || payload["type"] != want {
+			t.Errorf("Expected %s, got %s %v", want, name, payload)
+		}
+	}
+
+	response = alexaDirective(t, handler, directive(alexaInterface, "ReportState", "hall-thermostat", testToken, "{}"))
+	if name, _ := alexaEventOf(response); name != "Alexa.StateReport" {
+		t.Fatalf("Unexpected state report %v", response)
+	}
+	properties := response["context"].(map[string]interface{})["properties"].([]interface{})
+	reported := map[string]interface{}{}
+	for _, p := range properties {
+		property := p.(map[string]interface{})
+		reported[property["name"].(string)] = property["value"]
+	}
+	if reported["thermostatMode"] != "COOL" || reported["targetSetpoint"].(map[string]interface{})["value"] != 69.6 {
+		t.Errorf("Unexpected properties %v", reported)
+	}
+}
@@ -0,0 +1,280 @@
+package voice
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/logger"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// Google Smart Home intents, device types, traits and commands
+const (
+	googleSync       = "action.devices.SYNC"
+	googleQuery      = "action.devices.QUERY"
+	googleExecute    = "action.devices.EXECUTE"
+	googleDisconnect = "action.devices.DISCONNECT"
+
+	googleTypeOutlet     = "action.devices.types.OUTLET"
+	googleTypeLight      = "action.devices.types.LIGHT"
+	googleTypeThermostat = "action.devices.types.THERMOSTAT"
+
+	googleTraitOnOff       = "action.devices.traits.OnOff"
+	googleTraitTemperature = "action.devices.traits.TemperatureSetting"
+
+	googleCommandOnOff    = "action.devices.commands.OnOff"
+	googleCommandSetpoint = "action.devices.commands.ThermostatTemperatureSetpoint"
+	googleCommandSetMode  = "action.devices.commands.ThermostatSetMode"
+)
+
+// googleModes maps thermostat modes to Google's; auto is Google's heatcool
+var googleModes = map[models.ThermostatMode]string{
+	models.ModeOff:  "off",
+	models.ModeHeat: "heat",
+	models.ModeCool: "cool",
+	models.ModeAuto: "heatcool",
+	models.ModeFan:  "fan-only",
+}
+
+type googleRequest struct {
+	RequestID string `json:"requestId"`
+	Inputs    []struct {
+		Intent  string `json:"intent"`
+		Payload struct {
+			Devices []struct {
+				ID string `json:"id"`
+			} `json:"devices"`
+			Commands []googleCommand `json:"commands"`
+		} `json:"payload"`
+	} `json:"inputs"`
+}
+
+type googleCommand struct {
+	Devices []struct {
+		ID string `json:"id"`
+	} `json:"devices"`
+	Execution []struct {
+		Command string                 `json:"command"`
+		Params  map[string]interface{} `json:"params"`
+	} `json:"execution"`
+}
+
+type googleCommandResult struct {
+	IDs       []string               `json:"ids"`
+	Status    string                 `json:"status"`
+	States    map[string]interface{} `json:"states,omitempty"`
+	ErrorCode string                 `json:"errorCode,omitempty"`
+}
+
+// googleErrorCodes maps failures to Google's error codes
+var googleErrorCodes = map[string]string{
+	failureNotFound:   "deviceNotFound",
+	failureOffline:    "deviceOffline",
+	failureRange:      "valueOutOfRange",
+	failureBlocked:    "actionNotAvailable",
+	failureNotAllowed: "functionNotSupported",
+	failureInternal:   "hardError",
+}
+
+// GoogleHandler serves the fulfillment URL of a Google Smart Home action
+func GoogleHandler(controller Controller, validator TokenValidator, cfg *Config, serviceLogger *logger.Logger) http.Handler {
+	if serviceLogger == nil {
+		serviceLogger = logger.NewLogger("GoogleSmartHome", nil)
+	}
+	agentUserID := cfg.AgentUserID
+	if agentUserID == "" {
+		agentUserID = "home"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := validator.Validate(r.Context(), bearerToken(r)); err != nil {
+			status := http.StatusUnauthorized
+			if haErr, ok := err.(*errors.HomeAutomationError); !ok || haErr.Type != errors.ErrorTypeValidation {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		var req googleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Inputs) == 0 {
+			http.Error(w, "invalid smart home request", http.StatusBadRequest)
+			return
+		}
+
+		input := req.Inputs[0]
+		var payload interface{}
+		switch input.Intent {
+		case googleSync:
+			payload = googleSyncPayload(exposed(controller, cfg), agentUserID)
+		case googleQuery:
+			devices := exposed(controller, cfg)
+			states := make(map[string]interface{}, len(input.Payload.Devices))
+			for _, requested := range input.Payload.Devices {
+				device, ok := findDevice(devices, requested.ID)
+				if !ok {
+					states[requested.ID] = map[string]interface{}{"status": "ERROR", "errorCode": googleErrorCodes[failureNotFound]}
+					continue
+				}
+				states[requested.ID] = googleState(device)
+			}
+			payload = map[string]interface{}{"devices": states}
+		case googleExecute:
+			payload = map[string]interface{}{"commands": googleExecuteResults(controller, cfg, input.Payload.Commands, serviceLogger)}
+		case googleDisconnect:
+			serviceLogger.Info("Google account unlinked", nil)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+			return
+		default:
+			payload = map[string]interface{}{"errorCode": "notSupported"}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"requestId": req.RequestID, "payload": payload})
+	})
+}
+
+// googleSyncPayload describes the devices, their traits and attributes
+func googleSyncPayload(devices []Device, agentUserID string) map[string]interface{} {
+	described := make([]map[string]interface{}, 0, len(devices))
+	for _, device := range devices {
+		entry := map[string]interface{}{
+			"id":              device.ID,
+			"name":            map[string]interface{}{"name": device.Name},
+			"willReportState": false,
+		}
+		if device.RoomID != "" {
+			entry["roomHint"] = device.RoomID
+		}
+
+		switch device.Kind {
+		case KindThermostat:
+			entry["type"] = googleTypeThermostat
+			entry["traits"] = []string{googleTraitTemperature}
+			entry["attributes"] = map[string]interface{}{
+				"availableThermostatModes":  []string{"off", "heat", "cool", "heatcool"},
+				"thermostatTemperatureUnit": "F",
+				"thermostatTemperatureRange": map[string]interface{}{
+					"minThresholdCelsius": celsius(device.MinTemp),
+					"maxThresholdCelsius": celsius(device.MaxTemp),
+				},
+			}
+		case KindLight:
+			entry["type"] = googleTypeLight
+			entry["traits"] = []string{googleTraitOnOff}
+		default:
+			entry["type"] = googleTypeOutlet
+			entry["traits"] = []string{googleTraitOnOff}
+		}
+		described = append(described, entry)
+	}
+	return map[string]interface{}{"agentUserId": agentUserID, "devices": described}
+}
+
+// googleState reports the state of a device; Google expects temperatures in Celsius
+func googleState(device Device) map[string]interface{} {
+	state := map[string]interface{}{"online": device.Online, "status": "SUCCESS"}
+	if !device.Online {
+		state["status"] = "OFFLINE"
+	}
+
+	if device.Kind == KindThermostat {
+		state["thermostatMode"] = googleModes[device.Mode]
+		state["thermostatTemperatureSetpoint"] = celsius(device.TargetTemp)
+		if device.CurrentTemp != 0 {
+			state["thermostatTemperatureAmbient"] = celsius(device.CurrentTemp)
+		}
+		if device.Humidity != 0 {
+			state["thermostatHumidityAmbient"] = device.Humidity
+		}
+		return state
+	}
+	if device.On != nil {
+		state["on"] = *device.On
+	}
+	return state
+}
+
+// googleExecuteResults runs the executions on each device, stopping a device at its first failure
+func googleExecuteResults(controller Controller, cfg *Config, commands []googleCommand, serviceLogger *logger.Logger) []googleCommandResult {
+	var results []googleCommandResult
+	for _, command := range commands {
+		for _, target := range command.Devices {
+			result := googleCommandResult{IDs: []string{target.ID}, Status: "SUCCESS"}
+			for _, execution := range command.Execution {
+				if reason := runGoogleCommand(controller, cfg, target.ID, execution.Command, execution.Params); reason != "" {
+					result.Status = "ERROR"
+					result.ErrorCode = googleErrorCodes[reason]
+					serviceLogger.Warn("Google command failed", map[string]interface{}{"device_id": target.ID, "command": execution.Command, "reason": reason})
+					break
+				}
+			}
+			if result.Status == "SUCCESS" {
+				if device, ok := findDevice(exposed(controller, cfg), target.ID); ok {
+					result.States = googleState(device)
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// runGoogleCommand runs a command on a device and returns the failure reason, if any
+func runGoogleCommand(controller Controller, cfg *Config, deviceID, command string, params map[string]interface{}) string {
+	device, ok := findDevice(exposed(controller, cfg), deviceID)
+	if !ok {
+		return failureNotFound
+	}
+
+	var err error
+	switch command {
+	case googleCommandOnOff:
+		on, ok := params["on"].(bool)
+		if !ok || device.Kind == KindThermostat {
+			return failureNotAllowed
+		}
+		err = controller.SetPower(deviceID, on)
+	case googleCommandSetpoint:
+		setpoint, ok := params["thermostatTemperatureSetpoint"].(float64)
+		if !ok || device.Kind != KindThermostat {
+			return failureNotAllowed
+		}
+		tempF := fahrenheit(setpoint)
+		if tempF < device.MinTemp || tempF > device.MaxTemp {
+			return failureRange
+		}
+		err = controller.SetTargetTemperature(deviceID, tempF)
+	case googleCommandSetMode:
+		name, _ := params["thermostatMode"].(string)
+		mode, ok := modeFromGoogle(name)
+		if !ok || device.Kind != KindThermostat {
+			return failureNotAllowed
+		}
+		err = controller.SetThermostatMode(deviceID, mode)
+	default:
+		return failureNotAllowed
+	}
+	if err != nil {
+		return failure(err)
+	}
+	return ""
+}
+
+func modeFromGoogle(name string) (models.ThermostatMode, bool) {
+	if name == "on" {
+		return models.ModeAuto, true
+	}
+	for mode, googleName := range googleModes {
+		if googleName == name {
+			return mode, true
+		}
+	}
+	return "", false
+}
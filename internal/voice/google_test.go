@@ -0,0 +1,89 @@
+package voice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+func googleRequestTo(t *testing.T, handler http.Handler, token, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/voice/google", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var response map[string]interface{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, response
+}
+
+func TestGoogleSmartHome(t *testing.T) {
+	controller := newFakeController()
+	cfg := testConfig()
+	cfg.Exclude = []string{"garage-plug"}
+	handler := GoogleHandler(controller, NewTokenValidator(cfg), cfg, nil)
+
+	if code, _ := googleRequestTo(t, handler, "wrong-token", `{"inputs":[{"intent":"action.devices.SYNC"}]}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected an invalid token rejected, got %d", code)
+	}
+
+	_, response := googleRequestTo(t, handler, testToken, `{"requestId":"r1","inputs":[{"intent":"action.devices.SYNC"}]}`)
+	payload := response["payload"].(map[string]interface{})
+	devices := payload["devices"].([]interface{})
+	if response["requestId"] != "r1" || payload["agentUserId"] != "home" || len(devices) != 2 {
+		t.Fatalf("Unexpected SYNC response %v", response)
+	}
+	thermostat := devices[0].(map[string]interface{})
+	if thermostat["type"] != googleTypeThermostat || thermostat["name"].(map[string]interface{})["name"] != "Hallway" {
+		t.Errorf("Unexpected thermostat %v", thermostat)
+	}
+
+	_, response = googleRequestTo(t, handler, testToken, `{"requestId":"r2","inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[
+		{"devices":[{"id":"kettle-plug"}],"execution":[{"command":"action.devices.commands.OnOff","params":{"on":true}}]},
+		{"devices":[{"id":"hall-thermostat"}],"execution":[
+			{"command":"action.devices.commands.ThermostatSetMode","params":{"thermostatMode":"heatcool"}},
+			{"command":"action.devices.commands.ThermostatTemperatureSetpoint","params":{"thermostatTemperatureSetpoint":21.5}}]},
+		{"devices":[{"id":"hall-thermostat"}],"execution":[{"command":"action.devices.commands.ThermostatTemperatureSetpoint","params":{"thermostatTemperatureSetpoint":35}}]},
+		{"devices":[{"id":"garage-plug"}],"execution":[{"command":"action.devices.commands.OnOff","params":{"on":true}}]}]}}]}`)
+	results := response["payload"].(map[string]interface{})["commands"].([]interface{})
+	wantCodes := []string{"", "", "valueOutOfRange", "deviceNotFound"}
+	for i, want := range wantCodes {
+		result := results[i].(map[string]interface{})
+		if code, _ := result["errorCode"].(string); code != want {
+			t.Errorf("Command %d: expected error %q, got %v", i, want, result)
+		}
+	}
+	if on := controller.devices["kettle-plug"].On; on == nil || !*on {
+		t.Error("Expected the kettle switched on")
+	}
+	if hall := controller.devices["hall-thermostat"]; hall.Mode != models.ModeAuto || hall.TargetTemp != 70.7 {
+		t.Errorf("Expected the thermostat on auto at 70.7°F, got %s at %.1f", hall.Mode, hall.TargetTemp)
+	}
+
+	_, response = googleRequestTo(t, handler, testToken, `{"requestId":"r3","inputs":[{"intent":"action.devices.QUERY","payload":{"devices":[{"id":"hall-thermostat"}]}}]}`)
+	state := response["payload"].(map[string]interface{})["devices"].(map[string]interface{})["hall-thermostat"].(map[string]interface{})
+	if state["thermostatMode"] != "heatcool" || state["thermostatTemperatureSetpoint"] != 21.5 || state["thermostatTemperatureAmbient"] != 18.9 {
+		t.Errorf("Unexpected QUERY state %v", state)
+	}
+
+	// Commands the system holds back are reported as unavailable
+	controller.err = errors.NewBusinessError("safe mode is active", nil)
+	_, response = googleRequestTo(t, handler, testToken, `{"requestId":"r4","inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[
+		{"devices":[{"id":"kettle-plug"}],"execution":[{"command":"action.devices.commands.OnOff","params":{"on":false}}]}]}}]}`)
+	result := response["payload"].(map[string]interface{})["commands"].([]interface{})[0].(map[string]interface{})
+	if result["errorCode"] != "actionNotAvailable" {
+		t.Errorf("Expected a blocked command, got %v", result)
+	}
+}
@@ -0,0 +1,129 @@
+package voice
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// introspectionCacheTTL bounds how long an active token is trusted without asking again
+const introspectionCacheTTL = 5 * time.Minute
+
+// TokenValidator decides whether an OAuth access token grants access to the home
+type TokenValidator interface {
+	Validate(ctx context.Context, token string) error
+}
+
+// NewTokenValidator accepts the configured access tokens and, with an introspection URL, the
+// tokens the authorization server reports active
+func NewTokenValidator(cfg *Config) TokenValidator {
+	validator := &tokenValidator{
+		introspectionURL: cfg.IntrospectionURL,
+		clientID:         cfg.ClientID,
+		clientSecret:     cfg.ClientSecret,
+		httpClient:       &http.Client{Timeout: 5 * time.Second},
+		cache:            make(map[[32]byte]time.Time),
+	}
+	for _, token := range cfg.AccessTokens {
+		validator.static = append(validator.static, sha256.Sum256([]byte(token)))
+	}
+	return validator
+}
+
+type tokenValidator struct {
+	static           [][32]byte
+	introspectionURL string
+	clientID         string
+	clientSecret     string
+	httpClient       *http.Client
+	cache            map[[32]byte]time.Time // Active tokens by hash, until they must be checked again
+	mu               sync.Mutex
+}
+
+func (v *tokenValidator) Validate(ctx context.Context, token string) error {
+	if token == "" {
+		return errors.NewValidationError("missing access token", nil)
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	for _, known := range v.static {
+		if subtle.ConstantTimeCompare(hash[:], known[:]) == 1 {
+			return nil
+		}
+	}
+	if v.introspectionURL == "" {
+		return errors.NewValidationError("invalid access token", nil)
+	}
+
+	v.mu.Lock()
+	until, cached := v.cache[hash]
+	v.mu.Unlock()
+	if cached && time.Now().Before(until) {
+		return nil
+	}
+
+	until, err := v.introspect(ctx, token)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.cache[hash] = until
+	v.mu.Unlock()
+	return nil
+}
+
+// introspect asks the authorization server about a token and returns how long to trust it
+func (v *tokenValidator) introspect(ctx context.Context, token string) (time.Time, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.introspectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return time.Time{}, errors.NewConfigError("invalid introspection URL", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if v.clientID != "" {
+		req.SetBasicAuth(v.clientID, v.clientSecret)
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, errors.NewServiceError("token introspection failed", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, errors.NewServiceError("token introspection returned "+resp.Status, nil)
+	}
+
+	var result struct {
+		Active bool  `json:"active"`
+		Exp    int64 `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return time.Time{}, errors.NewServiceError("invalid introspection response", err)
+	}
+	if !result.Active {
+		return time.Time{}, errors.NewValidationError("access token is not active", nil)
+	}
+
+	until := time.Now().Add(introspectionCacheTTL)
+	if result.Exp > 0 && time.Unix(result.Exp, 0).Before(until) {
+		until = time.Unix(result.Exp, 0)
+	}
+	return until, nil
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
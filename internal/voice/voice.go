@@ -0,0 +1,171 @@
+// Package voice implements the smart home webhooks of Google Assistant (SYNC, QUERY, EXECUTE and
+// DISCONNECT intents) and Alexa (Smart Home Skill API v3 directives, usually forwarded by the
+// skill's Lambda function). Both control the plugs, lights and thermostats of a Controller, and
+// every request must carry an OAuth access token issued at account linking.
+package voice
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+// Kinds of devices exposed to voice assistants
+const (
+	KindPlug       = "plug"
+	KindLight      = "light"
+	KindThermostat = "thermostat"
+)
+
+// Device is a device as voice assistants see it. Temperatures are in °F like everywhere else in
+// the system and converted to Celsius where an assistant expects it.
+type Device struct {
+	ID     string
+	Name   string
+	RoomID string
+	Kind   string
+	Online bool
+
+	// Plugs and lights
+	On *bool
+
+	// Thermostats
+	Mode        models.ThermostatMode
+	TargetTemp  float64
+	CurrentTemp float64
+	Humidity    float64
+	MinTemp     float64
+	MaxTemp     float64
+}
+
+// Controller lists and controls the devices voice assistants may use
+type Controller interface {
+	Devices() []Device
+	SetPower(deviceID string, on bool) error
+	SetTargetTemperature(deviceID string, tempF float64) error
+	SetThermostatMode(deviceID string, mode models.ThermostatMode) error
+}
+
+// Config configures the voice assistant webhooks
+type Config struct {
+	AgentUserID string `json:"agent_user_id,omitempty"` // Google's ID for the household, default "home"
+
+	// Access tokens are accepted when listed in AccessTokens or when the authorization server at
+	// IntrospectionURL reports them active (RFC 7662)
+	AccessTokens     []string `json:"access_tokens,omitempty"`
+	IntrospectionURL string   `json:"introspection_url,omitempty"`
+	ClientID         string   `json:"client_id,omitempty"`
+	ClientSecret     string   `json:"client_secret,omitempty"`
+
+	Exclude []string          `json:"exclude,omitempty"` // Devices hidden from assistants
+	Names   map[string]string `json:"names,omitempty"`   // Spoken names by device ID
+}
+
+// LoadConfig reads the voice assistant configuration from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read voice assistant file", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.NewConfigError("failed to parse voice assistant file", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that tokens can be validated one way or another
+func (c *Config) Validate() error {
+	if len(c.AccessTokens) == 0 && c.IntrospectionURL == "" {
+		return errors.NewValidationError("voice assistants need access_tokens or an introspection_url", nil)
+	}
+	for _, token := range c.AccessTokens {
+		if len(token) < 16 {
+			return errors.NewValidationError("access tokens must be at least 16 characters", nil)
+		}
+	}
+	return nil
+}
+
+// exposed returns the controller's devices that assistants may see, with their spoken names
+func exposed(controller Controller, cfg *Config) []Device {
+	hidden := make(map[string]bool, len(cfg.Exclude))
+	for _, id := range cfg.Exclude {
+		hidden[id] = true
+	}
+
+	var devices []Device
+	for _, device := range controller.Devices() {
+		if hidden[device.ID] {
+			continue
+		}
+		if name, ok := cfg.Names[device.ID]; ok {
+			device.Name = name
+		}
+		if device.Name == "" {
+			device.Name = device.ID
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func findDevice(devices []Device, id string) (Device, bool) {
+	for _, device := range devices {
+		if device.ID == id {
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+// Failure reasons shared by both assistants' error codes
+const (
+	failureNotFound   = "not_found"
+	failureOffline    = "offline"
+	failureRange      = "out_of_range"
+	failureBlocked    = "blocked"
+	failureNotAllowed = "not_supported"
+	failureInternal   = "internal"
+)
+
+// failure classifies a controller error. Business errors are actions the system refuses, such as
+// commands held back by safe mode; device and connection errors mean the device didn't answer.
+func failure(err error) string {
+	haErr, ok := err.(*errors.HomeAutomationError)
+	if !ok {
+		return failureInternal
+	}
+	switch haErr.Type {
+	case errors.ErrorTypeBusiness:
+		return failureBlocked
+	case errors.ErrorTypeValidation:
+		return failureNotAllowed
+	case errors.ErrorTypeDevice, errors.ErrorTypeConnection, errors.ErrorTypeMQTT, errors.ErrorTypeTimeout, errors.ErrorTypeService:
+		return failureOffline
+	}
+	return failureInternal
+}
+
+// celsius and fahrenheit convert rounded to a tenth of a degree
+func celsius(f float64) float64 {
+	return roundTenth((f - 32) * 5 / 9)
+}
+
+func fahrenheit(c float64) float64 {
+	return roundTenth(c*9/5 + 32)
+}
+
+func roundTenth(v float64) float64 {
+	if v < 0 {
+		return float64(int(v*10-0.5)) / 10
+	}
+	return float64(int(v*10+0.5)) / 10
+}
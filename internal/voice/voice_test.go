@@ -0,0 +1,118 @@
+package voice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/models"
+)
+
+const testToken = "linked-account-token"
+
+type fakeController struct {
+	devices map[string]*Device
+	err     error
+}
+
+func newFakeController() *fakeController {
+	off := false
+	return &fakeController{devices: map[string]*Device{
+		"kettle-plug": {ID: "kettle-plug", Name: "Kettle", RoomID: "kitchen", Kind: KindPlug, Online: true, On: &off},
+		"hall-thermostat": {ID: "hall-thermostat", Name: "Hall", RoomID: "hall", Kind: KindThermostat, Online: true,
+			Mode: models.ModeHeat, TargetTemp: 68, CurrentTemp: 66, MinTemp: 50, MaxTemp: 85},
+		"garage-plug": {ID: "garage-plug", Kind: KindPlug},
+	}}
+}
+
+func (f *fakeController) Devices() []Device {
+	var devices []Device
+	for _, id := range []string{"garage-plug", "hall-thermostat", "kettle-plug"} {
+		devices = append(devices, *f.devices[id])
+	}
+	return devices
+}
+
+func (f *fakeController) SetPower(deviceID string, on bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.devices[deviceID].On = &on
+	return nil
+}
+
+func (f *fakeController) SetTargetTemperature(deviceID string, tempF float64) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.devices[deviceID].TargetTemp = tempF
+	return nil
+}
+
+func (f *fakeController) SetThermostatMode(deviceID string, mode models.ThermostatMode) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.devices[deviceID].Mode = mode
+	return nil
+}
+
+func testConfig() *Config {
+	return &Config{AccessTokens: []string{testToken}, Names: map[string]string{"hall-thermostat": "Hallway"}}
+}
+
+func TestTokenValidatorIntrospection(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "home" || pass != "secret" {
+			t.Errorf("Expected client credentials, got %q %q", user, pass)
+		}
+		if r.FormValue("token") == "active-token" {
+			w.Write([]byte(`{"active": true}`))
+			return
+		}
+		w.Write([]byte(`{"active": false}`))
+	}))
+	defer server.Close()
+
+	validator := NewTokenValidator(&Config{AccessTokens: []string{testToken}, IntrospectionURL: server.URL, ClientID: "home", ClientSecret: "secret"})
+	ctx := context.Background()
+
+	if err := validator.Validate(ctx, testToken); err != nil {
+		t.Errorf("Expected the configured token accepted, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected configured tokens checked locally, got %d introspections", calls)
+	}
+	for i := 0; i < 2; i++ {
+		if err := validator.Validate(ctx, "active-token"); err != nil {
+			t.Errorf("Expected the active token accepted, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the active token cached, got %d introspections", calls)
+	}
+
+	err := validator.Validate(ctx, "revoked-token")
+	if haErr, ok := err.(*errors.HomeAutomationError); !ok || haErr.Type != errors.ErrorTypeValidation {
+		t.Errorf("Expected an inactive token rejected, got %v", err)
+	}
+	if err := validator.Validate(ctx, ""); err == nil {
+		t.Error("Expected a missing token rejected")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err == nil {
+		t.Error("Expected a config without tokens rejected")
+	}
+	if err := (&Config{AccessTokens: []string{"short"}}).Validate(); err == nil {
+		t.Error("Expected a short token rejected")
+	}
+	if err := testConfig().Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Package ble listens for the Bluetooth LE advertisements of battery thermometers and decodes
+// their readings: BTHome v2, Xiaomi MiBeacon (unencrypted), the ATC and pvvx custom firmware of
+// Xiaomi LYWSD03MMC thermometers, and SwitchBot meters. Scanning is passive, through a raw HCI
+// socket, and only available on Linux.
+package ble
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Advertisement formats
+const (
+	FormatBTHome    = "bthome"
+	FormatMiBeacon  = "mibeacon"
+	FormatATC       = "atc"
+	FormatPVVX      = "pvvx"
+	FormatSwitchBot = "switchbot"
+)
+
+// AD structure types read from advertising data
+const (
+	adServiceData16      = 0x16
+	adManufacturerData   = 0xff
+	hciEventPacket       = 0x04
+	hciEventLEMeta       = 0x3e
+	leAdvertisingReport  = 0x02
+	advertisingReportLen = 10 // Event type, address type, address, data length, RSSI
+)
+
+// Advertisement is the advertising data of a device, keyed by 16-bit service UUID and company ID
+type Advertisement struct {
+	Address          string // e.g. A4:C1:38:12:34:56
+	RSSI             int
+	ServiceData      map[uint16][]byte
+	ManufacturerData map[uint16][]byte
+}
+
+// Reading is what a thermometer advertised. Fields it didn't send are nil.
+type Reading struct {
+	Format         string
+	TemperatureC   *float64
+	Humidity       *float64 // Relative humidity in percent
+	BatteryPercent *float64
+}
+
+// ParseAdvertisingData splits advertising data into its service and manufacturer data
+func ParseAdvertisingData(address string, rssi int, data []byte) Advertisement {
+	adv := Advertisement{
+		Address:          address,
+		RSSI:             rssi,
+		ServiceData:      make(map[uint16][]byte),
+		ManufacturerData: make(map[uint16][]byte),
+	}
+	for len(data) > 1 {
+		length := int(data[0])
+		if length == 0 || length >= len(data) {
+			break
+		}
+		field := data[1 : 1+length]
+		if len(field) >= 3 {
+			id := uint16(field[1]) | uint16(field[2])<<8
+			switch field[0] {
+			case adServiceData16:
+				adv.ServiceData[id] = field[3:]
+			case adManufacturerData:
+				adv.ManufacturerData[id] = field[3:]
+			}
+		}
+		data = data[1+length:]
+	}
+	return adv
+}
+
+// ParseHCIEvent returns the advertisements of an HCI LE advertising report event, starting with
+// the packet type. Other events return none.
+func ParseHCIEvent(packet []byte) []Advertisement {
+	if len(packet) < 5 || packet[0] != hciEventPacket || packet[1] != hciEventLEMeta || packet[3] != leAdvertisingReport {
+		return nil
+	}
+
+	var advertisements []Advertisement
+	reports, body := int(packet[4]), packet[5:]
+	for i := 0; i < reports && len(body) >= advertisingReportLen; i++ {
+		dataLen := int(body[8])
+		if len(body) < advertisingReportLen+dataLen {
+			break
+		}
+		address := body[2:8]
+		rssi := int(int8(body[9+dataLen]))
+		advertisements = append(advertisements, ParseAdvertisingData(formatAddress(address), rssi, body[9:9+dataLen]))
+		body = body[advertisingReportLen+dataLen:]
+	}
+	return advertisements
+}
+
+// formatAddress formats an address sent least significant byte first
+func formatAddress(address []byte) string {
+	parts := make([]string, len(address))
+	for i := range address {
+		parts[i] = fmt.Sprintf("%02X", address[len(address)-1-i])
+	}
+	return strings.Join(parts, ":")
+}
+
+// NormalizeAddress upper-cases an address and accepts dashes, so configured addresses match
+func NormalizeAddress(address string) string {
+	return strings.ToUpper(strings.ReplaceAll(address, "-", ":"))
+}
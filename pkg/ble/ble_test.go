@@ -0,0 +1,102 @@
+package ble
+
+import (
+	"math"
+	"testing"
+)
+
+func near(value *float64, want float64) bool {
+	return value != nil && math.Abs(*value-want) < 0.001
+}
+
+func TestParseHCIEvent(t *testing.T) {
+	// An LE advertising report of a pvvx thermometer: 21.5 C, 48.3 %, 3000 mV, 87 %
+	data := []byte{
+		0x02, 0x01, 0x06, // Flags
+		0x12, 0x16, 0x1a, 0x18, // Service data of 0x181A
+		0x56, 0x34, 0x12, 0x38, 0xc1, 0xa4, 0x66, 0x08, 0xde, 0x12, 0xb8, 0x0b, 0x57, 0x01, 0x04,
+	}
+	packet := append([]byte{0x04, 0x3e, byte(12 + len(data)), 0x02, 0x01, 0x00, 0x00,
+		0x56, 0x34, 0x12, 0x38, 0xc1, 0xa4, byte(len(data))}, data...)
+	packet = append(packet, 0xc4) // RSSI -60
+
+	advertisements := ParseHCIEvent(packet)
+	if len(advertisements) != 1 {
+		t.Fatalf("Expected one advertisement, got %d", len(advertisements))
+	}
+	adv := advertisements[0]
+	if adv.Address != "A4:C1:38:12:34:56" || adv.RSSI != -60 {
+		t.Fatalf("Unexpected advertisement %+v", adv)
+	}
+	reading, err := Decode(adv)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if reading.Format != FormatPVVX || !near(reading.TemperatureC, 21.5) || !near(reading.Humidity, 48.3) || !near(reading.BatteryPercent, 87) {
+		t.Fatalf("Unexpected reading %+v", reading)
+	}
+
+	if ParseHCIEvent([]byte{0x04, 0x0e, 0x04, 0x01, 0x0b, 0x20, 0x00}) != nil {
+		t.Fatal("Expected a command completion to carry no advertisements")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name         string
+		adv          Advertisement
+		format       string
+		temperatureC float64
+		humidity     float64
+	}{
+		{
+			name:   "bthome",
+			adv:    Advertisement{ServiceData: map[uint16][]byte{uuidBTHome: {0x40, 0x00, 0x12, 0x01, 0x5d, 0x02, 0xca, 0x08, 0x03, 0xbf, 0x13}}},
+			format: FormatBTHome, temperatureC: 22.5, humidity: 50.55,
+		},
+		{
+			name:   "atc",
+			adv:    Advertisement{ServiceData: map[uint16][]byte{uuidEnvironmental: {0xa4, 0xc1, 0x38, 0x12, 0x34, 0x56, 0xff, 0xec, 0x3c, 0x5a, 0x0b, 0xb8, 0x01}}},
+			format: FormatATC, temperatureC: -2.0, humidity: 60,
+		},
+		{
+			name: "mibeacon",
+			adv: Advertisement{ServiceData: map[uint16][]byte{uuidMiBeacon: {
+				0x50, 0x20, 0xaa, 0x01, 0x07, 0x56, 0x34, 0x12, 0x38, 0xc1, 0xa4, 0x0d, 0x10, 0x04, 0xdb, 0x00, 0xe3, 0x01,
+			}}},
+			format: FormatMiBeacon, temperatureC: 21.9, humidity: 48.3,
+		},
+		{
+			name:   "switchbot meter",
+			adv:    Advertisement{ServiceData: map[uint16][]byte{uuidSwitchBotLegacy: {0x54, 0x00, 0x5f, 0x04, 0x96, 0x2d}}},
+			format: FormatSwitchBot, temperatureC: 22.4, humidity: 45,
+		},
+		{
+			name: "switchbot outdoor meter",
+			adv: Advertisement{
+				ServiceData:      map[uint16][]byte{uuidSwitchBot: {0x77, 0x00, 0x50}},
+				ManufacturerData: map[uint16][]byte{companySwitchBot: {0xd0, 0xc8, 0x4b, 0x1c, 0x2b, 0x7e, 0x00, 0x00, 0x03, 0x05, 0x4e, 0x00}},
+			},
+			format: FormatSwitchBot, temperatureC: -5.3, humidity: 78,
+		},
+	}
+
+	for _, test := range tests {
+		reading, err := Decode(test.adv)
+		if err != nil {
+			t.Errorf("%s: Decode failed: %v", test.name, err)
+			continue
+		}
+		if reading.Format != test.format || !near(reading.TemperatureC, test.temperatureC) || !near(reading.Humidity, test.humidity) {
+			t.Errorf("%s: unexpected reading %s %v C %v %%", test.name, reading.Format, *reading.TemperatureC, *reading.Humidity)
+		}
+	}
+
+	encrypted := Advertisement{ServiceData: map[uint16][]byte{uuidMiBeacon: {0x58, 0x58, 0x5b, 0x05, 0x01, 0x00}}}
+	if _, err := Decode(encrypted); err == nil || err == ErrNoReading {
+		t.Errorf("Expected encrypted MiBeacon frames reported, got %v", err)
+	}
+	if _, err := Decode(Advertisement{ManufacturerData: map[uint16][]byte{0x004c: {0x02, 0x15}}}); err != ErrNoReading {
+		t.Errorf("Expected other devices to carry no reading, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package ble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Service UUIDs and company IDs of the formats decoded
+const (
+	uuidBTHome          = 0xfcd2
+	uuidMiBeacon        = 0xfe95
+	uuidEnvironmental   = 0x181a // ATC and pvvx firmware
+	uuidSwitchBot       = 0xfd3d
+	uuidSwitchBotLegacy = 0x0d00
+	companySwitchBot    = 0x0969
+)
+
+// ErrNoReading is returned for advertisements carrying no thermometer data
+var ErrNoReading = errors.New("no thermometer data in the advertisement")
+
+// bthomeObjectLengths are the data lengths of BTHome v2 objects by ID. Objects are parsed in
+// order, so an unknown ID ends the parsing.
+var bthomeObjectLengths = map[byte]int{
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x04: 3, 0x05: 3, 0x06: 2, 0x07: 2, 0x08: 2, 0x09: 1,
+	0x0a: 3, 0x0b: 3, 0x0c: 2, 0x0d: 2, 0x0e: 2, 0x0f: 1, 0x10: 1, 0x11: 1, 0x12: 2, 0x13: 2,
+	0x14: 2, 0x15: 1, 0x16: 1, 0x17: 1, 0x18: 1, 0x19: 1, 0x1a: 1, 0x1b: 1, 0x1c: 1, 0x1d: 1,
+	0x1e: 1, 0x1f: 1, 0x20: 1, 0x21: 1, 0x22: 1, 0x23: 1, 0x24: 1, 0x25: 1, 0x26: 1, 0x27: 1,
+	0x28: 1, 0x29: 1, 0x2a: 1, 0x2b: 1, 0x2c: 1, 0x2d: 1, 0x2e: 1, 0x2f: 1, 0x3a: 1, 0x3c: 2,
+	0x3d: 2, 0x3e: 4, 0x3f: 2, 0x40: 2, 0x41: 2, 0x42: 3, 0x43: 2, 0x44: 2, 0x45: 2, 0x46: 1,
+	0x47: 2, 0x48: 2, 0x49: 2, 0x4a: 2, 0x4b: 3, 0x4c: 4, 0x4d: 4, 0x4e: 4, 0x4f: 4, 0x50: 4,
+	0x51: 2, 0x52: 2, 0x57: 1, 0x58: 1,
+}
+
+// Decode returns the reading of a thermometer's advertisement
+func Decode(adv Advertisement) (Reading, error) {
+	if data, ok := adv.ServiceData[uuidBTHome]; ok {
+		return decodeBTHome(data)
+	}
+	if data, ok := adv.ServiceData[uuidEnvironmental]; ok {
+		return decodeEnvironmental(data)
+	}
+	if data, ok := adv.ServiceData[uuidMiBeacon]; ok {
+		return decodeMiBeacon(data)
+	}
+	for _, uuid := range []uint16{uuidSwitchBot, uuidSwitchBotLegacy} {
+		if data, ok := adv.ServiceData[uuid]; ok {
+			return decodeSwitchBot(data, adv.ManufacturerData[companySwitchBot])
+		}
+	}
+	return Reading{}, ErrNoReading
+}
+
+func value(v float64) *float64 {
+	return &v
+}
+
+// decodeBTHome reads a BTHome v2 payload: a device information byte, then objects of an ID and
+// little-endian data
+func decodeBTHome(data []byte) (Reading, error) {
+	if len(data) < 1 {
+		return Reading{}, ErrNoReading
+	}
+	if data[0]&0x01 != 0 {
+		return Reading{}, fmt.Errorf("encrypted BTHome advertisements are not supported")
+	}
+	if version := data[0] >> 5; version != 2 {
+		return Reading{}, fmt.Errorf("unsupported BTHome version %d", version)
+	}
+
+	reading := Reading{Format: FormatBTHome}
+	objects := data[1:]
+	for len(objects) > 0 {
+		id := objects[0]
+		length, known := bthomeObjectLengths[id]
+		if !known || len(objects) < 1+length {
+			break
+		}
+		raw := objects[1 : 1+length]
+		switch id {
+		case 0x01:
+			reading.BatteryPercent = value(float64(raw[0]))
+		case 0x02:
+			reading.TemperatureC = value(float64(int16(binary.LittleEndian.Uint16(raw))) * 0.01)
+		case 0x03:
+			reading.Humidity = value(float64(binary.LittleEndian.Uint16(raw)) * 0.01)
+		case 0x2e:
+			reading.Humidity = value(float64(raw[0]))
+		case 0x45:
+			reading.TemperatureC = value(float64(int16(binary.LittleEndian.Uint16(raw))) * 0.1)
+		case 0x57:
+			reading.TemperatureC = value(float64(int8(raw[0])))
+		case 0x58:
+			reading.TemperatureC = value(float64(int8(raw[0])) * 0.35)
+		}
+		objects = objects[1+length:]
+	}
+	if reading.TemperatureC == nil && reading.Humidity == nil {
+		return Reading{}, ErrNoReading
+	}
+	return reading, nil
+}
+
+// decodeEnvironmental reads the ATC (13 bytes, big-endian) and pvvx (15 bytes, little-endian)
+// custom firmware formats
+func decodeEnvironmental(data []byte) (Reading, error) {
+	switch len(data) {
+	case 13:
+		return Reading{
+			Format:         FormatATC,
+			TemperatureC:   value(float64(int16(binary.BigEndian.Uint16(data[6:]))) * 0.1),
+			Humidity:       value(float64(data[8])),
+			BatteryPercent: value(float64(data[9])),
+		}, nil
+	case 15:
+		return Reading{
+			Format:         FormatPVVX,
+			TemperatureC:   value(float64(int16(binary.LittleEndian.Uint16(data[6:]))) * 0.01),
+			Humidity:       value(float64(binary.LittleEndian.Uint16(data[8:])) * 0.01),
+			BatteryPercent: value(float64(data[12])),
+		}, nil
+	default:
+		return Reading{}, ErrNoReading
+	}
+}
+
+// decodeMiBeacon reads an unencrypted Xiaomi MiBeacon frame: frame control, product ID and
+// counter, optionally the MAC and capabilities, then objects of a type, length and data
+func decodeMiBeacon(data []byte) (Reading, error) {
+	if len(data) < 5 {
+		return Reading{}, ErrNoReading
+	}
+	control := binary.LittleEndian.Uint16(data)
+	if control&0x0008 != 0 {
+		return Reading{}, fmt.Errorf("encrypted MiBeacon advertisements need the device's bind key; flash ATC or pvvx firmware instead")
+	}
+	if control&0x0040 == 0 {
+		return Reading{}, ErrNoReading
+	}
+
+	offset := 5
+	if control&0x0010 != 0 {
+		offset += 6 // MAC
+	}
+	if control&0x0020 != 0 {
+		if len(data) <= offset {
+			return Reading{}, ErrNoReading
+		}
+		capability := data[offset]
+		offset++
+		if capability&0x20 != 0 {
+			offset += 2 // I/O capability
+		}
+	}
+
+	reading := Reading{Format: FormatMiBeacon}
+	for offset+3 <= len(data) {
+		objectType := binary.LittleEndian.Uint16(data[offset:])
+		length := int(data[offset+2])
+		raw := data[offset+3:]
+		if len(raw) < length {
+			break
+		}
+		raw = raw[:length]
+		switch {
+		case objectType == 0x1004 && length == 2:
+			reading.TemperatureC = value(float64(int16(binary.LittleEndian.Uint16(raw))) * 0.1)
+		case objectType == 0x1006 && length == 2:
+			reading.Humidity = value(float64(binary.LittleEndian.Uint16(raw)) * 0.1)
+		case objectType == 0x100a && length >= 1:
+			reading.BatteryPercent = value(float64(raw[0]))
+		case objectType == 0x100d && length == 4:
+			reading.TemperatureC = value(float64(int16(binary.LittleEndian.Uint16(raw))) * 0.1)
+			reading.Humidity = value(float64(binary.LittleEndian.Uint16(raw[2:])) * 0.1)
+		}
+		offset += 3 + length
+	}
+	if reading.TemperatureC == nil && reading.Humidity == nil && reading.BatteryPercent == nil {
+		return Reading{}, ErrNoReading
+	}
+	return reading, nil
+}
+
+// decodeSwitchBot reads a SwitchBot Meter, Meter Plus or Outdoor Meter. The meters put their
+// reading in the service data; the outdoor meter, and newer meter firmware, in the manufacturer
+// data after the MAC.
+func decodeSwitchBot(service, manufacturer []byte) (Reading, error) {
+	if len(service) < 3 {
+		return Reading{}, ErrNoReading
+	}
+	model := service[0] & 0x7f
+	if model != 'T' && model != 'i' && model != 'w' {
+		return Reading{}, ErrNoReading
+	}
+
+	reading := Reading{Format: FormatSwitchBot, BatteryPercent: value(float64(service[2] & 0x7f))}
+	var raw []byte
+	switch {
+	case len(manufacturer) >= 13 || (model == 'w' && len(manufacturer) >= 11):
+		raw = manufacturer[8:11]
+	case model != 'w' && len(service) >= 6:
+		raw = service[3:6]
+	default:
+		return Reading{}, ErrNoReading
+	}
+	temperature := float64(raw[1]&0x7f) + float64(raw[0]&0x0f)/10
+	if raw[1]&0x80 == 0 {
+		temperature = -temperature
+	}
+	reading.TemperatureC = value(temperature)
+	reading.Humidity = value(float64(raw[2] & 0x7f))
+	return reading, nil
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package ble
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	btProtoHCI     = 1
+	solHCI         = 0
+	hciFilter      = 2
+	hciChannelRaw  = 0
+	hciCommandPkt  = 0x01
+	opSetScanParam = 0x200b // LE Set Scan Parameters
+	opSetScanOn    = 0x200c // LE Set Scan Enable
+)
+
+// Scan scans passively on the adapter hciN, passing every advertisement to handle until ctx is
+// done. It needs the CAP_NET_RAW and CAP_NET_ADMIN capabilities, and the adapter up.
+func Scan(ctx context.Context, adapter int, handle func(Advertisement)) error {
+	fd, err := syscall.Socket(syscall.AF_BLUETOOTH, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, btProtoHCI)
+	if err != nil {
+		return fmt.Errorf("failed to open HCI socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// struct sockaddr_hci: family, device, channel
+	addr := [3]uint16{syscall.AF_BLUETOOTH, uint16(adapter), hciChannelRaw}
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr)); errno != 0 {
+		return fmt.Errorf("failed to bind hci%d: %w", adapter, errno)
+	}
+
+	// struct hci_filter: packet types, then events; only LE meta events pass
+	filter := make([]byte, 16)
+	binary.LittleEndian.PutUint32(filter[0:], 1<<hciEventPacket)
+	binary.LittleEndian.PutUint32(filter[4+hciEventLEMeta/32*4:], 1<<(hciEventLEMeta%32))
+	if err := syscall.SetsockoptString(fd, solHCI, hciFilter, string(filter[:14])); err != nil {
+		return fmt.Errorf("failed to filter HCI events: %w", err)
+	}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1}); err != nil {
+		return fmt.Errorf("failed to set HCI read timeout: %w", err)
+	}
+
+	// Passive scanning, interval and window of 10 ms (16 × 0.625 ms), public address, no filter
+	if err := sendCommand(fd, opSetScanParam, []byte{0x00, 0x10, 0x00, 0x10, 0x00, 0x00, 0x00}); err != nil {
+		return err
+	}
+	if err := sendCommand(fd, opSetScanOn, []byte{0x01, 0x00}); err != nil {
+		return err
+	}
+	defer sendCommand(fd, opSetScanOn, []byte{0x00, 0x00})
+
+	buffer := make([]byte, 512)
+	for ctx.Err() == nil {
+		n, err := syscall.Read(fd, buffer)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read from hci%d: %w", adapter, err)
+		}
+		for _, adv := range ParseHCIEvent(buffer[:n]) {
+			handle(adv)
+		}
+	}
+	return nil
+}
+
+// sendCommand writes an HCI command; its completion event is filtered out
+func sendCommand(fd int, opcode uint16, params []byte) error {
+	packet := append([]byte{hciCommandPkt, byte(opcode), byte(opcode >> 8), byte(len(params))}, params...)
+	if _, err := syscall.Write(fd, packet); err != nil {
+		return fmt.Errorf("failed to send HCI command 0x%04x: %w", opcode, err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ble
+
+import (
+	"context"
+	"fmt"
+)
+
+// Scan is only available on Linux, through a raw HCI socket
+func Scan(ctx context.Context, adapter int, handle func(Advertisement)) error {
+	return fmt.Errorf("hci%d: Bluetooth LE scanning is only supported on Linux", adapter)
+}
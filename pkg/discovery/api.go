@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inventoryColumns are the CSV export's columns
+var inventoryColumns = []string{
+	"id", "name", "type", "manufacturer", "model", "version", "ip_address", "mac_address", "hostname",
+	"room", "zone", "capabilities", "status", "discovered_via", "first_seen", "last_seen",
+}
+
+// InventoryEntry is an asset in the inventory: the live asset, or the last known one when it is
+// offline, with the user's name and room
+type InventoryEntry struct {
+	*AssetInfo
+	FirstSeen *time.Time `json:"first_seen,omitempty"` // Unknown without a registry
+}
+
+// Inventory returns every asset online, and those the registry remembers offline, by ID
+func (dm *DiscoveryManager) Inventory() []InventoryEntry {
+	records := make(map[string]AssetRecord)
+	for _, record := range dm.registry.List() {
+		records[record.Asset.ID] = record
+	}
+
+	dm.assetsMutex.RLock()
+	entries := make([]InventoryEntry, 0, len(records)+len(dm.assets))
+	for id, asset := range dm.assets {
+		entry := InventoryEntry{AssetInfo: asset}
+		if record, ok := records[id]; ok {
+			entry.FirstSeen = &record.FirstSeen
+			delete(records, id)
+		}
+		entries = append(entries, entry)
+	}
+	dm.assetsMutex.RUnlock()
+
+	for _, record := range records {
+		firstSeen := record.FirstSeen
+		asset := record.Merged()
+		asset.Status = "offline"
+		asset.LastSeen = record.LastSeen
+		entries = append(entries, InventoryEntry{AssetInfo: asset, FirstSeen: &firstSeen})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// filterInventory keeps the entries matching the type, room, capability and status query
+// parameters that are set
+func filterInventory(entries []InventoryEntry, r *http.Request) []InventoryEntry {
+	query := r.URL.Query()
+	filtered := make([]InventoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if t := query.Get("type"); t != "" && string(entry.Type) != t {
+			continue
+		}
+		if room := query.Get("room"); room != "" && entry.Room != room {
+			continue
+		}
+		if capability := query.Get("capability"); capability != "" && !hasCapability(entry.AssetInfo, AssetCapability(capability)) {
+			continue
+		}
+		if status := query.Get("status"); status != "" && entry.Status != status {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+func hasCapability(asset *AssetInfo, capability AssetCapability) bool {
+	for _, c := range asset.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// AssetsHandler serves GET /api/assets: the inventory as JSON, filtered by the type, room,
+// capability and status query parameters
+func (dm *DiscoveryManager) AssetsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(filterInventory(dm.Inventory(), r))
+	})
+}
+
+// AssetHandler serves GET /api/assets/{id}: the asset, live or last known, with its first-seen
+// time and address and firmware history
+func (dm *DiscoveryManager) AssetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/assets/")
+		record, known := dm.registry.Get(id)
+		asset, online := dm.GetAsset(id)
+		if !known && !online {
+			http.Error(w, "unknown asset "+id, http.StatusNotFound)
+			return
+		}
+
+		response := struct {
+			*AssetInfo
+			FirstSeen *time.Time    `json:"first_seen,omitempty"`
+			History   []AssetChange `json:"history"`
+		}{AssetInfo: asset, History: []AssetChange{}}
+		if known {
+			response.FirstSeen = &record.FirstSeen
+			response.History = append(response.History, record.History...)
+			if !online {
+				response.AssetInfo = record.Merged()
+				response.LastSeen = record.LastSeen
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// ExportHandler serves the full inventory as a JSON download, or as CSV with ?format=csv, for
+// auditing what's on the network. The filters of AssetsHandler apply too.
+func (dm *DiscoveryManager) ExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries := filterInventory(dm.Inventory(), r)
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="assets.csv"`)
+			if err := WriteInventoryCSV(w, entries); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="assets.json"`)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(entries)
+	})
+}
+
+// WriteInventoryCSV writes the inventory as CSV with a header row
+func WriteInventoryCSV(w io.Writer, entries []InventoryEntry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(inventoryColumns); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		capabilities := make([]string, 0, len(entry.Capabilities))
+		for _, capability := range entry.Capabilities {
+			capabilities = append(capabilities, string(capability))
+		}
+		var firstSeen, lastSeen string
+		if entry.FirstSeen != nil {
+			firstSeen = entry.FirstSeen.Format(time.RFC3339)
+		}
+		if !entry.LastSeen.IsZero() {
+			lastSeen = entry.LastSeen.Format(time.RFC3339)
+		}
+		discoveredVia := entry.Metadata["discovered_via"]
+		if discoveredVia == "" {
+			discoveredVia = "homeauto"
+		}
+
+		if err := writer.Write([]string{
+			entry.ID, entry.Name, string(entry.Type), entry.Manufacturer, entry.Model, entry.Version, entry.IPAddress,
+			entry.MACAddress, entry.Hostname, entry.Room, entry.Zone, strings.Join(capabilities, " "), entry.Status,
+			discoveredVia, firstSeen, lastSeen,
+		}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
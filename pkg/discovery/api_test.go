@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInventoryAPI(t *testing.T) {
+	registry, _ := NewAssetRegistry("")
+	dm := testManager(registry)
+	dm.OnAssetDiscovered(&AssetInfo{ID: "sensor-1", Name: "Pico", Type: AssetTypeSensor, Room: "kitchen",
+		Capabilities: []AssetCapability{CapabilityTemperature}, Status: "online", IPAddress: "192.168.1.40"})
+	dm.OnAssetDiscovered(&AssetInfo{ID: "upnp-tv", Name: "[TV] Living Room", Type: AssetTypeTelevision,
+		Capabilities: []AssetCapability{CapabilityUPnP, CapabilityVideo}, Status: "online", Metadata: map[string]string{"discovered_via": "ssdp"}})
+	dm.OnAssetUpdated(&AssetInfo{ID: "sensor-1", Name: "Pico", Type: AssetTypeSensor, Room: "kitchen",
+		Capabilities: []AssetCapability{CapabilityTemperature}, Status: "online", IPAddress: "192.168.1.41"})
+	dm.OnAssetLost("upnp-tv")
+
+	var assets []InventoryEntry
+	recorder := httptest.NewRecorder()
+	dm.AssetsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/assets?capability=video", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &assets)
+	if len(assets) != 1 || assets[0].ID != "upnp-tv" || assets[0].Status != "offline" || assets[0].FirstSeen == nil {
+		t.Errorf("Expected the lost TV listed offline, got %+v", assets)
+	}
+	recorder = httptest.NewRecorder()
+	dm.AssetsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/assets?room=kitchen&status=online", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &assets)
+	if len(assets) != 1 || assets[0].ID != "sensor-1" {
+		t.Errorf("Expected the kitchen sensor, got %+v", assets)
+	}
+
+	var asset struct {
+		ID      string        `json:"id"`
+		History []AssetChange `json:"history"`
+	}
+	recorder = httptest.NewRecorder()
+	dm.AssetHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/assets/sensor-1", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &asset)
+	if asset.ID != "sensor-1" || len(asset.History) != 1 || asset.History[0].To != "192.168.1.41" {
+		t.Errorf("Expected the sensor with its address change, got %s", recorder.Body)
+	}
+	recorder = httptest.NewRecorder()
+	dm.AssetHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/assets/nope", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown asset not found, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	dm.ExportHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/api/assets/export?format=csv", nil))
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "id" || rows[1][0] != "sensor-1" || rows[1][13] != "homeauto" ||
+		rows[2][11] != "upnp video" || rows[2][12] != "offline" || rows[2][13] != "ssdp" {
+		t.Errorf("Unexpected CSV export %v", rows)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"runtime"
 	"strings"
 	"time"
+
+	"github.com/johnpr01/home-automation/internal/buildinfo"
+	"github.com/johnpr01/home-automation/pkg/mqtt"
 )
 
 // AssetBuilder helps create AssetInfo structures
@@ -223,6 +226,15 @@ func (ab *AssetBuilder) AutoDetectSystem() *AssetBuilder {
 	return ab
 }
 
+// WithBuildInfo sets the software version and adds the build info to the metadata
+func (ab *AssetBuilder) WithBuildInfo(info buildinfo.Info) *AssetBuilder {
+	ab.asset.Version = info.Version
+	for key, value := range info.Metadata() {
+		ab.asset.Metadata[key] = value
+	}
+	return ab
+}
+
 // Build creates the final AssetInfo
 func (ab *AssetBuilder) Build() *AssetInfo {
 	// Generate ID if not set
@@ -285,13 +297,13 @@ func NewPicoSensor(name, room string, capabilities []AssetCapability) *AssetBuil
 	for _, cap := range capabilities {
 		switch cap {
 		case CapabilityTemperature:
-			builder.WithMQTTService("temperature", fmt.Sprintf("room-temp/%s", room), "Temperature sensor")
+			builder.WithMQTTService("temperature", mqtt.RoomTopic(mqtt.TopicRoomTemperature, room), "Temperature sensor")
 		case CapabilityHumidity:
-			builder.WithMQTTService("humidity", fmt.Sprintf("room-humidity/%s", room), "Humidity sensor")
+			builder.WithMQTTService("humidity", mqtt.RoomTopic(mqtt.TopicRoomHumidity, room), "Humidity sensor")
 		case CapabilityMotion:
-			builder.WithMQTTService("motion", fmt.Sprintf("room-motion/%s", room), "Motion sensor")
+			builder.WithMQTTService("motion", mqtt.RoomTopic(mqtt.TopicRoomMotion, room), "Motion sensor")
 		case CapabilityLight:
-			builder.WithMQTTService("light", fmt.Sprintf("room-light/%s", room), "Light sensor")
+			builder.WithMQTTService("light", mqtt.RoomTopic(mqtt.TopicRoomLight, room), "Light sensor")
 		}
 	}
 
@@ -425,6 +437,16 @@ func ParseAssetType(s string) (AssetType, error) {
 		return AssetTypeHumiditySensor, nil
 	case "light_sensor", "lightsensor":
 		return AssetTypeLightSensor, nil
+	case "television", "tv":
+		return AssetTypeTelevision, nil
+	case "media_player", "mediaplayer":
+		return AssetTypeMediaPlayer, nil
+	case "media_server", "mediaserver":
+		return AssetTypeMediaServer, nil
+	case "router":
+		return AssetTypeRouter, nil
+	case "network_device", "networkdevice":
+		return AssetTypeNetworkDevice, nil
 	default:
 		return "", fmt.Errorf("unknown asset type: %s", s)
 	}
@@ -449,6 +471,8 @@ func ParseAssetCapability(s string) (AssetCapability, error) {
 		return CapabilitySwitch, nil
 	case "dimmer":
 		return CapabilityDimmer, nil
+	case "color", "colour":
+		return CapabilityColor, nil
 	case "thermostat_control", "thermostatcontrol":
 		return CapabilityThermostatCtrl, nil
 	case "video":
@@ -461,6 +485,8 @@ func ParseAssetCapability(s string) (AssetCapability, error) {
 		return CapabilityHTTP, nil
 	case "klap":
 		return CapabilityKLAP, nil
+	case "upnp":
+		return CapabilityUPnP, nil
 	default:
 		return "", fmt.Errorf("unknown capability: %s", s)
 	}
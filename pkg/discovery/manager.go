@@ -10,7 +10,11 @@ import (
 // DiscoveryManager manages asset discovery for the home automation system
 type DiscoveryManager struct {
 	protocol    *DiscoveryProtocol
+	mdns        *MDNSService // Nil unless mDNS/DNS-SD is enabled
+	ssdp        *SSDPService // Nil unless SSDP/UPnP is enabled
+	registry    *AssetRegistry
 	assets      map[string]*AssetInfo
+	mdnsOnly    map[string]bool // Assets found over mDNS but not the custom protocol
 	assetsMutex sync.RWMutex
 	eventLog    []DiscoveryEvent
 	logMutex    sync.RWMutex
@@ -53,6 +57,14 @@ type DiscoveryConfig struct {
 	QueryInterval time.Duration // Query interval for auto-query
 	MaxLogSize    int           // Maximum number of events to keep in log
 	Logger        *log.Logger   // Logger for discovery events
+	MDNS          bool          // Also advertise and browse over mDNS/DNS-SD as _homeauto._tcp
+	SSDP          bool          // Also find third-party UPnP devices over SSDP
+	// UnicastPeers are queried directly too, as host or host:port: relays, or assets on another
+	// VLAN that multicast doesn't reach
+	UnicastPeers []string
+	// RegistryPath keeps every asset discovered in a file, to remember them with the names and
+	// rooms given to them across restarts. Empty keeps the registry in memory only.
+	RegistryPath string
 }
 
 // NewDiscoveryManager creates a new discovery manager
@@ -61,6 +73,16 @@ func NewDiscoveryManager(config DiscoveryConfig) (*DiscoveryManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create discovery protocol: %w", err)
 	}
+	if err := protocol.SetUnicastPeers(config.UnicastPeers); err != nil {
+		protocol.close()
+		return nil, err
+	}
+
+	registry, err := NewAssetRegistry(config.RegistryPath)
+	if err != nil {
+		protocol.close()
+		return nil, err
+	}
 
 	if config.QueryInterval == 0 {
 		config.QueryInterval = 5 * time.Minute
@@ -71,7 +93,9 @@ func NewDiscoveryManager(config DiscoveryConfig) (*DiscoveryManager, error) {
 
 	dm := &DiscoveryManager{
 		protocol:      protocol,
+		registry:      registry,
 		assets:        make(map[string]*AssetInfo),
+		mdnsOnly:      make(map[string]bool),
 		eventLog:      make([]DiscoveryEvent, 0),
 		maxLogSize:    config.MaxLogSize,
 		logger:        config.Logger,
@@ -86,6 +110,16 @@ func NewDiscoveryManager(config DiscoveryConfig) (*DiscoveryManager, error) {
 	// Add ourselves as a listener
 	protocol.AddListener(dm)
 
+	if config.MDNS {
+		dm.mdns = NewMDNSService(config.LocalAsset)
+		dm.mdns.AddListener(mdnsListener{dm})
+	}
+	if config.SSDP {
+		// UPnP devices have IDs of their own, so their events are the manager's as they come
+		dm.ssdp = NewSSDPService()
+		dm.ssdp.AddListener(dm)
+	}
+
 	return dm, nil
 }
 
@@ -94,6 +128,16 @@ func (dm *DiscoveryManager) Start() error {
 	if err := dm.protocol.Start(); err != nil {
 		return fmt.Errorf("failed to start discovery protocol: %w", err)
 	}
+	if dm.mdns != nil {
+		if err := dm.mdns.Start(); err != nil {
+			return fmt.Errorf("failed to start mDNS: %w", err)
+		}
+	}
+	if dm.ssdp != nil {
+		if err := dm.ssdp.Start(); err != nil {
+			return fmt.Errorf("failed to start SSDP: %w", err)
+		}
+	}
 
 	// Start auto-query if enabled
 	if dm.autoQuery {
@@ -107,9 +151,74 @@ func (dm *DiscoveryManager) Start() error {
 // Stop stops the discovery manager
 func (dm *DiscoveryManager) Stop() error {
 	dm.logEvent("system", "", nil, nil, "", "Discovery manager stopping")
+	if dm.mdns != nil {
+		dm.mdns.Stop()
+	}
+	if dm.ssdp != nil {
+		dm.ssdp.Stop()
+	}
+	if err := dm.registry.Flush(); err != nil {
+		dm.logEvent("system", "", nil, nil, "", err.Error())
+	}
 	return dm.protocol.Stop()
 }
 
+// Registry returns the registry of every asset discovered, including those not seen since
+func (dm *DiscoveryManager) Registry() *AssetRegistry {
+	return dm.registry
+}
+
+// GetKnownAssets returns the records of every asset ever discovered, online or not
+func (dm *DiscoveryManager) GetKnownAssets() []AssetRecord {
+	return dm.registry.List()
+}
+
+// SetAssetName names an asset, over the name it announces. An empty name restores it.
+func (dm *DiscoveryManager) SetAssetName(id, name string) error {
+	if err := dm.registry.SetName(id, name); err != nil {
+		return err
+	}
+	dm.refresh(id)
+	return nil
+}
+
+// SetAssetRoom puts an asset in a room, over the room it announces. An empty room restores it.
+func (dm *DiscoveryManager) SetAssetRoom(id, room string) error {
+	if err := dm.registry.SetRoom(id, room); err != nil {
+		return err
+	}
+	dm.refresh(id)
+	return nil
+}
+
+// refresh applies an edited record to the asset if it is online
+func (dm *DiscoveryManager) refresh(id string) {
+	record, ok := dm.registry.Get(id)
+	if !ok {
+		return
+	}
+	dm.assetsMutex.Lock()
+	_, online := dm.assets[id]
+	asset := record.Merged()
+	if online {
+		dm.assets[id] = asset
+	}
+	dm.assetsMutex.Unlock()
+
+	if online {
+		dm.updated(asset)
+	}
+}
+
+// remember records a sighting in the registry, returning the asset with the user's name and room
+func (dm *DiscoveryManager) remember(asset *AssetInfo) *AssetInfo {
+	merged, err := dm.registry.Observe(asset, time.Now())
+	if err != nil {
+		dm.logEvent("system", asset.ID, nil, nil, "", err.Error())
+	}
+	return merged
+}
+
 // GetAllAssets returns all discovered assets
 func (dm *DiscoveryManager) GetAllAssets() map[string]*AssetInfo {
 	dm.assetsMutex.RLock()
@@ -176,9 +285,20 @@ func (dm *DiscoveryManager) GetAssetsByCapability(capability AssetCapability) []
 	return assets
 }
 
-// Query sends a discovery query
+// Query sends a discovery query; over mDNS and SSDP, which can't filter, every instance and
+// UPnP root device is asked
 func (dm *DiscoveryManager) Query(query *Query) error {
 	dm.logEvent("query", "", nil, query, "", "Sending discovery query")
+	if dm.mdns != nil {
+		if err := dm.mdns.Browse(); err != nil {
+			dm.logEvent("system", "", nil, nil, "", fmt.Sprintf("mDNS browse failed: %v", err))
+		}
+	}
+	if dm.ssdp != nil {
+		if err := dm.ssdp.Search(); err != nil {
+			dm.logEvent("system", "", nil, nil, "", fmt.Sprintf("SSDP search failed: %v", err))
+		}
+	}
 	return dm.protocol.Query(query)
 }
 
@@ -212,6 +332,11 @@ func (dm *DiscoveryManager) QueryByRoom(room string) error {
 // Announce sends an announcement for the local asset
 func (dm *DiscoveryManager) Announce() error {
 	dm.logEvent("announce", "", nil, nil, "", "Sending asset announcement")
+	if dm.mdns != nil {
+		if err := dm.mdns.Announce(); err != nil {
+			dm.logEvent("system", "", nil, nil, "", fmt.Sprintf("mDNS announcement failed: %v", err))
+		}
+	}
 	return dm.protocol.Announce()
 }
 
@@ -306,10 +431,23 @@ type DiscoveryStats struct {
 
 // OnAssetDiscovered handles asset discovery events
 func (dm *DiscoveryManager) OnAssetDiscovered(asset *AssetInfo) {
+	asset = dm.remember(asset)
 	dm.assetsMutex.Lock()
 	dm.assets[asset.ID] = asset
+	seenOverMDNS := dm.mdnsOnly[asset.ID]
+	delete(dm.mdnsOnly, asset.ID)
 	dm.assetsMutex.Unlock()
 
+	// An asset already found over mDNS is updated with the richer announcement
+	if seenOverMDNS {
+		dm.updated(asset)
+		return
+	}
+	dm.discovered(asset)
+}
+
+// discovered logs and sends a newly discovered asset
+func (dm *DiscoveryManager) discovered(asset *AssetInfo) {
 	message := fmt.Sprintf("Discovered %s: %s (%s)", asset.Type, asset.Name, asset.IPAddress)
 	dm.logEvent("discovered", asset.ID, asset, nil, "", message)
 
@@ -323,10 +461,17 @@ func (dm *DiscoveryManager) OnAssetDiscovered(asset *AssetInfo) {
 
 // OnAssetUpdated handles asset update events
 func (dm *DiscoveryManager) OnAssetUpdated(asset *AssetInfo) {
+	asset = dm.remember(asset)
 	dm.assetsMutex.Lock()
 	dm.assets[asset.ID] = asset
+	delete(dm.mdnsOnly, asset.ID)
 	dm.assetsMutex.Unlock()
 
+	dm.updated(asset)
+}
+
+// updated logs and sends an updated asset
+func (dm *DiscoveryManager) updated(asset *AssetInfo) {
 	message := fmt.Sprintf("Updated %s: %s", asset.Type, asset.Name)
 	dm.logEvent("updated", asset.ID, asset, nil, "", message)
 
@@ -346,8 +491,12 @@ func (dm *DiscoveryManager) OnAssetLost(assetID string) {
 	if asset, exists := dm.assets[assetID]; exists {
 		assetName = fmt.Sprintf("%s (%s)", asset.Name, asset.Type)
 		delete(dm.assets, assetID)
+		delete(dm.mdnsOnly, assetID)
 	}
 	dm.assetsMutex.Unlock()
+	if err := dm.registry.Lost(assetID, time.Now()); err != nil {
+		dm.logEvent("system", assetID, nil, nil, "", err.Error())
+	}
 
 	message := fmt.Sprintf("Lost asset: %s", assetName)
 	if assetName == "" {
@@ -364,6 +513,90 @@ func (dm *DiscoveryManager) OnAssetLost(assetID string) {
 	}
 }
 
+// SetServiceAvailability marks the assets running a service (metadata "service") online or
+// offline, e.g. from the MQTT availability topics, without waiting for their TTL to expire
+func (dm *DiscoveryManager) SetServiceAvailability(service string, online bool) {
+	status := "offline"
+	if online {
+		status = "online"
+	}
+
+	var changed []*AssetInfo
+	dm.assetsMutex.Lock()
+	for _, asset := range dm.assets {
+		if asset.Metadata["service"] == service && asset.Status != status {
+			asset.Status = status
+			changed = append(changed, asset)
+		}
+	}
+	dm.assetsMutex.Unlock()
+
+	for _, asset := range changed {
+		message := fmt.Sprintf("Service %s is %s: %s (%s)", service, status, asset.Name, asset.Type)
+		dm.logEvent("updated", asset.ID, asset, nil, "", message)
+
+		// Send to channel (non-blocking)
+		select {
+		case dm.updatedCh <- asset:
+		default:
+			// Channel full, skip
+		}
+	}
+}
+
+// mdnsListener merges the assets found over mDNS into the manager's. An asset the custom protocol
+// also announces keeps its richer announcement and is only lost when the protocol loses it.
+type mdnsListener struct {
+	dm *DiscoveryManager
+}
+
+func (l mdnsListener) OnAssetDiscovered(asset *AssetInfo) {
+	l.merge(asset)
+}
+
+func (l mdnsListener) OnAssetUpdated(asset *AssetInfo) {
+	l.merge(asset)
+}
+
+func (l mdnsListener) merge(asset *AssetInfo) {
+	dm := l.dm
+	dm.assetsMutex.Lock()
+	_, known := dm.assets[asset.ID]
+	if known && !dm.mdnsOnly[asset.ID] {
+		dm.assetsMutex.Unlock()
+		return
+	}
+	dm.assetsMutex.Unlock()
+
+	asset = dm.remember(asset)
+	dm.assetsMutex.Lock()
+	if _, announced := dm.assets[asset.ID]; announced && !dm.mdnsOnly[asset.ID] {
+		// Announced over the custom protocol meanwhile
+		dm.assetsMutex.Unlock()
+		return
+	}
+	dm.assets[asset.ID] = asset
+	dm.mdnsOnly[asset.ID] = true
+	dm.assetsMutex.Unlock()
+
+	if known {
+		dm.updated(asset)
+	} else {
+		dm.discovered(asset)
+	}
+}
+
+func (l mdnsListener) OnAssetLost(assetID string) {
+	l.dm.assetsMutex.RLock()
+	mdnsOnly := l.dm.mdnsOnly[assetID]
+	l.dm.assetsMutex.RUnlock()
+	if mdnsOnly {
+		l.dm.OnAssetLost(assetID)
+	}
+}
+
+func (l mdnsListener) OnQueryReceived(query *Query, sender string) {}
+
 // OnQueryReceived handles query events
 func (dm *DiscoveryManager) OnQueryReceived(query *Query, sender string) {
 	message := fmt.Sprintf("Received query from %s", sender)
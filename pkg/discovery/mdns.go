@@ -0,0 +1,678 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mDNS/DNS-SD constants
+const (
+	MDNSAddress     = "224.0.0.251"
+	MDNSPort        = 5353
+	MDNSServiceType = "_homeauto._tcp"
+	MDNSDomain      = "local."
+
+	// MDNSMetadataSource is set to "mdns" in the metadata of assets found over mDNS
+	MDNSMetadataSource = "discovered_via"
+
+	mdnsServicesName  = "_services._dns-sd._udp." + MDNSDomain
+	mdnsServiceName   = MDNSServiceType + "." + MDNSDomain
+	mdnsCacheFlush    = 1 << 15 // Class bit marking unique records in responses
+	mdnsUnicast       = 1 << 15 // Class bit asking for a unicast response in questions
+	mdnsLegacyTTL     = 10      // Maximum TTL in replies to legacy unicast queries
+	mdnsMaxTXTLength  = 255
+	mdnsMaxLabelBytes = 63
+)
+
+// MDNSService advertises the local asset as a _homeauto._tcp DNS-SD service and browses for the
+// other instances, so assets are visible to standard tools such as avahi-browse and are found on
+// devices that can't join the custom multicast protocol. Discovered assets are reported to the
+// same listeners as the custom protocol.
+type MDNSService struct {
+	conn        *net.UDPConn
+	group       *net.UDPAddr
+	localAsset  *AssetInfo
+	instances   map[string]*mdnsInstance // By lower-case instance name
+	hosts       map[string]string        // IPv4 address by lower-case host name
+	knownAssets map[string]*AssetInfo
+	listeners   []AssetDiscoveryListener
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mu          sync.Mutex
+}
+
+// mdnsInstance collects the records of a service instance, which may arrive in several packets
+type mdnsInstance struct {
+	name        string
+	host        string
+	port        uint16
+	txt         []string
+	ttl         uint32
+	assetID     string
+	fingerprint string // Records the asset was last reported with, to report only changes
+}
+
+// NewMDNSService creates an mDNS responder for localAsset and browser; a nil localAsset only
+// browses. The socket is opened by Start.
+func NewMDNSService(localAsset *AssetInfo) *MDNSService {
+	ctx, cancel := context.WithCancel(context.Background())
+	if localAsset != nil && localAsset.TTL == 0 {
+		localAsset.TTL = DefaultTTL
+	}
+
+	return &MDNSService{
+		group:       &net.UDPAddr{IP: net.ParseIP(MDNSAddress), Port: MDNSPort},
+		localAsset:  localAsset,
+		instances:   make(map[string]*mdnsInstance),
+		hosts:       make(map[string]string),
+		knownAssets: make(map[string]*AssetInfo),
+		listeners:   make([]AssetDiscoveryListener, 0),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// AddListener adds a discovery event listener
+func (s *MDNSService) AddListener(listener AssetDiscoveryListener) {
+	s.listeners = append(s.listeners, listener)
+}
+
+// Start joins the mDNS group, announces the local asset and browses for the others
+func (s *MDNSService) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, s.group)
+	if err != nil {
+		return fmt.Errorf("failed to listen on mDNS address: %w", err)
+	}
+	s.conn = conn
+
+	go s.messageListener()
+	go s.periodicAnnounce()
+	go s.assetCleanup()
+
+	if s.localAsset != nil {
+		if err := s.Announce(); err != nil {
+			return err
+		}
+	}
+	return s.Browse()
+}
+
+// Stop withdraws the local asset and leaves the mDNS group
+func (s *MDNSService) Stop() error {
+	if s.conn == nil {
+		return nil
+	}
+	if s.localAsset != nil {
+		s.Goodbye()
+	}
+
+	s.cancel()
+	return s.conn.Close()
+}
+
+// UpdateLocalAsset changes the local asset before the next announcement
+func (s *MDNSService) UpdateLocalAsset(update func(asset *AssetInfo)) {
+	if s.localAsset == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(s.localAsset)
+}
+
+// Announce sends the local asset's records unsolicited
+func (s *MDNSService) Announce() error {
+	return s.announce(0)
+}
+
+// Goodbye withdraws the local asset's records by announcing them with a TTL of zero
+func (s *MDNSService) Goodbye() error {
+	return s.announce(-1)
+}
+
+// announce sends the local records with the asset's TTL, or with ttl when it is not 0; a
+// negative ttl sends the goodbye
+func (s *MDNSService) announce(ttl int) error {
+	if s.localAsset == nil {
+		return fmt.Errorf("no local asset configured")
+	}
+
+	s.mu.Lock()
+	if ttl == 0 {
+		ttl = s.localAsset.TTL
+	}
+	records := mdnsRecordsFor(s.localAsset, uint32(max(ttl, 0)), true)
+	s.mu.Unlock()
+
+	answers := append([]dnsmessage.Resource{records.services, records.ptr, records.srv, records.txt}, records.a...)
+	return s.send(&dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}, s.group)
+}
+
+// Browse asks every instance of the service to answer
+func (s *MDNSService) Browse() error {
+	return s.send(mdnsBrowseQuery(), s.group)
+}
+
+// GetKnownAssets returns the assets currently found over mDNS
+func (s *MDNSService) GetKnownAssets() map[string]*AssetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]*AssetInfo)
+	for id, asset := range s.knownAssets {
+		result[id] = asset
+	}
+	return result
+}
+
+// send packs and sends a message
+func (s *MDNSService) send(message *dnsmessage.Message, to *net.UDPAddr) error {
+	if s.conn == nil {
+		return fmt.Errorf("mDNS service not started")
+	}
+
+	data, err := message.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack mDNS message: %w", err)
+	}
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("message too large: %d bytes (max %d)", len(data), MaxMessageSize)
+	}
+
+	if _, err := s.conn.WriteToUDP(data, to); err != nil {
+		return fmt.Errorf("failed to send mDNS message: %w", err)
+	}
+	return nil
+}
+
+// messageListener answers queries and collects responses
+func (s *MDNSService) messageListener() {
+	buffer := make([]byte, MaxMessageSize)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+			s.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, addr, err := s.conn.ReadFromUDP(buffer)
+			if err != nil {
+				continue // Timeouts are expected, keep listening on other errors
+			}
+
+			if reply, to := s.handleMessage(buffer[:n], addr, time.Now()); reply != nil {
+				s.send(reply, to)
+			}
+		}
+	}
+}
+
+// handleMessage processes a packet and returns the reply to send, if any, and where to
+func (s *MDNSService) handleMessage(data []byte, sender *net.UDPAddr, now time.Time) (*dnsmessage.Message, *net.UDPAddr) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(data)
+	if err != nil {
+		return nil, nil // Invalid message, ignore
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, nil
+	}
+
+	if !header.Response {
+		return s.answer(header, questions, sender)
+	}
+
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return nil, nil
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return nil, nil
+	}
+	additionals, _ := parser.AllAdditionals() // Additional records are optional
+	s.handleResponse(append(answers, additionals...), sender, now)
+	return nil, nil
+}
+
+// answer builds the reply to a query for the local records. Legacy unicast queries, sent from
+// a port other than 5353, are answered to the sender with their ID and questions.
+func (s *MDNSService) answer(header dnsmessage.Header, questions []dnsmessage.Question, sender *net.UDPAddr) (*dnsmessage.Message, *net.UDPAddr) {
+	if s.localAsset == nil || len(questions) == 0 {
+		return nil, nil
+	}
+
+	legacy := sender != nil && sender.Port != MDNSPort
+	s.mu.Lock()
+	ttl := uint32(s.localAsset.TTL)
+	if legacy {
+		ttl = min(ttl, mdnsLegacyTTL)
+	}
+	records := mdnsRecordsFor(s.localAsset, ttl, !legacy)
+	s.mu.Unlock()
+
+	var answers, additionals []dnsmessage.Resource
+	unicast := true
+	for _, question := range questions {
+		name := strings.ToLower(question.Name.String())
+		all := question.Type == dnsmessage.TypeALL
+		if question.Class&mdnsUnicast == 0 {
+			unicast = false
+		}
+
+		switch name {
+		case mdnsServicesName:
+			if all || question.Type == dnsmessage.TypePTR {
+				answers = append(answers, records.services)
+			}
+		case mdnsServiceName:
+			if all || question.Type == dnsmessage.TypePTR {
+				answers = append(answers, records.ptr)
+				additionals = append(append(additionals, records.srv, records.txt), records.a...)
+			}
+		case strings.ToLower(records.srv.Header.Name.String()):
+			if all || question.Type == dnsmessage.TypeSRV {
+				answers = append(answers, records.srv)
+				additionals = append(additionals, records.a...)
+			}
+			if all || question.Type == dnsmessage.TypeTXT {
+				answers = append(answers, records.txt)
+			}
+		case strings.ToLower(records.host):
+			if all || question.Type == dnsmessage.TypeA {
+				answers = append(answers, records.a...)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, nil
+	}
+
+	reply := &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	switch {
+	case legacy:
+		reply.Header.ID = header.ID
+		reply.Questions = questions
+		return reply, sender
+	case unicast && sender != nil:
+		return reply, sender
+	default:
+		return reply, s.group
+	}
+}
+
+// handleResponse collects the records of the service's instances and reports the assets they
+// describe. Instances without an address record are reached at the sender's address.
+func (s *MDNSService) handleResponse(records []dnsmessage.Resource, sender *net.UDPAddr, now time.Time) {
+	var discovered, updated []*AssetInfo
+	var lost []string
+
+	s.mu.Lock()
+	touched := make(map[string]bool)
+	for _, record := range records {
+		name := strings.ToLower(record.Header.Name.String())
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name != mdnsServiceName {
+				continue
+			}
+			instance := s.instance(body.PTR.String())
+			if record.Header.TTL == 0 {
+				if id := instance.assetID; id != "" {
+					delete(s.knownAssets, id)
+					lost = append(lost, id)
+				}
+				delete(s.instances, strings.ToLower(instance.name))
+				delete(touched, strings.ToLower(instance.name))
+				continue
+			}
+			instance.ttl = record.Header.TTL
+			touched[strings.ToLower(instance.name)] = true
+		case *dnsmessage.SRVResource:
+			if !strings.HasSuffix(name, "."+mdnsServiceName) {
+				continue
+			}
+			instance := s.instance(record.Header.Name.String())
+			instance.host, instance.port = strings.ToLower(body.Target.String()), body.Port
+			touched[name] = true
+		case *dnsmessage.TXTResource:
+			if !strings.HasSuffix(name, "."+mdnsServiceName) {
+				continue
+			}
+			s.instance(record.Header.Name.String()).txt = body.TXT
+			touched[name] = true
+		case *dnsmessage.AResource:
+			s.hosts[name] = net.IP(body.A[:]).String()
+		}
+	}
+
+	for name := range touched {
+		instance := s.instances[name]
+		if instance == nil || instance.txt == nil {
+			continue // Wait for the TXT record carrying the asset
+		}
+		address := s.hosts[instance.host]
+		if address == "" && sender != nil {
+			address = sender.IP.String()
+		}
+
+		asset := mdnsAsset(instance, address, now)
+		if s.localAsset != nil && asset.ID == s.localAsset.ID {
+			continue // Our own announcement
+		}
+		fingerprint := fmt.Sprintf("%s|%d|%s|%s", instance.host, instance.port, address, strings.Join(instance.txt, "\x00"))
+		_, known := s.knownAssets[asset.ID]
+		s.knownAssets[asset.ID] = asset
+		instance.assetID = asset.ID
+		switch {
+		case !known:
+			discovered = append(discovered, asset)
+		case fingerprint != instance.fingerprint:
+			updated = append(updated, asset)
+		}
+		instance.fingerprint = fingerprint
+	}
+	s.mu.Unlock()
+
+	for _, asset := range discovered {
+		for _, listener := range s.listeners {
+			listener.OnAssetDiscovered(asset)
+		}
+	}
+	for _, asset := range updated {
+		for _, listener := range s.listeners {
+			listener.OnAssetUpdated(asset)
+		}
+	}
+	for _, id := range lost {
+		for _, listener := range s.listeners {
+			listener.OnAssetLost(id)
+		}
+	}
+}
+
+// instance returns the collected records of an instance, adding it when new; s.mu must be held
+func (s *MDNSService) instance(name string) *mdnsInstance {
+	key := strings.ToLower(name)
+	instance, ok := s.instances[key]
+	if !ok {
+		instance = &mdnsInstance{name: name, ttl: DefaultTTL}
+		s.instances[key] = instance
+	}
+	return instance
+}
+
+// periodicAnnounce announces the local asset and browses again at a third of the TTL
+func (s *MDNSService) periodicAnnounce() {
+	interval := time.Duration(DefaultTTL/3) * time.Second
+	if s.localAsset != nil && s.localAsset.TTL > 0 {
+		interval = time.Duration(s.localAsset.TTL/3) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.localAsset != nil {
+				s.Announce()
+			}
+			s.Browse()
+		}
+	}
+}
+
+// assetCleanup removes the assets whose records expired
+func (s *MDNSService) assetCleanup() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range s.expire(now) {
+				for _, listener := range s.listeners {
+					listener.OnAssetLost(id)
+				}
+			}
+		}
+	}
+}
+
+// expire forgets the instances not seen for twice their TTL and returns their asset IDs
+func (s *MDNSService) expire(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lost []string
+	for key, instance := range s.instances {
+		asset, ok := s.knownAssets[instance.assetID]
+		if !ok {
+			continue
+		}
+		if now.Sub(asset.LastSeen) > 2*time.Duration(instance.ttl)*time.Second {
+			delete(s.knownAssets, instance.assetID)
+			delete(s.instances, key)
+			lost = append(lost, instance.assetID)
+		}
+	}
+	return lost
+}
+
+// mdnsRecords are the DNS-SD records describing an asset
+type mdnsRecords struct {
+	host     string
+	services dnsmessage.Resource // Service type enumeration, for avahi-browse -a
+	ptr      dnsmessage.Resource
+	srv      dnsmessage.Resource
+	txt      dnsmessage.Resource
+	a        []dnsmessage.Resource // Empty without an IPv4 address
+}
+
+// mdnsRecordsFor builds the records of an asset; unique records get the cache-flush bit unless
+// they answer a legacy query
+func mdnsRecordsFor(asset *AssetInfo, ttl uint32, cacheFlush bool) mdnsRecords {
+	unique := dnsmessage.ClassINET
+	if cacheFlush {
+		unique |= mdnsCacheFlush
+	}
+
+	label := asset.Name
+	if label == "" {
+		label = asset.ID
+	}
+	hostLabel := strings.SplitN(asset.Hostname, ".", 2)[0]
+	if hostLabel == "" {
+		hostLabel = asset.ID
+	}
+	instance := mdnsLabel(label) + "." + mdnsServiceName
+	host := mdnsLabel(hostLabel) + "." + MDNSDomain
+
+	records := mdnsRecords{
+		host: host,
+		services: dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsServicesName), Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsServiceName)},
+		},
+		ptr: dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsServiceName), Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance)},
+		},
+		srv: dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(instance), Class: unique, TTL: ttl},
+			Body:   &dnsmessage.SRVResource{Port: uint16(mdnsPort(asset)), Target: dnsmessage.MustNewName(host)},
+		},
+		txt: dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(instance), Class: unique, TTL: ttl},
+			Body:   &dnsmessage.TXTResource{TXT: mdnsTXT(asset)},
+		},
+	}
+	if ip := net.ParseIP(asset.IPAddress).To4(); ip != nil {
+		records.a = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(host), Class: unique, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte(ip)},
+		}}
+	}
+	return records
+}
+
+// mdnsLabel makes a single DNS label of s: dots would split it, and labels are 63 bytes at most
+func mdnsLabel(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	for len(s) > mdnsMaxLabelBytes {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// mdnsPort returns the port the SRV record points at: the first HTTP service, else the first port
+func mdnsPort(asset *AssetInfo) int {
+	for _, service := range asset.Services {
+		if service.Protocol == "http" && service.Port > 0 {
+			return service.Port
+		}
+	}
+	if len(asset.Ports) > 0 {
+		return asset.Ports[0]
+	}
+	return 0
+}
+
+// mdnsTXT lists the asset's identity as key=value strings, leaving out empty values
+func mdnsTXT(asset *AssetInfo) []string {
+	capabilities := make([]string, len(asset.Capabilities))
+	for i, capability := range asset.Capabilities {
+		capabilities[i] = string(capability)
+	}
+	path := ""
+	for _, service := range asset.Services {
+		if service.Protocol == "http" {
+			path = service.Path
+			break
+		}
+	}
+
+	txt := []string{"txtvers=1"}
+	for _, field := range [][2]string{
+		{"id", asset.ID},
+		{"name", asset.Name},
+		{"type", string(asset.Type)},
+		{"model", asset.Model},
+		{"manufacturer", asset.Manufacturer},
+		{"version", asset.Version},
+		{"room", asset.Room},
+		{"zone", asset.Zone},
+		{"caps", strings.Join(capabilities, ",")},
+		{"tags", strings.Join(asset.Tags, ",")},
+		{"mac", asset.MACAddress},
+		{"path", path},
+		{"ttl", strconv.Itoa(asset.TTL)},
+	} {
+		if field[1] == "" {
+			continue
+		}
+		entry := field[0] + "=" + field[1]
+		if len(entry) > mdnsMaxTXTLength {
+			entry = entry[:mdnsMaxTXTLength]
+		}
+		txt = append(txt, entry)
+	}
+	return txt
+}
+
+// mdnsAsset builds the asset an instance's records describe. Instances of other software
+// without an id are identified by their instance name.
+func mdnsAsset(instance *mdnsInstance, address string, now time.Time) *AssetInfo {
+	values := make(map[string]string)
+	for _, entry := range instance.txt {
+		key, value, _ := strings.Cut(entry, "=")
+		values[strings.ToLower(key)] = value
+	}
+	label := instance.name
+	if strings.HasSuffix(strings.ToLower(label), "."+mdnsServiceName) {
+		label = label[:len(label)-len(mdnsServiceName)-1]
+	}
+
+	asset := &AssetInfo{
+		ID:               values["id"],
+		Name:             values["name"],
+		Type:             AssetType(values["type"]),
+		Model:            values["model"],
+		Manufacturer:     values["manufacturer"],
+		Version:          values["version"],
+		IPAddress:        address,
+		MACAddress:       values["mac"],
+		Hostname:         strings.TrimSuffix(instance.host, "."+MDNSDomain),
+		Ports:            []int{},
+		Capabilities:     []AssetCapability{},
+		Services:         []ServiceInfo{},
+		Room:             values["room"],
+		Zone:             values["zone"],
+		Tags:             []string{},
+		Metadata:         map[string]string{MDNSMetadataSource: "mdns"},
+		Status:           "online",
+		LastSeen:         now,
+		DiscoveryVersion: DiscoveryVersion,
+		TTL:              int(instance.ttl),
+	}
+	if asset.ID == "" {
+		asset.ID = "mdns-" + strings.ReplaceAll(strings.ToLower(label), " ", "-")
+	}
+	if asset.Name == "" {
+		asset.Name = label
+	}
+	if ttl, err := strconv.Atoi(values["ttl"]); err == nil && ttl > 0 {
+		asset.TTL = ttl
+	}
+	if values["caps"] != "" {
+		for _, capability := range strings.Split(values["caps"], ",") {
+			asset.Capabilities = append(asset.Capabilities, AssetCapability(capability))
+		}
+	}
+	if values["tags"] != "" {
+		asset.Tags = strings.Split(values["tags"], ",")
+	}
+	if instance.port > 0 {
+		asset.Ports = []int{int(instance.port)}
+		asset.Services = []ServiceInfo{{
+			Name:        MDNSServiceType,
+			Protocol:    "tcp",
+			Port:        int(instance.port),
+			Path:        values["path"],
+			Description: "Advertised over mDNS",
+		}}
+	}
+	return asset
+}
+
+// mdnsBrowseQuery asks for the instances of the service, with multicast answers so every
+// browser on the link sees them
+func mdnsBrowseQuery() *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(mdnsServiceName),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
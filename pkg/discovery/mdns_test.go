@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recordingListener records discovery events
+type recordingListener struct {
+	discovered, updated []*AssetInfo
+	lost                []string
+}
+
+func (l *recordingListener) OnAssetDiscovered(asset *AssetInfo) {
+	l.discovered = append(l.discovered, asset)
+}
+
+func (l *recordingListener) OnAssetUpdated(asset *AssetInfo) {
+	l.updated = append(l.updated, asset)
+}
+
+func (l *recordingListener) OnAssetLost(assetID string) {
+	l.lost = append(l.lost, assetID)
+}
+
+func (l *recordingListener) OnQueryReceived(query *Query, sender string) {}
+
+func pack(t *testing.T, message *dnsmessage.Message) []byte {
+	t.Helper()
+	data, err := message.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	return data
+}
+
+func TestMDNSAdvertiseAndBrowse(t *testing.T) {
+	asset := NewHomeAutomationGateway("Gateway v1.2").
+		WithID("gateway-1").
+		WithHostname("gateway.home.lan").
+		WithIPAddress("192.168.1.10").
+		WithRoom("utility").
+		WithHTTPService("api", 8080, "/api", "Home Automation API").
+		Build()
+	responder := NewMDNSService(asset)
+	peer := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: MDNSPort}
+
+	// A browse query is answered by multicast with the instance's records
+	reply, to := responder.handleMessage(pack(t, mdnsBrowseQuery()), peer, time.Now())
+	if reply == nil || to != responder.group || len(reply.Answers) != 1 || len(reply.Additionals) != 3 {
+		t.Fatalf("Expected the PTR answer with SRV, TXT and A records, got %+v to %v", reply, to)
+	}
+	if name := reply.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); name != "Gateway v1-2._homeauto._tcp.local." {
+		t.Errorf("Expected the dot kept out of the instance label, got %s", name)
+	}
+
+	browser := NewMDNSService(nil)
+	listener := &recordingListener{}
+	browser.AddListener(listener)
+	now := time.Now()
+	browser.handleMessage(pack(t, reply), peer, now)
+	if len(listener.discovered) != 1 {
+		t.Fatalf("Expected the gateway discovered, got %+v", listener)
+	}
+	found := listener.discovered[0]
+	if found.ID != "gateway-1" || found.Type != AssetTypeGateway || found.IPAddress != "192.168.1.10" || found.Hostname != "gateway" ||
+		found.Room != "utility" || len(found.Ports) != 1 || found.Ports[0] != 8080 || found.Services[0].Path != "/api" ||
+		len(found.Capabilities) != 2 || found.Metadata[MDNSMetadataSource] != "mdns" {
+		t.Errorf("Expected the gateway's identity from its records, got %+v", found)
+	}
+
+	// Repeated records are not an update, a changed room is
+	browser.handleMessage(pack(t, reply), peer, now)
+	responder.UpdateLocalAsset(func(asset *AssetInfo) { asset.Room = "garage" })
+	reply, _ = responder.handleMessage(pack(t, mdnsBrowseQuery()), peer, now)
+	browser.handleMessage(pack(t, reply), peer, now)
+	if len(listener.discovered) != 1 || len(listener.updated) != 1 || listener.updated[0].Room != "garage" {
+		t.Errorf("Expected one update for the new room, got %+v", listener)
+	}
+
+	// Legacy unicast queries get a unicast reply with their ID and a short TTL
+	legacy := mdnsBrowseQuery()
+	legacy.Header.ID = 42
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.30"), Port: 49152}
+	reply, to = responder.handleMessage(pack(t, legacy), client, now)
+	if reply == nil || to != client || reply.Header.ID != 42 || len(reply.Questions) != 1 || reply.Answers[0].Header.TTL != mdnsLegacyTTL {
+		t.Errorf("Expected a legacy unicast reply, got %+v to %v", reply, to)
+	}
+
+	// The goodbye withdraws the asset
+	records := mdnsRecordsFor(asset, 0, true)
+	browser.handleMessage(pack(t, &dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{records.ptr},
+	}), peer, now)
+	if len(listener.lost) != 1 || listener.lost[0] != "gateway-1" || len(browser.GetKnownAssets()) != 0 {
+		t.Errorf("Expected the gateway lost after its goodbye, got %+v", listener)
+	}
+}
+
+func TestMDNSBrowseForeignInstance(t *testing.T) {
+	// An instance advertised by other software, without an id or an address record
+	instance := dnsmessage.MustNewName("Porch Sensor._homeauto._tcp.local.")
+	response := &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsServiceName), Class: dnsmessage.ClassINET, TTL: 120},
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		}},
+		Additionals: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: 120},
+				Body:   &dnsmessage.SRVResource{Port: 80, Target: dnsmessage.MustNewName("porch.local.")},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: 120},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"type=motion_sensor", "caps=motion"}},
+			},
+		},
+	}
+
+	browser := NewMDNSService(nil)
+	listener := &recordingListener{}
+	browser.AddListener(listener)
+	seen := time.Now()
+	browser.handleMessage(pack(t, response), &net.UDPAddr{IP: net.ParseIP("192.168.1.40"), Port: MDNSPort}, seen)
+	if len(listener.discovered) != 1 {
+		t.Fatalf("Expected the porch sensor discovered, got %+v", listener)
+	}
+	found := listener.discovered[0]
+	if found.ID != "mdns-porch-sensor" || found.Name != "Porch Sensor" || found.IPAddress != "192.168.1.40" || found.Type != AssetTypeMotionSensor {
+		t.Errorf("Expected the sensor named after its instance at the sender's address, got %+v", found)
+	}
+
+	if lost := browser.expire(seen.Add(3 * time.Minute)); len(lost) != 0 {
+		t.Errorf("Expected the sensor kept within twice its TTL, got %v", lost)
+	}
+	if lost := browser.expire(seen.Add(5 * time.Minute)); len(lost) != 1 {
+		t.Errorf("Expected the sensor expired, got %v", lost)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -24,6 +25,13 @@ const (
 	AssetTypeTempSensor     AssetType = "temperature_sensor"
 	AssetTypeHumiditySensor AssetType = "humidity_sensor"
 	AssetTypeLightSensor    AssetType = "light_sensor"
+
+	// Third-party devices found over SSDP/UPnP
+	AssetTypeTelevision    AssetType = "television"
+	AssetTypeMediaPlayer   AssetType = "media_player"
+	AssetTypeMediaServer   AssetType = "media_server"
+	AssetTypeRouter        AssetType = "router"
+	AssetTypeNetworkDevice AssetType = "network_device" // Any other UPnP device
 )
 
 // AssetCapability represents what an asset can do
@@ -38,12 +46,14 @@ const (
 	CapabilityEnergyMonitor  AssetCapability = "energy_monitor"
 	CapabilitySwitch         AssetCapability = "switch"
 	CapabilityDimmer         AssetCapability = "dimmer"
+	CapabilityColor          AssetCapability = "color"
 	CapabilityThermostatCtrl AssetCapability = "thermostat_control"
 	CapabilityVideo          AssetCapability = "video"
 	CapabilityAudio          AssetCapability = "audio"
 	CapabilityMQTT           AssetCapability = "mqtt"
 	CapabilityHTTP           AssetCapability = "http"
 	CapabilityKLAP           AssetCapability = "klap"
+	CapabilityUPnP           AssetCapability = "upnp"
 )
 
 // AssetInfo represents information about a discovered asset
@@ -102,6 +112,12 @@ type DiscoveryMessage struct {
 	Query     *Query     `json:"query"`     // Query parameters (for query messages)
 	Timestamp time.Time  `json:"timestamp"` // Message timestamp
 	Sender    string     `json:"sender"`    // Sender identifier
+
+	// Unicast asks responders to answer a query directly instead of over multicast, at ReplyTo
+	// or else the address the query came from
+	Unicast bool   `json:"unicast,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"` // host:port, set by relays for the original querier
+	Hops    int    `json:"hops,omitempty"`     // Relays the message has crossed
 }
 
 // Query represents a discovery query
@@ -131,7 +147,10 @@ const (
 	MessageTypeGoodbye  = "goodbye"
 )
 
-// DiscoveryProtocol handles asset discovery using multicast
+// DiscoveryProtocol handles asset discovery using multicast. It is safe for concurrent use: the
+// listener, announcement and cleanup goroutines share the known assets with its callers.
+// Listeners are called without the locks held, so they may call back into the protocol, and
+// one event at a time in the order the changes were made.
 type DiscoveryProtocol struct {
 	receiveConn   *net.UDPConn
 	sendConn      *net.UDPConn
@@ -142,6 +161,11 @@ type DiscoveryProtocol struct {
 	ctx           context.Context
 	cancel        context.CancelFunc
 	sequence      uint64
+	localMu       sync.Mutex     // Guards localAsset and sequence while announcing
+	peers         []*net.UDPAddr // Queried directly as well, beyond the multicast segment
+	mu            sync.RWMutex   // Guards knownAssets, listeners and peers
+	eventMu       sync.Mutex     // Held from a change to knownAssets until its events are sent
+	closeOnce     sync.Once
 }
 
 // AssetDiscoveryListener handles discovery events
@@ -198,9 +222,48 @@ func NewDiscoveryProtocol(localAsset *AssetInfo) (*DiscoveryProtocol, error) {
 
 // AddListener adds a discovery event listener
 func (dp *DiscoveryProtocol) AddListener(listener AssetDiscoveryListener) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
 	dp.listeners = append(dp.listeners, listener)
 }
 
+// getListeners returns the listeners to notify
+func (dp *DiscoveryProtocol) getListeners() []AssetDiscoveryListener {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+	return dp.listeners[:len(dp.listeners):len(dp.listeners)]
+}
+
+// SetUnicastPeers sets hosts to query directly besides over multicast, such as relays or
+// assets on another VLAN, as host or host:port with the discovery port by default
+func (dp *DiscoveryProtocol) SetUnicastPeers(peers []string) error {
+	var addrs []*net.UDPAddr
+	for _, peer := range peers {
+		addr, err := ResolvePeer(peer)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.peers = addrs
+	return nil
+}
+
+// ResolvePeer resolves a discovery peer given as host or host:port
+func ResolvePeer(peer string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(peer); err != nil {
+		peer = net.JoinHostPort(peer, fmt.Sprint(DefaultMulticastPort))
+	}
+	addr, err := net.ResolveUDPAddr("udp4", peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve discovery peer %s: %w", peer, err)
+	}
+	return addr, nil
+}
+
 // Start begins the discovery protocol
 func (dp *DiscoveryProtocol) Start() error {
 	// Start listening for messages
@@ -227,10 +290,18 @@ func (dp *DiscoveryProtocol) Stop() error {
 		dp.Goodbye()
 	}
 
-	// Cancel context and close connections
-	dp.cancel()
-	dp.receiveConn.Close()
-	return dp.sendConn.Close()
+	return dp.close()
+}
+
+// close cancels the context and closes the connections, once
+func (dp *DiscoveryProtocol) close() error {
+	var err error
+	dp.closeOnce.Do(func() {
+		dp.cancel()
+		dp.receiveConn.Close()
+		err = dp.sendConn.Close()
+	})
+	return err
 }
 
 // Announce sends an announcement message for the local asset
@@ -239,6 +310,9 @@ func (dp *DiscoveryProtocol) Announce() error {
 		return fmt.Errorf("no local asset configured")
 	}
 
+	dp.localMu.Lock()
+	defer dp.localMu.Unlock()
+
 	dp.sequence++
 	dp.localAsset.Sequence = dp.sequence
 	dp.localAsset.LastSeen = time.Now()
@@ -253,9 +327,23 @@ func (dp *DiscoveryProtocol) Announce() error {
 	return dp.sendMessage(message)
 }
 
-// Query sends a discovery query
+// UpdateLocalAsset changes the local asset, e.g. its metadata, before the next announcement
+func (dp *DiscoveryProtocol) UpdateLocalAsset(update func(asset *AssetInfo)) {
+	if dp.localAsset == nil {
+		return
+	}
+
+	dp.localMu.Lock()
+	defer dp.localMu.Unlock()
+	update(dp.localAsset)
+}
+
+// Query sends a discovery query over multicast, and to each unicast peer asking for direct
+// responses
 func (dp *DiscoveryProtocol) Query(query *Query) error {
+	dp.localMu.Lock()
 	dp.sequence++
+	dp.localMu.Unlock()
 
 	message := &DiscoveryMessage{
 		Type:      MessageTypeQuery,
@@ -264,7 +352,22 @@ func (dp *DiscoveryProtocol) Query(query *Query) error {
 		Sender:    dp.getLocalID(),
 	}
 
-	return dp.sendMessage(message)
+	if err := dp.sendMessage(message); err != nil {
+		return err
+	}
+
+	dp.mu.RLock()
+	peers := dp.peers
+	dp.mu.RUnlock()
+
+	message.Unicast = true
+	var firstErr error
+	for _, peer := range peers {
+		if err := dp.sendUnicast(message, peer); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // Goodbye sends a goodbye message when leaving the network
@@ -273,6 +376,9 @@ func (dp *DiscoveryProtocol) Goodbye() error {
 		return fmt.Errorf("no local asset configured")
 	}
 
+	dp.localMu.Lock()
+	defer dp.localMu.Unlock()
+
 	dp.sequence++
 	dp.localAsset.Sequence = dp.sequence
 
@@ -288,6 +394,9 @@ func (dp *DiscoveryProtocol) Goodbye() error {
 
 // GetKnownAssets returns all currently known assets
 func (dp *DiscoveryProtocol) GetKnownAssets() map[string]*AssetInfo {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
 	result := make(map[string]*AssetInfo)
 	for id, asset := range dp.knownAssets {
 		result[id] = asset
@@ -297,6 +406,9 @@ func (dp *DiscoveryProtocol) GetKnownAssets() map[string]*AssetInfo {
 
 // GetAssetsByType returns assets filtered by type
 func (dp *DiscoveryProtocol) GetAssetsByType(assetType AssetType) []*AssetInfo {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
 	var assets []*AssetInfo
 	for _, asset := range dp.knownAssets {
 		if asset.Type == assetType {
@@ -308,6 +420,9 @@ func (dp *DiscoveryProtocol) GetAssetsByType(assetType AssetType) []*AssetInfo {
 
 // GetAssetsByCapability returns assets with specific capability
 func (dp *DiscoveryProtocol) GetAssetsByCapability(capability AssetCapability) []*AssetInfo {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
 	var assets []*AssetInfo
 	for _, asset := range dp.knownAssets {
 		for _, cap := range asset.Capabilities {
@@ -322,6 +437,9 @@ func (dp *DiscoveryProtocol) GetAssetsByCapability(capability AssetCapability) [
 
 // GetAssetsByRoom returns assets in a specific room
 func (dp *DiscoveryProtocol) GetAssetsByRoom(room string) []*AssetInfo {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
 	var assets []*AssetInfo
 	for _, asset := range dp.knownAssets {
 		if asset.Room == room {
@@ -331,15 +449,24 @@ func (dp *DiscoveryProtocol) GetAssetsByRoom(room string) []*AssetInfo {
 	return assets
 }
 
-// sendMessage sends a discovery message via multicast
-func (dp *DiscoveryProtocol) sendMessage(message *DiscoveryMessage) error {
+// encodeMessage marshals a discovery message, checking it fits in a datagram
+func encodeMessage(message *DiscoveryMessage) ([]byte, error) {
 	data, err := json.Marshal(message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
 	if len(data) > MaxMessageSize {
-		return fmt.Errorf("message too large: %d bytes (max %d)", len(data), MaxMessageSize)
+		return nil, fmt.Errorf("message too large: %d bytes (max %d)", len(data), MaxMessageSize)
+	}
+	return data, nil
+}
+
+// sendMessage sends a discovery message via multicast
+func (dp *DiscoveryProtocol) sendMessage(message *DiscoveryMessage) error {
+	data, err := encodeMessage(message)
+	if err != nil {
+		return err
 	}
 
 	_, err = dp.sendConn.Write(data)
@@ -350,6 +477,20 @@ func (dp *DiscoveryProtocol) sendMessage(message *DiscoveryMessage) error {
 	return nil
 }
 
+// sendUnicast sends a discovery message to one host, from the discovery port so that its
+// replies come back to it
+func (dp *DiscoveryProtocol) sendUnicast(message *DiscoveryMessage, to *net.UDPAddr) error {
+	data, err := encodeMessage(message)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dp.receiveConn.WriteToUDP(data, to); err != nil {
+		return fmt.Errorf("failed to send unicast message to %s: %w", to, err)
+	}
+	return nil
+}
+
 // messageListener listens for incoming discovery messages
 func (dp *DiscoveryProtocol) messageListener() {
 	buffer := make([]byte, MaxMessageSize)
@@ -368,33 +509,60 @@ func (dp *DiscoveryProtocol) messageListener() {
 				continue // Other errors, keep listening
 			}
 
-			dp.handleMessage(buffer[:n], addr)
+			response, to := dp.handleMessage(buffer[:n], addr)
+			if response == nil {
+				continue
+			}
+			if to != nil {
+				dp.sendUnicast(response, to)
+			} else {
+				dp.sendMessage(response)
+			}
 		}
 	}
 }
 
-// handleMessage processes an incoming discovery message
-func (dp *DiscoveryProtocol) handleMessage(data []byte, sender *net.UDPAddr) {
+// handleMessage processes an incoming discovery message. It returns the response to a query
+// the local asset matches, with the address to send it to, or nil to multicast it.
+func (dp *DiscoveryProtocol) handleMessage(data []byte, sender *net.UDPAddr) (*DiscoveryMessage, *net.UDPAddr) {
 	var message DiscoveryMessage
 	if err := json.Unmarshal(data, &message); err != nil {
-		return // Invalid message, ignore
+		return nil, nil // Invalid message, ignore
 	}
 
 	// Ignore our own messages
 	if message.Sender == dp.getLocalID() {
-		return
+		return nil, nil
 	}
 
 	switch message.Type {
 	case MessageTypeAnnounce:
 		dp.handleAnnounce(message.Asset)
 	case MessageTypeQuery:
-		dp.handleQuery(message.Query, message.Sender)
+		if response := dp.handleQuery(message.Query, message.Sender); response != nil {
+			if message.Unicast {
+				return response, replyAddress(&message, sender)
+			}
+			return response, nil
+		}
 	case MessageTypeResponse:
 		dp.handleResponse(message.Asset)
 	case MessageTypeGoodbye:
 		dp.handleGoodbye(message.Asset)
 	}
+	return nil, nil
+}
+
+// replyAddress is where a unicast query is answered: the querier a relay names, as long as it
+// is on the local network so that queries can't aim responses at other hosts, else the sender
+func replyAddress(message *DiscoveryMessage, sender *net.UDPAddr) *net.UDPAddr {
+	if message.ReplyTo != "" {
+		if addr, err := net.ResolveUDPAddr("udp4", message.ReplyTo); err == nil &&
+			(addr.IP.IsPrivate() || addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast()) {
+			return addr
+		}
+	}
+	return sender
 }
 
 // handleAnnounce processes an asset announcement
@@ -403,41 +571,54 @@ func (dp *DiscoveryProtocol) handleAnnounce(asset *AssetInfo) {
 		return
 	}
 
-	existing, exists := dp.knownAssets[asset.ID]
+	dp.eventMu.Lock()
+	defer dp.eventMu.Unlock()
+
 	asset.LastSeen = time.Now()
+	dp.mu.Lock()
+	existing, exists := dp.knownAssets[asset.ID]
 	dp.knownAssets[asset.ID] = asset
+	dp.mu.Unlock()
 
 	if exists {
-		// Asset updated
-		if existing.Sequence < asset.Sequence {
-			for _, listener := range dp.listeners {
+		// Asset updated; a lower sequence means the asset restarted
+		if existing.Sequence != asset.Sequence {
+			for _, listener := range dp.getListeners() {
 				listener.OnAssetUpdated(asset)
 			}
 		}
 	} else {
 		// New asset discovered
-		for _, listener := range dp.listeners {
+		for _, listener := range dp.getListeners() {
 			listener.OnAssetDiscovered(asset)
 		}
 	}
 }
 
-// handleQuery processes a discovery query
-func (dp *DiscoveryProtocol) handleQuery(query *Query, sender string) {
+// handleQuery processes a discovery query, returning the response if our local asset matches
+func (dp *DiscoveryProtocol) handleQuery(query *Query, sender string) *DiscoveryMessage {
 	// Notify listeners about the query
-	for _, listener := range dp.listeners {
+	for _, listener := range dp.getListeners() {
 		listener.OnQueryReceived(query, sender)
 	}
 
 	// Respond if our local asset matches the query
-	if dp.localAsset != nil && dp.matchesQuery(dp.localAsset, query) {
-		response := &DiscoveryMessage{
-			Type:      MessageTypeResponse,
-			Asset:     dp.localAsset,
-			Timestamp: time.Now(),
-			Sender:    dp.localAsset.ID,
-		}
-		dp.sendMessage(response)
+	if dp.localAsset == nil {
+		return nil
+	}
+
+	dp.localMu.Lock()
+	defer dp.localMu.Unlock()
+	if !dp.matchesQuery(dp.localAsset, query) {
+		return nil
+	}
+	// Copy the asset, which may change before the response is sent
+	asset := *dp.localAsset
+	return &DiscoveryMessage{
+		Type:      MessageTypeResponse,
+		Asset:     &asset,
+		Timestamp: time.Now(),
+		Sender:    asset.ID,
 	}
 }
 
@@ -452,9 +633,16 @@ func (dp *DiscoveryProtocol) handleGoodbye(asset *AssetInfo) {
 		return
 	}
 
-	if _, exists := dp.knownAssets[asset.ID]; exists {
-		delete(dp.knownAssets, asset.ID)
-		for _, listener := range dp.listeners {
+	dp.eventMu.Lock()
+	defer dp.eventMu.Unlock()
+
+	dp.mu.Lock()
+	_, exists := dp.knownAssets[asset.ID]
+	delete(dp.knownAssets, asset.ID)
+	dp.mu.Unlock()
+
+	if exists {
+		for _, listener := range dp.getListeners() {
 			listener.OnAssetLost(asset.ID)
 		}
 	}
@@ -539,7 +727,11 @@ func (dp *DiscoveryProtocol) periodicAnnounce() {
 		return
 	}
 
-	ticker := time.NewTicker(time.Duration(dp.localAsset.TTL/3) * time.Second)
+	dp.localMu.Lock()
+	interval := time.Duration(dp.localAsset.TTL/3) * time.Second
+	dp.localMu.Unlock()
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
@@ -561,25 +753,42 @@ func (dp *DiscoveryProtocol) assetCleanup() {
 		select {
 		case <-dp.ctx.Done():
 			return
-		case <-ticker.C:
-			now := time.Now()
-			for id, asset := range dp.knownAssets {
-				ttl := time.Duration(asset.TTL) * time.Second
-				if now.Sub(asset.LastSeen) > ttl*2 { // Double TTL for cleanup
-					delete(dp.knownAssets, id)
-					for _, listener := range dp.listeners {
-						listener.OnAssetLost(id)
-					}
-				}
-			}
+		case now := <-ticker.C:
+			dp.expire(now)
+		}
+	}
+}
+
+// expire forgets the assets not seen for twice their TTL and tells the listeners they're lost
+func (dp *DiscoveryProtocol) expire(now time.Time) {
+	dp.eventMu.Lock()
+	defer dp.eventMu.Unlock()
+
+	var lost []string
+	dp.mu.Lock()
+	for id, asset := range dp.knownAssets {
+		ttl := time.Duration(asset.TTL) * time.Second
+		if now.Sub(asset.LastSeen) > ttl*2 { // Double TTL for cleanup
+			delete(dp.knownAssets, id)
+			lost = append(lost, id)
+		}
+	}
+	dp.mu.Unlock()
+
+	for _, id := range lost {
+		for _, listener := range dp.getListeners() {
+			listener.OnAssetLost(id)
 		}
 	}
 }
 
 // getLocalID returns the local asset ID or a default
 func (dp *DiscoveryProtocol) getLocalID() string {
-	if dp.localAsset != nil {
-		return dp.localAsset.ID
+	if dp.localAsset == nil {
+		return "unknown"
 	}
-	return "unknown"
+
+	dp.localMu.Lock()
+	defer dp.localMu.Unlock()
+	return dp.localAsset.ID
 }
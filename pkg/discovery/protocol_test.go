@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProtocol returns a protocol on loopback sockets, its "multicast" sent to itself
+func testProtocol(t *testing.T, localAsset *AssetInfo) *DiscoveryProtocol {
+	t.Helper()
+	receiveConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendConn, err := net.DialUDP("udp4", nil, receiveConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		receiveConn.Close()
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if localAsset != nil && localAsset.TTL == 0 {
+		localAsset.TTL = DefaultTTL
+	}
+	dp := &DiscoveryProtocol{
+		receiveConn:   receiveConn,
+		sendConn:      sendConn,
+		multicastAddr: sendConn.RemoteAddr().(*net.UDPAddr),
+		localAsset:    localAsset,
+		knownAssets:   make(map[string]*AssetInfo),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	t.Cleanup(func() { dp.close() })
+	return dp
+}
+
+// eventRecorder tracks the assets its events say are known, calling back into the protocol
+type eventRecorder struct {
+	protocol *DiscoveryProtocol
+	known    map[string]bool
+	invalid  []string
+	mu       sync.Mutex
+}
+
+func (r *eventRecorder) OnAssetDiscovered(asset *AssetInfo) {
+	r.protocol.GetKnownAssets()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.known[asset.ID] {
+		r.invalid = append(r.invalid, "discovered twice: "+asset.ID)
+	}
+	r.known[asset.ID] = true
+}
+
+func (r *eventRecorder) OnAssetUpdated(asset *AssetInfo) {}
+
+func (r *eventRecorder) OnAssetLost(assetID string) {
+	r.protocol.GetAssetsByRoom("kitchen")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.known[assetID] {
+		r.invalid = append(r.invalid, "lost before discovered: "+assetID)
+	}
+	delete(r.known, assetID)
+}
+
+func (r *eventRecorder) OnQueryReceived(query *Query, sender string) {}
+
+func TestProtocolConcurrentAnnounceQueryCleanup(t *testing.T) {
+	gateway := &AssetInfo{ID: "gateway", Type: AssetTypeGateway}
+	dp := testProtocol(t, gateway)
+	recorder := &eventRecorder{protocol: dp, known: make(map[string]bool)}
+	dp.AddListener(recorder)
+	if err := dp.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const senders, messages = 8, 50
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			sender := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(s+1)), Port: DefaultMulticastPort}
+			for i := 0; i < messages; i++ {
+				asset := &AssetInfo{ID: fmt.Sprintf("sensor-%d", i%10), Type: AssetTypeSensor, Room: "kitchen", Sequence: uint64(i), TTL: 1}
+				message := DiscoveryMessage{Type: MessageTypeAnnounce, Asset: asset, Sender: asset.ID}
+				switch i % 5 {
+				case 1:
+					message.Type = MessageTypeResponse
+				case 2:
+					message.Type = MessageTypeGoodbye
+				case 3:
+					message = DiscoveryMessage{Type: MessageTypeQuery, Query: &Query{Room: "kitchen"}, Sender: "cli"}
+				}
+				dp.handleMessage(discoveryMessage(t, message), sender)
+			}
+		}(s)
+	}
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			dp.Query(&Query{AssetTypes: []AssetType{AssetTypeSensor}})
+			dp.Announce()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			dp.expire(time.Now().Add(time.Duration(i%3) * time.Second))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			dp.GetAssetsByType(AssetTypeSensor)
+			dp.GetAssetsByCapability(CapabilityTemperature)
+			dp.UpdateLocalAsset(func(asset *AssetInfo) { asset.Room = fmt.Sprint("room-", i) })
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			dp.AddListener(&eventRecorder{protocol: dp, known: make(map[string]bool)})
+			dp.SetUnicastPeers([]string{"127.0.0.1:9"})
+		}
+	}()
+	wg.Wait()
+	dp.Stop()
+	dp.Stop()
+
+	// The listener saw every change, in order
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.invalid) > 0 {
+		t.Errorf("Expected events in the order of the changes, got %v", recorder.invalid)
+	}
+	known := dp.GetKnownAssets()
+	if len(known) != len(recorder.known) {
+		t.Errorf("Expected the listener to know the %d known assets, got %v", len(known), recorder.known)
+	}
+	for id := range known {
+		if !recorder.known[id] {
+			t.Errorf("Expected %s discovered", id)
+		}
+	}
+}
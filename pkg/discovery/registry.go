@@ -0,0 +1,244 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// AssetRegistryFileName is the registry's file in the state directory
+	AssetRegistryFileName = "assets.json"
+
+	maxAssetHistory = 50 // Changes kept per asset, oldest dropped first
+	// Sightings that only move LastSeen are saved at most this often, and when the manager stops
+	registrySaveInterval = time.Minute
+)
+
+// AssetRegistryPath returns the registry's path in a state directory
+func AssetRegistryPath(stateDir string) string {
+	return filepath.Join(stateDir, AssetRegistryFileName)
+}
+
+// AssetChange is a change of address or firmware seen between two sightings of an asset
+type AssetChange struct {
+	Field string    `json:"field"` // ip_address, mac_address or version
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	At    time.Time `json:"at"`
+}
+
+// AssetRecord is everything remembered about an asset across restarts
+type AssetRecord struct {
+	Asset     *AssetInfo    `json:"asset"` // As last discovered
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+	Online    bool          `json:"online"`
+	Name      string        `json:"name,omitempty"` // Assigned by the user, over the discovered name
+	Room      string        `json:"room,omitempty"` // Assigned by the user, over the discovered room
+	History   []AssetChange `json:"history,omitempty"`
+}
+
+// Merged returns a copy of the discovered asset with the user's name and room
+func (r *AssetRecord) Merged() *AssetInfo {
+	asset := *r.Asset
+	if r.Name != "" {
+		asset.Name = r.Name
+	}
+	if r.Room != "" {
+		asset.Room = r.Room
+	}
+	if !r.Online {
+		asset.Status = "offline"
+	}
+	return &asset
+}
+
+// AssetRegistry remembers every asset ever discovered in a JSON file, with when it was first and
+// last seen, how its address and firmware changed, and the name and room the user gave it
+type AssetRegistry struct {
+	path    string
+	records map[string]*AssetRecord
+	dirty   bool
+	savedAt time.Time
+	mu      sync.Mutex
+}
+
+// NewAssetRegistry loads the registry at path. A missing file starts an empty registry, and an
+// empty path keeps it in memory only.
+func NewAssetRegistry(path string) (*AssetRegistry, error) {
+	r := &AssetRegistry{path: path, records: make(map[string]*AssetRecord)}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read asset registry: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.records); err != nil {
+		return nil, fmt.Errorf("failed to parse asset registry %s: %w", path, err)
+	}
+	for id, record := range r.records {
+		if record == nil || record.Asset == nil {
+			delete(r.records, id)
+		}
+	}
+	return r, nil
+}
+
+// Observe records a sighting of an asset and returns it merged with the user's name and room
+func (r *AssetRegistry) Observe(asset *AssetInfo, now time.Time) (*AssetInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	copied := *asset
+	record, known := r.records[asset.ID]
+	changed := !known
+	if !known {
+		record = &AssetRecord{FirstSeen: now}
+		r.records[asset.ID] = record
+	} else {
+		previous := record.Asset
+		for _, field := range []struct{ name, from, to string }{
+			{"ip_address", previous.IPAddress, asset.IPAddress},
+			{"mac_address", previous.MACAddress, asset.MACAddress},
+			{"version", previous.Version, asset.Version},
+		} {
+			// An asset that stops reporting a field hasn't changed it
+			if field.to == "" || field.from == field.to {
+				continue
+			}
+			record.History = append(record.History, AssetChange{Field: field.name, From: field.from, To: field.to, At: now})
+			changed = true
+		}
+		if len(record.History) > maxAssetHistory {
+			record.History = record.History[len(record.History)-maxAssetHistory:]
+		}
+		changed = changed || !record.Online
+	}
+	record.Asset = &copied
+	record.LastSeen = now
+	record.Online = true
+
+	r.dirty = true
+	if !changed && now.Sub(r.savedAt) < registrySaveInterval {
+		return record.Merged(), nil
+	}
+	return record.Merged(), r.save(now)
+}
+
+// Lost marks an asset offline, keeping its record
+func (r *AssetRegistry) Lost(id string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok || !record.Online {
+		return nil
+	}
+	record.Online = false
+	r.dirty = true
+	return r.save(now)
+}
+
+// SetName gives an asset a name of the user's, or restores the discovered name when empty
+func (r *AssetRegistry) SetName(id, name string) error {
+	return r.edit(id, func(record *AssetRecord) { record.Name = name })
+}
+
+// SetRoom puts an asset in a room of the user's, or restores the discovered room when empty
+func (r *AssetRegistry) SetRoom(id, room string) error {
+	return r.edit(id, func(record *AssetRecord) { record.Room = room })
+}
+
+func (r *AssetRegistry) edit(id string, change func(*AssetRecord)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return fmt.Errorf("unknown asset %s", id)
+	}
+	change(record)
+	r.dirty = true
+	return r.save(time.Now())
+}
+
+// Forget removes an asset's record, e.g. for a device that was thrown away
+func (r *AssetRegistry) Forget(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.records[id]; !ok {
+		return fmt.Errorf("unknown asset %s", id)
+	}
+	delete(r.records, id)
+	r.dirty = true
+	return r.save(time.Now())
+}
+
+// Get returns a copy of an asset's record
+func (r *AssetRegistry) Get(id string) (AssetRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return AssetRecord{}, false
+	}
+	return r.copyRecord(record), true
+}
+
+// List returns copies of every record, by ID
+func (r *AssetRegistry) List() []AssetRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := make([]AssetRecord, 0, len(r.records))
+	for _, record := range r.records {
+		records = append(records, r.copyRecord(record))
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Asset.ID < records[j].Asset.ID })
+	return records
+}
+
+func (r *AssetRegistry) copyRecord(record *AssetRecord) AssetRecord {
+	copied := *record
+	copied.History = append([]AssetChange(nil), record.History...)
+	return copied
+}
+
+// Flush saves sightings not saved yet
+func (r *AssetRegistry) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save(time.Now())
+}
+
+// save writes the registry if it changed since it was last saved. The caller holds the lock.
+func (r *AssetRegistry) save(now time.Time) error {
+	if r.path == "" || !r.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode asset registry: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write asset registry: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to save asset registry: %w", err)
+	}
+	r.dirty = false
+	r.savedAt = now
+	return nil
+}
@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testManager returns a manager with the registry that isn't on the network
+func testManager(registry *AssetRegistry) *DiscoveryManager {
+	return &DiscoveryManager{
+		registry:     registry,
+		assets:       make(map[string]*AssetInfo),
+		mdnsOnly:     make(map[string]bool),
+		maxLogSize:   10,
+		discoveredCh: make(chan *AssetInfo, 10),
+		updatedCh:    make(chan *AssetInfo, 10),
+		lostCh:       make(chan string, 10),
+	}
+}
+
+func TestAssetRegistryRemembersAssets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), AssetRegistryFileName)
+	registry, err := NewAssetRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := testManager(registry)
+
+	plug := &AssetInfo{ID: "plug-1", Name: "Tapo P110", Type: AssetTypeSmartPlug, IPAddress: "192.168.1.20", Version: "1.0.3"}
+	dm.OnAssetDiscovered(plug)
+	if err := dm.SetAssetName("plug-1", "Dehumidifier"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.SetAssetRoom("plug-1", "basement"); err != nil {
+		t.Fatal(err)
+	}
+	if asset, _ := dm.GetAsset("plug-1"); asset.Name != "Dehumidifier" || asset.Room != "basement" {
+		t.Errorf("Expected the user's name and room on the live asset, got %s in %q", asset.Name, asset.Room)
+	}
+
+	// A new address and firmware are kept as history, and the user's name survives announcements
+	dm.OnAssetUpdated(&AssetInfo{ID: "plug-1", Name: "Tapo P110", Type: AssetTypeSmartPlug, IPAddress: "192.168.1.31", Version: "1.1.0"})
+	if asset, _ := dm.GetAsset("plug-1"); asset.Name != "Dehumidifier" || asset.IPAddress != "192.168.1.31" {
+		t.Errorf("Expected the live data merged with the user's name, got %s at %s", asset.Name, asset.IPAddress)
+	}
+	if plug.Name != "Tapo P110" {
+		t.Error("Expected the announced asset left alone")
+	}
+	dm.OnAssetLost("plug-1")
+
+	// Remembered after a restart, offline
+	restarted, err := NewAssetRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := restarted.Get("plug-1")
+	if !ok || record.Online || record.Name != "Dehumidifier" || record.FirstSeen.IsZero() {
+		t.Fatalf("Expected the asset remembered offline with its name, got %+v", record)
+	}
+	if len(record.History) != 2 || record.History[0].Field != "ip_address" || record.History[0].From != "192.168.1.20" ||
+		record.History[1].Field != "version" || record.History[1].To != "1.1.0" {
+		t.Errorf("Expected the address and firmware changes, got %+v", record.History)
+	}
+	if merged := record.Merged(); merged.Status != "offline" || merged.Room != "basement" {
+		t.Errorf("Expected an offline asset in the basement, got %s in %s", merged.Status, merged.Room)
+	}
+
+	// Sightings that only move LastSeen wait for the next save
+	now := time.Now()
+	restarted.Observe(record.Asset, now)
+	restarted.Observe(record.Asset, now.Add(10*time.Second))
+	if saved, _ := NewAssetRegistry(path); !saved.records["plug-1"].LastSeen.Equal(now) {
+		t.Errorf("Expected the second sighting not saved yet, got %v", saved.records["plug-1"].LastSeen)
+	}
+	if err := restarted.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := NewAssetRegistry(path); !saved.records["plug-1"].LastSeen.Equal(now.Add(10 * time.Second)) {
+		t.Error("Expected the sighting saved on flush")
+	}
+
+	if err := restarted.SetName("unknown", "x"); err == nil {
+		t.Error("Expected an unknown asset rejected")
+	}
+}
@@ -0,0 +1,330 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Relay directions of an interface
+const (
+	RelayBoth     = "both" // Relays what is heard on the interface, and repeats the others' on it
+	RelayInbound  = "in"   // Only relays what is heard on the interface to the others
+	RelayOutbound = "out"  // Only repeats the other interfaces' messages on it
+)
+
+// DefaultRelayMaxHops is how many relays a message may cross, which also stops relays on the
+// same segments from relaying each other's copies back and forth
+const DefaultRelayMaxHops = 2
+
+// RelayInterface configures relaying on one network interface
+type RelayInterface struct {
+	Name      string   `json:"name"`                // e.g. eth0, or eth0.20 for a VLAN
+	Direction string   `json:"direction,omitempty"` // both (default), in or out
+	Types     []string `json:"types,omitempty"`     // Message types repeated on it, all by default
+}
+
+// RelayConfig configures a discovery relay
+type RelayConfig struct {
+	Interfaces []RelayInterface `json:"interfaces"`
+	MaxHops    int              `json:"max_hops,omitempty"`
+}
+
+// Validate checks there are interfaces to relay between and their directions
+func (c *RelayConfig) Validate() error {
+	if len(c.Interfaces) < 2 {
+		return fmt.Errorf("a relay needs at least two interfaces")
+	}
+	seen := make(map[string]bool)
+	for _, iface := range c.Interfaces {
+		if iface.Name == "" || seen[iface.Name] {
+			return fmt.Errorf("relay interfaces need distinct names")
+		}
+		seen[iface.Name] = true
+		switch iface.Direction {
+		case "", RelayBoth, RelayInbound, RelayOutbound:
+		default:
+			return fmt.Errorf("interface %s: unknown relay direction %q", iface.Name, iface.Direction)
+		}
+		for _, t := range iface.Types {
+			switch t {
+			case MessageTypeAnnounce, MessageTypeQuery, MessageTypeResponse, MessageTypeGoodbye:
+			default:
+				return fmt.Errorf("interface %s: unknown message type %q", iface.Name, t)
+			}
+		}
+	}
+	if c.MaxHops < 0 {
+		return fmt.Errorf("max_hops must not be negative")
+	}
+	return nil
+}
+
+// ParseRelayInterfaces parses interfaces given as a comma-separated list of name[:direction],
+// e.g. "eth0,eth0.20:in"
+func ParseRelayInterfaces(spec string) []RelayInterface {
+	var interfaces []RelayInterface
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, direction, _ := strings.Cut(part, ":")
+		interfaces = append(interfaces, RelayInterface{Name: name, Direction: direction})
+	}
+	return interfaces
+}
+
+// RelayStats counts the messages a relay forwarded
+type RelayStats struct {
+	Relayed map[string]int `json:"relayed"` // By message type
+	Dropped int            `json:"dropped"` // Past the hop limit
+}
+
+// relaySegment is the network segment behind one relay interface
+type relaySegment struct {
+	RelayInterface
+	iface    *net.Interface
+	networks []*net.IPNet
+}
+
+func (s *relaySegment) repeats(messageType string) bool {
+	if s.Direction == RelayInbound {
+		return false
+	}
+	if len(s.Types) == 0 {
+		return true
+	}
+	for _, t := range s.Types {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// Relay forwards discovery messages between network segments, as multicast doesn't cross VLANs
+// or subnets. It runs on a gateway with an interface on each segment, and repeats the multicast
+// heard on one interface on the others. Unicast queries sent to the relay are repeated on every
+// interface, so hosts that can't receive the multicast at all can still query. Unicast queries
+// name the querier in ReplyTo, so that assets answer it directly across the router.
+type Relay struct {
+	group    *net.UDPAddr
+	maxHops  int
+	segments []*relaySegment
+	local    map[string]bool // Our own addresses, whose messages aren't relayed again
+	conn     *net.UDPConn
+	packets  *ipv4.PacketConn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	statsMu  sync.Mutex
+	stats    RelayStats
+}
+
+// NewRelay creates a relay between the configured interfaces
+func NewRelay(config RelayConfig) (*Relay, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	group, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", DefaultMulticastAddress, DefaultMulticastPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve multicast address: %w", err)
+	}
+
+	relay := newRelay(config)
+	relay.group = group
+	for _, ri := range config.Interfaces {
+		iface, err := net.InterfaceByName(ri.Name)
+		if err != nil {
+			return nil, fmt.Errorf("relay interface %s: %w", ri.Name, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("relay interface %s: %w", ri.Name, err)
+		}
+		var networks []*net.IPNet
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+				networks = append(networks, network)
+				relay.local[network.IP.String()] = true
+			}
+		}
+		relay.segments = append(relay.segments, &relaySegment{RelayInterface: ri, iface: iface, networks: networks})
+	}
+	return relay, nil
+}
+
+func newRelay(config RelayConfig) *Relay {
+	maxHops := config.MaxHops
+	if maxHops == 0 {
+		maxHops = DefaultRelayMaxHops
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		maxHops: maxHops,
+		local:   make(map[string]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+		stats:   RelayStats{Relayed: make(map[string]int)},
+	}
+}
+
+// Start joins the discovery group on every interface and begins relaying
+func (r *Relay) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", r.segments[0].iface, r.group)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", r.segments[0].Name, err)
+	}
+	packets := ipv4.NewPacketConn(conn)
+	for _, segment := range r.segments[1:] {
+		if err := packets.JoinGroup(segment.iface, r.group); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to join the discovery group on %s: %w", segment.Name, err)
+		}
+	}
+	// The arrival interface tells the segments apart, and the destination unicast from multicast
+	if err := packets.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to enable packet information: %w", err)
+	}
+
+	r.conn, r.packets = conn, packets
+	go r.messageListener()
+	return nil
+}
+
+// Stop stops relaying
+func (r *Relay) Stop() error {
+	r.cancel()
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// Stats returns how many messages the relay forwarded
+func (r *Relay) Stats() RelayStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+
+	stats := RelayStats{Relayed: make(map[string]int), Dropped: r.stats.Dropped}
+	for t, count := range r.stats.Relayed {
+		stats.Relayed[t] = count
+	}
+	return stats
+}
+
+// messageListener relays the messages heard on any interface
+func (r *Relay) messageListener() {
+	buffer := make([]byte, MaxMessageSize)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		default:
+			r.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, cm, src, err := r.packets.ReadFrom(buffer)
+			if err != nil {
+				continue // Timeout is expected, keep listening after other errors
+			}
+
+			var ifIndex int
+			var unicast bool
+			if cm != nil {
+				ifIndex = cm.IfIndex
+				unicast = cm.Dst != nil && !cm.Dst.IsMulticast()
+			}
+			sender, _ := src.(*net.UDPAddr)
+			data, outs := r.route(buffer[:n], ifIndex, unicast, sender)
+			for _, out := range outs {
+				if err := r.packets.SetMulticastInterface(out); err != nil {
+					continue
+				}
+				r.packets.WriteTo(data, nil, r.group)
+			}
+		}
+	}
+}
+
+// route works out where to repeat a message heard on the interface with ifIndex: the message
+// to send, one hop further, and the interfaces to multicast it on
+func (r *Relay) route(data []byte, ifIndex int, unicast bool, sender *net.UDPAddr) ([]byte, []*net.Interface) {
+	if sender == nil || r.local[sender.IP.String()] {
+		return nil, nil
+	}
+	ingress := r.segment(ifIndex, sender.IP)
+	if ingress == nil || (!unicast && ingress.Direction == RelayOutbound) {
+		return nil, nil
+	}
+
+	var message DiscoveryMessage
+	if err := json.Unmarshal(data, &message); err != nil || message.Type == "" {
+		return nil, nil
+	}
+	// Only queries are sent to the relay itself; responses go to the querier
+	if unicast && message.Type != MessageTypeQuery {
+		return nil, nil
+	}
+	if message.Hops >= r.maxHops {
+		r.statsMu.Lock()
+		r.stats.Dropped++
+		r.statsMu.Unlock()
+		return nil, nil
+	}
+	message.Hops++
+	if unicast {
+		message.Unicast = true
+	}
+	if message.Unicast && message.ReplyTo == "" {
+		message.ReplyTo = sender.String()
+	}
+
+	var outs []*net.Interface
+	for _, segment := range r.segments {
+		// A unicast query didn't come over the segment's multicast, so it's repeated there too
+		if (segment == ingress && !unicast) || !segment.repeats(message.Type) {
+			continue
+		}
+		outs = append(outs, segment.iface)
+	}
+	if len(outs) == 0 {
+		return nil, nil
+	}
+	relayed, err := encodeMessage(&message)
+	if err != nil {
+		return nil, nil
+	}
+
+	r.statsMu.Lock()
+	r.stats.Relayed[message.Type]++
+	r.statsMu.Unlock()
+	return relayed, outs
+}
+
+// segment finds the segment a message came from, by its arrival interface or else, without
+// packet information, the sender's network
+func (r *Relay) segment(ifIndex int, ip net.IP) *relaySegment {
+	if ifIndex != 0 {
+		for _, segment := range r.segments {
+			if segment.iface.Index == ifIndex {
+				return segment
+			}
+		}
+		return nil
+	}
+	for _, segment := range r.segments {
+		for _, network := range segment.networks {
+			if network.Contains(ip) {
+				return segment
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func discoveryMessage(t *testing.T, message DiscoveryMessage) []byte {
+	t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUnicastQueryResponse(t *testing.T) {
+	sensor := &AssetInfo{ID: "pico-kitchen", Type: AssetTypeSensor, Room: "kitchen"}
+	protocol := &DiscoveryProtocol{localAsset: sensor, knownAssets: make(map[string]*AssetInfo)}
+	sender := &net.UDPAddr{IP: net.ParseIP("192.168.20.1"), Port: DefaultMulticastPort}
+
+	// A multicast query is answered over multicast
+	query := DiscoveryMessage{Type: MessageTypeQuery, Query: &Query{Room: "kitchen"}, Sender: "cli"}
+	response, to := protocol.handleMessage(discoveryMessage(t, query), sender)
+	if response == nil || response.Asset.ID != "pico-kitchen" || to != nil {
+		t.Fatalf("Expected a multicast response, got %+v to %v", response, to)
+	}
+
+	// A unicast query is answered directly, at the querier a relay names
+	query.Unicast = true
+	if _, to := protocol.handleMessage(discoveryMessage(t, query), sender); to == nil || to.String() != sender.String() {
+		t.Errorf("Expected the response sent to the sender, got %v", to)
+	}
+	query.ReplyTo = "192.168.1.10:42424"
+	if _, to := protocol.handleMessage(discoveryMessage(t, query), sender); to == nil || to.String() != query.ReplyTo {
+		t.Errorf("Expected the response sent to the querier, got %v", to)
+	}
+	query.ReplyTo = "8.8.8.8:53"
+	if _, to := protocol.handleMessage(discoveryMessage(t, query), sender); to == nil || to.String() != sender.String() {
+		t.Errorf("Expected no response aimed off the local network, got %v", to)
+	}
+
+	// Queries that don't match aren't answered, and responses are taken in
+	query.Query.Room = "garage"
+	if response, _ := protocol.handleMessage(discoveryMessage(t, query), sender); response != nil {
+		t.Error("Expected no response for another room")
+	}
+	plug := DiscoveryMessage{Type: MessageTypeResponse, Asset: &AssetInfo{ID: "tapo-1", Type: AssetTypeSmartPlug}, Sender: "tapo-1"}
+	protocol.handleMessage(discoveryMessage(t, plug), sender)
+	if _, ok := protocol.GetKnownAssets()["tapo-1"]; !ok {
+		t.Error("Expected the unicast response's asset known")
+	}
+
+	if addr, err := ResolvePeer("192.168.20.5"); err != nil || addr.Port != DefaultMulticastPort {
+		t.Errorf("Expected the discovery port by default, got %v, %v", addr, err)
+	}
+}
+
+func TestRelayRoutes(t *testing.T) {
+	_, lanNet, _ := net.ParseCIDR("192.168.1.0/24")
+	_, iotNet, _ := net.ParseCIDR("192.168.20.0/24")
+	_, guestNet, _ := net.ParseCIDR("192.168.30.0/24")
+	lan := &net.Interface{Index: 2, Name: "eth0"}
+	iot := &net.Interface{Index: 3, Name: "eth0.20"}
+	guest := &net.Interface{Index: 4, Name: "eth0.30"}
+
+	relay := newRelay(RelayConfig{})
+	relay.local["192.168.1.1"] = true
+	relay.segments = []*relaySegment{
+		{RelayInterface: RelayInterface{Name: "eth0"}, iface: lan, networks: []*net.IPNet{lanNet}},
+		{RelayInterface: RelayInterface{Name: "eth0.20"}, iface: iot, networks: []*net.IPNet{iotNet}},
+		{RelayInterface: RelayInterface{Name: "eth0.30", Direction: RelayOutbound, Types: []string{MessageTypeAnnounce}},
+			iface: guest, networks: []*net.IPNet{guestNet}},
+	}
+	laptop := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: DefaultMulticastPort}
+	sensor := &net.UDPAddr{IP: net.ParseIP("192.168.20.7"), Port: DefaultMulticastPort}
+
+	// A query on the LAN goes to the IoT VLAN, not the guest network that only gets announcements
+	query := discoveryMessage(t, DiscoveryMessage{Type: MessageTypeQuery, Query: &Query{}, Sender: "laptop", Timestamp: time.Now()})
+	data, outs := relay.route(query, lan.Index, false, laptop)
+	if len(outs) != 1 || outs[0] != iot {
+		t.Fatalf("Expected the query relayed to the IoT VLAN, got %v", outs)
+	}
+	var relayed DiscoveryMessage
+	json.Unmarshal(data, &relayed)
+	if relayed.Hops != 1 || relayed.Unicast || relayed.ReplyTo != "" {
+		t.Errorf("Expected one hop on a multicast query, got %+v", relayed)
+	}
+
+	// The sensor's announcement reaches both; the copies echoed back from the relay don't
+	announce := discoveryMessage(t, DiscoveryMessage{Type: MessageTypeAnnounce, Asset: &AssetInfo{ID: "pico"}, Sender: "pico"})
+	if _, outs := relay.route(announce, iot.Index, false, sensor); len(outs) != 2 || outs[0] != lan || outs[1] != guest {
+		t.Errorf("Expected the announcement relayed to the LAN and guests, got %v", outs)
+	}
+	if _, outs := relay.route(announce, lan.Index, false, &net.UDPAddr{IP: net.ParseIP("192.168.1.1")}); outs != nil {
+		t.Error("Expected the relay's own messages ignored")
+	}
+
+	// Nothing heard on the outbound-only guest network is relayed
+	if _, outs := relay.route(query, guest.Index, false, &net.UDPAddr{IP: net.ParseIP("192.168.30.9")}); outs != nil {
+		t.Error("Expected the guest network's query dropped")
+	}
+
+	// A unicast query to the relay is repeated on its own segment too, naming the querier
+	data, outs = relay.route(query, lan.Index, true, laptop)
+	relayed = DiscoveryMessage{}
+	json.Unmarshal(data, &relayed)
+	if len(outs) != 2 || outs[0] != lan || !relayed.Unicast || relayed.ReplyTo != "192.168.1.10:42424" {
+		t.Errorf("Expected the unicast query relayed with the querier to reply to, got %v and %+v", outs, relayed)
+	}
+
+	// Without packet information the sender's network tells the segment
+	if _, outs := relay.route(announce, 0, false, sensor); len(outs) != 2 {
+		t.Errorf("Expected the announcement placed on the IoT VLAN by address, got %v", outs)
+	}
+
+	// Messages past the hop limit stop
+	tired := discoveryMessage(t, DiscoveryMessage{Type: MessageTypeAnnounce, Asset: &AssetInfo{ID: "pico"}, Hops: DefaultRelayMaxHops})
+	if _, outs := relay.route(tired, iot.Index, false, sensor); outs != nil {
+		t.Error("Expected the message past the hop limit dropped")
+	}
+	if stats := relay.Stats(); stats.Dropped != 1 || stats.Relayed[MessageTypeQuery] != 2 || stats.Relayed[MessageTypeAnnounce] != 2 {
+		t.Errorf("Expected the relayed messages counted, got %+v", stats)
+	}
+
+	if err := (&RelayConfig{Interfaces: ParseRelayInterfaces("eth0,eth0.20:sideways")}).Validate(); err == nil {
+		t.Error("Expected an unknown direction rejected")
+	}
+	if err := (&RelayConfig{Interfaces: ParseRelayInterfaces("eth0")}).Validate(); err == nil {
+		t.Error("Expected a single interface rejected")
+	}
+}
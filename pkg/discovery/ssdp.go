@@ -0,0 +1,519 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSDP/UPnP constants
+const (
+	SSDPAddress = "239.255.255.250"
+	SSDPPort    = 1900
+
+	// SSDPMetadataDeviceType holds the UPnP device type of assets found over SSDP, whose
+	// MDNSMetadataSource metadata is "ssdp"
+	SSDPMetadataDeviceType = "upnp_device_type"
+
+	ssdpSearchTarget    = "upnp:rootdevice"
+	ssdpSearchWait      = 2       // MX: seconds devices may wait before answering a search
+	ssdpDefaultMaxAge   = 1800    // Seconds an advertisement lasts without CACHE-CONTROL
+	ssdpMaxDescription  = 1 << 16 // Bytes read of a device description
+	ssdpDescribeTimeout = 5 * time.Second
+	ssdpAliveNTS        = "ssdp:alive"
+	ssdpByeByeNTS       = "ssdp:byebye"
+	ssdpUpdateNTS       = "ssdp:update"
+)
+
+// SSDPService listens for the SSDP advertisements of UPnP devices, such as TVs, media players
+// and routers, and searches for them, so third-party devices show up as assets next to our own
+// agents. Each device's description is fetched once to name it and map its UPnP device type to
+// an asset type and capabilities. Discovered assets are reported to the same listeners as the
+// custom protocol. The service only listens; it advertises nothing.
+type SSDPService struct {
+	conn      *net.UDPConn // Multicast group, for NOTIFY
+	search    *net.UDPConn // Unicast, for M-SEARCH and its responses
+	group     *net.UDPAddr
+	devices   map[string]*ssdpDevice // By UUID
+	pending   map[string]bool        // UUIDs whose description is being fetched
+	fetch     func(ctx context.Context, location string) (*ssdpDescription, error)
+	listeners []AssetDiscoveryListener
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+}
+
+// ssdpDevice is a device found over SSDP and the description location it was built from
+type ssdpDevice struct {
+	location string
+	asset    *AssetInfo
+}
+
+// ssdpAdvert is a NOTIFY or a search response
+type ssdpAdvert struct {
+	uuid     string
+	usn      string
+	location string
+	server   string
+	maxAge   int
+	byebye   bool
+}
+
+// ssdpDescription is the part of a UPnP device description the asset is built from
+type ssdpDescription struct {
+	Device ssdpDescribedDevice `xml:"device"`
+}
+
+type ssdpDescribedDevice struct {
+	DeviceType      string                `xml:"deviceType"`
+	FriendlyName    string                `xml:"friendlyName"`
+	Manufacturer    string                `xml:"manufacturer"`
+	ModelName       string                `xml:"modelName"`
+	ModelNumber     string                `xml:"modelNumber"`
+	SerialNumber    string                `xml:"serialNumber"`
+	UDN             string                `xml:"UDN"`
+	PresentationURL string                `xml:"presentationURL"`
+	Services        []string              `xml:"serviceList>service>serviceType"`
+	Devices         []ssdpDescribedDevice `xml:"deviceList>device"`
+}
+
+// NewSSDPService creates an SSDP listener; the sockets are opened by Start
+func NewSSDPService() *SSDPService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SSDPService{
+		group:     &net.UDPAddr{IP: net.ParseIP(SSDPAddress), Port: SSDPPort},
+		devices:   make(map[string]*ssdpDevice),
+		pending:   make(map[string]bool),
+		fetch:     fetchSSDPDescription,
+		listeners: make([]AssetDiscoveryListener, 0),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// AddListener adds a discovery event listener
+func (s *SSDPService) AddListener(listener AssetDiscoveryListener) {
+	s.listeners = append(s.listeners, listener)
+}
+
+// Start joins the SSDP group and searches for root devices
+func (s *SSDPService) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, s.group)
+	if err != nil {
+		return fmt.Errorf("failed to listen on SSDP address: %w", err)
+	}
+	search, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open SSDP search socket: %w", err)
+	}
+	s.conn, s.search = conn, search
+
+	go s.messageListener(s.conn)
+	go s.messageListener(s.search)
+	go s.periodicSearch()
+	go s.assetCleanup()
+
+	return s.Search()
+}
+
+// Stop leaves the SSDP group
+func (s *SSDPService) Stop() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	s.cancel()
+	s.search.Close()
+	return s.conn.Close()
+}
+
+// Search asks every root device to answer
+func (s *SSDPService) Search() error {
+	if s.search == nil {
+		return fmt.Errorf("SSDP service not started")
+	}
+
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		fmt.Sprintf("HOST: %s:%d\r\n", SSDPAddress, SSDPPort) +
+		"MAN: \"ssdp:discover\"\r\n" +
+		fmt.Sprintf("MX: %d\r\n", ssdpSearchWait) +
+		"ST: " + ssdpSearchTarget + "\r\n\r\n"
+	if _, err := s.search.WriteToUDP([]byte(request), s.group); err != nil {
+		return fmt.Errorf("failed to send SSDP search: %w", err)
+	}
+	return nil
+}
+
+// GetKnownAssets returns the assets currently found over SSDP
+func (s *SSDPService) GetKnownAssets() map[string]*AssetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]*AssetInfo)
+	for _, device := range s.devices {
+		result[device.asset.ID] = device.asset
+	}
+	return result
+}
+
+// messageListener handles the advertisements arriving on conn, fetching new devices'
+// descriptions in the background
+func (s *SSDPService) messageListener(conn *net.UDPConn) {
+	buffer := make([]byte, MaxMessageSize)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				continue // Timeouts are expected, keep listening on other errors
+			}
+
+			if advert := s.handleMessage(buffer[:n], addr, time.Now()); advert != nil {
+				go s.describe(advert, time.Now())
+			}
+		}
+	}
+}
+
+// handleMessage processes a packet. Refreshes and byebyes of known devices are handled at once;
+// an advertisement that needs the device's description is returned for describe.
+func (s *SSDPService) handleMessage(data []byte, sender *net.UDPAddr, now time.Time) *ssdpAdvert {
+	advert, ok := parseSSDP(data)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	device, known := s.devices[advert.uuid]
+	switch {
+	case advert.byebye:
+		if !known {
+			s.mu.Unlock()
+			return nil
+		}
+		delete(s.devices, advert.uuid)
+		s.mu.Unlock()
+		for _, listener := range s.listeners {
+			listener.OnAssetLost(device.asset.ID)
+		}
+		return nil
+	case known && device.location == advert.location:
+		device.asset.LastSeen = now
+		device.asset.TTL = advert.maxAge
+		s.mu.Unlock()
+		return nil
+	case s.pending[advert.uuid] || !ssdpFromSender(advert.location, sender):
+		// Descriptions are only fetched from the address that advertised them
+		s.mu.Unlock()
+		return nil
+	}
+	s.pending[advert.uuid] = true
+	s.mu.Unlock()
+	return advert
+}
+
+// describe fetches a device's description and reports its asset. A failed fetch is retried
+// on the device's next advertisement.
+func (s *SSDPService) describe(advert *ssdpAdvert, now time.Time) {
+	ctx, cancel := context.WithTimeout(s.ctx, ssdpDescribeTimeout)
+	description, err := s.fetch(ctx, advert.location)
+	cancel()
+
+	s.mu.Lock()
+	delete(s.pending, advert.uuid)
+	if err != nil {
+		s.mu.Unlock()
+		return
+	}
+	asset := ssdpAsset(advert, description, now)
+	_, known := s.devices[advert.uuid]
+	s.devices[advert.uuid] = &ssdpDevice{location: advert.location, asset: asset}
+	s.mu.Unlock()
+
+	for _, listener := range s.listeners {
+		if known {
+			listener.OnAssetUpdated(asset)
+		} else {
+			listener.OnAssetDiscovered(asset)
+		}
+	}
+}
+
+// periodicSearch searches again every TTL, catching devices whose announcements were missed
+func (s *SSDPService) periodicSearch() {
+	ticker := time.NewTicker(DefaultTTL * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.Search()
+		}
+	}
+}
+
+// assetCleanup removes the devices whose advertisements expired
+func (s *SSDPService) assetCleanup() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range s.expire(now) {
+				for _, listener := range s.listeners {
+					listener.OnAssetLost(id)
+				}
+			}
+		}
+	}
+}
+
+// expire forgets the devices not advertised within their max-age and returns their asset IDs
+func (s *SSDPService) expire(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lost []string
+	for uuid, device := range s.devices {
+		if now.Sub(device.asset.LastSeen) > time.Duration(device.asset.TTL)*time.Second {
+			delete(s.devices, uuid)
+			lost = append(lost, device.asset.ID)
+		}
+	}
+	return lost
+}
+
+// parseSSDP reads a NOTIFY or a search response; searches from other control points and
+// advertisements without a UUID or location are ignored
+func parseSSDP(data []byte) (*ssdpAdvert, bool) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var header http.Header
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil || response.StatusCode != http.StatusOK {
+			return nil, false
+		}
+		header = response.Header
+	} else {
+		request, err := http.ReadRequest(reader)
+		if err != nil || request.Method != "NOTIFY" {
+			return nil, false
+		}
+		header = request.Header
+	}
+
+	advert := &ssdpAdvert{
+		usn:      header.Get("USN"),
+		location: header.Get("LOCATION"),
+		server:   header.Get("SERVER"),
+		maxAge:   ssdpDefaultMaxAge,
+	}
+	switch header.Get("NTS") {
+	case ssdpByeByeNTS:
+		advert.byebye = true
+	case "", ssdpAliveNTS, ssdpUpdateNTS:
+	default:
+		return nil, false
+	}
+
+	uuid, _, _ := strings.Cut(advert.usn, "::")
+	if !strings.HasPrefix(strings.ToLower(uuid), "uuid:") || len(uuid) == len("uuid:") {
+		return nil, false
+	}
+	advert.uuid = strings.ToLower(uuid[len("uuid:"):])
+	if advert.location == "" && !advert.byebye {
+		return nil, false
+	}
+
+	for _, directive := range strings.Split(header.Get("CACHE-CONTROL"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if maxAge, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && maxAge > 0 {
+				advert.maxAge = maxAge
+			}
+		}
+	}
+	return advert, true
+}
+
+// ssdpFromSender reports whether a description location is an HTTP URL on the sender's address
+func ssdpFromSender(location string, sender *net.UDPAddr) bool {
+	parsed, err := url.Parse(location)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+	if sender == nil {
+		return true
+	}
+	ip := net.ParseIP(parsed.Hostname())
+	return ip != nil && ip.Equal(sender.IP)
+}
+
+// fetchSSDPDescription downloads and parses a device description
+func fetchSSDPDescription(ctx context.Context, location string) (*ssdpDescription, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid description location: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device description: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch device description: %s", response.Status)
+	}
+
+	var description ssdpDescription
+	if err := xml.NewDecoder(io.LimitReader(response.Body, ssdpMaxDescription)).Decode(&description); err != nil {
+		return nil, fmt.Errorf("failed to parse device description: %w", err)
+	}
+	return &description, nil
+}
+
+// ssdpAsset builds the asset of a described device, reached at its description's address
+func ssdpAsset(advert *ssdpAdvert, description *ssdpDescription, now time.Time) *AssetInfo {
+	device := description.Device
+	location, _ := url.Parse(advert.location)
+	assetType, capabilities := ssdpClassify(device)
+
+	asset := &AssetInfo{
+		ID:           "upnp-" + advert.uuid,
+		Name:         device.FriendlyName,
+		Type:         assetType,
+		Model:        strings.TrimSpace(device.ModelName + " " + device.ModelNumber),
+		Manufacturer: device.Manufacturer,
+		IPAddress:    location.Hostname(),
+		Ports:        []int{},
+		Capabilities: capabilities,
+		Services:     []ServiceInfo{},
+		Tags:         []string{},
+		Metadata: map[string]string{
+			MDNSMetadataSource:     "ssdp",
+			SSDPMetadataDeviceType: device.DeviceType,
+			"usn":                  advert.usn,
+			"location":             advert.location,
+		},
+		Status:           "online",
+		LastSeen:         now,
+		DiscoveryVersion: DiscoveryVersion,
+		TTL:              advert.maxAge,
+	}
+	if asset.Name == "" {
+		asset.Name = asset.ID
+	}
+	if advert.server != "" {
+		asset.Metadata["server"] = advert.server
+	}
+	if device.SerialNumber != "" {
+		asset.Metadata["serial_number"] = device.SerialNumber
+	}
+
+	port, _ := strconv.Atoi(location.Port())
+	if port == 0 && location.Scheme == "http" {
+		port = 80
+	}
+	if port > 0 {
+		asset.Ports = []int{port}
+		asset.Services = append(asset.Services, ServiceInfo{
+			Name:        "upnp",
+			Protocol:    "http",
+			Port:        port,
+			Path:        location.Path,
+			Description: "UPnP device description",
+		})
+	}
+	if presentation, err := location.Parse(device.PresentationURL); err == nil && device.PresentationURL != "" {
+		presentationPort, _ := strconv.Atoi(presentation.Port())
+		if presentationPort == 0 && presentation.Scheme == "http" {
+			presentationPort = 80
+		}
+		if presentationPort > 0 && presentation.Hostname() == asset.IPAddress {
+			asset.Services = append(asset.Services, ServiceInfo{
+				Name:        "presentation",
+				Protocol:    "http",
+				Port:        presentationPort,
+				Path:        presentation.Path,
+				Description: "Device web interface",
+			})
+		}
+	}
+	return asset
+}
+
+// ssdpClassify maps the UPnP device types and services of a device, and of the devices
+// embedded in it, to an asset type and capabilities
+func ssdpClassify(device ssdpDescribedDevice) (AssetType, []AssetCapability) {
+	var types, services []string
+	var collect func(d ssdpDescribedDevice)
+	collect = func(d ssdpDescribedDevice) {
+		types = append(types, strings.ToLower(d.DeviceType))
+		for _, service := range d.Services {
+			services = append(services, strings.ToLower(service))
+		}
+		for _, embedded := range d.Devices {
+			collect(embedded)
+		}
+	}
+	collect(device)
+
+	has := func(values []string, parts ...string) bool {
+		for _, value := range values {
+			for _, part := range parts {
+				if strings.Contains(value, part) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	named := strings.ToLower(device.FriendlyName + " " + device.ModelName)
+	renderer := has(types, ":mediarenderer:")
+	streamer := has(types, ":dial:", "roku-com:device:player")
+	player := renderer || streamer
+
+	capabilities := []AssetCapability{CapabilityUPnP}
+	assetType := AssetTypeNetworkDevice
+	switch {
+	case has(types, ":tvdevice:", ":remotecontrolreceiver:") || (player && has(strings.Fields(named), "tv")):
+		assetType = AssetTypeTelevision
+		capabilities = append(capabilities, CapabilityVideo, CapabilityAudio)
+	case has(types, ":internetgatewaydevice:", ":wandevice:", ":wanconnectiondevice:"):
+		assetType = AssetTypeRouter
+	case has(types, ":mediaserver:"):
+		assetType = AssetTypeMediaServer
+		capabilities = append(capabilities, CapabilityVideo, CapabilityAudio)
+	case player:
+		assetType = AssetTypeMediaPlayer
+		if streamer {
+			capabilities = append(capabilities, CapabilityVideo)
+		}
+		if !renderer || has(services, ":renderingcontrol:") {
+			capabilities = append(capabilities, CapabilityAudio)
+		}
+	}
+	if device.PresentationURL != "" {
+		capabilities = append(capabilities, CapabilityHTTP)
+	}
+	return assetType, capabilities
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const tvDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+    <friendlyName>[TV] Living Room</friendlyName>
+    <manufacturer>Samsung Electronics</manufacturer>
+    <modelName>UE55TU7100</modelName>
+    <serialNumber>0A1B2C</serialNumber>
+    <UDN>uuid:0b6e7f2c-1d7a-4a6b-9d3c-1234567890ab</UDN>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType></service>
+      <service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType></service>
+    </serviceList>
+    <presentationURL>/index.html</presentationURL>
+  </device>
+</root>`
+
+func ssdpNotify(location, nts string) []byte {
+	return []byte("NOTIFY * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"CACHE-CONTROL: max-age=600\r\n" +
+		"LOCATION: " + location + "\r\n" +
+		"NT: urn:schemas-upnp-org:service:AVTransport:1\r\n" +
+		"NTS: " + nts + "\r\n" +
+		"SERVER: Linux/4.1 UPnP/1.0 Samsung/1.0\r\n" +
+		"USN: uuid:0B6E7F2C-1D7A-4A6B-9D3C-1234567890AB::urn:schemas-upnp-org:service:AVTransport:1\r\n\r\n")
+}
+
+func TestSSDPImportsUPnPDevice(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprint(w, tvDescription)
+	}))
+	defer server.Close()
+	location := server.URL + "/dmr.xml"
+	sender := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: SSDPPort}
+
+	service := NewSSDPService()
+	listener := &recordingListener{}
+	service.AddListener(listener)
+
+	// Descriptions are only fetched from the advertising address
+	if service.handleMessage(ssdpNotify(location, "ssdp:alive"), &net.UDPAddr{IP: net.ParseIP("192.168.1.66"), Port: SSDPPort}, time.Now()) != nil {
+		t.Fatal("Expected a description on another host ignored")
+	}
+
+	now := time.Now()
+	advert := service.handleMessage(ssdpNotify(location, "ssdp:alive"), sender, now)
+	if advert == nil {
+		t.Fatal("Expected the TV's description fetched")
+	}
+	if service.handleMessage(ssdpNotify(location, "ssdp:alive"), sender, now) != nil {
+		t.Error("Expected no second fetch while one is pending")
+	}
+	service.describe(advert, now)
+	if len(listener.discovered) != 1 {
+		t.Fatalf("Expected the TV discovered, got %+v", listener)
+	}
+	tv := listener.discovered[0]
+	if tv.ID != "upnp-0b6e7f2c-1d7a-4a6b-9d3c-1234567890ab" || tv.Type != AssetTypeTelevision || tv.Name != "[TV] Living Room" ||
+		tv.Manufacturer != "Samsung Electronics" || tv.IPAddress != "127.0.0.1" || tv.TTL != 600 || len(tv.Services) != 2 {
+		t.Errorf("Expected the TV's identity from its description, got %+v", tv)
+	}
+	if tv.Metadata[MDNSMetadataSource] != "ssdp" || tv.Metadata[SSDPMetadataDeviceType] != "urn:schemas-upnp-org:device:MediaRenderer:1" ||
+		len(tv.Capabilities) != 4 || tv.Capabilities[1] != CapabilityVideo {
+		t.Errorf("Expected the UPnP metadata and the TV's capabilities, got %+v and %v", tv.Metadata, tv.Capabilities)
+	}
+	if err := ValidateAssetInfo(tv); err != nil {
+		t.Errorf("Expected a valid asset, got %v", err)
+	}
+
+	// The device's other advertisements and search responses only refresh it
+	response := []byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=900\r\nEXT:\r\nLOCATION: " + location + "\r\n" +
+		"ST: upnp:rootdevice\r\nUSN: uuid:0b6e7f2c-1d7a-4a6b-9d3c-1234567890ab::upnp:rootdevice\r\n\r\n")
+	later := now.Add(10 * time.Minute)
+	if service.handleMessage(response, sender, later) != nil || fetches != 1 || len(listener.updated) != 0 {
+		t.Errorf("Expected the search response to refresh the TV, got %d fetches", fetches)
+	}
+	if lost := service.expire(later.Add(14 * time.Minute)); len(lost) != 0 {
+		t.Errorf("Expected the TV kept within the response's max-age, got %v", lost)
+	}
+
+	// Leaving the network loses it
+	service.handleMessage(ssdpNotify(location, "ssdp:byebye"), sender, later)
+	if len(listener.lost) != 1 || listener.lost[0] != tv.ID || len(service.GetKnownAssets()) != 0 {
+		t.Errorf("Expected the TV lost after its byebye, got %+v", listener)
+	}
+
+	// Searches from other control points are no advertisements
+	search := []byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: ssdp:all\r\n\r\n")
+	if service.handleMessage(search, sender, later) != nil {
+		t.Error("Expected a search ignored")
+	}
+}
+
+func TestSSDPClassify(t *testing.T) {
+	cases := []struct {
+		device ssdpDescribedDevice
+		want   AssetType
+	}{
+		{ssdpDescribedDevice{DeviceType: "urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+			Devices: []ssdpDescribedDevice{{DeviceType: "urn:schemas-upnp-org:device:WANDevice:1"}}}, AssetTypeRouter},
+		{ssdpDescribedDevice{DeviceType: "urn:schemas-upnp-org:device:MediaServer:1", FriendlyName: "NAS"}, AssetTypeMediaServer},
+		{ssdpDescribedDevice{DeviceType: "urn:schemas-upnp-org:device:ZonePlayer:1", FriendlyName: "Kitchen",
+			Devices: []ssdpDescribedDevice{{DeviceType: "urn:schemas-upnp-org:device:MediaRenderer:1",
+				Services: []string{"urn:schemas-upnp-org:service:RenderingControl:1"}}}}, AssetTypeMediaPlayer},
+		{ssdpDescribedDevice{DeviceType: "urn:roku-com:device:player:1-0", FriendlyName: "Roku Express"}, AssetTypeMediaPlayer},
+		{ssdpDescribedDevice{DeviceType: "urn:schemas-upnp-org:device:Basic:1", FriendlyName: "Hue Bridge"}, AssetTypeNetworkDevice},
+	}
+	for _, c := range cases {
+		if got, capabilities := ssdpClassify(c.device); got != c.want || capabilities[0] != CapabilityUPnP {
+			t.Errorf("%s: expected %s, got %s with %v", c.device.DeviceType, c.want, got, capabilities)
+		}
+	}
+}
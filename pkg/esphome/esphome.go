@@ -0,0 +1,161 @@
+// Package esphome speaks the MQTT conventions of ESPHome firmware: each entity publishes its
+// state on <prefix>/<component>/<object_id>/state and takes commands on
+// <prefix>/<component>/<object_id>/command, where the prefix defaults to the node name.
+package esphome
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Components of the entities the adapter understands
+const (
+	ComponentSensor       = "sensor"
+	ComponentBinarySensor = "binary_sensor"
+	ComponentSwitch       = "switch"
+	ComponentLight        = "light"
+)
+
+// StateTopic returns the state topic of an entity
+func StateTopic(prefix, component, objectID string) string {
+	return prefix + "/" + component + "/" + objectID + "/state"
+}
+
+// CommandTopic returns the command topic of an entity
+func CommandTopic(prefix, component, objectID string) string {
+	return prefix + "/" + component + "/" + objectID + "/command"
+}
+
+// StatusTopic returns the availability topic of a node, online or offline
+func StatusTopic(prefix string) string {
+	return prefix + "/status"
+}
+
+// ParseStateTopic splits a state topic of the node with prefix into its component and object ID
+func ParseStateTopic(prefix, topic string) (component, objectID string, ok bool) {
+	rest, found := strings.CutPrefix(topic, prefix+"/")
+	if !found {
+		return "", "", false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 || parts[2] != "state" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ParseNumber parses the state of a sensor entity
+func ParseNumber(payload []byte) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sensor state %q: %w", payload, err)
+	}
+	return value, nil
+}
+
+// ParseBinary parses the ON or OFF state of a switch or binary sensor
+func ParseBinary(payload []byte) (bool, error) {
+	switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+	case "ON":
+		return true, nil
+	case "OFF":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid binary state %q", payload)
+}
+
+// LightState is the JSON state of a light entity
+type LightState struct {
+	State      string  `json:"state"`
+	Brightness *int    `json:"brightness,omitempty"` // 0-255
+	ColorTemp  *int    `json:"color_temp,omitempty"` // mireds
+	Color      *RGB    `json:"color,omitempty"`
+	Transition float64 `json:"transition,omitempty"` // seconds
+}
+
+// RGB is a light color with channels from 0 to 255
+type RGB struct {
+	R int `json:"r"`
+	G int `json:"g"`
+	B int `json:"b"`
+}
+
+// ParseLight parses the state of a light entity
+func ParseLight(payload []byte) (LightState, error) {
+	var state LightState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return state, fmt.Errorf("invalid light state: %w", err)
+	}
+	return state, nil
+}
+
+// SwitchCommand returns the payload that switches a switch entity
+func SwitchCommand(on bool) []byte {
+	if on {
+		return []byte("ON")
+	}
+	return []byte("OFF")
+}
+
+// PowerCommand returns the light command payload that switches a light
+func PowerCommand(on bool) []byte {
+	return lightCommand(LightState{State: string(SwitchCommand(on))})
+}
+
+// BrightnessCommand returns the light command payload that switches a light on at a brightness in percent
+func BrightnessCommand(percent int) []byte {
+	brightness := int(math.Round(float64(clamp(percent, 0, 100)) * 255 / 100))
+	return lightCommand(LightState{State: "ON", Brightness: &brightness})
+}
+
+// ColorTempCommand returns the light command payload that sets a white color temperature in kelvin
+func ColorTempCommand(kelvin int) []byte {
+	if kelvin <= 0 {
+		kelvin = 1
+	}
+	mireds := 1000000 / kelvin
+	return lightCommand(LightState{State: "ON", ColorTemp: &mireds})
+}
+
+// ColorCommand returns the light command payload that sets a color from hue (0-360) and saturation (0-100)
+func ColorCommand(hue, saturation int) []byte {
+	color := hsvToRGB(float64(clamp(hue, 0, 360)), float64(clamp(saturation, 0, 100))/100)
+	return lightCommand(LightState{State: "ON", Color: &color})
+}
+
+func lightCommand(state LightState) []byte {
+	payload, _ := json.Marshal(state)
+	return payload
+}
+
+// hsvToRGB converts a hue and saturation at full value to RGB
+func hsvToRGB(hue, saturation float64) RGB {
+	chroma := saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := 1 - chroma
+
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	channel := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return RGB{R: channel(r), G: channel(g), B: channel(b)}
+}
+
+func clamp(value, low, high int) int {
+	return min(max(value, low), high)
+}
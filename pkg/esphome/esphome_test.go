@@ -0,0 +1,46 @@
+package esphome
+
+import "testing"
+
+func TestParseStateTopic(t *testing.T) {
+	component, objectID, ok := ParseStateTopic("desk-node", "desk-node/sensor/plug_power/state")
+	if !ok || component != ComponentSensor || objectID != "plug_power" {
+		t.Errorf("Expected sensor plug_power, got %s %s (%v)", component, objectID, ok)
+	}
+	for _, topic := range []string{"other-node/sensor/power/state", "desk-node/switch/relay/command", "desk-node/status"} {
+		if _, _, ok := ParseStateTopic("desk-node", topic); ok {
+			t.Errorf("Expected %s not to be a state topic of desk-node", topic)
+		}
+	}
+}
+
+func TestParseStates(t *testing.T) {
+	if value, err := ParseNumber([]byte("23.45")); err != nil || value != 23.45 {
+		t.Errorf("Expected 23.45, got %v (%v)", value, err)
+	}
+	if on, err := ParseBinary([]byte("ON")); err != nil || !on {
+		t.Errorf("Expected ON, got %v (%v)", on, err)
+	}
+	if _, err := ParseBinary([]byte("maybe")); err == nil {
+		t.Error("Expected an invalid binary state to fail")
+	}
+	if state, err := ParseLight([]byte(`{"state":"ON","brightness":128,"color_mode":"color_temp","color_temp":370}`)); err != nil || state.State != "ON" || *state.Brightness != 128 {
+		t.Errorf("Expected a light on at 128, got %+v (%v)", state, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := map[string]string{
+		string(SwitchCommand(true)):           "ON",
+		string(PowerCommand(false)):           `{"state":"OFF"}`,
+		string(BrightnessCommand(50)):         `{"state":"ON","brightness":128}`,
+		string(ColorTempCommand(2700)):        `{"state":"ON","color_temp":370}`,
+		string(ColorCommand(120, 100)):        `{"state":"ON","color":{"r":0,"g":255,"b":0}}`,
+		CommandTopic("desk", "light", "lamp"): "desk/light/lamp/command",
+	}
+	for got, want := range tests {
+		if got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package hwsensors
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// BME280 registers
+const (
+	bme280RegChipID    = 0xD0
+	bme280RegCalib00   = 0x88 // Temperature and pressure calibration, 0x88 to 0xA1
+	bme280RegCalib26   = 0xE1 // Humidity calibration, 0xE1 to 0xE7
+	bme280RegCtrlHum   = 0xF2
+	bme280RegCtrlMeas  = 0xF4
+	bme280RegData      = 0xF7 // Pressure, temperature and humidity, 0xF7 to 0xFE
+	bme280ChipID       = 0x60
+	bme280HumidityX1   = 0x01
+	bme280ForcedX1     = 0x25 // Temperature and pressure oversampling x1, forced mode
+	bme280MeasureTime  = 10 * time.Millisecond
+	bme280CalibLength  = 26
+	bme280CalibHLength = 7
+)
+
+// bme280Calibration holds the trimming parameters factory-programmed into each sensor
+type bme280Calibration struct {
+	T1                             uint16
+	T2, T3                         int16
+	P1                             uint16
+	P2, P3, P4, P5, P6, P7, P8, P9 int16
+	H1, H3                         uint8
+	H2, H4, H5                     int16
+	H6                             int8
+}
+
+// ReadBME280 measures temperature, humidity and pressure with a BME280 at addr, in forced mode
+// so the sensor sleeps between readings and doesn't warm itself up
+func ReadBME280(bus Bus, addr uint16) (Reading, error) {
+	id := make([]byte, 1)
+	if err := bus.Tx(addr, []byte{bme280RegChipID}, id); err != nil {
+		return Reading{}, fmt.Errorf("failed to read BME280 chip ID: %w", err)
+	}
+	if id[0] != bme280ChipID {
+		return Reading{}, fmt.Errorf("device at 0x%02x is not a BME280 (chip ID 0x%02x)", addr, id[0])
+	}
+
+	calib := make([]byte, bme280CalibLength)
+	if err := bus.Tx(addr, []byte{bme280RegCalib00}, calib); err != nil {
+		return Reading{}, fmt.Errorf("failed to read BME280 calibration: %w", err)
+	}
+	calibH := make([]byte, bme280CalibHLength)
+	if err := bus.Tx(addr, []byte{bme280RegCalib26}, calibH); err != nil {
+		return Reading{}, fmt.Errorf("failed to read BME280 humidity calibration: %w", err)
+	}
+
+	// ctrl_hum only takes effect after a write to ctrl_meas
+	if err := bus.Tx(addr, []byte{bme280RegCtrlHum, bme280HumidityX1}, nil); err != nil {
+		return Reading{}, fmt.Errorf("failed to configure BME280: %w", err)
+	}
+	if err := bus.Tx(addr, []byte{bme280RegCtrlMeas, bme280ForcedX1}, nil); err != nil {
+		return Reading{}, fmt.Errorf("failed to start BME280 measurement: %w", err)
+	}
+	time.Sleep(bme280MeasureTime)
+
+	data := make([]byte, 8)
+	if err := bus.Tx(addr, []byte{bme280RegData}, data); err != nil {
+		return Reading{}, fmt.Errorf("failed to read BME280 measurement: %w", err)
+	}
+
+	c := parseBME280Calibration(calib, calibH)
+	adcP := int32(data[0])<<12 | int32(data[1])<<4 | int32(data[2])>>4
+	adcT := int32(data[3])<<12 | int32(data[4])<<4 | int32(data[5])>>4
+	adcH := int32(data[6])<<8 | int32(data[7])
+
+	celsius, tFine := c.temperature(adcT)
+	if err := checkRange("BME280", celsius, -40, 85); err != nil {
+		return Reading{}, err
+	}
+	humidity := c.humidity(adcH, tFine)
+	pressure := c.pressure(adcP, tFine) / 100
+	return Reading{TemperatureC: celsius, Humidity: &humidity, PressureHPa: &pressure}, nil
+}
+
+func parseBME280Calibration(calib, calibH []byte) bme280Calibration {
+	le := binary.LittleEndian
+	s16 := func(b []byte) int16 { return int16(le.Uint16(b)) }
+	return bme280Calibration{
+		T1: le.Uint16(calib[0:]), T2: s16(calib[2:]), T3: s16(calib[4:]),
+		P1: le.Uint16(calib[6:]), P2: s16(calib[8:]), P3: s16(calib[10:]), P4: s16(calib[12:]),
+		P5: s16(calib[14:]), P6: s16(calib[16:]), P7: s16(calib[18:]), P8: s16(calib[20:]), P9: s16(calib[22:]),
+		H1: calib[25],
+		H2: s16(calibH[0:]),
+		H3: calibH[2],
+		// H4 and H5 are 12-bit values sharing the nibbles of 0xE5
+		H4: int16(int8(calibH[3]))<<4 | int16(calibH[4]&0x0F),
+		H5: int16(int8(calibH[5]))<<4 | int16(calibH[4]>>4),
+		H6: int8(calibH[6]),
+	}
+}
+
+// temperature compensates a raw temperature, returning °C and the fine temperature the
+// pressure and humidity compensation need (datasheet section 8.1)
+func (c bme280Calibration) temperature(adcT int32) (float64, float64) {
+	var1 := (float64(adcT)/16384 - float64(c.T1)/1024) * float64(c.T2)
+	var2 := float64(adcT)/131072 - float64(c.T1)/8192
+	var2 = var2 * var2 * float64(c.T3)
+	tFine := var1 + var2
+	return tFine / 5120, tFine
+}
+
+// pressure compensates a raw pressure, in Pa
+func (c bme280Calibration) pressure(adcP int32, tFine float64) float64 {
+	var1 := tFine/2 - 64000
+	var2 := var1 * var1 * float64(c.P6) / 32768
+	var2 += var1 * float64(c.P5) * 2
+	var2 = var2/4 + float64(c.P4)*65536
+	var1 = (float64(c.P3)*var1*var1/524288 + float64(c.P2)*var1) / 524288
+	var1 = (1 + var1/32768) * float64(c.P1)
+	if var1 == 0 {
+		return 0 // Avoid dividing by zero on an unprogrammed sensor
+	}
+	p := 1048576 - float64(adcP)
+	p = (p - var2/4096) * 6250 / var1
+	var1 = float64(c.P9) * p * p / 2147483648
+	var2 = p * float64(c.P8) / 32768
+	return p + (var1+var2+float64(c.P7))/16
+}
+
+// humidity compensates a raw humidity, in percent
+func (c bme280Calibration) humidity(adcH int32, tFine float64) float64 {
+	h := tFine - 76800
+	h = (float64(adcH) - (float64(c.H4)*64 + float64(c.H5)/16384*h)) *
+		(float64(c.H2) / 65536 * (1 + float64(c.H6)/67108864*h*(1+float64(c.H3)/67108864*h)))
+	h *= 1 - float64(c.H1)*h/524288
+	return min(max(h, 0), 100)
+}
@@ -0,0 +1,75 @@
+package hwsensors
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OneWireRoot is where the kernel lists 1-Wire devices once the w1-gpio overlay is enabled
+const OneWireRoot = "/sys/bus/w1/devices"
+
+// ds18b20Family is the 1-Wire family code of DS18B20 probes, the prefix of their device IDs
+const ds18b20Family = "28-"
+
+// OneWireDevices lists the IDs of the DS18B20 probes under root, e.g. 28-0316a2795fff
+func OneWireDevices(root string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(root, ds18b20Family+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		ids = append(ids, filepath.Base(match))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ReadDS18B20 reads the probe with deviceID under root. Reading takes the kernel driver about
+// 750ms, the probe's conversion time.
+func ReadDS18B20(root, deviceID string) (Reading, error) {
+	data, err := os.ReadFile(filepath.Join(root, deviceID, "w1_slave"))
+	if err != nil {
+		return Reading{}, fmt.Errorf("failed to read 1-Wire device %s: %w", deviceID, err)
+	}
+	return parseW1Slave(string(data))
+}
+
+// parseW1Slave parses the two lines of w1_slave: the scratchpad with its CRC check result, and
+// the scratchpad again with the temperature in millidegrees, e.g.
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func parseW1Slave(data string) (Reading, error) {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	if len(lines) < 2 {
+		return Reading{}, fmt.Errorf("truncated 1-Wire reading %q", data)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return Reading{}, fmt.Errorf("1-Wire reading failed its CRC check")
+	}
+
+	_, value, found := strings.Cut(lines[1], "t=")
+	if !found {
+		return Reading{}, fmt.Errorf("1-Wire reading has no temperature")
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return Reading{}, fmt.Errorf("invalid 1-Wire temperature %q: %w", value, err)
+	}
+	// 85°C is the power-on value of the scratchpad, read when a conversion didn't happen
+	if milli == 85000 {
+		return Reading{}, fmt.Errorf("1-Wire probe returned its power-on value, check its power supply")
+	}
+
+	celsius := float64(milli) / 1000
+	if err := checkRange("DS18B20", celsius, -55, 125); err != nil {
+		return Reading{}, err
+	}
+	return Reading{TemperatureC: celsius}, nil
+}
@@ -0,0 +1,57 @@
+// Package hwsensors reads temperature and humidity sensors attached to the gateway itself:
+// DS18B20 probes on the 1-Wire bus through the kernel's w1-therm driver, and SHT3x and BME280
+// sensors on an I2C bus. It is pure Go, so it builds for every architecture the gateway ships
+// on; I2C access is only available on Linux.
+package hwsensors
+
+import "fmt"
+
+// Sensor types
+const (
+	TypeDS18B20 = "ds18b20"
+	TypeSHT3x   = "sht3x"
+	TypeBME280  = "bme280"
+)
+
+// Default I2C addresses
+const (
+	DefaultSHT3xAddress  = 0x44
+	DefaultBME280Address = 0x76
+)
+
+// Reading is one measurement. Fields the sensor doesn't measure are nil.
+type Reading struct {
+	TemperatureC float64
+	Humidity     *float64 // Relative humidity in percent
+	PressureHPa  *float64
+}
+
+// Bus is an I2C bus: Tx writes w to the device at addr, then reads len(r) bytes from it
+type Bus interface {
+	Tx(addr uint16, w, r []byte) error
+	Close() error
+}
+
+// crc8 is the Sensirion checksum of SHT3x words: polynomial 0x31, initial value 0xFF
+func crc8(data []byte) byte {
+	crc := byte(0xFF)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// checkRange rejects readings outside what a sensor can measure, e.g. after a bus glitch
+func checkRange(name string, value, low, high float64) error {
+	if value < low || value > high {
+		return fmt.Errorf("%s reading %.2f is outside %.0f to %.0f", name, value, low, high)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package hwsensors
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDS18B20(t *testing.T) {
+	root := t.TempDir()
+	for id, data := range map[string]string{
+		"28-0316a2795fff": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-0416b1a2c3ff": "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-0516000000ff": "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n",
+	} {
+		os.MkdirAll(filepath.Join(root, id), 0755)
+		os.WriteFile(filepath.Join(root, id, "w1_slave"), []byte(data), 0644)
+	}
+	os.MkdirAll(filepath.Join(root, "w1_bus_master1"), 0755)
+
+	ids, err := OneWireDevices(root)
+	if err != nil || len(ids) != 3 || ids[0] != "28-0316a2795fff" {
+		t.Fatalf("Expected the three probes and not the bus master, got %v (%v)", ids, err)
+	}
+
+	reading, err := ReadDS18B20(root, "28-0316a2795fff")
+	if err != nil || reading.TemperatureC != 23.125 || reading.Humidity != nil {
+		t.Errorf("Expected 23.125°C, got %+v (%v)", reading, err)
+	}
+	if _, err := ReadDS18B20(root, "28-0416b1a2c3ff"); err == nil {
+		t.Error("Expected a failed CRC check to be refused")
+	}
+	if _, err := ReadDS18B20(root, "28-0516000000ff"); err == nil {
+		t.Error("Expected the power-on value to be refused")
+	}
+}
+
+// fakeBus answers register reads from a register map and records writes
+type fakeBus struct {
+	registers map[byte]byte
+	writes    [][]byte
+	response  []byte // Returned by reads without a register, like the SHT3x's
+}
+
+func (b *fakeBus) Tx(addr uint16, w, r []byte) error {
+	if len(w) > 0 {
+		b.writes = append(b.writes, append([]byte(nil), w...))
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	if len(w) == 0 {
+		copy(r, b.response)
+		return nil
+	}
+	for i := range r {
+		r[i] = b.registers[w[0]+byte(i)]
+	}
+	return nil
+}
+
+func (b *fakeBus) Close() error { return nil }
+
+func TestSHT3x(t *testing.T) {
+	// 0x6666 is 25°C and 0x8000 50% relative humidity
+	data := []byte{0x66, 0x66, 0, 0x80, 0x00, 0}
+	data[2], data[5] = crc8(data[0:2]), crc8(data[3:5])
+	if crc8([]byte{0xBE, 0xEF}) != 0x92 {
+		t.Fatal("Expected the datasheet's CRC example to match")
+	}
+
+	bus := &fakeBus{response: data}
+	reading, err := ReadSHT3x(bus, DefaultSHT3xAddress)
+	if err != nil {
+		t.Fatalf("ReadSHT3x failed: %v", err)
+	}
+	if math.Abs(reading.TemperatureC-25) > 0.01 || reading.Humidity == nil || math.Abs(*reading.Humidity-50) > 0.01 {
+		t.Errorf("Expected 25°C and 50%%, got %+v", reading)
+	}
+	if len(bus.writes) != 1 || bus.writes[0][0] != 0x24 {
+		t.Errorf("Expected a single-shot measurement command, got %x", bus.writes)
+	}
+
+	data[5] ^= 0xFF
+	if _, err := ReadSHT3x(&fakeBus{response: data}, DefaultSHT3xAddress); err == nil {
+		t.Error("Expected a corrupted reading to be refused")
+	}
+}
+
+func TestBME280Compensation(t *testing.T) {
+	// The worked example of the BME280 datasheet
+	c := bme280Calibration{
+		T1: 27504, T2: 26435, T3: -1000,
+		P1: 36477, P2: -10685, P3: 3024, P4: 2855, P5: 140, P6: -7, P7: 15500, P8: -14600, P9: 6000,
+	}
+	celsius, tFine := c.temperature(519888)
+	if math.Abs(celsius-25.08) > 0.01 {
+		t.Errorf("Expected 25.08°C, got %.2f", celsius)
+	}
+	if pressure := c.pressure(415148, tFine); math.Abs(pressure-100653.27) > 1 {
+		t.Errorf("Expected 100653 Pa, got %.2f", pressure)
+	}
+}
+
+func TestReadBME280(t *testing.T) {
+	bus := &fakeBus{registers: map[byte]byte{
+		bme280RegChipID: bme280ChipID,
+		// T1 27504, T2 26435, T3 -1000 as in the datasheet, then P1 36477
+		0x88: 0x70, 0x89: 0x6B, 0x8A: 0x43, 0x8B: 0x67, 0x8C: 0x18, 0x8D: 0xFC, 0x8E: 0x7D, 0x8F: 0x8E,
+		// H1 75, H2 362, H3 0, H4 317, H5 50, H6 30
+		0xA1: 75, 0xE1: 0x6A, 0xE2: 0x01, 0xE3: 0, 0xE4: 0x13, 0xE5: 0x2D, 0xE6: 0x03, 0xE7: 30,
+		// adc_T 519888 and a mid-range adc_H
+		0xFA: 0x7E, 0xFB: 0xED, 0xFC: 0x00, 0xFD: 0x70, 0xFE: 0x00,
+	}}
+	reading, err := ReadBME280(bus, DefaultBME280Address)
+	if err != nil {
+		t.Fatalf("ReadBME280 failed: %v", err)
+	}
+	if math.Abs(reading.TemperatureC-25.08) > 0.01 || reading.Humidity == nil || *reading.Humidity <= 0 || *reading.Humidity > 100 {
+		t.Errorf("Expected 25.08°C and a humidity, got %+v", reading)
+	}
+	if len(bus.writes) < 2 || bus.writes[len(bus.writes)-2][1] != bme280ForcedX1 {
+		t.Errorf("Expected a forced-mode measurement, got %x", bus.writes)
+	}
+
+	bus.registers[bme280RegChipID] = 0x58
+	if _, err := ReadBME280(bus, DefaultBME280Address); err == nil {
+		t.Error("Expected a BMP280 to be refused")
+	}
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package hwsensors
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// i2cSlave is the ioctl selecting the device later reads and writes address
+const i2cSlave = 0x0703
+
+// i2cDevice is a bus opened through the kernel's i2c-dev interface
+type i2cDevice struct {
+	file *os.File
+	addr uint16
+	mu   sync.Mutex
+}
+
+// OpenI2C opens /dev/i2c-<bus>. On a Raspberry Pi, enable it with dtparam=i2c_arm=on; the
+// header pins 3 and 5 are bus 1.
+func OpenI2C(bus int) (Bus, error) {
+	file, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open I2C bus %d: %w", bus, err)
+	}
+	return &i2cDevice{file: file}, nil
+}
+
+func (d *i2cDevice) Tx(addr uint16, w, r []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.addr != addr {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), i2cSlave, uintptr(addr)); errno != 0 {
+			return fmt.Errorf("failed to address I2C device 0x%02x: %w", addr, errno)
+		}
+		d.addr = addr
+	}
+	if len(w) > 0 {
+		if _, err := d.file.Write(w); err != nil {
+			return err
+		}
+	}
+	if len(r) > 0 {
+		if _, err := d.file.Read(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *i2cDevice) Close() error {
+	return d.file.Close()
+}
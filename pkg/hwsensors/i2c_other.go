@@ -0,0 +1,10 @@
+//go:build !linux
+
+package hwsensors
+
+import "fmt"
+
+// OpenI2C is only available on Linux, through the kernel's i2c-dev interface
+func OpenI2C(bus int) (Bus, error) {
+	return nil, fmt.Errorf("I2C bus %d: I2C sensors are only supported on Linux", bus)
+}
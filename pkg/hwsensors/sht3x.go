@@ -0,0 +1,41 @@
+package hwsensors
+
+import (
+	"fmt"
+	"time"
+)
+
+// sht3xMeasure starts a single-shot, high-repeatability measurement without clock stretching
+var sht3xMeasure = []byte{0x24, 0x00}
+
+// sht3xMeasureTime is the longest high-repeatability measurement
+const sht3xMeasureTime = 16 * time.Millisecond
+
+// ReadSHT3x measures temperature and humidity with an SHT30, SHT31 or SHT35 at addr
+func ReadSHT3x(bus Bus, addr uint16) (Reading, error) {
+	if err := bus.Tx(addr, sht3xMeasure, nil); err != nil {
+		return Reading{}, fmt.Errorf("failed to start SHT3x measurement: %w", err)
+	}
+	time.Sleep(sht3xMeasureTime)
+
+	data := make([]byte, 6)
+	if err := bus.Tx(addr, nil, data); err != nil {
+		return Reading{}, fmt.Errorf("failed to read SHT3x measurement: %w", err)
+	}
+	return parseSHT3x(data)
+}
+
+// parseSHT3x converts the temperature and humidity words, each followed by its CRC
+func parseSHT3x(data []byte) (Reading, error) {
+	if crc8(data[0:2]) != data[2] || crc8(data[3:5]) != data[5] {
+		return Reading{}, fmt.Errorf("SHT3x reading failed its CRC check")
+	}
+
+	rawTemp := float64(uint16(data[0])<<8 | uint16(data[1]))
+	rawHumidity := float64(uint16(data[3])<<8 | uint16(data[4]))
+	humidity := 100 * rawHumidity / 65535
+	return Reading{
+		TemperatureC: -45 + 175*rawTemp/65535,
+		Humidity:     &humidity,
+	}, nil
+}
@@ -0,0 +1,303 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Measurement names written by the client
+const (
+	MeasurementEnergy      = "energy"
+	MeasurementEnvironment = "environment"
+)
+
+// Client writes energy and sensor readings to an InfluxDB v2 bucket.
+// It implements the services TimeSeriesClient interface.
+type Client struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	url      string
+	org      string
+	bucket   string
+
+	deviceNames map[string]string
+	deviceTags  map[string]string
+	mu          sync.RWMutex
+}
+
+// NewClient creates an InfluxDB client for the write API of one org and bucket
+func NewClient(url, token, org, bucket string) (*Client, error) {
+	if url == "" || token == "" || org == "" || bucket == "" {
+		return nil, errors.NewConfigError("InfluxDB needs a URL, token, org and bucket (INFLUXDB_URL, INFLUXDB_TOKEN, INFLUXDB_ORG, INFLUXDB_BUCKET)", nil)
+	}
+
+	client := influxdb2.NewClient(url, token)
+	return &Client{
+		client:      client,
+		writeAPI:    client.WriteAPIBlocking(org, bucket),
+		url:         url,
+		org:         org,
+		bucket:      bucket,
+		deviceNames: make(map[string]string),
+		deviceTags:  make(map[string]string),
+	}, nil
+}
+
+// Connect checks that the InfluxDB server is healthy
+func (c *Client) Connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	health, err := c.client.Health(ctx)
+	if err != nil {
+		return errors.NewConnectionError("failed to connect to InfluxDB", err).WithContext("url", c.url)
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		return errors.NewConnectionError(fmt.Sprintf("InfluxDB health check failed: %s", health.Status), nil).WithContext("url", c.url)
+	}
+	return nil
+}
+
+// Disconnect releases the client's connections
+func (c *Client) Disconnect() {
+	c.client.Close()
+}
+
+// WriteEnergyReading writes a smart plug reading to the energy measurement
+func (c *Client) WriteEnergyReading(ctx context.Context, deviceID, roomID string, powerW, energyWh, voltageV, currentA float64, isOn bool, timestamp time.Time) error {
+	tags := map[string]string{
+		"device_id":   deviceID,
+		"device_name": c.deviceName(deviceID),
+		"room_id":     roomID,
+	}
+	if deviceTags := c.tags(deviceID); deviceTags != "" {
+		tags["tags"] = deviceTags
+	}
+
+	point := influxdb2.NewPoint(MeasurementEnergy, tags, map[string]interface{}{
+		"power_w":   powerW,
+		"energy_wh": energyWh,
+		"voltage_v": voltageV,
+		"current_a": currentA,
+		"is_on":     isOn,
+	}, timestamp)
+
+	if err := c.writeAPI.WritePoint(ctx, point); err != nil {
+		return errors.NewConnectionError("failed to write energy reading to InfluxDB", err).
+			WithDevice(deviceID).
+			WithContext("bucket", c.bucket)
+	}
+	return nil
+}
+
+// WriteTemperatureReading writes a room sensor reading to the environment measurement
+func (c *Client) WriteTemperatureReading(ctx context.Context, deviceID, roomID string, tempF, humidity float64, timestamp time.Time) error {
+	point := influxdb2.NewPoint(MeasurementEnvironment, map[string]string{
+		"device_id": deviceID,
+		"room_id":   roomID,
+	}, map[string]interface{}{
+		"temperature_f": tempF,
+		"temperature_c": (tempF - 32) * 5 / 9,
+		"humidity":      humidity,
+	}, timestamp)
+
+	if err := c.writeAPI.WritePoint(ctx, point); err != nil {
+		return errors.NewConnectionError("failed to write sensor reading to InfluxDB", err).
+			WithDevice(deviceID).
+			WithRoom(roomID).
+			WithContext("bucket", c.bucket)
+	}
+	return nil
+}
+
+// SetDeviceName sets the device_name tag written for a device ID, e.g. a UUID
+func (c *Client) SetDeviceName(deviceID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deviceNames[deviceID] = name
+}
+
+// SetDeviceTags sets the tags written with a device's readings, as a sorted comma-separated tag
+func (c *Client) SetDeviceTags(deviceID string, tags []string) {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deviceTags[deviceID] = strings.Join(sorted, ",")
+}
+
+// deviceName returns the name tag for a device, falling back to its ID
+func (c *Client) deviceName(deviceID string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if name, exists := c.deviceNames[deviceID]; exists && name != "" {
+		return name
+	}
+	return deviceID
+}
+
+// tags returns the comma-separated tags of a device
+func (c *Client) tags(deviceID string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.deviceTags[deviceID]
+}
+
+// CountRoomPoints counts the points of every measurement tagged with a room
+func (c *Client) CountRoomPoints(ctx context.Context, roomID string) (int64, error) {
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: 0)
+  |> filter(fn: (r) => r.room_id == %q)
+  |> count()
+  |> group()
+  |> sum()`, c.bucket, roomID)
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return 0, errors.NewConnectionError("failed to count room points in InfluxDB", err).WithRoom(roomID)
+	}
+	defer result.Close()
+
+	var count int64
+	for result.Next() {
+		if value, ok := result.Record().Value().(int64); ok {
+			count += value
+		}
+	}
+	if result.Err() != nil {
+		return 0, errors.NewConnectionError("failed to read room point count from InfluxDB", result.Err()).WithRoom(roomID)
+	}
+	return count, nil
+}
+
+// RenameRoom moves the history of a room to a new room_id tag. InfluxDB can't change the tags of
+// stored points, so the points are copied under the new tag and the originals deleted afterwards;
+// if the copy fails nothing is deleted.
+func (c *Client) RenameRoom(ctx context.Context, from, to string) error {
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: 0)
+  |> filter(fn: (r) => r.room_id == %q)
+  |> set(key: "room_id", value: %q)
+  |> to(bucket: %q, org: %q)`, c.bucket, from, to, c.bucket, c.org)
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return errors.NewConnectionError("failed to copy room history in InfluxDB", err).WithRoom(from)
+	}
+	for result.Next() {
+	}
+	err = result.Err()
+	result.Close()
+	if err != nil {
+		return errors.NewConnectionError("failed to copy room history in InfluxDB", err).WithRoom(from)
+	}
+
+	predicate := fmt.Sprintf(`room_id=%q`, from)
+	if err := c.client.DeleteAPI().DeleteWithName(ctx, c.org, c.bucket, time.Unix(0, 0), time.Now(), predicate); err != nil {
+		return errors.NewConnectionError("failed to delete the old room history in InfluxDB", err).WithRoom(from)
+	}
+	return nil
+}
+
+// Aggregates a series can be downsampled with
+const (
+	AggregateMean = "mean"
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+)
+
+// SeriesQuery selects one field of the points tagged TagKey=TagValue between Start and Stop,
+// downsampled to one point per Every
+type SeriesQuery struct {
+	Measurement string
+	Field       string
+	TagKey      string
+	TagValue    string
+	Start       time.Time
+	Stop        time.Time
+	Every       time.Duration
+	Aggregate   string // AggregateMean, AggregateMin or AggregateMax
+	// SumSeries adds up the downsampled series of each device, e.g. the power of a room's
+	// plugs; otherwise all matching points are aggregated together
+	SumSeries bool
+}
+
+// SeriesPoint is a downsampled value, timed at the start of its window
+type SeriesPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// fluxEscaper escapes what Flux reads specially in a string literal: backslashes, quotes and
+// the ${ of interpolation
+var fluxEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`)
+
+// fluxString quotes s as a Flux string literal. Go's %q doesn't fit: it leaves ${ alone and
+// writes escapes, such as \a or \u200b, that Flux rejects.
+func fluxString(s string) string {
+	return `"` + fluxEscaper.Replace(s) + `"`
+}
+
+// QuerySeries returns a downsampled series, oldest first. Windows without points are left out.
+func (c *Client) QuerySeries(ctx context.Context, q SeriesQuery) ([]SeriesPoint, error) {
+	switch q.Aggregate {
+	case AggregateMean, AggregateMin, AggregateMax:
+	default:
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown aggregate %q, use mean, min or max", q.Aggregate), nil)
+	}
+	if q.Every < time.Second || !q.Start.Before(q.Stop) {
+		return nil, errors.NewValidationError("a series needs a window of at least a second and a start before its stop", nil)
+	}
+
+	group := `group()`
+	if q.SumSeries {
+		group = `group(columns: ["device_id"])`
+	}
+	query := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r._field == %s and r[%s] == %s)
+  |> %s
+  |> aggregateWindow(every: %ds, fn: %s, timeSrc: "_start", createEmpty: false)`,
+		fluxString(c.bucket), q.Start.UTC().Format(time.RFC3339Nano), q.Stop.UTC().Format(time.RFC3339Nano),
+		fluxString(q.Measurement), fluxString(q.Field), fluxString(q.TagKey), fluxString(q.TagValue), group, int64(q.Every/time.Second), q.Aggregate)
+	if q.SumSeries {
+		query += `
+  |> group(columns: ["_time"])
+  |> sum()`
+	}
+	query += `
+  |> group()
+  |> sort(columns: ["_time"])`
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return nil, errors.NewConnectionError("failed to query a series from InfluxDB", err).WithContext("measurement", q.Measurement)
+	}
+	defer result.Close()
+
+	var points []SeriesPoint
+	for result.Next() {
+		record := result.Record()
+		switch value := record.Value().(type) {
+		case float64:
+			points = append(points, SeriesPoint{Time: record.Time(), Value: value})
+		case int64:
+			points = append(points, SeriesPoint{Time: record.Time(), Value: float64(value)})
+		}
+	}
+	if result.Err() != nil {
+		return nil, errors.NewConnectionError("failed to read a series from InfluxDB", result.Err()).WithContext("measurement", q.Measurement)
+	}
+	return points, nil
+}
@@ -0,0 +1,172 @@
+package influxdb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientWritesLineProtocol(t *testing.T) {
+	var body, auth, org, bucket string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"influxdb","status":"pass"}`)
+		case "/api/v2/write":
+			data, _ := io.ReadAll(r.Body)
+			body += string(data)
+			auth = r.Header.Get("Authorization")
+			org, bucket = r.URL.Query().Get("org"), r.URL.Query().Get("bucket")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "secret-token", "home", "energy")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	client.SetDeviceName("0b6c", "washer")
+	client.SetDeviceTags("0b6c", []string{"laundry", "appliance"})
+	at := time.Unix(1700000000, 0)
+	if err := client.WriteEnergyReading(context.Background(), "0b6c", "laundry_room", 512.5, 1200, 230, 2.2, true, at); err != nil {
+		t.Fatalf("WriteEnergyReading failed: %v", err)
+	}
+	if err := client.WriteTemperatureReading(context.Background(), "pico-kitchen", "kitchen", 68, 40, at); err != nil {
+		t.Fatalf("WriteTemperatureReading failed: %v", err)
+	}
+
+	if auth != "Token secret-token" || org != "home" || bucket != "energy" {
+		t.Errorf("Unexpected auth %q, org %q, bucket %q", auth, org, bucket)
+	}
+	for _, want := range []string{
+		`energy,device_id=0b6c,device_name=washer,room_id=laundry_room,tags=appliance\,laundry `,
+		`power_w=512.5`,
+		`is_on=true`,
+		`environment,device_id=pico-kitchen,room_id=kitchen `,
+		`temperature_c=20`,
+		` 1700000000000000000`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected written lines to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestNewClientRequiresSettings(t *testing.T) {
+	if _, err := NewClient("http://localhost:8086", "", "home", "energy"); err == nil {
+		t.Error("Expected an error without a token")
+	}
+}
+
+func TestClientRenamesRoom(t *testing.T) {
+	var queries []string
+	var predicate string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/query":
+			data, _ := io.ReadAll(r.Body)
+			queries = append(queries, string(data))
+			w.Header().Set("Content-Type", "text/csv")
+			if strings.Contains(string(data), "count()") {
+				io.WriteString(w, "#datatype,string,long,long\n#group,false,false,false\n#default,_result,,\n,result,table,_value\n,,0,42\n\n")
+			}
+		case "/api/v2/delete":
+			data, _ := io.ReadAll(r.Body)
+			predicate = string(data)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "secret-token", "home", "energy")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	count, err := client.CountRoomPoints(context.Background(), "kitchen")
+	if err != nil || count != 42 {
+		t.Fatalf("Expected 42 points, got %d, %v", count, err)
+	}
+	if err := client.RenameRoom(context.Background(), "kitchen", "galley"); err != nil {
+		t.Fatalf("RenameRoom failed: %v", err)
+	}
+	if len(queries) != 2 || !strings.Contains(queries[1], `set(key: \"room_id\", value: \"galley\")`) {
+		t.Errorf("Expected the points copied under the new tag, got %v", queries)
+	}
+	if !strings.Contains(predicate, `room_id=\"kitchen\"`) {
+		t.Errorf("Expected the old points deleted, got %s", predicate)
+	}
+}
+
+func TestClientQueriesSeries(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		query = string(data)
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, "#datatype,string,long,dateTime:RFC3339,double\n#group,false,false,false,false\n#default,_result,,,\n"+
+			",result,table,_time,_value\n,,0,2026-07-14T22:00:00Z,71.5\n,,0,2026-07-14T22:05:00Z,72.25\n\n")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "secret-token", "home", "energy")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	stop := time.Date(2026, 7, 14, 22, 10, 0, 0, time.UTC)
+	q := SeriesQuery{
+		Measurement: "energy", Field: "power_w", TagKey: "room_id", TagValue: "kitchen",
+		Start: stop.Add(-10 * time.Minute), Stop: stop, Every: 5 * time.Minute, Aggregate: AggregateMax, SumSeries: true,
+	}
+	points, err := client.QuerySeries(context.Background(), q)
+	if err != nil {
+		t.Fatalf("QuerySeries failed: %v", err)
+	}
+	if len(points) != 2 || points[1].Value != 72.25 || !points[1].Time.Equal(stop.Add(-5*time.Minute)) {
+		t.Fatalf("Unexpected points %+v", points)
+	}
+	for _, want := range []string{`r[\"room_id\"] == \"kitchen\"`, `every: 300s, fn: max`, `group(columns: [\"_time\"])`} {
+		if !strings.Contains(query, want) {
+			t.Errorf("Expected the query to contain %s, got %s", want, query)
+		}
+	}
+
+	q.Aggregate = "sum"
+	if _, err := client.QuerySeries(context.Background(), q); err == nil {
+		t.Error("Expected an unknown aggregate to be rejected")
+	}
+}
+
+func TestFluxString(t *testing.T) {
+	for value, want := range map[string]string{
+		"bedroom":       `"bedroom"`,
+		`say "hi"`:      `"say \"hi\""`,
+		`C:\temp`:       `"C:\\temp"`,
+		"${r._value}":   `"\${r._value}"`,
+		"café\tkitchen": "\"café\tkitchen\"",
+		"price $5":      `"price $5"`,
+	} {
+		if got := fluxString(value); got != want {
+			t.Errorf("%s: expected %s, got %s", value, want, got)
+		}
+	}
+}
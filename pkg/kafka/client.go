@@ -13,13 +13,14 @@ import (
 
 // LogMessage represents a structured log message for Kafka
 type LogMessage struct {
-	Timestamp string                 `json:"timestamp"`
-	Level     string                 `json:"level"`
-	Service   string                 `json:"service"`
-	Message   string                 `json:"message"`
-	DeviceID  string                 `json:"device_id,omitempty"`
-	Action    string                 `json:"action,omitempty"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Service    string                 `json:"service"`
+	Message    string                 `json:"message"`
+	DeviceID   string                 `json:"device_id,omitempty"`
+	DeviceUUID string                 `json:"device_uuid,omitempty"`
+	Action     string                 `json:"action,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // ConnectionState represents the Kafka connection state
@@ -280,6 +281,14 @@ func (c *Client) drainMessageQueue() {
 	}
 }
 
+// HealthCheck fails while the client isn't connected; it fits utils.HealthChecker
+func (c *Client) HealthCheck() error {
+	if c == nil {
+		return errors.NewKafkaError("kafka client is nil", nil)
+	}
+	return c.healthCheck()
+}
+
 // GetHealthStatus returns the health status of the Kafka client
 func (c *Client) GetHealthStatus(ctx context.Context) map[string]error {
 	if c == nil {
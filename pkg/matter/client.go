@@ -0,0 +1,338 @@
+package matter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Node is a commissioned Matter node with the attributes the controller last read from it,
+// keyed by "endpoint/cluster/attribute"
+type Node struct {
+	NodeID           uint64                 `json:"node_id"`
+	DateCommissioned string                 `json:"date_commissioned,omitempty"`
+	Available        bool                   `json:"available"`
+	IsBridge         bool                   `json:"is_bridge,omitempty"`
+	Attributes       map[string]interface{} `json:"attributes"`
+}
+
+// Attribute returns the last known value of an attribute
+func (n *Node) Attribute(path AttributePath) (interface{}, bool) {
+	value, ok := n.Attributes[path.String()]
+	return value, ok
+}
+
+// HasCluster reports whether an endpoint of the node serves a cluster
+func (n *Node) HasCluster(endpoint int, cluster uint32) bool {
+	prefix := fmt.Sprintf("%d/%d/", endpoint, cluster)
+	for path := range n.Attributes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoints returns the node's application endpoints, without the root endpoint
+func (n *Node) Endpoints() []int {
+	seen := make(map[int]bool)
+	for path := range n.Attributes {
+		endpoint, err := strconv.Atoi(path[:strings.IndexByte(path+"/", '/')])
+		if err == nil && endpoint != RootEndpoint {
+			seen[endpoint] = true
+		}
+	}
+	endpoints := make([]int, 0, len(seen))
+	for endpoint := range seen {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Ints(endpoints)
+	return endpoints
+}
+
+// Label returns the node label set by the user, falling back to the vendor's product name
+func (n *Node) Label() string {
+	for _, attribute := range []uint32{AttributeNodeLabel, AttributeProductName} {
+		if value, ok := n.Attribute(AttributePath{RootEndpoint, ClusterBasicInformation, attribute}); ok {
+			if label, ok := value.(string); ok && label != "" {
+				return label
+			}
+		}
+	}
+	return fmt.Sprintf("Matter node %d", n.NodeID)
+}
+
+// AttributeCallback receives attribute changes reported by commissioned nodes
+type AttributeCallback func(nodeID uint64, path AttributePath, value interface{})
+
+// Client talks to a Matter controller over its WebSocket API
+type Client struct {
+	url        string
+	conn       *websocket.Conn
+	nextID     int
+	pending    map[string]chan response
+	callbacks  []AttributeCallback
+	nodeEvents []func(node Node)
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+}
+
+type request struct {
+	MessageID string      `json:"message_id"`
+	Command   string      `json:"command"`
+	Args      interface{} `json:"args,omitempty"`
+}
+
+type response struct {
+	MessageID string          `json:"message_id"`
+	Result    json.RawMessage `json:"result"`
+	ErrorCode *int            `json:"error_code"`
+	Details   string          `json:"details"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// NewClient creates a client for the controller at a ws:// URL, e.g. ws://localhost:5580/ws
+func NewClient(url string) *Client {
+	return &Client{
+		url:     url,
+		pending: make(map[string]chan response),
+	}
+}
+
+// AddAttributeCallback registers a callback for attribute changes of every node
+func (c *Client) AddAttributeCallback(callback AttributeCallback) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, callback)
+}
+
+// AddNodeCallback registers a callback for nodes added or re-interviewed by the controller
+func (c *Client) AddNodeCallback(callback func(node Node)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeEvents = append(c.nodeEvents, callback)
+}
+
+// Connect opens the WebSocket, reads the controller's server info and subscribes to node events
+func (c *Client) Connect(ctx context.Context) error {
+	config, err := websocket.NewConfig(c.url, "http://localhost/")
+	if err != nil {
+		return errors.NewValidationError("invalid Matter controller URL "+c.url, err)
+	}
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return errors.NewServiceError("failed to connect to Matter controller", err)
+	}
+
+	var info map[string]interface{}
+	if err := websocket.JSON.Receive(conn, &info); err != nil {
+		conn.Close()
+		return errors.NewServiceError("failed to read Matter controller info", err)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	go c.readLoop(conn)
+
+	if err := c.call(ctx, "start_listening", nil, nil); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// Connected reports whether the WebSocket to the controller is open
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Close disconnects from the controller and fails pending requests
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Commission adds a device to the controller's fabric from its QR code payload or manual pairing
+// code. With networkOnly the device must already be on the network, as for Thread devices
+// attached through the border router or devices reset after a previous commissioning.
+func (c *Client) Commission(ctx context.Context, code string, networkOnly bool) (*Node, error) {
+	if _, err := ParseSetupCode(code); err != nil {
+		return nil, errors.NewValidationError("invalid setup code", err)
+	}
+
+	var node Node
+	args := map[string]interface{}{"code": code, "network_only": networkOnly}
+	if err := c.call(ctx, "commission_with_code", args, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// Nodes returns every node of the controller's fabric
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	var nodes []Node
+	if err := c.call(ctx, "get_nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// SendCommand invokes a cluster command on an endpoint of a node
+func (c *Client) SendCommand(ctx context.Context, nodeID uint64, endpoint int, cmd Command) error {
+	args := map[string]interface{}{
+		"node_id":      nodeID,
+		"endpoint_id":  endpoint,
+		"cluster_id":   cmd.Cluster,
+		"command_name": cmd.Name,
+		"payload":      cmd.Payload,
+	}
+	return c.call(ctx, "device_command", args, nil)
+}
+
+// ReadAttribute reads an attribute from the node rather than the controller's cache
+func (c *Client) ReadAttribute(ctx context.Context, nodeID uint64, path AttributePath) (interface{}, error) {
+	var values map[string]interface{}
+	args := map[string]interface{}{"node_id": nodeID, "attribute_path": path.String()}
+	if err := c.call(ctx, "read_attribute", args, &values); err != nil {
+		return nil, err
+	}
+	return values[path.String()], nil
+}
+
+// RemoveNode decommissions a node from the fabric
+func (c *Client) RemoveNode(ctx context.Context, nodeID uint64) error {
+	return c.call(ctx, "remove_node", map[string]interface{}{"node_id": nodeID}, nil)
+}
+
+// call sends a command and waits for its result, decoding it into result when non-nil
+func (c *Client) call(ctx context.Context, command string, args interface{}, result interface{}) error {
+	c.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return errors.NewServiceError("not connected to a Matter controller", nil)
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	replies := make(chan response, 1)
+	c.pending[id] = replies
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	err := websocket.JSON.Send(conn, request{MessageID: id, Command: command, Args: args})
+	c.writeMu.Unlock()
+	if err != nil {
+		return errors.NewServiceError("failed to send "+command+" to Matter controller", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return errors.NewServiceError(command+" timed out", ctx.Err())
+	case reply, ok := <-replies:
+		if !ok {
+			return errors.NewServiceError("Matter controller connection closed during "+command, nil)
+		}
+		if reply.ErrorCode != nil {
+			return errors.NewDeviceError(fmt.Sprintf("%s failed with error %d: %s", command, *reply.ErrorCode, reply.Details), nil)
+		}
+		if result != nil && len(reply.Result) > 0 {
+			if err := json.Unmarshal(reply.Result, result); err != nil {
+				return errors.NewServiceError("invalid "+command+" result", err)
+			}
+		}
+		return nil
+	}
+}
+
+// readLoop dispatches results to their callers and events to the callbacks until the connection closes
+func (c *Client) readLoop(conn *websocket.Conn) {
+	defer func() {
+		c.mu.Lock()
+		for id, replies := range c.pending {
+			close(replies)
+			delete(c.pending, id)
+		}
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	for {
+		var message response
+		if err := websocket.JSON.Receive(conn, &message); err != nil {
+			return
+		}
+		if message.Event != "" {
+			c.dispatchEvent(message.Event, message.Data)
+			continue
+		}
+
+		c.mu.Lock()
+		replies, ok := c.pending[message.MessageID]
+		c.mu.Unlock()
+		if ok {
+			replies <- message
+		}
+	}
+}
+
+func (c *Client) dispatchEvent(event string, data json.RawMessage) {
+	c.mu.Lock()
+	callbacks := append([]AttributeCallback{}, c.callbacks...)
+	nodeEvents := append([]func(Node){}, c.nodeEvents...)
+	c.mu.Unlock()
+
+	switch event {
+	case "attribute_updated":
+		var update [3]json.RawMessage
+		if err := json.Unmarshal(data, &update); err != nil {
+			return
+		}
+		var nodeID uint64
+		var pathText string
+		var value interface{}
+		if json.Unmarshal(update[0], &nodeID) != nil || json.Unmarshal(update[1], &pathText) != nil || json.Unmarshal(update[2], &value) != nil {
+			return
+		}
+		path, err := ParseAttributePath(pathText)
+		if err != nil {
+			return
+		}
+		for _, callback := range callbacks {
+			callback(nodeID, path, value)
+		}
+	case "node_added", "node_updated":
+		var node Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			return
+		}
+		for _, callback := range nodeEvents {
+			callback(node)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package matter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeController answers the controller commands the client uses and pushes an attribute event
+func fakeController(commands chan<- request) *httptest.Server {
+	node := Node{NodeID: 5, Available: true, Attributes: map[string]interface{}{
+		"0/40/3":   "Smart Plug Mini",
+		"1/6/0":    false,
+		"2/1026/0": 2150,
+	}}
+
+	return httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, map[string]interface{}{"fabric_id": 1, "schema_version": 11})
+		for {
+			var req request
+			if err := websocket.JSON.Receive(conn, &req); err != nil {
+				return
+			}
+			commands <- req
+
+			reply := map[string]interface{}{"message_id": req.MessageID}
+			switch req.Command {
+			case "start_listening", "get_nodes":
+				reply["result"] = []Node{node}
+			case "commission_with_code":
+				reply["result"] = node
+			case "device_command":
+				reply["result"] = nil
+				websocket.JSON.Send(conn, map[string]interface{}{"event": "attribute_updated", "data": []interface{}{5, "1/6/0", true}})
+			default:
+				reply["error_code"] = 1
+				reply["details"] = "unknown command"
+			}
+			websocket.JSON.Send(conn, reply)
+		}
+	}))
+}
+
+func TestClient(t *testing.T) {
+	commands := make(chan request, 10)
+	server := fakeController(commands)
+	defer server.Close()
+
+	client := NewClient("ws" + strings.TrimPrefix(server.URL, "http"))
+	updates := make(chan string, 1)
+	client.AddAttributeCallback(func(nodeID uint64, path AttributePath, value interface{}) {
+		updates <- path.String()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	<-commands
+
+	node, err := client.Commission(ctx, "3497-011-2332", true)
+	if err != nil {
+		t.Fatalf("Commission failed: %v", err)
+	}
+	if got := <-commands; got.Command != "commission_with_code" {
+		t.Errorf("Expected commission_with_code, got %s", got.Command)
+	}
+	if node.Label() != "Smart Plug Mini" || !node.HasCluster(1, ClusterOnOff) || len(node.Endpoints()) != 2 {
+		t.Errorf("Unexpected node %+v", node)
+	}
+	if value, _ := node.Attribute(AttributePath{2, ClusterTemperature, AttributeMeasuredValue}); Celsius(value.(float64)) != 21.5 {
+		t.Errorf("Expected 21.5 C, got %v", value)
+	}
+
+	if err := client.SendCommand(ctx, 5, 1, OnCommand(true)); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	got := <-commands
+	args, _ := json.Marshal(got.Args)
+	if got.Command != "device_command" || !strings.Contains(string(args), `"command_name":"On"`) || !strings.Contains(string(args), `"cluster_id":6`) {
+		t.Errorf("Unexpected device command %s %s", got.Command, args)
+	}
+	select {
+	case path := <-updates:
+		if path != "1/6/0" {
+			t.Errorf("Expected an on/off update, got %s", path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected an attribute update")
+	}
+
+	if err := client.RemoveNode(ctx, 5); err == nil {
+		t.Error("Expected a controller error to be returned")
+	}
+	if _, err := client.Commission(ctx, "12345", false); err == nil {
+		t.Error("Expected an invalid setup code to be rejected")
+	}
+}
+
+func TestConversions(t *testing.T) {
+	path, err := ParseAttributePath("1/1029/0")
+	if err != nil || path != (AttributePath{1, ClusterRelativeHumidity, AttributeMeasuredValue}) {
+		t.Errorf("Unexpected path %+v (%v)", path, err)
+	}
+	if lux := Lux(40001); lux < 9999 || lux > 10001 {
+		t.Errorf("Expected 10000 lux, got %.1f", lux)
+	}
+	if Level(100) != 254 || Level(0) != 1 || LevelPercent(127) != 50 {
+		t.Error("Unexpected level conversion")
+	}
+}
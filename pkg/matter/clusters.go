@@ -0,0 +1,144 @@
+// Package matter commissions and controls Matter devices over IP through a Matter controller
+// speaking the python-matter-server WebSocket API. The controller owns the fabric and runs the
+// secure sessions; Thread devices are reached through the controller's border router.
+package matter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Cluster IDs of the device types the adapter understands
+const (
+	ClusterDescriptor       uint32 = 0x001D
+	ClusterBasicInformation uint32 = 0x0028
+	ClusterBooleanState     uint32 = 0x0045
+	ClusterOnOff            uint32 = 0x0006
+	ClusterLevelControl     uint32 = 0x0008
+	ClusterColorControl     uint32 = 0x0300
+	ClusterIlluminance      uint32 = 0x0400
+	ClusterTemperature      uint32 = 0x0402
+	ClusterRelativeHumidity uint32 = 0x0405
+	ClusterOccupancySensing uint32 = 0x0406
+	ClusterElectricalPower  uint32 = 0x0090
+)
+
+// Attribute IDs within their clusters
+const (
+	AttributeMeasuredValue uint32 = 0x0000 // Illuminance, temperature and humidity
+	AttributeOnOff         uint32 = 0x0000
+	AttributeCurrentLevel  uint32 = 0x0000
+	AttributeOccupancy     uint32 = 0x0000
+	AttributeStateValue    uint32 = 0x0000
+	AttributeActivePower   uint32 = 0x0008 // Electrical power measurement, mW
+
+	AttributeVendorName   uint32 = 0x0001
+	AttributeProductName  uint32 = 0x0003
+	AttributeNodeLabel    uint32 = 0x0005
+	AttributeSerialNumber uint32 = 0x000F
+
+	AttributeServerList uint32 = 0x0001 // Descriptor
+)
+
+// RootEndpoint holds the node-wide clusters such as basic information
+const RootEndpoint = 0
+
+// AttributePath addresses one attribute of one endpoint, written "endpoint/cluster/attribute"
+type AttributePath struct {
+	Endpoint  int
+	Cluster   uint32
+	Attribute uint32
+}
+
+// String returns the path in the controller's "endpoint/cluster/attribute" form
+func (p AttributePath) String() string {
+	return fmt.Sprintf("%d/%d/%d", p.Endpoint, p.Cluster, p.Attribute)
+}
+
+// ParseAttributePath parses an "endpoint/cluster/attribute" path
+func ParseAttributePath(path string) (AttributePath, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return AttributePath{}, fmt.Errorf("invalid attribute path %q", path)
+	}
+	var values [3]uint64
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return AttributePath{}, fmt.Errorf("invalid attribute path %q: %w", path, err)
+		}
+		values[i] = value
+	}
+	return AttributePath{Endpoint: int(values[0]), Cluster: uint32(values[1]), Attribute: uint32(values[2])}, nil
+}
+
+// Celsius converts a temperature measurement (0.01 °C) to degrees
+func Celsius(measured float64) float64 {
+	return measured / 100
+}
+
+// HumidityPercent converts a relative humidity measurement (0.01 %) to percent
+func HumidityPercent(measured float64) float64 {
+	return measured / 100
+}
+
+// Lux converts an illuminance measurement, 10000 × log10(lux) + 1, to lux
+func Lux(measured float64) float64 {
+	if measured <= 0 {
+		return 0
+	}
+	return math.Pow(10, (measured-1)/10000)
+}
+
+// Level converts a brightness percentage to a level control level (1-254)
+func Level(percent int) int {
+	return min(max(int(math.Round(float64(percent)*254/100)), 1), 254)
+}
+
+// LevelPercent converts a level control level to a brightness percentage
+func LevelPercent(level float64) float64 {
+	return math.Round(level * 100 / 254)
+}
+
+// Command is a cluster command with its fields, as sent to an endpoint
+type Command struct {
+	Cluster uint32
+	Name    string
+	Payload map[string]interface{}
+}
+
+// OnCommand returns the on/off cluster command that switches an endpoint
+func OnCommand(on bool) Command {
+	if on {
+		return Command{Cluster: ClusterOnOff, Name: "On", Payload: map[string]interface{}{}}
+	}
+	return Command{Cluster: ClusterOnOff, Name: "Off", Payload: map[string]interface{}{}}
+}
+
+// LevelCommand returns the level control command that switches an endpoint on at a brightness percentage
+func LevelCommand(percent int) Command {
+	return Command{Cluster: ClusterLevelControl, Name: "MoveToLevelWithOnOff", Payload: map[string]interface{}{
+		"level": Level(percent), "transitionTime": 0, "optionsMask": 0, "optionsOverride": 0,
+	}}
+}
+
+// ColorTempCommand returns the color control command that sets a white color temperature in kelvin
+func ColorTempCommand(kelvin int) Command {
+	mireds := 1000000 / max(kelvin, 1)
+	return Command{Cluster: ClusterColorControl, Name: "MoveToColorTemperature", Payload: map[string]interface{}{
+		"colorTemperatureMireds": mireds, "transitionTime": 0, "optionsMask": 0, "optionsOverride": 0,
+	}}
+}
+
+// HueSaturationCommand returns the color control command that sets hue (0-360) and saturation (0-100)
+func HueSaturationCommand(hue, saturation int) Command {
+	return Command{Cluster: ClusterColorControl, Name: "MoveToHueAndSaturation", Payload: map[string]interface{}{
+		"hue":             int(math.Round(float64(min(max(hue, 0), 360)) * 254 / 360)),
+		"saturation":      int(math.Round(float64(min(max(saturation, 0), 100)) * 254 / 100)),
+		"transitionTime":  0,
+		"optionsMask":     0,
+		"optionsOverride": 0,
+	}}
+}
@@ -0,0 +1,207 @@
+package matter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rendezvous capabilities of a QR code payload
+const (
+	RendezvousSoftAP = 1 << 0
+	RendezvousBLE    = 1 << 1
+	RendezvousOnIP   = 1 << 2
+)
+
+// SetupPayload is the onboarding information printed on a Matter device as a QR code or
+// manual pairing code. Manual codes only carry the upper four bits of the discriminator.
+type SetupPayload struct {
+	Version            int    `json:"version"`
+	VendorID           uint16 `json:"vendor_id,omitempty"`
+	ProductID          uint16 `json:"product_id,omitempty"`
+	CommissioningFlow  int    `json:"commissioning_flow"`
+	Rendezvous         int    `json:"rendezvous,omitempty"`
+	Discriminator      uint16 `json:"discriminator"`
+	ShortDiscriminator bool   `json:"short_discriminator,omitempty"`
+	Passcode           uint32 `json:"-"`
+}
+
+// ParseSetupCode parses a QR code payload ("MT:...") or a manual pairing code, which may
+// contain dashes and spaces as printed on the device
+func ParseSetupCode(code string) (*SetupPayload, error) {
+	code = strings.TrimSpace(code)
+	if strings.HasPrefix(code, qrPrefix) {
+		return ParseQRCode(code)
+	}
+	return ParseManualCode(code)
+}
+
+// ParseManualCode parses an 11 or 21 digit manual pairing code
+func ParseManualCode(code string) (*SetupPayload, error) {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(digits) != 11 && len(digits) != 21 {
+		return nil, fmt.Errorf("manual pairing code must have 11 or 21 digits, got %d", len(digits))
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("manual pairing code must only contain digits")
+		}
+	}
+	if !verhoeffValid(digits) {
+		return nil, fmt.Errorf("manual pairing code check digit mismatch")
+	}
+
+	first := int(digits[0] - '0')
+	if first > 7 {
+		return nil, fmt.Errorf("manual pairing code has an invalid first digit %d", first)
+	}
+	chunk2, _ := strconv.ParseUint(digits[1:6], 10, 32)
+	chunk3, _ := strconv.ParseUint(digits[6:10], 10, 32)
+
+	payload := &SetupPayload{
+		Discriminator:      uint16((first&0x3)<<2|int(chunk2>>14)) << 8,
+		ShortDiscriminator: true,
+		Passcode:           uint32(chunk3<<14 | chunk2&0x3FFF),
+	}
+
+	hasVendor := first&0x4 != 0
+	if hasVendor != (len(digits) == 21) {
+		return nil, fmt.Errorf("manual pairing code length does not match its vendor flag")
+	}
+	if hasVendor {
+		vendorID, _ := strconv.ParseUint(digits[10:15], 10, 16)
+		productID, _ := strconv.ParseUint(digits[15:20], 10, 16)
+		payload.VendorID, payload.ProductID = uint16(vendorID), uint16(productID)
+		payload.CommissioningFlow = 2 // Custom flow
+	}
+	return payload, payload.validatePasscode()
+}
+
+const (
+	qrPrefix = "MT:"
+	base38   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-."
+)
+
+// ParseQRCode parses the base-38 "MT:" payload of a Matter QR code
+func ParseQRCode(code string) (*SetupPayload, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(code), qrPrefix)
+	if !ok {
+		return nil, fmt.Errorf("QR code payload must start with %s", qrPrefix)
+	}
+	data, err := decodeBase38(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 11 {
+		return nil, fmt.Errorf("QR code payload too short: %d bytes", len(data))
+	}
+
+	bits := bitReader{data: data}
+	payload := &SetupPayload{
+		Version:           int(bits.read(3)),
+		VendorID:          uint16(bits.read(16)),
+		ProductID:         uint16(bits.read(16)),
+		CommissioningFlow: int(bits.read(2)),
+		Rendezvous:        int(bits.read(8)),
+		Discriminator:     uint16(bits.read(12)),
+		Passcode:          uint32(bits.read(27)),
+	}
+	if payload.Version != 0 {
+		return nil, fmt.Errorf("unsupported QR code payload version %d", payload.Version)
+	}
+	return payload, payload.validatePasscode()
+}
+
+// validatePasscode rejects passcodes the specification forbids as too easy to guess
+func (p *SetupPayload) validatePasscode() error {
+	switch p.Passcode {
+	case 0, 11111111, 22222222, 33333333, 44444444, 55555555, 66666666, 77777777, 88888888, 99999999, 12345678, 87654321:
+		return fmt.Errorf("invalid setup passcode")
+	}
+	if p.Passcode > 99999998 {
+		return fmt.Errorf("setup passcode out of range")
+	}
+	return nil
+}
+
+// decodeBase38 decodes chunks of 5, 4 or 2 characters into 3, 2 or 1 little-endian bytes
+func decodeBase38(encoded string) ([]byte, error) {
+	var data []byte
+	for len(encoded) > 0 {
+		size := min(5, len(encoded))
+		byteCount := map[int]int{5: 3, 4: 2, 2: 1}[size]
+		if byteCount == 0 {
+			return nil, fmt.Errorf("invalid base-38 chunk length %d", size)
+		}
+
+		var value uint32
+		for i := size - 1; i >= 0; i-- {
+			digit := strings.IndexByte(base38, encoded[i])
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid base-38 character %q", encoded[i])
+			}
+			value = value*38 + uint32(digit)
+		}
+		if value >= 1<<(8*byteCount) {
+			return nil, fmt.Errorf("base-38 chunk %s out of range", encoded[:size])
+		}
+		for i := 0; i < byteCount; i++ {
+			data = append(data, byte(value>>(8*i)))
+		}
+		encoded = encoded[size:]
+	}
+	return data, nil
+}
+
+// bitReader reads little-endian bit fields, least significant bit first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(count int) uint64 {
+	var value uint64
+	for i := 0; i < count; i++ {
+		if r.data[r.pos/8]&(1<<(r.pos%8)) != 0 {
+			value |= 1 << i
+		}
+		r.pos++
+	}
+	return value
+}
+
+// Verhoeff check digit tables
+var (
+	verhoeffMultiply = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffPermute = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+)
+
+// verhoeffValid checks a number whose last digit is its Verhoeff check digit
+func verhoeffValid(digits string) bool {
+	check := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		check = verhoeffMultiply[check][verhoeffPermute[i%8][digit]]
+	}
+	return check == 0
+}
@@ -0,0 +1,38 @@
+package matter
+
+import "testing"
+
+func TestParseManualCode(t *testing.T) {
+	for _, code := range []string{"34970112332", "3497-011-2332"} {
+		payload, err := ParseSetupCode(code)
+		if err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+		if payload.Passcode != 20202021 || payload.Discriminator != 3840 || !payload.ShortDiscriminator {
+			t.Errorf("%s: expected passcode 20202021 and discriminator 3840, got %+v", code, payload)
+		}
+	}
+
+	for _, code := range []string{"34970112331", "3497011233", "84970112332", "abc"} {
+		if _, err := ParseSetupCode(code); err == nil {
+			t.Errorf("Expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestParseQRCode(t *testing.T) {
+	payload, err := ParseSetupCode("MT:Y.K9042C00KA0648G00")
+	if err != nil {
+		t.Fatalf("ParseSetupCode failed: %v", err)
+	}
+	if payload.VendorID != 0xFFF1 || payload.ProductID != 0x8000 || payload.Discriminator != 3840 || payload.Passcode != 20202021 {
+		t.Errorf("Expected the test vendor's lighting app payload, got %+v", payload)
+	}
+	if payload.Rendezvous&RendezvousBLE == 0 {
+		t.Errorf("Expected BLE rendezvous, got %d", payload.Rendezvous)
+	}
+
+	if _, err := ParseQRCode("MT:Y.K9042C00KA0648G0"); err == nil {
+		t.Error("Expected a truncated payload to be rejected")
+	}
+}
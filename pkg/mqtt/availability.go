@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// AvailabilityTopicPrefix holds a retained online/offline status per service,
+// e.g. home/service/thermostat/status
+const AvailabilityTopicPrefix = "home/service/"
+
+// Availability payloads
+const (
+	PayloadOnline  = "online"
+	PayloadOffline = "offline"
+)
+
+// AvailabilityTopic returns the status topic of a service; "+" matches every service
+func AvailabilityTopic(service string) string {
+	return AvailabilityTopicPrefix + service + "/status"
+}
+
+// availabilityService returns the service named by a status topic
+func availabilityService(topic string) (string, bool) {
+	service, found := strings.CutPrefix(topic, AvailabilityTopicPrefix)
+	if !found {
+		return "", false
+	}
+	service, found = strings.CutSuffix(service, "/status")
+	return service, found && service != "" && !strings.Contains(service, "/")
+}
+
+// Will returns the last will the broker publishes when the connection drops without a
+// clean disconnect, or nil if the client announces no service or is read-only. The broker
+// publishes it as is, so its topic is already in the client's namespace.
+func (c *Client) Will() *Message {
+	if c.service == "" || c.readOnly {
+		return nil
+	}
+	return &Message{Topic: c.Namespace().Apply(AvailabilityTopic(c.service)), Payload: []byte(PayloadOffline), QoS: 1, Retain: true}
+}
+
+// announce publishes the service's retained availability
+func (c *Client) announce(payload string) {
+	if c.service == "" {
+		return
+	}
+
+	message := &Message{Topic: AvailabilityTopic(c.service), Payload: []byte(payload), QoS: 1, Retain: true}
+	if err := c.Publish(message); err != nil {
+		c.logger.Warn("Failed to publish service availability", map[string]interface{}{
+			"service": c.service,
+			"status":  payload,
+			"error":   err.Error(),
+		})
+	}
+}
+
+// ServiceAvailability is the last status a service announced
+type ServiceAvailability struct {
+	Service   string    `json:"service"`
+	Online    bool      `json:"online"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// AvailabilityTracker follows the availability topics of all services, so a crashed service
+// is known to be offline as soon as the broker publishes its last will
+type AvailabilityTracker struct {
+	services  map[string]ServiceAvailability
+	callbacks []func(service string, online bool)
+	mu        sync.RWMutex
+}
+
+// NewAvailabilityTracker creates an empty tracker
+func NewAvailabilityTracker() *AvailabilityTracker {
+	return &AvailabilityTracker{
+		services: make(map[string]ServiceAvailability),
+	}
+}
+
+// Subscribe starts tracking the availability topics received by a client
+func (t *AvailabilityTracker) Subscribe(client *Client) error {
+	return client.Subscribe(AvailabilityTopic("+"), t.Handle)
+}
+
+// AddCallback registers a function called when a service goes online or offline
+func (t *AvailabilityTracker) AddCallback(callback func(service string, online bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.callbacks = append(t.callbacks, callback)
+}
+
+// Handle processes a message on an availability topic
+func (t *AvailabilityTracker) Handle(topic string, payload []byte) error {
+	service, ok := availabilityService(topic)
+	if !ok {
+		return errors.NewValidationError(fmt.Sprintf("not an availability topic: %s", topic), nil)
+	}
+
+	var online bool
+	switch string(payload) {
+	case PayloadOnline:
+		online = true
+	case PayloadOffline:
+		online = false
+	default:
+		return errors.NewValidationError(fmt.Sprintf("invalid availability %q", payload), nil).
+			WithContext("service", service)
+	}
+
+	t.mu.Lock()
+	previous, known := t.services[service]
+	changed := !known || previous.Online != online
+	if changed {
+		t.services[service] = ServiceAvailability{Service: service, Online: online, ChangedAt: time.Now()}
+	}
+	callbacks := t.callbacks
+	t.mu.Unlock()
+
+	if changed {
+		for _, callback := range callbacks {
+			callback(service, online)
+		}
+	}
+	return nil
+}
+
+// Online reports whether a service last announced itself online, and whether it is known at all
+func (t *AvailabilityTracker) Online(service string) (online, known bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	availability, known := t.services[service]
+	return availability.Online, known
+}
+
+// Services returns the availability of every known service, sorted by name
+func (t *AvailabilityTracker) Services() []ServiceAvailability {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	services := make([]ServiceAvailability, 0, len(t.services))
+	for _, availability := range t.services {
+		services = append(services, availability)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Service < services[j].Service
+	})
+	return services
+}
+
+// HealthCheck fails while any known service is offline; it fits utils.HealthChecker
+func (t *AvailabilityTracker) HealthCheck() error {
+	var offline []string
+	for _, availability := range t.Services() {
+		if !availability.Online {
+			offline = append(offline, availability.Service)
+		}
+	}
+	if len(offline) > 0 {
+		return errors.NewServiceError(fmt.Sprintf("services offline: %s", strings.Join(offline, ", ")), nil)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestClientAnnouncesAvailability(t *testing.T) {
+	cache, _ := NewStateCache("", 0)
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, &ClientOptions{
+		StateCache: cache,
+		Service:    "thermostat",
+	})
+
+	will := client.Will()
+	if will == nil || will.Topic != "home/service/thermostat/status" || string(will.Payload) != PayloadOffline || !will.Retain {
+		t.Fatalf("Expected a retained offline last will, got %+v", will)
+	}
+
+	status := func() string {
+		messages := cache.Matching([]string{AvailabilityTopic("thermostat")}, time.Now())
+		if len(messages) != 1 {
+			return ""
+		}
+		return string(messages[0].Payload)
+	}
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if got := status(); got != PayloadOnline {
+		t.Errorf("Expected online after connecting, got %q", got)
+	}
+
+	client.Disconnect()
+	if got := status(); got != PayloadOffline {
+		t.Errorf("Expected offline after a clean disconnect, got %q", got)
+	}
+
+	if NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil).Will() != nil {
+		t.Error("Expected no last will without a service name")
+	}
+}
+
+func TestReadOnlyClientNeverPublishes(t *testing.T) {
+	cache, _ := NewStateCache("", 0)
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, &ClientOptions{
+		StateCache: cache,
+		Service:    "unified",
+		ReadOnly:   true,
+	})
+
+	if client.Will() != nil {
+		t.Error("Expected no last will on a read-only client")
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	if err := client.Publish(&Message{Topic: "thermostat/living-room/control", Payload: []byte("{}"), Retain: true}); err != nil {
+		t.Errorf("Expected a dropped publish to succeed quietly, got %v", err)
+	}
+	if messages := cache.Matching([]string{"#"}, time.Now()); len(messages) != 0 {
+		t.Errorf("Expected nothing published, got %+v", messages)
+	}
+}
+
+func TestAvailabilityTracker(t *testing.T) {
+	tracker := NewAvailabilityTracker()
+	var changes []string
+	tracker.AddCallback(func(service string, online bool) {
+		changes = append(changes, service+"="+map[bool]string{true: PayloadOnline, false: PayloadOffline}[online])
+	})
+
+	tracker.Handle(AvailabilityTopic("thermostat"), []byte(PayloadOnline))
+	tracker.Handle(AvailabilityTopic("thermostat"), []byte(PayloadOnline))
+	tracker.Handle(AvailabilityTopic("unified"), []byte(PayloadOnline))
+	if err := tracker.HealthCheck(); err != nil {
+		t.Errorf("Expected healthy while all services are online, got %v", err)
+	}
+
+	// The broker publishes the last will of a crashed service
+	tracker.Handle(AvailabilityTopic("thermostat"), []byte(PayloadOffline))
+	if online, known := tracker.Online("thermostat"); online || !known {
+		t.Errorf("Expected thermostat to be known and offline, got online=%t known=%t", online, known)
+	}
+	if err := tracker.HealthCheck(); err == nil {
+		t.Error("Expected the health check to fail while a service is offline")
+	}
+
+	want := []string{"thermostat=online", "unified=online", "thermostat=offline"}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected callbacks only on changes %v, got %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Change %d: expected %s, got %s", i, want[i], changes[i])
+		}
+	}
+
+	if err := tracker.Handle(AvailabilityTopic("thermostat"), []byte("maybe")); err == nil {
+		t.Error("Expected an invalid payload to be rejected")
+	}
+	if err := tracker.Handle("home/service/status", []byte(PayloadOnline)); err == nil {
+		t.Error("Expected a topic without a service to be rejected")
+	}
+}
@@ -0,0 +1,127 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// bridgeLoopWindow is how long a forwarded message is remembered to stop it bouncing back
+const bridgeLoopWindow = 5 * time.Second
+
+// Bridge forwards messages matching topic filters between two clients, e.g. from an
+// integration's own broker to the shared one, so services on either side see the same topics
+type Bridge struct {
+	clients [2]*Client
+	filters []string
+	both    bool
+
+	recent map[[sha256.Size]byte]time.Time
+	mu     sync.Mutex
+}
+
+// NewBridge creates a bridge from source to target. With bidirectional set, messages also flow
+// from target to source; a message forwarded one way is never forwarded back, so identical
+// messages on the same topic within a few seconds are passed on only once.
+func NewBridge(source, target *Client, filters []string, bidirectional bool) *Bridge {
+	return &Bridge{
+		clients: [2]*Client{source, target},
+		filters: filters,
+		both:    bidirectional,
+		recent:  make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Start subscribes to the bridged filters
+func (b *Bridge) Start() error {
+	if len(b.filters) == 0 {
+		return errors.NewValidationError("bridge needs at least one topic filter", nil)
+	}
+
+	for _, filter := range b.filters {
+		if err := b.clients[0].Subscribe(filter, b.forwarder(b.clients[1])); err != nil {
+			return err
+		}
+		if b.both {
+			if err := b.clients[1].Subscribe(filter, b.forwarder(b.clients[0])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forwarder returns a handler republishing messages on target
+func (b *Bridge) forwarder(target *Client) MessageHandler {
+	return func(topic string, payload []byte) error {
+		if b.both && b.seen(topic, payload) {
+			return nil
+		}
+		return target.Publish(&Message{Topic: topic, Payload: payload, QoS: 1})
+	}
+}
+
+// seen reports whether the bridge forwarded this message recently, and remembers it otherwise
+func (b *Bridge) seen(topic string, payload []byte) bool {
+	hash := sha256.New()
+	hash.Write([]byte(topic))
+	hash.Write([]byte{0})
+	hash.Write(payload)
+	var key [sha256.Size]byte
+	copy(key[:], hash.Sum(nil))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for old, at := range b.recent {
+		if now.Sub(at) > bridgeLoopWindow {
+			delete(b.recent, old)
+		}
+	}
+
+	if _, exists := b.recent[key]; exists {
+		return true
+	}
+	b.recent[key] = now
+	return false
+}
+
+// ConnectIntegration connects the client of one integration. When the integration has its own
+// brokers (MQTT_BROKERS_<INTEGRATION>), its topics are bridged both ways to the shared brokers,
+// so a crash of either broker only affects the services that use it.
+func ConnectIntegration(shared config.MQTTConfig, integration string, topics []string, options *ClientOptions) (*Client, error) {
+	own := shared.ForIntegration(integration)
+	client := NewClient(own, options)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+
+	if slices.Equal(own.BrokerAddresses(), shared.BrokerAddresses()) {
+		return client, nil
+	}
+
+	sharedClient := NewClient(&shared, options)
+	if err := sharedClient.Connect(); err != nil {
+		client.logger.Error("Shared MQTT brokers unavailable, integration topics are not bridged", err, map[string]interface{}{
+			"integration": integration,
+		})
+		return client, nil
+	}
+	if err := NewBridge(client, sharedClient, topics, true).Start(); err != nil {
+		sharedClient.Disconnect()
+		client.Disconnect()
+		return nil, err
+	}
+
+	client.linked = append(client.linked, sharedClient)
+	client.logger.Info("Bridging integration topics to the shared MQTT brokers", map[string]interface{}{
+		"integration": integration,
+		"topics":      topics,
+	})
+	return client, nil
+}
@@ -3,7 +3,6 @@ package mqtt
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 	"time"
 
@@ -26,6 +25,7 @@ const (
 type Client struct {
 	config         *config.MQTTConfig
 	handlers       map[string]MessageHandler
+	handlersMutex  sync.RWMutex // Guards handlers, propertyHandlers and contextHandlers
 	state          ConnectionState
 	stateMutex     sync.RWMutex
 	logger         *logger.Logger
@@ -36,6 +36,34 @@ type Client struct {
 	ctx            context.Context
 	cancel         context.CancelFunc
 	reconnectChan  chan struct{}
+	keys           *KeyRing
+	keysErr        error // Publishing fails closed when the configured key file can't be loaded
+
+	// Broker failover
+	dialer        func(broker string) error
+	subscriber    func(broker, topic string) error
+	activeBroker  int // Index into the config's broker addresses
+	lastFailback  time.Time
+	reconnectOnce sync.Once
+	linked        []*Client // Bridged clients disconnected along with this one
+
+	// Last-known state replayed after a restart
+	stateCache *StateCache
+
+	// Service announced on its availability topic, with an offline last will
+	service string
+
+	// Handlers that also receive MQTT v5 properties
+	propertyHandlers map[string]PropertyHandler
+
+	// Handlers that continue the trace of each message
+	contextHandlers map[string]ContextHandler
+
+	// Read replicas subscribe but never publish
+	readOnly bool
+
+	// Published messages delivered to the client's own subscriptions in place of a broker
+	loopback chan *Message
 }
 
 type MessageHandler func(topic string, payload []byte) error
@@ -45,6 +73,10 @@ type Message struct {
 	Payload []byte
 	QoS     byte
 	Retain  bool
+
+	// MQTT v5 only; dropped when the client speaks v3.1.1
+	Expiry     time.Duration     // The broker discards the message if it isn't delivered within this time
+	Properties map[string]string // User properties, e.g. room and device metadata
 }
 
 // ClientOptions provides configuration options for the MQTT client
@@ -52,6 +84,13 @@ type ClientOptions struct {
 	RetryConfig    *utils.RetryConfig
 	CircuitBreaker *utils.CircuitBreaker
 	Logger         *logger.Logger
+	KeyRing        *KeyRing                         // Overrides the key file named in the MQTT config
+	Dialer         func(broker string) error        // Opens the connection to a host:port broker
+	Subscriber     func(broker, topic string) error // Sends a subscription to the connected broker
+	StateCache     *StateCache                      // Keeps last-known state for ReplayState
+	Service        string                           // Announces availability on home/service/<name>/status
+	ReadOnly       bool                             // Drops every publish, including availability, e.g. for a read replica
+	Loopback       bool                             // Delivers every publish to the client's own subscriptions, e.g. for the demo house without a broker
 }
 
 func NewClient(cfg *config.MQTTConfig, options *ClientOptions) *Client {
@@ -61,11 +100,32 @@ func NewClient(cfg *config.MQTTConfig, options *ClientOptions) *Client {
 	var retryConfig *utils.RetryConfig
 	var circuitBreaker *utils.CircuitBreaker
 	var clientLogger *logger.Logger
+	var keys *KeyRing
+	var dialer func(broker string) error
+	var subscriber func(broker, topic string) error
+	var stateCache *StateCache
+	var service string
+	var readOnly bool
+	var loopback bool
 
 	if options != nil {
 		retryConfig = options.RetryConfig
 		circuitBreaker = options.CircuitBreaker
 		clientLogger = options.Logger
+		keys = options.KeyRing
+		dialer = options.Dialer
+		subscriber = options.Subscriber
+		stateCache = options.StateCache
+		service = options.Service
+		readOnly = options.ReadOnly
+		loopback = options.Loopback
+	}
+
+	if dialer == nil {
+		dialer = dialBroker
+	}
+	if subscriber == nil {
+		subscriber = subscribeBroker
 	}
 
 	if retryConfig == nil {
@@ -83,17 +143,37 @@ func NewClient(cfg *config.MQTTConfig, options *ClientOptions) *Client {
 	}
 
 	client := &Client{
-		config:         cfg,
-		handlers:       make(map[string]MessageHandler),
-		state:          StateDisconnected,
-		logger:         clientLogger,
-		errorHandler:   errors.NewErrorHandler("mqtt-client"),
-		retryConfig:    retryConfig,
-		circuitBreaker: circuitBreaker,
-		healthChecker:  utils.NewHealthChecker(),
-		ctx:            ctx,
-		cancel:         cancel,
-		reconnectChan:  make(chan struct{}, 1),
+		config:           cfg,
+		handlers:         make(map[string]MessageHandler),
+		propertyHandlers: make(map[string]PropertyHandler),
+		contextHandlers:  make(map[string]ContextHandler),
+		state:            StateDisconnected,
+		logger:           clientLogger,
+		errorHandler:     errors.NewErrorHandler("mqtt-client"),
+		retryConfig:      retryConfig,
+		circuitBreaker:   circuitBreaker,
+		healthChecker:    utils.NewHealthChecker(),
+		ctx:              ctx,
+		cancel:           cancel,
+		reconnectChan:    make(chan struct{}, 1),
+		keys:             keys,
+		dialer:           dialer,
+		subscriber:       subscriber,
+		stateCache:       stateCache,
+		service:          service,
+		readOnly:         readOnly,
+	}
+
+	if keys == nil && cfg.KeyFile != "" {
+		client.keys, client.keysErr = NewKeyRing(cfg.KeyFile)
+		if client.keysErr != nil {
+			clientLogger.Error("Failed to load MQTT key file, publishing is disabled", client.keysErr)
+		}
+	}
+
+	if loopback {
+		client.loopback = make(chan *Message, loopbackQueueSize)
+		go client.runLoopback()
 	}
 
 	// Register health check
@@ -103,39 +183,15 @@ func NewClient(cfg *config.MQTTConfig, options *ClientOptions) *Client {
 }
 
 func (c *Client) Connect() error {
-	c.logger.Info("Attempting to connect to MQTT broker", map[string]interface{}{
-		"broker": c.config.Broker,
-		"port":   c.config.Port,
-	})
-
-	operation := func() error {
-		c.setState(StateConnecting)
-
-		// Simulate connection logic - replace with actual MQTT client
-		if c.config.Broker == "" {
-			return errors.NewMQTTError("broker address is empty", nil)
-		}
-
-		if c.config.Port == "" {
-			return errors.NewMQTTError("broker port is empty", nil)
-		}
-
-		// TODO: Implement actual MQTT connection logic here
-		// For now, we'll simulate a successful connection
-		c.setState(StateConnected)
-
-		c.logger.Info("Successfully connected to MQTT broker")
-		return nil
-	}
-
-	err := utils.Retry(c.ctx, c.retryConfig, operation)
-	if err != nil {
-		c.setState(StateDisconnected)
-		return c.errorHandler.WrapError(err, "failed to connect to MQTT broker")
+	if err := c.connect(); err != nil {
+		return err
 	}
+	c.announce(PayloadOnline)
 
 	// Start background reconnection handler
-	go c.handleReconnection()
+	c.reconnectOnce.Do(func() {
+		go c.handleReconnection()
+	})
 
 	return nil
 }
@@ -143,9 +199,22 @@ func (c *Client) Connect() error {
 func (c *Client) Disconnect() error {
 	c.logger.Info("Disconnecting from MQTT broker")
 
+	// A clean disconnect doesn't trigger the last will
+	if c.isConnected() {
+		c.announce(PayloadOffline)
+	}
+
 	// Cancel background operations
 	c.cancel()
 
+	for _, linked := range c.linked {
+		linked.Disconnect()
+	}
+
+	if err := c.stateCache.Save(); err != nil {
+		c.logger.Error("Failed to save MQTT state cache", err)
+	}
+
 	c.setState(StateDisconnected)
 
 	// TODO: Implement actual MQTT disconnection logic
@@ -168,11 +237,15 @@ func (c *Client) Subscribe(topic string, handler MessageHandler) error {
 	}
 
 	operation := func() error {
-		// TODO: Implement actual MQTT subscription logic
+		if err := c.subscribe(topic); err != nil {
+			return err
+		}
+		c.handlersMutex.Lock()
 		c.handlers[topic] = handler
+		c.handlersMutex.Unlock()
 
 		c.logger.Info("Subscribed to MQTT topic", map[string]interface{}{
-			"topic": topic,
+			"topic": c.Namespace().Apply(topic),
 		})
 		return nil
 	}
@@ -189,28 +262,62 @@ func (c *Client) Publish(msg *Message) error {
 		return errors.NewValidationError("message topic cannot be empty", nil)
 	}
 
+	if c.readOnly {
+		c.logger.Debug("Read-only client, not publishing", map[string]interface{}{
+			"topic": msg.Topic,
+		})
+		return nil
+	}
+
 	if !c.isConnected() {
 		return errors.NewMQTTError("client is not connected", nil)
 	}
 
+	if c.keysErr != nil {
+		return c.errorHandler.WrapError(c.keysErr, "refusing to publish without payload keys").
+			WithContext("topic", msg.Topic)
+	}
+
+	payload, err := c.keys.Encrypt(msg.Topic, msg.Payload)
+	if err != nil {
+		return c.errorHandler.WrapError(err, "failed to encrypt MQTT payload").
+			WithContext("topic", msg.Topic)
+	}
+	encrypted := c.keys.Encrypted(msg.Topic)
+
 	operation := func() error {
 		// TODO: Implement actual MQTT publish logic
-		c.logger.Debug("Publishing MQTT message", map[string]interface{}{
-			"topic":   msg.Topic,
-			"qos":     msg.QoS,
-			"retain":  msg.Retain,
-			"payload": string(msg.Payload),
-		})
+		fields := map[string]interface{}{
+			"topic":     c.Namespace().Apply(msg.Topic),
+			"qos":       msg.QoS,
+			"retain":    msg.Retain,
+			"encrypted": encrypted,
+		}
+		c.v5Fields(msg, fields)
+		if encrypted {
+			fields["payload_bytes"] = len(payload)
+		} else {
+			fields["payload"] = string(payload)
+		}
+		c.logger.Debug("Publishing MQTT message", fields)
 		return nil
 	}
 
-	err := c.circuitBreaker.Execute(operation)
+	err = c.circuitBreaker.Execute(operation)
 	if err != nil {
 		return c.errorHandler.WrapError(err, "failed to publish MQTT message").
 			WithContext("topic", msg.Topic).
 			WithContext("qos", msg.QoS)
 	}
 
+	// Retained messages are state; remember them for replay
+	if msg.Retain {
+		c.cacheState(msg.Topic, payload, msg.expiresAt(time.Now()))
+	}
+	if c.loopback != nil {
+		c.loop(msg, payload)
+	}
+
 	return nil
 }
 
@@ -223,7 +330,7 @@ func (c *Client) PublishDeviceState(deviceID string, state map[string]interface{
 		return errors.NewValidationError("state cannot be nil", nil)
 	}
 
-	topic := fmt.Sprintf("homeautomation/devices/%s/state", deviceID)
+	topic := DeviceStateTopic(deviceID)
 
 	payload, err := json.Marshal(state)
 	if err != nil {
@@ -231,12 +338,12 @@ func (c *Client) PublishDeviceState(deviceID string, state map[string]interface{
 			WithDevice(deviceID)
 	}
 
-	msg := &Message{
+	msg := (&Message{
 		Topic:   topic,
 		Payload: payload,
 		QoS:     1,
 		Retain:  true,
-	}
+	}).WithProperty(PropertyDevice, deviceID)
 
 	err = c.Publish(msg)
 	if err != nil {
@@ -256,7 +363,7 @@ func (c *Client) PublishSensorReading(sensorID string, reading map[string]interf
 		return errors.NewValidationError("reading cannot be nil", nil)
 	}
 
-	topic := fmt.Sprintf("homeautomation/sensors/%s/reading", sensorID)
+	topic := SensorReadingTopic(sensorID)
 
 	payload, err := json.Marshal(reading)
 	if err != nil {
@@ -264,12 +371,12 @@ func (c *Client) PublishSensorReading(sensorID string, reading map[string]interf
 			WithContext("sensor_id", sensorID)
 	}
 
-	msg := &Message{
+	msg := (&Message{
 		Topic:   topic,
 		Payload: payload,
 		QoS:     1,
 		Retain:  false,
-	}
+	}).WithProperty(PropertySensor, sensorID)
 
 	err = c.Publish(msg)
 	if err != nil {
@@ -280,6 +387,84 @@ func (c *Client) PublishSensorReading(sensorID string, reading map[string]interf
 	return nil
 }
 
+// SetKeyRing replaces the payload keys, e.g. after a key rotation
+func (c *Client) SetKeyRing(keys *KeyRing) {
+	c.keys = keys
+	c.keysErr = nil
+}
+
+// dispatch decrypts an inbound message and hands it to every handler whose filter matches.
+// The transport calls it for each message received; services only ever see plaintext.
+func (c *Client) dispatch(topic string, payload []byte) error {
+	return c.dispatchMessage(&Message{Topic: topic, Payload: payload})
+}
+
+// dispatchMessage is dispatch for a message with MQTT v5 properties. The transport passes the
+// wire topic; handlers and the state cache see it without the client's namespace.
+func (c *Client) dispatchMessage(msg *Message) error {
+	topic, ours := c.Namespace().Strip(msg.Topic)
+	if !ours {
+		return nil // Another house or environment sharing the broker
+	}
+	local := *msg
+	local.Topic = topic
+	msg = &local
+
+	if err := c.deliver(msg); err != nil {
+		return err
+	}
+	c.cacheState(msg.Topic, msg.Payload, msg.expiresAt(time.Now()))
+	return nil
+}
+
+// deliver decrypts a message and hands it to every handler whose filter matches
+func (c *Client) deliver(msg *Message) error {
+	plaintext, err := c.keys.Decrypt(msg.Topic, msg.Payload)
+	if err != nil {
+		c.logger.Warn("Dropping MQTT message that failed to decrypt", map[string]interface{}{
+			"topic": msg.Topic,
+			"error": err.Error(),
+		})
+		return err
+	}
+
+	// Handlers run outside the lock, so they may subscribe in turn
+	c.handlersMutex.RLock()
+	var handlers []MessageHandler
+	for subscription, handler := range c.handlers {
+		if TopicMatches(subscriptionFilter(subscription), msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	var propertyHandlers []PropertyHandler
+	for subscription, handler := range c.propertyHandlers {
+		if TopicMatches(subscriptionFilter(subscription), msg.Topic) {
+			propertyHandlers = append(propertyHandlers, handler)
+		}
+	}
+	c.handlersMutex.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(msg.Topic, plaintext); err != nil {
+			c.logger.Error("MQTT message handler failed", err, map[string]interface{}{
+				"topic": msg.Topic,
+			})
+		}
+	}
+
+	decrypted := *msg
+	decrypted.Payload = plaintext
+	for _, handler := range propertyHandlers {
+		if err := handler(&decrypted); err != nil {
+			c.logger.Error("MQTT message handler failed", err, map[string]interface{}{
+				"topic": msg.Topic,
+			})
+		}
+	}
+	c.deliverTraced(&decrypted)
+	return nil
+}
+
 // setState safely updates the connection state
 func (c *Client) setState(state ConnectionState) {
 	c.stateMutex.Lock()
@@ -322,6 +507,8 @@ func (c *Client) handleReconnection() {
 			if !c.isConnected() {
 				c.logger.Warn("MQTT client disconnected, attempting to reconnect")
 				c.reconnect()
+			} else {
+				c.tryFailback()
 			}
 		case <-c.reconnectChan:
 			if !c.isConnected() {
@@ -331,19 +518,18 @@ func (c *Client) handleReconnection() {
 	}
 }
 
-// reconnect attempts to reconnect to the MQTT broker
+// reconnect attempts to reconnect, failing over to the next broker if the active one is down
 func (c *Client) reconnect() {
 	c.setState(StateReconnecting)
 
-	operation := func() error {
-		return c.Connect()
-	}
-
-	err := utils.Retry(c.ctx, c.retryConfig, operation)
-	if err != nil {
+	if err := c.connect(); err != nil {
 		c.logger.Error("Failed to reconnect to MQTT broker", err)
 		c.setState(StateDisconnected)
+		return
 	}
+
+	// The broker published the last will when the old connection dropped
+	c.announce(PayloadOnline)
 }
 
 // TriggerReconnect manually triggers a reconnection attempt
@@ -355,6 +541,11 @@ func (c *Client) TriggerReconnect() {
 	}
 }
 
+// HealthCheck fails while the client isn't connected to a broker; it fits utils.HealthChecker
+func (c *Client) HealthCheck() error {
+	return c.healthCheck()
+}
+
 // GetHealthStatus returns the health status of the MQTT client
 func (c *Client) GetHealthStatus(ctx context.Context) map[string]error {
 	return c.healthChecker.CheckHealth(ctx)
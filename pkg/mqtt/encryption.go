@@ -0,0 +1,295 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// encryptedMagic prefixes encrypted payloads so plaintext publishers can share a topic during rollout
+var encryptedMagic = []byte("HAE1")
+
+const (
+	keySize   = 32 // AES-256
+	nonceSize = 12
+)
+
+// TopicKey is an AES-256 key used for every topic matching Topic, an MQTT filter such as home/+/state
+type TopicKey struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Key       string    `json:"key"` // Hex encoded
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyRing holds the per-topic payload keys. Older keys of a topic stay on the ring so
+// messages published before a rotation can still be decrypted.
+type KeyRing struct {
+	path string
+	keys []TopicKey
+	mu   sync.RWMutex
+}
+
+// NewKeyRing loads the key file at path. A missing file is an empty ring; the file must not
+// be readable by group or others since it holds the keys.
+func NewKeyRing(path string) (*KeyRing, error) {
+	ring := &KeyRing{path: path}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ring, nil
+	}
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read MQTT key file", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, errors.NewConfigError(fmt.Sprintf("MQTT key file %s must not be accessible by group or others (chmod 600)", path), nil)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.NewConfigError("failed to read MQTT key file", err)
+	}
+	if err := json.Unmarshal(data, &ring.keys); err != nil {
+		return nil, errors.NewConfigError("failed to parse MQTT key file", err)
+	}
+	for _, key := range ring.keys {
+		if _, err := key.aead(); err != nil {
+			return nil, errors.NewConfigError(fmt.Sprintf("invalid MQTT key %s", key.ID), err)
+		}
+	}
+
+	return ring, nil
+}
+
+// GenerateKey adds a new key for a topic filter, replacing earlier keys of that filter for
+// publishing, and saves the ring
+func (r *KeyRing) GenerateKey(topic string) (TopicKey, error) {
+	if topic == "" {
+		return TopicKey{}, errors.NewValidationError("topic filter cannot be empty", nil)
+	}
+
+	secret := make([]byte, keySize)
+	id := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return TopicKey{}, errors.NewSystemError("failed to generate MQTT key", err)
+	}
+	if _, err := rand.Read(id); err != nil {
+		return TopicKey{}, errors.NewSystemError("failed to generate MQTT key ID", err)
+	}
+
+	key := TopicKey{
+		ID:        hex.EncodeToString(id),
+		Topic:     topic,
+		Key:       hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys = append(r.keys, key)
+	if err := r.save(); err != nil {
+		r.keys = r.keys[:len(r.keys)-1]
+		return TopicKey{}, err
+	}
+	return key, nil
+}
+
+// Keys returns the keys on the ring without their secrets
+func (r *KeyRing) Keys() []TopicKey {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]TopicKey, len(r.keys))
+	for i, key := range r.keys {
+		key.Key = ""
+		keys[i] = key
+	}
+	return keys
+}
+
+// Encrypted reports whether payloads on a topic are encrypted
+func (r *KeyRing) Encrypted(topic string) bool {
+	_, exists := r.keyFor(topic)
+	return exists
+}
+
+// Encrypt seals a payload with the newest key whose filter matches the topic. The topic is
+// authenticated, so a payload replayed on another topic fails to decrypt. Payloads on topics
+// without a key are returned unchanged.
+func (r *KeyRing) Encrypt(topic string, payload []byte) ([]byte, error) {
+	key, exists := r.keyFor(topic)
+	if !exists {
+		return payload, nil
+	}
+
+	aead, err := key.aead()
+	if err != nil {
+		return nil, errors.NewSystemError("invalid MQTT key", err).WithContext("key_id", key.ID)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.NewSystemError("failed to generate nonce", err)
+	}
+
+	sealed := make([]byte, 0, len(encryptedMagic)+1+len(key.ID)+nonceSize+len(payload)+aead.Overhead())
+	sealed = append(sealed, encryptedMagic...)
+	sealed = append(sealed, byte(len(key.ID)))
+	sealed = append(sealed, key.ID...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, payload, []byte(topic)), nil
+}
+
+// Decrypt opens a payload sealed by Encrypt. Plaintext payloads on topics without a key are
+// returned unchanged; plaintext on an encrypted topic is rejected.
+func (r *KeyRing) Decrypt(topic string, payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, encryptedMagic) {
+		if r.Encrypted(topic) {
+			return nil, errors.NewValidationError(fmt.Sprintf("unencrypted payload on encrypted topic %s", topic), nil)
+		}
+		return payload, nil
+	}
+
+	rest := payload[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+nonceSize {
+		return nil, errors.NewValidationError("truncated encrypted payload", nil).WithContext("topic", topic)
+	}
+	keyID := string(rest[1 : 1+rest[0]])
+	rest = rest[1+rest[0]:]
+
+	key, exists := r.keyByID(keyID)
+	if !exists {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown MQTT key %s", keyID), nil).WithContext("topic", topic)
+	}
+	// A key only opens the topics of its filter, so a device holding one topic's key can't
+	// seal payloads for another
+	if !TopicMatches(key.Topic, topic) {
+		return nil, errors.NewValidationError(fmt.Sprintf("MQTT key %s is not for topic %s", keyID, topic), nil).
+			WithContext("topic", topic).
+			WithContext("key_id", keyID)
+	}
+	aead, err := key.aead()
+	if err != nil {
+		return nil, errors.NewSystemError("invalid MQTT key", err).WithContext("key_id", key.ID)
+	}
+
+	plaintext, err := aead.Open(nil, rest[:nonceSize], rest[nonceSize:], []byte(topic))
+	if err != nil {
+		return nil, errors.NewValidationError("failed to decrypt payload", err).
+			WithContext("topic", topic).
+			WithContext("key_id", keyID)
+	}
+	return plaintext, nil
+}
+
+// keyFor returns the newest key whose filter matches the topic
+func (r *KeyRing) keyFor(topic string) (TopicKey, bool) {
+	if r == nil {
+		return TopicKey{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		if TopicMatches(r.keys[i].Topic, topic) {
+			return r.keys[i], true
+		}
+	}
+	return TopicKey{}, false
+}
+
+// keyByID returns a key by its ID
+func (r *KeyRing) keyByID(id string) (TopicKey, bool) {
+	if r == nil {
+		return TopicKey{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, key := range r.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return TopicKey{}, false
+}
+
+// save atomically writes the ring with owner-only permissions; callers must hold the lock
+func (r *KeyRing) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return errors.NewSystemError("failed to create key directory", err)
+	}
+
+	data, err := json.MarshalIndent(r.keys, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal MQTT keys", err)
+	}
+
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.NewSystemError("failed to write MQTT key file", err)
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		return errors.NewSystemError("failed to replace MQTT key file", err)
+	}
+	return nil
+}
+
+// aead builds the AES-GCM cipher of a key
+func (k TopicKey) aead() (cipher.AEAD, error) {
+	secret, err := hex.DecodeString(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", keySize, len(secret))
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// TopicMatches reports whether a topic matches an MQTT filter with + and # wildcards
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestKeyRingEncryptDecrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt-keys.json")
+	keys, err := NewKeyRing(path)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	oldKey, err := keys.GenerateKey("room/+/temperature")
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	payload := []byte(`{"temperature":21.5}`)
+	sealed, err := keys.Encrypt("room/kitchen/temperature", payload)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if bytes.Contains(sealed, payload) {
+		t.Fatal("Expected the payload to be encrypted")
+	}
+
+	// Rotation: new messages use the new key, old ones still decrypt after a reload
+	newKey, _ := keys.GenerateKey("room/+/temperature")
+	reloaded, err := NewKeyRing(path)
+	if err != nil {
+		t.Fatalf("Reloading key ring failed: %v", err)
+	}
+	if opened, err := reloaded.Decrypt("room/kitchen/temperature", sealed); err != nil || !bytes.Equal(opened, payload) {
+		t.Fatalf("Expected payload sealed with %s to decrypt, got %q, %v", oldKey.ID, opened, err)
+	}
+	resealed, _ := reloaded.Encrypt("room/kitchen/temperature", payload)
+	if !bytes.Contains(resealed, []byte(newKey.ID)) {
+		t.Errorf("Expected new payloads to use key %s", newKey.ID)
+	}
+
+	// The topic is authenticated
+	if _, err := reloaded.Decrypt("room/garage/temperature", sealed); err == nil {
+		t.Error("Expected a payload replayed on another topic to fail")
+	}
+	// Plaintext is rejected on encrypted topics and passed through elsewhere
+	if _, err := reloaded.Decrypt("room/kitchen/temperature", payload); err == nil {
+		t.Error("Expected plaintext on an encrypted topic to be rejected")
+	}
+	if opened, err := reloaded.Decrypt("room/kitchen/light", payload); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("Expected plaintext on other topics to pass through, got %q, %v", opened, err)
+	}
+	for _, key := range reloaded.Keys() {
+		if key.Key != "" {
+			t.Error("Expected Keys to omit secrets")
+		}
+	}
+}
+
+func TestKeyRingKeyOnlyOpensItsTopics(t *testing.T) {
+	keys, _ := NewKeyRing("")
+	sensorKey, err := keys.GenerateKey("sensors/#")
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	keys.GenerateKey("commands/#")
+
+	// A device holding only the sensor key seals a command with it
+	stolen := sensorKey
+	stolen.Key = keys.keys[0].Key
+	stolen.Topic = "#"
+	device := &KeyRing{keys: []TopicKey{stolen}}
+	forged, err := device.Encrypt("commands/heater", []byte(`{"action":"turn_on"}`))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := keys.Decrypt("commands/heater", forged); err == nil {
+		t.Fatal("Expected a key for sensors/# not to open a command topic")
+	}
+
+	sealed, _ := device.Encrypt("sensors/kitchen", []byte(`{"temperature":21.5}`))
+	if _, err := keys.Decrypt("sensors/kitchen", sealed); err != nil {
+		t.Fatalf("Expected the sensor key to open its own topics, got %v", err)
+	}
+}
+
+func TestKeyRingRejectsReadableKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt-keys.json")
+	if err := os.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyRing(path); err == nil {
+		t.Error("Expected a world-readable key file to be rejected")
+	}
+
+	// A client with an unusable key file must not fall back to plaintext
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883", KeyFile: path}, nil)
+	client.setState(StateConnected)
+	if err := client.Publish(&Message{Topic: "room/kitchen/temperature", Payload: []byte("{}")}); err == nil {
+		t.Error("Expected publishing to fail without usable keys")
+	}
+}
+
+func TestClientDispatchDecrypts(t *testing.T) {
+	keys, _ := NewKeyRing("")
+	keys.GenerateKey("home-automation/#")
+
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, &ClientOptions{KeyRing: keys})
+	var received []byte
+	client.handlers["home-automation/energy/+"] = func(topic string, payload []byte) error {
+		received = payload
+		return nil
+	}
+
+	sealed, _ := keys.Encrypt("home-automation/energy/laundry", []byte("42"))
+	if err := client.dispatch("home-automation/energy/laundry", sealed); err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+	if string(received) != "42" {
+		t.Errorf("Expected the handler to receive plaintext, got %q", received)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"room/+/temperature", "room/kitchen/temperature", true},
+		{"room/+/temperature", "room/kitchen/humidity", false},
+		{"room/#", "room/kitchen/temperature", true},
+		{"room/kitchen", "room/kitchen/temperature", false},
+		{"#", "anything/at/all", true},
+	}
+	for _, c := range cases {
+		if got := TopicMatches(c.filter, c.topic); got != c.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/utils"
+)
+
+// dialBroker opens a connection to a broker
+func dialBroker(broker string) error {
+	host, port, err := net.SplitHostPort(broker)
+	if err != nil || host == "" {
+		return errors.NewMQTTError(fmt.Sprintf("invalid broker address %q", broker), err)
+	}
+	if port == "" {
+		return errors.NewMQTTError("broker port is empty", nil)
+	}
+
+	// TODO: Implement actual MQTT connection logic here, registering Client.Will as the last will
+	// For now, we'll simulate a successful connection
+	return nil
+}
+
+// subscribeBroker sends a subscription to the connected broker
+func subscribeBroker(broker, topic string) error {
+	// TODO: Implement actual MQTT subscription logic here
+	// For now, we'll simulate a successful subscription
+	return nil
+}
+
+// subscribe sends a subscription to the active broker
+func (c *Client) subscribe(topic string) error {
+	if err := c.subscriber(c.ActiveBroker(), c.Namespace().Apply(topic)); err != nil {
+		return errors.NewMQTTError(fmt.Sprintf("failed to subscribe to %s", topic), err)
+	}
+	return nil
+}
+
+// subscriptions returns the topics of every handler, each once
+func (c *Client) subscriptions() []string {
+	c.handlersMutex.RLock()
+	defer c.handlersMutex.RUnlock()
+
+	seen := make(map[string]bool, len(c.handlers)+len(c.propertyHandlers)+len(c.contextHandlers))
+	for topic := range c.handlers {
+		seen[topic] = true
+	}
+	for topic := range c.propertyHandlers {
+		seen[topic] = true
+	}
+	for topic := range c.contextHandlers {
+		seen[topic] = true
+	}
+	topics := make([]string, 0, len(seen))
+	for topic := range seen {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// connect tries the configured brokers in order of preference and stays on the first that accepts
+func (c *Client) connect() error {
+	brokers := c.config.BrokerAddresses()
+	c.logger.Info("Attempting to connect to MQTT broker", map[string]interface{}{
+		"brokers": brokers,
+	})
+
+	operation := func() error {
+		c.setState(StateConnecting)
+
+		if len(brokers) == 0 {
+			return errors.NewMQTTError("broker address is empty", nil)
+		}
+
+		var lastErr error
+		for i, broker := range brokers {
+			if err := c.dialer(broker); err != nil {
+				c.logger.Warn("MQTT broker unavailable", map[string]interface{}{
+					"broker": broker,
+					"error":  err.Error(),
+				})
+				lastErr = err
+				continue
+			}
+
+			if err := c.switchBroker(i, broker); err != nil {
+				c.logger.Warn("MQTT broker refused the subscriptions", map[string]interface{}{
+					"broker": broker,
+					"error":  err.Error(),
+				})
+				lastErr = err
+				continue
+			}
+			c.setState(StateConnected)
+			return nil
+		}
+		return lastErr
+	}
+
+	err := utils.Retry(c.ctx, c.retryConfig, operation)
+	if err != nil {
+		c.setState(StateDisconnected)
+		return c.errorHandler.WrapError(err, "failed to connect to MQTT broker")
+	}
+
+	return nil
+}
+
+// switchBroker restores the subscriptions on a newly connected broker and makes it the active
+// one, so handlers keep receiving their messages after a failover or failback
+func (c *Client) switchBroker(index int, broker string) error {
+	subscriptions := c.subscriptions()
+	for _, topic := range subscriptions {
+		if err := c.subscriber(broker, c.Namespace().Apply(topic)); err != nil {
+			return errors.NewMQTTError(fmt.Sprintf("failed to restore subscription %s", topic), err)
+		}
+	}
+
+	c.stateMutex.Lock()
+	previous := c.activeBroker
+	c.activeBroker = index
+	if index > 0 && previous == 0 {
+		c.lastFailback = time.Now() // Give the primary time to recover before trying it again
+	}
+	c.stateMutex.Unlock()
+
+	fields := map[string]interface{}{
+		"broker":        broker,
+		"subscriptions": len(subscriptions),
+	}
+	if index > 0 {
+		c.logger.Warn("Connected to secondary MQTT broker", fields)
+	} else {
+		c.logger.Info("Successfully connected to MQTT broker", fields)
+	}
+	return nil
+}
+
+// tryFailback moves a client on a secondary broker back to the primary once it accepts connections
+func (c *Client) tryFailback() {
+	c.stateMutex.RLock()
+	onSecondary := c.activeBroker > 0
+	due := time.Since(c.lastFailback) >= c.config.FailbackInterval
+	c.stateMutex.RUnlock()
+
+	if !onSecondary || !due {
+		return
+	}
+
+	brokers := c.config.BrokerAddresses()
+	c.stateMutex.Lock()
+	c.lastFailback = time.Now()
+	c.stateMutex.Unlock()
+
+	if err := c.dialer(brokers[0]); err != nil {
+		return
+	}
+
+	c.logger.Info("Primary MQTT broker is back, failing back", map[string]interface{}{
+		"broker": brokers[0],
+	})
+	if err := c.switchBroker(0, brokers[0]); err != nil {
+		c.logger.Warn("Primary MQTT broker refused the subscriptions, staying on the secondary", map[string]interface{}{
+			"broker": brokers[0],
+			"error":  err.Error(),
+		})
+		return
+	}
+	c.announce(PayloadOnline)
+}
+
+// connectionLost is called by the transport when the active broker drops the connection
+func (c *Client) connectionLost(err error) {
+	c.logger.Error("Lost connection to MQTT broker", err, map[string]interface{}{
+		"broker": c.ActiveBroker(),
+	})
+	c.setState(StateDisconnected)
+	c.TriggerReconnect()
+}
+
+// ActiveBroker returns the host:port of the broker the client is using
+func (c *Client) ActiveBroker() string {
+	brokers := c.config.BrokerAddresses()
+
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	if c.activeBroker < len(brokers) {
+		return brokers[c.activeBroker]
+	}
+	return ""
+}
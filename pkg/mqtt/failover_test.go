@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/utils"
+)
+
+// fakeBrokers lets tests take brokers up and down, and records the subscriptions each holds
+type fakeBrokers struct {
+	down          map[string]bool
+	subscriptions map[string][]string
+	mu            sync.Mutex
+}
+
+func (f *fakeBrokers) set(broker string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[broker] = down
+}
+
+func (f *fakeBrokers) dial(broker string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[broker] {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeBrokers) subscribe(broker, topic string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[broker] {
+		return fmt.Errorf("connection refused")
+	}
+	if f.subscriptions == nil {
+		f.subscriptions = make(map[string][]string)
+	}
+	f.subscriptions[broker] = append(f.subscriptions[broker], topic)
+	return nil
+}
+
+// publish delivers a message to the client if the broker holds a matching subscription
+func (f *fakeBrokers) publish(client *Client, broker, topic string, payload []byte) {
+	f.mu.Lock()
+	subscribed := false
+	for _, filter := range f.subscriptions[broker] {
+		subscribed = subscribed || TopicMatches(filter, topic)
+	}
+	f.mu.Unlock()
+	if subscribed {
+		client.dispatch(topic, payload)
+	}
+}
+
+func newFailoverClient(brokers *fakeBrokers) *Client {
+	retry := utils.DefaultRetryConfig()
+	retry.MaxAttempts = 1
+	cfg := &config.MQTTConfig{Brokers: []string{"primary:1883", "secondary:1883"}, FailbackInterval: time.Minute}
+	return NewClient(cfg, &ClientOptions{RetryConfig: retry, Dialer: brokers.dial, Subscriber: brokers.subscribe})
+}
+
+func TestClientFailsOverAndBack(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{"primary:1883": true}}
+	client := newFailoverClient(brokers)
+	defer client.Disconnect()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected to connect to the secondary broker, got %v", err)
+	}
+	if broker := client.ActiveBroker(); broker != "secondary:1883" {
+		t.Fatalf("Expected secondary broker, got %s", broker)
+	}
+
+	// The primary is not retried before the failback interval
+	brokers.set("primary:1883", false)
+	client.tryFailback()
+	if broker := client.ActiveBroker(); broker != "secondary:1883" {
+		t.Fatalf("Expected to wait before failing back, got %s", broker)
+	}
+
+	client.lastFailback = time.Now().Add(-2 * time.Minute)
+	client.tryFailback()
+	if broker := client.ActiveBroker(); broker != "primary:1883" {
+		t.Errorf("Expected to fail back to the primary, got %s", broker)
+	}
+
+	// Losing the active broker fails over again
+	brokers.set("primary:1883", true)
+	client.connectionLost(fmt.Errorf("broker crashed"))
+	client.reconnect()
+	if !client.isConnected() || client.ActiveBroker() != "secondary:1883" {
+		t.Errorf("Expected to reconnect to the secondary, got %s", client.ActiveBroker())
+	}
+}
+
+func TestClientResubscribesAfterFailover(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{}}
+	client := newFailoverClient(brokers)
+	defer client.Disconnect()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	var received []string
+	if err := client.Subscribe("sensors/#", func(topic string, payload []byte) error {
+		received = append(received, topic)
+		return nil
+	}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	brokers.publish(client, "primary:1883", "sensors/kitchen", []byte(`{}`))
+
+	// The handler registered on the primary still fires once the secondary takes over
+	brokers.set("primary:1883", true)
+	client.connectionLost(fmt.Errorf("broker crashed"))
+	client.reconnect()
+	if client.ActiveBroker() != "secondary:1883" {
+		t.Fatalf("Expected to fail over to the secondary, got %s", client.ActiveBroker())
+	}
+	brokers.publish(client, "secondary:1883", "sensors/garage", []byte(`{}`))
+	if len(received) != 2 || received[1] != "sensors/garage" {
+		t.Fatalf("Expected the handler to fire on both brokers, got %v", received)
+	}
+}
+
+func TestClientFailsWhenAllBrokersDown(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{"primary:1883": true, "secondary:1883": true}}
+	client := newFailoverClient(brokers)
+	if err := client.Connect(); err == nil {
+		t.Error("Expected Connect to fail with every broker down")
+	}
+}
+
+func TestBridgeForwardsWithoutLoops(t *testing.T) {
+	brokers := &fakeBrokers{down: map[string]bool{}}
+	local, shared := newFailoverClient(brokers), newFailoverClient(brokers)
+	for _, client := range []*Client{local, shared} {
+		if err := client.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		defer client.Disconnect()
+	}
+
+	bridge := NewBridge(local, shared, []string{"tapo/#"}, true)
+	if err := bridge.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	var forwarded int
+	forward := shared.handlers["tapo/#"]
+	shared.handlers["tapo/#"] = func(topic string, payload []byte) error {
+		forwarded++
+		return forward(topic, payload)
+	}
+
+	// A message arriving locally reaches the shared broker, and its echo there is not sent back
+	if err := local.dispatch("tapo/washer/energy", []byte("42")); err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+	if err := shared.dispatch("tapo/washer/energy", []byte("42")); err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+	if forwarded != 1 || !bridge.seen("tapo/washer/energy", []byte("42")) {
+		t.Errorf("Expected the echo to be recognised, handled %d", forwarded)
+	}
+}
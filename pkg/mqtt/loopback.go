@@ -0,0 +1,33 @@
+package mqtt
+
+// loopbackQueueSize is how many published messages wait for delivery to the client's own
+// subscriptions before new ones are dropped
+const loopbackQueueSize = 1024
+
+// loop queues a published message for the client's own subscriptions, as a broker would deliver
+// it. payload is what went on the wire, encrypted for encrypted topics.
+func (c *Client) loop(msg *Message, payload []byte) {
+	wire := *msg
+	wire.Topic = c.Namespace().Apply(msg.Topic)
+	wire.Payload = payload
+	select {
+	case c.loopback <- &wire:
+	default:
+		c.logger.Warn("Loopback queue full, dropping MQTT message", map[string]interface{}{
+			"topic": msg.Topic,
+		})
+	}
+}
+
+// runLoopback delivers looped-back messages in order. Delivery is asynchronous, so a handler
+// that publishes doesn't re-enter the handlers, or the locks, of the service that published.
+func (c *Client) runLoopback() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case msg := <-c.loopback:
+			c.dispatchMessage(msg)
+		}
+	}
+}
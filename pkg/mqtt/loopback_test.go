@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+	"github.com/johnpr01/home-automation/internal/tracing"
+)
+
+func TestLoopbackDeliversPublishes(t *testing.T) {
+	client := NewClient(&config.MQTTConfig{Brokers: []string{"localhost:1883"}}, &ClientOptions{Loopback: true})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan string, 1)
+	client.Subscribe(RoomTopic(TopicRoomTemperature, "+"), func(topic string, payload []byte) error {
+		// Publishing from a handler is delivered later instead of re-entering it
+		if topic == "room-temp/kitchen" {
+			client.Publish(&Message{Topic: "room-temp/office", Payload: payload})
+		}
+		received <- topic + " " + string(payload)
+		return nil
+	})
+
+	if err := client.Publish(&Message{Topic: "room-temp/kitchen", Payload: []byte(`{"temperature":70}`)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`room-temp/kitchen {"temperature":70}`, `room-temp/office {"temperature":70}`} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s delivered", want)
+		}
+	}
+
+	if plain := NewClient(&config.MQTTConfig{Brokers: []string{"localhost:1883"}}, nil); plain.loopback != nil {
+		t.Error("Expected no loopback by default")
+	}
+}
+
+func TestLoopbackCarriesTraceContext(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	tracer, err := tracing.NewTracer(collector.URL, "unified", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracing.SetTracer(tracer)
+	defer func() {
+		tracing.SetTracer(nil)
+		tracer.Shutdown(context.Background())
+	}()
+
+	client := NewClient(&config.MQTTConfig{Brokers: []string{"localhost:1883"}}, &ClientOptions{Loopback: true})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan tracing.SpanContext, 1)
+	client.SubscribeContext(ThermostatControlTopic("+"), func(ctx context.Context, topic string, payload []byte) error {
+		sc, _ := tracing.SpanContextFrom(ctx)
+		received <- sc
+		return nil
+	})
+
+	ctx, span := tracing.Start(context.Background(), "ThermostatService process", tracing.KindInternal)
+	defer span.End()
+	msg := &Message{Topic: ThermostatControlTopic("kitchen"), Payload: []byte(`{"action":"heating"}`)}
+	if err := client.PublishContext(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Property(PropertyTraceParent) != "" {
+		t.Error("Expected the caller's message left unchanged")
+	}
+	select {
+	case sc := <-received:
+		if sc.TraceID != span.Context().TraceID || sc.SpanID == span.Context().SpanID {
+			t.Errorf("Expected the handler within a span of the publisher's trace, got %+v", sc)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the control command delivered")
+	}
+}
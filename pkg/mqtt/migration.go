@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// TopicMigration maps a legacy topic filter to the topic that replaced it. Wildcard levels carry
+// over in order, so room-humidity/+ → room-hum/+ republishes room-humidity/kitchen on
+// room-hum/kitchen.
+type TopicMigration struct {
+	Legacy  string `json:"legacy"`
+	Current string `json:"current"`
+}
+
+// LegacyTopics are the topic schemas replaced so far. Older firmware keeps publishing on them
+// until it is reflashed.
+var LegacyTopics = []TopicMigration{
+	{Legacy: "room-humidity/+", Current: RoomTopic(TopicRoomHumidity, "+")},
+}
+
+// Validate checks that the wildcards of both filters line up and that republished messages
+// can't be picked up again as legacy traffic
+func (m TopicMigration) Validate() error {
+	if m.Legacy == "" || m.Current == "" {
+		return errors.NewValidationError("a topic migration needs a legacy and a current topic", nil)
+	}
+	if wildcards(m.Legacy) != wildcards(m.Current) {
+		return errors.NewValidationError("legacy topic "+m.Legacy+" and current topic "+m.Current+" must have the same wildcards", nil)
+	}
+	if TopicMatches(m.Legacy, m.Current) || TopicMatches(m.Current, m.Legacy) {
+		return errors.NewValidationError("legacy topic "+m.Legacy+" overlaps current topic "+m.Current, nil)
+	}
+	return nil
+}
+
+// Translate returns the current topic of a topic published on the legacy filter
+func (m TopicMigration) Translate(topic string) (string, bool) {
+	if !TopicMatches(m.Legacy, topic) {
+		return "", false
+	}
+
+	topicLevels := strings.Split(topic, "/")
+	var captured []string
+	for i, level := range strings.Split(m.Legacy, "/") {
+		switch level {
+		case "+":
+			captured = append(captured, topicLevels[i])
+		case "#":
+			captured = append(captured, strings.Join(topicLevels[i:], "/"))
+		}
+	}
+
+	levels := strings.Split(m.Current, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			levels[i], captured = captured[0], captured[1:]
+		}
+	}
+	return strings.Join(levels, "/"), true
+}
+
+// wildcards returns the sequence of wildcard levels of a filter, e.g. "+#"
+func wildcards(filter string) string {
+	var sequence strings.Builder
+	for _, level := range strings.Split(filter, "/") {
+		if level == "+" || level == "#" {
+			sequence.WriteString(level)
+		}
+	}
+	return sequence.String()
+}
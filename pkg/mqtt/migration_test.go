@@ -0,0 +1,41 @@
+package mqtt
+
+import "testing"
+
+func TestTopicMigrationTranslate(t *testing.T) {
+	tests := []struct {
+		migration TopicMigration
+		topic     string
+		want      string
+		ok        bool
+	}{
+		{LegacyTopics[0], "room-humidity/kitchen", "room-hum/kitchen", true},
+		{LegacyTopics[0], "room-hum/kitchen", "", false},
+		{TopicMigration{Legacy: "sensors/+/temp", Current: "room-temp/+"}, "sensors/hall/temp", "room-temp/hall", true},
+		{TopicMigration{Legacy: "old/+/#", Current: "new/+/state/#"}, "old/plug/a/b", "new/plug/state/a/b", true},
+	}
+	for _, tt := range tests {
+		got, ok := tt.migration.Translate(tt.topic)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s on %+v: expected %q %v, got %q %v", tt.topic, tt.migration, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestTopicMigrationValidate(t *testing.T) {
+	for _, migration := range LegacyTopics {
+		if err := migration.Validate(); err != nil {
+			t.Errorf("Built-in migration %+v is invalid: %v", migration, err)
+		}
+	}
+	invalid := []TopicMigration{
+		{Legacy: "room-humidity/+", Current: "room-hum/kitchen"},
+		{Legacy: "room/+", Current: "room/+"},
+		{Legacy: "", Current: "room-hum/+"},
+	}
+	for _, migration := range invalid {
+		if err := migration.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", migration)
+		}
+	}
+}
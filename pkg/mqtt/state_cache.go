@@ -0,0 +1,229 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// StateCacheFileName holds the last message of every topic inside the state directory
+const StateCacheFileName = "mqtt-state.json"
+
+// StateRequestTopic asks devices to republish their state, e.g. after a service restart.
+// The payload lists the topic filters the service subscribes to.
+const StateRequestTopic = "home-automation/state/request"
+
+// stateCacheSaveInterval limits how often the cache is written, sparing SD cards
+const stateCacheSaveInterval = 30 * time.Second
+
+// CachedMessage is the last message seen on a topic. Payloads are kept as sent on the wire,
+// so encrypted topics stay encrypted at rest.
+type CachedMessage struct {
+	Topic      string    `json:"topic"`
+	Payload    []byte    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+	ExpiresAt  time.Time `json:"expires_at"` // Zero if the message never expires
+}
+
+// StateCache remembers the last message of every topic across restarts, so a restarted
+// service can replay last-known state instead of waiting for the next publish
+type StateCache struct {
+	path     string
+	maxAge   time.Duration
+	messages map[string]CachedMessage
+	lastSave time.Time
+	mu       sync.Mutex
+}
+
+// NewStateCache loads the cache at path, or keeps it in memory if path is empty.
+// Messages older than maxAge are not replayed; 0 replays messages of any age.
+func NewStateCache(path string, maxAge time.Duration) (*StateCache, error) {
+	cache := &StateCache{
+		path:     path,
+		maxAge:   maxAge,
+		messages: make(map[string]CachedMessage),
+	}
+	if path == "" {
+		return cache, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, errors.NewSystemError("failed to read MQTT state cache", err)
+	}
+
+	var messages []CachedMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return cache, errors.NewSystemError("failed to parse MQTT state cache", err)
+	}
+	for _, message := range messages {
+		cache.messages[message.Topic] = message
+	}
+	return cache, nil
+}
+
+// StateCachePath returns the state cache file path for a state directory
+func StateCachePath(stateDir string) string {
+	return filepath.Join(stateDir, StateCacheFileName)
+}
+
+// Store records the last message of a topic. The cache is written at most every 30 seconds;
+// an error means that write failed.
+func (s *StateCache) Store(topic string, payload []byte, at time.Time) error {
+	return s.StoreExpiring(topic, payload, at, time.Time{})
+}
+
+// StoreExpiring is Store for a message with an MQTT v5 expiry; it isn't replayed once expired
+func (s *StateCache) StoreExpiring(topic string, payload []byte, at, expiresAt time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages[topic] = CachedMessage{
+		Topic:      topic,
+		Payload:    append([]byte(nil), payload...),
+		ReceivedAt: at,
+		ExpiresAt:  expiresAt,
+	}
+
+	if s.path != "" && time.Since(s.lastSave) >= stateCacheSaveInterval {
+		return s.save()
+	}
+	return nil
+}
+
+// Matching returns the fresh cached messages whose topic matches any of the filters, sorted by topic
+func (s *StateCache) Matching(filters []string, now time.Time) []CachedMessage {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matching []CachedMessage
+	for topic, message := range s.messages {
+		if s.maxAge > 0 && now.Sub(message.ReceivedAt) > s.maxAge {
+			continue
+		}
+		if !message.ExpiresAt.IsZero() && now.After(message.ExpiresAt) {
+			continue
+		}
+		for _, filter := range filters {
+			if TopicMatches(filter, topic) {
+				matching = append(matching, message)
+				break
+			}
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Topic < matching[j].Topic
+	})
+	return matching
+}
+
+// Save writes the cache, e.g. on shutdown
+func (s *StateCache) Save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// save atomically writes the cache; callers must hold the lock
+func (s *StateCache) save() error {
+	messages := make([]CachedMessage, 0, len(s.messages))
+	for _, message := range s.messages {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal MQTT state cache", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.NewSystemError("failed to write MQTT state cache", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.NewSystemError("failed to replace MQTT state cache", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
+
+// cacheState records the last message of a topic in the client's state cache
+func (c *Client) cacheState(topic string, payload []byte, expiresAt time.Time) {
+	if err := c.stateCache.StoreExpiring(topic, payload, time.Now(), expiresAt); err != nil {
+		c.logger.Error("Failed to save MQTT state cache", err)
+	}
+}
+
+// ReplayState hands the last-known message of every subscribed topic to its handlers and asks
+// devices to republish their state. Call it once all services and callbacks are wired up after
+// a restart, so they don't operate blind until the next sensor publish. It returns the number
+// of messages replayed.
+func (c *Client) ReplayState() int {
+	subscriptions := c.subscriptions()
+	filters := make([]string, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		filters = append(filters, subscriptionFilter(subscription))
+	}
+	sort.Strings(filters)
+
+	replayed := 0
+	for _, message := range c.stateCache.Matching(filters, time.Now()) {
+		if err := c.deliver(&Message{Topic: message.Topic, Payload: message.Payload}); err != nil {
+			continue
+		}
+		replayed++
+	}
+
+	c.logger.Info("Replayed last-known MQTT state", map[string]interface{}{
+		"subscriptions": len(filters),
+		"replayed":      replayed,
+	})
+
+	if err := c.RequestState(filters); err != nil {
+		c.logger.Warn("Failed to request state from devices", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	return replayed
+}
+
+// RequestState asks devices publishing on the given topic filters to republish their state
+func (c *Client) RequestState(filters []string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"topics":       c.Namespace().ApplyAll(filters), // Devices match them against the topics they publish
+		"requested_at": time.Now(),
+	})
+	if err != nil {
+		return errors.NewSystemError("failed to marshal state request", err)
+	}
+	return c.Publish(&Message{Topic: StateRequestTopic, Payload: payload, QoS: 1})
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestStateCachePersistsAndMatches(t *testing.T) {
+	path := StateCachePath(t.TempDir())
+	cache, err := NewStateCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStateCache failed: %v", err)
+	}
+
+	now := time.Now()
+	cache.Store("room-temp/1", []byte("70.5"), now)
+	cache.Store("room-temp/1", []byte("71.0"), now)
+	cache.Store("room-hum/1", []byte("45"), now.Add(-2*time.Hour))
+	cache.Store("tapo/plug-1", []byte("on"), now)
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	reloaded, err := NewStateCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Reloading failed: %v", err)
+	}
+
+	matching := reloaded.Matching([]string{"room-temp/+", "room-hum/+"}, now)
+	if len(matching) != 1 {
+		t.Fatalf("Expected only the fresh temperature, got %+v", matching)
+	}
+	if matching[0].Topic != "room-temp/1" || string(matching[0].Payload) != "71.0" {
+		t.Errorf("Expected the last temperature message, got %+v", matching[0])
+	}
+}
+
+func TestClientReplayState(t *testing.T) {
+	cache, _ := NewStateCache(filepath.Join(t.TempDir(), StateCacheFileName), 0)
+	cfg := &config.MQTTConfig{Broker: "localhost", Port: "1883"}
+
+	// Messages received before the restart are cached
+	before := NewClient(cfg, &ClientOptions{StateCache: cache})
+	before.handlers["room-temp/+"] = func(topic string, payload []byte) error { return nil }
+	if err := before.dispatch("room-temp/kitchen", []byte("68")); err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+
+	after := NewClient(cfg, &ClientOptions{StateCache: cache})
+	after.setState(StateConnected)
+	received := map[string]string{}
+	after.handlers["room-temp/+"] = func(topic string, payload []byte) error {
+		received[topic] = string(payload)
+		return nil
+	}
+
+	if replayed := after.ReplayState(); replayed != 1 {
+		t.Errorf("Expected 1 replayed message, got %d", replayed)
+	}
+	if received["room-temp/kitchen"] != "68" {
+		t.Errorf("Expected the last-known temperature to be replayed, got %v", received)
+	}
+}
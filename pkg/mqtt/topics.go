@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"strings"
+)
+
+// Topic roots of the home automation system. Room topics end in the room ID, e.g. room-temp/kitchen.
+const (
+	TopicRoomTemperature = "room-temp"
+	TopicRoomHumidity    = "room-hum"
+	TopicRoomMotion      = "room-motion"
+	TopicRoomLight       = "room-light"
+	TopicRoomLeak        = "room-leak"
+	TopicRoomSmoke       = "room-smoke"
+	TopicRoomContact     = "room-contact"
+)
+
+// SensorTopics are the filters of every room sensor reading
+var SensorTopics = []string{
+	RoomTopic(TopicRoomTemperature, "+"),
+	RoomTopic(TopicRoomHumidity, "+"),
+	RoomTopic(TopicRoomMotion, "+"),
+	RoomTopic(TopicRoomLight, "+"),
+	RoomTopic(TopicRoomLeak, "+"),
+	RoomTopic(TopicRoomSmoke, "+"),
+	RoomTopic(TopicRoomContact, "+"),
+}
+
+// Topic joins topic levels, e.g. Topic("tapo", id, "energy")
+func Topic(levels ...string) string {
+	return strings.Join(levels, "/")
+}
+
+// RoomTopic returns the topic of a room sensor; "+" matches every room
+func RoomTopic(root, roomID string) string {
+	return Topic(root, roomID)
+}
+
+// TapoEnergyTopic carries the energy readings of a Tapo plug
+func TapoEnergyTopic(deviceID string) string {
+	return Topic("tapo", deviceID, "energy")
+}
+
+// TapoCycleTopic carries the appliance cycles detected on a Tapo plug
+func TapoCycleTopic(deviceID string) string {
+	return Topic("tapo", deviceID, "cycle")
+}
+
+// ThermostatControlTopic carries HVAC control commands of a thermostat
+func ThermostatControlTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "control")
+}
+
+// ThermostatCommandTopic carries setpoint and mode commands of a thermostat
+func ThermostatCommandTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "command")
+}
+
+// ThermostatScheduleTopic carries the retained weekly schedule and hold of a thermostat
+func ThermostatScheduleTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "schedule")
+}
+
+// ThermostatScheduleSetTopic carries edits of a thermostat's weekly schedule
+func ThermostatScheduleSetTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "schedule", "set")
+}
+
+// ThermostatHoldTopic carries manual holds of a thermostat's setpoint; an empty payload resumes
+// the schedule
+func ThermostatHoldTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "hold")
+}
+
+// ThermostatFanTopic carries fan mode and speed changes of a thermostat, as a fan settings object
+// or a bare mode
+func ThermostatFanTopic(thermostatID string) string {
+	return Topic("thermostat", thermostatID, "fan")
+}
+
+// HVACPlantTopic carries the retained mode of a zoned HVAC system and the zones it serves
+func HVACPlantTopic(systemID string) string {
+	return Topic("hvac", systemID, "plant")
+}
+
+// HVACDamperTopic carries the retained position of a zone damper or valve of an HVAC system
+func HVACDamperTopic(systemID, damperID string) string {
+	return Topic("hvac", systemID, "damper", damperID)
+}
+
+// AutomationTopic carries the automation events of a room
+func AutomationTopic(roomID string) string {
+	return Topic("automation", roomID)
+}
+
+// AutomationFeedbackTopic carries user feedback on the automation activations of a room
+func AutomationFeedbackTopic(roomID string) string {
+	return Topic("automation", roomID, "feedback")
+}
+
+// GatewayTopic carries retained events of the gateway itself, e.g. GatewayTopic("power") for
+// its UPS state and an imminent shutdown
+func GatewayTopic(event string) string {
+	return Topic("home", "gateway", event)
+}
+
+// PresenceTopic carries the retained home or away state of a resident, e.g. PresenceTopic("alex")
+func PresenceTopic(resident string) string {
+	return Topic("home", "presence", resident)
+}
+
+// OccupancyTopic carries the retained whole-home occupancy: home while any resident is
+const OccupancyTopic = "home/occupancy"
+
+// HomeModeTopic carries the retained mode of the home: home, away, night or vacation
+const HomeModeTopic = "home/mode"
+
+// GridTopic carries the retained solar production, grid power and electricity price
+const GridTopic = "home/energy/grid"
+
+// OTAUpdateTopic carries the retained firmware update command of a Pico; an empty payload
+// clears it
+func OTAUpdateTopic(deviceID string) string {
+	return Topic("home", "ota", deviceID, "update")
+}
+
+// OTAStatusTopic carries a Pico's progress installing a firmware update; "+" matches every Pico
+func OTAStatusTopic(deviceID string) string {
+	return Topic("home", "ota", deviceID, "status")
+}
+
+// DeviceStateTopic carries the state of a device
+func DeviceStateTopic(deviceID string) string {
+	return Topic("homeautomation", "devices", deviceID, "state")
+}
+
+// SensorReadingTopic carries the readings of a generic sensor
+func SensorReadingTopic(sensorID string) string {
+	return Topic("homeautomation", "sensors", sensorID, "reading")
+}
+
+// PluginStatusTopic carries a plugin's retained online or offline state; "+" matches every plugin
+func PluginStatusTopic(plugin string) string {
+	return Topic("plugins", plugin, "status")
+}
+
+// PluginDevicesTopic carries the retained list of devices a plugin handles
+func PluginDevicesTopic(plugin string) string {
+	return Topic("plugins", plugin, "devices")
+}
+
+// PluginDeviceStateTopic carries the state of a device a plugin handles
+func PluginDeviceStateTopic(plugin, deviceID string) string {
+	return Topic("plugins", plugin, "devices", deviceID, "state")
+}
+
+// PluginDeviceCommandTopic carries the commands for a device a plugin handles
+func PluginDeviceCommandTopic(plugin, deviceID string) string {
+	return Topic("plugins", plugin, "devices", deviceID, "command")
+}
+
+// PluginActionTopic carries the requests for one of a plugin's automation actions
+func PluginActionTopic(plugin, action string) string {
+	return Topic("plugins", plugin, "actions", action)
+}
+
+// Namespace prefixes every topic on the wire, e.g. home1/room-temp/kitchen, so several houses
+// or test environments can share a broker. Services use topics without the namespace; the
+// client adds it when publishing and subscribing and removes it from received topics.
+type Namespace string
+
+// NewNamespace normalizes a topic prefix such as "home1", "home1/" or "/home1/" to "home1/".
+// An empty prefix is the root namespace, which leaves topics unchanged.
+func NewNamespace(prefix string) Namespace {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return Namespace(prefix + "/")
+}
+
+// Apply returns the wire topic of a topic or filter. Shared subscriptions keep their
+// $share/<group>/ prefix in front, and broker $SYS topics are left alone.
+func (n Namespace) Apply(topic string) string {
+	if n == "" || strings.HasPrefix(topic, "$SYS") {
+		return topic
+	}
+	if rest, shared := strings.CutPrefix(topic, sharedPrefix); shared {
+		if group, filter, found := strings.Cut(rest, "/"); found {
+			return SharedTopic(group, string(n)+filter)
+		}
+	}
+	return string(n) + topic
+}
+
+// Strip returns the topic of a received wire topic without the namespace, and false if the
+// topic belongs to another namespace
+func (n Namespace) Strip(topic string) (string, bool) {
+	if n == "" {
+		return topic, true
+	}
+	return strings.CutPrefix(topic, string(n))
+}
+
+// ApplyAll returns the wire topics of several topics or filters
+func (n Namespace) ApplyAll(topics []string) []string {
+	wire := make([]string, len(topics))
+	for i, topic := range topics {
+		wire[i] = n.Apply(topic)
+	}
+	return wire
+}
+
+// Namespace returns the topic namespace of the client, set by MQTT_TOPIC_PREFIX
+func (c *Client) Namespace() Namespace {
+	return NewNamespace(c.config.TopicPrefix)
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestTopicBuilders(t *testing.T) {
+	tests := map[string]string{
+		RoomTopic(TopicRoomTemperature, "kitchen"): "room-temp/kitchen",
+		RoomTopic(TopicRoomHumidity, "+"):          "room-hum/+",
+		TapoEnergyTopic("washer"):                  "tapo/washer/energy",
+		ThermostatCommandTopic("living-room"):      "thermostat/living-room/command",
+		AutomationTopic("hall"):                    "automation/hall",
+		AutomationFeedbackTopic("hall"):            "automation/hall/feedback",
+		GatewayTopic("power"):                      "home/gateway/power",
+		PluginActionTopic("zigbee", "pair"):        "plugins/zigbee/actions/pair",
+	}
+	for got, want := range tests {
+		if got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	for _, prefix := range []string{"home1", "home1/", "/home1/"} {
+		if namespace := NewNamespace(prefix); namespace != "home1/" {
+			t.Errorf("Expected %q to normalize to home1/, got %q", prefix, namespace)
+		}
+	}
+
+	namespace := NewNamespace("home1")
+	tests := map[string]string{
+		"room-temp/kitchen":                      "home1/room-temp/kitchen",
+		SharedTopic("scrapers", "tapo/+/energy"): "$share/scrapers/home1/tapo/+/energy",
+		"$SYS/broker/uptime":                     "$SYS/broker/uptime",
+	}
+	for topic, want := range tests {
+		if got := namespace.Apply(topic); got != want {
+			t.Errorf("Expected %s to become %s, got %s", topic, want, got)
+		}
+	}
+
+	if topic, ours := namespace.Strip("home1/room-temp/kitchen"); !ours || topic != "room-temp/kitchen" {
+		t.Errorf("Expected room-temp/kitchen, got %s (%v)", topic, ours)
+	}
+	if _, ours := namespace.Strip("home2/room-temp/kitchen"); ours {
+		t.Error("Expected a topic of another namespace not to be ours")
+	}
+	if topic, ours := NewNamespace("").Strip("room-temp/kitchen"); !ours || topic != "room-temp/kitchen" {
+		t.Errorf("Expected the root namespace to keep topics, got %s", topic)
+	}
+}
+
+func TestClientNamespace(t *testing.T) {
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883", TopicPrefix: "home1/"}, &ClientOptions{Service: "thermostat"})
+	client.setState(StateConnected)
+
+	var topics []string
+	client.Subscribe(RoomTopic(TopicRoomTemperature, "+"), func(topic string, payload []byte) error {
+		topics = append(topics, topic)
+		return nil
+	})
+
+	// Handlers see topics without the namespace, and other houses on the broker are ignored
+	client.dispatch("home1/room-temp/kitchen", []byte("21.5"))
+	client.dispatch("home2/room-temp/kitchen", []byte("18.0"))
+	if len(topics) != 1 || topics[0] != "room-temp/kitchen" {
+		t.Errorf("Expected only room-temp/kitchen, got %v", topics)
+	}
+
+	if will := client.Will(); will.Topic != "home1/home/service/thermostat/status" {
+		t.Errorf("Expected the last will in the namespace, got %s", will.Topic)
+	}
+}
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"context"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+	"github.com/johnpr01/home-automation/internal/tracing"
+)
+
+// PropertyTraceParent is the user property carrying the W3C trace context of a message, so a
+// trace continues in the service that receives it. It needs MQTT v5 between services; within a
+// process, and over loopback, the context is handed on directly.
+const PropertyTraceParent = "traceparent"
+
+// ContextHandler receives a message with a context carrying its trace, for the spans of the
+// work it causes and the messages published in turn
+type ContextHandler func(ctx context.Context, topic string, payload []byte) error
+
+// SubscribeContext subscribes a handler that continues the trace of each message it receives
+func (c *Client) SubscribeContext(topic string, handler ContextHandler) error {
+	if topic == "" {
+		return errors.NewValidationError("topic cannot be empty", nil)
+	}
+
+	if handler == nil {
+		return errors.NewValidationError("handler cannot be nil", nil)
+	}
+
+	if !c.isConnected() {
+		return errors.NewMQTTError("client is not connected", nil)
+	}
+
+	operation := func() error {
+		if err := c.subscribe(topic); err != nil {
+			return err
+		}
+		c.handlersMutex.Lock()
+		c.contextHandlers[topic] = handler
+		c.handlersMutex.Unlock()
+
+		c.logger.Info("Subscribed to MQTT topic", map[string]interface{}{
+			"topic":  c.Namespace().Apply(topic),
+			"traced": true,
+		})
+		return nil
+	}
+
+	return c.circuitBreaker.Execute(operation)
+}
+
+// PublishContext publishes a message within the trace ctx carries, recording the publish as a
+// span and sending its trace context with the message
+func (c *Client) PublishContext(ctx context.Context, msg *Message) error {
+	if msg == nil {
+		return c.Publish(msg)
+	}
+
+	ctx, span := tracing.Start(ctx, "mqtt publish", tracing.KindProducer)
+	defer span.End()
+	span.SetAttribute("messaging.system", "mqtt")
+	span.SetAttribute("messaging.destination.name", msg.Topic)
+
+	if traceParent := tracing.Inject(ctx); traceParent != "" {
+		traced := *msg
+		traced.Properties = make(map[string]string, len(msg.Properties)+1)
+		for key, value := range msg.Properties {
+			traced.Properties[key] = value
+		}
+		traced.Properties[PropertyTraceParent] = traceParent
+		msg = &traced
+	}
+
+	err := c.Publish(msg)
+	span.RecordError(err)
+	return err
+}
+
+// deliverTraced hands a decrypted message to the context handlers matching its topic, within
+// a span continuing the trace it was published in
+func (c *Client) deliverTraced(msg *Message) {
+	c.handlersMutex.RLock()
+	var handlers []ContextHandler
+	for subscription, handler := range c.contextHandlers {
+		if TopicMatches(subscriptionFilter(subscription), msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.handlersMutex.RUnlock()
+
+	var ctx context.Context
+	var span *tracing.Span
+	for _, handler := range handlers {
+		if ctx == nil {
+			ctx, span = tracing.Start(tracing.Extract(context.Background(), msg.Property(PropertyTraceParent)), "mqtt receive", tracing.KindConsumer)
+			defer span.End()
+			span.SetAttribute("messaging.system", "mqtt")
+			span.SetAttribute("messaging.destination.name", msg.Topic)
+		}
+		if err := handler(ctx, msg.Topic, msg.Payload); err != nil {
+			span.RecordError(err)
+			c.logger.Error("MQTT message handler failed", err, map[string]interface{}{
+				"topic": msg.Topic,
+			})
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"strings"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Protocol versions as sent in the CONNECT packet
+const (
+	ProtocolV311 byte = 4 // MQTT 3.1.1, the default
+	ProtocolV5   byte = 5
+)
+
+// User properties set by the publish helpers
+const (
+	PropertyRoom   = "room"
+	PropertyDevice = "device_id"
+	PropertySensor = "sensor_id"
+)
+
+// sharedPrefix starts a shared subscription, $share/<group>/<filter>
+const sharedPrefix = "$share/"
+
+// PropertyHandler receives a message with its MQTT v5 properties. Against a v3.1.1 broker
+// the properties are always empty.
+type PropertyHandler func(msg *Message) error
+
+// WithProperty sets a user property, e.g. the room a reading belongs to. It returns the message.
+func (m *Message) WithProperty(key, value string) *Message {
+	if m.Properties == nil {
+		m.Properties = make(map[string]string)
+	}
+	m.Properties[key] = value
+	return m
+}
+
+// Property returns a user property, or "" if the message doesn't carry it
+func (m *Message) Property(key string) string {
+	return m.Properties[key]
+}
+
+// SharedTopic returns the shared subscription of a group to a filter. The broker hands each
+// message to one member of the group, so instances of a scaled-out service split the load.
+func SharedTopic(group, filter string) string {
+	return sharedPrefix + group + "/" + filter
+}
+
+// subscriptionFilter returns the topic filter of a subscription, without a $share/<group>/ prefix
+func subscriptionFilter(subscription string) string {
+	rest, shared := strings.CutPrefix(subscription, sharedPrefix)
+	if !shared {
+		return subscription
+	}
+	if _, filter, found := strings.Cut(rest, "/"); found {
+		return filter
+	}
+	return subscription
+}
+
+// ProtocolVersion returns the MQTT version the client speaks
+func (c *Client) ProtocolVersion() byte {
+	if c.config.ProtocolVersion == ProtocolV5 {
+		return ProtocolV5
+	}
+	return ProtocolV311
+}
+
+// SubscribeShared joins a shared subscription group. A v3.1.1 broker has no shared subscriptions,
+// so the client subscribes to the plain filter and every instance receives every message.
+func (c *Client) SubscribeShared(group, filter string, handler MessageHandler) error {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return errors.NewValidationError("shared subscription group must be a non-empty topic level", nil).
+			WithContext("group", group)
+	}
+
+	if c.ProtocolVersion() < ProtocolV5 {
+		c.logger.Warn("Shared subscriptions need MQTT v5, subscribing to every message", map[string]interface{}{
+			"group": group,
+			"topic": filter,
+		})
+		return c.Subscribe(filter, handler)
+	}
+	return c.Subscribe(SharedTopic(group, filter), handler)
+}
+
+// SubscribeWithProperties subscribes a handler that also receives the message properties,
+// e.g. to read the room of a reading from its user properties instead of its topic
+func (c *Client) SubscribeWithProperties(topic string, handler PropertyHandler) error {
+	if topic == "" {
+		return errors.NewValidationError("topic cannot be empty", nil)
+	}
+
+	if handler == nil {
+		return errors.NewValidationError("handler cannot be nil", nil)
+	}
+
+	if !c.isConnected() {
+		return errors.NewMQTTError("client is not connected", nil)
+	}
+
+	operation := func() error {
+		if err := c.subscribe(topic); err != nil {
+			return err
+		}
+		c.handlersMutex.Lock()
+		c.propertyHandlers[topic] = handler
+		c.handlersMutex.Unlock()
+
+		c.logger.Info("Subscribed to MQTT topic", map[string]interface{}{
+			"topic":      c.Namespace().Apply(topic),
+			"properties": true,
+		})
+		return nil
+	}
+
+	return c.circuitBreaker.Execute(operation)
+}
+
+// v5Fields adds the properties of a message to its publish log, or notes they are dropped
+// when the broker only speaks v3.1.1
+func (c *Client) v5Fields(msg *Message, fields map[string]interface{}) {
+	if msg.Expiry == 0 && len(msg.Properties) == 0 {
+		return
+	}
+	if c.ProtocolVersion() < ProtocolV5 {
+		fields["v5_properties_dropped"] = true
+		return
+	}
+	if msg.Expiry > 0 {
+		fields["expiry"] = msg.Expiry.String()
+	}
+	if len(msg.Properties) > 0 {
+		fields["properties"] = msg.Properties
+	}
+}
+
+// expiresAt returns when a message expires, or the zero time if it never does
+func (m *Message) expiresAt(from time.Time) time.Time {
+	if m.Expiry <= 0 {
+		return time.Time{}
+	}
+	return from.Add(m.Expiry)
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/config"
+)
+
+func TestSharedSubscriptions(t *testing.T) {
+	if filter := subscriptionFilter(SharedTopic("tapo-scrapers", "tapo/+/energy")); filter != "tapo/+/energy" {
+		t.Errorf("Expected the shared prefix to be stripped, got %s", filter)
+	}
+	if filter := subscriptionFilter("room-temp/+"); filter != "room-temp/+" {
+		t.Errorf("Expected a plain filter to be unchanged, got %s", filter)
+	}
+
+	v5 := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883", ProtocolVersion: ProtocolV5}, nil)
+	v5.setState(StateConnected)
+	received := 0
+	if err := v5.SubscribeShared("tapo-scrapers", "tapo/+/energy", func(topic string, payload []byte) error {
+		received++
+		return nil
+	}); err != nil {
+		t.Fatalf("SubscribeShared failed: %v", err)
+	}
+	if _, ok := v5.handlers["$share/tapo-scrapers/tapo/+/energy"]; !ok {
+		t.Errorf("Expected a shared subscription with MQTT v5, got %v", v5.handlers)
+	}
+	v5.dispatch("tapo/washer/energy", []byte("42"))
+	if received != 1 {
+		t.Errorf("Expected the shared subscription to receive the message, got %d", received)
+	}
+
+	// v3.1.1 brokers have no shared subscriptions
+	v311 := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883"}, nil)
+	v311.setState(StateConnected)
+	v311.SubscribeShared("tapo-scrapers", "tapo/+/energy", func(topic string, payload []byte) error { return nil })
+	if _, ok := v311.handlers["tapo/+/energy"]; !ok {
+		t.Errorf("Expected a plain subscription with MQTT 3.1.1, got %v", v311.handlers)
+	}
+
+	if err := v5.SubscribeShared("a/b", "tapo/#", func(topic string, payload []byte) error { return nil }); err == nil {
+		t.Error("Expected a group with a topic separator to be rejected")
+	}
+}
+
+func TestPropertyHandlersReceiveUserProperties(t *testing.T) {
+	client := NewClient(&config.MQTTConfig{Broker: "localhost", Port: "1883", ProtocolVersion: ProtocolV5}, nil)
+	client.setState(StateConnected)
+
+	var room string
+	client.SubscribeWithProperties("room-temp/+", func(msg *Message) error {
+		room = msg.Property(PropertyRoom)
+		return nil
+	})
+
+	msg := (&Message{Topic: "room-temp/3", Payload: []byte("70.5")}).WithProperty(PropertyRoom, "living-room")
+	if err := client.dispatchMessage(msg); err != nil {
+		t.Fatalf("dispatchMessage failed: %v", err)
+	}
+	if room != "living-room" {
+		t.Errorf("Expected the room user property, got %q", room)
+	}
+}
+
+func TestStateCacheSkipsExpiredMessages(t *testing.T) {
+	cache, _ := NewStateCache("", 0)
+	now := time.Now()
+	cache.StoreExpiring("thermostat/1/control", []byte("heat"), now.Add(-time.Hour), now.Add(-time.Minute))
+	cache.StoreExpiring("thermostat/2/control", []byte("cool"), now, now.Add(time.Minute))
+	cache.Store("thermostat/3/control", []byte("idle"), now.Add(-time.Hour))
+
+	matching := cache.Matching([]string{"thermostat/+/control"}, now)
+	if len(matching) != 2 || matching[0].Topic != "thermostat/2/control" {
+		t.Errorf("Expected only the expired message to be skipped, got %+v", matching)
+	}
+}
@@ -0,0 +1,154 @@
+// Package nut reads UPS state from a Network UPS Tools server (upsd) over its line protocol,
+// by default on port 3493. Only the read-only LIST VAR command is used, so no login is needed.
+package nut
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAddress is the upsd listener on the gateway itself
+const DefaultAddress = "localhost:3493"
+
+// Flags of the ups.status variable
+const (
+	FlagOnline     = "OL"
+	FlagOnBattery  = "OB"
+	FlagLowBattery = "LB"
+	FlagCharging   = "CHRG"
+	FlagShutdown   = "FSD" // Forced shutdown, set by the primary upsmon
+)
+
+// Status is the state of a UPS. Charge and RuntimeSec are -1 when the driver doesn't report them.
+type Status struct {
+	Flags      []string `json:"flags"`
+	OnBattery  bool     `json:"on_battery"`
+	LowBattery bool     `json:"low_battery"`
+	Charging   bool     `json:"charging"`
+	Shutdown   bool     `json:"forced_shutdown"`
+	Charge     float64  `json:"charge"`      // battery.charge, %
+	RuntimeSec float64  `json:"runtime_sec"` // battery.runtime, seconds left on battery
+	LoadPct    float64  `json:"load_pct"`    // ups.load, % of rated power
+	Model      string   `json:"model,omitempty"`
+}
+
+// ParseStatus reads the state of a UPS from its variables
+func ParseStatus(vars map[string]string) Status {
+	status := Status{
+		Flags:      strings.Fields(vars["ups.status"]),
+		Charge:     number(vars, "battery.charge"),
+		RuntimeSec: number(vars, "battery.runtime"),
+		LoadPct:    number(vars, "ups.load"),
+		Model:      strings.TrimSpace(vars["device.mfr"] + " " + vars["ups.model"]),
+	}
+	for _, flag := range status.Flags {
+		switch flag {
+		case FlagOnBattery:
+			status.OnBattery = true
+		case FlagLowBattery:
+			status.LowBattery = true
+		case FlagCharging:
+			status.Charging = true
+		case FlagShutdown:
+			status.Shutdown = true
+		}
+	}
+	return status
+}
+
+func number(vars map[string]string, name string) float64 {
+	value, err := strconv.ParseFloat(vars[name], 64)
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+// Client reads UPS variables from upsd, opening a connection per request
+type Client struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClient creates a client for the upsd at address, DefaultAddress when empty
+func NewClient(address string) *Client {
+	if address == "" {
+		address = DefaultAddress
+	}
+	return &Client{address: address, timeout: 5 * time.Second}
+}
+
+// Status returns the state of a UPS
+func (c *Client) Status(ctx context.Context, ups string) (Status, error) {
+	vars, err := c.Variables(ctx, ups)
+	if err != nil {
+		return Status{}, err
+	}
+	return ParseStatus(vars), nil
+}
+
+// Variables lists every variable of a UPS
+func (c *Client) Variables(ctx context.Context, ups string) (map[string]string, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upsd at %s: %w", c.address, err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := fmt.Fprintf(conn, "LIST VAR %s\n", ups); err != nil {
+		return nil, fmt.Errorf("failed to send LIST VAR: %w", err)
+	}
+
+	vars := make(map[string]string)
+	prefix := "VAR " + ups + " "
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "ERR "):
+			return nil, fmt.Errorf("upsd error for %s: %s", ups, strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "BEGIN LIST VAR"):
+		case strings.HasPrefix(line, "END LIST VAR"):
+			fmt.Fprint(conn, "LOGOUT\n")
+			return vars, nil
+		case strings.HasPrefix(line, prefix):
+			name, value, found := strings.Cut(strings.TrimPrefix(line, prefix), " ")
+			if !found {
+				return nil, fmt.Errorf("invalid upsd line %q", line)
+			}
+			vars[name] = unquote(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from upsd: %w", err)
+	}
+	return nil, fmt.Errorf("upsd closed the connection before listing %s", ups)
+}
+
+// unquote removes the quotes around a value and its backslash escapes
+func unquote(value string) string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+	var b strings.Builder
+	escaped := false
+	for _, r := range value {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
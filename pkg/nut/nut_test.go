@@ -0,0 +1,75 @@
+package nut
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeUPSD answers LIST VAR for the "ups" UPS and rejects every other name
+func fakeUPSD(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					switch line := scanner.Text(); line {
+					case "LIST VAR ups":
+						conn.Write([]byte("BEGIN LIST VAR ups\n" +
+							"VAR ups battery.charge \"42\"\n" +
+							"VAR ups battery.runtime \"540\"\n" +
+							"VAR ups device.mfr \"APC\"\n" +
+							"VAR ups ups.model \"Back-UPS \\\"ES\\\" 700\"\n" +
+							"VAR ups ups.status \"OB DISCHRG\"\n" +
+							"END LIST VAR ups\n"))
+					case "LOGOUT":
+						conn.Write([]byte("OK Goodbye\n"))
+						return
+					default:
+						conn.Write([]byte("ERR UNKNOWN-UPS\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClientStatus(t *testing.T) {
+	client := NewClient(fakeUPSD(t))
+
+	status, err := client.Status(context.Background(), "ups")
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !status.OnBattery || status.LowBattery || status.Charge != 42 || status.RuntimeSec != 540 || status.LoadPct != -1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if status.Model != `APC Back-UPS "ES" 700` {
+		t.Errorf("Unexpected model %q", status.Model)
+	}
+
+	if _, err := client.Status(context.Background(), "other"); err == nil || !strings.Contains(err.Error(), "UNKNOWN-UPS") {
+		t.Errorf("Expected an unknown UPS error, got %v", err)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	status := ParseStatus(map[string]string{"ups.status": "OB LB FSD", "battery.charge": "8"})
+	if !status.OnBattery || !status.LowBattery || !status.Shutdown || status.Charging || status.RuntimeSec != -1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
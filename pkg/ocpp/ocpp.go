@@ -0,0 +1,451 @@
+// Package ocpp is a small OCPP 1.6J central system. EV chargers connect to its WebSocket at a URL
+// ending in their charge point identity, report their status and meter values, and accept a
+// charging profile pausing them. Every charge and ID tag is accepted.
+package ocpp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Subprotocol is the WebSocket subprotocol of OCPP 1.6 over JSON
+const Subprotocol = "ocpp1.6"
+
+// Actions of events besides the messages of the charge point
+const (
+	ActionConnected    = "Connected"
+	ActionDisconnected = "Disconnected"
+)
+
+// Measurands read from MeterValues
+const (
+	MeasurandEnergy = "Energy.Active.Import.Register"
+	MeasurandPower  = "Power.Active.Import"
+)
+
+const (
+	messageCall       = 2
+	messageCallResult = 3
+	messageCallError  = 4
+
+	heartbeatSeconds = 300
+	maxMessageBytes  = 64 << 10
+	// pauseProfileID identifies the charging profile pausing a connector, so clearing it leaves
+	// profiles set by others alone
+	pauseProfileID = 100
+)
+
+// Event is a message from a charge point, or its connection opening or closing
+type Event struct {
+	ChargePointID string
+	Action        string // e.g. BootNotification, StatusNotification, MeterValues or Connected
+	ConnectorID   int
+	Status        string // StatusNotification: Available, Preparing, Charging, SuspendedEV, ...
+	ErrorCode     string // StatusNotification, NoError when all is well
+	Vendor        string // BootNotification
+	Model         string // BootNotification
+	// PowerW and EnergyWh are the active import power and register of MeterValues, and the
+	// meter at the start and stop of a transaction
+	PowerW        *float64
+	EnergyWh      *float64
+	TransactionID int
+	Time          time.Time
+}
+
+// Server accepts charge point connections and sends them requests
+type Server struct {
+	passwords   map[string]string
+	connections map[string]*connection
+	callbacks   []func(Event)
+	transaction int
+	mu          sync.Mutex
+}
+
+type connection struct {
+	conn    *websocket.Conn
+	nextID  int
+	pending map[string]chan []json.RawMessage
+	writeMu sync.Mutex
+}
+
+// NewServer creates a central system for the charge points keyed by identity. A charge point
+// with a password must send it with HTTP basic authentication, as in OCPP security profile 1.
+// Without charge points any may connect.
+func NewServer(passwords map[string]string) *Server {
+	return &Server{
+		passwords:   passwords,
+		connections: make(map[string]*connection),
+		transaction: int(time.Now().Unix() % 1000000000),
+	}
+}
+
+// AddEventCallback registers a callback for every event. Callbacks run on the connection's
+// reader, so they must not block or send the charge point requests themselves.
+func (s *Server) AddEventCallback(callback func(Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// Handler serves the charge points' WebSocket, e.g. ws://host:port/ocpp/{charge point ID}
+func (s *Server) Handler() http.Handler {
+	return websocket.Server{Handshake: s.handshake, Handler: s.serve}
+}
+
+// Connected reports whether a charge point is connected
+func (s *Server) Connected(chargePointID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections[chargePointID] != nil
+}
+
+// Pause sets a charging profile limiting a connector to 0 A, which chargers keep across charges
+// and restarts until it's cleared
+func (s *Server) Pause(ctx context.Context, chargePointID string, connectorID int) error {
+	request := map[string]interface{}{
+		"connectorId": connectorID,
+		"csChargingProfiles": map[string]interface{}{
+			"chargingProfileId":      pauseProfileID,
+			"stackLevel":             1,
+			"chargingProfilePurpose": "TxDefaultProfile",
+			"chargingProfileKind":    "Relative",
+			"chargingSchedule": map[string]interface{}{
+				"chargingRateUnit":       "A",
+				"chargingSchedulePeriod": []map[string]interface{}{{"startPeriod": 0, "limit": 0}},
+			},
+		},
+	}
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := s.Call(ctx, chargePointID, "SetChargingProfile", request, &result); err != nil {
+		return err
+	}
+	if result.Status != "Accepted" {
+		return errors.NewDeviceError(fmt.Sprintf("%s answered %s to the pause profile", chargePointID, result.Status), nil)
+	}
+	return nil
+}
+
+// Resume clears the profile set by Pause
+func (s *Server) Resume(ctx context.Context, chargePointID string, connectorID int) error {
+	request := map[string]interface{}{"id": pauseProfileID, "connectorId": connectorID}
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := s.Call(ctx, chargePointID, "ClearChargingProfile", request, &result); err != nil {
+		return err
+	}
+	// Unknown: there was no pause to clear
+	if result.Status != "Accepted" && result.Status != "Unknown" {
+		return errors.NewDeviceError(fmt.Sprintf("%s answered %s to clearing the pause profile", chargePointID, result.Status), nil)
+	}
+	return nil
+}
+
+// Configure changes a configuration key of a charge point, e.g. MeterValueSampleInterval
+func (s *Server) Configure(ctx context.Context, chargePointID, key, value string) error {
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := s.Call(ctx, chargePointID, "ChangeConfiguration", map[string]string{"key": key, "value": value}, &result); err != nil {
+		return err
+	}
+	if result.Status != "Accepted" && result.Status != "RebootRequired" {
+		return errors.NewDeviceError(fmt.Sprintf("%s answered %s to setting %s", chargePointID, result.Status, key), nil)
+	}
+	return nil
+}
+
+// Call sends a request to a charge point and waits for its result, decoding it into result
+// when non-nil
+func (s *Server) Call(ctx context.Context, chargePointID, action string, request, result interface{}) error {
+	s.mu.Lock()
+	c := s.connections[chargePointID]
+	if c == nil {
+		s.mu.Unlock()
+		return errors.NewConnectionError(fmt.Sprintf("charge point %s is not connected", chargePointID), nil)
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	replies := make(chan []json.RawMessage, 1)
+	c.pending[id] = replies
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(c.pending, id)
+		s.mu.Unlock()
+	}()
+
+	if err := c.send([]interface{}{messageCall, id, action, request}); err != nil {
+		return errors.NewConnectionError(fmt.Sprintf("failed to send %s to %s", action, chargePointID), err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return errors.NewConnectionError(fmt.Sprintf("%s to %s timed out", action, chargePointID), ctx.Err())
+	case reply, ok := <-replies:
+		if !ok {
+			return errors.NewConnectionError(fmt.Sprintf("%s disconnected during %s", chargePointID, action), nil)
+		}
+		var messageType int
+		json.Unmarshal(reply[0], &messageType)
+		if messageType == messageCallError {
+			var code, description string
+			if len(reply) > 3 {
+				json.Unmarshal(reply[2], &code)
+				json.Unmarshal(reply[3], &description)
+			}
+			return errors.NewDeviceError(fmt.Sprintf("%s failed on %s: %s %s", action, chargePointID, code, description), nil)
+		}
+		if result != nil && len(reply) > 2 {
+			if err := json.Unmarshal(reply[2], result); err != nil {
+				return errors.NewDeviceError(fmt.Sprintf("invalid %s result from %s", action, chargePointID), err)
+			}
+		}
+		return nil
+	}
+}
+
+// handshake admits known charge points speaking OCPP 1.6
+func (s *Server) handshake(config *websocket.Config, req *http.Request) error {
+	id := path.Base(req.URL.Path)
+	if len(s.passwords) > 0 {
+		password, known := s.passwords[id]
+		if !known {
+			return fmt.Errorf("unknown charge point %s", id)
+		}
+		if password != "" {
+			user, given, ok := req.BasicAuth()
+			if !ok || user != id || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+				return fmt.Errorf("charge point %s failed to authenticate", id)
+			}
+		}
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == Subprotocol {
+			config.Protocol = []string{Subprotocol}
+			return nil
+		}
+	}
+	return fmt.Errorf("charge point %s doesn't speak %s", id, Subprotocol)
+}
+
+// serve reads a charge point's messages until it disconnects. A reconnecting charge point
+// replaces its previous connection.
+func (s *Server) serve(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = maxMessageBytes
+	id := path.Base(conn.Request().URL.Path)
+	c := &connection{conn: conn, pending: make(map[string]chan []json.RawMessage)}
+
+	s.mu.Lock()
+	previous := s.connections[id]
+	s.connections[id] = c
+	s.mu.Unlock()
+	if previous != nil {
+		previous.conn.Close()
+	}
+	s.dispatch(Event{ChargePointID: id, Action: ActionConnected, Time: time.Now()})
+
+	defer func() {
+		s.mu.Lock()
+		for messageID, replies := range c.pending {
+			close(replies)
+			delete(c.pending, messageID)
+		}
+		current := s.connections[id] == c
+		if current {
+			delete(s.connections, id)
+		}
+		s.mu.Unlock()
+		conn.Close()
+		if current {
+			s.dispatch(Event{ChargePointID: id, Action: ActionDisconnected, Time: time.Now()})
+		}
+	}()
+
+	for {
+		var text string
+		if err := websocket.Message.Receive(conn, &text); err != nil {
+			return
+		}
+		var message []json.RawMessage
+		if err := json.Unmarshal([]byte(text), &message); err != nil || len(message) < 3 {
+			continue
+		}
+		var messageType int
+		var messageID string
+		json.Unmarshal(message[0], &messageType)
+		json.Unmarshal(message[1], &messageID)
+
+		switch messageType {
+		case messageCall:
+			var action string
+			json.Unmarshal(message[2], &action)
+			var payload json.RawMessage
+			if len(message) > 3 {
+				payload = message[3]
+			}
+			s.handleCall(c, id, messageID, action, payload)
+		case messageCallResult, messageCallError:
+			s.mu.Lock()
+			replies, ok := c.pending[messageID]
+			s.mu.Unlock()
+			if ok {
+				replies <- message
+			}
+		}
+	}
+}
+
+// handleCall answers a charge point's request and reports it as an event
+func (s *Server) handleCall(c *connection, id, messageID, action string, payload json.RawMessage) {
+	now := time.Now()
+	event := Event{ChargePointID: id, Action: action, Time: now}
+	accepted := map[string]string{"status": "Accepted"}
+	var response interface{} = struct{}{}
+
+	switch action {
+	case "BootNotification":
+		var boot struct {
+			Vendor string `json:"chargePointVendor"`
+			Model  string `json:"chargePointModel"`
+		}
+		json.Unmarshal(payload, &boot)
+		event.Vendor, event.Model = boot.Vendor, boot.Model
+		response = map[string]interface{}{"status": "Accepted", "currentTime": now.UTC().Format(time.RFC3339), "interval": heartbeatSeconds}
+	case "Heartbeat":
+		response = map[string]string{"currentTime": now.UTC().Format(time.RFC3339)}
+	case "StatusNotification":
+		var status struct {
+			ConnectorID int    `json:"connectorId"`
+			Status      string `json:"status"`
+			ErrorCode   string `json:"errorCode"`
+		}
+		json.Unmarshal(payload, &status)
+		event.ConnectorID, event.Status, event.ErrorCode = status.ConnectorID, status.Status, status.ErrorCode
+	case "MeterValues":
+		var values struct {
+			ConnectorID   int          `json:"connectorId"`
+			TransactionID int          `json:"transactionId"`
+			MeterValue    []meterValue `json:"meterValue"`
+		}
+		json.Unmarshal(payload, &values)
+		event.ConnectorID, event.TransactionID = values.ConnectorID, values.TransactionID
+		if len(values.MeterValue) > 0 {
+			last := values.MeterValue[len(values.MeterValue)-1]
+			event.PowerW, event.EnergyWh = last.read(MeasurandPower), last.read(MeasurandEnergy)
+		}
+	case "StartTransaction":
+		var start struct {
+			ConnectorID int     `json:"connectorId"`
+			MeterStart  float64 `json:"meterStart"`
+		}
+		json.Unmarshal(payload, &start)
+		s.mu.Lock()
+		s.transaction++
+		event.TransactionID = s.transaction
+		s.mu.Unlock()
+		event.ConnectorID, event.EnergyWh = start.ConnectorID, &start.MeterStart
+		response = map[string]interface{}{"transactionId": event.TransactionID, "idTagInfo": accepted}
+	case "StopTransaction":
+		var stop struct {
+			TransactionID int     `json:"transactionId"`
+			MeterStop     float64 `json:"meterStop"`
+		}
+		json.Unmarshal(payload, &stop)
+		event.TransactionID, event.EnergyWh = stop.TransactionID, &stop.MeterStop
+		response = map[string]interface{}{"idTagInfo": accepted}
+	case "Authorize":
+		response = map[string]interface{}{"idTagInfo": accepted}
+	case "DataTransfer":
+		response = map[string]string{"status": "UnknownVendorId"}
+	case "DiagnosticsStatusNotification", "FirmwareStatusNotification":
+	default:
+		c.send([]interface{}{messageCallError, messageID, "NotImplemented", action + " is not supported", struct{}{}})
+		return
+	}
+
+	c.send([]interface{}{messageCallResult, messageID, response})
+	s.dispatch(event)
+}
+
+func (s *Server) dispatch(event Event) {
+	s.mu.Lock()
+	callbacks := append([]func(Event){}, s.callbacks...)
+	s.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+// send writes a message; requests and replies may be sent from several goroutines
+func (c *connection) send(message []interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return websocket.Message.Send(c.conn, string(data))
+}
+
+type meterValue struct {
+	SampledValue []struct {
+		Value     string `json:"value"`
+		Measurand string `json:"measurand"`
+		Unit      string `json:"unit"`
+		Phase     string `json:"phase"`
+	} `json:"sampledValue"`
+}
+
+// read returns a measurand in W or Wh. A value without a phase is the total; when there is none,
+// the phases to neutral are summed.
+func (m meterValue) read(measurand string) *float64 {
+	var total, phases float64
+	var hasTotal, hasPhases bool
+	for _, sample := range m.SampledValue {
+		name := sample.Measurand
+		if name == "" {
+			name = MeasurandEnergy // The default measurand
+		}
+		if name != measurand {
+			continue
+		}
+		value, err := strconv.ParseFloat(sample.Value, 64)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(sample.Unit, "k") {
+			value *= 1000
+		}
+		switch {
+		case sample.Phase == "":
+			total, hasTotal = value, true
+		case sample.Phase != "N" && (strings.HasSuffix(sample.Phase, "-N") || !strings.Contains(sample.Phase, "-")):
+			phases += value
+			hasPhases = true
+		}
+	}
+	switch {
+	case hasTotal:
+		return &total
+	case hasPhases:
+		return &phases
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialChargePoint connects to the server as a charge point
+func dialChargePoint(t *testing.T, server *httptest.Server, id, password string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/ocpp/"+id, "http://localhost/")
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	config.Protocol = []string{Subprotocol}
+	if password != "" {
+		config.Header = http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+password))}}
+	}
+	return websocket.DialConfig(config)
+}
+
+func sendMessage(t *testing.T, conn *websocket.Conn, message ...interface{}) {
+	data, _ := json.Marshal(message)
+	if err := websocket.Message.Send(conn, string(data)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+}
+
+func receiveMessage(t *testing.T, conn *websocket.Conn) []json.RawMessage {
+	var text string
+	if err := websocket.Message.Receive(conn, &text); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	var message []json.RawMessage
+	if err := json.Unmarshal([]byte(text), &message); err != nil {
+		t.Fatalf("Invalid message %s: %v", text, err)
+	}
+	return message
+}
+
+func TestServer(t *testing.T) {
+	central := NewServer(map[string]string{"garage": "secret"})
+	events := make(chan Event, 10)
+	central.AddEventCallback(func(event Event) { events <- event })
+	server := httptest.NewServer(central.Handler())
+	defer server.Close()
+
+	if _, err := dialChargePoint(t, server, "garage", "wrong"); err == nil {
+		t.Fatal("Expected a wrong password refused")
+	}
+	if _, err := dialChargePoint(t, server, "neighbour", ""); err == nil {
+		t.Fatal("Expected an unknown charge point refused")
+	}
+	conn, err := dialChargePoint(t, server, "garage", "secret")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if event := <-events; event.Action != ActionConnected || event.ChargePointID != "garage" {
+		t.Fatalf("Expected the connection reported, got %+v", event)
+	}
+
+	sendMessage(t, conn, messageCall, "1", "BootNotification", map[string]string{"chargePointVendor": "Acme", "chargePointModel": "Wallbox 11"})
+	if reply := receiveMessage(t, conn); string(reply[1]) != `"1"` || !strings.Contains(string(reply[2]), `"Accepted"`) {
+		t.Fatalf("Unexpected boot reply %s", reply)
+	}
+	if event := <-events; event.Vendor != "Acme" || event.Model != "Wallbox 11" {
+		t.Fatalf("Unexpected boot event %+v", event)
+	}
+
+	sendMessage(t, conn, messageCall, "2", "MeterValues", map[string]interface{}{
+		"connectorId": 1,
+		"meterValue": []map[string]interface{}{{
+			"timestamp": "2024-07-01T12:00:00Z",
+			"sampledValue": []map[string]string{
+				{"value": "12.5", "measurand": MeasurandEnergy, "unit": "kWh"},
+				{"value": "2300", "measurand": MeasurandPower, "unit": "W", "phase": "L1-N"},
+				{"value": "2400", "measurand": MeasurandPower, "unit": "W", "phase": "L2-N"},
+				{"value": "16", "measurand": "Current.Import", "unit": "A", "phase": "L1"},
+			},
+		}},
+	})
+	receiveMessage(t, conn)
+	if event := <-events; event.ConnectorID != 1 || *event.PowerW != 4700 || *event.EnergyWh != 12500 {
+		t.Fatalf("Unexpected meter event %+v", event)
+	}
+
+	sendMessage(t, conn, messageCall, "3", "UnlockConnector", map[string]int{"connectorId": 1})
+	if reply := receiveMessage(t, conn); string(reply[0]) != "4" || string(reply[2]) != `"NotImplemented"` {
+		t.Fatalf("Expected an unknown action refused, got %s", reply)
+	}
+
+	// The charge point answers the pause request while the server waits
+	done := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() { done <- central.Pause(ctx, "garage", 1) }()
+	request := receiveMessage(t, conn)
+	if string(request[2]) != `"SetChargingProfile"` || !strings.Contains(string(request[3]), `"limit":0`) {
+		t.Fatalf("Unexpected pause request %s", request)
+	}
+	var requestID string
+	json.Unmarshal(request[1], &requestID)
+	sendMessage(t, conn, messageCallResult, requestID, map[string]string{"status": "Accepted"})
+	if err := <-done; err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+
+	go func() { done <- central.Resume(ctx, "garage", 1) }()
+	request = receiveMessage(t, conn)
+	json.Unmarshal(request[1], &requestID)
+	sendMessage(t, conn, messageCallResult, requestID, map[string]string{"status": "Rejected"})
+	if err := <-done; err == nil {
+		t.Fatal("Expected a rejected resume to fail")
+	}
+
+	conn.Close()
+	if event := <-events; event.Action != ActionDisconnected {
+		t.Fatalf("Expected the disconnection reported, got %+v", event)
+	}
+	if central.Connected("garage") || central.Pause(ctx, "garage", 1) == nil {
+		t.Fatal("Expected requests to a disconnected charge point to fail")
+	}
+}
@@ -0,0 +1,70 @@
+package prices
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultOctopusURL is Octopus Energy's public API
+const DefaultOctopusURL = "https://api.octopus.energy/v1"
+
+// Octopus fetches the half-hourly unit rates of an Octopus Agile tariff, published each
+// afternoon for the next day. Rates are converted from pence to pounds.
+type Octopus struct {
+	BaseURL string
+	product string
+	tariff  string
+	client  *http.Client
+}
+
+// NewOctopus creates an Octopus provider for a product and regional tariff code
+func NewOctopus(product, tariff string) *Octopus {
+	return &Octopus{
+		BaseURL: DefaultOctopusURL,
+		product: product,
+		tariff:  tariff,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+type octopusResponse struct {
+	Results []struct {
+		ValueIncVAT float64   `json:"value_inc_vat"`
+		ValidFrom   time.Time `json:"valid_from"`
+		ValidTo     time.Time `json:"valid_to"`
+	} `json:"results"`
+}
+
+// Fetch returns the rates from the start of today on
+func (o *Octopus) Fetch(ctx context.Context) (*Schedule, error) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	endpoint := fmt.Sprintf("%s/products/%s/electricity-tariffs/%s/standard-unit-rates/?period_from=%s&page_size=200",
+		o.BaseURL, url.PathEscape(o.product), url.PathEscape(o.tariff), from.Format(time.RFC3339))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("octopus request failed: %w", err)
+	}
+	var response octopusResponse
+	if err := decodeResponse(resp, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Results) == 0 {
+		return nil, fmt.Errorf("octopus returned no rates for %s", o.tariff)
+	}
+
+	schedule := &Schedule{Provider: ProviderOctopus, Currency: "GBP", FetchedAt: time.Now()}
+	for _, rate := range response.Results {
+		schedule.Prices = append(schedule.Prices, Price{Start: rate.ValidFrom, End: rate.ValidTo, PerKWh: rate.ValueIncVAT / 100})
+	}
+	schedule.sort()
+	return schedule, nil
+}
@@ -0,0 +1,107 @@
+// Package prices fetches dynamic electricity prices from Octopus Energy's Agile tariffs (public,
+// no key) or Tibber (API token). Prices are per kWh in the supplier's currency, taxes included.
+package prices
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Providers
+const (
+	ProviderOctopus = "octopus"
+	ProviderTibber  = "tibber"
+)
+
+const requestTimeout = 15 * time.Second
+
+// Price is the price of electricity from Start until End
+type Price struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	PerKWh float64   `json:"per_kwh"`
+}
+
+// Schedule is the known prices in one currency, oldest first
+type Schedule struct {
+	Provider  string    `json:"provider"`
+	Currency  string    `json:"currency"`
+	Prices    []Price   `json:"prices"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// At returns the price in effect at a time
+func (s *Schedule) At(at time.Time) (Price, bool) {
+	for _, price := range s.Prices {
+		if !at.Before(price.Start) && at.Before(price.End) {
+			return price, true
+		}
+	}
+	return Price{}, false
+}
+
+// Until returns when the prices known end
+func (s *Schedule) Until() time.Time {
+	if len(s.Prices) == 0 {
+		return time.Time{}
+	}
+	return s.Prices[len(s.Prices)-1].End
+}
+
+// sort orders the prices by start
+func (s *Schedule) sort() {
+	sort.Slice(s.Prices, func(i, j int) bool { return s.Prices[i].Start.Before(s.Prices[j].Start) })
+}
+
+// Provider fetches the prices of today and, once published, tomorrow
+type Provider interface {
+	Fetch(ctx context.Context) (*Schedule, error)
+}
+
+// Config selects and sets up a provider
+type Config struct {
+	Provider string `json:"provider"` // octopus or tibber
+	// Product and Tariff are Octopus codes, e.g. AGILE-24-10-01 and E-1R-AGILE-24-10-01-C for region C
+	Product string `json:"product,omitempty"`
+	Tariff  string `json:"tariff,omitempty"`
+	// Token is a Tibber API token; HomeID picks one of several homes, the first by default
+	Token  string `json:"token,omitempty"`
+	HomeID string `json:"home_id,omitempty"`
+}
+
+// New creates the provider of a configuration
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderOctopus:
+		if cfg.Product == "" || cfg.Tariff == "" {
+			return nil, fmt.Errorf("octopus needs a product and tariff code")
+		}
+		return NewOctopus(cfg.Product, cfg.Tariff), nil
+	case ProviderTibber:
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("tibber needs an API token")
+		}
+		return NewTibber(cfg.Token, cfg.HomeID), nil
+	default:
+		return nil, fmt.Errorf("unknown price provider %q, use octopus or tibber", cfg.Provider)
+	}
+}
+
+// decodeResponse checks the status of a response and decodes its JSON body into v
+func decodeResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("price request failed with status %d: %s", resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid price response: %w", err)
+	}
+	return nil
+}
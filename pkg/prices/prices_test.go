@@ -0,0 +1,91 @@
+package prices
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOctopusFetch(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"results":[
+			{"value_inc_vat":24.15,"valid_from":"2024-03-01T17:30:00Z","valid_to":"2024-03-01T18:00:00Z"},
+			{"value_inc_vat":-1.05,"valid_from":"2024-03-01T03:00:00Z","valid_to":"2024-03-01T03:30:00Z"}
+		]}`))
+	}))
+	defer server.Close()
+
+	provider := NewOctopus("AGILE-24-10-01", "E-1R-AGILE-24-10-01-C")
+	provider.BaseURL = server.URL
+	schedule, err := provider.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if path != "/products/AGILE-24-10-01/electricity-tariffs/E-1R-AGILE-24-10-01-C/standard-unit-rates/" {
+		t.Errorf("Unexpected path %s", path)
+	}
+
+	// Rates are sorted and converted to pounds; Agile prices can go negative
+	price, ok := schedule.At(time.Date(2024, 3, 1, 3, 15, 0, 0, time.UTC))
+	if !ok || price.PerKWh != -0.0105 || schedule.Currency != "GBP" {
+		t.Errorf("Expected the negative overnight price, got %+v in %s", price, schedule.Currency)
+	}
+	if until := schedule.Until(); !until.Equal(time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected prices until 18:00, got %s", until)
+	}
+	if _, ok := schedule.At(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)); ok {
+		t.Error("Expected no price for a gap in the rates")
+	}
+}
+
+func TestTibberFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer token" || !strings.Contains(string(body), "priceInfo") {
+			w.Write([]byte(`{"errors":[{"message":"invalid token"}]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"viewer":{"homes":[
+			{"id":"cabin","currentSubscription":null},
+			{"id":"home","currentSubscription":{"priceInfo":{
+				"today":[{"total":1.25,"startsAt":"2024-03-01T22:00:00+01:00","currency":"NOK"},{"total":0.95,"startsAt":"2024-03-01T23:00:00+01:00","currency":"NOK"}],
+				"tomorrow":[]}}}
+		]}}}`))
+	}))
+	defer server.Close()
+
+	provider := NewTibber("token", "home")
+	provider.BaseURL = server.URL
+	schedule, err := provider.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(schedule.Prices) != 2 || schedule.Currency != "NOK" {
+		t.Fatalf("Unexpected schedule %+v", schedule)
+	}
+	if price, ok := schedule.At(time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)); !ok || price.PerKWh != 0.95 {
+		t.Errorf("Expected the last hour's price to last an hour, got %+v", price)
+	}
+
+	provider.token = "wrong"
+	if _, err := provider.Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("Expected the API error, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, cfg := range []Config{{Provider: ProviderOctopus, Product: "AGILE"}, {Provider: ProviderTibber}, {Provider: "nordpool"}} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected %+v to fail", cfg)
+		}
+	}
+	if provider, err := New(Config{Provider: ProviderTibber, Token: "token"}); err != nil || provider.(*Tibber) == nil {
+		t.Errorf("Expected a Tibber provider, got %v", err)
+	}
+}
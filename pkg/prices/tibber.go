@@ -0,0 +1,114 @@
+package prices
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultTibberURL is Tibber's GraphQL API
+const DefaultTibberURL = "https://api.tibber.com/v1-beta/gql"
+
+const tibberQuery = `{viewer{homes{id currentSubscription{priceInfo{` +
+	`today{total startsAt currency} tomorrow{total startsAt currency}}}}}}`
+
+// Tibber fetches today's and, from early afternoon, tomorrow's hourly prices of a Tibber home
+type Tibber struct {
+	BaseURL string
+	token   string
+	homeID  string
+	client  *http.Client
+}
+
+// NewTibber creates a Tibber provider; an empty home ID picks the account's first home
+func NewTibber(token, homeID string) *Tibber {
+	return &Tibber{
+		BaseURL: DefaultTibberURL,
+		token:   token,
+		homeID:  homeID,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+type tibberPrice struct {
+	Total    float64   `json:"total"`
+	StartsAt time.Time `json:"startsAt"`
+	Currency string    `json:"currency"`
+}
+
+type tibberResponse struct {
+	Data struct {
+		Viewer struct {
+			Homes []struct {
+				ID                  string `json:"id"`
+				CurrentSubscription *struct {
+					PriceInfo struct {
+						Today    []tibberPrice `json:"today"`
+						Tomorrow []tibberPrice `json:"tomorrow"`
+					} `json:"priceInfo"`
+				} `json:"currentSubscription"`
+			} `json:"homes"`
+		} `json:"viewer"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Fetch returns the prices of today and tomorrow. Each price lasts until the next one starts.
+func (t *Tibber) Fetch(ctx context.Context) (*Schedule, error) {
+	body, _ := json.Marshal(map[string]string{"query": tibberQuery})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.BaseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tibber request failed: %w", err)
+	}
+	var response tibberResponse
+	if err := decodeResponse(resp, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Errors) > 0 {
+		return nil, fmt.Errorf("tibber error: %s", response.Errors[0].Message)
+	}
+
+	for _, home := range response.Data.Viewer.Homes {
+		if t.homeID != "" && home.ID != t.homeID {
+			continue
+		}
+		if home.CurrentSubscription == nil {
+			return nil, fmt.Errorf("tibber home %s has no subscription", home.ID)
+		}
+		info := home.CurrentSubscription.PriceInfo
+		points := append(append([]tibberPrice{}, info.Today...), info.Tomorrow...)
+		if len(points) == 0 {
+			return nil, fmt.Errorf("tibber returned no prices for home %s", home.ID)
+		}
+
+		schedule := &Schedule{Provider: ProviderTibber, Currency: points[0].Currency, FetchedAt: time.Now()}
+		for _, point := range points {
+			schedule.Prices = append(schedule.Prices, Price{Start: point.StartsAt, PerKWh: point.Total})
+		}
+		schedule.sort()
+		// The last price lasts as long as the one before it, an hour or a quarter
+		last := len(schedule.Prices) - 1
+		for i := 0; i < last; i++ {
+			schedule.Prices[i].End = schedule.Prices[i+1].Start
+		}
+		length := time.Hour
+		if last > 0 {
+			length = schedule.Prices[last].Start.Sub(schedule.Prices[last-1].Start)
+		}
+		schedule.Prices[last].End = schedule.Prices[last].Start.Add(length)
+		return schedule, nil
+	}
+	return nil, fmt.Errorf("tibber account has no home %q", t.homeID)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/api"
@@ -22,6 +23,10 @@ type Client struct {
 
 	// Metrics for Tapo energy monitoring
 	energyMetrics *EnergyMetrics
+
+	// Human-readable names for device_name labels, keyed by device ID (UUID)
+	deviceNames map[string]string
+	namesMu     sync.RWMutex
 }
 
 // EnergyMetrics holds all Prometheus metrics for energy monitoring
@@ -33,6 +38,7 @@ type EnergyMetrics struct {
 	DeviceStatus     *prometheus.GaugeVec
 	SignalStrength   *prometheus.GaugeVec
 	Temperature      *prometheus.GaugeVec
+	DeviceTag        *prometheus.GaugeVec // Always 1; join on device_id to group by tag
 }
 
 // EnergyReading represents energy data from Tapo devices
@@ -115,6 +121,13 @@ func NewClient(url string) *Client {
 			},
 			[]string{"device_id", "device_name", "room_id"},
 		),
+		DeviceTag: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "tapo_device_tag",
+				Help: "Tags of a device (always 1), e.g. sum by (tag) (tapo_power_consumption_watts * on (device_id) group_left (tag) tapo_device_tag)",
+			},
+			[]string{"device_id", "tag"},
+		),
 	}
 
 	return &Client{
@@ -122,6 +135,7 @@ func NewClient(url string) *Client {
 		api:           v1api,
 		url:           url,
 		energyMetrics: energyMetrics,
+		deviceNames:   make(map[string]string),
 	}
 }
 
@@ -155,7 +169,7 @@ func (c *Client) WriteEnergyReading(ctx context.Context, deviceID, roomID string
 		return fmt.Errorf("prometheus client or metrics not initialized")
 	}
 
-	deviceName := deviceID // Use device ID as name if not provided separately
+	deviceName := c.deviceName(deviceID)
 	labels := prometheus.Labels{
 		"device_id":   deviceID,
 		"device_name": deviceName,
@@ -177,6 +191,35 @@ func (c *Client) WriteEnergyReading(ctx context.Context, deviceID, roomID string
 	return nil
 }
 
+// SetDeviceName sets the device_name label used for a device ID, e.g. a UUID
+func (c *Client) SetDeviceName(deviceID, name string) {
+	c.namesMu.Lock()
+	defer c.namesMu.Unlock()
+	c.deviceNames[deviceID] = name
+}
+
+// SetDeviceTags publishes the tags of a device as tapo_device_tag series
+func (c *Client) SetDeviceTags(deviceID string, tags []string) {
+	if c == nil || c.energyMetrics == nil {
+		return
+	}
+
+	c.energyMetrics.DeviceTag.DeletePartialMatch(prometheus.Labels{"device_id": deviceID})
+	for _, tag := range tags {
+		c.energyMetrics.DeviceTag.WithLabelValues(deviceID, tag).Set(1)
+	}
+}
+
+// deviceName returns the label name for a device, falling back to its ID
+func (c *Client) deviceName(deviceID string) string {
+	c.namesMu.RLock()
+	defer c.namesMu.RUnlock()
+	if name, exists := c.deviceNames[deviceID]; exists && name != "" {
+		return name
+	}
+	return deviceID
+}
+
 // WriteEnergyReadingComplete records all energy metrics including signal and temperature
 func (c *Client) WriteEnergyReadingComplete(ctx context.Context, reading *EnergyReading) error {
 	if c == nil || c.energyMetrics == nil {
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStore is an in-memory S3-compatible bucket
+type fakeStore struct {
+	objects map[string][]byte
+	mu      sync.Mutex
+}
+
+func (f *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/backups") {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/backups"), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == http.MethodGet && key == "":
+		var result listResult
+		for name, data := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, Object{Key: name, Size: int64(len(data))})
+			}
+		}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"ListBucketResult"`
+			listResult
+		}{listResult: result})
+	case r.Method == http.MethodGet:
+		data, exists := f.objects[key]
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	store := &fakeStore{objects: make(map[string][]byte)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	client := New(server.URL, "", "backups", "key", "secret")
+	ctx := context.Background()
+
+	if err := client.Put(ctx, "nightly/home automation+1.tar.gz", []byte("archive")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, exists := store.objects["nightly/home automation+1.tar.gz"]; !exists {
+		t.Fatalf("Expected the key to arrive unescaped, got %v", store.objects)
+	}
+
+	data, err := client.Get(ctx, "nightly/home automation+1.tar.gz")
+	if err != nil || string(data) != "archive" {
+		t.Fatalf("Expected the archive back, got %q (%v)", data, err)
+	}
+
+	objects, err := client.List(ctx, "nightly/")
+	if err != nil || len(objects) != 1 || objects[0].Size != 7 {
+		t.Fatalf("Expected one listed object, got %+v (%v)", objects, err)
+	}
+
+	if err := client.Delete(ctx, "nightly/home automation+1.tar.gz"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := client.Get(ctx, "nightly/home automation+1.tar.gz"); err == nil {
+		t.Error("Expected a deleted object to be gone")
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	query := url.Values{"prefix": {"a b/"}, "list-type": {"2"}}
+	if got := canonicalQuery(query); got != "list-type=2&prefix=a%20b%2F" {
+		t.Errorf("Unexpected canonical query %q", got)
+	}
+}
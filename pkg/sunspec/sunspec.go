@@ -0,0 +1,177 @@
+// Package sunspec reads the AC power of solar inverters and grid meters speaking SunSpec over
+// Modbus TCP, by default on port 502. Only the read-only Read Holding Registers function is used.
+package sunspec
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// DefaultBaseAddress is where the SunSpec map starts on most devices; some use 0 or 50000
+const DefaultBaseAddress = 40000
+
+// Model IDs of the SunSpec models read
+const (
+	ModelInverterSinglePhase = 101
+	ModelInverterSplitPhase  = 102
+	ModelInverterThreePhase  = 103
+	ModelMeterSinglePhase    = 201
+	ModelMeterSplitPhase     = 202
+	ModelMeterWye            = 203
+	ModelMeterDelta          = 204
+)
+
+const (
+	sunsMarker      = 0x53756e53 // "SunS"
+	endModel        = 0xffff
+	notImplemented  = 0x8000 // int16 and sunssf points not implemented by the device
+	readHolding     = 0x03
+	maxModelsWalked = 50
+
+	// Offsets of W and W_SF within the model's points, after its ID and length
+	inverterPowerOffset = 12
+	inverterScaleOffset = 13
+	meterPowerOffset    = 16
+	meterScaleOffset    = 20
+)
+
+// Reading is the AC power of the first inverter and meter models of a device. A meter's power
+// is positive when importing from the grid and negative when exporting, on most devices.
+type Reading struct {
+	InverterW *float64 `json:"inverter_w,omitempty"`
+	MeterW    *float64 `json:"meter_w,omitempty"`
+}
+
+// Client reads a SunSpec device over Modbus TCP, opening a connection per request. It is not
+// safe for concurrent use.
+type Client struct {
+	address     string
+	unitID      byte
+	BaseAddress uint16
+	timeout     time.Duration
+	transaction uint16
+}
+
+// NewClient creates a client for the device at address (host:port) and Modbus unit ID
+func NewClient(address string, unitID byte) *Client {
+	return &Client{address: address, unitID: unitID, BaseAddress: DefaultBaseAddress, timeout: 5 * time.Second}
+}
+
+// Read walks the device's models and returns the power of its first inverter and meter
+func (c *Client) Read(ctx context.Context) (Reading, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return Reading{}, fmt.Errorf("failed to connect to %s: %w", c.address, err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	marker, err := c.readRegisters(conn, c.BaseAddress, 2)
+	if err != nil {
+		return Reading{}, err
+	}
+	if uint32(marker[0])<<16|uint32(marker[1]) != sunsMarker {
+		return Reading{}, fmt.Errorf("no SunSpec map at register %d of %s", c.BaseAddress, c.address)
+	}
+
+	var reading Reading
+	address := c.BaseAddress + 2
+	for i := 0; i < maxModelsWalked; i++ {
+		header, err := c.readRegisters(conn, address, 2)
+		if err != nil {
+			return Reading{}, err
+		}
+		model, length := header[0], header[1]
+		if model == endModel {
+			break
+		}
+
+		switch {
+		case reading.InverterW == nil && model >= ModelInverterSinglePhase && model <= ModelInverterThreePhase:
+			reading.InverterW, err = c.readPower(conn, address+2, inverterPowerOffset, inverterScaleOffset)
+		case reading.MeterW == nil && model >= ModelMeterSinglePhase && model <= ModelMeterDelta:
+			reading.MeterW, err = c.readPower(conn, address+2, meterPowerOffset, meterScaleOffset)
+		}
+		if err != nil {
+			return Reading{}, fmt.Errorf("failed to read model %d: %w", model, err)
+		}
+		if reading.InverterW != nil && reading.MeterW != nil {
+			break
+		}
+		address += 2 + length
+	}
+
+	if reading.InverterW == nil && reading.MeterW == nil {
+		return Reading{}, fmt.Errorf("%s has no SunSpec inverter or meter", c.address)
+	}
+	return reading, nil
+}
+
+// readPower reads W scaled by W_SF; nil when the device doesn't implement them
+func (c *Client) readPower(conn net.Conn, start, powerOffset, scaleOffset uint16) (*float64, error) {
+	registers, err := c.readRegisters(conn, start+powerOffset, scaleOffset-powerOffset+1)
+	if err != nil {
+		return nil, err
+	}
+	power, scale := registers[0], registers[len(registers)-1]
+	if power == notImplemented || scale == notImplemented {
+		return nil, nil
+	}
+	watts := float64(int16(power)) * math.Pow(10, float64(int16(scale)))
+	return &watts, nil
+}
+
+// readRegisters reads count holding registers from address
+func (c *Client) readRegisters(conn net.Conn, address, count uint16) ([]uint16, error) {
+	c.transaction++
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint16(request[0:], c.transaction)
+	binary.BigEndian.PutUint16(request[2:], 0) // Modbus protocol
+	binary.BigEndian.PutUint16(request[4:], 6) // Bytes following: unit, function, address, count
+	request[6] = c.unitID
+	request[7] = readHolding
+	binary.BigEndian.PutUint16(request[8:], address)
+	binary.BigEndian.PutUint16(request[10:], count)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send Modbus request: %w", err)
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read Modbus response: %w", err)
+	}
+	if binary.BigEndian.Uint16(header[0:]) != c.transaction {
+		return nil, fmt.Errorf("modbus response to another request")
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 || length > 256 {
+		return nil, fmt.Errorf("invalid Modbus response length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		return nil, fmt.Errorf("failed to read Modbus response: %w", err)
+	}
+
+	if pdu[0] == readHolding|0x80 {
+		return nil, fmt.Errorf("modbus exception %d reading register %d", pdu[1], address)
+	}
+	if pdu[0] != readHolding || len(pdu) < 2 || int(pdu[1]) != int(count)*2 || len(pdu) < 2+int(count)*2 {
+		return nil, fmt.Errorf("unexpected Modbus response reading register %d", address)
+	}
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(pdu[2+i*2:])
+	}
+	return registers, nil
+}
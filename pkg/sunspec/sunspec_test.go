@@ -0,0 +1,99 @@
+package sunspec
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeDevice serves holding registers from a map over Modbus TCP, answering an exception for
+// registers it doesn't have
+func fakeDevice(t *testing.T, registers map[uint16]uint16) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, 12)
+				for {
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+					address, count := binary.BigEndian.Uint16(request[8:]), binary.BigEndian.Uint16(request[10:])
+					pdu := []byte{readHolding, byte(count * 2)}
+					for i := uint16(0); i < count; i++ {
+						value, exists := registers[address+i]
+						if !exists {
+							pdu = []byte{readHolding | 0x80, 2}
+							break
+						}
+						pdu = binary.BigEndian.AppendUint16(pdu, value)
+					}
+					response := append([]byte{}, request[:4]...)
+					response = binary.BigEndian.AppendUint16(response, uint16(len(pdu)+1))
+					response = append(append(response, request[6]), pdu...)
+					conn.Write(response)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// sunSpecMap lays out the SunSpec marker, a common model, an inverter and a meter
+func sunSpecMap(inverterW, meterW int16, scale int16) map[uint16]uint16 {
+	registers := map[uint16]uint16{40000: 0x5375, 40001: 0x6e53}
+	put := func(start uint16, model, length uint16) {
+		registers[start], registers[start+1] = model, length
+		for i := uint16(0); i < length; i++ {
+			registers[start+2+i] = 0
+		}
+	}
+	put(40002, 1, 66) // Common model
+	put(40070, ModelInverterThreePhase, 50)
+	registers[40072+inverterPowerOffset] = uint16(inverterW)
+	registers[40072+inverterScaleOffset] = uint16(scale)
+	put(40122, ModelMeterWye, 105)
+	registers[40124+meterPowerOffset] = uint16(meterW)
+	registers[40124+meterScaleOffset] = uint16(scale)
+	registers[40229] = 0xffff
+	return registers
+}
+
+func TestClientRead(t *testing.T) {
+	client := NewClient(fakeDevice(t, sunSpecMap(3456, -1200, 0)), 1)
+	reading, err := client.Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if reading.InverterW == nil || *reading.InverterW != 3456 || reading.MeterW == nil || *reading.MeterW != -1200 {
+		t.Errorf("Unexpected reading %+v", reading)
+	}
+
+	// Scale factors apply, and a device without a meter reports the inverter alone
+	registers := sunSpecMap(1234, 0, -1)
+	registers[40122] = 0xffff
+	reading, err = NewClient(fakeDevice(t, registers), 1).Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if *reading.InverterW != 123.4 || reading.MeterW != nil {
+		t.Errorf("Unexpected reading %+v", reading)
+	}
+
+	client.BaseAddress = 50000
+	if _, err := client.Read(context.Background()); err == nil {
+		t.Error("Expected a missing SunSpec map to fail")
+	}
+}
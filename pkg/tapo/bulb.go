@@ -0,0 +1,156 @@
+package tapo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Value ranges accepted by Tapo L530/L900 bulbs
+const (
+	MinBrightness = 1
+	MaxBrightness = 100
+	MinColorTemp  = 2500 // Kelvin
+	MaxColorTemp  = 6500 // Kelvin
+	MaxHue        = 360
+	MaxSaturation = 100
+)
+
+// BulbInfo represents the state of a Tapo smart bulb
+type BulbInfo struct {
+	DeviceID    string `json:"device_id"`
+	Nickname    string `json:"nickname"`
+	Model       string `json:"model"`
+	FirmwareVer string `json:"fw_ver"`
+	IsOn        bool   `json:"device_on"`
+	Brightness  int    `json:"brightness"`
+	ColorTemp   int    `json:"color_temp"` // Kelvin, 0 when a hue/saturation color is active
+	Hue         int    `json:"hue"`
+	Saturation  int    `json:"saturation"`
+}
+
+// BulbClient controls a Tapo L530/L900 smart bulb over either the legacy or the KLAP protocol
+type BulbClient struct {
+	legacy *TapoClient
+	klap   *KlapClient
+}
+
+// NewBulbClient creates a bulb client using the legacy protocol
+func NewBulbClient(client *TapoClient) *BulbClient {
+	return &BulbClient{legacy: client}
+}
+
+// NewKlapBulbClient creates a bulb client using the KLAP protocol for newer firmware
+func NewKlapBulbClient(client *KlapClient) *BulbClient {
+	return &BulbClient{klap: client}
+}
+
+// Connect establishes a session with the bulb
+func (b *BulbClient) Connect(ctx context.Context) error {
+	if b.klap != nil {
+		return b.klap.Connect(ctx)
+	}
+	return b.legacy.Connect()
+}
+
+// GetBulbInfo retrieves the power, brightness and color state of the bulb
+func (b *BulbClient) GetBulbInfo(ctx context.Context) (*BulbInfo, error) {
+	if b.klap != nil {
+		var response struct {
+			ErrorCode int      `json:"error_code"`
+			Result    BulbInfo `json:"result"`
+		}
+
+		if err := b.klap.secureRequest(ctx, TapoRequest{Method: "get_device_info"}, &response); err != nil {
+			return nil, err
+		}
+
+		if response.ErrorCode != 0 {
+			return nil, errors.NewDeviceError(fmt.Sprintf("device returned error code: %d", response.ErrorCode), nil)
+		}
+
+		return &response.Result, nil
+	}
+
+	if b.legacy.token == "" {
+		return nil, errors.NewConnectionError("Not authenticated with Tapo device", nil)
+	}
+
+	resp, err := b.legacy.makeAuthenticatedRequest(LoginRequest{
+		Method: "get_device_info",
+		Params: map[string]interface{}{},
+	})
+	if err != nil {
+		return nil, errors.NewDeviceError("Failed to get bulb info", err)
+	}
+
+	if resp.ErrorCode != 0 {
+		return nil, errors.NewDeviceError(fmt.Sprintf("Get bulb info failed with error code: %d", resp.ErrorCode), nil)
+	}
+
+	info := &BulbInfo{}
+	if err := mapToStruct(resp.Result, info); err != nil {
+		return nil, errors.NewDeviceError("Failed to parse bulb info", err)
+	}
+
+	return info, nil
+}
+
+// SetOn turns the bulb on or off
+func (b *BulbClient) SetOn(ctx context.Context, on bool) error {
+	return b.setDeviceInfo(ctx, map[string]interface{}{"device_on": on})
+}
+
+// SetBrightness sets the brightness in percent (1-100), turning the bulb on
+func (b *BulbClient) SetBrightness(ctx context.Context, brightness int) error {
+	if brightness < MinBrightness || brightness > MaxBrightness {
+		return errors.NewValidationError(fmt.Sprintf("brightness must be between %d and %d, got %d",
+			MinBrightness, MaxBrightness, brightness), nil)
+	}
+
+	return b.setDeviceInfo(ctx, map[string]interface{}{
+		"device_on":  true,
+		"brightness": brightness,
+	})
+}
+
+// SetColorTemp sets the white color temperature in Kelvin (2500-6500), turning the bulb on
+func (b *BulbClient) SetColorTemp(ctx context.Context, kelvin int) error {
+	if kelvin < MinColorTemp || kelvin > MaxColorTemp {
+		return errors.NewValidationError(fmt.Sprintf("color temperature must be between %dK and %dK, got %dK",
+			MinColorTemp, MaxColorTemp, kelvin), nil)
+	}
+
+	return b.setDeviceInfo(ctx, map[string]interface{}{
+		"device_on":  true,
+		"color_temp": kelvin,
+	})
+}
+
+// SetHueSaturation sets a color by hue (0-360) and saturation (0-100), turning the bulb on
+func (b *BulbClient) SetHueSaturation(ctx context.Context, hue, saturation int) error {
+	if hue < 0 || hue > MaxHue {
+		return errors.NewValidationError(fmt.Sprintf("hue must be between 0 and %d, got %d", MaxHue, hue), nil)
+	}
+	if saturation < 0 || saturation > MaxSaturation {
+		return errors.NewValidationError(fmt.Sprintf("saturation must be between 0 and %d, got %d",
+			MaxSaturation, saturation), nil)
+	}
+
+	// color_temp must be cleared for the bulb to switch from white to color mode
+	return b.setDeviceInfo(ctx, map[string]interface{}{
+		"device_on":  true,
+		"hue":        hue,
+		"saturation": saturation,
+		"color_temp": 0,
+	})
+}
+
+// setDeviceInfo sends a set_device_info request over the configured protocol
+func (b *BulbClient) setDeviceInfo(ctx context.Context, params map[string]interface{}) error {
+	if b.klap != nil {
+		return b.klap.SetDeviceInfo(ctx, params)
+	}
+	return b.legacy.SetDeviceInfo(params)
+}
@@ -0,0 +1,127 @@
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/logger"
+)
+
+func TestKlapBulbControl(t *testing.T) {
+	device := newMockKlapDevice(t, "user@example.com", "secret")
+	device.info["model"] = "L530"
+	device.info["brightness"] = 50
+	device.info["color_temp"] = 2700
+
+	bulb := NewKlapBulbClient(NewKlapClient(device.host(), "user@example.com", "secret", 5*time.Second, *logger.NewLogger("test", nil)))
+	ctx := context.Background()
+
+	if err := bulb.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	if err := bulb.SetBrightness(ctx, 80); err != nil {
+		t.Fatalf("SetBrightness failed: %v", err)
+	}
+	if err := bulb.SetColorTemp(ctx, 4000); err != nil {
+		t.Fatalf("SetColorTemp failed: %v", err)
+	}
+
+	info, err := bulb.GetBulbInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetBulbInfo failed: %v", err)
+	}
+	if !info.IsOn || info.Brightness != 80 || info.ColorTemp != 4000 || info.Model != "L530" {
+		t.Errorf("Unexpected bulb state: %+v", info)
+	}
+
+	if err := bulb.SetHueSaturation(ctx, 240, 100); err != nil {
+		t.Fatalf("SetHueSaturation failed: %v", err)
+	}
+
+	info, err = bulb.GetBulbInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetBulbInfo failed: %v", err)
+	}
+	if info.Hue != 240 || info.Saturation != 100 || info.ColorTemp != 0 {
+		t.Errorf("Expected color mode with hue 240 and saturation 100, got %+v", info)
+	}
+}
+
+func TestBulbRejectsOutOfRangeValues(t *testing.T) {
+	// Validation happens before any request, so no connection is needed
+	bulb := NewBulbClient(NewTapoClient("127.0.0.1:1", "user", "pass", logger.NewLogger("test", nil)))
+	ctx := context.Background()
+
+	if err := bulb.SetBrightness(ctx, 0); err == nil {
+		t.Error("Expected error for brightness 0")
+	}
+	if err := bulb.SetColorTemp(ctx, 9000); err == nil {
+		t.Error("Expected error for color temperature 9000K")
+	}
+	if err := bulb.SetHueSaturation(ctx, 400, 50); err == nil {
+		t.Error("Expected error for hue 400")
+	}
+	if err := bulb.SetHueSaturation(ctx, 120, 101); err == nil {
+		t.Error("Expected error for saturation 101")
+	}
+}
+
+func TestLegacyBulbControl(t *testing.T) {
+	state := map[string]interface{}{"model": "L900", "device_on": false, "brightness": 20}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request LoginRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		response := TapoResponse{}
+		switch request.Method {
+		case "handshake":
+		case "login_device":
+			response.Result = map[string]interface{}{"token": "legacy-token"}
+		case "get_device_info":
+			response.Result = state
+		case "set_device_info":
+			if r.URL.Query().Get("token") != "legacy-token" {
+				response.ErrorCode = -1501
+			}
+			for key, value := range request.Params {
+				state[key] = value
+			}
+		default:
+			response.ErrorCode = -1
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	bulb := NewBulbClient(NewTapoClient(strings.TrimPrefix(server.URL, "http://"), "user", "pass", logger.NewLogger("test", nil)))
+	ctx := context.Background()
+
+	if err := bulb.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := bulb.SetBrightness(ctx, 65); err != nil {
+		t.Fatalf("SetBrightness failed: %v", err)
+	}
+
+	info, err := bulb.GetBulbInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetBulbInfo failed: %v", err)
+	}
+	if !info.IsOn || info.Brightness != 65 || info.Model != "L900" {
+		t.Errorf("Unexpected bulb state: %+v", info)
+	}
+
+	if err := bulb.SetOn(ctx, false); err != nil {
+		t.Fatalf("SetOn failed: %v", err)
+	}
+	if state["device_on"] != false {
+		t.Error("Expected bulb to be switched off")
+	}
+}
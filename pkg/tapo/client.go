@@ -201,26 +201,33 @@ func (c *TapoClient) GetEnergyUsage() (*EnergyUsage, error) {
 	return usage, nil
 }
 
-// SetDeviceOn turns the device on or off
-func (c *TapoClient) SetDeviceOn(on bool) error {
+// SetDeviceInfo updates device settings
+func (c *TapoClient) SetDeviceInfo(params map[string]interface{}) error {
 	if c.token == "" {
 		return errors.NewConnectionError("Not authenticated with Tapo device", nil)
 	}
 
 	req := LoginRequest{
 		Method: "set_device_info",
-		Params: map[string]interface{}{
-			"device_on": on,
-		},
+		Params: params,
 	}
 
 	resp, err := c.makeAuthenticatedRequest(req)
 	if err != nil {
-		return errors.NewDeviceError("Failed to set device state", err)
+		return errors.NewDeviceError("Failed to set device info", err)
 	}
 
 	if resp.ErrorCode != 0 {
-		return errors.NewDeviceError(fmt.Sprintf("Set device state failed with error code: %d", resp.ErrorCode), nil)
+		return errors.NewDeviceError(fmt.Sprintf("Set device info failed with error code: %d", resp.ErrorCode), nil)
+	}
+
+	return nil
+}
+
+// SetDeviceOn turns the device on or off
+func (c *TapoClient) SetDeviceOn(on bool) error {
+	if err := c.SetDeviceInfo(map[string]interface{}{"device_on": on}); err != nil {
+		return err
 	}
 
 	c.logger.Info("Device state changed", map[string]interface{}{
@@ -179,6 +179,40 @@ func (c *KlapClient) GetEnergyUsage(ctx context.Context) (*KlapEnergyUsage, erro
 	return &response.Result, nil
 }
 
+// SetDeviceInfo updates device settings over the KLAP secure session
+func (c *KlapClient) SetDeviceInfo(ctx context.Context, params map[string]interface{}) error {
+	request := TapoRequest{
+		Method: "set_device_info",
+		Params: params,
+	}
+
+	var response KlapTapoResponse
+
+	if err := c.secureRequest(ctx, request, &response); err != nil {
+		return err
+	}
+
+	if response.ErrorCode != 0 {
+		return errors.NewDeviceError(fmt.Sprintf("device returned error code: %d", response.ErrorCode), nil)
+	}
+
+	return nil
+}
+
+// SetDeviceOn turns the device on or off
+func (c *KlapClient) SetDeviceOn(ctx context.Context, on bool) error {
+	if err := c.SetDeviceInfo(ctx, map[string]interface{}{"device_on": on}); err != nil {
+		return err
+	}
+
+	c.logger.Info("Device state changed", map[string]interface{}{
+		"device_ip": c.baseURL,
+		"state":     on,
+	})
+
+	return nil
+}
+
 // handshake1 performs the first KLAP handshake
 func (c *KlapClient) handshake1(ctx context.Context) ([]byte, []*http.Cookie, error) {
 	url := c.baseURL + "/app/handshake1"
@@ -205,12 +239,13 @@ func (c *KlapClient) handshake1(ctx context.Context) ([]byte, []*http.Cookie, er
 		return nil, nil, err
 	}
 
-	if len(body) < 32 {
+	// Response is the 16 byte remote seed followed by the 32 byte SHA256 server hash
+	if len(body) < 48 {
 		return nil, nil, fmt.Errorf("invalid handshake1 response length: %d", len(body))
 	}
 
 	remoteSeed := body[:16]
-	serverHash := body[16:32]
+	serverHash := body[16:48]
 
 	// Verify server hash
 	localHash := sha256Hash(concat(c.localSeed, remoteSeed, c.authHash))
@@ -1,6 +1,7 @@
 package tapo
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -121,3 +122,70 @@ func TestEnergyUsageStruct(t *testing.T) {
 		t.Errorf("Expected today energy to be 1000, got %d", energyUsage.TodayEnergy)
 	}
 }
+
+func TestKlapSetDeviceOn(t *testing.T) {
+	device := newMockKlapDevice(t, "test_user", "test_pass")
+	logger := logger.NewLogger("test", nil)
+	client := NewKlapClient(device.host(), "test_user", "test_pass", 5*time.Second, *logger)
+
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	if err := client.SetDeviceOn(ctx, true); err != nil {
+		t.Fatalf("SetDeviceOn(true) failed: %v", err)
+	}
+
+	if !device.deviceOn() {
+		t.Error("Expected mock device to be switched on")
+	}
+
+	info, err := client.GetDeviceInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetDeviceInfo failed: %v", err)
+	}
+
+	if !info.DeviceOn {
+		t.Error("Expected device info to report device on")
+	}
+
+	if err := client.SetDeviceOn(ctx, false); err != nil {
+		t.Fatalf("SetDeviceOn(false) failed: %v", err)
+	}
+
+	if device.deviceOn() {
+		t.Error("Expected mock device to be switched off")
+	}
+}
+
+func TestKlapSetDeviceOnDeviceError(t *testing.T) {
+	device := newMockKlapDevice(t, "test_user", "test_pass")
+	logger := logger.NewLogger("test", nil)
+	client := NewKlapClient(device.host(), "test_user", "test_pass", 5*time.Second, *logger)
+
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	device.setErrorCode(-1008)
+
+	if err := client.SetDeviceOn(ctx, true); err == nil {
+		t.Error("Expected error when device returns a non-zero error code")
+	}
+
+	if device.deviceOn() {
+		t.Error("Expected device state to be unchanged after an error")
+	}
+}
+
+func TestKlapConnectWrongCredentials(t *testing.T) {
+	device := newMockKlapDevice(t, "test_user", "test_pass")
+	logger := logger.NewLogger("test", nil)
+	client := NewKlapClient(device.host(), "test_user", "wrong_pass", 5*time.Second, *logger)
+
+	if err := client.Connect(context.Background()); err == nil {
+		t.Error("Expected handshake to fail with wrong credentials")
+	}
+}
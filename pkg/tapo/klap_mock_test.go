@@ -0,0 +1,189 @@
+package tapo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockKlapDevice is an in-memory Tapo device speaking the KLAP protocol
+type mockKlapDevice struct {
+	server   *httptest.Server
+	authHash []byte
+
+	mu         sync.Mutex
+	localSeed  []byte
+	remoteSeed []byte
+	sessionKey []byte
+	iv         []byte
+	info       map[string]interface{}
+	errorCode  int
+	requests   []string
+}
+
+// newMockKlapDevice starts a mock KLAP device accepting the given credentials
+func newMockKlapDevice(t *testing.T, username, password string) *mockKlapDevice {
+	t.Helper()
+
+	device := &mockKlapDevice{
+		authHash: sha256Hash(concat(sha1Hash([]byte(username)), sha1Hash([]byte(password)))),
+		info: map[string]interface{}{
+			"device_id": "mock-device",
+			"model":     "P110",
+			"fw_ver":    "1.3.0",
+			"device_on": false,
+			"nickname":  "Mock Plug",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/handshake1", device.handleHandshake1)
+	mux.HandleFunc("/app/handshake2", device.handleHandshake2)
+	mux.HandleFunc("/app/request", device.handleRequest)
+
+	device.server = httptest.NewServer(mux)
+	t.Cleanup(device.server.Close)
+
+	return device
+}
+
+// host returns the host:port of the mock device
+func (d *mockKlapDevice) host() string {
+	return strings.TrimPrefix(d.server.URL, "http://")
+}
+
+// deviceOn returns the current power state of the mock device
+func (d *mockKlapDevice) deviceOn() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	on, _ := d.info["device_on"].(bool)
+	return on
+}
+
+// setErrorCode makes the device answer every request with the given error code
+func (d *mockKlapDevice) setErrorCode(code int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errorCode = code
+}
+
+func (d *mockKlapDevice) handleHandshake1(w http.ResponseWriter, r *http.Request) {
+	localSeed, _ := io.ReadAll(r.Body)
+	if len(localSeed) != 16 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	remoteSeed := make([]byte, 16)
+	rand.Read(remoteSeed)
+
+	d.mu.Lock()
+	d.localSeed = localSeed
+	d.remoteSeed = remoteSeed
+	d.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "TP_SESSIONID", Value: "mock-session"})
+	w.Write(concat(remoteSeed, sha256Hash(concat(localSeed, remoteSeed, d.authHash))))
+}
+
+func (d *mockKlapDevice) handleHandshake2(w http.ResponseWriter, r *http.Request) {
+	payload, _ := io.ReadAll(r.Body)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !bytes.Equal(payload, sha256Hash(concat(d.remoteSeed, d.localSeed, d.authHash))) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	d.sessionKey = sha256Hash(concat([]byte("lsk"), d.localSeed, d.remoteSeed, d.authHash))[:16]
+	d.iv = sha256Hash(concat([]byte("iv"), d.localSeed, d.remoteSeed, d.authHash))[:12]
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *mockKlapDevice) handleRequest(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.Atoi(r.URL.Query().Get("seq"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sessionKey == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	plaintext, err := d.crypt(body, seq, false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.Unmarshal(plaintext, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	d.requests = append(d.requests, request.Method)
+
+	response := map[string]interface{}{"error_code": d.errorCode}
+	if d.errorCode == 0 {
+		switch request.Method {
+		case "get_device_info":
+			response["result"] = d.info
+		case "get_energy_usage":
+			response["result"] = map[string]interface{}{"current_power": 12500, "today_energy": 420}
+		case "set_device_info":
+			for key, value := range request.Params {
+				d.info[key] = value
+			}
+		default:
+			response["error_code"] = -1
+		}
+	}
+
+	payload, _ := json.Marshal(response)
+	encrypted, _ := d.crypt(payload, seq, true)
+	w.Write(encrypted)
+}
+
+// crypt mirrors the client's AES-GCM session encryption for a sequence number
+func (d *mockKlapDevice) crypt(data []byte, seq int, seal bool) ([]byte, error) {
+	block, err := aes.NewCipher(d.sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, 12)
+	copy(iv, d.iv)
+	binary.BigEndian.PutUint32(iv[8:], uint32(seq))
+
+	if seal {
+		return aesGCM.Seal(nil, iv, data, nil), nil
+	}
+	return aesGCM.Open(nil, iv, data, nil)
+}
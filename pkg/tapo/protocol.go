@@ -0,0 +1,127 @@
+package tapo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnpr01/home-automation/internal/errors"
+)
+
+// Protocol identifies the wire protocol spoken by a Tapo device
+type Protocol string
+
+const (
+	ProtocolAuto   Protocol = "auto"   // Detect, trying KLAP first
+	ProtocolKlap   Protocol = "klap"   // Firmware 1.1.0+
+	ProtocolLegacy Protocol = "legacy" // Older firmware
+)
+
+// ProtocolCacheFileName is the protocol cache file inside the state directory
+const ProtocolCacheFileName = "tapo-protocols.json"
+
+// ProtocolRecord remembers which protocol worked for a device
+type ProtocolRecord struct {
+	Protocol        Protocol  `json:"protocol"`
+	FirmwareVersion string    `json:"fw_ver,omitempty"`
+	DetectedAt      time.Time `json:"detected_at"`
+}
+
+// ProtocolCache remembers the detected protocol per device so restarts skip probing.
+// An empty path keeps the cache in memory only.
+type ProtocolCache struct {
+	path    string
+	records map[string]ProtocolRecord
+	mu      sync.RWMutex
+}
+
+// NewProtocolCache creates a protocol cache, loading previously detected protocols from path
+func NewProtocolCache(path string) (*ProtocolCache, error) {
+	cache := &ProtocolCache{
+		path:    path,
+		records: make(map[string]ProtocolRecord),
+	}
+
+	if path == "" {
+		return cache, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, errors.NewSystemError("failed to read Tapo protocol cache", err)
+	}
+
+	if err := json.Unmarshal(data, &cache.records); err != nil {
+		return cache, errors.NewConfigError("failed to parse Tapo protocol cache", err)
+	}
+
+	return cache, nil
+}
+
+// ProtocolCachePath returns the protocol cache file path for a state directory
+func ProtocolCachePath(stateDir string) string {
+	return filepath.Join(stateDir, ProtocolCacheFileName)
+}
+
+// Get returns the remembered protocol for a device
+func (pc *ProtocolCache) Get(deviceID string) (ProtocolRecord, bool) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	record, exists := pc.records[deviceID]
+	return record, exists
+}
+
+// Remember stores the protocol and firmware version that worked for a device
+func (pc *ProtocolCache) Remember(deviceID string, protocol Protocol, firmwareVersion string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.records[deviceID] = ProtocolRecord{
+		Protocol:        protocol,
+		FirmwareVersion: firmwareVersion,
+		DetectedAt:      time.Now(),
+	}
+
+	return pc.save()
+}
+
+// Forget drops the remembered protocol so the device is probed again
+func (pc *ProtocolCache) Forget(deviceID string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.records, deviceID)
+	return pc.save()
+}
+
+// save atomically writes the cache file; callers must hold the lock
+func (pc *ProtocolCache) save() error {
+	if pc.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pc.path), 0755); err != nil {
+		return errors.NewSystemError("failed to create state directory", err)
+	}
+
+	data, err := json.MarshalIndent(pc.records, "", "  ")
+	if err != nil {
+		return errors.NewSystemError("failed to marshal Tapo protocol cache", err)
+	}
+
+	tmpPath := pc.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.NewSystemError("failed to write Tapo protocol cache", err)
+	}
+
+	if err := os.Rename(tmpPath, pc.path); err != nil {
+		return errors.NewSystemError("failed to replace Tapo protocol cache", err)
+	}
+
+	return nil
+}
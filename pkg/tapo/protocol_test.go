@@ -0,0 +1,39 @@
+package tapo
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProtocolCachePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ProtocolCacheFileName)
+
+	cache, err := NewProtocolCache(path)
+	if err != nil {
+		t.Fatalf("NewProtocolCache failed: %v", err)
+	}
+
+	if err := cache.Remember("dryer", ProtocolKlap, "1.3.0"); err != nil {
+		t.Fatalf("Remember failed: %v", err)
+	}
+	if err := cache.Remember("lamp", ProtocolLegacy, ""); err != nil {
+		t.Fatalf("Remember failed: %v", err)
+	}
+
+	reloaded, err := NewProtocolCache(path)
+	if err != nil {
+		t.Fatalf("Reloading cache failed: %v", err)
+	}
+
+	record, exists := reloaded.Get("dryer")
+	if !exists || record.Protocol != ProtocolKlap || record.FirmwareVersion != "1.3.0" {
+		t.Errorf("Expected dryer to be remembered as KLAP on 1.3.0, got %+v", record)
+	}
+
+	if err := reloaded.Forget("lamp"); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if _, exists := reloaded.Get("lamp"); exists {
+		t.Error("Expected lamp to be forgotten")
+	}
+}
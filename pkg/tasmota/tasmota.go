@@ -0,0 +1,179 @@
+// Package tasmota speaks the MQTT conventions of Tasmota firmware: telemetry on
+// tele/<topic>/SENSOR and tele/<topic>/STATE, power state on stat/<topic>/POWER and
+// commands on cmnd/<topic>/<command>.
+package tasmota
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Topic prefixes of Tasmota's default FullTopic %prefix%/%topic%/
+const (
+	PrefixCommand   = "cmnd"
+	PrefixStatus    = "stat"
+	PrefixTelemetry = "tele"
+)
+
+// TelemetryTopic returns the topic of a telemetry message such as SENSOR, STATE or LWT
+func TelemetryTopic(deviceTopic, kind string) string {
+	return PrefixTelemetry + "/" + deviceTopic + "/" + kind
+}
+
+// PowerTopic returns the topic on which the device reports its relay state
+func PowerTopic(deviceTopic string) string {
+	return PrefixStatus + "/" + deviceTopic + "/POWER"
+}
+
+// CommandTopic returns the topic of a command
+func CommandTopic(deviceTopic, command string) string {
+	return PrefixCommand + "/" + deviceTopic + "/" + command
+}
+
+// Telemetry is what a SENSOR or STATE message reported. Fields the message didn't carry are nil.
+type Telemetry struct {
+	PowerW      *float64
+	EnergyWh    *float64 // Total energy counter
+	VoltageV    *float64
+	CurrentA    *float64
+	On          *bool
+	RSSI        *float64 // WiFi signal in dBm
+	Temperature *float64 // In TempUnit
+	TempUnit    string   // C or F
+	Humidity    *float64
+	Illuminance *float64 // lux
+	UptimeSec   *float64 // Seconds since the device booted, from STATE messages
+}
+
+// energy is the ENERGY object of a power-monitoring plug
+type energy struct {
+	Total   *float64 `json:"Total"` // kWh
+	Power   *float64 `json:"Power"`
+	Voltage *float64 `json:"Voltage"`
+	Current *float64 `json:"Current"`
+}
+
+// climate holds the readings of a sensor object such as AM2301, SI7021, BME280 or DS18B20
+type climate struct {
+	Temperature *float64 `json:"Temperature"`
+	Humidity    *float64 `json:"Humidity"`
+	Illuminance *float64 `json:"Illuminance"`
+}
+
+// ParseSensor parses a tele/<topic>/SENSOR message. Energy comes from the ENERGY object, and
+// temperature, humidity and illuminance from the sensor objects; a device is expected to have
+// one sensor of each.
+func ParseSensor(payload []byte) (Telemetry, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return Telemetry{}, fmt.Errorf("invalid SENSOR message: %w", err)
+	}
+
+	telemetry := Telemetry{TempUnit: "C"}
+	for key, raw := range fields {
+		switch key {
+		case "Time":
+		case "TempUnit":
+			json.Unmarshal(raw, &telemetry.TempUnit)
+		case "ENERGY":
+			var e energy
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return Telemetry{}, fmt.Errorf("invalid ENERGY object: %w", err)
+			}
+			telemetry.PowerW, telemetry.VoltageV, telemetry.CurrentA = e.Power, e.Voltage, e.Current
+			if e.Total != nil {
+				wh := *e.Total * 1000
+				telemetry.EnergyWh = &wh
+			}
+		default:
+			var c climate
+			if json.Unmarshal(raw, &c) != nil {
+				continue // Not a sensor object
+			}
+			if telemetry.Temperature == nil {
+				telemetry.Temperature = c.Temperature
+			}
+			if telemetry.Humidity == nil {
+				telemetry.Humidity = c.Humidity
+			}
+			if telemetry.Illuminance == nil {
+				telemetry.Illuminance = c.Illuminance
+			}
+		}
+	}
+	return telemetry, nil
+}
+
+// ParseState parses a tele/<topic>/STATE message for the relay state, WiFi signal and uptime
+func ParseState(payload []byte) (Telemetry, error) {
+	var state struct {
+		Power     string   `json:"POWER"`
+		Power1    string   `json:"POWER1"`
+		UptimeSec *float64 `json:"UptimeSec"`
+		Wifi      struct {
+			Signal *float64 `json:"Signal"`
+		} `json:"Wifi"`
+	}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return Telemetry{}, fmt.Errorf("invalid STATE message: %w", err)
+	}
+
+	telemetry := Telemetry{RSSI: state.Wifi.Signal, UptimeSec: state.UptimeSec}
+	power := state.Power
+	if power == "" {
+		power = state.Power1
+	}
+	if on, ok := ParsePower(power); ok {
+		telemetry.On = &on
+	}
+	return telemetry, nil
+}
+
+// ParsePower parses an ON or OFF power state, as sent on stat/<topic>/POWER
+func ParsePower(payload string) (on bool, ok bool) {
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case "ON", "1":
+		return true, true
+	case "OFF", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// Command is a Tasmota command and its payload
+type Command struct {
+	Name    string
+	Payload string
+}
+
+// Power switches the relay
+func Power(on bool) Command {
+	if on {
+		return Command{"POWER", "ON"}
+	}
+	return Command{"POWER", "OFF"}
+}
+
+// Dimmer sets the brightness of a light in percent
+func Dimmer(percent int) Command {
+	return Command{"Dimmer", strconv.Itoa(clamp(percent, 0, 100))}
+}
+
+// ColorTemp sets the white color temperature of a light. Tasmota takes mireds from 153 to 500.
+func ColorTemp(kelvin int) Command {
+	if kelvin <= 0 {
+		kelvin = 1
+	}
+	return Command{"CT", strconv.Itoa(clamp(1000000/kelvin, 153, 500))}
+}
+
+// HueSaturation sets the color of a light without changing its brightness
+func HueSaturation(hue, saturation int) Command {
+	return Command{"Backlog", fmt.Sprintf("HSBColor1 %d; HSBColor2 %d", clamp(hue, 0, 360), clamp(saturation, 0, 100))}
+}
+
+func clamp(value, low, high int) int {
+	return min(max(value, low), high)
+}
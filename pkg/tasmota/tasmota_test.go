@@ -0,0 +1,53 @@
+package tasmota
+
+import "testing"
+
+func TestParseSensor(t *testing.T) {
+	payload := []byte(`{"Time":"2024-01-14T10:00:00","ENERGY":{"TotalStartTime":"2023-12-01T00:00:00","Total":12.345,"Yesterday":0.8,"Today":0.2,"Power":85,"Voltage":230,"Current":0.37},"AM2301":{"Temperature":21.5,"Humidity":48.2},"TempUnit":"C"}`)
+
+	telemetry, err := ParseSensor(payload)
+	if err != nil {
+		t.Fatalf("ParseSensor failed: %v", err)
+	}
+	if telemetry.PowerW == nil || *telemetry.PowerW != 85 || telemetry.EnergyWh == nil || *telemetry.EnergyWh != 12345 {
+		t.Errorf("Expected 85 W and 12345 Wh, got %+v", telemetry)
+	}
+	if telemetry.Temperature == nil || *telemetry.Temperature != 21.5 || telemetry.TempUnit != "C" || *telemetry.Humidity != 48.2 {
+		t.Errorf("Expected 21.5 C and 48.2%%, got %+v", telemetry)
+	}
+
+	if _, err := ParseSensor([]byte("not json")); err == nil {
+		t.Error("Expected an invalid message to fail")
+	}
+}
+
+func TestParseState(t *testing.T) {
+	telemetry, err := ParseState([]byte(`{"Time":"2024-01-14T10:00:00","Uptime":"0T00:05:12","UptimeSec":312,"POWER":"ON","Wifi":{"AP":1,"RSSI":72,"Signal":-64}}`))
+	if err != nil {
+		t.Fatalf("ParseState failed: %v", err)
+	}
+	if telemetry.On == nil || !*telemetry.On || telemetry.RSSI == nil || *telemetry.RSSI != -64 {
+		t.Errorf("Expected on at -64 dBm, got %+v", telemetry)
+	}
+	if telemetry.UptimeSec == nil || *telemetry.UptimeSec != 312 {
+		t.Errorf("Expected an uptime of 312 s, got %v", telemetry.UptimeSec)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := map[Command]Command{
+		Power(false):           {"POWER", "OFF"},
+		Dimmer(140):            {"Dimmer", "100"},
+		ColorTemp(2700):        {"CT", "370"},
+		ColorTemp(10000):       {"CT", "153"},
+		HueSaturation(120, 80): {"Backlog", "HSBColor1 120; HSBColor2 80"},
+	}
+	for got, want := range tests {
+		if got != want {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+	if topic := CommandTopic("garage-plug", "POWER"); topic != "cmnd/garage-plug/POWER" {
+		t.Errorf("Expected cmnd/garage-plug/POWER, got %s", topic)
+	}
+}
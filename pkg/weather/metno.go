@@ -0,0 +1,88 @@
+package weather
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultMetNoURL is the Met.no compact location forecast
+const DefaultMetNoURL = "https://api.met.no/weatherapi/locationforecast/2.0/compact"
+
+// defaultUserAgent identifies the application, as Met.no's terms require
+const defaultUserAgent = "home-automation/1.0 github.com/johnpr01/home-automation"
+
+// MetNo fetches the hourly forecast of the Norwegian Meteorological Institute, which covers
+// the whole world. Its first hour serves as the current conditions.
+type MetNo struct {
+	BaseURL   string
+	UserAgent string
+	client    *http.Client
+}
+
+// NewMetNo creates a Met.no provider; an empty user agent identifies this project
+func NewMetNo(userAgent string) *MetNo {
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	return &MetNo{
+		BaseURL:   DefaultMetNoURL,
+		UserAgent: userAgent,
+		client:    &http.Client{Timeout: requestTimeout},
+	}
+}
+
+type metNoResponse struct {
+	Properties struct {
+		Timeseries []struct {
+			Time time.Time `json:"time"`
+			Data struct {
+				Instant struct {
+					Details struct {
+						AirTemperature   float64 `json:"air_temperature"`
+						RelativeHumidity float64 `json:"relative_humidity"`
+						WindSpeed        float64 `json:"wind_speed"`
+					} `json:"details"`
+				} `json:"instant"`
+				Next1Hours *struct {
+					Summary struct {
+						SymbolCode string `json:"symbol_code"`
+					} `json:"summary"`
+				} `json:"next_1_hours"`
+			} `json:"data"`
+		} `json:"timeseries"`
+	} `json:"properties"`
+}
+
+// Fetch returns the current conditions and the forecast. Met.no asks for coordinates rounded
+// to four decimals, which also lets its cache answer.
+func (m *MetNo) Fetch(ctx context.Context, latitude, longitude float64) (*Report, error) {
+	url := fmt.Sprintf("%s?lat=%.4f&lon=%.4f", m.BaseURL, latitude, longitude)
+	var response metNoResponse
+	if err := getJSON(ctx, m.client, url, m.UserAgent, &response); err != nil {
+		return nil, err
+	}
+
+	series := response.Properties.Timeseries
+	if len(series) == 0 {
+		return nil, fmt.Errorf("met.no returned no forecast")
+	}
+
+	report := &Report{Provider: ProviderMetNo, FetchedAt: time.Now()}
+	for _, entry := range series {
+		details := entry.Data.Instant.Details
+		point := Conditions{
+			Time:         entry.Time,
+			TemperatureF: celsiusToF(details.AirTemperature),
+			Humidity:     details.RelativeHumidity,
+			WindMph:      metersPerSecondToMph(details.WindSpeed),
+		}
+		if entry.Data.Next1Hours != nil {
+			point.Summary = entry.Data.Next1Hours.Summary.SymbolCode
+		}
+		report.Forecast = append(report.Forecast, point)
+	}
+	report.Current = report.Forecast[0]
+	return report, nil
+}
@@ -0,0 +1,83 @@
+package weather
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultOpenWeatherMapURL is the OpenWeatherMap API of the free plan
+const DefaultOpenWeatherMapURL = "https://api.openweathermap.org/data/2.5"
+
+// OpenWeatherMap fetches the current weather and the 3-hourly, 5-day forecast
+type OpenWeatherMap struct {
+	BaseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewOpenWeatherMap creates an OpenWeatherMap provider
+func NewOpenWeatherMap(apiKey string) *OpenWeatherMap {
+	return &OpenWeatherMap{
+		BaseURL: DefaultOpenWeatherMapURL,
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// owmConditions is the shape shared by the current weather and each forecast entry
+type owmConditions struct {
+	Dt   int64 `json:"dt"`
+	Main struct {
+		Temp     float64 `json:"temp"`
+		Humidity float64 `json:"humidity"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+	Weather []struct {
+		Description string `json:"description"`
+	} `json:"weather"`
+}
+
+func (c owmConditions) conditions() Conditions {
+	point := Conditions{
+		Time:         time.Unix(c.Dt, 0),
+		TemperatureF: c.Main.Temp,
+		Humidity:     c.Main.Humidity,
+		WindMph:      c.Wind.Speed,
+	}
+	if len(c.Weather) > 0 {
+		point.Summary = c.Weather[0].Description
+	}
+	return point
+}
+
+// Fetch returns the current conditions and the forecast, in imperial units
+func (o *OpenWeatherMap) Fetch(ctx context.Context, latitude, longitude float64) (*Report, error) {
+	query := url.Values{
+		"lat":   {fmt.Sprintf("%.4f", latitude)},
+		"lon":   {fmt.Sprintf("%.4f", longitude)},
+		"appid": {o.apiKey},
+		"units": {"imperial"},
+	}.Encode()
+
+	var current owmConditions
+	if err := getJSON(ctx, o.client, o.BaseURL+"/weather?"+query, "", &current); err != nil {
+		return nil, err
+	}
+	var forecast struct {
+		List []owmConditions `json:"list"`
+	}
+	if err := getJSON(ctx, o.client, o.BaseURL+"/forecast?"+query, "", &forecast); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Provider: ProviderOpenWeatherMap, Current: current.conditions(), FetchedAt: time.Now()}
+	for _, entry := range forecast.List {
+		report.Forecast = append(report.Forecast, entry.conditions())
+	}
+	return report, nil
+}
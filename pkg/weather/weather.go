@@ -0,0 +1,107 @@
+// Package weather fetches current outdoor conditions and the hourly forecast for a location
+// from Met.no (free, no key) or OpenWeatherMap (API key). Temperatures are in °F.
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Providers
+const (
+	ProviderMetNo          = "metno"
+	ProviderOpenWeatherMap = "openweathermap"
+)
+
+const requestTimeout = 15 * time.Second
+
+// Conditions is the weather at one time, observed or forecast
+type Conditions struct {
+	Time         time.Time `json:"time"`
+	TemperatureF float64   `json:"temperature_f"`
+	Humidity     float64   `json:"humidity"` // %
+	WindMph      float64   `json:"wind_mph"`
+	Summary      string    `json:"summary,omitempty"` // e.g. "cloudy" or "light rain"
+}
+
+// Report is the current conditions and the forecast, oldest first
+type Report struct {
+	Provider  string       `json:"provider"`
+	Current   Conditions   `json:"current"`
+	Forecast  []Conditions `json:"forecast"`
+	FetchedAt time.Time    `json:"fetched_at"`
+}
+
+// Coldest returns the coldest forecast point from from until to
+func (r *Report) Coldest(from, to time.Time) (Conditions, bool) {
+	var coldest Conditions
+	found := false
+	for _, point := range r.Forecast {
+		if point.Time.Before(from) || point.Time.After(to) {
+			continue
+		}
+		if !found || point.TemperatureF < coldest.TemperatureF {
+			coldest, found = point, true
+		}
+	}
+	return coldest, found
+}
+
+// Provider fetches the weather for a location
+type Provider interface {
+	Fetch(ctx context.Context, latitude, longitude float64) (*Report, error)
+}
+
+// New creates a provider by name. Met.no asks for a user agent identifying the application
+// and a contact; OpenWeatherMap needs an API key.
+func New(provider, apiKey, userAgent string) (Provider, error) {
+	switch provider {
+	case ProviderMetNo, "":
+		return NewMetNo(userAgent), nil
+	case ProviderOpenWeatherMap:
+		if apiKey == "" {
+			return nil, fmt.Errorf("openweathermap needs an API key")
+		}
+		return NewOpenWeatherMap(apiKey), nil
+	default:
+		return nil, fmt.Errorf("unknown weather provider %q, use metno or openweathermap", provider)
+	}
+}
+
+// getJSON fetches a URL and decodes its JSON body into v
+func getJSON(ctx context.Context, client *http.Client, url, userAgent string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("weather request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("weather request failed with status %d: %s", resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid weather response: %w", err)
+	}
+	return nil
+}
+
+func celsiusToF(c float64) float64 {
+	return c*9/5 + 32
+}
+
+func metersPerSecondToMph(mps float64) float64 {
+	return mps * 2.23694
+}
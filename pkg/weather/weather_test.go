@@ -0,0 +1,89 @@
+package weather
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetNoFetch(t *testing.T) {
+	var userAgent, query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent, query = r.UserAgent(), r.URL.RawQuery
+		w.Write([]byte(`{"properties":{"timeseries":[
+			{"time":"2024-01-10T18:00:00Z","data":{"instant":{"details":{"air_temperature":5,"relative_humidity":80,"wind_speed":2}},"next_1_hours":{"summary":{"symbol_code":"cloudy"}}}},
+			{"time":"2024-01-11T03:00:00Z","data":{"instant":{"details":{"air_temperature":-10,"relative_humidity":90,"wind_speed":1}}}}
+		]}}`))
+	}))
+	defer server.Close()
+
+	provider := NewMetNo("")
+	provider.BaseURL = server.URL
+	report, err := provider.Fetch(context.Background(), 59.91273, 10.74609)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if !strings.HasPrefix(userAgent, "home-automation/") || query != "lat=59.9127&lon=10.7461" {
+		t.Errorf("Unexpected request: user agent %q, query %q", userAgent, query)
+	}
+	if report.Current.TemperatureF != 41 || report.Current.Summary != "cloudy" || math.Abs(report.Current.WindMph-4.47) > 0.01 {
+		t.Errorf("Unexpected current conditions %+v", report.Current)
+	}
+
+	from := time.Date(2024, 1, 10, 19, 0, 0, 0, time.UTC)
+	coldest, ok := report.Coldest(from, from.Add(12*time.Hour))
+	if !ok || coldest.TemperatureF != 14 {
+		t.Errorf("Expected the night's low of 14°F, got %+v", coldest)
+	}
+	if _, ok := report.Coldest(from, from.Add(time.Hour)); ok {
+		t.Error("Expected no forecast point within the hour")
+	}
+}
+
+func TestOpenWeatherMapFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("appid") != "key" || r.URL.Query().Get("units") != "imperial" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/weather":
+			w.Write([]byte(`{"dt":1704909600,"main":{"temp":38.5,"humidity":70},"wind":{"speed":6},"weather":[{"description":"light rain"}]}`))
+		case "/forecast":
+			w.Write([]byte(`{"list":[{"dt":1704920400,"main":{"temp":30,"humidity":75}},{"dt":1704931200,"main":{"temp":25,"humidity":80}}]}`))
+		}
+	}))
+	defer server.Close()
+
+	provider := NewOpenWeatherMap("key")
+	provider.BaseURL = server.URL
+	report, err := provider.Fetch(context.Background(), 40.7, -74)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if report.Current.TemperatureF != 38.5 || report.Current.Summary != "light rain" || len(report.Forecast) != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	provider.apiKey = "wrong"
+	if _, err := provider.Fetch(context.Background(), 40.7, -74); err == nil {
+		t.Error("Expected a rejected key to fail")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(ProviderOpenWeatherMap, "", ""); err == nil {
+		t.Error("Expected OpenWeatherMap without a key to fail")
+	}
+	if _, err := New("accuweather", "", ""); err == nil {
+		t.Error("Expected an unknown provider to fail")
+	}
+	if provider, err := New("", "", ""); err != nil || provider.(*MetNo) == nil {
+		t.Errorf("Expected Met.no by default, got %v", err)
+	}
+}
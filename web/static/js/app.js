@@ -1,25 +1,128 @@
 // Home Automation Dashboard JavaScript
+//
+// The dashboard is served by the unified gateway and by the server. Each section loads from its
+// own API and stays hidden where that API isn't served, so the same page works on both.
+
+const TOKEN_KEY = 'home-automation-token';
+const HOME_MODES = ['auto', 'home', 'away', 'night', 'vacation'];
 
 class HomeAutomationApp {
     constructor() {
         this.apiBaseUrl = '/api';
+        this.token = localStorage.getItem(TOKEN_KEY) || '';
         this.devices = [];
+        this.mqttDevices = [];
+        this.registry = [];
         this.sensors = [];
+        this.thermostats = [];
+        this.messages = {};
         this.init();
     }
 
     async init() {
-        await this.loadSystemStatus();
-        await this.loadDevices();
-        await this.loadSensors();
+        await this.loadMessages();
         this.setupEventListeners();
+        await Promise.all([
+            this.loadSystemStatus(),
+            this.loadRooms(),
+            this.loadThermostats(),
+            this.loadEnergy(),
+            this.loadDevices(),
+            this.loadMQTTDevices(),
+            this.loadRegistry(),
+            this.loadSensors(),
+            this.loadAutomations(),
+        ]);
         this.startPolling();
     }
 
+    async loadMessages() {
+        try {
+            const catalog = await this.api(`/i18n?lang=${encodeURIComponent(navigator.language || '')}`);
+            if (catalog === null) return;
+            this.messages = catalog.messages || {};
+            document.documentElement.lang = catalog.locale;
+            document.querySelectorAll('[data-i18n]').forEach(element => {
+                element.textContent = this.messages[element.dataset.i18n] || element.textContent;
+            });
+        } catch (error) {
+            console.error('Failed to load translations:', error);
+        }
+    }
+
+    // t returns a dashboard label in the negotiated locale, or the English one
+    t(key, fallback) {
+        return this.messages[`dashboard.${key}`] || fallback;
+    }
+
+    // api fetches a JSON endpoint with the API token, when set. It resolves to null when the
+    // endpoint isn't served here, so its section stays hidden.
+    async api(path, options = {}) {
+        const headers = Object.assign({}, options.headers);
+        if (this.token) {
+            headers.Authorization = `Bearer ${this.token}`;
+        }
+        const response = await fetch(`${this.apiBaseUrl}${path}`, Object.assign({}, options, { headers }));
+        if (response.status === 404 && !options.method) {
+            return null;
+        }
+        if (response.status === 401) {
+            this.showNotice(this.t('unauthorized', 'Set an API token in Settings to make changes.'));
+            throw new Error(`${path}: unauthorized`);
+        }
+        if (!response.ok) {
+            throw new Error(`${path}: ${response.status} ${(await response.text()).trim()}`);
+        }
+        if (response.status === 204) {
+            return {};
+        }
+        return response.json();
+    }
+
+    // post sends a change and shows why it failed
+    async post(path, body) {
+        const options = { method: 'POST' };
+        if (body !== undefined) {
+            options.headers = { 'Content-Type': 'application/json' };
+            options.body = JSON.stringify(body);
+        }
+        try {
+            return await this.api(path, options);
+        } catch (error) {
+            console.error('Request failed:', error);
+            if (!error.message.endsWith('unauthorized')) {
+                this.showNotice(error.message);
+            }
+            return null;
+        }
+    }
+
+    showNotice(message) {
+        const notice = document.getElementById('notice');
+        if (!notice) return;
+        notice.textContent = message;
+        notice.hidden = false;
+        clearTimeout(this.noticeTimer);
+        this.noticeTimer = setTimeout(() => { notice.hidden = true; }, 8000);
+    }
+
+    // show reveals a section once its API has answered
+    show(sectionId, visible = true) {
+        const section = document.getElementById(sectionId);
+        if (section) section.hidden = !visible;
+    }
+
+    escape(value) {
+        return String(value ?? '').replace(/[&<>"']/g, c => ({
+            '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+        })[c]);
+    }
+
     async loadSystemStatus() {
         try {
-            const response = await fetch(`${this.apiBaseUrl}/status`);
-            const status = await response.json();
+            const status = await this.api('/status');
+            if (status === null) return;
+            this.show('dashboard');
             this.updateSystemStatus(status);
         } catch (error) {
             console.error('Failed to load system status:', error);
@@ -33,7 +136,7 @@ class HomeAutomationApp {
         const sensorCountElement = document.getElementById('sensor-count');
 
         if (statusElement) {
-            statusElement.textContent = status.status === 'ok' ? 'Online' : 'Offline';
+            statusElement.textContent = status.status === 'ok' ? this.t('online', 'Online') : this.t('offline', 'Offline');
             statusElement.className = `status-indicator ${status.status === 'ok' ? 'online' : 'offline'}`;
         }
 
@@ -46,10 +149,154 @@ class HomeAutomationApp {
         }
     }
 
+    async loadRooms() {
+        try {
+            const summary = await this.api('/rooms');
+            if (summary === null) return;
+            this.show('rooms');
+            this.renderRooms(summary.rooms || []);
+        } catch (error) {
+            console.error('Failed to load rooms:', error);
+        }
+    }
+
+    renderRooms(rooms) {
+        const container = document.getElementById('rooms-container');
+        if (!container) return;
+
+        if (rooms.length === 0) {
+            container.innerHTML = `<p>${this.t('no_rooms', 'No room readings yet.')}</p>`;
+            return;
+        }
+
+        container.innerHTML = rooms.map(room => `
+            <div class="sensor-card ${room.is_online ? '' : 'stale'}">
+                <div class="sensor-header">
+                    <div class="sensor-name">${this.escape(room.room_id)}</div>
+                    <div class="sensor-type">${room.is_occupied ? this.t('occupied', 'Occupied') : this.t('vacant', 'Vacant')}</div>
+                </div>
+                <div class="sensor-value">
+                    ${room.temperature.toFixed(1)}<span class="sensor-unit">°F</span>
+                </div>
+                <div class="room-readings">
+                    <span>${this.t('humidity', 'Humidity')} ${room.humidity.toFixed(0)}%</span>
+                    <span>${this.t('light', 'Light')} ${room.light_level.toFixed(0)}% ${this.escape(room.light_state)}</span>
+                </div>
+                ${room.leak_detected || room.smoke_detected ? `<div class="status-indicator offline">${room.smoke_detected ? '🔥' : '💧'}</div>` : ''}
+                <div class="sensor-timestamp">
+                    ${this.t('last_updated', 'Last updated')}: ${this.formatTimestamp(room.last_seen)}
+                </div>
+            </div>
+        `).join('');
+    }
+
+    async loadThermostats() {
+        try {
+            const response = await this.api('/thermostats');
+            if (response === null) return;
+            this.show('thermostats');
+            this.thermostats = response.thermostats || [];
+            this.renderThermostats();
+        } catch (error) {
+            console.error('Failed to load thermostats:', error);
+        }
+    }
+
+    renderThermostats() {
+        const container = document.getElementById('thermostats-container');
+        if (!container) return;
+
+        if (this.thermostats.length === 0) {
+            container.innerHTML = `<p>${this.t('no_devices', 'No devices found.')}</p>`;
+            return;
+        }
+
+        container.innerHTML = this.thermostats.map(thermostat => `
+            <div class="device-card" data-thermostat-id="${this.escape(thermostat.id)}">
+                <div class="device-header">
+                    <div class="device-name">${this.escape(thermostat.name || thermostat.id)}</div>
+                    <div class="device-type">${this.escape(thermostat.mode)}</div>
+                </div>
+                <div class="device-status">
+                    <div class="status-dot ${thermostat.is_online && thermostat.status !== 'idle' ? 'on' : 'off'}"></div>
+                    <span>${thermostat.is_online ? this.escape(thermostat.status) : this.t('offline', 'Offline')}</span>
+                </div>
+                <div class="sensor-value">
+                    ${thermostat.current_temp.toFixed(1)}<span class="sensor-unit">°F</span>
+                </div>
+                <div class="device-controls">
+                    <button class="btn btn-secondary" data-action="setpoint" data-id="${this.escape(thermostat.id)}" data-change="-1">-</button>
+                    <span>${this.t('target', 'Target')} ${thermostat.target_temp.toFixed(1)}°F</span>
+                    <button class="btn btn-secondary" data-action="setpoint" data-id="${this.escape(thermostat.id)}" data-change="1">+</button>
+                </div>
+            </div>
+        `).join('');
+    }
+
+    // adjustSetpoint holds a thermostat a degree up or down until the schedule's next block
+    async adjustSetpoint(thermostatId, change) {
+        const thermostat = this.thermostats.find(t => t.id === thermostatId);
+        if (!thermostat) return;
+
+        const held = await this.post(`/thermostats/hold?thermostat=${encodeURIComponent(thermostatId)}`, {
+            mode: 'next_block',
+            target_temp: thermostat.target_temp + change,
+        });
+        if (held) {
+            thermostat.target_temp = held.target_temp;
+            this.renderThermostats();
+        }
+    }
+
+    async loadEnergy() {
+        try {
+            const response = await this.api('/energy/rooms/daily?days=7');
+            if (response === null) return;
+            this.show('energy');
+            this.renderEnergy(response.rooms || []);
+        } catch (error) {
+            console.error('Failed to load energy:', error);
+        }
+    }
+
+    // renderEnergy draws a bar per day for each room, scaled to the room's busiest day
+    renderEnergy(rooms) {
+        const container = document.getElementById('energy-container');
+        if (!container) return;
+
+        if (rooms.length === 0) {
+            container.innerHTML = `<p>${this.t('no_rooms', 'No room readings yet.')}</p>`;
+            return;
+        }
+
+        container.innerHTML = rooms.map(room => {
+            const peak = Math.max(...room.days.map(day => day.kwh), 0.001);
+            const total = room.days.reduce((sum, day) => sum + day.kwh, 0);
+            return `
+                <div class="sensor-card">
+                    <div class="sensor-header">
+                        <div class="sensor-name">${this.escape(room.room_id)}</div>
+                        <div class="sensor-type">${this.t('total', 'Total')} ${total.toFixed(1)} kWh</div>
+                    </div>
+                    <div class="energy-chart">
+                        ${room.days.map(day => `
+                            <div class="energy-bar" title="${this.escape(day.date)}: ${day.kwh.toFixed(2)} kWh">
+                                <div class="energy-fill" style="height: ${(day.kwh / peak * 100).toFixed(0)}%"></div>
+                                <span>${this.escape(day.date.slice(8))}</span>
+                            </div>
+                        `).join('')}
+                    </div>
+                </div>
+            `;
+        }).join('');
+    }
+
     async loadDevices() {
         try {
-            const response = await fetch(`${this.apiBaseUrl}/devices`);
-            this.devices = await response.json();
+            const devices = await this.api('/devices');
+            if (devices === null) return;
+            this.show('devices');
+            this.devices = devices;
             this.renderDevices();
         } catch (error) {
             console.error('Failed to load devices:', error);
@@ -58,70 +305,154 @@ class HomeAutomationApp {
         }
     }
 
+    // loadMQTTDevices loads the gateway's Tasmota and ESPHome devices
+    async loadMQTTDevices() {
+        try {
+            const response = await this.api('/mqtt-devices');
+            if (response === null) return;
+            this.show('devices');
+            this.mqttDevices = response.devices || [];
+            this.renderDevices();
+        } catch (error) {
+            console.error('Failed to load MQTT devices:', error);
+        }
+    }
+
+    // loadRegistry loads the device registry, where devices are named and put in rooms
+    async loadRegistry() {
+        try {
+            const devices = await this.api('/devices/registry');
+            if (devices === null) return;
+            this.show('devices');
+            document.getElementById('registry-card').hidden = false;
+            this.registry = devices;
+            // Polling mustn't throw away a row being edited
+            if (!document.activeElement || !document.activeElement.closest('#registry-container')) {
+                this.renderRegistry();
+            }
+        } catch (error) {
+            console.error('Failed to load the device registry:', error);
+        }
+    }
+
+    renderRegistry() {
+        const container = document.getElementById('registry-container');
+        if (!container) return;
+
+        if (this.registry.length === 0) {
+            container.innerHTML = `<p>${this.t('no_devices', 'No devices found.')}</p>`;
+            return;
+        }
+
+        container.innerHTML = this.registry.map(device => `
+            <div class="registry-row" data-uuid="${this.escape(device.uuid)}">
+                <input data-field="icon" value="${this.escape(device.icon)}" placeholder="🔌" aria-label="${this.t('icon', 'Icon')}">
+                <input data-field="name" value="${this.escape(device.name)}" aria-label="${this.t('name', 'Name')}">
+                <input data-field="room_id" value="${this.escape(device.room_id)}" placeholder="${this.t('room', 'Room')}" aria-label="${this.t('room', 'Room')}">
+                <input data-field="tags" value="${this.escape((device.tags || []).join(', '))}" placeholder="${this.t('tags', 'Tags')}" aria-label="${this.t('tags', 'Tags')}">
+                <button class="btn btn-secondary" data-action="registry-save" data-id="${this.escape(device.uuid)}">${this.t('save', 'Save')}</button>
+            </div>
+        `).join('');
+    }
+
+    // saveRegistryDevice saves the name, room, icon and tags edited in a device's row
+    async saveRegistryDevice(uuid) {
+        const row = document.querySelector(`.registry-row[data-uuid="${CSS.escape(uuid)}"]`);
+        if (!row) return;
+
+        const value = field => row.querySelector(`[data-field="${field}"]`).value.trim();
+        const update = {
+            icon: value('icon'),
+            room_id: value('room_id'),
+            tags: value('tags').split(',').map(tag => tag.trim()).filter(tag => tag),
+        };
+        // Saving the name keeps it over the one the device is configured with, so it's only sent when changed
+        const device = this.registry.find(d => d.uuid === uuid);
+        if (value('name') && (!device || value('name') !== device.name)) {
+            update.name = value('name');
+        }
+        const saved = await this.post(`/devices/registry/update?uuid=${encodeURIComponent(uuid)}`, update);
+        if (saved) {
+            this.registry = this.registry.map(device => device.uuid === uuid ? saved : device);
+            this.renderRegistry();
+        }
+    }
+
     renderDevices() {
         const container = document.getElementById('devices-container');
         if (!container) return;
 
-        if (this.devices.length === 0) {
-            container.innerHTML = '<p>No devices found.</p>';
+        if (this.devices.length === 0 && this.mqttDevices.length === 0) {
+            container.innerHTML = `<p>${this.t('no_devices', 'No devices found.')}</p>`;
             return;
         }
 
         container.innerHTML = this.devices.map(device => `
-            <div class="device-card" data-device-id="${device.id}">
+            <div class="device-card" data-device-id="${this.escape(device.id)}">
                 <div class="device-header">
-                    <div class="device-name">${device.name}</div>
-                    <div class="device-type">${device.type}</div>
+                    <div class="device-name">${this.escape(device.name)}</div>
+                    <div class="device-type">${this.escape(device.type)}</div>
                 </div>
                 <div class="device-status">
-                    <div class="status-dot ${device.status}"></div>
-                    <span>${device.status.charAt(0).toUpperCase() + device.status.slice(1)}</span>
+                    <div class="status-dot ${this.escape(device.status)}"></div>
+                    <span>${this.escape(device.status.charAt(0).toUpperCase() + device.status.slice(1))}</span>
                 </div>
                 <div class="device-controls">
                     ${this.renderDeviceControls(device)}
                 </div>
             </div>
+        `).join('') + this.mqttDevices.map(device => `
+            <div class="device-card" data-device-id="${this.escape(device.device_id)}">
+                <div class="device-header">
+                    <div class="device-name">${this.escape(device.device_name || device.device_id)}</div>
+                    <div class="device-type">${this.escape(device.room_id)}</div>
+                </div>
+                <div class="device-status">
+                    <div class="status-dot ${device.on ? 'on' : 'off'}"></div>
+                    <span>${device.online ? (device.power_w != null ? `${device.power_w.toFixed(1)} W` : this.t('online', 'Online')) : this.t('offline', 'Offline')}</span>
+                </div>
+                <div class="device-controls">
+                    ${device.on == null ? `<span class="text-muted">${this.t('no_controls', 'No controls available')}</span>` : `
+                        <button class="btn btn-primary" data-action="switch" data-id="${this.escape(device.device_id)}">
+                            ${device.on ? this.t('turn_off', 'Turn Off') : this.t('turn_on', 'Turn On')}
+                        </button>
+                    `}
+                </div>
+            </div>
         `).join('');
     }
 
     renderDeviceControls(device) {
+        const id = this.escape(device.id);
         switch (device.type) {
             case 'light':
                 return `
-                    <button class="btn btn-primary" onclick="app.toggleDevice('${device.id}')">
-                        ${device.status === 'on' ? 'Turn Off' : 'Turn On'}
+                    <button class="btn btn-primary" data-action="toggle" data-id="${id}">
+                        ${device.status === 'on' ? this.t('turn_off', 'Turn Off') : this.t('turn_on', 'Turn On')}
                     </button>
                     ${device.status === 'on' ? `
-                        <button class="btn btn-secondary" onclick="app.dimDevice('${device.id}')">
-                            Dim
+                        <button class="btn btn-secondary" data-action="dim" data-id="${id}">
+                            ${this.t('dim', 'Dim')}
                         </button>
                     ` : ''}
                 `;
             case 'switch':
                 return `
-                    <button class="btn btn-primary" onclick="app.toggleDevice('${device.id}')">
-                        ${device.status === 'on' ? 'Turn Off' : 'Turn On'}
-                    </button>
-                `;
-            case 'climate':
-                return `
-                    <button class="btn btn-secondary" onclick="app.adjustTemperature('${device.id}', -1)">
-                        -
-                    </button>
-                    <span>22°C</span>
-                    <button class="btn btn-secondary" onclick="app.adjustTemperature('${device.id}', 1)">
-                        +
+                    <button class="btn btn-primary" data-action="toggle" data-id="${id}">
+                        ${device.status === 'on' ? this.t('turn_off', 'Turn Off') : this.t('turn_on', 'Turn On')}
                     </button>
                 `;
             default:
-                return '<span class="text-muted">No controls available</span>';
+                return `<span class="text-muted">${this.t('no_controls', 'No controls available')}</span>`;
         }
     }
 
     async loadSensors() {
         try {
-            const response = await fetch(`${this.apiBaseUrl}/sensors`);
-            this.sensors = await response.json();
+            const sensors = await this.api('/sensors');
+            if (sensors === null) return;
+            this.show('sensors');
+            this.sensors = sensors;
             this.renderSensors();
         } catch (error) {
             console.error('Failed to load sensors:', error);
@@ -135,22 +466,22 @@ class HomeAutomationApp {
         if (!container) return;
 
         if (this.sensors.length === 0) {
-            container.innerHTML = '<p>No sensors found.</p>';
+            container.innerHTML = `<p>${this.t('no_sensors', 'No sensors found.')}</p>`;
             return;
         }
 
         container.innerHTML = this.sensors.map(sensor => `
-            <div class="sensor-card" data-sensor-id="${sensor.id}">
+            <div class="sensor-card" data-sensor-id="${this.escape(sensor.id)}">
                 <div class="sensor-header">
-                    <div class="sensor-name">${sensor.name}</div>
-                    <div class="sensor-type">${sensor.type}</div>
+                    <div class="sensor-name">${this.escape(sensor.name)}</div>
+                    <div class="sensor-type">${this.escape(sensor.type)}</div>
                 </div>
                 <div class="sensor-value">
-                    ${this.formatSensorValue(sensor.value, sensor.type)}
+                    ${this.escape(this.formatSensorValue(sensor.value, sensor.type))}
                     <span class="sensor-unit">${this.getSensorUnit(sensor.type)}</span>
                 </div>
                 <div class="sensor-timestamp">
-                    Last updated: ${this.formatTimestamp(sensor.last_updated)}
+                    ${this.t('last_updated', 'Last updated')}: ${this.formatTimestamp(sensor.last_updated)}
                 </div>
             </div>
         `).join('');
@@ -177,84 +508,86 @@ class HomeAutomationApp {
     }
 
     formatTimestamp(timestamp) {
-        if (!timestamp) return 'Unknown';
+        if (!timestamp) return this.t('unknown', 'Unknown');
         const date = new Date(timestamp);
-        return date.toLocaleString();
+        return date.toLocaleString(document.documentElement.lang);
     }
 
-    async toggleDevice(deviceId) {
-        const device = this.devices.find(d => d.id === deviceId);
-        if (!device) return;
+    // loadAutomations loads the home mode and the alert rules that can be switched on and off
+    async loadAutomations() {
+        const [mode, alerts] = await Promise.all([
+            this.api('/mode').catch(error => { console.error('Failed to load home mode:', error); return null; }),
+            this.api('/alerts').catch(error => { console.error('Failed to load alert rules:', error); return null; }),
+        ]);
+        if (mode === null && alerts === null) return;
+        this.show('automations');
 
-        const action = device.status === 'on' ? 'turn_off' : 'turn_on';
-        
-        try {
-            const response = await fetch(`${this.apiBaseUrl}/devices/${deviceId}/command`, {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({ action })
-            });
+        const modeCard = document.getElementById('mode-card');
+        if (modeCard && mode !== null) {
+            modeCard.hidden = false;
+            const current = mode.source === 'manual' ? mode.mode : 'auto';
+            document.getElementById('mode-container').innerHTML = HOME_MODES.map(name => `
+                <button class="btn ${name === current ? 'btn-primary' : 'btn-secondary'}" data-action="mode" data-id="${name}">
+                    ${this.t(`mode_${name}`, name)}
+                </button>
+            `).join('');
+        }
 
-            if (response.ok) {
-                // Update local state and re-render
-                device.status = device.status === 'on' ? 'off' : 'on';
-                this.renderDevices();
-            } else {
-                console.error('Failed to toggle device');
-            }
-        } catch (error) {
-            console.error('Error toggling device:', error);
+        const rulesCard = document.getElementById('rules-card');
+        if (rulesCard && alerts !== null) {
+            rulesCard.hidden = false;
+            const firing = new Set((alerts.active || []).map(alert => alert.rule_id));
+            document.getElementById('rules-container').innerHTML = (alerts.rules || []).map(rule => `
+                <label class="toggle-row">
+                    <input type="checkbox" data-action="rule" data-id="${this.escape(rule.id)}" ${rule.disabled ? '' : 'checked'}>
+                    <span>${this.escape(rule.name || rule.id)}</span>
+                    ${firing.has(rule.id) ? `<span class="status-indicator offline">${this.escape(rule.severity)}</span>` : ''}
+                </label>
+            `).join('');
         }
     }
 
-    async dimDevice(deviceId) {
-        try {
-            const response = await fetch(`${this.apiBaseUrl}/devices/${deviceId}/command`, {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({ 
-                    action: 'set_brightness',
-                    value: 50 
-                })
-            });
+    async setMode(mode) {
+        if (await this.post(`/mode/set?mode=${encodeURIComponent(mode)}`)) {
+            this.loadAutomations();
+        }
+    }
 
-            if (response.ok) {
-                console.log('Device dimmed successfully');
-            } else {
-                console.error('Failed to dim device');
-            }
-        } catch (error) {
-            console.error('Error dimming device:', error);
+    async enableRule(ruleId, enabled) {
+        await this.post(`/alerts/rules/enable?rule=${encodeURIComponent(ruleId)}&enabled=${enabled}`);
+        this.loadAutomations();
+    }
+
+    async switchMQTTDevice(deviceId) {
+        const device = this.mqttDevices.find(d => d.device_id === deviceId);
+        if (!device) return;
+
+        const action = device.on ? 'turn_off' : 'turn_on';
+        if (await this.post('/mqtt-devices/command', { device_id: deviceId, action })) {
+            device.on = !device.on;
+            this.renderDevices();
         }
     }
 
-    async adjustTemperature(deviceId, change) {
-        try {
-            const response = await fetch(`${this.apiBaseUrl}/devices/${deviceId}/command`, {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({ 
-                    action: 'set_temperature',
-                    value: change 
-                })
-            });
+    async toggleDevice(deviceId) {
+        const device = this.devices.find(d => d.id === deviceId);
+        if (!device) return;
 
-            if (response.ok) {
-                console.log('Temperature adjusted successfully');
-            } else {
-                console.error('Failed to adjust temperature');
-            }
-        } catch (error) {
-            console.error('Error adjusting temperature:', error);
+        const action = device.status === 'on' ? 'turn_off' : 'turn_on';
+        if (await this.post(`/devices/${encodeURIComponent(deviceId)}/command`, { action })) {
+            // Update local state and re-render
+            device.status = device.status === 'on' ? 'off' : 'on';
+            this.renderDevices();
         }
     }
 
+    async dimDevice(deviceId) {
+        await this.post(`/devices/${encodeURIComponent(deviceId)}/command`, {
+            action: 'set_brightness',
+            value: 50
+        });
+    }
+
     setupEventListeners() {
         // Navigation
         document.querySelectorAll('.nav-link').forEach(link => {
@@ -267,18 +600,59 @@ class HomeAutomationApp {
                 }
             });
         });
+
+        // Controls are rendered with the data, so their clicks are handled here
+        document.addEventListener('click', (e) => {
+            const control = e.target.closest('button[data-action]');
+            if (!control) return;
+            const id = control.dataset.id;
+            switch (control.dataset.action) {
+                case 'setpoint': this.adjustSetpoint(id, Number(control.dataset.change)); break;
+                case 'switch': this.switchMQTTDevice(id); break;
+                case 'toggle': this.toggleDevice(id); break;
+                case 'dim': this.dimDevice(id); break;
+                case 'mode': this.setMode(id); break;
+                case 'registry-save': this.saveRegistryDevice(id); break;
+            }
+        });
+        document.addEventListener('change', (e) => {
+            if (e.target.dataset.action === 'rule') {
+                this.enableRule(e.target.dataset.id, e.target.checked);
+            }
+        });
+
+        const tokenInput = document.getElementById('token-input');
+        const tokenSave = document.getElementById('token-save');
+        if (tokenInput && tokenSave) {
+            tokenInput.value = this.token;
+            tokenSave.addEventListener('click', () => {
+                this.token = tokenInput.value.trim();
+                if (this.token) {
+                    localStorage.setItem(TOKEN_KEY, this.token);
+                } else {
+                    localStorage.removeItem(TOKEN_KEY);
+                }
+                document.getElementById('notice').hidden = true;
+            });
+        }
     }
 
     startPolling() {
-        // Poll for updates every 30 seconds
+        // Room readings, thermostats and devices change often
         setInterval(() => {
             this.loadSystemStatus();
-            this.loadSensors(); // Sensors update more frequently
-        }, 30000);
+            this.loadRooms();
+            this.loadThermostats();
+            this.loadMQTTDevices();
+            this.loadSensors();
+        }, 15000);
 
-        // Poll devices less frequently (every 60 seconds)
+        // The rest less so (every 60 seconds)
         setInterval(() => {
             this.loadDevices();
+            this.loadRegistry();
+            this.loadEnergy();
+            this.loadAutomations();
         }, 60000);
     }
 }
@@ -0,0 +1,43 @@
+// Package web embeds the dashboard so the services serve it without a separate frontend.
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed templates/index.html static
+var assets embed.FS
+
+// Handler serves the dashboard page on / and its scripts and styles under /static/. Other paths
+// are not found, so it can sit at the root of a mux of API routes.
+func Handler() http.Handler {
+	static, _ := fs.Sub(assets, "static")
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "use GET to load the dashboard", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/" || r.URL.Path == "/index.html":
+			page, err := assets.ReadFile("templates/index.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(page)
+		case strings.HasPrefix(r.URL.Path, "/static/") && r.URL.Path != "/static/":
+			w.Header().Set("Cache-Control", "no-cache")
+			files.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServesDashboard(t *testing.T) {
+	handler := Handler()
+
+	for path, want := range map[string]string{
+		"/":                     "/static/js/app.js",
+		"/static/js/app.js":     "class HomeAutomationApp",
+		"/static/css/style.css": ".navbar",
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("GET %s: expected %q, got %d %.80q", path, want, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	for _, path := range []string{"/api/unknown", "/static/", "/templates/index.html"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected not found, got %d", path, recorder.Code)
+		}
+	}
+}